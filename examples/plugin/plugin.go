@@ -0,0 +1,102 @@
+// Package plugin is an example of a destination compiled into ecs-logs from
+// outside of its repository. It appends the content of the messages of each
+// stream to a file named after the stream, in a directory named after the
+// group.
+//
+// A custom build of ecs-logs enables it by adding a file to the main package
+// that imports it for its side effect of registering the destination:
+//
+//	package main
+//
+//	import _ "github.com/segmentio/ecs-logs/examples/plugin"
+//
+// then selects it with -dst example, configured with EXAMPLE_DIR.
+package plugin
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+func init() {
+	// The name is what -dst selects, uppercased it's also the prefix of the
+	// environment variables of the destination.
+	lib.RegisterDestination("example", lib.NewCheckedDestination(lib.DestinationFunc(NewWriter), checkConfig))
+}
+
+// NewWriter opens the file of a stream, it's called by ecs-logs the first time
+// it writes a batch to the stream.
+func NewWriter(group string, stream string) (lib.Writer, error) {
+	dir, err := getDir()
+
+	if err != nil {
+		return nil, err
+	}
+
+	dir = filepath.Join(dir, group)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, stream+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &writer{file: f, buffer: bufio.NewWriter(f)}, nil
+}
+
+// checkConfig reports a missing EXAMPLE_DIR when ecs-logs starts instead of
+// when the first stream is opened.
+func checkConfig() error {
+	_, err := getDir()
+	return err
+}
+
+func getDir() (string, error) {
+	dir := lib.Getenv("EXAMPLE_DIR")
+
+	if len(dir) == 0 {
+		return "", errors.New("missing EXAMPLE_DIR")
+	}
+
+	return dir, nil
+}
+
+// writer implements lib.Writer, the batches of a stream are never written
+// concurrently so it doesn't need to synchronize its methods.
+type writer struct {
+	file   *os.File
+	buffer *bufio.Writer
+}
+
+func (w *writer) Close() error {
+	err := w.buffer.Flush()
+
+	if e := w.file.Close(); err == nil {
+		err = e
+	}
+
+	return err
+}
+
+func (w *writer) WriteMessage(msg lib.Message) error {
+	return w.WriteMessageBatch(lib.MessageBatch{msg})
+}
+
+// WriteMessageBatch returns once the batch is in the file, an error causes
+// ecs-logs to log and drop the batch so a partially written batch is not
+// retried.
+func (w *writer) WriteMessageBatch(batch lib.MessageBatch) error {
+	for _, msg := range batch {
+		w.buffer.WriteString(msg.Event.Message)
+		w.buffer.WriteByte('\n')
+	}
+	return w.buffer.Flush()
+}
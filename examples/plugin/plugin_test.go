@@ -0,0 +1,63 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+func TestRegistered(t *testing.T) {
+	dst := lib.GetDestination("example")
+
+	if dst == nil {
+		t.Fatal("the example destination is not registered")
+	}
+
+	os.Unsetenv("EXAMPLE_DIR")
+
+	if err := dst.(lib.ConfigChecker).CheckConfig(); err == nil {
+		t.Error("no error reported when EXAMPLE_DIR is missing")
+	}
+}
+
+func TestWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ecs-logs-example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("EXAMPLE_DIR", dir)
+	defer os.Unsetenv("EXAMPLE_DIR")
+
+	for _, content := range []string{"Hello", "World"} {
+		w, err := NewWriter("group", "stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := w.WriteMessageBatch(lib.MessageBatch{
+			{Group: "group", Stream: "stream", Event: ecslogs.Event{Message: content + "!"}},
+			{Group: "group", Stream: "stream", Event: ecslogs.Event{Message: content + "?"}},
+		}); err != nil {
+			t.Error(err)
+		}
+
+		if err := w.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "group", "stream.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := string(b); s != "Hello!\nHello?\nWorld!\nWorld?\n" {
+		t.Errorf("invalid file content: %q", s)
+	}
+}
@@ -0,0 +1,266 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// An Acknowledger is a Rewinder that only commits its checkpoint once the
+// messages it read are durably accepted by all the destinations they were
+// routed to, so a crash between reading and writing them doesn't lose them.
+//
+// Each component holding a message retains it while it's handed to the next
+// ones and acknowledges it when it's done with it: the main loop, the streams
+// buffering it, each destination it was routed to and the buffers of the
+// paused destinations. The messages dropped on purpose, by the filters or the
+// stages, are acknowledged as well, the ones that failed to be written are
+// rewound and never acknowledged. The source redelivers the messages that
+// weren't acknowledged in time.
+//
+// Both methods are called from any goroutine, with the position of a message
+// that SetOrigin associated with the source.
+type Acknowledger interface {
+	Rewinder
+
+	// Retain adds a holder of the message at pos, which acknowledges it on
+	// its own.
+	Retain(pos Position)
+
+	// Acknowledge releases one holder of the message at pos.
+	Acknowledge(pos Position)
+}
+
+// RetainBatch adds a holder to each message of batch whose source acknowledges
+// them.
+func RetainBatch(batch MessageBatch) {
+	for _, msg := range batch {
+		if a, ok := msg.origin.(Acknowledger); ok {
+			a.Retain(msg.position)
+		}
+	}
+}
+
+// AcknowledgeBatch releases a holder of each message of batch whose source
+// acknowledges them.
+func AcknowledgeBatch(batch MessageBatch) {
+	for _, msg := range batch {
+		if a, ok := msg.origin.(Acknowledger); ok {
+			a.Acknowledge(msg.position)
+		}
+	}
+}
+
+// HandOff moves the hold on msg to the messages that were made of it, the
+// output of a stage for example, the ones that the stage held carry theirs
+// already. Acknowledging msg last means that it's committed if none of them
+// came from it.
+func HandOff(msg Message, msgs []Message) {
+	for i := range msgs {
+		if msgs[i].held {
+			msgs[i].held = false
+		} else {
+			RetainBatch(msgs[i : i+1])
+		}
+	}
+	AcknowledgeBatch(MessageBatch{msg})
+}
+
+// Hold adds a hold to msg for a stage that keeps it past the call to Process
+// that received it, like the pending lines of the multiline stage, so its
+// source doesn't commit it while it's only in memory. The copy of msg that the
+// stage returns later, from Process or Flush, carries the hold on.
+func Hold(msg *Message) {
+	RetainBatch(MessageBatch{*msg})
+	msg.held = true
+}
+
+// released moves the holds of the messages that a stage returned from Flush
+// to the caller.
+func released(msgs []Message) []Message {
+	for i := range msgs {
+		msgs[i].held = false
+	}
+	return msgs
+}
+
+// AckTracker tracks the messages that a source handed to ecs-logs until they
+// are acknowledged, which is what the sources implementing Acknowledger need
+// to know what they can commit and what they must redeliver.
+//
+// The positions must be read in the order of their Seq, which the source
+// increments for each message it reads, redelivered ones included. The
+// acknowledgements of the messages that were redelivered since are ignored.
+type AckTracker struct {
+	// How long a message may wait for its acknowledgement before it's
+	// redelivered with the ones read after it, zero waits indefinitely.
+	Timeout time.Duration
+
+	// How many times the same message is redelivered before it's given up,
+	// and considered acknowledged.
+	MaxRedeliveries int
+
+	source      string
+	redelivered *metrics.Counter
+	abandoned   *metrics.Counter
+
+	mutex     sync.Mutex
+	pending   []*pendingMessage
+	index     map[int64]*pendingMessage
+	committed Position
+	ok        bool
+
+	// The checkpoint of the message redelivered last and how many times it
+	// was.
+	redelivery string
+	attempts   int
+}
+
+type pendingMessage struct {
+	pos    Position
+	refs   int
+	readAt time.Time
+}
+
+// NewAckTracker returns a tracker of the messages of source, its redeliveries
+// are counted by the redelivered_messages and abandoned_messages metrics of
+// registry.
+func NewAckTracker(source string, timeout time.Duration, maxRedeliveries int, registry *metrics.Registry) *AckTracker {
+	return &AckTracker{
+		Timeout:         timeout,
+		MaxRedeliveries: maxRedeliveries,
+		source:          source,
+		redelivered:     registry.Counter("redelivered_messages", "source", source),
+		abandoned:       registry.Counter("abandoned_messages", "source", source),
+		index:           make(map[int64]*pendingMessage),
+	}
+}
+
+// SourceAckTracker returns the tracker of the messages of source configured by
+// the <SOURCE>_ACK_TIMEOUT (default 5m) and <SOURCE>_MAX_REDELIVERIES (default 3)
+// environment variables.
+func SourceAckTracker(source string) (t *AckTracker, err error) {
+	prefix := strings.ToUpper(source) + "_"
+	timeout, max := 5*time.Minute, 3
+
+	if s := strings.TrimSpace(Getenv(prefix + "ACK_TIMEOUT")); len(s) != 0 {
+		if timeout, err = time.ParseDuration(s); err != nil || timeout < 0 {
+			err = fmt.Errorf("invalid %sACK_TIMEOUT, must be a positive duration or zero: %s", prefix, s)
+			return
+		}
+	}
+
+	if s := strings.TrimSpace(Getenv(prefix + "MAX_REDELIVERIES")); len(s) != 0 {
+		if max, err = strconv.Atoi(s); err != nil || max < 0 {
+			err = fmt.Errorf("invalid %sMAX_REDELIVERIES, must be a positive integer or zero: %s", prefix, s)
+			return
+		}
+	}
+
+	t = NewAckTracker(source, timeout, max, metrics.Default)
+	return
+}
+
+// Read records that the message at pos was read at now, it's held once until
+// it's acknowledged.
+func (t *AckTracker) Read(pos Position, now time.Time) {
+	m := &pendingMessage{pos: pos, refs: 1, readAt: now}
+	t.mutex.Lock()
+	t.pending = append(t.pending, m)
+	t.index[pos.Seq] = m
+	t.mutex.Unlock()
+}
+
+func (t *AckTracker) Retain(pos Position) {
+	t.mutex.Lock()
+	if m := t.index[pos.Seq]; m != nil {
+		m.refs++
+	}
+	t.mutex.Unlock()
+}
+
+func (t *AckTracker) Acknowledge(pos Position) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if m := t.index[pos.Seq]; m != nil {
+		if m.refs--; m.refs == 0 {
+			delete(t.index, pos.Seq)
+			t.advance()
+		}
+	}
+}
+
+// advance commits the acknowledged messages at the front of the pending ones,
+// the others wait for the ones read before them.
+func (t *AckTracker) advance() {
+	for len(t.pending) != 0 && t.pending[0].refs == 0 {
+		t.committed, t.ok = t.pending[0].pos, true
+		t.pending[0] = nil
+		t.pending = t.pending[1:]
+	}
+}
+
+// Committed returns the position of the latest message that was acknowledged
+// with all the ones read before it, the source can checkpoint past it. The
+// boolean is false until there's one.
+func (t *AckTracker) Committed() (Position, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.committed, t.ok
+}
+
+// Pending returns the number of messages waiting for their acknowledgement.
+func (t *AckTracker) Pending() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.index)
+}
+
+// Expire returns the position of the earliest message that waited for its
+// acknowledgement for longer than the timeout at now, and true if the source
+// must read it again with all the messages that followed it. The messages are
+// forgotten, the source reads them again as new ones.
+//
+// A message that's still not acknowledged after the maximum number of
+// redeliveries is given up instead, the ones read after it expire on their
+// own.
+func (t *AckTracker) Expire(now time.Time) (pos Position, ok bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.Timeout == 0 || len(t.pending) == 0 || now.Sub(t.pending[0].readAt) < t.Timeout {
+		return
+	}
+
+	m := t.pending[0]
+
+	if m.pos.Checkpoint == t.redelivery {
+		t.attempts++
+	} else {
+		t.redelivery, t.attempts = m.pos.Checkpoint, 1
+	}
+
+	if t.attempts > t.MaxRedeliveries {
+		log.WithFields(log.Fields{
+			"source":     t.source,
+			"checkpoint": m.pos.Checkpoint,
+			"attempts":   t.attempts - 1,
+		}).Error("giving up on a message that was never acknowledged")
+
+		t.abandoned.Add(1)
+		delete(t.index, m.pos.Seq)
+		m.refs = 0
+		t.advance()
+		return
+	}
+
+	t.redelivered.Add(int64(len(t.index)))
+	t.pending, t.index = nil, make(map[int64]*pendingMessage)
+	return m.pos, true
+}
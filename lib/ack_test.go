@@ -0,0 +1,168 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+type acknowledger struct {
+	rewinder
+	*AckTracker
+}
+
+func newAcknowledger(timeout time.Duration, max int) *acknowledger {
+	return &acknowledger{AckTracker: NewAckTracker("test", timeout, max, metrics.NewRegistry())}
+}
+
+func (a *acknowledger) read(seq int64, checkpoint string, now time.Time) (msg Message) {
+	pos := Position{Seq: seq, Checkpoint: checkpoint}
+	a.Read(pos, now)
+	SetOrigin(&msg, a, pos)
+	return
+}
+
+func TestAckTrackerCommit(t *testing.T) {
+	a := newAcknowledger(0, 0)
+	now := time.Unix(0, 0)
+	m0, m1, m2 := a.read(0, "a", now), a.read(1, "b", now), a.read(2, "c", now)
+
+	if _, ok := a.Committed(); ok {
+		t.Error("nothing should be committed before the first acknowledgement")
+	}
+
+	// The second message is split by a stage and routed to two destinations,
+	// the third one is dropped by the stages.
+	HandOff(m1, []Message{m1, m1})
+	RetainBatch(MessageBatch{m1})
+	AcknowledgeBatch(MessageBatch{m1})
+	HandOff(m2, nil)
+
+	if _, ok := a.Committed(); ok || a.Pending() != 2 {
+		t.Errorf("the acknowledged messages must wait for the ones read before them: %d", a.Pending())
+	}
+
+	AcknowledgeBatch(MessageBatch{m0, m1})
+
+	if pos, _ := a.Committed(); pos.Seq != 0 || a.Pending() != 1 {
+		t.Errorf("the commit should stop at the message still held: %+v %d", pos, a.Pending())
+	}
+
+	AcknowledgeBatch(MessageBatch{m1})
+
+	if pos, _ := a.Committed(); pos.Seq != 2 || a.Pending() != 0 {
+		t.Errorf("all the messages should be committed: %+v %d", pos, a.Pending())
+	}
+
+	// Acknowledging a message that isn't held anymore has no effect.
+	AcknowledgeBatch(MessageBatch{m1, {}})
+}
+
+// holder is a processor holding the messages until they're flushed.
+type holder struct {
+	msgs []Message
+}
+
+func (h *holder) Process(msg Message, now time.Time) []Message {
+	Hold(&msg)
+	h.msgs = append(h.msgs, msg)
+	return nil
+}
+
+func (h *holder) Flush(now time.Time) (msgs []Message) {
+	msgs, h.msgs = h.msgs, nil
+	return
+}
+
+func TestAckTrackerHeld(t *testing.T) {
+	a := newAcknowledger(0, 0)
+	now := time.Unix(0, 0)
+	m0 := a.read(0, "a", now)
+
+	// The message held by the first stage goes through the second one when
+	// it's flushed.
+	p := Pipeline{&holder{}, ProcessorFunc(func(msg Message, now time.Time) []Message {
+		return []Message{msg}
+	})}
+
+	if msgs := p.Process(m0, now); len(msgs) != 0 {
+		t.Fatalf("the message should be held: %+v", msgs)
+	}
+
+	if _, ok := a.Committed(); ok || a.Pending() != 1 {
+		t.Errorf("the held message should not be committed: %d", a.Pending())
+	}
+
+	msgs := p.Flush(now)
+
+	if _, ok := a.Committed(); len(msgs) != 1 || ok || a.Pending() != 1 {
+		t.Errorf("the flushed message should carry the hold: %+v %d", msgs, a.Pending())
+	}
+
+	AcknowledgeBatch(msgs)
+
+	if pos, ok := a.Committed(); !ok || pos.Seq != 0 || a.Pending() != 0 {
+		t.Errorf("the message should be committed once delivered: %+v %d", pos, a.Pending())
+	}
+}
+
+func TestAckTrackerRedelivery(t *testing.T) {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	a := newAcknowledger(time.Minute, 1)
+	epoch := time.Unix(0, 0)
+	m0, m1 := a.read(0, "a", epoch), a.read(1, "b", epoch.Add(time.Second))
+
+	AcknowledgeBatch(MessageBatch{m0})
+
+	if _, ok := a.Expire(epoch.Add(time.Minute)); ok {
+		t.Error("the pending message didn't wait for the timeout yet")
+	}
+
+	pos, ok := a.Expire(epoch.Add(2 * time.Minute))
+
+	if !ok || pos.Seq != 1 || a.Pending() != 0 {
+		t.Fatalf("the expired message should be redelivered: %+v %t %d", pos, ok, a.Pending())
+	}
+
+	// The acknowledgement of the first delivery is ignored, the source read
+	// the message again with a new sequence number.
+	a.read(2, "b", epoch.Add(2*time.Minute))
+	AcknowledgeBatch(MessageBatch{m1})
+
+	if a.Pending() != 1 {
+		t.Error("the late acknowledgement should not release the redelivered message")
+	}
+
+	// The message is given up after the maximum number of redeliveries.
+	if _, ok := a.Expire(epoch.Add(4 * time.Minute)); ok {
+		t.Error("the message should not be redelivered again")
+	}
+
+	if pos, _ := a.Committed(); pos.Seq != 2 || a.Pending() != 0 || a.abandoned.Value() != 1 {
+		t.Errorf("the message should be given up: %+v %d", pos, a.Pending())
+	}
+}
+
+func TestSourceAckTracker(t *testing.T) {
+	defer SetConfigEnv(nil)
+
+	SetConfigEnv(map[string]string{"TESTSRC_ACK_TIMEOUT": "30s", "TESTSRC_MAX_REDELIVERIES": "0"})
+
+	if a, err := SourceAckTracker("testsrc"); err != nil || a.Timeout != 30*time.Second || a.MaxRedeliveries != 0 {
+		t.Errorf("invalid tracker: %+v (%v)", a, err)
+	}
+
+	for _, env := range []map[string]string{
+		{"TESTSRC_ACK_TIMEOUT": "-1s"},
+		{"TESTSRC_MAX_REDELIVERIES": "many"},
+	} {
+		SetConfigEnv(env)
+
+		if _, err := SourceAckTracker("testsrc"); err == nil {
+			t.Errorf("%v: the configuration should be rejected", env)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// AtomicTarget is one of the destinations that an AtomicDelivery writes to.
+type AtomicTarget struct {
+	Name        string
+	Destination Destination
+}
+
+// AtomicDelivery writes each batch to a set of destinations as a unit, for the
+// destinations that must stay consistent with each other, like an index and
+// its archive. A batch is only committed once all the destinations accepted it
+// in the same attempt, when one of them fails it the batch is written again to
+// all of them.
+//
+// The destinations have no way to take back a batch, so the ones that accepted
+// it in a failed attempt receive it again in the next one. They should drop
+// the duplicates, for example with the message IDs of -message-ids.
+type AtomicDelivery struct {
+	// The number of times a batch is written to all the destinations before
+	// being aborted.
+	Attempts int
+
+	// The delay before the first retry, it doubles with each retry.
+	Backoff time.Duration
+
+	committed *metrics.Counter
+	aborted   *metrics.Counter
+	clock     clock.Clock
+}
+
+// NewAtomicDelivery returns an AtomicDelivery which counts its batches in the
+// atomic_batches metric of registry.
+func NewAtomicDelivery(attempts int, backoff time.Duration, registry *metrics.Registry, clock clock.Clock) *AtomicDelivery {
+	if attempts < 1 {
+		attempts = 1
+	}
+	return &AtomicDelivery{
+		Attempts:  attempts,
+		Backoff:   backoff,
+		committed: registry.Counter("atomic_batches", "result", "committed"),
+		aborted:   registry.Counter("atomic_batches", "result", "aborted"),
+		clock:     clock,
+	}
+}
+
+// AtomicError is returned when a batch was aborted, it has the errors of the
+// destinations which failed it in the last attempt.
+type AtomicError struct {
+	Attempts int
+	Errors   map[string]error
+}
+
+func (e *AtomicError) Error() string {
+	names := make([]string, 0, len(e.Errors))
+
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for i, name := range names {
+		names[i] = name + ": " + e.Errors[name].Error()
+	}
+
+	return fmt.Sprintf("the batch failed to be written to all the destinations after %d attempts (%s)", e.Attempts, strings.Join(names, ", "))
+}
+
+// Write writes batch to the stream of all the targets, concurrently, until
+// they all accept it in the same attempt. It returns nil once the batch was
+// committed, or an *AtomicError if it was aborted after all the attempts.
+func (a *AtomicDelivery) Write(targets []AtomicTarget, group string, stream string, batch MessageBatch, urgent bool) error {
+	backoff := a.Backoff
+	errs := make([]error, len(targets))
+
+	for attempt := 1; true; attempt++ {
+		var wg sync.WaitGroup
+
+		for i, t := range targets {
+			wg.Add(1)
+			go func(i int, dest Destination) {
+				defer wg.Done()
+				errs[i] = writeBatch(dest, group, stream, batch, urgent)
+			}(i, t.Destination)
+		}
+
+		wg.Wait()
+		failed := make(map[string]error)
+
+		for i, err := range errs {
+			if err != nil {
+				failed[targets[i].Name] = err
+			}
+		}
+
+		if len(failed) == 0 {
+			a.committed.Add(1)
+			return nil
+		}
+
+		if attempt >= a.Attempts {
+			a.aborted.Add(1)
+			return &AtomicError{Attempts: attempt, Errors: failed}
+		}
+
+		a.clock.Sleep(context.Background(), backoff)
+		backoff *= 2
+	}
+
+	return nil
+}
+
+func writeBatch(dest Destination, group string, stream string, batch MessageBatch, urgent bool) (err error) {
+	var w Writer
+
+	if w, err = dest.Open(group, stream); err != nil {
+		return
+	}
+	defer w.Close()
+
+	if urgent {
+		_, err = WriteUrgentMessageBatch(w, batch)
+	} else {
+		err = w.WriteMessageBatch(batch)
+	}
+
+	return
+}
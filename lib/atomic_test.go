@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// atomicTestDestination fails the first writes, then records the batches it
+// accepts.
+type atomicTestDestination struct {
+	mutex    sync.Mutex
+	failures int
+	writes   int
+	batches  []MessageBatch
+}
+
+func (d *atomicTestDestination) Open(group string, stream string) (Writer, error) {
+	return atomicTestWriter{d}, nil
+}
+
+func (d *atomicTestDestination) Close(group string, stream string) {}
+
+type atomicTestWriter struct {
+	dest *atomicTestDestination
+}
+
+func (w atomicTestWriter) Close() error { return nil }
+
+func (w atomicTestWriter) WriteMessage(msg Message) error {
+	return w.WriteMessageBatch(MessageBatch{msg})
+}
+
+func (w atomicTestWriter) WriteMessageBatch(batch MessageBatch) error {
+	d := w.dest
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.writes++; d.writes <= d.failures {
+		return errors.New("ServiceUnavailable")
+	}
+
+	d.batches = append(d.batches, batch)
+	return nil
+}
+
+func newAtomicTest(attempts int, failures ...int) (*AtomicDelivery, []AtomicTarget, []*atomicTestDestination, *metrics.Registry, *clock.Fake) {
+	registry := metrics.NewRegistry()
+	clock := clock.NewFake(time.Unix(0, 0))
+	a := NewAtomicDelivery(attempts, time.Second, registry, clock)
+
+	var targets []AtomicTarget
+	var dests []*atomicTestDestination
+
+	for i, n := range failures {
+		d := &atomicTestDestination{failures: n}
+		dests = append(dests, d)
+		targets = append(targets, AtomicTarget{Name: string('a' + rune(i)), Destination: d})
+	}
+
+	return a, targets, dests, registry, clock
+}
+
+func TestAtomicDeliveryRetriesAll(t *testing.T) {
+	// The index fails the first write, the archive accepts all of them.
+	a, targets, dests, registry, clock := newAtomicTest(3, 1, 0)
+	batch := MessageBatch{{Group: "A", Stream: "B", Event: ecslogs.Event{Message: "hello"}}}
+
+	if err := a.Write(targets, "A", "B", batch, false); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, d := range dests {
+		if d.writes != 2 {
+			t.Errorf("destination %d: the batch should be written to every destination on each attempt, got %d writes", i, d.writes)
+		}
+	}
+
+	if len(dests[0].batches) != 1 || len(dests[1].batches) != 2 {
+		t.Errorf("invalid batches accepted: %d and %d", len(dests[0].batches), len(dests[1].batches))
+	}
+
+	if clock.Slept() != time.Second {
+		t.Error("the retry should wait for the backoff:", clock.Slept())
+	}
+
+	if n := registry.Counter("atomic_batches", "result", "committed").Value(); n != 1 {
+		t.Error("the batch should be committed once all the destinations accepted it:", n)
+	}
+}
+
+func TestAtomicDeliveryPartialSuccess(t *testing.T) {
+	a, targets, dests, registry, clock := newAtomicTest(3, 5, 0)
+	batch := MessageBatch{{Group: "A", Stream: "B", Event: ecslogs.Event{Message: "hello"}}}
+
+	err := a.Write(targets, "A", "B", batch, false)
+	e, ok := err.(*AtomicError)
+
+	if !ok {
+		t.Fatalf("the batch should be aborted: %v", err)
+	}
+
+	if e.Attempts != 3 || len(e.Errors) != 1 || e.Errors["a"] == nil {
+		t.Errorf("the error should report the failed destination: %+v", e)
+	}
+
+	if dests[1].writes != 3 {
+		t.Errorf("the batch should be written to all the destinations on each attempt, got %d writes", dests[1].writes)
+	}
+
+	if n := registry.Counter("atomic_batches", "result", "committed").Value(); n != 0 {
+		t.Error("a partial success should not be committed:", n)
+	}
+
+	if n := registry.Counter("atomic_batches", "result", "aborted").Value(); n != 1 {
+		t.Error("the batch should be counted as aborted:", n)
+	}
+
+	if clock.Slept() != 3*time.Second {
+		t.Error("the backoff should double between the attempts:", clock.Slept())
+	}
+}
@@ -0,0 +1,315 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// AuditChain controls how the entries of an audit log are linked together.
+type AuditChain int
+
+const (
+	// SHA256AuditChain sets a SHA-256 hash of each entry and of the previous
+	// one on the entries, so an entry that was modified, removed or inserted
+	// breaks the chain.
+	SHA256AuditChain AuditChain = iota
+
+	// NoAuditChain writes the entries without hashes.
+	NoAuditChain
+)
+
+func ParseAuditChain(s string) (c AuditChain, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "sha256":
+		c = SHA256AuditChain
+	case "none":
+		c = NoAuditChain
+	default:
+		err = fmt.Errorf("invalid audit chain, must be one of sha256 or none: %s", s)
+	}
+	return
+}
+
+func (c AuditChain) String() string {
+	switch c {
+	case NoAuditChain:
+		return "none"
+	default:
+		return "sha256"
+	}
+}
+
+// AuditEntry is the record of a batch delivered to a destination.
+type AuditEntry struct {
+	Seq         int64     `json:"seq"`
+	Time        time.Time `json:"time"`
+	Destination string    `json:"destination"`
+	Group       string    `json:"group"`
+	Stream      string    `json:"stream"`
+
+	// The batch ID is a SHA-256 hash of the messages as they were written,
+	// it ties the entry to the content that was delivered. The message IDs
+	// are only known when ecs-logs assigns them (see -message-ids).
+	BatchID    string   `json:"batch_id"`
+	Count      int      `json:"count"`
+	MessageIDs []string `json:"message_ids,omitempty"`
+
+	// What the destination returned for the batch, like the next sequence
+	// token of the CloudWatch Logs stream.
+	Receipt string `json:"receipt,omitempty"`
+
+	Prev string `json:"prev,omitempty"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// hash returns the hash of the entry, computed over its JSON representation
+// without the hash itself. Prev is part of it, which is what links an entry to
+// the previous one.
+func (e AuditEntry) hash() string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// ReceiptWriter is implemented by the writers that can report what the
+// destination returned for the last batch they wrote, which is recorded in
+// the audit log.
+type ReceiptWriter interface {
+	Receipt() string
+}
+
+// AuditLog records an entry for each batch delivered to the destinations, as
+// lines of JSON. It's distinct from the logs that ecs-logs forwards so the
+// trail of what was shipped where can be kept apart, and verified with
+// VerifyAuditLog.
+type AuditLog struct {
+	mutex sync.Mutex
+	w     io.Writer
+	chain AuditChain
+	seq   int64
+	prev  string
+	now   func() time.Time
+}
+
+// NewAuditLog returns an audit log writing its entries to w, the chain starts
+// from the entry with the given sequence number and hash, or from scratch when
+// they're zero.
+func NewAuditLog(w io.Writer, chain AuditChain, seq int64, prev string) *AuditLog {
+	return &AuditLog{
+		w:     w,
+		chain: chain,
+		seq:   seq,
+		prev:  prev,
+		now:   time.Now,
+	}
+}
+
+// OpenAuditLog opens the audit log at path, the entries are appended to the
+// file and the chain continues from its last entry.
+func OpenAuditLog(path string, chain AuditChain) (a *AuditLog, err error) {
+	var f *os.File
+	var last AuditEntry
+
+	if f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+		return
+	}
+
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 64*1024*1024)
+
+	for s.Scan() {
+		if line := bytes.TrimSpace(s.Bytes()); len(line) != 0 {
+			if err = json.Unmarshal(line, &last); err != nil {
+				f.Close()
+				err = fmt.Errorf("invalid audit log %s: %s", path, err)
+				return
+			}
+		}
+	}
+
+	if err = s.Err(); err != nil {
+		f.Close()
+		return
+	}
+
+	a = NewAuditLog(f, chain, last.Seq, last.Hash)
+	return
+}
+
+// Record appends the entry of batch, which was delivered to the given group
+// and stream of destination.
+func (a *AuditLog) Record(destination string, group string, stream string, batch MessageBatch, receipt string) (err error) {
+	e := AuditEntry{
+		Destination: destination,
+		Group:       group,
+		Stream:      stream,
+		BatchID:     batchID(batch),
+		Count:       len(batch),
+		Receipt:     receipt,
+	}
+
+	for _, msg := range batch {
+		if id := MessageID(msg); len(id) != 0 {
+			e.MessageIDs = append(e.MessageIDs, id)
+		}
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	e.Seq = a.seq + 1
+	e.Time = a.now().UTC()
+
+	if a.chain == SHA256AuditChain {
+		e.Prev = a.prev
+		e.Hash = e.hash()
+	}
+
+	b, _ := json.Marshal(e)
+
+	if _, err = a.w.Write(append(b, '\n')); err != nil {
+		return
+	}
+
+	a.seq, a.prev = e.Seq, e.Hash
+	return
+}
+
+func batchID(batch MessageBatch) string {
+	h := sha256.New()
+
+	for _, msg := range batch {
+		h.Write(msg.Bytes())
+		h.Write([]byte{'\n'})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// VerifyAuditLog reads the entries of an audit log from r and checks that
+// they form an unbroken chain, it returns the number of entries read.
+func VerifyAuditLog(r io.Reader) (count int, err error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 64*1024*1024)
+	prev := AuditEntry{}
+
+	for s.Scan() {
+		var e AuditEntry
+		line := bytes.TrimSpace(s.Bytes())
+
+		if len(line) == 0 {
+			continue
+		}
+
+		if err = json.Unmarshal(line, &e); err != nil {
+			err = fmt.Errorf("entry %d: %s", count+1, err)
+			return
+		}
+
+		switch {
+		case count != 0 && e.Seq != prev.Seq+1:
+			err = fmt.Errorf("entry %d: the sequence number %d doesn't follow %d", count+1, e.Seq, prev.Seq)
+		case count != 0 && e.Prev != prev.Hash:
+			err = fmt.Errorf("entry %d: the entry isn't linked to the previous one", count+1)
+		case len(e.Hash) == 0:
+			err = fmt.Errorf("entry %d: the entry has no hash", count+1)
+		case e.Hash != e.hash():
+			err = fmt.Errorf("entry %d: the hash doesn't match the content of the entry", count+1)
+		}
+
+		if err != nil {
+			return
+		}
+
+		prev = e
+		count++
+	}
+
+	err = s.Err()
+	return
+}
+
+// NewAuditDestination wraps dest so the batches it delivered are recorded in
+// audit, dest is returned unchanged when audit is nil. It must be the
+// innermost wrapper, the batches are recorded as they're written and only
+// once the destination accepted them.
+func NewAuditDestination(name string, dest Destination, audit *AuditLog) Destination {
+	if audit == nil {
+		return dest
+	}
+	return auditDestination{Destination: dest, name: name, audit: audit}
+}
+
+type auditDestination struct {
+	Destination
+	name  string
+	audit *AuditLog
+}
+
+func (d auditDestination) Open(group string, stream string) (w Writer, err error) {
+	if w, err = d.Destination.Open(group, stream); err == nil {
+		w = auditWriter{Writer: w, dest: d, group: group, stream: stream}
+	}
+	return
+}
+
+type auditWriter struct {
+	Writer
+	dest   auditDestination
+	group  string
+	stream string
+}
+
+func (w auditWriter) WriteMessage(msg Message) error {
+	return w.WriteMessageBatch(MessageBatch{msg})
+}
+
+func (w auditWriter) WriteMessageBatch(batch MessageBatch) (err error) {
+	_, err = w.WriteMessageBatchSize(batch)
+	return
+}
+
+func (w auditWriter) WriteMessageBatchSize(batch MessageBatch) (int, error) {
+	return w.write(batch, WriteMessageBatchSize)
+}
+
+func (w auditWriter) WriteUrgentMessageBatch(batch MessageBatch) (int, error) {
+	return w.write(batch, WriteUrgentMessageBatch)
+}
+
+func (w auditWriter) write(batch MessageBatch, write func(Writer, MessageBatch) (int, error)) (size int, err error) {
+	if size, err = write(w.Writer, batch); err != nil || len(batch) == 0 {
+		return
+	}
+
+	var receipt string
+
+	if rw, ok := w.Writer.(ReceiptWriter); ok {
+		receipt = rw.Receipt()
+	}
+
+	// The batch was delivered, failing the write would have it logged as
+	// dropped, or retried and delivered twice.
+	if e := w.dest.audit.Record(w.dest.name, w.group, w.stream, batch, receipt); e != nil {
+		log.WithFields(log.Fields{
+			"destination": w.dest.name,
+			"group":       w.group,
+			"stream":      w.stream,
+			"error":       e,
+		}).Error("failed to record a delivered batch in the audit log")
+	}
+
+	return
+}
@@ -0,0 +1,173 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+// receiptTestWriter accepts the batches of a stream, except the ones starting
+// with a "reject" message, and reports a new receipt after each of them.
+type receiptTestWriter struct {
+	batches *int
+}
+
+func (w receiptTestWriter) Close() error { return nil }
+
+func (w receiptTestWriter) WriteMessage(msg Message) error {
+	return w.WriteMessageBatch(MessageBatch{msg})
+}
+
+func (w receiptTestWriter) WriteMessageBatch(batch MessageBatch) error {
+	if batch[0].Event.Message == "reject" {
+		return errors.New("400 Bad Request")
+	}
+	*w.batches++
+	return nil
+}
+
+func (w receiptTestWriter) Receipt() string {
+	return "token-" + strings.Repeat("x", *w.batches)
+}
+
+func makeAuditBatch(ids ...string) (batch MessageBatch) {
+	for _, id := range ids {
+		batch = append(batch, Message{Event: ecslogs.Event{
+			Message: id,
+			Data:    ecslogs.EventData{MessageIDField: id},
+		}})
+	}
+	return
+}
+
+func TestAuditDestination(t *testing.T) {
+	var buf bytes.Buffer
+	var batches int
+
+	audit := NewAuditLog(&buf, SHA256AuditChain, 0, "")
+	audit.now = func() time.Time { return time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC) }
+
+	dest := NewAuditDestination("testdest", DestinationFunc(func(group string, stream string) (Writer, error) {
+		return receiptTestWriter{batches: &batches}, nil
+	}), audit)
+
+	w, _ := dest.Open("A", "B")
+
+	if err := w.WriteMessageBatch(makeAuditBatch("1", "2")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteMessageBatch(makeAuditBatch("reject")); err == nil {
+		t.Fatal("the error of the destination should be returned")
+	}
+
+	if _, err := WriteUrgentMessageBatch(w, makeAuditBatch("3")); err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []AuditEntry
+
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e AuditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("each delivered batch should be recorded, and only those: %d entries", len(entries))
+	}
+
+	if e := entries[0]; e.Seq != 1 || e.Destination != "testdest" || e.Group != "A" || e.Stream != "B" ||
+		e.Count != 2 || strings.Join(e.MessageIDs, ",") != "1,2" || e.Receipt != "token-x" || len(e.Prev) != 0 {
+		t.Errorf("invalid first entry: %+v", e)
+	}
+
+	if e := entries[1]; e.Seq != 2 || e.Prev != entries[0].Hash || e.Receipt != "token-xx" {
+		t.Errorf("the second entry should be linked to the first one: %+v", e)
+	}
+
+	if entries[0].BatchID == entries[1].BatchID || len(entries[0].BatchID) != 64 {
+		t.Errorf("the batches should have distinct IDs: %s %s", entries[0].BatchID, entries[1].BatchID)
+	}
+
+	if n, err := VerifyAuditLog(&buf); err != nil || n != 2 {
+		t.Errorf("the audit log should verify: %d entries (%v)", n, err)
+	}
+}
+
+func TestVerifyAuditLogTampering(t *testing.T) {
+	var buf bytes.Buffer
+	audit := NewAuditLog(&buf, SHA256AuditChain, 0, "")
+
+	for _, id := range []string{"1", "2", "3"} {
+		audit.Record("testdest", "A", "B", makeAuditBatch(id), "")
+	}
+
+	lines := strings.SplitAfter(buf.String(), "\n")
+
+	for name, log := range map[string]string{
+		"modified": lines[0] + strings.Replace(lines[1], `"count":1`, `"count":2`, 1) + lines[2],
+		"removed":  lines[0] + lines[2],
+		"swapped":  lines[0] + lines[2] + lines[1],
+	} {
+		if _, err := VerifyAuditLog(strings.NewReader(log)); err == nil {
+			t.Errorf("%s: the broken chain should be detected", name)
+		}
+	}
+
+	var unchained bytes.Buffer
+	NewAuditLog(&unchained, NoAuditChain, 0, "").Record("testdest", "A", "B", makeAuditBatch("1"), "")
+
+	if strings.Contains(unchained.String(), `"hash"`) {
+		t.Errorf("the entries should have no hash when the chain is disabled: %s", unchained.String())
+	}
+}
+
+func TestOpenAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+
+	// The chain continues across restarts of ecs-logs.
+	for i := 0; i != 2; i++ {
+		audit, err := OpenAuditLog(path, SHA256AuditChain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		audit.Record("testdest", "A", "B", makeAuditBatch("1"), "")
+		audit.w.(*os.File).Close()
+	}
+
+	f, _ := os.Open(path)
+	defer f.Close()
+
+	if n, err := VerifyAuditLog(f); err != nil || n != 2 {
+		t.Errorf("the audit log should verify after a restart: %d entries (%v)", n, err)
+	}
+}
+
+func TestParseAuditChain(t *testing.T) {
+	for s, c := range map[string]AuditChain{"": SHA256AuditChain, "sha256": SHA256AuditChain, "none": NoAuditChain} {
+		if x, err := ParseAuditChain(s); err != nil || x != c {
+			t.Errorf("%q: invalid audit chain: %s (%v)", s, x, err)
+		}
+	}
+
+	if _, err := ParseAuditChain("md5"); err == nil {
+		t.Error("an unknown chain should be rejected")
+	}
+}
@@ -0,0 +1,143 @@
+package blank
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+const (
+	// Blank messages are forwarded like any other message.
+	Keep = "keep"
+
+	// Blank messages are dropped.
+	Drop = "drop"
+
+	// The first blank message of a run is replaced with a marker and the
+	// following ones are dropped, until a non-blank message shows up on the
+	// same stream.
+	CollapseConsecutive = "collapse-consecutive"
+)
+
+type config struct {
+	policy string
+	marker string
+	trim   bool
+}
+
+func getConfig() (c config, err error) {
+	c = config{
+		policy: Keep,
+		marker: "[blank]",
+	}
+	var s string
+
+	if s = strings.TrimSpace(lib.Getenv("BLANK_POLICY")); len(s) != 0 {
+		switch c.policy = s; c.policy {
+		case Keep, Drop, CollapseConsecutive:
+		default:
+			err = fmt.Errorf("invalid BLANK_POLICY, must be one of %s, %s or %s: %s", Keep, Drop, CollapseConsecutive, s)
+			return
+		}
+	}
+
+	if s = lib.Getenv("BLANK_MARKER"); len(s) != 0 {
+		c.marker = s
+	}
+
+	if s = lib.Getenv("BLANK_TRIM"); len(s) != 0 {
+		if c.trim, err = strconv.ParseBool(s); err != nil {
+			err = fmt.Errorf("invalid BLANK_TRIM: %s", s)
+			return
+		}
+	}
+
+	return
+}
+
+func NewProcessor() (p lib.Processor, err error) {
+	var c config
+
+	if c, err = getConfig(); err == nil {
+		p = newProcessor(c)
+	}
+
+	return
+}
+
+func checkConfig() (err error) {
+	_, err = getConfig()
+	return
+}
+
+type processor struct {
+	config
+	// The streams currently in a run of blank messages.
+	runs map[string]bool
+}
+
+func newProcessor(c config) *processor {
+	return &processor{
+		config: c,
+		runs:   make(map[string]bool),
+	}
+}
+
+func (p *processor) Process(msg lib.Message, now time.Time) []lib.Message {
+	if p.trim {
+		msg.Event.Message = trimLines(msg.Event.Message)
+	}
+
+	if !isBlank(msg) {
+		if p.policy == CollapseConsecutive {
+			delete(p.runs, key(msg))
+		}
+		return []lib.Message{msg}
+	}
+
+	switch p.policy {
+	case Drop:
+		return nil
+
+	case CollapseConsecutive:
+		k := key(msg)
+
+		if p.runs[k] {
+			return nil
+		}
+
+		p.runs[k] = true
+		msg.Event.Message = p.marker
+	}
+
+	return []lib.Message{msg}
+}
+
+func (p *processor) Flush(now time.Time) []lib.Message {
+	return nil
+}
+
+// isBlank returns true if msg only carries an empty or whitespace-only message,
+// structured events that have data attached are never considered blank.
+func isBlank(msg lib.Message) bool {
+	return len(msg.Event.Data) == 0 && len(strings.TrimSpace(msg.Event.Message)) == 0
+}
+
+// trimLines strips the trailing whitespaces and carriage returns of each line
+// in s.
+func trimLines(s string) string {
+	lines := strings.Split(s, "\n")
+
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func key(msg lib.Message) string {
+	return msg.Group + "\x00" + msg.Stream
+}
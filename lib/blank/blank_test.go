@@ -0,0 +1,95 @@
+package blank
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+func TestProcessorPolicies(t *testing.T) {
+	input := []lib.Message{
+		makeMessage("A", "hello"),
+		makeMessage("A", ""),
+		makeMessage("A", "  \t"),
+		makeMessage("B", "\r\n"),
+		makeMessage("A", ""),
+		makeMessage("A", "world"),
+		makeMessage("A", ""),
+	}
+
+	tests := []struct {
+		policy string
+		output []string
+	}{
+		{
+			policy: Keep,
+			output: []string{"A:hello", "A:", "A:  \t", "B:\r\n", "A:", "A:world", "A:"},
+		},
+		{
+			policy: Drop,
+			output: []string{"A:hello", "A:world"},
+		},
+		{
+			// Runs are tracked per stream, the blank message on B doesn't
+			// interrupt the run on A.
+			policy: CollapseConsecutive,
+			output: []string{"A:hello", "A:-", "B:-", "A:world", "A:-"},
+		},
+	}
+
+	for _, test := range tests {
+		p := newProcessor(config{policy: test.policy, marker: "-"})
+
+		if output := process(p, input); !reflect.DeepEqual(output, test.output) {
+			t.Errorf("%s: invalid output:\n- expected: %#v\n- found:    %#v", test.policy, test.output, output)
+		}
+	}
+}
+
+func TestProcessorStructuredEvents(t *testing.T) {
+	p := newProcessor(config{policy: Drop})
+
+	msg := makeMessage("A", "")
+	msg.Event.Data = ecslogs.EventData{"status": 200}
+
+	if msgs := p.Process(msg, time.Now()); len(msgs) != 1 {
+		t.Error("events with data should never be considered blank")
+	}
+}
+
+func TestProcessorTrim(t *testing.T) {
+	p := newProcessor(config{policy: CollapseConsecutive, marker: "-", trim: true})
+
+	input := []lib.Message{
+		makeMessage("A", "hello  \r"),
+		makeMessage("A", "first \t\r\nsecond\r\n"),
+		makeMessage("A", " \r"),
+		makeMessage("A", "\r"),
+	}
+
+	ref := []string{"A:hello", "A:first\nsecond\n", "A:-"}
+
+	if output := process(p, input); !reflect.DeepEqual(output, ref) {
+		t.Errorf("invalid output:\n- expected: %#v\n- found:    %#v", ref, output)
+	}
+}
+
+func process(p lib.Processor, input []lib.Message) (output []string) {
+	for _, msg := range input {
+		for _, m := range p.Process(msg, time.Now()) {
+			output = append(output, m.Stream+":"+m.Event.Message)
+		}
+	}
+	return
+}
+
+func makeMessage(stream string, message string) lib.Message {
+	return lib.Message{
+		Group:  "G",
+		Stream: stream,
+		Event:  ecslogs.Event{Message: message},
+	}
+}
@@ -0,0 +1,7 @@
+package blank
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterStage("blank", lib.NewCheckedStage(lib.StageFunc(NewProcessor), checkConfig))
+}
@@ -0,0 +1,120 @@
+package lib
+
+import (
+	"sync/atomic"
+
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// Pressure is how close the memory used by the messages held by ecs-logs is to
+// its budget.
+type Pressure int
+
+const (
+	// NoPressure means there's room left in the budget, or there is no
+	// budget.
+	NoPressure Pressure = iota
+
+	// FlushPressure means the budget is running out, the buffered messages
+	// should be flushed without waiting for their batches to fill up.
+	FlushPressure
+
+	// Backpressure means the budget is almost exhausted, no more messages
+	// should be read from the sources until the batches in flight drain.
+	Backpressure
+)
+
+// The fractions of the budget at which the pressure kicks in, they leave room
+// for the messages that keep coming from the stages and the log of ecs-logs
+// while the sources are held.
+const (
+	flushPressureRatio = 0.75
+	backpressureRatio  = 0.9
+)
+
+// MemoryBudget accounts for the bytes of the messages that ecs-logs holds,
+// from the time they're buffered in their stream until their batch was written
+// to all the destinations, or dropped.
+//
+// The usage is reported by the memory_budget_used_bytes metric and the limit
+// by memory_budget_limit_bytes.
+type MemoryBudget struct {
+	limit int64
+	used  int64
+	c     chan struct{}
+
+	usage *metrics.Counter
+}
+
+// NewMemoryBudget returns a budget of limit bytes, a zero limit only accounts
+// for the memory used without ever putting pressure.
+func NewMemoryBudget(limit int64, registry *metrics.Registry) *MemoryBudget {
+	registry.Gauge("memory_budget_limit_bytes").Add(limit)
+	return &MemoryBudget{
+		limit: limit,
+		c:     make(chan struct{}, 1),
+		usage: registry.Gauge("memory_budget_used_bytes"),
+	}
+}
+
+// Acquire adds n bytes to the memory used.
+func (b *MemoryBudget) Acquire(n int) {
+	atomic.AddInt64(&b.used, int64(n))
+	b.usage.Add(int64(n))
+}
+
+// Release removes n bytes from the memory used and signals C.
+func (b *MemoryBudget) Release(n int) {
+	atomic.AddInt64(&b.used, -int64(n))
+	b.usage.Add(-int64(n))
+
+	select {
+	case b.c <- struct{}{}:
+	default:
+	}
+}
+
+// Hold returns a function that releases n bytes when it's called for the
+// count-th time, it's what accounts for a batch written to count destinations
+// concurrently.
+func (b *MemoryBudget) Hold(n int, count int) func() {
+	if count <= 0 {
+		b.Release(n)
+		return func() {}
+	}
+
+	left := int32(count)
+	return func() {
+		if atomic.AddInt32(&left, -1) == 0 {
+			b.Release(n)
+		}
+	}
+}
+
+// Used returns the number of bytes currently held.
+func (b *MemoryBudget) Used() int64 {
+	return atomic.LoadInt64(&b.used)
+}
+
+// Pressure returns the pressure that the memory currently used puts on the
+// budget.
+func (b *MemoryBudget) Pressure() Pressure {
+	if b.limit <= 0 {
+		return NoPressure
+	}
+
+	switch used := float64(b.Used()); {
+	case used >= backpressureRatio*float64(b.limit):
+		return Backpressure
+	case used >= flushPressureRatio*float64(b.limit):
+		return FlushPressure
+	default:
+		return NoPressure
+	}
+}
+
+// C receives a value after memory was released, a program holding its
+// sources can check the pressure again then.
+func (b *MemoryBudget) C() <-chan struct{} {
+	return b.c
+}
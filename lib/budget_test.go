@@ -0,0 +1,84 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+func TestMemoryBudgetPressure(t *testing.T) {
+	r := metrics.NewRegistry()
+	b := NewMemoryBudget(1000, r)
+
+	// The batches of a few streams are buffered, then flushed to two
+	// destinations.
+	b.Acquire(500)
+
+	if p := b.Pressure(); p != NoPressure {
+		t.Errorf("there should be no pressure at half the budget: %d", p)
+	}
+
+	b.Acquire(250)
+
+	if p := b.Pressure(); p != FlushPressure {
+		t.Errorf("the buffered messages should be flushed as the budget is approached: %d", p)
+	}
+
+	b.Acquire(150)
+
+	if p := b.Pressure(); p != Backpressure {
+		t.Errorf("the sources should be held before the budget is exhausted: %d", p)
+	}
+
+	if used := usage(r); used != 900 {
+		t.Errorf("the usage should be exposed as a metric: %d", used)
+	}
+
+	release := b.Hold(400, 2)
+	release()
+
+	if used := b.Used(); used != 900 {
+		t.Errorf("the batch should be held until all the destinations are done with it: %d", used)
+	}
+
+	release()
+
+	if used := b.Used(); used != 500 || b.Pressure() != NoPressure {
+		t.Errorf("the usage should drop once the batch drained: %d (pressure %d)", used, b.Pressure())
+	}
+
+	select {
+	case <-b.C():
+	default:
+		t.Error("releasing memory should be signaled")
+	}
+
+	if used := usage(r); used != 500 {
+		t.Errorf("the metric should follow the usage: %d", used)
+	}
+}
+
+func TestMemoryBudgetDisabled(t *testing.T) {
+	b := NewMemoryBudget(0, metrics.NewRegistry())
+	b.Acquire(1 << 30)
+
+	if p := b.Pressure(); p != NoPressure {
+		t.Errorf("a budget without a limit should never put pressure: %d", p)
+	}
+
+	// A batch skipped by all the destinations is released right away.
+	b.Hold(1<<30, 0)
+
+	if used := b.Used(); used != 0 {
+		t.Errorf("the memory should have been released: %d", used)
+	}
+}
+
+func usage(r *metrics.Registry) int64 {
+	for _, s := range r.Snapshot() {
+		if s.Name == "memory_budget_used_bytes" {
+			return s.Value
+		}
+	}
+	return -1
+}
@@ -0,0 +1,84 @@
+package lib
+
+import "fmt"
+
+// ConfigChecker is implemented by destinations and stages that can validate
+// their configuration when ecs-logs starts, instead of failing when the first
+// writer or processor is opened.
+type ConfigChecker interface {
+	CheckConfig() error
+}
+
+// NewCheckedDestination returns a destination that behaves like dest, with
+// check as its CheckConfig method. It's useful to destinations made from a
+// DestinationFunc.
+func NewCheckedDestination(dest Destination, check func() error) Destination {
+	return checkedDestination{
+		Destination: dest,
+		check:       check,
+	}
+}
+
+type checkedDestination struct {
+	Destination
+	check func() error
+}
+
+func (d checkedDestination) CheckConfig() error {
+	return d.check()
+}
+
+// NewCheckedStage returns a stage that behaves like stage, with check as its
+// CheckConfig method.
+func NewCheckedStage(stage Stage, check func() error) Stage {
+	return checkedStage{
+		Stage: stage,
+		check: check,
+	}
+}
+
+type checkedStage struct {
+	Stage
+	check func() error
+}
+
+func (s checkedStage) CheckConfig() error {
+	return s.check()
+}
+
+// CheckConfig validates the configuration of v if it implements ConfigChecker.
+// The errors found are returned as an ErrorList, each of them prefixed with
+// the kind and the name of the component so they can be reported together.
+func CheckConfig(kind string, name string, v interface{}) error {
+	c, ok := v.(ConfigChecker)
+
+	if !ok {
+		return nil
+	}
+
+	err := c.CheckConfig()
+
+	if err == nil {
+		return nil
+	}
+
+	var errs ErrorList
+
+	for _, e := range flattenErrors(nil, err) {
+		errs = append(errs, fmt.Errorf("%s %s: %s", kind, name, e))
+	}
+
+	return errs
+}
+
+// flattenErrors appends err to list, expanding the error lists nested by
+// AppendError.
+func flattenErrors(list ErrorList, err error) ErrorList {
+	if errs, ok := err.(ErrorList); ok {
+		for _, e := range errs {
+			list = flattenErrors(list, e)
+		}
+		return list
+	}
+	return append(list, err)
+}
@@ -0,0 +1,37 @@
+package lib
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	dest := NewCheckedDestination(DestinationFunc(nil), func() error {
+		return AppendError(AppendError(errors.New("A"), errors.New("B")), errors.New("C"))
+	})
+
+	err := CheckConfig("destination", "test", dest)
+	list, ok := err.(ErrorList)
+
+	if !ok {
+		t.Fatalf("the errors should be returned as a list: %#v", err)
+	}
+
+	var found []string
+	for _, e := range list {
+		found = append(found, e.Error())
+	}
+
+	if ref := []string{"destination test: A", "destination test: B", "destination test: C"}; !reflect.DeepEqual(found, ref) {
+		t.Errorf("invalid errors:\n- expected: %v\n- found:    %v", ref, found)
+	}
+
+	if err := CheckConfig("stage", "test", NewCheckedStage(StageFunc(nil), func() error { return nil })); err != nil {
+		t.Errorf("a valid configuration shouldn't report errors: %v", err)
+	}
+
+	if err := CheckConfig("destination", "stdout", GetDestination("stdout")); err != nil {
+		t.Errorf("components that don't check their configuration shouldn't report errors: %v", err)
+	}
+}
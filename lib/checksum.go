@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// BodyChecksum sets a checksum of the body on the requests of the HTTP
+// destinations, so receivers can reject bodies that were truncated or
+// corrupted on the way, like by a misbehaving proxy.
+//
+// The zero value is disabled.
+type BodyChecksum struct {
+	// Either md5, sent base64 encoded in Content-MD5 by default, or sha256
+	// sent hex encoded in X-Body-SHA256.
+	Algorithm string
+
+	// The header carrying the checksum.
+	Header string
+}
+
+// DestinationBodyChecksum returns the checksum configured for destination by
+// the <DESTINATION>_BODY_CHECKSUM and <DESTINATION>_BODY_CHECKSUM_HEADER
+// environment variables.
+func DestinationBodyChecksum(destination string) (c BodyChecksum, err error) {
+	name := strings.ToUpper(destination) + "_BODY_CHECKSUM"
+
+	switch s := strings.ToLower(strings.TrimSpace(Getenv(name))); s {
+	case "", "none":
+		return
+	case "md5":
+		c = BodyChecksum{Algorithm: s, Header: "Content-MD5"}
+	case "sha256":
+		c = BodyChecksum{Algorithm: s, Header: "X-Body-SHA256"}
+	default:
+		err = fmt.Errorf("invalid %s, must be one of none, md5 or sha256: %s", name, s)
+		return
+	}
+
+	if s := strings.TrimSpace(Getenv(name + "_HEADER")); len(s) != 0 {
+		c.Header = s
+	}
+
+	return
+}
+
+// Enabled returns true if a checksum is sent.
+func (c BodyChecksum) Enabled() bool {
+	return len(c.Algorithm) != 0
+}
+
+// Sum returns the encoded checksum of body.
+func (c BodyChecksum) Sum(body []byte) string {
+	switch c.Algorithm {
+	case "md5":
+		sum := md5.Sum(body)
+		return base64.StdEncoding.EncodeToString(sum[:])
+	case "sha256":
+		sum := sha256.Sum256(body)
+		return hex.EncodeToString(sum[:])
+	default:
+		return ""
+	}
+}
+
+// Sign sets the checksum of body on req.
+func (c BodyChecksum) Sign(req *http.Request, body []byte) {
+	if c.Enabled() {
+		req.Header.Set(c.Header, c.Sum(body))
+	}
+}
+
+// Verify compares the checksum that the server echoed in the same header of
+// its response with the one of body. Servers that don't echo it can't be
+// verified, nil is returned.
+func (c BodyChecksum) Verify(res *http.Response, body []byte) error {
+	if !c.Enabled() {
+		return nil
+	}
+
+	echoed := strings.TrimSpace(res.Header.Get(c.Header))
+
+	if len(echoed) == 0 {
+		return nil
+	}
+
+	if sum := c.Sum(body); !c.equal(echoed, sum) {
+		return fmt.Errorf("the server received a body with the %s checksum %s instead of %s", c.Algorithm, echoed, sum)
+	}
+
+	return nil
+}
+
+func (c BodyChecksum) equal(a string, b string) bool {
+	// Only the hex encoding is case insensitive.
+	if c.Algorithm == "sha256" {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
@@ -0,0 +1,102 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBodyChecksumSign(t *testing.T) {
+	large := bytes.Repeat([]byte(`{"level":"INFO","message":"Hello World!"}`+"\n"), 1000)
+	largeMD5 := md5.Sum(large)
+	largeSHA256 := sha256.Sum256(large)
+
+	tests := []struct {
+		algorithm string
+		body      []byte
+		header    string
+		sum       string
+	}{
+		{algorithm: "md5", body: []byte("hello world"), header: "Content-MD5", sum: "XrY7u+Ae7tCTyyK7j1rNww=="},
+		{algorithm: "sha256", body: []byte(`{"a":1}`), header: "X-Body-SHA256", sum: "015abd7f5cc57a2dd94b7590f04ad8084273905ee33ec5cebeae62276a97f862"},
+		{algorithm: "md5", body: large, header: "Content-MD5", sum: base64.StdEncoding.EncodeToString(largeMD5[:])},
+		{algorithm: "sha256", body: large, header: "X-Body-SHA256", sum: hex.EncodeToString(largeSHA256[:])},
+	}
+
+	for _, test := range tests {
+		SetConfigEnv(map[string]string{"TESTDEST_BODY_CHECKSUM": test.algorithm})
+		c, err := DestinationBodyChecksum("testdest")
+		SetConfigEnv(nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, _ := http.NewRequest("POST", "http://localhost/", bytes.NewReader(test.body))
+		c.Sign(req, test.body)
+
+		if s := req.Header.Get(test.header); s != test.sum {
+			t.Errorf("%s: invalid checksum in %s: %q", test.algorithm, test.header, s)
+		}
+	}
+}
+
+func TestBodyChecksumVerify(t *testing.T) {
+	body := []byte("hello world")
+	c := BodyChecksum{Algorithm: "sha256", Header: "X-Body-SHA256"}
+	sum := c.Sum(body)
+
+	for _, test := range []struct {
+		echoed string
+		ok     bool
+	}{
+		{echoed: "", ok: true},
+		{echoed: sum, ok: true},
+		{echoed: strings.ToUpper(sum), ok: true},
+		{echoed: c.Sum(body[:5]), ok: false},
+	} {
+		res := &http.Response{Header: http.Header{}}
+
+		if len(test.echoed) != 0 {
+			res.Header.Set(c.Header, test.echoed)
+		}
+
+		if err := c.Verify(res, body); (err == nil) != test.ok {
+			t.Errorf("%q: the verification should succeed: %t (%v)", test.echoed, test.ok, err)
+		}
+	}
+}
+
+func TestDestinationBodyChecksum(t *testing.T) {
+	defer SetConfigEnv(nil)
+
+	SetConfigEnv(nil)
+
+	if c, err := DestinationBodyChecksum("testdest"); err != nil || c.Enabled() {
+		t.Errorf("the checksum should be disabled by default: %+v (%v)", c, err)
+	}
+
+	req, _ := http.NewRequest("POST", "http://localhost/", nil)
+	BodyChecksum{}.Sign(req, []byte("hello world"))
+
+	if len(req.Header) != 0 {
+		t.Errorf("a disabled checksum should not set headers: %v", req.Header)
+	}
+
+	SetConfigEnv(map[string]string{"TESTDEST_BODY_CHECKSUM": "sha256", "TESTDEST_BODY_CHECKSUM_HEADER": "X-Checksum"})
+
+	if c, err := DestinationBodyChecksum("testdest"); err != nil || c.Header != "X-Checksum" {
+		t.Errorf("the header should be overridden: %+v (%v)", c, err)
+	}
+
+	SetConfigEnv(map[string]string{"TESTDEST_BODY_CHECKSUM": "crc32"})
+
+	if _, err := DestinationBodyChecksum("testdest"); err == nil {
+		t.Error("unknown algorithms should be rejected")
+	}
+}
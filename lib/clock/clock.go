@@ -0,0 +1,64 @@
+// Package clock abstracts the current time and the passing of time, so code
+// that retries, backs off or expires things can be tested with a fake clock
+// instead of real sleeps.
+package clock
+
+import (
+	"context"
+	"time"
+)
+
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// Sleep pauses for the duration d, returning early with the context error
+	// if ctx is canceled.
+	Sleep(ctx context.Context, d time.Duration) error
+
+	// NewTimer creates a timer that fires after the duration d.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the interface of timers created by clocks, it behaves like a
+// time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+
+	Stop() bool
+
+	Reset(d time.Duration) bool
+}
+
+// System is the clock backed by the time package.
+var System Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
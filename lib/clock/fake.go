@@ -0,0 +1,138 @@
+package clock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Fake is a clock that only moves when told to, timers fire when the clock is
+// advanced past their deadline.
+//
+// Calling Sleep on a fake clock advances it by the sleep duration and returns
+// immediately, which lets code that retries with delays be tested on a single
+// goroutine. The total time slept is reported by Slept.
+type Fake struct {
+	mutex  sync.Mutex
+	now    time.Time
+	slept  time.Duration
+	timers []*fakeTimer
+}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+func (f *Fake) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	f.slept += d
+	f.mutex.Unlock()
+
+	f.Advance(d)
+	return nil
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	t := &fakeTimer{
+		clock: f,
+		c:     make(chan time.Time, 1),
+	}
+	f.schedule(t, d)
+	return t
+}
+
+// Advance moves the clock forward by d, firing the timers that expire in the
+// meantime.
+func (f *Fake) Advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.now = f.now.Add(d)
+	timers := f.timers[:0]
+
+	for _, t := range f.timers {
+		if t.deadline.After(f.now) {
+			timers = append(timers, t)
+			continue
+		}
+
+		t.active = false
+
+		select {
+		case t.c <- t.deadline:
+		default:
+		}
+	}
+
+	f.timers = timers
+}
+
+// Slept returns the total duration that Sleep was called with.
+func (f *Fake) Slept() time.Duration {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.slept
+}
+
+func (f *Fake) schedule(t *fakeTimer, d time.Duration) {
+	if t.deadline = f.now.Add(d); d <= 0 {
+		select {
+		case t.c <- t.deadline:
+		default:
+		}
+		return
+	}
+	t.active = true
+	f.timers = append(f.timers, t)
+}
+
+func (f *Fake) unschedule(t *fakeTimer) (active bool) {
+	if active = t.active; active {
+		for i, x := range f.timers {
+			if x == t {
+				f.timers = append(f.timers[:i], f.timers[i+1:]...)
+				break
+			}
+		}
+		t.active = false
+	}
+	return
+}
+
+type fakeTimer struct {
+	clock    *Fake
+	c        chan time.Time
+	deadline time.Time
+	active   bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	return t.clock.unschedule(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	active := t.clock.unschedule(t)
+	t.clock.schedule(t, d)
+	return active
+}
@@ -0,0 +1,75 @@
+package clock
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFakeSleep(t *testing.T) {
+	start := time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+
+	if err := f.Sleep(context.Background(), 1*time.Second); err != nil {
+		t.Error(err)
+	}
+
+	if now := f.Now(); !now.Equal(start.Add(1 * time.Second)) {
+		t.Errorf("sleeping should advance the fake clock: %s", now)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := f.Sleep(ctx, 1*time.Second); err != context.Canceled {
+		t.Errorf("sleeping with a canceled context should fail: %v", err)
+	}
+
+	if d := f.Slept(); d != 1*time.Second {
+		t.Errorf("invalid time slept: %s", d)
+	}
+}
+
+func TestFakeTimer(t *testing.T) {
+	f := NewFake(time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC))
+	a := f.NewTimer(1 * time.Second)
+	b := f.NewTimer(2 * time.Second)
+
+	f.Advance(1500 * time.Millisecond)
+
+	select {
+	case <-a.C():
+	default:
+		t.Error("the first timer should have fired")
+	}
+
+	select {
+	case <-b.C():
+		t.Error("the second timer should not have fired yet")
+	default:
+	}
+
+	if !b.Stop() {
+		t.Error("stopping an active timer should return true")
+	}
+
+	f.Advance(1 * time.Second)
+
+	select {
+	case <-b.C():
+		t.Error("a stopped timer should not fire")
+	default:
+	}
+
+	if b.Reset(1 * time.Second) {
+		t.Error("resetting a stopped timer should return false")
+	}
+
+	f.Advance(1 * time.Second)
+
+	select {
+	case <-b.C():
+	default:
+		t.Error("the reset timer should have fired")
+	}
+}
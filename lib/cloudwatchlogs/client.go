@@ -1,160 +1,298 @@
 package cloudwatchlogs
 
 import (
-	"fmt"
+	"os"
+	"strings"
 	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
 	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+	"github.com/segmentio/ecs-logs/lib/retry"
 )
 
 type client struct {
+	lazy   lib.LazyConfig
+	load   func() config
+	config config
+
+	// Appended to the names of the physical log streams, resolved once with
+	// the configuration.
+	suffix string
+
 	cmtx   sync.Mutex
-	client *cloudwatchlogs.CloudWatchLogs
+	client cloudwatchlogsiface.CloudWatchLogsAPI
+
+	// The credentials of the AWS client, they are expired to force a refresh
+	// when CloudWatch Logs reports that they're no longer valid.
+	creds expirer
+
+	// The partitions by key, a sync.Map so the writers of different groups
+	// don't contend on a lock to find theirs.
+	partitions sync.Map
+
+	// Looks up the sequence tokens of existing streams, shared by all the
+	// partitions since DescribeLogStreams has its own rate limit.
+	describerOnce sync.Once
+	describer     *describer
+
+	// Creates the log groups and streams, with its own rate limit as well.
+	creatorOnce sync.Once
+	creator     *creator
 
-	wmtx    sync.Mutex
-	writers map[string]*writer
+	// Looks up the data protection policies of the log groups.
+	protection *protection
+
+	// Saves the sequence tokens across restarts, nil unless a token file is
+	// configured.
+	tokens *tokenStore
+
+	// Limits the retries when CloudWatch Logs keeps failing, nil when no
+	// retry budget is configured.
+	retries *lib.RetryLimiter
+
+	// Round-robin counter used to distribute messages of sharded streams.
+	next uint64
+
+	// The clock used by the rate limiters, replaced in tests.
+	clock clock.Clock
 }
 
-func newClient() *client {
+func newClient(load func() config) *client {
 	return &client{
-		writers: make(map[string]*writer, 100),
+		load:  load,
+		clock: clock.System,
 	}
 }
 
-func (c *client) Open(group string, stream string) (w lib.Writer, err error) {
-	var client *cloudwatchlogs.CloudWatchLogs
-	var token string
-	var writer = c.get(group, stream)
+func (c *client) init() error {
+	c.config = c.load()
+	c.suffix = c.config.resolveStreamSuffix()
+	c.retries = lib.NewRetryLimiter("cloudwatchlogs", c.config.retryBudget, metrics.Default)
+	c.protection = newProtection(c.config.dataProtection)
 
-	w = writer
+	if len(c.config.tokenFile) != 0 {
+		c.tokens = newTokenStore(c.config.tokenFile, c.config.tokenGrace, c.clock)
+	}
 
-	writer.mutex.Lock()
-	defer writer.mutex.Unlock()
+	return c.config.check()
+}
+
+// CheckConfig validates the CLOUDWATCHLOGS_* settings when ecs-logs starts,
+// Open reports the same errors but only once the first stream is written.
+func (c *client) CheckConfig() error {
+	return c.load().check()
+}
 
-	if len(writer.token) != 0 {
-		// The writer already has a token, this means the log group and streams
-		// have been created for that writer already.
+func (c *client) Open(group string, stream string) (w lib.Writer, err error) {
+	if err = c.lazy.Init(c.init); err != nil {
 		return
 	}
 
-	if client, err = c.getAwsClient(); err != nil {
+	if len(c.config.levelGroups) != 0 {
+		w = &levelWriter{client: c, group: group, stream: stream}
 		return
 	}
 
-	if token, err = createGroupAndStream(client, group, stream); err != nil {
-		// Creating the log group or stream failed, this writer cannot be used.
-		c.remove(group, stream)
-		return
+	return c.openGroup(group, stream)
+}
+
+// openGroup returns a writer to the physical log group and stream, which may
+// be spread across multiple shards.
+func (c *client) openGroup(group string, stream string) (w lib.Writer, err error) {
+	if shards := c.config.shards(stream); shards > 1 {
+		return c.openShards(group, stream, shards)
 	}
 
-	writer.token = token
+	return c.open(group, stream)
+}
+
+func (c *client) open(group string, stream string) (writer *writer, err error) {
+	writer = c.get(group, stream)
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	// A writer whose group or stream failed to be created stays registered,
+	// the next Open or batch tries again.
+	err = writer.ensure()
 	return
 }
 
 func (c *client) Close(group string, stream string) {
-	c.remove(group, stream)
-}
+	c.lazy.Init(c.init)
 
-func (c *client) get(group string, stream string) (w *writer) {
-	key := joinGroupStream(group, stream)
-	c.wmtx.Lock()
+	for _, g := range c.config.levelGroups {
+		c.closeGroup(strings.Replace(g.group, "{group}", group, -1), stream)
+	}
+
+	c.closeGroup(group, stream)
+}
 
-	if w = c.writers[key]; w == nil {
-		w = &writer{
-			group:  group,
-			stream: stream,
-			parent: c,
+func (c *client) closeGroup(group string, stream string) {
+	if shards := c.config.shards(stream); shards > 1 {
+		for i := 0; i < shards; i++ {
+			c.remove(group, shardName(stream, i))
 		}
-		c.writers[key] = w
+		return
 	}
 
-	c.wmtx.Unlock()
-	return
+	c.remove(group, stream)
+}
+
+func (c *client) get(group string, stream string) *writer {
+	p := c.partition(group)
+
+	return p.writers.getOrCreate(joinGroupStream(group, stream), func() *writer {
+		return &writer{
+			group:         group,
+			stream:        stream,
+			name:          c.streamName(stream),
+			parent:        c,
+			limiter:       p.limiter,
+			streamLimiter: newLimiter(c.config.streamRateLimit, c.clock),
+			calls:         metrics.Default.Counter("put_log_events_calls", "group", group),
+		}
+	})
 }
 
+// remove removes the writer of group and stream.
 func (c *client) remove(group string, stream string) {
-	key := joinGroupStream(group, stream)
-	c.wmtx.Lock()
-	delete(c.writers, key)
-	c.wmtx.Unlock()
+	c.partition(group).writers.remove(joinGroupStream(group, stream), nil)
+}
+
+func (c *client) partition(group string) *partition {
+	key := c.config.partitionKey(group)
+
+	if p, ok := c.partitions.Load(key); ok {
+		return p.(*partition)
+	}
+
+	p, _ := c.partitions.LoadOrStore(key, &partition{
+		writers: newRegistry(),
+		limiter: newLimiter(c.config.rateLimit, c.clock),
+	})
+	return p.(*partition)
+}
+
+func (c *client) getDescriber() *describer {
+	c.describerOnce.Do(func() {
+		c.describer = newDescriber(newLimiter(describeRateLimit, c.clock))
+	})
+	return c.describer
 }
 
-func (c *client) getAwsClient() (client *cloudwatchlogs.CloudWatchLogs, err error) {
+// tokenDescriber returns the describer looking up the sequence tokens of the
+// streams that exist when their writer is opened, nil when the writers don't
+// send sequence tokens.
+func (c *client) tokenDescriber() *describer {
+	if c.config.skipSequenceTokens {
+		return nil
+	}
+	return c.getDescriber()
+}
+
+func (c *client) getCreator() *creator {
+	c.creatorOnce.Do(func() {
+		c.creator = newCreator(newLimiter(c.config.createRateLimit, c.clock), c.config.createConcurrency)
+	})
+	return c.creator
+}
+
+// getAwsClient returns the AWS client, opening it on the first call. The
+// writers keep the client they got so the lock is only taken once per stream.
+func (c *client) getAwsClient() (client cloudwatchlogsiface.CloudWatchLogsAPI, err error) {
 	c.cmtx.Lock()
 	defer c.cmtx.Unlock()
 
 	if client = c.client; client == nil {
-		if client, err = openAwsClient(); err != nil {
+		var creds *credentials.Credentials
+
+		if client, creds, err = openAwsClient(newRetryer(c.config.maxRetries, c.retries), c.config.endpoint, c.config.credentialProcess); err != nil {
 			return
 		}
+
 		c.client = client
+		c.creds = creds
+
+		if c.config.credentialsRefresh != 0 {
+			go c.renewCredentials(creds)
+		}
 	}
 
 	return
 }
 
-func openAwsClient() (client *cloudwatchlogs.CloudWatchLogs, err error) {
+// refreshCredentials expires the credentials of the AWS client so they are
+// retrieved again on the next request.
+func (c *client) refreshCredentials() {
+	c.cmtx.Lock()
+	defer c.cmtx.Unlock()
+
+	if c.creds != nil {
+		c.creds.Expire()
+	}
+}
+
+type expirer interface {
+	Expire()
+}
+
+func openAwsClient(retryer request.Retryer, endpoint awsEndpoint, process string) (client *cloudwatchlogs.CloudWatchLogs, creds *credentials.Credentials, err error) {
 	var region string
+	var url string
 
 	if region, err = getAwsRegion(); err != nil {
 		return
 	}
 
-	client = cloudwatchlogs.New(session.New(&aws.Config{
-		Region: aws.String(region),
-	}))
-	return
-}
+	if url, err = endpoint.resolve(region); err != nil {
+		return
+	}
 
-func createGroupAndStream(client *cloudwatchlogs.CloudWatchLogs, group string, stream string) (token string, err error) {
-	var result *cloudwatchlogs.DescribeLogStreamsOutput
+	cfg := &aws.Config{
+		Region: aws.String(region),
+	}
 
-	if _, err := client.CreateLogGroup(&cloudwatchlogs.CreateLogGroupInput{
-		LogGroupName: aws.String(group),
-	}); err != nil && !isAlreadyExists(err) {
-		return "", err
+	if len(url) != 0 {
+		cfg.Endpoint = aws.String(url)
 	}
 
-	_, err = client.CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{
-		LogGroupName:  aws.String(group),
-		LogStreamName: aws.String(stream),
-	})
-	if err == nil {
-		// Log stream successfully created.  No token need be provided.
-		return "", nil
-	} else if !isAlreadyExists(err) {
-		return "", err
-	}
-
-	if result, err = client.DescribeLogStreams(&cloudwatchlogs.DescribeLogStreamsInput{
-		Limit:               aws.Int64(1),
-		LogGroupName:        aws.String(group),
-		LogStreamNamePrefix: aws.String(stream),
-	}); err != nil {
-		if isThrottled(err) {
-			// The documentation says that we can only make 5 calls per second to
-			// this endpoint, but we need the sequence token in order to send events
-			// to streams that already exist.
-			//
-			// If we fail to fetch the stream description we still move on without
-			// a token and let the retry logic around PutLogEvents attempt to handle
-			// the issue.
-			return "", nil
+	sess := session.New(cfg)
+
+	// A configured credential process takes precedence over the environment.
+	// When running with IAM Roles for Service Accounts the web identity token
+	// is rotated, the credentials built from the token file are refreshed
+	// automatically by the SDK when they expire.
+	if len(process) != 0 {
+		creds = newProcessCredentials(process)
+	} else if tokenFile, roleARN := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN"); len(tokenFile) != 0 && len(roleARN) != 0 {
+		sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+
+		if len(sessionName) == 0 {
+			sessionName = "ecs-logs"
 		}
-		return "", err
-	}
 
-	// This should be an invariant
-	if len(result.LogStreams) == 0 {
-		return "", fmt.Errorf("Assertion failure: Log stream %s: %s not found",
-			group, stream)
+		creds = stscreds.NewWebIdentityCredentials(sess, roleARN, sessionName, tokenFile)
+	} else {
+		creds = sess.Config.Credentials
 	}
 
-	return aws.StringValue(result.LogStreams[0].UploadSequenceToken), nil
+	// The retryer is always asked whether a request should be retried, even
+	// when a handler already decided, so errors retried by ecs-logs aren't
+	// retried by the SDK as well.
+	client = cloudwatchlogs.New(sess, request.WithRetryer(&aws.Config{
+		Credentials:             creds,
+		EnforceShouldRetryCheck: aws.Bool(true),
+	}, retryer))
+	return
 }
 
 func joinGroupStream(group string, stream string) string {
@@ -173,5 +311,19 @@ func isAlreadyExists(err error) bool {
 }
 
 func isThrottled(err error) bool {
-	return isAwsErrorCode(err, "ThrottlingException")
+	return retry.IsThrottled(err)
+}
+
+func isExpiredCredentials(err error) bool {
+	for _, code := range []string{
+		"ExpiredToken",
+		"ExpiredTokenException",
+		"AccessDenied",
+		"AccessDeniedException",
+	} {
+		if isAwsErrorCode(err, code) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,299 @@
+package cloudwatchlogs
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+// The mockAPI type is used to mock the CloudWatch Logs API, methods that the
+// tests don't override panic since the embedded interface is nil.
+type mockAPI struct {
+	cloudwatchlogsiface.CloudWatchLogsAPI
+
+	mutex      sync.Mutex
+	groups     []*cloudwatchlogs.CreateLogGroupInput
+	streams    []*cloudwatchlogs.CreateLogStreamInput
+	puts       []*cloudwatchlogs.PutLogEventsInput
+	retentions []*cloudwatchlogs.PutRetentionPolicyInput
+	kmsKeys    []*cloudwatchlogs.AssociateKmsKeyInput
+	tags       []*cloudwatchlogs.TagResourceInput
+
+	createLogGroup     func(*cloudwatchlogs.CreateLogGroupInput) error
+	putLogEvents       func(*cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error)
+	filterLogEvents    func(*cloudwatchlogs.FilterLogEventsInput) (*cloudwatchlogs.FilterLogEventsOutput, error)
+	describeLogStreams func(*cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error)
+	describeLogGroups  func(*cloudwatchlogs.DescribeLogGroupsInput) (*cloudwatchlogs.DescribeLogGroupsOutput, error)
+	listTags           func(*cloudwatchlogs.ListTagsForResourceInput) (*cloudwatchlogs.ListTagsForResourceOutput, error)
+
+	describeAccountPolicies func(*cloudwatchlogs.DescribeAccountPoliciesInput) (*cloudwatchlogs.DescribeAccountPoliciesOutput, error)
+	getDataProtectionPolicy func(*cloudwatchlogs.GetDataProtectionPolicyInput) (*cloudwatchlogs.GetDataProtectionPolicyOutput, error)
+
+	// When set the streams are reported as already existing.
+	existingStreams bool
+}
+
+// invalidSequenceToken returns the error that the SDK decodes from a response
+// rejecting the sequence token of a PutLogEvents call.
+func invalidSequenceToken(expected string) error {
+	return &cloudwatchlogs.InvalidSequenceTokenException{
+		ExpectedSequenceToken: aws.String(expected),
+		Message_:              aws.String("The given sequenceToken is invalid. The next expected sequenceToken is: " + expected),
+	}
+}
+
+func (m *mockAPI) CreateLogGroup(input *cloudwatchlogs.CreateLogGroupInput) (*cloudwatchlogs.CreateLogGroupOutput, error) {
+	m.mutex.Lock()
+	m.groups = append(m.groups, input)
+	m.mutex.Unlock()
+
+	if m.createLogGroup != nil {
+		if err := m.createLogGroup(input); err != nil {
+			return nil, err
+		}
+	}
+
+	return &cloudwatchlogs.CreateLogGroupOutput{}, nil
+}
+
+func (m *mockAPI) CreateLogStream(input *cloudwatchlogs.CreateLogStreamInput) (*cloudwatchlogs.CreateLogStreamOutput, error) {
+	m.mutex.Lock()
+	m.streams = append(m.streams, input)
+	m.mutex.Unlock()
+
+	if m.existingStreams {
+		return nil, awserr.New("ResourceAlreadyExistsException", "The specified log stream already exists", nil)
+	}
+
+	return &cloudwatchlogs.CreateLogStreamOutput{}, nil
+}
+
+func (m *mockAPI) DescribeLogStreams(input *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+	return m.describeLogStreams(input)
+}
+
+func (m *mockAPI) DescribeAccountPolicies(input *cloudwatchlogs.DescribeAccountPoliciesInput) (*cloudwatchlogs.DescribeAccountPoliciesOutput, error) {
+	return m.describeAccountPolicies(input)
+}
+
+func (m *mockAPI) GetDataProtectionPolicy(input *cloudwatchlogs.GetDataProtectionPolicyInput) (*cloudwatchlogs.GetDataProtectionPolicyOutput, error) {
+	return m.getDataProtectionPolicy(input)
+}
+
+func (m *mockAPI) PutRetentionPolicy(input *cloudwatchlogs.PutRetentionPolicyInput) (*cloudwatchlogs.PutRetentionPolicyOutput, error) {
+	m.mutex.Lock()
+	m.retentions = append(m.retentions, input)
+	m.mutex.Unlock()
+	return &cloudwatchlogs.PutRetentionPolicyOutput{}, nil
+}
+
+func (m *mockAPI) DescribeLogGroups(input *cloudwatchlogs.DescribeLogGroupsInput) (*cloudwatchlogs.DescribeLogGroupsOutput, error) {
+	return m.describeLogGroups(input)
+}
+
+func (m *mockAPI) ListTagsForResource(input *cloudwatchlogs.ListTagsForResourceInput) (*cloudwatchlogs.ListTagsForResourceOutput, error) {
+	return m.listTags(input)
+}
+
+func (m *mockAPI) TagResource(input *cloudwatchlogs.TagResourceInput) (*cloudwatchlogs.TagResourceOutput, error) {
+	m.mutex.Lock()
+	m.tags = append(m.tags, input)
+	m.mutex.Unlock()
+	return &cloudwatchlogs.TagResourceOutput{}, nil
+}
+
+func (m *mockAPI) AssociateKmsKey(input *cloudwatchlogs.AssociateKmsKeyInput) (*cloudwatchlogs.AssociateKmsKeyOutput, error) {
+	m.mutex.Lock()
+	m.kmsKeys = append(m.kmsKeys, input)
+	m.mutex.Unlock()
+	return &cloudwatchlogs.AssociateKmsKeyOutput{}, nil
+}
+
+func (m *mockAPI) FilterLogEvents(input *cloudwatchlogs.FilterLogEventsInput) (*cloudwatchlogs.FilterLogEventsOutput, error) {
+	return m.filterLogEvents(input)
+}
+
+// PutLogEventsWithContext completes a request with the ID of the call after
+// PutLogEvents, so the options see it like with the SDK.
+func (m *mockAPI) PutLogEventsWithContext(ctx aws.Context, input *cloudwatchlogs.PutLogEventsInput, opts ...request.Option) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	output, err := m.PutLogEvents(input)
+
+	m.mutex.Lock()
+	r := &request.Request{RequestID: fmt.Sprintf("request-%d", len(m.puts))}
+	m.mutex.Unlock()
+
+	r.ApplyOptions(opts...)
+	r.Handlers.Complete.Run(r)
+	return output, err
+}
+
+func (m *mockAPI) PutLogEvents(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	// The writers reuse the memory of the events once the call returned, the
+	// input is copied to be inspected later.
+	copied := *input
+	copied.LogEvents = make([]*cloudwatchlogs.InputLogEvent, len(input.LogEvents))
+
+	for i, e := range input.LogEvents {
+		copied.LogEvents[i] = &cloudwatchlogs.InputLogEvent{
+			Message:   aws.String(aws.StringValue(e.Message)),
+			Timestamp: aws.Int64(aws.Int64Value(e.Timestamp)),
+		}
+	}
+
+	input = &copied
+
+	m.mutex.Lock()
+	m.puts = append(m.puts, input)
+	m.mutex.Unlock()
+
+	if m.putLogEvents != nil {
+		return m.putLogEvents(input)
+	}
+
+	return &cloudwatchlogs.PutLogEventsOutput{
+		NextSequenceToken: aws.String("next"),
+	}, nil
+}
+
+func newTestClient(cfg config, api cloudwatchlogsiface.CloudWatchLogsAPI) *client {
+	c := newClient(func() config { return cfg })
+	c.client = api
+	c.clock = newFakeClock()
+	return c
+}
+
+func TestCreateLogGroupClass(t *testing.T) {
+	tests := []struct {
+		class string
+		input *string
+	}{
+		{
+			class: "",
+			input: nil,
+		},
+		{
+			class: cloudwatchlogs.LogGroupClassStandard,
+			input: aws.String(cloudwatchlogs.LogGroupClassStandard),
+		},
+		{
+			class: cloudwatchlogs.LogGroupClassInfrequentAccess,
+			input: aws.String(cloudwatchlogs.LogGroupClassInfrequentAccess),
+		},
+	}
+
+	for _, test := range tests {
+		api := &mockAPI{}
+		c := newTestClient(config{groupClass: test.class}, api)
+
+		if _, err := c.Open("A", "0123456789"); err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if len(api.groups) != 1 {
+			t.Errorf("invalid number of log groups created: %d", len(api.groups))
+			continue
+		}
+
+		if s, ref := aws.StringValue(api.groups[0].LogGroupClass), aws.StringValue(test.input); s != ref {
+			t.Errorf("invalid log group class passed to CreateLogGroup:\n- expected: %#v\n- found:    %#v", ref, s)
+		}
+	}
+}
+
+func TestCreateLogGroupInvalidClass(t *testing.T) {
+	api := &mockAPI{}
+	c := newTestClient(config{groupClass: "GLACIER"}, api)
+
+	if _, err := c.Open("A", "0123456789"); err == nil {
+		t.Error("expected an error when opening a writer with an invalid log group class")
+	}
+
+	if len(api.groups) != 0 {
+		t.Error("no log groups should be created with an invalid log group class")
+	}
+}
+
+func TestInfrequentAccessRejectsEmbeddedMetrics(t *testing.T) {
+	api := &mockAPI{}
+	c := newTestClient(config{groupClass: cloudwatchlogs.LogGroupClassInfrequentAccess}, api)
+
+	w, err := c.Open("A", "0123456789")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteMessage(lib.Message{
+		Group:  "A",
+		Stream: "0123456789",
+		Event:  ecslogs.Event{Message: "Hello World!"},
+	}); err != nil {
+		t.Error(err)
+	}
+
+	emf := lib.Message{
+		Group:  "A",
+		Stream: "0123456789",
+		Event: ecslogs.Event{
+			Data: ecslogs.EventData{
+				"_aws": map[string]interface{}{
+					"CloudWatchMetrics": []interface{}{},
+				},
+			},
+		},
+	}
+
+	// Only the embedded metric format events are rejected, the other
+	// messages of the batch are written.
+	err = w.WriteMessageBatch(lib.MessageBatch{emf, {
+		Group:  "A",
+		Stream: "0123456789",
+		Event:  ecslogs.Event{Message: "Goodbye!"},
+	}})
+
+	if e, ok := err.(*lib.RejectedError); !ok || len(e.Rejections) != 1 || e.Rejections[0].Message.Event.Data["_aws"] == nil {
+		t.Errorf("expected the embedded metric event to be rejected: %v", err)
+	}
+
+	if len(api.puts) != 2 || len(api.puts[1].LogEvents) != 1 {
+		t.Errorf("invalid calls to PutLogEvents: %d", len(api.puts))
+	}
+
+	if _, ok := w.WriteMessage(emf).(*lib.RejectedError); !ok {
+		t.Error("expected a batch of embedded metric events only to be rejected")
+	}
+
+	if len(api.puts) != 2 {
+		t.Errorf("no call to PutLogEvents should be made for rejected events only: %d", len(api.puts))
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	lib.SetConfigEnv(map[string]string{
+		"CLOUDWATCHLOGS_RETENTION":       "*=13",
+		"CLOUDWATCHLOGS_SHARD_BY":        "random",
+		"CLOUDWATCHLOGS_SEQUENCE_TOKENS": "maybe",
+	})
+	defer lib.SetConfigEnv(nil)
+
+	err := newClient(getConfig).CheckConfig()
+
+	for _, s := range []string{
+		"invalid CLOUDWATCHLOGS_RETENTION, the number of days must be one of",
+		"invalid CLOUDWATCHLOGS_SHARD_BY, must be one of round-robin, hash: random",
+		"invalid CLOUDWATCHLOGS_SEQUENCE_TOKENS, must be a boolean: maybe",
+	} {
+		if err == nil || !strings.Contains(err.Error(), s) {
+			t.Errorf("the error should report %q: %v", s, err)
+		}
+	}
+}
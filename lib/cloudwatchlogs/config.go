@@ -0,0 +1,457 @@
+package cloudwatchlogs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	awsclient "github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/ecsmeta"
+)
+
+// config carries the settings of the cloudwatchlogs destination, they are
+// loaded from CLOUDWATCHLOGS_* environment variables.
+type config struct {
+	// The log class that log groups are created with, an empty string lets
+	// CloudWatch Logs pick its default (STANDARD).
+	groupClass string
+
+	// Streams matching one of these patterns are spread across multiple
+	// physical log streams, trading ordering for throughput. Sharding is only
+	// allowed when the ordering mode isn't strict.
+	streamShards []streamShards
+	ordering     lib.OrderingMode
+
+	// How messages are distributed across the shards of a stream, either
+	// "round-robin" or "hash".
+	shardBy string
+
+	// How writers and rate limiters are partitioned, either "shared" or
+	// "group" to isolate the throughput budget and throttling of each group.
+	partition string
+
+	// The maximum number of PutLogEvents calls per second in each partition
+	// and in each log stream, zero means no limit.
+	rateLimit       float64
+	streamRateLimit float64
+
+	// The maximum number of calls per second creating log groups and streams,
+	// zero means no limit, and how many of them may run at once in each log
+	// group.
+	createRateLimit   float64
+	createConcurrency int
+
+	// When set, each event is serialized with a routingField top-level field
+	// rendered from this template, for subscription filters to match on.
+	routingKey   string
+	routingField string
+
+	// How events are serialized, either "json" or "insights" to flatten
+	// them for CloudWatch Logs Insights.
+	format string
+
+	// The outer object that serialized events are wrapped in, disabled by
+	// default.
+	envelope lib.Envelope
+
+	// Whether the raw lines of the messages that weren't modified are sent
+	// instead of their serialized events.
+	rawPassthrough bool
+
+	// Messages at or above the level of one of these are written to its log
+	// group instead of the group of their stream.
+	levelGroups []levelGroup
+
+	// The retention set on the log groups that are created.
+	groupRetentions []groupRetention
+
+	// The tags and the ARN of the KMS key encrypting the log groups that are
+	// created, and whether the groups that already exist are given them and
+	// the retention as well.
+	groupTags       map[string]string
+	kmsKey          string
+	reconcileGroups bool
+
+	// Where the suffix appended to the names of log streams comes from, one
+	// of "none", "task", "container" or "random", and the URI of the ECS
+	// container metadata endpoint that the task and container IDs are read
+	// from.
+	streamSuffix string
+	metadataURI  string
+
+	// The maximum number of retries of transient errors made by the AWS SDK
+	// on each API call.
+	maxRetries int
+
+	// The budget of the retries made across all the writers, both by the
+	// SDK and after throttling, disabled unless configured.
+	retryBudget lib.RetryBudget
+
+	// How many times the sequence token of a stream is looked up again while
+	// writing a batch, when CloudWatch Logs rejects the token without telling
+	// which one it expects.
+	tokenRefetches int
+
+	// Whether the writers leave the sequence tokens out of PutLogEvents, which
+	// CloudWatch Logs doesn't require anymore, so the existing streams don't
+	// have to be described when their writer is opened. Some emulators still
+	// check the tokens.
+	skipSequenceTokens bool
+
+	// The file that the sequence tokens are saved to when writers are closed,
+	// and the minimum time between two saves.
+	tokenFile  string
+	tokenGrace time.Duration
+
+	// The endpoint of CloudWatch Logs, overridden or the FIPS one.
+	endpoint awsEndpoint
+
+	// How long before their expiry the credentials of the AWS client are
+	// refreshed in the background, zero leaves it to the SDK to refresh them
+	// on the first request made once they expired.
+	credentialsRefresh time.Duration
+
+	// The command run to get the credentials of the AWS client, from
+	// CLOUDWATCHLOGS_CREDENTIAL_PROCESS or the credential_process of the
+	// AWS profile.
+	credentialProcess string
+
+	// How the data protection policies masking data server-side are handled,
+	// one of "ignore", "detect" or "skip-redaction".
+	dataProtection string
+
+	// The streams created when ecs-logs starts, and whether failing to create
+	// them is fatal.
+	warmup       []warmStream
+	warmupStrict bool
+
+	err error
+}
+
+type streamShards struct {
+	pattern string
+	count   int
+}
+
+const (
+	shardByRoundRobin = "round-robin"
+	shardByHash       = "hash"
+
+	partitionShared = "shared"
+	partitionGroup  = "group"
+
+	formatJSON     = "json"
+	formatInsights = "insights"
+)
+
+func getConfig() (c config) {
+	var err error
+
+	c.groupClass = strings.ToUpper(strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_GROUP_CLASS")))
+
+	if c.streamShards, err = parseStreamShards(lib.Getenv("CLOUDWATCHLOGS_STREAM_SHARDS")); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.ordering, err = lib.DestinationOrdering("cloudwatchlogs"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.shardBy = strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_SHARD_BY")); len(c.shardBy) == 0 {
+		c.shardBy = shardByRoundRobin
+	}
+
+	if c.partition = strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_PARTITION")); len(c.partition) == 0 {
+		c.partition = partitionShared
+	}
+
+	if s := strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_RATE_LIMIT")); len(s) != 0 {
+		if c.rateLimit, err = strconv.ParseFloat(s, 64); err != nil || c.rateLimit < 0 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid CLOUDWATCHLOGS_RATE_LIMIT, must be a positive number: %s", s))
+		}
+	}
+
+	c.streamRateLimit = defaultStreamRateLimit
+
+	if s := strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_STREAM_RATE_LIMIT")); len(s) != 0 {
+		if c.streamRateLimit, err = strconv.ParseFloat(s, 64); err != nil || c.streamRateLimit < 0 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid CLOUDWATCHLOGS_STREAM_RATE_LIMIT, must be a positive number or zero: %s", s))
+		}
+	}
+
+	c.createRateLimit = defaultCreateRateLimit
+
+	if s := strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_CREATE_RATE_LIMIT")); len(s) != 0 {
+		if c.createRateLimit, err = strconv.ParseFloat(s, 64); err != nil || c.createRateLimit < 0 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid CLOUDWATCHLOGS_CREATE_RATE_LIMIT, must be a positive number or zero: %s", s))
+		}
+	}
+
+	c.createConcurrency = defaultCreateConcurrency
+
+	if s := strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_CREATE_CONCURRENCY")); len(s) != 0 {
+		if c.createConcurrency, err = strconv.Atoi(s); err != nil || c.createConcurrency <= 0 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid CLOUDWATCHLOGS_CREATE_CONCURRENCY, must be a positive integer: %s", s))
+		}
+	}
+
+	c.maxRetries = awsclient.DefaultRetryerMaxNumRetries
+
+	if s := strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_MAX_RETRIES")); len(s) != 0 {
+		if c.maxRetries, err = strconv.Atoi(s); err != nil || c.maxRetries < 0 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid CLOUDWATCHLOGS_MAX_RETRIES, must be a positive integer: %s", s))
+		}
+	}
+
+	if c.retryBudget, err = lib.DestinationRetryBudget("cloudwatchlogs"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.envelope, err = lib.DestinationEnvelope("cloudwatchlogs"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.rawPassthrough, err = lib.DestinationRawPassthrough("cloudwatchlogs"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	c.tokenRefetches = 1
+
+	if s := strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_TOKEN_REFETCHES")); len(s) != 0 {
+		if c.tokenRefetches, err = strconv.Atoi(s); err != nil || c.tokenRefetches < 0 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid CLOUDWATCHLOGS_TOKEN_REFETCHES, must be a positive integer or zero: %s", s))
+		}
+	}
+
+	if s := strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_SEQUENCE_TOKENS")); len(s) != 0 {
+		var enabled bool
+
+		if enabled, err = strconv.ParseBool(s); err != nil {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid CLOUDWATCHLOGS_SEQUENCE_TOKENS, must be a boolean: %s", s))
+		}
+
+		c.skipSequenceTokens = !enabled
+	}
+
+	c.tokenFile = strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_TOKEN_FILE"))
+
+	if s := strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_TOKEN_FILE_GRACE")); len(s) != 0 {
+		if c.tokenGrace, err = time.ParseDuration(s); err != nil || c.tokenGrace < 0 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid CLOUDWATCHLOGS_TOKEN_FILE_GRACE, must be a positive duration or zero: %s", s))
+		}
+	}
+
+	if c.endpoint, err = getAwsEndpoint(); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	c.credentialsRefresh = defaultCredentialsRefresh
+
+	if s := strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_CREDENTIALS_REFRESH")); len(s) != 0 {
+		if c.credentialsRefresh, err = time.ParseDuration(s); err != nil || c.credentialsRefresh < 0 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid CLOUDWATCHLOGS_CREDENTIALS_REFRESH, must be a positive duration or zero: %s", s))
+		}
+	}
+
+	if c.credentialProcess = strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_CREDENTIAL_PROCESS")); len(c.credentialProcess) == 0 && len(os.Getenv("AWS_ACCESS_KEY_ID")) == 0 {
+		// The SDK only reads the profile of the shared config file when
+		// AWS_SDK_LOAD_CONFIG is set, it runs the process itself then.
+		if len(os.Getenv("AWS_SDK_LOAD_CONFIG")) == 0 {
+			if c.credentialProcess, err = profileCredentialProcess(); err != nil {
+				c.err = lib.AppendError(c.err, fmt.Errorf("reading the credential_process of the AWS profile: %s", err))
+			}
+		}
+	}
+
+	if c.levelGroups, err = parseLevelGroups(lib.Getenv("CLOUDWATCHLOGS_LEVEL_GROUPS")); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.groupRetentions, err = parseGroupRetentions(lib.Getenv("CLOUDWATCHLOGS_RETENTION")); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.groupTags, err = parseGroupTags(lib.Getenv("CLOUDWATCHLOGS_GROUP_TAGS")); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	// CloudWatch Logs only takes the ARN of the key, not its ID or alias.
+	if c.kmsKey = strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_KMS_KEY")); len(c.kmsKey) != 0 && !strings.HasPrefix(c.kmsKey, "arn:") {
+		c.err = lib.AppendError(c.err, fmt.Errorf("invalid CLOUDWATCHLOGS_KMS_KEY, must be the ARN of a KMS key: %s", c.kmsKey))
+	}
+
+	if s := strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_RECONCILE_GROUPS")); len(s) != 0 {
+		if c.reconcileGroups, err = strconv.ParseBool(s); err != nil {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid CLOUDWATCHLOGS_RECONCILE_GROUPS, must be a boolean: %s", s))
+		}
+	}
+
+	if c.format = strings.ToLower(strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_FORMAT"))); len(c.format) == 0 {
+		c.format = formatJSON
+	}
+
+	if c.streamSuffix = strings.ToLower(strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_STREAM_SUFFIX"))); len(c.streamSuffix) == 0 {
+		c.streamSuffix = suffixNone
+	}
+
+	if c.dataProtection = strings.ToLower(strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_DATA_PROTECTION"))); len(c.dataProtection) == 0 {
+		c.dataProtection = protectionIgnore
+	}
+
+	if c.warmup, err = parseWarmup(lib.Getenv("CLOUDWATCHLOGS_WARMUP")); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if s := strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_WARMUP_STRICT")); len(s) != 0 {
+		if c.warmupStrict, err = strconv.ParseBool(s); err != nil {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid CLOUDWATCHLOGS_WARMUP_STRICT, must be a boolean: %s", s))
+		}
+	}
+
+	c.metadataURI = ecsmeta.URI()
+	c.routingKey = lib.Getenv("CLOUDWATCHLOGS_ROUTING_KEY")
+
+	if c.routingField = strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_ROUTING_KEY_FIELD")); len(c.routingField) == 0 {
+		c.routingField = defaultRoutingField
+	}
+
+	return
+}
+
+func (c config) check() (err error) {
+	if c.err != nil {
+		err = lib.AppendError(err, c.err)
+	}
+
+	if len(c.groupClass) != 0 && !isLogGroupClass(c.groupClass) {
+		err = lib.AppendError(err, fmt.Errorf("invalid CLOUDWATCHLOGS_GROUP_CLASS, must be one of %s: %s",
+			strings.Join(cloudwatchlogs.LogGroupClass_Values(), ", "), c.groupClass))
+	}
+
+	if len(c.streamShards) != 0 && c.ordering == lib.OrderingStrict {
+		err = lib.AppendError(err, fmt.Errorf("invalid CLOUDWATCHLOGS_STREAM_SHARDS, sharded streams aren't ordered, "+
+			"CLOUDWATCHLOGS_ORDERING must be set to best-effort or none"))
+	}
+
+	switch c.shardBy {
+	case "", shardByRoundRobin, shardByHash:
+	default:
+		err = lib.AppendError(err, fmt.Errorf("invalid CLOUDWATCHLOGS_SHARD_BY, must be one of %s, %s: %s",
+			shardByRoundRobin, shardByHash, c.shardBy))
+	}
+
+	if len(c.routingKey) != 0 {
+		if e := checkRoutingKey(c.routingKey); e != nil {
+			err = lib.AppendError(err, fmt.Errorf("invalid CLOUDWATCHLOGS_ROUTING_KEY: %s", e))
+		}
+
+		if e := checkRoutingField(c.routingField); e != nil {
+			err = lib.AppendError(err, fmt.Errorf("invalid CLOUDWATCHLOGS_ROUTING_KEY_FIELD: %s", e))
+		}
+	}
+
+	switch c.partition {
+	case "", partitionShared, partitionGroup:
+	default:
+		err = lib.AppendError(err, fmt.Errorf("invalid CLOUDWATCHLOGS_PARTITION, must be one of %s, %s: %s",
+			partitionShared, partitionGroup, c.partition))
+	}
+
+	switch c.streamSuffix {
+	case "", suffixNone, suffixTask, suffixContainer, suffixRandom:
+	default:
+		err = lib.AppendError(err, fmt.Errorf("invalid CLOUDWATCHLOGS_STREAM_SUFFIX, must be one of %s, %s, %s, %s: %s",
+			suffixNone, suffixTask, suffixContainer, suffixRandom, c.streamSuffix))
+	}
+
+	switch c.dataProtection {
+	case "", protectionIgnore, protectionDetect, protectionSkipRedaction:
+	default:
+		err = lib.AppendError(err, fmt.Errorf("invalid CLOUDWATCHLOGS_DATA_PROTECTION, must be one of %s, %s, %s: %s",
+			protectionIgnore, protectionDetect, protectionSkipRedaction, c.dataProtection))
+	}
+
+	switch c.format {
+	case "", formatJSON, formatInsights:
+	default:
+		err = lib.AppendError(err, fmt.Errorf("invalid CLOUDWATCHLOGS_FORMAT, must be one of %s, %s: %s",
+			formatJSON, formatInsights, c.format))
+	}
+
+	return
+}
+
+// shards returns the number of physical streams that the given stream is
+// spread across, 1 means the stream isn't sharded.
+func (c config) shards(stream string) int {
+	for _, s := range c.streamShards {
+		if ok, _ := path.Match(s.pattern, stream); ok {
+			return s.count
+		}
+	}
+	return 1
+}
+
+// partitionKey returns the key of the partition that the writers of group
+// belong to.
+func (c config) partitionKey(group string) string {
+	if c.partition == partitionGroup {
+		return group
+	}
+	return ""
+}
+
+func (c config) infrequentAccess() bool {
+	return c.groupClass == cloudwatchlogs.LogGroupClassInfrequentAccess
+}
+
+func isLogGroupClass(class string) bool {
+	for _, v := range cloudwatchlogs.LogGroupClass_Values() {
+		if class == v {
+			return true
+		}
+	}
+	return false
+}
+
+// parseStreamShards parses a comma separated list of pattern=count pairs, for
+// example "web-*=4,api=2".
+func parseStreamShards(s string) (shards []streamShards, err error) {
+	for _, item := range strings.Split(s, ",") {
+		var count int
+
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+
+		i := strings.LastIndexByte(item, '=')
+
+		if i < 0 {
+			err = fmt.Errorf("invalid CLOUDWATCHLOGS_STREAM_SHARDS, expected pattern=count: %s", item)
+			return
+		}
+
+		pattern := strings.TrimSpace(item[:i])
+
+		if _, e := path.Match(pattern, ""); e != nil || len(pattern) == 0 {
+			err = fmt.Errorf("invalid CLOUDWATCHLOGS_STREAM_SHARDS, bad stream pattern: %s", item)
+			return
+		}
+
+		if count, err = strconv.Atoi(strings.TrimSpace(item[i+1:])); err != nil || count < 1 {
+			err = fmt.Errorf("invalid CLOUDWATCHLOGS_STREAM_SHARDS, the shard count must be a positive integer: %s", item)
+			return
+		}
+
+		shards = append(shards, streamShards{
+			pattern: pattern,
+			count:   count,
+		})
+	}
+	return
+}
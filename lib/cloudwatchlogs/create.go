@@ -0,0 +1,202 @@
+package cloudwatchlogs
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+)
+
+const (
+	// The default rate of CreateLogGroup, CreateLogStream and
+	// PutRetentionPolicy calls across all log groups, and the default number
+	// of those calls running at the same time in each group.
+	defaultCreateRateLimit   = 10
+	defaultCreateConcurrency = 4
+
+	// The maximum number of attempts of a creation call that keeps being
+	// throttled.
+	maxCreateAttempts = 5
+)
+
+// creator makes the calls that create log groups and streams. When a service
+// starts or a new group shows up hundreds of writers may open at once, all of
+// them creating their group and stream, so these calls get their own rate
+// limit instead of competing with PutLogEvents for its budget.
+//
+// Creations of the same group or stream that overlap are coalesced into a
+// single call whose result is shared by all the callers, and the number of
+// calls running in each group is capped so a burst in one group doesn't hold
+// all the others behind it.
+type creator struct {
+	mutex       sync.Mutex
+	limiter     *limiter
+	concurrency int
+	calls       map[string]*createCall
+	groups      map[string]*creatorGroup
+	reconciled  map[string]bool
+}
+
+type createCall struct {
+	existed bool
+	err     error
+	done    chan struct{}
+	waiters int // callers waiting for the result of the call
+}
+
+type creatorGroup struct {
+	slots chan struct{}
+	refs  int
+}
+
+func newCreator(l *limiter, concurrency int) *creator {
+	if concurrency <= 0 {
+		concurrency = defaultCreateConcurrency
+	}
+	return &creator{
+		limiter:     l,
+		concurrency: concurrency,
+		calls:       make(map[string]*createCall),
+		groups:      make(map[string]*creatorGroup),
+		reconciled:  make(map[string]bool),
+	}
+}
+
+// createGroupAndStream creates group and stream if they don't exist yet and
+// returns the sequence token of the stream, which is empty when it was just
+// created. The token of an existing stream is only looked up when describer
+// isn't nil.
+func (c *creator) createGroupAndStream(client cloudwatchlogsiface.CloudWatchLogsAPI, describer *describer, group string, stream string, settings groupSettings) (token string, err error) {
+	if _, err = c.do(group, "", func() error { return c.createGroup(client, group, settings) }); err != nil {
+		return
+	}
+
+	existed, err := c.do(group, stream, func() error { return c.createStream(client, group, stream) })
+
+	if err != nil || !existed || describer == nil {
+		return
+	}
+
+	// The stream already exists, we need its sequence token in order to send
+	// events to it.
+	return describer.token(client, group, stream)
+}
+
+// do runs create once a slot of the group is free, or waits for the call
+// creating the same resource if one is already running. The existed result is
+// true if CloudWatch Logs reported that the resource already existed, which
+// isn't an error.
+func (c *creator) do(group string, stream string, create func() error) (existed bool, err error) {
+	key := joinGroupStream(group, stream)
+
+	c.mutex.Lock()
+
+	if call := c.calls[key]; call != nil {
+		call.waiters++
+		c.mutex.Unlock()
+		<-call.done
+		return call.existed, call.err
+	}
+
+	call := &createCall{done: make(chan struct{})}
+	c.calls[key] = call
+
+	g := c.groups[group]
+
+	if g == nil {
+		g = &creatorGroup{slots: make(chan struct{}, c.concurrency)}
+		c.groups[group] = g
+	}
+
+	g.refs++
+	c.mutex.Unlock()
+
+	g.slots <- struct{}{}
+	err = create()
+	<-g.slots
+
+	if isAlreadyExists(err) {
+		call.existed, err = true, nil
+	}
+
+	call.err = err
+
+	c.mutex.Lock()
+	delete(c.calls, key)
+
+	if g.refs--; g.refs == 0 {
+		delete(c.groups, group)
+	}
+
+	c.mutex.Unlock()
+
+	close(call.done)
+	return call.existed, call.err
+}
+
+// call makes a creation call once the rate limit allows it, retrying it while
+// it's throttled.
+func (c *creator) call(f func() error) (err error) {
+	for attempt := 1; true; attempt++ {
+		c.limiter.wait(false)
+
+		if err = f(); !isThrottled(err) {
+			c.limiter.succeeded()
+			return
+		}
+
+		if attempt == maxCreateAttempts {
+			return
+		}
+
+		c.limiter.throttled()
+	}
+	return
+}
+
+func (c *creator) createGroup(client cloudwatchlogsiface.CloudWatchLogsAPI, group string, settings groupSettings) error {
+	var input = &cloudwatchlogs.CreateLogGroupInput{
+		LogGroupName: aws.String(group),
+		Tags:         awsTags(settings.tags),
+	}
+
+	if len(settings.class) != 0 {
+		input.LogGroupClass = aws.String(settings.class)
+	}
+
+	if len(settings.kmsKey) != 0 {
+		input.KmsKeyId = aws.String(settings.kmsKey)
+	}
+
+	err := c.call(func() (err error) { _, err = client.CreateLogGroup(input); return })
+
+	// Unless reconciling them is enabled the settings are only applied to
+	// the groups that ecs-logs creates, so changes made to existing groups
+	// aren't overwritten.
+	if isAlreadyExists(err) && settings.reconcile && !settings.empty() {
+		c.reconcileGroup(client, group, settings)
+	}
+
+	if err != nil || settings.retention == 0 {
+		return err
+	}
+
+	return c.call(func() (err error) {
+		_, err = client.PutRetentionPolicy(&cloudwatchlogs.PutRetentionPolicyInput{
+			LogGroupName:    aws.String(group),
+			RetentionInDays: aws.Int64(settings.retention),
+		})
+		return
+	})
+}
+
+func (c *creator) createStream(client cloudwatchlogsiface.CloudWatchLogsAPI, group string, stream string) error {
+	return c.call(func() (err error) {
+		_, err = client.CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{
+			LogGroupName:  aws.String(group),
+			LogStreamName: aws.String(stream),
+		})
+		return
+	})
+}
@@ -0,0 +1,225 @@
+package cloudwatchlogs
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+func TestCreateCoalesced(t *testing.T) {
+	const writers = 20
+
+	release := make(chan struct{})
+	once := sync.Once{}
+
+	api := &mockAPI{}
+	api.createLogGroup = func(*cloudwatchlogs.CreateLogGroupInput) error {
+		// The first call is held until all the other writers are waiting for
+		// it, so they share its result.
+		once.Do(func() { <-release })
+		return nil
+	}
+
+	c := newTestClient(config{}, api)
+	cr := c.getCreator()
+
+	var wg sync.WaitGroup
+	var errs = make(chan error, writers)
+
+	for i := 0; i != writers; i++ {
+		wg.Add(1)
+		go func(stream string) {
+			defer wg.Done()
+			if _, err := c.Open("A", stream); err != nil {
+				errs <- err
+			}
+		}(fmt.Sprintf("web-%d", i))
+	}
+
+	for waiting := 0; waiting != writers-1; {
+		time.Sleep(time.Millisecond)
+		cr.mutex.Lock()
+		if call := cr.calls["A:"]; call != nil {
+			waiting = call.waiters
+		}
+		cr.mutex.Unlock()
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if len(api.groups) != 1 {
+		t.Errorf("the concurrent creations of the log group should be coalesced into a single call: %d", len(api.groups))
+	}
+
+	if len(api.streams) != writers {
+		t.Errorf("each log stream should be created: %d", len(api.streams))
+	}
+
+	if len(cr.calls) != 0 || len(cr.groups) != 0 {
+		t.Errorf("the creator should forget the calls once they're done: %d calls, %d groups", len(cr.calls), len(cr.groups))
+	}
+}
+
+func TestCreatePaced(t *testing.T) {
+	api := &mockAPI{}
+	f := newFakeClock()
+	c := newTestClient(config{createRateLimit: 2}, api)
+	c.clock = f
+
+	const streams = 10
+
+	for i := 0; i != streams; i++ {
+		if _, err := c.Open(fmt.Sprintf("group-%d", i), "0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(api.groups) != streams || len(api.streams) != streams {
+		t.Errorf("invalid number of creations: %d groups, %d streams", len(api.groups), len(api.streams))
+	}
+
+	// Each writer creates its group and stream, the burst of the limiter goes
+	// through and the following calls are spread at the create rate.
+	if min := time.Second * (2*streams - 2) / 2; f.Slept() < min {
+		t.Errorf("the creations should be paced, waited %s instead of at least %s", f.Slept(), min)
+	}
+
+	// The writers still have the whole PutLogEvents budget of the partition.
+	if d := c.partition("group-0").limiter.reserve(false); d != 0 {
+		t.Errorf("the creations should not use the rate limit of PutLogEvents: %s", d)
+	}
+}
+
+func TestCreateConcurrency(t *testing.T) {
+	const concurrency = 2
+
+	var mutex sync.Mutex
+	var running = map[string]int{}
+	var max = map[string]int{}
+
+	cr := newCreator(newLimiter(0, newFakeClock()), concurrency)
+	create := func(group string) func() error {
+		return func() error {
+			mutex.Lock()
+			if running[group]++; running[group] > max[group] {
+				max[group] = running[group]
+			}
+			mutex.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mutex.Lock()
+			running[group]--
+			mutex.Unlock()
+			return nil
+		}
+	}
+
+	var wg sync.WaitGroup
+
+	for _, group := range []string{"A", "B"} {
+		for i := 0; i != 10; i++ {
+			wg.Add(1)
+			go func(group string, stream string) {
+				defer wg.Done()
+				cr.do(group, stream, create(group))
+			}(group, fmt.Sprint(i))
+		}
+	}
+
+	wg.Wait()
+
+	for _, group := range []string{"A", "B"} {
+		if max[group] > concurrency {
+			t.Errorf("%s: at most %d creations should run at once: %d", group, concurrency, max[group])
+		}
+	}
+}
+
+func TestCreateAlreadyExists(t *testing.T) {
+	api := &mockAPI{existingStreams: true}
+	api.createLogGroup = func(*cloudwatchlogs.CreateLogGroupInput) error {
+		return awserr.New("ResourceAlreadyExistsException", "The specified log group already exists", nil)
+	}
+	api.describeLogStreams = func(*cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+		return &cloudwatchlogs.DescribeLogStreamsOutput{}, nil
+	}
+
+	c := newTestClient(config{groupRetentions: []groupRetention{{pattern: "*", days: 7}}}, api)
+
+	if _, err := c.Open("A", "0"); err == nil {
+		t.Error("the stream not being found after it already existed should be reported")
+	}
+
+	if len(api.retentions) != 0 {
+		t.Errorf("the retention should not be set on an existing group: %d", len(api.retentions))
+	}
+}
+
+func TestCreateThrottled(t *testing.T) {
+	var calls int
+
+	api := &mockAPI{}
+	api.createLogGroup = func(*cloudwatchlogs.CreateLogGroupInput) error {
+		if calls++; calls < 3 {
+			return awserr.New("ThrottlingException", "Rate exceeded", nil)
+		}
+		return nil
+	}
+
+	f := newFakeClock()
+	c := newTestClient(config{}, api)
+	c.clock = f
+
+	if _, err := c.Open("A", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 3 || len(api.streams) != 1 {
+		t.Errorf("the throttled creation should be retried: %d calls", calls)
+	}
+
+	if f.Slept() == 0 {
+		t.Error("the throttled calls should back off")
+	}
+}
+
+func TestCreateConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(nil)
+
+	if c := getConfig(); c.createRateLimit != defaultCreateRateLimit || c.createConcurrency != defaultCreateConcurrency {
+		t.Errorf("invalid default creation limits: %v, %d", c.createRateLimit, c.createConcurrency)
+	}
+
+	if c := getConfig(); c.streamRateLimit != defaultStreamRateLimit {
+		t.Errorf("invalid default stream rate limit: %v", c.streamRateLimit)
+	}
+
+	lib.SetConfigEnv(map[string]string{
+		"CLOUDWATCHLOGS_CREATE_RATE_LIMIT":  "2.5",
+		"CLOUDWATCHLOGS_CREATE_CONCURRENCY": "1",
+	})
+
+	if c := getConfig(); c.err != nil || c.createRateLimit != 2.5 || c.createConcurrency != 1 {
+		t.Errorf("invalid creation limits: %v, %d (%v)", c.createRateLimit, c.createConcurrency, c.err)
+	}
+
+	lib.SetConfigEnv(map[string]string{"CLOUDWATCHLOGS_CREATE_CONCURRENCY": "0"})
+
+	if c := getConfig(); c.err == nil {
+		t.Error("a zero concurrency should be rejected")
+	}
+}
@@ -0,0 +1,84 @@
+package cloudwatchlogs
+
+import (
+	"time"
+
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+const (
+	// The credentials are refreshed this long before they expire by default,
+	// which leaves room for STS being slow or failing a couple of times.
+	defaultCredentialsRefresh = 5 * time.Minute
+
+	// The minimum time between two checks of the credentials expiry, so
+	// credentials that live shorter than the refresh window don't get
+	// refreshed in a loop.
+	minCredentialsCheck = time.Minute
+)
+
+// renewableCredentials is implemented by *credentials.Credentials.
+type renewableCredentials interface {
+	expirer
+	ExpiresAt() (time.Time, error)
+	Get() (credentials.Value, error)
+}
+
+// renewCredentials refreshes creds ahead of their expiry for as long as they
+// have one. The SDK only refreshes credentials on the first request made after
+// they expired, after a quiet period or a long backoff that request often goes
+// out with the old credentials and fails.
+func (c *client) renewCredentials(creds renewableCredentials) {
+	for {
+		wait, ok := c.renewExpiringCredentials(creds)
+
+		if !ok {
+			return
+		}
+
+		<-c.clock.NewTimer(wait).C()
+	}
+}
+
+// renewExpiringCredentials refreshes creds if they expire within the refresh
+// window, it returns how long to wait before checking them again, or false if
+// they never expire.
+func (c *client) renewExpiringCredentials(creds renewableCredentials) (wait time.Duration, ok bool) {
+	var expiresAt time.Time
+	var err error
+	var window = c.config.credentialsRefresh
+
+	if expiresAt, err = creds.ExpiresAt(); err != nil {
+		// The provider doesn't support expiring credentials.
+		return
+	}
+
+	// The expiry is zero before the credentials were first retrieved, and
+	// when the provider of a chain that found them doesn't expire them.
+	if !expiresAt.IsZero() {
+		if wait = expiresAt.Sub(c.clock.Now()) - window; wait > 0 {
+			return maxDuration(wait, minCredentialsCheck), true
+		}
+		creds.Expire()
+	}
+
+	if _, err = creds.Get(); err != nil {
+		log.WithError(err).Warn("failed to refresh the AWS credentials ahead of their expiry")
+		return minCredentialsCheck, true
+	}
+
+	if expiresAt, err = creds.ExpiresAt(); err != nil || expiresAt.IsZero() {
+		return
+	}
+
+	wait = expiresAt.Sub(c.clock.Now()) - window
+	return maxDuration(wait, minCredentialsCheck), true
+}
+
+func maxDuration(a time.Duration, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,105 @@
+package cloudwatchlogs
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRenewExpiringCredentials(t *testing.T) {
+	f := newFakeClock()
+	now := f.Now()
+
+	tests := []struct {
+		name    string
+		creds   *mockCredentials
+		wait    time.Duration
+		ok      bool
+		expired int
+	}{
+		{
+			name:    "imminent expiry",
+			creds:   &mockCredentials{expiresAt: now.Add(time.Minute), renewed: now.Add(time.Hour)},
+			wait:    55 * time.Minute,
+			ok:      true,
+			expired: 1,
+		},
+		{
+			name:  "distant expiry",
+			creds: &mockCredentials{expiresAt: now.Add(time.Hour)},
+			wait:  55 * time.Minute,
+			ok:    true,
+		},
+		{
+			name:    "short lived credentials",
+			creds:   &mockCredentials{expiresAt: now.Add(time.Minute), renewed: now.Add(2 * time.Minute)},
+			wait:    minCredentialsCheck,
+			ok:      true,
+			expired: 1,
+		},
+		{
+			name:  "not retrieved yet",
+			creds: &mockCredentials{renewed: now.Add(time.Hour)},
+		},
+		{
+			name:  "provider without expiry",
+			creds: &mockCredentials{err: errors.New("ProviderNotExpirer")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newTestClient(config{credentialsRefresh: defaultCredentialsRefresh}, &mockAPI{})
+			c.clock = f
+			c.lazy.Init(c.init)
+
+			wait, ok := c.renewExpiringCredentials(test.creds)
+
+			if wait != test.wait || ok != test.ok {
+				t.Errorf("invalid next check: %s (%t) != %s (%t)", wait, ok, test.wait, test.ok)
+			}
+
+			if test.creds.expired != test.expired {
+				t.Errorf("the credentials should have been expired %d time(s): %d", test.expired, test.creds.expired)
+			}
+
+			if test.expired != 0 && test.creds.gets != 1 {
+				t.Errorf("the credentials should have been retrieved right after being expired: %d", test.creds.gets)
+			}
+		})
+	}
+}
+
+func TestRenewCredentials(t *testing.T) {
+	f := newFakeClock()
+	creds := &mockCredentials{
+		expiresAt: f.Now().Add(time.Hour),
+		renewed:   f.Now().Add(2 * time.Hour),
+		retrieved: make(chan struct{}, 1),
+	}
+
+	c := newTestClient(config{credentialsRefresh: defaultCredentialsRefresh}, &mockAPI{})
+	c.clock = f
+	c.lazy.Init(c.init)
+
+	go c.renewCredentials(creds)
+
+	// Nothing happens until the credentials get close to their expiry, then
+	// they're refreshed without any request being made.
+	for elapsed := time.Duration(0); ; elapsed += 10 * time.Minute {
+		select {
+		case <-creds.retrieved:
+			if elapsed < 50*time.Minute || creds.expired != 1 {
+				t.Errorf("the credentials should have been refreshed once close to their expiry: %s elapsed, %d refresh(es)", elapsed, creds.expired)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		if elapsed > 2*time.Hour {
+			t.Fatal("the credentials were never refreshed")
+		}
+
+		f.Advance(10 * time.Minute)
+	}
+}
@@ -0,0 +1,209 @@
+package cloudwatchlogs
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+)
+
+const (
+	// The rate of DescribeLogStreams calls across all log groups, CloudWatch
+	// Logs accepts 5 per second per account and region.
+	describeRateLimit = 4
+
+	// The maximum number of attempts of a DescribeLogStreams call that keeps
+	// being throttled, and the maximum number of pages listed to find the
+	// streams of a batch.
+	maxDescribeAttempts = 5
+	maxDescribePages    = 10
+)
+
+// describer fetches the sequence tokens of existing log streams. After an
+// event that invalidates many writers at once, like a CloudWatch Logs outage,
+// all of them recover by describing their stream, which would quickly trip
+// the low rate limit of DescribeLogStreams.
+//
+// Lookups in the same log group are coalesced: only one DescribeLogStreams
+// call runs per group at a time, the streams looked up in the meantime are
+// batched and a single listing of the streams sharing their longest common
+// prefix returns all their tokens.
+type describer struct {
+	mutex   sync.Mutex
+	limiter *limiter
+	groups  map[string]*describeGroup
+}
+
+type describeGroup struct {
+	running *describeBatch
+	pending *describeBatch
+}
+
+type describeBatch struct {
+	streams map[string]bool
+	tokens  map[string]string
+	listed  bool // all the streams with the prefix were listed
+	err     error
+	done    chan struct{}
+}
+
+func newDescriber(l *limiter) *describer {
+	return &describer{
+		limiter: l,
+		groups:  make(map[string]*describeGroup),
+	}
+}
+
+// token returns the sequence token of the given stream, an empty token with no
+// error means that the stream couldn't be described because of throttling and
+// that the retry logic around PutLogEvents has to recover the token.
+func (d *describer) token(client cloudwatchlogsiface.CloudWatchLogsAPI, group string, stream string) (token string, err error) {
+	d.mutex.Lock()
+	g := d.groups[group]
+
+	if g == nil {
+		g = &describeGroup{}
+		d.groups[group] = g
+	}
+
+	b := g.pending
+	leader := b == nil
+
+	if leader {
+		b = &describeBatch{
+			streams: make(map[string]bool),
+			done:    make(chan struct{}),
+		}
+		g.pending = b
+	}
+
+	b.streams[stream] = true
+	prev := g.running
+	d.mutex.Unlock()
+
+	if leader {
+		if prev != nil {
+			<-prev.done
+		}
+
+		d.limiter.wait(false)
+
+		// Streams can't be added to the batch once it started listing, the
+		// following lookups go to a new one.
+		d.mutex.Lock()
+		g.pending, g.running = nil, b
+		d.mutex.Unlock()
+
+		b.tokens, b.listed, b.err = d.describe(client, group, b.streams)
+
+		d.mutex.Lock()
+		if g.running = nil; g.pending == nil {
+			delete(d.groups, group)
+		}
+		d.mutex.Unlock()
+
+		close(b.done)
+	}
+
+	<-b.done
+
+	if err = b.err; err != nil {
+		return
+	}
+
+	token, found := b.tokens[stream]
+
+	// Only streams that ecs-logs failed to create because they already
+	// existed are described, this should be an invariant.
+	if !found && b.listed {
+		err = fmt.Errorf("Assertion failure: Log stream %s: %s not found", group, stream)
+	}
+
+	return
+}
+
+func (d *describer) describe(client cloudwatchlogsiface.CloudWatchLogsAPI, group string, streams map[string]bool) (tokens map[string]string, listed bool, err error) {
+	var result *cloudwatchlogs.DescribeLogStreamsOutput
+	var names = make([]string, 0, len(streams))
+
+	for name := range streams {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	tokens = make(map[string]string, len(names))
+
+	input := &cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName: aws.String(group),
+	}
+
+	if prefix := commonPrefix(names); len(prefix) != 0 {
+		input.LogStreamNamePrefix = aws.String(prefix)
+	}
+
+	for page := 1; ; page++ {
+		for attempt := 1; true; attempt++ {
+			if page != 1 || attempt != 1 {
+				d.limiter.wait(false)
+			}
+
+			if result, err = client.DescribeLogStreams(input); err == nil {
+				d.limiter.succeeded()
+				break
+			}
+
+			if !isThrottled(err) {
+				return
+			}
+
+			if attempt == maxDescribeAttempts {
+				// Giving up on the tokens that weren't found yet, the writers
+				// move on without and let PutLogEvents report the expected
+				// ones.
+				err = nil
+				return
+			}
+
+			d.limiter.throttled()
+		}
+
+		for _, s := range result.LogStreams {
+			if name := aws.StringValue(s.LogStreamName); streams[name] {
+				tokens[name] = aws.StringValue(s.UploadSequenceToken)
+			}
+		}
+
+		if len(tokens) == len(names) {
+			return
+		}
+
+		if input.NextToken = result.NextToken; input.NextToken == nil {
+			listed = true
+			return
+		}
+
+		if page == maxDescribePages {
+			return
+		}
+	}
+}
+
+func commonPrefix(names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	// The names are sorted, the common prefix of the first and last ones is
+	// the prefix of all of them.
+	first, last := names[0], names[len(names)-1]
+	i := 0
+
+	for i < len(first) && i < len(last) && first[i] == last[i] {
+		i++
+	}
+
+	return first[:i]
+}
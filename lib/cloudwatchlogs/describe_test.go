@@ -0,0 +1,181 @@
+package cloudwatchlogs
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// describeStreams returns a mock of DescribeLogStreams listing the given
+// streams, the sequence token of each stream is its name.
+func describeStreams(names []string, calls *[]*cloudwatchlogs.DescribeLogStreamsInput, mutex *sync.Mutex) func(*cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+	return func(input *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+		mutex.Lock()
+		*calls = append(*calls, input)
+		mutex.Unlock()
+
+		res := &cloudwatchlogs.DescribeLogStreamsOutput{}
+
+		for _, name := range names {
+			if strings.HasPrefix(name, aws.StringValue(input.LogStreamNamePrefix)) {
+				res.LogStreams = append(res.LogStreams, &cloudwatchlogs.LogStream{
+					LogStreamName:       aws.String(name),
+					UploadSequenceToken: aws.String(name),
+				})
+			}
+		}
+
+		return res, nil
+	}
+}
+
+func TestDescribeCoalesced(t *testing.T) {
+	const writers = 20
+
+	var mutex sync.Mutex
+	var calls []*cloudwatchlogs.DescribeLogStreamsInput
+	var names []string
+
+	for i := 0; i != writers; i++ {
+		names = append(names, fmt.Sprintf("web-%d", i))
+	}
+
+	list := describeStreams(names, &calls, &mutex)
+	release := make(chan struct{})
+	once := sync.Once{}
+
+	api := &mockAPI{existingStreams: true}
+	api.describeLogStreams = func(input *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+		// The first call is held until all the other writers are waiting, so
+		// they're all batched in the second one.
+		once.Do(func() { <-release })
+		return list(input)
+	}
+
+	c := newTestClient(config{}, api)
+	d := c.getDescriber()
+
+	var wg sync.WaitGroup
+	var errs = make(chan error, writers)
+
+	for _, name := range names {
+		wg.Add(1)
+		go func(stream string) {
+			defer wg.Done()
+			if _, err := c.Open("A", stream); err != nil {
+				errs <- err
+			}
+		}(name)
+	}
+
+	for waiting := 0; waiting != writers-1; {
+		time.Sleep(time.Millisecond)
+		d.mutex.Lock()
+		if g := d.groups["A"]; g != nil && g.running != nil && g.pending != nil {
+			waiting = len(g.running.streams) + len(g.pending.streams) - 1
+		}
+		d.mutex.Unlock()
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if len(calls) != 2 {
+		t.Errorf("the concurrent lookups should be coalesced into 2 calls to DescribeLogStreams: %d", len(calls))
+	}
+
+	if n := len(calls); n != 0 && aws.StringValue(calls[n-1].LogStreamNamePrefix) != "web-" {
+		t.Errorf("the batched streams should be listed by their common prefix: %q", aws.StringValue(calls[n-1].LogStreamNamePrefix))
+	}
+
+	for _, name := range names {
+		if w := c.get("A", name); w.token != name {
+			t.Errorf("%s: invalid sequence token: %q", name, w.token)
+		}
+	}
+}
+
+func TestDescribePaced(t *testing.T) {
+	var mutex sync.Mutex
+	var calls []*cloudwatchlogs.DescribeLogStreamsInput
+
+	api := &mockAPI{existingStreams: true}
+	api.describeLogStreams = describeStreams([]string{"0"}, &calls, &mutex)
+
+	f := newFakeClock()
+	c := newTestClient(config{}, api)
+	c.clock = f
+
+	const groups = 10
+
+	for i := 0; i != groups; i++ {
+		if _, err := c.Open(fmt.Sprintf("group-%d", i), "0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(calls) != groups {
+		t.Errorf("invalid number of calls to DescribeLogStreams: %d", len(calls))
+	}
+
+	// The burst of the limiter goes through, the following calls are spread
+	// at the describe rate.
+	if min := time.Second * (groups - describeRateLimit) / describeRateLimit; f.Slept() < min {
+		t.Errorf("the calls to DescribeLogStreams should be paced, waited %s instead of at least %s", f.Slept(), min)
+	}
+}
+
+func TestDescribeThrottled(t *testing.T) {
+	var calls int
+
+	api := &mockAPI{existingStreams: true}
+	api.describeLogStreams = func(input *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+		calls++
+		return nil, awserr.New("ThrottlingException", "Rate exceeded", nil)
+	}
+
+	f := newFakeClock()
+	c := newTestClient(config{}, api)
+	c.clock = f
+
+	w, err := c.Open("A", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != maxDescribeAttempts {
+		t.Errorf("invalid number of calls to DescribeLogStreams: %d", calls)
+	}
+
+	if f.Slept() == 0 {
+		t.Error("the throttled calls should back off")
+	}
+
+	// The writer moves on without a token and lets PutLogEvents report it.
+	if w.(*writer).token != "" {
+		t.Errorf("invalid sequence token: %q", w.(*writer).token)
+	}
+}
+
+func TestDescribeNotFound(t *testing.T) {
+	var mutex sync.Mutex
+	var calls []*cloudwatchlogs.DescribeLogStreamsInput
+
+	api := &mockAPI{existingStreams: true}
+	api.describeLogStreams = describeStreams([]string{"web-1"}, &calls, &mutex)
+
+	if _, err := newTestClient(config{}, api).Open("A", "web"); err == nil {
+		t.Error("opening a stream that can't be found should fail")
+	}
+}
@@ -0,0 +1,59 @@
+package cloudwatchlogs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+// awsEndpoint describes how the endpoint of CloudWatch Logs is picked, the
+// zero value lets the SDK resolve the standard endpoint of the region.
+type awsEndpoint struct {
+	// The URL of the endpoint, set to override the resolution (like for VPC
+	// endpoints or local emulators). It wins over fips.
+	url string
+
+	// When set the FIPS endpoint of the region is used, the regions where
+	// CloudWatch Logs has none are rejected.
+	fips bool
+}
+
+func getAwsEndpoint() (e awsEndpoint, err error) {
+	e.url = strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_ENDPOINT"))
+
+	if s := strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_FIPS_ENDPOINT")); len(s) != 0 {
+		if e.fips, err = strconv.ParseBool(s); err != nil {
+			err = fmt.Errorf("invalid CLOUDWATCHLOGS_FIPS_ENDPOINT, must be a boolean: %s", s)
+		}
+	}
+
+	return
+}
+
+// resolve returns the URL of the endpoint in region, or an empty string when
+// the SDK should resolve it.
+func (e awsEndpoint) resolve(region string) (url string, err error) {
+	if len(e.url) != 0 || !e.fips {
+		url = e.url
+		return
+	}
+
+	// Strict matching prevents the resolver from making up the name of an
+	// endpoint that doesn't exist for the regions it doesn't know about.
+	res, err := endpoints.DefaultResolver().EndpointFor(cloudwatchlogs.EndpointsID, region, func(o *endpoints.Options) {
+		o.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+		o.StrictMatching = true
+	})
+
+	if err != nil {
+		err = fmt.Errorf("CloudWatch Logs has no FIPS endpoint in the %s region, unset CLOUDWATCHLOGS_FIPS_ENDPOINT or set CLOUDWATCHLOGS_ENDPOINT: %s", region, err)
+		return
+	}
+
+	url = res.URL
+	return
+}
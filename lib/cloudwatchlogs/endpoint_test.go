@@ -0,0 +1,65 @@
+package cloudwatchlogs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+func TestAwsEndpointResolve(t *testing.T) {
+	tests := []struct {
+		endpoint awsEndpoint
+		region   string
+		url      string
+	}{
+		{endpoint: awsEndpoint{}, region: "us-east-1", url: ""},
+		{endpoint: awsEndpoint{fips: true}, region: "us-east-1", url: "https://logs-fips.us-east-1.amazonaws.com"},
+		{endpoint: awsEndpoint{fips: true}, region: "us-west-2", url: "https://logs-fips.us-west-2.amazonaws.com"},
+		{endpoint: awsEndpoint{fips: true}, region: "us-gov-west-1", url: "https://logs.us-gov-west-1.amazonaws.com"},
+		{endpoint: awsEndpoint{url: "https://logs.vpce.example.com"}, region: "us-east-1", url: "https://logs.vpce.example.com"},
+
+		// The custom endpoint wins, even in regions without FIPS endpoints.
+		{endpoint: awsEndpoint{url: "https://logs.vpce.example.com", fips: true}, region: "eu-west-1", url: "https://logs.vpce.example.com"},
+	}
+
+	for _, test := range tests {
+		url, err := test.endpoint.resolve(test.region)
+
+		if err != nil {
+			t.Errorf("%+v in %s: %s", test.endpoint, test.region, err)
+		} else if url != test.url {
+			t.Errorf("%+v in %s: invalid endpoint: %q", test.endpoint, test.region, url)
+		}
+	}
+}
+
+func TestAwsEndpointNoFIPS(t *testing.T) {
+	for _, region := range []string{"eu-west-1", "cn-north-1", "mars-1"} {
+		_, err := awsEndpoint{fips: true}.resolve(region)
+
+		if err == nil {
+			t.Errorf("%s: resolving a FIPS endpoint should fail", region)
+		} else if !strings.Contains(err.Error(), "no FIPS endpoint in the "+region+" region") {
+			t.Errorf("%s: the error should explain that the region has no FIPS endpoint: %s", region, err)
+		}
+	}
+}
+
+func TestGetAwsEndpoint(t *testing.T) {
+	lib.SetConfigEnv(map[string]string{
+		"CLOUDWATCHLOGS_ENDPOINT":      "http://localhost:4566",
+		"CLOUDWATCHLOGS_FIPS_ENDPOINT": "true",
+	})
+	defer lib.SetConfigEnv(nil)
+
+	if e, err := getAwsEndpoint(); err != nil || e != (awsEndpoint{url: "http://localhost:4566", fips: true}) {
+		t.Errorf("invalid endpoint: %+v (%v)", e, err)
+	}
+
+	lib.SetConfigEnv(map[string]string{"CLOUDWATCHLOGS_FIPS_ENDPOINT": "fips"})
+
+	if err := getConfig().check(); err == nil || !strings.Contains(err.Error(), "CLOUDWATCHLOGS_FIPS_ENDPOINT") {
+		t.Errorf("an invalid CLOUDWATCHLOGS_FIPS_ENDPOINT should be reported: %v", err)
+	}
+}
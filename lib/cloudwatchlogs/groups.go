@@ -0,0 +1,238 @@
+package cloudwatchlogs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+)
+
+// The limits that CloudWatch Logs puts on the tags of a log group.
+const (
+	maxGroupTags      = 50
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+)
+
+// groupSettings are the properties that the log groups are created with.
+type groupSettings struct {
+	class     string
+	retention int64
+	tags      map[string]string
+	kmsKey    string
+
+	// Whether the groups that already exist are given the retention, tags
+	// and KMS key as well.
+	reconcile bool
+}
+
+// groupSettings returns the settings of the given log group.
+func (c config) groupSettings(group string) groupSettings {
+	return groupSettings{
+		class:     c.groupClass,
+		retention: c.retention(group),
+		tags:      c.groupTags,
+		kmsKey:    c.kmsKey,
+		reconcile: c.reconcileGroups,
+	}
+}
+
+// empty returns true if there's nothing to bring the existing groups in line
+// with.
+func (s groupSettings) empty() bool {
+	return s.retention == 0 && len(s.tags) == 0 && len(s.kmsKey) == 0
+}
+
+// reconcileGroup applies the settings that the existing group doesn't have
+// yet, so running it again once they're applied makes no more changes. Tags
+// that ecs-logs doesn't manage are left as they are, and so is a retention
+// when none is configured for the group.
+//
+// It runs once per group for the lifetime of the creator, the failures are
+// only logged since a missing permission to change the group must not prevent
+// writing to it.
+func (c *creator) reconcileGroup(client cloudwatchlogsiface.CloudWatchLogsAPI, group string, settings groupSettings) {
+	c.mutex.Lock()
+	done := c.reconciled[group]
+	c.reconciled[group] = true
+	c.mutex.Unlock()
+
+	if done {
+		return
+	}
+
+	if err := c.applyGroupSettings(client, group, settings); err != nil {
+		log.WithFields(log.Fields{"group": group, "error": err}).Warn("failed to apply the retention, tags or KMS key to the existing CloudWatch Logs group")
+	}
+}
+
+func (c *creator) applyGroupSettings(client cloudwatchlogsiface.CloudWatchLogsAPI, group string, settings groupSettings) (err error) {
+	var current *cloudwatchlogs.LogGroup
+
+	if current, err = c.describeGroup(client, group); err != nil || current == nil {
+		return
+	}
+
+	if settings.retention != 0 && aws.Int64Value(current.RetentionInDays) != settings.retention {
+		if err = c.call(func() (err error) {
+			_, err = client.PutRetentionPolicy(&cloudwatchlogs.PutRetentionPolicyInput{
+				LogGroupName:    aws.String(group),
+				RetentionInDays: aws.Int64(settings.retention),
+			})
+			return
+		}); err != nil {
+			return
+		}
+	}
+
+	if len(settings.kmsKey) != 0 && aws.StringValue(current.KmsKeyId) != settings.kmsKey {
+		if err = c.call(func() (err error) {
+			_, err = client.AssociateKmsKey(&cloudwatchlogs.AssociateKmsKeyInput{
+				LogGroupName: aws.String(group),
+				KmsKeyId:     aws.String(settings.kmsKey),
+			})
+			return
+		}); err != nil {
+			return
+		}
+	}
+
+	if len(settings.tags) == 0 {
+		return
+	}
+
+	// The tagging API takes the ARN of the group without the :* suffix that
+	// the Arn field has.
+	arn := aws.StringValue(current.LogGroupArn)
+
+	if len(arn) == 0 {
+		arn = strings.TrimSuffix(aws.StringValue(current.Arn), ":*")
+	}
+
+	var tags map[string]*string
+
+	if err = c.call(func() error {
+		res, err := client.ListTagsForResource(&cloudwatchlogs.ListTagsForResourceInput{
+			ResourceArn: aws.String(arn),
+		})
+		if err == nil {
+			tags = res.Tags
+		}
+		return err
+	}); err != nil {
+		return
+	}
+
+	missing := make(map[string]*string)
+
+	for k, v := range settings.tags {
+		if t, ok := tags[k]; !ok || aws.StringValue(t) != v {
+			missing[k] = aws.String(v)
+		}
+	}
+
+	if len(missing) == 0 {
+		return
+	}
+
+	return c.call(func() (err error) {
+		_, err = client.TagResource(&cloudwatchlogs.TagResourceInput{
+			ResourceArn: aws.String(arn),
+			Tags:        missing,
+		})
+		return
+	})
+}
+
+// describeGroup returns the description of group, or nil if it doesn't
+// exist. The groups are listed by prefix so other groups sharing the name of
+// this one as prefix may have to be skipped.
+func (c *creator) describeGroup(client cloudwatchlogsiface.CloudWatchLogsAPI, group string) (found *cloudwatchlogs.LogGroup, err error) {
+	input := &cloudwatchlogs.DescribeLogGroupsInput{
+		LogGroupNamePrefix: aws.String(group),
+	}
+
+	for found == nil {
+		var res *cloudwatchlogs.DescribeLogGroupsOutput
+
+		if err = c.call(func() (err error) { res, err = client.DescribeLogGroups(input); return }); err != nil {
+			return
+		}
+
+		for _, g := range res.LogGroups {
+			if aws.StringValue(g.LogGroupName) == group {
+				found = g
+				break
+			}
+		}
+
+		if input.NextToken = res.NextToken; len(aws.StringValue(input.NextToken)) == 0 {
+			break
+		}
+	}
+
+	return
+}
+
+// awsTags converts tags to the map that the SDK takes, nil when it's empty
+// since CloudWatch Logs rejects an empty map.
+func awsTags(tags map[string]string) map[string]*string {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	m := make(map[string]*string, len(tags))
+
+	for k, v := range tags {
+		m[k] = aws.String(v)
+	}
+
+	return m
+}
+
+// parseGroupTags parses a comma separated list of key=value pairs, for
+// example "team=platform,env=prod".
+func parseGroupTags(s string) (tags map[string]string, err error) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+
+		i := strings.IndexByte(item, '=')
+
+		if i < 0 {
+			err = fmt.Errorf("invalid CLOUDWATCHLOGS_GROUP_TAGS, expected key=value: %s", item)
+			return
+		}
+
+		key, value := strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+
+		switch {
+		case len(key) == 0 || len(key) > maxTagKeyLength:
+			err = fmt.Errorf("invalid CLOUDWATCHLOGS_GROUP_TAGS, the keys must have 1 to %d characters: %s", maxTagKeyLength, item)
+		case strings.HasPrefix(strings.ToLower(key), "aws:"):
+			err = fmt.Errorf("invalid CLOUDWATCHLOGS_GROUP_TAGS, the aws: prefix is reserved: %s", item)
+		case len(value) > maxTagValueLength:
+			err = fmt.Errorf("invalid CLOUDWATCHLOGS_GROUP_TAGS, the values must have at most %d characters: %s", maxTagValueLength, item)
+		}
+
+		if err != nil {
+			return
+		}
+
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+
+		tags[key] = value
+	}
+
+	if len(tags) > maxGroupTags {
+		err = fmt.Errorf("invalid CLOUDWATCHLOGS_GROUP_TAGS, a log group has at most %d tags: %d", maxGroupTags, len(tags))
+	}
+
+	return
+}
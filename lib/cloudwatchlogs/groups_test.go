@@ -0,0 +1,185 @@
+package cloudwatchlogs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+const testKmsKey = "arn:aws:kms:us-east-1:123456789012:key/0123"
+
+func existingGroupAPI(group *cloudwatchlogs.LogGroup, tags map[string]*string) *mockAPI {
+	api := &mockAPI{}
+	api.createLogGroup = func(*cloudwatchlogs.CreateLogGroupInput) error {
+		return awserr.New("ResourceAlreadyExistsException", "The specified log group already exists", nil)
+	}
+	api.describeLogGroups = func(input *cloudwatchlogs.DescribeLogGroupsInput) (*cloudwatchlogs.DescribeLogGroupsOutput, error) {
+		// A group sharing the prefix comes first, on its own page.
+		if input.NextToken == nil {
+			return &cloudwatchlogs.DescribeLogGroupsOutput{
+				LogGroups: []*cloudwatchlogs.LogGroup{{LogGroupName: aws.String(*input.LogGroupNamePrefix + "/errors")}},
+				NextToken: aws.String("2"),
+			}, nil
+		}
+		return &cloudwatchlogs.DescribeLogGroupsOutput{LogGroups: []*cloudwatchlogs.LogGroup{group}}, nil
+	}
+	api.listTags = func(input *cloudwatchlogs.ListTagsForResourceInput) (*cloudwatchlogs.ListTagsForResourceOutput, error) {
+		if aws.StringValue(input.ResourceArn) != "arn:aws:logs:us-east-1:123456789012:log-group:A" {
+			return nil, awserr.New("ResourceNotFoundException", "not found", nil)
+		}
+		return &cloudwatchlogs.ListTagsForResourceOutput{Tags: tags}, nil
+	}
+	return api
+}
+
+func TestCreateGroupSettings(t *testing.T) {
+	api := &mockAPI{}
+	c := newTestClient(config{
+		groupRetentions: []groupRetention{{pattern: "*", days: 7}},
+		groupTags:       map[string]string{"team": "platform"},
+		kmsKey:          testKmsKey,
+	}, api)
+
+	if _, err := c.Open("A", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	input := api.groups[0]
+
+	if aws.StringValue(input.KmsKeyId) != testKmsKey || aws.StringValue(input.Tags["team"]) != "platform" {
+		t.Errorf("the group should be created with the tags and KMS key: %+v", input)
+	}
+
+	if len(api.retentions) != 1 || len(api.tags) != 0 || len(api.kmsKeys) != 0 {
+		t.Errorf("only the retention should be set after creating the group: %d %d %d", len(api.retentions), len(api.tags), len(api.kmsKeys))
+	}
+}
+
+func TestReconcileGroup(t *testing.T) {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	api := existingGroupAPI(&cloudwatchlogs.LogGroup{
+		LogGroupName:    aws.String("A"),
+		Arn:             aws.String("arn:aws:logs:us-east-1:123456789012:log-group:A:*"),
+		RetentionInDays: aws.Int64(14),
+	}, map[string]*string{
+		"team":  aws.String("other"),
+		"owner": aws.String("someone"),
+	})
+
+	cfg := config{
+		groupRetentions: []groupRetention{{pattern: "*", days: 7}},
+		groupTags:       map[string]string{"team": "platform", "env": "prod"},
+		kmsKey:          testKmsKey,
+	}
+
+	// The existing groups are left alone unless reconciling them is enabled.
+	c := newTestClient(cfg, api)
+
+	if _, err := c.Open("A", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(api.retentions) != 0 || len(api.tags) != 0 || len(api.kmsKeys) != 0 {
+		t.Error("the existing group should not be changed")
+	}
+
+	cfg.reconcileGroups = true
+	c = newTestClient(cfg, api)
+
+	for _, stream := range []string{"0", "1"} {
+		if _, err := c.Open("A", stream); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(api.retentions) != 1 || aws.Int64Value(api.retentions[0].RetentionInDays) != 7 {
+		t.Errorf("the retention should be set once: %+v", api.retentions)
+	}
+
+	if len(api.kmsKeys) != 1 || aws.StringValue(api.kmsKeys[0].KmsKeyId) != testKmsKey {
+		t.Errorf("the KMS key should be associated once: %+v", api.kmsKeys)
+	}
+
+	if len(api.tags) != 1 || len(api.tags[0].Tags) != 2 || api.tags[0].Tags["owner"] != nil {
+		t.Errorf("only the missing or different tags should be set: %+v", api.tags)
+	}
+}
+
+func TestReconcileGroupUpToDate(t *testing.T) {
+	api := existingGroupAPI(&cloudwatchlogs.LogGroup{
+		LogGroupName:    aws.String("A"),
+		LogGroupArn:     aws.String("arn:aws:logs:us-east-1:123456789012:log-group:A"),
+		RetentionInDays: aws.Int64(7),
+		KmsKeyId:        aws.String(testKmsKey),
+	}, map[string]*string{
+		"team": aws.String("platform"),
+	})
+
+	c := newTestClient(config{
+		groupRetentions: []groupRetention{{pattern: "*", days: 7}},
+		groupTags:       map[string]string{"team": "platform"},
+		kmsKey:          testKmsKey,
+		reconcileGroups: true,
+	}, api)
+
+	if _, err := c.Open("A", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(api.retentions) != 0 || len(api.tags) != 0 || len(api.kmsKeys) != 0 {
+		t.Errorf("the group already has its settings, it should not be changed: %d %d %d", len(api.retentions), len(api.tags), len(api.kmsKeys))
+	}
+}
+
+func TestParseGroupTags(t *testing.T) {
+	if tags, err := parseGroupTags(" team=platform, env=prod,empty=,"); err != nil || len(tags) != 3 || tags["env"] != "prod" || tags["empty"] != "" {
+		t.Errorf("invalid tags: %v (%v)", tags, err)
+	}
+
+	if tags, err := parseGroupTags(""); err != nil || tags != nil {
+		t.Errorf("no tags should be parsed: %v (%v)", tags, err)
+	}
+
+	for _, s := range []string{
+		"team",
+		"=platform",
+		"aws:team=platform",
+		"team=" + strings.Repeat("x", 257),
+	} {
+		if _, err := parseGroupTags(s); err == nil {
+			t.Errorf("%s: the tags should be rejected", s)
+		}
+	}
+}
+
+func TestGroupConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(map[string]string{
+		"CLOUDWATCHLOGS_GROUP_TAGS":       "team=platform",
+		"CLOUDWATCHLOGS_KMS_KEY":          testKmsKey,
+		"CLOUDWATCHLOGS_RECONCILE_GROUPS": "true",
+	})
+
+	if c := getConfig(); c.err != nil || c.groupTags["team"] != "platform" || c.kmsKey != testKmsKey || !c.reconcileGroups {
+		t.Errorf("invalid group settings: %+v (%v)", c.groupSettings("A"), c.err)
+	}
+
+	for _, env := range []map[string]string{
+		{"CLOUDWATCHLOGS_KMS_KEY": "alias/logs"},
+		{"CLOUDWATCHLOGS_RECONCILE_GROUPS": "sometimes"},
+		{"CLOUDWATCHLOGS_GROUP_TAGS": "team"},
+	} {
+		lib.SetConfigEnv(env)
+
+		if c := getConfig(); c.err == nil {
+			t.Errorf("%v: the configuration should be rejected", env)
+		}
+	}
+}
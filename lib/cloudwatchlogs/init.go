@@ -3,5 +3,10 @@ package cloudwatchlogs
 import "github.com/segmentio/ecs-logs/lib"
 
 func init() {
-	lib.RegisterDestination("cloudwatchlogs", newClient())
+	lib.RegisterSource("cloudwatchlogs", lib.SourceFunc(NewSource))
+	lib.RegisterDestination("cloudwatchlogs", newClient(getConfig))
+
+	// CloudWatch Logs counts 26 bytes of overhead in the 256 KB limit of each
+	// event.
+	lib.RegisterRecordLimit("cloudwatchlogs", 262144-26)
 }
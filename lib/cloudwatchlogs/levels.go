@@ -0,0 +1,208 @@
+package cloudwatchlogs
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+// levelGroup sends the messages at level or more severe to a separate log
+// group, the group name is a template which may reference the group that the
+// messages were sent to with {group}, for example "{group}/errors".
+type levelGroup struct {
+	level ecslogs.Level
+	group string
+}
+
+// groupRetention sets the retention of the log groups matching pattern.
+type groupRetention struct {
+	pattern string
+	days    int64
+}
+
+// The retention periods accepted by CloudWatch Logs.
+var retentionDays = []int64{1, 3, 5, 7, 14, 30, 60, 90, 120, 150, 180, 365, 400, 545, 731, 1096, 1827, 2192, 2557, 2922, 3288, 3653}
+
+// levelGroup returns the log group that a message of the given group and level
+// is written to.
+func (c config) levelGroup(group string, level ecslogs.Level) string {
+	if level != ecslogs.NONE {
+		for _, g := range c.levelGroups {
+			if level <= g.level {
+				return strings.Replace(g.group, "{group}", group, -1)
+			}
+		}
+	}
+	return group
+}
+
+// retention returns the retention in days of the given log group, zero means
+// the group never expires its events.
+func (c config) retention(group string) int64 {
+	for _, r := range c.groupRetentions {
+		if ok, _ := path.Match(r.pattern, group); ok {
+			return r.days
+		}
+	}
+	return 0
+}
+
+// parseLevelGroups parses a comma separated list of LEVEL=group pairs, for
+// example "ERROR={group}/errors". The returned list is sorted from the most to
+// the least severe level so the first match is the most specific one.
+func parseLevelGroups(s string) (groups []levelGroup, err error) {
+	for _, item := range strings.Split(s, ",") {
+		var lvl ecslogs.Level
+
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+
+		if len(kv) != 2 || len(strings.TrimSpace(kv[1])) == 0 {
+			err = fmt.Errorf("invalid CLOUDWATCHLOGS_LEVEL_GROUPS, expected LEVEL=group: %s", item)
+			return
+		}
+
+		if lvl, err = ecslogs.ParseLevel(strings.ToUpper(strings.TrimSpace(kv[0]))); err != nil || lvl == ecslogs.NONE {
+			err = fmt.Errorf("invalid CLOUDWATCHLOGS_LEVEL_GROUPS, unknown level: %s", item)
+			return
+		}
+
+		group := strings.TrimSpace(kv[1])
+
+		if e := checkTemplate(group, []string{"group"}); e != nil {
+			err = fmt.Errorf("invalid CLOUDWATCHLOGS_LEVEL_GROUPS, %s", e)
+			return
+		}
+
+		groups = append(groups, levelGroup{level: lvl, group: group})
+	}
+
+	sort.SliceStable(groups, func(i int, j int) bool { return groups[i].level < groups[j].level })
+	return
+}
+
+// parseGroupRetentions parses a comma separated list of pattern=days pairs,
+// for example "*/errors=365,*=14".
+func parseGroupRetentions(s string) (retentions []groupRetention, err error) {
+	for _, item := range strings.Split(s, ",") {
+		var days int64
+
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+
+		i := strings.LastIndexByte(item, '=')
+
+		if i < 0 {
+			err = fmt.Errorf("invalid CLOUDWATCHLOGS_RETENTION, expected pattern=days: %s", item)
+			return
+		}
+
+		pattern := strings.TrimSpace(item[:i])
+
+		if _, e := path.Match(pattern, ""); e != nil || len(pattern) == 0 {
+			err = fmt.Errorf("invalid CLOUDWATCHLOGS_RETENTION, bad group pattern: %s", item)
+			return
+		}
+
+		if days, err = strconv.ParseInt(strings.TrimSpace(item[i+1:]), 10, 64); err != nil || !isRetentionDays(days) {
+			err = fmt.Errorf("invalid CLOUDWATCHLOGS_RETENTION, the number of days must be one of %s: %s", joinInts(retentionDays), item)
+			return
+		}
+
+		retentions = append(retentions, groupRetention{
+			pattern: pattern,
+			days:    days,
+		})
+	}
+	return
+}
+
+func isRetentionDays(days int64) bool {
+	for _, d := range retentionDays {
+		if d == days {
+			return true
+		}
+	}
+	return false
+}
+
+func joinInts(list []int64) string {
+	s := make([]string, len(list))
+
+	for i, n := range list {
+		s[i] = strconv.FormatInt(n, 10)
+	}
+
+	return strings.Join(s, ", ")
+}
+
+// levelWriter splits the batches of a stream across the log groups that its
+// messages are routed to by level. Each group has its own writer, and its own
+// sequence token, which are opened when a batch has messages for it.
+type levelWriter struct {
+	client *client
+	group  string
+	stream string
+}
+
+func (w *levelWriter) Close() error {
+	w.client.tokens.save()
+	return nil
+}
+
+func (w *levelWriter) WriteMessage(msg lib.Message) error {
+	return w.WriteMessageBatch(lib.MessageBatch{msg})
+}
+
+func (w *levelWriter) WriteMessageBatch(batch lib.MessageBatch) (err error) {
+	_, err = w.WriteMessageBatchSize(batch)
+	return
+}
+
+func (w *levelWriter) WriteMessageBatchSize(batch lib.MessageBatch) (int, error) {
+	return w.write(batch, lib.WriteMessageBatchSize)
+}
+
+func (w *levelWriter) WriteUrgentMessageBatch(batch lib.MessageBatch) (int, error) {
+	return w.write(batch, lib.WriteUrgentMessageBatch)
+}
+
+func (w *levelWriter) write(batch lib.MessageBatch, write func(lib.Writer, lib.MessageBatch) (int, error)) (size int, err error) {
+	var groups []string
+	var batches = make(map[string]lib.MessageBatch)
+
+	for _, msg := range batch {
+		group := w.client.config.levelGroup(w.group, msg.Event.Level)
+
+		if _, ok := batches[group]; !ok {
+			groups = append(groups, group)
+		}
+
+		batches[group] = append(batches[group], msg)
+	}
+
+	for _, group := range groups {
+		var gw lib.Writer
+		var n int
+		var e error
+
+		if gw, e = w.client.openGroup(group, w.stream); e == nil {
+			n, e = write(gw, batches[group])
+		}
+
+		if size += n; e != nil {
+			err = lib.AppendWriteError(err, e)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,115 @@
+package cloudwatchlogs
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+func TestParseLevelGroups(t *testing.T) {
+	groups, err := parseLevelGroups("WARN={group}/warnings, crit=/app/critical,ERROR={group}/errors")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []levelGroup{
+		{level: ecslogs.CRIT, group: "/app/critical"},
+		{level: ecslogs.ERROR, group: "{group}/errors"},
+		{level: ecslogs.WARN, group: "{group}/warnings"},
+	}
+
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("invalid level groups:\n- expected: %+v\n- found:    %+v", expected, groups)
+	}
+
+	for _, s := range []string{"ERROR", "LOUD=errors", "ERROR={stream}/errors", "ERROR="} {
+		if _, err := parseLevelGroups(s); err == nil {
+			t.Errorf("%#v should be rejected", s)
+		}
+	}
+}
+
+func TestParseGroupRetentions(t *testing.T) {
+	retentions, err := parseGroupRetentions("/app/*=365,*=14")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := config{groupRetentions: retentions}
+
+	for group, days := range map[string]int64{"/app/errors": 365, "all": 14, "/other/all": 0} {
+		if n := c.retention(group); n != days {
+			t.Errorf("invalid retention of %s: %d != %d", group, n, days)
+		}
+	}
+
+	if _, err := parseGroupRetentions("*=15"); err == nil {
+		t.Error("retention periods not supported by CloudWatch Logs should be rejected")
+	}
+}
+
+func TestLevelGroups(t *testing.T) {
+	api := &mockAPI{}
+	api.putLogEvents = func(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+		return &cloudwatchlogs.PutLogEventsOutput{
+			NextSequenceToken: aws.String(aws.StringValue(input.LogGroupName) + "-" + aws.StringValue(input.SequenceToken) + "x"),
+		}, nil
+	}
+
+	c := newTestClient(config{
+		levelGroups:     []levelGroup{{level: ecslogs.ERROR, group: "{group}/errors"}},
+		groupRetentions: []groupRetention{{pattern: "*/errors", days: 365}},
+	}, api)
+
+	for i := 0; i != 2; i++ {
+		w, err := c.Open("app", "0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := w.WriteMessageBatch(lib.MessageBatch{
+			{Group: "app", Stream: "0", Event: ecslogs.Event{Level: ecslogs.INFO, Message: "A"}},
+			{Group: "app", Stream: "0", Event: ecslogs.Event{Level: ecslogs.CRIT, Message: "B"}},
+			{Group: "app", Stream: "0", Event: ecslogs.Event{Level: ecslogs.ERROR, Message: "C"}},
+			{Group: "app", Stream: "0", Event: ecslogs.Event{Message: "D"}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var found []string
+
+	for _, put := range api.puts {
+		events := ""
+		for _, e := range put.LogEvents {
+			var event ecslogs.Event
+			json.Unmarshal([]byte(aws.StringValue(e.Message)), &event)
+			events += event.Message
+		}
+		found = append(found, aws.StringValue(put.LogGroupName)+":"+events+":"+aws.StringValue(put.SequenceToken))
+	}
+
+	// Each group keeps its own sequence token, the second batch of each group
+	// is sent with the token returned for the first one.
+	expected := []string{
+		"app:AD:",
+		"app/errors:BC:",
+		"app:AD:app-x",
+		"app/errors:BC:app/errors-x",
+	}
+
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("invalid calls to PutLogEvents:\n- expected: %v\n- found:    %v", expected, found)
+	}
+
+	if len(api.retentions) != 1 || aws.StringValue(api.retentions[0].LogGroupName) != "app/errors" || aws.Int64Value(api.retentions[0].RetentionInDays) != 365 {
+		t.Errorf("the retention should only be set on the errors group: %v", api.retentions)
+	}
+}
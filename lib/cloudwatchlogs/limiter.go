@@ -0,0 +1,171 @@
+package cloudwatchlogs
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/segmentio/ecs-logs/lib/clock"
+)
+
+// partition holds the writers of a set of log groups along with the rate limiter
+// they share. By default all groups belong to a single partition, configuring
+// per-group partitions prevents throttling in one group from eating into the
+// throughput budget of the others.
+type partition struct {
+	writers *registry
+	limiter *limiter
+}
+
+// The default rate of PutLogEvents calls to each log stream, matching the
+// per-stream quota of CloudWatch Logs.
+const defaultStreamRateLimit = 5
+
+// How the rate of a limiter adapts to throttling: each throttled request
+// multiplies it by throttledRateFactor, down to minRateRatio of the configured
+// rate, and each request that goes through adds recoveredRateRatio of the
+// configured rate back.
+const (
+	throttledRateFactor = 0.5
+	minRateRatio        = 0.1
+	recoveredRateRatio  = 0.05
+)
+
+// limiter is a token bucket limiting the rate of PutLogEvents calls, after
+// CloudWatch Logs throttled a request all calls are also held off for an
+// exponentially growing delay until one succeeds.
+//
+// The rate of a limiter with a configured rate also slows down while requests
+// are being throttled and climbs back to the configured one once they go
+// through, so a burst is spread over time instead of hitting the quota again
+// as soon as the backoff expires.
+type limiter struct {
+	mutex   sync.Mutex
+	max     float64 // the configured rate
+	rate    float64 // the current rate, adapted to throttling
+	tokens  float64
+	last    time.Time
+	until   time.Time
+	urgent  time.Time // when the next urgent request may go
+	backoff backoff.Backoff
+	clock   clock.Clock
+}
+
+func newLimiter(rate float64, clock clock.Clock) *limiter {
+	return &limiter{
+		max:    rate,
+		rate:   rate,
+		tokens: burst(rate),
+		last:   clock.Now(),
+		backoff: backoff.Backoff{
+			Min:    100 * time.Millisecond,
+			Max:    10 * time.Second,
+			Factor: 2,
+			Jitter: true,
+		},
+		clock: clock,
+	}
+}
+
+// wait blocks until the caller is allowed to make a request, urgent requests
+// are the ones carrying batches that reached their maximum latency.
+func (l *limiter) wait(urgent bool) {
+	if delay := l.reserve(urgent); delay > 0 {
+		l.clock.Sleep(context.Background(), delay)
+	}
+}
+
+// reserve takes a token from the bucket and returns how long the caller must
+// wait before using it.
+func (l *limiter) reserve(urgent bool) (delay time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.clock.Now()
+
+	if l.until.After(now) {
+		delay = l.until.Sub(now)
+	}
+
+	if l.rate == 0 {
+		return
+	}
+
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.rate
+	}
+
+	if max := burst(l.rate); l.tokens > max {
+		l.tokens = max
+	}
+
+	l.last = now
+	interval := time.Duration(float64(time.Second) / l.rate)
+
+	if urgent {
+		// Urgent requests only queue up behind each other, they get the
+		// next token ahead of the requests already waiting. This may let
+		// slightly more requests through than the rate for a moment, which
+		// the backoff absorbs if CloudWatch Logs starts throttling.
+		slot := now
+
+		if l.tokens < 1 {
+			slot = now.Add(time.Duration((1 - math.Max(l.tokens, 0)) * float64(interval)))
+		}
+
+		if slot.Before(l.urgent) {
+			slot = l.urgent
+		}
+
+		l.urgent = slot.Add(interval)
+		l.tokens--
+
+		if d := slot.Sub(now); d > delay {
+			delay = d
+		}
+		return
+	}
+
+	// Tokens may go negative, which reserves the next ones for the callers
+	// that are already waiting.
+	if l.tokens--; l.tokens < 0 {
+		if d := time.Duration(-l.tokens * float64(interval)); d > delay {
+			delay = d
+		}
+	}
+
+	return
+}
+
+// throttled is called when a request was throttled by CloudWatch Logs.
+func (l *limiter) throttled() {
+	l.mutex.Lock()
+	l.until = l.clock.Now().Add(l.backoff.Duration())
+
+	if l.max != 0 {
+		l.rate = math.Max(l.rate*throttledRateFactor, l.max*minRateRatio)
+	}
+
+	l.mutex.Unlock()
+}
+
+// succeeded is called when a request went through, resetting the backoff.
+func (l *limiter) succeeded() {
+	l.mutex.Lock()
+	l.backoff.Reset()
+
+	if l.rate < l.max {
+		l.rate = math.Min(l.rate+l.max*recoveredRateRatio, l.max)
+	}
+
+	l.mutex.Unlock()
+}
+
+func burst(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
@@ -0,0 +1,228 @@
+package cloudwatchlogs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/segmentio/ecs-logs/lib/clock"
+)
+
+func newFakeClock() *clock.Fake {
+	return clock.NewFake(time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC))
+}
+
+func TestLimiterRate(t *testing.T) {
+	f := newFakeClock()
+	l := newLimiter(2, f)
+
+	l.wait(false)
+	l.wait(false)
+
+	if d := f.Slept(); d != 0 {
+		t.Errorf("the first calls should fit in the burst but the limiter waited %s", d)
+	}
+
+	l.wait(false)
+
+	if d := f.Slept(); d != 500*time.Millisecond {
+		t.Errorf("invalid delay after the burst: %s", d)
+	}
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	f := newFakeClock()
+	l := newLimiter(0, f)
+
+	for i := 0; i != 100; i++ {
+		l.wait(false)
+	}
+
+	if d := f.Slept(); d != 0 {
+		t.Errorf("an unlimited limiter should never wait but it waited %s", d)
+	}
+}
+
+func TestLimiterThrottled(t *testing.T) {
+	f := newFakeClock()
+	l := newLimiter(0, f)
+
+	l.throttled()
+	l.wait(false)
+
+	if d := f.Slept(); d < l.backoff.Min {
+		t.Errorf("the limiter should back off after being throttled but it waited %s", d)
+	}
+
+	l.succeeded()
+	before := f.Slept()
+	l.wait(false)
+
+	if d := f.Slept() - before; d != 0 {
+		t.Errorf("the limiter should not wait once the backoff expired but it waited %s", d)
+	}
+}
+
+func TestPartitionIsolation(t *testing.T) {
+	tests := []struct {
+		partition string
+		isolated  bool
+	}{
+		{partition: partitionShared, isolated: false},
+		{partition: partitionGroup, isolated: true},
+	}
+
+	for _, test := range tests {
+		throttles := 2
+		api := &mockAPI{}
+		api.putLogEvents = func(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+			if aws.StringValue(input.LogGroupName) == "noisy" && throttles != 0 {
+				throttles--
+				return nil, awserr.New("ThrottlingException", "Rate exceeded", nil)
+			}
+			return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String("next")}, nil
+		}
+
+		f := newFakeClock()
+		c := newTestClient(config{partition: test.partition, rateLimit: 1}, api)
+		c.clock = f
+
+		noisy, err := c.Open("noisy", "0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		quiet, err := c.Open("quiet", "0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := noisy.WriteMessageBatch(makeTestBatch("noisy", "0", 1)); err != nil {
+			t.Errorf("%s: throttled requests should be retried: %s", test.partition, err)
+		}
+
+		before := f.Slept()
+
+		if err := quiet.WriteMessageBatch(makeTestBatch("quiet", "0", 1)); err != nil {
+			t.Error(err)
+		}
+
+		switch waited := f.Slept() - before; {
+		case test.isolated && waited != 0:
+			t.Errorf("%s: the quiet group should not be affected by the noisy group but it waited %s", test.partition, waited)
+		case !test.isolated && waited == 0:
+			t.Errorf("%s: the groups should share the same rate budget", test.partition)
+		}
+	}
+}
+
+func TestLimiterUrgent(t *testing.T) {
+	f := newFakeClock()
+	l := newLimiter(1, f)
+
+	if d := l.reserve(false); d != 0 {
+		t.Errorf("the first call should fit in the burst but the limiter asked to wait %s", d)
+	}
+
+	// Three requests are now queued up, the last one only goes in 3 seconds.
+	for i := 1; i <= 3; i++ {
+		if d := l.reserve(false); d != time.Duration(i)*time.Second {
+			t.Errorf("invalid delay of queued request %d: %s", i, d)
+		}
+	}
+
+	// Urgent requests skip ahead of the queued ones, only waiting for the next
+	// token and for each other.
+	if d := l.reserve(true); d != time.Second {
+		t.Errorf("invalid delay of the first urgent request: %s", d)
+	}
+
+	if d := l.reserve(true); d != 2*time.Second {
+		t.Errorf("invalid delay of the second urgent request: %s", d)
+	}
+
+	// Urgent requests still honor the backoff after being throttled.
+	l.throttled()
+
+	if d := l.reserve(true); d < l.backoff.Min {
+		t.Errorf("urgent requests should back off after being throttled but the limiter asked to wait %s", d)
+	}
+}
+
+func TestLimiterAdaptive(t *testing.T) {
+	l := newLimiter(10, newFakeClock())
+
+	for i := 0; i != 10; i++ {
+		l.throttled()
+	}
+
+	if l.rate != 1 {
+		t.Errorf("the rate should slow down to its minimum while throttled: %v", l.rate)
+	}
+
+	for i := 0; i != 5; i++ {
+		l.succeeded()
+	}
+
+	if l.rate <= 1 || l.rate >= 10 {
+		t.Errorf("the rate should climb back gradually: %v", l.rate)
+	}
+
+	for i := 0; i != 100; i++ {
+		l.succeeded()
+	}
+
+	if l.rate != 10 {
+		t.Errorf("the rate should not go over the configured one: %v", l.rate)
+	}
+
+	// Without a configured rate there's nothing to slow down, the limiter
+	// only backs off.
+	l = newLimiter(0, newFakeClock())
+	l.throttled()
+
+	if l.rate != 0 {
+		t.Errorf("an unlimited limiter should stay unlimited: %v", l.rate)
+	}
+}
+
+func TestStreamRateLimit(t *testing.T) {
+	api := &mockAPI{}
+	f := newFakeClock()
+	c := newTestClient(config{streamRateLimit: 5}, api)
+	c.clock = f
+
+	w0, err := c.Open("A", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w1, err := c.Open("A", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The burst of each stream is its rate, the 5 extra calls to the first
+	// stream are spread over a second.
+	for i := 0; i != 10; i++ {
+		if err := w0.WriteMessageBatch(makeTestBatch("A", "0", 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if d := f.Slept(); d != time.Second {
+		t.Errorf("the calls to the stream should be limited, the writer waited %s", d)
+	}
+
+	before := f.Slept()
+
+	if err := w1.WriteMessageBatch(makeTestBatch("A", "1", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := f.Slept() - before; d != 0 {
+		t.Errorf("the other stream has its own budget, it should not wait but it waited %s", d)
+	}
+}
@@ -0,0 +1,90 @@
+package cloudwatchlogs
+
+import (
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// The hard limits of PutLogEvents, a call breaking any of them fails with an
+// InvalidParameterException and none of its events are written.
+const (
+	// The maximum number of events per call.
+	maxEventsPerCall = 10000
+
+	// The maximum size of a call, the sum of the sizes of the messages plus
+	// 26 bytes for each event.
+	maxCallSize = 1048576
+
+	// The bytes that CloudWatch Logs counts for each event on top of its
+	// message.
+	eventOverhead = 26
+
+	// The maximum size of a message, the 256 KB limit of an event minus its
+	// overhead.
+	maxEventSize = 262144 - eventOverhead
+
+	// The events of a call can't span more than 24 hours.
+	maxCallSpan = 24 * time.Hour
+)
+
+// truncationMarker ends the messages that were cut to fit in an event.
+const truncationMarker = "...[truncated]"
+
+// truncateEvent cuts the message s so it fits in an event with the truncation
+// marker, without breaking a UTF-8 sequence.
+func truncateEvent(s string) string {
+	n := maxEventSize - len(truncationMarker)
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n] + truncationMarker
+}
+
+// splitEvents splits events in the runs that can each be sent with a single
+// PutLogEvents call, in their original order.
+func splitEvents(events []*cloudwatchlogs.InputLogEvent) (chunks [][]*cloudwatchlogs.InputLogEvent) {
+	span := maxCallSpan.Nanoseconds() / int64(time.Millisecond)
+	start, size := 0, 0
+	var min, max int64
+
+	for i, e := range events {
+		n := len(aws.StringValue(e.Message)) + eventOverhead
+		t := aws.Int64Value(e.Timestamp)
+
+		if i != start {
+			lo, hi := min, max
+
+			if t < lo {
+				lo = t
+			}
+
+			if t > hi {
+				hi = t
+			}
+
+			if i-start == maxEventsPerCall || size+n > maxCallSize || hi-lo > span {
+				chunks = append(chunks, events[start:i])
+				start, size = i, 0
+			} else {
+				min, max = lo, hi
+			}
+		}
+
+		if i == start {
+			min, max = t, t
+		}
+
+		size += n
+	}
+
+	if start < len(events) {
+		chunks = append(chunks, events[start:])
+	}
+
+	return
+}
@@ -0,0 +1,123 @@
+package cloudwatchlogs
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+func makeEvents(count int, size int, t time.Time, step time.Duration) (events []*cloudwatchlogs.InputLogEvent) {
+	for i := 0; i != count; i++ {
+		events = append(events, &cloudwatchlogs.InputLogEvent{
+			Message:   aws.String(strings.Repeat("x", size)),
+			Timestamp: aws.Int64(aws.TimeUnixMilli(t.Add(time.Duration(i) * step))),
+		})
+	}
+	return
+}
+
+func chunkLengths(chunks [][]*cloudwatchlogs.InputLogEvent) (n []int) {
+	for _, c := range chunks {
+		n = append(n, len(c))
+	}
+	return
+}
+
+func TestSplitEvents(t *testing.T) {
+	now := time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		events  []*cloudwatchlogs.InputLogEvent
+		lengths []int
+	}{
+		{"count", makeEvents(25000, 1, now, 0), []int{10000, 10000, 5000}},
+		// 1048576 / (100000 + 26) = 10.48 events per call.
+		{"size", makeEvents(25, 100000, now, 0), []int{10, 10, 5}},
+		// The events are 10 hours apart, three of them span 20 hours.
+		{"span", makeEvents(7, 1, now, 10*time.Hour), []int{3, 3, 1}},
+		{"fits", makeEvents(3, 1, now, time.Hour), []int{3}},
+	}
+
+	for _, test := range tests {
+		if n := chunkLengths(splitEvents(test.events)); !reflect.DeepEqual(n, test.lengths) {
+			t.Errorf("%s: invalid chunks: %v", test.name, n)
+		}
+	}
+
+	// The span is checked against the earliest and latest events of the call,
+	// whatever their order.
+	events := append(makeEvents(1, 1, now, 0), makeEvents(1, 1, now.Add(-23*time.Hour), 0)...)
+	events = append(events, makeEvents(1, 1, now.Add(2*time.Hour), 0)...)
+
+	if n := chunkLengths(splitEvents(events)); !reflect.DeepEqual(n, []int{2, 1}) {
+		t.Errorf("unordered events: invalid chunks: %v", n)
+	}
+}
+
+func TestTruncateEvent(t *testing.T) {
+	s := truncateEvent(strings.Repeat("é", maxEventSize))
+
+	if len(s) > maxEventSize || !strings.HasSuffix(s, truncationMarker) || !utf8.ValidString(s) {
+		t.Errorf("invalid truncated event: %d bytes, ends with %q", len(s), s[len(s)-20:])
+	}
+}
+
+func TestWriterSplitsBatches(t *testing.T) {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	api := &mockAPI{}
+	c := newTestClient(config{}, api)
+
+	w, err := c.Open("A", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := makeTestBatch("A", "0", 12000)
+	batch = append(batch, lib.Message{Group: "A", Stream: "0", Event: ecslogs.Event{Message: strings.Repeat("x", 300000)}})
+
+	if err := w.WriteMessageBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+
+	for i, put := range api.puts {
+		size := 0
+
+		for _, e := range put.LogEvents {
+			size += len(aws.StringValue(e.Message)) + eventOverhead
+		}
+
+		if len(put.LogEvents) > maxEventsPerCall || size > maxCallSize {
+			t.Errorf("call #%d is over the limits of PutLogEvents: %d events, %d bytes", i, len(put.LogEvents), size)
+		}
+
+		// Each call uses the token returned by the previous one.
+		if token := aws.StringValue(put.SequenceToken); i != 0 && token != "next" {
+			t.Errorf("call #%d: invalid sequence token: %q", i, token)
+		}
+
+		count += len(put.LogEvents)
+	}
+
+	if len(api.puts) < 2 || count != len(batch) {
+		t.Fatalf("the batch should be split in several calls: %d events in %d calls", count, len(api.puts))
+	}
+
+	last := api.puts[len(api.puts)-1].LogEvents
+	e := aws.StringValue(last[len(last)-1].Message)
+
+	if len(e) > maxEventSize || !strings.HasSuffix(e, truncationMarker) {
+		t.Errorf("the oversized event should be truncated: %d bytes", len(e))
+	}
+}
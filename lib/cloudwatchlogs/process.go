@@ -0,0 +1,206 @@
+package cloudwatchlogs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+const (
+	// The code of the errors returned when the credential process fails, they
+	// aren't retried since running the process again would fail the same way.
+	errCodeCredentialProcess = "CredentialProcessError"
+
+	// How long the credential process may run, it usually makes a network
+	// call to the service vending the credentials.
+	credentialProcessTimeout = time.Minute
+
+	// The maximum number of bytes of the standard error of a failed process
+	// reported in the error.
+	maxCredentialProcessStderr = 512
+)
+
+// processCredentials is a credentials.Provider which runs an external command
+// that vends credentials, like the credential_process of the AWS CLI. The
+// command writes a JSON document to its standard output:
+//
+//	{
+//	  "Version": 1,
+//	  "AccessKeyId": "...",
+//	  "SecretAccessKey": "...",
+//	  "SessionToken": "...",
+//	  "Expiration": "2016-10-12T01:00:00Z"
+//	}
+//
+// The session token and the expiration are optional. The credentials which
+// expire are renewed ahead of time by the client like the ones of the other
+// providers, see renewCredentials.
+//
+// The processcreds package of the SDK isn't used because it writes the standard
+// error of the process to the one of ecs-logs and puts the whole output in its
+// parse errors, secrets included, while the errors are reported here with the
+// standard error of the process and without the output.
+type processCredentials struct {
+	credentials.Expiry
+	command  string
+	expiring bool
+}
+
+func newProcessCredentials(command string) *credentials.Credentials {
+	return credentials.NewCredentials(&processCredentials{command: command})
+}
+
+type processOutput struct {
+	Version         int
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      *time.Time
+}
+
+func (p *processCredentials) Retrieve() (v credentials.Value, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), credentialProcessTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+
+	// The command is run by the shell like the AWS CLI does, so it can
+	// have arguments and quotes.
+	cmd := exec.CommandContext(ctx, "sh", "-c", p.command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err = cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+
+		if len(msg) > maxCredentialProcessStderr {
+			msg = msg[:maxCredentialProcessStderr] + "..."
+		}
+
+		if len(msg) != 0 {
+			msg = ": " + msg
+		}
+
+		err = awserr.New(errCodeCredentialProcess, fmt.Sprintf("the credential process failed (%s)%s", err, msg), err)
+		return
+	}
+
+	var out processOutput
+
+	if err = json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		err = awserr.New(errCodeCredentialProcess, "the credential process returned invalid JSON", err)
+		return
+	}
+
+	switch {
+	case out.Version != 1:
+		err = fmt.Errorf("the credential process returned version %d, only version 1 is supported", out.Version)
+	case len(out.AccessKeyId) == 0:
+		err = fmt.Errorf("the credential process returned no AccessKeyId")
+	case len(out.SecretAccessKey) == 0:
+		err = fmt.Errorf("the credential process returned no SecretAccessKey")
+	}
+
+	if err != nil {
+		err = awserr.New(errCodeCredentialProcess, err.Error(), nil)
+		return
+	}
+
+	if p.expiring = out.Expiration != nil; p.expiring {
+		p.SetExpiration(*out.Expiration, 0)
+	} else {
+		p.SetExpiration(time.Time{}, 0)
+	}
+
+	v = credentials.Value{
+		AccessKeyID:     out.AccessKeyId,
+		SecretAccessKey: out.SecretAccessKey,
+		SessionToken:    out.SessionToken,
+		ProviderName:    "CredentialProcess",
+	}
+	return
+}
+
+// IsExpired returns true if the credentials expired, the ones without an
+// expiration never do.
+func (p *processCredentials) IsExpired() bool {
+	return p.expiring && p.Expiry.IsExpired()
+}
+
+func isCredentialProcessError(err error) bool {
+	return isAwsErrorCode(err, errCodeCredentialProcess)
+}
+
+// profileCredentialProcess returns the credential_process of the AWS profile
+// in use, from the AWS_PROFILE environment variable, in the shared config file
+// of the AWS CLI. It returns an empty string if there's none.
+func profileCredentialProcess() (command string, err error) {
+	path := os.Getenv("AWS_CONFIG_FILE")
+
+	if len(path) == 0 {
+		home, _ := os.UserHomeDir()
+
+		if len(home) == 0 {
+			return
+		}
+
+		path = filepath.Join(home, ".aws", "config")
+	}
+
+	profile := os.Getenv("AWS_PROFILE")
+
+	if len(profile) == 0 {
+		profile = "default"
+	}
+
+	f, err := os.Open(path)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer f.Close()
+
+	// The default profile has no prefix in the config file, unlike the
+	// other ones.
+	section := "profile " + profile
+
+	if profile == "default" {
+		section = "default"
+	}
+
+	inSection := false
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			inSection = strings.TrimSpace(strings.Trim(line, "[]")) == section
+			continue
+		}
+
+		if kv := strings.SplitN(line, "=", 2); inSection && len(kv) == 2 && strings.TrimSpace(kv[0]) == "credential_process" {
+			command = strings.TrimSpace(kv[1])
+		}
+	}
+
+	err = scanner.Err()
+	return
+}
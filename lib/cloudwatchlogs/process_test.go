@@ -0,0 +1,175 @@
+package cloudwatchlogs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	awsclient "github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/segmentio/ecs-logs/lib/clock"
+)
+
+// writeCredentialProcess writes a fake credential helper to dir and returns the
+// command running it. The helper counts its runs in a file next to it and can
+// number the access keys it vends after them with $n.
+func writeCredentialProcess(t *testing.T, dir string, script string) (command string, runs func() string) {
+	f, err := ioutil.TempFile(dir, "helper")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	path := f.Name()
+	count := path + ".count"
+
+	script = "n=$(cat " + count + " 2>/dev/null || echo 0)\nn=$((n+1))\necho $n > " + count + "\n" + script
+
+	if err = ioutil.WriteFile(path, []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	runs = func() string {
+		b, _ := ioutil.ReadFile(count)
+		return strings.TrimSpace(string(b))
+	}
+
+	return "sh " + path, runs
+}
+
+func newTempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ecs-logs-credential-process")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func TestProcessCredentials(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	command, runs := writeCredentialProcess(t, dir, `echo '{"Version":1,"AccessKeyId":"AKID'$n'","SecretAccessKey":"SECRET","SessionToken":"TOKEN"}'`)
+
+	creds := newProcessCredentials(command)
+	v, err := creds.Get()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.AccessKeyID != "AKID1" || v.SecretAccessKey != "SECRET" || v.SessionToken != "TOKEN" {
+		t.Errorf("invalid credentials: %+v", v)
+	}
+
+	// Credentials without an expiration are kept for the life of the client.
+	if _, err = creds.Get(); err != nil || creds.IsExpired() || runs() != "1" {
+		t.Errorf("the credentials without an expiration should not be retrieved again: %v, %s runs", err, runs())
+	}
+}
+
+func TestProcessCredentialsRefresh(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	// The helper vends credentials expiring within the refresh window.
+	expiration := time.Now().Add(time.Minute).UTC().Format(time.RFC3339)
+	command, runs := writeCredentialProcess(t, dir, fmt.Sprintf(`echo '{"Version":1,"AccessKeyId":"AKID'$n'","SecretAccessKey":"SECRET","Expiration":"%s"}'`, expiration))
+
+	c := newTestClient(config{credentialsRefresh: defaultCredentialsRefresh}, &mockAPI{})
+	c.clock = clock.NewFake(time.Now())
+	c.lazy.Init(c.init)
+
+	creds := newProcessCredentials(command)
+
+	if wait, ok := c.renewExpiringCredentials(creds); !ok || wait != minCredentialsCheck {
+		t.Errorf("the credentials should be checked again soon: %s (%t)", wait, ok)
+	}
+
+	if _, ok := c.renewExpiringCredentials(creds); !ok || runs() != "2" {
+		t.Errorf("the credentials should be renewed ahead of their expiry: %s runs", runs())
+	}
+
+	if v, err := creds.Get(); err != nil || v.AccessKeyID != "AKID2" {
+		t.Errorf("the renewed credentials should be used: %+v (%v)", v, err)
+	}
+}
+
+func TestProcessCredentialsFailure(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	command, _ := writeCredentialProcess(t, dir, "echo 'the SSO session expired' >&2\nexit 1")
+
+	_, err := newProcessCredentials(command).Get()
+
+	if !isCredentialProcessError(err) {
+		t.Fatalf("the failure should be reported as a credential process error: %v", err)
+	}
+
+	if !strings.Contains(err.Error(), "the SSO session expired") {
+		t.Error("the error should have the output of the process:", err)
+	}
+
+	r := newRetryer(awsclient.DefaultRetryerMaxNumRetries, nil)
+
+	if r.ShouldRetry(&request.Request{Error: err}) {
+		t.Error("the failures of the credential process should not be retried")
+	}
+
+	for _, script := range []string{
+		"echo 'not json'",
+		`echo '{"Version":2,"AccessKeyId":"AKID","SecretAccessKey":"SECRET"}'`,
+		`echo '{"Version":1,"AccessKeyId":"AKID"}'`,
+	} {
+		command, _ := writeCredentialProcess(t, dir, script)
+
+		if _, err := newProcessCredentials(command).Get(); !isCredentialProcessError(err) {
+			t.Errorf("%s: the output should be rejected: %v", script, err)
+		}
+	}
+}
+
+func TestProfileCredentialProcess(t *testing.T) {
+	f, err := ioutil.TempFile("", "ecs-logs-aws-config")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("[default]\nregion = us-west-2\n\n[profile logs]\n; vended by the SSO helper\ncredential_process = /usr/bin/helper --role logs\n")
+	f.Close()
+
+	restore := map[string]string{}
+
+	for _, k := range []string{"AWS_CONFIG_FILE", "AWS_PROFILE"} {
+		restore[k] = os.Getenv(k)
+	}
+
+	defer func() {
+		for k, v := range restore {
+			os.Setenv(k, v)
+		}
+	}()
+
+	os.Setenv("AWS_CONFIG_FILE", f.Name())
+
+	for profile, expected := range map[string]string{
+		"":        "",
+		"logs":    "/usr/bin/helper --role logs",
+		"missing": "",
+	} {
+		os.Setenv("AWS_PROFILE", profile)
+
+		if command, err := profileCredentialProcess(); err != nil || command != expected {
+			t.Errorf("%q: invalid credential process: %q (%v)", profile, command, err)
+		}
+	}
+}
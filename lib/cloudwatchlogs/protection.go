@@ -0,0 +1,162 @@
+package cloudwatchlogs
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+// How the data protection policies of CloudWatch Logs are handled, they mask
+// the sensitive data of the events when they're stored.
+const (
+	// The policies aren't looked up.
+	protectionIgnore = "ignore"
+
+	// The policies that apply to each log group are looked up when it's first
+	// written to, and a warning lists the data that they mask.
+	protectionDetect = "detect"
+
+	// Same as detect, the data masked in each group is also reported to the
+	// stages redacting data on the host so they leave it to CloudWatch Logs.
+	protectionSkipRedaction = "skip-redaction"
+)
+
+// The prefix of the ARNs of the managed data identifiers, the identifiers are
+// reported without it (EmailAddress for example).
+const managedIdentifierPrefix = "arn:aws:dataprotection::aws:data-identifier/"
+
+// protection looks up the data protection policies that apply to the log
+// groups, the account policies are looked up once and apply to all of them.
+type protection struct {
+	mode string
+
+	mutex   sync.Mutex
+	account []string
+	fetched bool
+	groups  map[string]bool
+}
+
+func newProtection(mode string) *protection {
+	return &protection{mode: mode, groups: make(map[string]bool)}
+}
+
+// check looks up the policies that apply to group the first time it's called
+// for it. The failures are only logged, a missing permission to read the
+// policies must not prevent writing the logs.
+func (p *protection) check(client cloudwatchlogsiface.CloudWatchLogsAPI, group string) {
+	if p == nil || p.mode == protectionIgnore || len(p.mode) == 0 {
+		return
+	}
+
+	// The lookups are made once per group, holding the lock while they run
+	// keeps the writers of new groups from making the same calls.
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.groups[group] {
+		return
+	}
+
+	p.groups[group] = true
+
+	if !p.fetched {
+		res, err := client.DescribeAccountPolicies(&cloudwatchlogs.DescribeAccountPoliciesInput{
+			PolicyType: aws.String(cloudwatchlogs.PolicyTypeDataProtectionPolicy),
+		})
+
+		if err != nil {
+			log.WithError(err).Warn("failed to look up the account data protection policies of CloudWatch Logs")
+		} else {
+			for _, policy := range res.AccountPolicies {
+				p.account = append(p.account, maskedIdentifiers(aws.StringValue(policy.PolicyDocument))...)
+			}
+		}
+
+		p.fetched = true
+	}
+
+	var masked []string
+	var scopes []string
+
+	if len(p.account) != 0 {
+		masked = append(masked, p.account...)
+		scopes = append(scopes, "account")
+	}
+
+	res, err := client.GetDataProtectionPolicy(&cloudwatchlogs.GetDataProtectionPolicyInput{
+		LogGroupIdentifier: aws.String(group),
+	})
+
+	switch {
+	case err == nil:
+		if ids := maskedIdentifiers(aws.StringValue(res.PolicyDocument)); len(ids) != 0 {
+			masked = append(masked, ids...)
+			scopes = append(scopes, "log group")
+		}
+	case !isAwsErrorCode(err, cloudwatchlogs.ErrCodeResourceNotFoundException):
+		log.WithFields(log.Fields{"group": group, "error": err}).Warn("failed to look up the data protection policy of the CloudWatch Logs group")
+	}
+
+	if masked = uniqueStrings(masked); len(masked) == 0 {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"group":       group,
+		"policies":    strings.Join(scopes, ", "),
+		"identifiers": strings.Join(masked, ", "),
+	}).Warn("CloudWatch Logs masks sensitive data in this log group, the events it stores may differ from the ones that were sent")
+
+	if p.mode == protectionSkipRedaction {
+		lib.SetServerMasking(group, masked)
+	}
+}
+
+// maskedIdentifiers returns the data identifiers that the policy document
+// masks, the statements that only audit the data are ignored.
+func maskedIdentifiers(document string) (ids []string) {
+	var policy struct {
+		Statement []struct {
+			DataIdentifier []string
+			Operation      struct {
+				Deidentify *json.RawMessage
+			}
+		}
+	}
+
+	if len(document) == 0 || json.Unmarshal([]byte(document), &policy) != nil {
+		return
+	}
+
+	for _, s := range policy.Statement {
+		if s.Operation.Deidentify == nil {
+			continue
+		}
+
+		for _, id := range s.DataIdentifier {
+			ids = append(ids, strings.TrimPrefix(id, managedIdentifierPrefix))
+		}
+	}
+
+	return
+}
+
+func uniqueStrings(list []string) []string {
+	sort.Strings(list)
+	res := make([]string, 0, len(list))
+
+	for _, s := range list {
+		if len(res) == 0 || s != res[len(res)-1] {
+			res = append(res, s)
+		}
+	}
+
+	return res
+}
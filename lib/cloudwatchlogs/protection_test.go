@@ -0,0 +1,165 @@
+package cloudwatchlogs
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+const (
+	testAccountPolicy = `{
+		"Name": "account",
+		"Version": "2021-06-01",
+		"Statement": [
+			{"Sid": "audit", "DataIdentifier": ["arn:aws:dataprotection::aws:data-identifier/EmailAddress"], "Operation": {"Audit": {"FindingsDestination": {}}}},
+			{"Sid": "redact", "DataIdentifier": ["arn:aws:dataprotection::aws:data-identifier/EmailAddress"], "Operation": {"Deidentify": {"MaskConfig": {}}}}
+		]
+	}`
+
+	testGroupPolicy = `{
+		"Name": "api",
+		"Version": "2021-06-01",
+		"Statement": [
+			{"Sid": "audit", "DataIdentifier": ["arn:aws:dataprotection::aws:data-identifier/IpAddress"], "Operation": {"Audit": {"FindingsDestination": {}}}},
+			{"Sid": "redact", "DataIdentifier": ["arn:aws:dataprotection::aws:data-identifier/AwsSecretKey", "EmployeeId"], "Operation": {"Deidentify": {"MaskConfig": {}}}}
+		]
+	}`
+)
+
+// logRecorder keeps the entries logged while it's the handler of the logger.
+type logRecorder struct {
+	mutex   sync.Mutex
+	entries []*log.Entry
+}
+
+func (r *logRecorder) HandleLog(e *log.Entry) error {
+	r.mutex.Lock()
+	r.entries = append(r.entries, e)
+	r.mutex.Unlock()
+	return nil
+}
+
+func (r *logRecorder) find(group string) *log.Entry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, e := range r.entries {
+		if e.Fields["group"] == group {
+			return e
+		}
+	}
+	return nil
+}
+
+func newProtectionTestAPI(accountCalls *int, groupCalls map[string]int) *mockAPI {
+	return &mockAPI{
+		describeAccountPolicies: func(input *cloudwatchlogs.DescribeAccountPoliciesInput) (*cloudwatchlogs.DescribeAccountPoliciesOutput, error) {
+			*accountCalls++
+			return &cloudwatchlogs.DescribeAccountPoliciesOutput{AccountPolicies: []*cloudwatchlogs.AccountPolicy{
+				{PolicyName: aws.String("account"), PolicyDocument: aws.String(testAccountPolicy)},
+			}}, nil
+		},
+		getDataProtectionPolicy: func(input *cloudwatchlogs.GetDataProtectionPolicyInput) (*cloudwatchlogs.GetDataProtectionPolicyOutput, error) {
+			group := aws.StringValue(input.LogGroupIdentifier)
+			groupCalls[group]++
+
+			if group != "api" {
+				return nil, awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "no policy", nil)
+			}
+			return &cloudwatchlogs.GetDataProtectionPolicyOutput{PolicyDocument: aws.String(testGroupPolicy)}, nil
+		},
+	}
+}
+
+func TestProtectionDetect(t *testing.T) {
+	logs := &logRecorder{}
+	log.SetHandler(logs)
+	defer log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	accountCalls, groupCalls := 0, map[string]int{}
+	c := newTestClient(config{dataProtection: protectionDetect}, newProtectionTestAPI(&accountCalls, groupCalls))
+
+	for _, name := range [][2]string{{"api", "0"}, {"api", "1"}, {"web", "0"}} {
+		if _, err := c.Open(name[0], name[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if accountCalls != 1 || groupCalls["api"] != 1 || groupCalls["web"] != 1 {
+		t.Errorf("the policies should be looked up once: account=%d groups=%v", accountCalls, groupCalls)
+	}
+
+	if e := logs.find("api"); e == nil || e.Level != log.WarnLevel ||
+		e.Fields["identifiers"] != "AwsSecretKey, EmailAddress, EmployeeId" || e.Fields["policies"] != "account, log group" {
+		t.Errorf("the data masked in the group should be reported: %+v", e)
+	}
+
+	if e := logs.find("web"); e == nil || e.Fields["identifiers"] != "EmailAddress" || e.Fields["policies"] != "account" {
+		t.Errorf("the account policy should apply to all the groups: %+v", e)
+	}
+
+	if lib.ServerMasked("api", "EmailAddress") {
+		t.Error("the masking should only be reported to the stages with skip-redaction")
+	}
+}
+
+func TestProtectionSkipRedaction(t *testing.T) {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+	defer lib.SetServerMasking("api", nil)
+
+	accountCalls, groupCalls := 0, map[string]int{}
+	c := newTestClient(config{dataProtection: protectionSkipRedaction}, newProtectionTestAPI(&accountCalls, groupCalls))
+
+	if _, err := c.Open("api", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"EmailAddress", "AwsSecretKey", "EmployeeId"} {
+		if !lib.ServerMasked("api", id) {
+			t.Errorf("%s: client-side redaction should be skipped for the data masked by CloudWatch Logs", id)
+		}
+	}
+
+	// The IP addresses are only audited, they're still stored unmasked.
+	if lib.ServerMasked("api", "IpAddress") {
+		t.Error("client-side redaction should not be skipped for the audited data")
+	}
+}
+
+func TestProtectionFailures(t *testing.T) {
+	logs := &logRecorder{}
+	log.SetHandler(logs)
+	defer log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	denied := awserr.New("AccessDeniedException", "not authorized", nil)
+	c := newTestClient(config{dataProtection: protectionDetect}, &mockAPI{
+		describeAccountPolicies: func(*cloudwatchlogs.DescribeAccountPoliciesInput) (*cloudwatchlogs.DescribeAccountPoliciesOutput, error) {
+			return nil, denied
+		},
+		getDataProtectionPolicy: func(*cloudwatchlogs.GetDataProtectionPolicyInput) (*cloudwatchlogs.GetDataProtectionPolicyOutput, error) {
+			return nil, denied
+		},
+	})
+
+	// The default mock API panics if the policies are looked up.
+	if _, err := newTestClient(config{}, &mockAPI{}).Open("api", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Open("api", "0"); err != nil {
+		t.Errorf("the writers should open when the policies can't be looked up: %v", err)
+	}
+
+	if len(logs.entries) != 2 {
+		t.Errorf("the failed lookups should be logged: %d entries", len(logs.entries))
+	}
+
+	if err := (config{dataProtection: "mask"}).check(); err == nil {
+		t.Error("an invalid CLOUDWATCHLOGS_DATA_PROTECTION should be rejected")
+	}
+}
@@ -0,0 +1,91 @@
+package cloudwatchlogs
+
+import "sync"
+
+// The number of shards of writer registries, a power of two so the shard of a
+// key is picked with a mask.
+const registryShards = 64
+
+// registry indexes writers by group and stream. The writers are spread across
+// shards which each have their own lock, with thousands of streams being
+// opened and evicted a single lock would serialize all the lookups.
+type registry struct {
+	shards [registryShards]registryShard
+}
+
+type registryShard struct {
+	mutex   sync.Mutex
+	writers map[string]*writer
+}
+
+func newRegistry() *registry {
+	r := &registry{}
+
+	for i := range r.shards {
+		r.shards[i].writers = make(map[string]*writer)
+	}
+
+	return r
+}
+
+func (r *registry) shard(key string) *registryShard {
+	// Inlined 32 bits FNV-1a, hash/fnv would allocate on each lookup.
+	h := uint32(2166136261)
+
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+
+	return &r.shards[h&(registryShards-1)]
+}
+
+// get returns the writer of key, or nil if there is none.
+func (r *registry) get(key string) (w *writer) {
+	s := r.shard(key)
+	s.mutex.Lock()
+	w = s.writers[key]
+	s.mutex.Unlock()
+	return
+}
+
+// getOrCreate returns the writer of key, calling create to make it if there is
+// none. create is called with the shard locked so concurrent callers get the
+// same writer, it must not use the registry.
+func (r *registry) getOrCreate(key string, create func() *writer) (w *writer) {
+	s := r.shard(key)
+	s.mutex.Lock()
+
+	if w = s.writers[key]; w == nil {
+		w = create()
+		s.writers[key] = w
+	}
+
+	s.mutex.Unlock()
+	return
+}
+
+// remove removes the writer of key. When w isn't nil the writer is only
+// removed if it's still w, so a writer giving up doesn't evict the one that
+// replaced it in the meantime.
+func (r *registry) remove(key string, w *writer) {
+	s := r.shard(key)
+	s.mutex.Lock()
+
+	if w == nil || s.writers[key] == w {
+		delete(s.writers, key)
+	}
+
+	s.mutex.Unlock()
+}
+
+// len returns the number of writers in the registry.
+func (r *registry) len() (n int) {
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mutex.Lock()
+		n += len(s.writers)
+		s.mutex.Unlock()
+	}
+	return
+}
@@ -0,0 +1,140 @@
+package cloudwatchlogs
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestRegistryConcurrent(t *testing.T) {
+	r := newRegistry()
+	keys := make([]string, 1000)
+
+	for i := range keys {
+		keys[i] = joinGroupStream("A", strconv.Itoa(i))
+	}
+
+	var join sync.WaitGroup
+	var mutex sync.Mutex
+	var created = map[string]*writer{}
+
+	// All the goroutines race to create the same writers, each key must end
+	// up with a single writer.
+	for g := 0; g != 8; g++ {
+		join.Add(1)
+		go func() {
+			defer join.Done()
+
+			for _, key := range keys {
+				w := r.getOrCreate(key, func() *writer { return &writer{stream: key} })
+
+				mutex.Lock()
+				if prev := created[key]; prev == nil {
+					created[key] = w
+				} else if prev != w {
+					t.Errorf("%s: two writers were created for the same key", key)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	join.Wait()
+
+	if n := r.len(); n != len(keys) {
+		t.Fatalf("invalid number of writers: %d", n)
+	}
+
+	// A writer removing itself after it was replaced keeps the new writer in
+	// the registry.
+	replaced := r.get(keys[0])
+	r.remove(keys[0], nil)
+	current := r.getOrCreate(keys[0], func() *writer { return &writer{} })
+	r.remove(keys[0], replaced)
+
+	if r.get(keys[0]) != current {
+		t.Error("removing a writer that was replaced should not evict the new one")
+	}
+
+	for g := 0; g != 8; g++ {
+		join.Add(1)
+		go func(g int) {
+			defer join.Done()
+
+			for i := g; i < len(keys); i += 8 {
+				r.remove(keys[i], nil)
+			}
+		}(g)
+	}
+
+	join.Wait()
+
+	if n := r.len(); n != 0 {
+		t.Errorf("all the writers should have been removed: %d", n)
+	}
+}
+
+// mutexRegistry is the registry guarded by a single lock that the sharded one
+// replaced, kept to compare them in benchmarks.
+type mutexRegistry struct {
+	mutex   sync.Mutex
+	writers map[string]*writer
+}
+
+func (r *mutexRegistry) getOrCreate(key string, create func() *writer) (w *writer) {
+	r.mutex.Lock()
+	if w = r.writers[key]; w == nil {
+		w = create()
+		r.writers[key] = w
+	}
+	r.mutex.Unlock()
+	return
+}
+
+func (r *mutexRegistry) remove(key string, w *writer) {
+	r.mutex.Lock()
+	if w == nil || r.writers[key] == w {
+		delete(r.writers, key)
+	}
+	r.mutex.Unlock()
+}
+
+type writerRegistry interface {
+	getOrCreate(key string, create func() *writer) *writer
+	remove(key string, w *writer)
+}
+
+func benchmarkRegistry(b *testing.B, r writerRegistry, streams int) {
+	keys := make([]string, streams)
+
+	for i := range keys {
+		keys[i] = joinGroupStream("A", strconv.Itoa(i))
+	}
+
+	create := func() *writer { return &writer{} }
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			key := keys[(i*7919)%len(keys)]
+
+			// One in a hundred lookups evicts the writer, like streams that
+			// went idle or writers that gave up.
+			if w := r.getOrCreate(key, create); i%100 == 0 {
+				r.remove(key, w)
+			}
+		}
+	})
+}
+
+func BenchmarkRegistry(b *testing.B) {
+	for _, streams := range []int{100, 10000} {
+		b.Run("sharded/"+strconv.Itoa(streams), func(b *testing.B) {
+			benchmarkRegistry(b, newRegistry(), streams)
+		})
+
+		b.Run("mutex/"+strconv.Itoa(streams), func(b *testing.B) {
+			benchmarkRegistry(b, &mutexRegistry{writers: make(map[string]*writer)}, streams)
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package cloudwatchlogs
+
+import (
+	"sync"
+
+	awsclient "github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+var (
+	retryerMutex  sync.RWMutex
+	customRetryer request.Retryer
+)
+
+// SetRetryer replaces the retryer of the AWS SDK used by the cloudwatchlogs
+// source and destination, it must be called before the first client is opened
+// (for example in the init function of a package imported by a custom build
+// of ecs-logs). Passing nil restores the SDK's default retryer.
+//
+// The retryer governs the low-level retries of transient errors, like network
+// failures or 5xx responses. The errors that ecs-logs recovers from itself,
+// throttling, invalid sequence tokens and expired credentials, are never
+// retried by the SDK, so they aren't retried by both layers. Neither are the
+// failures of the credential process, which would only fail again.
+func SetRetryer(r request.Retryer) {
+	retryerMutex.Lock()
+	customRetryer = r
+	retryerMutex.Unlock()
+}
+
+// newRetryer returns the retryer that AWS clients are created with, the SDK's
+// default retryer making up to maxRetries retries is used when no custom
+// retryer was set. The retries are denied once the budget of limiter is
+// exhausted, limiter may be nil.
+func newRetryer(maxRetries int, limiter *lib.RetryLimiter) request.Retryer {
+	retryerMutex.RLock()
+	r := customRetryer
+	retryerMutex.RUnlock()
+
+	if r == nil {
+		r = awsclient.DefaultRetryer{NumMaxRetries: maxRetries}
+	}
+
+	return sdkRetryer{r, limiter}
+}
+
+// sdkRetryer wraps a retryer to leave the errors that ecs-logs handles to the
+// retry loops around the API calls. Without it each throttled PutLogEvents
+// attempt of the writers would also be retried by the SDK, multiplying the
+// number of requests instead of backing off.
+type sdkRetryer struct {
+	request.Retryer
+	limiter *lib.RetryLimiter
+}
+
+func (r sdkRetryer) ShouldRetry(req *request.Request) bool {
+	if err := req.Error; err != nil && (isRetriedByCaller(err) || isCredentialProcessError(err)) {
+		return false
+	}
+	return r.Retryer.ShouldRetry(req) && r.limiter.Allow()
+}
+
+func isRetriedByCaller(err error) bool {
+	return isThrottled(err) || isExpiredCredentials(err) || parseInvalidSequenceTokenException(err) != nil
+}
@@ -0,0 +1,212 @@
+package cloudwatchlogs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	awsclient "github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+// countingRetryer retries every error up to its maximum without waiting.
+type countingRetryer struct {
+	max   int
+	calls *int32
+}
+
+func (r countingRetryer) RetryRules(*request.Request) time.Duration { return 0 }
+func (r countingRetryer) MaxRetries() int                           { return r.max }
+
+func (r countingRetryer) ShouldRetry(*request.Request) bool {
+	atomic.AddInt32(r.calls, 1)
+	return true
+}
+
+// newRetryTestClient returns a client configured with cfg sending its requests
+// to a server that replies with the given responses in order, repeating the
+// last one.
+func newRetryTestClient(t *testing.T, cfg config, responses ...string) (c *client, requests *int32, close func()) {
+	var count int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		i := int(atomic.AddInt32(&count, 1)) - 1
+
+		if i >= len(responses) {
+			i = len(responses) - 1
+		}
+
+		switch body := responses[i]; body {
+		case "":
+			res.WriteHeader(http.StatusInternalServerError)
+		case "{}":
+			res.Write([]byte(`{"nextSequenceToken":"43"}`))
+		default:
+			res.WriteHeader(http.StatusBadRequest)
+			res.Write([]byte(body))
+		}
+	}))
+
+	// The credentials are only read when sending the requests, the environment
+	// is restored when the test is done.
+	var restore []func()
+
+	for k, v := range map[string]string{
+		"AWS_REGION":            "us-west-2",
+		"AWS_ACCESS_KEY_ID":     "AKID",
+		"AWS_SECRET_ACCESS_KEY": "SECRET",
+	} {
+		k := k
+		prev, ok := os.LookupEnv(k)
+		os.Setenv(k, v)
+
+		if ok {
+			restore = append(restore, func() { os.Setenv(k, prev) })
+		} else {
+			restore = append(restore, func() { os.Unsetenv(k) })
+		}
+	}
+
+	close = func() {
+		server.Close()
+		for _, f := range restore {
+			f()
+		}
+	}
+
+	c = newTestClient(cfg, nil)
+	c.lazy.Init(c.init)
+
+	api, _, err := openAwsClient(newRetryer(awsclient.DefaultRetryerMaxNumRetries, c.retries), awsEndpoint{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.Endpoint = server.URL
+
+	c.client = api
+	c.get("A", "0").token = "42"
+	return c, &count, close
+}
+
+func TestCustomRetryer(t *testing.T) {
+	var calls int32
+
+	SetRetryer(countingRetryer{max: 2, calls: &calls})
+	defer SetRetryer(nil)
+
+	c, requests, close := newRetryTestClient(t, config{}, "", "", "{}")
+	defer close()
+
+	w, _ := c.Open("A", "0")
+
+	if err := w.WriteMessageBatch(makeTestBatch("A", "0", 1)); err != nil {
+		t.Error(err)
+	}
+
+	if n := atomic.LoadInt32(requests); n != 3 {
+		t.Errorf("the transient errors should be retried by the custom retryer: %d requests", n)
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("the custom retryer should be asked whether to retry the failed requests: %d calls", n)
+	}
+}
+
+func TestRetryerSkipsThrottling(t *testing.T) {
+	var calls int32
+
+	SetRetryer(countingRetryer{max: 10, calls: &calls})
+	defer SetRetryer(nil)
+
+	c, requests, close := newRetryTestClient(t, config{}, `{"__type":"ThrottlingException","message":"Rate exceeded"}`)
+	defer close()
+
+	w, _ := c.Open("A", "0")
+
+	if err := w.WriteMessageBatch(makeTestBatch("A", "0", 1)); err == nil {
+		t.Error("the batch should fail after being throttled too many times")
+	}
+
+	// Only the writer retries throttled requests, after backing off.
+	if n := atomic.LoadInt32(requests); n != maxThrottledAttempts {
+		t.Errorf("throttled requests shouldn't be retried by the SDK: %d requests", n)
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Errorf("the custom retryer shouldn't be asked to retry throttled requests: %d calls", n)
+	}
+}
+
+func TestRetryerSkipsInvalidSequenceToken(t *testing.T) {
+	var calls int32
+
+	SetRetryer(countingRetryer{max: 10, calls: &calls})
+	defer SetRetryer(nil)
+
+	c, requests, close := newRetryTestClient(t, config{},
+		`{"__type":"InvalidSequenceTokenException","message":"The given sequenceToken is invalid. The next expected sequenceToken is: 43","expectedSequenceToken":"43"}`,
+		"{}",
+	)
+	defer close()
+
+	w, _ := c.Open("A", "0")
+
+	if err := w.WriteMessageBatch(makeTestBatch("A", "0", 1)); err != nil {
+		t.Error(err)
+	}
+
+	if n := atomic.LoadInt32(requests); n != 2 {
+		t.Errorf("the writer should resubmit the batch once with the expected token: %d requests", n)
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Errorf("the custom retryer shouldn't be asked to retry invalid sequence tokens: %d calls", n)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	var calls int32
+
+	SetRetryer(countingRetryer{max: 10, calls: &calls})
+	defer SetRetryer(nil)
+
+	// CloudWatch Logs keeps failing, the first batch spends the budget and
+	// the next ones aren't retried at all.
+	c, requests, close := newRetryTestClient(t, config{retryBudget: lib.RetryBudget{Ratio: 0.5, Size: 3}}, "")
+	defer close()
+
+	for i := 0; i != 5; i++ {
+		// The writers are discarded after an error, the new ones get a token
+		// so only PutLogEvents is called.
+		c.get("A", "0").token = "42"
+		w, _ := c.Open("A", "0")
+
+		if err := w.WriteMessageBatch(makeTestBatch("A", "0", 1)); err == nil {
+			t.Error("the batch should fail when the requests keep failing")
+		}
+	}
+
+	if n := atomic.LoadInt32(requests); n != 5+3 {
+		t.Errorf("the retries should be capped by the budget: %d requests", n)
+	}
+}
+
+func TestRetryBudgetThrottling(t *testing.T) {
+	c, requests, close := newRetryTestClient(t, config{retryBudget: lib.RetryBudget{Ratio: 0.5, Size: 2}},
+		`{"__type":"ThrottlingException","message":"Rate exceeded"}`)
+	defer close()
+
+	w, _ := c.Open("A", "0")
+
+	if err := w.WriteMessageBatch(makeTestBatch("A", "0", 1)); err == nil {
+		t.Error("the batch should fail after being throttled")
+	}
+
+	if n := atomic.LoadInt32(requests); n != 3 {
+		t.Errorf("the throttled requests should only be retried within the budget: %d requests", n)
+	}
+}
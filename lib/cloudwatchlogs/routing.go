@@ -0,0 +1,129 @@
+package cloudwatchlogs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/flatten"
+)
+
+// The default name of the routing field, the @ prefix is reserved for fields
+// added by ecs-logs and is never used by the top-level fields of events.
+const defaultRoutingField = "@routingKey"
+
+var routingKeyVariables = []string{"group", "stream", "level"}
+
+// encodeEvent returns the JSON representation of the message event sent to
+// CloudWatch Logs, wrapped in the envelope when one is configured. With raw
+// passthrough the unmodified lines are sent as they were read instead, without
+// the routing key or the flattening of the format.
+func (c config) encodeEvent(msg lib.Message) string {
+	if c.rawPassthrough {
+		if line, ok := msg.RawLine(); ok {
+			return c.envelope.Wrap(line)
+		}
+	}
+	return c.envelope.Wrap(c.encodePayload(msg))
+}
+
+// encodePayload returns the JSON representation of the message event in the
+// configured format.
+//
+// When a routing key is configured it's rendered from the group, stream and
+// level of the message and placed first in the top-level object, next to and
+// not inside the event data, so it can never overwrite user fields.
+func (c config) encodePayload(msg lib.Message) string {
+	if c.format == formatInsights {
+		return c.encodeFlatEvent(msg)
+	}
+
+	if len(c.routingKey) == 0 {
+		return lib.EventString(msg.Event)
+	}
+
+	event, _ := json.Marshal(msg.Event)
+	field, _ := json.Marshal(c.routingField)
+	value, _ := json.Marshal(renderRoutingKey(c.routingKey, msg))
+
+	b := make([]byte, 0, len(event)+len(field)+len(value)+2)
+	b = append(b, '{')
+	b = append(b, field...)
+	b = append(b, ':')
+	b = append(b, value...)
+	b = append(b, ',')
+	b = append(b, event[1:]...)
+	return string(b)
+}
+
+// encodeFlatEvent returns the flattened JSON representation of the message
+// event, which CloudWatch Logs Insights discovers fields from without having to
+// parse nested objects. Keys are sorted so the output is stable.
+func (c config) encodeFlatEvent(msg lib.Message) string {
+	event := flatten.Event(msg.Event)
+
+	if len(c.routingKey) != 0 {
+		if v, exists := event[c.routingField]; exists {
+			event["data."+c.routingField] = v
+		}
+		event[c.routingField] = renderRoutingKey(c.routingKey, msg)
+	}
+
+	b, _ := json.Marshal(event)
+	return string(b)
+}
+
+func renderRoutingKey(template string, msg lib.Message) string {
+	return strings.NewReplacer(
+		"{group}", msg.Group,
+		"{stream}", msg.Stream,
+		"{level}", msg.Event.Level.String(),
+	).Replace(template)
+}
+
+// checkRoutingKey verifies that the template only references known variables,
+// for example "{group}/{level}".
+func checkRoutingKey(template string) error {
+	return checkTemplate(template, routingKeyVariables)
+}
+
+func checkTemplate(template string, variables []string) error {
+	for s := template; len(s) != 0; {
+		i := strings.IndexByte(s, '{')
+
+		if i < 0 {
+			break
+		}
+
+		j := strings.IndexByte(s[i:], '}')
+
+		if j < 0 {
+			return fmt.Errorf("unclosed variable: %s", template)
+		}
+
+		if name := s[i+1 : i+j]; !containsString(variables, name) {
+			return fmt.Errorf("unknown variable {%s}, must be one of {%s}: %s", name, strings.Join(variables, "}, {"), template)
+		}
+
+		s = s[i+j+1:]
+	}
+	return nil
+}
+
+func checkRoutingField(field string) error {
+	switch field {
+	case "level", "time", "info", "data", "message":
+		return fmt.Errorf("%s collides with a field of the log events", field)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package cloudwatchlogs
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+func TestEncodeEventRoutingKey(t *testing.T) {
+	c := config{
+		routingKey:   "{group}/{stream}/{level}",
+		routingField: defaultRoutingField,
+	}
+
+	msg := lib.Message{
+		Group:  "A",
+		Stream: "B",
+		Event: ecslogs.Event{
+			Level:   ecslogs.ERROR,
+			Message: "Hello World!",
+			Data: ecslogs.EventData{
+				"@routingKey": "user value",
+				"answer":      42,
+			},
+		},
+	}
+
+	s := c.encodeEvent(msg)
+
+	if s != c.encodeEvent(msg) {
+		t.Error("the encoding of identical messages should be stable")
+	}
+
+	var event map[string]interface{}
+
+	if err := json.Unmarshal([]byte(s), &event); err != nil {
+		t.Fatal(err)
+	}
+
+	if key := event["@routingKey"]; key != "A/B/ERROR" {
+		t.Errorf("invalid routing key: %#v", key)
+	}
+
+	// The routing field is set next to the event fields, which must all be
+	// left unchanged.
+	delete(event, "@routingKey")
+
+	var ref map[string]interface{}
+	json.Unmarshal([]byte(msg.Event.String()), &ref)
+
+	if !reflect.DeepEqual(event, ref) {
+		t.Errorf("the routing key should not modify the event:\n- expected: %#v\n- found:    %#v", ref, event)
+	}
+}
+
+func TestEncodeEventWithoutRoutingKey(t *testing.T) {
+	msg := lib.Message{Event: ecslogs.Event{Message: "Hello World!"}}
+
+	if s, ref := (config{routingField: defaultRoutingField}).encodeEvent(msg), msg.Event.String(); s != ref {
+		t.Errorf("events should be encoded unchanged when no routing key is configured:\n- expected: %s\n- found:    %s", ref, s)
+	}
+}
+
+func TestEncodeEventRawPassthrough(t *testing.T) {
+	lib.EnableRawLines()
+
+	const line = `level=error msg="disk full"  device=/dev/xvda`
+	c := config{routingKey: "{group}", routingField: defaultRoutingField, rawPassthrough: true}
+	msg := lib.ParseMessage(lib.GetParser("logfmt"), []byte(line))
+
+	if s := c.encodeEvent(msg); s != line {
+		t.Errorf("the raw line should be sent unchanged: %s", s)
+	}
+
+	msg.Event.Data = ecslogs.EventData{"device": "/dev/xvdb"}
+
+	if s := c.encodeEvent(msg); s == line || !strings.Contains(s, `"/dev/xvdb"`) {
+		t.Errorf("the modified message should be serialized: %s", s)
+	}
+}
+
+func TestWriterRoutingKey(t *testing.T) {
+	api := &mockAPI{}
+	c := newTestClient(config{routingKey: "{group}", routingField: "@route"}, api)
+
+	w, err := c.Open("A", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteMessageBatch(makeTestBatch("A", "0", 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range api.puts[0].LogEvents {
+		var event map[string]interface{}
+		json.Unmarshal([]byte(aws.StringValue(e.Message)), &event)
+
+		if event["@route"] != "A" {
+			t.Errorf("missing routing key in %s", aws.StringValue(e.Message))
+		}
+	}
+}
+
+func TestCheckRoutingKey(t *testing.T) {
+	for _, s := range []string{"", "static", "{group}", "{group}-{stream}:{level}"} {
+		if err := checkRoutingKey(s); err != nil {
+			t.Errorf("%#v: %s", s, err)
+		}
+	}
+
+	for _, s := range []string{"{host}", "{group", "{group}/{"} {
+		if err := checkRoutingKey(s); err == nil {
+			t.Errorf("%#v: expected an error", s)
+		}
+	}
+
+	if err := checkRoutingField("message"); err == nil {
+		t.Error("expected an error when the routing field collides with an event field")
+	}
+}
+
+func TestEncodeEventInsights(t *testing.T) {
+	msg := lib.Message{
+		Group:  "A",
+		Stream: "B",
+		Event: ecslogs.Event{
+			Level:   ecslogs.ERROR,
+			Time:    time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC),
+			Info:    ecslogs.EventInfo{Host: "i-1234", PID: 42},
+			Message: "request failed",
+			Data: ecslogs.EventData{
+				"error":      map[string]interface{}{"code": "E42", "detail": map[string]interface{}{"retryable": true}},
+				"level":      "custom",
+				"tags":       []interface{}{"a", "b"},
+				"@requestId": map[string]interface{}{"id": "abc"},
+				"_aws":       map[string]interface{}{"Timestamp": 1476230400000},
+			},
+		},
+	}
+
+	nested := `{"level":"ERROR","time":"2016-10-12T00:00:00Z","info":{"host":"i-1234","pid":42},` +
+		`"data":{"@requestId":{"id":"abc"},"_aws":{"Timestamp":1476230400000},"error":{"code":"E42","detail":{"retryable":true}},"level":"custom","tags":["a","b"]},` +
+		`"message":"request failed"}`
+
+	flat := `{"@requestId":{"id":"abc"},"_aws":{"Timestamp":1476230400000},"data.level":"custom",` +
+		`"error.code":"E42","error.detail.retryable":true,"info.host":"i-1234","info.pid":42,` +
+		`"level":"ERROR","message":"request failed","tags":["a","b"],"time":"2016-10-12T00:00:00Z"}`
+
+	if s := (config{format: formatJSON}).encodeEvent(msg); s != nested {
+		t.Errorf("invalid nested event:\n- expected: %s\n- found:    %s", nested, s)
+	}
+
+	if s := (config{format: formatInsights}).encodeEvent(msg); s != flat {
+		t.Errorf("invalid flat event:\n- expected: %s\n- found:    %s", flat, s)
+	}
+
+	c := config{format: formatInsights, routingKey: "{group}/{level}", routingField: defaultRoutingField}
+	flat = strings.Replace(flat, `"_aws"`, `"@routingKey":"A/ERROR","_aws"`, 1)
+
+	if s := c.encodeEvent(msg); s != flat {
+		t.Errorf("invalid flat event with a routing key:\n- expected: %s\n- found:    %s", flat, s)
+	}
+
+	if err := (config{format: "xml"}).check(); err == nil {
+		t.Error("expected an error for an unknown CLOUDWATCHLOGS_FORMAT")
+	}
+
+	// The envelope wraps the event in the chosen format.
+	lib.SetConfigEnv(map[string]string{"CLOUDWATCHLOGS_ENVELOPE": "true"})
+	defer lib.SetConfigEnv(nil)
+
+	var err error
+
+	if c.envelope, err = lib.DestinationEnvelope("cloudwatchlogs"); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := c.encodeEvent(msg); s != `{"source":"ecs-logs","version":1,"payload":`+flat+`}` {
+		t.Errorf("invalid event in an envelope: %s", s)
+	}
+}
@@ -0,0 +1,167 @@
+package cloudwatchlogs
+
+import (
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+// shardedWriter spreads the messages of a single logical stream across
+// multiple physical log streams, each of them having its own writer and
+// sequence token so they can be written to concurrently.
+//
+// Messages are still ordered within each physical stream but there's no
+// ordering guarantee across the shards.
+type shardedWriter struct {
+	shards []*writer
+	shard  func(msg lib.Message, n int) int
+}
+
+func (c *client) openShards(group string, stream string, count int) (w lib.Writer, err error) {
+	shards := make([]*writer, count)
+
+	for i := range shards {
+		if shards[i], err = c.open(group, shardName(stream, i)); err != nil {
+			return
+		}
+	}
+
+	w = &shardedWriter{
+		shards: shards,
+		shard:  c.shardFunc(),
+	}
+	return
+}
+
+func (c *client) shardFunc() func(lib.Message, int) int {
+	if c.config.shardBy == shardByHash {
+		return shardByMessageHash
+	}
+	return func(_ lib.Message, n int) int {
+		return int((atomic.AddUint64(&c.next, 1) - 1) % uint64(n))
+	}
+}
+
+// shardByMessageHash picks the shard of a message from the hash of its ID, or
+// of its content when it has none, so identical messages land on the same
+// physical stream.
+func shardByMessageHash(msg lib.Message, n int) int {
+	h := fnv.New32a()
+
+	if len(msg.Event.Info.ID) != 0 {
+		h.Write([]byte(msg.Event.Info.ID))
+	} else {
+		h.Write([]byte(msg.Event.Message))
+	}
+
+	return int(h.Sum32() % uint32(n))
+}
+
+func shardName(stream string, shard int) string {
+	return stream + "-" + strconv.Itoa(shard)
+}
+
+func (w *shardedWriter) Close() error {
+	for _, s := range w.shards {
+		s.Close()
+	}
+	return nil
+}
+
+func (w *shardedWriter) WriteMessage(msg lib.Message) error {
+	return w.WriteMessageBatch(lib.MessageBatch{msg})
+}
+
+func (w *shardedWriter) WriteMessageBatch(batch lib.MessageBatch) (err error) {
+	_, err = w.WriteMessageBatchSize(batch)
+	return
+}
+
+func (w *shardedWriter) WriteMessageBatchSize(batch lib.MessageBatch) (size int, err error) {
+	return w.write(batch, false)
+}
+
+func (w *shardedWriter) WriteUrgentMessageBatch(batch lib.MessageBatch) (size int, err error) {
+	return w.write(batch, true)
+}
+
+// write writes the messages of batch to their shards. The messages of the
+// shards that failed are written again to the shards which accepted theirs, so
+// the batch only fails when none of them did, failing it otherwise would have
+// the caller write the messages of the healthy shards twice.
+func (w *shardedWriter) write(batch lib.MessageBatch, urgent bool) (size int, err error) {
+	var failed lib.MessageBatch
+	var failure error
+	var healthy []*writer
+
+	size, batches, errs := writeShards(w.shards, batch, w.shard, urgent)
+
+	for i, e := range errs {
+		switch e.(type) {
+		case nil, *lib.RejectedError:
+			if len(batches[i]) != 0 {
+				healthy = append(healthy, w.shards[i])
+			}
+			err = lib.AppendWriteError(err, e)
+		default:
+			failed = append(failed, batches[i]...)
+			failure = lib.AppendWriteError(failure, e)
+		}
+	}
+
+	if len(failed) == 0 {
+		return
+	}
+
+	if len(healthy) == 0 {
+		err = lib.AppendWriteError(err, failure)
+		return
+	}
+
+	n, _, errs := writeShards(healthy, failed, w.shard, urgent)
+	size += n
+
+	for _, e := range errs {
+		err = lib.AppendWriteError(err, e)
+	}
+
+	return
+}
+
+// writeShards writes the messages of batch to the shards picked by shard
+// concurrently, it returns the messages and the error of each shard.
+func writeShards(shards []*writer, batch lib.MessageBatch, shard func(lib.Message, int) int, urgent bool) (size int, batches []lib.MessageBatch, errs []error) {
+	var join sync.WaitGroup
+	var mutex sync.Mutex
+
+	batches = make([]lib.MessageBatch, len(shards))
+	errs = make([]error, len(shards))
+
+	for _, msg := range batch {
+		i := shard(msg, len(shards))
+		batches[i] = append(batches[i], msg)
+	}
+
+	for i, b := range batches {
+		if len(b) == 0 {
+			continue
+		}
+
+		join.Add(1)
+		go func(i int, b lib.MessageBatch) {
+			defer join.Done()
+
+			n, e := shards[i].write(b, urgent)
+			mutex.Lock()
+			size += n
+			mutex.Unlock()
+			errs[i] = e
+		}(i, b)
+	}
+
+	join.Wait()
+	return
+}
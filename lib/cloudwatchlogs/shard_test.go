@@ -0,0 +1,237 @@
+package cloudwatchlogs
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+func TestParseStreamShards(t *testing.T) {
+	shards, err := parseStreamShards("web-*=4, api=2")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ref := []streamShards{{"web-*", 4}, {"api", 2}}; !reflect.DeepEqual(shards, ref) {
+		t.Errorf("invalid stream shards:\n- expected: %v\n- found:    %v", ref, shards)
+	}
+
+	for _, s := range []string{"web", "web=0", "web=x", "[=2"} {
+		if _, err := parseStreamShards(s); err == nil {
+			t.Errorf("expected an error when parsing %#v", s)
+		}
+	}
+}
+
+func TestShardsRequireOrdering(t *testing.T) {
+	shards := []streamShards{{"hot", 4}}
+
+	if err := (config{streamShards: shards}).check(); err == nil {
+		t.Error("sharding streams should be rejected when the ordering is strict")
+	}
+
+	for _, ordering := range []lib.OrderingMode{lib.OrderingBestEffort, lib.OrderingNone} {
+		if err := (config{streamShards: shards, ordering: ordering}).check(); err != nil {
+			t.Errorf("%s: %s", ordering, err)
+		}
+	}
+}
+
+func TestShardedWriterRoundRobin(t *testing.T) {
+	api := &mockAPI{}
+	c := newTestClient(config{
+		streamShards: []streamShards{{"hot", 4}},
+		ordering:     lib.OrderingBestEffort,
+		shardBy:      shardByRoundRobin,
+	}, api)
+
+	w, err := c.Open("A", "hot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteMessageBatch(makeTestBatch("A", "hot", 8)); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := countEventsByStream(api.puts)
+
+	if len(counts) != 4 {
+		t.Errorf("invalid number of physical streams written to: %v", counts)
+	}
+
+	for i := 0; i < 4; i++ {
+		if n := counts[shardName("hot", i)]; n != 2 {
+			t.Errorf("invalid number of events written to %s: %d", shardName("hot", i), n)
+		}
+	}
+
+	if len(api.streams) != 4 {
+		t.Errorf("invalid number of log streams created: %d", len(api.streams))
+	}
+}
+
+func TestShardedWriterHash(t *testing.T) {
+	api := &mockAPI{}
+	c := newTestClient(config{
+		streamShards: []streamShards{{"hot", 4}},
+		ordering:     lib.OrderingBestEffort,
+		shardBy:      shardByHash,
+	}, api)
+
+	w, err := c.Open("A", "hot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := append(makeTestBatch("A", "hot", 16), makeTestBatch("A", "hot", 16)...)
+
+	if err := w.WriteMessageBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	// Identical messages must land on the same physical stream.
+	streams := make(map[string]string)
+
+	for _, put := range api.puts {
+		for _, event := range put.LogEvents {
+			msg := aws.StringValue(event.Message)
+			stream := aws.StringValue(put.LogStreamName)
+
+			if s, ok := streams[msg]; ok && s != stream {
+				t.Errorf("identical messages written to different streams: %s and %s", s, stream)
+			}
+
+			streams[msg] = stream
+		}
+	}
+
+	if n := len(countEventsByStream(api.puts)); n < 2 {
+		t.Errorf("messages were not distributed across multiple streams: %d", n)
+	}
+}
+
+func TestShardedWriterTokens(t *testing.T) {
+	api := &mockAPI{}
+	api.putLogEvents = func(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+		return &cloudwatchlogs.PutLogEventsOutput{
+			NextSequenceToken: aws.String("token:" + aws.StringValue(input.LogStreamName)),
+		}, nil
+	}
+
+	c := newTestClient(config{
+		streamShards: []streamShards{{"hot", 2}},
+		ordering:     lib.OrderingBestEffort,
+		shardBy:      shardByRoundRobin,
+	}, api)
+
+	for i := 0; i != 2; i++ {
+		w, err := c.Open("A", "hot")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := w.WriteMessageBatch(makeTestBatch("A", "hot", 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(api.puts) != 4 {
+		t.Fatalf("invalid number of calls to PutLogEvents: %d", len(api.puts))
+	}
+
+	for _, put := range api.puts[2:] {
+		if token, ref := aws.StringValue(put.SequenceToken), "token:"+aws.StringValue(put.LogStreamName); token != ref {
+			t.Errorf("invalid sequence token used for %s: %s", aws.StringValue(put.LogStreamName), token)
+		}
+	}
+
+	c.Close("A", "hot")
+
+	if n := c.partition("A").writers.len(); n != 0 {
+		t.Errorf("closing a sharded stream should remove the writers of all its shards: %d left", n)
+	}
+}
+
+func TestShardedWriterFailedShard(t *testing.T) {
+	api := &mockAPI{}
+	api.putLogEvents = func(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+		if aws.StringValue(input.LogStreamName) == shardName("hot", 1) {
+			return nil, awserr.New("ServiceUnavailableException", "The service is unavailable", nil)
+		}
+		return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String("next")}, nil
+	}
+
+	c := newTestClient(config{
+		streamShards: []streamShards{{"hot", 4}},
+		ordering:     lib.OrderingBestEffort,
+		shardBy:      shardByRoundRobin,
+	}, api)
+
+	w, err := c.Open("A", "hot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteMessageBatch(makeTestBatch("A", "hot", 8)); err != nil {
+		t.Fatal("the messages of the failed shard should be written to the others:", err)
+	}
+
+	// Each message is delivered once, the healthy shards aren't written again.
+	delivered := make(map[string]int)
+
+	for _, put := range api.puts {
+		if aws.StringValue(put.LogStreamName) == shardName("hot", 1) {
+			continue
+		}
+		for _, event := range put.LogEvents {
+			var e ecslogs.Event
+			json.Unmarshal([]byte(aws.StringValue(event.Message)), &e)
+			delivered[e.Message]++
+		}
+	}
+
+	for _, msg := range makeTestBatch("A", "hot", 8) {
+		if n := delivered[msg.Event.Message]; n != 1 {
+			t.Errorf("%s was delivered %d times", msg.Event.Message, n)
+		}
+	}
+
+	// When all the shards fail the batch does too.
+	api.putLogEvents = func(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+		return nil, awserr.New("ServiceUnavailableException", "The service is unavailable", nil)
+	}
+
+	if err := w.WriteMessageBatch(makeTestBatch("A", "hot", 8)); err == nil {
+		t.Error("the batch should fail when all the shards failed")
+	}
+}
+
+func makeTestBatch(group string, stream string, count int) (batch lib.MessageBatch) {
+	for i := 0; i != count; i++ {
+		batch = append(batch, lib.Message{
+			Group:  group,
+			Stream: stream,
+			Event:  ecslogs.Event{Message: fmt.Sprintf("message %d", i)},
+		})
+	}
+	return
+}
+
+func countEventsByStream(puts []*cloudwatchlogs.PutLogEventsInput) map[string]int {
+	counts := make(map[string]int)
+
+	for _, put := range puts {
+		counts[aws.StringValue(put.LogStreamName)] += len(put.LogEvents)
+	}
+
+	return counts
+}
@@ -0,0 +1,405 @@
+package cloudwatchlogs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws"
+	awsclient "github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// The maximum number of attempts of a FilterLogEvents call that keeps being
+// throttled.
+const maxThrottledReads = 10
+
+// sourceConfig carries the settings of the cloudwatchlogs source, they are
+// loaded from CLOUDWATCHLOGS_SOURCE_* environment variables.
+type sourceConfig struct {
+	// The log group that events are read from, optionally restricted to the
+	// streams starting with the prefix.
+	group        string
+	streamPrefix string
+
+	// The time range of the events, a zero end reads the events up to the
+	// time the source was opened.
+	start time.Time
+	end   time.Time
+
+	// The file where the progress of the backfill is saved, and whether it's
+	// moved back to the events that couldn't be delivered.
+	checkpoint string
+	rollback   bool
+
+	// The maximum number of FilterLogEvents calls per second.
+	rateLimit float64
+
+	// The endpoint that events are read from, shared with the destination.
+	endpoint awsEndpoint
+}
+
+func getSourceConfig() (c sourceConfig, err error) {
+	var s string
+
+	c = sourceConfig{
+		group:        strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_SOURCE_GROUP")),
+		streamPrefix: strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_SOURCE_STREAM_PREFIX")),
+		checkpoint:   strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_SOURCE_CHECKPOINT")),
+		rateLimit:    5,
+	}
+
+	if len(c.group) == 0 {
+		err = fmt.Errorf("missing CLOUDWATCHLOGS_SOURCE_GROUP environment variable")
+		return
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_SOURCE_START")); len(s) != 0 {
+		if c.start, err = time.Parse(time.RFC3339, s); err != nil {
+			err = fmt.Errorf("invalid CLOUDWATCHLOGS_SOURCE_START, must be an RFC3339 time: %s", s)
+			return
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_SOURCE_END")); len(s) != 0 {
+		if c.end, err = time.Parse(time.RFC3339, s); err != nil || !c.end.After(c.start) {
+			err = fmt.Errorf("invalid CLOUDWATCHLOGS_SOURCE_END, must be an RFC3339 time after the start: %s", s)
+			return
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_SOURCE_ROLLBACK")); len(s) != 0 {
+		if c.rollback, err = strconv.ParseBool(s); err != nil {
+			err = fmt.Errorf("invalid CLOUDWATCHLOGS_SOURCE_ROLLBACK, must be a boolean: %s", s)
+			return
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("CLOUDWATCHLOGS_SOURCE_RATE_LIMIT")); len(s) != 0 {
+		if c.rateLimit, err = strconv.ParseFloat(s, 64); err != nil || c.rateLimit < 0 {
+			err = fmt.Errorf("invalid CLOUDWATCHLOGS_SOURCE_RATE_LIMIT, must be a positive number: %s", s)
+			return
+		}
+	}
+
+	c.endpoint, err = getAwsEndpoint()
+	return
+}
+
+// checkpoint records the progress of a backfill, the range is saved as well so
+// a checkpoint isn't resumed by a backfill of another group or time range.
+type checkpoint struct {
+	Group        string `json:"group"`
+	StreamPrefix string `json:"streamPrefix,omitempty"`
+	Start        int64  `json:"start"`
+	End          int64  `json:"end"`
+
+	// The token of the first page that wasn't entirely read, empty when the
+	// backfill starts from the beginning.
+	Token string `json:"token,omitempty"`
+
+	// Set when all events were read.
+	Complete bool `json:"complete,omitempty"`
+}
+
+func NewSource() (r lib.Reader, err error) {
+	var c sourceConfig
+	var client cloudwatchlogsiface.CloudWatchLogsAPI
+	var f lib.NameFilter
+	var s *source
+
+	if c, err = getSourceConfig(); err != nil {
+		return
+	}
+
+	if f, err = lib.SourceFilter("cloudwatchlogs"); err != nil {
+		return
+	}
+
+	if client, _, err = openAwsClient(newRetryer(awsclient.DefaultRetryerMaxNumRetries, nil), c.endpoint, ""); err != nil {
+		return
+	}
+
+	if s, err = newSource(c, client, clock.System); err != nil {
+		return
+	}
+
+	r = lib.NewFilteredReader("cloudwatchlogs", s, f, metrics.Default)
+	return
+}
+
+// source pages through the events of a log group with FilterLogEvents. The
+// checkpoint is saved each time a page was entirely read, so after a restart
+// at most one page of events is read again.
+//
+// With rollback enabled the messages carry the page they were read from, when
+// one of them fails to be delivered the checkpoint is moved back to that page
+// and stays there until the source is restarted.
+type source struct {
+	config  sourceConfig
+	client  cloudwatchlogsiface.CloudWatchLogsAPI
+	limiter *limiter
+	parser  lib.Parser
+	state   checkpoint
+	events  []*cloudwatchlogs.FilteredLogEvent
+	next    *string
+	page    lib.Position
+	stopped int32
+
+	// Rewind is called concurrently with the reads, the mutex protects the
+	// saves of the checkpoint and the page it was rewound to.
+	mutex   sync.Mutex
+	rewound *lib.Position
+}
+
+func newSource(c sourceConfig, client cloudwatchlogsiface.CloudWatchLogsAPI, clock clock.Clock) (s *source, err error) {
+	s = &source{
+		config:  c,
+		client:  client,
+		limiter: newLimiter(c.rateLimit, clock),
+	}
+
+	if s.parser, err = lib.SourceParser("cloudwatchlogs"); err != nil {
+		return
+	}
+
+	end := c.end
+
+	if end.IsZero() {
+		end = clock.Now()
+	}
+
+	s.state = checkpoint{
+		Group:        c.group,
+		StreamPrefix: c.streamPrefix,
+		End:          aws.TimeUnixMilli(end),
+	}
+
+	// The zero time is way before the Unix epoch, which is the earliest time
+	// CloudWatch Logs accepts.
+	if !c.start.IsZero() {
+		s.state.Start = aws.TimeUnixMilli(c.start)
+	}
+
+	// Without an explicit end the range of the backfill depends on when it
+	// started, resuming takes the end from the checkpoint then.
+	if len(c.checkpoint) != 0 {
+		if err = s.load(c.checkpoint, !c.end.IsZero()); err != nil {
+			return
+		}
+	}
+
+	if len(s.state.Token) != 0 {
+		s.next = aws.String(s.state.Token)
+	}
+
+	return
+}
+
+func (s *source) load(path string, checkEnd bool) (err error) {
+	var b []byte
+	var saved checkpoint
+
+	if b, err = ioutil.ReadFile(path); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	if err = json.Unmarshal(b, &saved); err != nil {
+		return fmt.Errorf("invalid checkpoint %s: %s", path, err)
+	}
+
+	if saved.Group != s.state.Group || saved.StreamPrefix != s.state.StreamPrefix || saved.Start != s.state.Start || (checkEnd && saved.End != s.state.End) {
+		return fmt.Errorf("the checkpoint %s belongs to another backfill, remove it to start over", path)
+	}
+
+	s.state = saved
+	return
+}
+
+func (s *source) save() (err error) {
+	if len(s.config.checkpoint) == 0 {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state := s.state
+
+	if s.rewound != nil {
+		state.Token, state.Complete = s.rewound.Checkpoint, false
+	}
+
+	b, _ := json.Marshal(state)
+	tmp := s.config.checkpoint + ".tmp"
+
+	if err = ioutil.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return
+	}
+
+	if err = os.Rename(tmp, s.config.checkpoint); err == nil {
+		syncDir(filepath.Dir(s.config.checkpoint))
+	}
+
+	return
+}
+
+// Rewind moves the checkpoint back to the page of pos, unless it was already
+// rewound to an earlier page.
+func (s *source) Rewind(pos lib.Position) {
+	s.mutex.Lock()
+
+	if s.rewound != nil && s.rewound.Seq <= pos.Seq {
+		s.mutex.Unlock()
+		return
+	}
+
+	s.rewound = &pos
+	s.mutex.Unlock()
+
+	log.WithFields(log.Fields{
+		"group": s.config.group,
+		"token": pos.Checkpoint,
+	}).Warn("rolling back the checkpoint to a page that failed to be delivered")
+
+	if err := s.save(); err != nil {
+		log.WithError(err).Error("failed to roll back the checkpoint")
+	}
+}
+
+func (s *source) Close() error {
+	atomic.StoreInt32(&s.stopped, 1)
+	return nil
+}
+
+func (s *source) ReadMessage() (msg lib.Message, err error) {
+	for len(s.events) == 0 {
+		if atomic.LoadInt32(&s.stopped) != 0 {
+			err = io.EOF
+			return
+		}
+
+		// The last page was entirely read, the checkpoint records that the
+		// backfill completed so it isn't started over.
+		if s.state.Complete {
+			if err = s.save(); err == nil {
+				err = io.EOF
+			}
+			return
+		}
+
+		if err = s.fetch(); err != nil {
+			return
+		}
+	}
+
+	event := s.events[0]
+	s.events = s.events[1:]
+	msg = s.makeMessage(event)
+	return
+}
+
+// fetch reads the next page of events, saving the checkpoint first since the
+// previous page was entirely read.
+func (s *source) fetch() (err error) {
+	var res *cloudwatchlogs.FilterLogEventsOutput
+
+	s.mutex.Lock()
+	s.state.Token = aws.StringValue(s.next)
+	s.mutex.Unlock()
+
+	if err = s.save(); err != nil {
+		return
+	}
+
+	s.page = lib.Position{Seq: s.page.Seq + 1, Checkpoint: s.state.Token}
+
+	input := &cloudwatchlogs.FilterLogEventsInput{
+		LogGroupName: aws.String(s.state.Group),
+		StartTime:    aws.Int64(s.state.Start),
+		EndTime:      aws.Int64(s.state.End),
+		NextToken:    s.next,
+	}
+
+	if len(s.state.StreamPrefix) != 0 {
+		input.LogStreamNamePrefix = aws.String(s.state.StreamPrefix)
+	}
+
+	for attempt := 1; true; attempt++ {
+		s.limiter.wait(false)
+
+		if res, err = s.client.FilterLogEvents(input); err == nil {
+			s.limiter.succeeded()
+			break
+		}
+
+		if !isThrottled(err) || attempt == maxThrottledReads {
+			return
+		}
+
+		s.limiter.throttled()
+	}
+
+	s.events = res.Events
+
+	if s.next = res.NextToken; s.next == nil {
+		s.mutex.Lock()
+		s.state.Token = ""
+		s.state.Complete = true
+		s.mutex.Unlock()
+	}
+
+	return
+}
+
+func (s *source) makeMessage(e *cloudwatchlogs.FilteredLogEvent) (msg lib.Message) {
+	text := aws.StringValue(e.Message)
+
+	if s.parser != nil {
+		msg.Event = lib.ParseMessage(s.parser, []byte(text)).Event
+	} else {
+		d := json.NewDecoder(strings.NewReader(text))
+		d.UseNumber()
+
+		if d.Decode(&msg.Event) != nil {
+			msg.Event = ecslogs.Event{Message: text}
+		}
+	}
+
+	msg.Group = s.state.Group
+	msg.Stream = aws.StringValue(e.LogStreamName)
+
+	if msg.Event.Time.IsZero() {
+		msg.Event.Time = aws.MillisecondsTimeValue(e.Timestamp)
+	}
+
+	if s.config.rollback {
+		lib.SetOrigin(&msg, s, s.page)
+	}
+
+	return
+}
+
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
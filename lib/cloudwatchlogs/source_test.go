@@ -0,0 +1,276 @@
+package cloudwatchlogs
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+// newPagedAPI returns a mock serving the given pages of event messages, the
+// tokens of the requests are recorded in the returned slice.
+func newPagedAPI(pages [][]string, throttles int) (*mockAPI, *[]string) {
+	tokens := &[]string{}
+	api := &mockAPI{}
+	api.filterLogEvents = func(input *cloudwatchlogs.FilterLogEventsInput) (*cloudwatchlogs.FilterLogEventsOutput, error) {
+		if throttles != 0 {
+			throttles--
+			return nil, awserr.New("ThrottlingException", "Rate exceeded", nil)
+		}
+
+		token := aws.StringValue(input.NextToken)
+		*tokens = append(*tokens, token)
+
+		page := 0
+		if len(token) != 0 {
+			page, _ = strconv.Atoi(token)
+		}
+
+		out := &cloudwatchlogs.FilterLogEventsOutput{}
+
+		for i, m := range pages[page] {
+			out.Events = append(out.Events, &cloudwatchlogs.FilteredLogEvent{
+				LogStreamName: aws.String("stream-" + strconv.Itoa(page)),
+				Message:       aws.String(m),
+				Timestamp:     aws.Int64(int64(1000*page + i)),
+			})
+		}
+
+		if page+1 < len(pages) {
+			out.NextToken = aws.String(strconv.Itoa(page + 1))
+		}
+
+		return out, nil
+	}
+	return api, tokens
+}
+
+func readMessages(t *testing.T, s *source, n int) (msgs []string) {
+	for i := 0; n < 0 || i < n; i++ {
+		msg, err := s.ReadMessage()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msgs = append(msgs, msg.Stream+":"+msg.Event.Message)
+	}
+	return
+}
+
+func TestSourcePaging(t *testing.T) {
+	api, tokens := newPagedAPI([][]string{{"A", "B"}, {}, {`{"level":"ERROR","message":"C"}`}}, 2)
+	f := newFakeClock()
+
+	s, err := newSource(sourceConfig{group: "G", rateLimit: 5}, api, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := s.ReadMessage()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Group != "G" || msg.Stream != "stream-0" || msg.Event.Message != "A" || !msg.Event.Time.Equal(time.Unix(0, 0)) {
+		t.Errorf("invalid message: %+v", msg)
+	}
+
+	if found := readMessages(t, s, -1); !reflect.DeepEqual(found, []string{"stream-0:B", "stream-2:C"}) {
+		t.Errorf("invalid messages: %v", found)
+	}
+
+	if !reflect.DeepEqual(*tokens, []string{"", "1", "2"}) {
+		t.Errorf("invalid page tokens: %v", *tokens)
+	}
+
+	if f.Slept() < 100*time.Millisecond {
+		t.Errorf("the source should back off after being throttled but it waited %s", f.Slept())
+	}
+}
+
+func TestSourceJSONEvents(t *testing.T) {
+	api, _ := newPagedAPI([][]string{{`{"level":"ERROR","message":"C"}`}}, 0)
+
+	s, err := newSource(sourceConfig{group: "G"}, api, newFakeClock())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := s.ReadMessage(); err != nil {
+		t.Fatal(err)
+	} else if msg.Event.Level != ecslogs.ERROR || msg.Event.Message != "C" {
+		t.Errorf("JSON events should be decoded: %+v", msg.Event)
+	}
+}
+
+func TestSourceCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ecs-logs-source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pages := [][]string{{"A", "B"}, {"C", "D"}, {"E"}}
+	config := sourceConfig{
+		group:      "G",
+		start:      time.Unix(10, 0),
+		end:        time.Unix(20, 0),
+		checkpoint: filepath.Join(dir, "checkpoint"),
+	}
+
+	api, _ := newPagedAPI(pages, 0)
+	s, err := newSource(config, api, newFakeClock())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stop in the middle of the second page, the checkpoint points to it since
+	// it wasn't entirely read.
+	if found := readMessages(t, s, 3); !reflect.DeepEqual(found, []string{"stream-0:A", "stream-0:B", "stream-1:C"}) {
+		t.Errorf("invalid messages: %v", found)
+	}
+	s.Close()
+
+	api, tokens := newPagedAPI(pages, 0)
+	if s, err = newSource(config, api, newFakeClock()); err != nil {
+		t.Fatal(err)
+	}
+
+	if found := readMessages(t, s, -1); !reflect.DeepEqual(found, []string{"stream-1:C", "stream-1:D", "stream-2:E"}) {
+		t.Errorf("invalid messages after resuming: %v", found)
+	}
+
+	if !reflect.DeepEqual(*tokens, []string{"1", "2"}) {
+		t.Errorf("the backfill should resume from the saved page: %v", *tokens)
+	}
+
+	var saved checkpoint
+	b, _ := ioutil.ReadFile(config.checkpoint)
+	json.Unmarshal(b, &saved)
+
+	if !saved.Complete || saved.Start != 10000 || saved.End != 20000 {
+		t.Errorf("invalid checkpoint: %+v", saved)
+	}
+
+	// A completed backfill isn't started over.
+	api, tokens = newPagedAPI(pages, 0)
+	if s, err = newSource(config, api, newFakeClock()); err != nil {
+		t.Fatal(err)
+	}
+
+	if found := readMessages(t, s, -1); len(found) != 0 || len(*tokens) != 0 {
+		t.Errorf("no events should be read once the backfill completed: %v", found)
+	}
+
+	// The checkpoint of another range is rejected.
+	config.start = time.Unix(5, 0)
+
+	if _, err := newSource(config, api, newFakeClock()); err == nil {
+		t.Error("a checkpoint of another backfill should not be resumed")
+	}
+}
+
+func TestSourceRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ecs-logs-source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pages := [][]string{{"A", "B"}, {"C", "D"}, {"E"}}
+	config := sourceConfig{
+		group:      "G",
+		start:      time.Unix(10, 0),
+		end:        time.Unix(20, 0),
+		checkpoint: filepath.Join(dir, "checkpoint"),
+		rollback:   true,
+	}
+
+	api, _ := newPagedAPI(pages, 0)
+	s, err := newSource(config, api, newFakeClock())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs lib.MessageBatch
+
+	for {
+		msg, err := s.ReadMessage()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+
+		// D fails to be delivered while the last page is read, after the
+		// checkpoint moved past its page.
+		if msg.Event.Message == "E" {
+			lib.RewindBatch(msgs[3:4])
+		}
+	}
+
+	// The failures of other messages of the same page, or of a later one,
+	// don't advance the checkpoint.
+	lib.RewindBatch(msgs[2:3])
+	lib.RewindBatch(msgs[4:5])
+
+	var saved checkpoint
+	b, _ := ioutil.ReadFile(config.checkpoint)
+	json.Unmarshal(b, &saved)
+
+	if saved.Complete || saved.Token != "1" {
+		t.Errorf("the checkpoint should point to the page of the failed messages: %+v", saved)
+	}
+
+	api, tokens := newPagedAPI(pages, 0)
+	if s, err = newSource(config, api, newFakeClock()); err != nil {
+		t.Fatal(err)
+	}
+
+	if found := readMessages(t, s, -1); !reflect.DeepEqual(found, []string{"stream-1:C", "stream-1:D", "stream-2:E"}) {
+		t.Errorf("the failed messages should be read again after a restart: %v", found)
+	}
+
+	if !reflect.DeepEqual(*tokens, []string{"1", "2"}) {
+		t.Errorf("the backfill should resume from the page of the failed messages: %v", *tokens)
+	}
+
+	// Without rollback the failures are ignored.
+	os.Remove(config.checkpoint)
+	config.rollback = false
+
+	api, _ = newPagedAPI(pages, 0)
+	if s, err = newSource(config, api, newFakeClock()); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, _ := s.ReadMessage()
+	lib.RewindBatch(lib.MessageBatch{msg})
+	readMessages(t, s, -1)
+
+	b, _ = ioutil.ReadFile(config.checkpoint)
+	json.Unmarshal(b, &saved)
+
+	if !saved.Complete {
+		t.Errorf("the checkpoint should not be rolled back when disabled: %+v", saved)
+	}
+}
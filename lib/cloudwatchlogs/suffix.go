@@ -0,0 +1,103 @@
+package cloudwatchlogs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs/lib/ecsmeta"
+)
+
+// The sources of the suffix appended to the names of log streams, so the
+// processes writing the same stream each own a physical stream instead of
+// invalidating each other's sequence tokens.
+const (
+	suffixNone      = "none"
+	suffixTask      = "task"
+	suffixContainer = "container"
+	suffixRandom    = "random"
+)
+
+// resolveStreamSuffix returns the stream suffix of the process from the source
+// set in the configuration. When the task metadata is unavailable the task
+// suffix falls back to the container one, and the container suffix to the
+// hostname, which Docker sets to the container ID, then to a random token.
+func (c config) resolveStreamSuffix() (suffix string) {
+	var err error
+
+	switch c.streamSuffix {
+	case "", suffixNone:
+		return ""
+
+	case suffixTask:
+		if suffix, err = taskID(c.metadataURI); err == nil {
+			return
+		}
+		log.WithError(err).Warn("the task ID is unavailable, falling back to the container ID for the stream suffix")
+		fallthrough
+
+	case suffixContainer:
+		if suffix, err = containerID(c.metadataURI); err == nil {
+			return
+		}
+		if host, _ := os.Hostname(); len(host) != 0 {
+			return host
+		}
+		log.WithError(err).Warn("the container ID is unavailable, falling back to a random stream suffix")
+	}
+
+	return randomSuffix()
+}
+
+// streamName returns the name of the physical log stream of stream.
+func (c *client) streamName(stream string) string {
+	if len(c.suffix) == 0 {
+		return stream
+	}
+	return stream + "-" + c.suffix
+}
+
+func taskID(uri string) (id string, err error) {
+	var task ecsmeta.Task
+
+	if task, err = ecsmeta.GetTask(uri, ecsmeta.DefaultTimeout); err != nil {
+		return
+	}
+
+	// The task ID is the last component of the ARN, with both the old and the
+	// new ARN formats.
+	if i := strings.LastIndexByte(task.TaskARN, '/'); i >= 0 && i < len(task.TaskARN)-1 {
+		id = task.TaskARN[i+1:]
+	} else {
+		err = fmt.Errorf("invalid task ARN in the ECS metadata: %q", task.TaskARN)
+	}
+
+	return
+}
+
+func containerID(uri string) (id string, err error) {
+	var container ecsmeta.Container
+
+	if container, err = ecsmeta.GetContainer(uri, ecsmeta.DefaultTimeout); err != nil {
+		return
+	}
+
+	// Docker IDs are 64 characters long, the first 12 are enough to identify
+	// containers and keep the stream names short like docker ps does.
+	if id = container.DockerId; len(id) > 12 {
+		id = id[:12]
+	} else if len(id) == 0 {
+		err = fmt.Errorf("missing container ID in the ECS metadata")
+	}
+
+	return
+}
+
+func randomSuffix() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
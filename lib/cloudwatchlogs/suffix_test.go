@@ -0,0 +1,106 @@
+package cloudwatchlogs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+func newMetadataServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v4":
+			res.Write([]byte(`{"DockerId":"ea32192c8553fbff06c9340478a2ff089b2bb5646fb718b4ee206641c9086d66"}`))
+		case "/v4/task":
+			res.Write([]byte(`{"TaskARN":"arn:aws:ecs:us-west-2:111122223333:task/default/158d1c8083dd49d6b527399fd6414f5c"}`))
+		default:
+			http.NotFound(res, req)
+		}
+	}))
+}
+
+func TestResolveStreamSuffix(t *testing.T) {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	server := newMetadataServer()
+	defer server.Close()
+
+	hostname, _ := os.Hostname()
+
+	tests := []struct {
+		suffix string
+		uri    string
+		out    string
+	}{
+		{suffix: suffixNone, uri: server.URL + "/v4", out: ""},
+		{suffix: suffixTask, uri: server.URL + "/v4", out: "158d1c8083dd49d6b527399fd6414f5c"},
+		{suffix: suffixContainer, uri: server.URL + "/v4", out: "ea32192c8553"},
+
+		// Without task metadata the suffix falls back to the hostname, which
+		// is the container ID in Docker containers.
+		{suffix: suffixTask, uri: "", out: hostname},
+		{suffix: suffixTask, uri: server.URL + "/missing", out: hostname},
+		{suffix: suffixContainer, uri: "", out: hostname},
+	}
+
+	for _, test := range tests {
+		if s := (config{streamSuffix: test.suffix, metadataURI: test.uri}).resolveStreamSuffix(); s != test.out {
+			t.Errorf("%s, %q: invalid stream suffix: %q != %q", test.suffix, test.uri, s, test.out)
+		}
+	}
+
+	if s := (config{streamSuffix: suffixRandom}).resolveStreamSuffix(); !regexp.MustCompile(`^[0-9a-f]{8}$`).MatchString(s) {
+		t.Errorf("invalid random stream suffix: %q", s)
+	}
+
+	if err := (config{streamSuffix: "pid"}).check(); err == nil {
+		t.Error("expected an error for an unknown CLOUDWATCHLOGS_STREAM_SUFFIX")
+	}
+}
+
+func TestStreamSuffixDistinct(t *testing.T) {
+	api := &mockAPI{}
+	names := map[string]bool{}
+
+	// Two processes writing the same base stream each get their own physical
+	// stream.
+	for i := 0; i != 2; i++ {
+		c := newTestClient(config{streamSuffix: suffixRandom}, api)
+
+		w, err := c.Open("A", "web")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := w.WriteMessageBatch(lib.MessageBatch{{Group: "A", Stream: "web", Event: ecslogs.Event{Message: "Hello World!"}}}); err != nil {
+			t.Fatal(err)
+		}
+
+		c.Close("A", "web")
+	}
+
+	for i, put := range api.puts {
+		stream := aws.StringValue(put.LogStreamName)
+
+		if stream != aws.StringValue(api.streams[i].LogStreamName) {
+			t.Errorf("events written to %s instead of the stream that was created: %s", stream, aws.StringValue(api.streams[i].LogStreamName))
+		}
+
+		if !regexp.MustCompile(`^web-[0-9a-f]{8}$`).MatchString(stream) {
+			t.Errorf("invalid stream name: %s", stream)
+		}
+
+		names[stream] = true
+	}
+
+	if len(api.puts) != 2 || len(names) != 2 {
+		t.Errorf("the clients should write to distinct streams: %v", names)
+	}
+}
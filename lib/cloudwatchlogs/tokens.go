@@ -0,0 +1,146 @@
+package cloudwatchlogs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs/lib/clock"
+)
+
+// tokenStore persists the sequence tokens of the streams to a file, so after a
+// restart the writers continue with the token they had instead of looking it up
+// or getting it from an invalid token error.
+//
+// All the methods can be called on a nil store, which persists nothing.
+type tokenStore struct {
+	path  string
+	grace time.Duration
+	clock clock.Clock
+
+	mutex sync.Mutex
+	// The latest token of each stream, and the tokens read from the file that
+	// no writer picked up yet.
+	tokens   map[string]string
+	restored map[string]string
+	dirty    bool
+	pending  bool
+	saved    time.Time
+}
+
+func newTokenStore(path string, grace time.Duration, clock clock.Clock) *tokenStore {
+	s := &tokenStore{
+		path:     path,
+		grace:    grace,
+		clock:    clock,
+		tokens:   make(map[string]string),
+		restored: make(map[string]string),
+	}
+
+	if b, err := ioutil.ReadFile(path); err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).WithField("path", path).Warn("failed to read the saved sequence tokens")
+		}
+	} else if err = json.Unmarshal(b, &s.restored); err != nil {
+		log.WithError(err).WithField("path", path).Warn("ignoring the invalid saved sequence tokens")
+		s.restored = make(map[string]string)
+	}
+
+	for key, token := range s.restored {
+		s.tokens[key] = token
+	}
+
+	return s
+}
+
+// take returns the token of the stream read from the file, only once since
+// the writers keep track of their token afterwards.
+func (s *tokenStore) take(key string) (token string) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	token = s.restored[key]
+	delete(s.restored, key)
+	s.mutex.Unlock()
+	return
+}
+
+// set records the latest token of a stream, an empty token forgets it.
+func (s *tokenStore) set(key string, token string) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+
+	if len(token) == 0 {
+		delete(s.tokens, key)
+	} else {
+		s.tokens[key] = token
+	}
+
+	s.dirty = true
+	s.mutex.Unlock()
+}
+
+// save writes the tokens to the file if they changed. Within the grace period
+// of the previous save the write is delayed until the end of the period, so
+// many writers being closed at once only write the file once.
+func (s *tokenStore) save() {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.dirty || s.pending {
+		return
+	}
+
+	if wait := s.saved.Add(s.grace).Sub(s.clock.Now()); wait > 0 {
+		timer := s.clock.NewTimer(wait)
+		s.pending = true
+
+		go func() {
+			<-timer.C()
+			s.mutex.Lock()
+			s.pending = false
+			s.write()
+			s.mutex.Unlock()
+		}()
+		return
+	}
+
+	s.write()
+}
+
+func (s *tokenStore) write() {
+	if !s.dirty {
+		return
+	}
+
+	b, _ := json.Marshal(s.tokens)
+	tmp := s.path + ".tmp"
+	err := ioutil.WriteFile(tmp, append(b, '\n'), 0644)
+
+	if err == nil {
+		if err = os.Rename(tmp, s.path); err == nil {
+			syncDir(filepath.Dir(s.path))
+		}
+	}
+
+	if err != nil {
+		log.WithError(err).WithField("path", s.path).Warn("failed to save the sequence tokens")
+		return
+	}
+
+	s.dirty = false
+	s.saved = s.clock.Now()
+}
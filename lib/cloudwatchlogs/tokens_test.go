@@ -0,0 +1,167 @@
+package cloudwatchlogs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+func makeTokenFile(t *testing.T, tokens map[string]string) (path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "tokens_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path = filepath.Join(dir, "tokens.json")
+	cleanup = func() { os.RemoveAll(dir) }
+
+	if tokens != nil {
+		b, _ := json.Marshal(tokens)
+		ioutil.WriteFile(path, b, 0644)
+	}
+
+	return
+}
+
+func readTokenFile(t *testing.T, path string) (tokens map[string]string) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = json.Unmarshal(b, &tokens); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func TestTokenFileSaveOnClose(t *testing.T) {
+	path, cleanup := makeTokenFile(t, nil)
+	defer cleanup()
+
+	c := newTestClient(config{tokenFile: path}, &mockAPI{})
+
+	w, err := c.Open("A", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteMessageBatch(makeTestBatch("A", "0", 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("the tokens should only be saved when the writer is closed")
+	}
+
+	w.Close()
+
+	if tokens := readTokenFile(t, path); tokens["A:0"] != "next" {
+		t.Errorf("the token of the stream should have been saved: %v", tokens)
+	}
+}
+
+func TestTokenFileLoadOnStart(t *testing.T) {
+	path, cleanup := makeTokenFile(t, map[string]string{"A:0": "42"})
+	defer cleanup()
+
+	api := &mockAPI{}
+	c := newTestClient(config{tokenFile: path}, api)
+
+	w, err := c.Open("A", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteMessageBatch(makeTestBatch("A", "0", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(api.groups) != 0 || len(api.streams) != 0 {
+		t.Errorf("the stream shouldn't be created when its token was saved: %d group(s), %d stream(s)", len(api.groups), len(api.streams))
+	}
+
+	if len(api.puts) != 1 || aws.StringValue(api.puts[0].SequenceToken) != "42" {
+		t.Errorf("the saved token should have been used by the first write: %d call(s)", len(api.puts))
+	}
+}
+
+func TestTokenFileStaleToken(t *testing.T) {
+	path, cleanup := makeTokenFile(t, map[string]string{"A:0": "41", "A:1": "7"})
+	defer cleanup()
+
+	api := &mockAPI{}
+	api.putLogEvents = func(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+		switch aws.StringValue(input.LogStreamName) + ":" + aws.StringValue(input.SequenceToken) {
+		case "0:41":
+			return nil, invalidSequenceToken("42")
+		case "1:7":
+			return nil, awserr.New("ResourceNotFoundException", "The specified log stream does not exist.", nil)
+		}
+		return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String("next")}, nil
+	}
+
+	c := newTestClient(config{tokenFile: path}, api)
+
+	for _, stream := range []string{"0", "1"} {
+		w, err := c.Open("A", stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := w.WriteMessageBatch(makeTestBatch("A", stream, 1)); err != nil {
+			t.Errorf("%s: writing with a stale token should recover: %v", stream, err)
+		}
+
+		w.Close()
+	}
+
+	// The deleted stream was created again.
+	if len(api.streams) != 1 || aws.StringValue(api.streams[0].LogStreamName) != "1" {
+		t.Errorf("the deleted stream should have been created: %d stream(s)", len(api.streams))
+	}
+
+	if tokens := readTokenFile(t, path); tokens["A:0"] != "next" || tokens["A:1"] != "next" {
+		t.Errorf("the recovered tokens should have been saved: %v", tokens)
+	}
+}
+
+func TestTokenFileGrace(t *testing.T) {
+	path, cleanup := makeTokenFile(t, nil)
+	defer cleanup()
+
+	f := newFakeClock()
+	s := newTokenStore(path, time.Second, f)
+
+	s.set("A:0", "1")
+	s.save()
+	s.set("A:0", "2")
+	s.save()
+
+	if tokens := readTokenFile(t, path); tokens["A:0"] != "1" {
+		t.Errorf("the second save should wait for the grace period: %v", tokens)
+	}
+
+	f.Advance(time.Second)
+
+	for i := 0; i != 100; i++ {
+		if s.mutex.Lock(); !s.dirty {
+			s.mutex.Unlock()
+			break
+		}
+		s.mutex.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	if tokens := readTokenFile(t, path); tokens["A:0"] != "2" {
+		t.Errorf("the tokens should have been saved at the end of the grace period: %v", tokens)
+	}
+}
@@ -0,0 +1,281 @@
+package cloudwatchlogs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+const (
+	// The maximum number of streams that the warm-up list may expand to, a
+	// typo in a range shouldn't create millions of streams.
+	maxWarmupStreams = 10000
+
+	// How many streams are warmed up at once, the creation and describe calls
+	// are paced by their own rate limits anyway.
+	warmupConcurrency = 16
+)
+
+// warmStream is a log group and stream created when ecs-logs starts.
+type warmStream struct {
+	group  string
+	stream string
+}
+
+// parseWarmup parses the list of group:stream pairs of CLOUDWATCHLOGS_WARMUP,
+// separated by commas or spaces. The pairs are expanded like the braces of a
+// shell, {api,worker} lists alternatives and {1..3} is a range of numbers.
+func parseWarmup(s string) (streams []warmStream, err error) {
+	seen := make(map[warmStream]bool)
+
+	for _, item := range splitWarmup(s) {
+		var names []string
+
+		if names, err = expandBraces(item); err != nil {
+			err = fmt.Errorf("invalid CLOUDWATCHLOGS_WARMUP, %s: %s", err, item)
+			return
+		}
+
+		for _, name := range names {
+			i := strings.LastIndexByte(name, ':')
+
+			if i <= 0 || i == len(name)-1 {
+				err = fmt.Errorf("invalid CLOUDWATCHLOGS_WARMUP, must be a list of group:stream pairs: %s", item)
+				return
+			}
+
+			w := warmStream{group: name[:i], stream: name[i+1:]}
+
+			if !seen[w] {
+				seen[w] = true
+				streams = append(streams, w)
+			}
+
+			if len(streams) > maxWarmupStreams {
+				err = fmt.Errorf("invalid CLOUDWATCHLOGS_WARMUP, the list expands to more than %d streams", maxWarmupStreams)
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// splitWarmup splits s on the commas and spaces that aren't within braces.
+func splitWarmup(s string) (items []string) {
+	depth, start := 0, 0
+
+	for i, c := range s {
+		switch {
+		case c == '{':
+			depth++
+		case c == '}' && depth > 0:
+			depth--
+		case depth == 0 && (c == ',' || c == ' ' || c == '\t' || c == '\n'):
+			if start < i {
+				items = append(items, s[start:i])
+			}
+			start = i + 1
+		}
+	}
+
+	if start < len(s) {
+		items = append(items, s[start:])
+	}
+
+	return
+}
+
+// expandBraces returns the names that the braces of s expand to, from left
+// to right.
+func expandBraces(s string) ([]string, error) {
+	i := strings.IndexByte(s, '{')
+
+	if i < 0 {
+		if strings.IndexByte(s, '}') >= 0 {
+			return nil, fmt.Errorf("unbalanced braces")
+		}
+		return []string{s}, nil
+	}
+
+	depth, j := 0, -1
+
+	for k := i; k < len(s) && j < 0; k++ {
+		switch s[k] {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				j = k
+			}
+		}
+	}
+
+	if j < 0 {
+		return nil, fmt.Errorf("unbalanced braces")
+	}
+
+	alternatives, err := braceAlternatives(s[i+1 : j])
+
+	if err != nil {
+		return nil, err
+	}
+
+	suffixes, err := expandBraces(s[j+1:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for _, a := range alternatives {
+		expanded, err := expandBraces(s[:i] + a)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range expanded {
+			for _, suffix := range suffixes {
+				if names = append(names, e+suffix); len(names) > maxWarmupStreams {
+					return nil, fmt.Errorf("expands to more than %d names", maxWarmupStreams)
+				}
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// braceAlternatives returns the alternatives of the content of a pair of
+// braces, either a range like 1..3 or a comma separated list.
+func braceAlternatives(s string) (alternatives []string, err error) {
+	if i := strings.Index(s, ".."); i >= 0 && !strings.ContainsAny(s, "{,") {
+		var from, to int64
+
+		if from, err = strconv.ParseInt(s[:i], 10, 64); err == nil {
+			to, err = strconv.ParseInt(s[i+2:], 10, 64)
+		}
+
+		if err != nil || to < from || to-from >= maxWarmupStreams {
+			return nil, fmt.Errorf("invalid range {%s}", s)
+		}
+
+		for n := from; n <= to; n++ {
+			alternatives = append(alternatives, strconv.FormatInt(n, 10))
+		}
+		return
+	}
+
+	depth, start := 0, 0
+
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				alternatives = append(alternatives, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	if alternatives = append(alternatives, s[start:]); len(alternatives) == 1 {
+		return nil, fmt.Errorf("braces must hold a range or a list of alternatives: {%s}", s)
+	}
+
+	return
+}
+
+// WarmUp creates the streams of CLOUDWATCHLOGS_WARMUP and looks up the
+// sequence tokens of the ones that exist, so the first batch written to them
+// is sent right away. The failures are logged, they're only returned when
+// CLOUDWATCHLOGS_WARMUP_STRICT is set; the writers of the streams that
+// failed are opened again by their first batch.
+func (c *client) WarmUp() (err error) {
+	if c.lazy.Init(c.init) != nil || len(c.config.warmup) == 0 {
+		return
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var slots = make(chan struct{}, warmupConcurrency)
+
+	for _, w := range c.config.warmup {
+		w := w
+		wg.Add(1)
+		slots <- struct{}{}
+
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			if e := c.warmGroup(w.group, w.stream); e != nil {
+				log.WithFields(log.Fields{
+					"group":  w.group,
+					"stream": w.stream,
+					"error":  e,
+				}).Warn("failed to warm up a cloudwatchlogs stream")
+
+				mutex.Lock()
+				err = lib.AppendError(err, fmt.Errorf("warming up %s: %s", joinGroupStream(w.group, w.stream), e))
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if !c.config.warmupStrict {
+		err = nil
+	}
+
+	return
+}
+
+// warmGroup warms up the physical streams of stream, one per shard.
+func (c *client) warmGroup(group string, stream string) (err error) {
+	if shards := c.config.shards(stream); shards > 1 {
+		for i := 0; i < shards && err == nil; i++ {
+			err = c.warm(group, shardName(stream, i))
+		}
+		return
+	}
+
+	return c.warm(group, stream)
+}
+
+// warm opens the writer of a stream the way the first batch would, except
+// that a token saved before a restart isn't trusted: the stream is described
+// to make sure it still exists, so its first batch doesn't have to recover
+// from a ResourceNotFoundException.
+func (c *client) warm(group string, stream string) (err error) {
+	writer := c.get(group, stream)
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	if writer.created {
+		return
+	}
+
+	if err = writer.connect(); err != nil {
+		return
+	}
+
+	c.protection.check(writer.api, group)
+
+	if err = writer.create(); err != nil {
+		return
+	}
+
+	c.tokens.take(writer.key())
+	return
+}
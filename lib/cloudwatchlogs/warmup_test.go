@@ -0,0 +1,152 @@
+package cloudwatchlogs
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+func TestParseWarmup(t *testing.T) {
+	streams, err := parseWarmup("/ecs/{api,worker}:main, /ecs/web:web-{1..3} /ecs/api:main")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []warmStream{
+		{"/ecs/api", "main"},
+		{"/ecs/worker", "main"},
+		{"/ecs/web", "web-1"},
+		{"/ecs/web", "web-2"},
+		{"/ecs/web", "web-3"},
+	}
+
+	if !reflect.DeepEqual(streams, expected) {
+		t.Errorf("invalid warm-up streams: %v", streams)
+	}
+
+	if streams, _ = parseWarmup("A:{a,b{1..2}}-{x,y}"); len(streams) != 6 || streams[2].stream != "b1-x" {
+		t.Errorf("nested braces should be expanded: %v", streams)
+	}
+
+	for _, s := range []string{"/ecs/api", "/ecs/api:", ":main", "A:{a", "A:a}", "A:{a}", "A:{3..1}", "A:{1..x}", "A:{0..99999}"} {
+		if _, err := parseWarmup(s); err == nil {
+			t.Errorf("%s: the warm-up list should be invalid", s)
+		}
+	}
+}
+
+func TestWarmUpCreatesStreams(t *testing.T) {
+	var mutex sync.Mutex
+	var describes []*cloudwatchlogs.DescribeLogStreamsInput
+
+	api := &mockAPI{}
+	api.describeLogStreams = describeStreams(nil, &describes, &mutex)
+	warmup, _ := parseWarmup("A:{0,1} B:0")
+	c := newTestClient(config{warmup: warmup}, api)
+
+	if err := c.WarmUp(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The group is created for each of its streams, unless the calls overlap
+	// and are coalesced.
+	groups := len(api.groups)
+
+	if groups < 2 || len(api.streams) != 3 || len(describes) != 0 {
+		t.Fatalf("the groups and streams should be created: %d group(s), %d stream(s), %d describe(s)", len(api.groups), len(api.streams), len(describes))
+	}
+
+	for _, w := range warmup {
+		writer, err := c.Open(w.group, w.stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := writer.WriteMessageBatch(makeTestBatch(w.group, w.stream, 1)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// The first writes went straight to PutLogEvents.
+	if len(api.groups) != groups || len(api.streams) != 3 || len(api.puts) != 3 {
+		t.Errorf("the writers shouldn't create their stream again: %d group(s), %d stream(s), %d put(s)", len(api.groups), len(api.streams), len(api.puts))
+	}
+}
+
+func TestWarmUpDescribesExistingStreams(t *testing.T) {
+	var mutex sync.Mutex
+	var describes []*cloudwatchlogs.DescribeLogStreamsInput
+
+	path, cleanup := makeTokenFile(t, map[string]string{"A:0": "41"})
+	defer cleanup()
+
+	api := &mockAPI{existingStreams: true}
+	api.describeLogStreams = describeStreams([]string{"0", "1"}, &describes, &mutex)
+	api.putLogEvents = func(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+		if aws.StringValue(input.SequenceToken) != aws.StringValue(input.LogStreamName) {
+			return nil, awserr.New("ResourceNotFoundException", "The specified log stream does not exist.", nil)
+		}
+		return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String("next")}, nil
+	}
+
+	warmup, _ := parseWarmup("A:{0..1}")
+	c := newTestClient(config{warmup: warmup, tokenFile: path}, api)
+
+	if err := c.WarmUp(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The saved token isn't trusted, the stream is described like the other
+	// one.
+	if len(api.streams) != 2 || len(describes) == 0 {
+		t.Fatalf("the existing streams should be described: %d stream(s), %d describe(s)", len(api.streams), len(describes))
+	}
+
+	for _, w := range warmup {
+		writer, err := c.Open(w.group, w.stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := writer.WriteMessageBatch(makeTestBatch(w.group, w.stream, 1)); err != nil {
+			t.Errorf("%s: the first write should use the described token: %v", w.stream, err)
+		}
+	}
+
+	if len(api.streams) != 2 || len(api.puts) != 2 {
+		t.Errorf("the first writes shouldn't go through the recovery: %d stream(s), %d put(s)", len(api.streams), len(api.puts))
+	}
+}
+
+func TestWarmUpFailures(t *testing.T) {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	for _, strict := range []bool{false, true} {
+		api := &mockAPI{}
+		api.createLogGroup = func(input *cloudwatchlogs.CreateLogGroupInput) error {
+			if aws.StringValue(input.LogGroupName) == "B" {
+				return errors.New("AccessDeniedException: not authorized to perform logs:CreateLogGroup")
+			}
+			return nil
+		}
+
+		warmup, _ := parseWarmup("A:0 B:0")
+		c := newTestClient(config{warmup: warmup, warmupStrict: strict}, api)
+
+		if err := c.WarmUp(); (err != nil) != strict {
+			t.Errorf("strict=%t: unexpected result of the warm-up: %v", strict, err)
+		}
+
+		// The stream of the group that failed is created by its first write.
+		if _, err := c.Open("B", "0"); err == nil || len(api.groups) != 3 {
+			t.Errorf("strict=%t: the stream that failed to warm up should be created again: %v, %d group(s)", strict, err, len(api.groups))
+		}
+	}
+}
@@ -1,120 +1,517 @@
 package cloudwatchlogs
 
 import (
-	"errors"
-	"strings"
+	"fmt"
 	"sync"
 
+	"github.com/apex/log"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/segmentio/ecs-logs-go"
 	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/metrics"
 )
 
+// writer writes the batches of a physical log stream. Everything it needs to
+// recover is done with its own lock held, creating the stream, looking up the
+// sequence token and retrying, so the streams are written to independently and
+// a failure never discards the writer, only the batch that couldn't be sent.
 type writer struct {
 	mutex  sync.Mutex
 	group  string
 	stream string
 	token  string
 	parent *client
+
+	// The AWS client of the parent, kept once the stream is first used so
+	// the writes don't go through the lock of the parent.
+	api cloudwatchlogsiface.CloudWatchLogsAPI
+
+	// The name of the physical log stream, the stream with the suffix of the
+	// client when one is configured.
+	name string
+
+	// The rate limiter of the partition that the writer belongs to, and the
+	// one of its log stream which CloudWatch Logs has its own quota for.
+	limiter       *limiter
+	streamLimiter *limiter
+
+	// Counts the PutLogEvents calls of the group, retries included.
+	calls *metrics.Counter
+
+	// Set once the group and stream were created or found to exist, a new
+	// stream has no token until its first batch.
+	created bool
 }
 
+// Close saves the sequence tokens when a token file is configured, the writer
+// stays usable.
 func (w *writer) Close() error {
+	w.parent.tokens.save()
 	return nil
 }
 
+// Receipt returns the sequence token that CloudWatch Logs returned for the
+// last batch written to the stream, which the audit log records.
+func (w *writer) Receipt() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.token
+}
+
+// ensure makes sure that the group and stream of the writer exist, creating
+// them or looking up the sequence token of the stream unless the writer already
+// has a token. It's called with the writer locked.
+func (w *writer) ensure() (err error) {
+	if err = w.connect(); err != nil {
+		return
+	}
+
+	if len(w.token) != 0 || w.created {
+		// The writer already has a token, or was warmed up, this means the
+		// log group and stream have been created for that writer already.
+		return
+	}
+
+	w.parent.protection.check(w.api, w.group)
+
+	// The token saved before a restart is trusted without checking that the
+	// stream still exists, writing to it recovers when it doesn't.
+	if w.token = w.parent.tokens.take(w.key()); len(w.token) != 0 {
+		return
+	}
+
+	return w.create()
+}
+
+// connect gets the AWS client of the parent the first time the writer is used.
+func (w *writer) connect() (err error) {
+	if w.api == nil {
+		w.api, err = w.parent.getAwsClient()
+	}
+	return
+}
+
+// create creates the group and stream of the writer, or looks up the sequence
+// token of the stream if it already exists.
+func (w *writer) create() (err error) {
+	var token string
+	var c = w.parent
+
+	if token, err = c.getCreator().createGroupAndStream(w.api, c.tokenDescriber(), w.group, w.name, c.config.groupSettings(w.group)); err == nil {
+		w.token, w.created = token, true
+	}
+
+	return
+}
+
+// reset forgets the token of the writer after a failure it couldn't recover
+// from, the next batch looks up the stream again.
+func (w *writer) reset() {
+	w.token, w.created = "", false
+	w.parent.tokens.set(w.key(), "")
+}
+
+// key returns the key of the physical log stream in the token file.
+func (w *writer) key() string {
+	return joinGroupStream(w.group, w.name)
+}
+
 func (w *writer) WriteMessage(msg lib.Message) error {
 	return w.WriteMessageBatch(lib.MessageBatch{msg})
 }
 
 func (w *writer) WriteMessageBatch(batch lib.MessageBatch) (err error) {
-	if len(batch) == 0 {
-		return
-	}
+	_, err = w.WriteMessageBatchSize(batch)
+	return
+}
 
-	var token *string
-	var result *cloudwatchlogs.PutLogEventsOutput
-	var events = make([]*cloudwatchlogs.InputLogEvent, len(batch))
+func (w *writer) WriteMessageBatchSize(batch lib.MessageBatch) (size int, err error) {
+	return w.write(batch, false)
+}
 
-	for i, msg := range batch {
-		events[i] = &cloudwatchlogs.InputLogEvent{
-			Message:   aws.String(msg.Event.String()),
-			Timestamp: aws.Int64(aws.TimeUnixMilli(msg.Event.Time)),
+// WriteUrgentMessageBatch writes batch ahead of the requests that are waiting
+// on the rate limiter of the partition.
+func (w *writer) WriteUrgentMessageBatch(batch lib.MessageBatch) (size int, err error) {
+	return w.write(batch, true)
+}
+
+func (w *writer) write(batch lib.MessageBatch, urgent bool) (size int, err error) {
+	var rejections []lib.Rejection
+
+	if w.parent.config.infrequentAccess() {
+		// Infrequent Access log groups accept embedded metric format events
+		// but silently skip the metric extraction, we'd rather reject them
+		// than quietly lose the metrics. The other messages are written.
+		accepted := make(lib.MessageBatch, 0, len(batch))
+
+		for _, msg := range batch {
+			if hasEmbeddedMetrics(msg) {
+				rejections = append(rejections, lib.Rejection{
+					Message: msg,
+					Reason:  fmt.Sprintf("the %s log group uses the %s log class which doesn't support embedded metric format events", w.group, w.parent.config.groupClass),
+				})
+			} else {
+				accepted = append(accepted, msg)
+			}
 		}
+
+		batch = accepted
 	}
 
+	if len(batch) == 0 {
+		if len(rejections) != 0 {
+			err = &lib.RejectedError{Rejections: rejections}
+		}
+		return
+	}
+
+	events := getInputEvents(len(batch))
+	defer putInputEvents(events)
+
 	// Because of the logic imposed by the AWS API we can only submit one upload
 	// request per log stream at a time due to the sequence token being unique
 	// and usable only once.
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 
-	if w.parent == nil {
-		// Another goroutine has invalidated this writer, giving up.
-		err = errInvalidWriter
+	// The stream is created here when it failed to be when the writer was
+	// opened, or after a failure reset the writer.
+	if err = w.ensure(); err != nil {
 		return
 	}
 
-	if len(w.token) != 0 {
+	truncated := 0
+
+	for i, msg := range batch {
+		s := w.parent.config.encodeEvent(msg)
+
+		if len(s) > maxEventSize {
+			s = truncateEvent(s)
+			truncated++
+		}
+
+		size += len(s)
+		events.set(i, s, aws.TimeUnixMilli(msg.Event.Time))
+	}
+
+	if truncated != 0 {
+		log.WithFields(log.Fields{
+			"group":  w.group,
+			"stream": w.stream,
+			"count":  truncated,
+		}).Warn("truncating events over the size limit of cloudwatchlogs")
+	}
+
+	var offset int
+
+	// A batch over the limits of PutLogEvents would be rejected whole, it's
+	// sent in as many calls as needed instead.
+	var rejectedBy string
+
+	for _, chunk := range splitEvents(events.ptrs) {
+		var rejected *cloudwatchlogs.RejectedLogEventsInfo
+		var requestID string
+
+		if rejected, requestID, err = w.put(chunk, urgent); err != nil {
+			return
+		}
+
+		if rejected != nil && len(rejectedBy) == 0 {
+			rejectedBy = requestID
+		}
+
+		rejections = appendRejections(rejections, batch[offset:offset+len(chunk)], rejected)
+		offset += len(chunk)
+	}
+
+	if len(rejections) != 0 {
+		err = &lib.RejectedError{Rejections: rejections, ID: rejectedBy}
+	}
+
+	return
+}
+
+// appendRejections appends to rejections the messages of batch that CloudWatch
+// Logs reported as rejected in info, the events of a call are in the order of
+// the batch they were made from.
+func appendRejections(rejections []lib.Rejection, batch lib.MessageBatch, info *cloudwatchlogs.RejectedLogEventsInfo) []lib.Rejection {
+	if info == nil {
+		return rejections
+	}
+
+	tooNew := int(aws.Int64Value(info.TooNewLogEventStartIndex))
+	tooOld := int(aws.Int64Value(info.TooOldLogEventEndIndex))
+	expired := int(aws.Int64Value(info.ExpiredLogEventEndIndex))
+
+	for i, msg := range batch {
+		var reason string
+
+		switch {
+		case info.TooNewLogEventStartIndex != nil && i >= tooNew:
+			reason = "the timestamp is more than 2 hours in the future"
+		case info.TooOldLogEventEndIndex != nil && i <= tooOld:
+			reason = "the timestamp is more than 14 days in the past"
+		case info.ExpiredLogEventEndIndex != nil && i <= expired:
+			reason = "the timestamp is older than the retention period of the log group"
+		default:
+			continue
+		}
+
+		rejections = append(rejections, lib.Rejection{Message: msg, Reason: reason})
+	}
+
+	return rejections
+}
+
+// put sends events with a single PutLogEvents call, retried on the errors that
+// can be recovered from. The writer is reset when the call fails, unless it was
+// only throttled, but stays usable for the next batches.
+//
+// The events of the call that CloudWatch Logs rejected, while accepting the
+// others, are described by the returned info, with the ID of the request.
+func (w *writer) put(events []*cloudwatchlogs.InputLogEvent, urgent bool) (rejected *cloudwatchlogs.RejectedLogEventsInfo, requestID string, err error) {
+	var token *string
+	var result *cloudwatchlogs.PutLogEventsOutput
+
+	if len(w.token) != 0 && !w.parent.config.skipSequenceTokens {
 		token = aws.String(w.token)
 	}
 
+	refreshed := false
+	recreated := false
+	refetches := 0
+
 	for attempt := 1; true; attempt++ {
-		if result, err = w.parent.client.PutLogEvents(&cloudwatchlogs.PutLogEventsInput{
+		w.streamLimiter.wait(urgent)
+		w.limiter.wait(urgent)
+		w.calls.Add(1)
+
+		if result, err = w.api.PutLogEventsWithContext(aws.BackgroundContext(), &cloudwatchlogs.PutLogEventsInput{
 			LogEvents:     events,
 			LogGroupName:  aws.String(w.group),
-			LogStreamName: aws.String(w.stream),
+			LogStreamName: aws.String(w.name),
 			SequenceToken: token,
-		}); err == nil {
+		}, withRequestID(&requestID)); err == nil {
+			w.limiter.succeeded()
+			w.streamLimiter.succeeded()
+			w.parent.retries.Succeeded()
+			break
+		}
+
+		// Throttled requests are retried after the partition backs off, the
+		// sequence token is still valid in that case. The retries spend the
+		// budget of the destination so that a service throttling most of
+		// the requests doesn't get even more of them.
+		if isThrottled(err) {
+			// Whether the partition or the stream went over its quota
+			// isn't known, both slow down.
+			w.limiter.throttled()
+			w.streamLimiter.throttled()
+
+			if attempt < maxThrottledAttempts && w.parent.retries.Allow() {
+				err = nil
+				continue
+			}
+
+			// The stream is fine, only CloudWatch Logs is overloaded. The
+			// batch fails but the writer keeps its token for the next one
+			// instead of being invalidated.
+			w.token = aws.StringValue(token)
+			w.parent.tokens.set(w.key(), w.token)
+
+			if e, ok := err.(awserr.RequestFailure); ok {
+				err = requestError{e}
+			}
+			return
+		}
+
+		// An earlier attempt was accepted but its response was lost, the
+		// events must not be sent twice.
+		if e, ok := err.(*cloudwatchlogs.DataAlreadyAcceptedException); ok {
+			result, err = &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: e.ExpectedSequenceToken}, nil
 			break
 		}
 
-		// The AWS Go SDK doesn't expose the error type but does return the
-		// token in the error message so we attempt to extract it from there
-		// and let the retry logic resubmit the event batch.
-		//
-		// See: https://forums.aws.amazon.com/message.jspa?messageID=676912
+		// Credentials built from a web identity token may have expired
+		// before the SDK refreshed them, retry once with fresh ones before
+		// giving up on the writer.
+		if isExpiredCredentials(err) && !refreshed {
+			w.parent.refreshCredentials()
+			refreshed = true
+			err = nil
+			continue
+		}
+
+		// The error carries the token that CloudWatch Logs expected, the
+		// batch is sent again with it.
 		if token = parseInvalidSequenceTokenException(err); attempt < 3 && token != nil {
 			err = nil
 			continue
 		}
 
+		// When the error doesn't carry the expected token it's looked up with
+		// DescribeLogStreams. The writer stays locked meanwhile so the batches
+		// queued behind this one reuse the token instead of each one failing
+		// and looking it up again.
+		if isInvalidSequenceToken(err) && refetches < w.parent.config.tokenRefetches {
+			var next string
+			refetches++
+
+			if next, err = w.parent.getDescriber().token(w.api, w.group, w.name); err == nil {
+				if token = nil; len(next) != 0 {
+					token = aws.String(next)
+				}
+				continue
+			}
+		}
+
+		// The group or stream was deleted, while ecs-logs was stopped or by
+		// something else since it was created, it's created again and the
+		// batch sent to it.
+		if !recreated && isAwsErrorCode(err, cloudwatchlogs.ErrCodeResourceNotFoundException) {
+			recreated = true
+
+			if err = w.create(); err == nil {
+				if token = nil; len(w.token) != 0 {
+					token = aws.String(w.token)
+				}
+				continue
+			}
+		}
+
 		// The documentation says we have to provide the sequence token when
 		// uploading events to CloudWatchLogs, if an error is returned here
 		// it's likely the token we have is either invalid or something worse
-		// happened.
-		// We remove the writer from it's parent client so a new writer will
-		// be created.
-		w.parent.remove(w.group, w.stream)
-		w.parent = nil
+		// happened. The writer forgets its token so the next batch starts
+		// over with the stream.
+		w.reset()
+
+		if e, ok := err.(awserr.RequestFailure); ok {
+			err = requestError{e}
+		}
 		return
 	}
 
 	w.token = aws.StringValue(result.NextSequenceToken)
+	w.parent.tokens.set(w.key(), w.token)
+	rejected = result.RejectedLogEventsInfo
 	return
 }
 
-func parseInvalidSequenceTokenException(err error) (token *string) {
-	msg := err.Error()
-
-	if !strings.HasPrefix(msg, "InvalidSequenceTokenException:") {
-		return
+// withRequestID returns a request option that sets id to the ID of the request
+// once it completed. The SDK only reports it in the errors, it's what AWS
+// support asks for when the events of a successful call were rejected too.
+func withRequestID(id *string) request.Option {
+	return func(r *request.Request) {
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			*id = r.RequestID
+		})
 	}
+}
+
+// hasEmbeddedMetrics returns true if the message is formatted as an embedded
+// metric format event, which carries its metric directives under _aws.
+func hasEmbeddedMetrics(msg lib.Message) bool {
+	var directives interface{}
 
-	if lines := strings.Split(msg, "\n"); len(lines) != 0 {
-		msg = lines[0]
+	switch v := msg.Event.Data["_aws"].(type) {
+	case map[string]interface{}:
+		directives = v["CloudWatchMetrics"]
+	case ecslogs.EventData:
+		directives = v["CloudWatchMetrics"]
 	}
 
-	parts := strings.Split(msg, ":")
+	return directives != nil
+}
 
-	if len(parts) < 3 {
-		return
+// requestError is returned by the writers when CloudWatch Logs rejected a
+// batch. The SDK appends the request ID to the end of the error message, on its
+// own line which tends to be cut off, the ID is what AWS support needs to look
+// into the rejection so it's put first.
+//
+// The RequestFailure is embedded, callers still see the error code and the
+// request ID returned by lib.RequestID.
+type requestError struct {
+	awserr.RequestFailure
+}
+
+func (e requestError) Error() string {
+	s := fmt.Sprintf("PutLogEvents request %s failed with status %d: %s: %s", e.RequestID(), e.StatusCode(), e.Code(), e.Message())
+
+	if orig := e.OrigErr(); orig != nil {
+		s += " (" + orig.Error() + ")"
 	}
 
-	s := strings.TrimSpace(parts[2])
-	token = &s
+	return s
+}
+
+func isInvalidSequenceToken(err error) bool {
+	return isAwsErrorCode(err, cloudwatchlogs.ErrCodeInvalidSequenceTokenException)
+}
+
+// parseInvalidSequenceTokenException returns the token that CloudWatch Logs
+// expected when err is an InvalidSequenceTokenException carrying it, the SDK
+// decodes it from the response into a typed error.
+func parseInvalidSequenceTokenException(err error) (token *string) {
+	if e, ok := err.(*cloudwatchlogs.InvalidSequenceTokenException); ok && e.ExpectedSequenceToken != nil {
+		token = e.ExpectedSequenceToken
+	}
 	return
 }
 
-var (
-	errInvalidWriter = errors.New("the writer was invalidated by another goroutine")
-)
+// The maximum number of attempts at writing a batch when CloudWatch Logs keeps
+// throttling the requests.
+const maxThrottledAttempts = 5
+
+// inputEvents holds the events of a batch. PutLogEvents doesn't retain its
+// input once it returned so the memory is reused by the next batches, instead
+// of allocating a slice and three values for every event.
+type inputEvents struct {
+	ptrs     []*cloudwatchlogs.InputLogEvent
+	values   []cloudwatchlogs.InputLogEvent
+	messages []string
+	times    []int64
+}
+
+var inputEventsPool = sync.Pool{
+	New: func() interface{} { return &inputEvents{} },
+}
+
+func getInputEvents(n int) *inputEvents {
+	e := inputEventsPool.Get().(*inputEvents)
+
+	if cap(e.ptrs) < n {
+		e.ptrs = make([]*cloudwatchlogs.InputLogEvent, n)
+		e.values = make([]cloudwatchlogs.InputLogEvent, n)
+		e.messages = make([]string, n)
+		e.times = make([]int64, n)
+	}
+
+	e.ptrs = e.ptrs[:n]
+	e.values = e.values[:n]
+	e.messages = e.messages[:n]
+	e.times = e.times[:n]
+	return e
+}
+
+func putInputEvents(e *inputEvents) {
+	// The messages are released so the pool doesn't keep them alive.
+	for i := range e.messages {
+		e.messages[i] = ""
+	}
+	inputEventsPool.Put(e)
+}
+
+func (e *inputEvents) set(i int, message string, timestamp int64) {
+	e.messages[i] = message
+	e.times[i] = timestamp
+	e.values[i] = cloudwatchlogs.InputLogEvent{
+		Message:   &e.messages[i],
+		Timestamp: &e.times[i],
+	}
+	e.ptrs[i] = &e.values[i]
+}
@@ -0,0 +1,628 @@
+package cloudwatchlogs
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+func TestWriterInvalidSequenceToken(t *testing.T) {
+	calls := 0
+	api := &mockAPI{}
+	api.putLogEvents = func(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+		switch calls++; calls {
+		case 1:
+			return nil, awserr.New("ThrottlingException", "Rate exceeded", nil)
+		case 2:
+			return nil, invalidSequenceToken("42")
+		default:
+			return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String("43")}, nil
+		}
+	}
+
+	f := newFakeClock()
+	c := newTestClient(config{}, api)
+	c.clock = f
+
+	w, err := c.Open("A", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteMessageBatch(makeTestBatch("A", "0", 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(api.puts) != 3 {
+		t.Fatalf("invalid number of calls to PutLogEvents: %d", len(api.puts))
+	}
+
+	if token := api.puts[2].SequenceToken; aws.StringValue(token) != "42" {
+		t.Errorf("the token extracted from the error should be used on retry: %#v", aws.StringValue(token))
+	}
+
+	// Only the throttled request backs off, the invalid token is retried
+	// right away.
+	if d := f.Slept(); d == 0 || d > c.partition("A").limiter.backoff.Max {
+		t.Errorf("invalid time spent backing off: %s", d)
+	}
+
+	if token := c.partition("A").writers.get(joinGroupStream("A", "0")).token; token != "43" {
+		t.Errorf("the writer should keep the next sequence token: %#v", token)
+	}
+
+	if receipt := w.(lib.ReceiptWriter).Receipt(); receipt != "43" {
+		t.Errorf("the next sequence token should be the receipt of the batch: %#v", receipt)
+	}
+}
+
+func TestWriterSkipSequenceTokens(t *testing.T) {
+	describes := 0
+	api := &mockAPI{existingStreams: true}
+	api.describeLogStreams = func(input *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+		describes++
+		return &cloudwatchlogs.DescribeLogStreamsOutput{}, nil
+	}
+	api.putLogEvents = func(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+		return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String("next")}, nil
+	}
+
+	c := newTestClient(config{skipSequenceTokens: true}, api)
+
+	w, err := c.Open("A", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i != 2; i++ {
+		if err := w.WriteMessageBatch(makeTestBatch("A", "0", 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if describes != 0 {
+		t.Errorf("the existing stream shouldn't be described: %d calls", describes)
+	}
+
+	for i, put := range api.puts {
+		if put.SequenceToken != nil {
+			t.Errorf("call #%d shouldn't send a sequence token: %q", i, aws.StringValue(put.SequenceToken))
+		}
+	}
+
+	// The token returned by CloudWatch Logs is still the receipt of the batch.
+	if receipt := w.(lib.ReceiptWriter).Receipt(); receipt != "next" {
+		t.Errorf("invalid receipt: %#v", receipt)
+	}
+}
+
+func TestWriterRefetchSequenceToken(t *testing.T) {
+	var mutex sync.Mutex
+	var valid = 1
+	var describes = 0
+
+	api := &mockAPI{existingStreams: true}
+	api.describeLogStreams = func(input *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		describes++
+		return &cloudwatchlogs.DescribeLogStreamsOutput{
+			LogStreams: []*cloudwatchlogs.LogStream{{
+				LogStreamName:       aws.String("0"),
+				UploadSequenceToken: aws.String(strconv.Itoa(valid)),
+			}},
+		}, nil
+	}
+	api.putLogEvents = func(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if aws.StringValue(input.SequenceToken) != strconv.Itoa(valid) {
+			return nil, awserr.New("InvalidSequenceTokenException", "The given sequenceToken is invalid.", nil)
+		}
+
+		valid++
+		return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String(strconv.Itoa(valid))}, nil
+	}
+
+	c := newTestClient(config{tokenRefetches: 1}, api)
+
+	w, err := c.Open("A", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Something else wrote to the stream, the token of the writer is stale.
+	mutex.Lock()
+	valid = 100
+	mutex.Unlock()
+
+	const batches = 5
+	errs := make(chan error, batches)
+
+	for i := 0; i != batches; i++ {
+		go func() { errs <- w.WriteMessageBatch(makeTestBatch("A", "0", 2)) }()
+	}
+
+	for i := 0; i != batches; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	// One lookup when the stream was found to exist, and one after the first
+	// batch was rejected.
+	if describes != 2 {
+		t.Errorf("the sequence token should have been looked up once: %d", describes-1)
+	}
+
+	if len(api.puts) != batches+1 {
+		t.Errorf("invalid number of calls to PutLogEvents: %d", len(api.puts))
+	}
+}
+
+func TestWriterTooManyThrottles(t *testing.T) {
+	api := &mockAPI{}
+	api.putLogEvents = func(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+		return nil, awserr.New("ThrottlingException", "Rate exceeded", nil)
+	}
+
+	c := newTestClient(config{}, api)
+
+	w, err := c.Open("A", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteMessageBatch(makeTestBatch("A", "0", 1)); err == nil {
+		t.Error("expected an error when the requests keep being throttled")
+	}
+
+	if len(api.puts) != maxThrottledAttempts {
+		t.Errorf("invalid number of calls to PutLogEvents: %d", len(api.puts))
+	}
+
+	// The writer wasn't invalidated, the next batch goes through once the
+	// throttling stops.
+	api.putLogEvents = nil
+
+	if err := w.WriteMessageBatch(makeTestBatch("A", "0", 1)); err != nil {
+		t.Error("the throttled writer should still be usable:", err)
+	}
+
+	if w2, _ := c.Open("A", "0"); w2 != w {
+		t.Error("the throttled writer shouldn't be replaced")
+	}
+}
+
+func TestWriterCallsMetric(t *testing.T) {
+	calls := 0
+	api := &mockAPI{}
+	api.putLogEvents = func(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+		if calls++; calls == 1 {
+			return nil, awserr.New("ThrottlingException", "Rate exceeded", nil)
+		}
+		return &cloudwatchlogs.PutLogEventsOutput{}, nil
+	}
+
+	c := newTestClient(config{}, api)
+	c.clock = newFakeClock()
+	counter := metrics.Default.Counter("put_log_events_calls", "group", "calls")
+	before := counter.Value()
+
+	for _, stream := range []string{"0", "1"} {
+		w, err := c.Open("calls", stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := w.WriteMessageBatch(makeTestBatch("calls", stream, 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The throttled call counts as well.
+	if n := counter.Value() - before; n != 3 {
+		t.Errorf("invalid number of calls of the group: %d", n)
+	}
+}
+
+func TestWriterPayloadSize(t *testing.T) {
+	api := &mockAPI{}
+	reg := metrics.NewRegistry()
+	dst := lib.NewMeteredDestination("cloudwatchlogs",
+		newTestClient(config{routingKey: "{group}", routingField: defaultRoutingField}, api),
+		reg,
+	)
+
+	w, err := dst.Open("A", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []int{3, 10} {
+		if err := w.WriteMessageBatch(makeTestBatch("A", "0", n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	size := 0
+
+	for _, put := range api.puts {
+		for _, e := range put.LogEvents {
+			size += len(aws.StringValue(e.Message))
+		}
+	}
+
+	if n := reg.Counter("delivered_bytes", "group", "A", "stream", "0", "destination", "cloudwatchlogs").Value(); n != int64(size) {
+		t.Errorf("the byte counter doesn't match the size of the events sent: %d != %d", n, size)
+	}
+}
+
+type mockCredentials struct {
+	expired int
+	gets    int
+
+	// The expiry reported before and after the credentials were expired, and
+	// the error reported by providers that don't expire credentials.
+	expiresAt time.Time
+	renewed   time.Time
+	err       error
+
+	// When set, signaled each time the credentials are retrieved.
+	retrieved chan struct{}
+}
+
+func (m *mockCredentials) Expire() {
+	m.expired++
+}
+
+func (m *mockCredentials) Get() (credentials.Value, error) {
+	if m.gets++; m.expired != 0 {
+		m.expiresAt = m.renewed
+	}
+	if m.retrieved != nil {
+		m.retrieved <- struct{}{}
+	}
+	return credentials.Value{AccessKeyID: "AKID"}, nil
+}
+
+func (m *mockCredentials) ExpiresAt() (time.Time, error) {
+	return m.expiresAt, m.err
+}
+
+func TestWriterExpiredCredentials(t *testing.T) {
+	calls := 0
+	api := &mockAPI{}
+	api.putLogEvents = func(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+		if calls++; calls == 1 {
+			return nil, awserr.New("ExpiredTokenException", "The security token included in the request is expired", nil)
+		}
+		return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String("next")}, nil
+	}
+
+	creds := &mockCredentials{}
+	c := newTestClient(config{}, api)
+	c.creds = creds
+
+	w, err := c.Open("A", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteMessageBatch(makeTestBatch("A", "0", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if creds.expired != 1 {
+		t.Errorf("the credentials should have been refreshed once: %d", creds.expired)
+	}
+
+	if len(api.puts) != 2 {
+		t.Errorf("invalid number of calls to PutLogEvents: %d", len(api.puts))
+	}
+
+	if c.partition("A").writers.get(joinGroupStream("A", "0")) == nil {
+		t.Error("the writer should not be torn down after refreshing the credentials")
+	}
+}
+
+func TestWriterAccessDenied(t *testing.T) {
+	api := &mockAPI{}
+	api.putLogEvents = func(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+		return nil, awserr.New("AccessDeniedException", "User is not authorized to perform: logs:PutLogEvents", nil)
+	}
+
+	creds := &mockCredentials{}
+	c := newTestClient(config{}, api)
+	c.creds = creds
+
+	w, err := c.Open("A", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteMessageBatch(makeTestBatch("A", "0", 1)); err == nil {
+		t.Error("expected an error when access keeps being denied")
+	}
+
+	if creds.expired != 1 || len(api.puts) != 2 {
+		t.Errorf("the request should be retried only once with refreshed credentials: %d refresh(es), %d call(s)", creds.expired, len(api.puts))
+	}
+}
+
+func TestWriterRequestID(t *testing.T) {
+	api := &mockAPI{}
+	api.putLogEvents = func(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+		return nil, awserr.NewRequestFailure(awserr.New("InvalidParameterException", "Log event too large", nil), 400, "4c2f1a3e-0000-4000-8000-1234567890ab")
+	}
+
+	c := newTestClient(config{}, api)
+
+	w, err := c.Open("A", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.WriteMessageBatch(makeTestBatch("A", "0", 1))
+
+	if id := lib.RequestID(err); id != "4c2f1a3e-0000-4000-8000-1234567890ab" {
+		t.Errorf("the request ID should be returned with the error: %q (%v)", id, err)
+	}
+
+	if err == nil || !strings.HasPrefix(err.Error(), "PutLogEvents request 4c2f1a3e-0000-4000-8000-1234567890ab failed with status 400: InvalidParameterException:") {
+		t.Errorf("the request ID should lead the error message: %v", err)
+	}
+
+	if !isAwsErrorCode(err, "InvalidParameterException") {
+		t.Errorf("the error code should still be visible: %v", err)
+	}
+}
+
+func TestWriterStreamDeleted(t *testing.T) {
+	calls := 0
+	api := &mockAPI{}
+	api.putLogEvents = func(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+		if calls++; calls == 2 {
+			return nil, awserr.New("ResourceNotFoundException", "The specified log stream does not exist.", nil)
+		}
+		return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String("next")}, nil
+	}
+
+	c := newTestClient(config{}, api)
+
+	w, err := c.Open("A", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i != 2; i++ {
+		if err := w.WriteMessageBatch(makeTestBatch("A", "0", 1)); err != nil {
+			t.Errorf("batch #%d: writing to a deleted stream should recover: %v", i, err)
+		}
+	}
+
+	if len(api.streams) != 2 {
+		t.Errorf("the deleted stream should have been created again: %d stream(s)", len(api.streams))
+	}
+
+	if len(api.puts) != 3 {
+		t.Errorf("the batch should have been sent again to the new stream: %d call(s)", len(api.puts))
+	}
+}
+
+func TestWriterRecoversAfterFailure(t *testing.T) {
+	api := &mockAPI{}
+	api.putLogEvents = func(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+		return nil, awserr.New("ServiceUnavailableException", "The service cannot complete the request.", nil)
+	}
+
+	c := newTestClient(config{}, api)
+
+	w, err := c.Open("A", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteMessageBatch(makeTestBatch("A", "0", 1)); err == nil {
+		t.Error("expected an error when the batch is rejected")
+	}
+
+	// The writer starts over with the stream on the next batch, instead of
+	// failing every batch until it's opened again.
+	api.putLogEvents = nil
+
+	if err := w.WriteMessageBatch(makeTestBatch("A", "0", 1)); err != nil {
+		t.Error("the writer should still be usable after a failure:", err)
+	}
+
+	if len(api.streams) != 2 {
+		t.Errorf("the stream should have been looked up again: %d stream(s)", len(api.streams))
+	}
+
+	if w2, _ := c.Open("A", "0"); w2 != w {
+		t.Error("the writer shouldn't be replaced after a failure")
+	}
+}
+
+func TestWriterCreateFailure(t *testing.T) {
+	fail := true
+	api := &mockAPI{}
+	api.createLogGroup = func(*cloudwatchlogs.CreateLogGroupInput) error {
+		if fail {
+			return awserr.New("ServiceUnavailableException", "The service cannot complete the request.", nil)
+		}
+		return nil
+	}
+
+	c := newTestClient(config{}, api)
+
+	w, err := c.Open("A", "0")
+	if err == nil {
+		t.Fatal("expected an error when the log group can't be created")
+	}
+
+	// The batches written to the writer create the stream.
+	fail = false
+
+	if err := w.WriteMessageBatch(makeTestBatch("A", "0", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(api.groups) != 2 || len(api.streams) != 1 || len(api.puts) != 1 {
+		t.Errorf("invalid calls: %d group(s), %d stream(s), %d put(s)", len(api.groups), len(api.streams), len(api.puts))
+	}
+}
+
+func TestWriterDataAlreadyAccepted(t *testing.T) {
+	api := &mockAPI{}
+	api.putLogEvents = func(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+		return nil, &cloudwatchlogs.DataAlreadyAcceptedException{
+			Message_:              aws.String("The given batch of log events has already been accepted."),
+			ExpectedSequenceToken: aws.String("43"),
+		}
+	}
+
+	c := newTestClient(config{}, api)
+
+	w, err := c.Open("A", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteMessageBatch(makeTestBatch("A", "0", 1)); err != nil {
+		t.Error("a batch that was already accepted should succeed:", err)
+	}
+
+	if len(api.puts) != 1 {
+		t.Errorf("the accepted batch shouldn't be sent again: %d call(s)", len(api.puts))
+	}
+
+	if receipt := w.(lib.ReceiptWriter).Receipt(); receipt != "43" {
+		t.Errorf("the expected sequence token should be kept: %#v", receipt)
+	}
+}
+
+func TestWriterConcurrentStreams(t *testing.T) {
+	release := make(chan struct{})
+	blocked := make(chan struct{})
+
+	api := &mockAPI{}
+	api.putLogEvents = func(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+		if aws.StringValue(input.LogStreamName) == "slow" {
+			close(blocked)
+			<-release
+		}
+		return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String("next")}, nil
+	}
+
+	c := newTestClient(config{}, api)
+	slow, err := c.Open("A", "slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- slow.WriteMessageBatch(makeTestBatch("A", "slow", 1)) }()
+	<-blocked
+
+	// The other streams of the group are opened and written to while the
+	// slow one is stuck in its call.
+	for _, stream := range []string{"0", "1"} {
+		w, err := c.Open("A", stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := w.WriteMessageBatch(makeTestBatch("A", stream, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func BenchmarkWriterWrite(b *testing.B) {
+	for _, n := range []int{10, 1000} {
+		batch := makeTestBatch("A", "0", n)
+
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			api := &mockAPI{}
+			client := newTestClient(config{}, api)
+
+			w, err := client.Open("A", "0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+
+			for i := 0; i != b.N; i++ {
+				if err := w.WriteMessageBatch(batch); err != nil {
+					b.Fatal(err)
+				}
+
+				// The mock records the calls, they're dropped so the
+				// benchmark measures the writer and not the recording.
+				api.mutex.Lock()
+				api.puts = api.puts[:0]
+				api.mutex.Unlock()
+			}
+		})
+	}
+}
+
+func TestWriterRejectedEvents(t *testing.T) {
+	api := &mockAPI{
+		putLogEvents: func(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+			return &cloudwatchlogs.PutLogEventsOutput{
+				NextSequenceToken: aws.String("next"),
+				RejectedLogEventsInfo: &cloudwatchlogs.RejectedLogEventsInfo{
+					TooOldLogEventEndIndex:   aws.Int64(0),
+					TooNewLogEventStartIndex: aws.Int64(int64(len(input.LogEvents) - 1)),
+				},
+			}, nil
+		},
+	}
+
+	w, err := newTestClient(config{}, api).Open("A", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := makeTestBatch("A", "0", 4)
+	err = w.WriteMessageBatch(batch)
+
+	rejected, ok := err.(*lib.RejectedError)
+	if !ok {
+		t.Fatalf("the rejected events should be reported: %v", err)
+	}
+
+	if len(rejected.Rejections) != 2 {
+		t.Fatalf("invalid number of rejected events: %d", len(rejected.Rejections))
+	}
+
+	if rejected.ID != "request-1" {
+		t.Errorf("the ID of the request should be reported: %q", rejected.ID)
+	}
+
+	if r := rejected.Rejections[0]; r.Message.Event.Message != "message 0" || !strings.Contains(r.Reason, "14 days") {
+		t.Errorf("the first event should be rejected as too old: %+v", r)
+	}
+
+	if r := rejected.Rejections[1]; r.Message.Event.Message != "message 3" || !strings.Contains(r.Reason, "future") {
+		t.Errorf("the last event should be rejected as too new: %+v", r)
+	}
+}
@@ -0,0 +1,173 @@
+// Package codec implements the compression formats that objects written by
+// the archival destinations can be encoded with.
+package codec
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// A Codec compresses the content of objects, the extension is appended to the
+// object keys so consumers can tell how to read them.
+type Codec interface {
+	// Name returns the name that the codec is selected by.
+	Name() string
+
+	// Extension returns the suffix of the keys of objects encoded with the
+	// codec, including the leading dot, or an empty string.
+	Extension() string
+
+	// NewWriter returns a writer compressing its input to w, closing it
+	// flushes the compressed data but doesn't close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+
+	// NewReader returns a reader of the decompressed content of r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// Names returns the names of the available codecs.
+func Names() []string {
+	return []string{"none", "gzip", "zstd", "snappy"}
+}
+
+// Get returns the codec of the given name, compressing at the given level
+// when the format supports it. A zero level selects the default level of the
+// codec.
+func Get(name string, level int) (c Codec, err error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "none":
+		c, err = noneCodec{}, checkNoLevel(name, level)
+	case "gzip", "":
+		c, err = newGzipCodec(level)
+	case "zstd":
+		c, err = newZstdCodec(level)
+	case "snappy":
+		c, err = snappyCodec{}, checkNoLevel(name, level)
+	default:
+		err = fmt.Errorf("unknown codec, must be one of %s: %s", strings.Join(Names(), ", "), name)
+	}
+	return
+}
+
+// Parse returns the codec configured by the given environment variables, for
+// example S3_CODEC and S3_COMPRESSION_LEVEL.
+func Parse(codecVar string, levelVar string, getenv func(string) string) (c Codec, err error) {
+	var level int
+
+	if s := strings.TrimSpace(getenv(levelVar)); len(s) != 0 {
+		if level, err = strconv.Atoi(s); err != nil {
+			err = fmt.Errorf("invalid %s, must be an integer: %s", levelVar, s)
+			return
+		}
+	}
+
+	if c, err = Get(getenv(codecVar), level); err != nil {
+		err = fmt.Errorf("invalid %s, %s", codecVar, err)
+	}
+	return
+}
+
+func checkNoLevel(name string, level int) error {
+	if level != 0 {
+		return fmt.Errorf("the %s codec has no compression level: %d", name, level)
+	}
+	return nil
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string { return "none" }
+
+func (noneCodec) Extension() string { return "" }
+
+func (noneCodec) NewWriter(w io.Writer) (io.WriteCloser, error) { return nopCloser{w}, nil }
+
+func (noneCodec) NewReader(r io.Reader) (io.ReadCloser, error) { return ioutil.NopCloser(r), nil }
+
+type gzipCodec struct {
+	level int
+}
+
+func newGzipCodec(level int) (c gzipCodec, err error) {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	} else if level < gzip.BestSpeed || level > gzip.BestCompression {
+		err = fmt.Errorf("the gzip compression level must be between %d and %d: %d", gzip.BestSpeed, gzip.BestCompression, level)
+	}
+	c.level = level
+	return
+}
+
+func (c gzipCodec) Name() string { return "gzip" }
+
+func (c gzipCodec) Extension() string { return ".gz" }
+
+func (c gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, c.level)
+}
+
+func (c gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type zstdCodec struct {
+	level zstd.EncoderLevel
+}
+
+func newZstdCodec(level int) (c zstdCodec, err error) {
+	// The zstd levels go from 1 to 22, they are mapped to the four speeds
+	// that the encoder implements.
+	if level == 0 {
+		c.level = zstd.SpeedDefault
+	} else if level < 1 || level > 22 {
+		err = fmt.Errorf("the zstd compression level must be between 1 and 22: %d", level)
+	} else {
+		c.level = zstd.EncoderLevelFromZstd(level)
+	}
+	return
+}
+
+func (c zstdCodec) Name() string { return "zstd" }
+
+func (c zstdCodec) Extension() string { return ".zst" }
+
+func (c zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(c.level), zstd.WithEncoderConcurrency(1))
+}
+
+func (c zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+// snappyCodec uses the framing format, unlike raw snappy blocks it can be
+// streamed and is what the snappy command line tools read.
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string { return "snappy" }
+
+func (snappyCodec) Extension() string { return ".sz" }
+
+func (snappyCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return snappy.NewBufferedWriter(w), nil
+}
+
+func (snappyCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(snappy.NewReader(r)), nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,108 @@
+package codec
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	content := []byte(strings.Repeat(`{"level":"INFO","message":"Hello World!"}`+"\n", 1000))
+
+	tests := []struct {
+		name      string
+		level     int
+		extension string
+	}{
+		{name: "none", extension: ""},
+		{name: "gzip", extension: ".gz"},
+		{name: "gzip", level: 9, extension: ".gz"},
+		{name: "zstd", extension: ".zst"},
+		{name: "zstd", level: 19, extension: ".zst"},
+		{name: "snappy", extension: ".sz"},
+	}
+
+	for _, test := range tests {
+		c, err := Get(test.name, test.level)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		if c.Name() != test.name {
+			t.Errorf("%s: invalid name: %s", test.name, c.Name())
+		}
+
+		if c.Extension() != test.extension {
+			t.Errorf("%s: invalid extension: %q", test.name, c.Extension())
+		}
+
+		var buf bytes.Buffer
+		w, err := c.NewWriter(&buf)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		if _, err := w.Write(content); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+
+		if err := w.Close(); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+
+		if test.name != "none" && buf.Len() >= len(content) {
+			t.Errorf("%s: the content wasn't compressed: %d bytes", test.name, buf.Len())
+		}
+
+		r, err := c.NewReader(&buf)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if !bytes.Equal(b, content) {
+			t.Errorf("%s: the decompressed content doesn't match", test.name)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		env map[string]string
+		out string
+		err bool
+	}{
+		{env: map[string]string{}, out: "gzip"},
+		{env: map[string]string{"S3_CODEC": "ZSTD"}, out: "zstd"},
+		{env: map[string]string{"S3_CODEC": "zstd", "S3_COMPRESSION_LEVEL": "3"}, out: "zstd"},
+		{env: map[string]string{"S3_CODEC": "lz4"}, err: true},
+		{env: map[string]string{"S3_CODEC": "gzip", "S3_COMPRESSION_LEVEL": "10"}, err: true},
+		{env: map[string]string{"S3_CODEC": "zstd", "S3_COMPRESSION_LEVEL": "fast"}, err: true},
+		{env: map[string]string{"S3_CODEC": "snappy", "S3_COMPRESSION_LEVEL": "1"}, err: true},
+	}
+
+	for _, test := range tests {
+		c, err := Parse("S3_CODEC", "S3_COMPRESSION_LEVEL", func(k string) string { return test.env[k] })
+
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: expected an error", test.env)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%v: %s", test.env, err)
+		} else if c.Name() != test.out {
+			t.Errorf("%v: invalid codec: %s", test.env, c.Name())
+		}
+	}
+}
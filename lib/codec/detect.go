@@ -0,0 +1,112 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The magic bytes that the compressed formats start with, snappy is the
+// stream identifier chunk of the framing format. The codecs compress at their
+// default level if they're used to write.
+var magics = []struct {
+	codec Codec
+	magic []byte
+}{
+	{gzipCodec{level: gzip.DefaultCompression}, []byte{0x1f, 0x8b}},
+	{zstdCodec{level: zstd.SpeedDefault}, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{snappyCodec{}, []byte("\xff\x06\x00\x00sNaPpY")},
+}
+
+// The number of bytes that Detect needs to recognize all the formats.
+const magicSize = 10
+
+// Detect returns the codec that the file of the given name and beginning is
+// compressed with. The magic bytes take precedence, the extension is only used
+// when header is too short to tell, like for a truncated file. Files that are
+// not compressed, and empty files which have nothing to decompress, get the
+// none codec.
+func Detect(name string, header []byte) Codec {
+	for _, m := range magics {
+		if bytes.HasPrefix(header, m.magic) {
+			return m.codec
+		}
+	}
+
+	if len(header) != 0 && len(header) < magicSize {
+		ext := strings.ToLower(filepath.Ext(name))
+
+		for _, m := range magics {
+			if m.codec.Extension() == ext && bytes.HasPrefix(m.magic, header) {
+				return m.codec
+			}
+		}
+	}
+
+	return noneCodec{}
+}
+
+// NewDetectingReader returns a reader of the decompressed content of r, the
+// codec is detected from name and the first bytes of r.
+func NewDetectingReader(name string, r io.Reader) (io.ReadCloser, Codec, error) {
+	b := bufio.NewReader(r)
+	header, _ := b.Peek(magicSize)
+	c := Detect(name, header)
+
+	d, err := c.NewReader(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return d, c, nil
+}
+
+// Open opens the log file at path for reading, decompressing it when it's
+// compressed. Files that are still being written to, like the current file of
+// a rotation, must be opened with active set: they're always read as is since
+// a compressed stream can't be followed while it grows, and a line that
+// happens to start with magic bytes mustn't be mistaken for a format.
+func Open(path string, active bool) (r io.ReadCloser, c Codec, err error) {
+	var f *os.File
+
+	if f, err = os.Open(path); err != nil {
+		return
+	}
+
+	if active {
+		r, c = f, noneCodec{}
+		return
+	}
+
+	var d io.ReadCloser
+
+	if d, c, err = NewDetectingReader(path, f); err != nil {
+		f.Close()
+		return
+	}
+
+	r = fileReader{ReadCloser: d, file: f}
+	return
+}
+
+// fileReader closes both the decompressor and the file it reads from.
+type fileReader struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (r fileReader) Close() error {
+	err := r.ReadCloser.Close()
+
+	if ferr := r.file.Close(); err == nil {
+		err = ferr
+	}
+
+	return err
+}
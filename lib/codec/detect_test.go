@@ -0,0 +1,98 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	compress := func(name string) []byte {
+		c, _ := Get(name, 0)
+		b := &bytes.Buffer{}
+		w, _ := c.NewWriter(b)
+		w.Write([]byte("Hello World!\n"))
+		w.Close()
+		return b.Bytes()
+	}
+
+	tests := []struct {
+		file   string
+		header []byte
+		codec  string
+	}{
+		{file: "app.log.1.gz", header: compress("gzip"), codec: "gzip"},
+		{file: "app.log.1", header: compress("gzip"), codec: "gzip"},
+		{file: "app.log.2.zst", header: compress("zstd"), codec: "zstd"},
+		{file: "app.log.3.sz", header: compress("snappy"), codec: "snappy"},
+		{file: "app.log", header: []byte("Hello World!\n"), codec: "none"},
+		{file: "app.log.gz", header: []byte("Hello World!\n"), codec: "none"},
+		{file: "app.log.gz", header: []byte{0x1f}, codec: "gzip"},
+		{file: "app.log.gz", header: nil, codec: "none"},
+	}
+
+	for _, test := range tests {
+		if c := Detect(test.file, test.header); c.Name() != test.codec {
+			t.Errorf("%s: invalid codec detected: %s", test.file, c.Name())
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codec_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const content = "first line\nsecond line\n"
+
+	rotated := filepath.Join(dir, "app.log.1.gz")
+	b := &bytes.Buffer{}
+	w := gzip.NewWriter(b)
+	w.Write([]byte(content))
+	w.Close()
+	ioutil.WriteFile(rotated, b.Bytes(), 0644)
+
+	plain := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(plain, []byte(content), 0644)
+
+	// The active file is written with gzip content, it must still be read
+	// as is.
+	active := filepath.Join(dir, "active.log")
+	ioutil.WriteFile(active, b.Bytes(), 0644)
+
+	tests := []struct {
+		path    string
+		active  bool
+		codec   string
+		content string
+	}{
+		{path: rotated, codec: "gzip", content: content},
+		{path: plain, codec: "none", content: content},
+		{path: plain, active: true, codec: "none", content: content},
+		{path: active, active: true, codec: "none", content: b.String()},
+	}
+
+	for _, test := range tests {
+		r, c, err := Open(test.path, test.active)
+		if err != nil {
+			t.Errorf("%s: %s", test.path, err)
+			continue
+		}
+
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+
+		if err != nil {
+			t.Errorf("%s: %s", test.path, err)
+		} else if c.Name() != test.codec {
+			t.Errorf("%s: invalid codec: %s", test.path, c.Name())
+		} else if string(data) != test.content {
+			t.Errorf("%s: invalid content: %q", test.path, data)
+		}
+	}
+}
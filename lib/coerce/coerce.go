@@ -0,0 +1,504 @@
+// Package coerce implements the coerce stage, which converts the data fields of
+// the messages to the types declared for them, so destinations with a typed
+// schema don't reject the messages carrying a number where a string was seen
+// before.
+package coerce
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// Type is the type that the values of a field are coerced to.
+type Type int
+
+const (
+	String Type = iota
+	Int
+	Float
+	Bool
+	Timestamp
+)
+
+func ParseType(s string) (t Type, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "string":
+		t = String
+	case "int":
+		t = Int
+	case "float":
+		t = Float
+	case "bool":
+		t = Bool
+	case "timestamp":
+		t = Timestamp
+	default:
+		err = fmt.Errorf("unknown type %q, must be one of string, int, float, bool or timestamp", s)
+	}
+	return
+}
+
+func (t Type) String() string {
+	switch t {
+	case String:
+		return "string"
+	case Int:
+		return "int"
+	case Float:
+		return "float"
+	case Bool:
+		return "bool"
+	default:
+		return "timestamp"
+	}
+}
+
+// Policy is what happens to the messages with values that can't be coerced.
+type Policy int
+
+const (
+	// DropPolicy removes the values that can't be coerced from the messages,
+	// the rest of the message is kept.
+	DropPolicy Policy = iota
+
+	// DeadLetterPolicy sends the messages to the dead-letter group unchanged,
+	// with the failed coercions recorded in their dead-letter data field.
+	DeadLetterPolicy
+)
+
+func ParsePolicy(s string) (p Policy, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "drop":
+		p = DropPolicy
+	case "dead-letter":
+		p = DeadLetterPolicy
+	default:
+		err = fmt.Errorf("invalid COERCE_POLICY, must be one of drop or dead-letter: %s", s)
+	}
+	return
+}
+
+type field struct {
+	// The dotted path of the field in the event data, like request.status,
+	// and its keys.
+	path string
+	keys []string
+
+	typ Type
+}
+
+type config struct {
+	fields []field
+	policy Policy
+
+	// The group that the messages are sent to with the dead-letter policy,
+	// {group} and {stream} are replaced by the names of the message.
+	deadLetterGroup string
+}
+
+func getConfig() (c config, err error) {
+	var s string
+
+	c.deadLetterGroup = "ecs-logs-dead-letter"
+
+	if s = strings.TrimSpace(lib.Getenv("COERCE_FIELDS")); len(s) == 0 {
+		err = fmt.Errorf("missing COERCE_FIELDS environment variable")
+		return
+	}
+
+	if c.fields, err = parseFields(s); err != nil {
+		err = fmt.Errorf("invalid COERCE_FIELDS, %s", err)
+		return
+	}
+
+	if c.policy, err = ParsePolicy(lib.Getenv("COERCE_POLICY")); err != nil {
+		return
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("COERCE_DEAD_LETTER_GROUP")); len(s) != 0 {
+		c.deadLetterGroup = s
+	}
+
+	return
+}
+
+// parseFields parses a comma separated list of path=type pairs.
+func parseFields(s string) (fields []field, err error) {
+	paths := make(map[string]bool)
+
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+
+		i := strings.IndexByte(item, '=')
+
+		if i < 0 {
+			err = fmt.Errorf("must be a list of path=type pairs: %s", item)
+			return
+		}
+
+		f := field{path: strings.TrimSpace(item[:i])}
+		f.keys = strings.Split(f.path, ".")
+
+		for _, k := range f.keys {
+			if len(k) == 0 {
+				err = fmt.Errorf("invalid path %q", f.path)
+				return
+			}
+		}
+
+		if paths[f.path] {
+			err = fmt.Errorf("the type of %s is declared twice", f.path)
+			return
+		}
+
+		if f.typ, err = ParseType(item[i+1:]); err != nil {
+			err = fmt.Errorf("%s: %s", f.path, err)
+			return
+		}
+
+		paths[f.path] = true
+		fields = append(fields, f)
+	}
+
+	if len(fields) == 0 {
+		err = fmt.Errorf("no fields were declared")
+	}
+
+	return
+}
+
+func NewProcessor() (p lib.Processor, err error) {
+	var c config
+
+	if c, err = getConfig(); err == nil {
+		p = newProcessor(c, metrics.Default)
+	}
+
+	return
+}
+
+func checkConfig() (err error) {
+	_, err = getConfig()
+	return
+}
+
+type processor struct {
+	config
+	invalid *metrics.Counter
+}
+
+func newProcessor(c config, registry *metrics.Registry) *processor {
+	return &processor{
+		config:  c,
+		invalid: registry.Counter("invalid_messages", "stage", "coerce"),
+	}
+}
+
+func (p *processor) Process(msg lib.Message, now time.Time) []lib.Message {
+	var problems []string
+	data := msg.Event.Data
+
+	for _, f := range p.fields {
+		v := lookup(data, f.keys)
+
+		// The missing fields and the null values fit any type.
+		if v == nil {
+			continue
+		}
+
+		c, err := coerce(v, f.typ)
+
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", f.path, err))
+
+			if p.policy == DropPolicy {
+				data = update(data, f.keys, nil, true)
+			}
+			continue
+		}
+
+		if c != v {
+			data = update(data, f.keys, c, false)
+		}
+	}
+
+	if len(problems) == 0 || p.policy == DropPolicy {
+		if len(problems) != 0 {
+			p.invalid.Add(1)
+			log.WithFields(log.Fields{
+				"group":    msg.Group,
+				"stream":   msg.Stream,
+				"problems": strings.Join(problems, "; "),
+			}).Warn("dropping data fields that couldn't be coerced to their type")
+		}
+
+		msg.Event.Data = data
+		return []lib.Message{msg}
+	}
+
+	p.invalid.Add(1)
+
+	res := msg
+	res.Group = strings.NewReplacer("{group}", msg.Group, "{stream}", msg.Stream).Replace(p.deadLetterGroup)
+	res.Event.Data = copyData(msg.Event.Data)
+
+	info := lib.DeadLetterInfo(msg, "some data fields couldn't be coerced to their type", nil)
+	info["problems"] = problems
+	res.Event.Data[lib.DeadLetterField] = info
+	return []lib.Message{res}
+}
+
+func (p *processor) Flush(now time.Time) []lib.Message {
+	return nil
+}
+
+// coerce converts v to t. The values that are already of the type are
+// returned as they are, so the message is only modified when needed.
+func coerce(v interface{}, t Type) (interface{}, error) {
+	switch t {
+	case String:
+		return coerceString(v)
+	case Int:
+		return coerceInt(v)
+	case Float:
+		return coerceFloat(v)
+	case Bool:
+		return coerceBool(v)
+	default:
+		return coerceTimestamp(v)
+	}
+}
+
+func coerceString(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case string:
+		return x, nil
+	case bool:
+		return strconv.FormatBool(x), nil
+	}
+
+	if f, ok := number(v); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+	}
+
+	// Objects and arrays become their JSON representation.
+	b, err := json.Marshal(v)
+
+	if err != nil {
+		return nil, fmt.Errorf("can't be converted to a string: %s", err)
+	}
+
+	return string(b), nil
+}
+
+func coerceInt(v interface{}) (interface{}, error) {
+	if x, ok := v.(int64); ok {
+		return x, nil
+	}
+
+	f, ok := number(v)
+
+	if s, isString := v.(string); isString {
+		s = strings.TrimSpace(s)
+
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, nil
+		}
+
+		f, ok = parseFloat(s)
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("%s can't be converted to an int", describe(v))
+	}
+
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return nil, fmt.Errorf("%v isn't an integer", f)
+	}
+
+	return int64(f), nil
+}
+
+func coerceFloat(v interface{}) (interface{}, error) {
+	if x, ok := v.(float64); ok {
+		return x, nil
+	}
+
+	f, ok := number(v)
+
+	if s, isString := v.(string); isString {
+		f, ok = parseFloat(strings.TrimSpace(s))
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("%s can't be converted to a float", describe(v))
+	}
+
+	return f, nil
+}
+
+func coerceBool(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case bool:
+		return x, nil
+	case string:
+		if b, err := strconv.ParseBool(strings.TrimSpace(x)); err == nil {
+			return b, nil
+		}
+	}
+
+	if f, ok := number(v); ok && (f == 0 || f == 1) {
+		return f == 1, nil
+	}
+
+	return nil, fmt.Errorf("%s can't be converted to a bool", describe(v))
+}
+
+// coerceTimestamp converts a RFC 3339 time or a unix time to a RFC 3339 time
+// in UTC. The unit of the unix times is guessed from their magnitude, so the
+// times in seconds, milliseconds, microseconds and nanoseconds all work.
+func coerceTimestamp(v interface{}) (interface{}, error) {
+	f, ok := number(v)
+
+	if s, isString := v.(string); isString {
+		s = strings.TrimSpace(s)
+
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return t.UTC().Format(time.RFC3339Nano), nil
+		}
+
+		f, ok = parseFloat(s)
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("%s can't be converted to a timestamp", describe(v))
+	}
+
+	var t time.Time
+
+	switch a := math.Abs(f); {
+	case a < 1e11:
+		sec, frac := math.Modf(f)
+		t = time.Unix(int64(sec), int64(frac*1e9))
+	case a < 1e14:
+		t = time.Unix(0, int64(f*1e6))
+	case a < 1e17:
+		t = time.Unix(0, int64(f*1e3))
+	case a < math.MaxInt64:
+		t = time.Unix(0, int64(f))
+	default:
+		return nil, fmt.Errorf("%v is out of the range of the timestamps", f)
+	}
+
+	return t.UTC().Format(time.RFC3339Nano), nil
+}
+
+// number returns the value of the numbers decoded from JSON or set by the
+// other stages.
+func number(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case float32:
+		return float64(x), true
+	case int:
+		return float64(x), true
+	case int32:
+		return float64(x), true
+	case int64:
+		return float64(x), true
+	case uint:
+		return float64(x), true
+	case uint32:
+		return float64(x), true
+	case uint64:
+		return float64(x), true
+	case json.Number:
+		return parseFloat(x.String())
+	}
+	return 0, false
+}
+
+// parseFloat parses s, the values that can't be represented in JSON like NaN
+// are rejected.
+func parseFloat(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil && !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+func describe(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return fmt.Sprintf("%q", v)
+	case map[string]interface{}, ecslogs.EventData:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func lookup(data ecslogs.EventData, keys []string) interface{} {
+	var value interface{} = map[string]interface{}(data)
+
+	for _, key := range keys {
+		switch m := value.(type) {
+		case ecslogs.EventData:
+			value = m[key]
+		case map[string]interface{}:
+			value = m[key]
+		default:
+			return nil
+		}
+	}
+
+	return value
+}
+
+// update returns a copy of data with the value at keys set to v, or removed.
+// The data of the message may be shared with other messages, the objects are
+// copied along the path instead of being modified in place.
+func update(data ecslogs.EventData, keys []string, v interface{}, remove bool) ecslogs.EventData {
+	c := copyData(data)
+	k := keys[0]
+
+	if len(keys) == 1 {
+		if remove {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+
+	switch m := c[k].(type) {
+	case ecslogs.EventData:
+		c[k] = update(m, keys[1:], v, remove)
+	case map[string]interface{}:
+		c[k] = map[string]interface{}(update(ecslogs.EventData(m), keys[1:], v, remove))
+	}
+
+	return c
+}
+
+func copyData(data ecslogs.EventData) ecslogs.EventData {
+	c := make(ecslogs.EventData, len(data)+1)
+
+	for k, v := range data {
+		c[k] = v
+	}
+
+	return c
+}
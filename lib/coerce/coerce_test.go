@@ -0,0 +1,210 @@
+package coerce
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+const testFields = "status=int,duration=float,user=string,cached=bool,started_at=timestamp,request.id=string"
+
+func newTestProcessor(t *testing.T, policy Policy) (*processor, *metrics.Registry) {
+	fields, err := parseFields(testFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := metrics.NewRegistry()
+	return newProcessor(config{fields: fields, policy: policy, deadLetterGroup: "dead-letter-{group}"}, r), r
+}
+
+func makeMessage(data ecslogs.EventData) lib.Message {
+	return lib.Message{
+		Group:  "A",
+		Stream: "B",
+		Event: ecslogs.Event{
+			Level:   ecslogs.INFO,
+			Time:    time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC),
+			Message: "Hello World!",
+			Data:    data,
+		},
+	}
+}
+
+func TestProcessorCoercions(t *testing.T) {
+	p, r := newTestProcessor(t, DropPolicy)
+	msg := makeMessage(ecslogs.EventData{
+		"status":     "200",
+		"duration":   "0.25",
+		"user":       42.0,
+		"cached":     "true",
+		"started_at": 1476230400000.0,
+		"request":    map[string]interface{}{"id": 1234.0, "path": "/"},
+		"other":      "unchanged",
+	})
+
+	msgs := p.Process(msg, time.Now())
+
+	if len(msgs) != 1 {
+		t.Fatalf("the message should be kept: %+v", msgs)
+	}
+
+	expected := ecslogs.EventData{
+		"status":     int64(200),
+		"duration":   0.25,
+		"user":       "42",
+		"cached":     true,
+		"started_at": "2016-10-12T00:00:00Z",
+		"request":    map[string]interface{}{"id": "1234", "path": "/"},
+		"other":      "unchanged",
+	}
+
+	if !reflect.DeepEqual(msgs[0].Event.Data, expected) {
+		t.Errorf("invalid coerced data:\n%#v\n%#v", msgs[0].Event.Data, expected)
+	}
+
+	if msg.Event.Data["status"] != "200" || msg.Event.Data["request"].(map[string]interface{})["id"] != 1234.0 {
+		t.Error("the original message should not be modified")
+	}
+
+	if n := r.Counter("invalid_messages", "stage", "coerce").Value(); n != 0 {
+		t.Errorf("no message should be counted as invalid: %d", n)
+	}
+}
+
+func TestCoerce(t *testing.T) {
+	tests := []struct {
+		value  interface{}
+		typ    Type
+		result interface{}
+	}{
+		{"-3", Int, int64(-3)},
+		{"3.0", Int, int64(3)},
+		{7, Int, int64(7)},
+		{1e3, String, "1000"},
+		{false, String, "false"},
+		{[]interface{}{1.0, "a"}, String, `[1,"a"]`},
+		{"1e3", Float, 1000.0},
+		{int64(2), Float, 2.0},
+		{1.0, Bool, true},
+		{" FALSE ", Bool, false},
+		{"2016-10-12T02:00:00.5+02:00", Timestamp, "2016-10-12T00:00:00.5Z"},
+		{1476230400, Timestamp, "2016-10-12T00:00:00Z"},
+		{"1476230400000000", Timestamp, "2016-10-12T00:00:00Z"},
+		{1476230400000000000.0, Timestamp, "2016-10-12T00:00:00Z"},
+	}
+
+	for _, test := range tests {
+		if res, err := coerce(test.value, test.typ); err != nil || res != test.result {
+			t.Errorf("%#v to %s: expected %#v but got %#v (%v)", test.value, test.typ, test.result, res, err)
+		}
+	}
+
+	for _, test := range []struct {
+		value interface{}
+		typ   Type
+	}{
+		{"OK", Int},
+		{2.5, Int},
+		{"NaN", Float},
+		{map[string]interface{}{}, Float},
+		{2.0, Bool},
+		{"yes please", Bool},
+		{"yesterday", Timestamp},
+		{true, Timestamp},
+	} {
+		if res, err := coerce(test.value, test.typ); err == nil {
+			t.Errorf("%#v to %s: the coercion should fail but got %#v", test.value, test.typ, res)
+		}
+	}
+}
+
+func TestProcessorDrop(t *testing.T) {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+	p, r := newTestProcessor(t, DropPolicy)
+	msg := makeMessage(ecslogs.EventData{"status": "OK", "duration": 12.0, "cached": nil})
+
+	msgs := p.Process(msg, time.Now())
+
+	if len(msgs) != 1 || msgs[0].Group != "A" {
+		t.Fatalf("the message should be kept in its group: %+v", msgs)
+	}
+
+	// The null values are left alone.
+	if expected := (ecslogs.EventData{"duration": 12.0, "cached": nil}); !reflect.DeepEqual(msgs[0].Event.Data, expected) {
+		t.Errorf("only the value that couldn't be coerced should be dropped: %#v", msgs[0].Event.Data)
+	}
+
+	if _, ok := msg.Event.Data["status"]; !ok {
+		t.Error("the original message should not be modified")
+	}
+
+	if n := r.Counter("invalid_messages", "stage", "coerce").Value(); n != 1 {
+		t.Errorf("the invalid message should be counted: %d", n)
+	}
+}
+
+func TestProcessorDeadLetter(t *testing.T) {
+	p, r := newTestProcessor(t, DeadLetterPolicy)
+	msg := makeMessage(ecslogs.EventData{"status": "OK", "duration": "12", "started_at": "yesterday"})
+
+	msgs := p.Process(msg, time.Now())
+
+	if len(msgs) != 1 || msgs[0].Group != "dead-letter-A" || msgs[0].Stream != "B" {
+		t.Fatalf("the message should be sent to the dead-letter group: %+v", msgs)
+	}
+
+	data := msgs[0].Event.Data
+	info, _ := data[lib.DeadLetterField].(ecslogs.EventData)
+	problems := []string{
+		`status: "OK" can't be converted to an int`,
+		`started_at: "yesterday" can't be converted to a timestamp`,
+	}
+
+	if info["group"] != "A" || info["stream"] != "B" || !reflect.DeepEqual(info["problems"], problems) {
+		t.Errorf("the failed coercions should be attached to the dead-lettered message: %#v", info)
+	}
+
+	if data["status"] != "OK" || data["duration"] != "12" {
+		t.Errorf("the dead-lettered message should keep its original values: %#v", data)
+	}
+
+	if _, ok := msg.Event.Data[lib.DeadLetterField]; ok {
+		t.Error("the original message should not be modified")
+	}
+
+	if n := r.Counter("invalid_messages", "stage", "coerce").Value(); n != 1 {
+		t.Errorf("the invalid message should be counted: %d", n)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	for fields, valid := range map[string]bool{
+		testFields:               true,
+		"status = INT":           true,
+		"":                       false,
+		"status":                 false,
+		"status=integer":         false,
+		"status=int,status=bool": false,
+		"request..id=string":     false,
+	} {
+		lib.SetConfigEnv(map[string]string{"COERCE_FIELDS": fields})
+
+		if _, err := getConfig(); (err == nil) != valid {
+			t.Errorf("%q: valid=%t but got %v", fields, valid, err)
+		}
+	}
+
+	lib.SetConfigEnv(map[string]string{"COERCE_FIELDS": "status=int", "COERCE_POLICY": "reject"})
+
+	if _, err := getConfig(); err == nil {
+		t.Error("the policy should be invalid")
+	}
+}
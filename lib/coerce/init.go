@@ -0,0 +1,14 @@
+package coerce
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterStage("coerce", lib.NewCheckedStage(lib.StageFunc(NewProcessor), checkConfig))
+
+	// The fields set by the other stages get the declared types too, and the
+	// validate stage checks the coerced values.
+	lib.RegisterStageOrder("coerce", lib.StageOrder{
+		After:  []string{"correlation", "merge", "metadata", "schema", "xray"},
+		Before: []string{"validate"},
+	})
+}
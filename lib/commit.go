@@ -0,0 +1,31 @@
+package lib
+
+import "fmt"
+
+// A Committer is a Reader that saves a checkpoint of its progress, like the
+// cursor of the journal, as the messages it read are acknowledged. The readers
+// save it periodically, Commit saves it right away so the acknowledgements of
+// the last batches written when ecs-logs exits aren't lost.
+//
+// Commit is called after the reader was closed.
+type Committer interface {
+	Commit() error
+}
+
+// Commit saves the checkpoint of the reader of the source called name if it
+// implements Committer, the error is prefixed with its name.
+func Commit(name string, r Reader) error {
+	if err := commit(r); err != nil {
+		return fmt.Errorf("source %s: %s", name, err)
+	}
+	return nil
+}
+
+// commit saves the checkpoint of r if it implements Committer, the readers
+// wrapping others use it to pass Commit through.
+func commit(r Reader) error {
+	if c, ok := r.(Committer); ok {
+		return c.Commit()
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package lib
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// committingReader is a reader with a checkpoint, it counts the commits and
+// fails them with err.
+type committingReader struct {
+	flakyReader
+	commits int
+	err     error
+}
+
+func (r *committingReader) Commit() error {
+	r.commits++
+	return r.err
+}
+
+type committingSource struct {
+	reader *committingReader
+}
+
+func (s committingSource) Open() (Reader, error) {
+	return s.reader, nil
+}
+
+func TestCommitWrappedReaders(t *testing.T) {
+	reader := &committingReader{}
+	reg := metrics.NewRegistry()
+
+	r, err := NewReconnectingReader("test", committingSource{reader}, DefaultReconnect, reg, nil, clock.NewFake(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r = NewFilteredReader("test", r, NameFilter{Exclude: []NamePattern{{Field: "group", Pattern: "A"}}}, reg)
+	r = NewTaggedReader("test", SourceField, r, reg)
+	r.Close()
+
+	if err := Commit("test", r); err != nil {
+		t.Fatal(err)
+	}
+
+	if reader.commits != 1 {
+		t.Errorf("the commit should have reached the reader of the source: %d commit(s)", reader.commits)
+	}
+
+	reader.err = errors.New("disk full")
+
+	if err := Commit("test", r); err == nil || !strings.HasPrefix(err.Error(), "source test: disk full") {
+		t.Errorf("the error should be prefixed with the name of the source: %v", err)
+	}
+}
+
+func TestCommitWithoutCheckpoint(t *testing.T) {
+	if err := Commit("test", NewTaggedReader("test", SourceField, &flakyReader{source: &flakySource{}}, metrics.NewRegistry())); err != nil {
+		t.Error("readers without a checkpoint have nothing to commit:", err)
+	}
+}
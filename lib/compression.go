@@ -0,0 +1,135 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/segmentio/ecs-logs/lib/codec"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// The codecs that the bodies of the HTTP requests can be compressed with, the
+// ones that servers know as a Content-Encoding.
+var bodyCodecs = []string{"none", "gzip", "zstd"}
+
+// BodyCompression compresses the bodies of the requests of the HTTP
+// destinations and sets their Content-Encoding. The sizes of the bodies before
+// and after compression are counted by the request_body_uncompressed_bytes
+// and request_body_bytes metrics of the destination, the latter being what
+// went through the network.
+//
+// The zero value sends the bodies as they are, without counting them.
+type BodyCompression struct {
+	codec codec.Codec
+
+	uncompressed *metrics.Counter
+	compressed   *metrics.Counter
+}
+
+// NewBodyCompression returns the compression of the bodies of destination with
+// the named codec, at the given level or the default level of the codec when
+// it's zero.
+func NewBodyCompression(destination string, name string, level int) (c BodyCompression, err error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	if !containsString(bodyCodecs, name) {
+		err = fmt.Errorf("must be one of %s: %s", strings.Join(bodyCodecs, ", "), name)
+		return
+	}
+
+	if c.codec, err = codec.Get(name, level); err != nil {
+		return
+	}
+
+	if name == "none" {
+		c.codec = nil
+	}
+
+	c.uncompressed = metrics.Default.Counter("request_body_uncompressed_bytes", "destination", destination)
+	c.compressed = metrics.Default.Counter("request_body_bytes", "destination", destination)
+	return
+}
+
+// DestinationBodyCompression returns the compression configured for
+// destination by the <DESTINATION>_COMPRESSION and
+// <DESTINATION>_COMPRESSION_LEVEL environment variables, the codec defaults to
+// def.
+func DestinationBodyCompression(destination string, def string) (c BodyCompression, err error) {
+	var level int
+	prefix := strings.ToUpper(destination) + "_"
+
+	if s := strings.TrimSpace(Getenv(prefix + "COMPRESSION_LEVEL")); len(s) != 0 {
+		if level, err = strconv.Atoi(s); err != nil {
+			err = fmt.Errorf("invalid %sCOMPRESSION_LEVEL, must be an integer: %s", prefix, s)
+			return
+		}
+	}
+
+	name := strings.TrimSpace(Getenv(prefix + "COMPRESSION"))
+
+	if len(name) == 0 {
+		name = def
+	}
+
+	if c, err = NewBodyCompression(destination, name, level); err != nil {
+		err = fmt.Errorf("invalid %sCOMPRESSION, %s", prefix, err)
+	}
+	return
+}
+
+// Enabled returns true if the bodies are compressed.
+func (c BodyCompression) Enabled() bool {
+	return c.codec != nil
+}
+
+// Encoding returns the Content-Encoding of the bodies, or an empty string when
+// they aren't compressed.
+func (c BodyCompression) Encoding() string {
+	if c.codec == nil {
+		return ""
+	}
+	return c.codec.Name()
+}
+
+// Compress returns the compressed body, checksums and signatures of the
+// requests must be computed on it rather than on the original one.
+func (c BodyCompression) Compress(body []byte) ([]byte, error) {
+	if c.uncompressed != nil {
+		c.uncompressed.Add(int64(len(body)))
+	}
+
+	if c.codec != nil {
+		var b bytes.Buffer
+
+		w, err := c.codec.NewWriter(&b)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = w.Write(body); err == nil {
+			err = w.Close()
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		body = b.Bytes()
+	}
+
+	if c.compressed != nil {
+		c.compressed.Add(int64(len(body)))
+	}
+
+	return body, nil
+}
+
+// Set sets the Content-Encoding of the compressed bodies on req.
+func (c BodyCompression) Set(req *http.Request) {
+	if e := c.Encoding(); len(e) != 0 {
+		req.Header.Set("Content-Encoding", e)
+	}
+}
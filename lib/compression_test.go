@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/ecs-logs/lib/codec"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+func TestBodyCompression(t *testing.T) {
+	body := bytes.Repeat([]byte(`{"level":"INFO","message":"Hello World!"}`+"\n"), 1000)
+
+	for _, name := range []string{"gzip", "zstd"} {
+		destination := "compress-" + name
+		c, err := NewBodyCompression(destination, name, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := c.Compress(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(b) >= len(body) {
+			t.Errorf("%s: the body should be compressed: %d >= %d", name, len(b), len(body))
+		}
+
+		req, _ := http.NewRequest("POST", "http://localhost/", bytes.NewReader(b))
+		c.Set(req)
+
+		if enc := req.Header.Get("Content-Encoding"); enc != name {
+			t.Errorf("%s: invalid content encoding: %q", name, enc)
+		}
+
+		d, _ := codec.Get(name, 0)
+		r, _ := d.NewReader(bytes.NewReader(b))
+
+		if decoded, _ := ioutil.ReadAll(r); !bytes.Equal(decoded, body) {
+			t.Errorf("%s: the body doesn't decompress to the original one", name)
+		}
+
+		// The size of the requests is accounted after compression.
+		if n := metrics.Default.Counter("request_body_bytes", "destination", destination).Value(); n != int64(len(b)) {
+			t.Errorf("%s: invalid compressed size: %d", name, n)
+		}
+
+		if n := metrics.Default.Counter("request_body_uncompressed_bytes", "destination", destination).Value(); n != int64(len(body)) {
+			t.Errorf("%s: invalid uncompressed size: %d", name, n)
+		}
+	}
+}
+
+func TestBodyCompressionNone(t *testing.T) {
+	for _, c := range []BodyCompression{{}, mustBodyCompression(t, "none")} {
+		b, err := c.Compress([]byte("hello"))
+
+		if err != nil || string(b) != "hello" || c.Enabled() {
+			t.Errorf("the body should be left as it is: %q (%v)", b, err)
+		}
+
+		req, _ := http.NewRequest("POST", "http://localhost/", nil)
+
+		if c.Set(req); len(req.Header.Get("Content-Encoding")) != 0 {
+			t.Error("no content encoding should be set")
+		}
+	}
+}
+
+func mustBodyCompression(t *testing.T, name string) BodyCompression {
+	c, err := NewBodyCompression("testdest", name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestDestinationBodyCompression(t *testing.T) {
+	defer SetConfigEnv(nil)
+
+	SetConfigEnv(nil)
+
+	if c, err := DestinationBodyCompression("testdest", "gzip"); err != nil || c.Encoding() != "gzip" {
+		t.Errorf("the default codec should be used: %q (%v)", c.Encoding(), err)
+	}
+
+	SetConfigEnv(map[string]string{"TESTDEST_COMPRESSION": "ZSTD", "TESTDEST_COMPRESSION_LEVEL": "19"})
+
+	if c, err := DestinationBodyCompression("testdest", "gzip"); err != nil || c.Encoding() != "zstd" {
+		t.Errorf("invalid codec: %q (%v)", c.Encoding(), err)
+	}
+
+	for _, test := range []struct {
+		env map[string]string
+		err string
+	}{
+		{map[string]string{"TESTDEST_COMPRESSION": "snappy"}, "TESTDEST_COMPRESSION"},
+		{map[string]string{"TESTDEST_COMPRESSION": "gzip", "TESTDEST_COMPRESSION_LEVEL": "10"}, "TESTDEST_COMPRESSION"},
+		{map[string]string{"TESTDEST_COMPRESSION": "none", "TESTDEST_COMPRESSION_LEVEL": "1"}, "TESTDEST_COMPRESSION"},
+		{map[string]string{"TESTDEST_COMPRESSION_LEVEL": "fast"}, "TESTDEST_COMPRESSION_LEVEL"},
+	} {
+		SetConfigEnv(test.env)
+
+		if _, err := DestinationBodyCompression("testdest", "gzip"); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: the error should mention %s: %v", test.env, test.err, err)
+		}
+	}
+}
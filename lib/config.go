@@ -0,0 +1,491 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"gopkg.in/yaml.v2"
+)
+
+// Config represents the content of an ecs-logs configuration file, the keys
+// mirror the command line flags, plus an env section which sets or overrides
+// environment variables used to configure the sources and destinations.
+//
+// Configuration files are either JSON (when their name ends with .json) or
+// YAML documents.
+type Config struct {
+	Sources         []string          `json:"sources,omitempty"           yaml:"sources,omitempty"`
+	Destinations    []string          `json:"destinations,omitempty"      yaml:"destinations,omitempty"`
+	Stages          []string          `json:"stages,omitempty"            yaml:"stages,omitempty"`
+	LogLevel        string            `json:"log-level,omitempty"         yaml:"log-level,omitempty"`
+	MaxBatchBytes   int               `json:"max-batch-bytes,omitempty"   yaml:"max-batch-bytes,omitempty"`
+	MaxBatchSize    int               `json:"max-batch-size,omitempty"    yaml:"max-batch-size,omitempty"`
+	FlushTimeout    Duration          `json:"flush-timeout,omitempty"     yaml:"flush-timeout,omitempty"`
+	MaxLatency      Duration          `json:"max-latency,omitempty"       yaml:"max-latency,omitempty"`
+	GroupWindow     Duration          `json:"group-window,omitempty"      yaml:"group-window,omitempty"`
+	CacheTimeout    Duration          `json:"cache-timeout,omitempty"     yaml:"cache-timeout,omitempty"`
+	EmptyNames      string            `json:"empty-names,omitempty"       yaml:"empty-names,omitempty"`
+	DefaultGroup    string            `json:"default-group,omitempty"     yaml:"default-group,omitempty"`
+	DefaultStream   string            `json:"default-stream,omitempty"    yaml:"default-stream,omitempty"`
+	DeadLetterGroup string            `json:"dead-letter-group,omitempty" yaml:"dead-letter-group,omitempty"`
+	Timestamp       string            `json:"timestamp,omitempty"         yaml:"timestamp,omitempty"`
+	MessageIDs      string            `json:"message-ids,omitempty"       yaml:"message-ids,omitempty"`
+	Heartbeat       Duration          `json:"heartbeat-interval,omitempty" yaml:"heartbeat-interval,omitempty"`
+	HeartbeatGroup  string            `json:"heartbeat-group,omitempty"   yaml:"heartbeat-group,omitempty"`
+	HeartbeatDests  []string          `json:"heartbeat-destinations,omitempty" yaml:"heartbeat-destinations,omitempty"`
+	MemoryBudget    int               `json:"memory-budget,omitempty"     yaml:"memory-budget,omitempty"`
+	SourceField     string            `json:"source-field,omitempty"      yaml:"source-field,omitempty"`
+	AuditFile       string            `json:"audit-file,omitempty"        yaml:"audit-file,omitempty"`
+	AuditChain      string            `json:"audit-chain,omitempty"       yaml:"audit-chain,omitempty"`
+	DeadLetterSink  string            `json:"dead-letter-sink,omitempty"  yaml:"dead-letter-sink,omitempty"`
+	SkewThreshold   Duration          `json:"clock-skew-threshold,omitempty" yaml:"clock-skew-threshold,omitempty"`
+	SkewInterval    Duration          `json:"clock-skew-interval,omitempty" yaml:"clock-skew-interval,omitempty"`
+	AtomicDests     []string          `json:"atomic-destinations,omitempty" yaml:"atomic-destinations,omitempty"`
+	AtomicAttempts  int               `json:"atomic-attempts,omitempty"   yaml:"atomic-attempts,omitempty"`
+	AtomicBackoff   Duration          `json:"atomic-backoff,omitempty"    yaml:"atomic-backoff,omitempty"`
+	FastPath        string            `json:"fast-path,omitempty"         yaml:"fast-path,omitempty"`
+	FastDest        string            `json:"fast-destination,omitempty"  yaml:"fast-destination,omitempty"`
+	Routes          []string          `json:"routes,omitempty"            yaml:"routes,omitempty"`
+	ShutdownTimeout Duration          `json:"shutdown-timeout,omitempty"  yaml:"shutdown-timeout,omitempty"`
+	Settings        Settings          `json:"settings,omitempty"          yaml:"settings,omitempty"`
+	Env             map[string]string `json:"env,omitempty"               yaml:"env,omitempty"`
+}
+
+// Settings are the options of the sources, stages and destinations set by the
+// configuration file, indexed by component name then by option name. They're
+// the environment variables named <COMPONENT>_<OPTION>, with the dashes of the
+// option names turned into underscores, so the settings section
+//
+//	settings:
+//	  cloudwatchlogs:
+//	    max-retries: 5
+//
+// sets CLOUDWATCHLOGS_MAX_RETRIES.
+type Settings map[string]map[string]string
+
+// Environment returns the environment variables set by the configuration, the
+// settings expanded to their variables and the env section, which takes
+// precedence.
+func (config Config) Environment() map[string]string {
+	env := make(map[string]string, len(config.Env))
+
+	for component, options := range config.Settings {
+		for option, value := range options {
+			env[settingName(component, option)] = value
+		}
+	}
+
+	for k, v := range config.Env {
+		env[k] = v
+	}
+
+	return env
+}
+
+func settingName(component string, option string) string {
+	return strings.ToUpper(strings.Replace(component+"_"+option, "-", "_", -1))
+}
+
+var settingPattern = regexp.MustCompile(`^[A-Za-z][-\w]*$`)
+
+// ConfigChange describes a configuration field that differs between two
+// configurations, Restart is true if the change cannot be applied to a running
+// ecs-logs process.
+type ConfigChange struct {
+	Field   string
+	Restart bool
+}
+
+func LoadConfig(path string) (config Config, err error) {
+	var b []byte
+
+	if b, err = ioutil.ReadFile(path); err != nil {
+		return
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(b, &config)
+	} else {
+		err = yaml.UnmarshalStrict(b, &config)
+	}
+
+	if err != nil {
+		err = fmt.Errorf("invalid configuration file %s: %s", path, err)
+		return
+	}
+
+	if err = config.Check(); err != nil {
+		err = fmt.Errorf("invalid configuration file %s: %s", path, err)
+	}
+
+	return
+}
+
+func (config Config) Check() (err error) {
+	if len(config.LogLevel) != 0 {
+		if _, e := log.ParseLevel(config.LogLevel); e != nil {
+			err = AppendError(err, fmt.Errorf("log-level: %s", e))
+		}
+	}
+
+	if config.MaxBatchBytes < 0 {
+		err = AppendError(err, fmt.Errorf("max-batch-bytes: must not be negative but %d was found", config.MaxBatchBytes))
+	}
+
+	if config.MaxBatchSize < 0 {
+		err = AppendError(err, fmt.Errorf("max-batch-size: must not be negative but %d was found", config.MaxBatchSize))
+	}
+
+	if config.FlushTimeout < 0 {
+		err = AppendError(err, fmt.Errorf("flush-timeout: must not be negative but %s was found", config.FlushTimeout))
+	}
+
+	if config.MaxLatency < 0 {
+		err = AppendError(err, fmt.Errorf("max-latency: must not be negative but %s was found", config.MaxLatency))
+	}
+
+	if config.GroupWindow < 0 {
+		err = AppendError(err, fmt.Errorf("group-window: must not be negative but %s was found", config.GroupWindow))
+	}
+
+	if config.MemoryBudget < 0 {
+		err = AppendError(err, fmt.Errorf("memory-budget: must not be negative but %d was found", config.MemoryBudget))
+	}
+
+	if config.Heartbeat < 0 {
+		err = AppendError(err, fmt.Errorf("heartbeat-interval: must not be negative but %s was found", config.Heartbeat))
+	}
+
+	if config.SkewThreshold < 0 {
+		err = AppendError(err, fmt.Errorf("clock-skew-threshold: must not be negative but %s was found", config.SkewThreshold))
+	}
+
+	if config.SkewInterval < 0 {
+		err = AppendError(err, fmt.Errorf("clock-skew-interval: must not be negative but %s was found", config.SkewInterval))
+	}
+
+	if config.AtomicAttempts < 0 {
+		err = AppendError(err, fmt.Errorf("atomic-attempts: must not be negative but %d was found", config.AtomicAttempts))
+	}
+
+	if config.AtomicBackoff < 0 {
+		err = AppendError(err, fmt.Errorf("atomic-backoff: must not be negative but %s was found", config.AtomicBackoff))
+	}
+
+	if config.CacheTimeout < 0 {
+		err = AppendError(err, fmt.Errorf("cache-timeout: must not be negative but %s was found", config.CacheTimeout))
+	}
+
+	if config.ShutdownTimeout < 0 {
+		err = AppendError(err, fmt.Errorf("shutdown-timeout: must not be negative but %s was found", config.ShutdownTimeout))
+	}
+
+	if _, e := ParseRoutes(strings.Join(config.Routes, ";")); e != nil {
+		err = AppendError(err, fmt.Errorf("routes: %s", e))
+	}
+
+	for component, options := range config.Settings {
+		if !settingPattern.MatchString(component) {
+			err = AppendError(err, fmt.Errorf("settings: invalid component name: %q", component))
+			continue
+		}
+
+		for option := range options {
+			if !settingPattern.MatchString(option) {
+				err = AppendError(err, fmt.Errorf("settings: %s: invalid option name: %q", component, option))
+			}
+		}
+	}
+
+	if _, e := ParseEmptyNamePolicy(config.EmptyNames); e != nil {
+		err = AppendError(err, fmt.Errorf("empty-names: %s", e))
+	}
+
+	if _, e := ParseTimestampPolicy(config.Timestamp); e != nil {
+		err = AppendError(err, fmt.Errorf("timestamp: %s", e))
+	}
+
+	if _, e := ParseMessageIDScheme(config.MessageIDs); e != nil {
+		err = AppendError(err, fmt.Errorf("message-ids: %s", e))
+	}
+
+	if _, e := ParseAuditChain(config.AuditChain); e != nil {
+		err = AppendError(err, fmt.Errorf("audit-chain: %s", e))
+	}
+
+	if e := (EmptyNames{
+		DefaultGroup:    config.DefaultGroup,
+		DefaultStream:   config.DefaultStream,
+		DeadLetterGroup: config.DeadLetterGroup,
+	}).Check(); e != nil {
+		err = AppendError(err, e)
+	}
+
+	return
+}
+
+// The fields that are only read when ecs-logs starts.
+var restartFields = map[string]bool{
+	"sources":           true,
+	"destinations":      true,
+	"stages":            true,
+	"empty-names":       true,
+	"default-group":     true,
+	"default-stream":    true,
+	"dead-letter-group": true,
+	"timestamp":         true,
+	"message-ids":       true,
+
+	"heartbeat-group":        true,
+	"heartbeat-destinations": true,
+	"memory-budget":          true,
+	"source-field":           true,
+	"audit-file":             true,
+	"audit-chain":            true,
+	"dead-letter-sink":       true,
+
+	"atomic-destinations": true,
+	"atomic-attempts":     true,
+	"atomic-backoff":      true,
+
+	"fast-path":        true,
+	"fast-destination": true,
+	"routes":           true,
+}
+
+// Changes returns the list of fields that differ from config to other, sorted
+// by field name.
+func (config Config) Changes(other Config) (changes []ConfigChange) {
+	a := reflect.ValueOf(config)
+	b := reflect.ValueOf(other)
+	t := a.Type()
+
+	for i := 0; i != t.NumField(); i++ {
+		f := t.Field(i)
+
+		if reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			continue
+		}
+
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		changes = append(changes, ConfigChange{
+			Field:   name,
+			Restart: restartFields[name],
+		})
+	}
+
+	sort.Slice(changes, func(i int, j int) bool { return changes[i].Field < changes[j].Field })
+	return
+}
+
+// Duration is a time.Duration which can be decoded from a string like "5s" in
+// configuration files.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) (err error) {
+	var s string
+
+	if err = json.Unmarshal(b, &s); err != nil {
+		return
+	}
+
+	return d.parse(s)
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var s string
+
+	if err = unmarshal(&s); err != nil {
+		return
+	}
+
+	return d.parse(s)
+}
+
+func (d *Duration) parse(s string) (err error) {
+	var v time.Duration
+
+	if v, err = time.ParseDuration(s); err == nil {
+		*d = Duration(v)
+	}
+
+	return
+}
+
+// Getenv returns the value of the environment variable named by key, values
+// set by the env section of the configuration file take precedence over the
+// process environment.
+//
+// Sources and destinations should use this function instead of os.Getenv to
+// read their settings.
+func Getenv(key string) string {
+	envmtx.RLock()
+	v, ok := envmap[key]
+	envmtx.RUnlock()
+
+	if !ok {
+		v = os.Getenv(key)
+	}
+
+	return v
+}
+
+// SetConfigEnv replaces the environment variables set by the configuration,
+// the change is atomic for all keys.
+func SetConfigEnv(env map[string]string) {
+	m := make(map[string]string, len(env))
+
+	for k, v := range env {
+		m[k] = v
+	}
+
+	envmtx.Lock()
+	envmap = m
+	envmtx.Unlock()
+}
+
+var (
+	envmtx sync.RWMutex
+	envmap map[string]string
+)
+
+// LazyConfig loads the configuration of a destination once, when its first
+// writer is opened rather than when the destination is registered, so the
+// settings from the configuration file are taken into account. The
+// configurations collect all the errors found in their settings while they're
+// loaded instead of stopping at the first one, and report them with check.
+type LazyConfig struct {
+	once sync.Once
+	err  error
+}
+
+// Init calls init the first time it's called, init loads the configuration and
+// sets up the destination with it. The error it returned is returned by every
+// call.
+func (c *LazyConfig) Init(init func() error) error {
+	c.once.Do(func() { c.err = init() })
+	return c.err
+}
+
+// A ConfigWatcher watches a configuration file, sending the new configuration
+// on C every time the file changes.
+//
+// The configuration is entirely loaded and validated before being sent, if the
+// file can't be loaded an error is reported on the Errors channel instead and
+// the previous configuration is expected to remain in effect.
+type ConfigWatcher struct {
+	C <-chan Config
+
+	path   string
+	config chan Config
+	errors chan error
+	reload chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+func WatchConfig(path string, interval time.Duration) *ConfigWatcher {
+	c := make(chan Config)
+	w := &ConfigWatcher{
+		C:      c,
+		path:   path,
+		config: c,
+		errors: make(chan error, 10),
+		reload: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go w.run(interval, w.stat())
+	return w
+}
+
+func (w *ConfigWatcher) Close() error {
+	w.once.Do(func() { close(w.done) })
+	return nil
+}
+
+// Reload loads the configuration file again even if it didn't change, for
+// example when ecs-logs receives a SIGHUP. The configuration, or the error, is
+// sent like the ones of the changes of the file.
+func (w *ConfigWatcher) Reload() {
+	select {
+	case w.reload <- struct{}{}:
+	default:
+	}
+}
+
+// Errors returns a channel of errors encountered when reloading the
+// configuration file. Errors will be dropped if this channel is not consumed.
+func (w *ConfigWatcher) Errors() <-chan error {
+	return w.errors
+}
+
+func (w *ConfigWatcher) run(interval time.Duration, last fileState) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		forced := false
+
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		case <-w.reload:
+			forced = true
+		}
+
+		state := w.stat()
+
+		if state == last && !forced {
+			continue
+		}
+
+		last = state
+		config, err := LoadConfig(w.path)
+
+		if err != nil {
+			select {
+			case w.errors <- err:
+			default:
+			}
+			continue
+		}
+
+		select {
+		case w.config <- config:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *ConfigWatcher) stat() (state fileState) {
+	if info, err := os.Stat(w.path); err == nil {
+		state.size = info.Size()
+		state.modTime = info.ModTime()
+	}
+	return
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
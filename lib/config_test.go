@@ -0,0 +1,259 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ref := Config{
+		Sources:       []string{"journald"},
+		Destinations:  []string{"cloudwatchlogs", "statsd"},
+		LogLevel:      "debug",
+		MaxBatchBytes: 500000,
+		FlushTimeout:  Duration(2 * time.Second),
+		Settings:      Settings{"cloudwatchlogs": {"max-retries": "5"}},
+		Env:           map[string]string{"STATSD_URL": "udp://localhost:8125"},
+	}
+
+	files := map[string]string{
+		"ecs-logs.yml": `
+sources: [journald]
+destinations: [cloudwatchlogs, statsd]
+log-level: debug
+max-batch-bytes: 500000
+flush-timeout: 2s
+settings:
+  cloudwatchlogs:
+    max-retries: 5
+env:
+  STATSD_URL: udp://localhost:8125
+`,
+		"ecs-logs.json": `{
+  "sources": ["journald"],
+  "destinations": ["cloudwatchlogs", "statsd"],
+  "log-level": "debug",
+  "max-batch-bytes": 500000,
+  "flush-timeout": "2s",
+  "settings": {"cloudwatchlogs": {"max-retries": "5"}},
+  "env": {"STATSD_URL": "udp://localhost:8125"}
+}`,
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		config, err := LoadConfig(path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if !reflect.DeepEqual(config, ref) {
+			t.Errorf("invalid configuration loaded from %s:\n- expected: %#v\n- found:    %#v", name, ref, config)
+		}
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"syntax.yml":    "sources: [journald",
+		"unknown.yml":   "sourcez: [journald]",
+		"level.yml":     "log-level: loud",
+		"negative.yml":  "max-batch-size: -1",
+		"duration.yml":  "flush-timeout: soon",
+		"timestamp.yml": "timestamp: sent",
+		"settings.yml":  "settings: {sqs: {queue url: x}}",
+		"routes.yml":    "routes: [\"group=api -> \"]",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := LoadConfig(path); err == nil {
+			t.Errorf("expected an error when loading %s", name)
+		}
+	}
+}
+
+func TestConfigChanges(t *testing.T) {
+	a := Config{
+		Sources:      []string{"journald"},
+		Destinations: []string{"cloudwatchlogs"},
+		LogLevel:     "info",
+		MaxBatchSize: 100,
+	}
+
+	b := a
+	b.Destinations = []string{"cloudwatchlogs", "syslog"}
+	b.LogLevel = "debug"
+	b.MaxBatchSize = 200
+
+	ref := []ConfigChange{
+		{Field: "destinations", Restart: true},
+		{Field: "log-level", Restart: false},
+		{Field: "max-batch-size", Restart: false},
+	}
+
+	if changes := a.Changes(b); !reflect.DeepEqual(changes, ref) {
+		t.Errorf("invalid configuration changes:\n- expected: %v\n- found:    %v", ref, changes)
+	}
+
+	if changes := a.Changes(a); len(changes) != 0 {
+		t.Errorf("identical configurations should have no changes: %v", changes)
+	}
+}
+
+func TestConfigWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "ecs-logs.yml")
+
+	if err := ioutil.WriteFile(path, []byte("max-batch-size: 100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := WatchConfig(path, 10*time.Millisecond)
+	defer w.Close()
+
+	// A valid change to the configuration file is loaded and sent to the
+	// program.
+	writeConfigFile(t, path, "max-batch-size: 200\n")
+
+	select {
+	case config := <-w.C:
+		if config.MaxBatchSize != 200 {
+			t.Error("invalid max batch size after reloading the configuration:", config.MaxBatchSize)
+		}
+	case err := <-w.Errors():
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the configuration to be reloaded")
+	}
+
+	// An invalid configuration file is reported and never sent to the
+	// program.
+	writeConfigFile(t, path, "max-batch-size: [200\n")
+
+	select {
+	case config := <-w.C:
+		t.Error("an invalid configuration should not be reloaded:", config)
+	case <-w.Errors():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the configuration error")
+	}
+}
+
+func TestConfigEnvironment(t *testing.T) {
+	config := Config{
+		Settings: Settings{
+			"cloudwatchlogs": {"max-retries": "5", "group-class": "STANDARD"},
+			"sqs":            {"queue-url": "https://sqs.us-west-2.amazonaws.com/123456789012/logs"},
+		},
+		Env: map[string]string{"CLOUDWATCHLOGS_GROUP_CLASS": "INFREQUENT_ACCESS"},
+	}
+
+	ref := map[string]string{
+		"CLOUDWATCHLOGS_MAX_RETRIES": "5",
+		"CLOUDWATCHLOGS_GROUP_CLASS": "INFREQUENT_ACCESS",
+		"SQS_QUEUE_URL":              "https://sqs.us-west-2.amazonaws.com/123456789012/logs",
+	}
+
+	if env := config.Environment(); !reflect.DeepEqual(env, ref) {
+		t.Errorf("invalid environment:\n- expected: %v\n- found:    %v", ref, env)
+	}
+}
+
+func TestConfigWatcherReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "ecs-logs.yml")
+
+	if err := ioutil.WriteFile(path, []byte("max-batch-size: 100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := WatchConfig(path, 10*time.Millisecond)
+	defer w.Close()
+
+	// The file didn't change, it's loaded again because it was asked to.
+	w.Reload()
+
+	select {
+	case config := <-w.C:
+		if config.MaxBatchSize != 100 {
+			t.Error("invalid max batch size after reloading the configuration:", config.MaxBatchSize)
+		}
+	case err := <-w.Errors():
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the configuration to be reloaded")
+	}
+}
+
+func TestGetenv(t *testing.T) {
+	os.Setenv("ECS_LOGS_TEST_GETENV", "A")
+	defer os.Unsetenv("ECS_LOGS_TEST_GETENV")
+
+	if s := Getenv("ECS_LOGS_TEST_GETENV"); s != "A" {
+		t.Error("invalid value read from the environment:", s)
+	}
+
+	SetConfigEnv(map[string]string{"ECS_LOGS_TEST_GETENV": "B"})
+	defer SetConfigEnv(nil)
+
+	if s := Getenv("ECS_LOGS_TEST_GETENV"); s != "B" {
+		t.Error("the configuration should take precedence over the environment:", s)
+	}
+}
+
+// writeConfigFile overwrites the configuration file at path, making sure its
+// modification time changes even on file systems with a coarse resolution.
+func writeConfigFile(t *testing.T, path string, content string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := info.ModTime().Add(1 * time.Second)
+
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
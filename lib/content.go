@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// ContentHeaders are the headers describing the bodies of the requests of the
+// HTTP destinations, so receivers migrating their ingest contract can tell
+// which shape of payloads ecs-logs sends them.
+type ContentHeaders struct {
+	// The Content-Type of the bodies.
+	ContentType string
+
+	// The header carrying the schema version, empty when it's not sent.
+	SchemaHeader string
+
+	// The schema version of the bodies, made of the format of the payloads
+	// and the version of the envelope wrapping them.
+	SchemaVersion string
+}
+
+// DestinationContentHeaders returns the content headers of destination, which
+// sends payloads formatted as format (for example "pagerduty-events.v2")
+// wrapped in envelope. The content type and the schema header default to
+// contentType and X-Schema-Version, they're configured by the
+// <DESTINATION>_CONTENT_TYPE and <DESTINATION>_SCHEMA_HEADER environment
+// variables, the schema header is disabled by setting it to none.
+func DestinationContentHeaders(destination string, contentType string, format string, envelope Envelope) (h ContentHeaders, err error) {
+	prefix := strings.ToUpper(destination) + "_"
+
+	h = ContentHeaders{
+		ContentType:   contentType,
+		SchemaHeader:  "X-Schema-Version",
+		SchemaVersion: format,
+	}
+
+	if s := envelope.Schema(); len(s) != 0 {
+		h.SchemaVersion = s + "+" + format
+	}
+
+	if s := strings.TrimSpace(Getenv(prefix + "CONTENT_TYPE")); len(s) != 0 {
+		if t, _, e := mime.ParseMediaType(s); e != nil || !strings.Contains(t, "/") {
+			err = fmt.Errorf("invalid %sCONTENT_TYPE, must be a media type: %s", prefix, s)
+			return
+		}
+		h.ContentType = s
+	}
+
+	switch s := strings.TrimSpace(Getenv(prefix + "SCHEMA_HEADER")); {
+	case len(s) == 0:
+	case strings.EqualFold(s, "none"):
+		h.SchemaHeader = ""
+	case strings.ContainsAny(s, " \t:()<>@,;\\\"/[]?={}"):
+		err = fmt.Errorf("invalid %sSCHEMA_HEADER, must be a header name or none: %s", prefix, s)
+	default:
+		h.SchemaHeader = s
+	}
+
+	return
+}
+
+// Set sets the content headers on req.
+func (h ContentHeaders) Set(req *http.Request) {
+	if len(h.ContentType) != 0 {
+		req.Header.Set("Content-Type", h.ContentType)
+	}
+
+	if len(h.SchemaHeader) != 0 && len(h.SchemaVersion) != 0 {
+		req.Header.Set(h.SchemaHeader, h.SchemaVersion)
+	}
+}
@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDestinationContentHeaders(t *testing.T) {
+	defer SetConfigEnv(nil)
+
+	tests := []struct {
+		env     map[string]string
+		headers map[string]string
+	}{
+		{
+			env: nil,
+			headers: map[string]string{
+				"Content-Type":     "application/json",
+				"X-Schema-Version": "messages.v1",
+			},
+		},
+		{
+			env: map[string]string{
+				"TESTDEST_ENVELOPE":      "true",
+				"TESTDEST_CONTENT_TYPE":  "application/x-ndjson",
+				"TESTDEST_SCHEMA_HEADER": "X-Ingest-Contract",
+			},
+			headers: map[string]string{
+				"Content-Type":      "application/x-ndjson",
+				"X-Ingest-Contract": "envelope.v1+messages.v1",
+				"X-Schema-Version":  "",
+			},
+		},
+		{
+			env: map[string]string{
+				"TESTDEST_ENVELOPE":         "true",
+				"TESTDEST_ENVELOPE_VERSION": "2",
+			},
+			headers: map[string]string{"X-Schema-Version": "envelope.v2+messages.v1"},
+		},
+		{
+			env: map[string]string{
+				"TESTDEST_ENVELOPE":      "true",
+				"TESTDEST_SCHEMA_HEADER": "none",
+			},
+			headers: map[string]string{
+				"Content-Type":     "application/json",
+				"X-Schema-Version": "",
+			},
+		},
+	}
+
+	for i, test := range tests {
+		SetConfigEnv(test.env)
+
+		e, err := DestinationEnvelope("testdest")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h, err := DestinationContentHeaders("testdest", "application/json", "messages.v1", e)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, _ := http.NewRequest("POST", "http://localhost/", nil)
+		h.Set(req)
+
+		for name, value := range test.headers {
+			if s := req.Header.Get(name); s != value {
+				t.Errorf("test %d: invalid %s header: %q != %q", i, name, s, value)
+			}
+		}
+	}
+
+	for _, env := range []map[string]string{
+		{"TESTDEST_CONTENT_TYPE": "json"},
+		{"TESTDEST_SCHEMA_HEADER": "Schema: Version"},
+	} {
+		SetConfigEnv(env)
+
+		if _, err := DestinationContentHeaders("testdest", "application/json", "messages.v1", Envelope{}); err == nil {
+			t.Errorf("the configuration should be rejected: %v", env)
+		}
+	}
+}
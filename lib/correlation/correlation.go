@@ -0,0 +1,192 @@
+// Package correlation implements the correlation stage, which attaches the
+// AWS account and region that ecs-logs runs in to messages, so entries shipped
+// to CloudWatch can be joined with the metrics, traces and audit logs the
+// other AWS services report for the same account and region.
+package correlation
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/ecsmeta"
+)
+
+// The reserved data fields that the stage sets on messages.
+const (
+	AccountIDField = "aws_account_id"
+	RegionField    = "aws_region"
+)
+
+type config struct {
+	// Whether the account ID and region are attached.
+	account bool
+	region  bool
+
+	// The region set in the configuration, when empty it's discovered from
+	// the environment.
+	regionName string
+
+	// The time allowed to STS and the ECS metadata endpoint to respond.
+	timeout time.Duration
+}
+
+func getConfig() (c config, err error) {
+	c.timeout = 5 * time.Second
+	var s string
+
+	if s = strings.TrimSpace(lib.Getenv("CORRELATION_FIELDS")); len(s) == 0 {
+		s = "account_id,region"
+	}
+
+	for _, f := range strings.Split(s, ",") {
+		switch f = strings.TrimSpace(f); f {
+		case "account_id":
+			c.account = true
+		case "region":
+			c.region = true
+		default:
+			err = fmt.Errorf("invalid CORRELATION_FIELDS, unknown field %q, must be account_id or region", f)
+			return
+		}
+	}
+
+	c.regionName = strings.TrimSpace(lib.Getenv("CORRELATION_REGION"))
+
+	if s = strings.TrimSpace(lib.Getenv("CORRELATION_TIMEOUT")); len(s) != 0 {
+		if c.timeout, err = time.ParseDuration(s); err != nil || c.timeout <= 0 {
+			err = fmt.Errorf("invalid CORRELATION_TIMEOUT, must be a positive duration: %s", s)
+			return
+		}
+	}
+
+	return
+}
+
+func NewProcessor() (p lib.Processor, err error) {
+	var c config
+
+	if c, err = getConfig(); err != nil {
+		return
+	}
+
+	region := getRegion(c)
+	var api stsiface.STSAPI
+
+	if c.account {
+		// STS has a global endpoint, the region only picks which one of the
+		// regional endpoints answers.
+		stsRegion := region
+
+		if len(stsRegion) == 0 {
+			stsRegion = "us-east-1"
+		}
+
+		api = sts.New(session.New(&aws.Config{Region: aws.String(stsRegion)}))
+	}
+
+	p = newProcessor(c, api, region)
+	return
+}
+
+func checkConfig() (err error) {
+	_, err = getConfig()
+	return
+}
+
+// getRegion returns the region configured for the stage or set in the
+// environment, falling back to the availability zone of the ECS task. An empty
+// region is returned when none of them is available.
+func getRegion(c config) string {
+	if len(c.regionName) != 0 {
+		return c.regionName
+	}
+
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(env); len(region) != 0 {
+			return region
+		}
+	}
+
+	if uri := ecsmeta.URI(); len(uri) != 0 {
+		task, err := ecsmeta.GetTask(uri, c.timeout)
+
+		if err != nil {
+			log.WithError(err).Warn("failed to get the region of the task from the ECS metadata")
+			return ""
+		}
+
+		// Availability zones are the region followed by a letter.
+		if n := len(task.AvailabilityZone); n > 1 {
+			return task.AvailabilityZone[:n-1]
+		}
+	}
+
+	return ""
+}
+
+type processor struct {
+	// The fields attached to every message, resolved once when the stage is
+	// created.
+	fields ecslogs.EventData
+}
+
+// newProcessor looks up the account ID with api, calls to STS are only made
+// here so a stage that couldn't reach it keeps attaching the region instead of
+// slowing down every message.
+func newProcessor(c config, api stsiface.STSAPI, region string) *processor {
+	p := &processor{fields: make(ecslogs.EventData, 2)}
+
+	if c.account && api != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		res, err := api.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+		cancel()
+
+		if err != nil {
+			log.WithError(err).Warn("failed to get the AWS account ID from STS, messages won't carry it")
+		} else if account := aws.StringValue(res.Account); len(account) != 0 {
+			p.fields[AccountIDField] = account
+		}
+	}
+
+	if c.region {
+		if len(region) == 0 {
+			log.Warn("the AWS region couldn't be determined, messages won't carry it")
+		} else {
+			p.fields[RegionField] = region
+		}
+	}
+
+	return p
+}
+
+func (p *processor) Process(msg lib.Message, now time.Time) []lib.Message {
+	if len(p.fields) != 0 {
+		data := make(ecslogs.EventData, len(msg.Event.Data)+len(p.fields))
+
+		for k, v := range msg.Event.Data {
+			data[k] = v
+		}
+
+		for k, v := range p.fields {
+			data[k] = v
+		}
+
+		msg.Event.Data = data
+	}
+
+	return []lib.Message{msg}
+}
+
+func (p *processor) Flush(now time.Time) []lib.Message {
+	return nil
+}
@@ -0,0 +1,122 @@
+package correlation
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+type mockSTS struct {
+	stsiface.STSAPI
+	account string
+	err     error
+	calls   int
+}
+
+func (m *mockSTS) GetCallerIdentityWithContext(ctx aws.Context, input *sts.GetCallerIdentityInput, opts ...request.Option) (*sts.GetCallerIdentityOutput, error) {
+	m.calls++
+
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	return &sts.GetCallerIdentityOutput{Account: aws.String(m.account)}, nil
+}
+
+func makeProcessor(t *testing.T, env map[string]string, api stsiface.STSAPI) *processor {
+	lib.SetConfigEnv(env)
+	defer lib.SetConfigEnv(nil)
+
+	c, err := getConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newProcessor(c, api, getRegion(c))
+}
+
+func makeMessage(data ecslogs.EventData) lib.Message {
+	return lib.Message{Group: "A", Stream: "0", Event: ecslogs.Event{Message: "hello", Data: data}}
+}
+
+func TestProcessorFields(t *testing.T) {
+	api := &mockSTS{account: "123456789012"}
+	p := makeProcessor(t, map[string]string{"CORRELATION_REGION": "us-west-2"}, api)
+
+	for i := 0; i != 3; i++ {
+		original := ecslogs.EventData{"user": "luke"}
+		msgs := p.Process(makeMessage(original), time.Now())
+
+		if len(msgs) != 1 {
+			t.Fatalf("invalid number of messages: %d", len(msgs))
+		}
+
+		data := msgs[0].Event.Data
+
+		if data[AccountIDField] != "123456789012" || data[RegionField] != "us-west-2" || data["user"] != "luke" {
+			t.Errorf("invalid data: %v", data)
+		}
+
+		if len(original) != 1 {
+			t.Error("the data of the original message should not be modified")
+		}
+	}
+
+	if api.calls != 1 {
+		t.Errorf("STS should only be called once: %d call(s)", api.calls)
+	}
+}
+
+func TestProcessorSelectFields(t *testing.T) {
+	api := &mockSTS{account: "123456789012"}
+	p := makeProcessor(t, map[string]string{"CORRELATION_FIELDS": "region", "CORRELATION_REGION": "eu-west-1"}, api)
+	data := p.Process(makeMessage(nil), time.Now())[0].Event.Data
+
+	if _, ok := data[AccountIDField]; ok || data[RegionField] != "eu-west-1" {
+		t.Errorf("only the region should be attached: %v", data)
+	}
+
+	if api.calls != 0 {
+		t.Errorf("STS should not be called when the account ID isn't attached: %d call(s)", api.calls)
+	}
+}
+
+func TestProcessorUnreachableSTS(t *testing.T) {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	api := &mockSTS{err: errors.New("RequestError: send request failed")}
+	p := makeProcessor(t, map[string]string{"CORRELATION_REGION": "us-west-2"}, api)
+	data := p.Process(makeMessage(ecslogs.EventData{"user": "luke"}), time.Now())[0].Event.Data
+
+	if _, ok := data[AccountIDField]; ok {
+		t.Errorf("the account ID should not be attached when STS failed: %v", data)
+	}
+
+	if data[RegionField] != "us-west-2" || data["user"] != "luke" {
+		t.Errorf("the region should still be attached when STS failed: %v", data)
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"CORRELATION_FIELDS": "account_id,partition"},
+		{"CORRELATION_TIMEOUT": "soon"},
+		{"CORRELATION_TIMEOUT": "-1s"},
+	} {
+		lib.SetConfigEnv(env)
+
+		if err := checkConfig(); err == nil {
+			t.Errorf("%v: the configuration should be invalid", env)
+		}
+	}
+
+	lib.SetConfigEnv(nil)
+}
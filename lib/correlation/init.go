@@ -0,0 +1,7 @@
+package correlation
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterStage("correlation", lib.NewCheckedStage(lib.StageFunc(NewProcessor), checkConfig))
+}
@@ -3,5 +3,5 @@ package datadog
 import "github.com/segmentio/ecs-logs/lib"
 
 func init() {
-	lib.RegisterDestination("datadog", lib.DestinationFunc(NewWriter))
+	lib.RegisterDestination("datadog", lib.NewCheckedDestination(lib.DestinationFunc(NewWriter), checkConfig))
 }
@@ -0,0 +1,274 @@
+package datadog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+const (
+	// The limits of the logs intake API, in number of logs and in bytes of
+	// uncompressed payload per request.
+	maxLogsPerRequest = 1000
+	maxPayloadSize    = 5 * 1024 * 1024
+
+	defaultSite = "datadoghq.com"
+)
+
+// logsRetryPolicy backs off longer than the default policy, the intake answers
+// with 429s for a while once an organization is over its rate limit.
+var logsRetryPolicy = retry.Policy{
+	MinBackoff: 500 * time.Millisecond,
+	MaxBackoff: 30 * time.Second,
+	Factor:     2,
+	Jitter:     true,
+	MaxRetries: 5,
+}
+
+// logsConfig carries the settings of the logs intake writers, which are used
+// instead of the statsd ones when DATADOG_API_KEY is set.
+type logsConfig struct {
+	apiKey string
+
+	// The URL that the logs are posted to, derived from DATADOG_SITE unless
+	// DATADOG_LOGS_URL is set.
+	url string
+
+	// The tags added to the ones derived from the group and stream.
+	tags string
+
+	// How the payloads are compressed, gzip unless DATADOG_COMPRESSION says
+	// otherwise.
+	compression lib.BodyCompression
+
+	// How the requests failing with a network error, a 429 or a 5xx status
+	// are sent again.
+	retry retry.Policy
+}
+
+// logsEnabled returns true if the messages are sent to the logs intake API.
+func logsEnabled() bool {
+	return len(strings.TrimSpace(lib.Getenv("DATADOG_API_KEY"))) != 0
+}
+
+func getLogsConfig() (c logsConfig, err error) {
+	c.apiKey = strings.TrimSpace(lib.Getenv("DATADOG_API_KEY"))
+
+	if c.url = strings.TrimSpace(lib.Getenv("DATADOG_LOGS_URL")); len(c.url) != 0 {
+		var u *url.URL
+
+		if u, err = url.Parse(c.url); err != nil || len(u.Host) == 0 || (u.Scheme != "http" && u.Scheme != "https") {
+			err = fmt.Errorf("invalid DATADOG_LOGS_URL, must be an http or https URL: %s", c.url)
+			return
+		}
+	} else {
+		site := strings.TrimSpace(lib.Getenv("DATADOG_SITE"))
+
+		if len(site) == 0 {
+			site = defaultSite
+		}
+
+		if strings.ContainsAny(site, "/: ") {
+			err = fmt.Errorf("invalid DATADOG_SITE, must be a domain like datadoghq.eu: %s", site)
+			return
+		}
+
+		c.url = "https://http-intake.logs." + site + "/api/v2/logs"
+	}
+
+	c.tags = strings.Trim(strings.TrimSpace(lib.Getenv("DATADOG_TAGS")), ",")
+
+	if c.compression, err = lib.DestinationBodyCompression("datadog", "gzip"); err != nil {
+		return
+	}
+
+	c.retry, err = retry.DestinationPolicy("datadog", logsRetryPolicy)
+	return
+}
+
+// logsClient is shared by all the writers so they use the same connection
+// pool.
+var logsClient = &http.Client{Timeout: 30 * time.Second}
+
+func newLogsWriter(c logsConfig, group string, stream string) *logsWriter {
+	tags := "group:" + group + ",stream:" + stream
+
+	if len(c.tags) != 0 {
+		tags += "," + c.tags
+	}
+
+	return &logsWriter{
+		config: c,
+		group:  group,
+		stream: stream,
+		tags:   tags,
+		client: logsClient,
+		clock:  clock.System,
+	}
+}
+
+// logsWriter posts the messages of a stream to the logs intake API, the group
+// is the service of the logs and the stream their source.
+type logsWriter struct {
+	config logsConfig
+	group  string
+	stream string
+	tags   string
+
+	client *http.Client
+	clock  clock.Clock
+}
+
+// logEntry is a log in the body of the requests to the logs intake API.
+type logEntry struct {
+	Message   string            `json:"message"`
+	Status    string            `json:"status,omitempty"`
+	Timestamp string            `json:"timestamp,omitempty"`
+	Hostname  string            `json:"hostname,omitempty"`
+	Service   string            `json:"service"`
+	Source    string            `json:"ddsource"`
+	Tags      string            `json:"ddtags"`
+	Info      ecslogs.EventInfo `json:"info"`
+	Data      ecslogs.EventData `json:"data,omitempty"`
+}
+
+func (w *logsWriter) Close() error {
+	return nil
+}
+
+func (w *logsWriter) WriteMessage(msg lib.Message) error {
+	return w.WriteMessageBatch(lib.MessageBatch{msg})
+}
+
+func (w *logsWriter) WriteMessageBatch(batch lib.MessageBatch) (err error) {
+	_, err = w.WriteMessageBatchSize(batch)
+	return
+}
+
+// WriteMessageBatchSize posts batch in as few requests as the limits of the
+// intake allow, and returns the uncompressed size of the payloads.
+func (w *logsWriter) WriteMessageBatchSize(batch lib.MessageBatch) (size int, err error) {
+	var payload bytes.Buffer
+	var count int
+
+	flush := func() {
+		if count != 0 {
+			payload.WriteByte(']')
+			size += payload.Len()
+
+			if e := w.send(payload.Bytes()); e != nil {
+				err = lib.AppendError(err, e)
+			}
+			payload.Reset()
+			count = 0
+		}
+	}
+
+	for _, msg := range batch {
+		b, e := json.Marshal(w.entry(msg))
+
+		if e != nil {
+			err = lib.AppendError(err, e)
+			continue
+		}
+
+		// The array takes a separator or a bracket before each log and the
+		// closing bracket.
+		if count == maxLogsPerRequest || (count != 0 && payload.Len()+len(b)+2 > maxPayloadSize) {
+			flush()
+		}
+
+		if count == 0 {
+			payload.WriteByte('[')
+		} else {
+			payload.WriteByte(',')
+		}
+
+		payload.Write(b)
+		count++
+	}
+
+	flush()
+	return
+}
+
+func (w *logsWriter) entry(msg lib.Message) logEntry {
+	e := logEntry{
+		Message:  msg.Event.Message,
+		Hostname: msg.Event.Info.Host,
+		Service:  w.group,
+		Source:   w.stream,
+		Tags:     w.tags,
+		Info:     msg.Event.Info,
+		Data:     msg.Event.Data,
+	}
+
+	if msg.Event.Level != ecslogs.NONE {
+		e.Status = strings.ToLower(msg.Event.Level.String())
+	}
+
+	if !msg.Event.Time.IsZero() {
+		e.Timestamp = msg.Event.Time.UTC().Format(time.RFC3339Nano)
+	}
+
+	return e
+}
+
+// send posts a payload, the requests that fail with a network error, a 429 or
+// a 5xx status are sent again with the retry policy of the writer.
+func (w *logsWriter) send(payload []byte) error {
+	body, err := w.config.compression.Compress(payload)
+	if err != nil {
+		return err
+	}
+
+	return w.config.retry.Do(w.clock, nil, func() error {
+		retryable, err := w.post(body)
+
+		if retryable {
+			err = retry.Retryable(err)
+		}
+
+		return err
+	})
+}
+
+func (w *logsWriter) post(body []byte) (retryable bool, err error) {
+	var req *http.Request
+	var res *http.Response
+
+	if req, err = http.NewRequest("POST", w.config.url, bytes.NewReader(body)); err != nil {
+		return
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	w.config.compression.Set(req)
+	req.Header.Set("DD-API-KEY", w.config.apiKey)
+
+	if res, err = w.client.Do(req); err != nil {
+		retryable = true
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(&io.LimitedReader{R: res.Body, N: 1024})
+		err = fmt.Errorf("datadog responded with %s: %s", res.Status, bytes.TrimSpace(msg))
+		retryable = res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusRequestTimeout || res.StatusCode >= 500
+		return
+	}
+
+	io.Copy(ioutil.Discard, res.Body)
+	return
+}
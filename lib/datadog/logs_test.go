@@ -0,0 +1,211 @@
+package datadog
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+// intake is a fake logs intake API, status returns the status of each request.
+type intake struct {
+	mutex    sync.Mutex
+	requests [][]logEntry
+	status   func(request int) int
+}
+
+func (in *intake) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	if req.Header.Get("DD-API-KEY") != "secret" || req.Header.Get("Content-Encoding") != "gzip" {
+		res.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var entries []logEntry
+
+	z, err := gzip.NewReader(req.Body)
+	if err == nil {
+		err = json.NewDecoder(z).Decode(&entries)
+	}
+
+	if err != nil {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	in.requests = append(in.requests, entries)
+
+	if in.status != nil {
+		res.WriteHeader(in.status(len(in.requests)))
+		return
+	}
+
+	res.WriteHeader(http.StatusAccepted)
+}
+
+func newTestLogsWriter(t *testing.T, in *intake, maxRetries int) (*logsWriter, *clock.Fake, func()) {
+	server := httptest.NewServer(in)
+	f := clock.NewFake(time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC))
+
+	gzip, err := lib.NewBodyCompression("datadog", "gzip", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := newLogsWriter(logsConfig{apiKey: "secret", url: server.URL + "/api/v2/logs", tags: "env:prod", retry: retry.Policy{MaxRetries: maxRetries}, compression: gzip}, "/ecs/api", "web")
+	w.clock = f
+	return w, f, server.Close
+}
+
+func makeMessage(message string) lib.Message {
+	return lib.Message{
+		Group:  "/ecs/api",
+		Stream: "web",
+		Event: ecslogs.Event{
+			Level:   ecslogs.ERROR,
+			Time:    time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC),
+			Info:    ecslogs.EventInfo{Host: "i-1234"},
+			Data:    ecslogs.EventData{"status": 500.0},
+			Message: message,
+		},
+	}
+}
+
+func TestLogsWriterEntries(t *testing.T) {
+	in := &intake{}
+	w, _, cleanup := newTestLogsWriter(t, in, 5)
+	defer cleanup()
+
+	if err := w.WriteMessageBatch(lib.MessageBatch{makeMessage("a"), makeMessage("b")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(in.requests) != 1 || len(in.requests[0]) != 2 {
+		t.Fatalf("the batch should be sent in one request: %v", in.requests)
+	}
+
+	e := in.requests[0][1]
+
+	if e.Message != "b" || e.Status != "error" || e.Timestamp != "2016-10-12T00:00:00Z" || e.Hostname != "i-1234" || e.Data["status"] != 500.0 {
+		t.Errorf("invalid log: %+v", e)
+	}
+
+	if e.Service != "/ecs/api" || e.Source != "web" || e.Tags != "group:/ecs/api,stream:web,env:prod" {
+		t.Errorf("the group and stream should be the service and source of the logs: %+v", e)
+	}
+}
+
+func TestLogsWriterChunks(t *testing.T) {
+	in := &intake{}
+	w, _, cleanup := newTestLogsWriter(t, in, 5)
+	defer cleanup()
+
+	var batch lib.MessageBatch
+
+	for i := 0; i != 2500; i++ {
+		batch = append(batch, makeMessage("x"))
+	}
+
+	// Each message takes a bit more than a fourth of the maximum payload, only
+	// three of them fit in a request.
+	text := strings.Repeat("x", maxPayloadSize/4)
+	batch = append(batch, makeMessage(text), makeMessage(text), makeMessage(text), makeMessage(text))
+
+	size, err := w.WriteMessageBatchSize(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var counts []int
+
+	for _, r := range in.requests {
+		counts = append(counts, len(r))
+	}
+
+	// The third request is full after the last 500 small logs and three big
+	// ones.
+	if len(counts) != 4 || counts[0] != 1000 || counts[1] != 1000 || counts[2] != 503 || counts[3] != 1 {
+		t.Errorf("the requests should stay under %d logs and %d bytes: %v", maxLogsPerRequest, maxPayloadSize, counts)
+	}
+
+	if min := 4 * len(text); size < min {
+		t.Errorf("invalid size: %d", size)
+	}
+}
+
+func TestLogsWriterRetries(t *testing.T) {
+	in := &intake{status: func(request int) int {
+		switch request {
+		case 1:
+			return http.StatusTooManyRequests
+		case 2:
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusAccepted
+	}}
+
+	w, f, cleanup := newTestLogsWriter(t, in, 5)
+	defer cleanup()
+
+	if err := w.WriteMessage(makeMessage("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(in.requests) != 3 || f.Slept() == 0 {
+		t.Errorf("the request should be retried with a backoff: %d requests, slept %s", len(in.requests), f.Slept())
+	}
+
+	// The other errors would fail again.
+	in.requests, in.status = nil, func(int) int { return http.StatusRequestEntityTooLarge }
+
+	if err := w.WriteMessage(makeMessage("a")); err == nil || len(in.requests) != 1 {
+		t.Errorf("the rejected request shouldn't be retried: %d requests, %v", len(in.requests), err)
+	}
+
+	in.requests, in.status = nil, func(int) int { return http.StatusInternalServerError }
+
+	if err := w.WriteMessage(makeMessage("a")); err == nil || len(in.requests) != 6 {
+		t.Errorf("the request should be sent %d times: %d requests, %v", 6, len(in.requests), err)
+	}
+}
+
+func TestLogsConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(map[string]string{"DATADOG_API_KEY": "secret", "DATADOG_SITE": "datadoghq.eu"})
+
+	if c, err := getLogsConfig(); err != nil || !logsEnabled() || c.url != "https://http-intake.logs.datadoghq.eu/api/v2/logs" || c.retry.MaxRetries != 5 || c.retry.MinBackoff != 500*time.Millisecond {
+		t.Errorf("invalid configuration: %+v, %v", c, err)
+	}
+
+	for _, env := range []map[string]string{
+		{"DATADOG_API_KEY": "secret", "DATADOG_LOGS_URL": "udp://localhost:8125"},
+		{"DATADOG_API_KEY": "secret", "DATADOG_SITE": "https://datadoghq.eu"},
+		{"DATADOG_API_KEY": "secret", "DATADOG_MAX_RETRIES": "-1"},
+		{"DATADOG_API_KEY": "secret", "DATADOG_COMPRESSION": "brotli"},
+	} {
+		lib.SetConfigEnv(env)
+
+		if err := checkConfig(); err == nil {
+			t.Errorf("%v: the configuration should be invalid", env)
+		}
+	}
+
+	// Without an API key the destination reports to the statsd agent.
+	lib.SetConfigEnv(map[string]string{"DATADOG_URL": "udp://localhost:8125"})
+
+	if err := checkConfig(); err != nil || logsEnabled() {
+		t.Errorf("the statsd configuration should be valid: %v", err)
+	}
+}
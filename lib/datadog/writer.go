@@ -3,7 +3,6 @@ package datadog
 import (
 	"fmt"
 	"net/url"
-	"os"
 	"strings"
 
 	"github.com/segmentio/ecs-logs-go"
@@ -12,12 +11,38 @@ import (
 	"github.com/statsd/datadog"
 )
 
+// NewWriter returns a writer posting the messages to the logs intake API when
+// DATADOG_API_KEY is set, or reporting their counts to the statsd agent.
 func NewWriter(group string, stream string) (w lib.Writer, err error) {
 	var c statsd.WriterConfig
+
+	if logsEnabled() {
+		var lc logsConfig
+
+		if lc, err = getLogsConfig(); err == nil {
+			w = newLogsWriter(lc, group, stream)
+		}
+		return
+	}
+
+	if c.Address, err = getAddress(); err != nil {
+		return
+	}
+
+	c.Group = group
+	c.Stream = stream
+	c.Dial = dialUdpClient
+
+	return statsd.DialWriter(c)
+}
+
+// getAddress returns the address of the agent set by DATADOG_URL, or an empty
+// string when the statsd default applies.
+func getAddress() (address string, err error) {
 	var s string
 	var u *url.URL
 
-	if s = os.Getenv("DATADOG_URL"); len(s) != 0 {
+	if s = lib.Getenv("DATADOG_URL"); len(s) != 0 {
 		if u, err = url.Parse(s); err != nil {
 			err = fmt.Errorf("invalid datadog URL: %s", err)
 			return
@@ -28,14 +53,20 @@ func NewWriter(group string, stream string) (w lib.Writer, err error) {
 			return
 		}
 
-		c.Address = u.Host
+		address = u.Host
 	}
 
-	c.Group = group
-	c.Stream = stream
-	c.Dial = dialUdpClient
+	return
+}
 
-	return statsd.DialWriter(c)
+func checkConfig() (err error) {
+	if logsEnabled() {
+		_, err = getLogsConfig()
+		return
+	}
+
+	_, err = getAddress()
+	return
 }
 
 type client struct {
@@ -0,0 +1,326 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// DeadLetterField is the data field of dead-lettered messages describing why
+// they were dead-lettered and where they were headed.
+const DeadLetterField = "deadLetter"
+
+// DeadLetterInfo returns the value of the DeadLetterField of msg when it's
+// dead-lettered for reason. If err is the error that made the message
+// undeliverable and carries the ID of a rejected request it's recorded as
+// well, it's what AWS support asks for when a rejection is escalated.
+func DeadLetterInfo(msg Message, reason string, err error) ecslogs.EventData {
+	info := ecslogs.EventData{
+		"reason": reason,
+		"group":  msg.Group,
+		"stream": msg.Stream,
+	}
+
+	if id := RequestID(err); len(id) != 0 {
+		info["request_id"] = id
+	}
+
+	return info
+}
+
+// DeadLetterMessage returns a copy of msg with the DeadLetterField telling that
+// it was dead-lettered by destination for reason, see DeadLetterInfo.
+func DeadLetterMessage(msg Message, destination string, reason string, err error) Message {
+	info := DeadLetterInfo(msg, reason, err)
+	info["destination"] = destination
+
+	msg.Event.Data = copyData(msg.Event.Data, 1)
+	msg.Event.Data[DeadLetterField] = info
+	return msg
+}
+
+// Rejection is a message that a destination permanently rejected, writing it
+// again would fail the same way.
+type Rejection struct {
+	Message Message
+	Reason  string
+}
+
+// RejectedError is returned by writers which delivered a batch except some of
+// its messages, that the destination permanently rejected. The writers are
+// wrapped by NewDeadLetterDestination, which sends the rejected messages to the
+// dead-letter sink and reports the batch as written.
+type RejectedError struct {
+	Rejections []Rejection
+
+	// The ID of the request the messages were rejected by, if any.
+	ID string
+}
+
+func (e *RejectedError) Error() string {
+	if len(e.Rejections) == 1 {
+		return "1 message was permanently rejected: " + e.Rejections[0].Reason
+	}
+	return fmt.Sprintf("%d messages were permanently rejected: %s", len(e.Rejections), e.Rejections[0].Reason)
+}
+
+// RequestID returns the ID of the request the messages were rejected by.
+func (e *RejectedError) RequestID() string {
+	return e.ID
+}
+
+// AppendWriteError combines the errors of the writes of parts of a batch, like
+// AppendError except that rejections are merged into a single RejectedError.
+// Any other error takes precedence over the rejections since the batch is
+// failed and written again then.
+func AppendWriteError(err error, other error) error {
+	r1, ok1 := err.(*RejectedError)
+	r2, ok2 := other.(*RejectedError)
+
+	switch {
+	case err == nil:
+		return other
+	case other == nil:
+		return err
+	case ok1 && ok2:
+		merged := &RejectedError{ID: r1.ID}
+		merged.Rejections = append(append(merged.Rejections, r1.Rejections...), r2.Rejections...)
+		if len(merged.ID) == 0 {
+			merged.ID = r2.ID
+		}
+		return merged
+	case ok1:
+		return other
+	case ok2:
+		return err
+	default:
+		return AppendError(err, other)
+	}
+}
+
+// DeadLetterSink is where the messages rejected by the destinations are
+// written to, with the reason of the rejection in their DeadLetterField.
+type DeadLetterSink interface {
+	WriteDeadLetters(batch MessageBatch) error
+
+	Close() error
+}
+
+// OpenDeadLetterSink returns the sink described by s, either file:<path> to
+// append the messages to a local file as JSON lines or the name of a registered
+// destination to write them to, in group. The group is a template where {group}
+// and {stream} are replaced with the names of the original stream.
+//
+// The sink is nil when s is empty, the rejected messages are only logged and
+// counted then.
+func OpenDeadLetterSink(s string, group string) (sink DeadLetterSink, err error) {
+	if s = strings.TrimSpace(s); len(s) == 0 {
+		return
+	}
+
+	if strings.HasPrefix(s, "file:") {
+		var f *os.File
+
+		if f, err = os.OpenFile(strings.TrimPrefix(s, "file:"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+			return
+		}
+
+		sink = &fileDeadLetterSink{file: f}
+		return
+	}
+
+	dest := GetDestination(s)
+
+	if dest == nil {
+		err = fmt.Errorf("invalid dead-letter sink, must be file:<path> or the name of a destination: %s", s)
+		return
+	}
+
+	sink = NewDestinationDeadLetterSink(dest, group)
+	return
+}
+
+// NewDestinationDeadLetterSink returns a sink writing the messages to dest, in
+// group like the sinks of OpenDeadLetterSink.
+func NewDestinationDeadLetterSink(dest Destination, group string) DeadLetterSink {
+	return &destinationDeadLetterSink{
+		dest:    dest,
+		group:   group,
+		writers: make(map[[2]string]Writer),
+	}
+}
+
+type fileDeadLetterSink struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func (s *fileDeadLetterSink) WriteDeadLetters(batch MessageBatch) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	w := bufio.NewWriter(s.file)
+
+	for _, msg := range batch {
+		w.Write(AppendMessageJSON(nil, msg))
+		w.WriteByte('\n')
+	}
+
+	return w.Flush()
+}
+
+func (s *fileDeadLetterSink) Close() error {
+	return s.file.Close()
+}
+
+// destinationDeadLetterSink writes the messages to a destination, the writers
+// of the dead-letter streams are kept open until the sink is closed since the
+// same streams tend to reject messages over and over.
+type destinationDeadLetterSink struct {
+	mutex   sync.Mutex
+	dest    Destination
+	group   string
+	writers map[[2]string]Writer
+}
+
+func (s *destinationDeadLetterSink) WriteDeadLetters(batch MessageBatch) (err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	streams := make(map[[2]string]MessageBatch)
+
+	for _, msg := range batch {
+		group := strings.NewReplacer("{group}", msg.Group, "{stream}", msg.Stream).Replace(s.group)
+		key := [2]string{group, msg.Stream}
+		msg.Group = group
+		streams[key] = append(streams[key], msg)
+	}
+
+	for key, msgs := range streams {
+		w := s.writers[key]
+
+		if w == nil {
+			if w, err = s.dest.Open(key[0], key[1]); err != nil {
+				return fmt.Errorf("opening the dead-letter group %s: %s", key[0], err)
+			}
+			s.writers[key] = w
+		}
+
+		if err = w.WriteMessageBatch(msgs); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (s *destinationDeadLetterSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for key, w := range s.writers {
+		w.Close()
+		s.dest.Close(key[0], key[1])
+		delete(s.writers, key)
+	}
+
+	return nil
+}
+
+// NewDeadLetterDestination wraps dest so the messages that its writers report
+// as rejected with a RejectedError are written to sink, with the reason of the
+// rejection, instead of failing the batch. The messages are counted in the
+// dead_lettered_messages counter of registry, and only logged when sink is nil.
+func NewDeadLetterDestination(name string, dest Destination, sink DeadLetterSink, registry *metrics.Registry) Destination {
+	return deadLetterDestination{
+		Destination: dest,
+		name:        name,
+		sink:        sink,
+		count:       registry.Counter("dead_lettered_messages", "destination", name),
+	}
+}
+
+type deadLetterDestination struct {
+	Destination
+	name  string
+	sink  DeadLetterSink
+	count *metrics.Counter
+}
+
+func (d deadLetterDestination) Open(group string, stream string) (w Writer, err error) {
+	if w, err = d.Destination.Open(group, stream); err == nil {
+		w = &deadLetterWriter{Writer: w, dest: d}
+	}
+	return
+}
+
+type deadLetterWriter struct {
+	Writer
+	dest deadLetterDestination
+}
+
+func (w *deadLetterWriter) WriteMessage(msg Message) error {
+	return w.WriteMessageBatch(MessageBatch{msg})
+}
+
+func (w *deadLetterWriter) WriteMessageBatch(batch MessageBatch) (err error) {
+	_, err = w.WriteMessageBatchSize(batch)
+	return
+}
+
+func (w *deadLetterWriter) WriteMessageBatchSize(batch MessageBatch) (int, error) {
+	return w.write(batch, WriteMessageBatchSize)
+}
+
+func (w *deadLetterWriter) WriteUrgentMessageBatch(batch MessageBatch) (int, error) {
+	return w.write(batch, WriteUrgentMessageBatch)
+}
+
+// Receipt returns the receipt of the wrapped writer, so the batches are still
+// recorded with it in the audit log.
+func (w *deadLetterWriter) Receipt() string {
+	if rw, ok := w.Writer.(ReceiptWriter); ok {
+		return rw.Receipt()
+	}
+	return ""
+}
+
+func (w *deadLetterWriter) write(batch MessageBatch, write func(Writer, MessageBatch) (int, error)) (size int, err error) {
+	size, err = write(w.Writer, batch)
+
+	rejected, ok := err.(*RejectedError)
+	if !ok {
+		return
+	}
+
+	err = nil
+	deadLetters := make(MessageBatch, 0, len(rejected.Rejections))
+
+	for _, r := range rejected.Rejections {
+		deadLetters = append(deadLetters, DeadLetterMessage(r.Message, w.dest.name, r.Reason, rejected))
+	}
+
+	w.dest.count.Add(int64(len(deadLetters)))
+
+	if w.dest.sink == nil {
+		LogMessages(deadLetters, "rejected", log.Fields{"destination": w.dest.name})
+		return
+	}
+
+	if e := w.dest.sink.WriteDeadLetters(deadLetters); e != nil {
+		// The rest of the batch was delivered, failing it would send it
+		// again, the rejected messages are logged instead.
+		log.WithError(e).WithField("destination", w.dest.name).Error("failed to write to the dead-letter sink")
+		LogMessages(deadLetters, "rejected", log.Fields{"destination": w.dest.name})
+		return
+	}
+
+	LogMessages(deadLetters, "dead-lettered", log.Fields{"destination": w.dest.name})
+	return
+}
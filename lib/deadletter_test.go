@@ -0,0 +1,205 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+func TestDeadLetterInfo(t *testing.T) {
+	msg := Message{Group: "A", Stream: "B"}
+
+	tests := []struct {
+		err  error
+		info ecslogs.EventData
+	}{
+		{
+			err:  nil,
+			info: ecslogs.EventData{"reason": "rejected", "group": "A", "stream": "B"},
+		},
+		{
+			err:  errors.New("connection reset"),
+			info: ecslogs.EventData{"reason": "rejected", "group": "A", "stream": "B"},
+		},
+		{
+			err:  awserr.NewRequestFailure(awserr.New("InvalidParameterException", "Log event too large", nil), 400, "req-42"),
+			info: ecslogs.EventData{"reason": "rejected", "group": "A", "stream": "B", "request_id": "req-42"},
+		},
+	}
+
+	for _, test := range tests {
+		if info := DeadLetterInfo(msg, "rejected", test.err); !reflect.DeepEqual(info, test.info) {
+			t.Errorf("%v: invalid dead-letter info:\n- expected: %#v\n- found:    %#v", test.err, test.info, info)
+		}
+	}
+}
+
+// rejectingTestWriter rejects the messages of the batches that are "rejected",
+// the other ones are delivered.
+type rejectingTestWriter struct {
+	delivered *MessageBatch
+}
+
+func (w rejectingTestWriter) Close() error { return nil }
+
+func (w rejectingTestWriter) WriteMessage(msg Message) error {
+	return w.WriteMessageBatch(MessageBatch{msg})
+}
+
+func (w rejectingTestWriter) WriteMessageBatch(batch MessageBatch) error {
+	rejected := &RejectedError{ID: "req-42"}
+
+	for _, msg := range batch {
+		if msg.Event.Message == "rejected" {
+			rejected.Rejections = append(rejected.Rejections, Rejection{Message: msg, Reason: "too old"})
+		} else {
+			*w.delivered = append(*w.delivered, msg)
+		}
+	}
+
+	if len(rejected.Rejections) != 0 {
+		return rejected
+	}
+	return nil
+}
+
+type testDeadLetterSink struct {
+	batches []MessageBatch
+}
+
+func (s *testDeadLetterSink) WriteDeadLetters(batch MessageBatch) error {
+	s.batches = append(s.batches, batch)
+	return nil
+}
+
+func (s *testDeadLetterSink) Close() error { return nil }
+
+func TestDeadLetterDestination(t *testing.T) {
+	var delivered MessageBatch
+	sink := &testDeadLetterSink{}
+	registry := metrics.NewRegistry()
+
+	dest := NewDeadLetterDestination("testdest", DestinationFunc(func(group string, stream string) (Writer, error) {
+		return rejectingTestWriter{delivered: &delivered}, nil
+	}), sink, registry)
+
+	w, err := dest.Open("A", "B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	batch := MessageBatch{
+		{Group: "A", Stream: "B", Event: ecslogs.Event{Message: "rejected"}},
+		{Group: "A", Stream: "B", Event: ecslogs.Event{Message: "accepted"}},
+	}
+
+	if err := w.WriteMessageBatch(batch); err != nil {
+		t.Errorf("the batch should be reported as written: %s", err)
+	}
+
+	if len(delivered) != 1 || delivered[0].Event.Message != "accepted" {
+		t.Errorf("the accepted messages should be delivered: %v", delivered)
+	}
+
+	if len(sink.batches) != 1 || len(sink.batches[0]) != 1 {
+		t.Fatalf("the rejected messages should be written to the sink: %v", sink.batches)
+	}
+
+	info, _ := sink.batches[0][0].Event.Data[DeadLetterField].(ecslogs.EventData)
+
+	if info["reason"] != "too old" || info["destination"] != "testdest" || info["request_id"] != "req-42" || info["group"] != "A" {
+		t.Errorf("the dead letters should carry the reason of the rejection: %v", info)
+	}
+
+	if batch[0].Event.Data != nil {
+		t.Error("the original messages should not be modified")
+	}
+
+	if n := registry.Counter("dead_lettered_messages", "destination", "testdest").Value(); n != 1 {
+		t.Errorf("invalid count of dead-lettered messages: %d", n)
+	}
+}
+
+func TestDeadLetterFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dead-letters.log")
+
+	sink, err := OpenDeadLetterSink("file:"+path, "ecs-logs-dead-letter")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := MessageBatch{
+		{Group: "A", Stream: "B", Event: ecslogs.Event{Message: "1"}},
+		{Group: "A", Stream: "B", Event: ecslogs.Event{Message: "2"}},
+	}
+
+	if err := sink.WriteDeadLetters(batch); err != nil {
+		t.Fatal(err)
+	}
+	sink.Close()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+
+	if len(lines) != 2 {
+		t.Fatalf("the dead letters should be written one per line: %q", b)
+	}
+
+	var msg Message
+
+	if err := json.Unmarshal([]byte(lines[1]), &msg); err != nil || msg.Event.Message != "2" {
+		t.Errorf("invalid dead letter: %s (%v)", lines[1], err)
+	}
+}
+
+func TestOpenDeadLetterSink(t *testing.T) {
+	if sink, err := OpenDeadLetterSink("", "ecs-logs-dead-letter"); sink != nil || err != nil {
+		t.Errorf("no sink should be opened when it isn't configured: %v %v", sink, err)
+	}
+
+	if _, err := OpenDeadLetterSink("nope", "ecs-logs-dead-letter"); err == nil {
+		t.Error("unknown destinations should be rejected")
+	}
+
+	if sink, err := OpenDeadLetterSink("stdout", "ecs-logs-dead-letter"); sink == nil || err != nil {
+		t.Errorf("the registered destinations should be valid sinks: %v", err)
+	}
+}
+
+func TestAppendWriteError(t *testing.T) {
+	a := &RejectedError{Rejections: []Rejection{{Reason: "a"}}}
+	b := &RejectedError{Rejections: []Rejection{{Reason: "b"}}, ID: "req-42"}
+	failed := errors.New("failed")
+
+	if err, ok := AppendWriteError(a, b).(*RejectedError); !ok || len(err.Rejections) != 2 || err.ID != "req-42" {
+		t.Errorf("the rejections should be merged: %v", err)
+	}
+
+	if err := AppendWriteError(a, failed); err != failed {
+		t.Errorf("failures should take precedence over the rejections: %v", err)
+	}
+
+	if err := AppendWriteError(nil, a); err != a {
+		t.Errorf("a single error should be returned as is: %v", err)
+	}
+}
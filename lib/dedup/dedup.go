@@ -0,0 +1,149 @@
+// Package dedup derives stable IDs from log messages, destinations that
+// support idempotency keys send them along with the messages so writing the
+// same message twice, for example when a batch is retried, doesn't create a
+// duplicate.
+package dedup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+// A Key describes how the IDs of messages are derived, the zero value doesn't
+// derive any ID.
+type Key struct {
+	// The fields that the ID is computed from, nil when the ID is a hash of
+	// the whole message.
+	fields []string
+
+	enabled bool
+}
+
+// The top-level fields that can be used in keys, the info and data fields are
+// referenced with dotted paths like info.host or data.request.id.
+var keyFields = []string{"group", "stream", "level", "time", "message"}
+
+// Parse returns the key described by s, which is either empty (no ID is
+// derived), "hash" for a hash of the whole message, or a comma separated list
+// of the fields that identify a message.
+func Parse(s string) (k Key, err error) {
+	switch s = strings.TrimSpace(s); strings.ToLower(s) {
+	case "":
+		return
+	case "hash":
+		k.enabled = true
+		return
+	}
+
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); !isKeyField(f) {
+			err = fmt.Errorf("invalid dedup key field, must be one of %s or start with info. or data.: %s",
+				strings.Join(keyFields, ", "), f)
+			return
+		}
+		k.fields = append(k.fields, f)
+	}
+
+	k.enabled = true
+	return
+}
+
+// DestinationKey returns the key configured for destination by the
+// <DESTINATION>_DEDUP_KEY environment variable.
+func DestinationKey(destination string) (k Key, err error) {
+	env := strings.ToUpper(destination) + "_DEDUP_KEY"
+
+	if k, err = Parse(lib.Getenv(env)); err != nil {
+		err = fmt.Errorf("%s: %s", env, err)
+	}
+
+	return
+}
+
+func isKeyField(f string) bool {
+	for _, k := range keyFields {
+		if f == k {
+			return true
+		}
+	}
+	return (strings.HasPrefix(f, "info.") || strings.HasPrefix(f, "data.")) && !strings.HasSuffix(f, ".")
+}
+
+// Enabled returns true if k derives IDs.
+func (k Key) Enabled() bool {
+	return k.enabled
+}
+
+func (k Key) String() string {
+	switch {
+	case !k.enabled:
+		return ""
+	case k.fields == nil:
+		return "hash"
+	default:
+		return strings.Join(k.fields, ",")
+	}
+}
+
+// ID returns the ID of msg, or an empty string if k is disabled. The ID only
+// depends on the content of msg, it stays the same when the message is
+// retried, including after it went through the spool.
+func (k Key) ID(msg lib.Message) string {
+	if !k.enabled {
+		return ""
+	}
+
+	h := sha256.New()
+
+	if k.fields == nil {
+		// Maps are marshaled with sorted keys so the encoding of a message is
+		// deterministic.
+		h.Write(msg.Bytes())
+	} else {
+		obj := decode(msg)
+
+		for _, f := range k.fields {
+			b, _ := json.Marshal(lookup(obj, f))
+			h.Write(b)
+			h.Write([]byte{0})
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+func decode(msg lib.Message) (obj map[string]interface{}) {
+	d := json.NewDecoder(bytes.NewReader(msg.Bytes()))
+	d.UseNumber()
+	d.Decode(&obj)
+
+	// The group and the stream are the only fields that aren't part of the
+	// event.
+	event, _ := obj["event"].(map[string]interface{})
+	if event == nil {
+		event = make(map[string]interface{}, 2)
+	}
+	event["group"] = obj["group"]
+	event["stream"] = obj["stream"]
+	return event
+}
+
+func lookup(obj map[string]interface{}, path string) interface{} {
+	var value interface{} = obj
+
+	for _, key := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+
+	return value
+}
@@ -0,0 +1,96 @@
+package dedup
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+func makeMessage(id string, attempt int) lib.Message {
+	return lib.Message{
+		Group:  "A",
+		Stream: "B",
+		Event: ecslogs.Event{
+			Level:   ecslogs.INFO,
+			Time:    time.Date(2016, 10, 12, 0, 0, 0, 123456789, time.UTC),
+			Info:    ecslogs.EventInfo{Host: "i-1234"},
+			Message: "Hello World!",
+			Data: ecslogs.EventData{
+				"request": map[string]interface{}{"id": id},
+				"attempt": attempt,
+			},
+		},
+	}
+}
+
+func TestRetriedMessages(t *testing.T) {
+	for _, s := range []string{"hash", "group,stream,time,message,data.request.id", "data.request", "info.host, data.request.id"} {
+		k, err := Parse(s)
+		if err != nil {
+			t.Errorf("%q: %s", s, err)
+			continue
+		}
+
+		msg := makeMessage("42", 1)
+		id := k.ID(msg)
+
+		if len(id) != 32 {
+			t.Errorf("%q: invalid ID: %q", s, id)
+		}
+
+		// Retries see the same message, or a copy decoded from the spool.
+		var spooled lib.Message
+		if err := json.Unmarshal(msg.Bytes(), &spooled); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i != 3; i++ {
+			if retry := k.ID(msg); retry != id {
+				t.Errorf("%q: the ID changed on retry %d: %s != %s", s, i, retry, id)
+			}
+		}
+
+		if retry := k.ID(spooled); retry != id {
+			t.Errorf("%q: the ID changed after spooling: %s != %s", s, retry, id)
+		}
+
+		if other := k.ID(makeMessage("43", 1)); other == id {
+			t.Errorf("%q: different messages have the same ID", s)
+		}
+	}
+}
+
+func TestFieldsKey(t *testing.T) {
+	k, err := Parse("data.request.id")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fields that aren't part of the key don't change the ID.
+	if a, b := k.ID(makeMessage("42", 1)), k.ID(makeMessage("42", 2)); a != b {
+		t.Errorf("the ID changed with a field that isn't part of the key: %s != %s", a, b)
+	}
+
+	if k, _ = Parse("hash"); k.ID(makeMessage("42", 1)) == k.ID(makeMessage("42", 2)) {
+		t.Error("the hash of different messages should differ")
+	}
+}
+
+func TestParse(t *testing.T) {
+	if k, err := Parse(""); err != nil || k.Enabled() || k.ID(makeMessage("42", 1)) != "" {
+		t.Errorf("an empty key should be disabled: %v", err)
+	}
+
+	if k, err := Parse(" group , data.request.id "); err != nil || k.String() != "group,data.request.id" {
+		t.Errorf("invalid key: %q (%v)", k, err)
+	}
+
+	for _, s := range []string{"host", "group,", "data.", "event.message"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
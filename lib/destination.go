@@ -6,6 +6,20 @@ import (
 	"sync"
 )
 
+// A Destination is where ecs-logs writes log messages to. Open is called for
+// each stream the first time a batch of the stream is written, and Close when
+// the stream expired or ecs-logs exits, the destination may keep the writers
+// of the streams open in between.
+//
+// The batches of a stream are written one at a time, from the goroutines of
+// the dispatcher, unless <DESTINATION>_ORDERING allows them to be written
+// concurrently. A batch is acknowledged to the sources once WriteMessageBatch
+// returns without an error, writers that hold the messages to write them later
+// must retain them with RetainBatch until they're written. A batch that fails
+// is logged, dropped and rewound.
+//
+// Destinations may implement ConfigChecker and Warmer, and their writers
+// SizedWriter, UrgentWriter and ReceiptWriter.
 type Destination interface {
 	Open(group string, stream string) (Writer, error)
 
@@ -20,10 +34,16 @@ func (f DestinationFunc) Open(group string, stream string) (Writer, error) {
 
 func (f DestinationFunc) Close(group string, stream string) {}
 
+// RegisterDestination makes destination available under name to the -dst
+// flag. It's meant to be called from the init function of the package
+// implementing the destination, and panics if name isn't a valid destination
+// name or is already registered.
 func RegisterDestination(name string, destination Destination) {
 	dstmtx.Lock()
+	defer dstmtx.Unlock()
+
+	checkPluginName("destination", name, dstmap[name] != nil)
 	dstmap[name] = destination
-	dstmtx.Unlock()
 }
 
 func DeregisterDestination(name string) {
@@ -66,9 +86,11 @@ func DestinationsAvailable() (destinations []string) {
 
 var (
 	dstmtx sync.RWMutex
-	dstmap = map[string]Destination{
-		"stdout": DestinationFunc(func(_ string, _ string) (Writer, error) {
-			return NewMessageEncoder(os.Stdout), nil
-		}),
-	}
+	dstmap = map[string]Destination{}
 )
+
+func init() {
+	RegisterDestination("stdout", DestinationFunc(func(_ string, _ string) (Writer, error) {
+		return NewMessageEncoder(os.Stdout), nil
+	}))
+}
@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// DryRunOutput is where the dry-run destinations print the batches written to
+// them, it's shared by all of them so the batches aren't interleaved.
+type DryRunOutput struct {
+	mutex sync.Mutex
+	w     io.Writer
+	count int
+}
+
+// NewDryRunOutput returns an output printing the batches to w.
+func NewDryRunOutput(w io.Writer) *DryRunOutput {
+	return &DryRunOutput{w: w}
+}
+
+// dryRunMessage is what the dry-run destinations print for each message, the
+// message annotated with the destination it was routed to and the batch it
+// was written in.
+type dryRunMessage struct {
+	Destination string `json:"destination"`
+	Batch       int    `json:"batch"`
+	Message
+}
+
+// NewDryRunDestination returns a destination which prints the batches written
+// to it to out instead of delivering them, one JSON object per message with the
+// name of the destination and the sequence number of the batch:
+//
+//	{"destination":"cloudwatchlogs","batch":1,"group":"A","stream":"B","event":{...}}
+func NewDryRunDestination(name string, out *DryRunOutput) Destination {
+	return DestinationFunc(func(_ string, _ string) (Writer, error) {
+		return dryRunWriter{name: name, out: out}, nil
+	})
+}
+
+type dryRunWriter struct {
+	name string
+	out  *DryRunOutput
+}
+
+func (w dryRunWriter) Close() error {
+	return nil
+}
+
+func (w dryRunWriter) WriteMessage(msg Message) error {
+	return w.WriteMessageBatch(MessageBatch{msg})
+}
+
+func (w dryRunWriter) WriteMessageBatch(batch MessageBatch) (err error) {
+	_, err = w.WriteMessageBatchSize(batch)
+	return
+}
+
+func (w dryRunWriter) WriteMessageBatchSize(batch MessageBatch) (size int, err error) {
+	w.out.mutex.Lock()
+	defer w.out.mutex.Unlock()
+
+	w.out.count++
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+
+	for _, msg := range batch {
+		if err = enc.Encode(dryRunMessage{Destination: w.name, Batch: w.out.count, Message: msg}); err != nil {
+			return
+		}
+	}
+
+	return w.out.w.Write(buf.Bytes())
+}
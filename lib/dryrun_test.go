@@ -0,0 +1,50 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+func TestDryRunDestination(t *testing.T) {
+	buf := &bytes.Buffer{}
+	out := NewDryRunOutput(buf)
+
+	for _, name := range []string{"cloudwatchlogs", "s3"} {
+		w, err := NewDryRunDestination(name, out).Open("A", "B")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := w.WriteMessageBatch(MessageBatch{
+			{Group: "A", Stream: "B", Event: ecslogs.Event{Message: "1"}},
+			{Group: "A", Stream: "B", Event: ecslogs.Event{Message: "2"}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+
+	if len(lines) != 4 {
+		t.Fatalf("each message should be printed on its own line:\n%s", buf)
+	}
+
+	var res struct {
+		Destination string        `json:"destination"`
+		Batch       int           `json:"batch"`
+		Group       string        `json:"group"`
+		Event       ecslogs.Event `json:"event"`
+	}
+
+	if err := json.Unmarshal([]byte(lines[3]), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Destination != "s3" || res.Batch != 2 || res.Group != "A" || res.Event.Message != "2" {
+		t.Errorf("the message should be annotated with its destination and batch: %s", lines[3])
+	}
+}
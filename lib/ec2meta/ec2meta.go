@@ -0,0 +1,106 @@
+// Package ec2meta reads the identity document served by the EC2 instance
+// metadata service (IMDS), which describes the instance that ecs-logs runs on.
+package ec2meta
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout is the time allowed to the service to respond, it's served
+// by the hypervisor of the instance so anything slower means it's unavailable.
+const DefaultTimeout = 2 * time.Second
+
+// URI returns the URI of the instance metadata service, or an empty string
+// when it was disabled, it honors the environment variables of the AWS SDKs.
+func URI() string {
+	if disabled := os.Getenv("AWS_EC2_METADATA_DISABLED"); strings.EqualFold(disabled, "true") {
+		return ""
+	}
+	if uri := os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"); len(uri) != 0 {
+		return strings.TrimSuffix(uri, "/")
+	}
+	return "http://169.254.169.254"
+}
+
+// Instance is the identity of an EC2 instance.
+type Instance struct {
+	InstanceID       string `json:"instanceId"`
+	InstanceType     string `json:"instanceType"`
+	AvailabilityZone string `json:"availabilityZone"`
+	Region           string `json:"region"`
+}
+
+// GetInstance returns the identity of the instance served by the service at
+// uri. It uses a session token (IMDSv2) when the service grants one, so it
+// works on the instances that require them, and falls back to IMDSv1
+// otherwise.
+func GetInstance(uri string, timeout time.Duration) (instance Instance, err error) {
+	var req *http.Request
+	var res *http.Response
+
+	if len(uri) == 0 {
+		err = fmt.Errorf("the EC2 instance metadata service is disabled")
+		return
+	}
+
+	client := http.Client{Timeout: timeout}
+	token := getToken(client, uri)
+
+	if req, err = http.NewRequest("GET", uri+"/latest/dynamic/instance-identity/document", nil); err != nil {
+		return
+	}
+
+	if len(token) != 0 {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+
+	if res, err = client.Do(req); err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("the EC2 instance metadata service responded with %s", res.Status)
+		return
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&instance)
+	return
+}
+
+// getToken returns a session token, or an empty string when the service
+// doesn't support them. The token is only used for a single request so it's
+// asked for the shortest duration.
+func getToken(client http.Client, uri string) string {
+	req, err := http.NewRequest("PUT", uri+"/latest/api/token", nil)
+
+	if err != nil {
+		return ""
+	}
+
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	res, err := client.Do(req)
+
+	if err != nil {
+		return ""
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return ""
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(b))
+}
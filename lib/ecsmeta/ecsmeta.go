@@ -0,0 +1,87 @@
+// Package ecsmeta reads the documents served by the ECS container metadata
+// endpoint, which describe the task and the container that ecs-logs runs in.
+package ecsmeta
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// DefaultTimeout is the time allowed to the endpoint to respond, it's served
+// by the ECS agent on the host so anything slower means it's unavailable.
+const DefaultTimeout = 2 * time.Second
+
+// URI returns the URI of the ECS container metadata endpoint, or an empty
+// string when ecs-logs doesn't run in an ECS task.
+func URI() string {
+	if uri := os.Getenv("ECS_CONTAINER_METADATA_URI_V4"); len(uri) != 0 {
+		return uri
+	}
+	return os.Getenv("ECS_CONTAINER_METADATA_URI")
+}
+
+// Limits are the resources reserved for a task or a container, the CPU is in
+// vCPUs for tasks and in CPU units for containers, the memory is in MiB. Zero
+// values mean the limit wasn't set.
+type Limits struct {
+	CPU    float64
+	Memory int64
+}
+
+// Container is the metadata of a container.
+type Container struct {
+	DockerId   string
+	Name       string
+	DockerName string
+	Image      string
+	ImageID    string
+	Limits     Limits
+}
+
+// Task is the metadata of a task, including its containers.
+type Task struct {
+	Cluster          string
+	TaskARN          string
+	Family           string
+	Revision         string
+	AvailabilityZone string
+	LaunchType       string
+	Limits           Limits
+	Containers       []Container
+}
+
+// GetTask returns the metadata of the task served by the endpoint at uri.
+func GetTask(uri string, timeout time.Duration) (task Task, err error) {
+	err = get(uri, "/task", timeout, &task)
+	return
+}
+
+// GetContainer returns the metadata of the container that ecs-logs runs in.
+func GetContainer(uri string, timeout time.Duration) (container Container, err error) {
+	err = get(uri, "", timeout, &container)
+	return
+}
+
+func get(uri string, path string, timeout time.Duration, v interface{}) (err error) {
+	var res *http.Response
+
+	if len(uri) == 0 {
+		return fmt.Errorf("the ECS container metadata endpoint isn't available outside of ECS tasks")
+	}
+
+	client := http.Client{Timeout: timeout}
+
+	if res, err = client.Get(uri + path); err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("the ECS container metadata endpoint responded with %s", res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
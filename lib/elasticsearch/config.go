@@ -0,0 +1,230 @@
+package elasticsearch
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+const (
+	defaultIndex = "ecs-logs-{group}-{yyyy.MM.dd}"
+
+	// The default maximum size of the uncompressed body of a bulk request,
+	// Elasticsearch recommends staying in the low megabytes.
+	defaultMaxBulkBytes = 5 * 1024 * 1024
+)
+
+// The format of the bodies, reported in the schema version header.
+const schemaVersion = "elasticsearch-bulk.v1"
+
+// The ways the requests are authenticated.
+const (
+	authNone   = ""
+	authBasic  = "basic"
+	authAPIKey = "api-key"
+	authSigV4  = "sigv4"
+)
+
+// config carries the settings of the elasticsearch destination, they are
+// loaded from ELASTICSEARCH_* environment variables.
+type config struct {
+	// The URL of the cluster, the bulk requests are sent to its _bulk path.
+	url string
+
+	// The name of the index of each message.
+	index indexTemplate
+
+	// The bulk action of the documents, create for data streams.
+	action string
+
+	// How the requests are authenticated, and the credentials of the basic
+	// and api-key modes. The sigv4 mode signs the requests for Amazon
+	// OpenSearch Service with the AWS credentials of ecs-logs.
+	auth     string
+	username string
+	password string
+	apiKey   string
+	region   string
+	service  string
+
+	// How the bodies are compressed, and their maximum uncompressed size.
+	compression  lib.BodyCompression
+	maxBulkBytes int
+
+	// How the requests failing and the documents rejected with a 429 or 5xx
+	// status are sent again.
+	retry       retry.Policy
+	retryBudget lib.RetryBudget
+
+	tls      *tls.Config
+	checksum lib.BodyChecksum
+	headers  lib.ContentHeaders
+
+	err error
+}
+
+func getConfig() (c config) {
+	var err error
+	var s string
+
+	c = config{
+		url:          strings.TrimRight(strings.TrimSpace(lib.Getenv("ELASTICSEARCH_URL")), "/"),
+		action:       "index",
+		maxBulkBytes: defaultMaxBulkBytes,
+	}
+
+	if len(c.url) == 0 {
+		c.err = lib.AppendError(c.err, fmt.Errorf("missing ELASTICSEARCH_URL environment variable"))
+	} else if u, e := url.Parse(c.url); e != nil || len(u.Host) == 0 || (u.Scheme != "http" && u.Scheme != "https") {
+		c.err = lib.AppendError(c.err, fmt.Errorf("invalid ELASTICSEARCH_URL, must be an http or https URL: %s", c.url))
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("ELASTICSEARCH_INDEX")); len(s) == 0 {
+		s = defaultIndex
+	}
+
+	if c.index, err = parseIndexTemplate(s); err != nil {
+		c.err = lib.AppendError(c.err, fmt.Errorf("invalid ELASTICSEARCH_INDEX, %s: %s", err, s))
+	}
+
+	switch s = strings.ToLower(strings.TrimSpace(lib.Getenv("ELASTICSEARCH_ACTION"))); s {
+	case "":
+	case "index", "create":
+		c.action = s
+	default:
+		c.err = lib.AppendError(c.err, fmt.Errorf("invalid ELASTICSEARCH_ACTION, must be one of index or create: %s", s))
+	}
+
+	c.username = lib.Getenv("ELASTICSEARCH_USERNAME")
+	c.password = lib.Getenv("ELASTICSEARCH_PASSWORD")
+	c.apiKey = strings.TrimSpace(lib.Getenv("ELASTICSEARCH_API_KEY"))
+
+	// The mode is guessed from the credentials that are set when it isn't
+	// given.
+	switch s = strings.ToLower(strings.TrimSpace(lib.Getenv("ELASTICSEARCH_AUTH"))); {
+	case len(s) != 0:
+		c.auth = s
+	case len(c.apiKey) != 0:
+		c.auth = authAPIKey
+	case len(c.username) != 0:
+		c.auth = authBasic
+	}
+
+	switch c.auth {
+	case "none":
+		c.auth = authNone
+	case authBasic:
+		if len(c.username) == 0 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("missing ELASTICSEARCH_USERNAME environment variable for the basic authentication"))
+		}
+	case authAPIKey:
+		if len(c.apiKey) == 0 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("missing ELASTICSEARCH_API_KEY environment variable for the api-key authentication"))
+		}
+	case authSigV4:
+		c.region, c.service = parseAWSHost(c.url)
+
+		if s = strings.TrimSpace(lib.Getenv("ELASTICSEARCH_REGION")); len(s) != 0 {
+			c.region = s
+		} else if len(c.region) == 0 {
+			if c.region = os.Getenv("AWS_REGION"); len(c.region) == 0 {
+				c.region = os.Getenv("AWS_DEFAULT_REGION")
+			}
+		}
+
+		if s = strings.TrimSpace(lib.Getenv("ELASTICSEARCH_SIGV4_SERVICE")); len(s) != 0 {
+			c.service = s
+		}
+
+		if len(c.region) == 0 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("the region of the domain couldn't be found in ELASTICSEARCH_URL, it must be set with ELASTICSEARCH_REGION"))
+		}
+	default:
+		c.err = lib.AppendError(c.err, fmt.Errorf("invalid ELASTICSEARCH_AUTH, must be one of none, basic, api-key or sigv4: %s", c.auth))
+	}
+
+	// ELASTICSEARCH_GZIP predates ELASTICSEARCH_COMPRESSION, it only changes
+	// the default codec.
+	codec := "gzip"
+
+	if s = strings.TrimSpace(lib.Getenv("ELASTICSEARCH_GZIP")); len(s) != 0 {
+		if gzip, e := strconv.ParseBool(s); e != nil {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid ELASTICSEARCH_GZIP, must be a boolean: %s", s))
+		} else if !gzip {
+			codec = "none"
+		}
+	}
+
+	if c.compression, err = lib.DestinationBodyCompression("elasticsearch", codec); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("ELASTICSEARCH_MAX_BULK_BYTES")); len(s) != 0 {
+		if c.maxBulkBytes, err = strconv.Atoi(s); err != nil || c.maxBulkBytes <= 0 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid ELASTICSEARCH_MAX_BULK_BYTES, must be a positive integer: %s", s))
+		}
+	}
+
+	if c.retry, err = retry.DestinationPolicy("elasticsearch", retry.DefaultPolicy); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.retryBudget, err = lib.DestinationRetryBudget("elasticsearch"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if t, err := lib.DestinationTLS("elasticsearch"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	} else if t.Enabled() {
+		if c.tls, err = t.Load(); err != nil {
+			c.err = lib.AppendError(c.err, err)
+		}
+	}
+
+	if c.checksum, err = lib.DestinationBodyChecksum("elasticsearch"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	// The bulk API only takes newline delimited JSON, the documents are never
+	// wrapped in an envelope.
+	if c.headers, err = lib.DestinationContentHeaders("elasticsearch", "application/x-ndjson", schemaVersion, lib.Envelope{}); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	return
+}
+
+func (c config) check() error {
+	return c.err
+}
+
+// parseAWSHost returns the region and the signing service of the Amazon
+// OpenSearch Service endpoint at s, like search-logs-abc.us-east-1.es.amazonaws.com
+// or abc.us-east-1.aoss.amazonaws.com for the serverless collections. The
+// region is empty for the other hosts.
+func parseAWSHost(s string) (region string, service string) {
+	service = "es"
+
+	u, err := url.Parse(s)
+
+	if err != nil {
+		return
+	}
+
+	parts := strings.Split(u.Hostname(), ".")
+
+	for i := 1; i+2 < len(parts); i++ {
+		if (parts[i+1] == "es" || parts[i+1] == "aoss") && parts[i+2] == "amazonaws" {
+			region, service = parts[i], parts[i+1]
+			return
+		}
+	}
+
+	return
+}
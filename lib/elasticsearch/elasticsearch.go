@@ -0,0 +1,359 @@
+// Package elasticsearch implements the elasticsearch destination, which indexes
+// the messages in an Elasticsearch or OpenSearch cluster with the bulk API.
+package elasticsearch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+// destination sends the messages of all the streams to a single cluster, the
+// writers share its HTTP client.
+type destination struct {
+	lazy   lib.LazyConfig
+	load   func() config
+	config config
+
+	client  *http.Client
+	signer  *v4.Signer
+	retries *lib.RetryLimiter
+	clock   clock.Clock
+}
+
+func newDestination(load func() config) *destination {
+	return &destination{
+		load:   load,
+		client: &http.Client{Timeout: 30 * time.Second},
+		clock:  clock.System,
+	}
+}
+
+func (d *destination) Open(group string, stream string) (w lib.Writer, err error) {
+	if err = d.lazy.Init(d.init); err != nil {
+		return
+	}
+
+	if d.config.auth == authSigV4 && d.signer == nil {
+		var sess *session.Session
+
+		if sess, err = session.NewSession(&aws.Config{Region: aws.String(d.config.region)}); err != nil {
+			return
+		}
+
+		d.signer = v4.NewSigner(sess.Config.Credentials)
+	}
+
+	w = writer{dest: d}
+	return
+}
+
+// CheckConfig reports the problems with the ELASTICSEARCH_* settings when
+// ecs-logs starts.
+func (d *destination) CheckConfig() error {
+	return d.load().check()
+}
+
+func (d *destination) Close(group string, stream string) {}
+
+func (d *destination) init() error {
+	d.config = d.load()
+	d.retries = lib.NewRetryLimiter("elasticsearch", d.config.retryBudget, metrics.Default)
+
+	if d.config.tls != nil {
+		d.client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: d.config.tls,
+		}
+	}
+
+	return d.config.check()
+}
+
+// document is a message as it's indexed.
+type document struct {
+	Timestamp string            `json:"@timestamp,omitempty"`
+	Message   string            `json:"message"`
+	Level     string            `json:"level,omitempty"`
+	Group     string            `json:"group"`
+	Stream    string            `json:"stream"`
+	Info      ecslogs.EventInfo `json:"info"`
+	Data      ecslogs.EventData `json:"data,omitempty"`
+}
+
+// item is a document of a bulk request, with its action line.
+type item struct {
+	msg    lib.Message
+	action []byte
+	source []byte
+}
+
+func (d *destination) item(msg lib.Message) (it item, err error) {
+	it.msg = msg
+	doc := document{
+		Message: msg.Event.Message,
+		Group:   msg.Group,
+		Stream:  msg.Stream,
+		Info:    msg.Event.Info,
+		Data:    msg.Event.Data,
+	}
+
+	if msg.Event.Level != ecslogs.NONE {
+		doc.Level = msg.Event.Level.String()
+	}
+
+	if !msg.Event.Time.IsZero() {
+		doc.Timestamp = msg.Event.Time.UTC().Format(time.RFC3339Nano)
+	}
+
+	meta := map[string]string{"_index": d.config.index.Render(msg)}
+
+	// The documents keep the ID of their message, so the ones sent again by
+	// the retries replace the copies that were already indexed instead of
+	// being duplicated.
+	if id, ok := msg.Event.Data[lib.MessageIDField].(string); ok && len(id) != 0 {
+		meta["_id"] = id
+	}
+
+	if it.action, err = json.Marshal(map[string]interface{}{d.config.action: meta}); err == nil {
+		it.source, err = json.Marshal(doc)
+	}
+
+	return
+}
+
+func (it item) size() int {
+	return len(it.action) + len(it.source) + 2
+}
+
+// send indexes items with a single bulk request. The requests failing with a
+// network error, a 429 or a 5xx status, and the documents that the cluster
+// failed to index for the same reasons (like a full write queue), are sent
+// again with the retry policy of the destination. The documents that it
+// rejected, like ones that don't match the mapping of the index, would fail
+// again and are reported right away in a lib.RejectedError.
+func (d *destination) send(items []item) (err error) {
+	var rejections []lib.Rejection
+
+	if e := d.config.retry.Do(d.clock, d.retries, func() error {
+		failed, last, rejected, retryable, e := d.bulk(items)
+		rejections = append(rejections, rejected...)
+
+		if e != nil {
+			if retryable {
+				e = retry.Retryable(e)
+			}
+			return e
+		}
+
+		if len(failed) == 0 {
+			return nil
+		}
+
+		items = failed
+		return retry.Retryable(fmt.Errorf("%d documents couldn't be indexed by elasticsearch, the last error was %s", len(failed), last))
+	}); e != nil {
+		err = e
+	}
+
+	if len(rejections) != 0 {
+		err = lib.AppendWriteError(err, &lib.RejectedError{Rejections: rejections})
+	}
+
+	return
+}
+
+// bulkResponse is the body of the responses to the bulk requests, each item
+// maps the action to its result.
+type bulkResponse struct {
+	Errors bool                        `json:"errors"`
+	Items  []map[string]bulkItemResult `json:"items"`
+}
+
+type bulkItemResult struct {
+	Status int `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// bulk posts items and returns the ones that can be sent again, along with the
+// error of the last of them, and the ones that were rejected.
+func (d *destination) bulk(items []item) (failed []item, last string, rejected []lib.Rejection, retryable bool, err error) {
+	var payload bytes.Buffer
+	var req *http.Request
+	var res *http.Response
+
+	for _, it := range items {
+		payload.Write(it.action)
+		payload.WriteByte('\n')
+		payload.Write(it.source)
+		payload.WriteByte('\n')
+	}
+
+	body, err := d.config.compression.Compress(payload.Bytes())
+	if err != nil {
+		return
+	}
+
+	if req, err = http.NewRequest("POST", d.config.url+"/_bulk", bytes.NewReader(body)); err != nil {
+		return
+	}
+
+	d.config.headers.Set(req)
+	d.config.compression.Set(req)
+	d.config.checksum.Sign(req, body)
+
+	if err = d.authenticate(req, body); err != nil {
+		return
+	}
+
+	if res, err = d.client.Do(req); err != nil {
+		retryable = true
+		return
+	}
+	defer res.Body.Close()
+
+	if cerr := d.config.checksum.Verify(res, body); cerr != nil {
+		metrics.Default.Counter("checksum_mismatches", "destination", "elasticsearch").Add(1)
+		log.WithError(cerr).Warn("elasticsearch received a corrupted bulk request")
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(&io.LimitedReader{R: res.Body, N: 1024})
+		err = fmt.Errorf("elasticsearch responded with %s: %s", res.Status, bytes.TrimSpace(msg))
+		retryable = res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusRequestTimeout || res.StatusCode >= 500
+		return
+	}
+
+	var r bulkResponse
+
+	if err = json.NewDecoder(res.Body).Decode(&r); err != nil {
+		err = fmt.Errorf("invalid response from elasticsearch: %s", err)
+		return
+	}
+
+	if !r.Errors {
+		return
+	}
+
+	if len(r.Items) != len(items) {
+		err = fmt.Errorf("elasticsearch responded with %d items to a bulk request of %d documents", len(r.Items), len(items))
+		return
+	}
+
+	for i, result := range r.Items {
+		for _, x := range result {
+			switch {
+			case x.Status >= 200 && x.Status <= 299:
+			case x.Status == http.StatusConflict && d.config.action == "create":
+				// The document was created by a previous attempt.
+			case x.Status == http.StatusTooManyRequests || x.Status >= 500:
+				failed, last = append(failed, items[i]), x.describe()
+			default:
+				rejected = append(rejected, lib.Rejection{Message: items[i].msg, Reason: "elasticsearch rejected the document, " + x.describe()})
+			}
+		}
+	}
+
+	return
+}
+
+func (x bulkItemResult) describe() string {
+	if x.Error == nil {
+		return fmt.Sprintf("status %d", x.Status)
+	}
+	return fmt.Sprintf("%s: %s", x.Error.Type, x.Error.Reason)
+}
+
+// authenticate sets the credentials of the destination on req, whose body is
+// body.
+func (d *destination) authenticate(req *http.Request, body []byte) (err error) {
+	switch d.config.auth {
+	case authBasic:
+		req.SetBasicAuth(d.config.username, d.config.password)
+
+	case authAPIKey:
+		req.Header.Set("Authorization", "ApiKey "+d.config.apiKey)
+
+	case authSigV4:
+		// OpenSearch Serverless requires the hash of the payload in a header,
+		// the signer uses it instead of computing its own.
+		sum := sha256.Sum256(body)
+		req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+		_, err = d.signer.Sign(req, bytes.NewReader(body), d.config.service, d.config.region, d.clock.Now())
+	}
+
+	return
+}
+
+type writer struct {
+	dest *destination
+}
+
+func (w writer) Close() error {
+	return nil
+}
+
+func (w writer) WriteMessage(msg lib.Message) error {
+	return w.WriteMessageBatch(lib.MessageBatch{msg})
+}
+
+func (w writer) WriteMessageBatch(batch lib.MessageBatch) (err error) {
+	_, err = w.WriteMessageBatchSize(batch)
+	return
+}
+
+// WriteMessageBatchSize indexes batch with as few bulk requests as the maximum
+// size of their bodies allows, and returns the uncompressed size of the
+// documents and their action lines.
+func (w writer) WriteMessageBatchSize(batch lib.MessageBatch) (size int, err error) {
+	var items []item
+	var length int
+
+	flush := func() {
+		if len(items) != 0 {
+			if e := w.dest.send(items); e != nil {
+				err = lib.AppendWriteError(err, e)
+			}
+			items, length = nil, 0
+		}
+	}
+
+	for _, msg := range batch {
+		it, e := w.dest.item(msg)
+
+		if e != nil {
+			err = lib.AppendError(err, e)
+			continue
+		}
+
+		if len(items) != 0 && length+it.size() > w.dest.config.maxBulkBytes {
+			flush()
+		}
+
+		items = append(items, it)
+		length += it.size()
+		size += it.size()
+	}
+
+	flush()
+	return
+}
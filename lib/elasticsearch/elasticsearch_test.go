@@ -0,0 +1,391 @@
+package elasticsearch
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/codec"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+var epoch = time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC)
+
+// request is a bulk request received by the mock cluster.
+type request struct {
+	header  http.Header
+	actions []map[string]map[string]string
+	docs    []document
+}
+
+// mockAPI is a cluster recording the bulk requests, status returns the status
+// of each document.
+type mockAPI struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	requests []request
+	status   func(call int, doc document) int
+}
+
+func newTestDestination(t *testing.T, c config) (*destination, *mockAPI) {
+	api := &mockAPI{}
+	api.Server = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		var body io.Reader = req.Body
+		var r = request{header: req.Header}
+
+		if req.URL.Path != "/_bulk" {
+			t.Errorf("invalid path: %s", req.URL.Path)
+		}
+
+		if enc := req.Header.Get("Content-Encoding"); len(enc) != 0 {
+			c, err := codec.Get(enc, 0)
+			if err == nil {
+				body, err = c.NewReader(req.Body)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		lines := bufio.NewScanner(body)
+
+		for lines.Scan() {
+			var action map[string]map[string]string
+			var doc document
+
+			json.Unmarshal(lines.Bytes(), &action)
+			lines.Scan()
+			json.Unmarshal(lines.Bytes(), &doc)
+
+			r.actions = append(r.actions, action)
+			r.docs = append(r.docs, doc)
+		}
+
+		api.mutex.Lock()
+		api.requests = append(api.requests, r)
+		call := len(api.requests)
+		api.mutex.Unlock()
+
+		var items []map[string]interface{}
+		var errors bool
+
+		for _, doc := range r.docs {
+			status := 201
+
+			if api.status != nil {
+				status = api.status(call, doc)
+			}
+
+			result := map[string]interface{}{"status": status}
+
+			if status > 299 {
+				errors = true
+				result["error"] = map[string]string{"type": "test_exception", "reason": doc.Message}
+			}
+
+			items = append(items, map[string]interface{}{"index": result})
+		}
+
+		json.NewEncoder(res).Encode(map[string]interface{}{"errors": errors, "items": items})
+	}))
+
+	index, _ := parseIndexTemplate(defaultIndex)
+
+	c.url = api.URL
+	c.index = index
+
+	if len(c.action) == 0 {
+		c.action = "index"
+	}
+
+	if c.maxBulkBytes == 0 {
+		c.maxBulkBytes = defaultMaxBulkBytes
+	}
+
+	c.headers = lib.ContentHeaders{ContentType: "application/x-ndjson"}
+
+	d := newDestination(func() config { return c })
+	d.clock = clock.NewFake(epoch)
+	return d, api
+}
+
+func makeMessage(group string, text string) lib.Message {
+	return lib.Message{
+		Group:  group,
+		Stream: "B",
+		Event:  ecslogs.Event{Level: ecslogs.INFO, Time: epoch, Message: text},
+	}
+}
+
+func compression(t *testing.T, name string) lib.BodyCompression {
+	c, err := lib.NewBodyCompression("elasticsearch", name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestWriterBulk(t *testing.T) {
+	d, api := newTestDestination(t, config{compression: compression(t, "zstd"), auth: authBasic, username: "elastic", password: "secret"})
+	defer api.Close()
+
+	w, _ := d.Open("/ecs/API", "B")
+
+	msg := makeMessage("/ecs/API", "hello")
+	msg.Event.Data = ecslogs.EventData{lib.MessageIDField: "0189", "status": 200.0}
+
+	if err := w.WriteMessageBatch(lib.MessageBatch{msg, makeMessage("worker", "world")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(api.requests) != 1 {
+		t.Fatalf("the batch should be sent in a single request: %d", len(api.requests))
+	}
+
+	r := api.requests[0]
+
+	if user, pass, _ := (&http.Request{Header: r.header}).BasicAuth(); user != "elastic" || pass != "secret" {
+		t.Errorf("invalid credentials: %s:%s", user, pass)
+	}
+
+	if ct := r.header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("invalid content type: %s", ct)
+	}
+
+	if enc := r.header.Get("Content-Encoding"); enc != "zstd" {
+		t.Errorf("invalid content encoding: %s", enc)
+	}
+
+	for i, index := range []string{"ecs-logs-ecs-api-2016.10.12", "ecs-logs-worker-2016.10.12"} {
+		if name := r.actions[i]["index"]["_index"]; name != index {
+			t.Errorf("#%d: invalid index: %s", i, name)
+		}
+	}
+
+	if id := r.actions[0]["index"]["_id"]; id != "0189" {
+		t.Errorf("the documents should have the ID of their message: %q", id)
+	}
+
+	if _, ok := r.actions[1]["index"]["_id"]; ok {
+		t.Error("the documents of messages without IDs should get one from elasticsearch")
+	}
+
+	if doc := r.docs[0]; doc.Message != "hello" || doc.Group != "/ecs/API" || doc.Level != "INFO" || doc.Timestamp != "2016-10-12T00:00:00Z" || doc.Data["status"] != 200.0 {
+		t.Errorf("invalid document: %+v", doc)
+	}
+}
+
+func TestWriterRetriesFailedItems(t *testing.T) {
+	d, api := newTestDestination(t, config{retry: retry.Policy{MaxRetries: 3}})
+	defer api.Close()
+
+	api.status = func(call int, doc document) int {
+		switch {
+		case doc.Message == "busy" && call < 3:
+			return 429
+		case doc.Message == "invalid":
+			return 400
+		default:
+			return 201
+		}
+	}
+
+	w, _ := d.Open("A", "B")
+	err := w.WriteMessageBatch(lib.MessageBatch{makeMessage("A", "ok"), makeMessage("A", "busy"), makeMessage("A", "invalid")})
+
+	if e, ok := err.(*lib.RejectedError); !ok || len(e.Rejections) != 1 || e.Rejections[0].Message.Event.Message != "invalid" || !strings.Contains(e.Rejections[0].Reason, "test_exception: invalid") {
+		t.Errorf("the rejected documents should be reported: %v", err)
+	}
+
+	if len(api.requests) != 3 {
+		t.Fatalf("the failed documents should be sent again until they're indexed: %d requests", len(api.requests))
+	}
+
+	for _, r := range api.requests[1:] {
+		if len(r.docs) != 1 || r.docs[0].Message != "busy" {
+			t.Errorf("only the documents that can be indexed later should be sent again: %+v", r.docs)
+		}
+	}
+}
+
+func TestWriterGivesUp(t *testing.T) {
+	d, api := newTestDestination(t, config{retry: retry.Policy{MaxRetries: 2}})
+	defer api.Close()
+
+	api.status = func(int, document) int { return 503 }
+
+	w, _ := d.Open("A", "B")
+	err := w.WriteMessageBatch(lib.MessageBatch{makeMessage("A", "unavailable")})
+
+	if err == nil || len(api.requests) != 3 {
+		t.Errorf("the retries should stop after the maximum: %d requests, %v", len(api.requests), err)
+	}
+}
+
+func TestWriterCreateConflicts(t *testing.T) {
+	d, api := newTestDestination(t, config{action: "create"})
+	defer api.Close()
+
+	api.status = func(int, document) int { return 409 }
+
+	w, _ := d.Open("A", "B")
+
+	if err := w.WriteMessageBatch(lib.MessageBatch{makeMessage("A", "duplicate")}); err != nil {
+		t.Error("the documents created by a previous attempt should not be reported:", err)
+	}
+
+	if _, ok := api.requests[0].actions[0]["create"]; !ok {
+		t.Errorf("invalid action: %v", api.requests[0].actions[0])
+	}
+}
+
+func TestWriterBulkSize(t *testing.T) {
+	d, api := newTestDestination(t, config{maxBulkBytes: 1000})
+	defer api.Close()
+
+	var batch lib.MessageBatch
+
+	for i := 0; i != 10; i++ {
+		batch = append(batch, makeMessage("A", fmt.Sprintf("%d %s", i, strings.Repeat("x", 300))))
+	}
+
+	w, _ := d.Open("A", "B")
+	size, err := w.(writer).WriteMessageBatchSize(batch)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+
+	for _, r := range api.requests {
+		count += len(r.docs)
+	}
+
+	if len(api.requests) < 4 || count != len(batch) || size < 3000 {
+		t.Errorf("the bulk requests should stay under the maximum size: %d documents in %d requests, %d bytes", count, len(api.requests), size)
+	}
+}
+
+func TestWriterSigV4(t *testing.T) {
+	d, api := newTestDestination(t, config{auth: authSigV4, region: "us-east-1", service: "es", compression: compression(t, "gzip")})
+	defer api.Close()
+
+	d.signer = v4.NewSigner(credentials.NewStaticCredentials("AKID", "SECRET", ""))
+	w, _ := d.Open("A", "B")
+
+	if err := w.WriteMessageBatch(lib.MessageBatch{makeMessage("A", "signed")}); err != nil {
+		t.Fatal(err)
+	}
+
+	h := api.requests[0].header
+
+	if auth := h.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/20161012/us-east-1/es/aws4_request") {
+		t.Errorf("invalid signature: %s", auth)
+	}
+
+	if len(h.Get("X-Amz-Content-Sha256")) != 64 {
+		t.Errorf("the hash of the payload should be sent: %q", h.Get("X-Amz-Content-Sha256"))
+	}
+}
+
+func TestIndexTemplate(t *testing.T) {
+	msg := makeMessage("/ecs/Billing API", "x")
+	msg.Stream = "web#1"
+
+	tests := []struct {
+		template string
+		index    string
+	}{
+		{defaultIndex, "ecs-logs-ecs-billing-api-2016.10.12"},
+		{"logs-{yyyy}.{MM}", "logs-2016.10"},
+		{"{group}-{stream}-{yy-MM-dd-HH}", "ecs-billing-api-web-1-16-10-12-00"},
+		{"_{stream}", "web-1"},
+	}
+
+	for _, test := range tests {
+		tmpl, err := parseIndexTemplate(test.template)
+
+		if err != nil {
+			t.Errorf("%s: %s", test.template, err)
+			continue
+		}
+
+		if index := tmpl.Render(msg); index != test.index {
+			t.Errorf("%s: invalid index: %s", test.template, index)
+		}
+	}
+
+	for _, s := range []string{"", "logs-{group", "logs-{}", "logs-{host}", "logs-{yyyy.ww}"} {
+		if _, err := parseIndexTemplate(s); err == nil {
+			t.Errorf("%q: the template should be invalid", s)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(map[string]string{
+		"ELASTICSEARCH_URL":  "https://search-logs-abc.eu-west-1.es.amazonaws.com/",
+		"ELASTICSEARCH_AUTH": "sigv4",
+	})
+
+	if c := getConfig(); c.err != nil || c.region != "eu-west-1" || c.service != "es" || c.url != "https://search-logs-abc.eu-west-1.es.amazonaws.com" {
+		t.Errorf("invalid configuration: region=%s service=%s url=%s (%v)", c.region, c.service, c.url, c.err)
+	}
+
+	lib.SetConfigEnv(map[string]string{
+		"ELASTICSEARCH_URL":     "https://abc.us-east-1.aoss.amazonaws.com",
+		"ELASTICSEARCH_AUTH":    "sigv4",
+		"ELASTICSEARCH_API_KEY": "ignored",
+	})
+
+	if c := getConfig(); c.err != nil || c.region != "us-east-1" || c.service != "aoss" {
+		t.Errorf("the serverless collections should be signed for aoss: %s %s (%v)", c.region, c.service, c.err)
+	}
+
+	lib.SetConfigEnv(map[string]string{"ELASTICSEARCH_URL": "http://localhost:9200", "ELASTICSEARCH_API_KEY": "a2V5"})
+
+	if c := getConfig(); c.err != nil || c.auth != authAPIKey || c.compression.Encoding() != "gzip" {
+		t.Errorf("the authentication should be guessed from the credentials: %q (%v)", c.auth, c.err)
+	}
+
+	lib.SetConfigEnv(map[string]string{"ELASTICSEARCH_URL": "http://localhost:9200", "ELASTICSEARCH_AUTH": "none", "ELASTICSEARCH_GZIP": "false"})
+
+	if c := getConfig(); c.err != nil || c.compression.Enabled() {
+		t.Errorf("ELASTICSEARCH_GZIP=false should disable the compression: %q (%v)", c.compression.Encoding(), c.err)
+	}
+
+	for _, env := range []map[string]string{
+		{},
+		{"ELASTICSEARCH_URL": "localhost:9200"},
+		{"ELASTICSEARCH_URL": "http://localhost:9200", "ELASTICSEARCH_INDEX": "logs-{host}"},
+		{"ELASTICSEARCH_URL": "http://localhost:9200", "ELASTICSEARCH_ACTION": "update"},
+		{"ELASTICSEARCH_URL": "http://localhost:9200", "ELASTICSEARCH_AUTH": "basic"},
+		{"ELASTICSEARCH_URL": "http://localhost:9200", "ELASTICSEARCH_AUTH": "kerberos"},
+		{"ELASTICSEARCH_URL": "http://localhost:9200", "ELASTICSEARCH_GZIP": "maybe"},
+		{"ELASTICSEARCH_URL": "http://localhost:9200", "ELASTICSEARCH_COMPRESSION": "snappy"},
+		{"ELASTICSEARCH_URL": "http://localhost:9200", "ELASTICSEARCH_COMPRESSION_LEVEL": "12"},
+		{"ELASTICSEARCH_URL": "http://localhost:9200", "ELASTICSEARCH_MAX_BULK_BYTES": "0"},
+	} {
+		lib.SetConfigEnv(env)
+
+		if err := getConfig().check(); err == nil {
+			t.Errorf("%v: the configuration should be invalid", env)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+// The date patterns of the index templates, in the notation of the date math
+// of Elasticsearch, and their Go layouts.
+var dateLayouts = []struct {
+	pattern string
+	layout  string
+}{
+	{"yyyy", "2006"},
+	{"yy", "06"},
+	{"MM", "01"},
+	{"dd", "02"},
+	{"HH", "15"},
+}
+
+// indexTemplate renders the index names of the messages, it's a list of parts
+// that are either literal text or the values of a variable.
+type indexTemplate []indexPart
+
+type indexPart struct {
+	text string
+
+	// The variable of a part, either group, stream or a date layout.
+	variable string
+	layout   string
+}
+
+// parseIndexTemplate parses s, where {group} and {stream} are replaced with the
+// names of the stream of a message and the other variables are dates, like
+// {yyyy.MM.dd}, formatted with the time of the message in UTC.
+func parseIndexTemplate(s string) (t indexTemplate, err error) {
+	for len(s) != 0 {
+		i := strings.IndexByte(s, '{')
+
+		if i < 0 {
+			t = append(t, indexPart{text: s})
+			break
+		}
+
+		if i != 0 {
+			t = append(t, indexPart{text: s[:i]})
+		}
+
+		j := strings.IndexByte(s[i:], '}')
+
+		if j < 0 {
+			err = fmt.Errorf("unclosed variable")
+			return
+		}
+
+		v := s[i+1 : i+j]
+		s = s[i+j+1:]
+
+		switch v {
+		case "group", "stream":
+			t = append(t, indexPart{variable: v})
+		default:
+			var layout string
+
+			if layout, err = dateLayout(v); err != nil {
+				return
+			}
+
+			t = append(t, indexPart{variable: "date", layout: layout})
+		}
+	}
+
+	if len(t) == 0 {
+		err = fmt.Errorf("the index name can't be empty")
+	}
+
+	return
+}
+
+// dateLayout converts the date pattern p to a Go layout, the characters that
+// aren't part of a pattern are kept as they are.
+func dateLayout(p string) (layout string, err error) {
+	if len(p) == 0 {
+		err = fmt.Errorf("empty variable")
+		return
+	}
+
+next:
+	for len(p) != 0 {
+		for _, d := range dateLayouts {
+			if strings.HasPrefix(p, d.pattern) {
+				layout += d.layout
+				p = p[len(d.pattern):]
+				continue next
+			}
+		}
+
+		if c := p[0]; (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			err = fmt.Errorf("unknown variable, must be group, stream or a date like yyyy.MM.dd: %s", p)
+			return
+		}
+
+		layout += p[:1]
+		p = p[1:]
+	}
+
+	return
+}
+
+// Render returns the name of the index of msg. The names of the groups and
+// streams are turned into valid index names, which are lowercase and can't
+// have some characters like slashes.
+func (t indexTemplate) Render(msg lib.Message) string {
+	var b bytes.Buffer
+	var now = msg.Event.Time
+
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	for _, p := range t {
+		switch p.variable {
+		case "group":
+			b.WriteString(sanitize(msg.Group))
+		case "stream":
+			b.WriteString(sanitize(msg.Stream))
+		case "date":
+			b.WriteString(now.UTC().Format(p.layout))
+		default:
+			b.WriteString(p.text)
+		}
+	}
+
+	return strings.TrimLeft(strings.ToLower(b.String()), "-_+.")
+}
+
+// sanitize replaces the characters that index names can't have with dashes,
+// the leading slashes of the names of log groups are removed.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`\/*?"<>| ,#:`, r) {
+			return '-'
+		}
+		return r
+	}, strings.TrimLeft(s, "/"))
+}
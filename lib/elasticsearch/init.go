@@ -0,0 +1,7 @@
+package elasticsearch
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterDestination("elasticsearch", newDestination(getConfig))
+}
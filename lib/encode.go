@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+// maxPooledBufferSize is the capacity past which the encoding buffers aren't
+// put back in the pool, a single huge message shouldn't pin its memory for the
+// lifetime of the program.
+const maxPooledBufferSize = 1 << 20
+
+// jsonBuffer is a buffer and the JSON encoder writing to it, both reused from
+// one encoding to the next.
+type jsonBuffer struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+var jsonBuffers = sync.Pool{
+	New: func() interface{} {
+		b := &jsonBuffer{}
+		b.enc = json.NewEncoder(&b.buf)
+		return b
+	},
+}
+
+func getJSONBuffer() *jsonBuffer {
+	b := jsonBuffers.Get().(*jsonBuffer)
+	b.buf.Reset()
+	return b
+}
+
+func putJSONBuffer(b *jsonBuffer) {
+	if b.buf.Cap() <= maxPooledBufferSize {
+		jsonBuffers.Put(b)
+	}
+}
+
+// encode writes the JSON representation of v to the buffer and returns it,
+// the bytes are only valid until the buffer is put back in the pool.
+//
+// The output is the same as json.Marshal, json.Encoder escapes HTML the same
+// way, except for the trailing newline which is removed.
+func (b *jsonBuffer) encode(v interface{}) []byte {
+	if err := b.enc.Encode(v); err != nil {
+		return nil
+	}
+	return bytes.TrimSuffix(b.buf.Bytes(), []byte{'\n'})
+}
+
+// AppendMessageJSON appends the JSON representation of msg to b and returns
+// the extended slice, it's the allocation-free version of msg.Bytes when b has
+// enough capacity.
+func AppendMessageJSON(b []byte, msg Message) []byte {
+	j := getJSONBuffer()
+	b = append(b, j.encode(msg)...)
+	putJSONBuffer(j)
+	return b
+}
+
+// AppendEventJSON appends the JSON representation of e to b and returns the
+// extended slice.
+func AppendEventJSON(b []byte, e ecslogs.Event) []byte {
+	j := getJSONBuffer()
+	b = append(b, j.encode(e)...)
+	putJSONBuffer(j)
+	return b
+}
+
+// EventString returns the JSON representation of e as a string, like
+// e.String but with a single allocation for the returned string.
+func EventString(e ecslogs.Event) string {
+	j := getJSONBuffer()
+	s := string(j.encode(e))
+	putJSONBuffer(j)
+	return s
+}
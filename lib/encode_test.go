@@ -0,0 +1,149 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+func makeEncodeTestMessage(i int) Message {
+	return Message{
+		Group:  "abc",
+		Stream: "0123456789",
+		Event: ecslogs.Event{
+			Level:   ecslogs.INFO,
+			Time:    time.Date(2016, 6, 13, 12, 23, 42, 123456789, time.UTC),
+			Info:    ecslogs.EventInfo{Host: "localhost"},
+			Data:    ecslogs.EventData{"request_id": strconv.Itoa(i), "path": "/a?b=<c>&d"},
+			Message: "Hello World! " + strconv.Itoa(i),
+		},
+	}
+}
+
+func makeEncodeTestBatch(n int) (batch MessageBatch) {
+	for i := 0; i != n; i++ {
+		batch = append(batch, makeEncodeTestMessage(i))
+	}
+	return
+}
+
+func TestAppendMessageJSON(t *testing.T) {
+	msg := makeEncodeTestMessage(1)
+	ref, _ := json.Marshal(msg)
+
+	if b := AppendMessageJSON(nil, msg); !bytes.Equal(b, ref) {
+		t.Errorf("invalid JSON representation of the message:\n - expected: %s\n - found:    %s", ref, b)
+	}
+
+	if b := AppendMessageJSON([]byte("prefix "), msg); string(b) != "prefix "+string(ref) {
+		t.Errorf("the JSON representation wasn't appended to the slice: %s", b)
+	}
+}
+
+func TestEventString(t *testing.T) {
+	msg := makeEncodeTestMessage(1)
+	ref, _ := json.Marshal(msg.Event)
+
+	if s := EventString(msg.Event); s != string(ref) {
+		t.Errorf("invalid JSON representation of the event:\n - expected: %s\n - found:    %s", ref, s)
+	}
+
+	if b := AppendEventJSON(nil, msg.Event); !bytes.Equal(b, ref) {
+		t.Errorf("invalid JSON representation of the event:\n - expected: %s\n - found:    %s", ref, b)
+	}
+}
+
+func TestMessageEncoderBatchSize(t *testing.T) {
+	batch := makeEncodeTestBatch(3)
+	buf := &bytes.Buffer{}
+
+	size, err := WriteMessageBatchSize(NewMessageEncoder(buf), batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref := &bytes.Buffer{}
+	for _, msg := range batch {
+		json.NewEncoder(ref).Encode(msg)
+	}
+
+	if buf.String() != ref.String() {
+		t.Errorf("invalid encoding of the batch:\n - expected: %s\n - found:    %s", ref, buf)
+	}
+
+	if size != ref.Len() {
+		t.Errorf("invalid size of the batch: %d != %d", size, ref.Len())
+	}
+}
+
+func BenchmarkMessageBytes(b *testing.B) {
+	msg := makeEncodeTestMessage(1)
+	b.ReportAllocs()
+
+	for i := 0; i != b.N; i++ {
+		msg.Bytes()
+	}
+}
+
+func BenchmarkAppendMessageJSON(b *testing.B) {
+	msg := makeEncodeTestMessage(1)
+	buf := make([]byte, 0, 1024)
+	b.ReportAllocs()
+
+	for i := 0; i != b.N; i++ {
+		buf = AppendMessageJSON(buf[:0], msg)
+	}
+}
+
+func BenchmarkEventString(b *testing.B) {
+	msg := makeEncodeTestMessage(1)
+
+	b.Run("event", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i != b.N; i++ {
+			_ = msg.Event.String()
+		}
+	})
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i != b.N; i++ {
+			_ = EventString(msg.Event)
+		}
+	})
+}
+
+func BenchmarkMessageEncoderBatch(b *testing.B) {
+	for _, n := range []int{1, 100, 1000} {
+		batch := makeEncodeTestBatch(n)
+
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			w := NewMessageEncoder(ioutil.Discard)
+			b.ReportAllocs()
+
+			for i := 0; i != b.N; i++ {
+				if err := w.WriteMessageBatch(batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEncodeParallel(b *testing.B) {
+	msg := makeEncodeTestMessage(1)
+	b.ReportAllocs()
+
+	b.RunParallel(func(pb *testing.PB) {
+		buf := make([]byte, 0, 1024)
+
+		for pb.Next() {
+			buf = AppendMessageJSON(buf[:0], msg)
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Envelope wraps the serialized messages of a destination in an outer JSON
+// object carrying static fields and a version, for collectors that route
+// entries by those fields. The payload stays whatever the destination would
+// have sent without the envelope, so its schema can evolve independently of
+// the envelope.
+//
+// The zero value is disabled and leaves payloads unchanged.
+type Envelope struct {
+	// The beginning of the envelope, up to the key of the payload.
+	head string
+
+	// The version of the envelope reported to receivers, see Schema.
+	version int
+}
+
+// DestinationEnvelope returns the envelope configured for destination by the
+// <DESTINATION>_ENVELOPE, <DESTINATION>_ENVELOPE_FIELDS,
+// <DESTINATION>_ENVELOPE_VERSION and <DESTINATION>_ENVELOPE_PAYLOAD
+// environment variables.
+func DestinationEnvelope(destination string) (e Envelope, err error) {
+	prefix := strings.ToUpper(destination) + "_ENVELOPE"
+	enabled := false
+
+	if s := strings.TrimSpace(Getenv(prefix)); len(s) != 0 {
+		if enabled, err = strconv.ParseBool(s); err != nil {
+			err = fmt.Errorf("invalid %s, must be a boolean: %s", prefix, s)
+			return
+		}
+	}
+
+	version := 1
+	payload := "payload"
+	fields := map[string]interface{}{"source": "ecs-logs"}
+
+	if s := strings.TrimSpace(Getenv(prefix + "_VERSION")); len(s) != 0 {
+		if version, err = strconv.Atoi(s); err != nil || version < 0 {
+			err = fmt.Errorf("invalid %s_VERSION, must be a positive integer: %s", prefix, s)
+			return
+		}
+	}
+
+	if s := strings.TrimSpace(Getenv(prefix + "_PAYLOAD")); len(s) != 0 {
+		payload = s
+	}
+
+	if s := strings.TrimSpace(Getenv(prefix + "_FIELDS")); len(s) != 0 {
+		fields = make(map[string]interface{})
+
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); len(item) == 0 {
+				continue
+			}
+
+			i := strings.IndexByte(item, '=')
+
+			if i <= 0 {
+				err = fmt.Errorf("invalid %s_FIELDS, expected key=value: %s", prefix, item)
+				return
+			}
+
+			// Values are decoded when they're valid JSON so numbers and
+			// booleans keep their type, anything else is a string.
+			key, raw := strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+			var value interface{}
+
+			if json.Unmarshal([]byte(raw), &value) != nil {
+				value = raw
+			}
+
+			fields[key] = value
+		}
+	}
+
+	for key := range fields {
+		if key == "version" || key == payload {
+			err = fmt.Errorf("invalid %s_FIELDS, the %s key is reserved: %s", prefix, key, key)
+			return
+		}
+	}
+
+	if enabled {
+		e.head = envelopeHead(fields, version, payload)
+		e.version = version
+	}
+
+	return
+}
+
+// envelopeHead renders the static part of the envelope, the fields are sorted
+// so the output is stable and the version and payload come last.
+func envelopeHead(fields map[string]interface{}, version int, payload string) string {
+	keys := make([]string, 0, len(fields))
+
+	for key := range fields {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	b := []byte{'{'}
+
+	for _, key := range keys {
+		k, _ := json.Marshal(key)
+		v, _ := json.Marshal(fields[key])
+		b = append(b, k...)
+		b = append(b, ':')
+		b = append(b, v...)
+		b = append(b, ',')
+	}
+
+	p, _ := json.Marshal(payload)
+	b = append(b, `"version":`...)
+	b = strconv.AppendInt(b, int64(version), 10)
+	b = append(b, ',')
+	b = append(b, p...)
+	b = append(b, ':')
+	return string(b)
+}
+
+// Enabled returns true if payloads are wrapped.
+func (e Envelope) Enabled() bool {
+	return len(e.head) != 0
+}
+
+// Schema returns the version of the envelope as it's reported in the schema
+// version header of the HTTP destinations, or an empty string when disabled.
+func (e Envelope) Schema() string {
+	if !e.Enabled() {
+		return ""
+	}
+	return "envelope.v" + strconv.Itoa(e.version)
+}
+
+// Wrap returns payload wrapped in the envelope. Payloads that aren't JSON, like
+// the plain text of some destinations, are embedded as a JSON string.
+func (e Envelope) Wrap(payload string) string {
+	if !e.Enabled() {
+		return payload
+	}
+
+	if !json.Valid([]byte(payload)) {
+		b, _ := json.Marshal(payload)
+		payload = string(b)
+	}
+
+	return e.head + payload + "}"
+}
@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEnvelope(t *testing.T) {
+	SetConfigEnv(map[string]string{
+		"TESTDEST_ENVELOPE":         "true",
+		"TESTDEST_ENVELOPE_FIELDS":  "source=ecs-logs, region=us-west-2, replicas=3",
+		"TESTDEST_ENVELOPE_VERSION": "2",
+	})
+	defer SetConfigEnv(nil)
+
+	e, err := DestinationEnvelope("testdest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := `{"level":"INFO","message":"Hello World!","data":{"user":"bob"}}`
+	s := e.Wrap(payload)
+
+	if s != `{"region":"us-west-2","replicas":3,"source":"ecs-logs","version":2,"payload":`+payload+`}` {
+		t.Errorf("invalid envelope: %s", s)
+	}
+
+	var envelope struct {
+		Version int
+		Payload map[string]interface{}
+	}
+
+	if err := json.Unmarshal([]byte(s), &envelope); err != nil {
+		t.Fatal(err)
+	}
+
+	var inner map[string]interface{}
+	json.Unmarshal([]byte(payload), &inner)
+
+	if envelope.Version != 2 || !reflect.DeepEqual(envelope.Payload, inner) {
+		t.Errorf("the payload should be carried unchanged: %+v", envelope)
+	}
+
+	if s := e.Wrap("plain text"); s != `{"region":"us-west-2","replicas":3,"source":"ecs-logs","version":2,"payload":"plain text"}` {
+		t.Errorf("payloads that aren't JSON should be embedded as strings: %s", s)
+	}
+}
+
+func TestEnvelopeDefaults(t *testing.T) {
+	SetConfigEnv(map[string]string{"TESTDEST_ENVELOPE": "true"})
+	defer SetConfigEnv(nil)
+
+	e, err := DestinationEnvelope("testdest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s := e.Wrap(`{}`); s != `{"source":"ecs-logs","version":1,"payload":{}}` {
+		t.Errorf("invalid default envelope: %s", s)
+	}
+
+	SetConfigEnv(nil)
+
+	if e, _ := DestinationEnvelope("testdest"); e.Enabled() || e.Wrap(`{}`) != `{}` {
+		t.Error("the envelope should be disabled by default")
+	}
+}
+
+func TestEnvelopeInvalid(t *testing.T) {
+	defer SetConfigEnv(nil)
+
+	for _, test := range []struct {
+		env map[string]string
+		err string
+	}{
+		{map[string]string{"TESTDEST_ENVELOPE": "maybe"}, "TESTDEST_ENVELOPE, must be a boolean"},
+		{map[string]string{"TESTDEST_ENVELOPE_VERSION": "v1"}, "TESTDEST_ENVELOPE_VERSION"},
+		{map[string]string{"TESTDEST_ENVELOPE_FIELDS": "source"}, "expected key=value"},
+		{map[string]string{"TESTDEST_ENVELOPE_FIELDS": "version=3"}, "the version key is reserved"},
+		{map[string]string{"TESTDEST_ENVELOPE_FIELDS": "body=x", "TESTDEST_ENVELOPE_PAYLOAD": "body"}, "the body key is reserved"},
+	} {
+		SetConfigEnv(test.env)
+
+		if _, err := DestinationEnvelope("testdest"); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: the error should mention %q: %v", test.env, test.err, err)
+		}
+	}
+}
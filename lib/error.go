@@ -25,3 +25,15 @@ func (err ErrorList) Error() string {
 
 	return strings.Join(s, "\n")
 }
+
+// RequestID returns the ID of the request that failed with err, or an empty
+// string if err doesn't carry one. The errors of the AWS SDK carry it when the
+// service rejected the request, see awserr.RequestFailure.
+func RequestID(err error) string {
+	if e, ok := err.(interface {
+		RequestID() string
+	}); ok {
+		return e.RequestID()
+	}
+	return ""
+}
@@ -0,0 +1,179 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// The maximum number of fast path writes in flight, the messages read while
+// they all are wait for one of them to complete.
+const fastLaneConcurrency = 16
+
+// FastPath selects the messages that must be delivered with the lowest latency,
+// like the errors that page someone. A message takes the fast path when any of
+// the predicates match, the zero value matches none.
+type FastPath struct {
+	// The messages at this level or more severe match, NONE disables it.
+	Level ecslogs.Level
+
+	// The messages with these data fields match.
+	Fields []FastPathField
+}
+
+// FastPathField matches the messages with a data field at Path, a dotted path
+// like error.code, whose value is Value, or any value when it's empty.
+type FastPathField struct {
+	Path  string
+	Value string
+}
+
+// ParseFastPath parses a comma separated list of predicates, either
+// level=LEVEL, data.path or data.path=value.
+func ParseFastPath(s string) (p FastPath, err error) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+
+		key, value, hasValue := item, "", false
+
+		if i := strings.IndexByte(item, '='); i >= 0 {
+			key, value, hasValue = strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:]), true
+		}
+
+		switch {
+		case key == "level":
+			if p.Level, err = ecslogs.ParseLevel(strings.ToUpper(value)); err != nil || p.Level == ecslogs.NONE {
+				err = fmt.Errorf("invalid fast path, unknown level: %s", item)
+				return
+			}
+
+		case strings.HasPrefix(key, "data.") && len(key) > 5:
+			if hasValue && len(value) == 0 {
+				err = fmt.Errorf("invalid fast path, the value of a field can't be empty: %s", item)
+				return
+			}
+			p.Fields = append(p.Fields, FastPathField{Path: key[5:], Value: value})
+
+		default:
+			err = fmt.Errorf("invalid fast path, must be level=LEVEL, data.field or data.field=value: %s", item)
+			return
+		}
+	}
+
+	return
+}
+
+// Enabled returns true if p matches some messages.
+func (p FastPath) Enabled() bool {
+	return p.Level != ecslogs.NONE || len(p.Fields) != 0
+}
+
+// Match returns true if msg takes the fast path.
+func (p FastPath) Match(msg Message) bool {
+	if p.Level != ecslogs.NONE && msg.Event.Level != ecslogs.NONE && msg.Event.Level <= p.Level {
+		return true
+	}
+
+	for _, f := range p.Fields {
+		if v := lookupData(msg.Event.Data, f.Path); v != nil && (len(f.Value) == 0 || fmt.Sprint(v) == f.Value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func lookupData(data ecslogs.EventData, path string) interface{} {
+	var value interface{} = map[string]interface{}(data)
+
+	for _, key := range strings.Split(path, ".") {
+		switch m := value.(type) {
+		case ecslogs.EventData:
+			value = m[key]
+		case map[string]interface{}:
+			value = m[key]
+		default:
+			return nil
+		}
+	}
+
+	return value
+}
+
+// FastLane writes the messages of a fast path to a destination as soon as
+// they're read, each on its own instead of waiting for its batch to fill up.
+// The other messages reach the destination in the batches of their streams.
+//
+// The messages of a stream that take the fast path are usually delivered ahead
+// of the ones read before them, which are still waiting in their batch.
+type FastLane struct {
+	Path FastPath
+
+	dest     Destination
+	slots    chan struct{}
+	messages *metrics.Counter
+}
+
+// NewFastLane returns a FastLane writing the messages matching path to dest,
+// which is reported as name in the fast_path_messages metric of registry.
+func NewFastLane(name string, dest Destination, path FastPath, registry *metrics.Registry) *FastLane {
+	return &FastLane{
+		Path:     path,
+		dest:     dest,
+		slots:    make(chan struct{}, fastLaneConcurrency),
+		messages: registry.Counter("fast_path_messages", "destination", name),
+	}
+}
+
+// Write starts writing msg to the destination if it takes the fast path, done
+// is then called with the result of the write and Write returns true. It blocks
+// while too many writes are in flight.
+func (l *FastLane) Write(msg Message, done func(error)) bool {
+	if !l.Path.Match(msg) {
+		return false
+	}
+
+	l.slots <- struct{}{}
+	l.messages.Add(1)
+
+	go func() {
+		// The message is as urgent as the batches that reached the maximum
+		// latency, it goes first when the destination is rate limited.
+		err := writeBatch(l.dest, msg.Group, msg.Stream, MessageBatch{msg}, true)
+		<-l.slots
+		done(err)
+	}()
+
+	return true
+}
+
+// Batch returns the messages of batch that didn't take the fast path, they're
+// the ones the destination receives in its batches.
+func (l *FastLane) Batch(batch MessageBatch) MessageBatch {
+	var res MessageBatch
+
+	for i, msg := range batch {
+		if !l.Path.Match(msg) {
+			if res != nil {
+				res = append(res, msg)
+			}
+			continue
+		}
+
+		// The batch is only copied when some messages are removed from it.
+		if res == nil {
+			res = make(MessageBatch, i, len(batch))
+			copy(res, batch[:i])
+		}
+	}
+
+	if res == nil {
+		return batch
+	}
+
+	return res
+}
@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+func TestParseFastPath(t *testing.T) {
+	p, err := ParseFastPath("level=error, data.alert, data.error.code=503")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := FastPath{
+		Level:  ecslogs.ERROR,
+		Fields: []FastPathField{{Path: "alert"}, {Path: "error.code", Value: "503"}},
+	}
+
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("invalid fast path: %#v", p)
+	}
+
+	if p, err = ParseFastPath(""); err != nil || p.Enabled() {
+		t.Errorf("an empty fast path should match no messages: %#v (%v)", p, err)
+	}
+
+	for _, s := range []string{"level=loud", "level", "data.", "data.alert=", "message=hello"} {
+		if _, err := ParseFastPath(s); err == nil {
+			t.Errorf("%s: the fast path should be invalid", s)
+		}
+	}
+}
+
+func TestFastPathMatch(t *testing.T) {
+	p, _ := ParseFastPath("level=error, data.alert, data.error.code=503")
+
+	tests := []struct {
+		event ecslogs.Event
+		match bool
+	}{
+		{ecslogs.Event{Level: ecslogs.CRIT}, true},
+		{ecslogs.Event{Level: ecslogs.ERROR}, true},
+		{ecslogs.Event{Level: ecslogs.WARN}, false},
+		{ecslogs.Event{}, false},
+		{ecslogs.Event{Level: ecslogs.INFO, Data: ecslogs.EventData{"alert": true}}, true},
+		{ecslogs.Event{Data: ecslogs.EventData{"error": map[string]interface{}{"code": 503.0}}}, true},
+		{ecslogs.Event{Data: ecslogs.EventData{"error": map[string]interface{}{"code": 500.0}}}, false},
+		{ecslogs.Event{Data: ecslogs.EventData{"error": "503"}}, false},
+	}
+
+	for i, test := range tests {
+		if match := p.Match(Message{Event: test.event}); match != test.match {
+			t.Errorf("#%d: match=%t but got %t", i, test.match, match)
+		}
+	}
+}
+
+func TestFastLaneWrite(t *testing.T) {
+	dest := &atomicTestDestination{}
+	registry := metrics.NewRegistry()
+	path, _ := ParseFastPath("level=error")
+	lane := NewFastLane("index", dest, path, registry)
+
+	errc := make(chan error, 1)
+	msg := Message{Group: "A", Stream: "B", Event: ecslogs.Event{Level: ecslogs.ERROR, Message: "failed"}}
+
+	if !lane.Write(msg, func(err error) { errc <- err }) {
+		t.Fatal("the error should take the fast path")
+	}
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the message wasn't written right away")
+	}
+
+	if len(dest.batches) != 1 || !reflect.DeepEqual(dest.batches[0], MessageBatch{msg}) {
+		t.Errorf("the message should be written on its own: %v", dest.batches)
+	}
+
+	info := Message{Group: "A", Stream: "B", Event: ecslogs.Event{Level: ecslogs.INFO, Message: "hello"}}
+
+	if lane.Write(info, func(error) { t.Error("the message shouldn't be written") }) {
+		t.Error("the message shouldn't take the fast path")
+	}
+
+	if n := registry.Counter("fast_path_messages", "destination", "index").Value(); n != 1 {
+		t.Errorf("invalid number of fast path messages: %d", n)
+	}
+}
+
+func TestFastLaneBatch(t *testing.T) {
+	path, _ := ParseFastPath("data.alert")
+	lane := NewFastLane("index", &atomicTestDestination{}, path, metrics.NewRegistry())
+
+	makeMessage := func(s string, alert bool) Message {
+		msg := Message{Group: "A", Stream: "B", Event: ecslogs.Event{Message: s}}
+		if alert {
+			msg.Event.Data = ecslogs.EventData{"alert": "disk"}
+		}
+		return msg
+	}
+
+	batch := MessageBatch{
+		makeMessage("1", false),
+		makeMessage("2", true),
+		makeMessage("3", false),
+		makeMessage("4", true),
+		makeMessage("5", false),
+	}
+
+	res := lane.Batch(batch)
+
+	if len(res) != 3 || res[0].Event.Message != "1" || res[1].Event.Message != "3" || res[2].Event.Message != "5" {
+		t.Errorf("the other messages should stay batched in order: %v", res)
+	}
+
+	if batch[1].Event.Message != "2" {
+		t.Error("the batch shouldn't be modified")
+	}
+
+	if res = lane.Batch(MessageBatch{batch[0], batch[2]}); len(res) != 2 {
+		t.Errorf("no message should be removed: %v", res)
+	}
+
+	if res = lane.Batch(MessageBatch{batch[1], batch[3]}); len(res) != 0 {
+		t.Errorf("all the messages took the fast path: %v", res)
+	}
+}
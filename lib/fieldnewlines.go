@@ -0,0 +1,299 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+// FieldNewlinePolicy controls how a destination receives data fields whose
+// values contain newlines, independently of the newlines of the message.
+type FieldNewlinePolicy int
+
+const (
+	// KeepFieldNewlines passes the values through unchanged.
+	KeepFieldNewlines FieldNewlinePolicy = iota
+
+	// EscapeFieldNewlines replaces carriage returns and line feeds with the
+	// \r and \n escape sequences.
+	EscapeFieldNewlines
+
+	// StripFieldNewlines replaces carriage returns and line feeds with spaces,
+	// a \r\n pair becomes a single space.
+	StripFieldNewlines
+)
+
+func ParseFieldNewlinePolicy(s string) (p FieldNewlinePolicy, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "keep":
+		p = KeepFieldNewlines
+	case "escape":
+		p = EscapeFieldNewlines
+	case "strip":
+		p = StripFieldNewlines
+	default:
+		err = fmt.Errorf("invalid field newline policy, must be one of keep, escape or strip: %s", s)
+	}
+	return
+}
+
+func (p FieldNewlinePolicy) String() string {
+	switch p {
+	case EscapeFieldNewlines:
+		return "escape"
+	case StripFieldNewlines:
+		return "strip"
+	default:
+		return "keep"
+	}
+}
+
+// FieldNewlines is the handling of the newlines embedded in the data fields of
+// the messages written to a destination.
+type FieldNewlines struct {
+	Policy FieldNewlinePolicy
+
+	// The dotted paths of the data fields allowed to contain newlines, like
+	// error.stack, the fields nested under them are allowed too.
+	Allow []string
+
+	// When set the policy also applies to tabs and the other control
+	// characters, escaped as \t or \u00XX, or replaced by spaces.
+	Control bool
+}
+
+// DestinationFieldNewlines returns the field newline handling configured for
+// destination by the <DESTINATION>_FIELD_NEWLINES,
+// <DESTINATION>_FIELD_NEWLINES_ALLOW and <DESTINATION>_FIELD_NEWLINES_CONTROL
+// environment variables.
+func DestinationFieldNewlines(destination string) (f FieldNewlines, err error) {
+	prefix := strings.ToUpper(destination) + "_FIELD_NEWLINES"
+
+	if f.Policy, err = ParseFieldNewlinePolicy(Getenv(prefix)); err != nil {
+		err = fmt.Errorf("%s: %s", prefix, err)
+		return
+	}
+
+	for _, path := range strings.Split(Getenv(prefix+"_ALLOW"), ",") {
+		if path = strings.TrimPrefix(strings.TrimSpace(path), "data."); len(path) != 0 {
+			f.Allow = append(f.Allow, path)
+		}
+	}
+
+	if s := strings.TrimSpace(Getenv(prefix + "_CONTROL")); len(s) != 0 {
+		if f.Control, err = strconv.ParseBool(s); err != nil {
+			err = fmt.Errorf("invalid %s_CONTROL, must be a boolean: %s", prefix, s)
+			return
+		}
+	}
+
+	return
+}
+
+// Apply returns the batch of messages after applying the policy to their data
+// fields, the input batch and the data of its messages are never modified.
+func (f FieldNewlines) Apply(batch MessageBatch) MessageBatch {
+	if f.Policy == KeepFieldNewlines {
+		return batch
+	}
+
+	var changed MessageBatch
+
+	for i, msg := range batch {
+		v, ok := f.value("", map[string]interface{}(msg.Event.Data))
+
+		if !ok {
+			continue
+		}
+
+		if changed == nil {
+			changed = make(MessageBatch, len(batch))
+			copy(changed, batch)
+		}
+
+		changed[i].Event.Data = ecslogs.EventData(v.(map[string]interface{}))
+	}
+
+	if changed == nil {
+		return batch
+	}
+
+	return changed
+}
+
+// value returns the value at path after applying the policy, and whether it
+// was changed. Maps and slices are only copied when one of their values
+// changes.
+func (f FieldNewlines) value(path string, v interface{}) (interface{}, bool) {
+	switch x := v.(type) {
+	case string:
+		if f.allowed(path) || !f.contains(x) {
+			return v, false
+		}
+		return f.replace(x), true
+
+	case ecslogs.EventData:
+		if m, ok := f.value(path, map[string]interface{}(x)); ok {
+			return ecslogs.EventData(m.(map[string]interface{})), true
+		}
+		return v, false
+
+	case map[string]interface{}:
+		var m map[string]interface{}
+
+		for k, e := range x {
+			p := k
+
+			if len(path) != 0 {
+				p = path + "." + k
+			}
+
+			if e, ok := f.value(p, e); ok {
+				if m == nil {
+					m = make(map[string]interface{}, len(x))
+
+					for k, e := range x {
+						m[k] = e
+					}
+				}
+				m[k] = e
+			}
+		}
+
+		if m == nil {
+			return v, false
+		}
+		return m, true
+
+	case []interface{}:
+		var s []interface{}
+
+		for i, e := range x {
+			if e, ok := f.value(path, e); ok {
+				if s == nil {
+					s = make([]interface{}, len(x))
+					copy(s, x)
+				}
+				s[i] = e
+			}
+		}
+
+		if s == nil {
+			return v, false
+		}
+		return s, true
+
+	default:
+		return v, false
+	}
+}
+
+func (f FieldNewlines) allowed(path string) bool {
+	for _, a := range f.Allow {
+		if path == a || strings.HasPrefix(path, a+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (f FieldNewlines) contains(s string) bool {
+	for i := 0; i != len(s); i++ {
+		if c := s[i]; c == '\r' || c == '\n' || (f.Control && isControl(c)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f FieldNewlines) replace(s string) string {
+	b := make([]byte, 0, len(s)+8)
+
+	for i := 0; i < len(s); {
+		c := s[i]
+
+		if !(c == '\r' || c == '\n' || (f.Control && isControl(c))) {
+			b = append(b, c)
+			i++
+			continue
+		}
+
+		if f.Policy == StripFieldNewlines {
+			// A windows line ending is a single line break.
+			if c == '\r' && i+1 < len(s) && s[i+1] == '\n' {
+				i++
+			}
+			b = append(b, ' ')
+			i++
+			continue
+		}
+
+		switch c {
+		case '\r':
+			b = append(b, `\r`...)
+		case '\n':
+			b = append(b, `\n`...)
+		case '\t':
+			b = append(b, `\t`...)
+		default:
+			b = append(b, fmt.Sprintf(`\u%04x`, c)...)
+		}
+		i++
+	}
+
+	return string(b)
+}
+
+func isControl(c byte) bool {
+	return c < 0x20 || c == 0x7f
+}
+
+// NewFieldNewlineDestination wraps dest so the writers it opens apply f to the
+// data fields of the messages before writing them.
+func NewFieldNewlineDestination(dest Destination, f FieldNewlines) Destination {
+	if f.Policy == KeepFieldNewlines {
+		return dest
+	}
+	return fieldNewlineDestination{
+		Destination: dest,
+		newlines:    f,
+	}
+}
+
+type fieldNewlineDestination struct {
+	Destination
+	newlines FieldNewlines
+}
+
+func (d fieldNewlineDestination) Open(group string, stream string) (w Writer, err error) {
+	if w, err = d.Destination.Open(group, stream); err == nil {
+		w = fieldNewlineWriter{
+			Writer:   w,
+			newlines: d.newlines,
+		}
+	}
+	return
+}
+
+type fieldNewlineWriter struct {
+	Writer
+	newlines FieldNewlines
+}
+
+func (w fieldNewlineWriter) WriteMessage(msg Message) error {
+	return w.WriteMessageBatch(MessageBatch{msg})
+}
+
+func (w fieldNewlineWriter) WriteMessageBatch(batch MessageBatch) error {
+	return w.Writer.WriteMessageBatch(w.newlines.Apply(batch))
+}
+
+func (w fieldNewlineWriter) WriteMessageBatchSize(batch MessageBatch) (int, error) {
+	return WriteMessageBatchSize(w.Writer, w.newlines.Apply(batch))
+}
+
+func (w fieldNewlineWriter) WriteUrgentMessageBatch(batch MessageBatch) (int, error) {
+	return WriteUrgentMessageBatch(w.Writer, w.newlines.Apply(batch))
+}
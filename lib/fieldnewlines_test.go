@@ -0,0 +1,138 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+func makeFieldNewlinesBatch() MessageBatch {
+	return MessageBatch{
+		{Event: ecslogs.Event{Message: "first\nsecond", Data: ecslogs.EventData{
+			"query": "SELECT *\r\nFROM users",
+			"error": map[string]interface{}{
+				"message": "oops",
+				"stack":   "main.main()\n\tmain.go:42",
+			},
+			"tags":  []interface{}{"a\nb", "c"},
+			"count": 1,
+		}}},
+		{Event: ecslogs.Event{Message: "Hello World!", Data: ecslogs.EventData{"user": "luke"}}},
+	}
+}
+
+func TestFieldNewlines(t *testing.T) {
+	tests := []struct {
+		name     string
+		newlines FieldNewlines
+		data     ecslogs.EventData
+	}{
+		{
+			name:     "keep",
+			newlines: FieldNewlines{Policy: KeepFieldNewlines},
+			data:     makeFieldNewlinesBatch()[0].Event.Data,
+		},
+		{
+			name:     "escape",
+			newlines: FieldNewlines{Policy: EscapeFieldNewlines},
+			data: ecslogs.EventData{
+				"query": `SELECT *\r\nFROM users`,
+				"error": map[string]interface{}{
+					"message": "oops",
+					"stack":   `main.main()\n` + "\tmain.go:42",
+				},
+				"tags":  []interface{}{`a\nb`, "c"},
+				"count": 1,
+			},
+		},
+		{
+			name:     "strip",
+			newlines: FieldNewlines{Policy: StripFieldNewlines, Control: true},
+			data: ecslogs.EventData{
+				"query": "SELECT * FROM users",
+				"error": map[string]interface{}{
+					"message": "oops",
+					"stack":   "main.main()  main.go:42",
+				},
+				"tags":  []interface{}{"a b", "c"},
+				"count": 1,
+			},
+		},
+		{
+			name:     "escape-control-allow",
+			newlines: FieldNewlines{Policy: EscapeFieldNewlines, Control: true, Allow: []string{"error"}},
+			data: ecslogs.EventData{
+				"query": `SELECT *\r\nFROM users`,
+				"error": map[string]interface{}{
+					"message": "oops",
+					"stack":   "main.main()\n\tmain.go:42",
+				},
+				"tags":  []interface{}{`a\nb`, "c"},
+				"count": 1,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		batch := makeFieldNewlinesBatch()
+		output := test.newlines.Apply(batch)
+
+		if !reflect.DeepEqual(output[0].Event.Data, test.data) {
+			t.Errorf("%s: invalid data:\n- expected: %#v\n- found:    %#v", test.name, test.data, output[0].Event.Data)
+		}
+
+		if output[0].Event.Message != "first\nsecond" {
+			t.Errorf("%s: the message should not be modified: %q", test.name, output[0].Event.Message)
+		}
+
+		if !reflect.DeepEqual(output[1], batch[1]) {
+			t.Errorf("%s: messages without newlines should be unchanged: %#v", test.name, output[1].Event.Data)
+		}
+
+		if !reflect.DeepEqual(batch, makeFieldNewlinesBatch()) {
+			t.Errorf("%s: the original batch should not be modified", test.name)
+		}
+	}
+}
+
+func TestFieldNewlinesControl(t *testing.T) {
+	batch := MessageBatch{{Event: ecslogs.Event{Data: ecslogs.EventData{"value": "a\tb\x00c"}}}}
+
+	if v := (FieldNewlines{Policy: EscapeFieldNewlines}).Apply(batch)[0].Event.Data["value"]; v != "a\tb\x00c" {
+		t.Errorf("control characters should be kept by default: %q", v)
+	}
+
+	if v := (FieldNewlines{Policy: EscapeFieldNewlines, Control: true}).Apply(batch)[0].Event.Data["value"]; v != `a\tb\u0000c` {
+		t.Errorf("control characters should have been escaped: %q", v)
+	}
+}
+
+func TestDestinationFieldNewlines(t *testing.T) {
+	SetConfigEnv(map[string]string{
+		"TESTDEST_FIELD_NEWLINES":         "strip",
+		"TESTDEST_FIELD_NEWLINES_ALLOW":   "data.error.stack, query",
+		"TESTDEST_FIELD_NEWLINES_CONTROL": "true",
+	})
+	defer SetConfigEnv(nil)
+
+	f, err := DestinationFieldNewlines("testdest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := (FieldNewlines{Policy: StripFieldNewlines, Allow: []string{"error.stack", "query"}, Control: true}); !reflect.DeepEqual(f, expected) {
+		t.Errorf("invalid field newlines: %+v", f)
+	}
+
+	for _, env := range []map[string]string{
+		{"TESTDEST_FIELD_NEWLINES": "split"},
+		{"TESTDEST_FIELD_NEWLINES_CONTROL": "tabs"},
+	} {
+		SetConfigEnv(env)
+
+		if _, err := DestinationFieldNewlines("testdest"); err == nil {
+			t.Errorf("%v: the configuration should be invalid", env)
+		}
+	}
+}
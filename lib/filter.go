@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// NameFilter selects the messages of a source by the names of their group,
+// stream or container. The zero value lets all messages through.
+type NameFilter struct {
+	Include []NamePattern
+	Exclude []NamePattern
+}
+
+// NamePattern is a glob, with the syntax of path.Match, matched against the
+// group, stream or container name of messages.
+type NamePattern struct {
+	Field   string
+	Pattern string
+}
+
+// SourceFilter returns the filter configured for source by the
+// <SOURCE>_INCLUDE and <SOURCE>_EXCLUDE environment variables, both are comma
+// separated lists of [group=|stream=|container=]pattern items, patterns with no
+// field match the stream.
+func SourceFilter(source string) (f NameFilter, err error) {
+	prefix := strings.ToUpper(source) + "_"
+
+	if f.Include, err = parseNamePatterns(prefix+"INCLUDE", Getenv(prefix+"INCLUDE")); err != nil {
+		return
+	}
+
+	f.Exclude, err = parseNamePatterns(prefix+"EXCLUDE", Getenv(prefix+"EXCLUDE"))
+	return
+}
+
+func parseNamePatterns(env string, s string) (patterns []NamePattern, err error) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+
+		p := NamePattern{Field: "stream", Pattern: item}
+
+		if i := strings.IndexByte(item, '='); i >= 0 {
+			p.Field, p.Pattern = strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+		}
+
+		switch p.Field {
+		case "group", "stream", "container":
+		default:
+			err = fmt.Errorf("invalid %s, the field must be one of group, stream or container: %s", env, item)
+			return
+		}
+
+		if _, e := path.Match(p.Pattern, ""); e != nil || len(p.Pattern) == 0 {
+			err = fmt.Errorf("invalid %s, bad pattern: %s", env, item)
+			return
+		}
+
+		patterns = append(patterns, p)
+	}
+	return
+}
+
+// Enabled returns true if the filter has any pattern.
+func (f NameFilter) Enabled() bool {
+	return len(f.Include) != 0 || len(f.Exclude) != 0
+}
+
+// Allows returns true if the messages with the given names pass the filter.
+// Messages must match one of the include patterns, when there are any, and
+// none of the exclude patterns, so excluding wins when both match.
+func (f NameFilter) Allows(group string, stream string, container string) bool {
+	if len(f.Include) != 0 && !matchNames(f.Include, group, stream, container) {
+		return false
+	}
+	return !matchNames(f.Exclude, group, stream, container)
+}
+
+func matchNames(patterns []NamePattern, group string, stream string, container string) bool {
+	for _, p := range patterns {
+		name := stream
+
+		switch p.Field {
+		case "group":
+			name = group
+		case "container":
+			name = container
+		}
+
+		if ok, _ := path.Match(p.Pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// NewFilteredReader returns a reader which drops the messages of r that f
+// doesn't allow, counting them in the excluded_messages counter of registry.
+// Readers don't know the container of messages, it's assumed to be their
+// stream. Sources that can tell it apart, or that can filter messages before
+// parsing them, should apply the filter themselves.
+func NewFilteredReader(source string, r Reader, f NameFilter, registry *metrics.Registry) Reader {
+	if !f.Enabled() {
+		return r
+	}
+	return filteredReader{
+		Reader:   r,
+		filter:   f,
+		excluded: registry.Counter("excluded_messages", "source", source),
+	}
+}
+
+type filteredReader struct {
+	Reader
+	filter   NameFilter
+	excluded *metrics.Counter
+}
+
+func (r filteredReader) ReadMessage() (msg Message, err error) {
+	for {
+		if msg, err = r.Reader.ReadMessage(); err != nil || r.filter.Allows(msg.Group, msg.Stream, msg.Stream) {
+			return
+		}
+		r.excluded.Add(1)
+		AcknowledgeBatch(MessageBatch{msg})
+	}
+}
+
+// Commit saves the checkpoint of the filtered reader, if it has one.
+func (r filteredReader) Commit() error {
+	return commit(r.Reader)
+}
@@ -0,0 +1,130 @@
+package lib
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+func TestNameFilter(t *testing.T) {
+	defer SetConfigEnv(nil)
+
+	tests := []struct {
+		name    string
+		include string
+		exclude string
+		allowed []string
+	}{
+		{
+			name:    "include all",
+			allowed: []string{"app:web", "app:envoy", "agent:ecs-logs"},
+		},
+		{
+			name:    "include only",
+			include: "group=app",
+			allowed: []string{"app:web", "app:envoy"},
+		},
+		{
+			name:    "exclude only",
+			exclude: "envoy, container=ecs-*",
+			allowed: []string{"app:web"},
+		},
+		{
+			name:    "exclude wins over include",
+			include: "group=app,ecs-logs",
+			exclude: "stream=envoy",
+			allowed: []string{"app:web", "agent:ecs-logs"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			SetConfigEnv(map[string]string{
+				"TESTSRC_INCLUDE": test.include,
+				"TESTSRC_EXCLUDE": test.exclude,
+			})
+
+			f, err := SourceFilter("testsrc")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var allowed []string
+
+			for _, name := range []string{"app:web", "app:envoy", "agent:ecs-logs"} {
+				i := strings.IndexByte(name, ':')
+
+				if f.Allows(name[:i], name[i+1:], name[i+1:]) {
+					allowed = append(allowed, name)
+				}
+			}
+
+			if strings.Join(allowed, ",") != strings.Join(test.allowed, ",") {
+				t.Errorf("invalid messages allowed: %v != %v", allowed, test.allowed)
+			}
+		})
+	}
+}
+
+func TestSourceFilterInvalid(t *testing.T) {
+	defer SetConfigEnv(nil)
+
+	for _, test := range []struct {
+		env string
+		err string
+	}{
+		{"host=web", "the field must be one of group, stream or container"},
+		{"stream=[", "bad pattern"},
+		{"group=", "bad pattern"},
+	} {
+		SetConfigEnv(map[string]string{"TESTSRC_EXCLUDE": test.env})
+
+		if _, err := SourceFilter("testsrc"); err == nil || !strings.Contains(err.Error(), "TESTSRC_EXCLUDE") || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: the error should mention %q: %v", test.env, test.err, err)
+		}
+	}
+}
+
+type sliceReader []Message
+
+func (r *sliceReader) Close() error {
+	return nil
+}
+
+func (r *sliceReader) ReadMessage() (msg Message, err error) {
+	if len(*r) == 0 {
+		err = io.EOF
+		return
+	}
+	msg, *r = (*r)[0], (*r)[1:]
+	return
+}
+
+func TestFilteredReader(t *testing.T) {
+	reg := metrics.NewRegistry()
+	src := &sliceReader{
+		{Group: "app", Stream: "envoy"},
+		{Group: "app", Stream: "web"},
+		{Group: "app", Stream: "envoy"},
+	}
+
+	r := NewFilteredReader("testsrc", src, NameFilter{Exclude: []NamePattern{{Field: "container", Pattern: "envoy"}}}, reg)
+
+	if msg, err := r.ReadMessage(); err != nil || msg.Stream != "web" {
+		t.Errorf("the messages of the excluded container should have been skipped: %+v (%v)", msg, err)
+	}
+
+	if _, err := r.ReadMessage(); err != io.EOF {
+		t.Errorf("the reader should have returned io.EOF: %v", err)
+	}
+
+	if n := reg.Counter("excluded_messages", "source", "testsrc").Value(); n != 2 {
+		t.Errorf("invalid number of excluded messages: %d", n)
+	}
+
+	if NewFilteredReader("testsrc", src, NameFilter{}, reg) != Reader(src) {
+		t.Error("the reader shouldn't be wrapped when the filter is empty")
+	}
+}
@@ -0,0 +1,69 @@
+// Package fingerprint turns log messages into templates by replacing their
+// variable parts, like IDs and numbers, with placeholders so messages that
+// only differ by those parts can be grouped.
+package fingerprint
+
+import (
+	"regexp"
+	"strings"
+)
+
+// A Pattern matches the variable parts of log messages, replacing them with
+// a placeholder so messages that only differ by those parts share the same
+// fingerprint.
+type Pattern struct {
+	re      *regexp.Regexp
+	replace func(string) string
+}
+
+// DefaultPatterns replace UUIDs, hexadecimal strings and numbers.
+var DefaultPatterns = []Pattern{
+	{
+		re:      regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`),
+		replace: placeholder("<uuid>"),
+	},
+	{
+		re: regexp.MustCompile(`\b0[xX][0-9a-fA-F]+\b|\b[0-9a-fA-F]{8,}\b`),
+		replace: func(s string) string {
+			// Long numbers also look like hexadecimal strings.
+			if strings.Trim(s, "0123456789") == "" {
+				return "<num>"
+			}
+			return "<hex>"
+		},
+	},
+	{
+		re:      regexp.MustCompile(`[0-9]+`),
+		replace: placeholder("<num>"),
+	},
+}
+
+// ParsePatterns compiles a whitespace separated list of regular expressions,
+// each match of the expressions is replaced with <*> when fingerprinting.
+func ParsePatterns(s string) (patterns []Pattern, err error) {
+	for _, expr := range strings.Fields(s) {
+		var re *regexp.Regexp
+
+		if re, err = regexp.Compile(expr); err != nil {
+			return
+		}
+
+		patterns = append(patterns, Pattern{
+			re:      re,
+			replace: placeholder("<*>"),
+		})
+	}
+	return
+}
+
+func placeholder(s string) func(string) string {
+	return func(string) string { return s }
+}
+
+// Apply returns the template of a message, patterns are applied in order.
+func Apply(patterns []Pattern, s string) string {
+	for _, p := range patterns {
+		s = p.re.ReplaceAllStringFunc(s, p.replace)
+	}
+	return s
+}
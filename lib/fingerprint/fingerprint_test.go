@@ -0,0 +1,52 @@
+package fingerprint
+
+import "testing"
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{
+			in:  "Hello World!",
+			out: "Hello World!",
+		},
+		{
+			in:  "request 42 failed after 1500ms",
+			out: "request <num> failed after <num>ms",
+		},
+		{
+			in:  "user b2c1a0e4-3f5d-4c8e-9a7b-1d2e3f4a5b6c not found",
+			out: "user <uuid> not found",
+		},
+		{
+			in:  "bad commit 8eab2debe79d at 0x7ffd1234",
+			out: "bad commit <hex> at <hex>",
+		},
+		{
+			in:  "timestamp 1476284572 is in the future",
+			out: "timestamp <num> is in the future",
+		},
+	}
+
+	for _, test := range tests {
+		if s := Apply(DefaultPatterns, test.in); s != test.out {
+			t.Errorf("invalid fingerprint of %#v:\n- expected: %#v\n- found:    %#v", test.in, test.out, s)
+		}
+	}
+}
+
+func TestParsePatterns(t *testing.T) {
+	patterns, err := ParsePatterns(`id=\w+  user:[a-z]+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s, ref := Apply(patterns, "lookup id=a1b2 for user:bob failed"), "lookup <*> for <*> failed"; s != ref {
+		t.Errorf("invalid fingerprint:\n- expected: %#v\n- found:    %#v", ref, s)
+	}
+
+	if _, err := ParsePatterns("(unclosed"); err == nil {
+		t.Error("expected an error when parsing an invalid pattern")
+	}
+}
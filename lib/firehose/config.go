@@ -0,0 +1,111 @@
+package firehose
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+// config carries the settings of the firehose destination, they are loaded
+// from FIREHOSE_* environment variables.
+type config struct {
+	// The name of the delivery stream that the messages are sent to, {group}
+	// and {stream} are replaced with the names of the stream.
+	deliveryStream string
+
+	// The region of the delivery streams, and the endpoint of the Firehose API
+	// when it isn't the public one (like a VPC endpoint or a local emulator).
+	region   string
+	endpoint string
+
+	// How the records that Firehose failed to put are sent again.
+	retry retry.Policy
+
+	// The budget of the retries shared by all the writers.
+	retryBudget lib.RetryBudget
+
+	err error
+}
+
+func getConfig() (c config) {
+	var err error
+	c.deliveryStream = strings.TrimSpace(lib.Getenv("FIREHOSE_DELIVERY_STREAM"))
+	c.endpoint = strings.TrimSpace(lib.Getenv("FIREHOSE_ENDPOINT"))
+
+	if len(c.deliveryStream) == 0 {
+		c.err = lib.AppendError(c.err, fmt.Errorf("missing FIREHOSE_DELIVERY_STREAM environment variable"))
+	} else if err = checkDeliveryStream(c.deliveryStream); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.region = strings.TrimSpace(lib.Getenv("FIREHOSE_REGION")); len(c.region) == 0 {
+		if c.region = os.Getenv("AWS_REGION"); len(c.region) == 0 {
+			c.region = os.Getenv("AWS_DEFAULT_REGION")
+		}
+	}
+
+	if len(c.region) == 0 {
+		c.err = lib.AppendError(c.err, fmt.Errorf("the region of the delivery stream must be set with FIREHOSE_REGION or AWS_REGION"))
+	}
+
+	if c.retry, err = retry.DestinationPolicy("firehose", retry.DefaultPolicy); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.retryBudget, err = lib.DestinationRetryBudget("firehose"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	return
+}
+
+func (c config) check() error {
+	return c.err
+}
+
+var (
+	streamVariable = regexp.MustCompile(`\{[^{}]*\}`)
+	validName      = regexp.MustCompile(`^[-.\w]{1,64}$`)
+	invalidChar    = regexp.MustCompile(`[^-.\w]+`)
+)
+
+// checkDeliveryStream reports the errors of the delivery stream template s,
+// the name it resolves to must be valid with any group and stream.
+func checkDeliveryStream(s string) error {
+	for _, v := range streamVariable.FindAllString(s, -1) {
+		if v != "{group}" && v != "{stream}" {
+			return fmt.Errorf("invalid FIREHOSE_DELIVERY_STREAM, unknown variable %s, must be one of {group} or {stream}: %s", v, s)
+		}
+	}
+
+	if !validName.MatchString(streamVariable.ReplaceAllString(s, "x")) {
+		return fmt.Errorf("invalid FIREHOSE_DELIVERY_STREAM, the names of delivery streams are up to 64 letters, digits and the -._ characters: %s", s)
+	}
+
+	return nil
+}
+
+// deliveryStreamName returns the name of the delivery stream of a group and
+// stream from the template. The characters that Firehose doesn't allow, like
+// the slashes of the group names, are replaced with dashes and the name is cut
+// to the maximum length.
+func deliveryStreamName(template string, group string, stream string) string {
+	clean := func(s string) string {
+		if s = strings.Trim(invalidChar.ReplaceAllString(s, "-"), "-"); len(s) == 0 {
+			s = "-"
+		}
+		return s
+	}
+
+	name := strings.NewReplacer("{group}", clean(group), "{stream}", clean(stream)).Replace(template)
+
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	return name
+}
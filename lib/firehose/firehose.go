@@ -0,0 +1,210 @@
+// Package firehose implements the firehose destination, which streams the
+// messages into Amazon Kinesis Data Firehose delivery streams that load them
+// into S3, Redshift or OpenSearch.
+package firehose
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+const (
+	// The limits of PutRecordBatch, in number of records and in bytes of
+	// record data, and the maximum size of a record.
+	maxBatchLength = 500
+	maxBatchSize   = 4 * 1024 * 1024
+	maxRecordSize  = 1000 * 1024
+)
+
+// The error codes of the records that Firehose failed to put because of a
+// problem on its side, the others (like a KMS key it can't use) would fail
+// again.
+var retryableCodes = map[string]bool{
+	"ServiceUnavailableException": true,
+	"InternalFailure":             true,
+}
+
+// destination sends the messages to the delivery streams named after the
+// template of the configuration, the writers of all the streams share the
+// Firehose client.
+type destination struct {
+	lazy   lib.LazyConfig
+	load   func() config
+	config config
+
+	client  firehoseiface.FirehoseAPI
+	retries *lib.RetryLimiter
+	clock   clock.Clock
+}
+
+func newDestination(load func() config) *destination {
+	return &destination{
+		load:  load,
+		clock: clock.System,
+	}
+}
+
+func (d *destination) Open(group string, stream string) (w lib.Writer, err error) {
+	if err = d.lazy.Init(d.init); err != nil {
+		return
+	}
+
+	if d.client == nil {
+		var sess *session.Session
+		var cfg = &aws.Config{Region: aws.String(d.config.region)}
+
+		if len(d.config.endpoint) != 0 {
+			cfg.Endpoint = aws.String(d.config.endpoint)
+		}
+
+		if sess, err = session.NewSession(cfg); err != nil {
+			return
+		}
+
+		d.client = firehose.New(sess)
+	}
+
+	w = writer{
+		dest:           d,
+		deliveryStream: deliveryStreamName(d.config.deliveryStream, group, stream),
+	}
+	return
+}
+
+// CheckConfig reports the problems with the FIREHOSE_* settings when ecs-logs
+// starts.
+func (d *destination) CheckConfig() error {
+	return d.load().check()
+}
+
+func (d *destination) Close(group string, stream string) {}
+
+func (d *destination) init() error {
+	d.config = d.load()
+	d.retries = lib.NewRetryLimiter("firehose", d.config.retryBudget, metrics.Default)
+
+	return d.config.check()
+}
+
+// send puts a batch of at most maxBatchLength records, made of the messages of
+// batch in the same order. The records reported as failed in the response,
+// because the delivery stream was throttled or Firehose had an internal error,
+// are sent again with the retry policy of the destination. The ones that
+// failed with another error are reported right away in a lib.RejectedError.
+func (d *destination) send(deliveryStream string, batch lib.MessageBatch, records []*firehose.Record) (err error) {
+	var rejections []lib.Rejection
+
+	if e := d.config.retry.Do(d.clock, d.retries, func() error {
+		var failed []*firehose.Record
+		var failedBatch lib.MessageBatch
+		var last *firehose.PutRecordBatchResponseEntry
+
+		res, e := d.client.PutRecordBatch(&firehose.PutRecordBatchInput{
+			DeliveryStreamName: aws.String(deliveryStream),
+			Records:            records,
+		})
+
+		if e != nil {
+			// The SDK already retried the transient errors of the call.
+			return e
+		}
+
+		if aws.Int64Value(res.FailedPutCount) != 0 {
+			// The responses are in the order of the records of the request.
+			for i, r := range res.RequestResponses {
+				code := aws.StringValue(r.ErrorCode)
+
+				switch {
+				case i >= len(records) || len(code) == 0:
+				case retryableCodes[code]:
+					failed, failedBatch, last = append(failed, records[i]), append(failedBatch, batch[i]), r
+				default:
+					rejections = append(rejections, lib.Rejection{
+						Message: batch[i],
+						Reason:  fmt.Sprintf("firehose rejected the record, %s: %s", code, aws.StringValue(r.ErrorMessage)),
+					})
+				}
+			}
+		}
+
+		if len(failed) == 0 {
+			return nil
+		}
+
+		records, batch = failed, failedBatch
+		return retry.Retryable(fmt.Errorf("%d records couldn't be put to the %s delivery stream, the last error was %s: %s",
+			len(failed), deliveryStream, aws.StringValue(last.ErrorCode), aws.StringValue(last.ErrorMessage)))
+	}); e != nil {
+		err = e
+	}
+
+	if len(rejections) != 0 {
+		err = lib.AppendWriteError(err, &lib.RejectedError{Rejections: rejections})
+	}
+
+	return
+}
+
+type writer struct {
+	dest           *destination
+	deliveryStream string
+}
+
+func (w writer) Close() error {
+	return nil
+}
+
+func (w writer) WriteMessage(msg lib.Message) error {
+	return w.WriteMessageBatch(lib.MessageBatch{msg})
+}
+
+func (w writer) WriteMessageBatch(batch lib.MessageBatch) (err error) {
+	_, err = w.WriteMessageBatchSize(batch)
+	return
+}
+
+// WriteMessageBatchSize puts batch with as few PutRecordBatch calls as the
+// limits of Firehose allow, and returns the size of the records. Each record
+// is a message serialized as JSON and followed by a newline, so the objects
+// that Firehose concatenates in S3 can be read line by line.
+func (w writer) WriteMessageBatchSize(batch lib.MessageBatch) (size int, err error) {
+	var chunk lib.MessageBatch
+	var records []*firehose.Record
+	var length int
+
+	flush := func() {
+		if len(records) != 0 {
+			if e := w.dest.send(w.deliveryStream, chunk, records); e != nil {
+				err = lib.AppendWriteError(err, e)
+			}
+			chunk, records, length = nil, nil, 0
+		}
+	}
+
+	for _, msg := range batch {
+		b := msg.Bytes()
+		data := make([]byte, len(b)+1)
+		copy(data, b)
+		data[len(b)] = '\n'
+
+		if len(records) == maxBatchLength || (len(records) != 0 && length+len(data) > maxBatchSize) {
+			flush()
+		}
+
+		chunk = append(chunk, msg)
+		records = append(records, &firehose.Record{Data: data})
+		length += len(data)
+		size += len(data)
+	}
+
+	flush()
+	return
+}
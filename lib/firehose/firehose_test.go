@@ -0,0 +1,285 @@
+package firehose
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+// mockAPI records the PutRecordBatch calls, fail returns the error code of the
+// records of each call that Firehose failed to put.
+type mockAPI struct {
+	firehoseiface.FirehoseAPI
+
+	mutex sync.Mutex
+	calls []*firehose.PutRecordBatchInput
+	fail  func(call int, r *firehose.Record) string
+}
+
+func (m *mockAPI) PutRecordBatch(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.calls = append(m.calls, input)
+	res := &firehose.PutRecordBatchOutput{FailedPutCount: aws.Int64(0)}
+
+	for i, r := range input.Records {
+		var code string
+
+		if m.fail != nil {
+			code = m.fail(len(m.calls), r)
+		}
+
+		if len(code) != 0 {
+			*res.FailedPutCount++
+			res.RequestResponses = append(res.RequestResponses, &firehose.PutRecordBatchResponseEntry{
+				ErrorCode:    aws.String(code),
+				ErrorMessage: aws.String("Slow down."),
+			})
+		} else {
+			res.RequestResponses = append(res.RequestResponses, &firehose.PutRecordBatchResponseEntry{
+				RecordId: aws.String(fmt.Sprint(i)),
+			})
+		}
+	}
+
+	return res, nil
+}
+
+func newTestDestination(c config) (*destination, *mockAPI, *clock.Fake) {
+	api := &mockAPI{}
+	f := clock.NewFake(time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC))
+
+	if len(c.deliveryStream) == 0 {
+		c.deliveryStream = "logs-{group}"
+	}
+
+	d := newDestination(func() config { return c })
+	d.client = api
+	d.clock = f
+	return d, api, f
+}
+
+func TestWriterBatchLength(t *testing.T) {
+	d, api, _ := newTestDestination(config{retry: retry.Policy{MaxRetries: 5}})
+	w, _ := d.Open("/ecs/api", "B")
+
+	var batch lib.MessageBatch
+
+	for i := 0; i != 1200; i++ {
+		batch = append(batch, makeMessage("/ecs/api", fmt.Sprintf("message %d", i)))
+	}
+
+	if err := w.WriteMessageBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(api.calls) != 3 {
+		t.Fatalf("1200 messages should be sent in 3 calls: %d", len(api.calls))
+	}
+
+	for i, n := range []int{500, 500, 200} {
+		if call := api.calls[i]; len(call.Records) != n || aws.StringValue(call.DeliveryStreamName) != "logs-ecs-api" {
+			t.Errorf("invalid call #%d: %d records to %s", i, len(call.Records), aws.StringValue(call.DeliveryStreamName))
+		}
+	}
+
+	if data := string(api.calls[2].Records[199].Data); data != string(batch[1199].Bytes())+"\n" {
+		t.Errorf("the records should be the messages followed by a newline: %q", data)
+	}
+}
+
+func TestWriterBatchSize(t *testing.T) {
+	d, api, _ := newTestDestination(config{retry: retry.Policy{MaxRetries: 5}})
+	w, _ := d.Open("A", "B")
+
+	// Each message takes a bit more than a fifth of the maximum size, only
+	// four of them fit in a batch.
+	text := strings.Repeat("x", maxBatchSize/5)
+	batch := lib.MessageBatch{}
+
+	for i := 0; i != 5; i++ {
+		batch = append(batch, makeMessage("A", text))
+	}
+
+	size, err := w.(writer).WriteMessageBatchSize(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(api.calls) != 2 || len(api.calls[0].Records) != 4 || len(api.calls[1].Records) != 1 {
+		t.Errorf("the batches should stay under %d bytes: %d calls", maxBatchSize, len(api.calls))
+	}
+
+	if min := 5 * len(text); size < min {
+		t.Errorf("invalid size: %d", size)
+	}
+}
+
+func TestWriterPartialFailure(t *testing.T) {
+	d, api, f := newTestDestination(config{retry: retry.Policy{MaxRetries: 5}})
+	api.fail = func(call int, r *firehose.Record) string {
+		// Messages 1 and 3 are throttled on the first two attempts.
+		if m := string(r.Data); call <= 2 && (strings.Contains(m, `"1"`) || strings.Contains(m, `"3"`)) {
+			return "ServiceUnavailableException"
+		}
+		return ""
+	}
+
+	w, _ := d.Open("A", "B")
+	batch := lib.MessageBatch{makeMessage("A", "0"), makeMessage("A", "1"), makeMessage("A", "2"), makeMessage("A", "3")}
+
+	if err := w.WriteMessageBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(api.calls) != 3 {
+		t.Fatalf("the failed records should be retried until they're put: %d calls", len(api.calls))
+	}
+
+	for _, call := range api.calls[1:] {
+		if len(call.Records) != 2 || string(call.Records[0].Data) != string(batch[1].Bytes())+"\n" || string(call.Records[1].Data) != string(batch[3].Bytes())+"\n" {
+			t.Errorf("only the failed records should be retried: %v", call.Records)
+		}
+	}
+
+	if f.Slept() == 0 {
+		t.Error("the retries should back off")
+	}
+}
+
+func TestWriterPartialFailureGiveUp(t *testing.T) {
+	d, api, _ := newTestDestination(config{retry: retry.Policy{MaxRetries: 2}})
+	api.fail = func(call int, r *firehose.Record) string {
+		if strings.Contains(string(r.Data), `"0"`) {
+			return "InternalFailure"
+		}
+		return ""
+	}
+
+	w, _ := d.Open("A", "B")
+	err := w.WriteMessageBatch(lib.MessageBatch{makeMessage("A", "0"), makeMessage("A", "1")})
+
+	if err == nil || !strings.Contains(err.Error(), "InternalFailure") {
+		t.Errorf("the record that kept failing should be reported: %v", err)
+	}
+
+	if len(api.calls) != 3 || len(api.calls[1].Records) != 1 || len(api.calls[2].Records) != 1 {
+		t.Errorf("the failed record should be sent %d times: %d calls", 3, len(api.calls))
+	}
+}
+
+func TestWriterRejected(t *testing.T) {
+	d, api, _ := newTestDestination(config{retry: retry.Policy{MaxRetries: 2}})
+	api.fail = func(call int, r *firehose.Record) string {
+		if strings.Contains(string(r.Data), `"1"`) {
+			return "KMS.AccessDeniedException"
+		}
+		return ""
+	}
+
+	w, _ := d.Open("A", "B")
+	err := w.WriteMessageBatch(lib.MessageBatch{makeMessage("A", "0"), makeMessage("A", "1"), makeMessage("A", "2")})
+
+	if e, ok := err.(*lib.RejectedError); !ok || len(e.Rejections) != 1 || e.Rejections[0].Message.Event.Message != "1" {
+		t.Errorf("only the rejected record should be reported: %v", err)
+	}
+
+	if len(api.calls) != 1 {
+		t.Errorf("the rejected record should not be retried: %d calls", len(api.calls))
+	}
+}
+
+func TestWriterRetryBudget(t *testing.T) {
+	d, api, _ := newTestDestination(config{retry: retry.Policy{MaxRetries: 5}, retryBudget: lib.RetryBudget{Ratio: 0.5, Size: 2}})
+	api.fail = func(call int, r *firehose.Record) string {
+		return "ServiceUnavailableException"
+	}
+
+	w, _ := d.Open("A", "B")
+
+	for i := 0; i != 10; i++ {
+		if err := w.WriteMessage(makeMessage("A", "0")); err == nil {
+			t.Fatal("the message should fail when the delivery stream keeps failing")
+		}
+	}
+
+	// Without the budget each message would have been sent 6 times.
+	if len(api.calls) != 10+2 {
+		t.Errorf("the retries should be capped by the budget: %d calls", len(api.calls))
+	}
+}
+
+func TestDeliveryStreamName(t *testing.T) {
+	tests := []struct {
+		template string
+		group    string
+		stream   string
+		name     string
+	}{
+		{"logs", "/ecs/api", "B", "logs"},
+		{"logs-{group}", "/ecs/api", "B", "logs-ecs-api"},
+		{"{group}.{stream}", "api", "web/1:2", "api.web-1-2"},
+		{"logs-{group}", "///", "B", "logs--"},
+		{"logs-{group}", strings.Repeat("a", 100), "B", "logs-" + strings.Repeat("a", 59)},
+	}
+
+	for _, test := range tests {
+		if name := deliveryStreamName(test.template, test.group, test.stream); name != test.name {
+			t.Errorf("%s with %s:%s: invalid delivery stream name: %s", test.template, test.group, test.stream, name)
+		}
+	}
+
+	for s, valid := range map[string]bool{
+		"logs":                  true,
+		"logs-{group}_{stream}": true,
+		"logs/{group}":          false,
+		"logs-{service}":        false,
+		strings.Repeat("a", 65): false,
+		"{group}{stream}":       true,
+	} {
+		if err := checkDeliveryStream(s); (err == nil) != valid {
+			t.Errorf("%s: valid=%t but got %v", s, valid, err)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(map[string]string{"FIREHOSE_DELIVERY_STREAM": "logs-{group}", "FIREHOSE_REGION": "us-west-2"})
+
+	if c := getConfig(); c.err != nil || c.region != "us-west-2" || c.retry.MaxRetries != 5 {
+		t.Errorf("invalid configuration: %+v", c)
+	}
+
+	lib.SetConfigEnv(map[string]string{"FIREHOSE_DELIVERY_STREAM": "logs", "FIREHOSE_REGION": "us-west-2", "FIREHOSE_MAX_RETRIES": "-1"})
+
+	if c := getConfig(); c.err == nil {
+		t.Error("a negative number of retries should be rejected")
+	}
+
+	lib.SetConfigEnv(map[string]string{"FIREHOSE_REGION": "us-west-2"})
+
+	if c := getConfig(); c.err == nil {
+		t.Error("the delivery stream should be required")
+	}
+}
+
+func makeMessage(group string, message string) lib.Message {
+	return lib.Message{
+		Group:  group,
+		Stream: "B",
+		Event:  ecslogs.Event{Message: message, Time: time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC)},
+	}
+}
@@ -0,0 +1,8 @@
+package firehose
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterDestination("firehose", newDestination(getConfig))
+	lib.RegisterRecordLimit("firehose", maxRecordSize-1)
+}
@@ -0,0 +1,78 @@
+// Package flatten turns nested JSON objects into flat ones where the fields of
+// nested objects are moved to the top level with dotted keys, so
+// {"error":{"code":42}} becomes {"error.code":42}.
+package flatten
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+// Object copies the fields of src to dst, the keys of nested objects are
+// joined to the keys of their parent with dots and prefixed with prefix. Arrays
+// are copied unchanged.
+func Object(dst map[string]interface{}, prefix string, src map[string]interface{}) {
+	for key, value := range src {
+		if len(prefix) != 0 {
+			key = prefix + "." + key
+		}
+
+		if obj, ok := value.(map[string]interface{}); ok && len(obj) != 0 {
+			Object(dst, key, obj)
+		} else {
+			dst[key] = value
+		}
+	}
+}
+
+// Event returns the flattened JSON representation of e. The level, time and
+// message stay at the top level, the info fields are prefixed with "info."
+// and the data fields are moved to the top level as well, unless they would
+// overwrite one of the other fields in which case they're prefixed with
+// "data.".
+//
+// Data fields starting with @, which CloudWatch Logs Insights reserves for its
+// own fields, and the _aws embedded metric format directives, which must stay
+// nested for CloudWatch to extract the metrics, are copied unchanged.
+func Event(e ecslogs.Event) map[string]interface{} {
+	var event map[string]interface{}
+
+	b, _ := json.Marshal(e)
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	d.Decode(&event)
+
+	flat := make(map[string]interface{}, len(event)+len(e.Data))
+	data, _ := event["data"].(map[string]interface{})
+	info, _ := event["info"].(map[string]interface{})
+
+	for key, value := range event {
+		if key != "data" && key != "info" {
+			flat[key] = value
+		}
+	}
+
+	Object(flat, "info", info)
+
+	fields := make(map[string]interface{}, len(data))
+
+	for key, value := range data {
+		if strings.HasPrefix(key, "@") || key == "_aws" {
+			fields[key] = value
+		} else {
+			Object(fields, "", map[string]interface{}{key: value})
+		}
+	}
+
+	for key, value := range fields {
+		if _, exists := flat[key]; exists {
+			key = "data." + key
+		}
+		flat[key] = value
+	}
+
+	return flat
+}
@@ -0,0 +1,32 @@
+package flatten
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestObject(t *testing.T) {
+	flat := map[string]interface{}{}
+
+	Object(flat, "", map[string]interface{}{
+		"a": 1,
+		"b": map[string]interface{}{
+			"c": "2",
+			"d": map[string]interface{}{"e": true},
+			"f": map[string]interface{}{},
+		},
+		"g": []interface{}{map[string]interface{}{"h": 3}},
+	})
+
+	ref := map[string]interface{}{
+		"a":     1,
+		"b.c":   "2",
+		"b.d.e": true,
+		"b.f":   map[string]interface{}{},
+		"g":     []interface{}{map[string]interface{}{"h": 3}},
+	}
+
+	if !reflect.DeepEqual(flat, ref) {
+		t.Errorf("invalid flattened object:\n- expected: %#v\n- found:    %#v", ref, flat)
+	}
+}
@@ -0,0 +1,104 @@
+package fluentd
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+// config carries the settings of the fluentd source, they are loaded from
+// FLUENTD_* environment variables.
+type config struct {
+	// The network and address the source listens on, a TCP address or the
+	// path of a unix socket.
+	network string
+	addr    string
+
+	// The key shared with the clients, when it's set they must authenticate
+	// with the handshake of the forward protocol before sending events.
+	sharedKey string
+	hostname  string
+
+	// Extracts the group and stream of the messages from their tag, when nil
+	// the tag is the group.
+	tagPattern *regexp.Regexp
+
+	// The field of the records that the stream is read from when the tag
+	// doesn't have one.
+	streamField string
+
+	// The maximum size in bytes of a string or binary value of an entry, and
+	// of the decompressed events of a compressed entry.
+	maxEntrySize int
+
+	// The parser of the log lines, when nil they're decoded as JSON when
+	// possible.
+	parser lib.Parser
+}
+
+func getConfig() (c config, err error) {
+	var s string
+
+	c = config{
+		network:      "tcp",
+		addr:         strings.TrimSpace(lib.Getenv("FLUENTD_ADDR")),
+		sharedKey:    lib.Getenv("FLUENTD_SHARED_KEY"),
+		hostname:     strings.TrimSpace(lib.Getenv("FLUENTD_HOSTNAME")),
+		streamField:  strings.TrimSpace(lib.Getenv("FLUENTD_STREAM_NAME")),
+		maxEntrySize: 16 * 1024 * 1024,
+	}
+
+	switch {
+	case len(c.addr) == 0:
+		c.addr = ":24224"
+	case strings.HasPrefix(c.addr, "unix://"):
+		c.network, c.addr = "unix", strings.TrimPrefix(c.addr, "unix://")
+	case strings.HasPrefix(c.addr, "tcp://"):
+		c.addr = strings.TrimPrefix(c.addr, "tcp://")
+	}
+
+	if len(c.hostname) == 0 {
+		c.hostname, _ = os.Hostname()
+	}
+
+	if len(c.streamField) == 0 {
+		c.streamField = "container_name"
+	}
+
+	if s = lib.Getenv("FLUENTD_TAG_PATTERN"); len(s) != 0 {
+		if c.tagPattern, err = regexp.Compile(s); err != nil {
+			err = fmt.Errorf("invalid FLUENTD_TAG_PATTERN, must be a regular expression: %s", s)
+			return
+		}
+
+		if subexp(c.tagPattern, "group") < 0 && subexp(c.tagPattern, "stream") < 0 {
+			err = fmt.Errorf("invalid FLUENTD_TAG_PATTERN, must have a group or a stream named group: %s", s)
+			return
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("FLUENTD_MAX_ENTRY_SIZE")); len(s) != 0 {
+		if c.maxEntrySize, err = strconv.Atoi(s); err != nil || c.maxEntrySize <= 0 {
+			err = fmt.Errorf("invalid FLUENTD_MAX_ENTRY_SIZE, must be a positive number of bytes: %s", s)
+			return
+		}
+	}
+
+	c.parser, err = lib.SourceParser("fluentd")
+	return
+}
+
+// subexp returns the index of the group called name in re, or -1 if it has
+// none.
+func subexp(re *regexp.Regexp, name string) int {
+	for i, n := range re.SubexpNames() {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,553 @@
+// Package fluentd implements the fluentd source, which receives the events
+// sent with the forward protocol of fluentd, like the ones of the containers
+// that docker runs with --log-driver=fluentd.
+package fluentd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+func NewReader() (r lib.Reader, err error) {
+	var c config
+	var l net.Listener
+	var f lib.NameFilter
+
+	if c, err = getConfig(); err != nil {
+		return
+	}
+
+	if f, err = lib.SourceFilter("fluentd"); err != nil {
+		return
+	}
+
+	if l, err = net.Listen(c.network, c.addr); err != nil {
+		return
+	}
+
+	rd := newReader(c)
+	go rd.serve(l)
+
+	r = lib.NewFilteredReader("fluentd", rd, f, metrics.Default)
+	return
+}
+
+// reader accepts the connections of the clients and hands the events of each
+// of their entries to ReadMessage. The entries are acknowledged, when the
+// clients ask for it, once all their events were read.
+type reader struct {
+	config config
+	msgs   chan lib.Message
+	done   chan struct{}
+	once   sync.Once
+
+	mutex    sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+}
+
+func newReader(c config) *reader {
+	return &reader{
+		config: c,
+		msgs:   make(chan lib.Message),
+		done:   make(chan struct{}),
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+func (r *reader) Close() (err error) {
+	r.once.Do(func() {
+		close(r.done)
+
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+
+		if r.listener != nil {
+			err = r.listener.Close()
+		}
+
+		for conn := range r.conns {
+			conn.Close()
+		}
+	})
+	return
+}
+
+func (r *reader) ReadMessage() (msg lib.Message, err error) {
+	select {
+	case msg = <-r.msgs:
+	case <-r.done:
+		err = io.EOF
+	}
+	return
+}
+
+func (r *reader) serve(l net.Listener) {
+	r.mutex.Lock()
+	r.listener = l
+	r.mutex.Unlock()
+
+	for {
+		conn, err := l.Accept()
+
+		if err != nil {
+			select {
+			case <-r.done:
+			default:
+				log.WithError(err).Error("the fluentd source stopped accepting connections")
+			}
+			return
+		}
+
+		if !r.track(conn) {
+			conn.Close()
+			return
+		}
+
+		go r.handle(conn)
+	}
+}
+
+// track registers conn so it's closed with the reader, it returns false if
+// the reader is already closed.
+func (r *reader) track(conn net.Conn) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	select {
+	case <-r.done:
+		return false
+	default:
+		r.conns[conn] = struct{}{}
+		return true
+	}
+}
+
+func (r *reader) untrack(conn net.Conn) {
+	r.mutex.Lock()
+	delete(r.conns, conn)
+	r.mutex.Unlock()
+}
+
+// handle reads the entries sent on conn until the client disconnects, the
+// connections that send something that isn't valid are closed.
+func (r *reader) handle(conn net.Conn) {
+	defer r.untrack(conn)
+	defer conn.Close()
+
+	d := newDecoder(conn, r.config.maxEntrySize)
+	client := conn.RemoteAddr().String()
+
+	fail := func(err error) {
+		if err != io.EOF {
+			select {
+			case <-r.done:
+			default:
+				log.WithFields(log.Fields{"client": client, "error": err}).Warn("closing the fluentd connection")
+			}
+		}
+	}
+
+	if len(r.config.sharedKey) != 0 {
+		if err := r.handshake(conn, d); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	for {
+		v, err := d.decode()
+
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		msgs, chunk, err := r.entry(v)
+
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		for _, msg := range msgs {
+			select {
+			case r.msgs <- msg:
+			case <-r.done:
+				return
+			}
+		}
+
+		if len(chunk) != 0 {
+			ack := appendMapHeader(nil, 1)
+			ack = appendString(ack, "ack")
+			ack = appendString(ack, chunk)
+
+			if _, err := conn.Write(ack); err != nil {
+				fail(err)
+				return
+			}
+		}
+	}
+}
+
+// entry returns the messages of an entry of the forward protocol, in any of
+// its modes, and the chunk ID to acknowledge it with when the client asked for
+// an ack.
+func (r *reader) entry(v interface{}) (msgs []lib.Message, chunk string, err error) {
+	a, ok := v.([]interface{})
+
+	if !ok || len(a) < 2 {
+		err = fmt.Errorf("the entries of the forward protocol must be arrays of at least 2 values")
+		return
+	}
+
+	tag, ok := stringOf(a[0])
+
+	if !ok {
+		err = fmt.Errorf("the tag of an entry must be a string")
+		return
+	}
+
+	var option map[string]interface{}
+	var events []interface{}
+
+	switch x := a[1].(type) {
+	case []interface{}:
+		// Forward mode: [tag, [[time, record], ...], option]
+		events = x
+		option = optionOf(a, 2)
+
+	case string, []byte:
+		// PackedForward mode: [tag, msgpack stream of [time, record], option],
+		// the stream is gzipped in the CompressedPackedForward mode.
+		option = optionOf(a, 2)
+		b, _ := x.([]byte)
+
+		if s, ok := x.(string); ok {
+			b = []byte(s)
+		}
+
+		if events, err = r.unpack(b, option["compressed"]); err != nil {
+			return
+		}
+
+	default:
+		// Message mode: [tag, time, record, option]
+		if len(a) < 3 {
+			err = fmt.Errorf("the entries of the message mode must have a time and a record")
+			return
+		}
+		events = []interface{}{a[1:3]}
+		option = optionOf(a, 3)
+	}
+
+	for _, e := range events {
+		var msg lib.Message
+
+		if msg, err = r.message(tag, e); err != nil {
+			return
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	chunk, _ = stringOf(option["chunk"])
+	return
+}
+
+// unpack decodes the events of a PackedForward entry.
+func (r *reader) unpack(b []byte, compressed interface{}) (events []interface{}, err error) {
+	var in io.Reader = bytes.NewReader(b)
+
+	if c, _ := stringOf(compressed); len(c) != 0 {
+		if c != "gzip" {
+			err = fmt.Errorf("unsupported compression of a packed entry, must be gzip: %s", c)
+			return
+		}
+
+		if in, err = gzip.NewReader(in); err != nil {
+			return
+		}
+
+		// The events are limited to the maximum size once decompressed,
+		// which is where a small entry could blow up.
+		in = &io.LimitedReader{R: in, N: int64(r.config.maxEntrySize)}
+	}
+
+	d := newDecoder(in, r.config.maxEntrySize)
+
+	for {
+		var v interface{}
+
+		if v, err = d.decode(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+
+		events = append(events, v)
+	}
+}
+
+// message converts an event, an array of a time and a record, to a message.
+func (r *reader) message(tag string, e interface{}) (msg lib.Message, err error) {
+	a, ok := e.([]interface{})
+
+	if !ok || len(a) < 2 {
+		err = fmt.Errorf("the events of the forward protocol must be arrays of a time and a record")
+		return
+	}
+
+	record, ok := a[1].(map[string]interface{})
+
+	if !ok {
+		err = fmt.Errorf("the records of the forward protocol must be maps")
+		return
+	}
+
+	msg.Group, msg.Stream = r.names(tag)
+
+	if len(msg.Stream) == 0 {
+		if s, ok := stringOf(record[r.config.streamField]); ok {
+			msg.Stream = sanitizeStreamName(s)
+		}
+	}
+
+	// Docker puts the line in the log field, the other clients usually use
+	// message.
+	field := "log"
+	line, ok := stringOf(record[field])
+
+	if !ok {
+		field = "message"
+		line, _ = stringOf(record[field])
+	}
+
+	if line = strings.TrimRight(line, "\r\n"); len(line) != 0 {
+		if r.config.parser != nil {
+			msg.Event = lib.ParseMessage(r.config.parser, []byte(line)).Event
+		} else {
+			d := json.NewDecoder(strings.NewReader(line))
+			d.UseNumber()
+
+			if d.Decode(&msg.Event) != nil {
+				msg.Event = ecslogs.Event{Message: line}
+			}
+		}
+	}
+
+	if msg.Event.Data == nil {
+		msg.Event.Data = ecslogs.EventData{}
+	}
+
+	// The other fields of the record, like the container_id and the source
+	// set by docker, are kept in the data without overwriting what the line
+	// carried.
+	for k, v := range record {
+		if _, exists := msg.Event.Data[k]; !exists && k != field {
+			msg.Event.Data[k] = dataValue(v)
+		}
+	}
+
+	if msg.Event.Level == ecslogs.NONE {
+		switch source, _ := stringOf(record["source"]); source {
+		case "stdout":
+			msg.Event.Level = ecslogs.INFO
+		case "stderr":
+			msg.Event.Level = ecslogs.ERROR
+		}
+	}
+
+	if msg.Event.Time.IsZero() {
+		msg.Event.Time = timeOf(a[0])
+	}
+
+	return
+}
+
+// names returns the group and stream of the messages with tag.
+func (r *reader) names(tag string) (group string, stream string) {
+	if r.config.tagPattern == nil {
+		return tag, ""
+	}
+
+	m := r.config.tagPattern.FindStringSubmatch(tag)
+
+	if m == nil {
+		return tag, ""
+	}
+
+	if i := subexp(r.config.tagPattern, "group"); i > 0 {
+		group = m[i]
+	}
+
+	if i := subexp(r.config.tagPattern, "stream"); i > 0 {
+		stream = m[i]
+	}
+
+	return
+}
+
+// handshake authenticates the client on conn with the shared key, following
+// the HELO, PING and PONG sequence of the forward protocol.
+func (r *reader) handshake(conn net.Conn, d *decoder) (err error) {
+	nonce := make([]byte, 16)
+	salt := make([]byte, 16)
+
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+
+	if _, err = rand.Read(salt); err != nil {
+		return
+	}
+
+	// The users aren't authenticated, the auth salt is empty.
+	helo := appendArrayHeader(nil, 2)
+	helo = appendString(helo, "HELO")
+	helo = appendMapHeader(helo, 3)
+	helo = appendString(helo, "nonce")
+	helo = appendBinary(helo, nonce)
+	helo = appendString(helo, "auth")
+	helo = appendBinary(helo, nil)
+	helo = appendString(helo, "keepalive")
+	helo = appendBool(helo, true)
+
+	if _, err = conn.Write(helo); err != nil {
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	v, err := d.decode()
+	conn.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		return
+	}
+
+	ping, ok := v.([]interface{})
+
+	if !ok || len(ping) < 4 {
+		return fmt.Errorf("the client didn't respond to the handshake with a PING")
+	}
+
+	kind, _ := stringOf(ping[0])
+	hostname, _ := stringOf(ping[1])
+	sharedSalt, _ := stringOf(ping[2])
+	digest, _ := stringOf(ping[3])
+
+	if kind != "PING" {
+		return fmt.Errorf("the client didn't respond to the handshake with a PING")
+	}
+
+	reason := ""
+
+	if digest != sharedKeyDigest(sharedSalt, hostname, nonce, r.config.sharedKey) {
+		reason = "shared_key mismatch"
+	}
+
+	pong := appendArrayHeader(nil, 5)
+	pong = appendString(pong, "PONG")
+	pong = appendBool(pong, len(reason) == 0)
+	pong = appendString(pong, reason)
+	pong = appendString(pong, r.config.hostname)
+	pong = appendString(pong, sharedKeyDigest(sharedSalt, r.config.hostname, nonce, r.config.sharedKey))
+
+	if _, err = conn.Write(pong); err == nil && len(reason) != 0 {
+		err = fmt.Errorf("the client %s failed to authenticate, %s", hostname, reason)
+	}
+
+	return
+}
+
+func sharedKeyDigest(salt string, hostname string, nonce []byte, key string) string {
+	h := sha512.New()
+	h.Write([]byte(salt))
+	h.Write([]byte(hostname))
+	h.Write(nonce)
+	h.Write([]byte(key))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func optionOf(a []interface{}, i int) map[string]interface{} {
+	if i < len(a) {
+		if m, ok := a[i].(map[string]interface{}); ok {
+			return m
+		}
+	}
+	return nil
+}
+
+func stringOf(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case string:
+		return x, true
+	case []byte:
+		return string(x), true
+	}
+	return "", false
+}
+
+// timeOf converts the time of an event, an EventTime or a number of seconds.
+func timeOf(v interface{}) time.Time {
+	switch x := v.(type) {
+	case time.Time:
+		return x
+	case int64:
+		return time.Unix(x, 0)
+	case uint64:
+		return time.Unix(int64(x), 0)
+	case float64:
+		return time.Unix(0, int64(x*1e9))
+	}
+	return time.Time{}
+}
+
+// dataValue converts the binaries of a record, which the clients use for
+// strings, so they're serialized as text.
+func dataValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case []byte:
+		return string(x)
+	case []interface{}:
+		for i := range x {
+			x[i] = dataValue(x[i])
+		}
+	case map[string]interface{}:
+		for k := range x {
+			x[k] = dataValue(x[k])
+		}
+	}
+	return v
+}
+
+// sanitizeStreamName turns the names of the containers into stream names like
+// the journald source, without the leading slash that docker adds to them.
+func sanitizeStreamName(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	name = strings.Replace(name, ":", "/", -1)
+	name = strings.Replace(name, "*", "/", -1)
+
+	if len(name) > 512 {
+		name = name[:512]
+	}
+
+	return name
+}
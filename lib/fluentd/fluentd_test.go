@@ -0,0 +1,267 @@
+package fluentd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+// pack encodes v with the msgpack types that the clients use.
+func pack(b []byte, v interface{}) []byte {
+	switch x := v.(type) {
+	case nil:
+		return append(b, 0xc0)
+	case bool:
+		return appendBool(b, x)
+	case int:
+		if x >= 0 && x < 128 {
+			return append(b, byte(x))
+		}
+		b = append(b, 0xd3)
+		return binary.BigEndian.AppendUint64(b, uint64(x))
+	case int64:
+		return pack(b, int(x))
+	case string:
+		return appendString(b, x)
+	case []byte:
+		return appendBinary(b, x)
+	case time.Time:
+		b = append(b, 0xd7, eventTimeExt)
+		b = binary.BigEndian.AppendUint32(b, uint32(x.Unix()))
+		return binary.BigEndian.AppendUint32(b, uint32(x.Nanosecond()))
+	case []interface{}:
+		b = appendArrayHeader(b, len(x))
+		for _, item := range x {
+			b = pack(b, item)
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = appendMapHeader(b, len(x))
+		for _, k := range keys {
+			b = pack(appendString(b, k), x[k])
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+type entry = []interface{}
+type record = map[string]interface{}
+
+func newTestReader(t *testing.T, c config) (*reader, string) {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.maxEntrySize == 0 {
+		c.maxEntrySize = 1024 * 1024
+	}
+
+	if len(c.streamField) == 0 {
+		c.streamField = "container_name"
+	}
+
+	r := newReader(c)
+	go r.serve(l)
+	return r, l.Addr().String()
+}
+
+func dial(t *testing.T, addr string) (net.Conn, *decoder) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, newDecoder(conn, 1024*1024)
+}
+
+func read(t *testing.T, r *reader, n int) (msgs []lib.Message) {
+	for i := 0; i != n; i++ {
+		select {
+		case msg := <-r.msgs:
+			msgs = append(msgs, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for message %d", i)
+		}
+	}
+	return
+}
+
+func TestReaderModes(t *testing.T) {
+	r, addr := newTestReader(t, config{})
+	defer r.Close()
+
+	conn, d := dial(t, addr)
+	defer conn.Close()
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 6000, time.UTC)
+	docker := record{
+		"container_id":   "0123456789ab",
+		"container_name": "/web-1",
+		"source":         "stderr",
+		"log":            "connection refused\n",
+	}
+
+	var packed []byte
+	packed = pack(packed, entry{now, record{"message": "packed"}})
+	packed = pack(packed, entry{now.Unix(), record{"log": `{"level":"WARN","message":"json line","data":{"user":"A"}}`}})
+
+	var gz bytes.Buffer
+	z := gzip.NewWriter(&gz)
+	z.Write(packed)
+	z.Close()
+
+	var b []byte
+	b = pack(b, entry{"/ecs/web", now, docker})
+	b = pack(b, entry{"/ecs/web", []interface{}{entry{now, record{"log": "forward", "container_name": "web-2"}}}, record{"chunk": "abc"}})
+	b = pack(b, entry{"/ecs/api", gz.Bytes(), record{"compressed": "gzip"}})
+
+	if _, err := conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := read(t, r, 4)
+
+	if m := msgs[0]; m.Group != "/ecs/web" || m.Stream != "web-1" || m.Event.Message != "connection refused" || m.Event.Level != ecslogs.ERROR || !m.Event.Time.Equal(now) || m.Event.Data["container_id"] != "0123456789ab" {
+		t.Errorf("invalid message of the message mode: %+v", m)
+	}
+
+	if m := msgs[1]; m.Stream != "web-2" || m.Event.Message != "forward" {
+		t.Errorf("invalid message of the forward mode: %+v", m)
+	}
+
+	if m := msgs[2]; m.Group != "/ecs/api" || m.Event.Message != "packed" {
+		t.Errorf("invalid message of the compressed packed forward mode: %+v", m)
+	}
+
+	if m := msgs[3]; m.Event.Message != "json line" || m.Event.Level != ecslogs.WARN || m.Event.Data["user"] != "A" || !m.Event.Time.Equal(time.Unix(now.Unix(), 0)) {
+		t.Errorf("the JSON lines should be decoded: %+v", m)
+	}
+
+	ack, err := d.decode()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(ack, map[string]interface{}{"ack": "abc"}) {
+		t.Errorf("invalid ack: %#v", ack)
+	}
+}
+
+func TestReaderTagPattern(t *testing.T) {
+	r, addr := newTestReader(t, config{tagPattern: regexp.MustCompile(`^docker\.(?P<group>[^.]+)\.(?P<stream>.+)$`)})
+	defer r.Close()
+
+	conn, _ := dial(t, addr)
+	defer conn.Close()
+
+	var b []byte
+	b = pack(b, entry{"docker.web.web-1", 1, record{"log": "A", "container_name": "/ignored"}})
+	b = pack(b, entry{"other", 1, record{"log": "B", "container_name": "/web-2"}})
+	conn.Write(b)
+
+	msgs := read(t, r, 2)
+
+	if m := msgs[0]; m.Group != "web" || m.Stream != "web-1" {
+		t.Errorf("the names should come from the tag: %s/%s", m.Group, m.Stream)
+	}
+
+	if m := msgs[1]; m.Group != "other" || m.Stream != "web-2" {
+		t.Errorf("the tags that don't match should be the group: %s/%s", m.Group, m.Stream)
+	}
+}
+
+func TestReaderHandshake(t *testing.T) {
+	r, addr := newTestReader(t, config{sharedKey: "secret", hostname: "ecs-logs"})
+	defer r.Close()
+
+	for _, test := range []struct {
+		key string
+		ok  bool
+	}{
+		{"secret", true},
+		{"wrong", false},
+	} {
+		conn, d := dial(t, addr)
+
+		v, err := d.decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		helo := v.([]interface{})
+		nonce := helo[1].(map[string]interface{})["nonce"].([]byte)
+
+		if helo[0] != "HELO" || len(nonce) == 0 {
+			t.Fatalf("invalid HELO: %#v", helo)
+		}
+
+		conn.Write(pack(nil, entry{"PING", "client", "salt", sharedKeyDigest("salt", "client", nonce, test.key), "", ""}))
+
+		if v, err = d.decode(); err != nil {
+			t.Fatal(err)
+		}
+
+		pong := v.([]interface{})
+
+		if pong[0] != "PONG" || pong[1] != test.ok || pong[3] != "ecs-logs" {
+			t.Errorf("%s: invalid PONG: %#v", test.key, pong)
+		}
+
+		if test.ok {
+			if pong[4] != sharedKeyDigest("salt", "ecs-logs", nonce, "secret") {
+				t.Errorf("invalid digest of the server: %#v", pong[4])
+			}
+
+			conn.Write(pack(nil, entry{"web", 1, record{"log": "authenticated"}}))
+
+			if msgs := read(t, r, 1); msgs[0].Event.Message != "authenticated" {
+				t.Errorf("invalid message: %+v", msgs[0])
+			}
+		} else if _, err := d.decode(); err == nil {
+			t.Error("the connection should be closed after a failed handshake")
+		}
+
+		conn.Close()
+	}
+}
+
+func TestReaderConcurrentConnections(t *testing.T) {
+	r, addr := newTestReader(t, config{})
+	defer r.Close()
+
+	for i := 0; i != 3; i++ {
+		conn, _ := dial(t, addr)
+		defer conn.Close()
+		conn.Write(pack(nil, entry{"web", 1, record{"log": "hello"}}))
+	}
+
+	if msgs := read(t, r, 3); len(msgs) != 3 {
+		t.Errorf("invalid messages: %+v", msgs)
+	}
+
+	r.Close()
+
+	if _, err := r.ReadMessage(); err == nil {
+		t.Error("the reader should be closed")
+	}
+}
@@ -0,0 +1,7 @@
+package fluentd
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterSource("fluentd", lib.SourceFunc(NewReader))
+}
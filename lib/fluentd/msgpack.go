@@ -0,0 +1,374 @@
+package fluentd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// The extension type of the EventTime values of the forward protocol, the
+// times with a nanosecond precision.
+const eventTimeExt = 0
+
+// decoder reads the msgpack values sent by the clients. Only the subset of
+// msgpack that the forward protocol uses is supported: the maps are decoded
+// as map[string]interface{}, the integers as int64 or uint64, and the strings
+// and binaries as string and []byte.
+type decoder struct {
+	r *bufio.Reader
+
+	// The maximum size of a string, a binary or an extension, and of the
+	// number of items of an array or a map, so a malformed length can't make
+	// the source allocate the memory of the host.
+	max int
+
+	// The nesting level of the value being decoded.
+	depth int
+}
+
+// The maximum nesting level of the arrays and maps.
+const maxDepth = 64
+
+func newDecoder(r io.Reader, max int) *decoder {
+	return &decoder{r: bufio.NewReader(r), max: max}
+}
+
+// decode reads the next value, it returns io.EOF when the stream ends between
+// two values and io.ErrUnexpectedEOF when it ends in the middle of one.
+func (d *decoder) decode() (v interface{}, err error) {
+	var c byte
+
+	if c, err = d.r.ReadByte(); err != nil {
+		return
+	}
+
+	v, err = d.value(c)
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return
+}
+
+func (d *decoder) value(c byte) (v interface{}, err error) {
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c >= 0x80 && c <= 0x8f:
+		return d.mapOf(int(c & 0x0f))
+	case c >= 0x90 && c <= 0x9f:
+		return d.arrayOf(int(c & 0x0f))
+	case c >= 0xa0 && c <= 0xbf:
+		return d.str(int(c & 0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+
+	case 0xc4, 0xc5, 0xc6:
+		var n int
+		var b []byte
+
+		if n, err = d.length(c - 0xc4); err == nil {
+			b, err = d.bytes(n)
+		}
+
+		return b, err
+
+	case 0xc7, 0xc8, 0xc9:
+		var n int
+
+		if n, err = d.length(c - 0xc7); err == nil {
+			v, err = d.ext(n)
+		}
+
+		return
+
+	case 0xca:
+		var b []byte
+
+		if b, err = d.read(4); err == nil {
+			v = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+		}
+
+		return
+
+	case 0xcb:
+		var b []byte
+
+		if b, err = d.read(8); err == nil {
+			v = math.Float64frombits(binary.BigEndian.Uint64(b))
+		}
+
+		return
+
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		var b []byte
+
+		if b, err = d.read(1 << (c - 0xcc)); err == nil {
+			v = uint64(bigEndian(b))
+		}
+
+		return
+
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		var b []byte
+
+		if b, err = d.read(1 << (c - 0xd0)); err == nil {
+			// The values are sign extended from their size.
+			shift := uint(64 - 8*len(b))
+			v = int64(bigEndian(b)<<shift) >> shift
+		}
+
+		return
+
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.ext(1 << (c - 0xd4))
+
+	case 0xd9, 0xda, 0xdb:
+		var n int
+
+		if n, err = d.length(c - 0xd9); err == nil {
+			v, err = d.str(n)
+		}
+
+		return
+
+	case 0xdc, 0xdd:
+		var n int
+
+		if n, err = d.length(c - 0xdb); err == nil {
+			v, err = d.arrayOf(n)
+		}
+
+		return
+
+	case 0xde, 0xdf:
+		var n int
+
+		if n, err = d.length(c - 0xdd); err == nil {
+			v, err = d.mapOf(n)
+		}
+
+		return
+	}
+
+	return nil, fmt.Errorf("invalid msgpack value starting with 0x%02x", c)
+}
+
+// length reads a length of 1, 2 or 4 bytes for the sizes 0, 1 and 2.
+func (d *decoder) length(size byte) (n int, err error) {
+	var b []byte
+
+	if b, err = d.read(1 << size); err != nil {
+		return
+	}
+
+	if u := bigEndian(b); u > uint64(d.max) {
+		err = fmt.Errorf("msgpack value of %d bytes or items, the maximum is %d", u, d.max)
+	} else {
+		n = int(u)
+	}
+
+	return
+}
+
+func (d *decoder) read(n int) (b []byte, err error) {
+	b = make([]byte, n)
+	_, err = io.ReadFull(d.r, b)
+	return
+}
+
+func (d *decoder) bytes(n int) (b []byte, err error) {
+	if n > d.max {
+		err = fmt.Errorf("msgpack value of %d bytes, the maximum is %d", n, d.max)
+		return
+	}
+	return d.read(n)
+}
+
+func (d *decoder) str(n int) (s string, err error) {
+	var b []byte
+
+	if b, err = d.bytes(n); err == nil {
+		s = string(b)
+	}
+
+	return
+}
+
+// ext decodes an extension of n bytes, the EventTime values are returned as
+// time.Time and the other ones as their bytes.
+func (d *decoder) ext(n int) (v interface{}, err error) {
+	var t byte
+	var b []byte
+
+	if t, err = d.r.ReadByte(); err != nil {
+		return
+	}
+
+	if b, err = d.bytes(n); err != nil {
+		return
+	}
+
+	if t == eventTimeExt && n == 8 {
+		return time.Unix(int64(binary.BigEndian.Uint32(b[:4])), int64(binary.BigEndian.Uint32(b[4:]))), nil
+	}
+
+	return b, nil
+}
+
+func (d *decoder) arrayOf(n int) (a []interface{}, err error) {
+	if err = d.enter(); err != nil {
+		return
+	}
+	defer d.leave()
+
+	a = make([]interface{}, 0, capacity(n))
+
+	for i := 0; i != n; i++ {
+		var c byte
+		var v interface{}
+
+		if c, err = d.r.ReadByte(); err != nil {
+			return
+		}
+
+		if v, err = d.value(c); err != nil {
+			return
+		}
+
+		a = append(a, v)
+	}
+
+	return
+}
+
+func (d *decoder) mapOf(n int) (m map[string]interface{}, err error) {
+	if err = d.enter(); err != nil {
+		return
+	}
+	defer d.leave()
+
+	m = make(map[string]interface{}, capacity(n))
+
+	for i := 0; i != n; i++ {
+		var c byte
+		var k, v interface{}
+
+		if c, err = d.r.ReadByte(); err != nil {
+			return
+		}
+
+		if k, err = d.value(c); err != nil {
+			return
+		}
+
+		if c, err = d.r.ReadByte(); err != nil {
+			return
+		}
+
+		if v, err = d.value(c); err != nil {
+			return
+		}
+
+		switch k := k.(type) {
+		case string:
+			m[k] = v
+		case []byte:
+			m[string(k)] = v
+		default:
+			m[fmt.Sprint(k)] = v
+		}
+	}
+
+	return
+}
+
+func (d *decoder) enter() error {
+	if d.depth++; d.depth > maxDepth {
+		return fmt.Errorf("msgpack values nested deeper than %d levels", maxDepth)
+	}
+	return nil
+}
+
+func (d *decoder) leave() {
+	d.depth--
+}
+
+// capacity limits the memory allocated upfront for the items of an array or
+// a map, the lengths come from the clients.
+func capacity(n int) int {
+	if n > 1024 {
+		return 1024
+	}
+	return n
+}
+
+func bigEndian(b []byte) (u uint64) {
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return
+}
+
+// The encoding functions append the msgpack representation of the values that
+// ecs-logs sends to the clients: the acks and the handshake messages.
+
+func appendArrayHeader(b []byte, n int) []byte {
+	if n < 16 {
+		return append(b, 0x90|byte(n))
+	}
+	return append(b, 0xdc, byte(n>>8), byte(n))
+}
+
+func appendMapHeader(b []byte, n int) []byte {
+	if n < 16 {
+		return append(b, 0x80|byte(n))
+	}
+	return append(b, 0xde, byte(n>>8), byte(n))
+}
+
+func appendString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n < 256:
+		b = append(b, 0xd9, byte(n))
+	case n < 65536:
+		b = append(b, 0xda, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0xdb, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(b, s...)
+}
+
+func appendBinary(b []byte, v []byte) []byte {
+	switch n := len(v); {
+	case n < 256:
+		b = append(b, 0xc4, byte(n))
+	case n < 65536:
+		b = append(b, 0xc5, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0xc6, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(b, v...)
+}
+
+func appendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 0xc3)
+	}
+	return append(b, 0xc2)
+}
@@ -0,0 +1,56 @@
+package fluentd
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestDecoder(t *testing.T) {
+	for _, test := range []struct {
+		in  []byte
+		out interface{}
+	}{
+		{[]byte{0x05}, int64(5)},
+		{[]byte{0xff}, int64(-1)},
+		{[]byte{0xd0, 0x80}, int64(-128)},
+		{[]byte{0xd1, 0xff, 0x00}, int64(-256)},
+		{[]byte{0xcd, 0x01, 0x00}, uint64(256)},
+		{[]byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, 1.5},
+		{[]byte{0xc0}, nil},
+		{[]byte{0xc3}, true},
+		{[]byte{0xa2, 'h', 'i'}, "hi"},
+		{[]byte{0xd9, 0x02, 'h', 'i'}, "hi"},
+		{[]byte{0xc4, 0x02, 'h', 'i'}, []byte("hi")},
+		{[]byte{0x92, 0x01, 0xa1, 'a'}, []interface{}{int64(1), "a"}},
+		{[]byte{0x81, 0xa1, 'k', 0x02}, map[string]interface{}{"k": int64(2)}},
+		{[]byte{0xd4, 0x05, 0x01}, []byte{0x01}},
+	} {
+		v, err := newDecoder(bytes.NewReader(test.in), 1024).decode()
+
+		if err != nil || !reflect.DeepEqual(v, test.out) {
+			t.Errorf("%x: %#v, %v", test.in, v, err)
+		}
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	nested := bytes.Repeat([]byte{0x91}, maxDepth+1)
+
+	for _, in := range [][]byte{
+		{0xc1},
+		{0xa2, 'h'},
+		{0xdb, 0xff, 0xff, 0xff, 0xff},
+		{0xdd, 0x7f, 0xff, 0xff, 0xff},
+		append(nested, 0x01),
+	} {
+		if _, err := newDecoder(bytes.NewReader(in), 1024).decode(); err == nil || err == io.EOF {
+			t.Errorf("%x: the value should be invalid: %v", in, err)
+		}
+	}
+
+	if _, err := newDecoder(bytes.NewReader(nil), 1024).decode(); err != io.EOF {
+		t.Errorf("an empty stream should end with io.EOF: %v", err)
+	}
+}
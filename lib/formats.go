@@ -0,0 +1,195 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+// The access logs of Apache and nginx in the combined format, the common
+// format is the same without the referer and user agent. Fields that servers
+// configured with a custom format append after those are ignored.
+var combinedLine = regexp.MustCompile(`^(\S+) (\S+) (\S+) \[([^\]]+)\] "((?:[^"\\]|\\.)*)" (\d{3}) (\d+|-)(?: "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)")?`)
+
+const combinedTime = "02/Jan/2006:15:04:05 -0700"
+
+// parseCombined parses the lines of access logs in the combined or common
+// format. The request line is the message of the event, the level is derived
+// from the status (ERROR for 5xx, WARN for 4xx, INFO otherwise) and the other
+// fields go to the event data, the ones set to "-" are omitted.
+func parseCombined(raw []byte) (msg Message, err error) {
+	m := combinedLine.FindSubmatch(raw)
+
+	if m == nil {
+		err = fmt.Errorf("invalid combined log line")
+		return
+	}
+
+	if msg.Event.Time, err = time.Parse(combinedTime, string(m[4])); err != nil {
+		err = fmt.Errorf("invalid combined log time: %s", m[4])
+		return
+	}
+
+	status, _ := strconv.ParseInt(string(m[6]), 10, 64)
+	data := ecslogs.EventData{"status": status}
+	request := unescapeCombined(m[5])
+
+	if parts := strings.Split(request, " "); len(parts) == 3 {
+		data["method"], data["path"], data["protocol"] = parts[0], parts[1], parts[2]
+	}
+
+	if size := string(m[7]); size != "-" {
+		data["bytes"], _ = strconv.ParseInt(size, 10, 64)
+	}
+
+	for _, f := range []struct {
+		key   string
+		value string
+	}{
+		{"remote_addr", string(m[1])},
+		{"remote_user", string(m[3])},
+		{"referer", unescapeCombined(m[8])},
+		{"user_agent", unescapeCombined(m[9])},
+	} {
+		if len(f.value) != 0 && f.value != "-" {
+			data[f.key] = f.value
+		}
+	}
+
+	switch {
+	case status >= 500:
+		msg.Event.Level = ecslogs.ERROR
+	case status >= 400:
+		msg.Event.Level = ecslogs.WARN
+	default:
+		msg.Event.Level = ecslogs.INFO
+	}
+
+	msg.Event.Message = request
+	msg.Event.Data = data
+	return
+}
+
+// unescapeCombined reverts the escaping of the quoted fields, nginx escapes
+// quotes and backslashes with a backslash and other bytes as \xHH.
+func unescapeCombined(b []byte) string {
+	if bytes.IndexByte(b, '\\') < 0 {
+		return string(b)
+	}
+
+	if s, err := strconv.Unquote(`"` + string(b) + `"`); err == nil {
+		return s
+	}
+
+	return string(b)
+}
+
+// The lines written by glog and klog, like
+// I1014 13:55:36.123456   12345 server.go:42] listening on :8080
+var glogLine = regexp.MustCompile(`^([IWEF])(\d{4} \d{2}:\d{2}:\d{2}\.\d{6}) +(\d+) ([^ :\]]+):(\d+)\] ?`)
+
+var glogLevels = map[byte]ecslogs.Level{
+	'I': ecslogs.INFO,
+	'W': ecslogs.WARN,
+	'E': ecslogs.ERROR,
+	'F': ecslogs.CRIT,
+}
+
+// parseGlog parses the lines written by glog. The header sets the level and
+// time of the event, the thread id, file and line go to the event data, and
+// the rest of the line is the message.
+//
+// The header has no year or time zone, the time is assumed to be in UTC and
+// in the latest year that its date falls in.
+func parseGlog(raw []byte) (msg Message, err error) {
+	m := glogLine.FindSubmatch(raw)
+
+	if m == nil {
+		err = fmt.Errorf("invalid glog line")
+		return
+	}
+
+	if msg.Event.Time, err = glogTime(string(m[2]), time.Now().UTC()); err != nil {
+		return
+	}
+
+	thread, _ := strconv.ParseInt(string(m[3]), 10, 64)
+	line, _ := strconv.ParseInt(string(m[5]), 10, 64)
+
+	msg.Event.Level = glogLevels[m[1][0]]
+	msg.Event.Message = string(raw[len(m[0]):])
+	msg.Event.Data = ecslogs.EventData{
+		"thread_id": thread,
+		"file":      string(m[4]),
+		"line":      line,
+	}
+	return
+}
+
+// glogTime returns the time of a glog header read at now, in the latest year
+// when its date existed and wasn't in the future: the previous one for a line
+// written in late December and read in early January, and the last leap year
+// for February 29.
+func glogTime(header string, now time.Time) (t time.Time, err error) {
+	var date time.Time
+
+	// 2000 is a leap year, every date of the headers is valid in it.
+	if date, err = time.Parse("2006 0102 15:04:05.000000", "2000 "+header); err != nil {
+		err = fmt.Errorf("invalid glog time: %s", header)
+		return
+	}
+
+	for year := now.Year(); ; year-- {
+		t = time.Date(year, date.Month(), date.Day(), date.Hour(), date.Minute(), date.Second(), date.Nanosecond(), time.UTC)
+
+		if t.Day() == date.Day() && !t.After(now.Add(24*time.Hour)) {
+			return
+		}
+	}
+}
+
+// detectParser recognizes the format of each line among the built-in ones,
+// the lines in none of them are raw messages, with their content unchanged.
+// It's more expensive than selecting the format, every parser may have to look
+// at a line, so it's meant for sources that carry the logs of many
+// applications.
+type detectParser struct{}
+
+func (detectParser) Parse(raw []byte) (Message, error) {
+	// Only JSON events start with a brace, the other lines would always fail
+	// to decode.
+	if line := bytes.TrimLeft(raw, " \t"); len(line) != 0 && line[0] == '{' {
+		if msg, err := parseJSON(raw); err == nil {
+			return msg, nil
+		}
+	}
+
+	for _, parse := range []func([]byte) (Message, error){parseCombined, parseGlog} {
+		if msg, err := parse(raw); err == nil {
+			return msg, nil
+		}
+	}
+
+	// Plain text with a few key=value pairs in it is valid logfmt too, only
+	// the lines made of pairs are detected as logfmt so the words of the
+	// others don't become empty data fields.
+	if msg, err := parseLogfmt(raw); err == nil && !hasEmptyValues(msg.Event.Data) {
+		return msg, nil
+	}
+
+	return parseRaw(raw)
+}
+
+func hasEmptyValues(data ecslogs.EventData) bool {
+	for _, v := range data {
+		if v == "" {
+			return true
+		}
+	}
+	return false
+}
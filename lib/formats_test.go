@@ -0,0 +1,170 @@
+package lib
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+func TestParseCombined(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected ecslogs.Event
+	}{
+		{
+			raw: `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav)"`,
+			expected: ecslogs.Event{
+				Level:   ecslogs.INFO,
+				Time:    time.Date(2000, 10, 10, 20, 55, 36, 0, time.UTC),
+				Message: "GET /apache_pb.gif HTTP/1.0",
+				Data: ecslogs.EventData{
+					"remote_addr": "127.0.0.1",
+					"remote_user": "frank",
+					"method":      "GET",
+					"path":        "/apache_pb.gif",
+					"protocol":    "HTTP/1.0",
+					"status":      int64(200),
+					"bytes":       int64(2326),
+					"referer":     "http://www.example.com/start.html",
+					"user_agent":  "Mozilla/4.08 [en] (Win98; I ;Nav)",
+				},
+			},
+		},
+		{
+			// The common format, with an escaped quote in the request.
+			raw: `10.0.0.1 - - [14/Oct/2026:08:00:00 +0000] "GET /q?s=\"x\" HTTP/1.1" 503 -`,
+			expected: ecslogs.Event{
+				Level:   ecslogs.ERROR,
+				Time:    time.Date(2026, 10, 14, 8, 0, 0, 0, time.UTC),
+				Message: `GET /q?s="x" HTTP/1.1`,
+				Data: ecslogs.EventData{
+					"remote_addr": "10.0.0.1",
+					"method":      "GET",
+					"path":        `/q?s="x"`,
+					"protocol":    "HTTP/1.1",
+					"status":      int64(503),
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		msg, err := parseCombined([]byte(test.raw))
+
+		if err != nil {
+			t.Errorf("%s: %s", test.raw, err)
+			continue
+		}
+
+		if !msg.Event.Time.Equal(test.expected.Time) {
+			t.Errorf("%s: invalid time: %s", test.raw, msg.Event.Time)
+		}
+
+		msg.Event.Time = test.expected.Time
+
+		if !reflect.DeepEqual(msg.Event, test.expected) {
+			t.Errorf("invalid event:\n- expected: %#v\n- found:    %#v", test.expected, msg.Event)
+		}
+	}
+
+	for _, raw := range []string{
+		"just some text",
+		`127.0.0.1 - - [yesterday] "GET / HTTP/1.1" 200 12`,
+	} {
+		if _, err := parseCombined([]byte(raw)); err == nil {
+			t.Errorf("%#v should not be parsed as a combined log line", raw)
+		}
+	}
+}
+
+func TestParseGlog(t *testing.T) {
+	msg, err := parseGlog([]byte("W0102 15:04:05.123456   12345 server.go:42] connection reset: read tcp"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ecslogs.Event{
+		Level:   ecslogs.WARN,
+		Time:    time.Date(time.Now().UTC().Year(), 1, 2, 15, 4, 5, 123456000, time.UTC),
+		Message: "connection reset: read tcp",
+		Data:    ecslogs.EventData{"thread_id": int64(12345), "file": "server.go", "line": int64(42)},
+	}
+
+	if !reflect.DeepEqual(msg.Event, expected) {
+		t.Errorf("invalid event:\n- expected: %#v\n- found:    %#v", expected, msg.Event)
+	}
+
+	// A date later in the year than today was logged last year.
+	future := time.Now().UTC().AddDate(0, 0, 7)
+	msg, _ = parseGlog([]byte("I" + future.Format("0102 15:04:05.000000") + " 1 main.go:1] hello"))
+
+	if year := msg.Event.Time.Year(); year != future.Year()-1 {
+		t.Errorf("invalid year: %d", year)
+	}
+
+	if _, err := parseGlog([]byte("I am not a glog line")); err == nil {
+		t.Error("plain text should not be parsed as a glog line")
+	}
+}
+
+func TestGlogTime(t *testing.T) {
+	for _, test := range []struct {
+		header string
+		now    time.Time
+		time   time.Time
+	}{
+		{"0315 10:00:00.000000", time.Date(2027, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(2027, 3, 15, 10, 0, 0, 0, time.UTC)},
+		{"1231 23:59:59.000000", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 12, 31, 23, 59, 59, 0, time.UTC)},
+		{"0229 12:00:00.000000", time.Date(2028, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 12, 0, 0, 0, time.UTC)},
+		{"0229 12:00:00.000000", time.Date(2027, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC)},
+		{"0229 12:00:00.000000", time.Date(2028, 1, 10, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC)},
+	} {
+		if tm, err := glogTime(test.header, test.now); err != nil || !tm.Equal(test.time) {
+			t.Errorf("%s at %s: invalid time: %s (%v)", test.header, test.now, tm, err)
+		}
+	}
+
+	if _, err := glogTime("0230 12:00:00.000000", time.Now()); err == nil {
+		t.Error("February 30 should be an invalid date")
+	}
+}
+
+func TestDetectParser(t *testing.T) {
+	p := GetParser("detect")
+
+	tests := []struct {
+		raw     string
+		message string
+		level   ecslogs.Level
+		data    ecslogs.EventData
+	}{
+		{`{"level":"INFO","message":"listening","data":{"port":8080}}`, "listening", ecslogs.INFO, ecslogs.EventData{"port": json.Number("8080")}},
+		{`127.0.0.1 - - [14/Oct/2026:08:00:00 +0000] "GET / HTTP/1.1" 404 12`, "GET / HTTP/1.1", ecslogs.WARN, nil},
+		{"E1014 08:00:00.000000 7 main.go:9] failed", "failed", ecslogs.ERROR, nil},
+		{"level=info msg=ready port=8080", "ready", ecslogs.INFO, ecslogs.EventData{"port": "8080"}},
+		// Plain text with a pair in it isn't logfmt.
+		{"Starting server version=1.2", "Starting server version=1.2", ecslogs.NONE, nil},
+		{"  {not json}", "  {not json}", ecslogs.NONE, nil},
+	}
+
+	for _, test := range tests {
+		msg, err := p.Parse([]byte(test.raw))
+
+		if err != nil {
+			t.Errorf("%s: %s", test.raw, err)
+			continue
+		}
+
+		if msg.Event.Message != test.message || msg.Event.Level != test.level {
+			t.Errorf("%s: invalid event: %#v", test.raw, msg.Event)
+		}
+
+		if test.data != nil && !reflect.DeepEqual(msg.Event.Data, test.data) {
+			t.Errorf("%s: invalid data: %#v", test.raw, msg.Event.Data)
+		}
+	}
+}
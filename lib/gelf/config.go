@@ -0,0 +1,120 @@
+package gelf
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+const (
+	// The port that Graylog listens on for GELF inputs by default.
+	defaultPort = "12201"
+
+	// The default size of the UDP datagrams, it fits in the MTU of most
+	// networks once the IP and UDP headers are added.
+	defaultMTU = 1420
+
+	// Chunks smaller than that would waste most of the 128 chunks that a
+	// message can be split into on their headers.
+	minMTU = 128
+)
+
+// config carries the settings of the gelf destination, they are loaded from
+// GELF_* environment variables.
+type config struct {
+	// The network of the Graylog input, one of udp, tcp or tls, and its
+	// address.
+	network string
+	address string
+	tls     *tls.Config
+
+	// The host field of the messages whose event doesn't have one.
+	host string
+
+	// The maximum size of the UDP datagrams, larger messages are chunked.
+	mtu int
+
+	// How long a batch is held while the input can't be reached before it's
+	// dropped.
+	reconnectTimeout time.Duration
+
+	err error
+}
+
+func getConfig() (c config) {
+	var err error
+	var s string
+
+	c.mtu = defaultMTU
+	c.reconnectTimeout = 30 * time.Second
+
+	if s = strings.TrimSpace(lib.Getenv("GELF_URL")); len(s) == 0 {
+		c.err = lib.AppendError(c.err, fmt.Errorf("missing GELF_URL environment variable"))
+	} else if err = c.parseURL(s); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.host = strings.TrimSpace(lib.Getenv("GELF_HOST")); len(c.host) == 0 {
+		c.host, _ = os.Hostname()
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("GELF_MTU")); len(s) != 0 {
+		if c.mtu, err = strconv.Atoi(s); err != nil || c.mtu < minMTU {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid GELF_MTU, must be an integer of at least %d: %s", minMTU, s))
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("GELF_RECONNECT_TIMEOUT")); len(s) != 0 {
+		if c.reconnectTimeout, err = time.ParseDuration(s); err != nil || c.reconnectTimeout < 0 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid GELF_RECONNECT_TIMEOUT, must be a positive duration or zero: %s", s))
+		}
+	}
+
+	if t, err := lib.DestinationTLS("gelf"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	} else if t.Enabled() {
+		if c.network != "tls" {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid GELF_TLS_* settings, the GELF_URL must be a tls:// URL to use them"))
+		} else if c.tls, err = t.Load(); err != nil {
+			c.err = lib.AppendError(c.err, err)
+		}
+	}
+
+	return
+}
+
+func (c config) check() error {
+	return c.err
+}
+
+// parseURL sets the network and address of the input from a URL like
+// udp://graylog:12201.
+func (c *config) parseURL(s string) error {
+	u, err := url.Parse(s)
+
+	if err != nil || len(u.Hostname()) == 0 {
+		return fmt.Errorf("invalid GELF_URL, must be a udp://, tcp:// or tls:// URL: %s", s)
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+	default:
+		return fmt.Errorf("invalid GELF_URL, the protocol must be one of udp, tcp or tls: %s", s)
+	}
+
+	c.network = u.Scheme
+	c.address = u.Host
+
+	if len(u.Port()) == 0 {
+		c.address = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+
+	return nil
+}
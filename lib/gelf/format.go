@@ -0,0 +1,179 @@
+package gelf
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+// The header of the chunks of a UDP message: the two magic bytes, the ID of
+// the message, the index of the chunk and the number of chunks.
+const (
+	chunkHeaderSize = 12
+	maxChunks       = 128
+)
+
+var chunkMagic = [2]byte{0x1e, 0x0f}
+
+var errTooManyChunks = errors.New("the message is too large to be sent over UDP, it takes more than 128 chunks")
+
+// Encode returns the GELF 1.1 payload of msg. The first line of the message is
+// the short message, the full message is only set when there are others. The
+// data of the event become additional fields, named by their path with the
+// levels joined by underscores. host is the host of the events without one.
+func Encode(msg lib.Message, host string) []byte {
+	e := msg.Event
+	fields := make(map[string]interface{}, len(e.Data)+8)
+
+	for k, v := range e.Data {
+		appendField(fields, "_"+fieldName(k), v)
+	}
+
+	// The id additional field is reserved by Graylog.
+	if v, ok := fields["_id"]; ok {
+		delete(fields, "_id")
+		fields["_data_id"] = v
+	}
+
+	if len(e.Info.Host) != 0 {
+		host = e.Info.Host
+	}
+
+	t := e.Time
+
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	text := strings.TrimSpace(e.Message)
+	short := text
+
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		short = strings.TrimSpace(text[:i])
+		fields["full_message"] = text
+	}
+
+	// Graylog rejects the messages whose short message is empty.
+	if len(short) == 0 {
+		short = "-"
+	}
+
+	if len(e.Info.Source) != 0 {
+		fields["_source"] = e.Info.Source
+	}
+
+	if e.Info.PID != 0 {
+		fields["_pid"] = e.Info.PID
+	}
+
+	if len(e.Info.Errors) != 0 {
+		appendField(fields, "_errors", e.Info.Errors)
+	}
+
+	fields["version"] = "1.1"
+	fields["host"] = host
+	fields["short_message"] = short
+	fields["timestamp"] = float64(t.UnixNano()/int64(time.Millisecond)) / 1000
+	fields["level"] = level(e.Level)
+	fields["_group"] = msg.Group
+	fields["_stream"] = msg.Stream
+
+	b, _ := json.Marshal(fields)
+	return b
+}
+
+// level returns the syslog severity of l, the events without a level are
+// informational and the traces are debug messages.
+func level(l ecslogs.Level) int {
+	switch {
+	case l < ecslogs.EMERG:
+		return int(ecslogs.INFO - ecslogs.EMERG)
+	case l > ecslogs.DEBUG:
+		return int(ecslogs.DEBUG - ecslogs.EMERG)
+	default:
+		return int(l - ecslogs.EMERG)
+	}
+}
+
+// appendField adds the value v to fields, the objects are flattened. GELF only
+// has strings and numbers, booleans and arrays are sent as JSON text.
+func appendField(fields map[string]interface{}, name string, v interface{}) {
+	switch x := v.(type) {
+	case nil:
+
+	case ecslogs.EventData:
+		appendField(fields, name, map[string]interface{}(x))
+
+	case map[string]interface{}:
+		for k, e := range x {
+			appendField(fields, name+"_"+fieldName(k), e)
+		}
+
+	case string, json.Number, float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		fields[name] = x
+
+	default:
+		b, _ := json.Marshal(x)
+		s := string(b)
+
+		if len(b) != 0 && b[0] == '"' {
+			json.Unmarshal(b, &s)
+		}
+
+		fields[name] = s
+	}
+}
+
+// fieldName replaces the characters that GELF doesn't allow in the names of
+// additional fields with underscores.
+func fieldName(s string) string {
+	return strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			return c
+		case c == '.', c == '-', c == '_':
+			return c
+		default:
+			return '_'
+		}
+	}, s)
+}
+
+// chunk returns the datagrams that b is sent in over UDP, with at most mtu
+// bytes each. The payloads that fit in a datagram are sent as is, the others
+// are split into chunks which share id so Graylog can reassemble them.
+func chunk(b []byte, mtu int, id [8]byte) ([][]byte, error) {
+	if len(b) <= mtu {
+		return [][]byte{b}, nil
+	}
+
+	size := mtu - chunkHeaderSize
+	count := (len(b) + size - 1) / size
+
+	if count > maxChunks {
+		return nil, errTooManyChunks
+	}
+
+	chunks := make([][]byte, 0, count)
+
+	for i := 0; i != count; i++ {
+		data := b[i*size:]
+
+		if len(data) > size {
+			data = data[:size]
+		}
+
+		c := make([]byte, 0, chunkHeaderSize+len(data))
+		c = append(c, chunkMagic[:]...)
+		c = append(c, id[:]...)
+		c = append(c, byte(i), byte(count))
+		c = append(c, data...)
+		chunks = append(chunks, c)
+	}
+
+	return chunks, nil
+}
@@ -0,0 +1,201 @@
+// Package gelf implements the gelf destination, which sends the messages to a
+// Graylog input in the GELF format, over UDP with chunking of the large
+// messages, or over TCP with null delimited messages.
+package gelf
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/jpillora/backoff"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+)
+
+// How long dialing the input or writing to it may take.
+const writeTimeout = 10 * time.Second
+
+// destination writes to a single connection shared by the writers of all the
+// streams, the batches are written one at a time so the messages sent over TCP
+// aren't interleaved.
+type destination struct {
+	lazy   lib.LazyConfig
+	load   func() config
+	config config
+
+	mutex   sync.Mutex
+	conn    net.Conn
+	backoff backoff.Backoff
+	clock   clock.Clock
+}
+
+func newDestination(load func() config) *destination {
+	return &destination{
+		load:  load,
+		clock: clock.System,
+		backoff: backoff.Backoff{
+			Min:    100 * time.Millisecond,
+			Max:    5 * time.Second,
+			Factor: 2,
+			Jitter: true,
+		},
+	}
+}
+
+func (d *destination) Open(group string, stream string) (w lib.Writer, err error) {
+	if err = d.lazy.Init(d.init); err != nil {
+		return
+	}
+
+	w = writer{dest: d}
+	return
+}
+
+// CheckConfig reports the problems with the GELF_* settings when ecs-logs
+// starts.
+func (d *destination) CheckConfig() error {
+	return d.load().check()
+}
+
+func (d *destination) Close(group string, stream string) {}
+
+func (d *destination) init() error {
+	d.config = d.load()
+	return d.config.check()
+}
+
+func (d *destination) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: writeTimeout}
+
+	if d.config.network == "tls" {
+		return tls.DialWithDialer(dialer, "tcp", d.config.address, d.config.tls)
+	}
+
+	return dialer.Dial(d.config.network, d.config.address)
+}
+
+// write sends the packets on the connection, dialing the input again if the
+// connection was lost. While the input can't be reached the write is retried
+// with an exponential backoff for up to the reconnect timeout.
+//
+// The packets are sent again from the first one after a failure, so the
+// messages that made it before the connection broke are duplicated.
+func (d *destination) write(packets [][]byte) (err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	bo := d.backoff
+	bo.Reset()
+	deadline := d.clock.Now().Add(d.config.reconnectTimeout)
+
+	for {
+		if d.conn == nil {
+			d.conn, err = d.dial()
+		}
+
+		if err == nil {
+			d.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+			for _, p := range packets {
+				if _, err = d.conn.Write(p); err != nil {
+					break
+				}
+			}
+
+			if err == nil {
+				return
+			}
+
+			d.conn.Close()
+			d.conn = nil
+		}
+
+		if !d.clock.Now().Before(deadline) {
+			err = fmt.Errorf("writing to the GELF input %s://%s: %s", d.config.network, d.config.address, err)
+			return
+		}
+
+		d.clock.Sleep(context.Background(), bo.Duration())
+	}
+}
+
+// packets returns what is sent for batch: one buffer of null terminated
+// messages over TCP, or the datagrams of each message over UDP. The messages
+// which can't be sent over UDP are dropped with a warning.
+func (d *destination) packets(batch lib.MessageBatch) (packets [][]byte, size int) {
+	if d.config.network != "udp" {
+		var buf bytes.Buffer
+
+		for _, msg := range batch {
+			buf.Write(Encode(msg, d.config.host))
+			buf.WriteByte(0)
+		}
+
+		return [][]byte{buf.Bytes()}, buf.Len()
+	}
+
+	for _, msg := range batch {
+		var id [8]byte
+		rand.Read(id[:])
+
+		b := Encode(msg, d.config.host)
+		chunks, err := chunk(b, d.config.mtu, id)
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"group":  msg.Group,
+				"stream": msg.Stream,
+				"size":   len(b),
+				"error":  err,
+			}).Warn("dropping a message that doesn't fit in a GELF UDP message")
+			continue
+		}
+
+		for _, c := range chunks {
+			packets = append(packets, c)
+			size += len(c)
+		}
+	}
+
+	return
+}
+
+type writer struct {
+	dest *destination
+}
+
+func (w writer) Close() error {
+	return nil
+}
+
+func (w writer) WriteMessage(msg lib.Message) error {
+	return w.WriteMessageBatch(lib.MessageBatch{msg})
+}
+
+func (w writer) WriteMessageBatch(batch lib.MessageBatch) (err error) {
+	_, err = w.WriteMessageBatchSize(batch)
+	return
+}
+
+// WriteMessageBatchSize sends the GELF messages of batch, and returns the number
+// of bytes written, chunk headers and delimiters included.
+func (w writer) WriteMessageBatchSize(batch lib.MessageBatch) (size int, err error) {
+	packets, size := w.dest.packets(batch)
+
+	if len(packets) == 0 {
+		return
+	}
+
+	if err = w.dest.write(packets); err != nil {
+		size = 0
+	}
+
+	return
+}
@@ -0,0 +1,307 @@
+package gelf
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+func TestEncode(t *testing.T) {
+	msg := lib.Message{
+		Group:  "api",
+		Stream: "1234",
+		Event: ecslogs.Event{
+			Level:   ecslogs.ERROR,
+			Time:    time.Date(2016, 10, 12, 1, 2, 3, 456000000, time.UTC),
+			Info:    ecslogs.EventInfo{Source: "main.go:42"},
+			Message: "request failed\n  at handler\n  at server",
+			Data: ecslogs.EventData{
+				"id":      "req-1",
+				"status":  500,
+				"cached":  false,
+				"user":    map[string]interface{}{"name": "bob", "roles": []interface{}{"admin"}},
+				"omitted": nil,
+				"a key":   "spaces",
+			},
+		},
+	}
+
+	var gelf map[string]interface{}
+
+	if err := json.Unmarshal(Encode(msg, "host-1"), &gelf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"version":       "1.1",
+		"host":          "host-1",
+		"short_message": "request failed",
+		"full_message":  "request failed\n  at handler\n  at server",
+		"timestamp":     1476234123.456,
+		"level":         3.0,
+		"_group":        "api",
+		"_stream":       "1234",
+		"_source":       "main.go:42",
+		"_data_id":      "req-1",
+		"_status":       500.0,
+		"_cached":       "false",
+		"_user_name":    "bob",
+		"_user_roles":   `["admin"]`,
+		"_a_key":        "spaces",
+	}
+
+	for k, v := range expected {
+		if gelf[k] != v {
+			t.Errorf("%s: %#v != %#v", k, gelf[k], v)
+		}
+	}
+
+	for k := range gelf {
+		if _, ok := expected[k]; !ok {
+			t.Errorf("unexpected field %s: %#v", k, gelf[k])
+		}
+	}
+}
+
+func TestEncodeDefaults(t *testing.T) {
+	var gelf map[string]interface{}
+
+	msg := lib.Message{Event: ecslogs.Event{Info: ecslogs.EventInfo{Host: "host-2"}, Time: time.Now()}}
+	json.Unmarshal(Encode(msg, "host-1"), &gelf)
+
+	if gelf["host"] != "host-2" || gelf["short_message"] != "-" || gelf["level"] != 6.0 {
+		t.Errorf("invalid defaults: %v", gelf)
+	}
+
+	if _, ok := gelf["full_message"]; ok {
+		t.Error("a single line message should not have a full message")
+	}
+
+	for l, expected := range map[ecslogs.Level]int{ecslogs.EMERG: 0, ecslogs.WARN: 4, ecslogs.DEBUG: 7, ecslogs.TRACE: 7} {
+		if level(l) != expected {
+			t.Errorf("%s: invalid level: %d != %d", l, level(l), expected)
+		}
+	}
+}
+
+func TestChunk(t *testing.T) {
+	id := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	b := bytes.Repeat([]byte("0123456789"), 50)
+
+	if chunks, _ := chunk(b, 500, id); len(chunks) != 1 || !bytes.Equal(chunks[0], b) {
+		t.Error("a message that fits in a datagram should not be chunked")
+	}
+
+	chunks, err := chunk(b, 200, id)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 188 bytes of payload per chunk.
+	if len(chunks) != 3 {
+		t.Fatalf("the message should be split in 3 chunks, got %d", len(chunks))
+	}
+
+	var join []byte
+
+	for i, c := range chunks {
+		if len(c) > 200 {
+			t.Errorf("chunk %d is larger than the MTU: %d", i, len(c))
+		}
+
+		if c[0] != 0x1e || c[1] != 0x0f || !bytes.Equal(c[2:10], id[:]) || c[10] != byte(i) || c[11] != 3 {
+			t.Errorf("invalid header of chunk %d: %v", i, c[:12])
+		}
+
+		join = append(join, c[12:]...)
+	}
+
+	if !bytes.Equal(join, b) {
+		t.Error("the chunks should carry the whole message")
+	}
+
+	if _, err := chunk(make([]byte, 128*188+1), 200, id); err != errTooManyChunks {
+		t.Error("a message of more than 128 chunks should be rejected:", err)
+	}
+}
+
+func TestWriterUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	d := newTestDestination(config{network: "udp", address: conn.LocalAddr().String(), host: "h", mtu: 200})
+	w, _ := d.Open("A", "B")
+
+	large := makeMessage(strings.Repeat("x", 300))
+	huge := makeMessage(strings.Repeat("x", 128*188))
+
+	if err := w.WriteMessageBatch(lib.MessageBatch{large, huge}); err != nil {
+		t.Fatal(err)
+	}
+
+	var payload []byte
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for i := 0; i != 3; i++ {
+		b := make([]byte, 1000)
+		n, _, err := conn.ReadFrom(b)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n > 200 || b[0] != 0x1e || b[1] != 0x0f || b[10] != byte(i) || b[11] != 3 {
+			t.Fatalf("invalid chunk %d of %d bytes: %v", i, n, b[:12])
+		}
+
+		payload = append(payload, b[12:n]...)
+	}
+
+	if !bytes.Equal(payload, Encode(large, "h")) {
+		t.Errorf("invalid payload reassembled from the chunks: %s", payload)
+	}
+
+	// The message too large for UDP was dropped.
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	if n, _, err := conn.ReadFrom(make([]byte, 1000)); err == nil {
+		t.Errorf("no more datagrams should be received, got %d bytes", n)
+	}
+}
+
+func TestWriterTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var mutex sync.Mutex
+	var data bytes.Buffer
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		b := make([]byte, 4096)
+		for {
+			n, err := conn.Read(b)
+			mutex.Lock()
+			data.Write(b[:n])
+			mutex.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	d := newTestDestination(config{network: "tcp", address: l.Addr().String(), host: "h"})
+	w, _ := d.Open("A", "B")
+
+	batch := lib.MessageBatch{makeMessage("hello"), makeMessage("multi\nline")}
+	size, err := w.(lib.SizedWriter).WriteMessageBatchSize(batch)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ref []byte
+
+	for _, msg := range batch {
+		ref = append(ref, Encode(msg, "h")...)
+		ref = append(ref, 0)
+	}
+
+	if size != len(ref) {
+		t.Errorf("invalid size: %d != %d", size, len(ref))
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		mutex.Lock()
+		n := data.Len()
+		mutex.Unlock()
+
+		if n >= len(ref) {
+			break
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !bytes.Equal(data.Bytes(), ref) {
+		t.Errorf("the messages should be null delimited:\n- expected: %q\n- found:    %q", ref, data.Bytes())
+	}
+
+	if frames := bytes.Split(bytes.TrimSuffix(data.Bytes(), []byte{0}), []byte{0}); len(frames) != 2 {
+		t.Errorf("two frames should be received, got %d", len(frames))
+	}
+
+	d.conn.Close()
+}
+
+func TestConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(map[string]string{
+		"GELF_URL":  "udp://graylog",
+		"GELF_HOST": "web-1",
+		"GELF_MTU":  "8192",
+	})
+
+	if c := getConfig(); c.check() != nil || c.network != "udp" || c.address != "graylog:12201" || c.host != "web-1" || c.mtu != 8192 {
+		t.Errorf("invalid config: %+v", c)
+	}
+
+	for _, env := range []map[string]string{
+		{},
+		{"GELF_URL": "http://graylog:12201"},
+		{"GELF_URL": "udp://graylog", "GELF_MTU": "64"},
+		{"GELF_URL": "tcp://graylog", "GELF_RECONNECT_TIMEOUT": "soon"},
+		{"GELF_URL": "tcp://graylog", "GELF_TLS_INSECURE": "true"},
+	} {
+		lib.SetConfigEnv(env)
+
+		if err := getConfig().check(); err == nil {
+			t.Errorf("%v: the configuration should be rejected", env)
+		}
+	}
+}
+
+func newTestDestination(c config) *destination {
+	if c.mtu == 0 {
+		c.mtu = defaultMTU
+	}
+
+	c.reconnectTimeout = time.Second
+	d := newDestination(func() config { return c })
+	d.backoff.Min, d.backoff.Max = time.Millisecond, 10*time.Millisecond
+	return d
+}
+
+func makeMessage(message string) lib.Message {
+	return lib.Message{
+		Group:  "A",
+		Stream: "B",
+		Event:  ecslogs.Event{Message: message, Time: time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC)},
+	}
+}
@@ -0,0 +1,7 @@
+package gelf
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterDestination("gelf", newDestination(getConfig))
+}
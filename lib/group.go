@@ -2,6 +2,8 @@ package lib
 
 import (
 	"fmt"
+	"math"
+	"sort"
 	"time"
 )
 
@@ -10,14 +12,28 @@ type Group struct {
 	streams   map[string]*Stream
 	createdOn time.Time
 	updatedOn time.Time
+	flushedOn time.Time
 }
 
+// StreamBatch is a batch flushed from a stream of a group, with the reason it
+// was flushed.
+type StreamBatch struct {
+	Stream *Stream
+	Batch  MessageBatch
+	Reason string
+}
+
+// GroupWindowElapsed is the reason of the batches flushed by Group.Flush when
+// the batching window of their group elapsed.
+const GroupWindowElapsed = "group window elapsed"
+
 func NewGroup(name string, now time.Time) *Group {
 	return &Group{
 		name:      name,
 		streams:   make(map[string]*Stream),
 		createdOn: now,
 		updatedOn: now,
+		flushedOn: now,
 	}
 }
 
@@ -59,3 +75,70 @@ func (group *Group) ForEach(f func(*Stream)) {
 		f(stream)
 	}
 }
+
+// Flush returns the batches of the streams of the group that are ready to be
+// written, the streams whose oldest message waited the longest come first so
+// none of them starves when the destinations are rate limited.
+//
+// With a GroupWindow in limits the streams are flushed all at once when the
+// window elapsed since the last time, or when the oldest message of one of
+// them reached the MaxLatency, so the group issues at most one call per stream
+// and per window.
+func (group *Group) Flush(limits StreamLimits, now time.Time) (batches []StreamBatch) {
+	streams := make([]*Stream, 0, len(group.streams))
+
+	for _, stream := range group.streams {
+		streams = append(streams, stream)
+	}
+
+	sort.Slice(streams, func(i int, j int) bool {
+		a, b := streams[i], streams[j]
+
+		// The empty streams have no oldest message, they come last.
+		if a.addedOn.IsZero() != b.addedOn.IsZero() {
+			return b.addedOn.IsZero()
+		}
+
+		if !a.addedOn.Equal(b.addedOn) {
+			return a.addedOn.Before(b.addedOn)
+		}
+
+		return a.name < b.name
+	})
+
+	reason := ""
+
+	if limits.GroupWindow > 0 && !limits.Force {
+		switch {
+		case limits.MaxLatency > 0 && len(streams) != 0 && !streams[0].addedOn.IsZero() && now.Sub(streams[0].addedOn) >= limits.MaxLatency:
+			reason = MaxLatencyExceeded
+		case now.Sub(group.flushedOn) >= limits.GroupWindow:
+			reason = GroupWindowElapsed
+		}
+
+		// The streams are flushed whole, only the size limits still split
+		// their messages in several batches.
+		if len(reason) != 0 {
+			limits.Force, limits.MaxLatency, limits.MaxTime = true, 0, math.MaxInt64
+			group.flushedOn = now
+		}
+	}
+
+	for _, stream := range streams {
+		for {
+			batch, r := stream.Flush(limits, now)
+
+			if len(batch) == 0 {
+				break
+			}
+
+			if len(reason) != 0 && r == "forced flushing" {
+				r = reason
+			}
+
+			batches = append(batches, StreamBatch{Stream: stream, Batch: batch, Reason: r})
+		}
+	}
+
+	return
+}
@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+// simulateGroup adds a message to each of the 50 streams of a group every
+// second, 20ms apart from one stream to the next, and flushes the group every
+// half second like the ticker of ecs-logs does. It returns the flushed batches.
+func simulateGroup(limits StreamLimits, duration time.Duration) (batches []StreamBatch) {
+	start := time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC)
+	group := NewGroup("A", start)
+
+	for t := time.Duration(0); t < duration; t += 10 * time.Millisecond {
+		now := start.Add(t)
+
+		if t%(500*time.Millisecond) == 0 {
+			batches = append(batches, group.Flush(limits, now)...)
+		}
+
+		for i := 0; i != 50; i++ {
+			if t%time.Second == time.Duration(i)*20*time.Millisecond {
+				group.Add(Message{Group: "A", Stream: fmt.Sprint(i), Event: ecslogs.Event{Message: "hello", Time: now}}, now)
+			}
+		}
+	}
+
+	return
+}
+
+func TestGroupFlushWindow(t *testing.T) {
+	limits := StreamLimits{
+		MaxCount: 10000,
+		MaxBytes: 1000000,
+		MaxTime:  5 * time.Second,
+	}
+
+	// Each stream flushes on its own time limit, the streams that got their
+	// first message right after a flush wait for the next one.
+	without := simulateGroup(limits, 60*time.Second)
+
+	limits.GroupWindow = 20 * time.Second
+	with := simulateGroup(limits, 60*time.Second)
+
+	// The window elapses at 20s and 40s, every stream is flushed once each
+	// time with all the messages it buffered.
+	if len(with) != 100 {
+		t.Errorf("the group should be flushed with one batch per stream and per window, got %d batches", len(with))
+	}
+
+	for _, b := range with {
+		if b.Reason != GroupWindowElapsed {
+			t.Errorf("invalid reason of the batch of stream %s: %s", b.Stream.Name(), b.Reason)
+		}
+
+		if len(b.Batch) != 20 {
+			t.Errorf("the batch of stream %s should have 20 messages, got %d", b.Stream.Name(), len(b.Batch))
+			break
+		}
+	}
+
+	if len(without) <= len(with) {
+		t.Errorf("the window should reduce the number of calls: %d without it, %d with it", len(without), len(with))
+	}
+}
+
+func TestGroupFlushWindowLimits(t *testing.T) {
+	now := time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC)
+	group := NewGroup("A", now)
+	limits := StreamLimits{
+		MaxCount:    3,
+		MaxBytes:    1000000,
+		MaxTime:     time.Second,
+		GroupWindow: time.Minute,
+		MaxLatency:  30 * time.Second,
+	}
+
+	for i := 0; i != 4; i++ {
+		group.Add(Message{Group: "A", Stream: "busy", Event: ecslogs.Event{Message: "hello"}}, now)
+	}
+
+	group.Add(Message{Group: "A", Stream: "quiet", Event: ecslogs.Event{Message: "hello"}}, now)
+
+	// The busy stream reached the count limit, it doesn't wait for the
+	// window, neither does the rest of the group.
+	batches := group.Flush(limits, now.Add(2*time.Second))
+
+	if len(batches) != 1 || batches[0].Stream.Name() != "busy" || len(batches[0].Batch) != 3 {
+		t.Fatalf("only the full batch should be flushed: %+v", batches)
+	}
+
+	// The oldest message reached the maximum latency before the window,
+	// the whole group is flushed urgently.
+	batches = group.Flush(limits, now.Add(30*time.Second))
+
+	if len(batches) != 2 {
+		t.Fatalf("the group should be flushed, got %d batches", len(batches))
+	}
+
+	for _, b := range batches {
+		if b.Reason != MaxLatencyExceeded {
+			t.Errorf("invalid reason of the batch of stream %s: %s", b.Stream.Name(), b.Reason)
+		}
+	}
+
+	if batches := group.Flush(forced(limits), now.Add(31*time.Second)); len(batches) != 0 {
+		t.Error("the group should be empty:", batches)
+	}
+}
+
+func TestGroupFlushOrder(t *testing.T) {
+	now := time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC)
+	group := NewGroup("A", now)
+
+	for i, name := range []string{"c", "a", "d", "b"} {
+		at := now.Add(time.Duration(i) * time.Second)
+		group.Add(Message{Group: "A", Stream: name, Event: ecslogs.Event{Message: "hello"}}, at)
+	}
+
+	// The stream whose oldest message waited the longest goes first.
+	batches := group.Flush(forced(StreamLimits{MaxCount: 10, MaxBytes: 1000}), now.Add(10*time.Second))
+	order := ""
+
+	for _, b := range batches {
+		order += b.Stream.Name()
+	}
+
+	if order != "cadb" {
+		t.Error("invalid order of the streams:", order)
+	}
+}
+
+func forced(limits StreamLimits) StreamLimits {
+	limits.Force = true
+	return limits
+}
@@ -0,0 +1,305 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ecs-logs/lib/clock"
+)
+
+// Health tracks the state of the sources and destinations of ecs-logs so an
+// orchestrator can restart a forwarder that got wedged, it's served on the
+// /healthz and /readyz endpoints.
+//
+// ecs-logs is unhealthy when one of its sources has been reconnecting for
+// longer than the window, when a destination failed all its writes for longer
+// than the window, or when the sources have been held because the queues are
+// saturated for longer than the window. It isn't ready before it started
+// reading the sources, and while a source is reconnecting or the sources are
+// held.
+//
+// A nil Health ignores the events, it's what the tests use.
+type Health struct {
+	Window time.Duration
+
+	clock clock.Clock
+	mutex sync.Mutex
+	ready bool
+
+	sources      map[string]*sourceHealth
+	destinations map[string]*destinationHealth
+
+	// Why the sources are held, and since when, empty while they're read.
+	saturation     string
+	saturatedSince time.Time
+}
+
+type sourceHealth struct {
+	connected bool
+	since     time.Time
+	err       error
+}
+
+type destinationHealth struct {
+	lastSuccess time.Time
+	lastFailure time.Time
+	err         error
+
+	// The time of the first failure after the last success, zero while the
+	// writes succeed.
+	failingSince time.Time
+}
+
+// HealthReport is the JSON body of the responses of the health endpoints.
+type HealthReport struct {
+	Status       string                             `json:"status"`
+	Problems     []string                           `json:"problems,omitempty"`
+	Sources      map[string]SourceHealthReport      `json:"sources,omitempty"`
+	Destinations map[string]DestinationHealthReport `json:"destinations,omitempty"`
+	Saturation   *SaturationReport                  `json:"saturation,omitempty"`
+}
+
+type SourceHealthReport struct {
+	Connected bool      `json:"connected"`
+	Since     time.Time `json:"since"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type DestinationHealthReport struct {
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+type SaturationReport struct {
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+}
+
+func NewHealth(window time.Duration, clock clock.Clock) *Health {
+	return &Health{
+		Window:       window,
+		clock:        clock,
+		sources:      make(map[string]*sourceHealth),
+		destinations: make(map[string]*destinationHealth),
+	}
+}
+
+// SetReady is called once the sources are being read.
+func (h *Health) SetReady() {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	h.ready = true
+	h.mutex.Unlock()
+}
+
+// SourceConnected records that the source name was opened.
+func (h *Health) SourceConnected(name string) {
+	h.source(name, true, nil)
+}
+
+// SourceDisconnected records that reading the source name failed with err, and
+// that it's being opened again.
+func (h *Health) SourceDisconnected(name string, err error) {
+	h.source(name, false, err)
+}
+
+func (h *Health) source(name string, connected bool, err error) {
+	if h == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s := h.sources[name]
+
+	if s == nil || s.connected != connected {
+		h.sources[name] = &sourceHealth{connected: connected, since: h.clock.Now(), err: err}
+	} else if err != nil {
+		s.err = err
+	}
+}
+
+// Delivered records that a batch was written to the destination name.
+func (h *Health) Delivered(name string) {
+	if h == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	d := h.destination(name)
+	d.lastSuccess = h.clock.Now()
+	d.failingSince = time.Time{}
+	h.mutex.Unlock()
+}
+
+// Failed records that a batch couldn't be written to the destination name.
+func (h *Health) Failed(name string, err error) {
+	if h == nil {
+		return
+	}
+
+	h.mutex.Lock()
+	d := h.destination(name)
+	d.lastFailure, d.err = h.clock.Now(), err
+
+	if d.failingSince.IsZero() {
+		d.failingSince = d.lastFailure
+	}
+
+	h.mutex.Unlock()
+}
+
+func (h *Health) destination(name string) *destinationHealth {
+	d := h.destinations[name]
+
+	if d == nil {
+		d = &destinationHealth{}
+		h.destinations[name] = d
+	}
+
+	return d
+}
+
+// Saturated records why the sources are held, an empty reason means they're
+// read again.
+func (h *Health) Saturated(reason string) {
+	if h == nil {
+		return
+	}
+
+	h.mutex.Lock()
+
+	if reason != h.saturation {
+		if len(h.saturation) == 0 {
+			h.saturatedSince = h.clock.Now()
+		}
+		h.saturation = reason
+	}
+
+	h.mutex.Unlock()
+}
+
+// Check returns the report of the liveness of ecs-logs, or of its readiness
+// when ready is true, and whether it passed.
+func (h *Health) Check(ready bool) (report HealthReport, ok bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := h.clock.Now()
+	fail := func(format string, args ...interface{}) {
+		report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+	}
+
+	if ready && !h.ready {
+		fail("the sources aren't being read yet")
+	}
+
+	if len(h.sources) != 0 {
+		report.Sources = make(map[string]SourceHealthReport, len(h.sources))
+	}
+
+	names := make([]string, 0, len(h.sources))
+
+	for name := range h.sources {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		s := h.sources[name]
+		r := SourceHealthReport{Connected: s.connected, Since: s.since}
+
+		if s.err != nil {
+			r.Error = s.err.Error()
+		}
+
+		if !s.connected {
+			if age := now.Sub(s.since); ready || age > h.Window {
+				fail("the %s source has been reconnecting for %s", name, age)
+			}
+		}
+
+		report.Sources[name] = r
+	}
+
+	if len(h.destinations) != 0 {
+		report.Destinations = make(map[string]DestinationHealthReport, len(h.destinations))
+	}
+
+	names = make([]string, 0, len(h.destinations))
+
+	for name := range h.destinations {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		d := h.destinations[name]
+		r := DestinationHealthReport{}
+
+		if !d.lastSuccess.IsZero() {
+			t := d.lastSuccess
+			r.LastSuccess = &t
+		}
+
+		if !d.lastFailure.IsZero() {
+			t := d.lastFailure
+			r.LastFailure = &t
+		}
+
+		if d.err != nil {
+			r.Error = d.err.Error()
+		}
+
+		if !d.failingSince.IsZero() {
+			if age := now.Sub(d.failingSince); age > h.Window {
+				fail("the writes to the %s destination have been failing for %s", name, age)
+			}
+		}
+
+		report.Destinations[name] = r
+	}
+
+	if len(h.saturation) != 0 {
+		report.Saturation = &SaturationReport{Reason: h.saturation, Since: h.saturatedSince}
+
+		if age := now.Sub(h.saturatedSince); ready || age > h.Window {
+			fail("the sources have been held for %s, %s", age, h.saturation)
+		}
+	}
+
+	if ok = len(report.Problems) == 0; ok {
+		report.Status = "ok"
+	} else {
+		report.Status = "unhealthy"
+	}
+
+	return
+}
+
+// Handler returns the handler of the /healthz endpoint, or of /readyz when
+// ready is true. It responds with the JSON report and a 503 status when the
+// check fails.
+func (h *Health) Handler(ready bool) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		report, ok := h.Check(ready)
+
+		res.Header().Set("Content-Type", "application/json")
+
+		if !ok {
+			res.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		json.NewEncoder(res).Encode(report)
+	})
+}
@@ -0,0 +1,130 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs/lib/clock"
+)
+
+func TestHealthDestinations(t *testing.T) {
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	h := NewHealth(time.Minute, c)
+	h.SetReady()
+
+	h.Delivered("sqs")
+	h.Failed("sqs", errors.New("throttled"))
+	c.Advance(30 * time.Second)
+	h.Failed("sqs", errors.New("throttled"))
+
+	if report, ok := h.Check(false); !ok {
+		t.Errorf("the destination hasn't been failing for longer than the window: %+v", report)
+	}
+
+	c.Advance(31 * time.Second)
+
+	report, ok := h.Check(false)
+
+	if ok || len(report.Problems) != 1 || report.Status != "unhealthy" {
+		t.Errorf("the destination failed all its writes for longer than the window: %+v", report)
+	}
+
+	if d := report.Destinations["sqs"]; d.Error != "throttled" || d.LastSuccess == nil || d.LastFailure == nil {
+		t.Errorf("invalid destination report: %+v", d)
+	}
+
+	h.Delivered("sqs")
+
+	if report, ok := h.Check(false); !ok {
+		t.Errorf("a success should make the destination healthy again: %+v", report)
+	}
+}
+
+func TestHealthSources(t *testing.T) {
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	h := NewHealth(time.Minute, c)
+
+	if report, ok := h.Check(true); ok {
+		t.Errorf("ecs-logs isn't ready before reading the sources: %+v", report)
+	}
+
+	h.SourceConnected("stdin")
+	h.SetReady()
+
+	if report, ok := h.Check(true); !ok {
+		t.Errorf("ecs-logs should be ready: %+v", report)
+	}
+
+	h.SourceDisconnected("stdin", errors.New("broken pipe"))
+
+	if _, ok := h.Check(true); ok {
+		t.Error("ecs-logs isn't ready while a source is reconnecting")
+	}
+
+	if report, ok := h.Check(false); !ok {
+		t.Errorf("a source that just started reconnecting is still healthy: %+v", report)
+	}
+
+	c.Advance(2 * time.Minute)
+
+	if report, ok := h.Check(false); ok || report.Sources["stdin"].Connected || report.Sources["stdin"].Error != "broken pipe" {
+		t.Errorf("a source reconnecting for longer than the window is unhealthy: %+v", report)
+	}
+}
+
+func TestHealthSaturation(t *testing.T) {
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	h := NewHealth(time.Minute, c)
+	h.SetReady()
+
+	h.Saturated("the memory budget is almost exhausted")
+	c.Advance(10 * time.Second)
+
+	if _, ok := h.Check(true); ok {
+		t.Error("ecs-logs isn't ready while the sources are held")
+	}
+
+	c.Advance(time.Minute)
+	h.Saturated("the queue of a stream of the sqs destination is full")
+
+	// The sources were held for the whole time, for different reasons.
+	report, ok := h.Check(false)
+
+	if ok || report.Saturation == nil || !report.Saturation.Since.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("the sources were held for longer than the window: %+v", report)
+	}
+
+	h.Saturated("")
+
+	if report, ok := h.Check(true); !ok {
+		t.Errorf("ecs-logs should be ready once the sources are read again: %+v", report)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	h := NewHealth(time.Minute, clock.NewFake(time.Now()))
+
+	res := httptest.NewRecorder()
+	h.Handler(true).ServeHTTP(res, httptest.NewRequest("GET", "/readyz", nil))
+
+	var report HealthReport
+
+	if err := json.Unmarshal(res.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Code != http.StatusServiceUnavailable || report.Status != "unhealthy" || len(report.Problems) != 1 {
+		t.Errorf("invalid response: %d %s", res.Code, res.Body)
+	}
+
+	res = httptest.NewRecorder()
+	h.Handler(false).ServeHTTP(res, httptest.NewRequest("GET", "/healthz", nil))
+
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("invalid response: %d %s", res.Code, res.Body)
+	}
+}
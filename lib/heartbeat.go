@@ -0,0 +1,166 @@
+package lib
+
+import (
+	"sort"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+const (
+	// SelfField is the data field marking the messages that ecs-logs emits
+	// about itself, its value is the kind of message.
+	SelfField = "self"
+
+	// HeartbeatField is the data field of heartbeats carrying the counters.
+	HeartbeatField = "heartbeat"
+)
+
+// Heartbeat emits a message reporting the health of ecs-logs at a regular
+// interval, a shipper that stopped sending them is dead or stuck.
+//
+// The counters come from the metrics registry: received_messages for the
+// messages read from the sources, and delivered_messages and dropped_messages
+// for the destinations.
+type Heartbeat struct {
+	Interval time.Duration
+	Group    string
+	Stream   string
+	Hostname string
+
+	registry *metrics.Registry
+	clock    clock.Clock
+	start    time.Time
+	last     time.Time
+
+	// The values of the destination counters at the last heartbeat, the
+	// heartbeats report what happened since.
+	delivered map[string]int64
+	dropped   map[string]int64
+}
+
+// HeartbeatStats are the counters carried by heartbeats.
+type HeartbeatStats struct {
+	Uptime       float64                              `json:"uptime_seconds"`
+	Processed    int64                                `json:"messages_processed"`
+	Backlog      int                                  `json:"backlog"`
+	Destinations map[string]HeartbeatDestinationStats `json:"destinations,omitempty"`
+}
+
+// HeartbeatDestinationStats are the counters of a destination since the
+// previous heartbeat, the error rate is the fraction of the messages written
+// to the destination that were dropped.
+type HeartbeatDestinationStats struct {
+	Delivered int64   `json:"delivered"`
+	Dropped   int64   `json:"dropped"`
+	ErrorRate float64 `json:"error_rate"`
+}
+
+func NewHeartbeat(interval time.Duration, group string, stream string, hostname string, registry *metrics.Registry, clock clock.Clock) *Heartbeat {
+	now := clock.Now()
+	return &Heartbeat{
+		Interval:  interval,
+		Group:     group,
+		Stream:    stream,
+		Hostname:  hostname,
+		registry:  registry,
+		clock:     clock,
+		start:     now,
+		last:      now,
+		delivered: make(map[string]int64),
+		dropped:   make(map[string]int64),
+	}
+}
+
+// Beat returns the heartbeat message if the interval elapsed since the last
+// one, backlog is the number of messages that ecs-logs is holding.
+func (h *Heartbeat) Beat(backlog int) (msg Message, ok bool) {
+	now := h.clock.Now()
+
+	if h.Interval <= 0 || now.Sub(h.last) < h.Interval {
+		return
+	}
+
+	h.last = now
+	stats := h.stats(now, backlog)
+
+	msg = Message{
+		Group:  h.Group,
+		Stream: h.Stream,
+		Event: ecslogs.Event{
+			Level:   ecslogs.INFO,
+			Time:    now,
+			Message: "heartbeat",
+			Info:    ecslogs.EventInfo{Host: h.Hostname},
+			Data: ecslogs.EventData{
+				SelfField:      HeartbeatField,
+				HeartbeatField: stats,
+			},
+		},
+	}
+	ok = true
+	return
+}
+
+func (h *Heartbeat) stats(now time.Time, backlog int) (stats HeartbeatStats) {
+	delivered := make(map[string]int64)
+	dropped := make(map[string]int64)
+
+	for _, s := range h.registry.Snapshot() {
+		switch s.Name {
+		case "received_messages":
+			stats.Processed += s.Value
+		case "delivered_messages":
+			delivered[s.Labels["destination"]] += s.Value
+		case "dropped_messages":
+			dropped[s.Labels["destination"]] += s.Value
+		}
+	}
+
+	names := make([]string, 0, len(delivered)+len(dropped))
+
+	for name := range delivered {
+		names = append(names, name)
+	}
+
+	for name := range dropped {
+		if _, ok := delivered[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	stats.Uptime = now.Sub(h.start).Seconds()
+	stats.Backlog = backlog
+
+	for _, name := range names {
+		// The delivered counters of a stream are removed when the stream
+		// expires, the difference is clamped so it never goes negative.
+		d := HeartbeatDestinationStats{
+			Delivered: positive(delivered[name] - h.delivered[name]),
+			Dropped:   positive(dropped[name] - h.dropped[name]),
+		}
+
+		if total := d.Delivered + d.Dropped; total != 0 {
+			d.ErrorRate = float64(d.Dropped) / float64(total)
+		}
+
+		if stats.Destinations == nil {
+			stats.Destinations = make(map[string]HeartbeatDestinationStats, len(names))
+		}
+
+		stats.Destinations[name] = d
+	}
+
+	h.delivered, h.dropped = delivered, dropped
+	return
+}
+
+func positive(n int64) int64 {
+	if n < 0 {
+		return 0
+	}
+	return n
+}
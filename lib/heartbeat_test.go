@@ -0,0 +1,125 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+func TestHeartbeatSchedule(t *testing.T) {
+	c := clock.NewFake(time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC))
+	h := NewHeartbeat(time.Minute, "ecs-logs-heartbeat", "host-1", "host-1", metrics.NewRegistry(), c)
+
+	if _, ok := h.Beat(0); ok {
+		t.Error("no heartbeat should be emitted before the interval elapsed")
+	}
+
+	c.Advance(59 * time.Second)
+
+	if _, ok := h.Beat(0); ok {
+		t.Error("no heartbeat should be emitted before the interval elapsed")
+	}
+
+	c.Advance(time.Second)
+	msg, ok := h.Beat(0)
+
+	if !ok {
+		t.Fatal("a heartbeat should be emitted once the interval elapsed")
+	}
+
+	if msg.Group != "ecs-logs-heartbeat" || msg.Stream != "host-1" || msg.Event.Info.Host != "host-1" || msg.Event.Level != ecslogs.INFO || !msg.Event.Time.Equal(c.Now()) {
+		t.Errorf("invalid heartbeat: %+v", msg)
+	}
+
+	if msg.Event.Data[SelfField] != HeartbeatField {
+		t.Errorf("the heartbeat should be tagged as a self-message: %v", msg.Event.Data)
+	}
+
+	// The next heartbeat is a full interval after the last one.
+	c.Advance(30 * time.Second)
+
+	if _, ok := h.Beat(0); ok {
+		t.Error("no heartbeat should be emitted less than an interval after the last one")
+	}
+
+	c.Advance(30 * time.Second)
+
+	if _, ok := h.Beat(0); !ok {
+		t.Error("a heartbeat should be emitted an interval after the last one")
+	}
+
+	h.Interval = 0
+	c.Advance(time.Hour)
+
+	if _, ok := h.Beat(0); ok {
+		t.Error("a zero interval should disable the heartbeats")
+	}
+}
+
+func TestHeartbeatStats(t *testing.T) {
+	c := clock.NewFake(time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC))
+	r := metrics.NewRegistry()
+	h := NewHeartbeat(time.Minute, "ecs-logs-heartbeat", "host-1", "host-1", r, c)
+
+	r.Counter("received_messages", "source", "stdin").Add(10)
+	r.Counter("received_messages", "source", "syslog").Add(5)
+	r.Counter("delivered_messages", "group", "A", "stream", "1", "destination", "cloudwatchlogs").Add(6)
+	r.Counter("delivered_messages", "group", "A", "stream", "2", "destination", "cloudwatchlogs").Add(3)
+	r.Counter("dropped_messages", "destination", "cloudwatchlogs").Add(1)
+	r.Counter("delivered_messages", "group", "A", "stream", "1", "destination", "stdout").Add(10)
+
+	c.Advance(time.Minute)
+	stats := beat(t, h, 42)
+
+	ref := HeartbeatStats{
+		Uptime:    60,
+		Processed: 15,
+		Backlog:   42,
+		Destinations: map[string]HeartbeatDestinationStats{
+			"cloudwatchlogs": {Delivered: 9, Dropped: 1, ErrorRate: 0.1},
+			"stdout":         {Delivered: 10},
+		},
+	}
+
+	if !reflect.DeepEqual(stats, ref) {
+		t.Errorf("invalid heartbeat stats:\n- expected: %+v\n- found:    %+v", ref, stats)
+	}
+
+	// The destination counters are reported since the previous heartbeat,
+	// the counters of a stream that expired don't go negative.
+	r.Counter("received_messages", "source", "stdin").Add(5)
+	r.Counter("dropped_messages", "destination", "cloudwatchlogs").Add(1)
+	r.Counter("delivered_messages", "group", "A", "stream", "1", "destination", "stdout").Add(4)
+	r.Remove("group", "A", "stream", "2")
+
+	c.Advance(time.Minute)
+	stats = beat(t, h, 0)
+
+	ref = HeartbeatStats{
+		Uptime:    120,
+		Processed: 20,
+		Destinations: map[string]HeartbeatDestinationStats{
+			"cloudwatchlogs": {Dropped: 1, ErrorRate: 1},
+			"stdout":         {Delivered: 4},
+		},
+	}
+
+	if !reflect.DeepEqual(stats, ref) {
+		t.Errorf("invalid heartbeat stats:\n- expected: %+v\n- found:    %+v", ref, stats)
+	}
+}
+
+func beat(t *testing.T, h *Heartbeat, backlog int) HeartbeatStats {
+	msg, ok := h.Beat(backlog)
+
+	if !ok {
+		t.Fatal("a heartbeat should have been emitted")
+	}
+
+	stats, _ := msg.Event.Data[HeartbeatField].(HeartbeatStats)
+	return stats
+}
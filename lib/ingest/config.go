@@ -0,0 +1,47 @@
+package ingest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+// config carries the settings of the http source, they are loaded from HTTP_*
+// environment variables.
+type config struct {
+	// The address the source listens on.
+	addr string
+
+	// The maximum size of a request body once decompressed, bigger requests
+	// are rejected.
+	maxBodySize int64
+
+	// The parser of the lines of request bodies, when nil the bodies carry a
+	// stream of JSON messages like the stdin source.
+	parser lib.Parser
+}
+
+func getConfig() (c config, err error) {
+	var s string
+
+	c = config{
+		addr:        strings.TrimSpace(lib.Getenv("HTTP_ADDR")),
+		maxBodySize: 10 * 1024 * 1024,
+	}
+
+	if len(c.addr) == 0 {
+		c.addr = ":8080"
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("HTTP_MAX_BODY_SIZE")); len(s) != 0 {
+		if c.maxBodySize, err = strconv.ParseInt(s, 10, 64); err != nil || c.maxBodySize <= 0 {
+			err = fmt.Errorf("invalid HTTP_MAX_BODY_SIZE, must be a positive number of bytes: %s", s)
+			return
+		}
+	}
+
+	c.parser, err = lib.SourceParser("http")
+	return
+}
@@ -0,0 +1,206 @@
+// Package ingest implements the http source, which receives log messages
+// pushed by clients in the body of POST requests.
+package ingest
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+var (
+	errTooLarge            = errors.New("the decompressed request body exceeds the maximum size")
+	errUnsupportedEncoding = errors.New("unsupported content encoding")
+)
+
+func NewReader() (r lib.Reader, err error) {
+	var c config
+	var l net.Listener
+	var f lib.NameFilter
+
+	if c, err = getConfig(); err != nil {
+		return
+	}
+
+	if f, err = lib.SourceFilter("http"); err != nil {
+		return
+	}
+
+	if l, err = net.Listen("tcp", c.addr); err != nil {
+		return
+	}
+
+	rd := newReader(c)
+	rd.server = &http.Server{Handler: rd}
+	go rd.server.Serve(l)
+
+	r = lib.NewFilteredReader("http", rd, f, metrics.Default)
+	return
+}
+
+// reader serves the HTTP endpoint and hands the messages of each request to
+// ReadMessage, requests only complete once all their messages were read so
+// clients are slowed down when ecs-logs can't keep up.
+type reader struct {
+	config config
+	server *http.Server
+	msgs   chan lib.Message
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newReader(c config) *reader {
+	return &reader{
+		config: c,
+		msgs:   make(chan lib.Message),
+		done:   make(chan struct{}),
+	}
+}
+
+func (r *reader) Close() (err error) {
+	r.once.Do(func() {
+		close(r.done)
+
+		if r.server != nil {
+			err = r.server.Close()
+		}
+	})
+	return
+}
+
+func (r *reader) ReadMessage() (msg lib.Message, err error) {
+	select {
+	case msg = <-r.msgs:
+	case <-r.done:
+		err = io.EOF
+	}
+	return
+}
+
+func (r *reader) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.Header().Set("Allow", "POST")
+		http.Error(res, "only POST requests are accepted", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := decodeBody(req)
+
+	switch err {
+	case nil:
+	case errUnsupportedEncoding:
+		http.Error(res, "unsupported content encoding, must be one of gzip or deflate: "+req.Header.Get("Content-Encoding"), http.StatusUnsupportedMediaType)
+		return
+	default:
+		http.Error(res, "malformed request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The whole body is parsed before the messages are forwarded so a request
+	// is either accepted or rejected entirely.
+	msgs, err := r.parse(&limitedReader{R: body, N: r.config.maxBodySize})
+
+	switch err {
+	case nil:
+	case errTooLarge:
+		http.Error(res, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	default:
+		http.Error(res, "malformed request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	group := req.URL.Query().Get("group")
+	stream := req.URL.Query().Get("stream")
+
+	for _, msg := range msgs {
+		if len(msg.Group) == 0 {
+			msg.Group = group
+		}
+
+		if len(msg.Stream) == 0 {
+			msg.Stream = stream
+		}
+
+		select {
+		case r.msgs <- msg:
+		case <-r.done:
+			http.Error(res, "the http source is closing", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func (r *reader) parse(body io.Reader) (msgs []lib.Message, err error) {
+	var d lib.Reader
+
+	if r.config.parser == nil {
+		d = lib.NewMessageDecoder(body)
+	} else {
+		d = lib.NewParserReader(body, r.config.parser)
+	}
+
+	for {
+		var msg lib.Message
+
+		if msg, err = d.ReadMessage(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+
+		msgs = append(msgs, msg)
+	}
+}
+
+// decodeBody returns a reader of the decompressed body of req according to its
+// Content-Encoding header.
+func decodeBody(req *http.Request) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return req.Body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(req.Body)
+	case "deflate":
+		// Despite its name the deflate content encoding is the zlib format.
+		return zlib.NewReader(req.Body)
+	default:
+		return nil, errUnsupportedEncoding
+	}
+}
+
+// limitedReader reads at most N bytes from R, unlike io.LimitedReader it fails
+// with errTooLarge instead of truncating the content when there's more.
+type limitedReader struct {
+	R io.Reader
+	N int64
+}
+
+func (l *limitedReader) Read(b []byte) (n int, err error) {
+	if l.N < 0 {
+		return 0, errTooLarge
+	}
+
+	if int64(len(b)) > (l.N + 1) {
+		b = b[:l.N+1]
+	}
+
+	n, err = l.R.Read(b)
+
+	if l.N -= int64(n); l.N < 0 {
+		return 0, errTooLarge
+	}
+
+	return
+}
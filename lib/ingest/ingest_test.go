@@ -0,0 +1,152 @@
+package ingest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+const testBody = `{"group":"A","stream":"0","event":{"message":"hello"}}
+{"group":"A","stream":"1","event":{"message":"world"}}
+`
+
+func newTestReader(c config) (*reader, *httptest.Server, <-chan lib.Message) {
+	r := newReader(c)
+	s := httptest.NewServer(r)
+	c2 := make(chan lib.Message, 100)
+
+	go func() {
+		defer close(c2)
+		for {
+			msg, err := r.ReadMessage()
+			if err != nil {
+				return
+			}
+			c2 <- msg
+		}
+	}()
+
+	return r, s, c2
+}
+
+func post(t *testing.T, url string, encoding string, body []byte) int {
+	req, _ := http.NewRequest("POST", url, bytes.NewReader(body))
+
+	if len(encoding) != 0 {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func compress(encoding string, b []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+
+	if encoding == "gzip" {
+		w = gzip.NewWriter(&buf)
+	} else {
+		w = zlib.NewWriter(&buf)
+	}
+
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestCompressedIngest(t *testing.T) {
+	for _, encoding := range []string{"", "gzip", "deflate"} {
+		r, s, msgs := newTestReader(config{maxBodySize: 1024})
+		body := []byte(testBody)
+
+		if len(encoding) != 0 {
+			body = compress(encoding, body)
+		}
+
+		if status := post(t, s.URL, encoding, body); status != http.StatusNoContent {
+			t.Errorf("%q: invalid status: %d", encoding, status)
+		}
+
+		s.Close()
+		r.Close()
+
+		var found []string
+		for msg := range msgs {
+			found = append(found, msg.Stream+":"+msg.Event.Message)
+		}
+
+		if s := strings.Join(found, ","); s != "0:hello,1:world" {
+			t.Errorf("%q: invalid messages: %s", encoding, s)
+		}
+	}
+}
+
+func TestIngestSizeLimit(t *testing.T) {
+	r, s, msgs := newTestReader(config{maxBodySize: 1024})
+	defer r.Close()
+	defer s.Close()
+
+	// A few kilobytes of compressed data would expand way beyond the limit.
+	bomb := append([]byte(`{"group":"A","stream":"0","event":{"message":"`), bytes.Repeat([]byte{'A'}, 1024*1024)...)
+	bomb = append(bomb, `"}}`...)
+
+	if status := post(t, s.URL, "gzip", compress("gzip", bomb)); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("invalid status: %d", status)
+	}
+
+	if status := post(t, s.URL, "", bomb); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("invalid status of the uncompressed request: %d", status)
+	}
+
+	select {
+	case msg := <-msgs:
+		t.Errorf("no messages should be read from rejected requests: %v", msg)
+	default:
+	}
+}
+
+func TestIngestUnsupportedEncoding(t *testing.T) {
+	r, s, _ := newTestReader(config{maxBodySize: 1024})
+	defer r.Close()
+	defer s.Close()
+
+	if status := post(t, s.URL, "br", []byte(testBody)); status != http.StatusUnsupportedMediaType {
+		t.Errorf("invalid status: %d", status)
+	}
+
+	if status := post(t, s.URL, "gzip", []byte(testBody)); status != http.StatusBadRequest {
+		t.Errorf("invalid status of a body that isn't gzip: %d", status)
+	}
+}
+
+func TestIngestParser(t *testing.T) {
+	r, s, msgs := newTestReader(config{maxBodySize: 1024, parser: lib.GetParser("raw")})
+
+	if status := post(t, s.URL+"?group=A&stream=0", "gzip", compress("gzip", []byte("hello\nworld\n"))); status != http.StatusNoContent {
+		t.Errorf("invalid status: %d", status)
+	}
+
+	s.Close()
+	r.Close()
+
+	var found []string
+	for msg := range msgs {
+		found = append(found, msg.Group+"/"+msg.Stream+":"+msg.Event.Message)
+	}
+
+	if s := strings.Join(found, ","); s != "A/0:hello,A/0:world" {
+		t.Errorf("invalid messages: %s", s)
+	}
+}
@@ -0,0 +1,7 @@
+package ingest
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterSource("http", lib.SourceFunc(NewReader))
+}
@@ -6,15 +6,20 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/apex/log"
 	"github.com/coreos/go-systemd/sdjournal"
 	"github.com/segmentio/ecs-logs-go"
 	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/metrics"
 )
 
 func NewReader() (r lib.Reader, err error) {
@@ -24,28 +29,127 @@ func NewReader() (r lib.Reader, err error) {
 		return
 	}
 
-	if err = j.SeekTail(); err != nil {
+	// With a cursor file the journal is read from the last entry that was
+	// delivered, the entries are acknowledged by the destinations first.
+	var acks *lib.AckTracker
+	cursorFile := strings.TrimSpace(lib.Getenv("JOURNALD_CURSOR_FILE"))
+
+	if len(cursorFile) == 0 {
+		err = j.SeekTail()
+	} else if acks, err = lib.SourceAckTracker("journald"); err == nil {
+		err = seekCursor(j, cursorFile)
+	}
+
+	if err != nil {
 		j.Close()
 		return
 	}
 
 	var streamName string
-	if streamName = os.Getenv("JOURNALD_STREAM_NAME"); len(streamName) == 0 {
+	if streamName = lib.Getenv("JOURNALD_STREAM_NAME"); len(streamName) == 0 {
 		streamName = "CONTAINER_NAME"
 	}
 
-	r = &reader{Journal: j, streamName: streamName}
+	var parser lib.Parser
+	if parser, err = lib.SourceParser("journald"); err != nil {
+		j.Close()
+		return
+	}
+
+	var filter lib.NameFilter
+	if filter, err = lib.SourceFilter("journald"); err != nil {
+		j.Close()
+		return
+	}
+
+	rd := &reader{
+		journal:    j,
+		streamName: streamName,
+		parser:     parser,
+		filter:     filter,
+		excluded:   metrics.Default.Counter("excluded_messages", "source", "journald"),
+		acks:       acks,
+		cursorFile: cursorFile,
+		done:       make(chan struct{}),
+	}
+
+	if acks != nil {
+		go rd.commit()
+	}
+
+	r = rd
+	return
+}
+
+// journal is the part of sdjournal.Journal that the reader uses, so the tests
+// can replace it.
+type journal interface {
+	Next() (int, error)
+	Previous() (int, error)
+	SeekTail() error
+	SeekCursor(cursor string) error
+	TestCursor(cursor string) error
+	GetCursor() (string, error)
+	GetDataValue(field string) (string, error)
+	GetRealtimeUsec() (uint64, error)
+	Wait(timeout time.Duration) int
+	Close() error
+}
+
+// seekCursor moves j to the entry following the cursor saved in path, or to
+// the tail of the journal if there's none yet.
+func seekCursor(j journal, path string) (err error) {
+	var b []byte
+
+	if b, err = ioutil.ReadFile(path); os.IsNotExist(err) {
+		return j.SeekTail()
+	} else if err != nil {
+		return
+	}
+
+	cursor := strings.TrimSpace(string(b))
+
+	if err = j.SeekCursor(cursor); err != nil {
+		return fmt.Errorf("invalid cursor in %s: %s", path, err)
+	}
+
+	// The entry of the cursor was delivered already, unless the journal was
+	// vacuumed since and the seek landed on the next one.
+	if _, err = j.Next(); err == nil && j.TestCursor(cursor) != nil {
+		_, err = j.Previous()
+	}
+
 	return
 }
 
 type reader struct {
 	streamName string
+	parser     lib.Parser
+	filter     lib.NameFilter
+	excluded   *metrics.Counter
 	stopped    int32
-	*sdjournal.Journal
+	journal
+
+	// Set with JOURNALD_CURSOR_FILE, the cursor of the latest acknowledged
+	// entry is saved there. The sequence numbers of the messages are only
+	// used by ReadMessage.
+	acks       *lib.AckTracker
+	cursorFile string
+	seq        int64
+
+	// The cursor last saved to the cursor file, saved by the commit loop
+	// and by Commit when ecs-logs exits.
+	mutex sync.Mutex
+	saved string
+
+	// Closed by Close, it stops the commit loop.
+	done chan struct{}
+	once sync.Once
 }
 
 func (r *reader) Close() (err error) {
 	atomic.StoreInt32(&r.stopped, 1)
+	r.once.Do(func() { close(r.done) })
 	return
 }
 
@@ -54,6 +158,10 @@ func (r *reader) ReadMessage() (msg lib.Message, err error) {
 		var cur int
 		var ok bool
 
+		if err = r.redeliver(); err != nil {
+			return
+		}
+
 		if cur, err = r.Next(); err != nil {
 			return
 		}
@@ -63,16 +171,130 @@ func (r *reader) ReadMessage() (msg lib.Message, err error) {
 			continue
 		}
 
-		if msg, ok, err = r.getMessage(); ok || err != nil {
+		if msg, ok, err = r.getMessage(); ok && r.acks != nil {
+			err = r.track(&msg)
+		}
+
+		if ok || err != nil {
 			return
 		}
 	}
 
-	r.Journal.Close()
+	r.journal.Close()
 	err = io.EOF
 	return
 }
 
+// track records msg as waiting for its acknowledgement, at the cursor of the
+// current entry.
+func (r *reader) track(msg *lib.Message) (err error) {
+	var cursor string
+
+	if cursor, err = r.GetCursor(); err != nil {
+		return
+	}
+
+	r.seq++
+	pos := lib.Position{Seq: r.seq, Checkpoint: cursor}
+	r.acks.Read(pos, time.Now())
+	lib.SetOrigin(msg, r, pos)
+	return
+}
+
+// redeliver moves the journal back to the earliest entry that wasn't
+// acknowledged in time, so it's read again with the ones that followed it.
+func (r *reader) redeliver() error {
+	if r.acks == nil {
+		return nil
+	}
+
+	pos, ok := r.acks.Expire(time.Now())
+
+	if !ok {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"source":  "journald",
+		"timeout": r.acks.Timeout,
+	}).Warn("redelivering the journal entries that were not acknowledged in time")
+
+	return r.SeekCursor(pos.Checkpoint)
+}
+
+// Rewind is called when an entry failed to be delivered, it stays
+// unacknowledged so the cursor isn't saved past it and it's redelivered after
+// the ack timeout.
+func (r *reader) Rewind(pos lib.Position) {}
+
+func (r *reader) Retain(pos lib.Position) {
+	r.acks.Retain(pos)
+}
+
+func (r *reader) Acknowledge(pos lib.Position) {
+	r.acks.Acknowledge(pos)
+}
+
+// commit saves the cursor of the latest acknowledged entry every second until
+// the reader is closed, it runs in its own goroutine since ReadMessage may be
+// waiting for new entries. The acknowledgements that come after the reader
+// was closed are saved by Commit when ecs-logs exits, the entries that failed
+// to be delivered may never be.
+func (r *reader) commit() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.done:
+			return
+		}
+
+		if err := r.Commit(); err != nil {
+			log.WithError(err).Error("failed to save the cursor of the journald source")
+		}
+	}
+}
+
+// Commit saves the cursor of the latest acknowledged entry if it changed since
+// it was last saved.
+func (r *reader) Commit() (err error) {
+	if r.acks == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if pos, ok := r.acks.Committed(); ok && pos.Checkpoint != r.saved {
+		if err = saveCursor(r.cursorFile, pos.Checkpoint); err == nil {
+			r.saved = pos.Checkpoint
+		}
+	}
+
+	return
+}
+
+// saveCursor replaces the content of path with cursor, through a temporary
+// file so a crash doesn't leave a partial cursor behind.
+func saveCursor(path string, cursor string) (err error) {
+	tmp := path + ".tmp"
+
+	if err = ioutil.WriteFile(tmp, []byte(cursor+"\n"), 0644); err != nil {
+		return
+	}
+
+	if err = os.Rename(tmp, path); err == nil {
+		if d, e := os.Open(filepath.Dir(path)); e == nil {
+			d.Sync()
+			d.Close()
+		}
+	}
+
+	return
+}
+
 func (r *reader) getMessage() (msg lib.Message, ok bool, err error) {
 	if msg.Group, err = r.GetDataValue("CONTAINER_TAG"); len(msg.Group) == 0 {
 		// No CONTAINER_TAG, this must be a journal message from a process that
@@ -95,12 +317,26 @@ func (r *reader) getMessage() (msg lib.Message, ok bool, err error) {
 
 	msg.Stream = sanitizeStreamName(msg.Stream)
 
-	if s := r.getString("MESSAGE"); len(s) != 0 {
-		d := json.NewDecoder(strings.NewReader(s))
-		d.UseNumber()
+	// Excluded messages are dropped before their content is parsed, which is
+	// where most of the time reading the journal goes.
+	if !r.filter.Allows(msg.Group, msg.Stream, r.getString("CONTAINER_NAME")) {
+		r.excluded.Add(1)
+		return
+	}
 
-		if d.Decode(&msg.Event) != nil {
-			msg.Event.Message = s
+	if s := r.getString("MESSAGE"); len(s) != 0 {
+		// Without a parser the message is decoded as JSON when possible,
+		// quietly falling back to plain text since that's what most
+		// containers write.
+		if r.parser != nil {
+			msg.Event = lib.ParseMessage(r.parser, []byte(s)).Event
+		} else {
+			d := json.NewDecoder(strings.NewReader(s))
+			d.UseNumber()
+
+			if d.Decode(&msg.Event) != nil {
+				msg.Event.Message = s
+			}
 		}
 	}
 
@@ -0,0 +1,249 @@
+// +build linux
+
+package journald
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// testJournal is a journal of entries in memory, their cursors are in the
+// order of the entries.
+type testJournal struct {
+	cursors []string
+	entries []map[string]string
+	current int
+	closed  bool
+}
+
+func newTestJournal(cursors ...string) *testJournal {
+	j := &testJournal{current: -1}
+
+	for _, c := range cursors {
+		j.cursors = append(j.cursors, c)
+		j.entries = append(j.entries, map[string]string{
+			"CONTAINER_TAG":  "group",
+			"CONTAINER_NAME": "stream",
+			"MESSAGE":        "message " + c,
+		})
+	}
+
+	return j
+}
+
+func (j *testJournal) Next() (int, error) {
+	if j.current+1 == len(j.entries) {
+		return 0, nil
+	}
+	j.current++
+	return 1, nil
+}
+
+func (j *testJournal) Previous() (int, error) {
+	if j.current < 0 {
+		return 0, nil
+	}
+	j.current--
+	return 1, nil
+}
+
+func (j *testJournal) SeekTail() error {
+	j.current = len(j.entries) - 1
+	return nil
+}
+
+// SeekCursor moves before the entry of cursor, or the first one after it when
+// it was vacuumed, like sd_journal_seek_cursor.
+func (j *testJournal) SeekCursor(cursor string) error {
+	j.current = len(j.entries) - 1
+
+	for i, c := range j.cursors {
+		if c >= cursor {
+			j.current = i - 1
+			break
+		}
+	}
+
+	return nil
+}
+
+func (j *testJournal) TestCursor(cursor string) error {
+	if c, _ := j.GetCursor(); c != cursor {
+		return errors.New("cursor mismatch")
+	}
+	return nil
+}
+
+func (j *testJournal) GetCursor() (string, error) {
+	if j.current < 0 || j.current >= len(j.entries) {
+		return "", errors.New("no entry")
+	}
+	return j.cursors[j.current], nil
+}
+
+func (j *testJournal) GetDataValue(field string) (string, error) {
+	if j.current < 0 || j.current >= len(j.entries) {
+		return "", errors.New("no entry")
+	}
+	if v, ok := j.entries[j.current][field]; ok {
+		return v, nil
+	}
+	return "", errors.New("missing " + field)
+}
+
+func (j *testJournal) GetRealtimeUsec() (uint64, error) { return 0, nil }
+
+func (j *testJournal) Wait(time.Duration) int { return 0 }
+
+func (j *testJournal) Close() error {
+	j.closed = true
+	return nil
+}
+
+func newTestReader(j *testJournal, acks *lib.AckTracker, cursorFile string) *reader {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	return &reader{
+		journal:    j,
+		streamName: "CONTAINER_NAME",
+		filter:     lib.NameFilter{},
+		excluded:   metrics.NewRegistry().Counter("excluded_messages"),
+		acks:       acks,
+		cursorFile: cursorFile,
+		done:       make(chan struct{}),
+	}
+}
+
+func readMessages(t *testing.T, r *reader, n int) (msgs []lib.Message) {
+	for i := 0; i != n; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return
+}
+
+func messages(msgs []lib.Message) string {
+	s := make([]string, len(msgs))
+	for i, msg := range msgs {
+		s[i] = msg.Event.Message
+	}
+	return strings.Join(s, ",")
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "journald_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestSeekCursor(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cursor")
+
+	// Without a cursor file the journal is read from its tail.
+	j := newTestJournal("c1", "c2", "c3")
+
+	if err := seekCursor(j, path); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, _ := j.Next(); n != 0 {
+		t.Errorf("the journal should be read from its tail: %s", j.cursors[j.current])
+	}
+
+	// The entry of the cursor was delivered, the next one is read first.
+	ioutil.WriteFile(path, []byte("c2\n"), 0644)
+	j = newTestJournal("c1", "c2", "c3")
+
+	if err := seekCursor(j, path); err != nil {
+		t.Fatal(err)
+	}
+
+	if msgs := readMessages(t, newTestReader(j, nil, ""), 1); messages(msgs) != "message c3" {
+		t.Errorf("the journal should be read after the cursor: %s", messages(msgs))
+	}
+
+	// The entry of the cursor was vacuumed, the seek landed on an entry that
+	// wasn't delivered yet.
+	j = newTestJournal("c3", "c4")
+
+	if err := seekCursor(j, path); err != nil {
+		t.Fatal(err)
+	}
+
+	if msgs := readMessages(t, newTestReader(j, nil, ""), 2); messages(msgs) != "message c3,message c4" {
+		t.Errorf("the entries after the vacuumed cursor should all be read: %s", messages(msgs))
+	}
+}
+
+func TestRedeliver(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cursor")
+	acks := lib.NewAckTracker("journald", time.Millisecond, 1, metrics.NewRegistry())
+	r := newTestReader(newTestJournal("c1", "c2", "c3"), acks, path)
+
+	msgs := readMessages(t, r, 3)
+	lib.AcknowledgeBatch(msgs[:1])
+
+	if err := r.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, _ := ioutil.ReadFile(path); string(b) != "c1\n" {
+		t.Errorf("the cursor of the acknowledged entry should be saved: %q", b)
+	}
+
+	// c2 wasn't acknowledged in time, it's read again with c3.
+	time.Sleep(5 * time.Millisecond)
+
+	if again := readMessages(t, r, 2); messages(again) != "message c2,message c3" {
+		t.Errorf("the entries after the cursor should be redelivered: %s", messages(again))
+	}
+
+	// The acknowledgements of the first delivery are ignored.
+	lib.AcknowledgeBatch(msgs[1:])
+
+	if pos, _ := acks.Committed(); pos.Checkpoint != "c1" || acks.Pending() != 2 {
+		t.Errorf("the entries should wait for the acknowledgement of their redelivery: %+v (%d)", pos, acks.Pending())
+	}
+}
+
+func TestCommitStopsOnClose(t *testing.T) {
+	acks := lib.NewAckTracker("journald", 0, 0, metrics.NewRegistry())
+	r := newTestReader(newTestJournal("c1"), acks, "")
+	readMessages(t, r, 1)
+
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		r.commit()
+	}()
+
+	// The entry is never acknowledged, the commit loop still stops.
+	r.Close()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Error("the commit loop should stop when the reader is closed")
+	}
+}
@@ -0,0 +1,236 @@
+package kafka
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+// The partitioners choosing the partitions of the records.
+const (
+	partitionByStream = "stream"
+	partitionByKey    = "key"
+)
+
+// config carries the settings of the kafka destination, they are loaded from
+// KAFKA_* environment variables.
+type config struct {
+	// The host:port addresses of the brokers the metadata of the cluster is
+	// fetched from, the records are then produced to the leaders of their
+	// partitions.
+	brokers  []string
+	clientID string
+	tls      *tls.Config
+	sasl     *saslConfig
+
+	// The topic and the key of the records, templates which may use the
+	// {group} and {stream} variables, and whether the partitions are picked by
+	// stream or by key.
+	topic       string
+	key         string
+	partitioner string
+
+	// How many replicas must have written the records before the brokers
+	// acknowledge them (-1 for all the in-sync ones), and how long they wait
+	// for them.
+	acks    int16
+	timeout time.Duration
+
+	// The maximum size of the record batches, larger batches are split in
+	// several produce requests.
+	maxBatchBytes int
+
+	// How the records that failed to be produced are sent again, and the
+	// budget of those retries shared by all the writers.
+	retry       retry.Policy
+	retryBudget lib.RetryBudget
+
+	// Whether the raw lines that the messages were read from are produced
+	// instead of their JSON representation.
+	raw bool
+
+	err error
+}
+
+func getConfig() (c config) {
+	var err error
+	var s string
+
+	c = config{
+		clientID:      "ecs-logs",
+		key:           "{group}/{stream}",
+		partitioner:   partitionByStream,
+		acks:          -1,
+		timeout:       10 * time.Second,
+		maxBatchBytes: 1000000,
+	}
+
+	for _, b := range strings.Split(lib.Getenv("KAFKA_BROKERS"), ",") {
+		if b = strings.TrimSpace(b); len(b) == 0 {
+			continue
+		}
+
+		if _, port, e := net.SplitHostPort(b); e != nil || len(port) == 0 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid KAFKA_BROKERS, must be a comma separated list of host:port addresses: %s", b))
+			continue
+		}
+
+		c.brokers = append(c.brokers, b)
+	}
+
+	if len(c.brokers) == 0 && c.err == nil {
+		c.err = lib.AppendError(c.err, fmt.Errorf("missing KAFKA_BROKERS environment variable"))
+	}
+
+	if c.topic = strings.TrimSpace(lib.Getenv("KAFKA_TOPIC")); len(c.topic) == 0 {
+		c.err = lib.AppendError(c.err, fmt.Errorf("missing KAFKA_TOPIC environment variable"))
+	} else if err = checkTemplate("KAFKA_TOPIC", c.topic); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	} else if !validTopic.MatchString(templateVariable.ReplaceAllString(c.topic, "x")) {
+		c.err = lib.AppendError(c.err, fmt.Errorf("invalid KAFKA_TOPIC, topic names may only contain letters, digits and the ._- characters: %s", c.topic))
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("KAFKA_KEY")); len(s) != 0 {
+		if err = checkTemplate("KAFKA_KEY", s); err != nil {
+			c.err = lib.AppendError(c.err, err)
+		}
+		c.key = s
+	}
+
+	switch s = strings.ToLower(strings.TrimSpace(lib.Getenv("KAFKA_PARTITIONER"))); s {
+	case "":
+	case partitionByStream, partitionByKey:
+		c.partitioner = s
+	default:
+		c.err = lib.AppendError(c.err, fmt.Errorf("invalid KAFKA_PARTITIONER, must be one of stream or key: %s", s))
+	}
+
+	switch s = strings.ToLower(strings.TrimSpace(lib.Getenv("KAFKA_ACKS"))); s {
+	case "", "all", "-1":
+	case "leader", "1":
+		c.acks = 1
+	case "none", "0":
+		c.acks = 0
+	default:
+		c.err = lib.AppendError(c.err, fmt.Errorf("invalid KAFKA_ACKS, must be one of all, leader or none: %s", s))
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("KAFKA_TIMEOUT")); len(s) != 0 {
+		if c.timeout, err = time.ParseDuration(s); err != nil || c.timeout < time.Millisecond {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid KAFKA_TIMEOUT, must be a duration of at least one millisecond: %s", s))
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("KAFKA_MAX_BATCH_BYTES")); len(s) != 0 {
+		if c.maxBatchBytes, err = strconv.Atoi(s); err != nil || c.maxBatchBytes < 1024 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid KAFKA_MAX_BATCH_BYTES, must be an integer of at least 1024: %s", s))
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("KAFKA_CLIENT_ID")); len(s) != 0 {
+		c.clientID = s
+	}
+
+	if s = strings.ToUpper(strings.TrimSpace(lib.Getenv("KAFKA_SASL_MECHANISM"))); len(s) != 0 {
+		switch s {
+		case mechanismPlain, mechanismSCRAMSHA256, mechanismSCRAMSHA512:
+		default:
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid KAFKA_SASL_MECHANISM, must be one of PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512: %s", s))
+		}
+
+		c.sasl = &saslConfig{
+			mechanism: s,
+			username:  lib.Getenv("KAFKA_SASL_USERNAME"),
+			password:  lib.Getenv("KAFKA_SASL_PASSWORD"),
+		}
+
+		if len(c.sasl.username) == 0 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("missing KAFKA_SASL_USERNAME environment variable, it's required with KAFKA_SASL_MECHANISM"))
+		}
+	}
+
+	if c.retry, err = retry.DestinationPolicy("kafka", retry.DefaultPolicy); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.retryBudget, err = lib.DestinationRetryBudget("kafka"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.raw, err = lib.DestinationRawPassthrough("kafka"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	enabled := false
+
+	if s = strings.TrimSpace(lib.Getenv("KAFKA_TLS")); len(s) != 0 {
+		if enabled, err = strconv.ParseBool(s); err != nil {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid KAFKA_TLS, must be a boolean: %s", s))
+		}
+	}
+
+	if t, err := lib.DestinationTLS("kafka"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	} else if t.Enabled() {
+		if c.tls, err = t.Load(); err != nil {
+			c.err = lib.AppendError(c.err, err)
+		}
+	} else if enabled {
+		c.tls = &tls.Config{}
+	}
+
+	return
+}
+
+func (c config) check() error {
+	return c.err
+}
+
+var (
+	templateVariable = regexp.MustCompile(`\{[^{}]*\}`)
+	validTopic       = regexp.MustCompile(`^[-.\w]{1,249}$`)
+	invalidChar      = regexp.MustCompile(`[^-.\w]+`)
+)
+
+// checkTemplate reports the unknown variables of the template s.
+func checkTemplate(env string, s string) error {
+	for _, v := range templateVariable.FindAllString(s, -1) {
+		if v != "{group}" && v != "{stream}" {
+			return fmt.Errorf("invalid %s, unknown variable %s, must be one of {group} or {stream}: %s", env, v, s)
+		}
+	}
+	return nil
+}
+
+// topicName returns the topic of a group and stream from the topic template.
+// The characters that Kafka doesn't allow in topic names, like the slashes of
+// the group names, are replaced with dashes.
+func topicName(template string, group string, stream string) string {
+	clean := func(s string) string {
+		if s = strings.Trim(invalidChar.ReplaceAllString(s, "-"), "-"); len(s) == 0 {
+			s = "-"
+		}
+		return s
+	}
+
+	topic := strings.NewReplacer("{group}", clean(group), "{stream}", clean(stream)).Replace(template)
+
+	if len(topic) > 249 {
+		topic = topic[:249]
+	}
+
+	return topic
+}
+
+// recordKey returns the key of the records of a group and stream from the key
+// template, which is used as it is.
+func recordKey(template string, group string, stream string) string {
+	return strings.NewReplacer("{group}", group, "{stream}", stream).Replace(template)
+}
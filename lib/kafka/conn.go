@@ -0,0 +1,147 @@
+package kafka
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// The maximum size of the responses accepted from the brokers.
+const maxResponseSize = 16 * 1024 * 1024
+
+// conn sends requests to a broker over a single connection, the requests are
+// serialized and the connection is opened again after a network error.
+type conn struct {
+	address  string
+	clientID string
+	tls      *tls.Config
+	timeout  time.Duration
+	sasl     *saslConfig
+
+	mutex         sync.Mutex
+	conn          net.Conn
+	correlationID int32
+}
+
+// isNetworkError returns true if err was returned by the connection rather
+// than by the broker.
+func isNetworkError(err error) bool {
+	_, ok := err.(net.Error)
+	return ok || err == io.EOF || err == io.ErrUnexpectedEOF || err == errShortResponse
+}
+
+// run sends the request of api at version with body and returns the decoder
+// of its response, or nil if the broker doesn't send one.
+func (c *conn) run(api int16, version int16, body []byte, response bool) (d *decoder, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn == nil {
+		if err = c.connect(); err != nil {
+			return
+		}
+	}
+
+	if d, err = c.roundTrip(api, version, body, response); err != nil && isNetworkError(err) {
+		c.conn.Close()
+		c.conn = nil
+	}
+
+	return
+}
+
+func (c *conn) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+func (c *conn) connect() (err error) {
+	d := &net.Dialer{Timeout: c.timeout}
+
+	if c.tls != nil {
+		config := c.tls
+
+		// The configuration is shared by the connections to all the brokers,
+		// each checks the certificate against its own host.
+		if len(config.ServerName) == 0 {
+			config = config.Clone()
+			config.ServerName, _, _ = net.SplitHostPort(c.address)
+		}
+
+		c.conn, err = tls.DialWithDialer(d, "tcp", c.address, config)
+	} else {
+		c.conn, err = d.Dial("tcp", c.address)
+	}
+
+	if err != nil {
+		c.conn = nil
+		return
+	}
+
+	if c.sasl != nil {
+		if err = c.authenticate(); err != nil {
+			c.conn.Close()
+			c.conn = nil
+			err = fmt.Errorf("authenticating to the kafka broker %s as %s: %s", c.address, c.sasl.username, err)
+		}
+	}
+
+	return
+}
+
+func (c *conn) roundTrip(api int16, version int16, body []byte, response bool) (d *decoder, err error) {
+	c.correlationID++
+
+	b := encoder(make([]byte, 4, 64+len(body))).
+		int16(api).
+		int16(version).
+		int32(c.correlationID).
+		string(c.clientID)
+	b = append(b, body...)
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	if c.timeout != 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	if _, err = c.conn.Write(b); err != nil || !response {
+		return
+	}
+
+	var header [8]byte
+
+	if _, err = io.ReadFull(c.conn, header[:]); err != nil {
+		return
+	}
+
+	size := int(binary.BigEndian.Uint32(header[:]))
+
+	if size < 4 || size > maxResponseSize {
+		return nil, fmt.Errorf("invalid kafka response size: %d", size)
+	}
+
+	if id := int32(binary.BigEndian.Uint32(header[4:])); id != c.correlationID {
+		// The responses come in the order of the requests, so the connection
+		// can't be used anymore.
+		c.conn.Close()
+		c.conn = nil
+		return nil, fmt.Errorf("the kafka broker %s responded to request %d instead of %d", c.address, id, c.correlationID)
+	}
+
+	res := make([]byte, size-4)
+
+	if _, err = io.ReadFull(c.conn, res); err != nil {
+		return
+	}
+
+	return &decoder{b: res}, nil
+}
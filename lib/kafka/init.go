@@ -0,0 +1,7 @@
+package kafka
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterDestination("kafka", newDestination(getConfig))
+}
@@ -0,0 +1,342 @@
+// Package kafka implements the kafka destination, which produces the messages
+// to Kafka topics with the protocol of the brokers. The records of a stream
+// all go to the same partition so consumers read them in order.
+package kafka
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+// How long the leaders of the partitions of a topic are cached, they are also
+// fetched again when a broker says they moved.
+const metadataTTL = 5 * time.Minute
+
+// destination produces the records of all the streams, it caches the metadata
+// of the cluster and shares a connection to each broker between the writers.
+type destination struct {
+	lazy   lib.LazyConfig
+	load   func() config
+	config config
+
+	mutex   sync.Mutex
+	conns   map[string]*conn
+	brokers map[int32]string
+	topics  map[string]cachedTopic
+	seed    int
+
+	retries *lib.RetryLimiter
+	clock   clock.Clock
+}
+
+// cachedTopic is the leaders of the partitions of a topic, by partition.
+type cachedTopic struct {
+	leaders []int32
+	expires time.Time
+}
+
+func newDestination(load func() config) *destination {
+	return &destination{
+		load:    load,
+		conns:   make(map[string]*conn),
+		brokers: make(map[int32]string),
+		topics:  make(map[string]cachedTopic),
+		clock:   clock.System,
+	}
+}
+
+func (d *destination) Open(group string, stream string) (w lib.Writer, err error) {
+	if err = d.lazy.Init(d.init); err != nil {
+		return
+	}
+
+	partitionKey := group + "/" + stream
+	key := recordKey(d.config.key, group, stream)
+
+	if d.config.partitioner == partitionByKey {
+		partitionKey = key
+	}
+
+	w = writer{
+		dest:         d,
+		topic:        topicName(d.config.topic, group, stream),
+		key:          []byte(key),
+		partitionKey: []byte(partitionKey),
+	}
+	return
+}
+
+// CheckConfig reports the problems with the KAFKA_* settings when ecs-logs
+// starts.
+func (d *destination) CheckConfig() error {
+	return d.load().check()
+}
+
+// Close does nothing, the connections to the brokers are shared by all the
+// streams.
+func (d *destination) Close(group string, stream string) {}
+
+func (d *destination) init() error {
+	d.config = d.load()
+	d.retries = lib.NewRetryLimiter("kafka", d.config.retryBudget, metrics.Default)
+
+	return d.config.check()
+}
+
+// conn returns the connection to the broker at address, it must be called with
+// the mutex locked.
+func (d *destination) conn(address string) *conn {
+	c := d.conns[address]
+
+	if c == nil {
+		c = &conn{
+			address:  address,
+			clientID: d.config.clientID,
+			tls:      d.config.tls,
+			sasl:     d.config.sasl,
+			// The brokers wait up to the timeout for the replicas to
+			// acknowledge the records, the responses are waited for a bit
+			// longer.
+			timeout: d.config.timeout + 5*time.Second,
+		}
+		d.conns[address] = c
+	}
+
+	return c
+}
+
+// leaders returns the leaders of the partitions of topic, the metadata is
+// fetched from the brokers when it's not cached.
+func (d *destination) leaders(topic string) ([]int32, error) {
+	now := d.clock.Now()
+
+	d.mutex.Lock()
+	t, ok := d.topics[topic]
+	d.mutex.Unlock()
+
+	if ok && now.Before(t.expires) {
+		return t.leaders, nil
+	}
+
+	m, err := d.fetchMetadata(topic)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tm := m.topics[topic]
+
+	if tm.err != nil {
+		err = fmt.Errorf("fetching the metadata of the kafka topic %s: %s", topic, tm.err)
+
+		if retriableErrors[tm.err.code] {
+			err = retry.Retryable(err)
+		}
+		return nil, err
+	}
+
+	if len(tm.leaders) == 0 {
+		return nil, retry.Retryable(fmt.Errorf("the kafka topic %s has no partitions", topic))
+	}
+
+	d.mutex.Lock()
+
+	for id, address := range m.brokers {
+		d.brokers[id] = address
+	}
+
+	d.topics[topic] = cachedTopic{leaders: tm.leaders, expires: now.Add(metadataTTL)}
+	d.mutex.Unlock()
+
+	return tm.leaders, nil
+}
+
+// fetchMetadata requests the metadata of topic from the configured brokers,
+// starting with the one that last answered. The error is retryable if the last
+// broker couldn't be reached, but not if it rejected the credentials.
+func (d *destination) fetchMetadata(topic string) (m metadata, err error) {
+	for i := range d.config.brokers {
+		d.mutex.Lock()
+		seed := (d.seed + i) % len(d.config.brokers)
+		c := d.conn(d.config.brokers[seed])
+		d.mutex.Unlock()
+
+		var res *decoder
+
+		if res, err = c.run(apiMetadata, metadataVersion, metadataRequest([]string{topic}), true); err == nil {
+			if m, err = decodeMetadata(res); err == nil {
+				d.mutex.Lock()
+				d.seed = seed
+				d.mutex.Unlock()
+				return
+			}
+		}
+
+		transient := isNetworkError(err)
+		err = fmt.Errorf("fetching the metadata of the kafka topic %s from %s: %s", topic, c.address, err)
+
+		if transient {
+			err = retry.Retryable(err)
+		}
+	}
+
+	return
+}
+
+// forget removes the metadata of topic from the cache, so it's fetched again
+// by the next attempt.
+func (d *destination) forget(topic string) {
+	d.mutex.Lock()
+	delete(d.topics, topic)
+	d.mutex.Unlock()
+}
+
+// produce produces records to the partition of partitionKey. They are split in
+// batches of at most maxBatchBytes that are produced one after the other, so a
+// batch is only sent once the previous one was acknowledged and the records
+// keep their order when a request is retried.
+func (d *destination) produce(topic string, partitionKey []byte, records []record) error {
+	return d.config.retry.Do(d.clock, d.retries, func() error {
+		for len(records) != 0 {
+			n, size := 0, 0
+
+			for n < len(records) && (n == 0 || size+records[n].size() <= d.config.maxBatchBytes) {
+				size += records[n].size()
+				n++
+			}
+
+			if err := d.send(topic, partitionKey, records[:n]); err != nil {
+				return err
+			}
+
+			records = records[n:]
+		}
+		return nil
+	})
+}
+
+// send produces records with a single request to the leader of their
+// partition.
+func (d *destination) send(topic string, partitionKey []byte, records []record) error {
+	leaders, err := d.leaders(topic)
+
+	if err != nil {
+		return err
+	}
+
+	p := partition(partitionKey, len(leaders))
+
+	d.mutex.Lock()
+	address, ok := d.brokers[leaders[p]]
+	var c *conn
+	if ok {
+		c = d.conn(address)
+	}
+	d.mutex.Unlock()
+
+	if !ok {
+		d.forget(topic)
+		return retry.Retryable(fmt.Errorf("the partition %d of the kafka topic %s has no leader", p, topic))
+	}
+
+	req := produceRequest(d.config.acks, d.config.timeout, topic, int32(p), recordBatch(records))
+	res, err := c.run(apiProduce, produceVersion, req, d.config.acks != 0)
+
+	if err != nil {
+		transient := isNetworkError(err)
+		err = fmt.Errorf("producing to the kafka broker %s: %s", address, err)
+
+		if transient {
+			d.forget(topic)
+			err = retry.Retryable(err)
+		}
+		return err
+	}
+
+	// Without acks the brokers don't respond, the records are assumed to be
+	// produced once they were written to the connection.
+	if res == nil {
+		return nil
+	}
+
+	if err = decodeProduce(res); err != nil {
+		e, ok := err.(*brokerError)
+		err = fmt.Errorf("producing to the partition %d of the kafka topic %s: %s", p, topic, err)
+
+		if !ok || staleMetadataErrors[e.code] {
+			d.forget(topic)
+		}
+
+		if !ok || retriableErrors[e.code] {
+			err = retry.Retryable(err)
+		}
+	}
+
+	return err
+}
+
+func (d *destination) record(w writer, msg lib.Message) record {
+	r := record{
+		key:     w.key,
+		headers: [][2]string{{"group", msg.Group}, {"stream", msg.Stream}},
+		time:    msg.Event.Time,
+	}
+
+	if line, ok := msg.RawLine(); d.config.raw && ok {
+		r.value = []byte(line)
+	} else {
+		r.value = msg.Bytes()
+	}
+
+	if r.time.IsZero() {
+		r.time = d.clock.Now()
+	}
+
+	return r
+}
+
+type writer struct {
+	dest         *destination
+	topic        string
+	key          []byte
+	partitionKey []byte
+}
+
+// Close returns right away, the writes wait for the brokers to acknowledge
+// their records so the writer has nothing pending.
+func (w writer) Close() error {
+	return nil
+}
+
+func (w writer) WriteMessage(msg lib.Message) error {
+	return w.WriteMessageBatch(lib.MessageBatch{msg})
+}
+
+func (w writer) WriteMessageBatch(batch lib.MessageBatch) (err error) {
+	records := make([]record, 0, len(batch))
+
+	for _, msg := range batch {
+		r := w.dest.record(w, msg)
+
+		if r.size() > w.dest.config.maxBatchBytes {
+			err = lib.AppendError(err, fmt.Errorf("a message of %s/%s is too large to be produced to kafka: %d bytes", msg.Group, msg.Stream, len(r.value)))
+			continue
+		}
+
+		records = append(records, r)
+	}
+
+	if len(records) != 0 {
+		if e := w.dest.produce(w.topic, w.partitionKey, records); e != nil {
+			err = lib.AppendError(err, e)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,510 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+var epoch = time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC)
+
+// mockBroker is a single broker cluster leading all the partitions of the
+// topics, it records the records produced to each partition. produceError
+// returns the error code of each produce request.
+type mockBroker struct {
+	t          *testing.T
+	ln         net.Listener
+	partitions int
+	password   string
+
+	mutex        sync.Mutex
+	records      map[string]map[int32][]record
+	apis         []int16
+	produceError func(call int) int16
+	produceCalls int
+}
+
+func newMockBroker(t *testing.T, partitions int) *mockBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &mockBroker{t: t, ln: ln, partitions: partitions, records: make(map[string]map[int32][]record)}
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(c)
+		}
+	}()
+
+	return b
+}
+
+func (b *mockBroker) address() string {
+	return b.ln.Addr().String()
+}
+
+func (b *mockBroker) close() {
+	b.ln.Close()
+}
+
+func (b *mockBroker) serve(c net.Conn) {
+	defer c.Close()
+
+	for {
+		var size [4]byte
+
+		if _, err := io.ReadFull(c, size[:]); err != nil {
+			return
+		}
+
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+
+		if _, err := io.ReadFull(c, req); err != nil {
+			return
+		}
+
+		d := &decoder{b: req}
+		api, version, id := d.int16(), d.int16(), d.int32()
+		d.string() // client ID
+
+		b.mutex.Lock()
+		b.apis = append(b.apis, api)
+		b.mutex.Unlock()
+
+		var res encoder
+
+		switch api {
+		case apiSaslHandshake:
+			if version != saslHandshakeVersion || d.string() != mechanismPlain {
+				res = encoder(nil).int16(33).int32(1).string(mechanismPlain)
+			} else {
+				res = encoder(nil).int16(0).int32(1).string(mechanismPlain)
+			}
+
+		case apiSaslAuthenticate:
+			if string(d.bytes()) != "\x00user\x00"+b.password {
+				res = encoder(nil).int16(58).string("invalid credentials").bytes(nil)
+			} else {
+				res = encoder(nil).int16(0).nullString().bytes(nil)
+			}
+
+		case apiMetadata:
+			host, port, _ := net.SplitHostPort(b.address())
+			p, _ := strconv.Atoi(port)
+			res = encoder(nil).int32(1).int32(1).string(host).int32(int32(p)).nullString().int32(1)
+
+			n := d.arrayLen()
+			res = res.int32(int32(n))
+
+			for i := 0; i < n; i++ {
+				res = res.int16(0).string(d.string()).int8(0).int32(int32(b.partitions))
+
+				for j := 0; j < b.partitions; j++ {
+					res = res.int16(0).int32(int32(j)).int32(1).int32(1).int32(1).int32(1).int32(1)
+				}
+			}
+
+		case apiProduce:
+			if version != produceVersion {
+				b.t.Errorf("invalid produce version: %d", version)
+			}
+
+			d.string() // transactional ID
+			acks := d.int16()
+			d.int32() // timeout
+			d.arrayLen()
+			topic := d.string()
+			d.arrayLen()
+			p := d.int32()
+			records := decodeBatch(b.t, d.bytes())
+
+			b.mutex.Lock()
+			b.produceCalls++
+			code := int16(0)
+
+			if b.produceError != nil {
+				code = b.produceError(b.produceCalls)
+			}
+
+			if code == 0 {
+				if b.records[topic] == nil {
+					b.records[topic] = make(map[int32][]record)
+				}
+				b.records[topic][p] = append(b.records[topic][p], records...)
+			}
+			b.mutex.Unlock()
+
+			if acks == 0 {
+				continue
+			}
+
+			res = encoder(nil).int32(1).string(topic).int32(1).int32(p).int16(code).int64(0).int64(-1).int32(0)
+
+		default:
+			b.t.Errorf("unexpected request: %d", api)
+			return
+		}
+
+		msg := encoder(nil).int32(int32(len(res) + 4)).int32(id)
+		c.Write(append(msg, res...))
+	}
+}
+
+// produced returns the records produced to the partitions of topic.
+func (b *mockBroker) produced(topic string) map[int32][]record {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.records[topic]
+}
+
+func (b *mockBroker) count(api int16) (n int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, a := range b.apis {
+		if a == api {
+			n++
+		}
+	}
+	return
+}
+
+func newTestDestination(b *mockBroker, c config) *destination {
+	c.brokers = []string{b.address()}
+	c.clientID = "ecs-logs"
+
+	if len(c.topic) == 0 {
+		c.topic = "logs"
+	}
+
+	if len(c.key) == 0 {
+		c.key = "{group}/{stream}"
+	}
+
+	if len(c.partitioner) == 0 {
+		c.partitioner = partitionByStream
+	}
+
+	if c.acks == 0 {
+		c.acks = -1
+	}
+
+	if c.timeout == 0 {
+		c.timeout = time.Second
+	}
+
+	if c.maxBatchBytes == 0 {
+		c.maxBatchBytes = 1000000
+	}
+
+	d := newDestination(func() config { return c })
+	d.clock = clock.NewFake(epoch)
+	return d
+}
+
+func makeMessage(group string, stream string, text string) lib.Message {
+	return lib.Message{
+		Group:  group,
+		Stream: stream,
+		Event:  ecslogs.Event{Level: ecslogs.INFO, Time: epoch, Message: text},
+	}
+}
+
+func write(t *testing.T, d *destination, batch ...lib.Message) error {
+	w, err := d.Open(batch[0].Group, batch[0].Stream)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return w.WriteMessageBatch(batch)
+}
+
+func messages(records []record) (texts []string) {
+	for _, r := range records {
+		var msg lib.Message
+		json.Unmarshal(r.value, &msg)
+		texts = append(texts, msg.Event.Message)
+	}
+	return
+}
+
+func TestWriterProduce(t *testing.T) {
+	b := newMockBroker(t, 8)
+	defer b.close()
+
+	d := newTestDestination(b, config{topic: "logs-{group}"})
+
+	if err := write(t, d, makeMessage("api/v1", "task/0", "A"), makeMessage("api/v1", "task/0", "B")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := write(t, d, makeMessage("api/v1", "task/1", "C")); err != nil {
+		t.Fatal(err)
+	}
+
+	produced := b.produced("logs-api-v1")
+	p0 := int32(partition([]byte("api/v1/task/0"), 8))
+	p1 := int32(partition([]byte("api/v1/task/1"), 8))
+
+	if texts := messages(produced[p0]); !reflect.DeepEqual(texts[:2], []string{"A", "B"}) {
+		t.Errorf("the records of a stream should be produced in order to its partition: %v", texts)
+	}
+
+	if texts := messages(produced[p1]); texts[len(texts)-1] != "C" {
+		t.Errorf("invalid records of the second stream: %v", texts)
+	}
+
+	r := produced[p0][0]
+
+	if string(r.key) != "api/v1/task/0" || !r.time.Equal(epoch) {
+		t.Errorf("invalid record: %+v", r)
+	}
+
+	if !reflect.DeepEqual(r.headers, [][2]string{{"group", "api/v1"}, {"stream", "task/0"}}) {
+		t.Errorf("invalid headers: %v", r.headers)
+	}
+
+	// The metadata of the topic is cached.
+	if n := b.count(apiMetadata); n != 1 {
+		t.Errorf("the metadata should be fetched once: %d", n)
+	}
+}
+
+func TestWriterPartitionByKey(t *testing.T) {
+	b := newMockBroker(t, 16)
+	defer b.close()
+
+	d := newTestDestination(b, config{key: "{group}", partitioner: partitionByKey})
+
+	for _, stream := range []string{"0", "1", "2", "3"} {
+		if err := write(t, d, makeMessage("api", stream, stream)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	produced := b.produced("logs")
+
+	if records := produced[int32(partition([]byte("api"), 16))]; len(produced) != 1 || len(records) != 4 || string(records[0].key) != "api" {
+		t.Errorf("the records with the same key should go to the same partition: %v", produced)
+	}
+}
+
+func TestWriterSplitsBatches(t *testing.T) {
+	b := newMockBroker(t, 1)
+	defer b.close()
+
+	d := newTestDestination(b, config{maxBatchBytes: 1024})
+
+	var batch lib.MessageBatch
+
+	for i := 0; i < 20; i++ {
+		batch = append(batch, makeMessage("api", "0", strconv.Itoa(i)))
+	}
+
+	if err := write(t, d, batch...); err != nil {
+		t.Fatal(err)
+	}
+
+	texts := messages(b.produced("logs")[0])
+
+	if len(texts) != 20 || texts[0] != "0" || texts[19] != "19" {
+		t.Errorf("all the records should be produced in order: %v", texts)
+	}
+
+	if n := b.count(apiProduce); n < 2 {
+		t.Errorf("the batch should be split in several requests: %d", n)
+	}
+
+	// A message that can't fit in a batch is reported without being produced.
+	large := makeMessage("api", "0", string(make([]byte, 2048)))
+
+	if err := write(t, d, large, makeMessage("api", "0", "last")); err == nil {
+		t.Error("the large message should be reported")
+	}
+
+	if texts := messages(b.produced("logs")[0]); texts[len(texts)-1] != "last" || len(texts) != 21 {
+		t.Errorf("the other messages should be produced: %d", len(texts))
+	}
+}
+
+func TestWriterRetries(t *testing.T) {
+	b := newMockBroker(t, 2)
+	defer b.close()
+
+	d := newTestDestination(b, config{retry: retry.Policy{MaxRetries: 3}})
+
+	// The leader moved, the metadata is fetched again before retrying.
+	b.produceError = func(call int) int16 {
+		if call == 1 {
+			return 6
+		}
+		return 0
+	}
+
+	if err := write(t, d, makeMessage("api", "0", "A")); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, m := b.count(apiProduce), b.count(apiMetadata); n != 2 || m != 2 {
+		t.Errorf("the request should be retried with new metadata: %d requests, %d metadata", n, m)
+	}
+
+	// The records that the broker rejects would be rejected again.
+	b.produceError = func(int) int16 { return 10 }
+
+	if err := write(t, d, makeMessage("api", "0", "B")); err == nil || b.count(apiProduce) != 3 {
+		t.Errorf("the rejected request should not be retried: %d (%v)", b.count(apiProduce), err)
+	}
+}
+
+func TestWriterBrokerDown(t *testing.T) {
+	b := newMockBroker(t, 1)
+	b.close()
+
+	d := newTestDestination(b, config{retry: retry.Policy{MaxRetries: 1}})
+
+	if err := write(t, d, makeMessage("api", "0", "A")); err == nil {
+		t.Error("the records can't be produced when the broker is down")
+	}
+}
+
+func TestWriterAcksNone(t *testing.T) {
+	b := newMockBroker(t, 1)
+	defer b.close()
+
+	d := newTestDestination(b, config{})
+	c := d.load()
+	c.acks = 0
+	d.load = func() config { return c }
+
+	if err := write(t, d, makeMessage("api", "0", "A"), makeMessage("api", "0", "B")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := write(t, d, makeMessage("api", "0", "C")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The broker doesn't respond, but the next request is still read after
+	// the ones that were produced.
+	if _, err := d.leaders("other"); err != nil {
+		t.Fatal(err)
+	}
+
+	if texts := messages(b.produced("logs")[0]); !reflect.DeepEqual(texts, []string{"A", "B", "C"}) {
+		t.Errorf("invalid records: %v", texts)
+	}
+}
+
+func TestWriterSASL(t *testing.T) {
+	b := newMockBroker(t, 1)
+	b.password = "secret"
+	defer b.close()
+
+	d := newTestDestination(b, config{sasl: &saslConfig{mechanism: mechanismPlain, username: "user", password: "secret"}})
+
+	if err := write(t, d, makeMessage("api", "0", "A")); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := b.count(apiSaslAuthenticate); n != 1 {
+		t.Errorf("the connection should be authenticated once: %d", n)
+	}
+
+	d = newTestDestination(b, config{
+		sasl:  &saslConfig{mechanism: mechanismPlain, username: "user", password: "wrong"},
+		retry: retry.Policy{MaxRetries: 3},
+	})
+
+	if err := write(t, d, makeMessage("api", "0", "B")); err == nil || b.count(apiSaslAuthenticate) != 2 {
+		t.Errorf("the invalid credentials should be reported without retrying: %d (%v)", b.count(apiSaslAuthenticate), err)
+	}
+}
+
+func TestTopicName(t *testing.T) {
+	for _, test := range []struct {
+		template string
+		group    string
+		stream   string
+		topic    string
+	}{
+		{"logs", "api", "0", "logs"},
+		{"logs.{group}", "team/api", "0", "logs.team-api"},
+		{"{group}-{stream}", "api", "task/0123", "api-task-0123"},
+		{"logs.{group}", "///", "0", "logs.-"},
+	} {
+		if topic := topicName(test.template, test.group, test.stream); topic != test.topic {
+			t.Errorf("%s: invalid topic: %s != %s", test.template, topic, test.topic)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(map[string]string{"KAFKA_BROKERS": "kafka-1:9092, kafka-2:9092", "KAFKA_TOPIC": "logs"})
+
+	if c := getConfig(); c.err != nil || !reflect.DeepEqual(c.brokers, []string{"kafka-1:9092", "kafka-2:9092"}) || c.acks != -1 || c.tls != nil || c.sasl != nil {
+		t.Errorf("invalid config: %+v (%v)", c, c.err)
+	}
+
+	lib.SetConfigEnv(map[string]string{
+		"KAFKA_BROKERS":        "kafka:9093",
+		"KAFKA_TOPIC":          "logs.{group}",
+		"KAFKA_KEY":            "{stream}",
+		"KAFKA_PARTITIONER":    "key",
+		"KAFKA_ACKS":           "leader",
+		"KAFKA_TLS":            "true",
+		"KAFKA_SASL_MECHANISM": "scram-sha-512",
+		"KAFKA_SASL_USERNAME":  "user",
+		"KAFKA_SASL_PASSWORD":  "secret",
+	})
+
+	c := getConfig()
+
+	if c.err != nil || c.key != "{stream}" || c.partitioner != partitionByKey || c.acks != 1 || c.tls == nil {
+		t.Errorf("invalid config: %+v (%v)", c, c.err)
+	}
+
+	if !reflect.DeepEqual(c.sasl, &saslConfig{mechanism: mechanismSCRAMSHA512, username: "user", password: "secret"}) {
+		t.Errorf("invalid SASL config: %+v", c.sasl)
+	}
+
+	for _, env := range []map[string]string{
+		{},
+		{"KAFKA_BROKERS": "kafka"},
+		{"KAFKA_BROKERS": "kafka:9092"},
+		{"KAFKA_BROKERS": "kafka:9092", "KAFKA_TOPIC": "logs/{group}"},
+		{"KAFKA_BROKERS": "kafka:9092", "KAFKA_TOPIC": "logs.{task}"},
+		{"KAFKA_BROKERS": "kafka:9092", "KAFKA_TOPIC": "logs", "KAFKA_KEY": "{level}"},
+		{"KAFKA_BROKERS": "kafka:9092", "KAFKA_TOPIC": "logs", "KAFKA_ACKS": "2"},
+		{"KAFKA_BROKERS": "kafka:9092", "KAFKA_TOPIC": "logs", "KAFKA_PARTITIONER": "random"},
+		{"KAFKA_BROKERS": "kafka:9092", "KAFKA_TOPIC": "logs", "KAFKA_SASL_MECHANISM": "GSSAPI", "KAFKA_SASL_USERNAME": "user"},
+		{"KAFKA_BROKERS": "kafka:9092", "KAFKA_TOPIC": "logs", "KAFKA_SASL_MECHANISM": "PLAIN"},
+		{"KAFKA_BROKERS": "kafka:9092", "KAFKA_TOPIC": "logs", "KAFKA_MAX_BATCH_BYTES": "10"},
+	} {
+		lib.SetConfigEnv(env)
+
+		if c := getConfig(); c.err == nil {
+			t.Errorf("%v: the configuration should be rejected", env)
+		}
+	}
+}
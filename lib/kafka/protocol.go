@@ -0,0 +1,462 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// The requests of the Kafka protocol that the destination sends, at the last
+// version before the flexible encodings, which every broker since 1.0 accepts.
+const (
+	apiProduce          = 0
+	apiMetadata         = 3
+	apiSaslHandshake    = 17
+	apiSaslAuthenticate = 36
+
+	produceVersion          = 3
+	metadataVersion         = 1
+	saslHandshakeVersion    = 1
+	saslAuthenticateVersion = 0
+)
+
+// The errors of the brokers that a retry may not hit again. The ones telling
+// that the metadata is stale also make the destination fetch it again.
+var (
+	retriableErrors = map[int16]bool{
+		2:  true, // CORRUPT_MESSAGE
+		3:  true, // UNKNOWN_TOPIC_OR_PARTITION
+		5:  true, // LEADER_NOT_AVAILABLE
+		6:  true, // NOT_LEADER_OR_FOLLOWER
+		7:  true, // REQUEST_TIMED_OUT
+		8:  true, // BROKER_NOT_AVAILABLE
+		13: true, // NETWORK_EXCEPTION
+		14: true, // COORDINATOR_LOAD_IN_PROGRESS
+		19: true, // NOT_ENOUGH_REPLICAS
+		20: true, // NOT_ENOUGH_REPLICAS_AFTER_APPEND
+		56: true, // KAFKA_STORAGE_ERROR
+	}
+
+	staleMetadataErrors = map[int16]bool{3: true, 5: true, 6: true}
+)
+
+var errorNames = map[int16]string{
+	2:  "CORRUPT_MESSAGE",
+	3:  "UNKNOWN_TOPIC_OR_PARTITION",
+	5:  "LEADER_NOT_AVAILABLE",
+	6:  "NOT_LEADER_OR_FOLLOWER",
+	7:  "REQUEST_TIMED_OUT",
+	8:  "BROKER_NOT_AVAILABLE",
+	10: "MESSAGE_TOO_LARGE",
+	13: "NETWORK_EXCEPTION",
+	14: "COORDINATOR_LOAD_IN_PROGRESS",
+	17: "INVALID_TOPIC_EXCEPTION",
+	18: "RECORD_LIST_TOO_LARGE",
+	19: "NOT_ENOUGH_REPLICAS",
+	20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	29: "TOPIC_AUTHORIZATION_FAILED",
+	33: "UNSUPPORTED_SASL_MECHANISM",
+	34: "ILLEGAL_SASL_STATE",
+	56: "KAFKA_STORAGE_ERROR",
+	58: "SASL_AUTHENTICATION_FAILED",
+	87: "INVALID_RECORD",
+}
+
+// brokerError is an error code returned by a broker.
+type brokerError struct {
+	code    int16
+	message string
+}
+
+func (e *brokerError) Error() string {
+	name := errorNames[e.code]
+
+	if len(name) == 0 {
+		name = fmt.Sprintf("error %d", e.code)
+	}
+
+	if len(e.message) != 0 {
+		return fmt.Sprintf("kafka %s: %s", name, e.message)
+	}
+	return "kafka " + name
+}
+
+var errShortResponse = errors.New("the kafka broker sent a truncated response")
+
+// encoder appends the primitive types of the protocol, integers are big
+// endian and the strings and byte arrays are prefixed with their length.
+type encoder []byte
+
+func (e encoder) int8(v int8) encoder {
+	return append(e, byte(v))
+}
+
+func (e encoder) int16(v int16) encoder {
+	return append(e, byte(v>>8), byte(v))
+}
+
+func (e encoder) int32(v int32) encoder {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	return append(e, b[:]...)
+}
+
+func (e encoder) int64(v int64) encoder {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	return append(e, b[:]...)
+}
+
+func (e encoder) string(s string) encoder {
+	return append(e.int16(int16(len(s))), s...)
+}
+
+// nullString appends the null value of the nullable strings.
+func (e encoder) nullString() encoder {
+	return e.int16(-1)
+}
+
+func (e encoder) bytes(b []byte) encoder {
+	return append(e.int32(int32(len(b))), b...)
+}
+
+// varint appends the zig-zag encoded variable length integers of the record
+// batches.
+func (e encoder) varint(v int64) encoder {
+	var b [binary.MaxVarintLen64]byte
+	return append(e, b[:binary.PutVarint(b[:], v)]...)
+}
+
+// varbytes appends b prefixed with its length as a varint, a nil slice is the
+// null value.
+func (e encoder) varbytes(b []byte) encoder {
+	if b == nil {
+		return e.varint(-1)
+	}
+	return append(e.varint(int64(len(b))), b...)
+}
+
+// decoder reads the primitive types of the protocol from a response, the first
+// error is sticky so the fields can be read before checking it once.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if n < 0 || len(d.b) < n {
+		d.err, d.b = errShortResponse, nil
+		return nil
+	}
+
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string reads a string or a nullable one, null is read as an empty string.
+func (d *decoder) string() string {
+	n := d.int16()
+
+	if n == -1 {
+		return ""
+	}
+
+	return string(d.next(int(n)))
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+
+	if n == -1 {
+		return nil
+	}
+
+	return d.next(int(n))
+}
+
+// arrayLen reads the length of an array, the lengths that can't fit in the
+// rest of the response are rejected so they don't cause huge allocations.
+func (d *decoder) arrayLen() int {
+	n := int(d.int32())
+
+	if n < 0 {
+		return 0
+	}
+
+	if n > len(d.b) {
+		d.err, d.b = errShortResponse, nil
+		return 0
+	}
+
+	return n
+}
+
+// record is a record of a produce request.
+type record struct {
+	key     []byte
+	value   []byte
+	headers [][2]string
+	time    time.Time
+}
+
+func (r record) size() int {
+	n := len(r.key) + len(r.value) + 32
+
+	for _, h := range r.headers {
+		n += len(h[0]) + len(h[1]) + 10
+	}
+
+	return n
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// recordBatch encodes records as a record batch of the version 2 of the
+// message format, uncompressed and without a producer ID.
+func recordBatch(records []record) []byte {
+	first, last := records[0].time, records[0].time
+
+	for _, r := range records[1:] {
+		if r.time.Before(first) {
+			first = r.time
+		}
+		if r.time.After(last) {
+			last = r.time
+		}
+	}
+
+	b := encoder(make([]byte, 0, 128)).
+		int64(0).                       // base offset, set by the broker
+		int32(0).                       // batch length, set below
+		int32(-1).                      // partition leader epoch
+		int8(2).                        // magic
+		int32(0).                       // CRC, set below
+		int16(0).                       // attributes
+		int32(int32(len(records) - 1)). // last offset delta
+		int64(millis(first)).
+		int64(millis(last)).
+		int64(-1). // producer ID
+		int16(-1). // producer epoch
+		int32(-1). // base sequence
+		int32(int32(len(records)))
+
+	for i, r := range records {
+		rec := encoder(nil).
+			int8(0).
+			varint(millis(r.time) - millis(first)).
+			varint(int64(i)).
+			varbytes(r.key).
+			varbytes(r.value).
+			varint(int64(len(r.headers)))
+
+		for _, h := range r.headers {
+			rec = rec.varbytes([]byte(h[0])).varbytes([]byte(h[1]))
+		}
+
+		b = b.varint(int64(len(rec)))
+		b = append(b, rec...)
+	}
+
+	binary.BigEndian.PutUint32(b[8:], uint32(len(b)-12))
+	binary.BigEndian.PutUint32(b[17:], crc32.Checksum(b[21:], crc32c))
+	return b
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// murmur2 is the hash of the default partitioner of the Java client, so
+// records keyed the same by ecs-logs and by other producers end up on the same
+// partitions.
+func murmur2(data []byte) int32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+
+	n := len(data)
+	h := uint32(seed) ^ uint32(n)
+
+	for i := 0; i+4 <= n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := data[n&^3:]
+
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+// partition returns the partition of key among n, like the Java client.
+func partition(key []byte, n int) int {
+	return int(murmur2(key)&0x7fffffff) % n
+}
+
+// metadata is the part of a metadata response that the destination uses: the
+// addresses of the brokers and the leaders of the partitions of the topics.
+type metadata struct {
+	brokers map[int32]string
+	topics  map[string]topicMetadata
+}
+
+type topicMetadata struct {
+	err     *brokerError
+	leaders []int32 // by partition, -1 when the partition has no leader
+}
+
+func metadataRequest(topics []string) encoder {
+	e := encoder(nil).int32(int32(len(topics)))
+
+	for _, t := range topics {
+		e = e.string(t)
+	}
+
+	return e
+}
+
+func decodeMetadata(d *decoder) (m metadata, err error) {
+	m.brokers = make(map[int32]string)
+	m.topics = make(map[string]topicMetadata)
+
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // rack
+		m.brokers[id] = fmt.Sprintf("%s:%d", host, port)
+	}
+
+	d.int32() // controller ID
+
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		var t topicMetadata
+
+		if code := d.int16(); code != 0 {
+			t.err = &brokerError{code: code}
+		}
+
+		name := d.string()
+		d.int8() // is internal
+
+		for j, p := 0, d.arrayLen(); j < p; j++ {
+			d.int16() // error code, the partitions without a leader say it
+			index := d.int32()
+			leader := d.int32()
+
+			for k, r := 0, d.arrayLen(); k < r; k++ {
+				d.int32() // replicas
+			}
+
+			for k, r := 0, d.arrayLen(); k < r; k++ {
+				d.int32() // in-sync replicas
+			}
+
+			if index >= 0 && int(index) < p {
+				for len(t.leaders) <= int(index) {
+					t.leaders = append(t.leaders, -1)
+				}
+				t.leaders[index] = leader
+			}
+		}
+
+		m.topics[name] = t
+	}
+
+	err = d.err
+	return
+}
+
+// produceRequest encodes a request producing batch to a single partition.
+func produceRequest(acks int16, timeout time.Duration, topic string, partition int32, batch []byte) encoder {
+	return encoder(nil).
+		nullString(). // transactional ID
+		int16(acks).
+		int32(int32(timeout / time.Millisecond)).
+		int32(1).
+		string(topic).
+		int32(1).
+		int32(partition).
+		bytes(batch)
+}
+
+// decodeProduce returns the error of the partition in a produce response.
+func decodeProduce(d *decoder) error {
+	var err error
+
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		d.string() // topic
+
+		for j, p := 0, d.arrayLen(); j < p; j++ {
+			d.int32() // partition
+			code := d.int16()
+			d.int64() // base offset
+			d.int64() // log append time
+
+			if code != 0 && err == nil {
+				err = &brokerError{code: code}
+			}
+		}
+	}
+
+	if d.err != nil {
+		return d.err
+	}
+
+	return err
+}
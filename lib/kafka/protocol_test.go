@@ -0,0 +1,135 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The test vectors of the murmur2 function of the Java client.
+func TestMurmur2(t *testing.T) {
+	for s, h := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		if v := murmur2([]byte(s)); v != h {
+			t.Errorf("%s: invalid murmur2 hash: %d != %d", s, v, h)
+		}
+	}
+}
+
+// decodeBatch decodes a record batch produced by recordBatch, after checking
+// its length and CRC.
+func decodeBatch(t *testing.T, b []byte) (records []record) {
+	if n := int(binary.BigEndian.Uint32(b[8:])); n != len(b)-12 {
+		t.Fatalf("invalid batch length: %d != %d", n, len(b)-12)
+	}
+
+	if b[16] != 2 {
+		t.Fatalf("invalid magic: %d", b[16])
+	}
+
+	if crc := binary.BigEndian.Uint32(b[17:]); crc != crc32.Checksum(b[21:], crc32c) {
+		t.Fatalf("invalid batch CRC: %x", crc)
+	}
+
+	firstTime := int64(binary.BigEndian.Uint64(b[27:]))
+	count := int(binary.BigEndian.Uint32(b[57:]))
+	b = b[61:]
+
+	varint := func() int64 {
+		v, n := binary.Varint(b)
+		if n <= 0 {
+			t.Fatal("invalid varint")
+		}
+		b = b[n:]
+		return v
+	}
+
+	varbytes := func() []byte {
+		n := varint()
+		if n < 0 {
+			return nil
+		}
+		v := b[:n]
+		b = b[n:]
+		return v
+	}
+
+	for i := 0; i < count; i++ {
+		varint()  // length
+		b = b[1:] // attributes
+		ts := firstTime + varint()
+
+		if delta := varint(); delta != int64(i) {
+			t.Errorf("invalid offset delta: %d != %d", delta, i)
+		}
+
+		r := record{key: varbytes(), value: varbytes(), time: time.Unix(0, ts*int64(time.Millisecond)).UTC()}
+
+		for h := varint(); h > 0; h-- {
+			r.headers = append(r.headers, [2]string{string(varbytes()), string(varbytes())})
+		}
+
+		records = append(records, r)
+	}
+
+	if len(b) != 0 {
+		t.Errorf("%d bytes left after the records", len(b))
+	}
+
+	return
+}
+
+func TestRecordBatch(t *testing.T) {
+	records := []record{
+		{key: []byte("api/0"), value: []byte("A"), headers: [][2]string{{"group", "api"}}, time: epoch.Add(time.Second)},
+		{value: []byte("B"), time: epoch},
+	}
+
+	if decoded := decodeBatch(t, recordBatch(records)); !reflect.DeepEqual(decoded, records) {
+		t.Errorf("invalid records:\n%+v\n%+v", decoded, records)
+	}
+}
+
+func TestDecodeMetadata(t *testing.T) {
+	res := encoder(nil).
+		int32(2).
+		int32(1).string("kafka-1").int32(9092).nullString().
+		int32(2).string("kafka-2").int32(9092).string("us-west-2a").
+		int32(1).
+		int32(2).
+		int16(0).string("logs").int8(0).
+		int32(2).
+		int16(0).int32(1).int32(2).int32(1).int32(2).int32(1).int32(2).
+		int16(5).int32(0).int32(-1).int32(0).int32(0).
+		int16(3).string("missing").int8(0).int32(0)
+
+	m, err := decodeMetadata(&decoder{b: res})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(m.brokers, map[int32]string{1: "kafka-1:9092", 2: "kafka-2:9092"}) {
+		t.Errorf("invalid brokers: %v", m.brokers)
+	}
+
+	if leaders := m.topics["logs"].leaders; !reflect.DeepEqual(leaders, []int32{-1, 2}) {
+		t.Errorf("invalid leaders: %v", leaders)
+	}
+
+	if e := m.topics["missing"].err; e == nil || e.code != 3 {
+		t.Errorf("invalid topic error: %v", e)
+	}
+
+	if _, err := decodeMetadata(&decoder{b: res[:len(res)-3]}); err != errShortResponse {
+		t.Errorf("a truncated response should be rejected: %v", err)
+	}
+}
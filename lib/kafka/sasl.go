@@ -0,0 +1,98 @@
+package kafka
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"strings"
+
+	"github.com/segmentio/ecs-logs/lib/scram"
+)
+
+// The SASL mechanisms that the destination authenticates with.
+const (
+	mechanismPlain       = "PLAIN"
+	mechanismSCRAMSHA256 = "SCRAM-SHA-256"
+	mechanismSCRAMSHA512 = "SCRAM-SHA-512"
+)
+
+type saslConfig struct {
+	mechanism string
+	username  string
+	password  string
+}
+
+// authenticate runs the SASL handshake on a new connection, then the exchange
+// of the mechanism wrapped in SaslAuthenticate requests.
+func (c *conn) authenticate() error {
+	d, err := c.roundTrip(apiSaslHandshake, saslHandshakeVersion, encoder(nil).string(c.sasl.mechanism), true)
+
+	if err != nil {
+		return err
+	}
+
+	if code := d.int16(); code != 0 {
+		var enabled []string
+
+		for i, n := 0, d.arrayLen(); i < n; i++ {
+			enabled = append(enabled, d.string())
+		}
+
+		return &brokerError{code: code, message: "the broker enables " + strings.Join(enabled, ", ")}
+	}
+
+	if c.sasl.mechanism == mechanismPlain {
+		_, err = c.saslAuthenticate([]byte("\x00" + c.sasl.username + "\x00" + c.sasl.password))
+		return err
+	}
+
+	h := sha256.New
+
+	if c.sasl.mechanism == mechanismSCRAMSHA512 {
+		h = sha512.New
+	}
+
+	// Kafka doesn't apply SASLprep to the credentials, they're used as they
+	// are.
+	s := scram.NewClient(h, c.sasl.username, c.sasl.password, scram.NewNonce())
+	serverFirst, err := c.saslAuthenticate([]byte(s.First()))
+
+	if err != nil {
+		return err
+	}
+
+	final, err := s.Final(string(serverFirst))
+
+	if err != nil {
+		return err
+	}
+
+	serverFinal, err := c.saslAuthenticate([]byte(final))
+
+	if err != nil {
+		return err
+	}
+
+	return s.Verify(string(serverFinal))
+}
+
+func (c *conn) saslAuthenticate(token []byte) ([]byte, error) {
+	d, err := c.roundTrip(apiSaslAuthenticate, saslAuthenticateVersion, encoder(nil).bytes(token), true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	code := d.int16()
+	msg := d.string()
+	res := d.bytes()
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if code != 0 {
+		return nil, &brokerError{code: code, message: msg}
+	}
+
+	return res, nil
+}
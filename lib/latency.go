@@ -0,0 +1,109 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+// PipelineLatencyField is the data field that the time messages spent in
+// ecs-logs is recorded in, when the destination enables it.
+const PipelineLatencyField = "pipeline_latency_ms"
+
+// DestinationPipelineLatency returns whether destination records the pipeline
+// latency of messages, as configured by <DESTINATION>_PIPELINE_LATENCY.
+func DestinationPipelineLatency(destination string) (enabled bool, err error) {
+	name := strings.ToUpper(destination) + "_PIPELINE_LATENCY"
+
+	if s := strings.TrimSpace(Getenv(name)); len(s) != 0 {
+		if enabled, err = strconv.ParseBool(s); err != nil {
+			err = fmt.Errorf("invalid %s, must be a boolean: %s", name, s)
+		}
+	}
+
+	return
+}
+
+// NewLatencyDestination wraps dest so the writers it opens set the number of
+// milliseconds since each message was received in its PipelineLatencyField,
+// right before handing the batch to the destination. Messages that weren't
+// received from a source, like the ones emitted by stages, are left unchanged.
+func NewLatencyDestination(dest Destination, enabled bool) Destination {
+	if !enabled {
+		return dest
+	}
+	return latencyDestination{
+		Destination: dest,
+		now:         time.Now,
+	}
+}
+
+type latencyDestination struct {
+	Destination
+	now func() time.Time
+}
+
+func (d latencyDestination) Open(group string, stream string) (w Writer, err error) {
+	if w, err = d.Destination.Open(group, stream); err == nil {
+		w = latencyWriter{
+			Writer: w,
+			now:    d.now,
+		}
+	}
+	return
+}
+
+type latencyWriter struct {
+	Writer
+	now func() time.Time
+}
+
+func (w latencyWriter) WriteMessage(msg Message) error {
+	return w.WriteMessageBatch(MessageBatch{msg})
+}
+
+func (w latencyWriter) WriteMessageBatch(batch MessageBatch) error {
+	return w.Writer.WriteMessageBatch(w.stamp(batch))
+}
+
+func (w latencyWriter) WriteMessageBatchSize(batch MessageBatch) (int, error) {
+	return WriteMessageBatchSize(w.Writer, w.stamp(batch))
+}
+
+func (w latencyWriter) WriteUrgentMessageBatch(batch MessageBatch) (int, error) {
+	return WriteUrgentMessageBatch(w.Writer, w.stamp(batch))
+}
+
+// stamp returns a copy of batch with the latency set on the messages, the
+// batch may be written to other destinations so it's never modified.
+func (w latencyWriter) stamp(batch MessageBatch) MessageBatch {
+	now := w.now()
+	stamped := make(MessageBatch, len(batch))
+	copy(stamped, batch)
+
+	for i, msg := range stamped {
+		if msg.Received.IsZero() {
+			continue
+		}
+
+		latency := now.Sub(msg.Received)
+
+		if latency < 0 {
+			latency = 0
+		}
+
+		data := make(ecslogs.EventData, len(msg.Event.Data)+1)
+
+		for k, v := range msg.Event.Data {
+			data[k] = v
+		}
+
+		data[PipelineLatencyField] = int64(latency / time.Millisecond)
+		stamped[i].Event.Data = data
+	}
+
+	return stamped
+}
@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+func openLatencyWriter(t *testing.T, enabled bool, now func() time.Time) (w Writer, batches *map[string]MessageBatch) {
+	batches = &map[string]MessageBatch{}
+	dest := NewLatencyDestination(DestinationFunc(func(group string, stream string) (Writer, error) {
+		return oversizeTestWriter{group: group, batches: batches}, nil
+	}), enabled)
+
+	if d, ok := dest.(latencyDestination); ok && now != nil {
+		d.now = now
+		dest = d
+	}
+
+	w, err := dest.Open("A", "B")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func TestLatencyDestination(t *testing.T) {
+	received := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	now := received.Add(1500 * time.Millisecond)
+
+	w, batches := openLatencyWriter(t, true, func() time.Time { return now })
+	defer w.Close()
+
+	original := ecslogs.EventData{"user": "luke"}
+	batch := MessageBatch{
+		{Event: ecslogs.Event{Message: "Hello World!", Data: original}, Received: received},
+		{Event: ecslogs.Event{Message: "emitted by a stage"}},
+		{Event: ecslogs.Event{Message: "clock went backward"}, Received: now.Add(time.Second)},
+	}
+
+	if err := w.WriteMessageBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	written := (*batches)["A"]
+
+	if len(written) != 3 {
+		t.Fatalf("invalid number of messages written: %d", len(written))
+	}
+
+	if latency := written[0].Event.Data[PipelineLatencyField]; latency != int64(1500) {
+		t.Errorf("invalid latency: %v", latency)
+	}
+
+	if written[0].Event.Data["user"] != "luke" {
+		t.Errorf("the data of the message should be kept: %v", written[0].Event.Data)
+	}
+
+	if _, ok := written[1].Event.Data[PipelineLatencyField]; ok {
+		t.Error("messages without a receive time should not get a latency")
+	}
+
+	if latency := written[2].Event.Data[PipelineLatencyField]; latency != int64(0) {
+		t.Errorf("the latency should never be negative: %v", latency)
+	}
+
+	if _, ok := original[PipelineLatencyField]; ok || batch[0].Event.Data[PipelineLatencyField] != nil {
+		t.Error("the original batch should not be modified")
+	}
+}
+
+func TestLatencyDestinationDisabled(t *testing.T) {
+	w, batches := openLatencyWriter(t, false, nil)
+	defer w.Close()
+
+	if _, ok := w.(latencyWriter); ok {
+		t.Error("the writers should not be wrapped when the latency is disabled")
+	}
+
+	w.WriteMessageBatch(MessageBatch{{Event: ecslogs.Event{Message: "Hello World!"}, Received: time.Now()}})
+
+	if _, ok := (*batches)["A"][0].Event.Data[PipelineLatencyField]; ok {
+		t.Error("the latency should not be set when it's disabled")
+	}
+}
+
+func TestLatencyDestinationMonotonic(t *testing.T) {
+	w, batches := openLatencyWriter(t, true, nil)
+	defer w.Close()
+
+	received := time.Now()
+	time.Sleep(2 * time.Millisecond)
+	w.WriteMessageBatch(MessageBatch{{Event: ecslogs.Event{Message: "Hello World!"}, Received: received}})
+	elapsed := time.Since(received)
+
+	latency, _ := (*batches)["A"][0].Event.Data[PipelineLatencyField].(int64)
+
+	if latency < 2 || time.Duration(latency)*time.Millisecond > elapsed {
+		t.Errorf("the latency should be between 2ms and %s: %dms", elapsed, latency)
+	}
+}
+
+func TestDestinationPipelineLatency(t *testing.T) {
+	SetConfigEnv(map[string]string{"TESTDEST_PIPELINE_LATENCY": "true"})
+	defer SetConfigEnv(nil)
+
+	if enabled, err := DestinationPipelineLatency("testdest"); err != nil || !enabled {
+		t.Errorf("the pipeline latency should be enabled: %t (%v)", enabled, err)
+	}
+
+	if enabled, err := DestinationPipelineLatency("other"); err != nil || enabled {
+		t.Errorf("the pipeline latency should be disabled by default: %t (%v)", enabled, err)
+	}
+
+	SetConfigEnv(map[string]string{"TESTDEST_PIPELINE_LATENCY": "sometimes"})
+
+	if _, err := DestinationPipelineLatency("testdest"); err == nil {
+		t.Error("an invalid value should be rejected")
+	}
+}
@@ -3,5 +3,5 @@ package logdna
 import "github.com/segmentio/ecs-logs/lib"
 
 func init() {
-	lib.RegisterDestination("logdna", lib.DestinationFunc(NewWriter))
+	lib.RegisterDestination("logdna", lib.NewCheckedDestination(lib.DestinationFunc(NewWriter), checkConfig))
 }
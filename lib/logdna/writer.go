@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net"
 	"net/url"
-	"os"
 	"strings"
 
 	"github.com/apex/log"
@@ -22,6 +21,8 @@ func NewWriter(group string, stream string) (w lib.Writer, err error) {
 	var template string
 	var timeFormat string
 	var socksProxy string
+	var tlsConfig *tls.Config
+	var envelope lib.Envelope
 
 	if endpoint, err = getEndpoint(); err != nil {
 		return
@@ -31,18 +32,26 @@ func NewWriter(group string, stream string) (w lib.Writer, err error) {
 		return
 	}
 
-	if template = os.Getenv("LOGDNA_TEMPLATE"); len(template) == 0 {
+	if template = lib.Getenv("LOGDNA_TEMPLATE"); len(template) == 0 {
 		template = "<{{.PRIVAL}}>1 {{.TIMESTAMP}} {{.HOSTNAME}} {{.GROUP}} {{.STREAM}} {{.MSGID}} [{{.TAG}}] {{.MSG}}"
 		if len(token) != 0 {
 			template = "<key:" + token + "> " + template
 		}
 	}
 
-	if timeFormat = os.Getenv("LOGDNA_TIME_FORMAT"); len(timeFormat) == 0 {
+	if timeFormat = lib.Getenv("LOGDNA_TIME_FORMAT"); len(timeFormat) == 0 {
 		timeFormat = "2016-02-10T09:28:01.982-08:00"
 	}
 
-	if socksProxy = os.Getenv("SOCKS_PROXY"); len(socksProxy) > 0 {
+	if tlsConfig, err = getTLSConfig(); err != nil {
+		return
+	}
+
+	if envelope, err = lib.DestinationEnvelope("logdna"); err != nil {
+		return
+	}
+
+	if socksProxy = lib.Getenv("SOCKS_PROXY"); len(socksProxy) > 0 {
 		if _, _, err = net.SplitHostPort(socksProxy); err != nil {
 			log.WithFields(log.Fields{
 				"SOCKS_PROXY": socksProxy,
@@ -57,21 +66,56 @@ func NewWriter(group string, stream string) (w lib.Writer, err error) {
 		Template:   template,
 		TimeFormat: timeFormat,
 		Tag:        fmt.Sprintf("logdna@48950 %s", tags),
-		TLS: &tls.Config{
-			InsecureSkipVerify: true,
-		},
+		TLS:        tlsConfig,
 		SocksProxy: socksProxy,
+		Envelope:   envelope,
 	})
 }
 
+// checkConfig validates the endpoint of the destination, the group and stream
+// only affect the tags so any name will do.
+func checkConfig() (err error) {
+	var endpoint string
+
+	if endpoint, err = getEndpoint(); err == nil {
+		_, _, _, _, err = parseEndpoint(endpoint, "group", "stream")
+	}
+
+	if err == nil {
+		_, err = getTLSConfig()
+	}
+
+	if err == nil {
+		_, err = lib.DestinationEnvelope("logdna")
+	}
+
+	return
+}
+
+// defaultTLS is used unless LOGDNA_TLS_* settings are given, it's shared by all
+// the writers so they use the same connection pool.
+var defaultTLS = &tls.Config{
+	InsecureSkipVerify: true,
+}
+
+func getTLSConfig() (*tls.Config, error) {
+	c, err := lib.DestinationTLS("logdna")
+
+	if err != nil || !c.Enabled() {
+		return defaultTLS, err
+	}
+
+	return c.Load()
+}
+
 func getEndpoint() (endpoint string, err error) {
 	var token string
 
-	if endpoint = os.Getenv("LOGDNA_URL"); len(endpoint) != 0 {
+	if endpoint = lib.Getenv("LOGDNA_URL"); len(endpoint) != 0 {
 		return
 	}
 
-	if token = os.Getenv("LOGDNA_TOKEN"); len(token) != 0 {
+	if token = lib.Getenv("LOGDNA_TOKEN"); len(token) != 0 {
 		endpoint = "tls://syslog-a.logdna.com:6514"
 		return
 	}
@@ -3,5 +3,5 @@ package loggly
 import "github.com/segmentio/ecs-logs/lib"
 
 func init() {
-	lib.RegisterDestination("loggly", lib.DestinationFunc(NewWriter))
+	lib.RegisterDestination("loggly", lib.NewCheckedDestination(lib.DestinationFunc(NewWriter), checkConfig))
 }
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net"
 	"net/url"
-	"os"
 	"strings"
 
 	"github.com/apex/log"
@@ -23,6 +22,8 @@ func NewWriter(group string, stream string) (w lib.Writer, err error) {
 	var template string
 	var timeFormat string
 	var socksProxy string
+	var tlsConfig *tls.Config
+	var envelope lib.Envelope
 
 	if endpoint, err = getEndpoint(); err != nil {
 		return
@@ -32,15 +33,23 @@ func NewWriter(group string, stream string) (w lib.Writer, err error) {
 		return
 	}
 
-	if template = os.Getenv("LOGGLY_TEMPLATE"); len(template) == 0 {
+	if template = lib.Getenv("LOGGLY_TEMPLATE"); len(template) == 0 {
 		template = "<{{.PRIVAL}}>1 {{.TIMESTAMP}} {{.HOSTNAME}} {{.GROUP}} {{.PROCID}} {{.MSGID}} [{{.TAG}}] {{.MSG}}"
 	}
 
-	if timeFormat = os.Getenv("LOGGLY_TIME_FORMAT"); len(timeFormat) == 0 {
+	if timeFormat = lib.Getenv("LOGGLY_TIME_FORMAT"); len(timeFormat) == 0 {
 		timeFormat = "2006-01-02T15:04:05.999Z07:00"
 	}
 
-	if socksProxy = os.Getenv("SOCKS_PROXY"); len(socksProxy) > 0 {
+	if tlsConfig, err = getTLSConfig(); err != nil {
+		return
+	}
+
+	if envelope, err = lib.DestinationEnvelope("loggly"); err != nil {
+		return
+	}
+
+	if socksProxy = lib.Getenv("SOCKS_PROXY"); len(socksProxy) > 0 {
 		if _, _, err = net.SplitHostPort(socksProxy); err != nil {
 			log.WithFields(log.Fields{
 				"SOCKS_PROXY": socksProxy,
@@ -55,21 +64,56 @@ func NewWriter(group string, stream string) (w lib.Writer, err error) {
 		Template:   template,
 		TimeFormat: timeFormat,
 		Tag:        fmt.Sprintf("%s@%s %s", token, pen, tags),
-		TLS: &tls.Config{
-			InsecureSkipVerify: true,
-		},
+		TLS:        tlsConfig,
 		SocksProxy: socksProxy,
+		Envelope:   envelope,
 	})
 }
 
+// checkConfig validates LOGGLY_URL or LOGGLY_TOKEN, the group and stream names
+// passed to parseEndpoint only end up in the tags.
+func checkConfig() (err error) {
+	var endpoint string
+
+	if endpoint, err = getEndpoint(); err == nil {
+		_, _, _, _, _, err = parseEndpoint(endpoint, "group", "stream")
+	}
+
+	if err == nil {
+		_, err = getTLSConfig()
+	}
+
+	if err == nil {
+		_, err = lib.DestinationEnvelope("loggly")
+	}
+
+	return
+}
+
+// The TLS config of the connections to loggly when no LOGGLY_TLS_* setting is
+// set, a single value is shared so the syslog connections get pooled.
+var defaultTLS = &tls.Config{
+	InsecureSkipVerify: true,
+}
+
+func getTLSConfig() (*tls.Config, error) {
+	c, err := lib.DestinationTLS("loggly")
+
+	if err != nil || !c.Enabled() {
+		return defaultTLS, err
+	}
+
+	return c.Load()
+}
+
 func getEndpoint() (endpoint string, err error) {
 	var token string
 
-	if endpoint = os.Getenv("LOGGLY_URL"); len(endpoint) != 0 {
+	if endpoint = lib.Getenv("LOGGLY_URL"); len(endpoint) != 0 {
 		return
 	}
 
-	if token = os.Getenv("LOGGLY_TOKEN"); len(token) != 0 {
+	if token = lib.Getenv("LOGGLY_TOKEN"); len(token) != 0 {
 		endpoint = "tls://" + token + "@logs-01.loggly.com:6514"
 		return
 	}
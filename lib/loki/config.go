@@ -0,0 +1,192 @@
+package loki
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+// The path of the push API, appended to LOKI_URL when it has none.
+const pushPath = "/loki/api/v1/push"
+
+const defaultLabels = "group,level"
+
+// Loki limits the number of labels of a stream to 15 by default.
+const maxLabels = 15
+
+// The formats of the push requests.
+const (
+	formatProtobuf = "protobuf"
+	formatJSON     = "json"
+)
+
+// config carries the settings of the loki destination, they are loaded from
+// LOKI_* environment variables.
+type config struct {
+	// The URL of the push API.
+	url string
+
+	// The format of the requests, protobuf bodies are always compressed
+	// with snappy.
+	format string
+
+	// The labels of the streams, only the ones listed are sent so the high
+	// cardinality fields don't create a stream each.
+	labels []label
+
+	// The tenant of the logs in a multi-tenant Loki, sent in X-Scope-OrgID.
+	tenant string
+
+	// The basic authentication credentials, Grafana Cloud takes the ID of
+	// the instance and an API token.
+	username string
+	password string
+
+	// The compression of the JSON bodies.
+	compression lib.BodyCompression
+
+	// How the requests failing with a network error, a 429 or a 5xx status
+	// are sent again.
+	retry       retry.Policy
+	retryBudget lib.RetryBudget
+
+	tls      *tls.Config
+	checksum lib.BodyChecksum
+
+	err error
+}
+
+// label is a label of the streams, named name and taking the value of source:
+// group, stream, level, host or data.<field>.
+type label struct {
+	name   string
+	source string
+}
+
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func getConfig() (c config) {
+	var err error
+	var s string
+
+	c = config{
+		url:    strings.TrimSpace(lib.Getenv("LOKI_URL")),
+		format: formatProtobuf,
+	}
+
+	if len(c.url) == 0 {
+		c.err = lib.AppendError(c.err, fmt.Errorf("missing LOKI_URL environment variable"))
+	} else if u, e := url.Parse(c.url); e != nil || len(u.Host) == 0 || (u.Scheme != "http" && u.Scheme != "https") {
+		c.err = lib.AppendError(c.err, fmt.Errorf("invalid LOKI_URL, must be an http or https URL: %s", c.url))
+	} else if strings.Trim(u.Path, "/") == "" {
+		c.url = strings.TrimRight(c.url, "/") + pushPath
+	}
+
+	switch s = strings.ToLower(strings.TrimSpace(lib.Getenv("LOKI_FORMAT"))); s {
+	case "":
+	case formatProtobuf, formatJSON:
+		c.format = s
+	default:
+		c.err = lib.AppendError(c.err, fmt.Errorf("invalid LOKI_FORMAT, must be one of protobuf or json: %s", s))
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("LOKI_LABELS")); len(s) == 0 {
+		s = defaultLabels
+	}
+
+	if c.labels, err = parseLabels(s); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	c.tenant = strings.TrimSpace(lib.Getenv("LOKI_TENANT_ID"))
+	c.username = lib.Getenv("LOKI_USERNAME")
+	c.password = lib.Getenv("LOKI_PASSWORD")
+
+	if c.compression, err = lib.DestinationBodyCompression("loki", "none"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	} else if c.compression.Enabled() && c.format == formatProtobuf {
+		c.err = lib.AppendError(c.err, fmt.Errorf("invalid LOKI_COMPRESSION, the protobuf requests are always compressed with snappy, it only applies to LOKI_FORMAT=json"))
+	}
+
+	if c.retry, err = retry.DestinationPolicy("loki", retry.DefaultPolicy); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.retryBudget, err = lib.DestinationRetryBudget("loki"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if t, err := lib.DestinationTLS("loki"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	} else if t.Enabled() {
+		if c.tls, err = t.Load(); err != nil {
+			c.err = lib.AppendError(c.err, err)
+		}
+	}
+
+	if c.checksum, err = lib.DestinationBodyChecksum("loki"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	return
+}
+
+func (c config) check() error {
+	return c.err
+}
+
+// parseLabels parses a comma separated list of labels, each one is the source
+// of its value optionally renamed with name=source, for example
+// "group,level,app=data.app".
+func parseLabels(s string) (labels []label, err error) {
+	seen := make(map[string]bool)
+
+	for _, item := range strings.Split(s, ",") {
+		var l label
+
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+
+		if i := strings.IndexByte(item, '='); i >= 0 {
+			l.name, l.source = strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+		} else {
+			l.source = item
+			l.name = strings.Replace(strings.TrimPrefix(item, "data."), ".", "_", -1)
+		}
+
+		switch {
+		case l.source == "group", l.source == "stream", l.source == "level", l.source == "host":
+		case strings.HasPrefix(l.source, "data.") && len(l.source) > len("data."):
+		default:
+			err = fmt.Errorf("invalid LOKI_LABELS, the values come from group, stream, level, host or data.<field>: %s", item)
+			return
+		}
+
+		if !labelName.MatchString(l.name) || strings.HasPrefix(l.name, "__") {
+			err = fmt.Errorf("invalid LOKI_LABELS, bad label name: %s", item)
+			return
+		}
+
+		if seen[l.name] {
+			err = fmt.Errorf("invalid LOKI_LABELS, the label is listed twice: %s", l.name)
+			return
+		}
+
+		seen[l.name] = true
+		labels = append(labels, l)
+	}
+
+	if len(labels) == 0 {
+		err = fmt.Errorf("invalid LOKI_LABELS, at least one label is needed: %s", s)
+	} else if len(labels) > maxLabels {
+		err = fmt.Errorf("invalid LOKI_LABELS, Loki accepts at most %d labels: %s", maxLabels, s)
+	}
+
+	return
+}
@@ -0,0 +1,7 @@
+package loki
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterDestination("loki", newDestination(getConfig))
+}
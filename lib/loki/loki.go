@@ -0,0 +1,306 @@
+// Package loki implements the loki destination, which pushes the messages to
+// the push API of Grafana Loki.
+package loki
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/golang/snappy"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+// destination pushes the messages of all the streams of ecs-logs to a single
+// Loki, the writers share its HTTP client.
+type destination struct {
+	lazy   lib.LazyConfig
+	load   func() config
+	config config
+
+	client  *http.Client
+	retries *lib.RetryLimiter
+	clock   clock.Clock
+}
+
+func newDestination(load func() config) *destination {
+	return &destination{
+		load:   load,
+		client: &http.Client{Timeout: 30 * time.Second},
+		clock:  clock.System,
+	}
+}
+
+func (d *destination) Open(group string, stream string) (w lib.Writer, err error) {
+	if err = d.lazy.Init(d.init); err == nil {
+		w = writer{dest: d}
+	}
+
+	return
+}
+
+// CheckConfig reports the problems with the LOKI_* settings when ecs-logs
+// starts.
+func (d *destination) CheckConfig() error {
+	return d.load().check()
+}
+
+func (d *destination) Close(group string, stream string) {}
+
+func (d *destination) init() error {
+	d.config = d.load()
+	d.retries = lib.NewRetryLimiter("loki", d.config.retryBudget, metrics.Default)
+
+	if d.config.tls != nil {
+		d.client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: d.config.tls,
+		}
+	}
+
+	return d.config.check()
+}
+
+// stream is a Loki stream of a push request, its labels are sorted by name.
+type stream struct {
+	labels  string
+	values  map[string]string
+	entries []entry
+}
+
+// streams groups the messages of batch by the values of their labels. The
+// order of the messages of each stream is kept, Loki rejects the entries older
+// than the last one of their stream.
+func (d *destination) streams(batch lib.MessageBatch) (streams []*stream, err error) {
+	index := make(map[string]*stream)
+
+	for _, msg := range batch {
+		line, e := json.Marshal(msg.Event)
+
+		if e != nil {
+			err = lib.AppendError(err, e)
+			continue
+		}
+
+		t := msg.Event.Time
+
+		if t.IsZero() {
+			t = d.clock.Now()
+		}
+
+		values := d.labels(msg)
+		key := formatLabels(values)
+		s := index[key]
+
+		if s == nil {
+			s = &stream{labels: key, values: values}
+			index[key] = s
+			streams = append(streams, s)
+		}
+
+		s.entries = append(s.entries, entry{time: t, line: string(line)})
+	}
+
+	sort.Slice(streams, func(i int, j int) bool { return streams[i].labels < streams[j].labels })
+	return
+}
+
+// labels returns the labels of msg, the empty ones are left out like Loki
+// does. A stream needs at least one label, the messages without any get the
+// ecs-logs job.
+func (d *destination) labels(msg lib.Message) map[string]string {
+	values := make(map[string]string, len(d.config.labels))
+
+	for _, l := range d.config.labels {
+		var v string
+
+		switch l.source {
+		case "group":
+			v = msg.Group
+		case "stream":
+			v = msg.Stream
+		case "level":
+			if msg.Event.Level != ecslogs.NONE {
+				v = msg.Event.Level.String()
+			}
+		case "host":
+			v = msg.Event.Info.Host
+		default:
+			if x, ok := msg.Event.Data[strings.TrimPrefix(l.source, "data.")]; ok && x != nil {
+				v = fmt.Sprint(x)
+			}
+		}
+
+		if len(v) != 0 {
+			values[l.name] = v
+		}
+	}
+
+	if len(values) == 0 {
+		values["job"] = "ecs-logs"
+	}
+
+	return values
+}
+
+// formatLabels formats the labels like the selectors of LogQL, which is how
+// the protobuf requests carry them.
+func formatLabels(values map[string]string) string {
+	names := make([]string, 0, len(values))
+
+	for name := range values {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	b.WriteByte('{')
+
+	for i, name := range names {
+		if i != 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[name]))
+		b.WriteByte('"')
+	}
+
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// jsonPushRequest is the JSON version of the push requests, the values are
+// pairs of a time in nanoseconds and a line.
+type jsonPushRequest struct {
+	Streams []jsonStream `json:"streams"`
+}
+
+type jsonStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// body returns the body of the push request of streams and its Content-Type.
+func (d *destination) body(streams []*stream) (body []byte, contentType string, err error) {
+	if d.config.format == formatProtobuf {
+		return snappy.Encode(nil, encodePushRequest(streams)), "application/x-protobuf", nil
+	}
+
+	req := jsonPushRequest{Streams: make([]jsonStream, 0, len(streams))}
+
+	for _, s := range streams {
+		js := jsonStream{Stream: s.values, Values: make([][2]string, 0, len(s.entries))}
+
+		for _, e := range s.entries {
+			js.Values = append(js.Values, [2]string{strconv.FormatInt(e.time.UnixNano(), 10), e.line})
+		}
+
+		req.Streams = append(req.Streams, js)
+	}
+
+	if body, err = json.Marshal(req); err == nil {
+		body, err = d.config.compression.Compress(body)
+	}
+
+	return body, "application/json", err
+}
+
+// push sends streams with a single request. The requests failing with a
+// network error, a 429 or a 5xx status are sent again with the retry policy of
+// the destination, the ones that Loki rejected (like entries too old or out of
+// order) would fail again and are reported right away.
+func (d *destination) push(streams []*stream) error {
+	body, contentType, err := d.body(streams)
+
+	if err != nil {
+		return err
+	}
+
+	return d.config.retry.Do(d.clock, d.retries, func() error {
+		var req *http.Request
+		var res *http.Response
+		var err error
+
+		if req, err = http.NewRequest("POST", d.config.url, bytes.NewReader(body)); err != nil {
+			return err
+		}
+
+		req.Header.Set("Content-Type", contentType)
+
+		if d.config.format == formatJSON {
+			d.config.compression.Set(req)
+		}
+
+		if len(d.config.tenant) != 0 {
+			req.Header.Set("X-Scope-OrgID", d.config.tenant)
+		}
+
+		if len(d.config.username) != 0 {
+			req.SetBasicAuth(d.config.username, d.config.password)
+		}
+
+		d.config.checksum.Sign(req, body)
+
+		if res, err = d.client.Do(req); err != nil {
+			return retry.Retryable(err)
+		}
+		defer res.Body.Close()
+
+		if cerr := d.config.checksum.Verify(res, body); cerr != nil {
+			metrics.Default.Counter("checksum_mismatches", "destination", "loki").Add(1)
+			log.WithError(cerr).Warn("loki received a corrupted push request")
+		}
+
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			msg, _ := ioutil.ReadAll(&io.LimitedReader{R: res.Body, N: 1024})
+			err = fmt.Errorf("loki responded with %s: %s", res.Status, bytes.TrimSpace(msg))
+
+			if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
+				err = retry.Retryable(err)
+			}
+			return err
+		}
+
+		return nil
+	})
+}
+
+type writer struct {
+	dest *destination
+}
+
+func (w writer) Close() error {
+	return nil
+}
+
+func (w writer) WriteMessage(msg lib.Message) error {
+	return w.WriteMessageBatch(lib.MessageBatch{msg})
+}
+
+func (w writer) WriteMessageBatch(batch lib.MessageBatch) (err error) {
+	streams, err := w.dest.streams(batch)
+
+	if len(streams) != 0 {
+		if e := w.dest.push(streams); e != nil {
+			err = lib.AppendError(err, e)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,376 @@
+package loki
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/codec"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+var epoch = time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC)
+
+// request is a push request received by the mock Loki, decoded whatever its
+// format was.
+type request struct {
+	header  http.Header
+	streams []jsonStream
+}
+
+type mockAPI struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	requests []request
+	status   func(call int) int
+}
+
+func newTestDestination(t *testing.T, c config) (*destination, *mockAPI) {
+	api := &mockAPI{}
+	api.Server = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		r := request{header: req.Header}
+		body, _ := ioutil.ReadAll(req.Body)
+
+		if req.URL.Path != pushPath {
+			t.Errorf("invalid path: %s", req.URL.Path)
+		}
+
+		switch req.Header.Get("Content-Type") {
+		case "application/x-protobuf":
+			b, err := snappy.Decode(nil, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.streams = decodePushRequest(t, b)
+
+		case "application/json":
+			if enc := req.Header.Get("Content-Encoding"); len(enc) != 0 {
+				c, _ := codec.Get(enc, 0)
+				rd, _ := c.NewReader(strings.NewReader(string(body)))
+				body, _ = ioutil.ReadAll(rd)
+			}
+
+			var push jsonPushRequest
+
+			if err := json.Unmarshal(body, &push); err != nil {
+				t.Fatal(err)
+			}
+			r.streams = push.Streams
+
+		default:
+			t.Errorf("invalid content type: %s", req.Header.Get("Content-Type"))
+		}
+
+		api.mutex.Lock()
+		api.requests = append(api.requests, r)
+		call := len(api.requests)
+		api.mutex.Unlock()
+
+		if api.status != nil {
+			if status := api.status(call); status != 0 {
+				http.Error(res, "test error", status)
+				return
+			}
+		}
+
+		res.WriteHeader(http.StatusNoContent)
+	}))
+
+	labels, _ := parseLabels(defaultLabels)
+
+	c.url = api.URL + pushPath
+
+	if len(c.format) == 0 {
+		c.format = formatProtobuf
+	}
+
+	if c.labels == nil {
+		c.labels = labels
+	}
+
+	d := newDestination(func() config { return c })
+	d.clock = clock.NewFake(epoch)
+	return d, api
+}
+
+// decodePushRequest decodes a protobuf push request into its JSON version, the
+// labels are parsed back from their selector.
+func decodePushRequest(t *testing.T, b []byte) (streams []jsonStream) {
+	for _, sb := range fields(t, b)[1] {
+		s := fields(t, sb)
+		js := jsonStream{Stream: parseSelector(string(s[1][0]))}
+
+		for _, eb := range s[2] {
+			e := fields(t, eb)
+			ts := fields(t, e[1][0])
+			sec, nsec := varint(ts[1]), varint(ts[2])
+			js.Values = append(js.Values, [2]string{fmt.Sprint(time.Unix(int64(sec), int64(nsec)).UnixNano()), string(e[2][0])})
+		}
+
+		streams = append(streams, js)
+	}
+	return
+}
+
+// fields returns the values of the fields of a protobuf message by number, the
+// varints are returned as their encoding.
+func fields(t *testing.T, b []byte) map[int][][]byte {
+	m := make(map[int][][]byte)
+
+	for len(b) != 0 {
+		key, n := readVarint(b)
+		b = b[n:]
+
+		switch key & 7 {
+		case wireVarint:
+			_, n = readVarint(b)
+			m[int(key>>3)] = append(m[int(key>>3)], b[:n])
+		case wireBytes:
+			l, k := readVarint(b)
+			n = k + int(l)
+			m[int(key>>3)] = append(m[int(key>>3)], b[k:n])
+		default:
+			t.Fatalf("unexpected wire type: %d", key&7)
+		}
+
+		b = b[n:]
+	}
+
+	return m
+}
+
+func readVarint(b []byte) (v uint64, n int) {
+	for shift := uint(0); n < len(b); shift += 7 {
+		c := b[n]
+		n++
+		v |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			break
+		}
+	}
+	return
+}
+
+func varint(values [][]byte) uint64 {
+	if len(values) == 0 {
+		return 0
+	}
+	v, _ := readVarint(values[0])
+	return v
+}
+
+func parseSelector(s string) map[string]string {
+	labels := make(map[string]string)
+
+	for _, pair := range strings.Split(strings.Trim(s, "{}"), ", ") {
+		i := strings.Index(pair, "=")
+		v, _ := strconv.Unquote(pair[i+1:])
+		labels[pair[:i]] = v
+	}
+
+	return labels
+}
+
+func makeMessage(group string, level ecslogs.Level, text string) lib.Message {
+	return lib.Message{
+		Group:  group,
+		Stream: "task/0123",
+		Event:  ecslogs.Event{Level: level, Time: epoch, Message: text},
+	}
+}
+
+func TestWriterPush(t *testing.T) {
+	for _, format := range []string{formatProtobuf, formatJSON} {
+		d, api := newTestDestination(t, config{format: format, tenant: "team-a", username: "1234", password: "token"})
+
+		w, _ := d.Open("api", "task/0123")
+
+		batch := lib.MessageBatch{
+			makeMessage("api", ecslogs.INFO, "A"),
+			makeMessage("worker", ecslogs.INFO, "B"),
+			makeMessage("api", ecslogs.INFO, `say "hi"`),
+			makeMessage("api", ecslogs.ERROR, "C"),
+		}
+		batch[2].Event.Time = epoch.Add(time.Second + 5)
+
+		if err := w.WriteMessageBatch(batch); err != nil {
+			t.Fatal(err)
+		}
+
+		api.Close()
+
+		if len(api.requests) != 1 {
+			t.Fatalf("%s: the batch should be pushed with a single request: %d", format, len(api.requests))
+		}
+
+		r := api.requests[0]
+
+		if r.header.Get("X-Scope-OrgID") != "team-a" {
+			t.Errorf("%s: the tenant should be sent: %v", format, r.header)
+		}
+
+		if user, pass, _ := (&http.Request{Header: r.header}).BasicAuth(); user != "1234" || pass != "token" {
+			t.Errorf("%s: invalid credentials: %s:%s", format, user, pass)
+		}
+
+		labels := make([]map[string]string, len(r.streams))
+		counts := make([]int, len(r.streams))
+
+		for i, s := range r.streams {
+			labels[i], counts[i] = s.Stream, len(s.Values)
+		}
+
+		ref := []map[string]string{
+			{"group": "api", "level": "ERROR"},
+			{"group": "api", "level": "INFO"},
+			{"group": "worker", "level": "INFO"},
+		}
+
+		if !reflect.DeepEqual(labels, ref) || !reflect.DeepEqual(counts, []int{1, 2, 1}) {
+			t.Errorf("%s: invalid streams: %v %v", format, labels, counts)
+		}
+
+		// The entries keep the order of the messages, with their time in
+		// nanoseconds and their event as the line.
+		v := r.streams[1].Values[1]
+
+		var event ecslogs.Event
+		json.Unmarshal([]byte(v[1]), &event)
+
+		if v[0] != fmt.Sprint(epoch.Add(time.Second+5).UnixNano()) || event.Message != `say "hi"` {
+			t.Errorf("%s: invalid entry: %v", format, v)
+		}
+	}
+}
+
+func TestWriterLabels(t *testing.T) {
+	labels, err := parseLabels("service=group,host,app=data.app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, api := newTestDestination(t, config{labels: labels})
+	defer api.Close()
+	d.Open("api", "0")
+
+	msg := makeMessage("api", ecslogs.INFO, "A")
+	msg.Event.Info.Host = "ip-10-0-0-1"
+	msg.Event.Data = ecslogs.EventData{"app": "checkout"}
+
+	if values := d.labels(msg); !reflect.DeepEqual(values, map[string]string{"service": "api", "host": "ip-10-0-0-1", "app": "checkout"}) {
+		t.Errorf("invalid labels: %v", values)
+	}
+
+	if s := formatLabels(map[string]string{"b": "x\ny", "a": `q"\`}); s != `{a="q\"\\", b="x\ny"}` {
+		t.Errorf("invalid selector: %s", s)
+	}
+
+	// The messages without any of the labels still need one to be pushed.
+	d.config.labels = []label{{name: "app", source: "data.app"}}
+
+	if values := d.labels(makeMessage("api", ecslogs.INFO, "A")); !reflect.DeepEqual(values, map[string]string{"job": "ecs-logs"}) {
+		t.Errorf("invalid default labels: %v", values)
+	}
+}
+
+func TestWriterRetries(t *testing.T) {
+	d, api := newTestDestination(t, config{retry: retry.Policy{MaxRetries: 3}})
+	defer api.Close()
+
+	api.status = func(call int) int {
+		if call < 3 {
+			return http.StatusServiceUnavailable
+		}
+		return 0
+	}
+
+	w, _ := d.Open("api", "0")
+
+	if err := w.WriteMessageBatch(lib.MessageBatch{makeMessage("api", ecslogs.INFO, "A")}); err != nil || len(api.requests) != 3 {
+		t.Errorf("the request should be sent again until it succeeds: %d (%v)", len(api.requests), err)
+	}
+
+	// The entries that Loki rejects are reported without retrying.
+	api.status = func(int) int { return http.StatusBadRequest }
+
+	if err := w.WriteMessageBatch(lib.MessageBatch{makeMessage("api", ecslogs.INFO, "B")}); err == nil || len(api.requests) != 4 {
+		t.Errorf("the rejected request should not be sent again: %d (%v)", len(api.requests), err)
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := parseLabels(" group, svc=stream ,data.user.id")
+
+	ref := []label{
+		{name: "group", source: "group"},
+		{name: "svc", source: "stream"},
+		{name: "user_id", source: "data.user.id"},
+	}
+
+	if err != nil || !reflect.DeepEqual(labels, ref) {
+		t.Errorf("invalid labels: %+v (%v)", labels, err)
+	}
+
+	var many []string
+
+	for i := 0; i <= maxLabels; i++ {
+		many = append(many, fmt.Sprintf("data.a%d", i))
+	}
+
+	for _, s := range []string{
+		"",
+		"message",
+		"data.",
+		"1st=group",
+		"__name__=group",
+		"group,group=stream",
+		strings.Join(many, ","),
+	} {
+		if _, err := parseLabels(s); err == nil {
+			t.Errorf("%q: the labels should be rejected", s)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(map[string]string{"LOKI_URL": "http://loki:3100/"})
+
+	if c := getConfig(); c.err != nil || c.url != "http://loki:3100"+pushPath || c.format != formatProtobuf || len(c.labels) != 2 {
+		t.Errorf("invalid config: %+v (%v)", c, c.err)
+	}
+
+	lib.SetConfigEnv(map[string]string{"LOKI_URL": "https://logs.example.com/api/push", "LOKI_FORMAT": "JSON", "LOKI_COMPRESSION": "gzip"})
+
+	if c := getConfig(); c.err != nil || c.url != "https://logs.example.com/api/push" || c.format != formatJSON || c.compression.Encoding() != "gzip" {
+		t.Errorf("invalid config: %+v (%v)", c, c.err)
+	}
+
+	for _, env := range []map[string]string{
+		{},
+		{"LOKI_URL": "loki:3100"},
+		{"LOKI_URL": "http://loki:3100", "LOKI_FORMAT": "xml"},
+		{"LOKI_URL": "http://loki:3100", "LOKI_COMPRESSION": "gzip"},
+		{"LOKI_URL": "http://loki:3100", "LOKI_LABELS": "message"},
+	} {
+		lib.SetConfigEnv(env)
+
+		if c := getConfig(); c.err == nil {
+			t.Errorf("%v: the configuration should be rejected", env)
+		}
+	}
+}
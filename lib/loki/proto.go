@@ -0,0 +1,78 @@
+package loki
+
+import "time"
+
+// The push requests are logproto.PushRequest messages, which are simple enough
+// to be encoded by hand instead of pulling a protobuf runtime:
+//
+//	message PushRequest { repeated StreamAdapter streams = 1; }
+//	message StreamAdapter { string labels = 1; repeated EntryAdapter entries = 2; }
+//	message EntryAdapter { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+//	message Timestamp { int64 seconds = 1; int32 nanos = 2; }
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// encodePushRequest returns the protobuf encoding of the push request of
+// streams.
+func encodePushRequest(streams []*stream) []byte {
+	var b []byte
+
+	for _, s := range streams {
+		var sb []byte
+		sb = appendString(sb, 1, s.labels)
+
+		for _, e := range s.entries {
+			var ts, eb []byte
+			ts = appendVarintField(ts, 1, uint64(e.time.Unix()))
+			ts = appendVarintField(ts, 2, uint64(e.time.Nanosecond()))
+
+			eb = appendBytes(eb, 1, ts)
+			eb = appendString(eb, 2, e.line)
+			sb = appendBytes(sb, 2, eb)
+		}
+
+		b = appendBytes(b, 1, sb)
+	}
+
+	return b
+}
+
+// The fields that are zero are left out, like protobuf does.
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendVarint(b, uint64(field<<3|wireVarint))
+	return appendVarint(b, v)
+}
+
+func appendString(b []byte, field int, s string) []byte {
+	if len(s) == 0 {
+		return b
+	}
+	b = appendVarint(b, uint64(field<<3|wireBytes))
+	b = appendVarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendBytes(b []byte, field int, v []byte) []byte {
+	b = appendVarint(b, uint64(field<<3|wireBytes))
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// entry is a line of a stream.
+type entry struct {
+	time time.Time
+	line string
+}
@@ -0,0 +1,44 @@
+package lib
+
+import "sync"
+
+// The data that the destinations mask on their side, by group. It lets the
+// stages redacting sensitive data on the host leave it to the destination,
+// instead of masking values that would be masked again once stored.
+var serverMasking = struct {
+	sync.RWMutex
+	groups map[string]map[string]bool
+}{groups: make(map[string]map[string]bool)}
+
+// SetServerMasking records that the destination writing group masks the data
+// matching the given identifiers, like the EmailAddress managed data
+// identifier of CloudWatch Logs. Passing no identifiers clears the group.
+//
+// Destinations only record it when asked to, the messages of a group written
+// to other destinations as well would reach those unmasked.
+func SetServerMasking(group string, identifiers []string) {
+	serverMasking.Lock()
+	defer serverMasking.Unlock()
+
+	if len(identifiers) == 0 {
+		delete(serverMasking.groups, group)
+		return
+	}
+
+	set := make(map[string]bool, len(identifiers))
+
+	for _, id := range identifiers {
+		set[id] = true
+	}
+
+	serverMasking.groups[group] = set
+}
+
+// ServerMasked returns true if the data matching identifier in the messages
+// of group is masked by the destination, so redacting it beforehand can be
+// skipped.
+func ServerMasked(group string, identifier string) bool {
+	serverMasking.RLock()
+	defer serverMasking.RUnlock()
+	return serverMasking.groups[group][identifier]
+}
@@ -0,0 +1,23 @@
+package lib
+
+import "testing"
+
+func TestServerMasking(t *testing.T) {
+	defer SetServerMasking("api", nil)
+
+	SetServerMasking("api", []string{"EmailAddress", "AwsSecretKey"})
+
+	if !ServerMasked("api", "EmailAddress") || !ServerMasked("api", "AwsSecretKey") {
+		t.Error("the identifiers masked by the destination should be reported")
+	}
+
+	if ServerMasked("api", "IpAddress") || ServerMasked("web", "EmailAddress") {
+		t.Error("only the identifiers masked in the group should be reported")
+	}
+
+	SetServerMasking("api", nil)
+
+	if ServerMasked("api", "EmailAddress") {
+		t.Error("clearing the group should forget its identifiers")
+	}
+}
@@ -0,0 +1,7 @@
+package merge
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterStage("merge", lib.NewCheckedStage(lib.StageFunc(NewProcessor), checkConfig))
+}
@@ -0,0 +1,229 @@
+// Package merge implements the merge stage, which folds the physical streams
+// of a task, like its stdout and stderr, into a single logical stream where
+// their messages are interleaved by time.
+package merge
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+type config struct {
+	// The suffixes of the physical streams, a stream named after one of them
+	// is merged into the stream named without the suffix.
+	suffixes []string
+
+	// The data field recording which physical stream a message came from, its
+	// value is the suffix without the leading separator.
+	field string
+
+	// How long the messages are held to be interleaved with the ones of the
+	// other physical streams, zero only renames the streams.
+	window time.Duration
+}
+
+func getConfig() (c config, err error) {
+	c.suffixes = []string{"-stdout", "-stderr"}
+	c.field = "stream"
+	c.window = time.Second
+
+	if s := strings.TrimSpace(lib.Getenv("MERGE_SUFFIXES")); len(s) != 0 {
+		c.suffixes = nil
+
+		for _, suffix := range strings.Split(s, ",") {
+			if suffix = strings.TrimSpace(suffix); len(marker(suffix)) == 0 {
+				err = fmt.Errorf("invalid MERGE_SUFFIXES, must be a comma separated list of stream name suffixes: %s", s)
+				return
+			}
+			c.suffixes = append(c.suffixes, suffix)
+		}
+	}
+
+	if s := strings.TrimSpace(lib.Getenv("MERGE_FIELD")); len(s) != 0 {
+		c.field = s
+	}
+
+	if s := strings.TrimSpace(lib.Getenv("MERGE_WINDOW")); len(s) != 0 {
+		if c.window, err = time.ParseDuration(s); err != nil || c.window < 0 {
+			err = fmt.Errorf("invalid MERGE_WINDOW, must be a positive duration or zero: %s", s)
+			return
+		}
+	}
+
+	// The longest suffixes are matched first, so -stderr-json wins over
+	// -json for example.
+	sort.SliceStable(c.suffixes, func(i int, j int) bool { return len(c.suffixes[i]) > len(c.suffixes[j]) })
+	return
+}
+
+func NewProcessor() (p lib.Processor, err error) {
+	var c config
+
+	if c, err = getConfig(); err == nil {
+		p = newProcessor(c)
+	}
+
+	return
+}
+
+func checkConfig() (err error) {
+	_, err = getConfig()
+	return
+}
+
+// processor holds the messages of each physical stream in the order they were
+// read. The messages are released by repeatedly taking the oldest of the heads
+// of the queues, so the order within each physical stream is kept even when
+// their times go backwards, and the physical streams are interleaved by time.
+type processor struct {
+	config
+	streams map[string]*stream
+}
+
+// stream is a logical stream and the queues of its physical streams, sorted by
+// marker so ties are broken the same way every time.
+type stream struct {
+	queues []*queue
+}
+
+type queue struct {
+	marker   string
+	messages []pending
+}
+
+type pending struct {
+	msg      lib.Message
+	received time.Time
+}
+
+func newProcessor(c config) *processor {
+	return &processor{
+		config:  c,
+		streams: make(map[string]*stream),
+	}
+}
+
+func (p *processor) Process(msg lib.Message, now time.Time) []lib.Message {
+	name, m := p.split(msg.Stream)
+
+	if len(m) == 0 {
+		return []lib.Message{msg}
+	}
+
+	msg.Stream = name
+	msg.Event.Data = copyData(msg.Event.Data)
+	msg.Event.Data[p.field] = m
+
+	if p.window == 0 {
+		return []lib.Message{msg}
+	}
+
+	k := msg.Group + "\x00" + name
+	s := p.streams[k]
+
+	if s == nil {
+		s = &stream{}
+		p.streams[k] = s
+	}
+
+	lib.Hold(&msg)
+	s.queue(m).messages = append(s.queue(m).messages, pending{msg: msg, received: now})
+	return s.release(now.Add(-p.window))
+}
+
+func (p *processor) Flush(now time.Time) (msgs []lib.Message) {
+	keys := make([]string, 0, len(p.streams))
+
+	for k := range p.streams {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := p.streams[k]
+		msgs = append(msgs, s.release(now.Add(-p.window))...)
+
+		if s.empty() {
+			delete(p.streams, k)
+		}
+	}
+
+	return
+}
+
+// split returns the name of the logical stream and the marker of the physical
+// stream, the marker is empty if the stream isn't merged.
+func (p *processor) split(name string) (string, string) {
+	for _, suffix := range p.suffixes {
+		if len(name) > len(suffix) && strings.HasSuffix(name, suffix) {
+			return name[:len(name)-len(suffix)], marker(suffix)
+		}
+	}
+	return name, ""
+}
+
+func (s *stream) queue(marker string) *queue {
+	i := sort.Search(len(s.queues), func(i int) bool { return s.queues[i].marker >= marker })
+
+	if i == len(s.queues) || s.queues[i].marker != marker {
+		s.queues = append(s.queues, nil)
+		copy(s.queues[i+1:], s.queues[i:])
+		s.queues[i] = &queue{marker: marker}
+	}
+
+	return s.queues[i]
+}
+
+// release returns the messages that can be sent, the oldest head is released
+// as long as it was received before deadline. A head that's still within the
+// window holds the others back, a message of another physical stream older
+// than it may still come.
+func (s *stream) release(deadline time.Time) (msgs []lib.Message) {
+	for {
+		var next *queue
+
+		for _, q := range s.queues {
+			if len(q.messages) != 0 && (next == nil || q.messages[0].msg.Event.Time.Before(next.messages[0].msg.Event.Time)) {
+				next = q
+			}
+		}
+
+		if next == nil || next.messages[0].received.After(deadline) {
+			return
+		}
+
+		msgs = append(msgs, next.messages[0].msg)
+		next.messages = next.messages[1:]
+	}
+}
+
+func (s *stream) empty() bool {
+	for _, q := range s.queues {
+		if len(q.messages) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// marker returns the value of the field of messages merged from a stream with
+// the given suffix.
+func marker(suffix string) string {
+	return strings.TrimLeft(suffix, "-_.:/")
+}
+
+func copyData(data ecslogs.EventData) ecslogs.EventData {
+	c := make(ecslogs.EventData, len(data)+1)
+
+	for k, v := range data {
+		c[k] = v
+	}
+
+	return c
+}
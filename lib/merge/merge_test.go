@@ -0,0 +1,157 @@
+package merge
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+var epoch = time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC)
+
+func TestProcessorInterleave(t *testing.T) {
+	p := newProcessor(config{suffixes: []string{"-stdout", "-stderr"}, field: "stream", window: time.Second})
+
+	// stderr is read a bit after stdout, its messages are older than the
+	// last ones of stdout.
+	var output []lib.Message
+
+	for _, msg := range []lib.Message{
+		makeMessage("web-stdout", "request 1", 0),
+		makeMessage("web-stdout", "request 2", 300),
+		makeMessage("web-stderr", "panic", 100),
+		makeMessage("web-stderr", "stack", 100),
+		makeMessage("web-stdout", "request 3", 500),
+	} {
+		output = append(output, p.Process(msg, epoch)...)
+	}
+
+	if len(output) != 0 {
+		t.Errorf("the messages should be held during the window: %v", lines(output))
+	}
+
+	output = p.Flush(epoch.Add(time.Second))
+
+	ref := []string{
+		"web:stdout:request 1",
+		"web:stderr:panic",
+		"web:stderr:stack",
+		"web:stdout:request 2",
+		"web:stdout:request 3",
+	}
+
+	if found := lines(output); !reflect.DeepEqual(found, ref) {
+		t.Errorf("invalid merged output:\n- expected: %#v\n- found:    %#v", ref, found)
+	}
+
+	if len(p.streams) != 0 {
+		t.Errorf("drained streams should be forgotten: %d", len(p.streams))
+	}
+}
+
+func TestProcessorPhysicalOrder(t *testing.T) {
+	p := newProcessor(config{suffixes: []string{"-stdout", "-stderr"}, field: "stream", window: time.Second})
+
+	// The clock of the application went backwards, the messages of stdout
+	// still come out in the order they were written.
+	for _, msg := range []lib.Message{
+		makeMessage("web-stdout", "a", 200),
+		makeMessage("web-stdout", "b", 100),
+		makeMessage("web-stderr", "c", 150),
+	} {
+		p.Process(msg, epoch)
+	}
+
+	ref := []string{"web:stderr:c", "web:stdout:a", "web:stdout:b"}
+
+	if found := lines(p.Flush(epoch.Add(time.Second))); !reflect.DeepEqual(found, ref) {
+		t.Errorf("invalid merged output:\n- expected: %#v\n- found:    %#v", ref, found)
+	}
+}
+
+func TestProcessorWindow(t *testing.T) {
+	p := newProcessor(config{suffixes: []string{"-stdout", "-stderr"}, field: "stream", window: time.Second})
+
+	p.Process(makeMessage("web-stdout", "early", 0), epoch)
+
+	if msgs := p.Process(makeMessage("web-stderr", "late", 10), epoch.Add(500*time.Millisecond)); len(msgs) != 0 {
+		t.Errorf("no message should be released before the window elapsed: %v", lines(msgs))
+	}
+
+	// The first message is out of the window but the second isn't yet.
+	if msgs := p.Process(makeMessage("web-stdout", "later", 20), epoch.Add(time.Second)); !reflect.DeepEqual(lines(msgs), []string{"web:stdout:early"}) {
+		t.Errorf("the messages out of the window should be released: %v", lines(msgs))
+	}
+
+	if msgs := p.Flush(epoch.Add(2 * time.Second)); !reflect.DeepEqual(lines(msgs), []string{"web:stderr:late", "web:stdout:later"}) {
+		t.Errorf("the remaining messages should be released: %v", lines(msgs))
+	}
+}
+
+func TestProcessorPassthrough(t *testing.T) {
+	p := newProcessor(config{suffixes: []string{"-stdout", "-stderr"}, field: "stream"})
+
+	msg := makeMessage("worker", "hello", 0)
+
+	if msgs := p.Process(msg, epoch); len(msgs) != 1 || msgs[0].Stream != "worker" || msgs[0].Event.Data["stream"] != nil {
+		t.Errorf("streams without a suffix should pass through unchanged: %+v", msgs)
+	}
+
+	// Without a window the streams are only renamed.
+	msg = makeMessage("web-stderr", "oops", 0)
+
+	if msgs := p.Process(msg, epoch); !reflect.DeepEqual(lines(msgs), []string{"web:stderr:oops"}) {
+		t.Errorf("the message should be released right away: %v", lines(msgs))
+	}
+
+	if msg.Event.Data["stream"] != nil {
+		t.Error("the data of the original message should not be modified")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(map[string]string{
+		"MERGE_SUFFIXES": ".out, .err, .err.json",
+		"MERGE_FIELD":    "fd",
+		"MERGE_WINDOW":   "250ms",
+	})
+
+	c, err := getConfig()
+
+	if err != nil || !reflect.DeepEqual(c.suffixes, []string{".err.json", ".out", ".err"}) || c.field != "fd" || c.window != 250*time.Millisecond {
+		t.Errorf("invalid config: %+v (%v)", c, err)
+	}
+
+	if name, m := newProcessor(c).split("web.err.json"); name != "web" || m != "err.json" {
+		t.Errorf("the longest suffix should be matched: %s %s", name, m)
+	}
+
+	lib.SetConfigEnv(map[string]string{"MERGE_SUFFIXES": "-stdout,-"})
+
+	if err := checkConfig(); err == nil {
+		t.Error("an empty suffix should be rejected")
+	}
+}
+
+func lines(msgs []lib.Message) (lines []string) {
+	for _, msg := range msgs {
+		lines = append(lines, msg.Stream+":"+msg.Event.Data["stream"].(string)+":"+msg.Event.Message)
+	}
+	return
+}
+
+func makeMessage(stream string, message string, ms int) lib.Message {
+	return lib.Message{
+		Group:  "G",
+		Stream: stream,
+		Event: ecslogs.Event{
+			Message: message,
+			Time:    epoch.Add(time.Duration(ms) * time.Millisecond),
+			Data:    ecslogs.EventData{},
+		},
+	}
+}
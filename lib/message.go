@@ -3,6 +3,7 @@ package lib
 import (
 	"encoding/json"
 	"sync"
+	"time"
 
 	"github.com/segmentio/ecs-logs-go"
 	"github.com/segmentio/jutil"
@@ -12,6 +13,23 @@ type Message struct {
 	Group  string        `json:"group,omitempty"`
 	Stream string        `json:"stream,omitempty"`
 	Event  ecslogs.Event `json:"event,omitempty"`
+
+	// The time ecs-logs read the message from its source, zero for messages
+	// emitted by stages. It's never serialized.
+	Received time.Time `json:"-"`
+
+	// The line the message was parsed from and the sum of its event at the
+	// time, see RawLine.
+	raw    string
+	rawSum uint64
+
+	// The source to rewind if the message can't be delivered, see SetOrigin.
+	origin   Rewinder
+	position Position
+
+	// Set on the copy that a stage holds, which carries the hold of its source
+	// until the stage releases it, see Hold.
+	held bool
 }
 
 func (m Message) Bytes() []byte {
@@ -0,0 +1,7 @@
+package metadata
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterStage("metadata", lib.NewCheckedStage(lib.StageFunc(NewProcessor), checkConfig))
+}
@@ -0,0 +1,297 @@
+package metadata
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/ec2meta"
+	"github.com/segmentio/ecs-logs/lib/ecsmeta"
+)
+
+// The fields that can be attached to messages, the task ones come from the
+// task of ecs-logs, the instance ones from the EC2 instance it runs on, and
+// the container ones from the container that logged the message.
+var taskFields = map[string]func(ecsmeta.Task) interface{}{
+	"cluster":           func(t ecsmeta.Task) interface{} { return t.Cluster },
+	"task_arn":          func(t ecsmeta.Task) interface{} { return t.TaskARN },
+	"task_family":       func(t ecsmeta.Task) interface{} { return t.Family },
+	"task_revision":     func(t ecsmeta.Task) interface{} { return t.Revision },
+	"availability_zone": func(t ecsmeta.Task) interface{} { return t.AvailabilityZone },
+	"task_cpu_limit":    func(t ecsmeta.Task) interface{} { return t.Limits.CPU },
+	"task_memory_limit": func(t ecsmeta.Task) interface{} { return t.Limits.Memory },
+}
+
+var instanceFields = map[string]func(ec2meta.Instance) interface{}{
+	"instance_id":   func(i ec2meta.Instance) interface{} { return i.InstanceID },
+	"instance_type": func(i ec2meta.Instance) interface{} { return i.InstanceType },
+}
+
+var containerFields = map[string]func(ecsmeta.Container) interface{}{
+	"container_name": func(c ecsmeta.Container) interface{} { return c.Name },
+	"container_id":   func(c ecsmeta.Container) interface{} { return c.DockerId },
+	"image":          func(c ecsmeta.Container) interface{} { return c.Image },
+	"image_digest":   func(c ecsmeta.Container) interface{} { return c.ImageID },
+	"cpu_limit":      func(c ecsmeta.Container) interface{} { return c.Limits.CPU },
+	"memory_limit":   func(c ecsmeta.Container) interface{} { return c.Limits.Memory },
+}
+
+const defaultFields = "cluster,task_family,task_revision,image,image_digest,task_cpu_limit,task_memory_limit,cpu_limit,memory_limit"
+
+type config struct {
+	// The URI of the ECS container metadata endpoint, empty outside of ECS.
+	uri string
+
+	// The URI of the EC2 instance metadata service, empty when it's disabled.
+	imds string
+
+	// The metadata fields attached to messages, under the field data key.
+	fields []string
+	field  string
+
+	// The time allowed to the endpoint to respond, and how often the
+	// metadata is fetched again.
+	timeout time.Duration
+	refresh time.Duration
+}
+
+func getConfig() (c config, err error) {
+	c = config{
+		uri:     ecsmeta.URI(),
+		imds:    ec2meta.URI(),
+		field:   "ecs",
+		timeout: ecsmeta.DefaultTimeout,
+		refresh: 5 * time.Minute,
+	}
+	var s string
+
+	if s = strings.TrimSpace(lib.Getenv("METADATA_FIELDS")); len(s) == 0 {
+		s = defaultFields
+	}
+
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); taskFields[f] == nil && instanceFields[f] == nil && containerFields[f] == nil {
+			err = fmt.Errorf("invalid METADATA_FIELDS, unknown field %q, must be one of %s", f, strings.Join(fieldNames(), ", "))
+			return
+		}
+		c.fields = append(c.fields, f)
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("METADATA_FIELD")); len(s) != 0 {
+		c.field = s
+	}
+
+	for _, d := range []struct {
+		env   string
+		value *time.Duration
+	}{
+		{"METADATA_TIMEOUT", &c.timeout},
+		{"METADATA_REFRESH", &c.refresh},
+	} {
+		if s = strings.TrimSpace(lib.Getenv(d.env)); len(s) != 0 {
+			if *d.value, err = time.ParseDuration(s); err != nil || *d.value <= 0 {
+				err = fmt.Errorf("invalid %s, must be a positive duration: %s", d.env, s)
+				return
+			}
+		}
+	}
+
+	return
+}
+
+func fieldNames() []string {
+	return append(strings.Split(defaultFields, ","), "task_arn", "availability_zone", "container_name", "container_id", "instance_id", "instance_type")
+}
+
+// NewProcessor fetches the task metadata, waiting at most for the configured
+// timeout so a slow endpoint doesn't hold back the startup, then refreshes it
+// in the background. Messages pass through unchanged until the metadata was
+// fetched once, and when ecs-logs doesn't run in an ECS task.
+func NewProcessor() (p lib.Processor, err error) {
+	var c config
+
+	if c, err = getConfig(); err != nil {
+		return
+	}
+
+	proc := newProcessor(c)
+	p = proc
+
+	if len(c.uri) == 0 {
+		log.Info("the ECS container metadata endpoint isn't available, messages won't be enriched")
+		return
+	}
+
+	proc.fetch()
+	go proc.run()
+	return
+}
+
+func checkConfig() (err error) {
+	_, err = getConfig()
+	return
+}
+
+type processor struct {
+	config
+
+	mutex sync.RWMutex
+	// The metadata attached to the messages of each container, indexed by
+	// the names that streams may take, and the metadata attached to the other
+	// messages, nil until the task metadata was fetched.
+	containers map[string]ecslogs.EventData
+	defaults   ecslogs.EventData
+
+	// The identity of the EC2 instance, it doesn't change so it's only
+	// fetched until it's known. Only the goroutine fetching the metadata uses
+	// it.
+	instance ec2meta.Instance
+}
+
+func newProcessor(c config) *processor {
+	return &processor{config: c}
+}
+
+func (p *processor) Process(msg lib.Message, now time.Time) []lib.Message {
+	p.mutex.RLock()
+	fields := p.containers[msg.Stream]
+	if fields == nil {
+		fields = p.defaults
+	}
+	p.mutex.RUnlock()
+
+	if fields != nil {
+		data := make(ecslogs.EventData, len(msg.Event.Data)+1)
+
+		for k, v := range msg.Event.Data {
+			data[k] = v
+		}
+
+		data[p.field] = fields
+		msg.Event.Data = data
+	}
+
+	return []lib.Message{msg}
+}
+
+func (p *processor) Flush(now time.Time) []lib.Message {
+	return nil
+}
+
+func (p *processor) run() {
+	for range time.Tick(p.refresh) {
+		p.fetch()
+	}
+}
+
+// fetch loads the task metadata, the previous metadata is kept when the
+// endpoint fails. Streams are matched with containers by name, the messages of
+// the other streams get the metadata of the container of ecs-logs, or only the
+// task fields if it isn't known.
+func (p *processor) fetch() {
+	task, err := ecsmeta.GetTask(p.uri, p.timeout)
+
+	if err != nil {
+		log.WithError(err).Warn("failed to fetch the ECS task metadata")
+		return
+	}
+
+	self, err := ecsmeta.GetContainer(p.uri, p.timeout)
+
+	if err != nil {
+		log.WithError(err).Warn("failed to fetch the ECS container metadata")
+	}
+
+	if len(p.instance.InstanceID) == 0 && p.needsInstance(task) {
+		if p.instance, err = ec2meta.GetInstance(p.imds, p.timeout); err != nil {
+			log.WithError(err).Warn("failed to fetch the EC2 instance metadata")
+		}
+	}
+
+	// The availability zone is only in the task metadata of recent versions
+	// of the ECS agent.
+	if len(task.AvailabilityZone) == 0 {
+		task.AvailabilityZone = p.instance.AvailabilityZone
+	}
+
+	containers := make(map[string]ecslogs.EventData, 2*len(task.Containers))
+
+	for _, c := range task.Containers {
+		fields := p.makeFields(task, c)
+
+		for _, name := range []string{c.Name, c.DockerName, c.DockerId} {
+			if len(name) != 0 {
+				containers[name] = fields
+			}
+		}
+	}
+
+	defaults := containers[self.DockerId]
+
+	if defaults == nil {
+		defaults = p.makeFields(task, self)
+	}
+
+	p.mutex.Lock()
+	p.containers = containers
+	p.defaults = defaults
+	p.mutex.Unlock()
+}
+
+// needsInstance returns true if the configured fields need the EC2 instance
+// metadata. Fargate tasks don't have access to the instance metadata service,
+// querying it would only delay them by the timeout.
+func (p *processor) needsInstance(task ecsmeta.Task) bool {
+	if task.LaunchType == "FARGATE" {
+		return false
+	}
+
+	for _, f := range p.fields {
+		if instanceFields[f] != nil || (f == "availability_zone" && len(task.AvailabilityZone) == 0) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// makeFields returns the configured fields of the container c of task, the
+// fields with a zero value are omitted.
+func (p *processor) makeFields(task ecsmeta.Task, c ecsmeta.Container) ecslogs.EventData {
+	fields := make(ecslogs.EventData, len(p.fields))
+
+	for _, f := range p.fields {
+		var value interface{}
+
+		if get := taskFields[f]; get != nil {
+			value = get(task)
+		} else if get := instanceFields[f]; get != nil {
+			value = get(p.instance)
+		} else {
+			value = containerFields[f](c)
+		}
+
+		switch v := value.(type) {
+		case string:
+			if len(v) == 0 {
+				continue
+			}
+		case float64:
+			if v == 0 {
+				continue
+			}
+		case int64:
+			if v == 0 {
+				continue
+			}
+		}
+
+		fields[f] = value
+	}
+
+	return fields
+}
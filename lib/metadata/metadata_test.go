@@ -0,0 +1,269 @@
+package metadata
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+// The documents served by the ECS task metadata v4 endpoint, trimmed of the
+// fields that aren't used.
+const (
+	containerDocument = `{
+  "DockerId": "ea32192c8553fbff06c9340478a2ff089b2bb5646fb718b4ee206641c9086d66",
+  "Name": "ecs-logs",
+  "DockerName": "ecs-web-5-ecs-logs-90ecd2b1a5a3a3e71400",
+  "Image": "segment/ecs-logs:latest",
+  "ImageID": "sha256:2ae34abc2ed0a22e280d17e13f9c01aaf725688b09b7a1525d1a2750e2c0d1de",
+  "Limits": {"CPU": 128, "Memory": 256}
+}`
+
+	taskDocument = `{
+  "Cluster": "arn:aws:ecs:us-west-2:111122223333:cluster/default",
+  "TaskARN": "arn:aws:ecs:us-west-2:111122223333:task/default/158d1c8083dd49d6b527399fd6414f5c",
+  "Family": "web",
+  "Revision": "5",
+  "AvailabilityZone": "us-west-2d",
+  "Limits": {"CPU": 0.5, "Memory": 1024},
+  "Containers": [
+    {
+      "DockerId": "ea32192c8553fbff06c9340478a2ff089b2bb5646fb718b4ee206641c9086d66",
+      "Name": "ecs-logs",
+      "DockerName": "ecs-web-5-ecs-logs-90ecd2b1a5a3a3e71400",
+      "Image": "segment/ecs-logs:latest",
+      "ImageID": "sha256:2ae34abc2ed0a22e280d17e13f9c01aaf725688b09b7a1525d1a2750e2c0d1de",
+      "Limits": {"CPU": 128, "Memory": 256}
+    },
+    {
+      "DockerId": "731a0d6a3b4210e2448339bc7015aaa79bfe4fa256384f4102db86ef94cbbc4c",
+      "Name": "web",
+      "DockerName": "ecs-web-5-web-e4a7c8f3d8a9d2c3b100",
+      "Image": "segment/web:v42",
+      "ImageID": "sha256:5d0da3dc976460b72c77d94c8a1ad043720b0416bfc16c52c45d4847e53fadb6",
+      "Limits": {"CPU": 384}
+    }
+  ]
+}`
+)
+
+func newMetadataServer(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		time.Sleep(delay)
+
+		switch req.URL.Path {
+		case "/v4":
+			res.Write([]byte(containerDocument))
+		case "/v4/task":
+			res.Write([]byte(taskDocument))
+		default:
+			http.NotFound(res, req)
+		}
+	}))
+}
+
+func makeProcessor(t *testing.T, uri string, env map[string]string) *processor {
+	lib.SetConfigEnv(env)
+	defer lib.SetConfigEnv(nil)
+
+	c, err := getConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.uri = uri
+	c.imds = ""
+	p := newProcessor(c)
+
+	if len(uri) != 0 {
+		p.fetch()
+	}
+
+	return p
+}
+
+// newInstanceServer serves the identity document of an EC2 instance to the
+// requests carrying a session token, and counts them.
+func newInstanceServer(requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(requests, 1)
+
+		switch {
+		case req.Method == "PUT" && req.URL.Path == "/latest/api/token":
+			res.Write([]byte("AQAEAFTzNjk="))
+		case req.URL.Path == "/latest/dynamic/instance-identity/document" && req.Header.Get("X-aws-ec2-metadata-token") == "AQAEAFTzNjk=":
+			res.Write([]byte(`{"instanceId": "i-0123456789abcdef0", "instanceType": "m5.large", "availabilityZone": "us-west-2b", "region": "us-west-2"}`))
+		default:
+			res.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+}
+
+func process(p *processor, stream string) ecslogs.EventData {
+	msg := lib.Message{
+		Group:  "web",
+		Stream: stream,
+		Event:  ecslogs.Event{Message: "Hello World!", Data: ecslogs.EventData{"answer": 42}},
+	}
+	return p.Process(msg, time.Now())[0].Event.Data
+}
+
+func TestProcessorFullDocument(t *testing.T) {
+	server := newMetadataServer(0)
+	defer server.Close()
+
+	p := makeProcessor(t, server.URL+"/v4", nil)
+
+	task := ecslogs.EventData{
+		"cluster":           "arn:aws:ecs:us-west-2:111122223333:cluster/default",
+		"task_family":       "web",
+		"task_revision":     "5",
+		"task_cpu_limit":    0.5,
+		"task_memory_limit": int64(1024),
+	}
+
+	web := ecslogs.EventData{
+		"image":        "segment/web:v42",
+		"image_digest": "sha256:5d0da3dc976460b72c77d94c8a1ad043720b0416bfc16c52c45d4847e53fadb6",
+		"cpu_limit":    384.0,
+	}
+
+	self := ecslogs.EventData{
+		"image":        "segment/ecs-logs:latest",
+		"image_digest": "sha256:2ae34abc2ed0a22e280d17e13f9c01aaf725688b09b7a1525d1a2750e2c0d1de",
+		"cpu_limit":    128.0,
+		"memory_limit": int64(256),
+	}
+
+	for k, v := range task {
+		web[k], self[k] = v, v
+	}
+
+	for _, test := range []struct {
+		stream string
+		fields ecslogs.EventData
+	}{
+		{"ecs-web-5-web-e4a7c8f3d8a9d2c3b100", web},
+		{"web", web},
+		// Streams that don't match a container get the metadata of the
+		// container of ecs-logs.
+		{"i-1234", self},
+	} {
+		data := process(p, test.stream)
+
+		if data["answer"] != 42 {
+			t.Errorf("%s: the data of the message was lost: %v", test.stream, data)
+		}
+
+		if !reflect.DeepEqual(data["ecs"], test.fields) {
+			t.Errorf("%s: invalid metadata:\n- expected: %#v\n- found:    %#v", test.stream, test.fields, data["ecs"])
+		}
+	}
+}
+
+func TestProcessorFieldsSubset(t *testing.T) {
+	server := newMetadataServer(0)
+	defer server.Close()
+
+	p := makeProcessor(t, server.URL+"/v4", map[string]string{
+		"METADATA_FIELDS": "cluster, task_arn,container_name",
+		"METADATA_FIELD":  "task",
+	})
+
+	ref := ecslogs.EventData{
+		"cluster":        "arn:aws:ecs:us-west-2:111122223333:cluster/default",
+		"task_arn":       "arn:aws:ecs:us-west-2:111122223333:task/default/158d1c8083dd49d6b527399fd6414f5c",
+		"container_name": "web",
+	}
+
+	if data := process(p, "web"); !reflect.DeepEqual(data["task"], ref) {
+		t.Errorf("invalid metadata:\n- expected: %#v\n- found:    %#v", ref, data["task"])
+	}
+}
+
+func TestProcessorInstanceFields(t *testing.T) {
+	var requests int32
+	imds := newInstanceServer(&requests)
+	defer imds.Close()
+
+	for _, test := range []struct {
+		launchType string
+		fields     ecslogs.EventData
+	}{
+		{"EC2", ecslogs.EventData{"cluster": "default", "instance_id": "i-0123456789abcdef0", "instance_type": "m5.large", "availability_zone": "us-west-2b"}},
+		// The instance metadata isn't available to Fargate tasks.
+		{"FARGATE", ecslogs.EventData{"cluster": "default"}},
+	} {
+		atomic.StoreInt32(&requests, 0)
+
+		server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/v4":
+				res.Write([]byte(containerDocument))
+			case "/v4/task":
+				res.Write([]byte(`{"Cluster": "default", "LaunchType": "` + test.launchType + `"}`))
+			default:
+				http.NotFound(res, req)
+			}
+		}))
+
+		p := makeProcessor(t, "", map[string]string{
+			"METADATA_FIELDS": "cluster,instance_id,instance_type,availability_zone",
+		})
+		p.uri, p.imds = server.URL+"/v4", imds.URL
+		p.fetch()
+		p.fetch()
+		server.Close()
+
+		if data := process(p, "web"); !reflect.DeepEqual(data["ecs"], test.fields) {
+			t.Errorf("%s: invalid metadata:\n- expected: %#v\n- found:    %#v", test.launchType, test.fields, data["ecs"])
+		}
+
+		// The instance metadata is fetched once, with a token.
+		if n, expected := atomic.LoadInt32(&requests), map[string]int32{"EC2": 2, "FARGATE": 0}[test.launchType]; n != expected {
+			t.Errorf("%s: %d requests to the instance metadata service, expected %d", test.launchType, n, expected)
+		}
+	}
+}
+
+func TestProcessorMissingEndpoint(t *testing.T) {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	slow := newMetadataServer(time.Second)
+	defer slow.Close()
+
+	for _, uri := range []string{"", "http://127.0.0.1:1/v4", slow.URL + "/v4", slow.URL + "/missing"} {
+		start := time.Now()
+		p := makeProcessor(t, uri, map[string]string{"METADATA_TIMEOUT": "100ms"})
+
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("%q: fetching the metadata should time out: %s", uri, elapsed)
+		}
+
+		if data := process(p, "web"); !reflect.DeepEqual(data, ecslogs.EventData{"answer": 42}) {
+			t.Errorf("%q: the message should be left unchanged: %v", uri, data)
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	for env, err := range map[string]string{
+		"METADATA_FIELDS":  "unknown field \"image_tag\"",
+		"METADATA_TIMEOUT": "invalid METADATA_TIMEOUT",
+	} {
+		lib.SetConfigEnv(map[string]string{env: map[string]string{"METADATA_FIELDS": "image,image_tag", "METADATA_TIMEOUT": "0s"}[env]})
+
+		if e := checkConfig(); e == nil || !strings.Contains(e.Error(), err) {
+			t.Errorf("%s: the error should mention %q: %v", env, err, e)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package lib
+
+import (
+	"time"
+
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of the buckets of the
+// delivery_latency_seconds histograms.
+var LatencyBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// NewMeteredDestination wraps dest so the messages and bytes it delivers are
+// counted in registry, labeled by group, stream and destination name.
+//
+// The counters of a stream are removed when the stream is closed on the
+// destination, which happens when ecs-logs stops seeing messages for it.
+//
+// The time between the moment the messages were read and the moment they were
+// delivered is observed by the delivery_latency_seconds histogram of the
+// destination, which isn't labeled by stream to keep the number of buckets
+// in check.
+func NewMeteredDestination(name string, dest Destination, registry *metrics.Registry) Destination {
+	return meteredDestination{
+		Destination: dest,
+		name:        name,
+		registry:    registry,
+	}
+}
+
+type meteredDestination struct {
+	Destination
+	name     string
+	registry *metrics.Registry
+}
+
+func (d meteredDestination) Open(group string, stream string) (w Writer, err error) {
+	if w, err = d.Destination.Open(group, stream); err == nil {
+		labels := []string{"group", group, "stream", stream, "destination", d.name}
+		w = meteredWriter{
+			Writer:   w,
+			name:     d.name,
+			registry: d.registry,
+			messages: d.registry.Counter("delivered_messages", labels...),
+			bytes:    d.registry.Counter("delivered_bytes", labels...),
+		}
+	}
+	return
+}
+
+func (d meteredDestination) Close(group string, stream string) {
+	d.Destination.Close(group, stream)
+	d.registry.Remove("group", group, "stream", stream, "destination", d.name)
+}
+
+type meteredWriter struct {
+	Writer
+	name     string
+	registry *metrics.Registry
+	messages *metrics.Counter
+	bytes    *metrics.Counter
+}
+
+func (w meteredWriter) WriteMessage(msg Message) error {
+	return w.WriteMessageBatch(MessageBatch{msg})
+}
+
+func (w meteredWriter) WriteMessageBatch(batch MessageBatch) (err error) {
+	_, err = w.WriteMessageBatchSize(batch)
+	return
+}
+
+func (w meteredWriter) WriteMessageBatchSize(batch MessageBatch) (size int, err error) {
+	size, err = WriteMessageBatchSize(w.Writer, batch)
+	w.count(batch, size, err)
+	return
+}
+
+func (w meteredWriter) WriteUrgentMessageBatch(batch MessageBatch) (size int, err error) {
+	size, err = WriteUrgentMessageBatch(w.Writer, batch)
+	w.count(batch, size, err)
+	return
+}
+
+func (w meteredWriter) count(batch MessageBatch, size int, err error) {
+	if err == nil {
+		w.messages.Add(int64(len(batch)))
+		w.bytes.Add(int64(size))
+		w.observe(batch, time.Now())
+	}
+}
+
+func (w meteredWriter) observe(batch MessageBatch, now time.Time) {
+	var latency *metrics.Histogram
+
+	for _, msg := range batch {
+		// The messages emitted by the stages were never read.
+		if msg.Received.IsZero() {
+			continue
+		}
+
+		if latency == nil {
+			latency = w.registry.Histogram("delivery_latency_seconds", LatencyBuckets, "destination", w.name)
+		}
+
+		latency.Observe(now.Sub(msg.Received).Seconds())
+	}
+}
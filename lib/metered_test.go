@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+func TestMeteredDestination(t *testing.T) {
+	buf := &bytes.Buffer{}
+	reg := metrics.NewRegistry()
+	dst := NewMeteredDestination("stdout", DestinationFunc(func(group string, stream string) (Writer, error) {
+		return NewMessageEncoder(buf), nil
+	}), reg)
+
+	batches := []MessageBatch{
+		{
+			{Group: "A", Stream: "1", Event: ecslogs.Event{Message: "Hello World!"}},
+		},
+		{
+			{Group: "A", Stream: "1", Event: ecslogs.Event{Message: "How are you?"}},
+			{Group: "A", Stream: "1", Event: ecslogs.Event{Message: "Good!", Data: ecslogs.EventData{"answer": 42}}},
+		},
+	}
+
+	for _, batch := range batches {
+		w, err := dst.Open("A", "1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := w.WriteMessageBatch(batch); err != nil {
+			t.Fatal(err)
+		}
+
+		w.Close()
+	}
+
+	labels := []string{"group", "A", "stream", "1", "destination", "stdout"}
+
+	if n := reg.Counter("delivered_bytes", labels...).Value(); n != int64(buf.Len()) {
+		t.Errorf("the byte counter doesn't match the size of the serialized messages: %d != %d", n, buf.Len())
+	}
+
+	if n := reg.Counter("delivered_messages", labels...).Value(); n != 3 {
+		t.Errorf("invalid number of delivered messages: %d", n)
+	}
+
+	dst.Close("A", "1")
+
+	if samples := reg.Snapshot(); len(samples) != 0 {
+		t.Errorf("closing the stream should remove its counters: %v", samples)
+	}
+}
+
+func TestMeteredDestinationNewlines(t *testing.T) {
+	buf := &bytes.Buffer{}
+	reg := metrics.NewRegistry()
+	dst := NewMeteredDestination("stdout", NewNewlineDestination(DestinationFunc(func(group string, stream string) (Writer, error) {
+		return NewMessageEncoder(buf), nil
+	}), SplitNewlines), reg)
+
+	w, _ := dst.Open("A", "1")
+	w.WriteMessageBatch(MessageBatch{
+		{Group: "A", Stream: "1", Event: ecslogs.Event{Message: "first\nsecond\nthird"}},
+	})
+
+	// The size is measured after the transformations made by the wrapped
+	// destinations.
+	labels := []string{"group", "A", "stream", "1", "destination", "stdout"}
+
+	if n := reg.Counter("delivered_bytes", labels...).Value(); n != int64(buf.Len()) {
+		t.Errorf("the byte counter doesn't match the size of the serialized messages: %d != %d", n, buf.Len())
+	}
+}
+
+func TestMeteredDestinationLatency(t *testing.T) {
+	reg := metrics.NewRegistry()
+	dst := NewMeteredDestination("stdout", DestinationFunc(func(group string, stream string) (Writer, error) {
+		return NewMessageEncoder(&bytes.Buffer{}), nil
+	}), reg)
+
+	w, err := dst.Open("A", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	batch := MessageBatch{
+		{Group: "A", Stream: "1", Event: ecslogs.Event{Message: "read"}, Received: time.Now().Add(-2 * time.Second)},
+		{Group: "A", Stream: "1", Event: ecslogs.Event{Message: "emitted by a stage"}},
+	}
+
+	if err := w.WriteMessageBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range reg.Snapshot() {
+		if s.Name == "delivery_latency_seconds" {
+			if s.Value != 1 || s.Sum < 2 || s.Labels["destination"] != "stdout" {
+				t.Errorf("only the message that was read should be observed: %+v", s)
+			}
+			return
+		}
+	}
+
+	t.Error("the latency of the messages wasn't observed")
+}
@@ -0,0 +1,264 @@
+// Package metrics implements the counters, gauges and histograms that ecs-logs
+// exposes about its own operations, they are published under the "ecs-logs"
+// expvar so they can be read from /debug/vars on the address set by
+// -pprof-addr, and served in the Prometheus text format by Handler.
+package metrics
+
+import (
+	"expvar"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The types of the series.
+const (
+	TypeCounter   = ""
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+type Counter struct {
+	value int64
+}
+
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.value, n)
+}
+
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+// Histogram counts observed values in buckets, like the sizes of batches or
+// the latencies of messages.
+type Histogram struct {
+	// The upper bounds of the buckets, sorted, and the number of values that
+	// fell in each. The last count is the one of the values greater than all
+	// the bounds.
+	bounds []float64
+	counts []int64
+
+	// The sum of the values, as the bits of a float64.
+	sum uint64
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	bounds = append([]float64(nil), bounds...)
+	sort.Float64s(bounds)
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+// Observe adds v to the histogram.
+func (h *Histogram) Observe(v float64) {
+	atomic.AddInt64(&h.counts[sort.SearchFloat64s(h.bounds, v)], 1)
+
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		if atomic.CompareAndSwapUint64(&h.sum, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			break
+		}
+	}
+}
+
+// Sample is the value of a series at the time a snapshot was taken. The value
+// of a histogram is the number of values it observed.
+type Sample struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  int64             `json:"value"`
+
+	// The cumulative counts of the buckets of a histogram, the values
+	// greater than the last bound are only counted in Value, and the sum of
+	// the observed values.
+	Buckets []Bucket `json:"buckets,omitempty"`
+	Sum     float64  `json:"sum,omitempty"`
+}
+
+// Bucket is the number of values of a histogram lower than or equal to its
+// upper bound.
+type Bucket struct {
+	UpperBound float64 `json:"le"`
+	Count      int64   `json:"count"`
+}
+
+// Registry holds series identified by a name and a set of labels.
+type Registry struct {
+	mutex  sync.RWMutex
+	series map[string]*series
+}
+
+type series struct {
+	name      string
+	kind      string
+	labels    []string
+	counter   *Counter
+	histogram *Histogram
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		series: make(map[string]*series),
+	}
+}
+
+// Counter returns the counter with the given name and labels, creating it if
+// it didn't exist yet. Labels are passed as a list of key/value pairs.
+func (r *Registry) Counter(name string, labels ...string) *Counter {
+	return r.get(TypeCounter, name, nil, labels).counter
+}
+
+// Gauge returns the counter with the given name and labels like Counter, but
+// its value is one that goes up and down, like the size of a buffer, instead
+// of a count of events.
+func (r *Registry) Gauge(name string, labels ...string) *Counter {
+	return r.get(TypeGauge, name, nil, labels).counter
+}
+
+// Histogram returns the histogram with the given name and labels, creating it
+// with the upper bounds of buckets if it didn't exist yet.
+func (r *Registry) Histogram(name string, buckets []float64, labels ...string) *Histogram {
+	if h := r.get(TypeHistogram, name, buckets, labels).histogram; h != nil {
+		return h
+	}
+	// The name is the one of a counter, the values are discarded.
+	return newHistogram(buckets)
+}
+
+func (r *Registry) get(kind string, name string, buckets []float64, labels []string) *series {
+	key := seriesKey(name, labels)
+
+	r.mutex.RLock()
+	s := r.series[key]
+	r.mutex.RUnlock()
+
+	if s != nil {
+		return s
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if s = r.series[key]; s == nil {
+		s = &series{
+			name:    name,
+			kind:    kind,
+			labels:  append([]string(nil), labels...),
+			counter: &Counter{},
+		}
+
+		if kind == TypeHistogram {
+			s.histogram = newHistogram(buckets)
+		}
+
+		r.series[key] = s
+	}
+
+	return s
+}
+
+// Remove deletes the counters which have all the given labels, whatever their
+// name and other labels are.
+func (r *Registry) Remove(labels ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for key, s := range r.series {
+		if s.match(labels) {
+			delete(r.series, key)
+		}
+	}
+}
+
+// Snapshot returns the values of all series, sorted by name and labels.
+func (r *Registry) Snapshot() []Sample {
+	r.mutex.RLock()
+	keys := make([]string, 0, len(r.series))
+
+	for key := range r.series {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	samples := make([]Sample, len(keys))
+
+	for i, key := range keys {
+		samples[i] = r.series[key].sample()
+	}
+
+	r.mutex.RUnlock()
+	return samples
+}
+
+func (s *series) sample() Sample {
+	x := Sample{
+		Name:   s.name,
+		Type:   s.kind,
+		Labels: s.labelMap(),
+	}
+
+	if s.histogram == nil {
+		x.Value = s.counter.Value()
+		return x
+	}
+
+	h := s.histogram
+	x.Buckets = make([]Bucket, len(h.bounds))
+
+	for i, bound := range h.bounds {
+		x.Value += atomic.LoadInt64(&h.counts[i])
+		x.Buckets[i] = Bucket{UpperBound: bound, Count: x.Value}
+	}
+
+	x.Value += atomic.LoadInt64(&h.counts[len(h.bounds)])
+	x.Sum = math.Float64frombits(atomic.LoadUint64(&h.sum))
+	return x
+}
+
+func (s *series) labelMap() map[string]string {
+	if len(s.labels) == 0 {
+		return nil
+	}
+
+	m := make(map[string]string, len(s.labels)/2)
+
+	for i := 0; i < len(s.labels)-1; i += 2 {
+		m[s.labels[i]] = s.labels[i+1]
+	}
+
+	return m
+}
+
+func (s *series) match(labels []string) bool {
+	m := s.labelMap()
+
+	for i := 0; i < len(labels)-1; i += 2 {
+		if v, ok := m[labels[i]]; !ok || v != labels[i+1] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func seriesKey(name string, labels []string) string {
+	if len(labels)%2 != 0 {
+		panic("metrics: labels must be passed as key/value pairs")
+	}
+	return name + "\x00" + strings.Join(labels, "\x00")
+}
+
+// Default is the registry published as an expvar.
+var Default = NewRegistry()
+
+func init() {
+	expvar.Publish("ecs-logs", expvar.Func(func() interface{} {
+		return Default.Snapshot()
+	}))
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	r.Counter("bytes", "group", "A", "stream", "1").Add(10)
+	r.Counter("bytes", "group", "A", "stream", "1").Add(5)
+	r.Counter("bytes", "group", "A", "stream", "2").Add(1)
+	r.Counter("count").Add(2)
+
+	ref := []Sample{
+		{Name: "bytes", Labels: map[string]string{"group": "A", "stream": "1"}, Value: 15},
+		{Name: "bytes", Labels: map[string]string{"group": "A", "stream": "2"}, Value: 1},
+		{Name: "count", Value: 2},
+	}
+
+	if samples := r.Snapshot(); !reflect.DeepEqual(samples, ref) {
+		t.Errorf("invalid snapshot:\n- expected: %#v\n- found:    %#v", ref, samples)
+	}
+
+	r.Remove("stream", "1")
+
+	if samples := r.Snapshot(); !reflect.DeepEqual(samples, ref[1:]) {
+		t.Errorf("invalid snapshot after removing a stream:\n- expected: %#v\n- found:    %#v", ref[1:], samples)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.Histogram("latency", []float64{1, 0.1, 10}, "destination", "sqs")
+
+	for _, v := range []float64{0.05, 0.1, 0.5, 2, 20} {
+		h.Observe(v)
+	}
+
+	r.Gauge("used_bytes").Add(10)
+	r.Gauge("used_bytes").Add(-4)
+
+	ref := []Sample{
+		{
+			Name:   "latency",
+			Type:   TypeHistogram,
+			Labels: map[string]string{"destination": "sqs"},
+			Value:  5,
+			Buckets: []Bucket{
+				{UpperBound: 0.1, Count: 2},
+				{UpperBound: 1, Count: 3},
+				{UpperBound: 10, Count: 4},
+			},
+			Sum: 22.65,
+		},
+		{Name: "used_bytes", Type: TypeGauge, Value: 6},
+	}
+
+	if samples := r.Snapshot(); !reflect.DeepEqual(samples, ref) {
+		t.Errorf("invalid snapshot:\n- expected: %#v\n- found:    %#v", ref, samples)
+	}
+}
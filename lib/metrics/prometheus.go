@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Prefix is prepended to the names of the series when they're exported to
+// Prometheus.
+const Prefix = "ecs_logs_"
+
+// Handler returns an HTTP handler serving the series of r in the Prometheus
+// text exposition format, it's what is mounted on /metrics.
+func Handler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WritePrometheus(res)
+	})
+}
+
+// WritePrometheus writes the series of r to w in the Prometheus text format.
+// The names are prefixed with ecs_logs_ and the ones of the counters end with
+// _total, like ecs_logs_delivered_messages_total.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	last := ""
+
+	for _, s := range r.Snapshot() {
+		name := prometheusName(s)
+
+		// The snapshot is sorted by name so the series of a metric are
+		// written together, after its type.
+		if name != last {
+			b.WriteString("# TYPE " + name + " " + prometheusType(s.Type) + "\n")
+			last = name
+		}
+
+		if s.Type != TypeHistogram {
+			writeSample(b, name, s.Labels, "", "", float64(s.Value))
+			continue
+		}
+
+		for _, bucket := range s.Buckets {
+			writeSample(b, name+"_bucket", s.Labels, "le", formatFloat(bucket.UpperBound), float64(bucket.Count))
+		}
+
+		writeSample(b, name+"_bucket", s.Labels, "le", "+Inf", float64(s.Value))
+		writeSample(b, name+"_sum", s.Labels, "", "", s.Sum)
+		writeSample(b, name+"_count", s.Labels, "", "", float64(s.Value))
+	}
+
+	return b.Flush()
+}
+
+func prometheusName(s Sample) string {
+	name := Prefix + sanitizeName(s.Name)
+
+	if s.Type == TypeCounter && !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+
+	return name
+}
+
+func prometheusType(kind string) string {
+	if kind == TypeCounter {
+		return "counter"
+	}
+	return kind
+}
+
+// writeSample writes a line of the exposition format, with the extra label k
+// set to v when k isn't empty.
+func writeSample(b *bufio.Writer, name string, labels map[string]string, k string, v string, value float64) {
+	keys := make([]string, 0, len(labels))
+
+	for key := range labels {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	b.WriteString(name)
+
+	if len(keys) != 0 || len(k) != 0 {
+		sep := "{"
+
+		for _, key := range keys {
+			b.WriteString(sep + sanitizeName(key) + `="` + escapeLabel(labels[key]) + `"`)
+			sep = ","
+		}
+
+		if len(k) != 0 {
+			b.WriteString(sep + k + `="` + v + `"`)
+		}
+
+		b.WriteString("}")
+	}
+
+	b.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, +1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sanitizeName replaces the characters that the names of the metrics and of
+// the labels can't have with underscores.
+func sanitizeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
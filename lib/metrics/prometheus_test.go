@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("delivered_messages", "group", "/ecs/web", "stream", `a"b`, "destination", "sqs").Add(3)
+	r.Counter("delivered_messages", "group", "/ecs/web", "stream", "c", "destination", "sqs").Add(1)
+	r.Gauge("memory_budget_used_bytes").Add(42)
+	r.Histogram("batch_messages", []float64{1, 10}, "destination", "sqs").Observe(5)
+
+	var b bytes.Buffer
+
+	if err := r.WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	ref := `# TYPE ecs_logs_batch_messages histogram
+ecs_logs_batch_messages_bucket{destination="sqs",le="1"} 0
+ecs_logs_batch_messages_bucket{destination="sqs",le="10"} 1
+ecs_logs_batch_messages_bucket{destination="sqs",le="+Inf"} 1
+ecs_logs_batch_messages_sum{destination="sqs"} 5
+ecs_logs_batch_messages_count{destination="sqs"} 1
+# TYPE ecs_logs_delivered_messages_total counter
+ecs_logs_delivered_messages_total{destination="sqs",group="/ecs/web",stream="a\"b"} 3
+ecs_logs_delivered_messages_total{destination="sqs",group="/ecs/web",stream="c"} 1
+# TYPE ecs_logs_memory_budget_used_bytes gauge
+ecs_logs_memory_budget_used_bytes 42
+`
+
+	if s := b.String(); s != ref {
+		t.Errorf("invalid exposition:\n- expected:\n%s\n- found:\n%s", ref, s)
+	}
+
+	res := httptest.NewRecorder()
+	Handler(r).ServeHTTP(res, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := res.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("invalid content type: %s", ct)
+	}
+
+	if s := res.Body.String(); s != ref {
+		t.Errorf("the handler should serve the exposition:\n%s", s)
+	}
+}
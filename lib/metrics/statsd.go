@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The maximum size of the datagrams sent to statsd, small enough to not be
+// fragmented on most networks.
+const maxPacketSize = 1432
+
+// Mirror sends the series of a registry to a statsd server, in the DogStatsD
+// format where the labels are tags. The names are prefixed with ecs-logs.,
+// like the metrics of the statsd destination.
+//
+// The counters are sent as the increments since the previous flush, and the
+// gauges as their current values. The histograms are sent as the count and
+// the sum of the values observed since the previous flush, since the values
+// themselves aren't kept.
+type Mirror struct {
+	registry *Registry
+	conn     io.Writer
+
+	// The values of the counters and histograms at the previous flush.
+	last map[string]Sample
+}
+
+// NewMirror returns a mirror of registry sending to the statsd server at addr,
+// a host:port UDP address.
+func NewMirror(registry *Registry, addr string) (m *Mirror, err error) {
+	var conn net.Conn
+
+	if conn, err = net.Dial("udp", addr); err == nil {
+		m = newMirror(registry, conn)
+	}
+
+	return
+}
+
+func newMirror(registry *Registry, conn io.Writer) *Mirror {
+	return &Mirror{
+		registry: registry,
+		conn:     conn,
+		last:     make(map[string]Sample),
+	}
+}
+
+// Flush sends the series to the statsd server, the ones that didn't change
+// since the previous flush are skipped.
+func (m *Mirror) Flush() (err error) {
+	var packet bytes.Buffer
+	var line bytes.Buffer
+	var seen = make(map[string]bool)
+
+	send := func() {
+		if packet.Len() != 0 {
+			if _, e := m.conn.Write(packet.Bytes()); e != nil && err == nil {
+				err = e
+			}
+			packet.Reset()
+		}
+	}
+
+	for _, s := range m.registry.Snapshot() {
+		key := sampleKey(s)
+		last := m.last[key]
+		name := "ecs-logs." + s.Name
+		tags := statsdTags(s.Labels)
+		seen[key] = true
+		line.Reset()
+
+		switch s.Type {
+		case TypeGauge:
+			writeMetric(&line, name, strconv.FormatInt(s.Value, 10), "g", tags)
+
+		case TypeHistogram:
+			if s.Value != last.Value {
+				writeMetric(&line, name+".count", strconv.FormatInt(s.Value-last.Value, 10), "c", tags)
+				writeMetric(&line, name+".sum", formatFloat(s.Sum-last.Sum), "c", tags)
+			}
+
+		default:
+			if s.Value != last.Value {
+				writeMetric(&line, name, strconv.FormatInt(s.Value-last.Value, 10), "c", tags)
+			}
+		}
+
+		m.last[key] = s
+
+		if packet.Len() != 0 && packet.Len()+line.Len() > maxPacketSize {
+			send()
+		}
+
+		packet.Write(line.Bytes())
+	}
+
+	send()
+
+	// The series removed from the registry, like the ones of the expired
+	// streams, are forgotten.
+	for key := range m.last {
+		if !seen[key] {
+			delete(m.last, key)
+		}
+	}
+
+	return
+}
+
+func writeMetric(b *bytes.Buffer, name string, value string, kind string, tags string) {
+	b.WriteString(name + ":" + value + "|" + kind)
+
+	if len(tags) != 0 {
+		b.WriteString("|#" + tags)
+	}
+
+	b.WriteByte('\n')
+}
+
+func statsdTags(labels map[string]string) string {
+	tags := make([]string, 0, len(labels))
+
+	for k, v := range labels {
+		tags = append(tags, k+":"+strings.NewReplacer(",", "_", "|", "_", "\n", "_").Replace(v))
+	}
+
+	sort.Strings(tags)
+	return strings.Join(tags, ",")
+}
+
+func sampleKey(s Sample) string {
+	labels := make([]string, 0, 2*len(s.Labels))
+
+	for k, v := range s.Labels {
+		labels = append(labels, k+"\x00"+v)
+	}
+
+	sort.Strings(labels)
+	return s.Name + "\x00" + strings.Join(labels, "\x00")
+}
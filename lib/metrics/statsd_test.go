@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMirror(t *testing.T) {
+	var b bytes.Buffer
+
+	r := NewRegistry()
+	m := newMirror(r, &b)
+
+	r.Counter("received_messages", "source", "stdin").Add(10)
+	r.Gauge("memory_budget_used_bytes").Add(100)
+	r.Histogram("batch_messages", []float64{10}, "destination", "sqs").Observe(4)
+
+	if err := m.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	ref := "ecs-logs.batch_messages.count:1|c|#destination:sqs\n" +
+		"ecs-logs.batch_messages.sum:4|c|#destination:sqs\n" +
+		"ecs-logs.memory_budget_used_bytes:100|g\n" +
+		"ecs-logs.received_messages:10|c|#source:stdin\n"
+
+	if s := b.String(); s != ref {
+		t.Errorf("invalid first flush:\n- expected:\n%s\n- found:\n%s", ref, s)
+	}
+
+	b.Reset()
+	r.Counter("received_messages", "source", "stdin").Add(5)
+
+	if err := m.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The counters are sent as increments and the unchanged ones are skipped,
+	// the gauges are always sent.
+	ref = "ecs-logs.memory_budget_used_bytes:100|g\n" +
+		"ecs-logs.received_messages:5|c|#source:stdin\n"
+
+	if s := b.String(); s != ref {
+		t.Errorf("invalid second flush:\n- expected:\n%s\n- found:\n%s", ref, s)
+	}
+}
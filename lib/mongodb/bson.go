@@ -0,0 +1,310 @@
+package mongodb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// document is a BSON document, the order of the keys matters to MongoDB since
+// the first key of a command is its name.
+type document []element
+
+type element struct {
+	key   string
+	value interface{}
+}
+
+// get returns the value of key in d, or nil if it's not found.
+func (d document) get(key string) interface{} {
+	for _, e := range d {
+		if e.key == key {
+			return e.value
+		}
+	}
+	return nil
+}
+
+// The BSON types encoded and decoded by the destination, the others are only
+// skipped in the replies of the server.
+const (
+	bsonDouble   = 0x01
+	bsonString   = 0x02
+	bsonDocument = 0x03
+	bsonArray    = 0x04
+	bsonBinary   = 0x05
+	bsonObjectID = 0x07
+	bsonBoolean  = 0x08
+	bsonDateTime = 0x09
+	bsonNull     = 0x0A
+	bsonInt32    = 0x10
+	bsonTime     = 0x11
+	bsonInt64    = 0x12
+	bsonDecimal  = 0x13
+)
+
+// appendDocument appends the BSON encoding of d to b.
+func appendDocument(b []byte, d document) []byte {
+	start := len(b)
+	b = append(b, 0, 0, 0, 0)
+
+	for _, e := range d {
+		b = appendElement(b, e.key, e.value)
+	}
+
+	b = append(b, 0)
+	binary.LittleEndian.PutUint32(b[start:], uint32(len(b)-start))
+	return b
+}
+
+func appendElement(b []byte, key string, value interface{}) []byte {
+	switch v := value.(type) {
+	case nil:
+		b = appendKey(b, bsonNull, key)
+	case bool:
+		b = appendKey(b, bsonBoolean, key)
+		if v {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+	case int:
+		b = appendInt64(appendKey(b, bsonInt64, key), int64(v))
+	case int32:
+		b = appendKey(b, bsonInt32, key)
+		b = append(b, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(v))
+	case int64:
+		b = appendInt64(appendKey(b, bsonInt64, key), v)
+	case float64:
+		b = appendInt64(appendKey(b, bsonDouble, key), int64(math.Float64bits(v)))
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			b = appendInt64(appendKey(b, bsonInt64, key), i)
+		} else if f, err := v.Float64(); err == nil {
+			b = appendInt64(appendKey(b, bsonDouble, key), int64(math.Float64bits(f)))
+		} else {
+			b = appendString(appendKey(b, bsonString, key), string(v))
+		}
+	case string:
+		b = appendString(appendKey(b, bsonString, key), v)
+	case []byte:
+		b = appendKey(b, bsonBinary, key)
+		b = append(b, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(v)))
+		b = append(b, 0)
+		b = append(b, v...)
+	case time.Time:
+		ms := v.Unix()*1000 + int64(v.Nanosecond()/1e6)
+		b = appendInt64(appendKey(b, bsonDateTime, key), ms)
+	case document:
+		b = appendDocument(appendKey(b, bsonDocument, key), v)
+	case map[string]interface{}:
+		b = appendDocument(appendKey(b, bsonDocument, key), sortedDocument(v))
+	case []document:
+		a := make([]interface{}, len(v))
+		for i, d := range v {
+			a[i] = d
+		}
+		b = appendArray(appendKey(b, bsonArray, key), a)
+	case []interface{}:
+		b = appendArray(appendKey(b, bsonArray, key), v)
+	default:
+		// Values that were decoded from JSON never get there, anything else
+		// is stored as its string representation rather than being lost.
+		b = appendString(appendKey(b, bsonString, key), fmt.Sprint(v))
+	}
+	return b
+}
+
+func appendKey(b []byte, t byte, key string) []byte {
+	b = append(b, t)
+	b = append(b, key...)
+	return append(b, 0)
+}
+
+func appendInt64(b []byte, v int64) []byte {
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint64(b[len(b)-8:], uint64(v))
+	return b
+}
+
+func appendString(b []byte, s string) []byte {
+	b = append(b, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(s)+1))
+	b = append(b, s...)
+	return append(b, 0)
+}
+
+// appendArray encodes arrays as documents keyed by the indexes of the values.
+func appendArray(b []byte, a []interface{}) []byte {
+	d := make(document, len(a))
+	for i, v := range a {
+		d[i] = element{key: strconv.Itoa(i), value: v}
+	}
+	return appendDocument(b, d)
+}
+
+// sortedDocument converts m to a document with sorted keys, so messages are
+// always encoded the same way.
+func sortedDocument(m map[string]interface{}) document {
+	keys := make([]string, 0, len(m))
+
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	d := make(document, len(keys))
+
+	for i, k := range keys {
+		d[i] = element{key: k, value: m[k]}
+	}
+
+	return d
+}
+
+var errInvalidBSON = errors.New("invalid BSON document")
+
+// readDocument decodes the BSON document at the beginning of b, it returns the
+// number of bytes it used.
+func readDocument(b []byte) (d document, n int, err error) {
+	if len(b) < 5 {
+		return nil, 0, errInvalidBSON
+	}
+
+	if n = int(binary.LittleEndian.Uint32(b)); n < 5 || n > len(b) || b[n-1] != 0 {
+		return nil, 0, errInvalidBSON
+	}
+
+	for p := b[4 : n-1]; len(p) != 0; {
+		var e element
+		var size int
+
+		if e, size, err = readElement(p); err != nil {
+			return
+		}
+
+		d = append(d, e)
+		p = p[size:]
+	}
+
+	return
+}
+
+func readElement(b []byte) (e element, n int, err error) {
+	t := b[0]
+	i := 1
+
+	for i < len(b) && b[i] != 0 {
+		i++
+	}
+
+	if i == len(b) {
+		return e, 0, errInvalidBSON
+	}
+
+	e.key = string(b[1:i])
+	n = i + 1
+	p := b[n:]
+
+	fixed := func(size int) ([]byte, error) {
+		if len(p) < size {
+			return nil, errInvalidBSON
+		}
+		v := p[:size]
+		p, n = p[size:], n+size
+		return v, nil
+	}
+
+	var v []byte
+
+	switch t {
+	case bsonDouble:
+		if v, err = fixed(8); err == nil {
+			e.value = math.Float64frombits(binary.LittleEndian.Uint64(v))
+		}
+	case bsonString:
+		if v, err = fixed(4); err == nil {
+			size := int(binary.LittleEndian.Uint32(v))
+			if v, err = fixed(size); err == nil && size != 0 {
+				e.value = string(v[:size-1])
+			}
+		}
+	case bsonDocument, bsonArray:
+		var d document
+		var size int
+
+		if d, size, err = readDocument(p); err == nil {
+			n += size
+
+			if t == bsonDocument {
+				e.value = d
+			} else {
+				a := make([]interface{}, len(d))
+				for i, x := range d {
+					a[i] = x.value
+				}
+				e.value = a
+			}
+		}
+	case bsonBinary:
+		if v, err = fixed(4); err == nil {
+			size := int(binary.LittleEndian.Uint32(v))
+			if v, err = fixed(size + 1); err == nil {
+				e.value = append([]byte(nil), v[1:]...)
+			}
+		}
+	case bsonObjectID:
+		if v, err = fixed(12); err == nil {
+			e.value = append([]byte(nil), v...)
+		}
+	case bsonBoolean:
+		if v, err = fixed(1); err == nil {
+			e.value = v[0] != 0
+		}
+	case bsonDateTime:
+		if v, err = fixed(8); err == nil {
+			ms := int64(binary.LittleEndian.Uint64(v))
+			e.value = time.Unix(ms/1000, (ms%1000)*1e6).UTC()
+		}
+	case bsonNull:
+	case bsonInt32:
+		if v, err = fixed(4); err == nil {
+			e.value = int32(binary.LittleEndian.Uint32(v))
+		}
+	case bsonTime, bsonInt64:
+		if v, err = fixed(8); err == nil {
+			e.value = int64(binary.LittleEndian.Uint64(v))
+		}
+	case bsonDecimal:
+		_, err = fixed(16)
+	default:
+		err = fmt.Errorf("unsupported BSON type 0x%02x of %s", t, e.key)
+	}
+
+	return
+}
+
+// toInt returns the numeric value v as an int, the servers reply with either
+// 32 or 64 bits integers, or doubles.
+func toInt(v interface{}) int {
+	switch x := v.(type) {
+	case int32:
+		return int(x)
+	case int64:
+		return int(x)
+	case float64:
+		return int(x)
+	case bool:
+		if x {
+			return 1
+		}
+	}
+	return 0
+}
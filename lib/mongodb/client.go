@@ -0,0 +1,225 @@
+package mongodb
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ecs-logs/lib/scram"
+)
+
+// The opcode of OP_MSG, the only message of the wire protocol that the client
+// sends, all the commands go through it since MongoDB 3.6.
+const opMsg = 2013
+
+// The maximum size of the replies accepted from the server.
+const maxMessageSize = 48 * 1000 * 1000
+
+// commandError is an error returned by the server for a command, or for one of
+// the documents of an insert.
+type commandError struct {
+	Code    int
+	Name    string
+	Message string
+}
+
+func (e *commandError) Error() string {
+	if len(e.Name) != 0 {
+		return fmt.Sprintf("mongodb error %d (%s): %s", e.Code, e.Name, e.Message)
+	}
+	return fmt.Sprintf("mongodb error %d: %s", e.Code, e.Message)
+}
+
+// Codes of the errors that the destination handles.
+const (
+	codeNamespaceExists = 48
+	codeDuplicateKey    = 11000
+)
+
+// The errors that a retry may not hit again, like a primary stepping down. The
+// list is the one of the retryable writes of the MongoDB drivers.
+var transientCodes = map[int]bool{
+	6:     true, // HostUnreachable
+	7:     true, // HostNotFound
+	89:    true, // NetworkTimeout
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	262:   true, // ExceededTimeLimit
+	9001:  true, // SocketException
+	10107: true, // NotWritablePrimary
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotPrimaryNoSecondaryOk
+	13436: true, // NotPrimaryOrSecondary
+}
+
+// isTransient returns true if err may not happen again when the write is
+// retried, network errors included.
+func isTransient(err error) bool {
+	if e, ok := err.(*commandError); ok {
+		return transientCodes[e.Code]
+	}
+	_, ok := err.(net.Error)
+	return ok || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// client sends commands to a MongoDB server over a single connection, the
+// commands are serialized and the connection is opened again after a network
+// error.
+type client struct {
+	address  string
+	tls      *tls.Config
+	timeout  time.Duration
+	username string
+	password string
+	authDB   string
+
+	mutex     sync.Mutex
+	conn      net.Conn
+	requestID int32
+}
+
+// run sends cmd to the database db and returns the reply of the server. A
+// reply that isn't ok is returned as a *commandError.
+func (c *client) run(db string, cmd document) (reply document, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn == nil {
+		if err = c.connect(); err != nil {
+			return
+		}
+	}
+
+	if reply, err = c.roundTrip(db, cmd); err != nil {
+		if _, ok := err.(*commandError); !ok {
+			c.conn.Close()
+			c.conn = nil
+		}
+	}
+
+	return
+}
+
+func (c *client) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+func (c *client) connect() (err error) {
+	d := &net.Dialer{Timeout: c.timeout}
+
+	if c.tls != nil {
+		c.conn, err = tls.DialWithDialer(d, "tcp", c.address, c.tls)
+	} else {
+		c.conn, err = d.Dial("tcp", c.address)
+	}
+
+	if err != nil {
+		c.conn = nil
+		return
+	}
+
+	if len(c.username) != 0 {
+		if err = authenticate(c, c.authDB, c.username, c.password, scram.NewNonce()); err != nil {
+			c.conn.Close()
+			c.conn = nil
+			err = fmt.Errorf("authenticating to mongodb as %s: %s", c.username, err)
+		}
+	}
+
+	return
+}
+
+func (c *client) roundTrip(db string, cmd document) (reply document, err error) {
+	c.requestID++
+	body := append(cmd[:len(cmd):len(cmd)], element{key: "$db", value: db})
+
+	// Header, flag bits, and a single section of kind 0 with the command.
+	b := make([]byte, 16, 1024)
+	b = append(b, 0, 0, 0, 0, 0)
+	b = appendDocument(b, body)
+	binary.LittleEndian.PutUint32(b[0:], uint32(len(b)))
+	binary.LittleEndian.PutUint32(b[4:], uint32(c.requestID))
+	binary.LittleEndian.PutUint32(b[12:], opMsg)
+
+	if c.timeout != 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	if _, err = c.conn.Write(b); err != nil {
+		return
+	}
+
+	if reply, err = readReply(c.conn); err != nil {
+		return
+	}
+
+	if toInt(reply.get("ok")) != 1 {
+		e := &commandError{Code: toInt(reply.get("code"))}
+		e.Name, _ = reply.get("codeName").(string)
+		e.Message, _ = reply.get("errmsg").(string)
+		err = e
+	}
+
+	return
+}
+
+// readReply reads an OP_MSG from r and returns the document of its body
+// section.
+func readReply(r io.Reader) (reply document, err error) {
+	var header [16]byte
+
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+
+	size := int(binary.LittleEndian.Uint32(header[:]))
+
+	if size < 21 || size > maxMessageSize {
+		return nil, fmt.Errorf("invalid mongodb message size: %d", size)
+	}
+
+	if op := binary.LittleEndian.Uint32(header[12:]); op != opMsg {
+		return nil, fmt.Errorf("unexpected mongodb opcode: %d", op)
+	}
+
+	b := make([]byte, size-16)
+
+	if _, err = io.ReadFull(r, b); err != nil {
+		return
+	}
+
+	// The flag bits are followed by the sections, the body is the only one
+	// of kind 0.
+	for p := b[4:]; len(p) != 0; {
+		switch p[0] {
+		case 0:
+			reply, _, err = readDocument(p[1:])
+			return
+		case 1:
+			if len(p) < 5 {
+				return nil, errInvalidBSON
+			}
+			n := int(binary.LittleEndian.Uint32(p[1:]))
+			if n < 4 || n+1 > len(p) {
+				return nil, errInvalidBSON
+			}
+			p = p[n+1:]
+		default:
+			return nil, fmt.Errorf("unexpected mongodb section kind: %d", p[0])
+		}
+	}
+
+	return nil, errors.New("the mongodb reply has no body")
+}
@@ -0,0 +1,153 @@
+package mongodb
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// serve answers the commands received on conn with the replies returned by
+// handle, the requests and the replies only differ by their body.
+func serve(conn net.Conn, handle func(cmd document) document) {
+	defer conn.Close()
+
+	for {
+		cmd, err := readReply(conn)
+
+		if err != nil {
+			return
+		}
+
+		b := make([]byte, 16, 256)
+		b = append(b, 0, 0, 0, 0, 0)
+		b = appendDocument(b, handle(cmd))
+		binary.LittleEndian.PutUint32(b[0:], uint32(len(b)))
+		binary.LittleEndian.PutUint32(b[12:], opMsg)
+
+		if _, err = conn.Write(b); err != nil {
+			return
+		}
+	}
+}
+
+func newTestClient(handle func(cmd document) document) *client {
+	c, s := net.Pipe()
+	go serve(s, handle)
+	return &client{conn: c, timeout: time.Second}
+}
+
+func TestBSON(t *testing.T) {
+	now := time.Date(2016, 10, 12, 1, 2, 3, 4000000, time.UTC)
+	doc := document{
+		{key: "string", value: "hello"},
+		{key: "int32", value: int32(-1)},
+		{key: "int64", value: int64(1) << 40},
+		{key: "double", value: 0.25},
+		{key: "bool", value: true},
+		{key: "null", value: nil},
+		{key: "time", value: now},
+		{key: "binary", value: []byte("bytes")},
+		{key: "document", value: document{{key: "a", value: "b"}}},
+		{key: "array", value: []interface{}{"x", int64(2)}},
+	}
+
+	b := appendDocument(nil, doc)
+	dec, n, err := readDocument(b)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != len(b) {
+		t.Errorf("%d bytes should be read, got %d", len(b), n)
+	}
+
+	if !reflect.DeepEqual(doc, dec) {
+		t.Errorf("invalid round trip:\n%#v\n%#v", doc, dec)
+	}
+
+	if _, _, err := readDocument(b[:len(b)-1]); err == nil {
+		t.Error("a truncated document should be rejected")
+	}
+}
+
+func TestClientInsert(t *testing.T) {
+	c := newTestClient(func(cmd document) document {
+		if cmd.get("insert") != "logs" || cmd.get("$db") != "db" || cmd.get("ordered") != false {
+			return document{{key: "ok", value: 0.0}, {key: "errmsg", value: "unexpected command"}}
+		}
+		return document{
+			{key: "n", value: int32(1)},
+			{key: "writeErrors", value: []interface{}{
+				document{{key: "index", value: int32(1)}, {key: "code", value: int32(11000)}, {key: "errmsg", value: "E11000"}},
+			}},
+			{key: "ok", value: 1.0},
+		}
+	})
+	defer c.close()
+
+	docs := []document{{{key: "a", value: "1"}}, {{key: "a", value: "2"}}}
+	werrs, err := serverAPI{c}.insert("db", "logs", docs, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(werrs) != 1 || werrs[0].index != 1 || werrs[0].err.Code != codeDuplicateKey {
+		t.Errorf("invalid write errors: %+v", werrs)
+	}
+}
+
+func TestClientCommandError(t *testing.T) {
+	c := newTestClient(func(cmd document) document {
+		return document{
+			{key: "ok", value: 0.0},
+			{key: "errmsg", value: "collection already exists"},
+			{key: "code", value: int32(48)},
+			{key: "codeName", value: "NamespaceExists"},
+		}
+	})
+	defer c.close()
+
+	err := serverAPI{c}.createCollection("db", document{{key: "create", value: "logs"}})
+
+	if e, ok := err.(*commandError); !ok || e.Code != codeNamespaceExists || e.Name != "NamespaceExists" {
+		t.Fatalf("invalid error: %#v", err)
+	}
+
+	if c.conn == nil {
+		t.Error("the connection should be kept after a command error")
+	}
+}
+
+func TestClientNetworkError(t *testing.T) {
+	// The server drops the connections right away.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	c := &client{address: l.Addr().String(), timeout: time.Second}
+
+	if _, err := c.run("db", document{{key: "ping", value: int32(1)}}); !isTransient(err) {
+		t.Errorf("a network error should be transient: %v", err)
+	}
+
+	if c.conn != nil {
+		t.Error("the connection should be closed after a network error")
+	}
+}
@@ -0,0 +1,182 @@
+package mongodb
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/dedup"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+// config carries the settings of the mongodb destination, they are loaded from
+// MONGODB_* environment variables.
+type config struct {
+	// The server that messages are inserted into, and the credentials of
+	// the SCRAM-SHA-256 authentication against authDB if username is set.
+	address  string
+	username string
+	password string
+	authDB   string
+	tls      *tls.Config
+
+	// The time-series collection, which is created when the destination
+	// starts if it doesn't exist with the time and meta fields, and with
+	// the TTL as expiration of the documents. A zero TTL keeps them.
+	database   string
+	collection string
+	timeField  string
+	metaField  string
+	ttl        time.Duration
+
+	// When enabled the ID of the messages is their _id, the messages of a
+	// batch that was inserted already are then skipped by MongoDB.
+	key dedup.Key
+
+	// How the inserts failing with a transient error are sent again, and the
+	// budget of those retries shared by all the writers.
+	retry       retry.Policy
+	retryBudget lib.RetryBudget
+	timeout     time.Duration
+
+	err error
+}
+
+func getConfig() (c config) {
+	var err error
+	var s string
+
+	c.database = "logs"
+	c.collection = "logs"
+	c.timeField = "time"
+	c.metaField = "meta"
+	c.timeout = 30 * time.Second
+
+	if s = strings.TrimSpace(lib.Getenv("MONGODB_URL")); len(s) == 0 {
+		c.err = lib.AppendError(c.err, fmt.Errorf("missing MONGODB_URL environment variable"))
+	} else if err = c.parseURL(s); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("MONGODB_DATABASE")); len(s) != 0 {
+		c.database = s
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("MONGODB_COLLECTION")); len(s) != 0 {
+		c.collection = s
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("MONGODB_TIME_FIELD")); len(s) != 0 {
+		c.timeField = s
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("MONGODB_META_FIELD")); len(s) != 0 {
+		c.metaField = s
+	}
+
+	if c.timeField == c.metaField || c.timeField == "_id" || c.metaField == "_id" {
+		c.err = lib.AppendError(c.err, fmt.Errorf("invalid MONGODB_TIME_FIELD and MONGODB_META_FIELD, must be different fields other than _id: %s and %s", c.timeField, c.metaField))
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("MONGODB_TTL")); len(s) != 0 {
+		if c.ttl, err = time.ParseDuration(s); err != nil || c.ttl < 0 || (c.ttl != 0 && c.ttl < time.Second) {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid MONGODB_TTL, must be a duration of at least one second, or zero: %s", s))
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("MONGODB_TIMEOUT")); len(s) != 0 {
+		if c.timeout, err = time.ParseDuration(s); err != nil || c.timeout <= 0 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid MONGODB_TIMEOUT, must be a positive duration: %s", s))
+		}
+	}
+
+	if c.retry, err = retry.DestinationPolicy("mongodb", retry.DefaultPolicy); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.key, err = dedup.DestinationKey("mongodb"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.retryBudget, err = lib.DestinationRetryBudget("mongodb"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if t, err := lib.DestinationTLS("mongodb"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	} else if t.Enabled() {
+		if c.tls, err = t.Load(); err != nil {
+			c.err = lib.AppendError(c.err, err)
+		}
+	}
+
+	return
+}
+
+func (c config) check() error {
+	return c.err
+}
+
+// parseURL sets the server settings from a mongodb:// connection string, only
+// single servers are supported, the ones of replica sets route the writes to
+// the primary.
+func (c *config) parseURL(s string) (err error) {
+	var u *url.URL
+
+	if u, err = url.Parse(s); err != nil || u.Scheme != "mongodb" || len(u.Host) == 0 || strings.Contains(u.Host, ",") {
+		return fmt.Errorf("invalid MONGODB_URL, must be a mongodb:// URL of a single server: %s", redact(s))
+	}
+
+	c.address = u.Host
+
+	if len(u.Port()) == 0 {
+		c.address = net.JoinHostPort(u.Hostname(), "27017")
+	}
+
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+
+	c.authDB = strings.TrimPrefix(u.Path, "/")
+	q := u.Query()
+
+	if v := q.Get("authSource"); len(v) != 0 {
+		c.authDB = v
+	}
+
+	if len(c.authDB) == 0 {
+		c.authDB = "admin"
+	}
+
+	if v := q.Get("tls"); len(v) != 0 {
+		var enabled bool
+
+		if enabled, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("invalid tls option of MONGODB_URL, must be a boolean: %s", v)
+		}
+
+		if enabled && c.tls == nil {
+			c.tls = &tls.Config{ServerName: u.Hostname()}
+		}
+	}
+
+	return
+}
+
+// redact removes the password from the connection string s so it can be put in
+// an error.
+func redact(s string) string {
+	if u, err := url.Parse(s); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+			return u.String()
+		}
+	}
+	return s
+}
@@ -0,0 +1,8 @@
+package mongodb
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterDestination("mongodb", newDestination(getConfig))
+	lib.RegisterRecordLimit("mongodb", maxDocumentSize)
+}
@@ -0,0 +1,328 @@
+// Package mongodb implements the mongodb destination, which inserts each
+// message as a document of a time-series collection where the timestamp of the
+// event is the time field and its group and stream are the metadata.
+package mongodb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+const (
+	// The limits of a single insert command, the server accepts larger
+	// batches but the whole command must fit in a BSON document.
+	maxBatchLength = 1000
+	maxBatchSize   = 8 * 1024 * 1024
+
+	// The maximum size of a BSON document.
+	maxDocumentSize = 16 * 1024 * 1024
+)
+
+// api is the subset of the MongoDB commands used by the destination.
+type api interface {
+	// createCollection creates a collection with the options of cmd, the
+	// NamespaceExists error is returned if it exists already.
+	createCollection(db string, cmd document) error
+
+	// insert inserts docs into the collection, it returns the errors of the
+	// documents that weren't inserted and an error if the command failed.
+	insert(db string, collection string, docs []document, ordered bool) ([]writeError, error)
+}
+
+// writeError is the error of a document of an insert, index is its position in
+// the inserted documents.
+type writeError struct {
+	index int
+	err   *commandError
+}
+
+// destination inserts messages into a single collection, the writers of all
+// the streams share the connection to the server.
+type destination struct {
+	lazy   lib.LazyConfig
+	load   func() config
+	config config
+
+	mutex   sync.Mutex
+	api     api
+	created bool
+
+	retries *lib.RetryLimiter
+	skipped *metrics.Counter
+	clock   clock.Clock
+}
+
+func newDestination(load func() config) *destination {
+	return &destination{
+		load:  load,
+		clock: clock.System,
+	}
+}
+
+func (d *destination) Open(group string, stream string) (w lib.Writer, err error) {
+	if err = d.lazy.Init(d.init); err != nil {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.api == nil {
+		d.api = serverAPI{&client{
+			address:  d.config.address,
+			tls:      d.config.tls,
+			timeout:  d.config.timeout,
+			username: d.config.username,
+			password: d.config.password,
+			authDB:   d.config.authDB,
+		}}
+	}
+
+	// The collection is created once, a failure is reported to the writer
+	// and the next one tries again.
+	if !d.created {
+		if err = d.create(); err != nil {
+			return
+		}
+		d.created = true
+	}
+
+	w = writer{dest: d}
+	return
+}
+
+// CheckConfig reports the problems with the MONGODB_* settings when ecs-logs
+// starts.
+func (d *destination) CheckConfig() error {
+	return d.load().check()
+}
+
+func (d *destination) Close(group string, stream string) {}
+
+func (d *destination) init() error {
+	d.config = d.load()
+	d.retries = lib.NewRetryLimiter("mongodb", d.config.retryBudget, metrics.Default)
+	d.skipped = metrics.Default.Counter("skipped_duplicates", "destination", "mongodb")
+
+	return d.config.check()
+}
+
+func (d *destination) create() error {
+	cmd := document{
+		{key: "create", value: d.config.collection},
+		{key: "timeseries", value: document{
+			{key: "timeField", value: d.config.timeField},
+			{key: "metaField", value: d.config.metaField},
+		}},
+	}
+
+	if d.config.ttl != 0 {
+		cmd = append(cmd, element{key: "expireAfterSeconds", value: int64(d.config.ttl / time.Second)})
+	}
+
+	// The collection may have been created by another instance of ecs-logs,
+	// or by hand with other options which are left untouched.
+	if err := d.api.createCollection(d.config.database, cmd); err != nil {
+		if e, ok := err.(*commandError); !ok || e.Code != codeNamespaceExists {
+			return fmt.Errorf("creating the mongodb collection %s.%s: %s", d.config.database, d.config.collection, err)
+		}
+	}
+
+	return nil
+}
+
+// document returns the document that msg is inserted as. The fields of the
+// event are at the top level, except its time which is the time field.
+func (d *destination) document(msg lib.Message) document {
+	var doc document
+	var obj map[string]interface{}
+
+	if id := d.config.key.ID(msg); len(id) != 0 {
+		doc = append(doc, element{key: "_id", value: id})
+	}
+
+	t := msg.Event.Time
+
+	if t.IsZero() {
+		// Time-series collections reject the documents without a time.
+		t = d.clock.Now()
+	}
+
+	doc = append(doc,
+		element{key: d.config.timeField, value: t},
+		element{key: d.config.metaField, value: document{
+			{key: "group", value: msg.Group},
+			{key: "stream", value: msg.Stream},
+		}},
+	)
+
+	// Numbers are kept as json.Number so integers aren't stored as doubles.
+	b, _ := json.Marshal(msg.Event)
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	dec.Decode(&obj)
+
+	for _, e := range sortedDocument(obj) {
+		switch e.key {
+		case "time", "_id", d.config.timeField, d.config.metaField:
+		default:
+			doc = append(doc, e)
+		}
+	}
+
+	return doc
+}
+
+// send inserts a batch of at most maxBatchLength documents. The insert isn't
+// ordered so a document that fails doesn't prevent the next ones from being
+// inserted, and only the documents that failed with a transient error are
+// sent again, with the retry policy of the destination.
+//
+// A transient error of the whole command sends all the documents again, the
+// server may have inserted some of them already. With a deduplication key the
+// duplicates are skipped, otherwise they're inserted twice.
+func (d *destination) send(docs []document) (err error) {
+	if e := d.config.retry.Do(d.clock, d.retries, func() error {
+		var failed []document
+		var last error
+
+		werrs, e := d.api.insert(d.config.database, d.config.collection, docs, false)
+
+		switch {
+		case e == nil:
+			for _, w := range werrs {
+				switch {
+				case w.err.Code == codeDuplicateKey && d.config.key.Enabled():
+					// The document was inserted by a previous write of
+					// the same message.
+					d.skipped.Add(1)
+				case transientCodes[w.err.Code] && w.index >= 0 && w.index < len(docs):
+					failed = append(failed, docs[w.index])
+					last = w.err
+				default:
+					err = lib.AppendError(err, fmt.Errorf("mongodb rejected a message: %s", w.err))
+				}
+			}
+		case isTransient(e):
+			failed, last = docs, e
+		default:
+			return e
+		}
+
+		if len(failed) == 0 {
+			return nil
+		}
+
+		docs = failed
+		return retry.Retryable(fmt.Errorf("%d messages couldn't be inserted into mongodb, the last error was %s", len(failed), last))
+	}); e != nil {
+		err = lib.AppendError(err, e)
+	}
+
+	return
+}
+
+type writer struct {
+	dest *destination
+}
+
+func (w writer) Close() error {
+	return nil
+}
+
+func (w writer) WriteMessage(msg lib.Message) error {
+	return w.WriteMessageBatch(lib.MessageBatch{msg})
+}
+
+func (w writer) WriteMessageBatch(batch lib.MessageBatch) (err error) {
+	_, err = w.WriteMessageBatchSize(batch)
+	return
+}
+
+// WriteMessageBatchSize inserts batch with as few commands as the limits allow,
+// and returns the size of the BSON documents.
+func (w writer) WriteMessageBatchSize(batch lib.MessageBatch) (size int, err error) {
+	var docs []document
+	var length int
+
+	flush := func() {
+		if len(docs) != 0 {
+			if e := w.dest.send(docs); e != nil {
+				err = lib.AppendError(err, e)
+			}
+			docs, length = nil, 0
+		}
+	}
+
+	for _, msg := range batch {
+		doc := w.dest.document(msg)
+		n := len(appendDocument(nil, doc))
+
+		if n > maxDocumentSize {
+			err = lib.AppendError(err, fmt.Errorf("a message of %s/%s is too large to be inserted into mongodb: %d bytes", msg.Group, msg.Stream, n))
+			continue
+		}
+
+		if len(docs) == maxBatchLength || (len(docs) != 0 && length+n > maxBatchSize) {
+			flush()
+		}
+
+		docs = append(docs, doc)
+		length += n
+		size += n
+	}
+
+	flush()
+	return
+}
+
+// serverAPI runs the commands on a MongoDB server.
+type serverAPI struct {
+	client *client
+}
+
+func (s serverAPI) createCollection(db string, cmd document) (err error) {
+	_, err = s.client.run(db, cmd)
+	return
+}
+
+func (s serverAPI) insert(db string, collection string, docs []document, ordered bool) (werrs []writeError, err error) {
+	var reply document
+
+	if reply, err = s.client.run(db, document{
+		{key: "insert", value: collection},
+		{key: "documents", value: docs},
+		{key: "ordered", value: ordered},
+	}); err != nil {
+		return
+	}
+
+	list, _ := reply.get("writeErrors").([]interface{})
+
+	for _, v := range list {
+		if e, ok := v.(document); ok {
+			msg, _ := e.get("errmsg").(string)
+			werrs = append(werrs, writeError{
+				index: toInt(e.get("index")),
+				err:   &commandError{Code: toInt(e.get("code")), Message: msg},
+			})
+		}
+	}
+
+	// The documents were inserted but the write concern wasn't satisfied,
+	// like when the primary steps down before replicating them.
+	if e, ok := reply.get("writeConcernError").(document); ok {
+		msg, _ := e.get("errmsg").(string)
+		err = &commandError{Code: toInt(e.get("code")), Message: msg}
+	}
+
+	return
+}
@@ -0,0 +1,57 @@
+package mongodb
+
+import (
+	"crypto/sha256"
+
+	"github.com/segmentio/ecs-logs/lib/scram"
+)
+
+// authenticate runs a SCRAM-SHA-256 conversation over c, the mechanism that
+// MongoDB clusters use by default since 4.0. The nonce of the client is passed
+// in so the conversation can be tested.
+func authenticate(c *client, db string, username string, password string, nonce string) error {
+	// MongoDB passes the password through SASLprep for SCRAM-SHA-256, which
+	// leaves ASCII passwords untouched.
+	s := scram.NewClient(sha256.New, username, password, nonce)
+	started, verified := false, false
+
+	reply, err := c.roundTrip(db, document{
+		{key: "saslStart", value: int32(1)},
+		{key: "mechanism", value: "SCRAM-SHA-256"},
+		{key: "payload", value: []byte(s.First())},
+		{key: "options", value: document{{key: "skipEmptyExchange", value: true}}},
+	})
+
+	for err == nil {
+		payload, _ := reply.get("payload").([]byte)
+
+		if done, _ := reply.get("done").(bool); done {
+			if !verified {
+				err = s.Verify(string(payload))
+			}
+			return err
+		}
+
+		var next string
+
+		if !started {
+			next, err = s.Final(string(payload))
+			started = true
+		} else {
+			err = s.Verify(string(payload))
+			verified = err == nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		reply, err = c.roundTrip(db, document{
+			{key: "saslContinue", value: int32(1)},
+			{key: "conversationId", value: reply.get("conversationId")},
+			{key: "payload", value: []byte(next)},
+		})
+	}
+
+	return err
+}
@@ -0,0 +1,185 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+)
+
+// MessageIDField is the data field carrying the ID that ecs-logs assigned to a
+// message when it was read.
+const MessageIDField = "message_id"
+
+// MessageIDScheme is how the IDs of messages are generated.
+type MessageIDScheme int
+
+const (
+	// NoMessageIDs doesn't assign IDs to the messages.
+	NoMessageIDs MessageIDScheme = iota
+
+	// UUIDv7MessageIDs assigns version 7 UUIDs, which start with the time
+	// the message was read so they sort in the order messages were read.
+	UUIDv7MessageIDs
+
+	// UUIDv4MessageIDs assigns random UUIDs.
+	UUIDv4MessageIDs
+)
+
+func ParseMessageIDScheme(s string) (scheme MessageIDScheme, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "none":
+		scheme = NoMessageIDs
+	case "uuidv7":
+		scheme = UUIDv7MessageIDs
+	case "uuidv4":
+		scheme = UUIDv4MessageIDs
+	default:
+		err = fmt.Errorf("invalid message ID scheme, must be one of none, uuidv7 or uuidv4: %s", s)
+	}
+	return
+}
+
+func (s MessageIDScheme) String() string {
+	switch s {
+	case UUIDv7MessageIDs:
+		return "uuidv7"
+	case UUIDv4MessageIDs:
+		return "uuidv4"
+	default:
+		return "none"
+	}
+}
+
+// MessageIDGenerator assigns IDs to the messages read from the sources, it's
+// safe to use from the goroutines of all the readers.
+type MessageIDGenerator struct {
+	scheme MessageIDScheme
+
+	// The millisecond of the last UUIDv7 and the counter distinguishing the
+	// UUIDs generated within that millisecond, so they stay ordered.
+	mutex sync.Mutex
+	last  int64
+	seq   uint16
+
+	now  func() time.Time
+	rand io.Reader
+}
+
+func NewMessageIDGenerator(scheme MessageIDScheme) *MessageIDGenerator {
+	return &MessageIDGenerator{
+		scheme: scheme,
+		now:    time.Now,
+		rand:   rand.Reader,
+	}
+}
+
+// Assign sets the ID of msg in its MessageIDField. Messages that already have
+// one keep it, the ID is only generated once so it stays the same when the
+// message is retried, spooled or read again from a destination.
+func (g *MessageIDGenerator) Assign(msg *Message) {
+	if g.scheme == NoMessageIDs || len(MessageID(*msg)) != 0 {
+		return
+	}
+
+	data := make(ecslogs.EventData, len(msg.Event.Data)+1)
+
+	for k, v := range msg.Event.Data {
+		data[k] = v
+	}
+
+	data[MessageIDField] = g.New()
+	msg.Event.Data = data
+}
+
+// New returns a new ID, or an empty string if the generator has no scheme.
+func (g *MessageIDGenerator) New() string {
+	var uuid [16]byte
+
+	switch g.scheme {
+	case UUIDv7MessageIDs:
+		g.rand.Read(uuid[8:])
+		ms, seq := g.tick()
+
+		for i := 0; i != 6; i++ {
+			uuid[i] = byte(ms >> uint(40-8*i))
+		}
+
+		// The counter takes the 12 bits of rand_a, as suggested by the first
+		// method of RFC 9562 for monotonic UUIDs.
+		uuid[6] = 0x70 | byte(seq>>8)&0x0f
+		uuid[7] = byte(seq)
+
+	case UUIDv4MessageIDs:
+		g.rand.Read(uuid[:])
+		uuid[6] = 0x40 | uuid[6]&0x0f
+
+	default:
+		return ""
+	}
+
+	uuid[8] = 0x80 | uuid[8]&0x3f
+	return formatUUID(uuid)
+}
+
+func (g *MessageIDGenerator) tick() (ms int64, seq uint16) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	// The time of the UUIDs never goes backward, when the clock does or the
+	// counter of the millisecond overflows the next millisecond is borrowed.
+	if ms = g.now().UnixNano() / int64(time.Millisecond); ms > g.last {
+		g.last, g.seq = ms, 0
+	} else if g.seq++; g.seq > 0x0fff {
+		g.last, g.seq = g.last+1, 0
+	}
+
+	return g.last, g.seq
+}
+
+func formatUUID(uuid [16]byte) string {
+	var b [36]byte
+
+	hex.Encode(b[0:8], uuid[0:4])
+	hex.Encode(b[9:13], uuid[4:6])
+	hex.Encode(b[14:18], uuid[6:8])
+	hex.Encode(b[19:23], uuid[8:10])
+	hex.Encode(b[24:], uuid[10:])
+	b[8], b[13], b[18], b[23] = '-', '-', '-', '-'
+	return string(b[:])
+}
+
+// MessageID returns the ID assigned to msg, or an empty string if it has none.
+func MessageID(msg Message) string {
+	id, _ := msg.Event.Data[MessageIDField].(string)
+	return id
+}
+
+// LogMessages logs each message of batch at the debug level with its ID, the
+// reason is what happened to the messages (like "dropped"). Finding the ID of
+// a message that didn't arrive in these logs tells where it went.
+func LogMessages(batch MessageBatch, reason string, fields log.Fields) {
+	for _, msg := range batch {
+		f := log.Fields{
+			"group":  msg.Group,
+			"stream": msg.Stream,
+			"event":  msg.Event,
+		}
+
+		if id := MessageID(msg); len(id) != 0 {
+			f["message_id"] = id
+		}
+
+		for k, v := range fields {
+			f[k] = v
+		}
+
+		log.WithFields(f).Debug(reason)
+	}
+}
@@ -0,0 +1,203 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-([47])[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestMessageIDsUnique(t *testing.T) {
+	for _, scheme := range []MessageIDScheme{UUIDv7MessageIDs, UUIDv4MessageIDs} {
+		g := NewMessageIDGenerator(scheme)
+		ids := make(map[string]bool)
+		mutex := sync.Mutex{}
+		wg := sync.WaitGroup{}
+
+		for i := 0; i != 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j != 2500; j++ {
+					id := g.New()
+					mutex.Lock()
+					ids[id] = true
+					mutex.Unlock()
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		if len(ids) != 10000 {
+			t.Errorf("%s: the IDs should be unique, found %d distinct IDs out of 10000", scheme, len(ids))
+		}
+
+		for id := range ids {
+			if m := uuidPattern.FindStringSubmatch(id); m == nil || m[1] != scheme.String()[5:] {
+				t.Errorf("%s: invalid UUID: %s", scheme, id)
+				break
+			}
+		}
+	}
+}
+
+func TestMessageIDsTimeOrdered(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	g := NewMessageIDGenerator(UUIDv7MessageIDs)
+	g.now = func() time.Time { return now }
+
+	var ids []string
+
+	for i := 0; i != 5000; i++ {
+		switch {
+		case i%1000 == 999:
+			// The clock going back doesn't break the order.
+			now = now.Add(-time.Second)
+		case i%100 == 99:
+			now = now.Add(time.Millisecond)
+		}
+		ids = append(ids, g.New())
+	}
+
+	if !sort.StringsAreSorted(ids) {
+		t.Error("the UUIDv7 should sort in the order they were generated")
+	}
+
+	// The first 48 bits are the milliseconds since the epoch.
+	g = NewMessageIDGenerator(UUIDv7MessageIDs)
+	g.now = func() time.Time { return time.Unix(0, 0x0123456789ab*int64(time.Millisecond)) }
+
+	if id := g.New(); id[:13] != "01234567-89ab" {
+		t.Errorf("the UUID should start with the time: %s", id)
+	}
+}
+
+func TestMessageIDAssign(t *testing.T) {
+	g := NewMessageIDGenerator(UUIDv7MessageIDs)
+	original := ecslogs.EventData{"user": "luke"}
+	msg := Message{Event: ecslogs.Event{Message: "Hello World!", Data: original}}
+
+	g.Assign(&msg)
+	id := MessageID(msg)
+
+	if len(id) == 0 || msg.Event.Data["user"] != "luke" {
+		t.Fatalf("the ID should be set along with the other data fields: %v", msg.Event.Data)
+	}
+
+	if _, ok := original[MessageIDField]; ok {
+		t.Error("the data of the original message should not be modified")
+	}
+
+	if g.Assign(&msg); MessageID(msg) != id {
+		t.Errorf("messages that have an ID should keep it: %s != %s", MessageID(msg), id)
+	}
+
+	msg = Message{}
+	NewMessageIDGenerator(NoMessageIDs).Assign(&msg)
+
+	if msg.Event.Data != nil {
+		t.Errorf("no ID should be set without a scheme: %v", msg.Event.Data)
+	}
+}
+
+func TestMessageIDRetried(t *testing.T) {
+	g := NewMessageIDGenerator(UUIDv7MessageIDs)
+	batch := MessageBatch{{}, {}}
+
+	for i := range batch {
+		g.Assign(&batch[i])
+	}
+
+	// The first attempt fails, the batch is written again as is.
+	var attempts int32
+	var written [][]string
+
+	w := DestinationFunc(func(group string, stream string) (Writer, error) {
+		return idTestWriter{attempts: &attempts, written: &written}, nil
+	})
+
+	for {
+		writer, _ := w.Open("A", "B")
+		if writer.WriteMessageBatch(batch) == nil {
+			break
+		}
+	}
+
+	if len(written) != 2 || written[0][0] != written[1][0] || written[0][1] != written[1][1] {
+		t.Errorf("the IDs should be the same on each attempt: %v", written)
+	}
+
+	// Messages spooled or read again carry their ID in their data.
+	var decoded Message
+	json.Unmarshal(batch[0].Bytes(), &decoded)
+	g.Assign(&decoded)
+
+	if MessageID(decoded) != MessageID(batch[0]) {
+		t.Errorf("the ID should survive the serialization of the message: %s != %s", MessageID(decoded), MessageID(batch[0]))
+	}
+}
+
+func TestMessageIDRawLine(t *testing.T) {
+	EnableRawLines()
+	defer atomic.StoreInt32(&rawLines, 0)
+
+	line := `{"message":"Hello World!","data":{"user":"luke"}}`
+	msg := ParseMessage(GetParser("json"), []byte(line))
+	NewMessageIDGenerator(UUIDv4MessageIDs).Assign(&msg)
+
+	if raw, ok := msg.RawLine(); !ok || raw != line {
+		t.Errorf("assigning an ID should not be seen as a change of the message: %q (%t)", raw, ok)
+	}
+}
+
+func TestParseMessageIDScheme(t *testing.T) {
+	for s, ref := range map[string]MessageIDScheme{
+		"":       NoMessageIDs,
+		"none":   NoMessageIDs,
+		"uuidv7": UUIDv7MessageIDs,
+		"UUIDv4": UUIDv4MessageIDs,
+	} {
+		if scheme, err := ParseMessageIDScheme(s); err != nil || scheme != ref {
+			t.Errorf("%q: invalid scheme: %s (%v)", s, scheme, err)
+		}
+	}
+
+	if _, err := ParseMessageIDScheme("ulid"); err == nil {
+		t.Error("unknown schemes should be rejected")
+	}
+}
+
+type idTestWriter struct {
+	attempts *int32
+	written  *[][]string
+}
+
+func (w idTestWriter) Close() error { return nil }
+
+func (w idTestWriter) WriteMessage(msg Message) error {
+	return w.WriteMessageBatch(MessageBatch{msg})
+}
+
+func (w idTestWriter) WriteMessageBatch(batch MessageBatch) error {
+	var ids []string
+
+	for _, msg := range batch {
+		ids = append(ids, MessageID(msg))
+	}
+
+	*w.written = append(*w.written, ids)
+
+	if atomic.AddInt32(w.attempts, 1) == 1 {
+		return errors.New("503 Service Unavailable")
+	}
+	return nil
+}
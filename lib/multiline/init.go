@@ -0,0 +1,12 @@
+package multiline
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterStage("multiline", lib.NewCheckedStage(lib.StageFunc(NewProcessor), checkConfig))
+
+	// The lines are joined per physical stream, before merge interleaves
+	// them with the lines of the other streams of the task, and stacktrace
+	// only finds the traces in the joined messages.
+	lib.RegisterStageOrder("multiline", lib.StageOrder{Before: []string{"merge", "stacktrace"}})
+}
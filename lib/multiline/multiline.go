@@ -0,0 +1,165 @@
+// Package multiline implements the multiline stage, which joins the lines of a
+// stream that belong to the same message, like the frames of a stack trace that
+// the programs write one line at a time, into a single message.
+package multiline
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// The continuation lines when no pattern is configured: the indented lines,
+// like the frames of java and python traces, the causes of java exceptions,
+// and the exception that ends a python trace.
+const defaultContinuation = `^(\s|Caused by: |[\w.$]+(Error|Exception)(: |$))`
+
+type config struct {
+	// A line matching start begins a new message, when it's set the lines
+	// that don't match it continue the previous one. When continuation is
+	// set only the lines matching it continue the previous one.
+	start        *regexp.Regexp
+	continuation *regexp.Regexp
+
+	// How long a message waits for its next line before being released.
+	timeout time.Duration
+
+	// The maximum size in bytes of a joined message, the line that would
+	// exceed it starts a new message.
+	maxBytes int
+}
+
+func getConfig() (c config, err error) {
+	c.timeout = time.Second
+	c.maxBytes = 256 * 1024
+
+	for _, v := range []struct {
+		name string
+		re   **regexp.Regexp
+	}{
+		{"MULTILINE_START", &c.start},
+		{"MULTILINE_CONTINUATION", &c.continuation},
+	} {
+		if s := lib.Getenv(v.name); len(s) != 0 {
+			if *v.re, err = regexp.Compile(s); err != nil {
+				err = fmt.Errorf("invalid %s, must be a regular expression: %s", v.name, s)
+				return
+			}
+		}
+	}
+
+	if c.start == nil && c.continuation == nil {
+		c.continuation = regexp.MustCompile(defaultContinuation)
+	}
+
+	if s := strings.TrimSpace(lib.Getenv("MULTILINE_TIMEOUT")); len(s) != 0 {
+		if c.timeout, err = time.ParseDuration(s); err != nil || c.timeout <= 0 {
+			err = fmt.Errorf("invalid MULTILINE_TIMEOUT, must be a positive duration: %s", s)
+			return
+		}
+	}
+
+	if s := strings.TrimSpace(lib.Getenv("MULTILINE_MAX_BYTES")); len(s) != 0 {
+		if c.maxBytes, err = strconv.Atoi(s); err != nil || c.maxBytes <= 0 {
+			err = fmt.Errorf("invalid MULTILINE_MAX_BYTES, must be a positive integer: %s", s)
+			return
+		}
+	}
+
+	return
+}
+
+// continues returns true if line is a continuation of the previous line.
+func (c config) continues(line string) bool {
+	return (c.start == nil || !c.start.MatchString(line)) && (c.continuation == nil || c.continuation.MatchString(line))
+}
+
+func NewProcessor() (p lib.Processor, err error) {
+	var c config
+
+	if c, err = getConfig(); err == nil {
+		p = newProcessor(c, metrics.Default)
+	}
+
+	return
+}
+
+func checkConfig() (err error) {
+	_, err = getConfig()
+	return
+}
+
+// processor holds the last message of each stream until a line that doesn't
+// continue it is read, or until it waited for the timeout.
+type processor struct {
+	config
+	pending map[string]*pending
+	joined  *metrics.Counter
+}
+
+type pending struct {
+	msg lib.Message
+
+	// The time that the last line was added at.
+	updated time.Time
+}
+
+func newProcessor(c config, registry *metrics.Registry) *processor {
+	return &processor{
+		config:  c,
+		pending: make(map[string]*pending),
+		joined:  registry.Counter("joined_lines", "stage", "multiline"),
+	}
+}
+
+func (p *processor) Process(msg lib.Message, now time.Time) (msgs []lib.Message) {
+	k := msg.Group + "\x00" + msg.Stream
+	last := p.pending[k]
+
+	if last != nil {
+		text := last.msg.Event.Message
+
+		// The time of the joined message is the time of its first line, the
+		// level and data are the ones of the first line too.
+		if now.Sub(last.updated) < p.timeout && p.continues(msg.Event.Message) && len(text)+1+len(msg.Event.Message) <= p.maxBytes {
+			last.msg.Event.Message = text + "\n" + msg.Event.Message
+			last.updated = now
+			p.joined.Add(1)
+
+			// The line is acknowledged, the hold of the first one keeps its
+			// source from committing past it until the message is released.
+			return nil
+		}
+
+		msgs = append(msgs, last.msg)
+	}
+
+	lib.Hold(&msg)
+	p.pending[k] = &pending{msg: msg, updated: now}
+	return
+}
+
+func (p *processor) Flush(now time.Time) (msgs []lib.Message) {
+	keys := make([]string, 0, len(p.pending))
+
+	for k, last := range p.pending {
+		if now.Sub(last.updated) >= p.timeout {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		msgs = append(msgs, p.pending[k].msg)
+		delete(p.pending, k)
+	}
+
+	return
+}
@@ -0,0 +1,161 @@
+package multiline
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+var epoch = time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC)
+
+func newTestProcessor(t *testing.T, env map[string]string) (*processor, *metrics.Registry) {
+	lib.SetConfigEnv(env)
+	defer lib.SetConfigEnv(nil)
+
+	c, err := getConfig()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry := metrics.NewRegistry()
+	return newProcessor(c, registry), registry
+}
+
+func process(p *processor, stream string, lines ...string) (msgs []lib.Message) {
+	for _, line := range lines {
+		msgs = append(msgs, p.Process(lib.Message{Group: "A", Stream: stream, Event: ecslogs.Event{Message: line}}, epoch)...)
+	}
+	return
+}
+
+func texts(msgs []lib.Message) (s []string) {
+	for _, msg := range msgs {
+		s = append(s, msg.Event.Message)
+	}
+	return
+}
+
+func TestProcessorJavaTrace(t *testing.T) {
+	p, registry := newTestProcessor(t, nil)
+
+	output := process(p, "0",
+		"request failed",
+		"java.lang.IllegalStateException: boom",
+		"\tat com.example.Main.run(Main.java:12)",
+		"\tat com.example.Main.main(Main.java:5)",
+		"Caused by: java.io.IOException: closed",
+		"\t... 2 more",
+		"request handled",
+	)
+
+	ref := []string{strings.Join([]string{
+		"request failed",
+		"java.lang.IllegalStateException: boom",
+		"\tat com.example.Main.run(Main.java:12)",
+		"\tat com.example.Main.main(Main.java:5)",
+		"Caused by: java.io.IOException: closed",
+		"\t... 2 more",
+	}, "\n")}
+
+	if found := texts(output); !reflect.DeepEqual(found, ref) {
+		t.Errorf("invalid joined messages:\n- expected: %q\n- found:    %q", ref, found)
+	}
+
+	if found := texts(p.Flush(epoch.Add(time.Second))); !reflect.DeepEqual(found, []string{"request handled"}) {
+		t.Errorf("the last message should be released after the timeout: %q", found)
+	}
+
+	if n := registry.Counter("joined_lines", "stage", "multiline").Value(); n != 5 {
+		t.Error("invalid number of joined lines:", n)
+	}
+}
+
+func TestProcessorPythonTrace(t *testing.T) {
+	p, _ := newTestProcessor(t, nil)
+
+	output := process(p, "0",
+		"Traceback (most recent call last):",
+		`  File "main.py", line 3, in <module>`,
+		"ValueError: boom",
+		"next",
+	)
+
+	if found := texts(output); len(found) != 1 || strings.Count(found[0], "\n") != 2 {
+		t.Errorf("invalid joined messages: %q", found)
+	}
+}
+
+func TestProcessorStartPattern(t *testing.T) {
+	p, _ := newTestProcessor(t, map[string]string{"MULTILINE_START": `^\d{4}-\d{2}-\d{2} `})
+
+	output := process(p, "0",
+		"2026-10-14 first",
+		"no timestamp",
+		"2026-10-14 second",
+	)
+
+	if found := texts(output); !reflect.DeepEqual(found, []string{"2026-10-14 first\nno timestamp"}) {
+		t.Errorf("invalid joined messages: %q", found)
+	}
+}
+
+func TestProcessorStreams(t *testing.T) {
+	p, _ := newTestProcessor(t, nil)
+
+	// The lines of the other streams don't release a message, nor continue
+	// it.
+	process(p, "0", "error")
+	process(p, "1", "other")
+	process(p, "0", "  frame")
+	process(p, "1", "  frame of other")
+
+	if found := texts(p.Flush(epoch.Add(time.Second))); !reflect.DeepEqual(found, []string{"error\n  frame", "other\n  frame of other"}) {
+		t.Errorf("invalid joined messages: %q", found)
+	}
+
+	if len(p.pending) != 0 {
+		t.Errorf("the released streams should be forgotten: %d", len(p.pending))
+	}
+}
+
+func TestProcessorLimits(t *testing.T) {
+	p, _ := newTestProcessor(t, map[string]string{"MULTILINE_MAX_BYTES": "11", "MULTILINE_TIMEOUT": "1s"})
+
+	if found := texts(process(p, "0", "error", " 1234", " 5678")); !reflect.DeepEqual(found, []string{"error\n 1234"}) {
+		t.Errorf("the line exceeding the maximum size should start a new message: %q", found)
+	}
+
+	if found := texts(p.Flush(epoch.Add(time.Second / 2))); len(found) != 0 {
+		t.Errorf("the messages should wait for their next line: %q", found)
+	}
+
+	// The line read after the timeout doesn't continue the last message.
+	found := texts(p.Process(lib.Message{Group: "A", Stream: "0", Event: ecslogs.Event{Message: " late"}}, epoch.Add(2*time.Second)))
+
+	if !reflect.DeepEqual(found, []string{" 5678"}) {
+		t.Errorf("invalid messages after the timeout: %q", found)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	for _, env := range []map[string]string{
+		{"MULTILINE_START": "("},
+		{"MULTILINE_CONTINUATION": "["},
+		{"MULTILINE_TIMEOUT": "0s"},
+		{"MULTILINE_MAX_BYTES": "-1"},
+	} {
+		lib.SetConfigEnv(env)
+
+		if _, err := getConfig(); err == nil {
+			t.Errorf("%v: the configuration should be rejected", env)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+// EmptyNamePolicy controls what happens to messages that were read without a
+// group or a stream, which destinations like CloudWatch Logs would reject.
+type EmptyNamePolicy int
+
+const (
+	// DropEmptyNames discards the messages.
+	DropEmptyNames EmptyNamePolicy = iota
+
+	// DefaultEmptyNames sets the missing names from the default templates.
+	DefaultEmptyNames
+
+	// DeadLetterEmptyNames sends the messages to the dead-letter group, with
+	// the reason and the original names recorded in the event data.
+	DeadLetterEmptyNames
+)
+
+// The variables that can be used in the templates of EmptyNames.
+var nameVariables = []string{"group", "stream", "source", "hostname", "level"}
+
+func ParseEmptyNamePolicy(s string) (p EmptyNamePolicy, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "drop":
+		p = DropEmptyNames
+	case "default":
+		p = DefaultEmptyNames
+	case "dead-letter":
+		p = DeadLetterEmptyNames
+	default:
+		err = fmt.Errorf("invalid empty name policy, must be one of drop, default or dead-letter: %s", s)
+	}
+	return
+}
+
+func (p EmptyNamePolicy) String() string {
+	switch p {
+	case DefaultEmptyNames:
+		return "default"
+	case DeadLetterEmptyNames:
+		return "dead-letter"
+	default:
+		return "drop"
+	}
+}
+
+// EmptyNames carries the configuration of how messages with an empty group or
+// stream are handled. The names are templates which may reference metadata of
+// the message with the {group}, {stream}, {source}, {hostname} and {level}
+// variables, for example "{source}-{hostname}".
+type EmptyNames struct {
+	Policy          EmptyNamePolicy
+	DefaultGroup    string
+	DefaultStream   string
+	DeadLetterGroup string
+}
+
+func (e EmptyNames) Check() (err error) {
+	for _, t := range []struct {
+		name     string
+		template string
+	}{
+		{"default group", e.DefaultGroup},
+		{"default stream", e.DefaultStream},
+		{"dead-letter group", e.DeadLetterGroup},
+	} {
+		if x := checkTemplate(t.template, nameVariables); x != nil {
+			err = AppendError(err, fmt.Errorf("invalid %s: %s", t.name, x))
+		}
+	}
+	return
+}
+
+// Resolve applies the policy to msg, which was read from source on hostname.
+// It returns the message to forward, the names that were missing ("group",
+// "stream" or "group and stream") and whether the message should be forwarded
+// at all. Messages that have both a group and a stream are returned unchanged.
+func (e EmptyNames) Resolve(msg Message, source string, hostname string) (res Message, missing string, ok bool) {
+	res = msg
+
+	switch {
+	case len(msg.Group) == 0 && len(msg.Stream) == 0:
+		missing = "group and stream"
+	case len(msg.Group) == 0:
+		missing = "group"
+	case len(msg.Stream) == 0:
+		missing = "stream"
+	default:
+		ok = true
+		return
+	}
+
+	r := strings.NewReplacer(
+		"{group}", msg.Group,
+		"{stream}", msg.Stream,
+		"{source}", source,
+		"{hostname}", hostname,
+		"{level}", msg.Event.Level.String(),
+	)
+
+	switch e.Policy {
+	case DefaultEmptyNames:
+		if len(res.Group) == 0 {
+			res.Group = r.Replace(e.DefaultGroup)
+		}
+		if len(res.Stream) == 0 {
+			res.Stream = r.Replace(e.DefaultStream)
+		}
+
+	case DeadLetterEmptyNames:
+		res.Group = r.Replace(e.DeadLetterGroup)
+		res.Stream = hostname
+		res.Event.Data = make(ecslogs.EventData, len(msg.Event.Data)+1)
+
+		for k, v := range msg.Event.Data {
+			res.Event.Data[k] = v
+		}
+
+		res.Event.Data[DeadLetterField] = DeadLetterInfo(msg, "missing "+missing, nil)
+
+	default:
+		return
+	}
+
+	// A template may render to an empty name, for example {group} when the
+	// message has no group, the message can't be delivered then.
+	ok = len(res.Group) != 0 && len(res.Stream) != 0
+	return
+}
+
+// checkTemplate verifies that the template only references the given
+// variables, for example "{group}/{level}".
+func checkTemplate(template string, variables []string) error {
+	for s := template; len(s) != 0; {
+		i := strings.IndexByte(s, '{')
+
+		if i < 0 {
+			break
+		}
+
+		j := strings.IndexByte(s[i:], '}')
+
+		if j < 0 {
+			return fmt.Errorf("unclosed variable: %s", template)
+		}
+
+		if name := s[i+1 : i+j]; !containsString(variables, name) {
+			return fmt.Errorf("unknown variable {%s}, must be one of {%s}: %s", name, strings.Join(variables, "}, {"), template)
+		}
+
+		s = s[i+j+1:]
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+func TestEmptyNamesResolve(t *testing.T) {
+	names := EmptyNames{
+		DefaultGroup:    "{source}",
+		DefaultStream:   "{hostname}-{level}",
+		DeadLetterGroup: "dead-letter",
+	}
+
+	tests := []struct {
+		name    string
+		policy  EmptyNamePolicy
+		msg     Message
+		res     Message
+		missing string
+		ok      bool
+	}{
+		{
+			name:   "complete",
+			policy: DropEmptyNames,
+			msg:    Message{Group: "A", Stream: "B"},
+			res:    Message{Group: "A", Stream: "B"},
+			ok:     true,
+		},
+		{
+			name:    "drop",
+			policy:  DropEmptyNames,
+			msg:     Message{Group: "A"},
+			res:     Message{Group: "A"},
+			missing: "stream",
+		},
+		{
+			name:    "default",
+			policy:  DefaultEmptyNames,
+			msg:     Message{Event: ecslogs.Event{Level: ecslogs.ERROR}},
+			res:     Message{Group: "journald", Stream: "localhost-ERROR", Event: ecslogs.Event{Level: ecslogs.ERROR}},
+			missing: "group and stream",
+			ok:      true,
+		},
+		{
+			name:    "default keeps the name that was set",
+			policy:  DefaultEmptyNames,
+			msg:     Message{Stream: "B"},
+			res:     Message{Group: "journald", Stream: "B"},
+			missing: "group",
+			ok:      true,
+		},
+		{
+			name:    "dead-letter",
+			policy:  DeadLetterEmptyNames,
+			msg:     Message{Group: "A", Event: ecslogs.Event{Data: ecslogs.EventData{"answer": 42}}},
+			missing: "stream",
+			ok:      true,
+			res: Message{Group: "dead-letter", Stream: "localhost", Event: ecslogs.Event{Data: ecslogs.EventData{
+				"answer": 42,
+				"deadLetter": ecslogs.EventData{
+					"reason": "missing stream",
+					"group":  "A",
+					"stream": "",
+				},
+			}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			names.Policy = test.policy
+			res, missing, ok := names.Resolve(test.msg, "journald", "localhost")
+
+			if ok != test.ok {
+				t.Errorf("invalid result: %t", ok)
+			}
+
+			if missing != test.missing {
+				t.Errorf("invalid missing names: %#v", missing)
+			}
+
+			if !reflect.DeepEqual(res, test.res) {
+				t.Errorf("invalid message:\n- expected: %#v\n- found:    %#v", test.res, res)
+			}
+		})
+	}
+}
+
+func TestEmptyNamesResolveEmptyTemplate(t *testing.T) {
+	names := EmptyNames{Policy: DefaultEmptyNames, DefaultGroup: "{group}", DefaultStream: "{hostname}"}
+
+	if _, _, ok := names.Resolve(Message{}, "journald", "localhost"); ok {
+		t.Error("messages should be dropped when a template renders an empty name")
+	}
+}
+
+func TestEmptyNamesCheck(t *testing.T) {
+	if err := (EmptyNames{DefaultGroup: "{source}", DefaultStream: "{hostname}"}).Check(); err != nil {
+		t.Error(err)
+	}
+
+	if err := (EmptyNames{DefaultGroup: "{container}"}).Check(); err == nil {
+		t.Error("unknown template variables should be rejected")
+	}
+
+	if err := (EmptyNames{DeadLetterGroup: "{source"}).Check(); err == nil {
+		t.Error("unclosed template variables should be rejected")
+	}
+}
@@ -0,0 +1,11 @@
+package namespace
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterStage("namespace", lib.NewCheckedStage(lib.StageFunc(NewProcessor), checkConfig))
+
+	// The template references the fields of the metadata stage and the
+	// streams renamed by the merge stage.
+	lib.RegisterStageOrder("namespace", lib.StageOrder{After: []string{"merge", "metadata"}})
+}
@@ -0,0 +1,358 @@
+// Package namespace implements the namespace stage, which rewrites the groups
+// (and optionally the streams) of messages from templates computed from their
+// metadata so the log groups created by ecs-logs follow a consistent naming
+// scheme.
+package namespace
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+const (
+	defaultTemplate = "/ecs/{ecs.cluster}/{ecs.task_family}/{group}"
+
+	// The maximum length of a CloudWatch Logs group or stream name.
+	maxGroupLength  = 512
+	maxStreamLength = 512
+)
+
+// A template is a sequence of literal parts and variables, variables are
+// either {group}, {stream}, or the dotted path of a data field. A variable may
+// be followed by "| trunc N" to keep only the first N characters of its value,
+// like {ecs.container_id | trunc 12}.
+type template []part
+
+type part struct {
+	text     string
+	variable bool
+	trunc    int
+}
+
+func parseTemplate(s string) (t template, err error) {
+	for rest := s; len(rest) != 0; {
+		i := strings.IndexByte(rest, '{')
+
+		if i < 0 {
+			t = append(t, part{text: rest})
+			break
+		}
+
+		j := strings.IndexByte(rest[i:], '}')
+
+		if j < 0 {
+			err = fmt.Errorf("unclosed variable: %s", s)
+			return
+		}
+
+		name := strings.TrimSpace(rest[i+1 : i+j])
+		trunc := 0
+
+		if k := strings.IndexByte(name, '|'); k >= 0 {
+			filter := strings.Fields(name[k+1:])
+			name = strings.TrimSpace(name[:k])
+
+			if len(filter) != 2 || filter[0] != "trunc" {
+				err = fmt.Errorf("invalid filter of {%s}, must be trunc followed by a length: %s", rest[i+1:i+j], s)
+				return
+			}
+
+			if trunc, err = strconv.Atoi(filter[1]); err != nil || trunc <= 0 {
+				err = fmt.Errorf("invalid length of {%s}, must be a positive integer: %s", rest[i+1:i+j], s)
+				return
+			}
+		}
+
+		if len(name) == 0 || strings.ContainsAny(name, "{") {
+			err = fmt.Errorf("invalid variable {%s}: %s", rest[i+1:i+j], s)
+			return
+		}
+
+		if i != 0 {
+			t = append(t, part{text: rest[:i]})
+		}
+
+		t = append(t, part{text: name, variable: true, trunc: trunc})
+		rest = rest[i+j+1:]
+	}
+
+	if len(t) == 0 {
+		err = fmt.Errorf("empty template")
+	}
+	return
+}
+
+type config struct {
+	template template
+
+	// The template of the streams, nil when the streams are left unchanged.
+	streamTemplate template
+
+	// The value of the variables that are missing from a message, so the
+	// prefix keeps the same number of levels.
+	missing string
+
+	// The data fields that the original group and stream are preserved in.
+	field       string
+	streamField string
+}
+
+func getConfig() (c config, err error) {
+	c = config{missing: "unknown", field: "original_group", streamField: "original_stream"}
+	var s string
+
+	if s = strings.TrimSpace(lib.Getenv("NAMESPACE_TEMPLATE")); len(s) == 0 {
+		s = defaultTemplate
+	}
+
+	if c.template, err = parseTemplate(s); err != nil {
+		err = fmt.Errorf("invalid NAMESPACE_TEMPLATE, %s", err)
+		return
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("NAMESPACE_STREAM_TEMPLATE")); len(s) != 0 {
+		if c.streamTemplate, err = parseTemplate(s); err != nil {
+			err = fmt.Errorf("invalid NAMESPACE_STREAM_TEMPLATE, %s", err)
+			return
+		}
+
+		for _, part := range c.streamTemplate {
+			if !part.variable && sanitizeStream(part.text) != part.text {
+				err = fmt.Errorf("invalid NAMESPACE_STREAM_TEMPLATE, stream names can't contain the characters : and *: %s", s)
+				return
+			}
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("NAMESPACE_MISSING")); len(s) != 0 {
+		if sanitize(s) != s {
+			err = fmt.Errorf("invalid NAMESPACE_MISSING, must only contain letters, digits and the characters . - _ #: %s", s)
+			return
+		}
+		c.missing = s
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("NAMESPACE_FIELD")); len(s) != 0 {
+		c.field = s
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("NAMESPACE_STREAM_FIELD")); len(s) != 0 {
+		c.streamField = s
+	}
+
+	return
+}
+
+func NewProcessor() (p lib.Processor, err error) {
+	var c config
+
+	if c, err = getConfig(); err != nil {
+		return
+	}
+
+	p = newProcessor(c)
+	return
+}
+
+func checkConfig() (err error) {
+	_, err = getConfig()
+	return
+}
+
+type processor struct {
+	config
+}
+
+func newProcessor(c config) *processor {
+	return &processor{config: c}
+}
+
+func (p *processor) Process(msg lib.Message, now time.Time) []lib.Message {
+	group := p.group(msg)
+	stream := msg.Stream
+
+	if p.streamTemplate != nil {
+		stream = p.stream(msg)
+	}
+
+	data := make(ecslogs.EventData, len(msg.Event.Data)+2)
+
+	for k, v := range msg.Event.Data {
+		data[k] = v
+	}
+
+	data[p.field] = msg.Group
+
+	if p.streamTemplate != nil {
+		data[p.streamField] = msg.Stream
+	}
+
+	msg.Event.Data = data
+	msg.Group = group
+	msg.Stream = stream
+	return []lib.Message{msg}
+}
+
+func (p *processor) Flush(now time.Time) []lib.Message {
+	return nil
+}
+
+// group renders the template for msg. The values of the variables are
+// sanitized, only the original group of the message may contain slashes, so
+// a value can't add levels to the prefix or get out of it.
+func (p *processor) group(msg lib.Message) string {
+	return p.render(p.template, msg, maxGroupLength, func(name string, value string) string {
+		if name == "group" {
+			return escape(strings.Trim(value, "/"), true)
+		}
+		return escape(value, false)
+	})
+}
+
+// stream renders the stream template for msg, stream names allow any character
+// but : and * so only those are replaced in the values of the variables.
+func (p *processor) stream(msg lib.Message) string {
+	return p.render(p.streamTemplate, msg, maxStreamLength, func(name string, value string) string {
+		return escapeWith(value, sanitizeStream)
+	})
+}
+
+func (p *processor) render(t template, msg lib.Message, max int, esc func(string, string) string) string {
+	b := make([]byte, 0, 100)
+
+	for _, part := range t {
+		if !part.variable {
+			b = append(b, part.text...)
+			continue
+		}
+
+		var value string
+
+		switch part.text {
+		case "group":
+			value = msg.Group
+		case "stream":
+			value = msg.Stream
+		default:
+			if v := lookup(msg.Event.Data, part.text); v != nil {
+				value = fmt.Sprint(v)
+			}
+		}
+
+		if part.trunc != 0 {
+			value = truncate(value, part.trunc)
+		}
+
+		if value = esc(part.text, value); len(value) == 0 {
+			value = p.missing
+		}
+
+		b = append(b, value...)
+	}
+
+	if len(b) > max {
+		s := string(b)
+		return s[:max-9] + "-" + hash(s)
+	}
+
+	return string(b)
+}
+
+// truncate returns the first n characters of s, it doesn't split multi-byte
+// characters.
+func truncate(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
+
+// escape returns s with the characters that aren't allowed in group names
+// replaced. When s had to be changed a hash of the original value is appended
+// so that different values, like "a b" and "a_b", don't end up in the same
+// group.
+func escape(s string, slashes bool) (r string) {
+	if slashes {
+		parts := strings.Split(s, "/")
+
+		for i, part := range parts {
+			parts[i] = sanitize(part)
+		}
+
+		r = strings.Join(parts, "/")
+	} else {
+		r = sanitize(s)
+	}
+
+	if r != s {
+		r += "-" + hash(s)
+	}
+
+	return
+}
+
+// escapeWith is like escape for names that are sanitized by f.
+func escapeWith(s string, f func(string) string) string {
+	if r := f(s); r != s {
+		return r + "-" + hash(s)
+	}
+	return s
+}
+
+// sanitize replaces the characters that aren't allowed in CloudWatch Logs group
+// names with underscores, the forward slashes included.
+func sanitize(s string) string {
+	return strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			return c
+		case c == '.', c == '-', c == '_', c == '#':
+			return c
+		default:
+			return '_'
+		}
+	}, s)
+}
+
+// sanitizeStream replaces the characters that aren't allowed in CloudWatch Logs
+// stream names with underscores.
+func sanitizeStream(s string) string {
+	return strings.Map(func(c rune) rune {
+		if c == ':' || c == '*' {
+			return '_'
+		}
+		return c
+	}, s)
+}
+
+func hash(s string) string {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+func lookup(data ecslogs.EventData, path string) interface{} {
+	var value interface{} = map[string]interface{}(data)
+
+	for _, key := range strings.Split(path, ".") {
+		switch m := value.(type) {
+		case ecslogs.EventData:
+			value = m[key]
+		case map[string]interface{}:
+			value = m[key]
+		default:
+			return nil
+		}
+	}
+
+	return value
+}
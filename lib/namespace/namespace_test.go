@@ -0,0 +1,215 @@
+package namespace
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+func newTestProcessor(t *testing.T, s string) *processor {
+	tpl, err := parseTemplate(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newProcessor(config{template: tpl, missing: "unknown", field: "original_group"})
+}
+
+func TestProcessorTemplate(t *testing.T) {
+	p := newTestProcessor(t, defaultTemplate)
+
+	tests := []struct {
+		group string
+		data  ecslogs.EventData
+		res   string
+	}{
+		{
+			group: "api",
+			data:  ecslogs.EventData{"ecs": map[string]interface{}{"cluster": "prod", "task_family": "billing"}},
+			res:   "/ecs/prod/billing/api",
+		},
+		{
+			// The application already used a hierarchical name.
+			group: "/aws/api/",
+			data:  ecslogs.EventData{"ecs": ecslogs.EventData{"cluster": "prod", "task_family": "billing"}},
+			res:   "/ecs/prod/billing/aws/api",
+		},
+		{
+			// Outside of ECS the prefix keeps its levels.
+			group: "api",
+			data:  ecslogs.EventData{},
+			res:   "/ecs/unknown/unknown/api",
+		},
+	}
+
+	for _, test := range tests {
+		msg := makeMessage(test.group, test.data)
+
+		if res := p.Process(msg, time.Now())[0]; res.Group != test.res {
+			t.Errorf("%s: invalid group: %s != %s", test.group, res.Group, test.res)
+		}
+	}
+
+	p = newTestProcessor(t, "/{team}/{stream}/logs")
+
+	if res := p.Process(makeMessage("api", ecslogs.EventData{"team": 42}), time.Now())[0]; res.Group != "/42/B/logs" {
+		t.Errorf("invalid group: %s", res.Group)
+	}
+}
+
+func TestProcessorStreamTemplate(t *testing.T) {
+	p := newTestProcessor(t, "/ecs/{cluster}/{group}")
+	tpl, err := parseTemplate("{stream}-{ecs.container_id | trunc 12}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.streamTemplate, p.streamField = tpl, "original_stream"
+
+	tests := []struct {
+		data ecslogs.EventData
+		res  string
+	}{
+		{
+			data: ecslogs.EventData{"ecs": ecslogs.EventData{"container_id": "ea32192c8553fbff06c9340478a2ff089b2bb5646fb718b4ee206641c9086d66"}},
+			res:  "B-ea32192c8553",
+		},
+		{
+			// Values shorter than the length are kept whole.
+			data: ecslogs.EventData{"ecs": ecslogs.EventData{"container_id": "ea32"}},
+			res:  "B-ea32",
+		},
+		{
+			data: ecslogs.EventData{},
+			res:  "B-unknown",
+		},
+	}
+
+	for _, test := range tests {
+		res := p.Process(makeMessage("api", test.data), time.Now())[0]
+
+		if res.Stream != test.res {
+			t.Errorf("invalid stream: %s != %s", res.Stream, test.res)
+		}
+
+		if res.Event.Data["original_stream"] != "B" {
+			t.Errorf("the original stream should be preserved: %#v", res.Event.Data)
+		}
+	}
+
+	// Slashes are allowed in stream names, colons aren't.
+	tpl, _ = parseTemplate("{cluster}/{stream}")
+	p.streamTemplate = tpl
+
+	if res := p.Process(makeMessage("api", ecslogs.EventData{"cluster": "prod:1"}), time.Now())[0]; !strings.HasPrefix(res.Stream, "prod_1-") || !strings.HasSuffix(res.Stream, "/B") {
+		t.Errorf("the invalid characters of the stream should be replaced: %s", res.Stream)
+	}
+
+	// Without a stream template the streams are left unchanged.
+	p = newTestProcessor(t, defaultTemplate)
+
+	if res := p.Process(makeMessage("api", nil), time.Now())[0]; res.Stream != "B" || res.Event.Data["original_stream"] != nil {
+		t.Errorf("the stream should be left unchanged: %s %#v", res.Stream, res.Event.Data)
+	}
+}
+
+func TestProcessorSanitize(t *testing.T) {
+	p := newTestProcessor(t, "/ecs/{cluster}/{group}")
+
+	a := p.Process(makeMessage("api", ecslogs.EventData{"cluster": "a b"}), time.Now())[0]
+	b := p.Process(makeMessage("api", ecslogs.EventData{"cluster": "a_b"}), time.Now())[0]
+
+	if !strings.HasPrefix(a.Group, "/ecs/a_b-") || !strings.HasSuffix(a.Group, "/api") {
+		t.Errorf("the invalid characters should be replaced: %s", a.Group)
+	}
+
+	if a.Group == b.Group {
+		t.Errorf("sanitized values should not collide with valid ones: %s", a.Group)
+	}
+
+	// A field can't add levels to the prefix.
+	c := p.Process(makeMessage("api", ecslogs.EventData{"cluster": "../../other"}), time.Now())[0]
+
+	if strings.Count(c.Group, "/") != 3 {
+		t.Errorf("slashes in fields should be replaced: %s", c.Group)
+	}
+
+	d := p.Process(makeMessage("my app/ø", nil), time.Now())[0]
+
+	if !strings.HasPrefix(d.Group, "/ecs/unknown/my_app/_-") {
+		t.Errorf("the invalid characters of the group should be replaced: %s", d.Group)
+	}
+
+	e := p.Process(makeMessage(strings.Repeat("x", 600), nil), time.Now())[0]
+
+	if len(e.Group) != maxGroupLength {
+		t.Errorf("the group should be truncated: %d", len(e.Group))
+	}
+}
+
+func TestProcessorOriginalGroup(t *testing.T) {
+	p := newTestProcessor(t, defaultTemplate)
+	msg := makeMessage("api", ecslogs.EventData{"user": "luke"})
+
+	res := p.Process(msg, time.Now())[0]
+
+	if res.Event.Data["original_group"] != "api" || res.Event.Data["user"] != "luke" {
+		t.Errorf("the original group should be preserved: %#v", res.Event.Data)
+	}
+
+	if _, ok := msg.Event.Data["original_group"]; ok {
+		t.Error("the data of the original message should not be modified")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(map[string]string{
+		"NAMESPACE_TEMPLATE": "/svc/{ecs.cluster}/{group}",
+		"NAMESPACE_MISSING":  "none",
+		"NAMESPACE_FIELD":    "app_group",
+	})
+
+	c, err := getConfig()
+
+	if err != nil || len(c.template) != 4 || c.missing != "none" || c.field != "app_group" || c.streamTemplate != nil {
+		t.Errorf("invalid config: %+v (%v)", c, err)
+	}
+
+	lib.SetConfigEnv(map[string]string{
+		"NAMESPACE_STREAM_TEMPLATE": "{stream}-{ecs.container_id|trunc 12}",
+		"NAMESPACE_STREAM_FIELD":    "app_stream",
+	})
+
+	c, err = getConfig()
+
+	if err != nil || len(c.streamTemplate) != 3 || c.streamTemplate[2].trunc != 12 || c.streamField != "app_stream" {
+		t.Errorf("invalid config: %+v (%v)", c, err)
+	}
+
+	for _, env := range []map[string]string{
+		{"NAMESPACE_TEMPLATE": "/ecs/{cluster"},
+		{"NAMESPACE_TEMPLATE": "/ecs/{}/{group}"},
+		{"NAMESPACE_TEMPLATE": "/ecs/{cluster | trunc}/{group}"},
+		{"NAMESPACE_TEMPLATE": "/ecs/{cluster | upper}/{group}"},
+		{"NAMESPACE_STREAM_TEMPLATE": "{stream | trunc 0}"},
+		{"NAMESPACE_STREAM_TEMPLATE": "{ecs.cluster}:{stream}"},
+		{"NAMESPACE_MISSING": "not/set"},
+	} {
+		lib.SetConfigEnv(env)
+
+		if err := checkConfig(); err == nil {
+			t.Errorf("%v: the configuration should be rejected", env)
+		}
+	}
+}
+
+func makeMessage(group string, data ecslogs.EventData) lib.Message {
+	return lib.Message{
+		Group:  group,
+		Stream: "B",
+		Event:  ecslogs.Event{Message: "hello", Time: time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC), Data: data},
+	}
+}
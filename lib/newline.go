@@ -0,0 +1,167 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NewlinePolicy controls how a destination receives messages that contain
+// embedded newlines.
+type NewlinePolicy int
+
+const (
+	// KeepNewlines passes messages through unchanged.
+	KeepNewlines NewlinePolicy = iota
+
+	// EscapeNewlines replaces carriage returns and line feeds with the \r and
+	// \n escape sequences.
+	EscapeNewlines
+
+	// SplitNewlines turns each line of a message into its own event.
+	SplitNewlines
+)
+
+func ParseNewlinePolicy(s string) (p NewlinePolicy, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "keep":
+		p = KeepNewlines
+	case "escape":
+		p = EscapeNewlines
+	case "split":
+		p = SplitNewlines
+	default:
+		err = fmt.Errorf("invalid newline policy, must be one of keep, escape or split: %s", s)
+	}
+	return
+}
+
+func (p NewlinePolicy) String() string {
+	switch p {
+	case EscapeNewlines:
+		return "escape"
+	case SplitNewlines:
+		return "split"
+	default:
+		return "keep"
+	}
+}
+
+// Apply returns the batch of messages after applying the policy, the input
+// batch is never modified.
+func (p NewlinePolicy) Apply(batch MessageBatch) MessageBatch {
+	switch p {
+	case EscapeNewlines:
+		return p.escape(batch)
+	case SplitNewlines:
+		return p.split(batch)
+	default:
+		return batch
+	}
+}
+
+var newlineEscaper = strings.NewReplacer("\r", `\r`, "\n", `\n`)
+
+func (p NewlinePolicy) escape(batch MessageBatch) MessageBatch {
+	var escaped MessageBatch
+
+	for i, msg := range batch {
+		if !strings.ContainsAny(msg.Event.Message, "\r\n") {
+			continue
+		}
+
+		if escaped == nil {
+			escaped = make(MessageBatch, len(batch))
+			copy(escaped, batch)
+		}
+
+		escaped[i].Event.Message = newlineEscaper.Replace(msg.Event.Message)
+	}
+
+	if escaped == nil {
+		return batch
+	}
+
+	return escaped
+}
+
+func (p NewlinePolicy) split(batch MessageBatch) MessageBatch {
+	var split MessageBatch
+
+	for i, msg := range batch {
+		if !strings.Contains(msg.Event.Message, "\n") {
+			if split != nil {
+				split = append(split, msg)
+			}
+			continue
+		}
+
+		if split == nil {
+			split = make(MessageBatch, i, len(batch)+10)
+			copy(split, batch[:i])
+		}
+
+		// A trailing newline terminates the last line, it doesn't start a
+		// new empty one.
+		lines := strings.Split(strings.TrimSuffix(msg.Event.Message, "\n"), "\n")
+
+		for _, line := range lines {
+			m := msg
+			m.Event.Message = strings.TrimSuffix(line, "\r")
+			split = append(split, m)
+		}
+	}
+
+	if split == nil {
+		return batch
+	}
+
+	return split
+}
+
+// NewNewlineDestination wraps dest so the writers it opens apply policy to the
+// messages before writing them.
+func NewNewlineDestination(dest Destination, policy NewlinePolicy) Destination {
+	if policy == KeepNewlines {
+		return dest
+	}
+	return newlineDestination{
+		Destination: dest,
+		policy:      policy,
+	}
+}
+
+type newlineDestination struct {
+	Destination
+	policy NewlinePolicy
+}
+
+func (d newlineDestination) Open(group string, stream string) (w Writer, err error) {
+	if w, err = d.Destination.Open(group, stream); err == nil {
+		w = newlineWriter{
+			Writer: w,
+			policy: d.policy,
+		}
+	}
+	return
+}
+
+type newlineWriter struct {
+	Writer
+	policy NewlinePolicy
+}
+
+func (w newlineWriter) WriteMessage(msg Message) error {
+	return w.WriteMessageBatch(MessageBatch{msg})
+}
+
+func (w newlineWriter) WriteMessageBatch(batch MessageBatch) error {
+	return w.Writer.WriteMessageBatch(w.policy.Apply(batch))
+}
+
+func (w newlineWriter) WriteMessageBatchSize(batch MessageBatch) (int, error) {
+	return WriteMessageBatchSize(w.Writer, w.policy.Apply(batch))
+}
+
+func (w newlineWriter) WriteUrgentMessageBatch(batch MessageBatch) (int, error) {
+	return WriteUrgentMessageBatch(w.Writer, w.policy.Apply(batch))
+}
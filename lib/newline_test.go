@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+func TestNewlinePolicy(t *testing.T) {
+	batch := MessageBatch{
+		{Event: ecslogs.Event{Message: "panic: oops\r\ngoroutine 1:\n\tmain.main()\n"}},
+		{Event: ecslogs.Event{Message: "Hello World!"}},
+	}
+
+	tests := []struct {
+		policy NewlinePolicy
+		output []string
+	}{
+		{
+			policy: KeepNewlines,
+			output: []string{"panic: oops\r\ngoroutine 1:\n\tmain.main()\n", "Hello World!"},
+		},
+		{
+			policy: EscapeNewlines,
+			output: []string{`panic: oops\r\ngoroutine 1:\n` + "\t" + `main.main()\n`, "Hello World!"},
+		},
+		{
+			policy: SplitNewlines,
+			output: []string{"panic: oops", "goroutine 1:", "\tmain.main()", "Hello World!"},
+		},
+	}
+
+	for _, test := range tests {
+		var output []string
+
+		for _, msg := range test.policy.Apply(batch) {
+			output = append(output, msg.Event.Message)
+		}
+
+		if !reflect.DeepEqual(output, test.output) {
+			t.Errorf("%s: invalid messages:\n- expected: %#v\n- found:    %#v", test.policy, test.output, output)
+		}
+	}
+
+	if s := batch[0].Event.Message; s != "panic: oops\r\ngoroutine 1:\n\tmain.main()\n" {
+		t.Errorf("the original batch should not be modified: %#v", s)
+	}
+}
+
+func TestParseNewlinePolicy(t *testing.T) {
+	for _, policy := range []NewlinePolicy{KeepNewlines, EscapeNewlines, SplitNewlines} {
+		if p, err := ParseNewlinePolicy(policy.String()); err != nil {
+			t.Error(err)
+		} else if p != policy {
+			t.Errorf("invalid newline policy: %s != %s", p, policy)
+		}
+	}
+
+	if p, err := ParseNewlinePolicy(""); err != nil || p != KeepNewlines {
+		t.Errorf("the default newline policy should be keep: %s (%v)", p, err)
+	}
+
+	if _, err := ParseNewlinePolicy("join"); err == nil {
+		t.Error("expected an error when parsing an invalid newline policy")
+	}
+}
@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StageOrder holds the constraints on where a stage runs in the pipeline, the
+// order of the stages is the one they're listed in on the command line and
+// some of them only behave as documented when they come before or after
+// others. Constraints on stages that aren't enabled don't apply.
+type StageOrder struct {
+	// The stages that must run before this one, for example the ones adding
+	// data fields to a stage that validates them.
+	After []string
+
+	// The stages that must run after this one.
+	Before []string
+
+	// Set when the stage must be the last one, because the messages it
+	// produces are the ones written to the destinations.
+	Last bool
+}
+
+// RegisterStageOrder sets the ordering constraints of the stage registered
+// with the given name.
+func RegisterStageOrder(name string, order StageOrder) {
+	stgmtx.Lock()
+	stgord[name] = order
+	stgmtx.Unlock()
+}
+
+// CheckStageOrder validates that the stages listed in names, in the order
+// they run, satisfy the constraints of all of them. All the problems found are
+// returned as an ErrorList.
+func CheckStageOrder(names []string) error {
+	var errs ErrorList
+	var index = make(map[string]int, len(names))
+
+	for i, name := range names {
+		if _, dup := index[name]; !dup {
+			index[name] = i
+		}
+	}
+
+	stgmtx.RLock()
+	defer stgmtx.RUnlock()
+
+	for i, name := range names {
+		order := stgord[name]
+
+		if order.Last && i != len(names)-1 {
+			errs = append(errs, fmt.Errorf("stage %s must be the last stage: %s", name, strings.Join(names, ",")))
+		}
+
+		for _, prev := range order.After {
+			if j, ok := index[prev]; ok && j > i {
+				errs = append(errs, fmt.Errorf("stage %s must run after %s: %s", name, prev, strings.Join(names, ",")))
+			}
+		}
+
+		for _, next := range order.Before {
+			if j, ok := index[next]; ok && j < i {
+				errs = append(errs, fmt.Errorf("stage %s must run before %s: %s", name, next, strings.Join(names, ",")))
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
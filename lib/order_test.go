@@ -0,0 +1,99 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+func registerOrderTestStages() func() {
+	names := []string{"test-redact", "test-enrich", "test-dedup", "test-format"}
+
+	for _, name := range names {
+		tag := strings.TrimPrefix(name, "test-")
+		RegisterStage(name, StageFunc(func() (Processor, error) {
+			return &testProcessor{tag: "," + tag}, nil
+		}))
+	}
+
+	RegisterStageOrder("test-redact", StageOrder{Before: []string{"test-dedup"}})
+	RegisterStageOrder("test-dedup", StageOrder{After: []string{"test-enrich"}})
+	RegisterStageOrder("test-format", StageOrder{Last: true})
+
+	return func() {
+		for _, name := range names {
+			DeregisterStage(name)
+		}
+	}
+}
+
+func TestCheckStageOrderValid(t *testing.T) {
+	defer registerOrderTestStages()()
+
+	orders := [][]string{
+		{"test-redact", "test-enrich", "test-dedup", "test-format"},
+		{"test-enrich", "test-redact", "test-dedup", "test-format"},
+		// Constraints on stages that aren't enabled don't apply.
+		{"test-dedup", "test-format"},
+		{"test-redact"},
+		{},
+	}
+
+	for _, names := range orders {
+		if err := CheckStageOrder(names); err != nil {
+			t.Errorf("%v: the order should be valid: %v", names, err)
+		}
+	}
+
+	// The processors run in the order of the stages.
+	names := []string{"test-enrich", "test-redact", "test-dedup", "test-format"}
+	pipeline := Pipeline{}
+
+	for _, stage := range GetStages(names...) {
+		proc, _ := stage.Open()
+		pipeline = append(pipeline, proc)
+	}
+
+	if msgs := pipeline.Process(Message{Event: ecslogs.Event{Message: "-"}}, time.Now()); len(msgs) != 1 || msgs[0].Event.Message != "-,enrich,redact,dedup,format" {
+		t.Errorf("the stages should run in the configured order: %v", msgs)
+	}
+}
+
+func TestCheckStageOrderInvalid(t *testing.T) {
+	defer registerOrderTestStages()()
+
+	tests := []struct {
+		names  []string
+		errors []string
+	}{
+		{
+			names:  []string{"test-format", "test-redact"},
+			errors: []string{"stage test-format must be the last stage: test-format,test-redact"},
+		},
+		{
+			names: []string{"test-dedup", "test-enrich", "test-redact"},
+			errors: []string{
+				"stage test-dedup must run after test-enrich: test-dedup,test-enrich,test-redact",
+				"stage test-redact must run before test-dedup: test-dedup,test-enrich,test-redact",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		err := CheckStageOrder(test.names)
+		errs, _ := err.(ErrorList)
+
+		if len(errs) != len(test.errors) {
+			t.Errorf("%v: invalid errors: %v", test.names, err)
+			continue
+		}
+
+		for i, e := range errs {
+			if e.Error() != test.errors[i] {
+				t.Errorf("%v: invalid error:\n- expected: %s\n- found:    %s", test.names, test.errors[i], e)
+			}
+		}
+	}
+}
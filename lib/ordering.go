@@ -0,0 +1,193 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OrderingMode is the ordering guarantee that a destination gives to the
+// messages of each stream, trading it for throughput.
+type OrderingMode int
+
+const (
+	// OrderingStrict writes the batches of a stream one at a time, in the
+	// order they were flushed, to a single destination stream.
+	OrderingStrict OrderingMode = iota
+
+	// OrderingBestEffort still dispatches the batches of a stream in order
+	// but lets destinations spread a stream across concurrent shards or
+	// partitions, messages are only ordered within each of them.
+	OrderingBestEffort
+
+	// OrderingNone writes batches as soon as they're flushed, concurrently
+	// with the other batches of their stream.
+	OrderingNone
+)
+
+func ParseOrderingMode(s string) (m OrderingMode, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "strict":
+		m = OrderingStrict
+	case "best-effort":
+		m = OrderingBestEffort
+	case "none":
+		m = OrderingNone
+	default:
+		err = fmt.Errorf("invalid ordering mode, must be one of strict, best-effort or none: %s", s)
+	}
+	return
+}
+
+func (m OrderingMode) String() string {
+	switch m {
+	case OrderingBestEffort:
+		return "best-effort"
+	case OrderingNone:
+		return "none"
+	default:
+		return "strict"
+	}
+}
+
+// DestinationOrdering returns the ordering mode configured for destination by
+// the <DESTINATION>_ORDERING environment variable, strict if it isn't set.
+func DestinationOrdering(destination string) (m OrderingMode, err error) {
+	env := strings.ToUpper(destination) + "_ORDERING"
+
+	if m, err = ParseOrderingMode(Getenv(env)); err != nil {
+		err = fmt.Errorf("%s: %s", env, err)
+	}
+
+	return
+}
+
+// Dispatcher runs the writes of message batches in the background according
+// to the ordering mode of their destination. The writes sharing a key are run
+// one after the other in the order they were dispatched, unless the mode is
+// OrderingNone.
+//
+// A stream that gets stuck, for example behind a long backoff, holds back the
+// writes queued after it. When MaxQueueAge is set the writes that waited for
+// longer than that are expired instead of being run, so the latency of the
+// messages that keep coming is bounded.
+//
+// Dispatch never blocks, so a slow stream doesn't hold the others back. When
+// QueueDepth is set the dispatcher is saturated while a key has that many
+// writes queued, the caller is expected to stop feeding it until it's signaled
+// on Released. Workers caps the number of writes running at the same time,
+// across all keys.
+//
+// The zero value is ready to use.
+type Dispatcher struct {
+	MaxQueueAge time.Duration
+	QueueDepth  int
+	Workers     int
+
+	// Released, when set, receives a value without blocking each time a
+	// queue that was full has room again.
+	Released chan struct{}
+
+	mutex     sync.Mutex
+	queues    map[string][]dispatch
+	saturated int
+	workers   chan struct{}
+}
+
+type dispatch struct {
+	write  func()
+	expire func(age time.Duration)
+	time   time.Time
+}
+
+// Dispatch runs write in the background, or expire with the time it waited in
+// the queue if it expired first.
+func (d *Dispatcher) Dispatch(mode OrderingMode, key string, write func(), expire func(age time.Duration)) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.workers == nil && d.Workers > 0 {
+		d.workers = make(chan struct{}, d.Workers)
+	}
+
+	if mode == OrderingNone {
+		go d.work(write)
+		return
+	}
+
+	if d.queues == nil {
+		d.queues = make(map[string][]dispatch)
+	}
+
+	// When the key already has a queue, the goroutine draining it picks up
+	// the write once the previous ones are done.
+	queue, running := d.queues[key]
+	next := dispatch{write: write, expire: expire, time: time.Now()}
+	d.queues[key] = append(queue, next)
+
+	if d.QueueDepth > 0 && len(queue)+1 == d.QueueDepth {
+		d.saturated++
+	}
+
+	if !running {
+		go d.run(key, next)
+	}
+}
+
+// Saturated returns true if the queue of a key holds QueueDepth writes or more.
+func (d *Dispatcher) Saturated() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.saturated != 0
+}
+
+func (d *Dispatcher) run(key string, next dispatch) {
+	for {
+		if age := time.Since(next.time); d.MaxQueueAge > 0 && age > d.MaxQueueAge {
+			next.expire(age)
+		} else {
+			d.work(next.write)
+		}
+
+		d.mutex.Lock()
+		queue := d.queues[key][1:]
+
+		if d.QueueDepth > 0 && len(queue)+1 == d.QueueDepth {
+			d.saturated--
+			d.release()
+		}
+
+		if len(queue) == 0 {
+			delete(d.queues, key)
+		} else {
+			d.queues[key] = queue
+			next = queue[0]
+		}
+
+		d.mutex.Unlock()
+
+		if len(queue) == 0 {
+			return
+		}
+	}
+}
+
+// work runs write once one of the workers is free, right away when the number
+// of workers isn't limited.
+func (d *Dispatcher) work(write func()) {
+	if d.workers != nil {
+		d.workers <- struct{}{}
+		defer func() { <-d.workers }()
+	}
+	write()
+}
+
+func (d *Dispatcher) release() {
+	if d.Released != nil {
+		select {
+		case d.Released <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseOrderingMode(t *testing.T) {
+	tests := []struct {
+		in  string
+		out OrderingMode
+	}{
+		{"", OrderingStrict},
+		{"strict", OrderingStrict},
+		{"best-effort", OrderingBestEffort},
+		{" NONE ", OrderingNone},
+	}
+
+	for _, test := range tests {
+		if m, err := ParseOrderingMode(test.in); err != nil {
+			t.Errorf("%q: %s", test.in, err)
+		} else if m != test.out {
+			t.Errorf("%q: invalid ordering mode: %s", test.in, m)
+		}
+	}
+
+	if _, err := ParseOrderingMode("random"); err == nil {
+		t.Error("parsing an unknown ordering mode should fail")
+	}
+}
+
+func TestDestinationOrdering(t *testing.T) {
+	os.Setenv("TESTDEST_ORDERING", "none")
+	defer os.Unsetenv("TESTDEST_ORDERING")
+
+	if m, err := DestinationOrdering("testdest"); err != nil || m != OrderingNone {
+		t.Errorf("invalid ordering mode: %s (%v)", m, err)
+	}
+}
+
+func TestDispatcherStrict(t *testing.T) {
+	const n = 100
+
+	var d Dispatcher
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var order []int
+
+	for i := 0; i != n; i++ {
+		i := i
+		wg.Add(1)
+		d.Dispatch(OrderingStrict, "A:0", func() {
+			defer wg.Done()
+			// Earlier writes taking longer mustn't let the later ones go first.
+			time.Sleep(time.Duration(n-i) * time.Microsecond)
+			mutex.Lock()
+			order = append(order, i)
+			mutex.Unlock()
+		}, nil)
+	}
+
+	wg.Wait()
+
+	for i, j := range order {
+		if i != j {
+			t.Fatalf("the batches were written out of order: %v", order)
+		}
+	}
+}
+
+func TestDispatcherNone(t *testing.T) {
+	const n = 10
+
+	var d Dispatcher
+	var started sync.WaitGroup
+	var release = make(chan struct{})
+	var done sync.WaitGroup
+
+	started.Add(n)
+	done.Add(n)
+
+	// Every write blocks until all of them started, which only happens if they
+	// run concurrently.
+	for i := 0; i != n; i++ {
+		d.Dispatch(OrderingNone, "A:0", func() {
+			defer done.Done()
+			started.Done()
+			<-release
+		}, nil)
+	}
+
+	ok := make(chan struct{})
+	go func() { started.Wait(); close(ok) }()
+
+	select {
+	case <-ok:
+	case <-time.After(time.Second):
+		t.Error("the writes of a stream should run concurrently when the ordering mode is none")
+	}
+
+	close(release)
+	done.Wait()
+}
+
+func TestDispatcherMaxQueueAge(t *testing.T) {
+	d := Dispatcher{MaxQueueAge: 20 * time.Millisecond}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var written []int
+	var expired []int
+	var release = make(chan struct{})
+
+	dispatch := func(i int, block bool) {
+		wg.Add(1)
+		d.Dispatch(OrderingStrict, "A:0", func() {
+			defer wg.Done()
+			if block {
+				<-release
+			}
+			mutex.Lock()
+			written = append(written, i)
+			mutex.Unlock()
+		}, func(age time.Duration) {
+			defer wg.Done()
+			if age <= d.MaxQueueAge {
+				t.Errorf("%d: expired too early: %s", i, age)
+			}
+			mutex.Lock()
+			expired = append(expired, i)
+			mutex.Unlock()
+		})
+	}
+
+	// The first write gets stuck, the ones queued behind it expire while the
+	// one dispatched after the stream recovers goes through.
+	dispatch(0, true)
+	dispatch(1, false)
+	dispatch(2, false)
+	time.Sleep(50 * time.Millisecond)
+	dispatch(3, false)
+	close(release)
+	wg.Wait()
+
+	if !reflect.DeepEqual(written, []int{0, 3}) {
+		t.Errorf("invalid written batches: %v", written)
+	}
+
+	if !reflect.DeepEqual(expired, []int{1, 2}) {
+		t.Errorf("invalid expired batches: %v", expired)
+	}
+}
+
+func TestDispatcherQueueDepth(t *testing.T) {
+	d := Dispatcher{QueueDepth: 2, Released: make(chan struct{}, 1)}
+
+	var wg sync.WaitGroup
+	var release = make(chan struct{})
+
+	dispatch := func(key string, block bool) {
+		wg.Add(1)
+		d.Dispatch(OrderingStrict, key, func() {
+			defer wg.Done()
+			if block {
+				<-release
+			}
+		}, nil)
+	}
+
+	// The slow stream fills its queue, the others are still dispatched.
+	dispatch("A:0", true)
+
+	if d.Saturated() {
+		t.Error("the dispatcher shouldn't be saturated before a queue is full")
+	}
+
+	dispatch("A:0", false)
+
+	if !d.Saturated() {
+		t.Error("the dispatcher should be saturated once a queue is full")
+	}
+
+	done := make(chan struct{})
+	wg.Add(1)
+	d.Dispatch(OrderingStrict, "A:1", func() { wg.Done(); close(done) }, nil)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("a full queue shouldn't hold back the other streams")
+	}
+
+	close(release)
+
+	select {
+	case <-d.Released:
+	case <-time.After(time.Second):
+		t.Error("the release of the full queue should be signaled")
+	}
+
+	wg.Wait()
+
+	if d.Saturated() {
+		t.Error("the dispatcher shouldn't be saturated once the queues are drained")
+	}
+}
+
+func TestDispatcherWorkers(t *testing.T) {
+	const n = 10
+
+	d := Dispatcher{Workers: 2}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var running, max int
+
+	for i := 0; i != n; i++ {
+		wg.Add(1)
+		d.Dispatch(OrderingStrict, fmt.Sprint("A:", i), func() {
+			defer wg.Done()
+
+			mutex.Lock()
+			if running++; running > max {
+				max = running
+			}
+			mutex.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+		}, nil)
+	}
+
+	wg.Wait()
+
+	if max > 2 {
+		t.Errorf("at most 2 writes should run at the same time: %d", max)
+	}
+}
@@ -0,0 +1,180 @@
+package otlp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+// The protocols of the exports, named like OTEL_EXPORTER_OTLP_PROTOCOL does.
+const (
+	protocolGRPC = "grpc"
+	protocolHTTP = "http/protobuf"
+)
+
+const (
+	// The method of the gRPC logs service, and the path of the logs with
+	// OTLP/HTTP which is appended to the endpoints that have no path.
+	grpcPath = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+	httpPath = "/v1/logs"
+
+	defaultGroupAttribute  = "service.name"
+	defaultStreamAttribute = "service.instance.id"
+)
+
+// config carries the settings of the otlp destination, they are loaded from
+// OTLP_* environment variables.
+type config struct {
+	// The URL the requests are sent to, and whether they're gRPC calls or
+	// OTLP/HTTP posts. The gRPC calls are made over HTTP/2, which is only
+	// negotiated with TLS so they need an https endpoint.
+	url      string
+	protocol string
+
+	// The headers set on each request, which is how the collectors
+	// authenticate them (like Authorization=Bearer <token>).
+	headers map[string]string
+
+	// The resource attributes carrying the group and stream of the messages,
+	// and the ones set on all the resources.
+	groupAttribute     string
+	streamAttribute    string
+	resourceAttributes map[string]string
+
+	// The data fields holding the W3C trace and span IDs of the messages, they
+	// are set on the log records instead of their attributes.
+	traceIDField string
+	spanIDField  string
+
+	// The compression of the requests, gzip or zstd is the grpc-encoding of
+	// the gRPC calls.
+	compression lib.BodyCompression
+
+	// How the requests failing with a transient error are sent again.
+	retry       retry.Policy
+	retryBudget lib.RetryBudget
+
+	tls *tls.Config
+
+	err error
+}
+
+func getConfig() (c config) {
+	var err error
+	var s string
+
+	c = config{
+		url:             strings.TrimSpace(lib.Getenv("OTLP_ENDPOINT")),
+		protocol:        protocolHTTP,
+		groupAttribute:  defaultGroupAttribute,
+		streamAttribute: defaultStreamAttribute,
+		traceIDField:    "trace_id",
+		spanIDField:     "span_id",
+	}
+
+	switch s = strings.ToLower(strings.TrimSpace(lib.Getenv("OTLP_PROTOCOL"))); s {
+	case "":
+	case protocolGRPC, protocolHTTP:
+		c.protocol = s
+	default:
+		c.err = lib.AppendError(c.err, fmt.Errorf("invalid OTLP_PROTOCOL, must be one of grpc or http/protobuf: %s", s))
+	}
+
+	if len(c.url) == 0 {
+		c.err = lib.AppendError(c.err, fmt.Errorf("missing OTLP_ENDPOINT environment variable"))
+	} else if u, e := url.Parse(c.url); e != nil || len(u.Host) == 0 || (u.Scheme != "http" && u.Scheme != "https") {
+		c.err = lib.AppendError(c.err, fmt.Errorf("invalid OTLP_ENDPOINT, must be an http or https URL: %s", c.url))
+	} else if c.protocol == protocolGRPC && u.Scheme != "https" {
+		c.err = lib.AppendError(c.err, fmt.Errorf("invalid OTLP_ENDPOINT, gRPC needs an https URL, use OTLP_PROTOCOL=http/protobuf with plain text collectors: %s", c.url))
+	} else if c.protocol == protocolGRPC {
+		c.url = u.Scheme + "://" + u.Host + grpcPath
+	} else if strings.Trim(u.Path, "/") == "" {
+		c.url = strings.TrimRight(c.url, "/") + httpPath
+	}
+
+	if c.headers, err = parsePairs("OTLP_HEADERS", lib.Getenv("OTLP_HEADERS")); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.resourceAttributes, err = parsePairs("OTLP_RESOURCE_ATTRIBUTES", lib.Getenv("OTLP_RESOURCE_ATTRIBUTES")); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("OTLP_GROUP_ATTRIBUTE")); len(s) != 0 {
+		c.groupAttribute = s
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("OTLP_STREAM_ATTRIBUTE")); len(s) != 0 {
+		c.streamAttribute = s
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("OTLP_TRACE_ID_FIELD")); len(s) != 0 {
+		c.traceIDField = s
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("OTLP_SPAN_ID_FIELD")); len(s) != 0 {
+		c.spanIDField = s
+	}
+
+	if c.compression, err = lib.DestinationBodyCompression("otlp", "none"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.retry, err = retry.DestinationPolicy("otlp", retry.DefaultPolicy); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.retryBudget, err = lib.DestinationRetryBudget("otlp"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if t, err := lib.DestinationTLS("otlp"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	} else if t.Enabled() {
+		if c.tls, err = t.Load(); err != nil {
+			c.err = lib.AppendError(c.err, err)
+		}
+	}
+
+	return
+}
+
+func (c config) check() error {
+	return c.err
+}
+
+// parsePairs parses the comma separated list of key=value pairs of the env
+// variable, the values are percent-decoded like the ones of the
+// OTEL_EXPORTER_OTLP_HEADERS and OTEL_RESOURCE_ATTRIBUTES variables.
+func parsePairs(env string, s string) (pairs map[string]string, err error) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+
+		i := strings.IndexByte(item, '=')
+
+		if i <= 0 {
+			err = fmt.Errorf("invalid %s, expected key=value: %s", env, item)
+			return
+		}
+
+		var v string
+
+		if v, err = url.PathUnescape(strings.TrimSpace(item[i+1:])); err != nil {
+			err = fmt.Errorf("invalid %s, bad percent-encoding: %s", env, item)
+			return
+		}
+
+		if pairs == nil {
+			pairs = make(map[string]string)
+		}
+
+		pairs[strings.TrimSpace(item[:i])] = v
+	}
+	return
+}
@@ -0,0 +1,7 @@
+package otlp
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterDestination("otlp", newDestination(getConfig))
+}
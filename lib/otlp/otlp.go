@@ -0,0 +1,444 @@
+// Package otlp implements the otlp destination, which exports the messages as
+// OpenTelemetry log records to a collector, with OTLP/gRPC or OTLP/HTTP.
+package otlp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/codec"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+// The name of the instrumentation scope of the log records.
+const scopeName = "github.com/segmentio/ecs-logs"
+
+// destination exports the messages of all the streams to a single collector,
+// the writers share its HTTP client.
+type destination struct {
+	lazy   lib.LazyConfig
+	load   func() config
+	config config
+
+	client  *http.Client
+	retries *lib.RetryLimiter
+	clock   clock.Clock
+}
+
+func newDestination(load func() config) *destination {
+	return &destination{
+		load:   load,
+		client: &http.Client{Timeout: 30 * time.Second},
+		clock:  clock.System,
+	}
+}
+
+func (d *destination) Open(group string, stream string) (w lib.Writer, err error) {
+	if err = d.lazy.Init(d.init); err == nil {
+		w = writer{dest: d}
+	}
+
+	return
+}
+
+// CheckConfig reports the problems with the OTLP_* settings when ecs-logs
+// starts.
+func (d *destination) CheckConfig() error {
+	return d.load().check()
+}
+
+func (d *destination) Close(group string, stream string) {}
+
+func (d *destination) init() error {
+	d.config = d.load()
+	d.retries = lib.NewRetryLimiter("otlp", d.config.retryBudget, metrics.Default)
+
+	// The gRPC calls need HTTP/2, which the transport negotiates with TLS
+	// when it's forced to even though the TLS configuration is customized.
+	t := &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		TLSClientConfig:   d.config.tls,
+		ForceAttemptHTTP2: true,
+	}
+
+	d.client.Transport = t
+
+	return d.config.check()
+}
+
+// resource identifies the ResourceLogs of a message.
+type resource struct {
+	group  string
+	stream string
+	host   string
+}
+
+// request returns the ExportLogsServiceRequest of batch, the messages are
+// grouped by resource in the order they first appear.
+func (d *destination) request(batch lib.MessageBatch) []byte {
+	var order []resource
+	records := make(map[resource][]message)
+
+	for _, msg := range batch {
+		r := resource{group: msg.Group, stream: msg.Stream, host: msg.Event.Info.Host}
+
+		if _, ok := records[r]; !ok {
+			order = append(order, r)
+		}
+
+		records[r] = append(records[r], d.record(msg))
+	}
+
+	var req message
+
+	for _, r := range order {
+		scope := message(nil).bytes(1, message(nil).string(1, scopeName))
+
+		for _, rec := range records[r] {
+			scope = scope.bytes(2, rec)
+		}
+
+		req = req.bytes(1, message(nil).bytes(1, d.resourceAttributes(r)).bytes(2, scope))
+	}
+
+	return req
+}
+
+// resourceAttributes returns the Resource message of r, its attributes are
+// the static ones and the names of the stream.
+func (d *destination) resourceAttributes(r resource) message {
+	attrs := make(map[string]interface{}, len(d.config.resourceAttributes)+3)
+
+	for k, v := range d.config.resourceAttributes {
+		attrs[k] = v
+	}
+
+	attrs[d.config.groupAttribute] = r.group
+	attrs[d.config.streamAttribute] = r.stream
+
+	if len(r.host) != 0 {
+		attrs["host.name"] = r.host
+	}
+
+	return message(nil).attributes(1, attrs)
+}
+
+// record returns the LogRecord of msg. The fields of its data are the
+// attributes, along with the ones of its info that aren't part of the
+// resource.
+func (d *destination) record(msg lib.Message) message {
+	e := msg.Event
+	attrs := make(map[string]interface{}, len(e.Data)+4)
+
+	for k, v := range e.Data {
+		attrs[k] = v
+	}
+
+	traceID := hexID(attrs, d.config.traceIDField, 16)
+	spanID := hexID(attrs, d.config.spanIDField, 8)
+
+	if e.Info.PID != 0 {
+		attrs["process.pid"] = e.Info.PID
+	}
+
+	if len(e.Info.ID) != 0 {
+		attrs["log.record.uid"] = e.Info.ID
+	}
+
+	if len(e.Info.Source) != 0 {
+		attrs["code.source"] = e.Info.Source
+	}
+
+	// The first error is the exception of the log record, like the
+	// semantic conventions describe them.
+	if len(e.Info.Errors) != 0 {
+		x := e.Info.Errors[0]
+
+		if len(x.Type) != 0 {
+			attrs["exception.type"] = x.Type
+		}
+
+		if len(x.Error) != 0 {
+			attrs["exception.message"] = x.Error
+		}
+
+		if x.Stack != nil {
+			attrs["exception.stacktrace"] = fmt.Sprint(x.Stack)
+		}
+	}
+
+	observed := msg.Received
+
+	if observed.IsZero() {
+		observed = d.clock.Now()
+	}
+
+	var rec message
+
+	if !e.Time.IsZero() {
+		rec = rec.fixed64(1, uint64(e.Time.UnixNano()))
+	}
+
+	rec = rec.uint(2, uint64(severityNumber(e.Level)))
+
+	if e.Level != ecslogs.NONE {
+		rec = rec.string(3, e.Level.String())
+	}
+
+	rec = rec.bytes(5, anyValue(e.Message))
+	rec = rec.attributes(6, attrs)
+
+	if traceID != nil {
+		rec = rec.bytes(9, traceID)
+	}
+
+	if spanID != nil {
+		rec = rec.bytes(10, spanID)
+	}
+
+	return rec.fixed64(11, uint64(observed.UnixNano()))
+}
+
+// hexID removes the field from attrs and returns its value decoded from hex if
+// it's an ID of n bytes, the field is kept as an attribute otherwise.
+func hexID(attrs map[string]interface{}, field string, n int) []byte {
+	s, ok := attrs[field].(string)
+
+	if !ok {
+		return nil
+	}
+
+	b, err := hex.DecodeString(s)
+
+	if err != nil || len(b) != n {
+		return nil
+	}
+
+	delete(attrs, field)
+	return b
+}
+
+// severityNumber maps the levels to the severity numbers of OpenTelemetry like
+// its data model maps the syslog severities.
+func severityNumber(level ecslogs.Level) int {
+	switch level {
+	case ecslogs.EMERG:
+		return 21 // FATAL
+	case ecslogs.ALERT:
+		return 19 // ERROR3
+	case ecslogs.CRIT:
+		return 18 // ERROR2
+	case ecslogs.ERROR:
+		return 17 // ERROR
+	case ecslogs.WARN:
+		return 13 // WARN
+	case ecslogs.NOTICE:
+		return 10 // INFO2
+	case ecslogs.INFO:
+		return 9 // INFO
+	case ecslogs.DEBUG:
+		return 5 // DEBUG
+	case ecslogs.TRACE:
+		return 1 // TRACE
+	default:
+		return 0 // UNSPECIFIED
+	}
+}
+
+// export sends the request with the protocol of the destination, the retry
+// policy applies to the failures that OTLP tells are transient.
+func (d *destination) export(req []byte) error {
+	body, err := d.config.compression.Compress(req)
+
+	if err != nil {
+		return err
+	}
+
+	if d.config.protocol == protocolGRPC {
+		body = grpcFrame(body, d.config.compression.Enabled())
+	}
+
+	return d.config.retry.Do(d.clock, d.retries, func() error {
+		var r *http.Request
+		var res *http.Response
+		var err error
+
+		if r, err = http.NewRequest("POST", d.config.url, bytes.NewReader(body)); err != nil {
+			return err
+		}
+
+		for k, v := range d.config.headers {
+			r.Header.Set(k, v)
+		}
+
+		if d.config.protocol == protocolGRPC {
+			r.Header.Set("Content-Type", "application/grpc")
+			r.Header.Set("TE", "trailers")
+
+			if e := d.config.compression.Encoding(); len(e) != 0 {
+				r.Header.Set("Grpc-Encoding", e)
+			}
+		} else {
+			r.Header.Set("Content-Type", "application/x-protobuf")
+			d.config.compression.Set(r)
+		}
+
+		if res, err = d.client.Do(r); err != nil {
+			return retry.Retryable(err)
+		}
+		defer res.Body.Close()
+
+		if d.config.protocol == protocolGRPC {
+			return d.grpcResponse(res)
+		}
+
+		return d.httpResponse(res)
+	})
+}
+
+// httpResponse returns the error of an OTLP/HTTP response, the 429, 502, 503
+// and 504 statuses are retryable.
+func (d *destination) httpResponse(res *http.Response) error {
+	b, _ := ioutil.ReadAll(&io.LimitedReader{R: res.Body, N: 1024 * 1024})
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode <= 299:
+		return rejection(b)
+
+	case res.StatusCode == http.StatusTooManyRequests,
+		res.StatusCode == http.StatusBadGateway,
+		res.StatusCode == http.StatusServiceUnavailable,
+		res.StatusCode == http.StatusGatewayTimeout:
+		return retry.Retryable(fmt.Errorf("the OTLP collector responded with %s", res.Status))
+
+	default:
+		if len(b) > 1024 {
+			b = b[:1024]
+		}
+		return fmt.Errorf("the OTLP collector responded with %s: %s", res.Status, bytes.TrimSpace(b))
+	}
+}
+
+// The gRPC status codes that OTLP considers transient: CANCELLED,
+// DEADLINE_EXCEEDED, RESOURCE_EXHAUSTED, ABORTED, OUT_OF_RANGE, UNAVAILABLE and
+// DATA_LOSS.
+var retryableCodes = map[int]bool{1: true, 4: true, 8: true, 10: true, 11: true, 14: true, 15: true}
+
+// grpcResponse returns the error of the response to a gRPC call, its status is
+// in the trailers, or in the headers of the responses without a body.
+func (d *destination) grpcResponse(res *http.Response) error {
+	b, err := ioutil.ReadAll(res.Body)
+
+	if err != nil {
+		return retry.Retryable(err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("the OTLP collector responded with %s", res.Status)
+
+		if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
+			err = retry.Retryable(err)
+		}
+		return err
+	}
+
+	status := res.Trailer.Get("Grpc-Status")
+	text := res.Trailer.Get("Grpc-Message")
+
+	if len(status) == 0 {
+		status, text = res.Header.Get("Grpc-Status"), res.Header.Get("Grpc-Message")
+	}
+
+	if code, _ := strconv.Atoi(status); code != 0 || len(status) == 0 {
+		if s, e := url.PathUnescape(text); e == nil {
+			text = s
+		}
+
+		err = fmt.Errorf("the OTLP collector failed the export with the gRPC status %s: %s", status, text)
+
+		if retryableCodes[code] {
+			err = retry.Retryable(err)
+		}
+		return err
+	}
+
+	if len(b) < 5 {
+		return nil
+	}
+
+	msg := b[5:]
+
+	if b[0] == 1 {
+		c, err := codec.Get(res.Header.Get("Grpc-Encoding"), 0)
+		if err != nil {
+			return err
+		}
+
+		r, err := c.NewReader(bytes.NewReader(msg))
+		if err != nil {
+			return err
+		}
+
+		if msg, err = ioutil.ReadAll(r); err != nil {
+			return err
+		}
+	}
+
+	return rejection(msg)
+}
+
+// rejection returns an error if the response in b reports that the collector
+// rejected some of the log records, they would be rejected again.
+func rejection(b []byte) error {
+	rejected, reason, err := partialSuccess(b)
+
+	if err != nil || rejected == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("the OTLP collector rejected %d log records: %s", rejected, reason)
+}
+
+// grpcFrame prefixes msg with its compression flag and its length, which is
+// how the messages are sent in the bodies of the gRPC calls.
+func grpcFrame(msg []byte, compressed bool) []byte {
+	b := make([]byte, 5, 5+len(msg))
+
+	if compressed {
+		b[0] = 1
+	}
+
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+type writer struct {
+	dest *destination
+}
+
+func (w writer) Close() error {
+	return nil
+}
+
+func (w writer) WriteMessage(msg lib.Message) error {
+	return w.WriteMessageBatch(lib.MessageBatch{msg})
+}
+
+func (w writer) WriteMessageBatch(batch lib.MessageBatch) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	return w.dest.export(w.dest.request(batch))
+}
@@ -0,0 +1,387 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+var epoch = time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC)
+
+// mockCollector records the export requests it receives, status returns the
+// error of each call: an HTTP status with OTLP/HTTP or a gRPC status code.
+type mockCollector struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	requests [][]byte
+	headers  []http.Header
+	status   func(call int) int
+	response []byte
+}
+
+func newTestDestination(t *testing.T, c config) (*destination, *mockCollector) {
+	api := &mockCollector{}
+	api.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+
+		if c.protocol == protocolGRPC {
+			if req.URL.Path != grpcPath || req.ProtoMajor != 2 {
+				t.Errorf("invalid gRPC call: %s %s", req.Proto, req.URL.Path)
+			}
+
+			if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+				t.Fatalf("invalid gRPC frame: %x", body)
+			}
+			body = body[5:]
+		} else {
+			if req.URL.Path != httpPath || req.Header.Get("Content-Type") != "application/x-protobuf" {
+				t.Errorf("invalid OTLP/HTTP request: %s %s", req.URL.Path, req.Header.Get("Content-Type"))
+			}
+		}
+
+		api.mutex.Lock()
+		api.requests = append(api.requests, body)
+		api.headers = append(api.headers, req.Header)
+		call := len(api.requests)
+		api.mutex.Unlock()
+
+		status := 0
+
+		if api.status != nil {
+			status = api.status(call)
+		}
+
+		if c.protocol == protocolGRPC {
+			res.Header().Set("Content-Type", "application/grpc")
+			res.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+			res.WriteHeader(http.StatusOK)
+			res.Write(grpcFrame(api.response, false))
+			res.Header().Set("Grpc-Status", strconv.Itoa(status))
+
+			if status != 0 {
+				res.Header().Set("Grpc-Message", "test%20error")
+			}
+			return
+		}
+
+		if status != 0 {
+			http.Error(res, "test error", status)
+			return
+		}
+
+		res.Header().Set("Content-Type", "application/x-protobuf")
+		res.Write(api.response)
+	}))
+
+	if len(c.protocol) == 0 {
+		c.protocol = protocolHTTP
+	}
+
+	if c.protocol == protocolGRPC {
+		api.EnableHTTP2 = true
+		api.StartTLS()
+		c.url = api.URL + grpcPath
+		c.tls = api.Client().Transport.(*http.Transport).TLSClientConfig
+	} else {
+		api.Start()
+		c.url = api.URL + httpPath
+	}
+
+	if len(c.groupAttribute) == 0 {
+		c.groupAttribute, c.streamAttribute = defaultGroupAttribute, defaultStreamAttribute
+	}
+
+	if len(c.traceIDField) == 0 {
+		c.traceIDField, c.spanIDField = "trace_id", "span_id"
+	}
+
+	d := newDestination(func() config { return c })
+	d.clock = clock.NewFake(epoch)
+	return d, api
+}
+
+func decode(t *testing.T, b []byte) map[int][][]byte {
+	m, err := fields(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// stringAttributes decodes the KeyValue fields with string values.
+func stringAttributes(t *testing.T, values [][]byte) map[string]string {
+	attrs := make(map[string]string)
+
+	for _, kv := range values {
+		f := decode(t, kv)
+		v := decode(t, f[2][0])
+
+		if len(v[1]) != 0 {
+			attrs[string(f[1][0])] = string(v[1][0])
+		}
+	}
+
+	return attrs
+}
+
+func makeMessage(group string, level ecslogs.Level, text string) lib.Message {
+	return lib.Message{
+		Group:    group,
+		Stream:   "task/0123",
+		Received: epoch.Add(time.Second),
+		Event:    ecslogs.Event{Level: level, Time: epoch, Message: text},
+	}
+}
+
+func TestWriterExport(t *testing.T) {
+	for _, protocol := range []string{protocolHTTP, protocolGRPC} {
+		d, api := newTestDestination(t, config{
+			protocol:           protocol,
+			headers:            map[string]string{"Authorization": "Bearer token"},
+			resourceAttributes: map[string]string{"deployment.environment": "production"},
+		})
+
+		w, err := d.Open("api", "task/0123")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		batch := lib.MessageBatch{
+			makeMessage("api", ecslogs.ERROR, "A"),
+			makeMessage("worker", ecslogs.INFO, "B"),
+			makeMessage("api", ecslogs.WARN, "C"),
+		}
+		batch[0].Event.Info.Host = "ip-10-0-0-1"
+		batch[0].Event.Info.PID = 42
+		batch[0].Event.Info.Errors = []ecslogs.EventError{{Type: "*errors.errorString", Error: "boom"}}
+		batch[0].Event.Data = ecslogs.EventData{
+			"user":     "bob",
+			"trace_id": "4bf92f3577b34da6a3ce929d0e0e4736",
+			"span_id":  "00f067aa0ba902b7",
+		}
+		batch[2].Event.Info.Host = "ip-10-0-0-1"
+
+		if err := w.WriteMessageBatch(batch); err != nil {
+			t.Fatalf("%s: %s", protocol, err)
+		}
+
+		api.Close()
+
+		if len(api.requests) != 1 {
+			t.Fatalf("%s: the batch should be exported with a single request: %d", protocol, len(api.requests))
+		}
+
+		if h := api.headers[0].Get("Authorization"); h != "Bearer token" {
+			t.Errorf("%s: the headers should be set on the requests: %q", protocol, h)
+		}
+
+		resources := decode(t, api.requests[0])[1]
+
+		if len(resources) != 2 {
+			t.Fatalf("%s: the messages should be grouped by resource: %d", protocol, len(resources))
+		}
+
+		rl := decode(t, resources[0])
+		attrs := stringAttributes(t, decode(t, rl[1][0])[1])
+
+		if !reflect.DeepEqual(attrs, map[string]string{
+			"service.name":           "api",
+			"service.instance.id":    "task/0123",
+			"host.name":              "ip-10-0-0-1",
+			"deployment.environment": "production",
+		}) {
+			t.Errorf("%s: invalid resource attributes: %v", protocol, attrs)
+		}
+
+		sl := decode(t, rl[2][0])
+
+		if name := string(decode(t, sl[1][0])[1][0]); name != scopeName {
+			t.Errorf("%s: invalid scope: %s", protocol, name)
+		}
+
+		if len(sl[2]) != 2 {
+			t.Fatalf("%s: the resource should have two log records: %d", protocol, len(sl[2]))
+		}
+
+		rec := decode(t, sl[2][0])
+
+		if string(rec[2][0]) != "17" || string(rec[3][0]) != "ERROR" {
+			t.Errorf("%s: invalid severity: %s %s", protocol, rec[2][0], rec[3][0])
+		}
+
+		if ts := binary.LittleEndian.Uint64(rec[1][0]); ts != uint64(epoch.UnixNano()) {
+			t.Errorf("%s: invalid time: %d", protocol, ts)
+		}
+
+		if ts := binary.LittleEndian.Uint64(rec[11][0]); ts != uint64(epoch.Add(time.Second).UnixNano()) {
+			t.Errorf("%s: invalid observed time: %d", protocol, ts)
+		}
+
+		if body := string(decode(t, rec[5][0])[1][0]); body != "A" {
+			t.Errorf("%s: invalid body: %s", protocol, body)
+		}
+
+		if id := hex.EncodeToString(rec[9][0]); id != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("%s: invalid trace ID: %s", protocol, id)
+		}
+
+		if id := hex.EncodeToString(rec[10][0]); id != "00f067aa0ba902b7" {
+			t.Errorf("%s: invalid span ID: %s", protocol, id)
+		}
+
+		if attrs := stringAttributes(t, rec[6]); !reflect.DeepEqual(attrs, map[string]string{
+			"user":              "bob",
+			"exception.type":    "*errors.errorString",
+			"exception.message": "boom",
+		}) {
+			t.Errorf("%s: invalid attributes: %v", protocol, attrs)
+		}
+
+		if len(rec[6]) != 4 {
+			t.Errorf("%s: the pid should be an attribute: %d", protocol, len(rec[6]))
+		}
+	}
+}
+
+func TestWriterRetries(t *testing.T) {
+	for _, test := range []struct {
+		protocol  string
+		transient int
+		permanent int
+	}{
+		{protocolHTTP, http.StatusServiceUnavailable, http.StatusBadRequest},
+		{protocolGRPC, 14, 3}, // UNAVAILABLE, INVALID_ARGUMENT
+	} {
+		d, api := newTestDestination(t, config{protocol: test.protocol, retry: retry.Policy{MaxRetries: 3}})
+
+		api.status = func(call int) int {
+			if call < 3 {
+				return test.transient
+			}
+			return 0
+		}
+
+		w, _ := d.Open("api", "0")
+
+		if err := w.WriteMessageBatch(lib.MessageBatch{makeMessage("api", ecslogs.INFO, "A")}); err != nil || len(api.requests) != 3 {
+			t.Errorf("%s: the request should be sent again until it succeeds: %d (%v)", test.protocol, len(api.requests), err)
+		}
+
+		api.status = func(int) int { return test.permanent }
+
+		if err := w.WriteMessageBatch(lib.MessageBatch{makeMessage("api", ecslogs.INFO, "B")}); err == nil || len(api.requests) != 4 {
+			t.Errorf("%s: the rejected request should not be sent again: %d (%v)", test.protocol, len(api.requests), err)
+		}
+
+		// The log records rejected by a partial success would be rejected
+		// again.
+		api.status = nil
+		api.response = message(nil).bytes(1, message(nil).uint(1, 1).string(2, "too old"))
+
+		if err := w.WriteMessageBatch(lib.MessageBatch{makeMessage("api", ecslogs.INFO, "C")}); err == nil || len(api.requests) != 5 {
+			t.Errorf("%s: the partial success should be reported: %d (%v)", test.protocol, len(api.requests), err)
+		}
+
+		api.Close()
+	}
+}
+
+func TestSeverityNumber(t *testing.T) {
+	for level, ref := range map[ecslogs.Level]int{
+		ecslogs.NONE:   0,
+		ecslogs.EMERG:  21,
+		ecslogs.ALERT:  19,
+		ecslogs.CRIT:   18,
+		ecslogs.ERROR:  17,
+		ecslogs.WARN:   13,
+		ecslogs.NOTICE: 10,
+		ecslogs.INFO:   9,
+		ecslogs.DEBUG:  5,
+		ecslogs.TRACE:  1,
+	} {
+		if n := severityNumber(level); n != ref {
+			t.Errorf("%s: invalid severity number: %d != %d", level, n, ref)
+		}
+	}
+}
+
+func TestAnyValue(t *testing.T) {
+	v := decode(t, anyValue(map[string]interface{}{"a": []interface{}{"x", true, 1.5}}))
+	kv := decode(t, decode(t, v[6][0])[1][0])
+	values := decode(t, decode(t, kv[2][0])[5][0])[1]
+
+	if string(kv[1][0]) != "a" || len(values) != 3 {
+		t.Fatalf("invalid kvlist: %v", kv)
+	}
+
+	if s := string(decode(t, values[0])[1][0]); s != "x" {
+		t.Errorf("invalid string value: %s", s)
+	}
+
+	if b := string(decode(t, values[1])[2][0]); b != "1" {
+		t.Errorf("invalid bool value: %s", b)
+	}
+
+	if len(decode(t, values[2])[4]) != 1 {
+		t.Errorf("invalid double value: %x", values[2])
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(map[string]string{"OTLP_ENDPOINT": "https://collector:4317/ignored", "OTLP_PROTOCOL": "grpc"})
+
+	if c := getConfig(); c.err != nil || c.url != "https://collector:4317"+grpcPath || c.protocol != protocolGRPC {
+		t.Errorf("invalid config: %+v (%v)", c, c.err)
+	}
+
+	lib.SetConfigEnv(map[string]string{
+		"OTLP_ENDPOINT":            "http://collector:4318/",
+		"OTLP_HEADERS":             "Authorization=Basic%20abc=, X-Team = logs",
+		"OTLP_RESOURCE_ATTRIBUTES": "deployment.environment=production",
+		"OTLP_GROUP_ATTRIBUTE":     "service.namespace",
+	})
+
+	c := getConfig()
+
+	if c.err != nil || c.url != "http://collector:4318"+httpPath || c.protocol != protocolHTTP || c.groupAttribute != "service.namespace" {
+		t.Errorf("invalid config: %+v (%v)", c, c.err)
+	}
+
+	if !reflect.DeepEqual(c.headers, map[string]string{"Authorization": "Basic abc=", "X-Team": "logs"}) {
+		t.Errorf("invalid headers: %v", c.headers)
+	}
+
+	if !reflect.DeepEqual(c.resourceAttributes, map[string]string{"deployment.environment": "production"}) {
+		t.Errorf("invalid resource attributes: %v", c.resourceAttributes)
+	}
+
+	for _, env := range []map[string]string{
+		{},
+		{"OTLP_ENDPOINT": "collector:4317"},
+		{"OTLP_ENDPOINT": "http://collector:4317", "OTLP_PROTOCOL": "http/json"},
+		{"OTLP_ENDPOINT": "http://collector:4317", "OTLP_PROTOCOL": "grpc"},
+		{"OTLP_ENDPOINT": "http://collector:4317", "OTLP_HEADERS": "Authorization"},
+		{"OTLP_ENDPOINT": "http://collector:4317", "OTLP_RESOURCE_ATTRIBUTES": "a=%zz"},
+	} {
+		lib.SetConfigEnv(env)
+
+		if c := getConfig(); c.err == nil {
+			t.Errorf("%v: the configuration should be rejected", env)
+		}
+	}
+}
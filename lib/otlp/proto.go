@@ -0,0 +1,242 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// The export requests are opentelemetry.proto.collector.logs.v1 messages,
+// encoded by hand rather than with a protobuf runtime since ecs-logs only
+// writes a handful of them:
+//
+//	ExportLogsServiceRequest { repeated ResourceLogs resource_logs = 1; }
+//	ResourceLogs { Resource resource = 1; repeated ScopeLogs scope_logs = 2; }
+//	Resource { repeated KeyValue attributes = 1; }
+//	ScopeLogs { InstrumentationScope scope = 1; repeated LogRecord log_records = 2; }
+//	InstrumentationScope { string name = 1; string version = 2; }
+//	LogRecord {
+//	  fixed64 time_unix_nano = 1; SeverityNumber severity_number = 2;
+//	  string severity_text = 3; AnyValue body = 5; repeated KeyValue attributes = 6;
+//	  bytes trace_id = 9; bytes span_id = 10; fixed64 observed_time_unix_nano = 11;
+//	}
+//	KeyValue { string key = 1; AnyValue value = 2; }
+//	AnyValue {
+//	  oneof { string string_value = 1; bool bool_value = 2; int64 int_value = 3;
+//	          double double_value = 4; ArrayValue array_value = 5; KeyValueList kvlist_value = 6; }
+//	}
+//	ArrayValue { repeated AnyValue values = 1; }
+//	KeyValueList { repeated KeyValue values = 1; }
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+type message []byte
+
+func (m message) tag(field int, wire int) message {
+	return m.varint(uint64(field<<3 | wire))
+}
+
+func (m message) varint(v uint64) message {
+	for v >= 0x80 {
+		m = append(m, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(m, byte(v))
+}
+
+// The scalar fields that are zero are left out, like protobuf does, unless
+// they're the value of a oneof.
+func (m message) uint(field int, v uint64) message {
+	if v == 0 {
+		return m
+	}
+	return m.tag(field, wireVarint).varint(v)
+}
+
+func (m message) fixed64(field int, v uint64) message {
+	if v == 0 {
+		return m
+	}
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(m.tag(field, wireFixed64), b[:]...)
+}
+
+func (m message) bytes(field int, v []byte) message {
+	return append(m.tag(field, wireBytes).varint(uint64(len(v))), v...)
+}
+
+func (m message) string(field int, s string) message {
+	if len(s) == 0 {
+		return m
+	}
+	return append(m.tag(field, wireBytes).varint(uint64(len(s))), s...)
+}
+
+// keyValue appends a KeyValue field made of key and the AnyValue of v.
+func (m message) keyValue(field int, key string, v interface{}) message {
+	return m.bytes(field, message(nil).string(1, key).bytes(2, anyValue(v)))
+}
+
+// attributes appends the KeyValue fields of attrs, sorted by key.
+func (m message) attributes(field int, attrs map[string]interface{}) message {
+	keys := make([]string, 0, len(attrs))
+
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		m = m.keyValue(field, k, attrs[k])
+	}
+
+	return m
+}
+
+// anyValue returns the AnyValue encoding of v, a value decoded from JSON or
+// set by a stage. The objects and arrays keep their structure, the values of
+// other types are sent as their string representation.
+func anyValue(v interface{}) (m message) {
+	switch x := v.(type) {
+	case nil:
+	case string:
+		m = m.tag(1, wireBytes).varint(uint64(len(x)))
+		m = append(m, x...)
+	case bool:
+		b := uint64(0)
+		if x {
+			b = 1
+		}
+		m = m.tag(2, wireVarint).varint(b)
+	case int:
+		m = m.tag(3, wireVarint).varint(uint64(x))
+	case int64:
+		m = m.tag(3, wireVarint).varint(uint64(x))
+	case float64:
+		m = m.double(x)
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			m = m.tag(3, wireVarint).varint(uint64(i))
+		} else if f, err := x.Float64(); err == nil {
+			m = m.double(f)
+		} else {
+			m = anyValue(x.String())
+		}
+	case []interface{}:
+		var a message
+		for _, item := range x {
+			a = a.bytes(1, anyValue(item))
+		}
+		m = m.bytes(5, a)
+	case map[string]interface{}:
+		m = m.bytes(6, message(nil).attributes(1, x))
+	default:
+		if b, err := json.Marshal(x); err == nil {
+			var decoded interface{}
+
+			if json.Unmarshal(b, &decoded) == nil {
+				if _, ok := decoded.(map[string]interface{}); ok {
+					return anyValue(decoded)
+				}
+			}
+		}
+		m = anyValue(fmt.Sprint(x))
+	}
+	return
+}
+
+func (m message) double(f float64) message {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(f))
+	return append(m.tag(4, wireFixed64), b[:]...)
+}
+
+// fields decodes the fields of a protobuf message by number, the values of the
+// varints are formatted in decimal.
+func fields(b []byte) (m map[int][][]byte, err error) {
+	m = make(map[int][][]byte)
+
+	for len(b) != 0 {
+		key, n := binary.Uvarint(b)
+
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid protobuf message")
+		}
+
+		b = b[n:]
+		field := int(key >> 3)
+
+		switch key & 7 {
+		case wireVarint:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return nil, fmt.Errorf("invalid protobuf varint")
+			}
+			m[field] = append(m[field], []byte(strconv.FormatUint(v, 10)))
+			b = b[n:]
+
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return nil, fmt.Errorf("invalid protobuf length")
+			}
+			m[field] = append(m[field], b[n:n+int(l)])
+			b = b[n+int(l):]
+
+		case wireFixed64:
+			if len(b) < 8 {
+				return nil, fmt.Errorf("invalid protobuf fixed64")
+			}
+			m[field] = append(m[field], b[:8])
+			b = b[8:]
+
+		case wireFixed32:
+			if len(b) < 4 {
+				return nil, fmt.Errorf("invalid protobuf fixed32")
+			}
+			m[field] = append(m[field], b[:4])
+			b = b[4:]
+
+		default:
+			return nil, fmt.Errorf("invalid protobuf wire type %d", key&7)
+		}
+	}
+
+	return
+}
+
+// partialSuccess decodes the ExportLogsServiceResponse in b, and returns the
+// number of log records that the collector rejected and why:
+//
+//	ExportLogsServiceResponse { ExportLogsPartialSuccess partial_success = 1; }
+//	ExportLogsPartialSuccess { int64 rejected_log_records = 1; string error_message = 2; }
+func partialSuccess(b []byte) (rejected int64, reason string, err error) {
+	var res, ps map[int][][]byte
+
+	if res, err = fields(b); err != nil || len(res[1]) == 0 {
+		return
+	}
+
+	if ps, err = fields(res[1][0]); err != nil {
+		return
+	}
+
+	if len(ps[1]) != 0 {
+		rejected, _ = strconv.ParseInt(string(ps[1][0]), 10, 64)
+	}
+
+	if len(ps[2]) != 0 {
+		reason = string(ps[2][0])
+	}
+
+	return
+}
@@ -0,0 +1,434 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+)
+
+// OversizePolicy controls what happens to the messages that exceed the maximum
+// record size of a destination, which would otherwise be rejected.
+type OversizePolicy int
+
+const (
+	// KeepOversize passes the messages through unchanged.
+	KeepOversize OversizePolicy = iota
+
+	// TruncateOversize cuts the message so the record fits, the original
+	// length of the message is recorded in the "truncated" data field.
+	TruncateOversize
+
+	// SplitOversize cuts the message in parts that each fit in a record, the
+	// parts get the "part" data field set to "i/N" like the split stage does.
+	SplitOversize
+
+	// DeadLetterOversize sends the truncated messages to the dead-letter
+	// group, with the reason and the original names recorded in the event
+	// data.
+	DeadLetterOversize
+)
+
+func ParseOversizePolicy(s string) (p OversizePolicy, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "keep":
+		p = KeepOversize
+	case "truncate":
+		p = TruncateOversize
+	case "split":
+		p = SplitOversize
+	case "dead-letter":
+		p = DeadLetterOversize
+	default:
+		err = fmt.Errorf("invalid oversize policy, must be one of keep, truncate, split or dead-letter: %s", s)
+	}
+	return
+}
+
+func (p OversizePolicy) String() string {
+	switch p {
+	case TruncateOversize:
+		return "truncate"
+	case SplitOversize:
+		return "split"
+	case DeadLetterOversize:
+		return "dead-letter"
+	default:
+		return "keep"
+	}
+}
+
+// RegisterRecordLimit sets the maximum size of the records that destination
+// accepts, in bytes, it's the default limit of the oversize policies.
+func RegisterRecordLimit(destination string, size int) {
+	limmtx.Lock()
+	limmap[destination] = size
+	limmtx.Unlock()
+}
+
+// GetRecordLimit returns the maximum record size registered for destination, or
+// zero if the destination has no known limit.
+func GetRecordLimit(destination string) (size int) {
+	limmtx.RLock()
+	size = limmap[destination]
+	limmtx.RUnlock()
+	return
+}
+
+var (
+	limmtx sync.RWMutex
+	limmap = map[string]int{}
+)
+
+// Oversize applies an oversize policy to the messages of a destination.
+type Oversize struct {
+	Policy OversizePolicy
+
+	// The maximum size of a record, measured as the length of the JSON
+	// representation of its event.
+	Limit int
+
+	// The group that oversized messages are sent to with DeadLetterOversize,
+	// {group} and {stream} are replaced with the names of the original stream.
+	DeadLetterGroup string
+}
+
+// DestinationOversize returns the oversize policy configured for destination
+// by the <DESTINATION>_OVERSIZE environment variable, the limit defaults to the
+// registered record limit of the destination and can be overridden with
+// <DESTINATION>_MAX_RECORD_SIZE.
+func DestinationOversize(destination string, deadLetterGroup string) (o Oversize, err error) {
+	prefix := strings.ToUpper(destination) + "_"
+
+	if o.Policy, err = ParseOversizePolicy(Getenv(prefix + "OVERSIZE")); err != nil {
+		err = fmt.Errorf("%sOVERSIZE: %s", prefix, err)
+		return
+	}
+
+	o.Limit = GetRecordLimit(destination)
+	o.DeadLetterGroup = deadLetterGroup
+
+	if s := strings.TrimSpace(Getenv(prefix + "MAX_RECORD_SIZE")); len(s) != 0 {
+		if o.Limit, err = strconv.Atoi(s); err != nil || o.Limit <= 0 {
+			err = fmt.Errorf("invalid %sMAX_RECORD_SIZE, must be a positive integer: %s", prefix, s)
+			return
+		}
+	}
+
+	if o.Policy != KeepOversize && o.Limit == 0 {
+		err = fmt.Errorf("%sOVERSIZE: the %s destination has no known record limit, %sMAX_RECORD_SIZE must be set",
+			prefix, destination, prefix)
+	}
+
+	return
+}
+
+// Apply returns the batch of messages that fit in the limit after applying the
+// policy, and the messages to send to the dead-letter group. The input batch is
+// never modified.
+func (o Oversize) Apply(batch MessageBatch) (res MessageBatch, deadLetters MessageBatch) {
+	if o.Policy == KeepOversize || o.Limit <= 0 {
+		return batch, nil
+	}
+
+	for i, msg := range batch {
+		size := msg.ContentLength()
+
+		if size <= o.Limit {
+			if res != nil {
+				res = append(res, msg)
+			}
+			continue
+		}
+
+		if res == nil {
+			res = make(MessageBatch, i, len(batch)+10)
+			copy(res, batch[:i])
+		}
+
+		switch o.Policy {
+		case TruncateOversize:
+			res = append(res, o.truncate(msg))
+		case SplitOversize:
+			res = append(res, o.split(msg)...)
+		case DeadLetterOversize:
+			deadLetters = append(deadLetters, o.deadLetter(msg, size))
+		}
+	}
+
+	if res == nil {
+		res = batch
+	}
+
+	return
+}
+
+func (o Oversize) truncate(msg Message) Message {
+	msg.Event.Data = copyData(msg.Event.Data, 1)
+	msg.Event.Data["truncated"] = len(msg.Event.Message)
+	msg.Event.Message = o.fit(msg)
+	return msg
+}
+
+func (o Oversize) deadLetter(msg Message, size int) Message {
+	res := msg
+	res.Group = o.DeadLetterGroup
+	res.Event.Data = copyData(msg.Event.Data, 1)
+	res.Event.Data[DeadLetterField] = DeadLetterInfo(msg, fmt.Sprintf("record of %d bytes over the limit of %d bytes", size, o.Limit), nil)
+	res.Event.Message = o.fit(res)
+	return res
+}
+
+// fit returns the longest prefix of the message of msg that fits in a record,
+// escaping can make the JSON representation of a message longer than the
+// message so the length of the prefix is searched for.
+func (o Oversize) fit(msg Message) string {
+	s := msg.Event.Message
+	fits := func(n int) bool {
+		msg.Event.Message = truncateString(s, n)
+		return msg.ContentLength() <= o.Limit
+	}
+
+	// The first lo bytes of s fit in a record, the first hi bytes don't.
+	lo, hi := 0, len(s)
+
+	for lo+1 < hi {
+		if n := (lo + hi) / 2; fits(n) {
+			lo = n
+		} else {
+			hi = n
+		}
+	}
+
+	return truncateString(s, lo)
+}
+
+func (o Oversize) split(msg Message) []Message {
+	// The part field, set on each part, must fit in the limit as well, the
+	// largest value it may take is used to measure the space left.
+	empty := msg
+	empty.Event.Message = ""
+	empty.Event.Data = copyData(msg.Event.Data, 1)
+	empty.Event.Data["part"] = fmt.Sprintf("%d/%d", len(msg.Event.Message), len(msg.Event.Message))
+
+	overhead := empty.ContentLength()
+	n := o.Limit - overhead
+
+	for n >= utf8.UTFMax {
+		parts := SplitMessage(msg, n, "part")
+		excess := 0
+
+		for _, part := range parts {
+			if e := part.ContentLength() - o.Limit; e > excess {
+				excess = e
+			}
+		}
+
+		if excess == 0 {
+			return parts
+		}
+
+		// Escaping makes the message of the largest part excess bytes
+		// longer than the room left for it, invalid UTF-8 and control
+		// characters grow several times longer so the length is scaled by
+		// how much the message grew.
+		size := o.Limit + excess - overhead
+		n -= (excess*n + size - 1) / size
+	}
+
+	// The other fields of the message don't leave room for the message, it
+	// can only be truncated.
+	return []Message{o.truncate(msg)}
+}
+
+func copyData(data ecslogs.EventData, extra int) ecslogs.EventData {
+	c := make(ecslogs.EventData, len(data)+extra)
+
+	for k, v := range data {
+		c[k] = v
+	}
+
+	return c
+}
+
+// SplitMessage cuts the message of msg into parts of at most n bytes that each
+// get a copy of the original event, with field set to "i/N". Timestamps are
+// incremented by a microsecond from one part to the next so they remain
+// ordered once sorted by time.
+func SplitMessage(msg Message, n int, field string) []Message {
+	if len(msg.Event.Message) <= n {
+		return []Message{msg}
+	}
+
+	chunks := SplitString(msg.Event.Message, n)
+	parts := make([]Message, len(chunks))
+
+	for i, chunk := range chunks {
+		part := msg
+		part.Event.Message = chunk
+		part.Event.Time = msg.Event.Time.Add(time.Duration(i) * time.Microsecond)
+		part.Event.Data = copyData(msg.Event.Data, 1)
+		part.Event.Data[field] = fmt.Sprintf("%d/%d", i+1, len(chunks))
+		parts[i] = part
+	}
+
+	return parts
+}
+
+// SplitString cuts s into chunks of at most n bytes. Chunks never end in the
+// middle of a UTF-8 sequence, and end after a whitespace when there's one in
+// the second half of the chunk. Invalid sequences longer than n have no place
+// to cut at and are cut after n bytes.
+func SplitString(s string, n int) (chunks []string) {
+	for len(s) > n {
+		i := n
+
+		for i > 0 && !utf8.RuneStart(s[i]) {
+			i--
+		}
+
+		if i == 0 {
+			i = n
+		}
+
+		if j := lastSpace(s[:i]); j >= (i / 2) {
+			i = j
+		}
+
+		chunks = append(chunks, s[:i])
+		s = s[i:]
+	}
+	return append(chunks, s)
+}
+
+// truncateString returns the first n bytes of s, or less so it doesn't end in
+// the middle of a UTF-8 sequence.
+func truncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
+
+// lastSpace returns the index right after the last whitespace in s, or -1 if
+// there are none.
+func lastSpace(s string) int {
+	for i := len(s); i > 0; {
+		r, size := utf8.DecodeLastRuneInString(s[:i])
+
+		if unicode.IsSpace(r) {
+			return i
+		}
+
+		i -= size
+	}
+	return -1
+}
+
+// NewOversizeDestination wraps dest so the writers it opens apply o to the
+// messages before writing them, oversized messages are dead-lettered through
+// writers of dest opened on the dead-letter group.
+func NewOversizeDestination(dest Destination, o Oversize) Destination {
+	if o.Policy == KeepOversize {
+		return dest
+	}
+	return oversizeDestination{
+		Destination: dest,
+		oversize:    o,
+	}
+}
+
+type oversizeDestination struct {
+	Destination
+	oversize Oversize
+}
+
+func (d oversizeDestination) Open(group string, stream string) (w Writer, err error) {
+	if w, err = d.Destination.Open(group, stream); err == nil {
+		o := d.oversize
+		o.DeadLetterGroup = strings.NewReplacer("{group}", group, "{stream}", stream).Replace(o.DeadLetterGroup)
+		w = &oversizeWriter{
+			Writer:   w,
+			dest:     d.Destination,
+			stream:   stream,
+			oversize: o,
+		}
+	}
+	return
+}
+
+type oversizeWriter struct {
+	Writer
+	dest       Destination
+	stream     string
+	oversize   Oversize
+	deadLetter Writer
+}
+
+func (w *oversizeWriter) Close() (err error) {
+	err = w.Writer.Close()
+
+	if w.deadLetter != nil {
+		w.deadLetter.Close()
+		w.dest.Close(w.oversize.DeadLetterGroup, w.stream)
+	}
+
+	return
+}
+
+func (w *oversizeWriter) WriteMessage(msg Message) error {
+	return w.WriteMessageBatch(MessageBatch{msg})
+}
+
+func (w *oversizeWriter) WriteMessageBatch(batch MessageBatch) (err error) {
+	_, err = w.WriteMessageBatchSize(batch)
+	return
+}
+
+func (w *oversizeWriter) WriteMessageBatchSize(batch MessageBatch) (int, error) {
+	return w.write(batch, WriteMessageBatchSize)
+}
+
+func (w *oversizeWriter) WriteUrgentMessageBatch(batch MessageBatch) (int, error) {
+	return w.write(batch, WriteUrgentMessageBatch)
+}
+
+func (w *oversizeWriter) write(batch MessageBatch, write func(Writer, MessageBatch) (int, error)) (size int, err error) {
+	batch, deadLetters := w.oversize.Apply(batch)
+
+	if len(batch) != 0 {
+		if size, err = write(w.Writer, batch); err != nil {
+			return
+		}
+	}
+
+	if len(deadLetters) != 0 {
+		if w.deadLetter == nil {
+			if w.deadLetter, err = w.dest.Open(w.oversize.DeadLetterGroup, w.stream); err != nil {
+				err = fmt.Errorf("opening the dead-letter group %s: %s", w.oversize.DeadLetterGroup, err)
+				return
+			}
+		}
+
+		var n int
+
+		if n, err = write(w.deadLetter, deadLetters); err == nil {
+			LogMessages(deadLetters, "dead-lettered", log.Fields{"dead_letter_group": w.oversize.DeadLetterGroup})
+		}
+
+		size += n
+	}
+
+	return
+}
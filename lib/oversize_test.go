@@ -0,0 +1,245 @@
+package lib
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+// The maximum record sizes of CloudWatch Logs, Kinesis and Firehose.
+var testRecordLimits = []int{262144 - 26, 1048576, 1024000}
+
+func makeOversizeMessage(n int) Message {
+	return Message{
+		Group:  "A",
+		Stream: "B",
+		Event: ecslogs.Event{
+			Time: time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC),
+			// Quotes are escaped so the records are longer than the messages.
+			Message: truncateString(strings.Repeat(`say "héllo" `, n/10+1), n),
+			Data:    ecslogs.EventData{"request": "42"},
+		},
+	}
+}
+
+func TestOversizeUnderLimit(t *testing.T) {
+	for _, limit := range testRecordLimits {
+		msg := makeOversizeMessage(limit / 2)
+
+		for _, p := range []OversizePolicy{TruncateOversize, SplitOversize, DeadLetterOversize} {
+			batch := MessageBatch{msg}
+
+			if res, dl := (Oversize{Policy: p, Limit: limit}).Apply(batch); !reflect.DeepEqual(res, batch) || len(dl) != 0 {
+				t.Errorf("%s, %d: messages under the limit should be left unchanged", p, limit)
+			}
+		}
+	}
+}
+
+func TestOversizeTruncate(t *testing.T) {
+	for _, limit := range testRecordLimits {
+		msg := makeOversizeMessage(limit)
+		res, dl := (Oversize{Policy: TruncateOversize, Limit: limit}).Apply(MessageBatch{msg})
+
+		if len(res) != 1 || len(dl) != 0 {
+			t.Errorf("%d: invalid result: %d messages, %d dead letters", limit, len(res), len(dl))
+			continue
+		}
+
+		m := res[0]
+
+		if n := m.ContentLength(); n > limit || n < limit-utf8.UTFMax*2 {
+			t.Errorf("%d: the truncated record should nearly fill the limit: %d", limit, n)
+		}
+
+		if !strings.HasPrefix(msg.Event.Message, m.Event.Message) || !utf8.ValidString(m.Event.Message) {
+			t.Errorf("%d: the message wasn't truncated at a rune boundary", limit)
+		}
+
+		if m.Event.Data["truncated"] != len(msg.Event.Message) || m.Event.Data["request"] != "42" {
+			t.Errorf("%d: invalid data: %v", limit, m.Event.Data)
+		}
+
+		if msg.Event.Data["truncated"] != nil {
+			t.Errorf("%d: the original message was modified", limit)
+		}
+	}
+}
+
+func TestOversizeSplit(t *testing.T) {
+	for _, limit := range testRecordLimits {
+		msg := makeOversizeMessage(limit * 2)
+		res, dl := (Oversize{Policy: SplitOversize, Limit: limit}).Apply(MessageBatch{msg})
+
+		if len(res) < 3 || len(dl) != 0 {
+			t.Errorf("%d: invalid result: %d messages, %d dead letters", limit, len(res), len(dl))
+			continue
+		}
+
+		var parts []string
+
+		for i, m := range res {
+			if n := m.ContentLength(); n > limit {
+				t.Errorf("%d: part %d is over the limit: %d", limit, i, n)
+			}
+			if !m.Event.Time.Equal(msg.Event.Time.Add(time.Duration(i) * time.Microsecond)) {
+				t.Errorf("%d: invalid time of part %d: %s", limit, i, m.Event.Time)
+			}
+			parts = append(parts, m.Event.Message)
+		}
+
+		if strings.Join(parts, "") != msg.Event.Message {
+			t.Errorf("%d: the parts don't add up to the original message", limit)
+		}
+
+		if part := res[len(res)-1].Event.Data["part"]; part != "3/3" {
+			t.Errorf("%d: invalid part field of the last part: %v", limit, part)
+		}
+	}
+}
+
+func TestOversizeDeadLetter(t *testing.T) {
+	for _, limit := range testRecordLimits {
+		small, large := makeOversizeMessage(10), makeOversizeMessage(limit)
+		res, dl := (Oversize{Policy: DeadLetterOversize, Limit: limit, DeadLetterGroup: "DL"}).Apply(MessageBatch{small, large, small})
+
+		if !reflect.DeepEqual(res, MessageBatch{small, small}) {
+			t.Errorf("%d: only the messages under the limit should be kept: %d messages", limit, len(res))
+		}
+
+		if len(dl) != 1 {
+			t.Errorf("%d: invalid dead letters: %d", limit, len(dl))
+			continue
+		}
+
+		m := dl[0]
+
+		if m.Group != "DL" || m.Stream != "B" {
+			t.Errorf("%d: invalid names of the dead letter: %s/%s", limit, m.Group, m.Stream)
+		}
+
+		if n := m.ContentLength(); n > limit {
+			t.Errorf("%d: the dead letter is over the limit: %d", limit, n)
+		}
+
+		if d, _ := m.Event.Data["deadLetter"].(ecslogs.EventData); d["group"] != "A" || d["stream"] != "B" {
+			t.Errorf("%d: invalid dead letter data: %v", limit, m.Event.Data)
+		}
+	}
+}
+
+type oversizeTestWriter struct {
+	group   string
+	batches *map[string]MessageBatch
+}
+
+func (w oversizeTestWriter) Close() error { return nil }
+
+func (w oversizeTestWriter) WriteMessage(msg Message) error {
+	return w.WriteMessageBatch(MessageBatch{msg})
+}
+
+func (w oversizeTestWriter) WriteMessageBatch(batch MessageBatch) error {
+	(*w.batches)[w.group] = append((*w.batches)[w.group], batch...)
+	return nil
+}
+
+func TestOversizeDestination(t *testing.T) {
+	batches := map[string]MessageBatch{}
+	dest := NewOversizeDestination(DestinationFunc(func(group string, stream string) (Writer, error) {
+		return oversizeTestWriter{group: group, batches: &batches}, nil
+	}), Oversize{Policy: DeadLetterOversize, Limit: 1000, DeadLetterGroup: "{group}-dead-letter"})
+
+	w, err := dest.Open("A", "B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err := w.WriteMessageBatch(MessageBatch{makeOversizeMessage(10), makeOversizeMessage(2000)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batches["A"]) != 1 || len(batches["A-dead-letter"]) != 1 {
+		t.Errorf("invalid batches written: %d in A, %d in A-dead-letter", len(batches["A"]), len(batches["A-dead-letter"]))
+	}
+}
+
+func TestDestinationOversize(t *testing.T) {
+	RegisterRecordLimit("testdest", 1048576)
+	os.Setenv("TESTDEST_OVERSIZE", "split")
+	defer os.Unsetenv("TESTDEST_OVERSIZE")
+
+	if o, err := DestinationOversize("testdest", "DL"); err != nil || o.Policy != SplitOversize || o.Limit != 1048576 {
+		t.Errorf("invalid oversize policy: %+v (%v)", o, err)
+	}
+
+	os.Setenv("TESTDEST_MAX_RECORD_SIZE", "1000")
+	defer os.Unsetenv("TESTDEST_MAX_RECORD_SIZE")
+
+	if o, err := DestinationOversize("testdest", "DL"); err != nil || o.Limit != 1000 {
+		t.Errorf("the limit should be overridden: %+v (%v)", o, err)
+	}
+
+	os.Setenv("OTHERDEST_OVERSIZE", "truncate")
+	defer os.Unsetenv("OTHERDEST_OVERSIZE")
+
+	if _, err := DestinationOversize("otherdest", "DL"); err == nil {
+		t.Error("expected an error for a destination without a known limit")
+	}
+
+	if _, err := ParseOversizePolicy("drop"); err == nil {
+		t.Error("parsing an unknown oversize policy should fail")
+	}
+}
+
+func TestSplitStringRunes(t *testing.T) {
+	s := strings.Repeat("héllo wörld 日本語", 10)
+
+	for n := utf8.UTFMax; n != 40; n++ {
+		chunks := SplitString(s, n)
+
+		for _, chunk := range chunks {
+			if len(chunk) > n {
+				t.Errorf("%d: chunk is too long: %#v", n, chunk)
+			}
+
+			if !utf8.ValidString(chunk) {
+				t.Errorf("%d: chunk was cut in the middle of a rune: %#v", n, chunk)
+			}
+		}
+
+		if strings.Join(chunks, "") != s {
+			t.Errorf("%d: the chunks don't add up to the original string", n)
+		}
+	}
+}
+
+func TestSplitOversizeInvalidUTF8(t *testing.T) {
+	o := Oversize{Policy: SplitOversize, Limit: 400}
+	msg := Message{Group: "A", Stream: "B", Event: ecslogs.Event{Message: "\xff" + strings.Repeat("\x80", 400)}}
+
+	res, _ := o.Apply(MessageBatch{msg})
+
+	if len(res) < 2 {
+		t.Fatalf("the message should be split: %d parts", len(res))
+	}
+
+	var joined string
+
+	for _, part := range res {
+		if size := part.ContentLength(); size > o.Limit {
+			t.Errorf("part of %d bytes over the limit", size)
+		}
+		joined += part.Event.Message
+	}
+
+	if joined != msg.Event.Message {
+		t.Error("the parts don't add up to the original message")
+	}
+}
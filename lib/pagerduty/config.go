@@ -0,0 +1,184 @@
+package pagerduty
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+const defaultURL = "https://events.pagerduty.com/v2/enqueue"
+
+// The format of the events, reported in the schema version header.
+const schemaVersion = "pagerduty-events.v2"
+
+// config carries the settings of the pagerduty destination, they are loaded
+// from PAGERDUTY_* environment variables.
+type config struct {
+	// The integration key of the PagerDuty service the events are sent to.
+	routingKey string
+
+	// The Events API v2 endpoint.
+	url string
+
+	// Only messages at this level or more severe trigger incidents.
+	level ecslogs.Level
+
+	// The PagerDuty severity of the events triggered by messages of each
+	// level.
+	severities map[ecslogs.Level]string
+
+	// The maximum number of trigger events sent per minute.
+	rateLimit float64
+
+	// How long an incident stays open without seeing the message that
+	// triggered it, and whether a resolve event is sent once it's over.
+	resolveAfter time.Duration
+	autoResolve  bool
+
+	// The TLS config of the connections to the Events API, nil unless one of
+	// the PAGERDUTY_TLS_* settings is set.
+	tls *tls.Config
+
+	// The checksum set on the requests, disabled by default.
+	checksum lib.BodyChecksum
+
+	// The compression of the events, they're small so it's disabled by
+	// default.
+	compression lib.BodyCompression
+
+	// The Content-Type and schema version of the events.
+	headers lib.ContentHeaders
+
+	err error
+}
+
+var defaultSeverities = map[ecslogs.Level]string{
+	ecslogs.EMERG:  "critical",
+	ecslogs.ALERT:  "critical",
+	ecslogs.CRIT:   "critical",
+	ecslogs.ERROR:  "error",
+	ecslogs.WARN:   "warning",
+	ecslogs.NOTICE: "info",
+	ecslogs.INFO:   "info",
+	ecslogs.DEBUG:  "info",
+}
+
+func getConfig() (c config) {
+	var err error
+	var s string
+
+	c = config{
+		routingKey:   strings.TrimSpace(lib.Getenv("PAGERDUTY_ROUTING_KEY")),
+		url:          strings.TrimSpace(lib.Getenv("PAGERDUTY_URL")),
+		level:        ecslogs.CRIT,
+		severities:   make(map[ecslogs.Level]string, len(defaultSeverities)),
+		rateLimit:    10,
+		resolveAfter: time.Hour,
+	}
+
+	for lvl, severity := range defaultSeverities {
+		c.severities[lvl] = severity
+	}
+
+	if len(c.routingKey) == 0 {
+		c.err = lib.AppendError(c.err, fmt.Errorf("missing PAGERDUTY_ROUTING_KEY environment variable"))
+	}
+
+	if len(c.url) == 0 {
+		c.url = defaultURL
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("PAGERDUTY_LEVEL")); len(s) != 0 {
+		if c.level, err = ecslogs.ParseLevel(strings.ToUpper(s)); err != nil || c.level == ecslogs.NONE {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid PAGERDUTY_LEVEL: %s", s))
+		}
+	}
+
+	if s = lib.Getenv("PAGERDUTY_SEVERITY"); len(s) != 0 {
+		if err = parseSeverities(c.severities, s); err != nil {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid PAGERDUTY_SEVERITY, %s: %s", err, s))
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("PAGERDUTY_RATE_LIMIT")); len(s) != 0 {
+		if c.rateLimit, err = strconv.ParseFloat(s, 64); err != nil || c.rateLimit <= 0 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid PAGERDUTY_RATE_LIMIT, must be a positive number: %s", s))
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("PAGERDUTY_RESOLVE_AFTER")); len(s) != 0 {
+		if c.resolveAfter, err = time.ParseDuration(s); err != nil || c.resolveAfter <= 0 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid PAGERDUTY_RESOLVE_AFTER, must be a positive duration: %s", s))
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("PAGERDUTY_AUTO_RESOLVE")); len(s) != 0 {
+		if c.autoResolve, err = strconv.ParseBool(s); err != nil {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid PAGERDUTY_AUTO_RESOLVE, must be a boolean: %s", s))
+		}
+	}
+
+	if t, err := lib.DestinationTLS("pagerduty"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	} else if t.Enabled() {
+		if c.tls, err = t.Load(); err != nil {
+			c.err = lib.AppendError(c.err, err)
+		}
+	}
+
+	if c.checksum, err = lib.DestinationBodyChecksum("pagerduty"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.compression, err = lib.DestinationBodyCompression("pagerduty", "none"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	// The events have the shape that the Events API expects, they're never
+	// wrapped in an envelope.
+	if c.headers, err = lib.DestinationContentHeaders("pagerduty", "application/json", schemaVersion, lib.Envelope{}); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	return
+}
+
+func (c config) check() error {
+	return c.err
+}
+
+// parseSeverities sets the severities from a comma separated list of
+// LEVEL=severity pairs, for example "ERROR=critical,WARN=error".
+func parseSeverities(severities map[ecslogs.Level]string, s string) error {
+	for _, pair := range strings.Split(s, ",") {
+		var lvl ecslogs.Level
+		var err error
+
+		if pair = strings.TrimSpace(pair); len(pair) == 0 {
+			continue
+		}
+
+		kv := strings.SplitN(pair, "=", 2)
+
+		if len(kv) != 2 {
+			return fmt.Errorf("%s is not a LEVEL=severity pair", pair)
+		}
+
+		if lvl, err = ecslogs.ParseLevel(strings.ToUpper(strings.TrimSpace(kv[0]))); err != nil {
+			return fmt.Errorf("unknown level %s", kv[0])
+		}
+
+		switch severity := strings.ToLower(strings.TrimSpace(kv[1])); severity {
+		case "critical", "error", "warning", "info":
+			severities[lvl] = severity
+		default:
+			return fmt.Errorf("unknown severity %s, must be one of critical, error, warning or info", kv[1])
+		}
+	}
+	return nil
+}
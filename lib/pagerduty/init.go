@@ -0,0 +1,7 @@
+package pagerduty
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterDestination("pagerduty", newDestination(getConfig))
+}
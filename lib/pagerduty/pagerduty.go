@@ -0,0 +1,360 @@
+package pagerduty
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/fingerprint"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// PagerDuty truncates the summaries of events to this length.
+const maxSummaryLength = 1024
+
+// destination triggers PagerDuty incidents from severe log messages. Messages
+// are fingerprinted so that repeated occurrences of the same error coalesce
+// into a single incident, which is only triggered once while it's open.
+type destination struct {
+	lazy   lib.LazyConfig
+	load   func() config
+	config config
+
+	mutex     sync.Mutex
+	incidents map[string]*incident
+
+	// Token bucket limiting the rate of trigger events.
+	tokens float64
+	last   time.Time
+
+	client *http.Client
+	clock  clock.Clock
+}
+
+// incident is an incident that was triggered and that's still considered open.
+type incident struct {
+	seen time.Time
+}
+
+func newDestination(load func() config) *destination {
+	return &destination{
+		load:      load,
+		incidents: make(map[string]*incident),
+		client:    &http.Client{Timeout: 10 * time.Second},
+		clock:     clock.System,
+	}
+}
+
+func (d *destination) Open(group string, stream string) (w lib.Writer, err error) {
+	if err = d.lazy.Init(d.init); err != nil {
+		return
+	}
+
+	w = writer{dest: d}
+	return
+}
+
+// CheckConfig reports the problems with the PAGERDUTY_* settings, which would
+// otherwise only show up when the first incident is triggered.
+func (d *destination) CheckConfig() error {
+	return d.load().check()
+}
+
+func (d *destination) Close(group string, stream string) {}
+
+func (d *destination) init() error {
+	d.config = d.load()
+
+	if d.config.tls != nil {
+		d.client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: d.config.tls,
+		}
+	}
+	d.tokens = burst(d.config.rateLimit)
+	d.last = d.clock.Now()
+
+	if err := d.config.check(); err != nil {
+		return err
+	}
+
+	go d.run()
+	return nil
+}
+
+// run periodically closes the incidents that weren't seen for the configured
+// period, resolving them in PagerDuty if enabled.
+func (d *destination) run() {
+	interval := d.config.resolveAfter / 10
+
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	timer := d.clock.NewTimer(interval)
+
+	for range timer.C() {
+		if err := d.expire(d.clock.Now()); err != nil {
+			log.WithError(err).Error("failed to resolve pagerduty incidents")
+		}
+		timer.Reset(interval)
+	}
+}
+
+func (d *destination) expire(now time.Time) (err error) {
+	var expired []string
+
+	d.mutex.Lock()
+
+	for key, inc := range d.incidents {
+		if now.Sub(inc.seen) >= d.config.resolveAfter {
+			expired = append(expired, key)
+			delete(d.incidents, key)
+		}
+	}
+
+	d.mutex.Unlock()
+
+	if !d.config.autoResolve {
+		return
+	}
+
+	for _, key := range expired {
+		if e := d.send(event{
+			RoutingKey:  d.config.routingKey,
+			EventAction: "resolve",
+			DedupKey:    key,
+		}); e != nil {
+			err = lib.AppendError(err, e)
+		}
+	}
+
+	return
+}
+
+func (d *destination) match(msg lib.Message) bool {
+	return msg.Event.Level != ecslogs.NONE && msg.Event.Level <= d.config.level
+}
+
+// trigger opens an incident for msg unless one is already open for the same
+// fingerprint. It returns false without error when the trigger was dropped
+// because of the rate limit.
+func (d *destination) trigger(msg lib.Message) (ok bool, err error) {
+	template := fingerprint.Apply(fingerprint.DefaultPatterns, msg.Event.Message)
+	key := dedupKey(msg.Group, template)
+	now := d.clock.Now()
+
+	d.mutex.Lock()
+
+	if inc := d.incidents[key]; inc != nil {
+		inc.seen = now
+		d.mutex.Unlock()
+		return true, nil
+	}
+
+	if !d.allow(now) {
+		d.mutex.Unlock()
+		return false, nil
+	}
+
+	inc := &incident{seen: now}
+	d.incidents[key] = inc
+	d.mutex.Unlock()
+
+	if err = d.send(d.makeTriggerEvent(msg, key, template)); err != nil {
+		// Forget the incident so the next occurrence of the message tries
+		// again.
+		d.mutex.Lock()
+		if d.incidents[key] == inc {
+			delete(d.incidents, key)
+		}
+		d.mutex.Unlock()
+		return
+	}
+
+	return true, nil
+}
+
+// allow takes a token from the bucket, it must be called with the mutex held.
+func (d *destination) allow(now time.Time) bool {
+	if elapsed := now.Sub(d.last); elapsed > 0 {
+		d.tokens += elapsed.Minutes() * d.config.rateLimit
+	}
+
+	if max := burst(d.config.rateLimit); d.tokens > max {
+		d.tokens = max
+	}
+
+	d.last = now
+
+	if d.tokens < 1 {
+		return false
+	}
+
+	d.tokens--
+	return true
+}
+
+func burst(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+// dedupKey returns the PagerDuty deduplication key of messages of group with
+// the given fingerprint. The stream isn't part of the key so the same error
+// reported by multiple containers of a service opens a single incident.
+func dedupKey(group string, template string) string {
+	sum := sha1.Sum([]byte(group + "\n" + template))
+	return "ecs-logs-" + hex.EncodeToString(sum[:])
+}
+
+func (d *destination) makeTriggerEvent(msg lib.Message, key string, template string) event {
+	source := msg.Event.Info.Host
+
+	if len(source) == 0 {
+		source = msg.Stream
+	}
+
+	details := map[string]interface{}{
+		"group":       msg.Group,
+		"stream":      msg.Stream,
+		"level":       msg.Event.Level.String(),
+		"fingerprint": template,
+	}
+
+	if len(msg.Event.Data) != 0 {
+		details["data"] = msg.Event.Data
+	}
+
+	return event{
+		RoutingKey:  d.config.routingKey,
+		EventAction: "trigger",
+		DedupKey:    key,
+		Payload: &payload{
+			Summary:       truncate(msg.Event.Message, maxSummaryLength),
+			Source:        source,
+			Severity:      d.config.severities[msg.Event.Level],
+			Timestamp:     msg.Event.Time.UTC().Format(time.RFC3339Nano),
+			Component:     msg.Group,
+			CustomDetails: details,
+		},
+	}
+}
+
+func (d *destination) send(e event) (err error) {
+	var b []byte
+	var req *http.Request
+	var res *http.Response
+
+	if b, err = json.Marshal(e); err != nil {
+		return
+	}
+
+	if b, err = d.config.compression.Compress(b); err != nil {
+		return
+	}
+
+	if req, err = http.NewRequest("POST", d.config.url, bytes.NewReader(b)); err != nil {
+		return
+	}
+
+	d.config.headers.Set(req)
+	d.config.compression.Set(req)
+	d.config.checksum.Sign(req, b)
+
+	if res, err = d.client.Do(req); err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	// The event was accepted anyway, the mismatch is reported so corruption
+	// on the way to PagerDuty doesn't go unnoticed.
+	if cerr := d.config.checksum.Verify(res, b); cerr != nil {
+		metrics.Default.Counter("checksum_mismatches", "destination", "pagerduty").Add(1)
+		log.WithError(cerr).Warn("pagerduty received a corrupted event")
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(&io.LimitedReader{R: res.Body, N: 1024})
+		err = fmt.Errorf("pagerduty responded to the %s event with %s: %s", e.EventAction, res.Status, bytes.TrimSpace(body))
+	}
+
+	return
+}
+
+// event is the body of requests to the PagerDuty Events API v2.
+type event struct {
+	RoutingKey  string   `json:"routing_key"`
+	EventAction string   `json:"event_action"`
+	DedupKey    string   `json:"dedup_key"`
+	Payload     *payload `json:"payload,omitempty"`
+}
+
+type payload struct {
+	Summary       string      `json:"summary"`
+	Source        string      `json:"source"`
+	Severity      string      `json:"severity"`
+	Timestamp     string      `json:"timestamp,omitempty"`
+	Component     string      `json:"component,omitempty"`
+	CustomDetails interface{} `json:"custom_details,omitempty"`
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
+
+type writer struct {
+	dest *destination
+}
+
+func (w writer) Close() error {
+	return nil
+}
+
+func (w writer) WriteMessage(msg lib.Message) error {
+	return w.WriteMessageBatch(lib.MessageBatch{msg})
+}
+
+func (w writer) WriteMessageBatch(batch lib.MessageBatch) (err error) {
+	var dropped int
+
+	for _, msg := range batch {
+		if !w.dest.match(msg) {
+			continue
+		}
+
+		if ok, e := w.dest.trigger(msg); e != nil {
+			err = lib.AppendError(err, e)
+		} else if !ok {
+			dropped++
+		}
+	}
+
+	if dropped != 0 {
+		err = lib.AppendError(err, fmt.Errorf("%d pagerduty incidents were not triggered because of the rate limit", dropped))
+	}
+
+	return
+}
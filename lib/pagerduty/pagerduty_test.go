@@ -0,0 +1,294 @@
+package pagerduty
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+)
+
+var epoch = time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC)
+
+func TestWriterLevel(t *testing.T) {
+	d, api := newTestDestination(t, testConfig())
+	defer api.Close()
+
+	write(t, d, lib.MessageBatch{
+		makeMessage("A", ecslogs.ERROR, "error"),
+		makeMessage("A", ecslogs.CRIT, "crit"),
+		makeMessage("A", ecslogs.EMERG, "emerg"),
+		makeMessage("A", ecslogs.NONE, "none"),
+	})
+
+	events := api.events()
+
+	if len(events) != 2 {
+		t.Fatalf("only messages at or above the configured level should trigger incidents: %+v", events)
+	}
+
+	for i, summary := range []string{"crit", "emerg"} {
+		if e := events[i]; e.EventAction != "trigger" || e.Payload.Summary != summary || e.Payload.Severity != "critical" || e.RoutingKey != "R" {
+			t.Errorf("invalid event: %+v", e)
+		}
+	}
+}
+
+func TestDedupKey(t *testing.T) {
+	d, api := newTestDestination(t, testConfig())
+	defer api.Close()
+
+	write(t, d, lib.MessageBatch{
+		makeMessage("A", ecslogs.CRIT, "request 1 failed after 100ms"),
+		makeMessage("A", ecslogs.CRIT, "request 2 failed after 120ms"),
+		makeMessage("B", ecslogs.CRIT, "request 3 failed after 100ms"),
+		makeMessage("A", ecslogs.CRIT, "disk full"),
+	})
+
+	events := api.events()
+
+	if len(events) != 3 {
+		t.Fatalf("messages with the same fingerprint should coalesce: %+v", events)
+	}
+
+	if events[0].DedupKey == events[1].DedupKey || events[0].DedupKey == events[2].DedupKey {
+		t.Errorf("messages of different groups or with different fingerprints should have different dedup keys: %+v", events)
+	}
+
+	if k1, k2 := dedupKey("A", "request <num> failed"), dedupKey("A", "request <num> failed"); k1 != k2 {
+		t.Errorf("dedup keys should be deterministic: %s != %s", k1, k2)
+	}
+}
+
+func TestWriterRateLimit(t *testing.T) {
+	c := testConfig()
+	c.rateLimit = 2
+
+	d, api := newTestDestination(t, c)
+	defer api.Close()
+
+	w, _ := d.Open("A", "B")
+	err := w.WriteMessageBatch(lib.MessageBatch{
+		makeMessage("A", ecslogs.CRIT, "alpha"),
+		makeMessage("A", ecslogs.CRIT, "beta"),
+		makeMessage("A", ecslogs.CRIT, "gamma"),
+		makeMessage("A", ecslogs.CRIT, "delta"),
+	})
+
+	if err == nil {
+		t.Error("dropping triggers because of the rate limit should be reported")
+	}
+
+	if n := len(api.events()); n != 2 {
+		t.Errorf("invalid number of triggers: %d", n)
+	}
+
+	// Two triggers per minute, 30 seconds later one more is allowed.
+	d.clock.(*clock.Fake).Advance(30 * time.Second)
+	w.WriteMessageBatch(lib.MessageBatch{
+		makeMessage("A", ecslogs.CRIT, "gamma"),
+		makeMessage("A", ecslogs.CRIT, "delta"),
+	})
+
+	if events := api.events(); len(events) != 3 || events[2].Payload.Summary != "gamma" {
+		t.Errorf("the dropped triggers should be retried when the messages occur again: %+v", events)
+	}
+}
+
+func TestAutoResolve(t *testing.T) {
+	c := testConfig()
+	c.resolveAfter = 10 * time.Second
+	c.autoResolve = true
+
+	d, api := newTestDestination(t, c)
+	defer api.Close()
+
+	write(t, d, lib.MessageBatch{makeMessage("A", ecslogs.CRIT, "request 1 failed")})
+
+	if err := d.expire(epoch.Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(api.events()); n != 1 {
+		t.Errorf("the incident should still be open: %d", n)
+	}
+
+	if err := d.expire(epoch.Add(15 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	events := api.events()
+
+	if len(events) != 2 || events[1].EventAction != "resolve" || events[1].DedupKey != events[0].DedupKey {
+		t.Fatalf("the incident should have been resolved: %+v", events)
+	}
+
+	write(t, d, lib.MessageBatch{makeMessage("A", ecslogs.CRIT, "request 2 failed")})
+
+	if events = api.events(); len(events) != 3 || events[2].EventAction != "trigger" {
+		t.Errorf("a new incident should be triggered after the previous one was resolved: %+v", events)
+	}
+}
+
+func TestBodyChecksum(t *testing.T) {
+	var mutex sync.Mutex
+	var checked int
+
+	c := testConfig()
+	c.checksum = lib.BodyChecksum{Algorithm: "sha256", Header: "X-Body-SHA256"}
+
+	api := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		sum := sha256.Sum256(body)
+
+		if s := req.Header.Get("X-Body-SHA256"); s != hex.EncodeToString(sum[:]) {
+			t.Errorf("the checksum doesn't match the body: %q", s)
+		}
+
+		mutex.Lock()
+		checked++
+		mutex.Unlock()
+		res.WriteHeader(http.StatusAccepted)
+	}))
+	defer api.Close()
+
+	c.url = api.URL
+	d := newDestination(func() config { return c })
+	d.clock = clock.NewFake(epoch)
+
+	write(t, d, lib.MessageBatch{
+		makeMessage("A", ecslogs.CRIT, "request 1 failed"),
+		makeMessage("A", ecslogs.CRIT, "disk full"),
+	})
+
+	if mutex.Lock(); checked != 2 {
+		t.Errorf("invalid number of events checked: %d", checked)
+	}
+	mutex.Unlock()
+}
+
+func TestContentHeaders(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(map[string]string{
+		"PAGERDUTY_ROUTING_KEY":  "R",
+		"PAGERDUTY_CONTENT_TYPE": "application/vnd.pagerduty+json",
+	})
+
+	c := getConfig()
+	if err := c.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	api := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if s := req.Header.Get("Content-Type"); s != "application/vnd.pagerduty+json" {
+			t.Errorf("invalid content type: %q", s)
+		}
+
+		if s := req.Header.Get("X-Schema-Version"); s != "pagerduty-events.v2" {
+			t.Errorf("invalid schema version: %q", s)
+		}
+
+		res.WriteHeader(http.StatusAccepted)
+	}))
+	defer api.Close()
+
+	c.url = api.URL
+	d := newDestination(func() config { return c })
+	d.clock = clock.NewFake(epoch)
+
+	write(t, d, lib.MessageBatch{makeMessage("A", ecslogs.CRIT, "disk full")})
+}
+
+func TestParseSeverities(t *testing.T) {
+	severities := map[ecslogs.Level]string{}
+
+	if err := parseSeverities(severities, "error=critical, WARN=error"); err != nil {
+		t.Fatal(err)
+	}
+
+	if severities[ecslogs.ERROR] != "critical" || severities[ecslogs.WARN] != "error" {
+		t.Errorf("invalid severities: %v", severities)
+	}
+
+	for _, s := range []string{"ERROR", "LOUD=critical", "ERROR=panic"} {
+		if err := parseSeverities(severities, s); err == nil {
+			t.Errorf("%s: parsing the severities should have failed", s)
+		}
+	}
+}
+
+type mockAPI struct {
+	*httptest.Server
+	mutex sync.Mutex
+	list  []event
+}
+
+func (api *mockAPI) events() []event {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	return append([]event(nil), api.list...)
+}
+
+func newTestDestination(t *testing.T, c config) (*destination, *mockAPI) {
+	api := &mockAPI{}
+	api.Server = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		var e event
+
+		if err := json.NewDecoder(req.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+
+		api.mutex.Lock()
+		api.list = append(api.list, e)
+		api.mutex.Unlock()
+		res.WriteHeader(http.StatusAccepted)
+	}))
+
+	c.url = api.URL
+	d := newDestination(func() config { return c })
+	d.clock = clock.NewFake(epoch)
+	return d, api
+}
+
+func testConfig() config {
+	return config{
+		routingKey:   "R",
+		level:        ecslogs.CRIT,
+		severities:   defaultSeverities,
+		rateLimit:    10,
+		resolveAfter: time.Hour,
+		headers:      lib.ContentHeaders{ContentType: "application/json"},
+	}
+}
+
+func write(t *testing.T, d *destination, batch lib.MessageBatch) {
+	w, err := d.Open("A", "B")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteMessageBatch(batch); err != nil {
+		t.Error(err)
+	}
+}
+
+func makeMessage(group string, level ecslogs.Level, s string) lib.Message {
+	return lib.Message{
+		Group:  group,
+		Stream: "B",
+		Event: ecslogs.Event{
+			Level:   level,
+			Time:    epoch,
+			Message: s,
+		},
+	}
+}
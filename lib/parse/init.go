@@ -0,0 +1,14 @@
+package parse
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterStage("parse", lib.NewCheckedStage(lib.StageFunc(NewProcessor), checkConfig))
+
+	// The lines are parsed once multiline joined them, and the fields they
+	// carry are typed, redacted and validated like the other ones.
+	lib.RegisterStageOrder("parse", lib.StageOrder{
+		After:  []string{"multiline"},
+		Before: []string{"coerce", "redact", "schema", "validate"},
+	})
+}
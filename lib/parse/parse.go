@@ -0,0 +1,162 @@
+// Package parse implements the parse stage, which turns the plain text
+// messages read from sources like stdin or journald into structured events
+// with the parsers of ecs-logs, selected per group.
+package parse
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+const defaultFormats = "*=detect"
+
+type format struct {
+	// The glob pattern of the groups, and the parser of their messages.
+	pattern string
+	parser  lib.Parser
+}
+
+type config struct {
+	formats []format
+}
+
+func getConfig() (c config, err error) {
+	s := strings.TrimSpace(lib.Getenv("PARSE_FORMATS"))
+
+	if len(s) == 0 {
+		s = defaultFormats
+	}
+
+	if c.formats, err = parseFormats(s); err != nil {
+		err = fmt.Errorf("invalid PARSE_FORMATS, %s", err)
+	}
+
+	return
+}
+
+// parseFormats parses a comma separated list of pattern=parser pairs, a parser
+// name alone applies to all the groups.
+func parseFormats(s string) (formats []format, err error) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+
+		f := format{pattern: "*"}
+		name := item
+
+		if i := strings.LastIndexByte(item, '='); i >= 0 {
+			f.pattern, name = strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+		}
+
+		if _, e := path.Match(f.pattern, ""); e != nil || len(f.pattern) == 0 {
+			err = fmt.Errorf("bad pattern: %s", item)
+			return
+		}
+
+		if f.parser = lib.GetParser(name); f.parser == nil {
+			err = fmt.Errorf("unknown parser %q, must be one of %s", name, strings.Join(lib.ParsersAvailable(), ", "))
+			return
+		}
+
+		formats = append(formats, f)
+	}
+
+	if len(formats) == 0 {
+		err = fmt.Errorf("no formats were declared")
+	}
+
+	return
+}
+
+func NewProcessor() (p lib.Processor, err error) {
+	var c config
+
+	if c, err = getConfig(); err == nil {
+		p = newProcessor(c, metrics.Default)
+	}
+
+	return
+}
+
+func checkConfig() (err error) {
+	_, err = getConfig()
+	return
+}
+
+type processor struct {
+	config
+	unparsed *metrics.Counter
+}
+
+func newProcessor(c config, registry *metrics.Registry) *processor {
+	return &processor{
+		config:   c,
+		unparsed: registry.Counter("unparsed_messages", "stage", "parse"),
+	}
+}
+
+// Process parses the message of msg with the parser of its group, the first
+// format whose pattern matches it. The parsed message, level and time replace
+// the ones of the event when they're set, and the parsed fields are added to
+// its data without overwriting the fields set by the source. Messages that
+// fail to parse are forwarded unchanged.
+func (p *processor) Process(msg lib.Message, now time.Time) []lib.Message {
+	parser := p.parser(msg.Group)
+
+	if parser == nil || len(msg.Event.Message) == 0 {
+		return []lib.Message{msg}
+	}
+
+	res, err := parser.Parse([]byte(msg.Event.Message))
+
+	if err != nil {
+		p.unparsed.Add(1)
+		return []lib.Message{msg}
+	}
+
+	msg.Event.Message = res.Event.Message
+
+	if res.Event.Level != ecslogs.NONE {
+		msg.Event.Level = res.Event.Level
+	}
+
+	if !res.Event.Time.IsZero() {
+		msg.Event.Time = res.Event.Time
+	}
+
+	if len(res.Event.Data) != 0 {
+		data := make(ecslogs.EventData, len(msg.Event.Data)+len(res.Event.Data))
+
+		for k, v := range res.Event.Data {
+			data[k] = v
+		}
+
+		for k, v := range msg.Event.Data {
+			data[k] = v
+		}
+
+		msg.Event.Data = data
+	}
+
+	return []lib.Message{msg}
+}
+
+func (p *processor) Flush(now time.Time) []lib.Message {
+	return nil
+}
+
+func (p *processor) parser(group string) lib.Parser {
+	for _, f := range p.formats {
+		if ok, _ := path.Match(f.pattern, group); ok {
+			return f.parser
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package parse
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+func newTestProcessor(t *testing.T, formats string) (*processor, *metrics.Registry) {
+	f, err := parseFormats(formats)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := metrics.NewRegistry()
+	return newProcessor(config{formats: f}, r), r
+}
+
+func makeMessage(group string, message string, data ecslogs.EventData) lib.Message {
+	return lib.Message{
+		Group:  group,
+		Stream: "B",
+		Event: ecslogs.Event{
+			Time:    time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC),
+			Message: message,
+			Data:    data,
+		},
+	}
+}
+
+func TestProcessorFormats(t *testing.T) {
+	p, r := newTestProcessor(t, "nginx*=combined, api=logfmt, journald=detect")
+
+	tests := []struct {
+		msg      lib.Message
+		expected ecslogs.Event
+	}{
+		{
+			msg: makeMessage("nginx-edge", `10.0.0.1 - - [14/Oct/2026:08:00:00 +0000] "GET / HTTP/1.1" 200 12`, nil),
+			expected: ecslogs.Event{
+				Level:   ecslogs.INFO,
+				Time:    time.Date(2026, 10, 14, 8, 0, 0, 0, time.UTC),
+				Message: "GET / HTTP/1.1",
+				Data: ecslogs.EventData{
+					"remote_addr": "10.0.0.1",
+					"method":      "GET",
+					"path":        "/",
+					"protocol":    "HTTP/1.1",
+					"status":      int64(200),
+					"bytes":       int64(12),
+				},
+			},
+		},
+		{
+			// The fields set by the source take precedence, and the time of
+			// the message is kept when the line has none.
+			msg: makeMessage("api", `level=warn msg="slow request" host=parsed`, ecslogs.EventData{"host": "source"}),
+			expected: ecslogs.Event{
+				Level:   ecslogs.WARN,
+				Time:    time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC),
+				Message: "slow request",
+				Data:    ecslogs.EventData{"host": "source"},
+			},
+		},
+		{
+			// Groups without a format are left unchanged.
+			msg: makeMessage("other", "level=warn msg=unchanged", nil),
+			expected: ecslogs.Event{
+				Time:    time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC),
+				Message: "level=warn msg=unchanged",
+			},
+		},
+		{
+			msg: makeMessage("journald", "just some text", nil),
+			expected: ecslogs.Event{
+				Time:    time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC),
+				Message: "just some text",
+			},
+		},
+		{
+			// Lines that fail to parse are forwarded unchanged.
+			msg: makeMessage("api", "just some text", ecslogs.EventData{"host": "source"}),
+			expected: ecslogs.Event{
+				Time:    time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC),
+				Message: "just some text",
+				Data:    ecslogs.EventData{"host": "source"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		msgs := p.Process(test.msg, time.Now())
+
+		if len(msgs) != 1 {
+			t.Errorf("%s: the message should be kept: %+v", test.msg.Group, msgs)
+			continue
+		}
+
+		event := msgs[0].Event
+
+		if !event.Time.Equal(test.expected.Time) {
+			t.Errorf("%s: invalid time: %s", test.msg.Group, event.Time)
+		}
+
+		event.Time = test.expected.Time
+
+		if !reflect.DeepEqual(event, test.expected) {
+			t.Errorf("%s: invalid event:\n- expected: %#v\n- found:    %#v", test.msg.Group, test.expected, event)
+		}
+	}
+
+	if n := r.Counter("unparsed_messages", "stage", "parse").Value(); n != 1 {
+		t.Errorf("invalid count of unparsed messages: %d", n)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(nil)
+
+	if c, err := getConfig(); err != nil || len(c.formats) != 1 || c.formats[0].pattern != "*" {
+		t.Errorf("invalid default config: %+v (%v)", c, err)
+	}
+
+	lib.SetConfigEnv(map[string]string{"PARSE_FORMATS": "glog"})
+
+	if c, err := getConfig(); err != nil || len(c.formats) != 1 || c.formats[0].pattern != "*" {
+		t.Errorf("a parser alone should apply to all the groups: %+v (%v)", c, err)
+	}
+
+	for _, formats := range []string{
+		"nginx=apache",
+		"[nginx=combined",
+		"=combined",
+		",",
+	} {
+		lib.SetConfigEnv(map[string]string{"PARSE_FORMATS": formats})
+
+		if err := checkConfig(); err == nil {
+			t.Errorf("%q: the configuration should be rejected", formats)
+		}
+	}
+}
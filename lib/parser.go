@@ -0,0 +1,338 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+)
+
+// A Parser turns the raw content of log lines into messages. Sources that read
+// unstructured content let operators choose the parser that matches the format
+// of their applications with the <SOURCE>_PARSER environment variable, for
+// example STDIN_PARSER=logfmt.
+//
+// Parsers usually only fill the event of the messages they return, the sources
+// set the group and stream when they know them.
+type Parser interface {
+	Parse(raw []byte) (Message, error)
+}
+
+type ParserFunc func(raw []byte) (Message, error)
+
+func (f ParserFunc) Parse(raw []byte) (Message, error) {
+	return f(raw)
+}
+
+func RegisterParser(name string, parser Parser) {
+	prsmtx.Lock()
+	prsmap[name] = parser
+	prsmtx.Unlock()
+}
+
+func DeregisterParser(name string) {
+	prsmtx.Lock()
+	delete(prsmap, name)
+	prsmtx.Unlock()
+}
+
+func GetParser(name string) (parser Parser) {
+	prsmtx.RLock()
+	parser = prsmap[name]
+	prsmtx.RUnlock()
+	return
+}
+
+func ParsersAvailable() (parsers []string) {
+	prsmtx.RLock()
+	parsers = make([]string, 0, len(prsmap))
+
+	for name := range prsmap {
+		parsers = append(parsers, name)
+	}
+
+	prsmtx.RUnlock()
+	sort.Strings(parsers)
+	return
+}
+
+// SourceParser returns the parser configured for source by the
+// <SOURCE>_PARSER environment variable, or nil if it isn't set.
+//
+// The auto parser hands the lines that aren't JSON to the parser named by
+// <SOURCE>_PLAIN_PARSER, raw by default.
+//
+// When <SOURCE>_RAW_FIELD is set as well the messages that were parsed carry
+// the original line in the data field of that name.
+func SourceParser(source string) (parser Parser, err error) {
+	prefix := strings.ToUpper(source) + "_"
+	name := strings.TrimSpace(Getenv(prefix + "PARSER"))
+
+	if len(name) == 0 {
+		return
+	}
+
+	if parser = GetParser(name); parser == nil {
+		err = fmt.Errorf("invalid %sPARSER, must be one of %s: %s", prefix, strings.Join(ParsersAvailable(), ", "), name)
+		return
+	}
+
+	if auto, ok := parser.(autoParser); ok {
+		if plain := strings.TrimSpace(Getenv(prefix + "PLAIN_PARSER")); len(plain) != 0 {
+			if auto.plain = GetParser(plain); auto.plain == nil || isAuto(auto.plain) {
+				err = fmt.Errorf("invalid %sPLAIN_PARSER, must be one of %s: %s", prefix, strings.Join(plainParsers(), ", "), plain)
+				return
+			}
+			parser = auto
+		}
+	}
+
+	if field := strings.TrimSpace(Getenv(prefix + "RAW_FIELD")); len(field) != 0 {
+		parser = rawFieldParser{Parser: parser, field: field}
+	}
+
+	return
+}
+
+// rawFieldParser keeps the raw content of the lines that parser parsed in a
+// data field, lines that fail to parse already carry it as their message.
+type rawFieldParser struct {
+	Parser
+	field string
+}
+
+func (p rawFieldParser) Parse(raw []byte) (msg Message, err error) {
+	if msg, err = p.Parser.Parse(raw); err == nil {
+		data := make(ecslogs.EventData, len(msg.Event.Data)+1)
+
+		for k, v := range msg.Event.Data {
+			data[k] = v
+		}
+
+		data[p.field] = string(raw)
+		msg.Event.Data = data
+	}
+	return
+}
+
+// autoParser detects the format of each line, so a source can carry both JSON
+// events and plain text, like a container printing a banner before switching
+// to JSON logging.
+type autoParser struct {
+	json  Parser
+	plain Parser
+}
+
+func (p autoParser) Parse(raw []byte) (Message, error) {
+	// Looking at the first byte is enough to rule out most plain lines, the
+	// ones that only look like JSON fail to decode and are plain text too.
+	if line := bytes.TrimLeft(raw, " \t"); len(line) != 0 && line[0] == '{' {
+		if msg, err := p.json.Parse(raw); err == nil {
+			return msg, nil
+		}
+	}
+	return p.plain.Parse(raw)
+}
+
+func isAuto(parser Parser) bool {
+	_, ok := parser.(autoParser)
+	return ok
+}
+
+// plainParsers returns the names of the parsers that can handle the plain
+// lines of the auto parser.
+func plainParsers() (parsers []string) {
+	for _, name := range ParsersAvailable() {
+		if !isAuto(GetParser(name)) {
+			parsers = append(parsers, name)
+		}
+	}
+	return
+}
+
+// ParseMessage parses raw with parser, when it fails a warning is logged and
+// the raw content is returned as the message of the event so nothing is lost.
+func ParseMessage(parser Parser, raw []byte) Message {
+	msg, err := parser.Parse(raw)
+
+	if err != nil {
+		log.WithError(err).Warn("failed to parse log message, forwarding it unchanged")
+		msg, _ = parseRaw(raw)
+	}
+
+	if atomic.LoadInt32(&rawLines) != 0 {
+		msg.setRaw(raw)
+	}
+
+	return msg
+}
+
+// NewParserReader returns a reader which parses each line read from r with
+// parser.
+func NewParserReader(r io.Reader, parser Parser) Reader {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+	return parserReader{s: s, r: r, parser: parser}
+}
+
+type parserReader struct {
+	s      *bufio.Scanner
+	r      io.Reader
+	parser Parser
+}
+
+func (p parserReader) Close() (err error) {
+	if c, ok := p.r.(io.Closer); ok {
+		err = c.Close()
+	}
+	return
+}
+
+func (p parserReader) ReadMessage() (msg Message, err error) {
+	for p.s.Scan() {
+		if line := bytes.TrimRight(p.s.Bytes(), "\r"); len(bytes.TrimSpace(line)) != 0 {
+			msg = ParseMessage(p.parser, line)
+			return
+		}
+	}
+
+	if err = p.s.Err(); err == nil {
+		err = io.EOF
+	}
+
+	return
+}
+
+func parseRaw(raw []byte) (msg Message, err error) {
+	msg.Event.Message = string(raw)
+	return
+}
+
+// parseJSON parses events with the JSON structure described in the README.
+func parseJSON(raw []byte) (msg Message, err error) {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+
+	if err = d.Decode(&msg.Event); err != nil {
+		err = fmt.Errorf("invalid JSON event: %s", err)
+	}
+
+	return
+}
+
+// parseLogfmt parses lines of key=value pairs, values may be quoted. The level,
+// msg (or message) and time (or ts) keys set the matching fields of the event,
+// the other ones are added to the event data.
+func parseLogfmt(raw []byte) (msg Message, err error) {
+	var pairs int
+	var data = ecslogs.EventData{}
+	var s = string(raw)
+
+	for {
+		var key string
+		var val string
+
+		if s = strings.TrimLeft(s, " \t"); len(s) == 0 {
+			break
+		}
+
+		i := strings.IndexAny(s, "= \t")
+
+		if i < 0 {
+			i = len(s)
+		}
+
+		if key, s = s[:i], s[i:]; len(key) == 0 {
+			err = fmt.Errorf("invalid logfmt, missing key before '='")
+			return
+		}
+
+		if strings.HasPrefix(s, "=") {
+			if val, s, err = logfmtValue(s[1:]); err != nil {
+				return
+			}
+			pairs++
+		}
+
+		switch key {
+		case "level", "lvl":
+			if msg.Event.Level, err = ecslogs.ParseLevel(strings.ToUpper(val)); err != nil {
+				err = fmt.Errorf("invalid logfmt level: %s", val)
+				return
+			}
+		case "msg", "message":
+			msg.Event.Message = val
+		case "time", "ts":
+			if msg.Event.Time, err = time.Parse(time.RFC3339Nano, val); err != nil {
+				err = fmt.Errorf("invalid logfmt time: %s", val)
+				return
+			}
+		default:
+			data[key] = val
+		}
+	}
+
+	// Every line of plain text is a valid list of keys without values, those
+	// aren't considered logfmt.
+	if pairs == 0 {
+		err = fmt.Errorf("invalid logfmt, no key=value pairs found")
+		return
+	}
+
+	if len(data) != 0 {
+		msg.Event.Data = data
+	}
+
+	return
+}
+
+func logfmtValue(s string) (val string, rest string, err error) {
+	if !strings.HasPrefix(s, `"`) {
+		i := strings.IndexAny(s, " \t")
+
+		if i < 0 {
+			i = len(s)
+		}
+
+		return s[:i], s[i:], nil
+	}
+
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			if val, err = strconv.Unquote(s[:i+1]); err != nil {
+				err = fmt.Errorf("invalid logfmt quoted value: %s", s[:i+1])
+			}
+			rest = s[i+1:]
+			return
+		}
+	}
+
+	err = fmt.Errorf("invalid logfmt, unterminated quoted value: %s", s)
+	return
+}
+
+var (
+	prsmtx sync.RWMutex
+	prsmap = map[string]Parser{
+		"raw":      ParserFunc(parseRaw),
+		"json":     ParserFunc(parseJSON),
+		"logfmt":   ParserFunc(parseLogfmt),
+		"combined": ParserFunc(parseCombined),
+		"glog":     ParserFunc(parseGlog),
+		"detect":   detectParser{},
+		"auto":     autoParser{json: ParserFunc(parseJSON), plain: ParserFunc(parseRaw)},
+	}
+)
@@ -0,0 +1,268 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+)
+
+// captureWarnings sets a log handler counting the warnings until the returned
+// function is called, which returns the count.
+func captureWarnings() func() int {
+	warnings := 0
+	log.SetHandler(log.HandlerFunc(func(e *log.Entry) error {
+		if e.Level == log.WarnLevel {
+			warnings++
+		}
+		return nil
+	}))
+	return func() int {
+		log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+		return warnings
+	}
+}
+
+var upperParser = ParserFunc(func(raw []byte) (msg Message, err error) {
+	if len(raw) == 0 || raw[0] == '!' {
+		err = errors.New("unexpected content")
+		return
+	}
+	msg.Event.Message = strings.ToUpper(string(raw))
+	return
+})
+
+func TestRegisterParser(t *testing.T) {
+	RegisterParser("upper", upperParser)
+
+	if GetParser("upper") == nil {
+		t.Error("the registered parser was not found")
+	}
+
+	if names := ParsersAvailable(); !reflect.DeepEqual(names, []string{"auto", "combined", "detect", "glog", "json", "logfmt", "raw", "upper"}) {
+		t.Errorf("invalid list of available parsers: %v", names)
+	}
+
+	DeregisterParser("upper")
+
+	if GetParser("upper") != nil {
+		t.Error("the parser should not be found after being deregistered")
+	}
+}
+
+func TestSourceParser(t *testing.T) {
+	RegisterParser("upper", upperParser)
+	defer DeregisterParser("upper")
+	defer SetConfigEnv(nil)
+
+	SetConfigEnv(map[string]string{"TEST_PARSER": "upper"})
+
+	if p, err := SourceParser("test"); err != nil {
+		t.Error(err)
+	} else if msg, _ := p.Parse([]byte("hello")); msg.Event.Message != "HELLO" {
+		t.Errorf("the parser selected by name was not used: %#v", msg.Event.Message)
+	}
+
+	SetConfigEnv(map[string]string{"TEST_PARSER": "nginx"})
+
+	if _, err := SourceParser("test"); err == nil {
+		t.Error("unknown parsers should be rejected")
+	}
+
+	SetConfigEnv(map[string]string{"TEST_PARSER": ""})
+
+	if p, err := SourceParser("test"); p != nil || err != nil {
+		t.Errorf("no parser should be returned when the variable isn't set: %v, %v", p, err)
+	}
+}
+
+func TestSourceParserRawField(t *testing.T) {
+	defer SetConfigEnv(nil)
+
+	tests := []struct {
+		parser string
+		line   string
+	}{
+		{"json", `{"level":"INFO","message":"hello","data":{"user":"bob"}}`},
+		{"logfmt", `level=info msg=hello user=bob`},
+	}
+
+	for _, test := range tests {
+		for _, field := range []string{"", "_raw"} {
+			SetConfigEnv(map[string]string{"TEST_PARSER": test.parser, "TEST_RAW_FIELD": field})
+
+			p, err := SourceParser("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			msg := ParseMessage(p, []byte(test.line))
+			raw, found := msg.Event.Data["_raw"]
+
+			if msg.Event.Message != "hello" || msg.Event.Data["user"] != "bob" {
+				t.Errorf("%s, %q: invalid message: %s", test.parser, field, msg)
+			}
+
+			if field == "" && found {
+				t.Errorf("%s: the raw field shouldn't be set when disabled: %v", test.parser, raw)
+			}
+
+			if field != "" && raw != test.line {
+				t.Errorf("%s: invalid raw field: %#v", test.parser, raw)
+			}
+		}
+	}
+
+	// Lines that fail to parse are forwarded as their message.
+	SetConfigEnv(map[string]string{"TEST_PARSER": "logfmt", "TEST_RAW_FIELD": "_raw"})
+	p, _ := SourceParser("test")
+	warnings := captureWarnings()
+
+	if msg := ParseMessage(p, []byte("not logfmt")); msg.Event.Message != "not logfmt" || msg.Event.Data["_raw"] != nil {
+		t.Errorf("invalid message of a line that failed to parse: %s", msg)
+	}
+
+	warnings()
+}
+
+func TestParserReader(t *testing.T) {
+	warnings := captureWarnings()
+	r := NewParserReader(strings.NewReader("hello\n!oops\r\n\nworld"), upperParser)
+
+	for _, expected := range []string{"HELLO", "!oops", "WORLD"} {
+		msg, err := r.ReadMessage()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Event.Message != expected {
+			t.Errorf("invalid message: %#v != %#v", msg.Event.Message, expected)
+		}
+	}
+
+	if _, err := r.ReadMessage(); err != io.EOF {
+		t.Errorf("invalid error at the end of the input: %v", err)
+	}
+
+	if n := warnings(); n != 1 {
+		t.Errorf("a warning should be logged for the line that failed to parse, found %d", n)
+	}
+}
+
+func TestParseLogfmt(t *testing.T) {
+	msg, err := parseLogfmt([]byte(`time=2016-10-12T01:02:03Z level=error msg="request failed: \"timeout\"" status=503 cached`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ecslogs.Event{
+		Level:   ecslogs.ERROR,
+		Time:    time.Date(2016, 10, 12, 1, 2, 3, 0, time.UTC),
+		Message: `request failed: "timeout"`,
+		Data:    ecslogs.EventData{"status": "503", "cached": ""},
+	}
+
+	if !reflect.DeepEqual(msg.Event, expected) {
+		t.Errorf("invalid event:\n- expected: %#v\n- found:    %#v", expected, msg.Event)
+	}
+
+	for _, raw := range []string{
+		"just some text",
+		`msg="unterminated`,
+		"=value",
+	} {
+		if _, err := parseLogfmt([]byte(raw)); err == nil {
+			t.Errorf("%#v should not be parsed as logfmt", raw)
+		}
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	defer captureWarnings()()
+	msg := ParseMessage(GetParser("json"), []byte(`{"level":"INFO","message":"hello"}`))
+
+	if msg.Event.Level != ecslogs.INFO || msg.Event.Message != "hello" {
+		t.Errorf("invalid event: %#v", msg.Event)
+	}
+
+	if msg = ParseMessage(GetParser("json"), []byte("hello")); msg.Event.Message != "hello" {
+		t.Errorf("content that fails to parse should be forwarded as a raw message: %#v", msg.Event)
+	}
+}
+
+func TestAutoParser(t *testing.T) {
+	defer SetConfigEnv(nil)
+	defer captureWarnings()()
+
+	input := strings.Join([]string{
+		"Starting server v1.2.3",
+		`{"level":"INFO","message":"listening","data":{"port":8080}}`,
+		"  {not json}",
+		"level=warn msg=reloading",
+		`  {"level":"ERROR","message":"failed"}`,
+	}, "\n")
+
+	tests := []struct {
+		plain    string
+		expected []ecslogs.Event
+	}{
+		{
+			plain: "",
+			expected: []ecslogs.Event{
+				{Message: "Starting server v1.2.3"},
+				{Level: ecslogs.INFO, Message: "listening", Data: ecslogs.EventData{"port": json.Number("8080")}},
+				{Message: "  {not json}"},
+				{Message: "level=warn msg=reloading"},
+				{Level: ecslogs.ERROR, Message: "failed"},
+			},
+		},
+		{
+			plain: "logfmt",
+			expected: []ecslogs.Event{
+				{Message: "Starting server v1.2.3"},
+				{Level: ecslogs.INFO, Message: "listening", Data: ecslogs.EventData{"port": json.Number("8080")}},
+				{Message: "  {not json}"},
+				{Level: ecslogs.WARN, Message: "reloading"},
+				{Level: ecslogs.ERROR, Message: "failed"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		SetConfigEnv(map[string]string{"TEST_PARSER": "auto", "TEST_PLAIN_PARSER": test.plain})
+
+		p, err := SourceParser("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := NewParserReader(strings.NewReader(input), p)
+
+		for i, expected := range test.expected {
+			msg, err := r.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(msg.Event, expected) {
+				t.Errorf("%q, line %d: invalid event:\n- expected: %#v\n- found:    %#v", test.plain, i, expected, msg.Event)
+			}
+		}
+	}
+
+	for _, plain := range []string{"auto", "nginx"} {
+		SetConfigEnv(map[string]string{"TEST_PARSER": "auto", "TEST_PLAIN_PARSER": plain})
+
+		if _, err := SourceParser("test"); err == nil {
+			t.Errorf("%s should be rejected as the parser of plain lines", plain)
+		}
+	}
+}
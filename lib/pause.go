@@ -0,0 +1,464 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// OverflowPolicy controls what happens to the batches written to a paused
+// destination once its buffer is full.
+type OverflowPolicy int
+
+const (
+	// DropNewestOverflow rejects the batches that don't fit in the buffer,
+	// they're dropped like batches that failed to be written.
+	DropNewestOverflow OverflowPolicy = iota
+
+	// DropOldestOverflow evicts the oldest buffered batches to make room for
+	// the new ones.
+	DropOldestOverflow
+
+	// BlockOverflow holds the writes until the destination is resumed, the
+	// batches queue up in front of the destination and expire after the
+	// maximum queue age if one is set.
+	BlockOverflow
+)
+
+func ParseOverflowPolicy(s string) (p OverflowPolicy, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "drop-newest":
+		p = DropNewestOverflow
+	case "drop-oldest":
+		p = DropOldestOverflow
+	case "block":
+		p = BlockOverflow
+	default:
+		err = fmt.Errorf("invalid overflow policy, must be one of drop-newest, drop-oldest or block: %s", s)
+	}
+	return
+}
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropOldestOverflow:
+		return "drop-oldest"
+	case BlockOverflow:
+		return "block"
+	default:
+		return "drop-newest"
+	}
+}
+
+// Pause is the configuration of the buffer that holds the batches written to a
+// destination while it's paused.
+type Pause struct {
+	// The maximum number of messages and bytes buffered, a batch is buffered
+	// only if it fits in both.
+	MaxCount int
+	MaxBytes int
+
+	Overflow OverflowPolicy
+}
+
+// DefaultPause is the buffer configuration of the destinations that don't set
+// one.
+var DefaultPause = Pause{
+	MaxCount: 100000,
+	MaxBytes: 100 * 1024 * 1024,
+}
+
+// DestinationPause returns the pause buffer configured for destination by the
+// <DESTINATION>_PAUSE_BUFFER_SIZE, <DESTINATION>_PAUSE_BUFFER_BYTES and
+// <DESTINATION>_PAUSE_OVERFLOW environment variables.
+func DestinationPause(destination string) (p Pause, err error) {
+	prefix := strings.ToUpper(destination) + "_PAUSE_"
+	p = DefaultPause
+
+	for _, v := range []struct {
+		env   string
+		value *int
+	}{
+		{prefix + "BUFFER_SIZE", &p.MaxCount},
+		{prefix + "BUFFER_BYTES", &p.MaxBytes},
+	} {
+		if s := strings.TrimSpace(Getenv(v.env)); len(s) != 0 {
+			if *v.value, err = strconv.Atoi(s); err != nil || *v.value <= 0 {
+				err = fmt.Errorf("invalid %s, must be a positive integer: %s", v.env, s)
+				return
+			}
+		}
+	}
+
+	if p.Overflow, err = ParseOverflowPolicy(Getenv(prefix + "OVERFLOW")); err != nil {
+		err = fmt.Errorf("%sOVERFLOW: %s", prefix, err)
+	}
+
+	return
+}
+
+// PausableDestination is a destination that can be paused during the
+// maintenance of the system it writes to. The batches written while it's
+// paused are buffered, and delivered in order once it's resumed.
+type PausableDestination struct {
+	Destination
+	name   string
+	config Pause
+
+	overflows *metrics.Counter
+
+	mutex    sync.Mutex
+	cond     sync.Cond
+	paused   bool
+	draining bool
+	buffer   []pausedBatch
+	count    int
+	bytes    int
+}
+
+type pausedBatch struct {
+	group  string
+	stream string
+	batch  MessageBatch
+	urgent bool
+	bytes  int
+}
+
+// NewPausableDestination wraps dest so it can be paused, the messages dropped
+// when the buffer overflows are counted in the pause_overflow_messages counter
+// of registry.
+func NewPausableDestination(name string, dest Destination, p Pause, registry *metrics.Registry) *PausableDestination {
+	d := &PausableDestination{
+		Destination: dest,
+		name:        name,
+		config:      p,
+		overflows:   registry.Counter("pause_overflow_messages", "destination", name),
+	}
+	d.cond.L = &d.mutex
+	return d
+}
+
+// Pause stops the delivery of messages to the destination, the writes that
+// were in flight complete but the following ones are buffered.
+func (d *PausableDestination) Pause() {
+	d.mutex.Lock()
+	d.paused = true
+	d.mutex.Unlock()
+}
+
+// Resume restarts the delivery of messages, the buffered batches are written
+// in the background before the new ones.
+func (d *PausableDestination) Resume() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if !d.paused {
+		return
+	}
+
+	d.paused = false
+
+	if len(d.buffer) != 0 && !d.draining {
+		d.draining = true
+		go d.drain()
+	}
+
+	d.cond.Broadcast()
+}
+
+// Paused returns whether the destination is paused.
+func (d *PausableDestination) Paused() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.paused
+}
+
+// Buffered returns the number of messages waiting for the destination to be
+// resumed.
+func (d *PausableDestination) Buffered() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.count
+}
+
+// Wait blocks until the batches buffered before the destination was resumed
+// are delivered, it returns immediately if the destination is paused.
+func (d *PausableDestination) Wait() {
+	d.mutex.Lock()
+	for d.draining {
+		d.cond.Wait()
+	}
+	d.mutex.Unlock()
+}
+
+func (d *PausableDestination) Open(group string, stream string) (Writer, error) {
+	return &pausableWriter{dest: d, group: group, stream: stream}, nil
+}
+
+// write buffers the batch if the destination is paused or still delivering the
+// batches buffered while it was, it returns false if the batch must be written
+// directly instead.
+func (d *PausableDestination) write(group string, stream string, batch MessageBatch, urgent bool) (buffered bool, err error) {
+	b := pausedBatch{group: group, stream: stream, batch: batch, urgent: urgent}
+
+	for _, msg := range batch {
+		b.bytes += msg.ContentLength()
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for {
+		if !d.paused && !d.draining {
+			return false, nil
+		}
+
+		if d.fits(b) || len(d.buffer) == 0 {
+			break
+		}
+
+		switch d.config.Overflow {
+		case DropOldestOverflow:
+			old := d.buffer[0]
+			d.buffer = d.buffer[1:]
+			d.count -= len(old.batch)
+			d.bytes -= old.bytes
+			d.overflow(old.group, old.stream, old.batch)
+
+		case BlockOverflow:
+			d.cond.Wait()
+
+		default:
+			d.overflow(group, stream, batch)
+			return true, fmt.Errorf("the buffer of the paused %s destination is full", d.name)
+		}
+	}
+
+	// The buffer holds the messages until they're delivered, the write is
+	// acknowledged by the caller.
+	RetainBatch(batch)
+	d.buffer = append(d.buffer, b)
+	d.count += len(b.batch)
+	d.bytes += b.bytes
+	return true, nil
+}
+
+func (d *PausableDestination) fits(b pausedBatch) bool {
+	return (d.count+len(b.batch)) <= d.config.MaxCount && (d.bytes+b.bytes) <= d.config.MaxBytes
+}
+
+func (d *PausableDestination) overflow(group string, stream string, batch MessageBatch) {
+	d.overflows.Add(int64(len(batch)))
+
+	log.WithFields(log.Fields{
+		"group":       group,
+		"stream":      stream,
+		"destination": d.name,
+		"count":       len(batch),
+		"overflow":    d.config.Overflow,
+	}).Warn("the buffer of the paused destination is full")
+
+	LogMessages(batch, "dropped", log.Fields{"destination": d.name})
+	RewindBatch(batch)
+}
+
+// drain writes the buffered batches in order until the buffer is empty or the
+// destination is paused again.
+func (d *PausableDestination) drain() {
+	for {
+		d.mutex.Lock()
+
+		if d.paused || len(d.buffer) == 0 {
+			d.draining = false
+			d.cond.Broadcast()
+			d.mutex.Unlock()
+			return
+		}
+
+		b := d.buffer[0]
+		d.buffer = d.buffer[1:]
+		d.count -= len(b.batch)
+		d.bytes -= b.bytes
+		d.cond.Broadcast()
+		d.mutex.Unlock()
+
+		if err := d.deliver(b); err != nil {
+			log.WithFields(log.Fields{
+				"group":       b.group,
+				"stream":      b.stream,
+				"destination": d.name,
+				"error":       err,
+				"count":       len(b.batch),
+			}).Error("dropping message batch buffered while the destination was paused")
+
+			LogMessages(b.batch, "dropped", log.Fields{"destination": d.name})
+			RewindBatch(b.batch)
+		} else {
+			AcknowledgeBatch(b.batch)
+		}
+	}
+}
+
+func (d *PausableDestination) deliver(b pausedBatch) (err error) {
+	var w Writer
+
+	if w, err = d.Destination.Open(b.group, b.stream); err != nil {
+		return
+	}
+	defer w.Close()
+
+	if b.urgent {
+		_, err = WriteUrgentMessageBatch(w, b.batch)
+	} else {
+		_, err = WriteMessageBatchSize(w, b.batch)
+	}
+
+	return
+}
+
+// pausableWriter only opens a writer of the wrapped destination when a batch
+// is written while the destination isn't paused, so writers aren't opened on
+// destinations under maintenance.
+type pausableWriter struct {
+	dest   *PausableDestination
+	group  string
+	stream string
+	writer Writer
+}
+
+func (w *pausableWriter) Close() (err error) {
+	if w.writer != nil {
+		err = w.writer.Close()
+	}
+	return
+}
+
+func (w *pausableWriter) WriteMessage(msg Message) error {
+	return w.WriteMessageBatch(MessageBatch{msg})
+}
+
+func (w *pausableWriter) WriteMessageBatch(batch MessageBatch) (err error) {
+	_, err = w.WriteMessageBatchSize(batch)
+	return
+}
+
+func (w *pausableWriter) WriteMessageBatchSize(batch MessageBatch) (int, error) {
+	return w.write(batch, false)
+}
+
+func (w *pausableWriter) WriteUrgentMessageBatch(batch MessageBatch) (int, error) {
+	return w.write(batch, true)
+}
+
+func (w *pausableWriter) write(batch MessageBatch, urgent bool) (size int, err error) {
+	var buffered bool
+
+	if buffered, err = w.dest.write(w.group, w.stream, batch, urgent); buffered {
+		return
+	}
+
+	if w.writer == nil {
+		if w.writer, err = w.dest.Destination.Open(w.group, w.stream); err != nil {
+			return
+		}
+	}
+
+	if urgent {
+		return WriteUrgentMessageBatch(w.writer, batch)
+	}
+	return WriteMessageBatchSize(w.writer, batch)
+}
+
+// PauseHandler serves the control interface of a set of pausable destinations,
+// indexed by name:
+//
+//	GET  /destinations/                  the state of all destinations
+//	POST /destinations/<name>/pause      pause a destination
+//	POST /destinations/<name>/resume     resume a destination
+//
+// The handler must be mounted on /destinations/.
+type PauseHandler map[string]*PausableDestination
+
+type pauseState struct {
+	Name     string `json:"name"`
+	Paused   bool   `json:"paused"`
+	Buffered int    `json:"buffered"`
+}
+
+func (h PauseHandler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/destinations"), "/")
+
+	if len(path) == 0 {
+		if req.Method != "GET" {
+			http.Error(res, "the list of destinations only supports GET", http.StatusMethodNotAllowed)
+			return
+		}
+		h.serveStates(res)
+		return
+	}
+
+	i := strings.LastIndexByte(path, '/')
+
+	if i < 0 {
+		http.NotFound(res, req)
+		return
+	}
+
+	name, action := path[:i], path[i+1:]
+	dest := h[name]
+
+	if dest == nil {
+		http.Error(res, "unknown destination: "+name, http.StatusNotFound)
+		return
+	}
+
+	if req.Method != "POST" {
+		http.Error(res, "pausing and resuming destinations only supports POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch action {
+	case "pause":
+		dest.Pause()
+	case "resume":
+		dest.Resume()
+	default:
+		http.NotFound(res, req)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"destination": name,
+		"buffered":    dest.Buffered(),
+	}).Infof("destination %sd", action)
+
+	h.serveStates(res, name)
+}
+
+func (h PauseHandler) serveStates(res http.ResponseWriter, names ...string) {
+	if len(names) == 0 {
+		for name := range h {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	states := make([]pauseState, len(names))
+
+	for i, name := range names {
+		d := h[name]
+		d.mutex.Lock()
+		states[i] = pauseState{Name: name, Paused: d.paused, Buffered: d.count}
+		d.mutex.Unlock()
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(states)
+}
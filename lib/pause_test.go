@@ -0,0 +1,222 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// pauseTestDestination records the messages written to each stream, in order.
+type pauseTestDestination struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (d *pauseTestDestination) Open(group string, stream string) (Writer, error) {
+	return NewMessageEncoder(writerFunc(func(b []byte) (int, error) {
+		d.mutex.Lock()
+		d.messages = append(d.messages, strings.TrimSpace(string(b)))
+		d.mutex.Unlock()
+		return len(b), nil
+	})), nil
+}
+
+func (d *pauseTestDestination) Close(group string, stream string) {}
+
+func (d *pauseTestDestination) written() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]string(nil), d.messages...)
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) { return f(b) }
+
+func makePauseBatch(i int) MessageBatch {
+	return MessageBatch{{Group: "A", Stream: "B", Event: ecslogs.Event{Message: fmt.Sprint(i)}}}
+}
+
+func writePauseBatch(t *testing.T, dest Destination, i int) error {
+	w, err := dest.Open("A", "B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	return w.WriteMessageBatch(makePauseBatch(i))
+}
+
+func pauseTestMessages(from int, to int) (messages []string) {
+	for i := from; i < to; i++ {
+		batch := makePauseBatch(i)
+		messages = append(messages, strings.TrimSpace(batch[0].String()))
+	}
+	return
+}
+
+func TestPausableDestination(t *testing.T) {
+	base := &pauseTestDestination{}
+	dest := NewPausableDestination("test", base, DefaultPause, metrics.NewRegistry())
+
+	writePauseBatch(t, dest, 0)
+	dest.Pause()
+
+	for i := 1; i != 10; i++ {
+		if err := writePauseBatch(t, dest, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := len(base.written()); n != 1 {
+		t.Errorf("the paused destination shouldn't deliver messages: %d written", n)
+	}
+
+	if n := dest.Buffered(); n != 9 {
+		t.Errorf("invalid number of buffered messages: %d", n)
+	}
+
+	dest.Resume()
+
+	// Batches written while the buffer is drained are delivered after it.
+	writePauseBatch(t, dest, 10)
+	dest.Wait()
+	writePauseBatch(t, dest, 11)
+
+	if found, ref := base.written(), pauseTestMessages(0, 12); strings.Join(found, ",") != strings.Join(ref, ",") {
+		t.Errorf("the messages weren't delivered in order:\n- expected: %v\n- found:    %v", ref, found)
+	}
+
+	if n := dest.Buffered(); n != 0 {
+		t.Errorf("the buffer should be empty after resuming: %d", n)
+	}
+}
+
+func TestPausableDestinationOverflow(t *testing.T) {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	for _, test := range []struct {
+		policy   OverflowPolicy
+		errors   int
+		messages []string
+	}{
+		{DropNewestOverflow, 2, pauseTestMessages(0, 3)},
+		{DropOldestOverflow, 0, pauseTestMessages(2, 5)},
+	} {
+		base := &pauseTestDestination{}
+		reg := metrics.NewRegistry()
+		dest := NewPausableDestination("test", base, Pause{MaxCount: 3, MaxBytes: 1000, Overflow: test.policy}, reg)
+		dest.Pause()
+		errors := 0
+
+		for i := 0; i != 5; i++ {
+			if writePauseBatch(t, dest, i) != nil {
+				errors++
+			}
+		}
+
+		dest.Resume()
+		dest.Wait()
+
+		if errors != test.errors {
+			t.Errorf("%s: invalid number of rejected batches: %d", test.policy, errors)
+		}
+
+		if found := base.written(); strings.Join(found, ",") != strings.Join(test.messages, ",") {
+			t.Errorf("%s: invalid messages delivered:\n- expected: %v\n- found:    %v", test.policy, test.messages, found)
+		}
+
+		if n := reg.Counter("pause_overflow_messages", "destination", "test").Value(); n != 2 {
+			t.Errorf("%s: invalid number of overflowing messages: %d", test.policy, n)
+		}
+	}
+}
+
+func TestPausableDestinationBlock(t *testing.T) {
+	base := &pauseTestDestination{}
+	dest := NewPausableDestination("test", base, Pause{MaxCount: 2, MaxBytes: 1000, Overflow: BlockOverflow}, metrics.NewRegistry())
+	dest.Pause()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i != 4; i++ {
+			writePauseBatch(t, dest, i)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("the writes should block once the buffer of the paused destination is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	dest.Resume()
+	<-done
+	dest.Wait()
+
+	if found, ref := base.written(), pauseTestMessages(0, 4); strings.Join(found, ",") != strings.Join(ref, ",") {
+		t.Errorf("the blocked writes should be delivered on resume:\n- expected: %v\n- found:    %v", ref, found)
+	}
+}
+
+func TestPauseHandler(t *testing.T) {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	dest := NewPausableDestination("test", &pauseTestDestination{}, DefaultPause, metrics.NewRegistry())
+	server := httptest.NewServer(PauseHandler{"test": dest})
+	defer server.Close()
+
+	for _, test := range []struct {
+		method string
+		path   string
+		status int
+		paused bool
+	}{
+		{"POST", "/destinations/test/pause", http.StatusOK, true},
+		{"GET", "/destinations/", http.StatusOK, true},
+		{"GET", "/destinations/test/resume", http.StatusMethodNotAllowed, true},
+		{"POST", "/destinations/other/resume", http.StatusNotFound, true},
+		{"POST", "/destinations/test/resume", http.StatusOK, false},
+	} {
+		req, _ := http.NewRequest(test.method, server.URL+test.path, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != test.status {
+			t.Errorf("%s %s: invalid status: %d", test.method, test.path, res.StatusCode)
+		}
+
+		if dest.Paused() != test.paused {
+			t.Errorf("%s %s: the destination should be paused=%t", test.method, test.path, test.paused)
+		}
+	}
+}
+
+func TestDestinationPause(t *testing.T) {
+	os.Setenv("TESTDEST_PAUSE_BUFFER_SIZE", "10")
+	os.Setenv("TESTDEST_PAUSE_OVERFLOW", "drop-oldest")
+	defer os.Unsetenv("TESTDEST_PAUSE_BUFFER_SIZE")
+	defer os.Unsetenv("TESTDEST_PAUSE_OVERFLOW")
+
+	if p, err := DestinationPause("testdest"); err != nil || p.MaxCount != 10 || p.MaxBytes != DefaultPause.MaxBytes || p.Overflow != DropOldestOverflow {
+		t.Errorf("invalid pause configuration: %+v (%v)", p, err)
+	}
+
+	os.Setenv("TESTDEST_PAUSE_OVERFLOW", "spill")
+
+	if _, err := DestinationPause("testdest"); err == nil {
+		t.Error("expected an error for an unknown overflow policy")
+	}
+}
@@ -0,0 +1,26 @@
+package lib
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// The names of the sources and destinations, they are listed in the comma
+// separated -src and -dst flags and uppercased to make the prefix of their
+// environment variables, like CLOUDWATCHLOGS_MAX_RETRIES.
+var pluginName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// checkPluginName panics if name can't be registered as a source or
+// destination, either because it's invalid or because another one already has
+// it. Registering happens in the init functions of the packages, a conflict
+// between two packages compiled into the same program is a programming error
+// that must not go unnoticed.
+func checkPluginName(kind string, name string, taken bool) {
+	if !pluginName.MatchString(name) {
+		panic(fmt.Sprintf("ecs-logs: invalid %s name %q, must be lowercase letters, digits and underscores starting with a letter", kind, name))
+	}
+
+	if taken {
+		panic(fmt.Sprintf("ecs-logs: the %s %q is registered twice", kind, name))
+	}
+}
@@ -0,0 +1,38 @@
+package lib
+
+import "testing"
+
+func TestRegisterInvalidName(t *testing.T) {
+	for _, name := range []string{"", "Upper", "with-dash", "with space", "a,b", "1st"} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("registering a destination with an invalid name didn't panic")
+				}
+				DeregisterDestination(name)
+			}()
+			RegisterDestination(name, DestinationFunc(nil))
+		})
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	defer DeregisterSource("test_twice")
+	RegisterSource("test_twice", SourceFunc(nil))
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a source twice didn't panic")
+		}
+	}()
+	RegisterSource("test_twice", SourceFunc(nil))
+}
+
+func TestBuiltinsRegistered(t *testing.T) {
+	if GetSource("stdin") == nil {
+		t.Error("the stdin source is not registered")
+	}
+	if GetDestination("stdout") == nil {
+		t.Error("the stdout destination is not registered")
+	}
+}
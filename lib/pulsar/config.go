@@ -0,0 +1,242 @@
+package pulsar
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+const (
+	// The ports of the web service of the brokers, which serves the
+	// WebSocket API, by default.
+	defaultPort    = "8080"
+	defaultTLSPort = "8443"
+
+	// The tenant and namespace of the topics given by their short name.
+	defaultTopicPrefix = "persistent://public/default/"
+)
+
+// config carries the settings of the pulsar destination, they are loaded from
+// PULSAR_* environment variables.
+type config struct {
+	// The web service of the broker or proxy, as a ws:// or wss:// URL
+	// without a path, and the token the connections are authenticated with.
+	url   *url.URL
+	token string
+	tls   *tls.Config
+
+	// The topic the messages are produced to, a template which may use the
+	// {group} and {stream} variables.
+	topic string
+
+	// The settings of the producers, they are passed to the broker when the
+	// connections are opened.
+	producerName  string
+	compression   string
+	batching      bool
+	batchingDelay time.Duration
+	sendTimeout   time.Duration
+
+	// How many messages each producer has waiting for the receipt of the
+	// broker, sending more blocks until some are acknowledged.
+	maxPending int
+
+	// How the messages that failed to be produced are sent again, and the
+	// budget of those retries shared by all the writers.
+	retry       retry.Policy
+	retryBudget lib.RetryBudget
+
+	// Whether the raw lines that the messages were read from are produced
+	// instead of their JSON representation.
+	raw bool
+
+	err error
+}
+
+func getConfig() (c config) {
+	var err error
+	var s string
+
+	c.sendTimeout = 30 * time.Second
+	c.maxPending = 1000
+
+	if s = strings.TrimSpace(lib.Getenv("PULSAR_URL")); len(s) == 0 {
+		c.err = lib.AppendError(c.err, fmt.Errorf("missing PULSAR_URL environment variable"))
+	} else if c.url, err = parseURL(s); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.topic = strings.TrimSpace(lib.Getenv("PULSAR_TOPIC")); len(c.topic) == 0 {
+		c.err = lib.AppendError(c.err, fmt.Errorf("missing PULSAR_TOPIC environment variable"))
+	} else if err = checkTopic(c.topic); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	c.token = strings.TrimSpace(lib.Getenv("PULSAR_TOKEN"))
+	c.producerName = strings.TrimSpace(lib.Getenv("PULSAR_PRODUCER_NAME"))
+
+	if s = strings.TrimSpace(lib.Getenv("PULSAR_COMPRESSION")); len(s) != 0 {
+		switch c.compression = strings.ToUpper(s); c.compression {
+		case "NONE", "LZ4", "ZLIB", "ZSTD", "SNAPPY":
+		default:
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid PULSAR_COMPRESSION, must be one of none, lz4, zlib, zstd or snappy: %s", s))
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("PULSAR_BATCHING")); len(s) != 0 {
+		if c.batching, err = strconv.ParseBool(s); err != nil {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid PULSAR_BATCHING, must be a boolean: %s", s))
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("PULSAR_BATCHING_DELAY")); len(s) != 0 {
+		if c.batchingDelay, err = time.ParseDuration(s); err != nil || c.batchingDelay < time.Millisecond {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid PULSAR_BATCHING_DELAY, must be a duration of at least one millisecond: %s", s))
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("PULSAR_SEND_TIMEOUT")); len(s) != 0 {
+		if c.sendTimeout, err = time.ParseDuration(s); err != nil || c.sendTimeout < time.Millisecond {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid PULSAR_SEND_TIMEOUT, must be a duration of at least one millisecond: %s", s))
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("PULSAR_MAX_PENDING")); len(s) != 0 {
+		if c.maxPending, err = strconv.Atoi(s); err != nil || c.maxPending < 1 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid PULSAR_MAX_PENDING, must be a positive integer: %s", s))
+		}
+	}
+
+	if c.retry, err = retry.DestinationPolicy("pulsar", retry.DefaultPolicy); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.retryBudget, err = lib.DestinationRetryBudget("pulsar"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.raw, err = lib.DestinationRawPassthrough("pulsar"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if t, err := lib.DestinationTLS("pulsar"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	} else if t.Enabled() {
+		if c.url != nil && c.url.Scheme != "wss" {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid PULSAR_TLS_* settings, the PULSAR_URL must be a wss:// or https:// URL to use them"))
+		} else if c.tls, err = t.Load(); err != nil {
+			c.err = lib.AppendError(c.err, err)
+		}
+	}
+
+	if c.url != nil && c.url.Scheme == "wss" && c.tls == nil {
+		c.tls = &tls.Config{ServerName: c.url.Hostname()}
+	}
+
+	return
+}
+
+func (c config) check() error {
+	return c.err
+}
+
+// parseURL parses the URL of the web service of a broker. The http:// and
+// https:// URLs that Pulsar documents for the web service are accepted too,
+// the WebSocket API is served on the same port.
+func parseURL(s string) (u *url.URL, err error) {
+	if u, err = url.Parse(s); err != nil || len(u.Hostname()) == 0 || (len(u.Path) != 0 && u.Path != "/") {
+		return nil, fmt.Errorf("invalid PULSAR_URL, must be a ws:// or wss:// URL without a path: %s", s)
+	}
+
+	port := defaultPort
+
+	switch u.Scheme {
+	case "ws", "http":
+		u.Scheme = "ws"
+	case "wss", "https":
+		u.Scheme, port = "wss", defaultTLSPort
+	default:
+		return nil, fmt.Errorf("invalid PULSAR_URL, the protocol must be one of ws or wss: %s", s)
+	}
+
+	if len(u.Port()) == 0 {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	u.Path = ""
+	return
+}
+
+var topicVariable = regexp.MustCompile(`\{[^{}]*\}`)
+
+// checkTopic reports the errors of the topic template s, the topic it resolves
+// to must be valid with any group and stream.
+func checkTopic(s string) error {
+	for _, v := range topicVariable.FindAllString(s, -1) {
+		if v != "{group}" && v != "{stream}" {
+			return fmt.Errorf("invalid PULSAR_TOPIC, unknown variable %s, must be one of {group} or {stream}: %s", v, s)
+		}
+	}
+
+	if _, err := topicPath(topicVariable.ReplaceAllString(s, "x")); err != nil {
+		return fmt.Errorf("invalid PULSAR_TOPIC, %s: %s", err, s)
+	}
+
+	return nil
+}
+
+// topicPath returns the path of the topic in the URLs of the WebSocket API,
+// like persistent/public/default/logs. A topic given by its short name is in
+// the default namespace of the public tenant.
+func topicPath(topic string) (string, error) {
+	if !strings.Contains(topic, "://") {
+		topic = defaultTopicPrefix + topic
+	}
+
+	i := strings.Index(topic, "://")
+	domain, name := topic[:i], topic[i+3:]
+
+	if domain != "persistent" && domain != "non-persistent" {
+		return "", fmt.Errorf("the domain must be persistent or non-persistent")
+	}
+
+	parts := strings.Split(name, "/")
+
+	if len(parts) != 3 {
+		return "", fmt.Errorf("must be a short name or a full name like persistent://tenant/namespace/topic")
+	}
+
+	for _, p := range parts {
+		if !validName.MatchString(p) {
+			return "", fmt.Errorf("the tenant, namespace and topic names can't be empty and may only contain letters, digits and the -=:._ characters")
+		}
+	}
+
+	return domain + "/" + name, nil
+}
+
+var (
+	validName   = regexp.MustCompile(`^[-=:.\w]+$`)
+	invalidChar = regexp.MustCompile(`[^-=:.\w]+`)
+)
+
+// topicName returns the name of the topic of a group and stream from the topic
+// template. The characters that Pulsar doesn't allow in names, like the slashes
+// of the group names, are replaced with dashes.
+func topicName(template string, group string, stream string) string {
+	clean := func(s string) string {
+		if s = strings.Trim(invalidChar.ReplaceAllString(s, "-"), "-"); len(s) == 0 {
+			s = "-"
+		}
+		return s
+	}
+	return strings.NewReplacer("{group}", clean(group), "{stream}", clean(stream)).Replace(template)
+}
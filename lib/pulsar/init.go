@@ -0,0 +1,8 @@
+package pulsar
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterDestination("pulsar", newDestination(getConfig))
+	lib.RegisterRecordLimit("pulsar", maxMessageSize)
+}
@@ -0,0 +1,298 @@
+package pulsar
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+)
+
+// message is a message produced to a topic.
+type message struct {
+	payload    []byte
+	key        string
+	properties map[string]string
+}
+
+// producer produces the messages of a topic, it's implemented by wsProducer
+// with the WebSocket API of Pulsar and by mocks in the tests.
+type producer interface {
+	// send produces m asynchronously, done is called with nil once the broker
+	// persisted it, or with the error that made it fail. It blocks while the
+	// producer has too many messages waiting for their receipt.
+	send(m message, done func(error))
+
+	// flush waits until all the messages sent were acknowledged or failed.
+	flush()
+
+	// close flushes the producer and closes its connection to the broker.
+	close()
+}
+
+var errReceiptTimeout = errors.New("the pulsar broker didn't acknowledge the messages in time")
+
+// wsProducer is a producer of the WebSocket API of Pulsar. The connection is
+// opened by the first send, and opened again by the next one when it's lost,
+// the messages waiting for their receipt then fail and are retried by the
+// writers.
+type wsProducer struct {
+	url     *url.URL
+	header  http.Header
+	tls     *tls.Config
+	timeout time.Duration
+
+	// A slot is taken by each message until its receipt, so at most
+	// maxPending messages are sent and not yet acknowledged.
+	slots chan struct{}
+
+	mutex   sync.Mutex
+	idle    *sync.Cond
+	conn    *wsConn
+	seq     uint64
+	pending map[string]func(error)
+
+	// After failing to connect the messages fail right away until the next
+	// attempt, so a batch doesn't wait for a connection timeout per message
+	// while the broker is down.
+	backoff backoff.Backoff
+	retryAt time.Time
+	dialErr error
+}
+
+func newProducer(c config, topic string) (producer, error) {
+	path, err := topicPath(topic)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid pulsar topic %s: %s", topic, err)
+	}
+
+	u := *c.url
+	u.Path = "/ws/v2/producer/" + path
+	q := url.Values{}
+	q.Set("sendTimeoutMillis", strconv.FormatInt(int64(c.sendTimeout/time.Millisecond), 10))
+	q.Set("maxPendingMessages", strconv.Itoa(c.maxPending))
+
+	if len(c.producerName) != 0 {
+		q.Set("producerName", c.producerName)
+	}
+
+	if len(c.compression) != 0 {
+		q.Set("compressionType", c.compression)
+	}
+
+	if c.batching {
+		q.Set("batchingEnabled", "true")
+
+		if c.batchingDelay != 0 {
+			q.Set("batchingMaxPublishDelay", strconv.FormatInt(int64(c.batchingDelay/time.Millisecond), 10))
+		}
+	}
+
+	u.RawQuery = q.Encode()
+	header := http.Header{}
+
+	if len(c.token) != 0 {
+		header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	p := &wsProducer{
+		url:    &u,
+		header: header,
+		tls:    c.tls,
+		// The broker fails the messages it couldn't persist within the send
+		// timeout, the receipts are waited for a bit longer.
+		timeout: c.sendTimeout + 5*time.Second,
+		slots:   make(chan struct{}, c.maxPending),
+		pending: make(map[string]func(error)),
+		backoff: backoff.Backoff{
+			Min:    100 * time.Millisecond,
+			Max:    10 * time.Second,
+			Factor: 2,
+			Jitter: true,
+		},
+	}
+	p.idle = sync.NewCond(&p.mutex)
+	return p, nil
+}
+
+type produceRequest struct {
+	Payload    string            `json:"payload"`
+	Properties map[string]string `json:"properties,omitempty"`
+	Context    string            `json:"context"`
+	Key        string            `json:"key,omitempty"`
+}
+
+type produceReceipt struct {
+	Result    string `json:"result"`
+	MessageID string `json:"messageId"`
+	ErrorMsg  string `json:"errorMsg"`
+	Context   string `json:"context"`
+}
+
+// encodePayload encodes the payload of a message, the WebSocket API expects
+// them in base64.
+func encodePayload(b []byte) string {
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func (p *wsProducer) send(m message, done func(error)) {
+	p.slots <- struct{}{}
+	p.mutex.Lock()
+
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			p.mutex.Unlock()
+			<-p.slots
+			done(err)
+			return
+		}
+	}
+
+	conn := p.conn
+	p.seq++
+	ctx := strconv.FormatUint(p.seq, 10)
+
+	b, _ := json.Marshal(produceRequest{
+		Payload:    encodePayload(m.payload),
+		Properties: m.properties,
+		Context:    ctx,
+		Key:        m.key,
+	})
+
+	if len(p.pending) == 0 {
+		// The receipts are expected within the timeout as long as messages
+		// are waiting for them.
+		conn.SetReadDeadline(time.Now().Add(p.timeout))
+	}
+
+	p.pending[ctx] = done
+	conn.SetWriteDeadline(time.Now().Add(p.timeout))
+	err := conn.writeMessage(b)
+	p.mutex.Unlock()
+
+	if err != nil {
+		p.lost(conn, err)
+	}
+}
+
+// connect opens the connection to the broker, it must be called with the mutex
+// locked.
+func (p *wsProducer) connect() error {
+	if now := time.Now(); now.Before(p.retryAt) {
+		return p.dialErr
+	}
+
+	conn, err := dialWebSocket(p.url, p.header, p.tls, p.timeout)
+
+	if err != nil {
+		p.dialErr = fmt.Errorf("connecting to pulsar: %s", err)
+		p.retryAt = time.Now().Add(p.backoff.Duration())
+		return p.dialErr
+	}
+
+	p.backoff.Reset()
+	p.conn = conn
+	go p.receive(conn)
+	return nil
+}
+
+// receive reads the receipts of the broker until the connection is lost.
+func (p *wsProducer) receive(conn *wsConn) {
+	for {
+		var r produceReceipt
+		var b []byte
+		var err error
+
+		if b, err = conn.readMessage(); err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				err = errReceiptTimeout
+			}
+			p.lost(conn, err)
+			return
+		}
+
+		if err = json.Unmarshal(b, &r); err != nil {
+			p.lost(conn, fmt.Errorf("the pulsar broker sent an invalid receipt: %s", err))
+			return
+		}
+
+		if r.Result != "ok" {
+			err = fmt.Errorf("pulsar failed to produce a message (%s): %s", r.Result, r.ErrorMsg)
+		}
+
+		p.complete(conn, r.Context, err)
+	}
+}
+
+func (p *wsProducer) complete(conn *wsConn, ctx string, err error) {
+	p.mutex.Lock()
+	done := p.pending[ctx]
+	delete(p.pending, ctx)
+
+	if len(p.pending) == 0 {
+		conn.SetReadDeadline(time.Time{})
+		p.idle.Broadcast()
+	} else {
+		conn.SetReadDeadline(time.Now().Add(p.timeout))
+	}
+
+	p.mutex.Unlock()
+
+	if done != nil {
+		<-p.slots
+		done(err)
+	}
+}
+
+// lost closes conn after an error, the messages waiting for their receipt fail
+// with err.
+func (p *wsProducer) lost(conn *wsConn, err error) {
+	var pending map[string]func(error)
+
+	p.mutex.Lock()
+
+	if p.conn == conn {
+		p.conn, pending = nil, p.pending
+		p.pending = make(map[string]func(error))
+		p.idle.Broadcast()
+	}
+
+	p.mutex.Unlock()
+	conn.Close()
+
+	for _, done := range pending {
+		<-p.slots
+		done(fmt.Errorf("lost the connection to pulsar: %s", err))
+	}
+}
+
+func (p *wsProducer) flush() {
+	p.mutex.Lock()
+
+	for len(p.pending) != 0 {
+		p.idle.Wait()
+	}
+
+	p.mutex.Unlock()
+}
+
+func (p *wsProducer) close() {
+	p.flush()
+	p.mutex.Lock()
+	conn := p.conn
+	p.conn = nil
+	p.mutex.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+}
@@ -0,0 +1,182 @@
+package pulsar
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testBroker serves the producer endpoint of the WebSocket API, receipt decides
+// how each message is answered and returns false to drop the connection
+// instead.
+type testBroker struct {
+	*httptest.Server
+	conns    int32
+	mutex    sync.Mutex
+	requests []*http.Request
+	received []produceRequest
+	receipt  func(n int, req produceRequest) (produceReceipt, bool)
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	b := &testBroker{}
+	b.Server = httptest.NewServer(http.HandlerFunc(b.serve))
+	return b
+}
+
+func (b *testBroker) serve(res http.ResponseWriter, req *http.Request) {
+	b.mutex.Lock()
+	b.requests = append(b.requests, req)
+	b.mutex.Unlock()
+
+	res.Header().Set("Upgrade", "websocket")
+	res.Header().Set("Connection", "Upgrade")
+	res.Header().Set("Sec-WebSocket-Accept", acceptKey(req.Header.Get("Sec-WebSocket-Key")))
+	res.WriteHeader(http.StatusSwitchingProtocols)
+
+	conn, rw, err := res.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	atomic.AddInt32(&b.conns, 1)
+	c := &wsConn{Conn: conn, r: rw.Reader}
+
+	for {
+		var r produceRequest
+		msg, err := c.readMessage()
+
+		if err != nil {
+			return
+		}
+
+		json.Unmarshal(msg, &r)
+
+		b.mutex.Lock()
+		b.received = append(b.received, r)
+		n := len(b.received)
+		b.mutex.Unlock()
+
+		receipt, ok := produceReceipt{Result: "ok", MessageID: "CAAQAw==", Context: r.Context}, true
+
+		if b.receipt != nil {
+			receipt, ok = b.receipt(n, r)
+			receipt.Context = r.Context
+		}
+
+		if !ok {
+			return
+		}
+
+		reply, _ := json.Marshal(receipt)
+		c.writeFrame(opText, reply)
+	}
+}
+
+func newTestProducer(t *testing.T, b *testBroker, topic string) *wsProducer {
+	u, _ := url.Parse(b.URL)
+	u.Scheme = "ws"
+
+	p, err := newProducer(config{
+		url:          u,
+		token:        "secret",
+		producerName: "ecs-logs",
+		sendTimeout:  time.Second,
+		maxPending:   2,
+	}, topic)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p.(*wsProducer)
+}
+
+func TestProducerSend(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	// The receipts are sent late, close waits for them.
+	b.receipt = func(n int, req produceRequest) (produceReceipt, bool) {
+		time.Sleep(10 * time.Millisecond)
+		return produceReceipt{Result: "ok"}, true
+	}
+
+	p := newTestProducer(t, b, "logs")
+	var receipts int32
+
+	for i := 0; i != 5; i++ {
+		p.send(message{payload: []byte("hello"), key: "A", properties: map[string]string{"stream": "B"}}, func(err error) {
+			if err != nil {
+				t.Error(err)
+			}
+			atomic.AddInt32(&receipts, 1)
+		})
+	}
+
+	p.close()
+
+	if n := atomic.LoadInt32(&receipts); n != 5 {
+		t.Errorf("close should wait for the receipts of the pending messages: %d receipts", n)
+	}
+
+	req := b.requests[0]
+
+	if req.URL.Path != "/ws/v2/producer/persistent/public/default/logs" {
+		t.Error("invalid topic path:", req.URL.Path)
+	}
+
+	if q := req.URL.Query(); q.Get("producerName") != "ecs-logs" || q.Get("sendTimeoutMillis") != "1000" {
+		t.Error("invalid producer settings:", q)
+	}
+
+	if auth := req.Header.Get("Authorization"); auth != "Bearer secret" {
+		t.Error("the connection should be authenticated with the token:", auth)
+	}
+
+	r := b.received[0]
+	payload, _ := base64.StdEncoding.DecodeString(r.Payload)
+
+	if string(payload) != "hello" || r.Key != "A" || r.Properties["stream"] != "B" {
+		t.Errorf("invalid message: %+v", r)
+	}
+}
+
+func TestProducerReconnect(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	// The broker goes away with the first message, and fails the second.
+	b.receipt = func(n int, req produceRequest) (produceReceipt, bool) {
+		switch n {
+		case 1:
+			return produceReceipt{}, false
+		case 2:
+			return produceReceipt{Result: "send-error", ErrorMsg: "topic is being unloaded"}, true
+		}
+		return produceReceipt{Result: "ok"}, true
+	}
+
+	p := newTestProducer(t, b, "logs")
+	defer p.close()
+
+	for i, expected := range []bool{false, false, true} {
+		errs := make(chan error, 1)
+		p.send(message{payload: []byte("hello")}, func(err error) { errs <- err })
+
+		if err := <-errs; (err == nil) != expected {
+			t.Errorf("#%d: invalid result: %v", i, err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&b.conns); n != 2 {
+		t.Errorf("the producer should reconnect after losing the connection: %d connections", n)
+	}
+}
@@ -0,0 +1,223 @@
+// Package pulsar implements the pulsar destination, which produces the messages
+// to an Apache Pulsar topic through the WebSocket API of the brokers, keyed by
+// their group so the messages of a group stay on the same partition.
+package pulsar
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+// The default maximum size of the messages accepted by the brokers.
+const maxMessageSize = 5 * 1024 * 1024
+
+// destination produces messages to the topics resolved from the template, the
+// writers of the streams of a topic share its producer, which is flushed and
+// closed when the last of those streams is.
+type destination struct {
+	lazy   lib.LazyConfig
+	load   func() config
+	config config
+
+	mutex     sync.Mutex
+	producers map[string]*topicProducer
+	open      func(c config, topic string) (producer, error)
+
+	retries *lib.RetryLimiter
+	clock   clock.Clock
+}
+
+// topicProducer is the producer of a topic and the streams using it.
+type topicProducer struct {
+	producer
+	streams map[[2]string]bool
+}
+
+func newDestination(load func() config) *destination {
+	return &destination{
+		load:      load,
+		producers: make(map[string]*topicProducer),
+		open:      newProducer,
+		clock:     clock.System,
+	}
+}
+
+func (d *destination) Open(group string, stream string) (w lib.Writer, err error) {
+	if err = d.lazy.Init(d.init); err != nil {
+		return
+	}
+
+	topic := topicName(d.config.topic, group, stream)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	p := d.producers[topic]
+
+	if p == nil {
+		var prod producer
+
+		if prod, err = d.open(d.config, topic); err != nil {
+			return
+		}
+
+		p = &topicProducer{producer: prod, streams: make(map[[2]string]bool)}
+		d.producers[topic] = p
+	}
+
+	p.streams[[2]string{group, stream}] = true
+	w = writer{dest: d, producer: p}
+	return
+}
+
+// CheckConfig reports the problems with the PULSAR_* settings when ecs-logs
+// starts.
+func (d *destination) CheckConfig() error {
+	return d.load().check()
+}
+
+// Close is called when the stream expired, the producer of its topic is closed
+// if no other stream uses it, once the messages it has pending are flushed.
+func (d *destination) Close(group string, stream string) {
+	if d.lazy.Init(d.init) != nil {
+		return
+	}
+
+	topic := topicName(d.config.topic, group, stream)
+
+	d.mutex.Lock()
+	p := d.producers[topic]
+
+	if p != nil {
+		if delete(p.streams, [2]string{group, stream}); len(p.streams) == 0 {
+			delete(d.producers, topic)
+		} else {
+			p = nil
+		}
+	}
+
+	d.mutex.Unlock()
+
+	if p != nil {
+		p.close()
+	}
+}
+
+func (d *destination) init() error {
+	d.config = d.load()
+	d.retries = lib.NewRetryLimiter("pulsar", d.config.retryBudget, metrics.Default)
+
+	return d.config.check()
+}
+
+func (d *destination) message(msg lib.Message) message {
+	m := message{
+		key:        msg.Group,
+		properties: map[string]string{"group": msg.Group, "stream": msg.Stream},
+	}
+
+	if line, ok := msg.RawLine(); d.config.raw && ok {
+		m.payload = []byte(line)
+	} else {
+		m.payload = msg.Bytes()
+	}
+
+	return m
+}
+
+// produce produces msgs and waits for their receipts. The messages that failed
+// are sent again with the retry policy of the destination, the producer
+// reconnects if the connection to the broker was lost.
+//
+// Pulsar keeps the messages of a key in order, but the ones that are retried
+// come after the ones of the batch that were produced in the first attempt.
+func (d *destination) produce(p producer, msgs []message) error {
+	return d.config.retry.Do(d.clock, d.retries, func() error {
+		failed, last := send(p, msgs)
+
+		if len(failed) == 0 {
+			return nil
+		}
+
+		msgs = failed
+		return retry.Retryable(fmt.Errorf("%d messages couldn't be produced to pulsar, the last error was %s", len(failed), last))
+	})
+}
+
+// send produces msgs asynchronously and returns the ones that failed, with the
+// last error.
+func send(p producer, msgs []message) (failed []message, last error) {
+	var wg sync.WaitGroup
+	errs := make([]error, len(msgs))
+	wg.Add(len(msgs))
+
+	for i, m := range msgs {
+		i := i
+		p.send(m, func(err error) {
+			errs[i] = err
+			wg.Done()
+		})
+	}
+
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, msgs[i])
+			last = err
+		}
+	}
+
+	return
+}
+
+type writer struct {
+	dest     *destination
+	producer producer
+}
+
+// Close returns right away, the writes wait for the receipts of their messages
+// so the writer has nothing pending.
+func (w writer) Close() error {
+	return nil
+}
+
+func (w writer) WriteMessage(msg lib.Message) error {
+	return w.WriteMessageBatch(lib.MessageBatch{msg})
+}
+
+func (w writer) WriteMessageBatch(batch lib.MessageBatch) (err error) {
+	_, err = w.WriteMessageBatchSize(batch)
+	return
+}
+
+// WriteMessageBatchSize produces the messages of batch, and returns the size of
+// their payloads.
+func (w writer) WriteMessageBatchSize(batch lib.MessageBatch) (size int, err error) {
+	msgs := make([]message, 0, len(batch))
+
+	for _, msg := range batch {
+		m := w.dest.message(msg)
+
+		if len(m.payload) > maxMessageSize {
+			err = lib.AppendError(err, fmt.Errorf("a message of %s/%s is too large to be produced to pulsar: %d bytes", msg.Group, msg.Stream, len(m.payload)))
+			continue
+		}
+
+		msgs = append(msgs, m)
+		size += len(m.payload)
+	}
+
+	if len(msgs) != 0 {
+		if e := w.dest.produce(w.producer, msgs); e != nil {
+			err = lib.AppendError(err, e)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,233 @@
+package pulsar
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+// mockProducer records the messages it produced, fail returns the error of each
+// attempt to send a message. The receipts are sent asynchronously, after delay.
+type mockProducer struct {
+	topic string
+	delay time.Duration
+	fail  func(attempt int, m message) error
+
+	mutex    sync.Mutex
+	wg       sync.WaitGroup
+	attempts int
+	sent     []message
+	closed   bool
+}
+
+func (p *mockProducer) send(m message, done func(error)) {
+	p.mutex.Lock()
+	p.attempts++
+	attempt := p.attempts
+	p.mutex.Unlock()
+
+	p.wg.Add(1)
+
+	go func() {
+		defer p.wg.Done()
+		time.Sleep(p.delay)
+
+		var err error
+
+		if p.fail != nil {
+			err = p.fail(attempt, m)
+		}
+
+		if err == nil {
+			p.mutex.Lock()
+			p.sent = append(p.sent, m)
+			p.mutex.Unlock()
+		}
+
+		done(err)
+	}()
+}
+
+func (p *mockProducer) flush() {
+	p.wg.Wait()
+}
+
+func (p *mockProducer) close() {
+	p.flush()
+	p.mutex.Lock()
+	p.closed = true
+	p.mutex.Unlock()
+}
+
+func newTestDestination(c config) (*destination, map[string]*mockProducer) {
+	producers := make(map[string]*mockProducer)
+
+	if len(c.topic) == 0 {
+		c.topic = "logs"
+	}
+
+	d := newDestination(func() config { return c })
+	d.clock = clock.NewFake(time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC))
+	d.open = func(c config, topic string) (producer, error) {
+		p := &mockProducer{topic: topic}
+		producers[topic] = p
+		return p, nil
+	}
+	return d, producers
+}
+
+func makeMessage(group string, stream string, s string) lib.Message {
+	return lib.Message{
+		Group:  group,
+		Stream: stream,
+		Event:  ecslogs.Event{Message: s, Time: time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC)},
+	}
+}
+
+func TestWriterKeying(t *testing.T) {
+	d, producers := newTestDestination(config{topic: "persistent://logs/ecs/{group}"})
+
+	for _, stream := range []string{"1", "2"} {
+		w, err := d.Open("/ecs/api", stream)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = w.WriteMessageBatch(lib.MessageBatch{makeMessage("/ecs/api", stream, "hello")}); err != nil {
+			t.Fatal(err)
+		}
+
+		w.Close()
+	}
+
+	// The slashes of the group aren't allowed in the topic names.
+	p := producers["persistent://logs/ecs/ecs-api"]
+
+	if len(producers) != 1 || p == nil {
+		t.Fatalf("the streams of the group should share a producer: %v", producers)
+	}
+
+	if len(p.sent) != 2 {
+		t.Fatalf("invalid number of messages produced: %d", len(p.sent))
+	}
+
+	for i, m := range p.sent {
+		if m.key != "/ecs/api" {
+			t.Errorf("#%d: the key should be the group of the message: %q", i, m.key)
+		}
+
+		if m.properties["group"] != "/ecs/api" || m.properties["stream"] == "" {
+			t.Errorf("#%d: invalid properties: %v", i, m.properties)
+		}
+
+		if !strings.Contains(string(m.payload), `"message":"hello"`) {
+			t.Errorf("#%d: invalid payload: %s", i, m.payload)
+		}
+	}
+}
+
+func TestDestinationFlushOnClose(t *testing.T) {
+	d, producers := newTestDestination(config{topic: "logs-{group}"})
+
+	for _, stream := range []string{"1", "2"} {
+		w, _ := d.Open("A", stream)
+		w.WriteMessageBatch(lib.MessageBatch{makeMessage("A", stream, "hello")})
+		w.Close()
+	}
+
+	p := producers["logs-A"]
+	p.delay = 50 * time.Millisecond
+
+	// A message is still pending when the streams expire.
+	p.send(message{key: "A"}, func(error) {})
+
+	d.Close("A", "1")
+
+	if p.closed {
+		t.Error("the producer should stay open while a stream of the topic is open")
+	}
+
+	d.Close("A", "2")
+
+	if !p.closed || len(p.sent) != 3 {
+		t.Errorf("the producer should be flushed and closed with the last stream: closed=%t, %d messages", p.closed, len(p.sent))
+	}
+
+	if w, _ := d.Open("A", "1"); w != nil && producers["logs-A"] == p {
+		t.Error("a new producer should be opened after the topic was closed")
+	}
+}
+
+func TestWriterRetry(t *testing.T) {
+	d, producers := newTestDestination(config{retry: retry.Policy{MaxRetries: 2}})
+	w, _ := d.Open("A", "B")
+	p := producers["logs"]
+
+	// The broker loses the second message twice, it's produced on the third
+	// attempt.
+	p.fail = func(attempt int, m message) error {
+		if strings.Contains(string(m.payload), "world") && attempt < 4 {
+			return errors.New("lost the connection to pulsar: EOF")
+		}
+		return nil
+	}
+
+	batch := lib.MessageBatch{makeMessage("A", "B", "hello"), makeMessage("A", "B", "world")}
+
+	if err := w.WriteMessageBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.attempts != 4 || len(p.sent) != 2 {
+		t.Errorf("only the failed message should be sent again: %d attempts, %d messages", p.attempts, len(p.sent))
+	}
+
+	if f := d.clock.(*clock.Fake); f.Slept() == 0 {
+		t.Error("the retries should wait for the backoff")
+	}
+
+	// The message keeps failing.
+	p.fail = func(int, message) error {
+		return errors.New("pulsar failed to produce a message (send-error): timeout")
+	}
+	err := w.WriteMessageBatch(batch[:1])
+
+	if err == nil || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Error("the batch should fail once the retries are exhausted:", err)
+	}
+}
+
+func TestConfigTopic(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	for topic, valid := range map[string]bool{
+		"logs":                          true,
+		"logs-{group}-{stream}":         true,
+		"persistent://logs/ecs/{group}": true,
+		"non-persistent://a/b/c":        true,
+		"logs-{level}":                  false,
+		"persistent://logs/{group}":     false,
+		"kafka://a/b/c":                 false,
+		"logs topic":                    false,
+	} {
+		lib.SetConfigEnv(map[string]string{"PULSAR_URL": "ws://localhost", "PULSAR_TOPIC": topic})
+
+		if err := getConfig().check(); (err == nil) != valid {
+			t.Errorf("%s: valid=%t but got %v", topic, valid, err)
+		}
+	}
+
+	lib.SetConfigEnv(map[string]string{"PULSAR_URL": "https://pulsar.example.com", "PULSAR_TOPIC": "logs"})
+
+	if c := getConfig(); c.check() != nil || c.url.String() != "wss://pulsar.example.com:8443" || c.tls == nil {
+		t.Errorf("invalid configuration: %v (%v)", c.url, c.check())
+	}
+}
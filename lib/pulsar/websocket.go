@@ -0,0 +1,266 @@
+package pulsar
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	// The receipts of the broker are small, a larger message means that the
+	// stream got out of sync.
+	maxFrameSize = 1024 * 1024
+
+	// The GUID that the accept key of the handshake is derived with.
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var errWebSocketClosed = errors.New("the pulsar broker closed the websocket connection")
+
+// wsConn is a minimal WebSocket connection, as described in RFC 6455, which
+// is all the WebSocket API of Pulsar needs: text messages, and answering the
+// pings of the broker. The frames that clients write are masked, the ones of
+// servers aren't.
+type wsConn struct {
+	net.Conn
+	r    *bufio.Reader
+	mask bool
+
+	// The writes of the producer and the pongs of the receiving goroutine
+	// must not be interleaved.
+	wmutex sync.Mutex
+}
+
+// dialWebSocket opens a WebSocket connection to u, header is added to the
+// handshake request.
+func dialWebSocket(u *url.URL, header http.Header, config *tls.Config, timeout time.Duration) (c *wsConn, err error) {
+	var conn net.Conn
+	var key [16]byte
+	var res *http.Response
+
+	dialer := &net.Dialer{Timeout: timeout}
+
+	if u.Scheme == "wss" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", u.Host, config)
+	} else {
+		conn, err = dialer.Dial("tcp", u.Host)
+	}
+
+	if err != nil {
+		return
+	}
+
+	reject := func(e error) (*wsConn, error) {
+		conn.Close()
+		return nil, e
+	}
+
+	rand.Read(key[:])
+	challenge := base64.StdEncoding.EncodeToString(key[:])
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Host:       u.Host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", challenge)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err = req.Write(conn); err != nil {
+		return reject(err)
+	}
+
+	r := bufio.NewReader(conn)
+
+	if res, err = http.ReadResponse(r, req); err != nil {
+		return reject(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return reject(fmt.Errorf("the pulsar broker refused the websocket connection to %s: %s", u.Path, res.Status))
+	}
+
+	if res.Header.Get("Sec-WebSocket-Accept") != acceptKey(challenge) {
+		return reject(fmt.Errorf("the pulsar broker sent an invalid websocket handshake"))
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &wsConn{Conn: conn, r: r, mask: true}, nil
+}
+
+func acceptKey(challenge string) string {
+	h := sha1.Sum([]byte(challenge + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// writeMessage writes b as a single text frame.
+func (c *wsConn) writeMessage(b []byte) error {
+	return c.writeFrame(opText, b)
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	var header [14]byte
+	var n = 2
+
+	header[0] = 0x80 | opcode
+
+	switch size := len(payload); {
+	case size < 126:
+		header[1] = byte(size)
+	case size <= 0xffff:
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:], uint16(size))
+		n += 2
+	default:
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(size))
+		n += 8
+	}
+
+	frame := make([]byte, 0, n+4+len(payload))
+
+	if c.mask {
+		var key [4]byte
+		rand.Read(key[:])
+		header[1] |= 0x80
+		frame = append(append(frame, header[:n]...), key[:]...)
+
+		for i, b := range payload {
+			frame = append(frame, b^key[i%4])
+		}
+	} else {
+		frame = append(append(frame, header[:n]...), payload...)
+	}
+
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+
+	_, err := c.Write(frame)
+	return err
+}
+
+// readMessage returns the next text or binary message, the pings received in
+// the meantime are answered.
+func (c *wsConn) readMessage() (msg []byte, err error) {
+	for {
+		var fin bool
+		var opcode byte
+		var payload []byte
+
+		if fin, opcode, payload, err = c.readFrame(); err != nil {
+			return
+		}
+
+		switch opcode {
+		case opPing:
+			if err = c.writeFrame(opPong, payload); err != nil {
+				return
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.writeFrame(opClose, nil)
+			err = errWebSocketClosed
+			return
+		case opText, opBinary, opContinuation:
+		default:
+			err = fmt.Errorf("the pulsar broker sent an unknown websocket frame: %#x", opcode)
+			return
+		}
+
+		if msg = append(msg, payload...); len(msg) > maxFrameSize {
+			err = fmt.Errorf("the pulsar broker sent a websocket message larger than %d bytes", maxFrameSize)
+			return
+		}
+
+		if fin {
+			return
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	var key [4]byte
+	var size uint64
+
+	if _, err = io.ReadFull(c.r, header[:]); err != nil {
+		return
+	}
+
+	fin, opcode = header[0]&0x80 != 0, header[0]&0x0f
+	masked := header[1]&0x80 != 0
+
+	switch size = uint64(header[1] & 0x7f); size {
+	case 126:
+		var b [2]byte
+		if _, err = io.ReadFull(c.r, b[:]); err != nil {
+			return
+		}
+		size = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err = io.ReadFull(c.r, b[:]); err != nil {
+			return
+		}
+		size = binary.BigEndian.Uint64(b[:])
+	}
+
+	if size > maxFrameSize {
+		err = fmt.Errorf("the websocket frame is larger than %d bytes: %d", maxFrameSize, size)
+		return
+	}
+
+	if masked {
+		if _, err = io.ReadFull(c.r, key[:]); err != nil {
+			return
+		}
+	}
+
+	payload = make([]byte, size)
+
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+
+	return
+}
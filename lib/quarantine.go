@@ -0,0 +1,209 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// Quarantine bounds the number of times a batch is written to a destination
+// which keeps failing it, for reasons ecs-logs can't classify. After Cycles
+// failed writes, each one with the recovery that the writer does on its own,
+// the batch is sent to the dead-letter group so one poison batch can't hold
+// back the ones queued behind it.
+//
+// The zero value is disabled, failed batches are dropped after one write.
+type Quarantine struct {
+	Cycles int
+
+	// The delay between two cycles, the writer is opened again after it.
+	Backoff time.Duration
+
+	// The group that quarantined batches are sent to, {group} and {stream}
+	// are replaced with the names of the original stream.
+	DeadLetterGroup string
+}
+
+// DestinationQuarantine returns the quarantine configured for destination by
+// the <DESTINATION>_QUARANTINE_CYCLES and <DESTINATION>_QUARANTINE_BACKOFF
+// environment variables.
+func DestinationQuarantine(destination string, deadLetterGroup string) (q Quarantine, err error) {
+	prefix := strings.ToUpper(destination) + "_QUARANTINE_"
+	q = Quarantine{Backoff: time.Second, DeadLetterGroup: deadLetterGroup}
+
+	if s := strings.TrimSpace(Getenv(prefix + "CYCLES")); len(s) != 0 {
+		if q.Cycles, err = strconv.Atoi(s); err != nil || q.Cycles < 0 {
+			err = fmt.Errorf("invalid %sCYCLES, must be a positive integer: %s", prefix, s)
+			return
+		}
+	}
+
+	if s := strings.TrimSpace(Getenv(prefix + "BACKOFF")); len(s) != 0 {
+		if q.Backoff, err = time.ParseDuration(s); err != nil || q.Backoff < 0 {
+			err = fmt.Errorf("invalid %sBACKOFF, must be a positive duration: %s", prefix, s)
+			return
+		}
+	}
+
+	return
+}
+
+// Enabled returns true if failed batches are written again and quarantined.
+func (q Quarantine) Enabled() bool {
+	return q.Cycles != 0
+}
+
+// NewQuarantineDestination wraps dest so the batches that its writers fail are
+// written again, up to the cycles of q, before being dead-lettered. The
+// quarantined messages are counted in the quarantined_messages counter of
+// registry.
+func NewQuarantineDestination(name string, dest Destination, q Quarantine, registry *metrics.Registry, clock clock.Clock) Destination {
+	if !q.Enabled() {
+		return dest
+	}
+	return quarantineDestination{
+		Destination: dest,
+		name:        name,
+		quarantine:  q,
+		quarantined: registry.Counter("quarantined_messages", "destination", name),
+		clock:       clock,
+	}
+}
+
+type quarantineDestination struct {
+	Destination
+	name        string
+	quarantine  Quarantine
+	quarantined *metrics.Counter
+	clock       clock.Clock
+}
+
+func (d quarantineDestination) Open(group string, stream string) (w Writer, err error) {
+	if w, err = d.Destination.Open(group, stream); err == nil {
+		w = &quarantineWriter{
+			Writer: w,
+			dest:   d,
+			group:  group,
+			stream: stream,
+		}
+	}
+	return
+}
+
+type quarantineWriter struct {
+	Writer
+	dest   quarantineDestination
+	group  string
+	stream string
+}
+
+func (w *quarantineWriter) Close() (err error) {
+	if w.Writer != nil {
+		err = w.Writer.Close()
+	}
+	return
+}
+
+func (w *quarantineWriter) WriteMessage(msg Message) error {
+	return w.WriteMessageBatch(MessageBatch{msg})
+}
+
+func (w *quarantineWriter) WriteMessageBatch(batch MessageBatch) (err error) {
+	_, err = w.WriteMessageBatchSize(batch)
+	return
+}
+
+func (w *quarantineWriter) WriteMessageBatchSize(batch MessageBatch) (int, error) {
+	return w.write(batch, WriteMessageBatchSize)
+}
+
+func (w *quarantineWriter) WriteUrgentMessageBatch(batch MessageBatch) (int, error) {
+	return w.write(batch, WriteUrgentMessageBatch)
+}
+
+func (w *quarantineWriter) write(batch MessageBatch, write func(Writer, MessageBatch) (int, error)) (size int, err error) {
+	q := w.dest.quarantine
+
+	for cycle := 1; true; cycle++ {
+		// The writer of the previous cycle failed, writers usually can't be
+		// used anymore after giving up so a new one is opened.
+		if w.Writer == nil {
+			w.Writer, err = w.dest.Destination.Open(w.group, w.stream)
+		}
+
+		if err == nil {
+			if size, err = write(w.Writer, batch); err == nil {
+				return
+			}
+
+			w.Writer.Close()
+			w.Writer = nil
+		}
+
+		if cycle >= q.Cycles {
+			return w.quarantine(batch, cycle, err, write)
+		}
+
+		w.dest.clock.Sleep(context.Background(), q.Backoff)
+	}
+
+	return
+}
+
+// quarantine sends batch to the dead-letter group, with the error of the last
+// cycle. If it can't be dead-lettered either err is returned and the batch is
+// dropped like any other failed batch.
+func (w *quarantineWriter) quarantine(batch MessageBatch, cycles int, err error, write func(Writer, MessageBatch) (int, error)) (size int, _ error) {
+	group := strings.NewReplacer("{group}", w.group, "{stream}", w.stream).Replace(w.dest.quarantine.DeadLetterGroup)
+	reason := fmt.Sprintf("the batch failed to be written %d times", cycles)
+	deadLetters := make(MessageBatch, len(batch))
+
+	for i, msg := range batch {
+		info := DeadLetterInfo(msg, reason, err)
+		info["error"] = err.Error()
+		info["cycles"] = cycles
+		msg.Group = group
+		msg.Event.Data = copyData(msg.Event.Data, 1)
+		msg.Event.Data[DeadLetterField] = info
+		deadLetters[i] = msg
+	}
+
+	fields := log.Fields{
+		"group":             w.group,
+		"stream":            w.stream,
+		"destination":       w.dest.name,
+		"dead_letter_group": group,
+		"count":             len(batch),
+		"cycles":            cycles,
+		"error":             err,
+	}
+
+	if id := RequestID(err); len(id) != 0 {
+		fields["request_id"] = id
+	}
+
+	dl, e := w.dest.Destination.Open(group, w.stream)
+
+	if e == nil {
+		size, e = write(dl, deadLetters)
+		dl.Close()
+		w.dest.Destination.Close(group, w.stream)
+	}
+
+	if e != nil {
+		fields["dead_letter_error"] = e
+		log.WithFields(fields).Error("failed to quarantine a poison message batch")
+		return 0, err
+	}
+
+	log.WithFields(fields).Error("quarantined a poison message batch")
+	w.dest.quarantined.Add(int64(len(batch)))
+	LogMessages(deadLetters, "dead-lettered", log.Fields{"dead_letter_group": group})
+	return size, nil
+}
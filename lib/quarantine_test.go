@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// quarantineTestWriter fails the batches carrying a poison message, the
+// batches written successfully are recorded by group.
+type quarantineTestWriter struct {
+	group   string
+	batches map[string][]MessageBatch
+}
+
+func (w quarantineTestWriter) Close() error { return nil }
+
+func (w quarantineTestWriter) WriteMessage(msg Message) error {
+	return w.WriteMessageBatch(MessageBatch{msg})
+}
+
+func (w quarantineTestWriter) WriteMessageBatch(batch MessageBatch) error {
+	for _, msg := range batch {
+		if msg.Event.Message == "poison" && w.group != "A-quarantine" {
+			return errors.New("InternalFailure: exotic error")
+		}
+	}
+	w.batches[w.group] = append(w.batches[w.group], batch)
+	return nil
+}
+
+func TestQuarantineDestination(t *testing.T) {
+	opens := 0
+	batches := map[string][]MessageBatch{}
+	registry := metrics.NewRegistry()
+	clock := clock.NewFake(time.Unix(0, 0))
+
+	dest := NewQuarantineDestination("testdest", DestinationFunc(func(group string, stream string) (Writer, error) {
+		if group == "A" {
+			opens++
+		}
+		return quarantineTestWriter{group: group, batches: batches}, nil
+	}), Quarantine{Cycles: 3, Backoff: time.Second, DeadLetterGroup: "{group}-quarantine"}, registry, clock)
+
+	w, err := dest.Open("A", "B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	poison := MessageBatch{
+		{Group: "A", Stream: "B", Event: ecslogs.Event{Message: "poison"}},
+		{Group: "A", Stream: "B", Event: ecslogs.Event{Message: "innocent"}},
+	}
+
+	if err := w.WriteMessageBatch(poison); err != nil {
+		t.Errorf("the poison batch should have been quarantined: %s", err)
+	}
+
+	if opens != 3 || clock.Slept() != 2*time.Second {
+		t.Errorf("the batch should be written once per cycle: %d opens, %s slept", opens, clock.Slept())
+	}
+
+	if q := batches["A-quarantine"]; len(q) != 1 || len(q[0]) != 2 {
+		t.Fatalf("the batch should be dead-lettered as a whole: %v", q)
+	}
+
+	info, _ := batches["A-quarantine"][0][0].Event.Data[DeadLetterField].(ecslogs.EventData)
+
+	if info["group"] != "A" || info["error"] != "InternalFailure: exotic error" || info["cycles"] != 3 {
+		t.Errorf("the dead letters should carry the error context: %v", info)
+	}
+
+	if poison[0].Event.Data != nil {
+		t.Error("the original messages should not be modified")
+	}
+
+	// The stream isn't wedged, the batches after the poison one flow.
+	for i := 0; i != 2; i++ {
+		if err := w.WriteMessageBatch(MessageBatch{{Group: "A", Stream: "B", Event: ecslogs.Event{Message: "next"}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(batches["A"]) != 2 || opens != 4 {
+		t.Errorf("the batches after the poison one should be written: %d batches, %d opens", len(batches["A"]), opens)
+	}
+
+	for _, s := range registry.Snapshot() {
+		if s.Name == "quarantined_messages" && s.Value != 2 {
+			t.Errorf("invalid number of quarantined messages: %d", s.Value)
+		}
+	}
+}
+
+func TestQuarantineDestinationDisabled(t *testing.T) {
+	fail := DestinationFunc(func(group string, stream string) (Writer, error) { return failingWriter{}, nil })
+
+	if dest := NewQuarantineDestination("testdest", fail, Quarantine{}, metrics.NewRegistry(), clock.System); dest == nil {
+		t.Fatal("no destination returned")
+	} else if _, ok := dest.(quarantineDestination); ok {
+		t.Error("the destination should not be wrapped when the quarantine is disabled")
+	}
+}
+
+func TestDestinationQuarantine(t *testing.T) {
+	defer SetConfigEnv(nil)
+
+	SetConfigEnv(map[string]string{
+		"TESTDEST_QUARANTINE_CYCLES":  "5",
+		"TESTDEST_QUARANTINE_BACKOFF": "250ms",
+	})
+
+	if q, err := DestinationQuarantine("testdest", "DL"); err != nil || q.Cycles != 5 || q.Backoff != 250*time.Millisecond || q.DeadLetterGroup != "DL" {
+		t.Errorf("invalid quarantine: %+v (%v)", q, err)
+	}
+
+	SetConfigEnv(map[string]string{"TESTDEST_QUARANTINE_CYCLES": "-1"})
+
+	if _, err := DestinationQuarantine("testdest", "DL"); err == nil {
+		t.Error("a negative number of cycles should be rejected")
+	}
+}
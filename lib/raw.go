@@ -0,0 +1,82 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+// rawLines is set when a destination passes the raw lines through, the
+// parsers only keep them then since they double the memory used by messages.
+var rawLines int32
+
+// EnableRawLines makes the parsers keep the raw lines that messages were
+// parsed from, it must be called before the sources are opened.
+func EnableRawLines() {
+	atomic.StoreInt32(&rawLines, 1)
+}
+
+// DestinationRawPassthrough returns whether destination sends the raw lines of
+// the messages instead of serializing them, as configured by the
+// <DESTINATION>_RAW_PASSTHROUGH environment variable.
+func DestinationRawPassthrough(destination string) (enabled bool, err error) {
+	name := strings.ToUpper(destination) + "_RAW_PASSTHROUGH"
+
+	if s := strings.TrimSpace(Getenv(name)); len(s) != 0 {
+		if enabled, err = strconv.ParseBool(s); err != nil {
+			err = fmt.Errorf("invalid %s, must be a boolean: %s", name, s)
+		}
+	}
+
+	return
+}
+
+// setRaw records the line that msg was parsed from, along with a sum of the
+// event as it was parsed to tell later whether it was modified.
+func (m *Message) setRaw(raw []byte) {
+	m.raw = string(raw)
+	m.rawSum = m.eventSum()
+}
+
+// RawLine returns the line that the message was parsed from. The line is only
+// returned if the message text, level and data weren't modified since, by
+// stages for example, otherwise it wouldn't carry the changes.
+func (m Message) RawLine() (line string, ok bool) {
+	if len(m.raw) != 0 && m.eventSum() == m.rawSum {
+		line, ok = m.raw, true
+	}
+	return
+}
+
+func (m Message) eventSum() uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(m.Event.Message))
+	h.Write([]byte{0, byte(m.Event.Level)})
+
+	// A nil data and an empty one are the same, the sources replace the
+	// former with the latter. The message ID is set after the message was
+	// parsed, it isn't a change to the line.
+	data := m.Event.Data
+
+	if _, ok := data[MessageIDField]; ok {
+		data = make(ecslogs.EventData, len(m.Event.Data))
+
+		for k, v := range m.Event.Data {
+			if k != MessageIDField {
+				data[k] = v
+			}
+		}
+	}
+
+	if len(data) != 0 {
+		b, _ := json.Marshal(data)
+		h.Write(b)
+	}
+
+	return h.Sum64()
+}
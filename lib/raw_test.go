@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+func TestRawLinePassthrough(t *testing.T) {
+	EnableRawLines()
+	defer atomic.StoreInt32(&rawLines, 0)
+
+	tests := []struct {
+		parser string
+		line   string
+	}{
+		{parser: "json", line: `{"level":"INFO",  "message":"Hello World!","data":{"n":1.50, "user":"luke"}}`},
+		{parser: "logfmt", line: `level=info msg="Hello World!"   user=luke`},
+		{parser: "raw", line: "\tHello World! \x1b[0m"},
+
+		// Lines that fail to parse are passed through as well.
+		{parser: "json", line: `{"message":`},
+	}
+
+	for _, test := range tests {
+		msg := ParseMessage(GetParser(test.parser), []byte(test.line))
+
+		// The sources set the group, stream and host, and replace a nil data
+		// with an empty one, none of which changes the line.
+		msg.Group, msg.Stream, msg.Event.Info.Host = "A", "B", "localhost"
+
+		if msg.Event.Data == nil {
+			msg.Event.Data = ecslogs.EventData{}
+		}
+
+		if line, ok := msg.RawLine(); !ok || line != test.line {
+			t.Errorf("%s: the original line should be preserved: %q (%t)", test.parser, line, ok)
+		}
+	}
+}
+
+func TestRawLineModified(t *testing.T) {
+	EnableRawLines()
+	defer atomic.StoreInt32(&rawLines, 0)
+
+	line := []byte(`{"level":"INFO","message":"Hello World!","data":{"user":"luke"}}`)
+
+	enrich := func(msg Message) Message {
+		data := make(ecslogs.EventData, len(msg.Event.Data)+1)
+
+		for k, v := range msg.Event.Data {
+			data[k] = v
+		}
+
+		data["cluster"] = "prod"
+		msg.Event.Data = data
+		return msg
+	}
+
+	tests := map[string]func(Message) Message{
+		"enriched": enrich,
+		"rewritten": func(msg Message) Message {
+			msg.Event.Message = "Hello ecs-logs!"
+			return msg
+		},
+		"leveled": func(msg Message) Message {
+			msg.Event.Level = ecslogs.ERROR
+			return msg
+		},
+	}
+
+	for name, modify := range tests {
+		msg := modify(ParseMessage(GetParser("json"), line))
+
+		if raw, ok := msg.RawLine(); ok {
+			t.Errorf("%s: the modified message should fall back to its serialized event: %q", name, raw)
+		}
+	}
+}
+
+func TestRawLineDisabled(t *testing.T) {
+	msg := ParseMessage(GetParser("raw"), []byte("Hello World!"))
+
+	if _, ok := msg.RawLine(); ok {
+		t.Error("the raw lines should only be kept when a destination passes them through")
+	}
+}
+
+func TestDestinationRawPassthrough(t *testing.T) {
+	SetConfigEnv(map[string]string{"TESTDEST_RAW_PASSTHROUGH": "true"})
+	defer SetConfigEnv(nil)
+
+	if enabled, err := DestinationRawPassthrough("testdest"); err != nil || !enabled {
+		t.Errorf("the raw passthrough should be enabled: %t (%v)", enabled, err)
+	}
+
+	SetConfigEnv(map[string]string{"TESTDEST_RAW_PASSTHROUGH": "verbatim"})
+
+	if _, err := DestinationRawPassthrough("testdest"); err == nil {
+		t.Error("an invalid value should be rejected")
+	}
+}
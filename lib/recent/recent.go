@@ -0,0 +1,200 @@
+// Package recent keeps the last messages that went through ecs-logs in memory
+// so they can be inspected over HTTP without going to the destinations.
+package recent
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+// Buffer is a ring buffer of the most recent messages, bounded both by the
+// number of messages and by their total size in bytes.
+//
+// The lock is only held to insert or copy out entries, the sizes of messages
+// are computed and the filters are applied outside of it so reading the buffer
+// doesn't hold back the goroutine adding messages.
+type Buffer struct {
+	mutex    sync.Mutex
+	entries  []entry
+	head     int
+	count    int
+	bytes    int
+	maxBytes int
+}
+
+type entry struct {
+	msg  lib.Message
+	size int
+}
+
+// NewBuffer returns a buffer holding at most size messages and maxBytes bytes
+// of messages.
+func NewBuffer(size int, maxBytes int) *Buffer {
+	return &Buffer{
+		entries:  make([]entry, size),
+		maxBytes: maxBytes,
+	}
+}
+
+// Add inserts msg in the buffer, evicting the oldest messages to make room for
+// it. Calling Add on a nil buffer does nothing, which is how the buffer is
+// disabled. Messages bigger than the whole buffer are skipped.
+func (b *Buffer) Add(msg lib.Message) {
+	if b == nil || len(b.entries) == 0 {
+		return
+	}
+
+	size := msg.ContentLength()
+
+	if size > b.maxBytes {
+		return
+	}
+
+	b.mutex.Lock()
+
+	for b.count == len(b.entries) || (b.count != 0 && (b.bytes+size) > b.maxBytes) {
+		b.bytes -= b.entries[b.head].size
+		b.entries[b.head] = entry{}
+		b.head = (b.head + 1) % len(b.entries)
+		b.count--
+	}
+
+	b.entries[(b.head+b.count)%len(b.entries)] = entry{msg: msg, size: size}
+	b.bytes += size
+	b.count++
+
+	b.mutex.Unlock()
+}
+
+// Len returns the number of messages in the buffer.
+func (b *Buffer) Len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.count
+}
+
+// Messages returns the messages matching the filter, from the oldest to the
+// most recent.
+func (b *Buffer) Messages(f Filter) (msgs []lib.Message) {
+	b.mutex.Lock()
+	all := make([]lib.Message, b.count)
+
+	for i := range all {
+		all[i] = b.entries[(b.head+i)%len(b.entries)].msg
+	}
+
+	b.mutex.Unlock()
+
+	for _, msg := range all {
+		if f.Match(msg) {
+			msgs = append(msgs, msg)
+		}
+	}
+
+	if f.Limit > 0 && len(msgs) > f.Limit {
+		msgs = msgs[len(msgs)-f.Limit:]
+	}
+
+	return
+}
+
+// ServeHTTP responds with the messages matching the filter set in the query
+// string, one JSON object per line.
+func (b *Buffer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	f, err := ParseFilter(req.URL.Query())
+
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/x-ndjson")
+
+	for _, msg := range b.Messages(f) {
+		res.Write(msg.Bytes())
+		res.Write([]byte{'\n'})
+	}
+}
+
+// Filter selects messages from a buffer, the zero value matches all messages.
+type Filter struct {
+	// Only match messages of this group and stream when they're not empty.
+	Group  string
+	Stream string
+
+	// Only match messages at this level or more severe, messages without a
+	// level don't match when it's set.
+	Level ecslogs.Level
+
+	// Only match messages which contain Text or match Regexp.
+	Text   string
+	Regexp *regexp.Regexp
+
+	// The maximum number of messages returned, the most recent ones are kept.
+	Limit int
+}
+
+// ParseFilter returns the filter described by the group, stream, level, q,
+// regex and limit query parameters.
+func ParseFilter(query url.Values) (f Filter, err error) {
+	var s string
+
+	f.Group = query.Get("group")
+	f.Stream = query.Get("stream")
+	f.Text = query.Get("q")
+
+	if s = query.Get("level"); len(s) != 0 {
+		if f.Level, err = ecslogs.ParseLevel(strings.ToUpper(s)); err != nil {
+			err = fmt.Errorf("invalid level: %s", s)
+			return
+		}
+	}
+
+	if s = query.Get("regex"); len(s) != 0 {
+		if f.Regexp, err = regexp.Compile(s); err != nil {
+			err = fmt.Errorf("invalid regex: %s", err)
+			return
+		}
+	}
+
+	if s = query.Get("limit"); len(s) != 0 {
+		if f.Limit, err = strconv.Atoi(s); err != nil || f.Limit < 0 {
+			err = fmt.Errorf("invalid limit, must be a positive integer: %s", s)
+			return
+		}
+	}
+
+	return
+}
+
+func (f Filter) Match(msg lib.Message) bool {
+	if len(f.Group) != 0 && msg.Group != f.Group {
+		return false
+	}
+
+	if len(f.Stream) != 0 && msg.Stream != f.Stream {
+		return false
+	}
+
+	if f.Level != ecslogs.NONE && (msg.Event.Level == ecslogs.NONE || msg.Event.Level > f.Level) {
+		return false
+	}
+
+	if len(f.Text) != 0 && !strings.Contains(msg.Event.Message, f.Text) {
+		return false
+	}
+
+	if f.Regexp != nil && !f.Regexp.MatchString(msg.Event.Message) {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,176 @@
+package recent
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+func TestBufferWraparound(t *testing.T) {
+	b := NewBuffer(3, 1000000)
+
+	for _, s := range []string{"A", "B", "C", "D", "E"} {
+		b.Add(makeMessage("group", "stream", ecslogs.INFO, s))
+	}
+
+	if n := b.Len(); n != 3 {
+		t.Errorf("invalid length: %d", n)
+	}
+
+	if s := messages(b.Messages(Filter{})); !reflect.DeepEqual(s, []string{"C", "D", "E"}) {
+		t.Errorf("the oldest messages should have been evicted: %v", s)
+	}
+}
+
+func TestBufferMaxBytes(t *testing.T) {
+	m := makeMessage("group", "stream", ecslogs.INFO, "A")
+	b := NewBuffer(100, 2*m.ContentLength())
+
+	for _, s := range []string{"A", "B", "C"} {
+		b.Add(makeMessage("group", "stream", ecslogs.INFO, s))
+	}
+
+	if s := messages(b.Messages(Filter{})); !reflect.DeepEqual(s, []string{"B", "C"}) {
+		t.Errorf("the oldest messages should have been evicted to stay under the size limit: %v", s)
+	}
+
+	b.Add(makeMessage("group", "stream", ecslogs.INFO, strings.Repeat("x", 1000)))
+
+	if s := messages(b.Messages(Filter{})); !reflect.DeepEqual(s, []string{"B", "C"}) {
+		t.Errorf("messages bigger than the buffer should be skipped: %v", s)
+	}
+}
+
+func TestBufferNil(t *testing.T) {
+	var b *Buffer
+	b.Add(makeMessage("group", "stream", ecslogs.INFO, "A"))
+}
+
+func TestBufferFilter(t *testing.T) {
+	b := NewBuffer(10, 1000000)
+	b.Add(makeMessage("A", "1", ecslogs.ERROR, "request 1 failed: timeout"))
+	b.Add(makeMessage("A", "2", ecslogs.INFO, "request 2 succeeded"))
+	b.Add(makeMessage("B", "1", ecslogs.WARN, "request 3 is slow"))
+	b.Add(makeMessage("B", "1", ecslogs.NONE, "plain text line"))
+	b.Add(makeMessage("B", "2", ecslogs.CRIT, "request 4 failed: connection refused"))
+
+	tests := []struct {
+		filter Filter
+		result []string
+	}{
+		{
+			filter: Filter{Group: "A"},
+			result: []string{"request 1 failed: timeout", "request 2 succeeded"},
+		},
+		{
+			filter: Filter{Group: "B", Stream: "1"},
+			result: []string{"request 3 is slow", "plain text line"},
+		},
+		{
+			filter: Filter{Level: ecslogs.WARN},
+			result: []string{"request 1 failed: timeout", "request 3 is slow", "request 4 failed: connection refused"},
+		},
+		{
+			filter: Filter{Text: "failed"},
+			result: []string{"request 1 failed: timeout", "request 4 failed: connection refused"},
+		},
+		{
+			filter: Filter{Regexp: regexp.MustCompile(`request \d+ (is|succ)`)},
+			result: []string{"request 2 succeeded", "request 3 is slow"},
+		},
+		{
+			filter: Filter{Group: "B", Text: "request", Limit: 1},
+			result: []string{"request 4 failed: connection refused"},
+		},
+	}
+
+	for _, test := range tests {
+		if s := messages(b.Messages(test.filter)); !reflect.DeepEqual(s, test.result) {
+			t.Errorf("%+v:\n- expected: %#v\n- found:    %#v", test.filter, test.result, s)
+		}
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	q, _ := url.ParseQuery("group=A&stream=1&level=warn&q=failed&regex=%5Cd%2B&limit=10")
+	f, err := ParseFilter(q)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Group != "A" || f.Stream != "1" || f.Level != ecslogs.WARN || f.Text != "failed" || f.Regexp.String() != `\d+` || f.Limit != 10 {
+		t.Errorf("invalid filter: %+v", f)
+	}
+
+	for _, s := range []string{"level=loud", "regex=(", "limit=-1"} {
+		q, _ := url.ParseQuery(s)
+
+		if _, err := ParseFilter(q); err == nil {
+			t.Errorf("%s: parsing the filter should have failed", s)
+		}
+	}
+}
+
+func TestBufferServeHTTP(t *testing.T) {
+	b := NewBuffer(10, 1000000)
+	b.Add(makeMessage("A", "1", ecslogs.ERROR, "Hello"))
+	b.Add(makeMessage("B", "1", ecslogs.ERROR, "World"))
+
+	res := httptest.NewRecorder()
+	b.ServeHTTP(res, httptest.NewRequest("GET", "/debug/recent?group=B", nil))
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("invalid status: %d", res.Code)
+	}
+
+	var msgs []lib.Message
+
+	for s := bufio.NewScanner(res.Body); s.Scan(); {
+		var msg lib.Message
+
+		if err := json.Unmarshal(s.Bytes(), &msg); err != nil {
+			t.Fatal(err)
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	if s := messages(msgs); !reflect.DeepEqual(s, []string{"World"}) {
+		t.Errorf("invalid response: %v", s)
+	}
+
+	res = httptest.NewRecorder()
+	b.ServeHTTP(res, httptest.NewRequest("GET", "/debug/recent?regex=(", nil))
+
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("invalid status for a bad filter: %d", res.Code)
+	}
+}
+
+func makeMessage(group string, stream string, level ecslogs.Level, s string) lib.Message {
+	return lib.Message{
+		Group:  group,
+		Stream: stream,
+		Event: ecslogs.Event{
+			Level:   level,
+			Message: s,
+		},
+	}
+}
+
+func messages(msgs []lib.Message) (s []string) {
+	for _, msg := range msgs {
+		s = append(s, msg.Event.Message)
+	}
+	return
+}
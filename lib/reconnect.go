@@ -0,0 +1,238 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// Reconnect is the policy applied when the reader of a source fails, the
+// source is opened again after an exponential backoff.
+type Reconnect struct {
+	// The delay before the first attempt, doubled on each of the following
+	// attempts up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// The number of consecutive attempts before giving up, zero retries
+	// forever.
+	MaxAttempts int
+}
+
+// DefaultReconnect is the policy of the sources that don't configure one.
+var DefaultReconnect = Reconnect{
+	MinBackoff:  1 * time.Second,
+	MaxBackoff:  1 * time.Minute,
+	MaxAttempts: 10,
+}
+
+// SourceReconnect returns the reconnect policy configured for source by the
+// <SOURCE>_RECONNECT_BACKOFF, <SOURCE>_RECONNECT_MAX_BACKOFF and
+// <SOURCE>_RECONNECT_MAX_ATTEMPTS environment variables.
+func SourceReconnect(source string) (r Reconnect, err error) {
+	prefix := strings.ToUpper(source) + "_RECONNECT_"
+	r = DefaultReconnect
+
+	for _, d := range []struct {
+		env   string
+		value *time.Duration
+	}{
+		{prefix + "BACKOFF", &r.MinBackoff},
+		{prefix + "MAX_BACKOFF", &r.MaxBackoff},
+	} {
+		if s := strings.TrimSpace(Getenv(d.env)); len(s) != 0 {
+			if *d.value, err = time.ParseDuration(s); err != nil || *d.value <= 0 {
+				err = fmt.Errorf("invalid %s, must be a positive duration: %s", d.env, s)
+				return
+			}
+		}
+	}
+
+	if r.MaxBackoff < r.MinBackoff {
+		err = fmt.Errorf("invalid %sMAX_BACKOFF, must be greater than %sBACKOFF: %s", prefix, prefix, r.MaxBackoff)
+		return
+	}
+
+	if s := strings.TrimSpace(Getenv(prefix + "MAX_ATTEMPTS")); len(s) != 0 {
+		if r.MaxAttempts, err = strconv.Atoi(s); err != nil || r.MaxAttempts < 0 {
+			err = fmt.Errorf("invalid %sMAX_ATTEMPTS, must be a positive integer or zero: %s", prefix, s)
+			return
+		}
+	}
+
+	return
+}
+
+// Backoff returns the delay before the given attempt, starting at 1.
+func (r Reconnect) Backoff(attempt int) time.Duration {
+	d := r.MinBackoff
+
+	for i := 1; i < attempt && d < r.MaxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+
+	return d
+}
+
+// ReconnectError is returned by the readers of NewReconnectingReader when the
+// source couldn't be reopened within the maximum number of attempts, there's
+// no point in keeping ecs-logs running then.
+type ReconnectError struct {
+	Source   string
+	Attempts int
+	Err      error
+}
+
+func (e *ReconnectError) Error() string {
+	return fmt.Sprintf("the %s source failed to reconnect after %d attempts: %s", e.Source, e.Attempts, e.Err)
+}
+
+// NewReconnectingReader opens source and returns a reader that opens it again
+// with the r policy each time reading fails. Each reconnect is logged and
+// counted in the source_reconnects counter of registry, and the source is
+// reported as disconnected to health until it's open again.
+//
+// Readers returning io.EOF were closed gracefully, they aren't reopened.
+func NewReconnectingReader(name string, source Source, r Reconnect, registry *metrics.Registry, health *Health, clock clock.Clock) (Reader, error) {
+	reader, err := source.Open()
+
+	if err != nil {
+		return nil, err
+	}
+
+	health.SourceConnected(name)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &reconnectingReader{
+		name:       name,
+		source:     source,
+		policy:     r,
+		clock:      clock,
+		reconnects: registry.Counter("source_reconnects", "source", name),
+		health:     health,
+		ctx:        ctx,
+		cancel:     cancel,
+		reader:     reader,
+	}, nil
+}
+
+type reconnectingReader struct {
+	name       string
+	source     Source
+	policy     Reconnect
+	clock      clock.Clock
+	reconnects *metrics.Counter
+	health     *Health
+	ctx        context.Context
+	cancel     context.CancelFunc
+
+	mutex  sync.Mutex
+	reader Reader
+}
+
+func (r *reconnectingReader) Close() (err error) {
+	r.cancel()
+	r.mutex.Lock()
+
+	if r.reader != nil {
+		err = r.reader.Close()
+	}
+
+	r.mutex.Unlock()
+	return
+}
+
+// Commit saves the checkpoint of the reader that the source was last opened
+// with, if it has one.
+func (r *reconnectingReader) Commit() error {
+	r.mutex.Lock()
+	reader := r.reader
+	r.mutex.Unlock()
+	return commit(reader)
+}
+
+func (r *reconnectingReader) ReadMessage() (msg Message, err error) {
+	r.mutex.Lock()
+	reader := r.reader
+	r.mutex.Unlock()
+
+	if reader != nil {
+		if msg, err = r.read(reader); err == nil || err == io.EOF {
+			return
+		}
+		reader.Close()
+		r.health.SourceDisconnected(r.name, err)
+	}
+
+	// The attempts are counted from the last time a message was read, a
+	// source that fails again right after reconnecting keeps backing off.
+	for attempt := 1; ; attempt++ {
+		if r.policy.MaxAttempts != 0 && attempt > r.policy.MaxAttempts {
+			err = &ReconnectError{Source: r.name, Attempts: r.policy.MaxAttempts, Err: err}
+			return
+		}
+
+		backoff := r.policy.Backoff(attempt)
+
+		log.WithFields(log.Fields{
+			"source":  r.name,
+			"attempt": attempt,
+			"backoff": backoff,
+			"error":   err,
+		}).Warn("reconnecting the log source")
+
+		r.reconnects.Add(1)
+
+		if r.clock.Sleep(r.ctx, backoff) != nil {
+			err = io.EOF
+			return
+		}
+
+		if reader, err = r.source.Open(); err != nil {
+			continue
+		}
+
+		r.mutex.Lock()
+		r.reader = reader
+		r.mutex.Unlock()
+
+		// The reader may have been closed while the new one was opening.
+		if r.ctx.Err() != nil {
+			reader.Close()
+			err = io.EOF
+			return
+		}
+
+		// The source is only reported as connected again once a message
+		// was read, the ones that fail right after being opened are still
+		// disconnected.
+		if msg, err = r.read(reader); err == nil || err == io.EOF {
+			r.health.SourceConnected(r.name)
+			return
+		}
+
+		reader.Close()
+	}
+}
+
+// read reads a message from reader, the errors of readers that were closed
+// while reading are reported as io.EOF.
+func (r *reconnectingReader) read(reader Reader) (msg Message, err error) {
+	if msg, err = reader.ReadMessage(); err != nil && r.ctx.Err() != nil {
+		err = io.EOF
+	}
+	return
+}
@@ -0,0 +1,191 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// sleepRecorder is a fake clock recording the duration of each sleep.
+type sleepRecorder struct {
+	*clock.Fake
+	sleeps []time.Duration
+}
+
+func (c *sleepRecorder) Sleep(ctx context.Context, d time.Duration) error {
+	c.sleeps = append(c.sleeps, d)
+	return c.Fake.Sleep(ctx, d)
+}
+
+// flakySource opens readers that return the messages of the source until
+// they fail, the opens fail as long as openErrors isn't empty.
+type flakySource struct {
+	messages   []string
+	failAfter  int
+	openErrors []error
+	opens      int
+}
+
+func (s *flakySource) Open() (Reader, error) {
+	s.opens++
+	if len(s.openErrors) != 0 {
+		err := s.openErrors[0]
+		s.openErrors = s.openErrors[1:]
+		return nil, err
+	}
+	return &flakyReader{source: s}, nil
+}
+
+type flakyReader struct {
+	source *flakySource
+	count  int
+}
+
+func (r *flakyReader) Close() error { return nil }
+
+func (r *flakyReader) ReadMessage() (msg Message, err error) {
+	switch {
+	case len(r.source.messages) == 0:
+		err = io.EOF
+	case r.count == r.source.failAfter:
+		err = errors.New("connection reset")
+	default:
+		msg.Event = ecslogs.Event{Message: r.source.messages[0]}
+		r.source.messages = r.source.messages[1:]
+		r.count++
+	}
+	return
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	p := Reconnect{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}
+
+	var found []time.Duration
+	for attempt := 1; attempt <= 6; attempt++ {
+		found = append(found, p.Backoff(attempt))
+	}
+
+	if ref := []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}; !reflect.DeepEqual(found, ref) {
+		t.Errorf("invalid backoff schedule:\n- expected: %v\n- found:    %v", ref, found)
+	}
+}
+
+func TestReconnectingReader(t *testing.T) {
+	defer captureWarnings()()
+
+	c := &sleepRecorder{Fake: clock.NewFake(time.Now())}
+	registry := metrics.NewRegistry()
+	source := &flakySource{
+		messages:   []string{"A", "B", "C", "D"},
+		failAfter:  2,
+		openErrors: nil,
+	}
+
+	r, err := NewReconnectingReader("test", source, Reconnect{MinBackoff: time.Second, MaxBackoff: time.Minute, MaxAttempts: 5}, registry, nil, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	var found []string
+
+	for i := 0; i != 2; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		found = append(found, msg.Event.Message)
+	}
+
+	// The reader fails after two messages, the next two opens fail as well.
+	source.openErrors = []error{errors.New("refused"), errors.New("refused")}
+
+	for {
+		msg, err := r.ReadMessage()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		found = append(found, msg.Event.Message)
+	}
+
+	if ref := []string{"A", "B", "C", "D"}; !reflect.DeepEqual(found, ref) {
+		t.Errorf("invalid messages:\n- expected: %v\n- found:    %v", ref, found)
+	}
+
+	if ref := []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second}; !reflect.DeepEqual(c.sleeps, ref) {
+		t.Errorf("invalid backoff schedule:\n- expected: %v\n- found:    %v", ref, c.sleeps)
+	}
+
+	if n := registry.Counter("source_reconnects", "source", "test").Value(); n != 3 {
+		t.Errorf("invalid number of reconnects: %d", n)
+	}
+}
+
+func TestReconnectingReaderExhausted(t *testing.T) {
+	defer captureWarnings()()
+
+	c := &sleepRecorder{Fake: clock.NewFake(time.Now())}
+	source := &flakySource{messages: []string{"A"}, failAfter: 0}
+
+	r, err := NewReconnectingReader("test", source, Reconnect{MinBackoff: time.Second, MaxBackoff: 2 * time.Second, MaxAttempts: 3}, metrics.NewRegistry(), nil, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	source.openErrors = []error{errors.New("refused"), errors.New("refused"), errors.New("refused")}
+
+	_, err = r.ReadMessage()
+
+	if e, ok := err.(*ReconnectError); !ok || e.Source != "test" || e.Attempts != 3 || e.Err.Error() != "refused" {
+		t.Errorf("expected a reconnect error after 3 attempts: %v", err)
+	}
+
+	if ref := []time.Duration{1 * time.Second, 2 * time.Second, 2 * time.Second}; !reflect.DeepEqual(c.sleeps, ref) {
+		t.Errorf("invalid backoff schedule:\n- expected: %v\n- found:    %v", ref, c.sleeps)
+	}
+}
+
+func TestReconnectingReaderClosed(t *testing.T) {
+	source := &flakySource{messages: []string{"A"}, failAfter: 0}
+
+	r, err := NewReconnectingReader("test", source, DefaultReconnect, metrics.NewRegistry(), nil, clock.NewFake(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Close()
+
+	if _, err := r.ReadMessage(); err != io.EOF || source.opens != 1 {
+		t.Errorf("a closed reader shouldn't reconnect: %v (%d opens)", err, source.opens)
+	}
+}
+
+func TestSourceReconnect(t *testing.T) {
+	os.Setenv("TESTSRC_RECONNECT_BACKOFF", "100ms")
+	os.Setenv("TESTSRC_RECONNECT_MAX_ATTEMPTS", "0")
+	defer os.Unsetenv("TESTSRC_RECONNECT_BACKOFF")
+	defer os.Unsetenv("TESTSRC_RECONNECT_MAX_ATTEMPTS")
+
+	if r, err := SourceReconnect("testsrc"); err != nil || r.MinBackoff != 100*time.Millisecond || r.MaxBackoff != time.Minute || r.MaxAttempts != 0 {
+		t.Errorf("invalid reconnect policy: %+v (%v)", r, err)
+	}
+
+	os.Setenv("TESTSRC_RECONNECT_MAX_BACKOFF", "10ms")
+	defer os.Unsetenv("TESTSRC_RECONNECT_MAX_BACKOFF")
+
+	if _, err := SourceReconnect("testsrc"); err == nil {
+		t.Error("expected an error when the maximum backoff is lower than the backoff")
+	}
+}
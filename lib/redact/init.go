@@ -0,0 +1,14 @@
+package redact
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterStage("redact", lib.NewCheckedStage(lib.StageFunc(NewProcessor), checkConfig))
+
+	// The text and fields added by the other stages must be redacted too,
+	// and the hashed fields are strings that validate should see as such.
+	lib.RegisterStageOrder("redact", lib.StageOrder{
+		After:  []string{"correlation", "merge", "metadata", "stacktrace", "summary", "xray"},
+		Before: []string{"validate"},
+	})
+}
@@ -0,0 +1,340 @@
+// Package redact implements the redact stage, which removes the sensitive
+// values from the messages before they leave the host: the values matching its
+// patterns are masked in the text and data of the messages, and the listed
+// data fields are removed or replaced with a hash of their value.
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// The data identifiers of the CloudWatch Logs data protection policies that
+// mask the same values as the builtin patterns, the groups whose destination
+// masks them are left to it.
+var identifiers = map[string]string{
+	"email":       "EmailAddress",
+	"credit-card": "CreditCardNumber",
+	"ssn":         "Ssn-US",
+}
+
+type config struct {
+	patterns []lib.SensitivePattern
+
+	// The paths of the data fields that are removed, and of the ones whose
+	// values are replaced with their hash.
+	remove [][]string
+	hash   [][]string
+
+	// The key of the HMAC which hashes the values, they're plain SHA-256
+	// hashes without one.
+	key []byte
+
+	// The glob patterns of the groups that are redacted, all of them when
+	// there are none.
+	groups []string
+}
+
+func getConfig() (c config, err error) {
+	if c.patterns, err = lib.ParseSensitivePatterns(lib.Getenv("REDACT_PATTERNS")); err != nil {
+		err = fmt.Errorf("invalid REDACT_PATTERNS, %s", err)
+		return
+	}
+
+	if c.remove, err = parsePaths("REDACT_REMOVE_FIELDS"); err != nil {
+		return
+	}
+
+	if c.hash, err = parsePaths("REDACT_HASH_FIELDS"); err != nil {
+		return
+	}
+
+	if s := lib.Getenv("REDACT_HASH_KEY"); len(s) != 0 {
+		c.key = []byte(s)
+	}
+
+	for _, g := range strings.Split(lib.Getenv("REDACT_GROUPS"), ",") {
+		if g = strings.TrimSpace(g); len(g) == 0 {
+			continue
+		}
+
+		if _, e := path.Match(g, ""); e != nil {
+			err = fmt.Errorf("invalid REDACT_GROUPS, bad pattern: %s", g)
+			return
+		}
+
+		c.groups = append(c.groups, g)
+	}
+
+	if len(c.patterns) == 0 && len(c.remove) == 0 && len(c.hash) == 0 {
+		err = fmt.Errorf("the redact stage needs at least one of REDACT_PATTERNS, REDACT_REMOVE_FIELDS or REDACT_HASH_FIELDS")
+	}
+
+	return
+}
+
+// parsePaths parses the comma separated list of dotted data paths set in the
+// variable called name.
+func parsePaths(name string) (paths [][]string, err error) {
+	for _, p := range strings.Split(lib.Getenv(name), ",") {
+		if p = strings.TrimSpace(p); len(p) == 0 {
+			continue
+		}
+
+		keys := strings.Split(p, ".")
+
+		for _, k := range keys {
+			if len(k) == 0 {
+				err = fmt.Errorf("invalid %s, bad field path: %s", name, p)
+				return
+			}
+		}
+
+		paths = append(paths, keys)
+	}
+	return
+}
+
+func NewProcessor() (p lib.Processor, err error) {
+	var c config
+
+	if c, err = getConfig(); err == nil {
+		p = newProcessor(c, metrics.Default)
+	}
+
+	return
+}
+
+func checkConfig() (err error) {
+	_, err = getConfig()
+	return
+}
+
+type processor struct {
+	config
+	registry *metrics.Registry
+}
+
+func newProcessor(c config, registry *metrics.Registry) *processor {
+	return &processor{config: c, registry: registry}
+}
+
+func (p *processor) Process(msg lib.Message, now time.Time) []lib.Message {
+	if !p.redacted(msg.Group) {
+		return []lib.Message{msg}
+	}
+
+	// The data of the message may be shared with other messages, the maps
+	// are copied on the way to the values that change.
+	data := map[string]interface{}(msg.Event.Data)
+	changed := false
+
+	for _, keys := range p.remove {
+		if d, ok := edit(data, keys, nil); ok {
+			data, changed = d, true
+			p.count("remove", keys)
+		}
+	}
+
+	for _, keys := range p.hash {
+		if d, ok := edit(data, keys, p.digest); ok {
+			data, changed = d, true
+			p.count("hash", keys)
+		}
+	}
+
+	if patterns := p.active(msg.Group); len(patterns) != 0 {
+		var masked bool
+
+		if msg.Event.Message, masked = p.mask(msg.Event.Message, patterns); masked {
+			changed = true
+		}
+
+		if v, masked := p.maskValue(data, patterns); masked {
+			data, changed = v.(map[string]interface{}), true
+		}
+	}
+
+	// The raw line of the message isn't passed through once it's changed,
+	// it still has the original values.
+	if changed {
+		msg.Event.Data = ecslogs.EventData(data)
+	}
+
+	return []lib.Message{msg}
+}
+
+func (p *processor) Flush(now time.Time) []lib.Message {
+	return nil
+}
+
+// redacted returns true if the messages of group are redacted.
+func (p *processor) redacted(group string) bool {
+	if len(p.groups) == 0 {
+		return true
+	}
+
+	for _, g := range p.groups {
+		if ok, _ := path.Match(g, group); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// active returns the patterns that mask the values of group, without the ones
+// that its destination masks when it's stored.
+func (p *processor) active(group string) []lib.SensitivePattern {
+	for i, pt := range p.patterns {
+		if id, ok := identifiers[pt.Name]; ok && lib.ServerMasked(group, id) {
+			patterns := append([]lib.SensitivePattern{}, p.patterns[:i]...)
+
+			for _, pt := range p.patterns[i+1:] {
+				if id, ok := identifiers[pt.Name]; !ok || !lib.ServerMasked(group, id) {
+					patterns = append(patterns, pt)
+				}
+			}
+
+			return patterns
+		}
+	}
+	return p.patterns
+}
+
+func (p *processor) mask(s string, patterns []lib.SensitivePattern) (string, bool) {
+	masked := false
+
+	for _, pt := range patterns {
+		if pt.Match(s) {
+			s, masked = pt.Mask(s), true
+			p.registry.Counter("redacted_values", "stage", "redact", "pattern", pt.Name).Add(1)
+		}
+	}
+
+	return s, masked
+}
+
+// maskValue masks the strings found in v, the maps and slices holding them are
+// copied.
+func (p *processor) maskValue(v interface{}, patterns []lib.SensitivePattern) (interface{}, bool) {
+	switch x := v.(type) {
+	case string:
+		return p.mask(x, patterns)
+
+	case ecslogs.EventData:
+		return p.maskValue(map[string]interface{}(x), patterns)
+
+	case map[string]interface{}:
+		var c map[string]interface{}
+
+		for k, e := range x {
+			if e, masked := p.maskValue(e, patterns); masked {
+				if c == nil {
+					c = copyMap(x)
+				}
+				c[k] = e
+			}
+		}
+
+		if c != nil {
+			return c, true
+		}
+
+	case []interface{}:
+		var c []interface{}
+
+		for i, e := range x {
+			if e, masked := p.maskValue(e, patterns); masked {
+				if c == nil {
+					c = append([]interface{}{}, x...)
+				}
+				c[i] = e
+			}
+		}
+
+		if c != nil {
+			return c, true
+		}
+	}
+
+	return v, false
+}
+
+// digest returns the hex encoded hash of v, prefixed with the algorithm so it
+// can't be mistaken for an original value.
+func (p *processor) digest(v interface{}) interface{} {
+	s := fmt.Sprint(v)
+
+	if p.key == nil {
+		sum := sha256.Sum256([]byte(s))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	h := hmac.New(sha256.New, p.key)
+	h.Write([]byte(s))
+	return "hmac-sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+func (p *processor) count(action string, keys []string) {
+	p.registry.Counter("redacted_fields", "stage", "redact", "action", action, "field", strings.Join(keys, ".")).Add(1)
+}
+
+// edit returns a copy of data where the field at keys is replaced with the
+// result of f, or removed when f is nil. The maps on the path are copied and
+// the other ones shared with data. It returns false if the field isn't set.
+func edit(data map[string]interface{}, keys []string, f func(interface{}) interface{}) (map[string]interface{}, bool) {
+	v, ok := data[keys[0]]
+
+	if !ok {
+		return data, false
+	}
+
+	if len(keys) > 1 {
+		var m map[string]interface{}
+
+		switch x := v.(type) {
+		case map[string]interface{}:
+			m = x
+		case ecslogs.EventData:
+			m = x
+		default:
+			return data, false
+		}
+
+		if v, ok = edit(m, keys[1:], f); !ok {
+			return data, false
+		}
+	} else if f != nil {
+		v = f(v)
+	}
+
+	c := copyMap(data)
+
+	if len(keys) == 1 && f == nil {
+		delete(c, keys[0])
+	} else {
+		c[keys[0]] = v
+	}
+
+	return c, true
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(m))
+
+	for k, v := range m {
+		c[k] = v
+	}
+
+	return c
+}
@@ -0,0 +1,152 @@
+package redact
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+func newTestProcessor(t *testing.T, env map[string]string) (*processor, *metrics.Registry) {
+	lib.SetConfigEnv(env)
+	defer lib.SetConfigEnv(nil)
+
+	c, err := getConfig()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry := metrics.NewRegistry()
+	return newProcessor(c, registry), registry
+}
+
+func TestProcessorRedact(t *testing.T) {
+	p, registry := newTestProcessor(t, map[string]string{
+		"REDACT_PATTERNS":      "email, token=tok_[a-z0-9]+",
+		"REDACT_REMOVE_FIELDS": "card_number, user.password",
+		"REDACT_HASH_FIELDS":   "user.email",
+	})
+
+	user := map[string]interface{}{"email": "bob@example.com", "password": "hunter2", "name": "Bob"}
+	data := ecslogs.EventData{
+		"card_number": "4111111111111111",
+		"user":        user,
+		"tags":        []interface{}{"ok", "paid with tok_abc123"},
+		"status":      200,
+	}
+
+	msg := lib.Message{Group: "A", Stream: "B", Event: ecslogs.Event{Message: "signup from bob@example.com", Data: data}}
+	res := p.Process(msg, time.Now())[0]
+
+	if res.Event.Message != "signup from [REDACTED]" {
+		t.Errorf("invalid message: %q", res.Event.Message)
+	}
+
+	if _, ok := res.Event.Data["card_number"]; ok {
+		t.Error("the removed fields should not be in the data")
+	}
+
+	u := res.Event.Data["user"].(map[string]interface{})
+
+	if _, ok := u["password"]; ok || u["name"] != "Bob" {
+		t.Errorf("invalid nested fields: %v", u)
+	}
+
+	if s, _ := u["email"].(string); !strings.HasPrefix(s, "sha256:") || len(s) != 7+64 {
+		t.Errorf("the hashed field should hold the hash of its value: %v", u["email"])
+	}
+
+	if tags := res.Event.Data["tags"].([]interface{}); tags[1] != "paid with [REDACTED]" {
+		t.Errorf("the strings of the data should be masked: %v", tags)
+	}
+
+	if len(data) != 4 || user["password"] != "hunter2" || user["email"] != "bob@example.com" || data["tags"].([]interface{})[1] != "paid with tok_abc123" {
+		t.Error("the data of the original message should not be modified:", data)
+	}
+
+	if n := registry.Counter("redacted_values", "stage", "redact", "pattern", "email").Value(); n != 1 {
+		t.Error("invalid number of masked values:", n)
+	}
+
+	if n := registry.Counter("redacted_fields", "stage", "redact", "action", "remove", "field", "user.password").Value(); n != 1 {
+		t.Error("invalid number of removed fields:", n)
+	}
+}
+
+func TestProcessorHashKey(t *testing.T) {
+	p, _ := newTestProcessor(t, map[string]string{"REDACT_HASH_FIELDS": "email", "REDACT_HASH_KEY": "secret"})
+	q, _ := newTestProcessor(t, map[string]string{"REDACT_HASH_FIELDS": "email", "REDACT_HASH_KEY": "other"})
+
+	msg := lib.Message{Event: ecslogs.Event{Data: ecslogs.EventData{"email": "bob@example.com"}}}
+	a := p.Process(msg, time.Now())[0].Event.Data["email"]
+	b := q.Process(msg, time.Now())[0].Event.Data["email"]
+
+	if s, _ := a.(string); !strings.HasPrefix(s, "hmac-sha256:") || a == b {
+		t.Errorf("the values should be hashed with the key: %v, %v", a, b)
+	}
+
+	if c := p.Process(msg, time.Now())[0].Event.Data["email"]; c != a {
+		t.Error("the hashes should be stable:", a, c)
+	}
+}
+
+func TestProcessorGroups(t *testing.T) {
+	p, _ := newTestProcessor(t, map[string]string{"REDACT_PATTERNS": "email", "REDACT_GROUPS": "/ecs/users*"})
+
+	for group, expected := range map[string]string{
+		"/ecs/users-api": "[REDACTED]",
+		"/ecs/billing":   "bob@example.com",
+	} {
+		msg := lib.Message{Group: group, Event: ecslogs.Event{Message: "bob@example.com"}}
+
+		if s := p.Process(msg, time.Now())[0].Event.Message; s != expected {
+			t.Errorf("%s: invalid message: %q", group, s)
+		}
+	}
+}
+
+func TestProcessorServerMasked(t *testing.T) {
+	p, _ := newTestProcessor(t, map[string]string{"REDACT_PATTERNS": "email,ssn"})
+
+	lib.SetServerMasking("masked", []string{"EmailAddress"})
+	defer lib.SetServerMasking("masked", nil)
+
+	msg := lib.Message{Group: "masked", Event: ecslogs.Event{Message: "bob@example.com 123-45-6789"}}
+
+	if s := p.Process(msg, time.Now())[0].Event.Message; s != "bob@example.com [REDACTED]" {
+		t.Errorf("the values masked by the destination should be left to it: %q", s)
+	}
+}
+
+func TestProcessorPassThrough(t *testing.T) {
+	p, _ := newTestProcessor(t, map[string]string{"REDACT_PATTERNS": "email", "REDACT_REMOVE_FIELDS": "password"})
+
+	data := ecslogs.EventData{"status": 200}
+	res := p.Process(lib.Message{Event: ecslogs.Event{Message: "hello", Data: data}}, time.Now())[0]
+	res.Event.Data["x"] = 1
+
+	if _, ok := data["x"]; !ok {
+		t.Error("the data should not be copied when nothing is redacted")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	for _, env := range []map[string]string{
+		nil,
+		{"REDACT_PATTERNS": "phone"},
+		{"REDACT_REMOVE_FIELDS": "user..email"},
+		{"REDACT_PATTERNS": "email", "REDACT_GROUPS": "[api"},
+	} {
+		lib.SetConfigEnv(env)
+
+		if _, err := getConfig(); err == nil {
+			t.Errorf("%v: the configuration should be rejected", env)
+		}
+	}
+}
@@ -0,0 +1,507 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// SensitivePattern matches a kind of sensitive value that must never leave the
+// host, like email addresses or access keys.
+type SensitivePattern struct {
+	Name   string
+	Regexp *regexp.Regexp
+
+	// valid filters the matches of the regexp, when it isn't nil.
+	valid func(string) bool
+}
+
+// Match returns true if s contains a value matched by p.
+func (p SensitivePattern) Match(s string) bool {
+	if p.valid == nil {
+		return p.Regexp.MatchString(s)
+	}
+
+	for _, m := range p.Regexp.FindAllString(s, -1) {
+		if p.valid(m) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Mask returns s with the values matched by p replaced with [REDACTED].
+func (p SensitivePattern) Mask(s string) string {
+	return p.Regexp.ReplaceAllStringFunc(s, func(m string) string {
+		if p.valid != nil && !p.valid(m) {
+			return m
+		}
+		return "[REDACTED]"
+	})
+}
+
+var builtinPatterns = map[string]SensitivePattern{
+	"email": {
+		Regexp: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+	},
+	// Long numbers are common in logs, only the ones with a valid checksum
+	// are reported.
+	"credit-card": {
+		Regexp: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`),
+		valid:  luhn,
+	},
+	"ssn": {
+		Regexp: regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`),
+	},
+	"aws-access-key": {
+		Regexp: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+	},
+	"bearer-token": {
+		Regexp: regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/-]{8,}=*`),
+	},
+	"private-key": {
+		Regexp: regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`),
+	},
+}
+
+// ParseSensitivePatterns parses s, a comma separated list of patterns. Each one
+// is either the name of a builtin pattern (email, credit-card, ssn,
+// aws-access-key, bearer-token or private-key) or a custom one written
+// name=regexp, whose regexp can't have commas (\x2c matches one).
+func ParseSensitivePatterns(s string) (patterns []SensitivePattern, err error) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+
+		if kv := strings.SplitN(item, "=", 2); len(kv) == 2 {
+			name := strings.TrimSpace(kv[0])
+			re, e := regexp.Compile(kv[1])
+
+			if len(name) == 0 || e != nil {
+				err = fmt.Errorf("invalid custom pattern, expected name=regexp: %s", item)
+				return
+			}
+
+			patterns = append(patterns, SensitivePattern{Name: name, Regexp: re})
+			continue
+		}
+
+		p, ok := builtinPatterns[item]
+
+		if !ok {
+			err = fmt.Errorf("unknown pattern, must be one of %s or name=regexp: %s", strings.Join(builtinPatternNames(), ", "), item)
+			return
+		}
+
+		p.Name = item
+		patterns = append(patterns, p)
+	}
+
+	return
+}
+
+func builtinPatternNames() []string {
+	names := make([]string, 0, len(builtinPatterns))
+
+	for name := range builtinPatterns {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// luhn returns true if the digits of s have a valid Luhn checksum, the spaces
+// and dashes are ignored.
+func luhn(s string) bool {
+	sum, n := 0, 0
+
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+
+		if c < '0' || c > '9' {
+			continue
+		}
+
+		d := int(c - '0')
+
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+
+		sum += d
+		n++
+	}
+
+	return n != 0 && sum%10 == 0
+}
+
+// LeakAction is what happens to the messages found with sensitive values that
+// weren't redacted.
+type LeakAction int
+
+const (
+	// LeakAlert only logs and counts the leaks, the messages are delivered.
+	LeakAlert LeakAction = iota
+
+	// LeakDeadLetter sends the messages to the dead-letter group instead,
+	// with the sensitive values masked.
+	LeakDeadLetter
+
+	// LeakDrop drops the messages.
+	LeakDrop
+)
+
+func ParseLeakAction(s string) (a LeakAction, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "alert":
+		a = LeakAlert
+	case "dead-letter":
+		a = LeakDeadLetter
+	case "drop":
+		a = LeakDrop
+	default:
+		err = fmt.Errorf("must be one of alert, dead-letter or drop: %s", s)
+	}
+	return
+}
+
+// RedactionAudit verifies that the messages written to a destination were
+// redacted, by scanning what the destination sends for sensitive values. It's
+// a safety net for the fields that the redaction missed, the messages aren't
+// redacted by the audit.
+//
+// The zero value is disabled.
+type RedactionAudit struct {
+	Patterns []SensitivePattern
+
+	// The fraction of the messages that are scanned, between 0 and 1.
+	Sample float64
+	Action LeakAction
+
+	// The group that the leaking messages are sent to with LeakDeadLetter,
+	// {group} and {stream} are replaced with the names of the original stream.
+	DeadLetterGroup string
+
+	// Raw is true when the destination sends the raw lines of the messages,
+	// they're what gets scanned then.
+	Raw bool
+}
+
+// DestinationRedactionAudit returns the redaction audit of destination, as
+// configured by the <DESTINATION>_REDACTION_AUDIT (the list of patterns),
+// <DESTINATION>_REDACTION_AUDIT_SAMPLE and <DESTINATION>_REDACTION_AUDIT_ACTION
+// environment variables.
+func DestinationRedactionAudit(destination string, deadLetterGroup string) (a RedactionAudit, err error) {
+	prefix := strings.ToUpper(destination) + "_REDACTION_AUDIT"
+	a = RedactionAudit{Sample: 1, DeadLetterGroup: deadLetterGroup}
+
+	if a.Patterns, err = ParseSensitivePatterns(Getenv(prefix)); err != nil {
+		err = fmt.Errorf("invalid %s, %s", prefix, err)
+		return
+	}
+
+	if s := strings.TrimSpace(Getenv(prefix + "_SAMPLE")); len(s) != 0 {
+		if a.Sample, err = strconv.ParseFloat(s, 64); err != nil || a.Sample < 0 || a.Sample > 1 {
+			err = fmt.Errorf("invalid %s_SAMPLE, must be a number between 0 and 1: %s", prefix, s)
+			return
+		}
+	}
+
+	if a.Action, err = ParseLeakAction(Getenv(prefix + "_ACTION")); err != nil {
+		err = fmt.Errorf("invalid %s_ACTION, %s", prefix, err)
+		return
+	}
+
+	a.Raw, err = DestinationRawPassthrough(destination)
+	return
+}
+
+// Enabled returns true if the audit has patterns to scan for.
+func (a RedactionAudit) Enabled() bool {
+	return len(a.Patterns) != 0
+}
+
+// Leak describes the sensitive values found in a message by an audit.
+type Leak struct {
+	// The names of the patterns that matched, in the order of the audit.
+	Patterns []string
+
+	// The paths of the fields holding the values, like message or
+	// data.user.email, or raw when the raw line was scanned.
+	Fields []string
+}
+
+// Scan returns the values of msg that the patterns of a match, or nil if there
+// are none. The payload is the one that the destination sends, the raw line or
+// the serialized message, so the fields added or modified after the redaction
+// are scanned too.
+func (a RedactionAudit) Scan(msg Message) *Leak {
+	line, raw := msg.RawLine()
+	raw = raw && a.Raw
+
+	if !raw {
+		line = string(msg.Bytes())
+	}
+
+	var leak *Leak
+
+	for _, p := range a.Patterns {
+		if p.Match(line) {
+			if leak == nil {
+				leak = &Leak{}
+			}
+			leak.Patterns = append(leak.Patterns, p.Name)
+		}
+	}
+
+	if leak == nil {
+		return nil
+	}
+
+	// The matches are located in a second pass, messages rarely leak so it
+	// isn't worth walking the fields of every one of them.
+	if raw {
+		leak.Fields = []string{"raw"}
+	} else {
+		var v interface{}
+		json.Unmarshal([]byte(line), &v)
+		leak.Fields = a.locate(v, "", nil)
+	}
+
+	sort.Strings(leak.Fields)
+	return leak
+}
+
+// locate appends the paths of the string values of v that the patterns match
+// to fields. The paths are relative to the event of the messages.
+func (a RedactionAudit) locate(v interface{}, path string, fields []string) []string {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, e := range x {
+			p := k
+
+			if len(path) != 0 {
+				p = path + "." + k
+			} else if k == "event" {
+				p = ""
+			}
+
+			fields = a.locate(e, p, fields)
+		}
+
+	case []interface{}:
+		for i, e := range x {
+			fields = a.locate(e, path+"["+strconv.Itoa(i)+"]", fields)
+		}
+
+	case string:
+		for _, p := range a.Patterns {
+			if p.Match(x) {
+				return append(fields, path)
+			}
+		}
+	}
+
+	return fields
+}
+
+// Mask returns a copy of msg with the matches of the patterns of a masked in
+// its message and data.
+func (a RedactionAudit) Mask(msg Message) Message {
+	data, _ := a.mask(map[string]interface{}(msg.Event.Data)).(map[string]interface{})
+	msg.Event.Message = a.mask(msg.Event.Message).(string)
+	msg.Event.Data = ecslogs.EventData(data)
+	return msg
+}
+
+func (a RedactionAudit) mask(v interface{}) interface{} {
+	switch x := v.(type) {
+	case string:
+		for _, p := range a.Patterns {
+			x = p.Mask(x)
+		}
+		return x
+
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(x)+1)
+		for k, e := range x {
+			c[k] = a.mask(e)
+		}
+		return c
+
+	case ecslogs.EventData:
+		return a.mask(map[string]interface{}(x))
+
+	case []interface{}:
+		c := make([]interface{}, len(x))
+		for i, e := range x {
+			c[i] = a.mask(e)
+		}
+		return c
+
+	default:
+		return v
+	}
+}
+
+// NewRedactionAuditDestination wraps dest so a sample of the messages written
+// to it are scanned for the patterns of audit. The leaks are logged, with the
+// patterns and fields but never the values, counted in the redaction_leaks
+// metric of registry, and handled according to the action of audit.
+func NewRedactionAuditDestination(name string, dest Destination, audit RedactionAudit, registry *metrics.Registry) Destination {
+	if !audit.Enabled() {
+		return dest
+	}
+	return redactionAuditDestination{
+		Destination: dest,
+		name:        name,
+		audit:       audit,
+		registry:    registry,
+		sample:      rand.Float64,
+	}
+}
+
+type redactionAuditDestination struct {
+	Destination
+	name     string
+	audit    RedactionAudit
+	registry *metrics.Registry
+	sample   func() float64
+}
+
+func (d redactionAuditDestination) Open(group string, stream string) (w Writer, err error) {
+	if w, err = d.Destination.Open(group, stream); err == nil {
+		w = redactionAuditWriter{
+			Writer: w,
+			dest:   d,
+			group:  group,
+			stream: stream,
+		}
+	}
+	return
+}
+
+type redactionAuditWriter struct {
+	Writer
+	dest   redactionAuditDestination
+	group  string
+	stream string
+}
+
+func (w redactionAuditWriter) WriteMessage(msg Message) error {
+	return w.WriteMessageBatch(MessageBatch{msg})
+}
+
+func (w redactionAuditWriter) WriteMessageBatch(batch MessageBatch) (err error) {
+	_, err = w.WriteMessageBatchSize(batch)
+	return
+}
+
+func (w redactionAuditWriter) WriteMessageBatchSize(batch MessageBatch) (int, error) {
+	return w.write(batch, WriteMessageBatchSize)
+}
+
+func (w redactionAuditWriter) WriteUrgentMessageBatch(batch MessageBatch) (int, error) {
+	return w.write(batch, WriteUrgentMessageBatch)
+}
+
+func (w redactionAuditWriter) write(batch MessageBatch, write func(Writer, MessageBatch) (int, error)) (size int, err error) {
+	d := w.dest
+	var clean, leaked MessageBatch
+
+	for _, msg := range batch {
+		var leak *Leak
+
+		if d.audit.Sample >= 1 || d.sample() < d.audit.Sample {
+			leak = d.audit.Scan(msg)
+		}
+
+		if leak == nil {
+			clean = append(clean, msg)
+			continue
+		}
+
+		leaked = append(leaked, msg)
+
+		for _, p := range leak.Patterns {
+			d.registry.Counter("redaction_leaks", "destination", d.name, "pattern", p).Add(1)
+		}
+
+		log.WithFields(log.Fields{
+			"group":       msg.Group,
+			"stream":      msg.Stream,
+			"destination": d.name,
+			"patterns":    strings.Join(leak.Patterns, ","),
+			"fields":      strings.Join(leak.Fields, ","),
+			"action":      d.audit.Action.String(),
+		}).Error("found sensitive values that weren't redacted")
+	}
+
+	if leaked == nil || d.audit.Action == LeakAlert {
+		return write(w.Writer, batch)
+	}
+
+	if len(clean) != 0 {
+		if size, err = write(w.Writer, clean); err != nil {
+			return
+		}
+	}
+
+	if d.audit.Action == LeakDeadLetter {
+		var n int
+		n, err = w.deadLetter(leaked, write)
+		size += n
+	}
+
+	return
+}
+
+// deadLetter sends the leaking messages to the dead-letter group, masked since
+// the group is delivered by the same destination.
+func (w redactionAuditWriter) deadLetter(batch MessageBatch, write func(Writer, MessageBatch) (int, error)) (size int, err error) {
+	d := w.dest
+	group := strings.NewReplacer("{group}", w.group, "{stream}", w.stream).Replace(d.audit.DeadLetterGroup)
+	deadLetters := make(MessageBatch, len(batch))
+
+	for i, msg := range batch {
+		res := d.audit.Mask(msg)
+		res.Group = group
+		res.Event.Data = copyData(res.Event.Data, 1)
+		res.Event.Data[DeadLetterField] = DeadLetterInfo(msg, "the message has sensitive values that weren't redacted", nil)
+		deadLetters[i] = res
+	}
+
+	dl, err := d.Destination.Open(group, w.stream)
+
+	if err == nil {
+		size, err = write(dl, deadLetters)
+		dl.Close()
+		d.Destination.Close(group, w.stream)
+	}
+
+	return
+}
+
+func (a LeakAction) String() string {
+	switch a {
+	case LeakDeadLetter:
+		return "dead-letter"
+	case LeakDrop:
+		return "drop"
+	default:
+		return "alert"
+	}
+}
@@ -0,0 +1,7 @@
+package repeat
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterStage("repeat", lib.NewCheckedStage(lib.StageFunc(NewProcessor), checkConfig))
+}
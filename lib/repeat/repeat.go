@@ -0,0 +1,153 @@
+// Package repeat implements the repeat stage, which collapses the runs of
+// identical consecutive messages of each stream into the first message and a
+// rollup counting the repeats.
+package repeat
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+// Field is the data field of rollups carrying the number of repeats.
+const Field = "repeated"
+
+type config struct {
+	// How long the repeats of a run are held before a rollup is emitted for
+	// them, so a run that never ends still gets reported.
+	timeout time.Duration
+}
+
+func getConfig() (c config, err error) {
+	c.timeout = 30 * time.Second
+
+	if s := strings.TrimSpace(lib.Getenv("REPEAT_TIMEOUT")); len(s) != 0 {
+		if c.timeout, err = time.ParseDuration(s); err != nil || c.timeout <= 0 {
+			err = fmt.Errorf("invalid REPEAT_TIMEOUT, must be a positive duration: %s", s)
+			return
+		}
+	}
+
+	return
+}
+
+func NewProcessor() (p lib.Processor, err error) {
+	var c config
+
+	if c, err = getConfig(); err == nil {
+		p = newProcessor(c)
+	}
+
+	return
+}
+
+func checkConfig() (err error) {
+	_, err = getConfig()
+	return
+}
+
+// processor only remembers the last message of each stream, unlike the dedup
+// and summary stages it never looks further back than the previous line.
+type processor struct {
+	config
+	streams map[string]*run
+}
+
+type run struct {
+	// The message that started the run and the first of the repeats not
+	// reported yet, which holds their source until they are.
+	first  lib.Message
+	repeat lib.Message
+
+	// The number of repeats not reported yet, the time of the last of them,
+	// when the first of them was seen, and when the stream was last seen.
+	count int
+	last  time.Time
+	since time.Time
+	seen  time.Time
+}
+
+func newProcessor(c config) *processor {
+	return &processor{
+		config:  c,
+		streams: make(map[string]*run),
+	}
+}
+
+func (p *processor) Process(msg lib.Message, now time.Time) (msgs []lib.Message) {
+	k := key(msg)
+	r := p.streams[k]
+
+	if r != nil {
+		r.seen = now
+
+		if identical(r.first, msg) {
+			if r.count++; r.count == 1 {
+				lib.Hold(&msg)
+				r.repeat, r.since = msg, now
+			}
+			r.last = msg.Event.Time
+			return nil
+		}
+
+		msgs = r.rollup(msgs)
+	}
+
+	p.streams[k] = &run{first: msg, seen: now}
+	return append(msgs, msg)
+}
+
+func (p *processor) Flush(now time.Time) (msgs []lib.Message) {
+	for k, r := range p.streams {
+		switch {
+		case r.count != 0 && now.Sub(r.since) >= p.timeout:
+			// The run keeps going, the next repeats are still suppressed
+			// and reported by the next rollup.
+			msgs = r.rollup(msgs)
+		case r.count == 0 && now.Sub(r.seen) >= p.timeout:
+			// Idle streams are forgotten so the state doesn't grow with
+			// streams that went away.
+			delete(p.streams, k)
+		}
+	}
+	return
+}
+
+// rollup appends a message reporting the repeats of the run to msgs, if there
+// were some, and starts counting again. The rollup is made of the first repeat
+// so it carries its hold, with the time of the last one.
+func (r *run) rollup(msgs []lib.Message) []lib.Message {
+	if r.count == 0 {
+		return msgs
+	}
+
+	msg := r.repeat
+	msg.Event.Time = r.last
+	data := make(ecslogs.EventData, len(msg.Event.Data)+1)
+
+	for k, v := range msg.Event.Data {
+		data[k] = v
+	}
+
+	data[Field] = r.count
+	msg.Event.Data = data
+	msg.Event.Message = fmt.Sprintf("%s (repeated %d times)", msg.Event.Message, r.count)
+	msg.Received = time.Time{}
+	r.count = 0
+	return append(msgs, msg)
+}
+
+// identical returns true if a and b only differ by their time.
+func identical(a lib.Message, b lib.Message) bool {
+	return a.Event.Message == b.Event.Message &&
+		a.Event.Level == b.Event.Level &&
+		reflect.DeepEqual(a.Event.Data, b.Event.Data)
+}
+
+func key(msg lib.Message) string {
+	return msg.Group + "\x00" + msg.Stream
+}
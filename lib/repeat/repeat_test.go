@@ -0,0 +1,138 @@
+package repeat
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+var epoch = time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC)
+
+func TestProcessorRun(t *testing.T) {
+	p := newProcessor(config{timeout: time.Minute})
+
+	output := process(p, []lib.Message{
+		makeMessage("A", "retrying"),
+		makeMessage("A", "retrying"),
+		makeMessage("A", "retrying"),
+		makeMessage("A", "retrying"),
+		makeMessage("A", "connected"),
+	})
+
+	ref := []string{"A:retrying", "A:retrying (repeated 3 times)", "A:connected"}
+
+	if !reflect.DeepEqual(output, ref) {
+		t.Errorf("invalid output:\n- expected: %#v\n- found:    %#v", ref, output)
+	}
+}
+
+func TestProcessorInterleaved(t *testing.T) {
+	p := newProcessor(config{timeout: time.Minute})
+
+	output := process(p, []lib.Message{
+		makeMessage("A", "ping"),
+		makeMessage("A", "pong"),
+		makeMessage("A", "ping"),
+		makeMessage("A", "ping"),
+		// The runs are tracked per stream, B doesn't break the run of A.
+		makeMessage("B", "ping"),
+		makeMessage("A", "ping"),
+		makeMessage("B", "ping"),
+		makeMessage("A", "pong"),
+	})
+
+	ref := []string{"A:ping", "A:pong", "A:ping", "B:ping", "A:ping (repeated 2 times)", "A:pong"}
+
+	if !reflect.DeepEqual(output, ref) {
+		t.Errorf("invalid output:\n- expected: %#v\n- found:    %#v", ref, output)
+	}
+
+	if r := p.streams["G\x00B"]; r == nil || r.count != 1 {
+		t.Errorf("the repeat on B should still be pending: %+v", r)
+	}
+}
+
+func TestProcessorDifferentData(t *testing.T) {
+	p := newProcessor(config{timeout: time.Minute})
+	a, b := makeMessage("A", "request"), makeMessage("A", "request")
+	a.Event.Data = ecslogs.EventData{"status": 200}
+	b.Event.Data = ecslogs.EventData{"status": 500}
+
+	if output := process(p, []lib.Message{a, b}); len(output) != 2 {
+		t.Errorf("messages with different data should not be collapsed: %#v", output)
+	}
+}
+
+func TestProcessorTimeout(t *testing.T) {
+	p := newProcessor(config{timeout: time.Minute})
+
+	for i := 0; i != 3; i++ {
+		msg := makeMessage("A", "health check")
+		msg.Event.Time = epoch.Add(time.Duration(i) * 10 * time.Second)
+		p.Process(msg, msg.Event.Time)
+	}
+
+	if msgs := p.Flush(epoch.Add(30 * time.Second)); len(msgs) != 0 {
+		t.Errorf("no rollup should be emitted before the timeout: %d", len(msgs))
+	}
+
+	msgs := p.Flush(epoch.Add(70 * time.Second))
+
+	if len(msgs) != 1 {
+		t.Fatalf("a rollup should be emitted when the timeout fires: %d", len(msgs))
+	}
+
+	if msg := msgs[0]; msg.Event.Message != "health check (repeated 2 times)" || msg.Event.Data[Field] != 2 || !msg.Event.Time.Equal(epoch.Add(20*time.Second)) {
+		t.Errorf("invalid rollup: %+v", msg)
+	}
+
+	// The run goes on after the rollup, the next repeats are still
+	// suppressed.
+	if msgs := p.Process(makeMessage("A", "health check"), epoch.Add(80*time.Second)); len(msgs) != 0 {
+		t.Errorf("the run should continue after a rollup: %#v", msgs)
+	}
+
+	if msgs := p.Process(makeMessage("A", "stopping"), epoch.Add(90*time.Second)); len(msgs) != 2 || msgs[0].Event.Message != "health check (repeated 1 times)" {
+		t.Errorf("the end of the run should emit a rollup of the last repeats: %#v", msgs)
+	}
+
+	if p.Flush(epoch.Add(200 * time.Second)); len(p.streams) != 0 {
+		t.Errorf("idle streams should be forgotten: %d", len(p.streams))
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(map[string]string{"REPEAT_TIMEOUT": "5s"})
+
+	if c, err := getConfig(); err != nil || c.timeout != 5*time.Second {
+		t.Errorf("invalid config: %+v (%v)", c, err)
+	}
+
+	lib.SetConfigEnv(map[string]string{"REPEAT_TIMEOUT": "0s"})
+
+	if err := checkConfig(); err == nil {
+		t.Error("a zero timeout should be rejected")
+	}
+}
+
+func process(p lib.Processor, input []lib.Message) (output []string) {
+	for i, msg := range input {
+		for _, m := range p.Process(msg, epoch.Add(time.Duration(i)*time.Second)) {
+			output = append(output, m.Stream+":"+m.Event.Message)
+		}
+	}
+	return
+}
+
+func makeMessage(stream string, message string) lib.Message {
+	return lib.Message{
+		Group:  "G",
+		Stream: stream,
+		Event:  ecslogs.Event{Message: message, Time: epoch, Data: ecslogs.EventData{}},
+	}
+}
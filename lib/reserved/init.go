@@ -0,0 +1,10 @@
+package reserved
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterStage("reserved", lib.NewCheckedStage(lib.StageFunc(NewProcessor), checkConfig))
+
+	// The fields added by the other stages are checked too.
+	lib.RegisterStageOrder("reserved", lib.StageOrder{After: []string{"correlation", "merge", "metadata", "schema", "xray"}})
+}
@@ -0,0 +1,157 @@
+// Package reserved implements the reserved stage, which renames the data fields
+// of the messages that collide with the names that CloudWatch Logs Insights
+// reserves for its own fields, like @timestamp or @message.
+package reserved
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// The fields that Logs Insights sets on every event, a field of the same name
+// in the event is shadowed by them in the queries.
+const defaultNames = "@timestamp,@message,@logStream,@log,@ingestionTime,@ptr"
+
+type config struct {
+	// The reserved names, and the prefixes of the reserved names written with
+	// a trailing * like @*.
+	names    map[string]bool
+	prefixes []string
+
+	// What the colliding fields are prefixed with, without their leading @.
+	prefix string
+}
+
+func getConfig() (c config, err error) {
+	var s string
+
+	c.names = make(map[string]bool)
+	c.prefix = "app."
+
+	if s = strings.TrimSpace(lib.Getenv("RESERVED_FIELDS")); len(s) == 0 {
+		s = defaultNames
+	}
+
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); len(name) == 0 {
+			continue
+		}
+
+		if strings.HasSuffix(name, "*") {
+			if name = strings.TrimSuffix(name, "*"); len(name) == 0 {
+				err = fmt.Errorf("invalid RESERVED_FIELDS, a prefix can't be empty: %s", s)
+				return
+			}
+			c.prefixes = append(c.prefixes, name)
+		} else {
+			c.names[name] = true
+		}
+	}
+
+	if s = lib.Getenv("RESERVED_PREFIX"); len(strings.TrimSpace(s)) != 0 {
+		c.prefix = strings.TrimSpace(s)
+
+		if c.reserved(c.prefix + "x") {
+			err = fmt.Errorf("invalid RESERVED_PREFIX, the renamed fields would still be reserved: %s", s)
+			return
+		}
+	}
+
+	return
+}
+
+// reserved returns true if name is one of the reserved names.
+func (c config) reserved(name string) bool {
+	if c.names[name] {
+		return true
+	}
+
+	for _, p := range c.prefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func NewProcessor() (p lib.Processor, err error) {
+	var c config
+
+	if c, err = getConfig(); err == nil {
+		p = newProcessor(c, metrics.Default)
+	}
+
+	return
+}
+
+func checkConfig() (err error) {
+	_, err = getConfig()
+	return
+}
+
+type processor struct {
+	config
+	renamed *metrics.Counter
+}
+
+func newProcessor(c config, registry *metrics.Registry) *processor {
+	return &processor{
+		config:  c,
+		renamed: registry.Counter("renamed_reserved_fields", "stage", "reserved"),
+	}
+}
+
+func (p *processor) Process(msg lib.Message, now time.Time) []lib.Message {
+	var data ecslogs.EventData
+
+	for k, v := range msg.Event.Data {
+		if !p.reserved(k) {
+			continue
+		}
+
+		// The data of the message may be shared with other messages, it's
+		// copied before the first change.
+		if data == nil {
+			data = make(ecslogs.EventData, len(msg.Event.Data))
+
+			for k, v := range msg.Event.Data {
+				data[k] = v
+			}
+		}
+
+		name := p.rename(k, data)
+		delete(data, k)
+		data[name] = v
+		p.renamed.Add(1)
+	}
+
+	if data != nil {
+		msg.Event.Data = data
+	}
+
+	return []lib.Message{msg}
+}
+
+func (p *processor) Flush(now time.Time) []lib.Message {
+	return nil
+}
+
+// rename returns the name that the reserved field k is moved to, @timestamp
+// becomes app.timestamp by default. The prefix is repeated until the name
+// doesn't collide with another field of data.
+func (p *processor) rename(k string, data ecslogs.EventData) string {
+	name := p.prefix + strings.TrimPrefix(k, "@")
+
+	for {
+		if _, exists := data[name]; !exists {
+			return name
+		}
+		name = p.prefix + name
+	}
+}
@@ -0,0 +1,114 @@
+package reserved
+
+import (
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+func newTestProcessor(t *testing.T, env map[string]string) (*processor, *metrics.Registry) {
+	lib.SetConfigEnv(env)
+	defer lib.SetConfigEnv(nil)
+
+	c, err := getConfig()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry := metrics.NewRegistry()
+	return newProcessor(c, registry), registry
+}
+
+func TestProcessorRename(t *testing.T) {
+	p, registry := newTestProcessor(t, nil)
+
+	data := ecslogs.EventData{
+		"@timestamp": "2016-10-12T00:00:00Z",
+		"@message":   "hello",
+		"status":     200,
+		"@custom":    true,
+	}
+
+	msg := lib.Message{Group: "A", Stream: "B", Event: ecslogs.Event{Message: "hello", Data: data}}
+	res := p.Process(msg, time.Now())
+
+	if len(res) != 1 {
+		t.Fatalf("a single message should be returned, got %d", len(res))
+	}
+
+	expected := ecslogs.EventData{
+		"app.timestamp": "2016-10-12T00:00:00Z",
+		"app.message":   "hello",
+		"status":        200,
+		"@custom":       true,
+	}
+
+	if len(res[0].Event.Data) != len(expected) {
+		t.Errorf("invalid data: %v", res[0].Event.Data)
+	}
+
+	for k, v := range expected {
+		if res[0].Event.Data[k] != v {
+			t.Errorf("%s: %v != %v", k, res[0].Event.Data[k], v)
+		}
+	}
+
+	if n := registry.Counter("renamed_reserved_fields", "stage", "reserved").Value(); n != 2 {
+		t.Error("invalid number of renamed fields:", n)
+	}
+
+	if _, ok := data["@timestamp"]; !ok || len(data) != 4 {
+		t.Error("the data of the original message should not be modified:", data)
+	}
+}
+
+func TestProcessorPassThrough(t *testing.T) {
+	p, _ := newTestProcessor(t, nil)
+
+	data := ecslogs.EventData{"status": 200, "user": map[string]interface{}{"@timestamp": "nested"}}
+	res := p.Process(lib.Message{Event: ecslogs.Event{Data: data}}, time.Now())[0]
+
+	// The data is left as is, only the top level fields are reserved.
+	if len(res.Event.Data) != 2 || res.Event.Data["status"] != 200 {
+		t.Errorf("the normal fields should pass through: %v", res.Event.Data)
+	}
+
+	res.Event.Data["x"] = 1
+
+	if _, ok := data["x"]; !ok {
+		t.Error("the data should not be copied when no field collides")
+	}
+}
+
+func TestProcessorConfig(t *testing.T) {
+	p, _ := newTestProcessor(t, map[string]string{
+		"RESERVED_FIELDS": "@*, level",
+		"RESERVED_PREFIX": "user_",
+	})
+
+	data := ecslogs.EventData{"@anything": 1, "level": "debug", "user_level": "taken"}
+	res := p.Process(lib.Message{Event: ecslogs.Event{Data: data}}, time.Now())[0]
+
+	for k, v := range map[string]interface{}{"user_anything": 1, "user_user_level": "debug", "user_level": "taken"} {
+		if res.Event.Data[k] != v {
+			t.Errorf("%s: %v != %v", k, res.Event.Data[k], v)
+		}
+	}
+
+	defer lib.SetConfigEnv(nil)
+
+	for _, env := range []map[string]string{
+		{"RESERVED_FIELDS": "*"},
+		{"RESERVED_FIELDS": "@*", "RESERVED_PREFIX": "@app."},
+	} {
+		lib.SetConfigEnv(env)
+
+		if _, err := getConfig(); err == nil {
+			t.Errorf("%v: the configuration should be rejected", env)
+		}
+	}
+}
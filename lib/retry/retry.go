@@ -0,0 +1,267 @@
+// Package retry implements the retries of the destinations that retry their
+// own requests, with an exponential backoff, jitter, and limits on the number
+// of attempts and on the time spent retrying.
+package retry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/jpillora/backoff"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// Policy is how the failed requests of a destination are retried.
+type Policy struct {
+	// The delay before the first retry, doubled by Factor after each retry up
+	// to MaxBackoff. With Jitter the delays are randomized between MinBackoff
+	// and the exponential delay, so the writers that failed at the same time
+	// don't all retry at once.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	Factor     float64
+	Jitter     bool
+
+	// The maximum number of retries after the first attempt, zero disables
+	// the retries.
+	MaxRetries int
+
+	// The time after which a request isn't retried anymore, counted from its
+	// first attempt. Zero doesn't limit it.
+	MaxElapsed time.Duration
+
+	// The retries metric of the destination, set by DestinationPolicy.
+	retries *metrics.Counter
+}
+
+// DefaultPolicy is the policy of the destinations that don't have their own.
+var DefaultPolicy = Policy{
+	MinBackoff: 100 * time.Millisecond,
+	MaxBackoff: 10 * time.Second,
+	Factor:     2,
+	Jitter:     true,
+	MaxRetries: 5,
+}
+
+// DestinationPolicy returns the policy configured for destination, starting
+// from p, by the <DESTINATION>_MAX_RETRIES, <DESTINATION>_RETRY_MIN_BACKOFF,
+// <DESTINATION>_RETRY_MAX_BACKOFF, <DESTINATION>_RETRY_MAX_ELAPSED and
+// <DESTINATION>_RETRY_JITTER environment variables. The retries made with the
+// policy are counted by the retries metric of destination.
+func DestinationPolicy(destination string, p Policy) (Policy, error) {
+	prefix := strings.ToUpper(destination) + "_"
+	p.retries = metrics.Default.Counter("retries", "destination", destination)
+
+	if s := strings.TrimSpace(lib.Getenv(prefix + "MAX_RETRIES")); len(s) != 0 {
+		n, err := strconv.Atoi(s)
+
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("invalid %sMAX_RETRIES, must be a positive integer or zero: %s", prefix, s)
+		}
+
+		p.MaxRetries = n
+	}
+
+	for _, d := range []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"RETRY_MIN_BACKOFF", &p.MinBackoff},
+		{"RETRY_MAX_BACKOFF", &p.MaxBackoff},
+		{"RETRY_MAX_ELAPSED", &p.MaxElapsed},
+	} {
+		if s := strings.TrimSpace(lib.Getenv(prefix + d.name)); len(s) != 0 {
+			v, err := time.ParseDuration(s)
+
+			if err != nil || v <= 0 {
+				return p, fmt.Errorf("invalid %s%s, must be a positive duration: %s", prefix, d.name, s)
+			}
+
+			*d.value = v
+		}
+	}
+
+	if p.MaxBackoff < p.MinBackoff {
+		return p, fmt.Errorf("invalid %sRETRY_MAX_BACKOFF, must be greater than the minimum backoff of %s: %s", prefix, p.MinBackoff, p.MaxBackoff)
+	}
+
+	if s := strings.TrimSpace(lib.Getenv(prefix + "RETRY_JITTER")); len(s) != 0 {
+		v, err := strconv.ParseBool(s)
+
+		if err != nil {
+			return p, fmt.Errorf("invalid %sRETRY_JITTER, must be a boolean: %s", prefix, s)
+		}
+
+		p.Jitter = v
+	}
+
+	return p, nil
+}
+
+// Retryable marks err as an error that the next attempt may not fail with, Do
+// only retries the errors marked retryable.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return retryableError{error: err}
+}
+
+// IsRetryable returns true if err was marked retryable, or if it's an AWS
+// error telling that the request was throttled.
+func IsRetryable(err error) bool {
+	if _, ok := err.(retryableError); ok {
+		return true
+	}
+	return IsThrottled(err)
+}
+
+type retryableError struct {
+	error
+	after time.Duration
+}
+
+// RetryAfter marks err as retryable like Retryable, the next attempt waits at
+// least for delay, like the servers ask with the Retry-After header of their
+// 429 and 503 responses. The delay may be longer than the maximum backoff, Do
+// only shortens it to the time left to retry.
+func RetryAfter(err error, delay time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return retryableError{err, delay}
+}
+
+// ParseRetryAfter returns the delay of a Retry-After header, which is either a
+// number of seconds or an HTTP date, relative to now. It returns zero when the
+// header is missing or invalid, or when the date has passed.
+func ParseRetryAfter(header string, now time.Time) time.Duration {
+	if header = strings.TrimSpace(header); len(header) == 0 {
+		return 0
+	}
+
+	if n, err := strconv.Atoi(header); err == nil {
+		if n < 0 {
+			return 0
+		}
+		return time.Duration(n) * time.Second
+	}
+
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+
+	return 0
+}
+
+// throttlingCodes are the codes of the errors returned by the AWS services
+// that throttled a request, which succeeds once retried more slowly.
+var throttlingCodes = map[string]bool{
+	"Throttling":                             true,
+	"ThrottlingException":                    true,
+	"ThrottledException":                     true,
+	"RequestThrottled":                       true,
+	"RequestThrottledException":              true,
+	"RequestLimitExceeded":                   true,
+	"TooManyRequestsException":               true,
+	"ProvisionedThroughputExceededException": true,
+	"SlowDown":                               true,
+}
+
+// IsThrottled returns true if err is an AWS error telling that the request was
+// throttled.
+func IsThrottled(err error) bool {
+	e, ok := err.(awserr.Error)
+	return ok && throttlingCodes[e.Code()]
+}
+
+// GiveUpError is returned by Do when it gave up on retrying a request, Err is
+// the error of the last attempt.
+type GiveUpError struct {
+	Err      error
+	Attempts int
+	Reason   string
+}
+
+func (e *GiveUpError) Error() string {
+	return fmt.Sprintf("%s (gave up after %d attempts, %s)", e.Err, e.Attempts, e.Reason)
+}
+
+// Do calls attempt until it returns nil or an error that isn't retryable, or
+// the policy gives up. The retries spend the budget of limiter, which may be
+// nil, and each success gives back to it. The errors are returned without the
+// retryable mark.
+func (p Policy) Do(c clock.Clock, limiter *lib.RetryLimiter, attempt func() error) error {
+	b := p.backoff()
+	start := c.Now()
+
+	for n := 1; true; n++ {
+		err := attempt()
+
+		if err == nil {
+			limiter.Succeeded()
+			return nil
+		}
+
+		if !IsRetryable(err) {
+			return unmark(err)
+		}
+
+		var reason string
+		var delay = b.Duration()
+		var elapsed = c.Now().Sub(start)
+
+		// The delay asked by the server replaces the backoff even when it's
+		// longer than MaxBackoff, it's only cut short by the time left to
+		// retry.
+		if e, ok := err.(retryableError); ok && e.after > delay {
+			if delay = e.after; p.MaxElapsed > elapsed && elapsed+delay > p.MaxElapsed {
+				delay = p.MaxElapsed - elapsed
+			}
+		}
+
+		switch {
+		case n > p.MaxRetries:
+			reason = "no retries left"
+		case p.MaxElapsed > 0 && (elapsed >= p.MaxElapsed || elapsed+delay > p.MaxElapsed):
+			reason = fmt.Sprintf("retried for longer than %s", p.MaxElapsed)
+		case !limiter.Allow():
+			reason = "the retry budget is exhausted"
+		}
+
+		if len(reason) != 0 {
+			return &GiveUpError{Err: unmark(err), Attempts: n, Reason: reason}
+		}
+
+		if p.retries != nil {
+			p.retries.Add(1)
+		}
+
+		c.Sleep(context.Background(), delay)
+	}
+
+	return nil
+}
+
+func (p Policy) backoff() *backoff.Backoff {
+	return &backoff.Backoff{
+		Min:    p.MinBackoff,
+		Max:    p.MaxBackoff,
+		Factor: p.Factor,
+		Jitter: p.Jitter,
+	}
+}
+
+func unmark(err error) error {
+	if e, ok := err.(retryableError); ok {
+		return e.error
+	}
+	return err
+}
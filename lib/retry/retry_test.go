@@ -0,0 +1,228 @@
+package retry
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+func newFakeClock() *clock.Fake {
+	return clock.NewFake(time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC))
+}
+
+func TestDoSucceeds(t *testing.T) {
+	c := newFakeClock()
+	n := 0
+
+	err := DefaultPolicy.Do(c, nil, func() error {
+		if n++; n < 3 {
+			return Retryable(errors.New("unavailable"))
+		}
+		return nil
+	})
+
+	if err != nil || n != 3 {
+		t.Errorf("the attempts should be retried until they succeed: %d attempts, %v", n, err)
+	}
+
+	if c.Slept() < DefaultPolicy.MinBackoff {
+		t.Errorf("the retries should back off: slept %s", c.Slept())
+	}
+}
+
+func TestDoFatal(t *testing.T) {
+	fatal := errors.New("rejected")
+	n := 0
+
+	err := DefaultPolicy.Do(newFakeClock(), nil, func() error {
+		n++
+		return fatal
+	})
+
+	if err != fatal || n != 1 {
+		t.Errorf("the errors that aren't retryable should be returned right away: %d attempts, %v", n, err)
+	}
+}
+
+func TestDoThrottled(t *testing.T) {
+	n := 0
+
+	err := DefaultPolicy.Do(newFakeClock(), nil, func() error {
+		if n++; n == 1 {
+			return awserr.New("ThrottlingException", "Rate exceeded", nil)
+		}
+		return nil
+	})
+
+	if err != nil || n != 2 {
+		t.Errorf("the throttled attempts should be retried: %d attempts, %v", n, err)
+	}
+}
+
+func TestDoRetryAfter(t *testing.T) {
+	c := newFakeClock()
+	n := 0
+
+	err := DefaultPolicy.Do(c, nil, func() error {
+		if n++; n == 1 {
+			return RetryAfter(errors.New("busy"), 30*time.Second)
+		}
+		return nil
+	})
+
+	if err != nil || n != 2 {
+		t.Errorf("the attempt should be retried: %d attempts, %v", n, err)
+	}
+
+	if c.Slept() != 30*time.Second {
+		t.Errorf("the retry should wait for the requested delay: slept %s", c.Slept())
+	}
+
+	// The delay is cut short by the time left to retry, the request is given
+	// up once there's none.
+	c = newFakeClock()
+	n = 0
+	p := Policy{MinBackoff: time.Second, MaxBackoff: time.Second, MaxRetries: 5, MaxElapsed: 20 * time.Second}
+
+	err = p.Do(c, nil, func() error {
+		n++
+		return RetryAfter(errors.New("busy"), 30*time.Second)
+	})
+
+	if e, ok := err.(*GiveUpError); !ok || e.Attempts != 2 || n != 2 || c.Slept() != 20*time.Second {
+		t.Errorf("the retry should wait until the maximum elapsed time: %d attempts, %v (slept %s)", n, err, c.Slept())
+	}
+
+	err = DefaultPolicy.Do(newFakeClock(), nil, func() error {
+		return RetryAfter(errors.New("busy"), time.Second)
+	})
+
+	if e, ok := err.(*GiveUpError); !ok || e.Err.Error() != "busy" {
+		t.Errorf("the error should be returned unmarked: %#v", err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC)
+
+	for header, delay := range map[string]time.Duration{
+		"":                              0,
+		"120":                           2 * time.Minute,
+		"-1":                            0,
+		"soon":                          0,
+		"Wed, 12 Oct 2016 00:00:30 GMT": 30 * time.Second,
+		"Tue, 11 Oct 2016 00:00:00 GMT": 0,
+	} {
+		if d := ParseRetryAfter(header, now); d != delay {
+			t.Errorf("%q: invalid delay: %s != %s", header, d, delay)
+		}
+	}
+}
+
+func TestDoGivesUp(t *testing.T) {
+	unavailable := errors.New("unavailable")
+
+	tests := []struct {
+		name     string
+		policy   Policy
+		attempts int
+	}{
+		{"max retries", Policy{MinBackoff: time.Second, MaxBackoff: time.Second, MaxRetries: 2}, 3},
+		{"no retries", Policy{MinBackoff: time.Second, MaxBackoff: time.Second}, 1},
+		// The fourth attempt would start after 3s.
+		{"max elapsed", Policy{MinBackoff: time.Second, MaxBackoff: time.Second, MaxRetries: 10, MaxElapsed: 2500 * time.Millisecond}, 3},
+	}
+
+	for _, test := range tests {
+		n := 0
+
+		err := test.policy.Do(newFakeClock(), nil, func() error {
+			n++
+			return Retryable(unavailable)
+		})
+
+		if e, ok := err.(*GiveUpError); !ok || e.Err != unavailable || e.Attempts != test.attempts || n != test.attempts {
+			t.Errorf("%s: invalid error after %d attempts: %v", test.name, n, err)
+		}
+	}
+}
+
+func TestDoRetryBudget(t *testing.T) {
+	limiter := lib.NewRetryLimiter("test", lib.RetryBudget{Ratio: 0.5, Size: 2}, metrics.NewRegistry())
+	p := Policy{MaxRetries: 5}
+	n := 0
+
+	for i := 0; i != 5; i++ {
+		p.Do(newFakeClock(), limiter, func() error {
+			n++
+			return Retryable(errors.New("unavailable"))
+		})
+	}
+
+	// Without the budget each call would have made 6 attempts.
+	if n != 5+2 {
+		t.Errorf("the retries should be capped by the budget: %d attempts", n)
+	}
+
+	err := p.Do(newFakeClock(), limiter, func() error { return Retryable(errors.New("unavailable")) })
+
+	if e, ok := err.(*GiveUpError); !ok || e.Reason != "the retry budget is exhausted" {
+		t.Errorf("invalid error: %v", err)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{errors.New("rejected"), false},
+		{Retryable(errors.New("unavailable")), true},
+		{awserr.New("ThrottlingException", "Rate exceeded", nil), true},
+		{awserr.New("RequestLimitExceeded", "Request limit exceeded", nil), true},
+		{awserr.New("ValidationException", "Invalid record", nil), false},
+	}
+
+	for _, test := range tests {
+		if retryable := IsRetryable(test.err); retryable != test.retryable {
+			t.Errorf("%v: retryable should be %t", test.err, test.retryable)
+		}
+	}
+}
+
+func TestDestinationPolicy(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(map[string]string{
+		"SQS_MAX_RETRIES":       "3",
+		"SQS_RETRY_MIN_BACKOFF": "1s",
+		"SQS_RETRY_MAX_BACKOFF": "1m",
+		"SQS_RETRY_MAX_ELAPSED": "5m",
+		"SQS_RETRY_JITTER":      "false",
+	})
+
+	p, err := DestinationPolicy("sqs", DefaultPolicy)
+
+	if err != nil || p.MaxRetries != 3 || p.MinBackoff != time.Second || p.MaxBackoff != time.Minute || p.MaxElapsed != 5*time.Minute || p.Jitter || p.Factor != 2 {
+		t.Errorf("invalid policy: %+v, %v", p, err)
+	}
+
+	for _, env := range []map[string]string{
+		{"SQS_MAX_RETRIES": "-1"},
+		{"SQS_RETRY_MIN_BACKOFF": "soon"},
+		{"SQS_RETRY_MAX_ELAPSED": "0s"},
+		{"SQS_RETRY_MAX_BACKOFF": "10ms"},
+		{"SQS_RETRY_JITTER": "sometimes"},
+	} {
+		lib.SetConfigEnv(env)
+
+		if _, err := DestinationPolicy("sqs", DefaultPolicy); err == nil {
+			t.Errorf("%v: the policy should be invalid", env)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// RetryBudget is the configuration of the retries that a destination may make
+// across all its writers. Each retry spends a token from a bucket holding up
+// to Size tokens, and each successful request puts Ratio tokens back, so when
+// requests keep failing the retries are capped to a fraction of the successes
+// instead of multiplying the load on the struggling service.
+type RetryBudget struct {
+	Ratio float64
+	Size  float64
+}
+
+// DefaultRetryBudget is the budget of the destinations that enable it without
+// setting both its ratio and its size, it allows one retry every ten
+// successful requests.
+var DefaultRetryBudget = RetryBudget{
+	Ratio: 0.1,
+	Size:  10,
+}
+
+// DestinationRetryBudget returns the retry budget configured for destination
+// by the <DESTINATION>_RETRY_BUDGET_RATIO and <DESTINATION>_RETRY_BUDGET_SIZE
+// environment variables. The budget is disabled, and the zero value returned,
+// when none of them is set.
+func DestinationRetryBudget(destination string) (b RetryBudget, err error) {
+	prefix := strings.ToUpper(destination) + "_RETRY_BUDGET_"
+	ratio := strings.TrimSpace(Getenv(prefix + "RATIO"))
+	size := strings.TrimSpace(Getenv(prefix + "SIZE"))
+
+	if len(ratio) == 0 && len(size) == 0 {
+		return
+	}
+
+	b = DefaultRetryBudget
+
+	if len(ratio) != 0 {
+		if b.Ratio, err = strconv.ParseFloat(ratio, 64); err != nil || b.Ratio < 0 {
+			err = fmt.Errorf("invalid %sRATIO, must be a positive number or zero: %s", prefix, ratio)
+			return
+		}
+	}
+
+	if len(size) != 0 {
+		if b.Size, err = strconv.ParseFloat(size, 64); err != nil || b.Size < 1 {
+			err = fmt.Errorf("invalid %sSIZE, must be a number greater than or equal to 1: %s", prefix, size)
+			return
+		}
+	}
+
+	return
+}
+
+// Enabled returns true if the budget was configured.
+func (b RetryBudget) Enabled() bool {
+	return b.Size != 0
+}
+
+// RetryLimiter enforces a retry budget, the retries it denies are counted by
+// the retries_denied metric of the destination.
+//
+// A nil limiter allows all the retries, it's what destinations without a
+// budget use.
+type RetryLimiter struct {
+	mutex  sync.Mutex
+	budget RetryBudget
+	tokens float64
+	denied *metrics.Counter
+}
+
+// NewRetryLimiter returns the limiter of the retries of destination, or nil if
+// the budget isn't enabled. The bucket starts full so the first errors are
+// retried before anything succeeded.
+func NewRetryLimiter(destination string, budget RetryBudget, registry *metrics.Registry) *RetryLimiter {
+	if !budget.Enabled() {
+		return nil
+	}
+	return &RetryLimiter{
+		budget: budget,
+		tokens: budget.Size,
+		denied: registry.Counter("retries_denied", "destination", destination),
+	}
+}
+
+// Succeeded records a successful request.
+func (r *RetryLimiter) Succeeded() {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+
+	if r.tokens += r.budget.Ratio; r.tokens > r.budget.Size {
+		r.tokens = r.budget.Size
+	}
+
+	r.mutex.Unlock()
+}
+
+// Allow returns true if a failed request may be retried, spending a token from
+// the budget.
+func (r *RetryLimiter) Allow() bool {
+	if r == nil {
+		return true
+	}
+
+	r.mutex.Lock()
+	ok := r.tokens >= 1
+
+	if ok {
+		r.tokens--
+	}
+
+	r.mutex.Unlock()
+
+	if !ok {
+		r.denied.Add(1)
+	}
+
+	return ok
+}
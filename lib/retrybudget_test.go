@@ -0,0 +1,101 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+func TestRetryLimiterSustainedFailure(t *testing.T) {
+	r := metrics.NewRegistry()
+	l := NewRetryLimiter("cloudwatchlogs", RetryBudget{Ratio: 0.1, Size: 5}, r)
+
+	// Each request fails and would be retried up to 3 times without a budget,
+	// one in four succeeds eventually.
+	retries, denied, successes := 0, 0, 0
+
+	for i := 0; i != 1000; i++ {
+		for attempt := 0; attempt != 3; attempt++ {
+			if !l.Allow() {
+				denied++
+				break
+			}
+			retries++
+		}
+
+		if i%4 == 0 {
+			successes++
+			l.Succeeded()
+		}
+	}
+
+	if max := int(0.1*float64(successes)) + 5; retries > max {
+		t.Errorf("the retries should be capped relative to the successes: %d retries for %d successes, at most %d expected", retries, successes, max)
+	}
+
+	if retries < 20 {
+		t.Errorf("the successes should allow more retries: %d", retries)
+	}
+
+	if n := r.Counter("retries_denied", "destination", "cloudwatchlogs").Value(); n != int64(denied) {
+		t.Errorf("the denied retries should be counted: %d", n)
+	}
+}
+
+func TestRetryLimiterRecovers(t *testing.T) {
+	l := NewRetryLimiter("sqs", RetryBudget{Ratio: 0.5, Size: 2}, metrics.NewRegistry())
+
+	if !l.Allow() || !l.Allow() || l.Allow() {
+		t.Fatal("the bucket should start with its size")
+	}
+
+	for i := 0; i != 100; i++ {
+		l.Succeeded()
+	}
+
+	if !l.Allow() || !l.Allow() || l.Allow() {
+		t.Error("the tokens should be refilled by successes, up to the size of the bucket")
+	}
+}
+
+func TestRetryLimiterDisabled(t *testing.T) {
+	l := NewRetryLimiter("sqs", RetryBudget{}, metrics.NewRegistry())
+
+	if l != nil {
+		t.Fatal("no limiter should be returned when the budget isn't enabled")
+	}
+
+	l.Succeeded()
+
+	for i := 0; i != 100; i++ {
+		if !l.Allow() {
+			t.Fatal("a nil limiter should allow all the retries")
+		}
+	}
+}
+
+func TestDestinationRetryBudget(t *testing.T) {
+	defer SetConfigEnv(nil)
+
+	if b, err := DestinationRetryBudget("sqs"); err != nil || b.Enabled() {
+		t.Errorf("the budget should be disabled by default: %+v (%v)", b, err)
+	}
+
+	SetConfigEnv(map[string]string{"SQS_RETRY_BUDGET_RATIO": "0.2"})
+
+	if b, err := DestinationRetryBudget("sqs"); err != nil || b != (RetryBudget{Ratio: 0.2, Size: DefaultRetryBudget.Size}) {
+		t.Errorf("invalid budget: %+v (%v)", b, err)
+	}
+
+	for _, env := range []map[string]string{
+		{"SQS_RETRY_BUDGET_RATIO": "-1"},
+		{"SQS_RETRY_BUDGET_SIZE": "0.5"},
+		{"SQS_RETRY_BUDGET_SIZE": "many"},
+	} {
+		SetConfigEnv(env)
+
+		if _, err := DestinationRetryBudget("sqs"); err == nil {
+			t.Errorf("%v: the budget should be rejected", env)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package lib
+
+// A Rewinder is implemented by the sources that checkpoint their progress, so
+// the messages that ecs-logs failed to deliver are read again after a restart
+// instead of being skipped.
+//
+// Rewind is called with the position of the earliest message of a batch that
+// was dropped after all the retries of a destination, the source must not
+// save a checkpoint past it anymore, and move back the one it already saved.
+// It's called from the goroutines writing to the destinations.
+type Rewinder interface {
+	Rewind(pos Position)
+}
+
+// Position locates a message in its source. Seq orders the positions of a
+// source, Checkpoint is what the source saves to read the message again.
+type Position struct {
+	Seq        int64
+	Checkpoint string
+}
+
+// SetOrigin records the source that msg was read from and its position, the
+// association is carried by the copies of the message made by the stages.
+func SetOrigin(msg *Message, source Rewinder, pos Position) {
+	msg.origin, msg.position = source, pos
+}
+
+// RewindBatch reports to their sources that the messages of batch could not
+// be delivered. Each source is rewound once, to the earliest of its messages.
+func RewindBatch(batch MessageBatch) {
+	var origins map[Rewinder]Position
+
+	for _, msg := range batch {
+		if msg.origin == nil {
+			continue
+		}
+
+		if origins == nil {
+			origins = make(map[Rewinder]Position)
+		}
+
+		if pos, ok := origins[msg.origin]; !ok || msg.position.Seq < pos.Seq {
+			origins[msg.origin] = msg.position
+		}
+	}
+
+	for source, pos := range origins {
+		source.Rewind(pos)
+	}
+}
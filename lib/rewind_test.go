@@ -0,0 +1,41 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+type rewinder []Position
+
+func (r *rewinder) Rewind(pos Position) {
+	*r = append(*r, pos)
+}
+
+func TestRewindBatch(t *testing.T) {
+	var a, b rewinder
+
+	batch := make(MessageBatch, 4)
+	SetOrigin(&batch[0], &a, Position{Seq: 3, Checkpoint: "3"})
+	SetOrigin(&batch[1], &b, Position{Seq: 7, Checkpoint: "7"})
+	SetOrigin(&batch[2], &a, Position{Seq: 2, Checkpoint: "2"})
+
+	// The last message was emitted by a stage, it has no source to rewind.
+	RewindBatch(batch)
+
+	if !reflect.DeepEqual(a, rewinder{{Seq: 2, Checkpoint: "2"}}) {
+		t.Errorf("the source should be rewound once to its earliest message: %v", a)
+	}
+
+	if !reflect.DeepEqual(b, rewinder{{Seq: 7, Checkpoint: "7"}}) {
+		t.Errorf("each source should be rewound: %v", b)
+	}
+
+	// Stages copy the messages, the copies keep their origin.
+	msg := batch[1]
+	msg.Event.Message = "modified"
+	RewindBatch(MessageBatch{msg})
+
+	if len(b) != 2 {
+		t.Errorf("the copy of a message should rewind its source: %v", b)
+	}
+}
@@ -0,0 +1,308 @@
+package lib
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+// Router picks the destinations of each message with an ordered list of rules,
+// the first rule matching a message decides which destinations it's written
+// to. The messages that no rule matches are written to all the destinations,
+// a last rule matching everything changes that.
+//
+// A nil router writes all messages to all the destinations.
+type Router struct {
+	Rules []RouteRule
+
+	// Only the messages matching all the predicates of the filter are
+	// written, to any of the destinations.
+	Filter []RoutePredicate
+}
+
+// RouteRule routes the messages matching all its predicates to Destinations,
+// an empty list drops them.
+type RouteRule struct {
+	Predicates   []RoutePredicate
+	Destinations []string
+}
+
+// RoutePredicate matches the messages whose Field, either group, stream, level
+// or a data.path, matches. Names are matched against Glob, with the syntax of
+// path.Match, or Regexp when it's set. Level matches the messages at that level
+// or more severe, a data field with any value when Value is empty.
+type RoutePredicate struct {
+	Field  string
+	Glob   string
+	Regexp *regexp.Regexp
+	Level  ecslogs.Level
+	Value  string
+}
+
+// ParseRoutes parses a semicolon separated list of rules. Each rule is a comma
+// separated list of predicates, followed by -> and the comma separated list of
+// destinations of the messages matching all of them, or drop. The predicates
+// are group=glob, stream=glob, group~regexp, stream~regexp, level=LEVEL (or
+// level>=LEVEL), data.path, data.path=value, or * which matches all messages,
+// for example:
+//
+//	group=/ecs/api*,level=ERROR -> cloudwatchlogs,loggly; group=/ecs/noisy -> drop
+//
+// It returns a nil router when s has no rules.
+func ParseRoutes(s string) (r *Router, err error) {
+	var rules []RouteRule
+
+	for _, item := range strings.Split(s, ";") {
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+
+		var rule RouteRule
+
+		if rule, err = parseRouteRule(item); err != nil {
+			err = fmt.Errorf("invalid route %q: %s", item, err)
+			return
+		}
+
+		rules = append(rules, rule)
+	}
+
+	if len(rules) != 0 {
+		r = &Router{Rules: rules}
+	}
+
+	return
+}
+
+// ParseFilter parses a list of predicates, with the syntax of the routes,
+// separated by commas or spaces, for example:
+//
+//	group=/ecs/api* level>=warn
+//
+// The messages matching all of them are let through by the filter.
+func ParseFilter(s string) (filter []RoutePredicate, err error) {
+	items := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+
+	for _, item := range items {
+		if item == "*" {
+			continue
+		}
+
+		var p RoutePredicate
+
+		if p, err = parseRoutePredicate(item); err != nil {
+			err = fmt.Errorf("invalid filter %q: %s", s, err)
+			return
+		}
+
+		filter = append(filter, p)
+	}
+
+	return
+}
+
+func parseRouteRule(s string) (rule RouteRule, err error) {
+	i := strings.Index(s, "->")
+
+	if i < 0 {
+		err = fmt.Errorf("must be predicates -> destinations")
+		return
+	}
+
+	for _, item := range strings.Split(s[:i], ",") {
+		if item = strings.TrimSpace(item); item == "*" {
+			continue
+		}
+
+		var p RoutePredicate
+
+		if p, err = parseRoutePredicate(item); err != nil {
+			return
+		}
+
+		rule.Predicates = append(rule.Predicates, p)
+	}
+
+	if dests := strings.TrimSpace(s[i+2:]); dests != "drop" {
+		for _, name := range strings.Split(dests, ",") {
+			if name = strings.TrimSpace(name); len(name) != 0 {
+				rule.Destinations = append(rule.Destinations, name)
+			}
+		}
+
+		if len(rule.Destinations) == 0 {
+			err = fmt.Errorf("the destinations must be listed, or drop")
+		}
+	}
+
+	return
+}
+
+func parseRoutePredicate(s string) (p RoutePredicate, err error) {
+	i := strings.IndexAny(s, "=~")
+
+	if i < 0 {
+		if strings.HasPrefix(s, "data.") && len(s) > 5 {
+			p.Field = s
+			return
+		}
+		err = fmt.Errorf("unknown predicate: %s", s)
+		return
+	}
+
+	p.Field = strings.TrimSpace(s[:i])
+	value := strings.TrimSpace(s[i+1:])
+
+	// The levels match the more severe ones too, level>= reads better in
+	// filters.
+	if p.Field == "level>" && s[i] == '=' {
+		p.Field = "level"
+	}
+
+	switch {
+	case (p.Field == "group" || p.Field == "stream") && s[i] == '~':
+		if p.Regexp, err = regexp.Compile(value); err != nil {
+			err = fmt.Errorf("bad regular expression: %s", s)
+		}
+
+	case p.Field == "group" || p.Field == "stream":
+		if _, e := path.Match(value, ""); e != nil || len(value) == 0 {
+			err = fmt.Errorf("bad pattern: %s", s)
+		}
+		p.Glob = value
+
+	case p.Field == "level" && s[i] == '=':
+		if p.Level, err = ecslogs.ParseLevel(strings.ToUpper(value)); err != nil || p.Level == ecslogs.NONE {
+			err = fmt.Errorf("unknown level: %s", s)
+		}
+
+	case strings.HasPrefix(p.Field, "data.") && len(p.Field) > 5 && s[i] == '=':
+		if p.Value = value; len(value) == 0 {
+			err = fmt.Errorf("the value of a field can't be empty: %s", s)
+		}
+
+	default:
+		err = fmt.Errorf("unknown predicate: %s", s)
+	}
+
+	return
+}
+
+// Check returns an error if the rules route messages to destinations that
+// aren't in names.
+func (r *Router) Check(names []string) (err error) {
+	if r == nil {
+		return
+	}
+
+	known := make(map[string]bool, len(names))
+
+	for _, name := range names {
+		known[name] = true
+	}
+
+	for _, rule := range r.Rules {
+		for _, name := range rule.Destinations {
+			if !known[name] {
+				err = AppendError(err, fmt.Errorf("%s is not one of the destinations", name))
+			}
+		}
+	}
+
+	return
+}
+
+// Routes returns true if msg is written to the destination called name.
+func (r *Router) Routes(name string, msg Message) bool {
+	if r == nil {
+		return true
+	}
+
+	for _, p := range r.Filter {
+		if !p.Match(msg) {
+			return false
+		}
+	}
+
+	for _, rule := range r.Rules {
+		if rule.Match(msg) {
+			for _, dest := range rule.Destinations {
+				if dest == name {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	return true
+}
+
+// Batch returns the messages of batch written to the destination called name,
+// batch itself when the rules don't filter out any of them.
+func (r *Router) Batch(name string, batch MessageBatch) MessageBatch {
+	if r == nil {
+		return batch
+	}
+
+	for i, msg := range batch {
+		if r.Routes(name, msg) {
+			continue
+		}
+
+		// Copied on the first message left out, the batch is shared by all
+		// the destinations.
+		routed := append(make(MessageBatch, 0, len(batch)-1), batch[:i]...)
+
+		for _, msg := range batch[i+1:] {
+			if r.Routes(name, msg) {
+				routed = append(routed, msg)
+			}
+		}
+
+		return routed
+	}
+
+	return batch
+}
+
+// Match returns true if msg matches all the predicates of the rule.
+func (rule RouteRule) Match(msg Message) bool {
+	for _, p := range rule.Predicates {
+		if !p.Match(msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// Match returns true if msg matches the predicate.
+func (p RoutePredicate) Match(msg Message) bool {
+	switch p.Field {
+	case "group", "stream":
+		name := msg.Group
+
+		if p.Field == "stream" {
+			name = msg.Stream
+		}
+
+		if p.Regexp != nil {
+			return p.Regexp.MatchString(name)
+		}
+
+		ok, _ := path.Match(p.Glob, name)
+		return ok
+
+	case "level":
+		return msg.Event.Level != ecslogs.NONE && msg.Event.Level <= p.Level
+
+	default:
+		v := lookupData(msg.Event.Data, p.Field[5:])
+		return v != nil && (len(p.Value) == 0 || fmt.Sprint(v) == p.Value)
+	}
+}
@@ -0,0 +1,157 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+func TestParseRoutes(t *testing.T) {
+	r, err := ParseRoutes("group=/ecs/api*, level=error -> cloudwatchlogs, loggly; stream~^worker-[0-9]+$ -> drop; data.audit=true -> s3; * -> cloudwatchlogs")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.Rules) != 4 {
+		t.Fatalf("invalid number of rules: %d", len(r.Rules))
+	}
+
+	if p := r.Rules[0].Predicates; !reflect.DeepEqual(p, []RoutePredicate{{Field: "group", Glob: "/ecs/api*"}, {Field: "level", Level: ecslogs.ERROR}}) {
+		t.Errorf("invalid predicates: %#v", p)
+	}
+
+	if d := r.Rules[0].Destinations; !reflect.DeepEqual(d, []string{"cloudwatchlogs", "loggly"}) {
+		t.Errorf("invalid destinations: %v", d)
+	}
+
+	if d := r.Rules[1].Destinations; d != nil {
+		t.Errorf("the dropping rules should have no destinations: %v", d)
+	}
+
+	if p := r.Rules[3].Predicates; p != nil {
+		t.Errorf("* should match all messages: %#v", p)
+	}
+
+	if r, err = ParseRoutes(" ; "); r != nil || err != nil {
+		t.Errorf("a list without rules should not route the messages: %#v (%v)", r, err)
+	}
+
+	for _, s := range []string{"group=api", "group=api ->", "group=[ -> s3", "stream~( -> s3", "level=loud -> s3", "data. -> s3", "data.audit= -> s3", "message=hello -> s3"} {
+		if _, err := ParseRoutes(s); err == nil {
+			t.Errorf("%s: the routes should be invalid", s)
+		}
+	}
+}
+
+func TestRouterRoutes(t *testing.T) {
+	r, _ := ParseRoutes("group=/ecs/api*, level=error -> cloudwatchlogs, loggly; stream~^worker-[0-9]+$ -> drop; data.audit=true -> s3")
+
+	tests := []struct {
+		msg   Message
+		dests []string
+	}{
+		{Message{Group: "/ecs/api-v2", Event: ecslogs.Event{Level: ecslogs.CRIT}}, []string{"cloudwatchlogs", "loggly"}},
+		{Message{Group: "/ecs/api-v2", Event: ecslogs.Event{Level: ecslogs.INFO}}, []string{"cloudwatchlogs", "loggly", "s3"}},
+		{Message{Group: "/ecs/api", Stream: "worker-1", Event: ecslogs.Event{Level: ecslogs.ERROR}}, []string{"cloudwatchlogs", "loggly"}},
+		{Message{Group: "/ecs/jobs", Stream: "worker-1"}, nil},
+		{Message{Group: "/ecs/jobs", Stream: "worker-x"}, []string{"cloudwatchlogs", "loggly", "s3"}},
+		{Message{Event: ecslogs.Event{Data: ecslogs.EventData{"audit": true}}}, []string{"s3"}},
+	}
+
+	for i, test := range tests {
+		var dests []string
+
+		for _, name := range []string{"cloudwatchlogs", "loggly", "s3"} {
+			if r.Routes(name, test.msg) {
+				dests = append(dests, name)
+			}
+		}
+
+		if !reflect.DeepEqual(dests, test.dests) {
+			t.Errorf("#%d: the message should be written to %v but was written to %v", i, test.dests, dests)
+		}
+	}
+
+	if err := r.Check([]string{"cloudwatchlogs", "s3"}); err == nil {
+		t.Error("the routes to unknown destinations should be reported")
+	}
+
+	if err := r.Check([]string{"cloudwatchlogs", "loggly", "s3"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRouterBatch(t *testing.T) {
+	r, _ := ParseRoutes("group=noisy -> drop")
+
+	batch := MessageBatch{{Group: "api"}, {Group: "noisy"}, {Group: "api"}}
+
+	if routed := r.Batch("s3", batch); !reflect.DeepEqual(routed, MessageBatch{batch[0], batch[2]}) {
+		t.Errorf("invalid routed batch: %v", routed)
+	}
+
+	if batch[1].Group != "noisy" {
+		t.Error("the original batch should not be modified")
+	}
+
+	if all := batch[:1]; &r.Batch("s3", all)[0] != &all[0] {
+		t.Error("the batches without messages left out should not be copied")
+	}
+
+	if routed := (*Router)(nil).Batch("s3", batch); len(routed) != len(batch) {
+		t.Error("a nil router should write all the messages")
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	f, err := ParseFilter("group=/ecs/api* level>=warn,data.audit")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(f, []RoutePredicate{{Field: "group", Glob: "/ecs/api*"}, {Field: "level", Level: ecslogs.WARN}, {Field: "data.audit"}}) {
+		t.Errorf("invalid predicates: %#v", f)
+	}
+
+	if f, err = ParseFilter(" "); f != nil || err != nil {
+		t.Errorf("an empty filter should let all messages through: %#v (%v)", f, err)
+	}
+
+	for _, s := range []string{"group=[", "level>=loud", "level>~error", "message=hello"} {
+		if _, err := ParseFilter(s); err == nil {
+			t.Errorf("%s: the filter should be invalid", s)
+		}
+	}
+}
+
+func TestRouterFilter(t *testing.T) {
+	r, _ := ParseRoutes("group=/ecs/jobs -> s3")
+	r.Filter, _ = ParseFilter("level>=warn")
+
+	tests := []struct {
+		msg   Message
+		dests []string
+	}{
+		{Message{Group: "/ecs/api", Event: ecslogs.Event{Level: ecslogs.ERROR}}, []string{"cloudwatchlogs", "s3"}},
+		{Message{Group: "/ecs/api", Event: ecslogs.Event{Level: ecslogs.INFO}}, nil},
+		{Message{Group: "/ecs/jobs", Event: ecslogs.Event{Level: ecslogs.WARN}}, []string{"s3"}},
+		{Message{Group: "/ecs/jobs", Event: ecslogs.Event{Level: ecslogs.DEBUG}}, nil},
+	}
+
+	for i, test := range tests {
+		var dests []string
+
+		for _, name := range []string{"cloudwatchlogs", "s3"} {
+			if r.Routes(name, test.msg) {
+				dests = append(dests, name)
+			}
+		}
+
+		if !reflect.DeepEqual(dests, test.dests) {
+			t.Errorf("#%d: the message should be written to %v but was written to %v", i, test.dests, dests)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package s3
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/codec"
+)
+
+const (
+	// The smallest part of a multipart upload that S3 accepts, only the last
+	// part of an object may be smaller.
+	minPartSize = 5 * 1024 * 1024
+
+	// The maximum number of parts of a multipart upload.
+	maxParts = 10000
+
+	// The default template of the object keys, the extension of the codec is
+	// appended to it.
+	defaultKey = "{group}/{stream}/{yyyy}/{MM}/{dd}/{HH}-{uuid}.json"
+)
+
+// config carries the settings of the s3 destination, they are loaded from S3_*
+// environment variables.
+type config struct {
+	// The bucket that the objects are written to, its region and the endpoint
+	// of the S3 API when it isn't the public one (like a VPC endpoint or a
+	// local emulator, which usually needs path style URLs).
+	bucket         string
+	region         string
+	endpoint       string
+	forcePathStyle bool
+
+	// The template of the object keys and the codec compressing the objects.
+	key   string
+	codec codec.Codec
+
+	// An object is written once it reaches maxObjectSize compressed bytes or
+	// once it was opened for maxObjectAge. Its content is uploaded in parts of
+	// partSize bytes as it grows past that size.
+	maxObjectSize int64
+	maxObjectAge  time.Duration
+	partSize      int
+
+	// The storage class and the server side encryption of the objects, the
+	// defaults of the bucket when empty.
+	storageClass string
+	sse          string
+	sseKMSKeyID  string
+
+	// Whether the raw lines that the messages were read from are archived
+	// instead of their JSON representation.
+	raw bool
+
+	err error
+}
+
+func getConfig() (c config) {
+	var err error
+	var s string
+
+	c = config{
+		key:           defaultKey,
+		maxObjectSize: 64 * 1024 * 1024,
+		maxObjectAge:  time.Minute,
+		partSize:      8 * 1024 * 1024,
+	}
+
+	if c.bucket = strings.TrimSpace(lib.Getenv("S3_BUCKET")); len(c.bucket) == 0 {
+		c.err = lib.AppendError(c.err, fmt.Errorf("missing S3_BUCKET environment variable"))
+	}
+
+	if c.region = strings.TrimSpace(lib.Getenv("S3_REGION")); len(c.region) == 0 {
+		if c.region = os.Getenv("AWS_REGION"); len(c.region) == 0 {
+			c.region = os.Getenv("AWS_DEFAULT_REGION")
+		}
+	}
+
+	if len(c.region) == 0 {
+		c.err = lib.AppendError(c.err, fmt.Errorf("the region of the bucket must be set with S3_REGION or AWS_REGION"))
+	}
+
+	c.endpoint = strings.TrimSpace(lib.Getenv("S3_ENDPOINT"))
+
+	if s = strings.TrimSpace(lib.Getenv("S3_FORCE_PATH_STYLE")); len(s) != 0 {
+		if c.forcePathStyle, err = strconv.ParseBool(s); err != nil {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid S3_FORCE_PATH_STYLE, must be a boolean: %s", s))
+		}
+	}
+
+	if c.codec, err = codec.Parse("S3_CODEC", "S3_COMPRESSION_LEVEL", lib.Getenv); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("S3_KEY")); len(s) != 0 {
+		c.key = s
+	}
+
+	if err = checkKey(c.key); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.codec != nil && !strings.HasSuffix(c.key, c.codec.Extension()) {
+		c.key += c.codec.Extension()
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("S3_MAX_OBJECT_SIZE")); len(s) != 0 {
+		if c.maxObjectSize, err = strconv.ParseInt(s, 10, 64); err != nil || c.maxObjectSize < 1024 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid S3_MAX_OBJECT_SIZE, must be a number of bytes of at least 1024: %s", s))
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("S3_MAX_OBJECT_AGE")); len(s) != 0 {
+		if c.maxObjectAge, err = time.ParseDuration(s); err != nil || c.maxObjectAge < time.Second {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid S3_MAX_OBJECT_AGE, must be a duration of at least one second: %s", s))
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("S3_PART_SIZE")); len(s) != 0 {
+		if c.partSize, err = strconv.Atoi(s); err != nil || c.partSize < minPartSize {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid S3_PART_SIZE, must be a number of bytes of at least %d: %s", minPartSize, s))
+		}
+	}
+
+	if c.err == nil && c.maxObjectSize/int64(c.partSize) >= maxParts {
+		c.err = lib.AppendError(c.err, fmt.Errorf("S3_MAX_OBJECT_SIZE must be less than %d times S3_PART_SIZE, the maximum number of parts of an object", maxParts))
+	}
+
+	if c.storageClass = strings.TrimSpace(lib.Getenv("S3_STORAGE_CLASS")); len(c.storageClass) != 0 {
+		if !oneOf(c.storageClass, s3.StorageClass_Values()) {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid S3_STORAGE_CLASS, must be one of %s: %s", strings.Join(s3.StorageClass_Values(), ", "), c.storageClass))
+		}
+	}
+
+	if c.sse = strings.TrimSpace(lib.Getenv("S3_SSE")); len(c.sse) != 0 {
+		if !oneOf(c.sse, s3.ServerSideEncryption_Values()) {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid S3_SSE, must be one of %s: %s", strings.Join(s3.ServerSideEncryption_Values(), ", "), c.sse))
+		}
+	}
+
+	if c.sseKMSKeyID = strings.TrimSpace(lib.Getenv("S3_SSE_KMS_KEY_ID")); len(c.sseKMSKeyID) != 0 && c.sse != s3.ServerSideEncryptionAwsKms {
+		c.err = lib.AppendError(c.err, fmt.Errorf("S3_SSE_KMS_KEY_ID requires S3_SSE=%s", s3.ServerSideEncryptionAwsKms))
+	}
+
+	if c.raw, err = lib.DestinationRawPassthrough("s3"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	return
+}
+
+func (c config) check() error {
+	return c.err
+}
+
+func oneOf(s string, values []string) bool {
+	for _, v := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+var keyVariable = regexp.MustCompile(`\{[^{}]*\}`)
+
+// The variables of the key templates, the dates and times are the ones at which
+// the objects were opened, in UTC.
+var keyVariables = []string{"{group}", "{stream}", "{yyyy}", "{MM}", "{dd}", "{HH}", "{mm}", "{ss}", "{uuid}"}
+
+// checkKey reports the errors of the key template s. It must have the {uuid}
+// variable, otherwise the objects of a stream written within the same period
+// would overwrite each other.
+func checkKey(s string) error {
+	for _, v := range keyVariable.FindAllString(s, -1) {
+		if !oneOf(v, keyVariables) {
+			return fmt.Errorf("invalid S3_KEY, unknown variable %s, must be one of %s: %s", v, strings.Join(keyVariables, ", "), s)
+		}
+	}
+
+	if !strings.Contains(s, "{uuid}") {
+		return fmt.Errorf("invalid S3_KEY, the template must contain {uuid} so the objects of a stream get distinct keys: %s", s)
+	}
+
+	return nil
+}
+
+// objectKey returns the key of an object of a group and stream opened at t
+// from the key template. The slashes of the group names make prefixes, the
+// leading ones are removed so the keys don't start with an empty prefix.
+func objectKey(template string, group string, stream string, t time.Time, uuid string) string {
+	t = t.UTC()
+	two := func(n int) string { return fmt.Sprintf("%02d", n) }
+
+	key := strings.NewReplacer(
+		"{group}", group,
+		"{stream}", stream,
+		"{yyyy}", fmt.Sprintf("%04d", t.Year()),
+		"{MM}", two(int(t.Month())),
+		"{dd}", two(t.Day()),
+		"{HH}", two(t.Hour()),
+		"{mm}", two(t.Minute()),
+		"{ss}", two(t.Second()),
+		"{uuid}", uuid,
+	).Replace(template)
+
+	return strings.TrimLeft(key, "/")
+}
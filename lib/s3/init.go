@@ -0,0 +1,7 @@
+package s3
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterDestination("s3", newDestination(getConfig))
+}
@@ -0,0 +1,430 @@
+// Package s3 implements the s3 destination, which archives the messages of
+// each stream in Amazon S3 objects of newline delimited JSON. The objects are
+// written when they reach a size or an age, the large ones with multipart
+// uploads.
+package s3
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// The content type of the objects, one JSON document or raw line per line.
+const contentType = "application/x-ndjson"
+
+// destination keeps the object being written of each stream, the writers of
+// the batches append to it and it outlives them until it's rolled.
+type destination struct {
+	lazy   lib.LazyConfig
+	load   func() config
+	config config
+
+	mutex    sync.Mutex
+	client   s3iface.S3API
+	archives map[[2]string]*archive
+
+	ids   *lib.MessageIDGenerator
+	clock clock.Clock
+}
+
+func newDestination(load func() config) *destination {
+	return &destination{
+		load:     load,
+		archives: make(map[[2]string]*archive),
+		ids:      lib.NewMessageIDGenerator(lib.UUIDv7MessageIDs),
+		clock:    clock.System,
+	}
+}
+
+func (d *destination) Open(group string, stream string) (w lib.Writer, err error) {
+	if err = d.lazy.Init(d.init); err != nil {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.client == nil {
+		var sess *session.Session
+		var cfg = &aws.Config{
+			Region:           aws.String(d.config.region),
+			S3ForcePathStyle: aws.Bool(d.config.forcePathStyle),
+		}
+
+		if len(d.config.endpoint) != 0 {
+			cfg.Endpoint = aws.String(d.config.endpoint)
+		}
+
+		if sess, err = session.NewSession(cfg); err != nil {
+			return
+		}
+
+		d.client = s3.New(sess)
+	}
+
+	a := d.archives[[2]string{group, stream}]
+
+	if a == nil {
+		a = &archive{dest: d, group: group, stream: stream}
+		d.archives[[2]string{group, stream}] = a
+	}
+
+	w = writer{a}
+	return
+}
+
+// CheckConfig reports the problems with the S3_* settings when ecs-logs
+// starts.
+func (d *destination) CheckConfig() error {
+	return d.load().check()
+}
+
+// Close writes the object of the stream, it's called when the stream expires
+// and when ecs-logs exits.
+func (d *destination) Close(group string, stream string) {
+	if d.lazy.Init(d.init) != nil {
+		return
+	}
+
+	d.mutex.Lock()
+	a := d.archives[[2]string{group, stream}]
+	delete(d.archives, [2]string{group, stream})
+	d.mutex.Unlock()
+
+	if a != nil {
+		a.flush()
+	}
+}
+
+func (d *destination) init() error {
+	d.config = d.load()
+	return d.config.check()
+}
+
+// line returns the line of msg in the objects.
+func (d *destination) line(msg lib.Message) []byte {
+	if line, ok := msg.RawLine(); d.config.raw && ok {
+		return append([]byte(line), '\n')
+	}
+	return append(msg.Bytes(), '\n')
+}
+
+// put writes o with a single request, it's used for the objects that never
+// grew past the size of a part.
+func (d *destination) put(o *object) error {
+	_, err := d.client.PutObject(&s3.PutObjectInput{
+		Bucket:               aws.String(d.config.bucket),
+		Key:                  aws.String(o.key),
+		Body:                 bytes.NewReader(o.buffer.Bytes()),
+		ContentType:          aws.String(contentType),
+		StorageClass:         optional(d.config.storageClass),
+		ServerSideEncryption: optional(d.config.sse),
+		SSEKMSKeyId:          optional(d.config.sseKMSKeyID),
+	})
+	return err
+}
+
+// uploadPart uploads the buffered content of o as its next part, the multipart
+// upload is created with the first one.
+func (d *destination) uploadPart(o *object) error {
+	if o.uploadID == nil {
+		res, err := d.client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket:               aws.String(d.config.bucket),
+			Key:                  aws.String(o.key),
+			ContentType:          aws.String(contentType),
+			StorageClass:         optional(d.config.storageClass),
+			ServerSideEncryption: optional(d.config.sse),
+			SSEKMSKeyId:          optional(d.config.sseKMSKeyID),
+		})
+
+		if err != nil {
+			return err
+		}
+
+		o.uploadID = res.UploadId
+	}
+
+	number := aws.Int64(int64(len(o.parts) + 1))
+
+	res, err := d.client.UploadPart(&s3.UploadPartInput{
+		Bucket:     aws.String(d.config.bucket),
+		Key:        aws.String(o.key),
+		UploadId:   o.uploadID,
+		PartNumber: number,
+		Body:       bytes.NewReader(o.buffer.Bytes()),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	o.parts = append(o.parts, &s3.CompletedPart{ETag: res.ETag, PartNumber: number})
+	o.buffer.Reset()
+	return nil
+}
+
+// complete writes the rest of o and makes it visible in the bucket.
+func (d *destination) complete(o *object) (err error) {
+	if err = o.encoder.Close(); err != nil {
+		return
+	}
+
+	if o.uploadID == nil {
+		return d.put(o)
+	}
+
+	if o.buffer.Len() != 0 {
+		if err = d.uploadPart(o); err != nil {
+			return
+		}
+	}
+
+	_, err = d.client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(d.config.bucket),
+		Key:             aws.String(o.key),
+		UploadId:        o.uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: o.parts},
+	})
+	return
+}
+
+// abort discards the parts of o that were uploaded, S3 would otherwise keep
+// storing them until a lifecycle rule clears the incomplete uploads.
+func (d *destination) abort(o *object) {
+	if o.uploadID == nil {
+		return
+	}
+
+	if _, err := d.client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(d.config.bucket),
+		Key:      aws.String(o.key),
+		UploadId: o.uploadID,
+	}); err != nil {
+		log.WithFields(log.Fields{
+			"bucket": d.config.bucket,
+			"key":    o.key,
+			"error":  err,
+		}).Warn("failed to abort the multipart upload of an s3 object")
+	}
+}
+
+func optional(s string) *string {
+	if len(s) == 0 {
+		return nil
+	}
+	return aws.String(s)
+}
+
+// archive is the object being written of a stream, there is none between the
+// time an object was rolled and the next message of the stream.
+type archive struct {
+	dest   *destination
+	group  string
+	stream string
+
+	mutex  sync.Mutex
+	object *object
+}
+
+// object is the content of an object that wasn't written yet. The messages are
+// compressed in the buffer as they come, it's uploaded as a part whenever it
+// reaches the part size.
+type object struct {
+	key     string
+	encoder io.WriteCloser
+	buffer  bytes.Buffer
+	size    int64
+
+	uploadID *string
+	parts    []*s3.CompletedPart
+
+	// The messages of the object, they are held until it's written so the
+	// sources only commit them once they're durably stored.
+	held lib.MessageBatch
+
+	timer clock.Timer
+	done  chan struct{}
+}
+
+// Write appends the compressed content to the buffer of the object, size
+// counts the bytes of the object that were uploaded as well.
+func (o *object) Write(b []byte) (int, error) {
+	o.size += int64(len(b))
+	return o.buffer.Write(b)
+}
+
+// write appends the messages of batch to the object of the stream, writing it
+// when it reaches the maximum size.
+func (a *archive) write(batch lib.MessageBatch) (err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	d := a.dest
+	n := 0 // the messages of batch in the current object
+
+	for _, msg := range batch {
+		if a.object == nil {
+			if a.object, err = a.open(); err != nil {
+				return
+			}
+			n = 0
+		}
+
+		o := a.object
+
+		if _, err = o.encoder.Write(d.line(msg)); err != nil {
+			return a.fail(n, err)
+		}
+
+		lib.RetainBatch(lib.MessageBatch{msg})
+		o.held = append(o.held, msg)
+		n++
+
+		if o.size >= d.config.maxObjectSize {
+			err = a.roll(n)
+		} else if o.buffer.Len() >= d.config.partSize {
+			if err = d.uploadPart(o); err != nil {
+				err = a.fail(n, err)
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// open starts a new object, its timer rolls it once it reaches the maximum
+// age.
+func (a *archive) open() (o *object, err error) {
+	d := a.dest
+	o = &object{
+		key:  objectKey(d.config.key, a.group, a.stream, d.clock.Now(), d.ids.New()),
+		done: make(chan struct{}),
+	}
+
+	if o.encoder, err = d.config.codec.NewWriter(o); err != nil {
+		return nil, err
+	}
+
+	o.timer = d.clock.NewTimer(d.config.maxObjectAge)
+	go a.expire(o)
+	return
+}
+
+func (a *archive) expire(o *object) {
+	select {
+	case <-o.timer.C():
+	case <-o.done:
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.object == o {
+		a.report(o, a.roll(0))
+	}
+}
+
+// flush writes the object of the stream, if it has one.
+func (a *archive) flush() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if o := a.object; o != nil {
+		a.report(o, a.roll(0))
+	}
+}
+
+// roll writes the current object, n is the number of its messages that are
+// part of the batch being written.
+func (a *archive) roll(n int) error {
+	o := a.object
+	a.object = nil
+	o.stop()
+
+	if err := a.dest.complete(o); err != nil {
+		a.object = o
+		return a.fail(n, err)
+	}
+
+	lib.AcknowledgeBatch(o.held)
+	return nil
+}
+
+// fail discards the current object after err prevented writing it. Its
+// messages are dropped and rewound so the sources deliver them again, but
+// the last n that are part of the batch being written, which the caller of
+// the writer already drops since the write returns the error.
+func (a *archive) fail(n int, err error) error {
+	o := a.object
+	a.object = nil
+	o.stop()
+	a.dest.abort(o)
+
+	if earlier := o.held[:len(o.held)-n]; len(earlier) != 0 {
+		lib.LogMessages(earlier, "dropped", log.Fields{"destination": "s3"})
+		lib.RewindBatch(earlier)
+	}
+
+	return fmt.Errorf("writing the object %s to the s3 bucket %s: %s", o.key, a.dest.config.bucket, err)
+}
+
+// report logs the error of an object rolled outside of a write, there is no
+// caller to return it to.
+func (a *archive) report(o *object, err error) {
+	if err == nil {
+		return
+	}
+
+	metrics.Default.Counter("write_errors", "destination", "s3").Add(1)
+	log.WithFields(log.Fields{
+		"group":       a.group,
+		"stream":      a.stream,
+		"destination": "s3",
+		"error":       err,
+		"count":       len(o.held),
+	}).Error("dropping the messages of an s3 object that failed to be written")
+}
+
+func (o *object) stop() {
+	o.timer.Stop()
+
+	select {
+	case <-o.done:
+	default:
+		close(o.done)
+	}
+}
+
+type writer struct {
+	archive *archive
+}
+
+// Close returns right away, the object of the stream stays open for the next
+// batches until it's rolled.
+func (w writer) Close() error {
+	return nil
+}
+
+func (w writer) WriteMessage(msg lib.Message) error {
+	return w.WriteMessageBatch(lib.MessageBatch{msg})
+}
+
+func (w writer) WriteMessageBatch(batch lib.MessageBatch) error {
+	return w.archive.write(batch)
+}
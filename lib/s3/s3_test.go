@@ -0,0 +1,534 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/codec"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// mockAPI stores the objects that were put or uploaded in parts, fail returns
+// the error of the calls of the given operation.
+type mockAPI struct {
+	s3iface.S3API
+
+	mutex   sync.Mutex
+	objects map[string][]byte
+	uploads map[string][][]byte
+	input   *s3.PutObjectInput
+	aborted []string
+	fail    func(op string) error
+}
+
+func newMockAPI() *mockAPI {
+	return &mockAPI{objects: make(map[string][]byte), uploads: make(map[string][][]byte)}
+}
+
+func (m *mockAPI) err(op string) error {
+	if m.fail != nil {
+		return m.fail(op)
+	}
+	return nil
+}
+
+func (m *mockAPI) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.err("PutObject"); err != nil {
+		return nil, err
+	}
+
+	b, _ := ioutil.ReadAll(input.Body)
+	m.objects[aws.StringValue(input.Key)] = b
+	m.input = input
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (m *mockAPI) CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.err("CreateMultipartUpload"); err != nil {
+		return nil, err
+	}
+
+	id := fmt.Sprintf("upload-%d", len(m.uploads))
+	m.uploads[id] = nil
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(id)}, nil
+}
+
+func (m *mockAPI) UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.err("UploadPart"); err != nil {
+		return nil, err
+	}
+
+	id := aws.StringValue(input.UploadId)
+
+	if n := aws.Int64Value(input.PartNumber); n != int64(len(m.uploads[id])+1) {
+		return nil, fmt.Errorf("part %d uploaded after part %d", n, len(m.uploads[id]))
+	}
+
+	b, _ := ioutil.ReadAll(input.Body)
+	m.uploads[id] = append(m.uploads[id], b)
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("etag-%d", len(m.uploads[id])))}, nil
+}
+
+func (m *mockAPI) CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.err("CompleteMultipartUpload"); err != nil {
+		return nil, err
+	}
+
+	id := aws.StringValue(input.UploadId)
+	parts := m.uploads[id]
+
+	if len(input.MultipartUpload.Parts) != len(parts) {
+		return nil, fmt.Errorf("%d parts completed out of %d", len(input.MultipartUpload.Parts), len(parts))
+	}
+
+	for i, p := range parts {
+		if i != len(parts)-1 && len(p) < minPartSize {
+			return nil, fmt.Errorf("the part %d is too small: %d bytes", i+1, len(p))
+		}
+	}
+
+	m.objects[aws.StringValue(input.Key)] = bytes.Join(parts, nil)
+	delete(m.uploads, id)
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (m *mockAPI) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.uploads, aws.StringValue(input.UploadId))
+	m.aborted = append(m.aborted, aws.StringValue(input.Key))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (m *mockAPI) keys() (keys []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for k := range m.objects {
+		keys = append(keys, k)
+	}
+	return
+}
+
+func newTestDestination(c config) (*destination, *mockAPI, *clock.Fake) {
+	api := newMockAPI()
+	f := clock.NewFake(time.Date(2016, 10, 12, 13, 4, 5, 0, time.UTC))
+
+	if c.codec == nil {
+		c.codec, _ = codec.Get("gzip", 0)
+	}
+
+	if len(c.key) == 0 {
+		c.key = defaultKey + c.codec.Extension()
+	}
+
+	if c.maxObjectSize == 0 {
+		c.maxObjectSize = 64 * 1024 * 1024
+	}
+
+	if c.maxObjectAge == 0 {
+		c.maxObjectAge = time.Minute
+	}
+
+	if c.partSize == 0 {
+		c.partSize = minPartSize
+	}
+
+	c.bucket = "logs"
+	d := newDestination(func() config { return c })
+	d.client = api
+	d.clock = f
+	return d, api, f
+}
+
+// readObject decodes the messages of an object encoded with c.
+func readObject(t *testing.T, c codec.Codec, b []byte) (messages []string) {
+	r, err := c.NewReader(bytes.NewReader(b))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 4*1024*1024)
+
+	for s.Scan() {
+		var m lib.Message
+
+		if err := json.Unmarshal(s.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+
+		messages = append(messages, m.Event.Message)
+	}
+
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func TestWriteObject(t *testing.T) {
+	d, api, _ := newTestDestination(config{storageClass: "STANDARD_IA"})
+	w, _ := d.Open("/ecs/api", "B")
+
+	if err := w.WriteMessageBatch(lib.MessageBatch{makeMessage("A"), makeMessage("B")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteMessage(makeMessage("C")); err != nil {
+		t.Fatal(err)
+	}
+
+	w.Close()
+
+	if keys := api.keys(); len(keys) != 0 {
+		t.Fatalf("the object shouldn't be written before it's rolled: %v", keys)
+	}
+
+	d.Close("/ecs/api", "B")
+	keys := api.keys()
+
+	if len(keys) != 1 {
+		t.Fatalf("one object should have been written: %v", keys)
+	}
+
+	if !regexp.MustCompile(`^ecs/api/B/2016/10/12/13-[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[0-9a-f]{4}-[0-9a-f]{12}\.json\.gz$`).MatchString(keys[0]) {
+		t.Errorf("invalid object key: %s", keys[0])
+	}
+
+	if msgs := readObject(t, d.config.codec, api.objects[keys[0]]); strings.Join(msgs, ",") != "A,B,C" {
+		t.Errorf("invalid object content: %v", msgs)
+	}
+
+	if c := aws.StringValue(api.input.StorageClass); c != "STANDARD_IA" {
+		t.Errorf("invalid storage class: %s", c)
+	}
+
+	if api.input.ServerSideEncryption != nil {
+		t.Error("the encryption of the bucket should be used by default")
+	}
+}
+
+func TestRollByAge(t *testing.T) {
+	d, api, f := newTestDestination(config{maxObjectAge: 30 * time.Second})
+	w, _ := d.Open("api", "B")
+
+	w.WriteMessage(makeMessage("A"))
+	f.Advance(20 * time.Second)
+	w.WriteMessage(makeMessage("B"))
+
+	if keys := api.keys(); len(keys) != 0 {
+		t.Fatalf("the object shouldn't be written before it's 30s old: %v", keys)
+	}
+
+	f.Advance(10 * time.Second)
+	waitObjects(t, api, 1)
+
+	// The next message opens a new object, with its own age.
+	w.WriteMessage(makeMessage("C"))
+	f.Advance(29 * time.Second)
+
+	if keys := api.keys(); len(keys) != 1 {
+		t.Fatalf("the second object shouldn't be written yet: %v", keys)
+	}
+
+	f.Advance(time.Second)
+	waitObjects(t, api, 2)
+
+	var msgs []string
+
+	for _, k := range api.keys() {
+		msgs = append(msgs, readObject(t, d.config.codec, api.objects[k])...)
+	}
+
+	if len(msgs) != 3 {
+		t.Errorf("invalid messages: %v", msgs)
+	}
+}
+
+// waitObjects waits for the timers to have written n objects.
+func waitObjects(t *testing.T, api *mockAPI, n int) {
+	for i := 0; len(api.keys()) != n; i++ {
+		if i == 100 {
+			t.Fatalf("%d objects should have been written: %v", n, api.keys())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRollBySize(t *testing.T) {
+	none, _ := codec.Get("none", 0)
+	d, api, _ := newTestDestination(config{codec: none, maxObjectSize: 12 * 1024 * 1024})
+	w, _ := d.Open("api", "B")
+
+	var batch lib.MessageBatch
+
+	for i := 0; i != 20; i++ {
+		batch = append(batch, makeMessage(fmt.Sprintf("%02d%s", i, strings.Repeat("x", 1024*1024))))
+	}
+
+	if err := w.WriteMessageBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := api.keys()
+
+	if len(keys) != 1 {
+		t.Fatalf("one object should have been written: %v", keys)
+	}
+
+	// The object is rolled by the message that makes it reach 12 MB, after
+	// two parts of 5 MB and a last smaller one.
+	msgs := readObject(t, none, api.objects[keys[0]])
+
+	if len(msgs) != 12 || !strings.HasPrefix(msgs[11], "11") {
+		t.Errorf("the object should have the first 12 messages: %d", len(msgs))
+	}
+
+	if len(api.uploads) != 1 {
+		t.Errorf("the rest of the messages should be in a multipart upload: %d", len(api.uploads))
+	}
+
+	d.Close("api", "B")
+
+	for _, k := range api.keys() {
+		if k != keys[0] {
+			if msgs := readObject(t, none, api.objects[k]); len(msgs) != 8 {
+				t.Errorf("the second object should have the last 8 messages: %d", len(msgs))
+			}
+		}
+	}
+}
+
+func TestWriteFailure(t *testing.T) {
+	d, api, _ := newTestDestination(config{})
+	w, _ := d.Open("api", "B")
+
+	a := &acknowledger{AckTracker: lib.NewAckTracker("test", 0, 0, metrics.NewRegistry())}
+	m0, m1 := a.read(0, "a"), a.read(1, "b")
+
+	// The destination holds the messages until the object is written, the
+	// ones the caller acknowledged are released when it fails.
+	lib.HandOff(m0, []lib.Message{m0})
+	lib.HandOff(m1, []lib.Message{m1})
+	w.WriteMessageBatch(lib.MessageBatch{m0, m1})
+	lib.AcknowledgeBatch(lib.MessageBatch{m0, m1})
+
+	if a.Pending() != 2 {
+		t.Fatalf("the messages of the object should be held: %d", a.Pending())
+	}
+
+	api.fail = func(op string) error { return errors.New("SlowDown") }
+	d.Close("api", "B")
+
+	if _, ok := a.Committed(); ok {
+		t.Error("the messages that failed to be written shouldn't be committed")
+	}
+
+	if len(a.rewound) != 1 || a.rewound[0].Seq != 0 {
+		t.Errorf("the messages should have been rewound: %+v", a.rewound)
+	}
+}
+
+func TestWriteAcknowledged(t *testing.T) {
+	d, _, _ := newTestDestination(config{})
+	w, _ := d.Open("api", "B")
+
+	a := &acknowledger{AckTracker: lib.NewAckTracker("test", 0, 0, metrics.NewRegistry())}
+	m0 := a.read(0, "a")
+
+	// The hold of the read moves to the message handed to the destination,
+	// like the stages do.
+	lib.HandOff(m0, []lib.Message{m0})
+	w.WriteMessage(m0)
+	lib.AcknowledgeBatch(lib.MessageBatch{m0})
+
+	if _, ok := a.Committed(); ok {
+		t.Error("the message should not be committed before its object was written")
+	}
+
+	d.Close("api", "B")
+
+	if pos, ok := a.Committed(); !ok || pos.Checkpoint != "a" {
+		t.Errorf("the message should be committed once its object was written: %+v", pos)
+	}
+}
+
+func TestAbortMultipartUpload(t *testing.T) {
+	none, _ := codec.Get("none", 0)
+	d, api, _ := newTestDestination(config{codec: none})
+	w, _ := d.Open("api", "B")
+
+	api.fail = func(op string) error {
+		if op == "UploadPart" && len(api.uploads["upload-0"]) == 1 {
+			return errors.New("InternalError")
+		}
+		return nil
+	}
+
+	var batch lib.MessageBatch
+
+	for i := 0; i != 12; i++ {
+		batch = append(batch, makeMessage(strings.Repeat("x", 1024*1024)))
+	}
+
+	if err := w.WriteMessageBatch(batch); err == nil || !strings.Contains(err.Error(), "InternalError") {
+		t.Errorf("the error of the upload should be returned: %v", err)
+	}
+
+	if len(api.aborted) != 1 || len(api.uploads) != 0 {
+		t.Errorf("the multipart upload should have been aborted: %v", api.aborted)
+	}
+
+	// The next batch starts another object.
+	w.WriteMessage(makeMessage("A"))
+	api.fail = nil
+	d.Close("api", "B")
+
+	if keys := api.keys(); len(keys) != 1 {
+		t.Errorf("the next object should have been written: %v", keys)
+	}
+}
+
+func TestRawPassthrough(t *testing.T) {
+	lib.EnableRawLines()
+
+	d, api, _ := newTestDestination(config{raw: true})
+	w, _ := d.Open("api", "B")
+
+	msg := lib.ParseMessage(lib.GetParser("raw"), []byte(`<14>Oct 12 00:00:00 host api: A`))
+	msg.Group, msg.Stream = "api", "B"
+	w.WriteMessage(msg)
+	d.Close("api", "B")
+
+	r, _ := d.config.codec.NewReader(bytes.NewReader(api.objects[api.keys()[0]]))
+	b, _ := ioutil.ReadAll(r)
+
+	if s := string(b); s != "<14>Oct 12 00:00:00 host api: A\n" {
+		t.Errorf("the raw line should be archived: %q", s)
+	}
+}
+
+func TestObjectKey(t *testing.T) {
+	now := time.Date(2016, 10, 12, 13, 4, 5, 0, time.FixedZone("PDT", -7*3600))
+
+	for _, test := range []struct {
+		template string
+		key      string
+	}{
+		{defaultKey + ".gz", "ecs/api/B/2016/10/12/20-ID.json.gz"},
+		{"logs/{yyyy}{MM}{dd}/{HH}{mm}{ss}/{group}-{uuid}", "logs/20161012/200405//ecs/api-ID"},
+	} {
+		if key := objectKey(test.template, "/ecs/api", "B", now, "ID"); key != test.key {
+			t.Errorf("%s: invalid object key: %s != %s", test.template, key, test.key)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(map[string]string{
+		"S3_BUCKET":          "logs",
+		"S3_REGION":          "us-west-2",
+		"S3_CODEC":           "zstd",
+		"S3_KEY":             "{group}/{uuid}.ndjson",
+		"S3_MAX_OBJECT_SIZE": "1048576",
+		"S3_MAX_OBJECT_AGE":  "5m",
+		"S3_SSE":             "aws:kms",
+		"S3_SSE_KMS_KEY_ID":  "alias/logs",
+	})
+
+	c := getConfig()
+
+	if err := c.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.key != "{group}/{uuid}.ndjson.zst" || c.maxObjectSize != 1048576 || c.maxObjectAge != 5*time.Minute || c.partSize != 8*1024*1024 {
+		t.Errorf("invalid configuration: %+v", c)
+	}
+
+	for env, value := range map[string]string{
+		"S3_KEY":             "{group}/{date}-{uuid}",
+		"S3_CODEC":           "lz4",
+		"S3_PART_SIZE":       "1048576",
+		"S3_MAX_OBJECT_SIZE": "1TB",
+		"S3_MAX_OBJECT_AGE":  "10ms",
+		"S3_STORAGE_CLASS":   "COLD",
+		"S3_SSE":             "des",
+	} {
+		lib.SetConfigEnv(map[string]string{"S3_BUCKET": "logs", "S3_REGION": "us-west-2", env: value})
+
+		if err := getConfig().check(); err == nil || !strings.Contains(err.Error(), env) {
+			t.Errorf("%s=%s should be rejected: %v", env, value, err)
+		}
+	}
+
+	lib.SetConfigEnv(map[string]string{"S3_BUCKET": "logs", "S3_REGION": "us-west-2", "S3_KEY": "{group}/{stream}.json"})
+
+	if err := getConfig().check(); err == nil || !strings.Contains(err.Error(), "{uuid}") {
+		t.Errorf("a key template without {uuid} should be rejected: %v", err)
+	}
+}
+
+// acknowledger is a source tracking the acknowledgements of its messages and
+// recording the positions it was rewound to.
+type acknowledger struct {
+	*lib.AckTracker
+
+	mutex   sync.Mutex
+	rewound []lib.Position
+}
+
+func (a *acknowledger) Rewind(pos lib.Position) {
+	a.mutex.Lock()
+	a.rewound = append(a.rewound, pos)
+	a.mutex.Unlock()
+}
+
+func (a *acknowledger) read(seq int64, checkpoint string) (msg lib.Message) {
+	msg = makeMessage(checkpoint)
+	pos := lib.Position{Seq: seq, Checkpoint: checkpoint}
+	a.Read(pos, time.Unix(0, 0))
+	lib.SetOrigin(&msg, a, pos)
+	return
+}
+
+func makeMessage(message string) lib.Message {
+	return lib.Message{
+		Group:  "api",
+		Stream: "B",
+		Event:  ecslogs.Event{Message: message, Time: time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC)},
+	}
+}
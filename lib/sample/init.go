@@ -0,0 +1,7 @@
+package sample
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterStage("sample", lib.NewCheckedStage(lib.StageFunc(NewProcessor), checkConfig))
+}
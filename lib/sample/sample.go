@@ -0,0 +1,268 @@
+// Package sample implements the sample stage, which keeps a fraction of the
+// messages of noisy groups and levels, and collapses the identical messages
+// that a stream repeats within a window into the first one and a rollup
+// counting the others.
+package sample
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+const (
+	// RateField is the data field of the sampled messages carrying the
+	// fraction of the messages like them that were kept, so the counts can be
+	// extrapolated.
+	RateField = "sample_rate"
+
+	// RepeatField is the data field of rollups carrying the number of
+	// duplicates, the same as the one of the repeat stage.
+	RepeatField = "repeated"
+)
+
+type config struct {
+	// The fraction of the messages kept by group and level, the first rule
+	// matching a message applies and the messages matching none are kept.
+	rules []rule
+
+	// How long the duplicates of a message are collapsed after it was seen,
+	// zero disables the deduplication.
+	window time.Duration
+
+	// The maximum number of distinct messages tracked for deduplication,
+	// the messages seen once the limit is reached are forwarded as they are.
+	maxEntries int
+}
+
+// rule keeps rate of the messages whose group matches pattern, and that have
+// the given level unless it's NONE.
+type rule struct {
+	pattern string
+	level   ecslogs.Level
+	rate    float64
+}
+
+func getConfig() (c config, err error) {
+	c.maxEntries = 10000
+
+	if c.rules, err = parseRules(lib.Getenv("SAMPLE_RATES")); err != nil {
+		return
+	}
+
+	if s := strings.TrimSpace(lib.Getenv("SAMPLE_DEDUP_WINDOW")); len(s) != 0 {
+		if c.window, err = time.ParseDuration(s); err != nil || c.window < 0 {
+			err = fmt.Errorf("invalid SAMPLE_DEDUP_WINDOW, must be a positive duration or zero: %s", s)
+			return
+		}
+	}
+
+	if s := strings.TrimSpace(lib.Getenv("SAMPLE_DEDUP_MAX_ENTRIES")); len(s) != 0 {
+		if c.maxEntries, err = strconv.Atoi(s); err != nil || c.maxEntries <= 0 {
+			err = fmt.Errorf("invalid SAMPLE_DEDUP_MAX_ENTRIES, must be a positive integer: %s", s)
+			return
+		}
+	}
+
+	if len(c.rules) == 0 && c.window == 0 {
+		err = fmt.Errorf("the sample stage needs SAMPLE_RATES or SAMPLE_DEDUP_WINDOW")
+	}
+
+	return
+}
+
+// parseRules parses a comma separated list of group[:LEVEL]=rate rules, for
+// example "web:DEBUG=0.1,batch-*=0.5".
+func parseRules(s string) (rules []rule, err error) {
+	for _, item := range strings.Split(s, ",") {
+		var r rule
+
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+
+		i := strings.LastIndexByte(item, '=')
+
+		if i < 0 {
+			err = fmt.Errorf("invalid SAMPLE_RATES, expected group[:LEVEL]=rate: %s", item)
+			return
+		}
+
+		r.pattern = strings.TrimSpace(item[:i])
+
+		// The level is optional, the groups may contain colons so the
+		// suffix is only a level if it parses as one.
+		if j := strings.LastIndexByte(r.pattern, ':'); j >= 0 {
+			if lvl, e := ecslogs.ParseLevel(strings.TrimSpace(r.pattern[j+1:])); e == nil {
+				r.pattern, r.level = strings.TrimSpace(r.pattern[:j]), lvl
+			}
+		}
+
+		if _, e := path.Match(r.pattern, ""); e != nil || len(r.pattern) == 0 {
+			err = fmt.Errorf("invalid SAMPLE_RATES, bad group pattern: %s", item)
+			return
+		}
+
+		if r.rate, err = strconv.ParseFloat(strings.TrimSpace(item[i+1:]), 64); err != nil || r.rate < 0 || r.rate > 1 {
+			err = fmt.Errorf("invalid SAMPLE_RATES, the rate must be between 0 and 1: %s", item)
+			return
+		}
+
+		rules = append(rules, r)
+	}
+	return
+}
+
+func NewProcessor() (p lib.Processor, err error) {
+	var c config
+
+	if c, err = getConfig(); err == nil {
+		p = newProcessor(c)
+	}
+
+	return
+}
+
+func checkConfig() (err error) {
+	_, err = getConfig()
+	return
+}
+
+// processor samples the messages after collapsing their duplicates, so the
+// rollups count all the duplicates that were seen whether or not the message
+// they repeat was kept. The rollups themselves are never dropped.
+type processor struct {
+	config
+	random  func() float64
+	entries map[string]*entry
+}
+
+// entry tracks the duplicates of a message during the window that it opened,
+// the first of them holds their source until the rollup is delivered.
+type entry struct {
+	first lib.Message
+	last  time.Time
+	count int
+	start time.Time
+}
+
+func newProcessor(c config) *processor {
+	return &processor{
+		config:  c,
+		random:  rand.Float64,
+		entries: make(map[string]*entry),
+	}
+}
+
+func (p *processor) Process(msg lib.Message, now time.Time) (msgs []lib.Message) {
+	if p.window != 0 {
+		k := key(msg)
+
+		if e := p.entries[k]; e != nil {
+			if now.Sub(e.start) < p.window {
+				if e.count++; e.count == 1 {
+					lib.Hold(&msg)
+					e.first = msg
+				}
+				e.last = msg.Event.Time
+				return nil
+			}
+
+			msgs = e.rollup(msgs)
+			delete(p.entries, k)
+		}
+
+		if len(p.entries) < p.maxEntries {
+			p.entries[k] = &entry{start: now}
+		}
+	}
+
+	if msg, ok := p.sample(msg); ok {
+		msgs = append(msgs, msg)
+	}
+
+	return
+}
+
+func (p *processor) Flush(now time.Time) (msgs []lib.Message) {
+	for k, e := range p.entries {
+		if now.Sub(e.start) >= p.window {
+			msgs = e.rollup(msgs)
+			delete(p.entries, k)
+		}
+	}
+	return
+}
+
+// sample returns msg annotated with its sample rate and true if it's kept.
+func (p *processor) sample(msg lib.Message) (lib.Message, bool) {
+	rate := p.rate(msg)
+
+	if rate >= 1 {
+		return msg, true
+	}
+
+	if rate == 0 || p.random() >= rate {
+		return msg, false
+	}
+
+	msg.Event.Data = withField(msg.Event.Data, RateField, rate)
+	return msg, true
+}
+
+// rate returns the fraction of the messages like msg that are kept.
+func (p *processor) rate(msg lib.Message) float64 {
+	for _, r := range p.rules {
+		if r.level != ecslogs.NONE && r.level != msg.Event.Level {
+			continue
+		}
+
+		if ok, _ := path.Match(r.pattern, msg.Group); ok {
+			return r.rate
+		}
+	}
+	return 1
+}
+
+// rollup appends a message reporting the duplicates of the entry to msgs, if
+// there were some. The rollup is made of the first duplicate so it carries its
+// hold, with the time of the last one.
+func (e *entry) rollup(msgs []lib.Message) []lib.Message {
+	if e.count == 0 {
+		return msgs
+	}
+
+	msg := e.first
+	msg.Event.Time = e.last
+	msg.Event.Data = withField(msg.Event.Data, RepeatField, e.count)
+	msg.Event.Message = fmt.Sprintf("%s (repeated %d times)", msg.Event.Message, e.count)
+	msg.Received = time.Time{}
+	return append(msgs, msg)
+}
+
+// withField returns a copy of data with the field set, the data of the
+// original message may be shared with other destinations or stages.
+func withField(data ecslogs.EventData, name string, value interface{}) ecslogs.EventData {
+	d := make(ecslogs.EventData, len(data)+1)
+
+	for k, v := range data {
+		d[k] = v
+	}
+
+	d[name] = value
+	return d
+}
+
+// key identifies the messages of a stream that only differ by their time, the
+// data is encoded as JSON which sorts the keys of its objects.
+func key(msg lib.Message) string {
+	data, _ := json.Marshal(msg.Event.Data)
+	return strings.Join([]string{msg.Group, msg.Stream, msg.Event.Level.String(), msg.Event.Message, string(data)}, "\x00")
+}
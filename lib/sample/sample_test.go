@@ -0,0 +1,171 @@
+package sample
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+var epoch = time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC)
+
+func TestProcessorSampling(t *testing.T) {
+	p := newProcessor(config{rules: []rule{
+		{pattern: "web", level: ecslogs.DEBUG, rate: 0.1},
+		{pattern: "batch-*", rate: 0},
+	}})
+
+	// One message out of ten is kept with a deterministic random source.
+	n := 0
+	p.random = func() float64 { n++; return float64(n%10) / 10 }
+
+	kept := 0
+
+	for i := 0; i != 100; i++ {
+		for _, msg := range p.Process(makeMessage("web", ecslogs.DEBUG, "cache miss"), epoch) {
+			if msg.Event.Data[RateField] != 0.1 {
+				t.Errorf("the sampled messages should carry their rate: %+v", msg.Event.Data)
+			}
+			kept++
+		}
+	}
+
+	if kept != 10 {
+		t.Errorf("10%% of the DEBUG messages of web should be kept: %d", kept)
+	}
+
+	for _, msg := range []lib.Message{
+		makeMessage("web", ecslogs.INFO, "started"),
+		makeMessage("api", ecslogs.DEBUG, "cache miss"),
+	} {
+		if output := p.Process(msg, epoch); len(output) != 1 || output[0].Event.Data[RateField] != nil {
+			t.Errorf("the messages matching no rule should be forwarded as they are: %+v", output)
+		}
+	}
+
+	if output := p.Process(makeMessage("batch-1", ecslogs.ERROR, "failed"), epoch); len(output) != 0 {
+		t.Errorf("a zero rate should drop all the messages: %+v", output)
+	}
+}
+
+func TestProcessorDedup(t *testing.T) {
+	p := newProcessor(config{window: time.Minute, maxEntries: 100})
+
+	// Unlike the repeat stage the duplicates don't have to be consecutive.
+	output := process(p, []lib.Message{
+		makeMessage("G", ecslogs.ERROR, "timeout"),
+		makeMessage("G", ecslogs.ERROR, "retrying"),
+		makeMessage("G", ecslogs.ERROR, "timeout"),
+		makeMessage("G", ecslogs.WARN, "timeout"),
+		makeMessage("G", ecslogs.ERROR, "timeout"),
+	})
+
+	if ref := []string{"timeout", "retrying", "timeout"}; !reflect.DeepEqual(output, ref) {
+		t.Errorf("invalid output:\n- expected: %#v\n- found:    %#v", ref, output)
+	}
+
+	if msgs := p.Flush(epoch.Add(30 * time.Second)); len(msgs) != 0 {
+		t.Errorf("no rollup should be emitted before the end of the window: %+v", msgs)
+	}
+
+	msgs := p.Flush(epoch.Add(time.Minute))
+
+	if len(msgs) != 1 {
+		t.Fatalf("a single rollup should be emitted at the end of the window: %+v", msgs)
+	}
+
+	if msg := msgs[0]; msg.Event.Message != "timeout (repeated 2 times)" || msg.Event.Data[RepeatField] != 2 || !msg.Received.IsZero() {
+		t.Errorf("invalid rollup: %+v", msg)
+	}
+
+	if p.Flush(epoch.Add(2 * time.Minute)); len(p.entries) != 0 {
+		t.Errorf("the expired entries should be forgotten: %d", len(p.entries))
+	}
+
+	// A duplicate seen after the window opens a new one, the rollup of the
+	// previous window goes first.
+	p.Process(makeMessage("G", ecslogs.INFO, "ping"), epoch)
+	p.Process(makeMessage("G", ecslogs.INFO, "ping"), epoch.Add(time.Second))
+
+	if msgs := p.Process(makeMessage("G", ecslogs.INFO, "ping"), epoch.Add(2*time.Minute)); len(msgs) != 2 || msgs[0].Event.Data[RepeatField] != 1 || msgs[1].Event.Message != "ping" {
+		t.Errorf("the new window should follow the rollup of the previous one: %+v", msgs)
+	}
+}
+
+func TestProcessorDedupBeforeSampling(t *testing.T) {
+	p := newProcessor(config{window: time.Minute, maxEntries: 1, rules: []rule{{pattern: "*", rate: 0}}})
+
+	process(p, []lib.Message{
+		makeMessage("G", ecslogs.DEBUG, "A"),
+		makeMessage("G", ecslogs.DEBUG, "A"),
+		makeMessage("G", ecslogs.DEBUG, "B"),
+	})
+
+	// The rollups are never sampled, the messages past the maximum number
+	// of entries aren't tracked.
+	if msgs := p.Flush(epoch.Add(time.Hour)); len(msgs) != 1 || msgs[0].Event.Message != "A (repeated 1 times)" {
+		t.Errorf("invalid rollups: %+v", msgs)
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := parseRules("web:DEBUG=0.1, /ecs/api:v2:INFO=0.5, batch-*=0")
+
+	ref := []rule{
+		{pattern: "web", level: ecslogs.DEBUG, rate: 0.1},
+		{pattern: "/ecs/api:v2", level: ecslogs.INFO, rate: 0.5},
+		{pattern: "batch-*", rate: 0},
+	}
+
+	if err != nil || !reflect.DeepEqual(rules, ref) {
+		t.Errorf("invalid rules: %+v (%v)", rules, err)
+	}
+
+	for _, s := range []string{"web", "web=2", "web=-0.1", "[web=0.5", ":DEBUG=0.5"} {
+		if _, err := parseRules(s); err == nil {
+			t.Errorf("%q: the rules should be rejected", s)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(map[string]string{"SAMPLE_DEDUP_WINDOW": "10s"})
+
+	if c, err := getConfig(); err != nil || c.window != 10*time.Second || c.maxEntries != 10000 {
+		t.Errorf("invalid config: %+v (%v)", c, err)
+	}
+
+	for _, env := range []map[string]string{
+		{},
+		{"SAMPLE_DEDUP_WINDOW": "soon"},
+		{"SAMPLE_RATES": "web=0.5", "SAMPLE_DEDUP_MAX_ENTRIES": "0"},
+	} {
+		lib.SetConfigEnv(env)
+
+		if err := checkConfig(); err == nil {
+			t.Errorf("%v: the configuration should be rejected", env)
+		}
+	}
+}
+
+func process(p lib.Processor, input []lib.Message) (output []string) {
+	for i, msg := range input {
+		for _, m := range p.Process(msg, epoch.Add(time.Duration(i)*time.Second)) {
+			output = append(output, m.Event.Message)
+		}
+	}
+	return
+}
+
+func makeMessage(group string, level ecslogs.Level, message string) lib.Message {
+	return lib.Message{
+		Group:    group,
+		Stream:   "S",
+		Received: epoch,
+		Event:    ecslogs.Event{Level: level, Message: message, Time: epoch, Data: ecslogs.EventData{"group": group}},
+	}
+}
@@ -0,0 +1,11 @@
+package schema
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterStage("schema", lib.NewCheckedStage(lib.StageFunc(NewProcessor), checkConfig))
+
+	// The fields attached by these stages would get around the schema if they
+	// were set after it ran.
+	lib.RegisterStageOrder("schema", lib.StageOrder{After: []string{"correlation", "metadata", "xray"}})
+}
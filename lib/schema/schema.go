@@ -0,0 +1,329 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+const (
+	// The event data fields that aren't part of the schema are kept.
+	Keep = "keep"
+
+	// The event data fields that aren't part of the schema are dropped.
+	Drop = "drop"
+)
+
+// The top-level fields of events, schema keys can't take their names since
+// they would be renamed when the event is flattened.
+var reservedKeys = []string{"level", "time", "message", "info", "data"}
+
+// The message fields that schema keys can be extracted from, the info and data
+// fields are referenced with dotted paths like info.host or data.request.id.
+var sourceFields = []string{"group", "stream", "level", "time", "message"}
+
+type field struct {
+	// The key of the field in the event data.
+	key string
+
+	// The path of the message field the value is extracted from.
+	source string
+
+	// The value set when the message has no value at the source path.
+	value interface{}
+}
+
+type config struct {
+	fields  []field
+	unknown string
+}
+
+func getConfig() (c config, err error) {
+	c.unknown = Keep
+	var s string
+
+	if s = strings.TrimSpace(lib.Getenv("SCHEMA_FIELDS")); len(s) == 0 {
+		err = fmt.Errorf("invalid SCHEMA_FIELDS, the list of schema keys must be set")
+		return
+	}
+
+	if c.fields, err = parseFields(s); err != nil {
+		err = fmt.Errorf("invalid SCHEMA_FIELDS, %s", err)
+		return
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("SCHEMA_DEFAULTS")); len(s) != 0 {
+		if err = parseDefaults(c.fields, s); err != nil {
+			err = fmt.Errorf("invalid SCHEMA_DEFAULTS, %s", err)
+			return
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("SCHEMA_UNKNOWN")); len(s) != 0 {
+		switch c.unknown = s; c.unknown {
+		case Keep, Drop:
+		default:
+			err = fmt.Errorf("invalid SCHEMA_UNKNOWN, must be one of %s or %s: %s", Keep, Drop, s)
+			return
+		}
+	}
+
+	return
+}
+
+// parseFields parses a comma separated list of key=source items, the source
+// defaults to the data field of the same name when omitted.
+func parseFields(s string) (fields []field, err error) {
+	seen := make(map[string]bool)
+
+	for _, item := range strings.Split(s, ",") {
+		var f field
+
+		if i := strings.IndexByte(item, '='); i < 0 {
+			f.key = strings.TrimSpace(item)
+			f.source = "data." + f.key
+		} else {
+			f.key = strings.TrimSpace(item[:i])
+			f.source = strings.TrimSpace(item[i+1:])
+		}
+
+		switch {
+		case len(f.key) == 0:
+			err = fmt.Errorf("empty schema key: %s", item)
+		case isReservedKey(f.key):
+			err = fmt.Errorf("the key is reserved by the top-level fields of events: %s", f.key)
+		case seen[f.key]:
+			err = fmt.Errorf("the key is listed more than once: %s", f.key)
+		case !isSourceField(f.source):
+			err = fmt.Errorf("the source must be one of %s or start with info. or data.: %s",
+				strings.Join(sourceFields, ", "), item)
+		}
+
+		if err != nil {
+			return
+		}
+
+		seen[f.key] = true
+		fields = append(fields, f)
+	}
+
+	return
+}
+
+// parseDefaults sets the default values of fields from a comma separated list
+// of key=value items. Values that are valid JSON are decoded, others are used
+// as strings.
+func parseDefaults(fields []field, s string) (err error) {
+	for _, item := range strings.Split(s, ",") {
+		i := strings.IndexByte(item, '=')
+
+		if i < 0 {
+			return fmt.Errorf("expected key=value: %s", item)
+		}
+
+		key, value := strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+		found := false
+
+		for j := range fields {
+			if f := &fields[j]; f.key == key {
+				if json.Unmarshal([]byte(value), &f.value) != nil {
+					f.value = value
+				}
+				found = true
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("the key isn't part of SCHEMA_FIELDS: %s", key)
+		}
+	}
+
+	return
+}
+
+func isReservedKey(key string) bool {
+	for _, k := range reservedKeys {
+		if key == k {
+			return true
+		}
+	}
+	return strings.HasPrefix(key, "info.")
+}
+
+func isSourceField(f string) bool {
+	for _, k := range sourceFields {
+		if f == k {
+			return true
+		}
+	}
+	return (strings.HasPrefix(f, "info.") || strings.HasPrefix(f, "data.")) && !strings.HasSuffix(f, ".")
+}
+
+func NewProcessor() (p lib.Processor, err error) {
+	var c config
+
+	if c, err = getConfig(); err == nil {
+		p = newProcessor(c)
+	}
+
+	return
+}
+
+func checkConfig() (err error) {
+	_, err = getConfig()
+	return
+}
+
+type processor struct {
+	config
+}
+
+func newProcessor(c config) *processor {
+	return &processor{config: c}
+}
+
+// Process sets every schema key in the event data of msg, from the source of
+// the key or from its default. Data fields used as sources are moved to their
+// key, and the fields that aren't part of the schema are either kept or
+// dropped.
+func (p *processor) Process(msg lib.Message, now time.Time) []lib.Message {
+	values := make([]interface{}, len(p.fields))
+	data := msg.Event.Data
+	var info map[string]interface{}
+
+	for i, f := range p.fields {
+		var value interface{}
+
+		switch {
+		case strings.HasPrefix(f.source, "data."):
+			value = lookup(data, f.source[5:])
+		case strings.HasPrefix(f.source, "info."):
+			if info == nil {
+				info = decodeInfo(msg.Event.Info)
+			}
+			value = lookup(info, f.source[5:])
+		default:
+			value = messageField(msg, f.source)
+		}
+
+		if value == nil {
+			value = f.value
+		}
+
+		values[i] = value
+	}
+
+	if p.unknown == Drop {
+		data = make(ecslogs.EventData, len(p.fields))
+	} else {
+		for _, f := range p.fields {
+			if strings.HasPrefix(f.source, "data.") && f.source[5:] != f.key {
+				data = remove(data, strings.Split(f.source[5:], "."))
+			}
+		}
+		data = copyData(data, len(p.fields))
+	}
+
+	for i, f := range p.fields {
+		data[f.key] = values[i]
+	}
+
+	msg.Event.Data = data
+	return []lib.Message{msg}
+}
+
+func (p *processor) Flush(now time.Time) []lib.Message {
+	return nil
+}
+
+func messageField(msg lib.Message, name string) interface{} {
+	switch name {
+	case "group":
+		return msg.Group
+	case "stream":
+		return msg.Stream
+	case "level":
+		return msg.Event.Level.String()
+	case "time":
+		return msg.Event.Time.Format(time.RFC3339Nano)
+	default:
+		return msg.Event.Message
+	}
+}
+
+func decodeInfo(info ecslogs.EventInfo) (obj map[string]interface{}) {
+	b, _ := json.Marshal(info)
+	json.Unmarshal(b, &obj)
+	return
+}
+
+// asObject returns v as a map if it's a JSON object, the data of events is
+// made of EventData values when built by ecs-logs and of plain maps when
+// decoded from JSON.
+func asObject(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case ecslogs.EventData:
+		return m, true
+	case map[string]interface{}:
+		return m, true
+	default:
+		return nil, false
+	}
+}
+
+func lookup(obj map[string]interface{}, path string) interface{} {
+	var value interface{} = obj
+
+	for _, key := range strings.Split(path, ".") {
+		m, ok := asObject(value)
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+
+	return value
+}
+
+// remove returns obj without the field at path. The maps on the path are
+// copied instead of being modified since they may be shared with other
+// messages.
+func remove(obj map[string]interface{}, path []string) map[string]interface{} {
+	value, exists := obj[path[0]]
+
+	if !exists {
+		return obj
+	}
+
+	if len(path) > 1 {
+		child, ok := asObject(value)
+		if !ok {
+			return obj
+		}
+		value = remove(child, path[1:])
+	}
+
+	res := copyData(obj, 0)
+
+	if len(path) == 1 {
+		delete(res, path[0])
+	} else {
+		res[path[0]] = value
+	}
+
+	return res
+}
+
+func copyData(data map[string]interface{}, extra int) ecslogs.EventData {
+	c := make(ecslogs.EventData, len(data)+extra)
+
+	for k, v := range data {
+		c[k] = v
+	}
+
+	return c
+}
@@ -0,0 +1,156 @@
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/flatten"
+)
+
+func makeMessage(data ecslogs.EventData) lib.Message {
+	return lib.Message{
+		Group:  "api",
+		Stream: "api-1",
+		Event: ecslogs.Event{
+			Level:   ecslogs.ERROR,
+			Time:    time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC),
+			Info:    ecslogs.EventInfo{Host: "i-1234"},
+			Message: "Hello World!",
+			Data:    data,
+		},
+	}
+}
+
+func makeProcessor(t *testing.T, env map[string]string) *processor {
+	lib.SetConfigEnv(env)
+	defer lib.SetConfigEnv(nil)
+
+	c, err := getConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newProcessor(c)
+}
+
+func process(p *processor, msg lib.Message) map[string]interface{} {
+	msgs := p.Process(msg, time.Now())
+
+	if len(msgs) != 1 {
+		return nil
+	}
+
+	// The schema keys are checked on the serialized events, like CloudWatch
+	// Logs Insights sees them.
+	b, _ := json.Marshal(flatten.Event(msgs[0].Event))
+	var event map[string]interface{}
+	json.Unmarshal(b, &event)
+	return event
+}
+
+func TestProcessorDefaults(t *testing.T) {
+	p := makeProcessor(t, map[string]string{
+		"SCHEMA_FIELDS":   "service=group,host=info.host,request_id=data.request.id,user,retries",
+		"SCHEMA_DEFAULTS": "user=anonymous,retries=0",
+	})
+
+	for _, data := range []ecslogs.EventData{
+		nil,
+		{},
+		{"request": map[string]interface{}{}},
+		{"request": "not an object", "other": true},
+	} {
+		event := process(p, makeMessage(data))
+
+		for key, value := range map[string]interface{}{
+			"service":    "api",
+			"host":       "i-1234",
+			"request_id": nil,
+			"user":       "anonymous",
+			"retries":    0.0,
+		} {
+			if v, exists := event[key]; !exists || !reflect.DeepEqual(v, value) {
+				t.Errorf("%v: invalid schema key %s: %#v", data, key, v)
+			}
+		}
+	}
+}
+
+func TestProcessorExtract(t *testing.T) {
+	p := makeProcessor(t, map[string]string{
+		"SCHEMA_FIELDS":   "request_id=data.request.id,user,level_name=level",
+		"SCHEMA_DEFAULTS": "user=anonymous",
+	})
+
+	data := ecslogs.EventData{
+		"request": map[string]interface{}{"id": "42", "path": "/"},
+		"user":    "luke",
+		"extra":   1,
+	}
+
+	event := process(p, makeMessage(data))
+
+	if ref := map[string]interface{}{
+		"level":        "ERROR",
+		"time":         "2016-10-12T00:00:00Z",
+		"message":      "Hello World!",
+		"info.host":    "i-1234",
+		"request_id":   "42",
+		"request.path": "/",
+		"user":         "luke",
+		"level_name":   "ERROR",
+		"extra":        1.0,
+	}; !reflect.DeepEqual(event, ref) {
+		t.Errorf("invalid event:\n- expected: %#v\n- found:    %#v", ref, event)
+	}
+
+	// The data of the original message is shared with other copies, it must
+	// not be modified when the extracted fields are moved.
+	if request := data["request"].(map[string]interface{}); request["id"] != "42" {
+		t.Errorf("the original message was modified: %#v", data)
+	}
+}
+
+func TestProcessorDropUnknown(t *testing.T) {
+	p := makeProcessor(t, map[string]string{
+		"SCHEMA_FIELDS":  "request_id=data.request.id,user",
+		"SCHEMA_UNKNOWN": "drop",
+	})
+
+	msgs := p.Process(makeMessage(ecslogs.EventData{
+		"request": map[string]interface{}{"id": "42"},
+		"extra":   1,
+	}), time.Now())
+
+	if ref := (ecslogs.EventData{"request_id": "42", "user": nil}); !reflect.DeepEqual(msgs[0].Event.Data, ref) {
+		t.Errorf("invalid data:\n- expected: %#v\n- found:    %#v", ref, msgs[0].Event.Data)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	for _, test := range []struct {
+		env map[string]string
+		err string
+	}{
+		{map[string]string{}, "SCHEMA_FIELDS"},
+		{map[string]string{"SCHEMA_FIELDS": "message"}, "reserved"},
+		{map[string]string{"SCHEMA_FIELDS": "info.host"}, "reserved"},
+		{map[string]string{"SCHEMA_FIELDS": "a,a"}, "more than once"},
+		{map[string]string{"SCHEMA_FIELDS": "a=host"}, "source"},
+		{map[string]string{"SCHEMA_FIELDS": "a", "SCHEMA_DEFAULTS": "b=1"}, "SCHEMA_DEFAULTS"},
+		{map[string]string{"SCHEMA_FIELDS": "a", "SCHEMA_UNKNOWN": "rename"}, "SCHEMA_UNKNOWN"},
+	} {
+		lib.SetConfigEnv(test.env)
+
+		if err := checkConfig(); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: the error should mention %q: %v", test.env, test.err, err)
+		}
+	}
+}
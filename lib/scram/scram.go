@@ -0,0 +1,156 @@
+// Package scram implements the client side of the SCRAM authentication
+// mechanisms of RFC 5802, like SCRAM-SHA-256 and SCRAM-SHA-512, that the kafka
+// and mongodb destinations authenticate with.
+package scram
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// Client holds the state of the client side of a SCRAM conversation.
+type Client struct {
+	hash     func() hash.Hash
+	username string
+	password string
+	nonce    string
+
+	authMsg   string
+	serverKey []byte
+}
+
+// NewClient returns a client authenticating username with password, hash is
+// the hash of the mechanism like sha256.New for SCRAM-SHA-256. The nonce is
+// usually NewNonce, it's passed in so conversations can be tested against the
+// examples of the RFCs.
+//
+// The credentials are used as they are, SASLprep leaves ASCII credentials
+// untouched.
+func NewClient(hash func() hash.Hash, username string, password string, nonce string) *Client {
+	return &Client{hash: hash, username: username, password: password, nonce: nonce}
+}
+
+func (c *Client) firstBare() string {
+	name := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(c.username)
+	return "n=" + name + ",r=" + c.nonce
+}
+
+// First returns the first message of the client.
+func (c *Client) First() string {
+	return "n,," + c.firstBare()
+}
+
+// Final returns the final message of the client, with the proof derived from
+// the salt and the iteration count of serverFirst.
+func (c *Client) Final(serverFirst string) (string, error) {
+	attrs := attributes(serverFirst)
+	nonce := attrs["r"]
+	iterations, err := strconv.Atoi(attrs["i"])
+
+	if e, ok := attrs["e"]; ok {
+		return "", fmt.Errorf("the server rejected the SCRAM authentication: %s", e)
+	}
+
+	if err != nil || iterations <= 0 {
+		return "", fmt.Errorf("invalid SCRAM iteration count: %q", attrs["i"])
+	}
+
+	if !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+		return "", errors.New("the SCRAM nonce of the server doesn't extend the one of the client")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+
+	if err != nil {
+		return "", fmt.Errorf("invalid SCRAM salt: %s", err)
+	}
+
+	saltedPassword := c.pbkdf2([]byte(c.password), salt, iterations)
+	clientKey := c.hmac(saltedPassword, "Client Key")
+	h := c.hash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+	withoutProof := "c=biws,r=" + nonce
+
+	c.authMsg = c.firstBare() + "," + serverFirst + "," + withoutProof
+	c.serverKey = c.hmac(saltedPassword, "Server Key")
+
+	proof := c.hmac(storedKey, c.authMsg)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// Verify checks the signature of serverFinal, so a server that doesn't know
+// the credentials can't pretend it does.
+func (c *Client) Verify(serverFinal string) error {
+	attrs := attributes(serverFinal)
+
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("the server rejected the SCRAM authentication: %s", e)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+
+	if err != nil || c.serverKey == nil || subtle.ConstantTimeCompare(signature, c.hmac(c.serverKey, c.authMsg)) != 1 {
+		return errors.New("invalid SCRAM signature of the server")
+	}
+
+	return nil
+}
+
+func attributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+
+	for _, a := range strings.Split(msg, ",") {
+		if len(a) > 1 && a[1] == '=' {
+			attrs[a[:1]] = a[2:]
+		}
+	}
+
+	return attrs
+}
+
+func (c *Client) hmac(key []byte, msg string) []byte {
+	h := hmac.New(c.hash, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+// pbkdf2 derives a single block key from password, the salted password is as
+// long as a sum of the hash.
+func (c *Client) pbkdf2(password []byte, salt []byte, iterations int) []byte {
+	h := hmac.New(c.hash, password)
+	h.Write(salt)
+	h.Write([]byte{0, 0, 0, 1})
+	u := h.Sum(nil)
+	key := append([]byte(nil), u...)
+
+	for i := 1; i < iterations; i++ {
+		h.Reset()
+		h.Write(u)
+		u = h.Sum(u[:0])
+
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+
+	return key
+}
+
+// NewNonce returns a random nonce for a new conversation.
+func NewNonce() string {
+	var b [24]byte
+	rand.Read(b[:])
+	return base64.StdEncoding.EncodeToString(b[:])
+}
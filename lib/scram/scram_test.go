@@ -0,0 +1,51 @@
+package scram
+
+import (
+	"crypto/sha256"
+	"testing"
+)
+
+// The example conversation of RFC 7677.
+func TestClient(t *testing.T) {
+	c := NewClient(sha256.New, "user", "pencil", "rOprNGfwEbeRWgbNEkqO")
+
+	if first := c.First(); first != "n,,n=user,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Error("invalid client first message:", first)
+	}
+
+	final, err := c.Final("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if final != "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=" {
+		t.Error("invalid client final message:", final)
+	}
+
+	if err := c.Verify("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err != nil {
+		t.Error(err)
+	}
+
+	if err := c.Verify("v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err == nil {
+		t.Error("an invalid server signature should be rejected")
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	c := NewClient(sha256.New, "user", "pencil", "rOprNGfwEbeRWgbNEkqO")
+
+	for _, serverFirst := range []string{
+		"r=AAAANGfwEbeRWgbNEkqO%hvYDpWUa2,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=0",
+		"e=unknown-user",
+	} {
+		if _, err := c.Final(serverFirst); err == nil {
+			t.Errorf("%s: the first message of the server should be rejected", serverFirst)
+		}
+	}
+
+	if err := c.Verify("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err == nil {
+		t.Error("the signature of the server should be rejected before the final message of the client")
+	}
+}
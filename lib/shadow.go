@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// Shadow configures a destination that only receives a mirror of the traffic,
+// to evaluate it against real messages before it replaces another one.
+type Shadow struct {
+	Enabled bool
+
+	// The fraction of the messages that are mirrored, between 0 and 1.
+	Sample float64
+}
+
+// DestinationShadow returns the shadow mode of destination, as configured by
+// the <DESTINATION>_SHADOW and <DESTINATION>_SHADOW_SAMPLE environment
+// variables.
+func DestinationShadow(destination string) (s Shadow, err error) {
+	prefix := strings.ToUpper(destination) + "_SHADOW"
+	s.Sample = 1
+
+	if v := strings.TrimSpace(Getenv(prefix)); len(v) != 0 {
+		if s.Enabled, err = strconv.ParseBool(v); err != nil {
+			err = fmt.Errorf("invalid %s, must be a boolean: %s", prefix, v)
+			return
+		}
+	}
+
+	if v := strings.TrimSpace(Getenv(prefix + "_SAMPLE")); len(v) != 0 {
+		if s.Sample, err = strconv.ParseFloat(v, 64); err != nil || s.Sample < 0 || s.Sample > 1 {
+			err = fmt.Errorf("invalid %s_SAMPLE, must be a number between 0 and 1: %s", prefix, v)
+		}
+	}
+
+	return
+}
+
+// NewShadowDestination wraps dest so it only receives the sampled messages,
+// and so its failures are logged as warnings and counted in the shadow_errors
+// metric but never reported to ecs-logs, which would log the batches as
+// dropped along with the ones of the primary destinations.
+func NewShadowDestination(name string, dest Destination, shadow Shadow, registry *metrics.Registry) Destination {
+	if !shadow.Enabled {
+		return dest
+	}
+	return shadowDestination{
+		Destination: dest,
+		name:        name,
+		shadow:      shadow,
+		errors:      registry.Counter("shadow_errors", "destination", name),
+		sample:      rand.Float64,
+	}
+}
+
+type shadowDestination struct {
+	Destination
+	name   string
+	shadow Shadow
+	errors *metrics.Counter
+	sample func() float64
+}
+
+func (d shadowDestination) Open(group string, stream string) (Writer, error) {
+	return shadowWriter{dest: d, group: group, stream: stream}, nil
+}
+
+// shadowWriter opens the writer of the shadowed destination only when a batch
+// has sampled messages.
+type shadowWriter struct {
+	dest   shadowDestination
+	group  string
+	stream string
+}
+
+func (w shadowWriter) Close() error {
+	return nil
+}
+
+func (w shadowWriter) WriteMessage(msg Message) error {
+	return w.WriteMessageBatch(MessageBatch{msg})
+}
+
+func (w shadowWriter) WriteMessageBatch(batch MessageBatch) (err error) {
+	_, err = w.WriteMessageBatchSize(batch)
+	return
+}
+
+func (w shadowWriter) WriteMessageBatchSize(batch MessageBatch) (int, error) {
+	return w.write(batch, WriteMessageBatchSize)
+}
+
+func (w shadowWriter) WriteUrgentMessageBatch(batch MessageBatch) (int, error) {
+	return w.write(batch, WriteUrgentMessageBatch)
+}
+
+func (w shadowWriter) write(batch MessageBatch, write func(Writer, MessageBatch) (int, error)) (size int, err error) {
+	if batch = w.mirror(batch); len(batch) == 0 {
+		return
+	}
+
+	var writer Writer
+	var e error
+
+	if writer, e = w.dest.Destination.Open(w.group, w.stream); e == nil {
+		size, e = write(writer, batch)
+		writer.Close()
+	}
+
+	if e != nil {
+		w.dest.errors.Add(1)
+		log.WithFields(log.Fields{
+			"group":       w.group,
+			"stream":      w.stream,
+			"destination": w.dest.name,
+			"error":       e,
+			"count":       len(batch),
+		}).Warn("the shadow destination failed to write a message batch")
+	}
+
+	return
+}
+
+// mirror returns the messages of batch that are sampled.
+func (w shadowWriter) mirror(batch MessageBatch) MessageBatch {
+	if w.dest.shadow.Sample >= 1 {
+		return batch
+	}
+
+	mirrored := make(MessageBatch, 0, len(batch))
+
+	for _, msg := range batch {
+		if w.dest.sample() < w.dest.shadow.Sample {
+			mirrored = append(mirrored, msg)
+		}
+	}
+
+	return mirrored
+}
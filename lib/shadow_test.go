@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+func TestShadowFailures(t *testing.T) {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	registry := metrics.NewRegistry()
+	failing := NewShadowDestination("testdest", DestinationFunc(func(group string, stream string) (Writer, error) {
+		if stream == "closed" {
+			return nil, errors.New("connection refused")
+		}
+		return failingWriter{}, nil
+	}), Shadow{Enabled: true, Sample: 1}, registry)
+
+	batch := MessageBatch{{Event: ecslogs.Event{Message: "Hello World!"}}}
+
+	for _, stream := range []string{"B", "closed"} {
+		w, err := failing.Open("A", stream)
+		if err != nil {
+			t.Fatalf("%s: opening a shadow destination should not fail: %v", stream, err)
+		}
+
+		if err := w.WriteMessageBatch(batch); err != nil {
+			t.Errorf("%s: the errors of a shadow destination should not propagate: %v", stream, err)
+		}
+
+		if _, err := WriteUrgentMessageBatch(w, batch); err != nil {
+			t.Errorf("%s: the errors of a shadow destination should not propagate: %v", stream, err)
+		}
+	}
+
+	if n := registry.Counter("shadow_errors", "destination", "testdest").Value(); n != 4 {
+		t.Errorf("the failures of the shadow destination should be counted: %d", n)
+	}
+}
+
+func TestShadowSample(t *testing.T) {
+	batches := &map[string]MessageBatch{}
+	dest := NewShadowDestination("testdest", DestinationFunc(func(group string, stream string) (Writer, error) {
+		return oversizeTestWriter{group: group, batches: batches}, nil
+	}), Shadow{Enabled: true, Sample: 0.25}, metrics.NewRegistry())
+
+	d := dest.(shadowDestination)
+	d.sample = rand.New(rand.NewSource(1)).Float64
+
+	w, _ := d.Open("A", "B")
+	batch := make(MessageBatch, 0, 100)
+
+	for n := 0; n != 40; n++ {
+		for i := 0; i != 100; i++ {
+			batch = append(batch, Message{Event: ecslogs.Event{Message: fmt.Sprint(i)}})
+		}
+		w.WriteMessageBatch(batch)
+		batch = batch[:0]
+	}
+
+	// 25% of the 4000 messages are expected, the seed makes it deterministic
+	// but the bounds leave room for any other seed.
+	if n := len((*batches)["A"]); n < 900 || n > 1100 {
+		t.Errorf("about a quarter of the messages should be mirrored: %d", n)
+	}
+
+	if _, ok := NewShadowDestination("testdest", d.Destination, Shadow{}, metrics.NewRegistry()).(shadowDestination); ok {
+		t.Error("destinations that aren't shadows should not be wrapped")
+	}
+}
+
+func TestDestinationShadow(t *testing.T) {
+	defer SetConfigEnv(nil)
+
+	SetConfigEnv(map[string]string{"TESTDEST_SHADOW": "true", "TESTDEST_SHADOW_SAMPLE": "0.1"})
+
+	if s, err := DestinationShadow("testdest"); err != nil || !s.Enabled || s.Sample != 0.1 {
+		t.Errorf("invalid shadow settings: %+v (%v)", s, err)
+	}
+
+	SetConfigEnv(map[string]string{"TESTDEST_SHADOW": "true"})
+
+	if s, err := DestinationShadow("testdest"); err != nil || s.Sample != 1 {
+		t.Errorf("all the messages should be mirrored by default: %+v (%v)", s, err)
+	}
+
+	SetConfigEnv(map[string]string{"TESTDEST_SHADOW_SAMPLE": "10%"})
+
+	if _, err := DestinationShadow("testdest"); err == nil {
+		t.Error("an invalid sample should be rejected")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Close() error               { return nil }
+func (failingWriter) WriteMessage(Message) error { return errors.New("503 Service Unavailable") }
+func (failingWriter) WriteMessageBatch(MessageBatch) error {
+	return errors.New("503 Service Unavailable")
+}
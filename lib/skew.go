@@ -0,0 +1,167 @@
+package lib
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// SkewMonitor tracks how far the timestamps of the messages are from the time
+// they were read, per source, to spot a container with a broken clock before
+// CloudWatch Logs starts rejecting its events.
+//
+// Every Interval the sources which had messages skewed by more than Threshold
+// are reported with a warning, and counted in the clock_skew_reports counter.
+// A zero threshold disables the monitor.
+type SkewMonitor struct {
+	registry *metrics.Registry
+	clock    clock.Clock
+
+	mutex     sync.Mutex
+	threshold time.Duration
+	interval  time.Duration
+	last      time.Time
+	sources   map[string]*skewStats
+}
+
+// SkewReport describes the skew of the messages of a source over an interval,
+// positive skews are timestamps in the future.
+type SkewReport struct {
+	Source string
+	Count  int
+	Skewed int
+	Min    time.Duration
+	Max    time.Duration
+	Mean   time.Duration
+
+	// The stream of the message that was the most skewed.
+	Group  string
+	Stream string
+}
+
+type skewStats struct {
+	SkewReport
+	sum   time.Duration
+	worst time.Duration
+}
+
+// NewSkewMonitor returns a monitor reporting the skews over threshold every
+// interval.
+func NewSkewMonitor(threshold time.Duration, interval time.Duration, registry *metrics.Registry, clock clock.Clock) *SkewMonitor {
+	m := &SkewMonitor{
+		registry: registry,
+		clock:    clock,
+		last:     clock.Now(),
+		sources:  make(map[string]*skewStats),
+	}
+	m.Configure(threshold, interval)
+	return m
+}
+
+// Configure changes the threshold and the interval of the reports, it's safe to
+// call while messages are observed.
+func (m *SkewMonitor) Configure(threshold time.Duration, interval time.Duration) {
+	m.mutex.Lock()
+	m.threshold, m.interval = threshold, interval
+
+	if threshold <= 0 {
+		m.sources = make(map[string]*skewStats)
+	}
+
+	m.mutex.Unlock()
+}
+
+// Observe records the skew of msg, read from source. Messages without a
+// timestamp or a receive time carry no skew and are ignored.
+func (m *SkewMonitor) Observe(source string, msg Message) {
+	if msg.Event.Time.IsZero() || msg.Received.IsZero() {
+		return
+	}
+
+	skew := msg.Event.Time.Sub(msg.Received)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.threshold <= 0 {
+		return
+	}
+
+	s := m.sources[source]
+
+	if s == nil {
+		s = &skewStats{SkewReport: SkewReport{Source: source, Min: skew, Max: skew}}
+		m.sources[source] = s
+	}
+
+	s.Count++
+	s.sum += skew
+
+	if skew < s.Min {
+		s.Min = skew
+	}
+
+	if skew > s.Max {
+		s.Max = skew
+	}
+
+	abs := skew
+	if abs < 0 {
+		abs = -abs
+	}
+
+	if abs > m.threshold {
+		s.Skewed++
+	}
+
+	if abs > s.worst {
+		s.worst, s.Group, s.Stream = abs, msg.Group, msg.Stream
+	}
+}
+
+// Report returns the reports of the sources that had skewed messages since the
+// previous interval, and logs them. It returns nothing until an interval has
+// elapsed, so it can be called more often.
+func (m *SkewMonitor) Report() (reports []SkewReport) {
+	m.mutex.Lock()
+	now := m.clock.Now()
+
+	if m.threshold <= 0 || now.Sub(m.last) < m.interval {
+		m.mutex.Unlock()
+		return
+	}
+
+	for _, s := range m.sources {
+		if s.Skewed != 0 {
+			s.Mean = s.sum / time.Duration(s.Count)
+			reports = append(reports, s.SkewReport)
+		}
+	}
+
+	m.sources = make(map[string]*skewStats)
+	m.last = now
+	m.mutex.Unlock()
+
+	sort.Slice(reports, func(i int, j int) bool { return reports[i].Source < reports[j].Source })
+
+	for _, r := range reports {
+		m.registry.Counter("clock_skew_reports", "source", r.Source).Add(1)
+
+		log.WithFields(log.Fields{
+			"source":  r.Source,
+			"count":   r.Count,
+			"skewed":  r.Skewed,
+			"min_ms":  r.Min.Nanoseconds() / 1e6,
+			"max_ms":  r.Max.Nanoseconds() / 1e6,
+			"mean_ms": r.Mean.Nanoseconds() / 1e6,
+			"group":   r.Group,
+			"stream":  r.Stream,
+		}).Warn("the timestamps of the messages of a source are skewed from the time they were read")
+	}
+
+	return
+}
@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+func makeSkewedMessage(stream string, received time.Time, skew time.Duration) Message {
+	return Message{
+		Group:    "A",
+		Stream:   stream,
+		Received: received,
+		Event:    ecslogs.Event{Message: "hello", Time: received.Add(skew)},
+	}
+}
+
+func TestSkewMonitor(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := clock.NewFake(time.Unix(1000, 0))
+	m := NewSkewMonitor(time.Minute, 10*time.Second, r, c)
+
+	// The clock of one of the containers read by journald is 10 minutes
+	// ahead, the other containers and stdin are fine.
+	for i := 0; i != 10; i++ {
+		now := c.Now()
+		m.Observe("journald", makeSkewedMessage("web-1", now, time.Duration(-i)*time.Millisecond))
+		m.Observe("stdin", makeSkewedMessage("worker", now, time.Duration(i)*time.Millisecond))
+	}
+
+	m.Observe("journald", makeSkewedMessage("web-2", c.Now(), 10*time.Minute))
+
+	if reports := m.Report(); len(reports) != 0 {
+		t.Errorf("nothing should be reported before the interval elapsed: %+v", reports)
+	}
+
+	c.Advance(10 * time.Second)
+	reports := m.Report()
+
+	if len(reports) != 1 {
+		t.Fatalf("only the skewed source should be reported: %+v", reports)
+	}
+
+	if rep := reports[0]; rep.Source != "journald" || rep.Count != 11 || rep.Skewed != 1 || rep.Max != 10*time.Minute || rep.Min != -9*time.Millisecond || rep.Stream != "web-2" {
+		t.Errorf("invalid report: %+v", rep)
+	}
+
+	for _, s := range r.Snapshot() {
+		if s.Name == "clock_skew_reports" && (s.Labels["source"] != "journald" || s.Value != 1) {
+			t.Errorf("invalid metric: %+v", s)
+		}
+	}
+
+	// The reports cover what happened since the previous one.
+	m.Observe("journald", makeSkewedMessage("web-1", c.Now(), 0))
+	c.Advance(10 * time.Second)
+
+	if reports := m.Report(); len(reports) != 0 {
+		t.Errorf("a source that recovered should not be reported again: %+v", reports)
+	}
+}
+
+func TestSkewMonitorDisabled(t *testing.T) {
+	c := clock.NewFake(time.Unix(1000, 0))
+	m := NewSkewMonitor(0, time.Second, metrics.NewRegistry(), c)
+
+	m.Observe("stdin", makeSkewedMessage("worker", c.Now(), time.Hour))
+	c.Advance(time.Second)
+
+	if reports := m.Report(); len(reports) != 0 {
+		t.Errorf("a monitor without a threshold should report nothing: %+v", reports)
+	}
+
+	// Messages without a timestamp have no skew.
+	m.Configure(time.Minute, time.Second)
+	m.Observe("stdin", Message{Received: c.Now()})
+	c.Advance(time.Second)
+
+	if reports := m.Report(); len(reports) != 0 {
+		t.Errorf("messages without a timestamp should be ignored: %+v", reports)
+	}
+}
@@ -5,8 +5,22 @@ import (
 	"os"
 	"sort"
 	"sync"
+
+	"github.com/segmentio/ecs-logs/lib/metrics"
 )
 
+// A Source is where ecs-logs reads log messages from, it's opened once when
+// ecs-logs starts and reopened when its reader fails.
+//
+// The Reader returned by Open is read from a single goroutine. ReadMessage
+// blocks until a message is available and returns io.EOF once Close was called,
+// Close is called from another goroutine when ecs-logs is stopped. The messages
+// must have a group and a stream, unless the source is configured with a default
+// for them.
+//
+// Readers may implement the optional interfaces that ecs-logs checks for:
+// Acknowledger (or Rewinder) when they checkpoint their progress, and Committer
+// to save the checkpoint when ecs-logs exits.
 type Source interface {
 	Open() (Reader, error)
 }
@@ -17,10 +31,16 @@ func (f SourceFunc) Open() (Reader, error) {
 	return f()
 }
 
+// RegisterSource makes source available under name to the -src flag. It's
+// meant to be called from the init function of the package implementing the
+// source, and panics if name isn't a valid source name or is already
+// registered.
 func RegisterSource(name string, source Source) {
 	srcmtx.Lock()
+	defer srcmtx.Unlock()
+
+	checkPluginName("source", name, srcmap[name] != nil)
 	srcmap[name] = source
-	srcmtx.Unlock()
 }
 
 func DeregisterSource(name string) {
@@ -63,37 +83,60 @@ func SourcesAvailable() (sources []string) {
 
 var (
 	srcmtx sync.RWMutex
-	srcmap = map[string]Source{
-		"stdin": SourceFunc(func() (Reader, error) {
-			// On some platforms closing stdin doesn't cause pending read
-			// operations to abort, resulting in a blocking call that never
-			// returns.
-			//
-			// To work around this limitation we start a goroutine that is
-			// responsible for reading from stdin and sending the bytes through
-			// an in-memory pipe. When the pipe is closed it properly cancels
-			// all pending reads which is the behavior we expect.
-			//
-			// There probably is a small performance cost to adding this extra
-			// step but the stdin source shouldn't be used in production
-			// environments so it shouldn't be a problem in practice.
-			//
-			// Note that the goroutine reading from stdin is likely gonna be
-			// leaked... This is OK in the ecs-logs use case because only one
-			// stdin reader will be instantiated.
-			r, w := io.Pipe()
-			go pipe(w, os.Stdin)
-			// We use the Close method of the write end of the pipe so when it's
-			// called the read end will start returning io.EOF to indicate a
-			// graceful shutdown.
-			return NewMessageDecoder(struct {
-				io.Reader
-				io.Closer
-			}{r, w}), nil
-		}),
-	}
+	srcmap = map[string]Source{}
 )
 
+func init() {
+	RegisterSource("stdin", SourceFunc(openStdin))
+}
+
+func openStdin() (Reader, error) {
+	// On some platforms closing stdin doesn't cause pending read operations to
+	// abort, resulting in a blocking call that never returns.
+	//
+	// To work around this limitation we start a goroutine that is responsible
+	// for reading from stdin and sending the bytes through an in-memory pipe.
+	// When the pipe is closed it properly cancels all pending reads which is
+	// the behavior we expect.
+	//
+	// There probably is a small performance cost to adding this extra step but
+	// the stdin source shouldn't be used in production environments so it
+	// shouldn't be a problem in practice.
+	//
+	// Note that the goroutine reading from stdin is likely gonna be leaked...
+	// This is OK in the ecs-logs use case because only one stdin reader will
+	// be instantiated.
+	parser, err := SourceParser("stdin")
+
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := SourceFilter("stdin")
+
+	if err != nil {
+		return nil, err
+	}
+
+	r, w := io.Pipe()
+	go pipe(w, os.Stdin)
+	// We use the Close method of the write end of the pipe so when it's called
+	// the read end will start returning io.EOF to indicate a graceful
+	// shutdown.
+	rc := struct {
+		io.Reader
+		io.Closer
+	}{r, w}
+
+	// Without a parser stdin carries a stream of JSON messages which include
+	// their group and stream.
+	if parser == nil {
+		return NewFilteredReader("stdin", NewMessageDecoder(rc), filter, metrics.Default), nil
+	}
+
+	return NewFilteredReader("stdin", NewParserReader(rc, parser), filter, metrics.Default), nil
+}
+
 func pipe(w *io.PipeWriter, r io.Reader) {
 	_, err := io.Copy(w, r)
 
@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// SourceField is the default data field that messages are tagged with the
+// name of the source they were read from in.
+const SourceField = "ecs_logs_source"
+
+// NewTaggedReader returns a reader which sets the name of source in the field
+// data field of the messages read from r, and counts them in the
+// received_messages counter of registry. An empty field disables the tagging,
+// the messages are still counted.
+//
+// The tag overwrites the field when a message already has it, a message
+// forwarded by another ecs-logs process is tagged with the source that this
+// one read it from.
+func NewTaggedReader(source string, field string, r Reader, registry *metrics.Registry) Reader {
+	return taggedReader{
+		Reader:   r,
+		source:   source,
+		field:    field,
+		received: registry.Counter("received_messages", "source", source),
+	}
+}
+
+type taggedReader struct {
+	Reader
+	source   string
+	field    string
+	received *metrics.Counter
+}
+
+func (r taggedReader) ReadMessage() (msg Message, err error) {
+	if msg, err = r.Reader.ReadMessage(); err != nil {
+		return
+	}
+
+	if len(r.field) != 0 {
+		data := make(ecslogs.EventData, len(msg.Event.Data)+1)
+
+		for k, v := range msg.Event.Data {
+			data[k] = v
+		}
+
+		data[r.field] = r.source
+		msg.Event.Data = data
+	}
+
+	r.received.Add(1)
+	return
+}
+
+// Commit saves the checkpoint of the tagged reader, if it has one.
+func (r taggedReader) Commit() error {
+	return commit(r.Reader)
+}
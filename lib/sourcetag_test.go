@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+func TestTaggedReader(t *testing.T) {
+	r := metrics.NewRegistry()
+
+	journald := NewTaggedReader("journald", SourceField, NewMessageDecoder(strings.NewReader(
+		`{"group":"A","stream":"B","event":{"message":"a","data":{"user":"luke"}}}
+		 {"group":"A","stream":"B","event":{"message":"b","data":{"ecs_logs_source":"stdin"}}}`,
+	)), r)
+
+	ingest := NewTaggedReader("ingest", "origin", NewMessageDecoder(strings.NewReader(
+		`{"group":"A","stream":"C","event":{"message":"c"}}`,
+	)), r)
+
+	for _, test := range []struct {
+		reader Reader
+		field  string
+		source string
+		count  int
+	}{
+		{journald, SourceField, "journald", 2},
+		{ingest, "origin", "ingest", 1},
+	} {
+		for i := 0; i != test.count; i++ {
+			msg, err := test.reader.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if msg.Event.Data[test.field] != test.source {
+				t.Errorf("%s: the message should be tagged with its source: %#v", msg.Event.Message, msg.Event.Data)
+			}
+		}
+
+		if _, err := test.reader.ReadMessage(); err != io.EOF {
+			t.Errorf("%s: the end of the source should be returned: %v", test.source, err)
+		}
+
+		if n := r.Counter("received_messages", "source", test.source).Value(); n != int64(test.count) {
+			t.Errorf("%s: the messages should be counted by source: %d", test.source, n)
+		}
+	}
+}
+
+func TestTaggedReaderDisabled(t *testing.T) {
+	r := NewTaggedReader("stdin", "", NewMessageDecoder(strings.NewReader(
+		`{"group":"A","stream":"B","event":{"message":"a","data":{"user":"luke"}}}`,
+	)), metrics.NewRegistry())
+
+	if msg, _ := r.ReadMessage(); len(msg.Event.Data) != 1 {
+		t.Errorf("the messages should not be tagged without a field: %#v", msg.Event.Data)
+	}
+}
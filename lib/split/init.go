@@ -0,0 +1,12 @@
+package split
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterStage("split", lib.NewCheckedStage(lib.StageFunc(NewProcessor), checkConfig))
+
+	// The parts are the events written to the destinations, a stage after
+	// split would see them as separate messages (and schema would drop their
+	// part field).
+	lib.RegisterStageOrder("split", lib.StageOrder{Last: true})
+}
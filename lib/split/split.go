@@ -0,0 +1,74 @@
+package split
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+type config struct {
+	// Messages longer than this number of bytes are split.
+	maxLength int
+
+	// The data field set to "i/N" on each part of a split message.
+	field string
+}
+
+func getConfig() (c config, err error) {
+	c = config{
+		maxLength: 200000,
+		field:     "part",
+	}
+	var s string
+
+	if s = lib.Getenv("SPLIT_MAX_LENGTH"); len(s) != 0 {
+		if c.maxLength, err = strconv.Atoi(s); err != nil || c.maxLength < utf8.UTFMax {
+			err = fmt.Errorf("invalid SPLIT_MAX_LENGTH, must be an integer greater than %d: %s", utf8.UTFMax, s)
+			return
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("SPLIT_FIELD")); len(s) != 0 {
+		c.field = s
+	}
+
+	return
+}
+
+func NewProcessor() (p lib.Processor, err error) {
+	var c config
+
+	if c, err = getConfig(); err == nil {
+		p = newProcessor(c)
+	}
+
+	return
+}
+
+func checkConfig() (err error) {
+	_, err = getConfig()
+	return
+}
+
+type processor struct {
+	config
+}
+
+func newProcessor(c config) *processor {
+	return &processor{config: c}
+}
+
+// Process splits messages over the maximum length into parts that each get a
+// copy of the original event, timestamps are incremented by a microsecond from
+// one part to the next so they remain ordered once sorted by time.
+func (p *processor) Process(msg lib.Message, now time.Time) []lib.Message {
+	return lib.SplitMessage(msg, p.maxLength, p.field)
+}
+
+func (p *processor) Flush(now time.Time) []lib.Message {
+	return nil
+}
@@ -0,0 +1,125 @@
+package split
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+func TestProcessorShortMessage(t *testing.T) {
+	p := newProcessor(config{maxLength: 10, field: "part"})
+	msg := makeMessage("Hello!")
+
+	if msgs := p.Process(msg, time.Now()); len(msgs) != 1 || msgs[0].Event.Data["part"] != nil {
+		t.Errorf("messages under the maximum length should be left unchanged: %v", msgs)
+	}
+}
+
+func TestProcessorSplitCount(t *testing.T) {
+	p := newProcessor(config{maxLength: 10, field: "part"})
+	msg := makeMessage(strings.Repeat("x", 25))
+	msg.Event.Data["answer"] = 42
+
+	msgs := p.Process(msg, time.Now())
+
+	if len(msgs) != 3 {
+		t.Fatalf("invalid number of parts: %d", len(msgs))
+	}
+
+	for i, ref := range []string{"1/3", "2/3", "3/3"} {
+		if part := msgs[i].Event.Data["part"]; part != ref {
+			t.Errorf("invalid part field: %v != %s", part, ref)
+		}
+
+		if msgs[i].Event.Data["answer"] != 42 {
+			t.Error("the parts should carry the data of the original message")
+		}
+	}
+
+	if _, ok := msg.Event.Data["part"]; ok {
+		t.Error("the data of the original message should not be modified")
+	}
+}
+
+func TestProcessorOrder(t *testing.T) {
+	p := newProcessor(config{maxLength: 8, field: "part"})
+	msg := makeMessage("the quick brown fox jumps over the lazy dog")
+
+	msgs := lib.MessageBatch(p.Process(msg, time.Now()))
+
+	// Shuffle the parts, sorting them by time like ecs-logs does before
+	// writing batches must restore the original message.
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	sort.Stable(msgs)
+
+	var parts []string
+
+	for i, m := range msgs {
+		if !m.Event.Time.Equal(msg.Event.Time.Add(time.Duration(i) * time.Microsecond)) {
+			t.Errorf("invalid time of part %d: %s", i, m.Event.Time)
+		}
+		parts = append(parts, m.Event.Message)
+	}
+
+	if s := strings.Join(parts, ""); s != msg.Event.Message {
+		t.Errorf("the parts don't add up to the original message: %#v", s)
+	}
+
+	// Whitespaces are preferred as boundaries.
+	for _, part := range parts[:len(parts)-1] {
+		if !strings.HasSuffix(part, " ") {
+			t.Errorf("the part should end on a whitespace: %#v", part)
+		}
+	}
+}
+
+func makeMessage(s string) lib.Message {
+	return lib.Message{
+		Group:  "A",
+		Stream: "B",
+		Event: ecslogs.Event{
+			Time:    time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC),
+			Message: s,
+			Data:    ecslogs.EventData{},
+		},
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+	lib.SetConfigEnv(map[string]string{"SPLIT_MAX_LENGTH": "2"})
+
+	if err := checkConfig(); err == nil || !strings.Contains(err.Error(), "invalid SPLIT_MAX_LENGTH") {
+		t.Errorf("a maximum length too short to hold a UTF-8 sequence should be reported: %v", err)
+	}
+}
+
+func TestProcessorInvalidUTF8(t *testing.T) {
+	p := newProcessor(config{maxLength: 10, field: "part"})
+	s := "\xff" + strings.Repeat("\x80", 20)
+
+	msgs := p.Process(makeMessage(s), time.Now())
+
+	if len(msgs) != 3 {
+		t.Fatalf("invalid number of parts: %d", len(msgs))
+	}
+
+	var joined string
+
+	for _, msg := range msgs {
+		if len(msg.Event.Message) > 10 {
+			t.Errorf("part is too long: %q", msg.Event.Message)
+		}
+		joined += msg.Event.Message
+	}
+
+	if joined != s {
+		t.Error("the parts don't add up to the original message")
+	}
+}
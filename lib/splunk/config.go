@@ -0,0 +1,217 @@
+package splunk
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+// The paths of the event and acknowledgement endpoints of the HTTP Event
+// Collector, the event one is appended to SPLUNK_URL when it has no path.
+const (
+	eventPath = "/services/collector/event"
+	ackPath   = "/services/collector/ack"
+)
+
+const (
+	defaultSource     = "{group}/{stream}"
+	defaultSourcetype = "_json"
+)
+
+// config carries the settings of the splunk destination, they are loaded from
+// SPLUNK_* environment variables.
+type config struct {
+	// The URLs of the event endpoint and of the acknowledgement endpoint
+	// next to it.
+	url    string
+	ackURL string
+
+	// The HEC token, sent in the Authorization header.
+	token string
+
+	// The templates of the index, source and sourcetype of the events, they
+	// may reference {group} and {stream}. The index of the token is used when
+	// the index template is empty.
+	index      string
+	source     string
+	sourcetype string
+
+	// The maximum size of the requests before compression, larger batches
+	// are sent with several requests.
+	maxBatchBytes int
+
+	compression lib.BodyCompression
+
+	// Whether the batches are only acknowledged to the sources once Splunk
+	// indexed them, which requires indexer acknowledgement on the token.
+	// The status of the events is polled every ackInterval for at most
+	// ackTimeout.
+	ack         bool
+	ackInterval time.Duration
+	ackTimeout  time.Duration
+
+	// How the requests failing with a network error, a 429 or a 5xx status
+	// are sent again.
+	retry       retry.Policy
+	retryBudget lib.RetryBudget
+
+	tls *tls.Config
+
+	err error
+}
+
+func getConfig() (c config) {
+	var err error
+	var s string
+
+	c = config{
+		url:           strings.TrimSpace(lib.Getenv("SPLUNK_URL")),
+		token:         strings.TrimSpace(lib.Getenv("SPLUNK_TOKEN")),
+		index:         strings.TrimSpace(lib.Getenv("SPLUNK_INDEX")),
+		source:        defaultSource,
+		sourcetype:    defaultSourcetype,
+		maxBatchBytes: 1000000,
+		ackInterval:   time.Second,
+		ackTimeout:    time.Minute,
+	}
+
+	if len(c.url) == 0 {
+		c.err = lib.AppendError(c.err, fmt.Errorf("missing SPLUNK_URL environment variable"))
+	} else if u, e := url.Parse(c.url); e != nil || len(u.Host) == 0 || (u.Scheme != "http" && u.Scheme != "https") {
+		c.err = lib.AppendError(c.err, fmt.Errorf("invalid SPLUNK_URL, must be an http or https URL: %s", c.url))
+	} else {
+		if strings.Trim(u.Path, "/") == "" {
+			u.Path = eventPath
+		}
+		c.url = u.String()
+
+		// The acknowledgement endpoint is next to the event one, behind the
+		// same prefix when the collector is exposed under a path.
+		if i := strings.Index(u.Path, "/services/collector"); i >= 0 {
+			u.Path = u.Path[:i] + ackPath
+		} else {
+			u.Path = strings.TrimSuffix(u.Path, "/") + ackPath
+		}
+		c.ackURL = u.String()
+	}
+
+	if len(c.token) == 0 {
+		c.err = lib.AppendError(c.err, fmt.Errorf("missing SPLUNK_TOKEN environment variable"))
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("SPLUNK_SOURCE")); len(s) != 0 {
+		c.source = s
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("SPLUNK_SOURCETYPE")); len(s) != 0 {
+		c.sourcetype = s
+	}
+
+	for _, t := range []struct {
+		env      string
+		template string
+	}{
+		{"SPLUNK_INDEX", c.index},
+		{"SPLUNK_SOURCE", c.source},
+		{"SPLUNK_SOURCETYPE", c.sourcetype},
+	} {
+		if err = checkTemplate(t.env, t.template); err != nil {
+			c.err = lib.AppendError(c.err, err)
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("SPLUNK_MAX_BATCH_BYTES")); len(s) != 0 {
+		if c.maxBatchBytes, err = strconv.Atoi(s); err != nil || c.maxBatchBytes < 1024 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid SPLUNK_MAX_BATCH_BYTES, must be an integer of at least 1024: %s", s))
+		}
+	}
+
+	if c.compression, err = lib.DestinationBodyCompression("splunk", "gzip"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("SPLUNK_ACK")); len(s) != 0 {
+		if c.ack, err = strconv.ParseBool(s); err != nil {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid SPLUNK_ACK, must be a boolean: %s", s))
+		}
+	}
+
+	for _, d := range []struct {
+		env   string
+		value *time.Duration
+	}{
+		{"SPLUNK_ACK_INTERVAL", &c.ackInterval},
+		{"SPLUNK_ACK_TIMEOUT", &c.ackTimeout},
+	} {
+		if s = strings.TrimSpace(lib.Getenv(d.env)); len(s) != 0 {
+			if *d.value, err = time.ParseDuration(s); err != nil || *d.value <= 0 {
+				c.err = lib.AppendError(c.err, fmt.Errorf("invalid %s, must be a positive duration: %s", d.env, s))
+			}
+		}
+	}
+
+	if c.retry, err = retry.DestinationPolicy("splunk", retry.DefaultPolicy); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.retryBudget, err = lib.DestinationRetryBudget("splunk"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if t, err := lib.DestinationTLS("splunk"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	} else if t.Enabled() {
+		if c.tls, err = t.Load(); err != nil {
+			c.err = lib.AppendError(c.err, err)
+		}
+	}
+
+	return
+}
+
+func (c config) check() error {
+	return c.err
+}
+
+var (
+	templateVariable = regexp.MustCompile(`\{[^{}]*\}`)
+	invalidIndexChar = regexp.MustCompile(`[^a-z0-9_-]+`)
+)
+
+// checkTemplate reports the unknown variables of the template s.
+func checkTemplate(env string, s string) error {
+	for _, v := range templateVariable.FindAllString(s, -1) {
+		if v != "{group}" && v != "{stream}" {
+			return fmt.Errorf("invalid %s, unknown variable %s, must be one of {group} or {stream}: %s", env, v, s)
+		}
+	}
+	return nil
+}
+
+// render returns the value of the template for a group and stream.
+func render(template string, group string, stream string) string {
+	return strings.NewReplacer("{group}", group, "{stream}", stream).Replace(template)
+}
+
+// indexName returns the index of a group and stream from the index template.
+// Splunk index names are made of lowercase letters, digits, underscores and
+// dashes and can't start with the latter two, the other characters (like the
+// slashes of the group names) are replaced with underscores.
+func indexName(template string, group string, stream string) string {
+	if len(template) == 0 {
+		return ""
+	}
+
+	clean := func(s string) string {
+		return strings.Trim(invalidIndexChar.ReplaceAllString(strings.ToLower(s), "_"), "_-")
+	}
+
+	return strings.TrimLeft(render(template, clean(group), clean(stream)), "_-")
+}
@@ -0,0 +1,7 @@
+package splunk
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterDestination("splunk", newDestination(getConfig))
+}
@@ -0,0 +1,303 @@
+// Package splunk implements the splunk destination, which sends the messages
+// to the event endpoint of the Splunk HTTP Event Collector (HEC).
+package splunk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+// destination sends the messages of all the streams of ecs-logs to a single
+// HTTP Event Collector, the writers share its HTTP client and its channel.
+type destination struct {
+	lazy   lib.LazyConfig
+	load   func() config
+	config config
+
+	// The channel of the requests, the acknowledgements of the events are
+	// tracked per channel.
+	channel string
+
+	client  *http.Client
+	retries *lib.RetryLimiter
+	clock   clock.Clock
+}
+
+func newDestination(load func() config) *destination {
+	return &destination{
+		load:   load,
+		client: &http.Client{Timeout: 30 * time.Second},
+		clock:  clock.System,
+	}
+}
+
+func (d *destination) Open(group string, stream string) (w lib.Writer, err error) {
+	if err = d.lazy.Init(d.init); err == nil {
+		w = writer{
+			dest:       d,
+			index:      indexName(d.config.index, group, stream),
+			source:     render(d.config.source, group, stream),
+			sourcetype: render(d.config.sourcetype, group, stream),
+		}
+	}
+
+	return
+}
+
+// CheckConfig reports the problems with the SPLUNK_* settings when ecs-logs
+// starts.
+func (d *destination) CheckConfig() error {
+	return d.load().check()
+}
+
+func (d *destination) Close(group string, stream string) {}
+
+func (d *destination) init() error {
+	d.config = d.load()
+	d.channel = lib.NewMessageIDGenerator(lib.UUIDv4MessageIDs).New()
+	d.retries = lib.NewRetryLimiter("splunk", d.config.retryBudget, metrics.Default)
+
+	if d.config.tls != nil {
+		d.client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: d.config.tls,
+		}
+	}
+
+	return d.config.check()
+}
+
+// event is the envelope of the events sent to the event endpoint, the indexed
+// fields carry the names of the message so searches can filter on them
+// without extracting the JSON of the events.
+type event struct {
+	Time       json.Number       `json:"time,omitempty"`
+	Host       string            `json:"host,omitempty"`
+	Index      string            `json:"index,omitempty"`
+	Source     string            `json:"source,omitempty"`
+	Sourcetype string            `json:"sourcetype,omitempty"`
+	Event      ecslogs.Event     `json:"event"`
+	Fields     map[string]string `json:"fields"`
+}
+
+// response is the body of the responses of the collector, the ID of the
+// acknowledgement is only set when the token has indexer acknowledgement
+// enabled.
+type response struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckID *int64 `json:"ackId"`
+}
+
+// post sends body to url with the retry policy of the destination and decodes
+// the response in v. The requests failing with a network error, a 429 or a 5xx
+// status are sent again, after the delay of their Retry-After header when they
+// have one, the ones the collector rejected (like an invalid token or
+// malformed events) would fail again and are reported right away.
+func (d *destination) post(url string, body []byte, v interface{}) error {
+	compressed, err := d.config.compression.Compress(body)
+
+	if err != nil {
+		return err
+	}
+
+	return d.config.retry.Do(d.clock, d.retries, func() error {
+		var req *http.Request
+		var res *http.Response
+		var err error
+
+		if req, err = http.NewRequest("POST", url, bytes.NewReader(compressed)); err != nil {
+			return err
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Splunk "+d.config.token)
+		d.config.compression.Set(req)
+
+		if d.config.ack {
+			req.Header.Set("X-Splunk-Request-Channel", d.channel)
+		}
+
+		if res, err = d.client.Do(req); err != nil {
+			return retry.Retryable(err)
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			msg, _ := ioutil.ReadAll(&io.LimitedReader{R: res.Body, N: 1024})
+			err = fmt.Errorf("splunk responded with %s: %s", res.Status, bytes.TrimSpace(msg))
+
+			if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
+				err = retry.RetryAfter(err, retry.ParseRetryAfter(res.Header.Get("Retry-After"), d.clock.Now()))
+			}
+			return err
+		}
+
+		if err = json.NewDecoder(res.Body).Decode(v); err != nil {
+			err = fmt.Errorf("invalid response of splunk: %s", err)
+		}
+		return err
+	})
+}
+
+// send posts the events of a batch, the ones that don't fit in a request go
+// in the next one. It returns the IDs of the acknowledgements of the requests
+// when they're enabled.
+func (d *destination) send(events [][]byte) (acks []int64, err error) {
+	for len(events) != 0 {
+		var body []byte
+		var n int
+
+		for n < len(events) && (n == 0 || len(body)+len(events[n]) <= d.config.maxBatchBytes) {
+			body = append(body, events[n]...)
+			n++
+		}
+
+		var res response
+
+		if err = d.post(d.config.url, body, &res); err != nil {
+			return
+		}
+
+		if d.config.ack {
+			if res.AckID == nil {
+				err = fmt.Errorf("splunk didn't return an acknowledgement ID, indexer acknowledgement must be enabled on the token when SPLUNK_ACK is set")
+				return
+			}
+			acks = append(acks, *res.AckID)
+		}
+
+		events = events[n:]
+	}
+
+	return
+}
+
+// wait polls the status of the acknowledgements until all of them are
+// indexed. It gives up after the ack timeout, the events may still be indexed
+// later but the batch is reported as failed so they aren't lost if they were
+// not.
+func (d *destination) wait(acks []int64) error {
+	deadline := d.clock.Now().Add(d.config.ackTimeout)
+	pending := make(map[int64]bool, len(acks))
+
+	for _, id := range acks {
+		pending[id] = true
+	}
+
+	for {
+		ids := make([]int64, 0, len(pending))
+
+		for id := range pending {
+			ids = append(ids, id)
+		}
+
+		body, _ := json.Marshal(struct {
+			Acks []int64 `json:"acks"`
+		}{ids})
+
+		var res struct {
+			Acks map[string]bool `json:"acks"`
+		}
+
+		if err := d.post(d.config.ackURL, body, &res); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if res.Acks[strconv.FormatInt(id, 10)] {
+				delete(pending, id)
+			}
+		}
+
+		if len(pending) == 0 {
+			return nil
+		}
+
+		if !d.clock.Now().Add(d.config.ackInterval).Before(deadline) {
+			return fmt.Errorf("splunk didn't acknowledge %d of %d requests within %s", len(pending), len(acks), d.config.ackTimeout)
+		}
+
+		d.clock.Sleep(context.Background(), d.config.ackInterval)
+	}
+}
+
+type writer struct {
+	dest       *destination
+	index      string
+	source     string
+	sourcetype string
+}
+
+func (w writer) Close() error {
+	return nil
+}
+
+func (w writer) WriteMessage(msg lib.Message) error {
+	return w.WriteMessageBatch(lib.MessageBatch{msg})
+}
+
+// WriteMessageBatch returns once the collector accepted the events of batch,
+// or indexed them when acknowledgements are enabled.
+func (w writer) WriteMessageBatch(batch lib.MessageBatch) (err error) {
+	events := make([][]byte, 0, len(batch))
+
+	for _, msg := range batch {
+		b, e := json.Marshal(w.event(msg))
+
+		if e != nil {
+			err = lib.AppendError(err, e)
+			continue
+		}
+
+		events = append(events, b)
+	}
+
+	if len(events) == 0 {
+		return
+	}
+
+	acks, e := w.dest.send(events)
+
+	if e == nil && len(acks) != 0 {
+		e = w.dest.wait(acks)
+	}
+
+	if e != nil {
+		err = lib.AppendError(err, e)
+	}
+
+	return
+}
+
+func (w writer) event(msg lib.Message) event {
+	e := event{
+		Host:       msg.Event.Info.Host,
+		Index:      w.index,
+		Source:     w.source,
+		Sourcetype: w.sourcetype,
+		Event:      msg.Event,
+		Fields:     map[string]string{"group": msg.Group, "stream": msg.Stream},
+	}
+
+	// The collector takes the time in seconds, with the milliseconds in the
+	// decimals.
+	if t := msg.Event.Time; !t.IsZero() {
+		e.Time = json.Number(strconv.FormatFloat(float64(t.UnixNano()/int64(time.Millisecond))/1000, 'f', 3, 64))
+	}
+
+	return e
+}
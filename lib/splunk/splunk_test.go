@@ -0,0 +1,349 @@
+package splunk
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+var epoch = time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC)
+
+// request is a request received by the mock collector, with its events or the
+// acknowledgement IDs it asked for.
+type request struct {
+	header http.Header
+	events []event
+	acks   []int64
+}
+
+type mockHEC struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	requests []request
+	ackCalls int
+
+	// The response to the n-th request to the event endpoint, zero for a
+	// success, and whether an acknowledgement was indexed by the n-th call to
+	// the ack endpoint.
+	status  func(call int) (int, http.Header)
+	indexed func(call int, id int64) bool
+}
+
+func newTestDestination(t *testing.T, c config) (*destination, *mockHEC) {
+	hec := &mockHEC{}
+	hec.Server = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		var body io.Reader = req.Body
+
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			z, err := gzip.NewReader(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = z
+		}
+
+		r := request{header: req.Header}
+		hec.mutex.Lock()
+		defer hec.mutex.Unlock()
+
+		switch req.URL.Path {
+		case eventPath:
+			for d := json.NewDecoder(body); d.More(); {
+				var e event
+				if err := d.Decode(&e); err != nil {
+					t.Fatal(err)
+				}
+				r.events = append(r.events, e)
+			}
+
+			hec.requests = append(hec.requests, r)
+			call := len(hec.requests)
+
+			if hec.status != nil {
+				if status, header := hec.status(call); status != 0 {
+					for k, v := range header {
+						res.Header()[k] = v
+					}
+					http.Error(res, `{"text":"Server is busy","code":9}`, status)
+					return
+				}
+			}
+
+			if len(req.Header.Get("X-Splunk-Request-Channel")) != 0 {
+				json.NewEncoder(res).Encode(map[string]interface{}{"text": "Success", "code": 0, "ackId": call})
+			} else {
+				res.Write([]byte(`{"text":"Success","code":0}`))
+			}
+
+		case ackPath:
+			var ack struct {
+				Acks []int64 `json:"acks"`
+			}
+
+			json.NewDecoder(body).Decode(&ack)
+			hec.ackCalls++
+			acks := make(map[string]bool)
+
+			for _, id := range ack.Acks {
+				acks[strconv.FormatInt(id, 10)] = hec.indexed(hec.ackCalls, id)
+			}
+
+			json.NewEncoder(res).Encode(map[string]interface{}{"acks": acks})
+
+		default:
+			t.Errorf("invalid path: %s", req.URL.Path)
+			http.NotFound(res, req)
+		}
+	}))
+
+	c.url = hec.URL + eventPath
+	c.ackURL = hec.URL + ackPath
+	c.token = "00000000-0000-0000-0000-000000000000"
+
+	if len(c.source) == 0 {
+		c.source = defaultSource
+	}
+
+	if len(c.sourcetype) == 0 {
+		c.sourcetype = defaultSourcetype
+	}
+
+	if c.maxBatchBytes == 0 {
+		c.maxBatchBytes = 1000000
+	}
+
+	if c.ackInterval == 0 {
+		c.ackInterval, c.ackTimeout = time.Second, time.Minute
+	}
+
+	d := newDestination(func() config { return c })
+	d.clock = clock.NewFake(epoch)
+	return d, hec
+}
+
+func makeBatch(n int) (batch lib.MessageBatch) {
+	for i := 0; i != n; i++ {
+		batch = append(batch, lib.Message{
+			Group:  "/ecs/API",
+			Stream: "web-1",
+			Event: ecslogs.Event{
+				Level:   ecslogs.INFO,
+				Time:    epoch.Add(time.Duration(i) * 1500 * time.Millisecond),
+				Message: "Hello World!",
+				Info:    ecslogs.EventInfo{Host: "i-1234"},
+			},
+		})
+	}
+	return
+}
+
+func TestWriteMessageBatch(t *testing.T) {
+	compression, _ := lib.NewBodyCompression("splunk", "gzip", 0)
+	d, hec := newTestDestination(t, config{index: "logs_{group}", sourcetype: "ecs:{stream}", compression: compression})
+	defer hec.Close()
+
+	w, err := d.Open("/ecs/API", "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteMessageBatch(makeBatch(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hec.requests) != 1 {
+		t.Fatalf("invalid number of requests: %d", len(hec.requests))
+	}
+
+	r := hec.requests[0]
+
+	if auth := r.header.Get("Authorization"); auth != "Splunk 00000000-0000-0000-0000-000000000000" {
+		t.Errorf("invalid authorization: %s", auth)
+	}
+
+	if len(r.header.Get("X-Splunk-Request-Channel")) != 0 {
+		t.Error("the channel should only be sent when acknowledgements are enabled")
+	}
+
+	if len(r.events) != 2 {
+		t.Fatalf("invalid number of events: %d", len(r.events))
+	}
+
+	e := r.events[1]
+
+	if e.Index != "logs_ecs_api" || e.Source != "/ecs/API/web-1" || e.Sourcetype != "ecs:web-1" || e.Host != "i-1234" {
+		t.Errorf("invalid envelope: %+v", e)
+	}
+
+	if e.Time != "1476230401.500" {
+		t.Errorf("invalid time: %s", e.Time)
+	}
+
+	if e.Event.Message != "Hello World!" || e.Fields["group"] != "/ecs/API" || e.Fields["stream"] != "web-1" {
+		t.Errorf("invalid event: %+v", e)
+	}
+}
+
+func TestWriteMessageBatchSplit(t *testing.T) {
+	d, hec := newTestDestination(t, config{maxBatchBytes: 1024})
+	defer hec.Close()
+
+	w, _ := d.Open("/ecs/API", "web-1")
+
+	if err := w.WriteMessageBatch(makeBatch(20)); err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+
+	for _, r := range hec.requests {
+		n += len(r.events)
+
+		if len(r.events) == 20 {
+			t.Error("the batch should be sent with several requests")
+		}
+	}
+
+	if n != 20 {
+		t.Errorf("invalid number of events: %d", n)
+	}
+}
+
+func TestWriteMessageBatchRetryAfter(t *testing.T) {
+	d, hec := newTestDestination(t, config{retry: retry.Policy{MaxRetries: 3}})
+	defer hec.Close()
+
+	hec.status = func(call int) (int, http.Header) {
+		switch call {
+		case 1:
+			return http.StatusServiceUnavailable, http.Header{"Retry-After": {"5"}}
+		case 2:
+			return http.StatusTooManyRequests, nil
+		}
+		return 0, nil
+	}
+
+	w, _ := d.Open("/ecs/API", "web-1")
+
+	if err := w.WriteMessageBatch(makeBatch(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hec.requests) != 3 {
+		t.Errorf("the request should be retried: %d requests", len(hec.requests))
+	}
+
+	if slept := d.clock.(*clock.Fake).Slept(); slept < 5*time.Second {
+		t.Errorf("the retry should wait for the delay of Retry-After: %s", slept)
+	}
+
+	// Rejected requests are not retried.
+	hec.requests = nil
+	hec.status = func(call int) (int, http.Header) { return http.StatusBadRequest, nil }
+
+	if err := w.WriteMessageBatch(makeBatch(1)); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("the error should be reported: %v", err)
+	}
+
+	if len(hec.requests) != 1 {
+		t.Errorf("the rejected request should not be retried: %d requests", len(hec.requests))
+	}
+}
+
+func TestWriteMessageBatchAck(t *testing.T) {
+	d, hec := newTestDestination(t, config{ack: true, maxBatchBytes: 1024})
+	defer hec.Close()
+
+	// The acknowledgements are indexed on the second poll.
+	hec.indexed = func(call int, id int64) bool { return call >= 2 }
+
+	w, _ := d.Open("/ecs/API", "web-1")
+
+	if err := w.WriteMessageBatch(makeBatch(20)); err != nil {
+		t.Fatal(err)
+	}
+
+	if hec.ackCalls != 2 {
+		t.Errorf("invalid number of acknowledgement polls: %d", hec.ackCalls)
+	}
+
+	for _, r := range hec.requests {
+		if r.header.Get("X-Splunk-Request-Channel") != d.channel || len(d.channel) != 36 {
+			t.Errorf("invalid channel: %q", r.header.Get("X-Splunk-Request-Channel"))
+		}
+	}
+
+	// Acknowledgements that never come fail the batch.
+	hec.indexed = func(call int, id int64) bool { return false }
+
+	if err := w.WriteMessageBatch(makeBatch(1)); err == nil || !strings.Contains(err.Error(), "didn't acknowledge") {
+		t.Errorf("the batch should fail: %v", err)
+	}
+}
+
+func TestIndexName(t *testing.T) {
+	for _, test := range []struct {
+		template string
+		index    string
+	}{
+		{"", ""},
+		{"main", "main"},
+		{"{group}", "ecs_api"},
+		{"logs-{stream}", "logs-web_1"},
+	} {
+		if index := indexName(test.template, "/ecs/API", "web.1"); index != test.index {
+			t.Errorf("%q: invalid index: %s != %s", test.template, index, test.index)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	for base, urls := range map[string][2]string{
+		"https://hec.example.com:8088":                         {"https://hec.example.com:8088/services/collector/event", "https://hec.example.com:8088/services/collector/ack"},
+		"https://hec.example.com/services/collector/event/1.0": {"https://hec.example.com/services/collector/event/1.0", "https://hec.example.com/services/collector/ack"},
+		"https://example.com/splunk/services/collector/event":  {"https://example.com/splunk/services/collector/event", "https://example.com/splunk/services/collector/ack"},
+	} {
+		lib.SetConfigEnv(map[string]string{"SPLUNK_URL": base, "SPLUNK_TOKEN": "token"})
+		c := getConfig()
+
+		if err := c.check(); err != nil {
+			t.Errorf("%s: %s", base, err)
+		}
+
+		if c.url != urls[0] || c.ackURL != urls[1] {
+			t.Errorf("%s: invalid URLs: %s %s", base, c.url, c.ackURL)
+		}
+	}
+
+	for _, env := range []map[string]string{
+		{"SPLUNK_TOKEN": "token"},
+		{"SPLUNK_URL": "https://hec.example.com"},
+		{"SPLUNK_URL": "hec.example.com", "SPLUNK_TOKEN": "token"},
+		{"SPLUNK_URL": "https://hec.example.com", "SPLUNK_TOKEN": "token", "SPLUNK_INDEX": "{cluster}"},
+		{"SPLUNK_URL": "https://hec.example.com", "SPLUNK_TOKEN": "token", "SPLUNK_ACK": "maybe"},
+		{"SPLUNK_URL": "https://hec.example.com", "SPLUNK_TOKEN": "token", "SPLUNK_ACK_TIMEOUT": "0s"},
+		{"SPLUNK_URL": "https://hec.example.com", "SPLUNK_TOKEN": "token", "SPLUNK_MAX_BATCH_BYTES": "10"},
+		{"SPLUNK_URL": "https://hec.example.com", "SPLUNK_TOKEN": "token", "SPLUNK_COMPRESSION": "brotli"},
+	} {
+		lib.SetConfigEnv(env)
+
+		if err := newDestination(getConfig).CheckConfig(); err == nil {
+			t.Errorf("%v: the configuration should be rejected", env)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package spool
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Format is the encoding of the records stored in the queue segments.
+type Format int
+
+const (
+	// FramedFormat stores each record as a length-prefixed frame followed by
+	// the CRC of its payload, torn or corrupted records are detected when the
+	// segment is replayed.
+	FramedFormat Format = iota
+
+	// NDJSONFormat stores one JSON document per line, it's larger and only
+	// detects incomplete lines but can be inspected with standard tools.
+	NDJSONFormat
+)
+
+// Version is the version of the segment format written by this package,
+// segments with a greater version are left untouched when opening a queue.
+const Version = 1
+
+const (
+	frameHeaderSize = 8
+	maxFrameSize    = 64 * 1024 * 1024
+)
+
+var (
+	errCorrupted = errors.New("corrupted record")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+func ParseFormat(s string) (f Format, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "framed":
+		f = FramedFormat
+	case "ndjson":
+		f = NDJSONFormat
+	default:
+		err = fmt.Errorf("invalid queue format, must be one of framed or ndjson: %s", s)
+	}
+	return
+}
+
+func (f Format) String() string {
+	switch f {
+	case NDJSONFormat:
+		return "ndjson"
+	default:
+		return "framed"
+	}
+}
+
+// formatHeader returns the first line of segments, like "ecs-logs-queue v1
+// framed". It's text so it doesn't get in the way of tools reading NDJSON
+// segments.
+//
+// Segments rewritten by a compaction keep the offsets of their records, the
+// offset of the first record is then added at the end of the header.
+func formatHeader(f Format, first int64) []byte {
+	if first != 0 {
+		return []byte(fmt.Sprintf("ecs-logs-queue v%d %s %d\n", Version, f, first))
+	}
+	return []byte(fmt.Sprintf("ecs-logs-queue v%d %s\n", Version, f))
+}
+
+// parseHeader reads the header of a segment, size is its length in bytes and
+// first the offset of the first record.
+func parseHeader(r *bufio.Reader) (f Format, version int, size int64, first int64, err error) {
+	var line string
+
+	if line, err = r.ReadString('\n'); err != nil {
+		if err == io.EOF {
+			err = errCorrupted
+		}
+		return
+	}
+
+	fields := strings.Fields(line)
+
+	if len(fields) < 3 || fields[0] != "ecs-logs-queue" {
+		err = errCorrupted
+		return
+	}
+
+	if _, err = fmt.Sscanf(fields[1], "v%d", &version); err != nil {
+		err = errCorrupted
+		return
+	}
+
+	if version > Version {
+		return
+	}
+
+	if len(fields) > 4 {
+		err = errCorrupted
+		return
+	}
+
+	if f, err = ParseFormat(fields[2]); err != nil {
+		err = errCorrupted
+		return
+	}
+
+	size = int64(len(line))
+	first = size
+
+	if len(fields) == 4 {
+		if first, err = strconv.ParseInt(fields[3], 10, 64); err != nil || first < size {
+			err = errCorrupted
+		}
+	}
+
+	return
+}
+
+// appendRecord appends the encoded form of the payload to b.
+func appendRecord(b []byte, f Format, payload []byte) []byte {
+	switch f {
+	case NDJSONFormat:
+		b = append(b, payload...)
+		return append(b, '\n')
+
+	default:
+		var h [frameHeaderSize]byte
+		binary.BigEndian.PutUint32(h[:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(h[4:], crc32.Checksum(payload, crcTable))
+		b = append(b, h[:]...)
+		return append(b, payload...)
+	}
+}
+
+// readRecord reads the next record from r, returning its payload and the
+// number of bytes it occupied in the segment. io.EOF is returned when r is
+// positioned at the end of the segment, errCorrupted when the data that
+// follows isn't a valid record.
+func readRecord(r *bufio.Reader, f Format) (payload []byte, n int, err error) {
+	switch f {
+	case NDJSONFormat:
+		if payload, err = r.ReadBytes('\n'); err != nil {
+			if err == io.EOF && len(payload) != 0 {
+				err = errCorrupted
+			}
+			return
+		}
+		n = len(payload)
+		payload = bytes.TrimSuffix(payload, []byte("\n"))
+		return
+
+	default:
+		var h [frameHeaderSize]byte
+
+		if _, err = io.ReadFull(r, h[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = errCorrupted
+			}
+			return
+		}
+
+		size := binary.BigEndian.Uint32(h[:4])
+		sum := binary.BigEndian.Uint32(h[4:])
+
+		if size > maxFrameSize {
+			err = errCorrupted
+			return
+		}
+
+		payload = make([]byte, size)
+
+		if _, err = io.ReadFull(r, payload); err != nil {
+			err = errCorrupted
+			return
+		}
+
+		if crc32.Checksum(payload, crcTable) != sum {
+			err = errCorrupted
+			return
+		}
+
+		n = frameHeaderSize + int(size)
+		return
+	}
+}
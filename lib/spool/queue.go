@@ -0,0 +1,707 @@
+package spool
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+const (
+	DefaultSegmentSize     = 16 * 1024 * 1024
+	DefaultCompactInterval = time.Minute
+)
+
+// Config carries the settings of a persisted queue.
+type Config struct {
+	// The directory where the segments are stored.
+	Dir string
+
+	// The format of the records in new segments, existing segments are read
+	// in whatever format they were written in.
+	Format Format
+
+	// Segments are sealed and a new one is started once they reach this size
+	// in bytes.
+	SegmentSize int64
+
+	// How often the delivered records are reclaimed in the background, zero
+	// disables background compaction.
+	CompactInterval time.Duration
+
+	// The maximum size in bytes of the records that weren't acknowledged,
+	// pushing more fails with ErrFull. Zero means no limit.
+	MaxSize int64
+}
+
+// ErrFull is returned by Push when the batch would take the queue over its
+// maximum size.
+var ErrFull = errors.New("the queue is full")
+
+// NewConfig returns a configuration loaded from the SPOOL_* environment
+// variables.
+func NewConfig() (c Config, err error) {
+	var s string
+
+	c = Config{
+		Dir:             lib.Getenv("SPOOL_DIR"),
+		SegmentSize:     DefaultSegmentSize,
+		CompactInterval: DefaultCompactInterval,
+	}
+
+	if c.Format, err = ParseFormat(lib.Getenv("SPOOL_FORMAT")); err != nil {
+		err = fmt.Errorf("invalid SPOOL_FORMAT, must be one of framed or ndjson: %s", lib.Getenv("SPOOL_FORMAT"))
+		return
+	}
+
+	if s = lib.Getenv("SPOOL_SEGMENT_SIZE"); len(s) != 0 {
+		if c.SegmentSize, err = strconv.ParseInt(s, 10, 64); err != nil || c.SegmentSize <= 0 {
+			err = fmt.Errorf("invalid SPOOL_SEGMENT_SIZE, must be a positive integer: %s", s)
+			return
+		}
+	}
+
+	if s = lib.Getenv("SPOOL_COMPACT_INTERVAL"); len(s) != 0 {
+		if c.CompactInterval, err = time.ParseDuration(s); err != nil || c.CompactInterval < 0 {
+			err = fmt.Errorf("invalid SPOOL_COMPACT_INTERVAL, must be a positive duration: %s", s)
+			return
+		}
+	}
+
+	return
+}
+
+// Queue is a FIFO of messages persisted to a directory. Messages are appended
+// to segment files and consumed by peeking at the head of the queue then
+// acknowledging the ones that were delivered, the position of the head is
+// persisted so a restarted program resumes where it stopped.
+type Queue struct {
+	mutex    sync.Mutex
+	config   Config
+	segments []*segment
+	skipped  []string
+	cursor   position
+	pending  int
+	peeked   []mark
+	file     *os.File
+	nextSeq  uint64
+	compact  sync.Mutex
+	done     chan struct{}
+	join     sync.WaitGroup
+}
+
+// Offsets within a segment are logical, they remain the same when records are
+// dropped from the start of the file by a compaction.
+type segment struct {
+	seq    uint64
+	path   string
+	format Format
+	header int64 // size of the header in the file
+	first  int64 // offset of the first record
+	size   int64 // offset of the end of the segment
+}
+
+func (seg *segment) physical(offset int64) int64 {
+	return offset - seg.first + seg.header
+}
+
+type position struct {
+	seq    uint64
+	offset int64
+}
+
+// mark is the position after a peeked message and the number of records that
+// acknowledging it consumes.
+type mark struct {
+	position
+	records int
+}
+
+// Open opens the queue stored in the directory of config, creating it if it
+// doesn't exist. Records that fail their integrity check, like the ones torn
+// by a crash in the middle of a write, are discarded along with the rest of
+// their segment.
+func Open(config Config) (q *Queue, err error) {
+	if config.SegmentSize <= 0 {
+		config.SegmentSize = DefaultSegmentSize
+	}
+
+	if err = os.MkdirAll(config.Dir, 0755); err != nil {
+		return
+	}
+
+	q = &Queue{
+		config: config,
+		cursor: readCursor(filepath.Join(config.Dir, "cursor")),
+		done:   make(chan struct{}),
+	}
+
+	if err = q.load(); err != nil {
+		q = nil
+		return
+	}
+
+	if config.CompactInterval > 0 {
+		q.join.Add(1)
+		go q.run(config.CompactInterval)
+	}
+
+	return
+}
+
+func (q *Queue) load() (err error) {
+	var names []string
+
+	if names, err = filepath.Glob(filepath.Join(q.config.Dir, "*.seg")); err != nil {
+		return
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		var seq uint64
+		var seg *segment
+		var records int
+
+		if seq, err = strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".seg"), 10, 64); err != nil {
+			err = nil
+			continue
+		}
+
+		if seq >= q.nextSeq {
+			q.nextSeq = seq + 1
+		}
+
+		// The program stopped before it could write the header of a new
+		// segment, there's nothing to recover.
+		if info, e := os.Stat(name); e == nil && info.Size() == 0 {
+			os.Remove(name)
+			continue
+		}
+
+		if seg, records, err = q.replay(name, seq); err != nil {
+			return
+		}
+
+		if seg == nil {
+			q.skipped = append(q.skipped, name)
+			continue
+		}
+
+		q.segments = append(q.segments, seg)
+		q.pending += records
+	}
+
+	if n := len(q.segments); n != 0 {
+		last := q.segments[n-1]
+
+		if last.format == q.config.Format && last.size < q.config.SegmentSize {
+			q.file, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0)
+		}
+	}
+
+	return
+}
+
+// replay scans the segment at path, truncating it after the last valid record
+// and counting the records that are after the cursor. A nil segment is
+// returned if the file couldn't be interpreted and was left untouched.
+func (q *Queue) replay(path string, seq uint64) (seg *segment, records int, err error) {
+	var f *os.File
+	var r *bufio.Reader
+	var version int
+	var format Format
+	var header int64
+	var first int64
+
+	if f, err = os.Open(path); err != nil {
+		return
+	}
+	defer f.Close()
+
+	r = bufio.NewReader(f)
+
+	if format, version, header, first, err = parseHeader(r); err != nil || version > Version {
+		err = nil
+		return
+	}
+
+	seg = &segment{
+		seq:    seq,
+		path:   path,
+		format: format,
+		header: header,
+		first:  first,
+		size:   first,
+	}
+
+	for {
+		var n int
+
+		if _, n, err = readRecord(r, format); err != nil {
+			break
+		}
+
+		if seq > q.cursor.seq || (seq == q.cursor.seq && seg.size >= q.cursor.offset) {
+			records++
+		}
+
+		seg.size += int64(n)
+	}
+
+	switch err {
+	case io.EOF:
+		err = nil
+	case errCorrupted:
+		err = os.Truncate(path, seg.physical(seg.size))
+	}
+
+	if seq == q.cursor.seq && q.cursor.offset > seg.size {
+		q.cursor.offset = seg.size
+	}
+
+	return
+}
+
+// Push appends the batch of messages to the queue, it returns once they were
+// synced to disk.
+func (q *Queue) Push(batch lib.MessageBatch) (err error) {
+	var b []byte
+
+	if len(batch) == 0 {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	roll := q.file == nil || q.tail().size >= q.config.SegmentSize
+	format := q.config.Format
+
+	if !roll {
+		format = q.tail().format
+	}
+
+	for _, msg := range batch {
+		b = appendRecord(b, format, msg.Bytes())
+	}
+
+	if q.config.MaxSize > 0 && q.size()+int64(len(b)) > q.config.MaxSize {
+		err = ErrFull
+		return
+	}
+
+	if roll {
+		if err = q.roll(); err != nil {
+			return
+		}
+	}
+
+	seg := q.tail()
+
+	if _, err = q.file.Write(b); err == nil {
+		err = q.file.Sync()
+	}
+
+	if err != nil {
+		// Don't leave a partial write behind, the next records would be
+		// discarded along with it when replaying the segment.
+		q.file.Truncate(seg.physical(seg.size))
+		return
+	}
+
+	seg.size += int64(len(b))
+	q.pending += len(batch)
+	return
+}
+
+func (q *Queue) tail() *segment {
+	return q.segments[len(q.segments)-1]
+}
+
+func (q *Queue) roll() (err error) {
+	var f *os.File
+	var header = formatHeader(q.config.Format, 0)
+	var seq = q.nextSeq
+	var path = filepath.Join(q.config.Dir, fmt.Sprintf("%020d.seg", seq))
+
+	if f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644); err != nil {
+		return
+	}
+
+	if _, err = f.Write(header); err == nil {
+		if err = f.Sync(); err == nil {
+			err = syncDir(q.config.Dir)
+		}
+	}
+
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return
+	}
+
+	if q.file != nil {
+		q.file.Close()
+	}
+
+	q.file = f
+	q.nextSeq++
+	q.segments = append(q.segments, &segment{
+		seq:    seq,
+		path:   path,
+		format: q.config.Format,
+		header: int64(len(header)),
+		first:  int64(len(header)),
+		size:   int64(len(header)),
+	})
+	return
+}
+
+// Peek returns up to max messages from the head of the queue without removing
+// them, Ack must be called to consume them once they were delivered.
+func (q *Queue) Peek(max int) (batch lib.MessageBatch, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.peeked = q.peeked[:0]
+	records := 0
+
+	for _, seg := range q.segments {
+		if len(batch) >= max {
+			break
+		}
+
+		if seg.seq < q.cursor.seq {
+			continue
+		}
+
+		offset := seg.first
+
+		if seg.seq == q.cursor.seq && q.cursor.offset > offset {
+			offset = q.cursor.offset
+		}
+
+		if offset >= seg.size {
+			continue
+		}
+
+		if batch, records, err = q.peek(batch, records, seg, offset, max); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (q *Queue) peek(batch lib.MessageBatch, records int, seg *segment, offset int64, max int) (lib.MessageBatch, int, error) {
+	f, err := os.Open(seg.path)
+
+	if err != nil {
+		return batch, records, err
+	}
+	defer f.Close()
+
+	if _, err = f.Seek(seg.physical(offset), io.SeekStart); err != nil {
+		return batch, records, err
+	}
+
+	r := bufio.NewReader(io.LimitReader(f, seg.size-offset))
+
+	for len(batch) < max {
+		var payload []byte
+		var msg lib.Message
+		var n int
+
+		if payload, n, err = readRecord(r, seg.format); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			break
+		}
+
+		offset += int64(n)
+		records++
+
+		// Records that passed the integrity check but can't be decoded won't
+		// ever be, they're consumed along with the next message.
+		if json.Unmarshal(payload, &msg) != nil {
+			continue
+		}
+
+		batch = append(batch, msg)
+		q.peeked = append(q.peeked, mark{
+			position: position{seq: seg.seq, offset: offset},
+			records:  records,
+		})
+		records = 0
+	}
+
+	return batch, records, err
+}
+
+// Ack removes the n first messages returned by the last call to Peek from the
+// queue.
+func (q *Queue) Ack(n int) (err error) {
+	if n <= 0 {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if n > len(q.peeked) {
+		err = fmt.Errorf("cannot acknowledge %d messages, only %d were peeked", n, len(q.peeked))
+		return
+	}
+
+	cursor := q.peeked[n-1].position
+
+	if err = writeCursor(filepath.Join(q.config.Dir, "cursor"), cursor); err != nil {
+		return
+	}
+
+	for _, m := range q.peeked[:n] {
+		q.pending -= m.records
+	}
+
+	q.cursor = cursor
+	q.peeked = q.peeked[:copy(q.peeked, q.peeked[n:])]
+	return
+}
+
+// Len returns the number of records that haven't been acknowledged yet.
+func (q *Queue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.pending
+}
+
+// Size returns the size in bytes of the records that haven't been
+// acknowledged yet, the delivered ones may still be on disk until the next
+// compaction.
+func (q *Queue) Size() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.size()
+}
+
+func (q *Queue) size() (n int64) {
+	for _, seg := range q.segments {
+		if seg.seq < q.cursor.seq {
+			continue
+		}
+
+		start := seg.first
+
+		if seg.seq == q.cursor.seq && q.cursor.offset > start {
+			start = q.cursor.offset
+		}
+
+		if start < seg.size {
+			n += seg.size - start
+		}
+	}
+	return
+}
+
+// Skipped returns the paths of the segments that were ignored when opening the
+// queue because they were written by a newer version or had an invalid header.
+func (q *Queue) Skipped() []string {
+	return q.skipped
+}
+
+// Compact reclaims the disk space used by acknowledged records. Segments that
+// were entirely delivered are removed, and the segment at the head of the
+// queue is rewritten without its delivered records when they make up at least
+// half of it. The records are copied without holding the lock so pushing to
+// the queue isn't blocked while compacting.
+func (q *Queue) Compact() (err error) {
+	q.compact.Lock()
+	defer q.compact.Unlock()
+
+	var removed []*segment
+	var head *segment
+	var start int64
+
+	q.mutex.Lock()
+	active := q.file != nil
+
+	for len(q.segments) != 0 {
+		seg := q.segments[0]
+
+		if active && len(q.segments) == 1 {
+			break
+		}
+
+		if seg.seq > q.cursor.seq || (seg.seq == q.cursor.seq && q.cursor.offset < seg.size) {
+			if seg.seq == q.cursor.seq && 2*(q.cursor.offset-seg.first) >= (seg.size-seg.first) {
+				head, start = seg, q.cursor.offset
+			}
+			break
+		}
+
+		removed = append(removed, seg)
+		q.segments = q.segments[1:]
+	}
+	q.mutex.Unlock()
+
+	for _, seg := range removed {
+		if e := os.Remove(seg.path); e != nil && !os.IsNotExist(e) {
+			err = lib.AppendError(err, e)
+		}
+	}
+
+	if head != nil {
+		if e := q.rewrite(head, start); e != nil {
+			err = lib.AppendError(err, e)
+		}
+	}
+
+	return
+}
+
+func (q *Queue) rewrite(seg *segment, start int64) (err error) {
+	var src *os.File
+	var dst *os.File
+	var tmp = seg.path + ".tmp"
+	var header = formatHeader(seg.format, start)
+
+	if src, err = os.Open(seg.path); err != nil {
+		return
+	}
+	defer src.Close()
+
+	if dst, err = os.Create(tmp); err != nil {
+		return
+	}
+	defer os.Remove(tmp)
+	defer dst.Close()
+
+	// Sealed segments are never written to, so the records can be copied
+	// while the queue is in use.
+	if _, err = dst.Write(header); err != nil {
+		return
+	}
+
+	if _, err = io.Copy(dst, io.NewSectionReader(src, seg.physical(start), seg.size-start)); err != nil {
+		return
+	}
+
+	if err = dst.Sync(); err != nil {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// The header of the new file carries the offset of its first record so
+	// the positions of the remaining records, including the cursor, don't
+	// change. Renaming is the only step that needs to be atomic.
+	if err = os.Rename(tmp, seg.path); err != nil {
+		return
+	}
+
+	seg.header = int64(len(header))
+	seg.first = start
+	return syncDir(q.config.Dir)
+}
+
+// Close stops the background compaction and closes the queue.
+func (q *Queue) Close() (err error) {
+	close(q.done)
+	q.join.Wait()
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.file != nil {
+		err = q.file.Close()
+		q.file = nil
+	}
+
+	return
+}
+
+func (q *Queue) run(interval time.Duration) {
+	defer q.join.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+			q.Compact()
+		}
+	}
+}
+
+func readCursor(path string) (p position) {
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return
+	}
+
+	// A corrupted cursor replays the queue from the start, delivering some
+	// messages twice is better than losing them.
+	if _, err = fmt.Sscanf(string(b), "%d %d\n", &p.seq, &p.offset); err != nil {
+		p = position{}
+	}
+
+	return
+}
+
+func writeCursor(path string, p position) (err error) {
+	var f *os.File
+	var tmp = path + ".tmp"
+
+	if f, err = os.Create(tmp); err != nil {
+		return
+	}
+
+	if _, err = fmt.Fprintf(f, "%d %d\n", p.seq, p.offset); err == nil {
+		err = f.Sync()
+	}
+
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return
+}
+
+func syncDir(path string) (err error) {
+	var d *os.File
+
+	if d, err = os.Open(path); err != nil {
+		return
+	}
+
+	// Some platforms don't support syncing directories, the files themselves
+	// were synced already so it's not worth failing for.
+	d.Sync()
+	return d.Close()
+}
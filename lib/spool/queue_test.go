@@ -0,0 +1,318 @@
+package spool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+func TestParseFormat(t *testing.T) {
+	tests := []struct {
+		s string
+		f Format
+	}{
+		{"", FramedFormat},
+		{"framed", FramedFormat},
+		{"NDJSON", NDJSONFormat},
+	}
+
+	for _, test := range tests {
+		if f, err := ParseFormat(test.s); err != nil {
+			t.Errorf("%#v: %s", test.s, err)
+		} else if f != test.f {
+			t.Errorf("%#v: invalid format: %s != %s", test.s, f, test.f)
+		}
+	}
+
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("parsing an unknown format should fail")
+	}
+}
+
+func TestQueueAck(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q := openQueue(t, Config{Dir: dir})
+	push(t, q, 0, 3)
+
+	if batch := peek(t, q, 2); !reflect.DeepEqual(batch, makeBatch(0, 2)) {
+		t.Errorf("invalid batch: %v", batch)
+	}
+
+	if err := q.Ack(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Ack(2); err == nil {
+		t.Error("acknowledging more messages than were peeked should fail")
+	}
+
+	q.Close()
+	q = openQueue(t, Config{Dir: dir})
+	defer q.Close()
+
+	if n := q.Len(); n != 2 {
+		t.Errorf("invalid length after reopening the queue: %d", n)
+	}
+
+	if batch := peek(t, q, 10); !reflect.DeepEqual(batch, makeBatch(1, 3)) {
+		t.Errorf("invalid batch after reopening the queue: %v", batch)
+	}
+}
+
+func TestQueueCorruptedTail(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  Format
+		corrupt func(b []byte) []byte
+	}{
+		{
+			name:   "torn frame",
+			format: FramedFormat,
+			corrupt: func(b []byte) []byte {
+				return b[:len(b)-5]
+			},
+		},
+		{
+			name:   "bit flip",
+			format: FramedFormat,
+			corrupt: func(b []byte) []byte {
+				b[len(b)-2] ^= 0x40
+				return b
+			},
+		},
+		{
+			name:   "torn line",
+			format: NDJSONFormat,
+			corrupt: func(b []byte) []byte {
+				return b[:len(b)-5]
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+
+			q := openQueue(t, Config{Dir: dir, Format: test.format})
+			push(t, q, 0, 2)
+			push(t, q, 2, 3)
+			q.Close()
+
+			path := filepath.Join(dir, fmt.Sprintf("%020d.seg", 0))
+			b, _ := ioutil.ReadFile(path)
+			ioutil.WriteFile(path, test.corrupt(b), 0644)
+
+			q = openQueue(t, Config{Dir: dir, Format: test.format})
+
+			if n := q.Len(); n != 2 {
+				t.Errorf("the corrupted record should have been discarded: %d", n)
+			}
+
+			// The segment must have been truncated, otherwise the records
+			// written next would be discarded with the corrupted one.
+			push(t, q, 3, 4)
+			q.Close()
+			q = openQueue(t, Config{Dir: dir, Format: test.format})
+			defer q.Close()
+
+			if batch, ref := peek(t, q, 10), append(makeBatch(0, 2), makeBatch(3, 4)...); !reflect.DeepEqual(batch, ref) {
+				t.Errorf("invalid batch after recovering from the corruption:\n- expected: %v\n- found:    %v", ref, batch)
+			}
+		})
+	}
+}
+
+func TestQueueCompact(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// A segment size of one byte seals the segment after each push.
+	q := openQueue(t, Config{Dir: dir, SegmentSize: 1})
+
+	for i := 0; i != 4; i++ {
+		push(t, q, 10*i, 10*i+10)
+	}
+
+	peek(t, q, 25)
+
+	if err := q.Ack(25); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%020d.seg", 2))
+	before := fileSize(t, path)
+
+	if err := q.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i != 2; i++ {
+		if _, err := os.Stat(filepath.Join(dir, fmt.Sprintf("%020d.seg", i))); !os.IsNotExist(err) {
+			t.Errorf("the delivered segment %d should have been removed: %v", i, err)
+		}
+	}
+
+	if after := fileSize(t, path); after >= before {
+		t.Errorf("the partially delivered segment should have been rewritten: %d >= %d", after, before)
+	}
+
+	if batch := peek(t, q, 100); !reflect.DeepEqual(batch, makeBatch(25, 40)) {
+		t.Errorf("invalid batch after compacting the queue: %v", batch)
+	}
+
+	// Pushing still works after compacting, and the positions are still
+	// valid once the queue is reopened.
+	push(t, q, 40, 45)
+	peek(t, q, 10)
+
+	if err := q.Ack(10); err != nil {
+		t.Fatal(err)
+	}
+
+	q.Close()
+	q = openQueue(t, Config{Dir: dir, SegmentSize: 1})
+	defer q.Close()
+
+	if batch := peek(t, q, 100); !reflect.DeepEqual(batch, makeBatch(35, 45)) {
+		t.Errorf("invalid batch after reopening the compacted queue: %v", batch)
+	}
+}
+
+func TestQueueFormatChange(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q := openQueue(t, Config{Dir: dir, Format: FramedFormat})
+	push(t, q, 0, 2)
+	q.Close()
+
+	q = openQueue(t, Config{Dir: dir, Format: NDJSONFormat})
+	defer q.Close()
+	push(t, q, 2, 4)
+
+	if batch := peek(t, q, 10); !reflect.DeepEqual(batch, makeBatch(0, 4)) {
+		t.Errorf("segments written in both formats should be readable: %v", batch)
+	}
+
+	b, _ := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("%020d.seg", 1)))
+
+	if s := string(b[:len("ecs-logs-queue v1 ndjson\n")]); s != "ecs-logs-queue v1 ndjson\n" {
+		t.Errorf("invalid header of the new segment: %#v", s)
+	}
+}
+
+func TestQueueMaxSize(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q := openQueue(t, Config{Dir: dir, SegmentSize: 1})
+	push(t, q, 0, 10)
+	size := q.Size()
+	q.Close()
+
+	q = openQueue(t, Config{Dir: dir, SegmentSize: 1, MaxSize: 2 * size})
+	defer q.Close()
+
+	if q.Size() != size {
+		t.Errorf("the size should be restored when opening the queue: %d != %d", q.Size(), size)
+	}
+
+	if err := q.Push(makeBatch(10, 30)); err != ErrFull {
+		t.Error("pushing past the maximum size should fail:", err)
+	}
+
+	peek(t, q, 5)
+
+	if err := q.Ack(5); err != nil {
+		t.Fatal(err)
+	}
+
+	// The acknowledged records don't count, even before they're compacted.
+	push(t, q, 10, 20)
+
+	if batch := peek(t, q, 100); !reflect.DeepEqual(batch, makeBatch(5, 20)) {
+		t.Errorf("invalid batch: %v", batch)
+	}
+}
+
+func TestQueueNewerVersion(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, fmt.Sprintf("%020d.seg", 0))
+	ioutil.WriteFile(path, []byte("ecs-logs-queue v2 something-else\n..."), 0644)
+
+	q := openQueue(t, Config{Dir: dir})
+	defer q.Close()
+	push(t, q, 0, 1)
+
+	if skipped := q.Skipped(); !reflect.DeepEqual(skipped, []string{path}) {
+		t.Errorf("the segment should have been skipped: %v", skipped)
+	}
+
+	if b, _ := ioutil.ReadFile(path); string(b) != "ecs-logs-queue v2 something-else\n..." {
+		t.Errorf("the skipped segment should be left untouched: %#v", string(b))
+	}
+
+	if batch := peek(t, q, 10); !reflect.DeepEqual(batch, makeBatch(0, 1)) {
+		t.Errorf("invalid batch: %v", batch)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ecs-logs-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func openQueue(t *testing.T, config Config) *Queue {
+	q, err := Open(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func push(t *testing.T, q *Queue, i int, j int) {
+	if err := q.Push(makeBatch(i, j)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func peek(t *testing.T, q *Queue, n int) lib.MessageBatch {
+	batch, err := q.Peek(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return batch
+}
+
+func makeBatch(i int, j int) (batch lib.MessageBatch) {
+	for ; i != j; i++ {
+		batch = append(batch, lib.Message{
+			Group:  "A",
+			Stream: "B",
+			Event:  ecslogs.Event{Message: fmt.Sprintf("message %d", i)},
+		})
+	}
+	return
+}
@@ -0,0 +1,400 @@
+package spool
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+const (
+	// The default maximum size of the records spilled to disk by each
+	// destination.
+	DefaultSpillSize = 1024 * 1024 * 1024
+
+	// The longest delay between two attempts at replaying the head of the
+	// spill buffer.
+	maxSpillBackoff = 30 * time.Second
+)
+
+// Spill is the configuration of the disk buffer that the batches a destination
+// failed to write are spilled to. They're replayed in the background until the
+// destination accepts them, and the following batches are appended to the
+// buffer in the meantime so each stream is delivered in order.
+//
+// The batches that the destination permanently rejected aren't spilled, and
+// the spilled ones it rejects are dropped so they don't hold up the others.
+//
+// The zero value is disabled, the failed batches are dropped.
+type Spill struct {
+	// The directory of the buffer, each destination needs its own.
+	Dir    string
+	Format Format
+
+	// The maximum size in bytes of the records waiting to be replayed, the
+	// batches that don't fit are dropped.
+	MaxSize int64
+
+	// How long the replay waits after the destination failed a batch, the
+	// delay doubles with each failure.
+	Backoff time.Duration
+
+	// The maximum number of messages and bytes of the replayed batches.
+	MaxBatchCount int
+	MaxBatchBytes int
+}
+
+// DestinationSpill returns the spill buffer configured for destination by the
+// <DESTINATION>_SPILL_DIR, <DESTINATION>_SPILL_MAX_SIZE,
+// <DESTINATION>_SPILL_FORMAT and <DESTINATION>_SPILL_BACKOFF environment
+// variables.
+func DestinationSpill(destination string) (s Spill, err error) {
+	prefix := strings.ToUpper(destination) + "_SPILL_"
+
+	s = Spill{
+		Dir:     strings.TrimSpace(lib.Getenv(prefix + "DIR")),
+		MaxSize: DefaultSpillSize,
+		Backoff: time.Second,
+	}
+
+	if v := strings.TrimSpace(lib.Getenv(prefix + "MAX_SIZE")); len(v) != 0 {
+		if s.MaxSize, err = strconv.ParseInt(v, 10, 64); err != nil || s.MaxSize <= 0 {
+			err = fmt.Errorf("invalid %sMAX_SIZE, must be a positive integer: %s", prefix, v)
+			return
+		}
+	}
+
+	if s.Format, err = ParseFormat(lib.Getenv(prefix + "FORMAT")); err != nil {
+		err = fmt.Errorf("%sFORMAT: %s", prefix, err)
+		return
+	}
+
+	if v := strings.TrimSpace(lib.Getenv(prefix + "BACKOFF")); len(v) != 0 {
+		if s.Backoff, err = time.ParseDuration(v); err != nil || s.Backoff <= 0 {
+			err = fmt.Errorf("invalid %sBACKOFF, must be a positive duration: %s", prefix, v)
+			return
+		}
+	}
+
+	return
+}
+
+// Enabled returns true if the failed batches are spilled to disk.
+func (s Spill) Enabled() bool {
+	return len(s.Dir) != 0
+}
+
+// NewSpillDestination wraps dest so the batches that it fails to write are
+// spilled to the buffer of s. The messages spilled and replayed are counted in
+// the spilled_messages and replayed_messages counters of registry, and the
+// spilled messages that dest rejected in the dropped_messages counter. The
+// batches left in the buffer by a previous run are replayed right away.
+func NewSpillDestination(name string, dest lib.Destination, s Spill, registry *metrics.Registry, clock clock.Clock) (lib.Destination, error) {
+	if !s.Enabled() {
+		return dest, nil
+	}
+
+	q, err := Open(Config{
+		Dir:             s.Dir,
+		Format:          s.Format,
+		SegmentSize:     DefaultSegmentSize,
+		CompactInterval: DefaultCompactInterval,
+		MaxSize:         s.MaxSize,
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("opening the spill buffer of %s: %s", name, err)
+	}
+
+	d := &SpillDestination{
+		Destination: dest,
+		name:        name,
+		config:      s,
+		queue:       q,
+		spilled:     registry.Counter("spilled_messages", "destination", name),
+		replayed:    registry.Counter("replayed_messages", "destination", name),
+		dropped:     registry.Counter("dropped_messages", "destination", name),
+		clock:       clock,
+	}
+	d.cond.L = &d.mutex
+
+	if n := q.Len(); n != 0 {
+		log.WithFields(log.Fields{
+			"destination": name,
+			"count":       n,
+		}).Info("replaying the messages spilled before the restart")
+
+		d.replaying = true
+		go d.replay()
+	}
+
+	return d, nil
+}
+
+// SpillDestination is a destination whose failed batches are spilled to disk
+// and replayed once it recovers.
+type SpillDestination struct {
+	lib.Destination
+	name   string
+	config Spill
+	queue  *Queue
+
+	spilled  *metrics.Counter
+	replayed *metrics.Counter
+	dropped  *metrics.Counter
+	clock    clock.Clock
+
+	mutex     sync.Mutex
+	cond      sync.Cond
+	replaying bool
+}
+
+// Wait blocks until the spilled batches were replayed.
+func (d *SpillDestination) Wait() {
+	d.mutex.Lock()
+	for d.replaying {
+		d.cond.Wait()
+	}
+	d.mutex.Unlock()
+}
+
+// Len returns the number of messages waiting to be replayed.
+func (d *SpillDestination) Len() int {
+	return d.queue.Len()
+}
+
+func (d *SpillDestination) Open(group string, stream string) (lib.Writer, error) {
+	return &spillWriter{dest: d, group: group, stream: stream}, nil
+}
+
+// spill appends batch to the buffer and starts replaying it if needed.
+func (d *SpillDestination) spill(batch lib.MessageBatch) (err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if err = d.queue.Push(batch); err != nil {
+		return fmt.Errorf("spilling the batch to %s: %s", d.config.Dir, err)
+	}
+
+	d.spilled.Add(int64(len(batch)))
+
+	if !d.replaying {
+		d.replaying = true
+		go d.replay()
+	}
+
+	return
+}
+
+// replay writes the spilled batches in order until the buffer is empty. The
+// head of the buffer is written again after a backoff while the destination
+// fails it, unless it was permanently rejected.
+func (d *SpillDestination) replay() {
+	delay := d.config.Backoff
+
+	for {
+		d.mutex.Lock()
+		batch, err := d.queue.Peek(d.maxBatchCount())
+
+		if err == nil && len(batch) == 0 {
+			d.replaying = false
+			d.cond.Broadcast()
+			d.mutex.Unlock()
+			return
+		}
+
+		d.mutex.Unlock()
+
+		if err == nil {
+			err = d.deliver(batch)
+		}
+
+		if err == nil {
+			delay = d.config.Backoff
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"destination": d.name,
+			"error":       err,
+			"pending":     d.queue.Len(),
+		}).Warn("failed to replay the spilled messages")
+
+		d.clock.Sleep(context.Background(), delay)
+
+		if delay *= 2; delay > maxSpillBackoff {
+			delay = maxSpillBackoff
+		}
+	}
+}
+
+// deliver writes the peeked messages, one batch per run of messages of the
+// same stream, and acknowledges each batch once it was written, or dropped
+// because the destination permanently rejected it.
+func (d *SpillDestination) deliver(msgs lib.MessageBatch) (err error) {
+	for len(msgs) != 0 {
+		n, bytes := 1, msgs[0].ContentLength()
+
+		for n < len(msgs) && msgs[n].Group == msgs[0].Group && msgs[n].Stream == msgs[0].Stream {
+			if bytes += msgs[n].ContentLength(); d.config.MaxBatchBytes > 0 && bytes > d.config.MaxBatchBytes {
+				break
+			}
+			n++
+		}
+
+		err = d.write(msgs[0].Group, msgs[0].Stream, msgs[:n])
+
+		switch {
+		case err == nil:
+			d.replayed.Add(int64(n))
+		case permanent(err):
+			log.WithFields(log.Fields{
+				"group":       msgs[0].Group,
+				"stream":      msgs[0].Stream,
+				"destination": d.name,
+				"error":       err,
+				"count":       n,
+			}).Error("dropping spilled messages rejected by the destination")
+			d.dropped.Add(int64(n))
+		default:
+			return
+		}
+
+		if err = d.queue.Ack(n); err != nil {
+			return
+		}
+
+		msgs = msgs[n:]
+	}
+
+	return
+}
+
+func (d *SpillDestination) write(group string, stream string, batch lib.MessageBatch) (err error) {
+	var w lib.Writer
+
+	if w, err = d.Destination.Open(group, stream); err != nil {
+		return
+	}
+	defer w.Close()
+
+	_, err = lib.WriteMessageBatchSize(w, batch)
+	return
+}
+
+// invalidRequestCodes are the codes of the AWS errors telling that a request
+// is invalid, sending the same batch again fails the same way.
+var invalidRequestCodes = map[string]bool{
+	"InvalidParameterException": true,
+	"InvalidParameterValue":     true,
+	"SerializationException":    true,
+	"ValidationException":       true,
+}
+
+// permanent returns true if err tells that the destination would reject the
+// batch again however many times it's written: some of its messages were
+// rejected, or the request was invalid or too large.
+func permanent(err error) bool {
+	switch e := err.(type) {
+	case *lib.RejectedError:
+		return true
+	case awserr.RequestFailure:
+		if retry.IsThrottled(err) {
+			return false
+		}
+		return invalidRequestCodes[e.Code()] || e.StatusCode() == http.StatusRequestEntityTooLarge
+	}
+	return false
+}
+
+func (d *SpillDestination) maxBatchCount() int {
+	if d.config.MaxBatchCount > 0 {
+		return d.config.MaxBatchCount
+	}
+	return 10000
+}
+
+// spillWriter writes the batches to the wrapped destination while nothing is
+// spilled, and to the spill buffer otherwise.
+type spillWriter struct {
+	dest   *SpillDestination
+	group  string
+	stream string
+}
+
+func (w *spillWriter) Close() error {
+	return nil
+}
+
+func (w *spillWriter) WriteMessage(msg lib.Message) error {
+	return w.WriteMessageBatch(lib.MessageBatch{msg})
+}
+
+func (w *spillWriter) WriteMessageBatch(batch lib.MessageBatch) (err error) {
+	_, err = w.WriteMessageBatchSize(batch)
+	return
+}
+
+func (w *spillWriter) WriteMessageBatchSize(batch lib.MessageBatch) (int, error) {
+	return w.write(batch, lib.WriteMessageBatchSize)
+}
+
+func (w *spillWriter) WriteUrgentMessageBatch(batch lib.MessageBatch) (int, error) {
+	return w.write(batch, lib.WriteUrgentMessageBatch)
+}
+
+func (w *spillWriter) write(batch lib.MessageBatch, write func(lib.Writer, lib.MessageBatch) (int, error)) (size int, err error) {
+	d := w.dest
+
+	d.mutex.Lock()
+	replaying := d.replaying
+	d.mutex.Unlock()
+
+	// The batches queue up behind the spilled ones, so the messages of each
+	// stream are still delivered in order. The batches that the destination
+	// rejected aren't spilled, replaying them would fail the same way.
+	if !replaying {
+		if size, err = w.writeDirect(batch, write); err == nil || permanent(err) {
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"group":       w.group,
+			"stream":      w.stream,
+			"destination": d.name,
+			"error":       err,
+			"count":       len(batch),
+		}).Warn("spilling a message batch to disk")
+	}
+
+	if e := d.spill(batch); e != nil {
+		return 0, lib.AppendError(err, e)
+	}
+
+	for _, msg := range batch {
+		size += msg.ContentLength()
+	}
+
+	return size, nil
+}
+
+func (w *spillWriter) writeDirect(batch lib.MessageBatch, write func(lib.Writer, lib.MessageBatch) (int, error)) (size int, err error) {
+	var dw lib.Writer
+
+	if dw, err = w.dest.Destination.Open(w.group, w.stream); err != nil {
+		return
+	}
+	defer dw.Close()
+
+	return write(dw, batch)
+}
@@ -0,0 +1,268 @@
+package spool
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// testDestination records the messages written to it, and fails the writes
+// while it's down. It permanently rejects the rejected message.
+type testDestination struct {
+	mutex    sync.Mutex
+	down     bool
+	rejected string
+	messages []string
+}
+
+func (d *testDestination) Open(group string, stream string) (lib.Writer, error) {
+	return testWriter{d}, nil
+}
+
+func (d *testDestination) Close(group string, stream string) {}
+
+func (d *testDestination) setDown(down bool) {
+	d.mutex.Lock()
+	d.down = down
+	d.mutex.Unlock()
+}
+
+func (d *testDestination) received() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]string{}, d.messages...)
+}
+
+type testWriter struct {
+	dest *testDestination
+}
+
+func (w testWriter) Close() error { return nil }
+
+func (w testWriter) WriteMessage(msg lib.Message) error {
+	return w.WriteMessageBatch(lib.MessageBatch{msg})
+}
+
+func (w testWriter) WriteMessageBatch(batch lib.MessageBatch) error {
+	w.dest.mutex.Lock()
+	defer w.dest.mutex.Unlock()
+
+	if w.dest.down {
+		return errors.New("the destination is down")
+	}
+
+	var err error
+
+	for _, msg := range batch {
+		if msg.Event.Message == w.dest.rejected {
+			err = &lib.RejectedError{Rejections: []lib.Rejection{{Message: msg, Reason: "rejected"}}}
+			continue
+		}
+		w.dest.messages = append(w.dest.messages, msg.Event.Message)
+	}
+	return err
+}
+
+func newSpill(t *testing.T, dest lib.Destination, s Spill, c clock.Clock) (*SpillDestination, *metrics.Registry) {
+	r := metrics.NewRegistry()
+	d, err := NewSpillDestination("test", dest, s, r, c)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d.(*SpillDestination), r
+}
+
+func write(t *testing.T, dest lib.Destination, i int, j int) error {
+	w, err := dest.Open("A", "B")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	return w.WriteMessageBatch(makeBatch(i, j))
+}
+
+func messages(i int, j int) (msgs []string) {
+	for _, msg := range makeBatch(i, j) {
+		msgs = append(msgs, msg.Event.Message)
+	}
+	return
+}
+
+func TestSpillReplaysInOrder(t *testing.T) {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	dest := &testDestination{down: true}
+	c := clock.NewFake(time.Now())
+	d, r := newSpill(t, dest, Spill{Dir: dir, MaxSize: DefaultSpillSize, Backoff: time.Second}, c)
+
+	if err := write(t, d, 0, 3); err != nil {
+		t.Fatal("the failed batch should be spilled:", err)
+	}
+
+	if err := write(t, d, 3, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := r.Counter("spilled_messages", "destination", "test").Value(); n != 5 {
+		t.Errorf("the spilled messages should be counted: %d", n)
+	}
+
+	// Wait for a replay to fail before the destination recovers.
+	for deadline := time.Now().Add(time.Second); c.Slept() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the replay should back off while the destination is down")
+		}
+	}
+
+	dest.setDown(false)
+	d.Wait()
+
+	if msgs := dest.received(); !reflect.DeepEqual(msgs, messages(0, 5)) {
+		t.Errorf("the spilled messages should be replayed in order: %v", msgs)
+	}
+
+	if n := r.Counter("replayed_messages", "destination", "test").Value(); n != 5 {
+		t.Errorf("the replayed messages should be counted: %d", n)
+	}
+
+	// Once the buffer is empty the batches are written directly.
+	if err := write(t, d, 5, 6); err != nil || d.Len() != 0 {
+		t.Errorf("the batch should be written directly: %v, %d pending", err, d.Len())
+	}
+
+	if msgs := dest.received(); !reflect.DeepEqual(msgs, messages(0, 6)) {
+		t.Errorf("invalid messages: %v", msgs)
+	}
+}
+
+func TestSpillReplaysAfterRestart(t *testing.T) {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	q := openQueue(t, Config{Dir: dir})
+	push(t, q, 0, 4)
+	q.Close()
+
+	dest := &testDestination{}
+	d, _ := newSpill(t, dest, Spill{Dir: dir, MaxSize: DefaultSpillSize, Backoff: time.Second, MaxBatchCount: 3}, clock.NewFake(time.Now()))
+	d.Wait()
+
+	if msgs := dest.received(); !reflect.DeepEqual(msgs, messages(0, 4)) {
+		t.Errorf("the messages spilled before the restart should be replayed: %v", msgs)
+	}
+}
+
+func TestSpillDropsRejected(t *testing.T) {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	dest := &testDestination{down: true, rejected: "message 3"}
+	c := clock.NewFake(time.Now())
+	d, r := newSpill(t, dest, Spill{Dir: dir, MaxSize: DefaultSpillSize, Backoff: time.Second, MaxBatchCount: 2}, c)
+
+	if err := write(t, d, 0, 6); err != nil {
+		t.Fatal("the failed batch should be spilled:", err)
+	}
+
+	dest.setDown(false)
+	d.Wait()
+
+	// The replayed batch with the rejected message is dropped, the ones after
+	// it are still delivered.
+	if msgs := dest.received(); !reflect.DeepEqual(msgs, []string{"message 0", "message 1", "message 2", "message 4", "message 5"}) {
+		t.Errorf("the batches after the rejected one should be replayed: %v", msgs)
+	}
+
+	if n := r.Counter("dropped_messages", "destination", "test").Value(); n != 2 {
+		t.Errorf("the dropped messages should be counted: %d", n)
+	}
+
+	// The batches rejected while nothing is spilled aren't spilled either.
+	dest.mutex.Lock()
+	dest.rejected = "message 7"
+	dest.mutex.Unlock()
+
+	if err := write(t, d, 6, 8); err == nil {
+		t.Error("the rejection should be returned")
+	}
+
+	if d.Len() != 0 {
+		t.Errorf("the rejected batch should not be spilled: %d pending", d.Len())
+	}
+}
+
+func TestSpillFull(t *testing.T) {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	dest := &testDestination{down: true}
+	d, _ := newSpill(t, dest, Spill{Dir: dir, MaxSize: 1, Backoff: time.Second}, clock.NewFake(time.Now()))
+
+	if err := write(t, d, 0, 1); err == nil {
+		t.Error("the batch that doesn't fit in the buffer should fail")
+	}
+
+	if d.Len() != 0 {
+		t.Errorf("nothing should be spilled: %d", d.Len())
+	}
+}
+
+func TestDestinationSpill(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(nil)
+
+	if s, err := DestinationSpill("cloudwatchlogs"); err != nil || s.Enabled() {
+		t.Errorf("the spill buffer should be disabled by default: %+v, %v", s, err)
+	}
+
+	lib.SetConfigEnv(map[string]string{
+		"CLOUDWATCHLOGS_SPILL_DIR":      "/var/spool/ecs-logs",
+		"CLOUDWATCHLOGS_SPILL_MAX_SIZE": "1048576",
+		"CLOUDWATCHLOGS_SPILL_FORMAT":   "ndjson",
+		"CLOUDWATCHLOGS_SPILL_BACKOFF":  "5s",
+	})
+
+	s, err := DestinationSpill("cloudwatchlogs")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := (Spill{Dir: "/var/spool/ecs-logs", Format: NDJSONFormat, MaxSize: 1048576, Backoff: 5 * time.Second}); s != expected {
+		t.Errorf("invalid spill configuration: %+v", s)
+	}
+
+	for _, env := range []map[string]string{
+		{"CLOUDWATCHLOGS_SPILL_MAX_SIZE": "0"},
+		{"CLOUDWATCHLOGS_SPILL_FORMAT": "xml"},
+		{"CLOUDWATCHLOGS_SPILL_BACKOFF": "soon"},
+	} {
+		lib.SetConfigEnv(env)
+
+		if _, err := DestinationSpill("cloudwatchlogs"); err == nil {
+			t.Errorf("%v: the spill configuration should be invalid", env)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package sqs
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/dedup"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+// config carries the settings of the sqs destination, they are loaded from
+// SQS_* environment variables.
+type config struct {
+	// The URL of the queue that messages are sent to.
+	queueURL string
+
+	// The region of the queue and the endpoint of the SQS API, which are
+	// derived from the queue URL unless it isn't an AWS one (like a VPC
+	// endpoint or a local emulator), the endpoint is empty for the public
+	// endpoints.
+	region   string
+	endpoint string
+
+	// Whether the queue is a FIFO queue, in which case messages are sent with
+	// their group as message group ID and a deduplication ID derived by key.
+	fifo bool
+	key  dedup.Key
+
+	// How the messages that SQS failed to enqueue are sent again.
+	retry retry.Policy
+
+	// The budget of the retries shared by all the writers, so a queue failing
+	// most of the messages isn't sent each of them the maximum number of retries.
+	retryBudget lib.RetryBudget
+
+	err error
+}
+
+func getConfig() (c config) {
+	var err error
+	var s string
+
+	c.queueURL = strings.TrimSpace(lib.Getenv("SQS_QUEUE_URL"))
+
+	if len(c.queueURL) == 0 {
+		c.err = lib.AppendError(c.err, fmt.Errorf("missing SQS_QUEUE_URL environment variable"))
+	} else if c.region, c.endpoint, err = parseQueueURL(c.queueURL); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("SQS_REGION")); len(s) != 0 {
+		c.region = s
+	} else if len(c.region) == 0 {
+		if c.region = os.Getenv("AWS_REGION"); len(c.region) == 0 {
+			c.region = os.Getenv("AWS_DEFAULT_REGION")
+		}
+	}
+
+	if len(c.region) == 0 && len(c.queueURL) != 0 {
+		c.err = lib.AppendError(c.err, fmt.Errorf("the region of the queue couldn't be found in SQS_QUEUE_URL, it must be set with SQS_REGION"))
+	}
+
+	// The names of FIFO queues must end with .fifo, which is a good default.
+	c.fifo = strings.HasSuffix(c.queueURL, ".fifo")
+
+	if s = strings.TrimSpace(lib.Getenv("SQS_FIFO")); len(s) != 0 {
+		if c.fifo, err = strconv.ParseBool(s); err != nil {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid SQS_FIFO, must be a boolean: %s", s))
+		}
+	}
+
+	if c.key, err = dedup.DestinationKey("sqs"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	} else if c.fifo && !c.key.Enabled() {
+		// FIFO queues require a deduplication ID unless content-based
+		// deduplication is enabled on them, a hash of the message works in
+		// both cases.
+		c.key, _ = dedup.Parse("hash")
+	}
+
+	if c.retry, err = retry.DestinationPolicy("sqs", retry.DefaultPolicy); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if c.retryBudget, err = lib.DestinationRetryBudget("sqs"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	return
+}
+
+func (c config) check() error {
+	return c.err
+}
+
+// parseQueueURL returns the region of the queue at s, and the endpoint that
+// the requests must be sent to if the queue isn't on an AWS endpoint.
+func parseQueueURL(s string) (region string, endpoint string, err error) {
+	var u *url.URL
+
+	if u, err = url.Parse(s); err != nil || len(u.Host) == 0 || (u.Scheme != "http" && u.Scheme != "https") {
+		err = fmt.Errorf("invalid SQS_QUEUE_URL, must be an http or https URL: %s", s)
+		return
+	}
+
+	host := u.Hostname()
+
+	if !strings.HasSuffix(host, ".amazonaws.com") && !strings.HasSuffix(host, ".amazonaws.com.cn") {
+		endpoint = u.Scheme + "://" + u.Host
+		return
+	}
+
+	// The URLs of the queues are either sqs.<region>.amazonaws.com/... or the
+	// legacy <region>.queue.amazonaws.com/...
+	switch parts := strings.Split(host, "."); {
+	case parts[0] == "sqs" && len(parts) > 2:
+		region = parts[1]
+	case len(parts) > 2 && parts[1] == "queue":
+		region = parts[0]
+	}
+
+	return
+}
@@ -0,0 +1,8 @@
+package sqs
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterDestination("sqs", newDestination(getConfig))
+	lib.RegisterRecordLimit("sqs", maxBatchSize)
+}
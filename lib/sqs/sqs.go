@@ -0,0 +1,215 @@
+// Package sqs implements the sqs destination, which sends the messages to an
+// Amazon SQS queue for consumers that pull them for their own processing.
+package sqs
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+const (
+	// The limits of SendMessageBatch, in number of messages and in bytes of
+	// message bodies.
+	maxBatchLength = 10
+	maxBatchSize   = 256 * 1024
+)
+
+// destination sends messages to a single queue, the writers of all the streams
+// share the SQS client.
+type destination struct {
+	lazy   lib.LazyConfig
+	load   func() config
+	config config
+
+	client  sqsiface.SQSAPI
+	retries *lib.RetryLimiter
+	clock   clock.Clock
+}
+
+func newDestination(load func() config) *destination {
+	return &destination{
+		load:  load,
+		clock: clock.System,
+	}
+}
+
+func (d *destination) Open(group string, stream string) (w lib.Writer, err error) {
+	if err = d.lazy.Init(d.init); err != nil {
+		return
+	}
+
+	if d.client == nil {
+		var sess *session.Session
+		var cfg = &aws.Config{Region: aws.String(d.config.region)}
+
+		if len(d.config.endpoint) != 0 {
+			cfg.Endpoint = aws.String(d.config.endpoint)
+		}
+
+		if sess, err = session.NewSession(cfg); err != nil {
+			return
+		}
+
+		d.client = sqs.New(sess)
+	}
+
+	w = writer{dest: d}
+	return
+}
+
+// CheckConfig reports the problems with the SQS_* settings when ecs-logs
+// starts.
+func (d *destination) CheckConfig() error {
+	return d.load().check()
+}
+
+func (d *destination) Close(group string, stream string) {}
+
+func (d *destination) init() error {
+	d.config = d.load()
+	d.retries = lib.NewRetryLimiter("sqs", d.config.retryBudget, metrics.Default)
+
+	return d.config.check()
+}
+
+// send sends a batch of at most maxBatchLength messages, entries are made of
+// the messages of batch in the same order. The messages that SQS failed to
+// enqueue because of an error on its side are sent again with the retry policy
+// of the destination, the ones it rejected (like a body with invalid
+// characters) would fail again and are reported right away in a
+// lib.RejectedError.
+func (d *destination) send(batch lib.MessageBatch, entries []*sqs.SendMessageBatchRequestEntry) (err error) {
+	var rejections []lib.Rejection
+
+	// The IDs of the entries stay the same across the retries, the failures
+	// are mapped back to their messages with them.
+	msgs := make(map[string]lib.Message, len(entries))
+
+	for i, e := range entries {
+		msgs[aws.StringValue(e.Id)] = batch[i]
+	}
+
+	if e := d.config.retry.Do(d.clock, d.retries, func() error {
+		var failed []*sqs.SendMessageBatchRequestEntry
+		var last *sqs.BatchResultErrorEntry
+
+		res, e := d.client.SendMessageBatch(&sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(d.config.queueURL),
+			Entries:  entries,
+		})
+
+		if e != nil {
+			// The SDK already retried the transient errors of the call.
+			return e
+		}
+
+		byID := make(map[string]*sqs.SendMessageBatchRequestEntry, len(entries))
+
+		for _, e := range entries {
+			byID[aws.StringValue(e.Id)] = e
+		}
+
+		for _, f := range res.Failed {
+			if aws.BoolValue(f.SenderFault) {
+				rejections = append(rejections, lib.Rejection{
+					Message: msgs[aws.StringValue(f.Id)],
+					Reason:  fmt.Sprintf("sqs rejected the message, %s: %s", aws.StringValue(f.Code), aws.StringValue(f.Message)),
+				})
+			} else if e := byID[aws.StringValue(f.Id)]; e != nil {
+				failed, last = append(failed, e), f
+			}
+		}
+
+		if len(failed) == 0 {
+			return nil
+		}
+
+		entries = failed
+		return retry.Retryable(fmt.Errorf("%d messages couldn't be sent to sqs, the last error was %s: %s",
+			len(failed), aws.StringValue(last.Code), aws.StringValue(last.Message)))
+	}); e != nil {
+		err = e
+	}
+
+	if len(rejections) != 0 {
+		err = lib.AppendWriteError(err, &lib.RejectedError{Rejections: rejections})
+	}
+
+	return
+}
+
+func (d *destination) entry(id int, msg lib.Message, body string) *sqs.SendMessageBatchRequestEntry {
+	e := &sqs.SendMessageBatchRequestEntry{
+		Id:          aws.String(strconv.Itoa(id)),
+		MessageBody: aws.String(body),
+	}
+
+	if d.config.fifo {
+		// Messages of the same group stay ordered, and the deduplication ID
+		// only depends on the content so batches retried by ecs-logs don't
+		// enqueue duplicates within the deduplication interval of SQS.
+		e.MessageGroupId = aws.String(msg.Group)
+		e.MessageDeduplicationId = aws.String(d.config.key.ID(msg))
+	}
+
+	return e
+}
+
+type writer struct {
+	dest *destination
+}
+
+func (w writer) Close() error {
+	return nil
+}
+
+func (w writer) WriteMessage(msg lib.Message) error {
+	return w.WriteMessageBatch(lib.MessageBatch{msg})
+}
+
+func (w writer) WriteMessageBatch(batch lib.MessageBatch) (err error) {
+	_, err = w.WriteMessageBatchSize(batch)
+	return
+}
+
+// WriteMessageBatchSize sends batch with as few SendMessageBatch calls as the
+// limits of SQS allow, and returns the size of the message bodies.
+func (w writer) WriteMessageBatchSize(batch lib.MessageBatch) (size int, err error) {
+	var chunk lib.MessageBatch
+	var entries []*sqs.SendMessageBatchRequestEntry
+	var length int
+
+	flush := func() {
+		if len(entries) != 0 {
+			if e := w.dest.send(chunk, entries); e != nil {
+				err = lib.AppendWriteError(err, e)
+			}
+			chunk, entries, length = nil, nil, 0
+		}
+	}
+
+	for _, msg := range batch {
+		body := string(msg.Bytes())
+
+		if len(entries) == maxBatchLength || (len(entries) != 0 && length+len(body) > maxBatchSize) {
+			flush()
+		}
+
+		chunk = append(chunk, msg)
+		entries = append(entries, w.dest.entry(len(entries), msg, body))
+		length += len(body)
+		size += len(body)
+	}
+
+	flush()
+	return
+}
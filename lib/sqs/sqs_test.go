@@ -0,0 +1,339 @@
+package sqs
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/dedup"
+	"github.com/segmentio/ecs-logs/lib/retry"
+)
+
+const testQueueURL = "https://sqs.us-west-2.amazonaws.com/123456789012/logs"
+
+// mockAPI records the SendMessageBatch calls, fail returns the entries of each
+// call that SQS failed to enqueue.
+type mockAPI struct {
+	sqsiface.SQSAPI
+
+	mutex sync.Mutex
+	calls []*sqs.SendMessageBatchInput
+	fail  func(call int, e *sqs.SendMessageBatchRequestEntry) *sqs.BatchResultErrorEntry
+}
+
+func (m *mockAPI) SendMessageBatch(input *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.calls = append(m.calls, input)
+	res := &sqs.SendMessageBatchOutput{}
+
+	for _, e := range input.Entries {
+		var f *sqs.BatchResultErrorEntry
+
+		if m.fail != nil {
+			f = m.fail(len(m.calls), e)
+		}
+
+		if f != nil {
+			f.Id = e.Id
+			res.Failed = append(res.Failed, f)
+		} else {
+			res.Successful = append(res.Successful, &sqs.SendMessageBatchResultEntry{Id: e.Id})
+		}
+	}
+
+	return res, nil
+}
+
+func newTestDestination(c config) (*destination, *mockAPI, *clock.Fake) {
+	api := &mockAPI{}
+	f := clock.NewFake(time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC))
+
+	if len(c.queueURL) == 0 {
+		c.queueURL = testQueueURL
+	}
+
+	d := newDestination(func() config { return c })
+	d.client = api
+	d.clock = f
+	return d, api, f
+}
+
+func TestWriterBatchLength(t *testing.T) {
+	d, api, _ := newTestDestination(config{retry: retry.Policy{MaxRetries: 5}})
+	w, _ := d.Open("A", "B")
+
+	var batch lib.MessageBatch
+
+	for i := 0; i != 25; i++ {
+		batch = append(batch, makeMessage("A", fmt.Sprintf("message %d", i)))
+	}
+
+	if err := w.WriteMessageBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(api.calls) != 3 {
+		t.Fatalf("25 messages should be sent in 3 calls: %d", len(api.calls))
+	}
+
+	for i, n := range []int{10, 10, 5} {
+		if call := api.calls[i]; len(call.Entries) != n || aws.StringValue(call.QueueUrl) != testQueueURL {
+			t.Errorf("invalid call #%d: %d entries to %s", i, len(call.Entries), aws.StringValue(call.QueueUrl))
+		}
+	}
+
+	if body := aws.StringValue(api.calls[2].Entries[4].MessageBody); body != string(batch[24].Bytes()) {
+		t.Errorf("invalid message body: %s", body)
+	}
+}
+
+func TestWriterBatchSize(t *testing.T) {
+	d, api, _ := newTestDestination(config{retry: retry.Policy{MaxRetries: 5}})
+	w, _ := d.Open("A", "B")
+
+	// Each message takes a bit more than a third of the maximum size, only
+	// two of them fit in a batch.
+	text := strings.Repeat("x", maxBatchSize/3)
+	batch := lib.MessageBatch{makeMessage("A", text), makeMessage("A", text), makeMessage("A", text)}
+
+	size, err := w.(writer).WriteMessageBatchSize(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(api.calls) != 2 || len(api.calls[0].Entries) != 2 || len(api.calls[1].Entries) != 1 {
+		t.Errorf("the batches should stay under %d bytes: %d calls", maxBatchSize, len(api.calls))
+	}
+
+	if min := 3 * len(text); size < min {
+		t.Errorf("invalid size: %d", size)
+	}
+}
+
+func TestWriterFIFO(t *testing.T) {
+	key, _ := dedup.Parse("hash")
+	d, api, _ := newTestDestination(config{queueURL: testQueueURL + ".fifo", fifo: true, key: key})
+	w, _ := d.Open("A", "B")
+
+	a, b := makeMessage("A", "hello"), makeMessage("B", "world")
+
+	if err := w.WriteMessageBatch(lib.MessageBatch{a, b, a}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := api.calls[0].Entries
+
+	for i, group := range []string{"A", "B", "A"} {
+		if id := aws.StringValue(entries[i].MessageGroupId); id != group {
+			t.Errorf("#%d: the message group ID should be the group of the message: %q", i, id)
+		}
+
+		if len(aws.StringValue(entries[i].MessageDeduplicationId)) == 0 {
+			t.Errorf("#%d: missing deduplication ID", i)
+		}
+	}
+
+	if x, y := aws.StringValue(entries[0].MessageDeduplicationId), aws.StringValue(entries[1].MessageDeduplicationId); x == y {
+		t.Errorf("different messages should have different deduplication IDs: %s", x)
+	}
+
+	if x, y := aws.StringValue(entries[0].MessageDeduplicationId), aws.StringValue(entries[2].MessageDeduplicationId); x != y {
+		t.Errorf("identical messages should have the same deduplication ID: %s != %s", x, y)
+	}
+
+	// Standard queues don't accept the FIFO attributes.
+	d, api, _ = newTestDestination(config{})
+	w, _ = d.Open("A", "B")
+	w.WriteMessage(a)
+
+	if e := api.calls[0].Entries[0]; e.MessageGroupId != nil || e.MessageDeduplicationId != nil {
+		t.Errorf("the FIFO attributes should only be set for FIFO queues: %+v", e)
+	}
+}
+
+func TestWriterPartialFailure(t *testing.T) {
+	d, api, f := newTestDestination(config{retry: retry.Policy{MaxRetries: 5}})
+	api.fail = func(call int, e *sqs.SendMessageBatchRequestEntry) *sqs.BatchResultErrorEntry {
+		// Messages 1 and 3 fail on the first two attempts.
+		if id := aws.StringValue(e.Id); call <= 2 && (id == "1" || id == "3") {
+			return &sqs.BatchResultErrorEntry{Code: aws.String("ServiceUnavailable"), SenderFault: aws.Bool(false)}
+		}
+		return nil
+	}
+
+	w, _ := d.Open("A", "B")
+	batch := lib.MessageBatch{makeMessage("A", "0"), makeMessage("A", "1"), makeMessage("A", "2"), makeMessage("A", "3")}
+
+	if err := w.WriteMessageBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(api.calls) != 3 {
+		t.Fatalf("the failed messages should be retried until they're sent: %d calls", len(api.calls))
+	}
+
+	for _, call := range api.calls[1:] {
+		if len(call.Entries) != 2 || aws.StringValue(call.Entries[0].Id) != "1" || aws.StringValue(call.Entries[1].Id) != "3" {
+			t.Errorf("only the failed messages should be retried: %v", call.Entries)
+		}
+	}
+
+	if f.Slept() == 0 {
+		t.Error("the retries should back off")
+	}
+}
+
+func TestWriterPartialFailureGiveUp(t *testing.T) {
+	d, api, _ := newTestDestination(config{retry: retry.Policy{MaxRetries: 2}})
+	api.fail = func(call int, e *sqs.SendMessageBatchRequestEntry) *sqs.BatchResultErrorEntry {
+		switch aws.StringValue(e.Id) {
+		case "0":
+			return &sqs.BatchResultErrorEntry{Code: aws.String("InternalError"), SenderFault: aws.Bool(false)}
+		case "1":
+			return &sqs.BatchResultErrorEntry{Code: aws.String("InvalidMessageContents"), SenderFault: aws.Bool(true)}
+		}
+		return nil
+	}
+
+	w, _ := d.Open("A", "B")
+	err := w.WriteMessageBatch(lib.MessageBatch{makeMessage("A", "0"), makeMessage("A", "1"), makeMessage("A", "2")})
+
+	// The batch failed, the rejected message is reported when it's written
+	// again.
+	if _, ok := err.(*retry.GiveUpError); !ok {
+		t.Errorf("the message that kept failing should be reported: %v", err)
+	}
+
+	if len(api.calls) != 3 || len(api.calls[1].Entries) != 1 || len(api.calls[2].Entries) != 1 {
+		t.Errorf("only the messages failing on the SQS side should be retried: %d calls", len(api.calls))
+	}
+}
+
+func TestWriterRejected(t *testing.T) {
+	d, api, _ := newTestDestination(config{retry: retry.Policy{MaxRetries: 2}})
+	api.fail = func(call int, e *sqs.SendMessageBatchRequestEntry) *sqs.BatchResultErrorEntry {
+		if aws.StringValue(e.Id) == "1" {
+			return &sqs.BatchResultErrorEntry{Code: aws.String("InvalidMessageContents"), SenderFault: aws.Bool(true)}
+		}
+		return nil
+	}
+
+	w, _ := d.Open("A", "B")
+	err := w.WriteMessageBatch(lib.MessageBatch{makeMessage("A", "0"), makeMessage("A", "1"), makeMessage("A", "2")})
+
+	if e, ok := err.(*lib.RejectedError); !ok || len(e.Rejections) != 1 || e.Rejections[0].Message.Event.Message != "1" {
+		t.Errorf("only the rejected message should be reported: %v", err)
+	}
+
+	if len(api.calls) != 1 {
+		t.Errorf("the rejected message should not be retried: %d calls", len(api.calls))
+	}
+}
+
+func TestWriterRetryBudget(t *testing.T) {
+	d, api, _ := newTestDestination(config{retry: retry.Policy{MaxRetries: 5}, retryBudget: lib.RetryBudget{Ratio: 0.5, Size: 2}})
+	api.fail = func(call int, e *sqs.SendMessageBatchRequestEntry) *sqs.BatchResultErrorEntry {
+		return &sqs.BatchResultErrorEntry{Code: aws.String("ServiceUnavailable"), SenderFault: aws.Bool(false)}
+	}
+
+	w, _ := d.Open("A", "B")
+
+	for i := 0; i != 10; i++ {
+		if err := w.WriteMessage(makeMessage("A", "0")); err == nil {
+			t.Fatal("the message should fail when the queue keeps failing")
+		}
+	}
+
+	// Without the budget each message would have been sent 6 times.
+	if len(api.calls) != 10+2 {
+		t.Errorf("the retries should be capped by the budget: %d calls", len(api.calls))
+	}
+
+	// Once the queue recovers each success gives back half a retry.
+	api.fail = nil
+
+	for i := 0; i != 4; i++ {
+		w.WriteMessage(makeMessage("A", "0"))
+	}
+
+	api.fail = func(call int, e *sqs.SendMessageBatchRequestEntry) *sqs.BatchResultErrorEntry {
+		return &sqs.BatchResultErrorEntry{Code: aws.String("ServiceUnavailable"), SenderFault: aws.Bool(false)}
+	}
+	calls := len(api.calls)
+	w.WriteMessage(makeMessage("A", "0"))
+
+	if n := len(api.calls) - calls; n != 1+2 {
+		t.Errorf("the successes should refill the budget: %d calls", n)
+	}
+}
+
+func TestParseQueueURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		region   string
+		endpoint string
+	}{
+		{url: "https://sqs.us-west-2.amazonaws.com/123456789012/logs", region: "us-west-2"},
+		{url: "https://eu-west-1.queue.amazonaws.com/123456789012/logs.fifo", region: "eu-west-1"},
+		{url: "https://sqs.cn-north-1.amazonaws.com.cn/123456789012/logs", region: "cn-north-1"},
+		{url: "http://localhost:4566/000000000000/logs", endpoint: "http://localhost:4566"},
+	}
+
+	for _, test := range tests {
+		region, endpoint, err := parseQueueURL(test.url)
+
+		if err != nil || region != test.region || endpoint != test.endpoint {
+			t.Errorf("%s: invalid region and endpoint: %q %q (%v)", test.url, region, endpoint, err)
+		}
+	}
+
+	if _, _, err := parseQueueURL("logs"); err == nil {
+		t.Error("a queue name should be rejected")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(map[string]string{"SQS_QUEUE_URL": testQueueURL + ".fifo"})
+
+	if c := getConfig(); c.err != nil || !c.fifo || !c.key.Enabled() || c.region != "us-west-2" || c.retry.MaxRetries != 5 {
+		t.Errorf("FIFO queues should be detected from their name: %+v", c)
+	}
+
+	lib.SetConfigEnv(map[string]string{"SQS_QUEUE_URL": testQueueURL, "SQS_FIFO": "true", "SQS_DEDUP_KEY": "data.id"})
+
+	if c := getConfig(); c.err != nil || !c.fifo || c.key.String() != "data.id" {
+		t.Errorf("invalid FIFO settings: %+v", c)
+	}
+
+	lib.SetConfigEnv(map[string]string{"SQS_QUEUE_URL": testQueueURL, "SQS_MAX_RETRIES": "-1"})
+
+	if c := getConfig(); c.err == nil {
+		t.Error("a negative number of retries should be rejected")
+	}
+
+	lib.SetConfigEnv(nil)
+
+	if c := getConfig(); c.err == nil {
+		t.Error("the queue URL should be required")
+	}
+}
+
+func makeMessage(group string, message string) lib.Message {
+	return lib.Message{
+		Group:  group,
+		Stream: "B",
+		Event:  ecslogs.Event{Message: message, Time: time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC)},
+	}
+}
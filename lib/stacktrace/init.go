@@ -0,0 +1,7 @@
+package stacktrace
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterStage("stacktrace", lib.NewCheckedStage(lib.StageFunc(NewProcessor), checkConfig))
+}
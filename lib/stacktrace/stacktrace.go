@@ -0,0 +1,219 @@
+// Package stacktrace implements the stacktrace stage, which moves the stack
+// traces found in messages to a data field of their own so destinations can
+// index them separately from the text of the messages.
+package stacktrace
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+// A detector finds the stack traces logged by the programs written in one
+// language. The pattern matches the first line of a trace (or the first frame
+// for java, the trace then starts at the exception above it), and first is
+// the index of the first line that the pattern may match.
+//
+// The message that a trace is extracted from keeps the lines above the trace,
+// when there are none it's set to the last line of the trace, which is where
+// Python reports the exception.
+type detector struct {
+	language string
+	pattern  *regexp.Regexp
+	first    int
+	start    func(i int) int
+}
+
+var languages = []struct {
+	name    string
+	pattern string
+	first   int
+	start   func(i int) int
+}{
+	{
+		// Exception in thread "main" java.lang.IllegalStateException: boom
+		// 	at com.example.Main.run(Main.java:12)
+		name:    "java",
+		pattern: `^\s+at [^\s(]+\(.*\)\s*$`,
+		first:   1,
+		start: func(i int) int {
+			if i == 1 {
+				return 1
+			}
+			return i - 1
+		},
+	},
+	{
+		// Traceback (most recent call last):
+		//   File "main.py", line 3, in <module>
+		// ValueError: boom
+		name:    "python",
+		pattern: `^Traceback \(most recent call last\):\s*$`,
+	},
+	{
+		// panic: boom
+		//
+		// goroutine 1 [running]:
+		// main.main()
+		name:    "go",
+		pattern: `^goroutine \d+ \[[^\]]*\]:\s*$`,
+		first:   1,
+	},
+}
+
+func languageNames() []string {
+	names := make([]string, len(languages))
+	for i, l := range languages {
+		names[i] = l.name
+	}
+	return names
+}
+
+type config struct {
+	detectors []detector
+
+	// The data field that the stack traces are moved to.
+	field string
+}
+
+func getConfig() (c config, err error) {
+	c.field = "stack_trace"
+	enabled := languageNames()
+
+	if s := strings.TrimSpace(lib.Getenv("STACKTRACE_LANGUAGES")); len(s) != 0 {
+		enabled = nil
+
+		for _, name := range strings.Split(s, ",") {
+			if name = strings.ToLower(strings.TrimSpace(name)); !containsString(languageNames(), name) {
+				err = fmt.Errorf("invalid STACKTRACE_LANGUAGES, unknown language %q, must be one of %s", name, strings.Join(languageNames(), ", "))
+				return
+			}
+			enabled = append(enabled, name)
+		}
+	}
+
+	for _, l := range languages {
+		if !containsString(enabled, l.name) {
+			continue
+		}
+
+		d := detector{language: l.name, first: l.first, start: l.start}
+		env := "STACKTRACE_" + strings.ToUpper(l.name) + "_PATTERN"
+		pattern := l.pattern
+
+		if s := strings.TrimSpace(lib.Getenv(env)); len(s) != 0 {
+			pattern = s
+		}
+
+		if d.pattern, err = regexp.Compile(pattern); err != nil {
+			err = fmt.Errorf("invalid %s, %s", env, err)
+			return
+		}
+
+		if d.start == nil {
+			d.start = func(i int) int { return i }
+		}
+
+		c.detectors = append(c.detectors, d)
+	}
+
+	if s := strings.TrimSpace(lib.Getenv("STACKTRACE_FIELD")); len(s) != 0 {
+		c.field = s
+	}
+
+	return
+}
+
+func NewProcessor() (p lib.Processor, err error) {
+	var c config
+
+	if c, err = getConfig(); err == nil {
+		p = newProcessor(c)
+	}
+
+	return
+}
+
+func checkConfig() (err error) {
+	_, err = getConfig()
+	return
+}
+
+type processor struct {
+	config
+}
+
+func newProcessor(c config) *processor {
+	return &processor{config: c}
+}
+
+func (p *processor) Process(msg lib.Message, now time.Time) []lib.Message {
+	if _, exists := msg.Event.Data[p.field]; exists || !strings.ContainsRune(msg.Event.Message, '\n') {
+		return []lib.Message{msg}
+	}
+
+	message, trace, ok := p.extract(msg.Event.Message)
+
+	if !ok {
+		return []lib.Message{msg}
+	}
+
+	data := make(ecslogs.EventData, len(msg.Event.Data)+1)
+
+	for k, v := range msg.Event.Data {
+		data[k] = v
+	}
+
+	data[p.field] = trace
+	msg.Event.Data = data
+	msg.Event.Message = message
+	return []lib.Message{msg}
+}
+
+func (p *processor) Flush(now time.Time) []lib.Message {
+	return nil
+}
+
+// extract splits s into the message and the stack trace it carries, it returns
+// false if none of the detectors found a trace.
+func (p *processor) extract(s string) (message string, trace string, ok bool) {
+	lines := strings.Split(s, "\n")
+
+	for _, d := range p.detectors {
+		for i := d.first; i < len(lines); i++ {
+			if !d.pattern.MatchString(lines[i]) {
+				continue
+			}
+
+			start := d.start(i)
+			message = strings.TrimRight(strings.Join(lines[:start], "\n"), " \t\r\n")
+			trace = strings.TrimRight(strings.Join(lines[start:], "\n"), " \t\r\n")
+
+			if len(message) == 0 {
+				message = lastLine(trace)
+			}
+
+			ok = len(trace) != 0
+			return
+		}
+	}
+
+	return
+}
+
+func lastLine(s string) string {
+	return strings.TrimSpace(s[strings.LastIndexByte(s, '\n')+1:])
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package stacktrace
+
+import (
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+const javaTrace = `Exception in thread "main" java.lang.IllegalStateException: connection closed
+	at com.example.db.Pool.acquire(Pool.java:87)
+	at com.example.Main.main(Main.java:12)
+Caused by: java.io.EOFException
+	at com.example.db.Conn.read(Conn.java:40)
+	... 2 more`
+
+const goPanic = `panic: runtime error: invalid memory address or nil pointer dereference
+[signal SIGSEGV: segmentation violation code=0x1 addr=0x0 pc=0x4871d1]
+
+goroutine 1 [running]:
+main.handle(0x0)
+	/go/src/app/main.go:14 +0x21
+main.main()
+	/go/src/app/main.go:9 +0x2a
+`
+
+const pythonTrace = `Traceback (most recent call last):
+  File "worker.py", line 12, in <module>
+    run()
+  File "worker.py", line 8, in run
+    raise ValueError("bad payload")
+ValueError: bad payload`
+
+func newTestProcessor(t *testing.T, env map[string]string) *processor {
+	defer lib.SetConfigEnv(nil)
+	lib.SetConfigEnv(env)
+
+	c, err := getConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newProcessor(c)
+}
+
+func TestProcessorExtract(t *testing.T) {
+	p := newTestProcessor(t, nil)
+
+	tests := []struct {
+		name    string
+		message string
+		res     string
+		trace   string
+	}{
+		{
+			name:    "java",
+			message: javaTrace,
+			res:     `Exception in thread "main" java.lang.IllegalStateException: connection closed`,
+			trace:   javaTrace[len(`Exception in thread "main" java.lang.IllegalStateException: connection closed`)+1:],
+		},
+		{
+			name:    "java logged with a message",
+			message: "failed to serve request 42\n" + javaTrace,
+			res:     "failed to serve request 42",
+			trace:   javaTrace,
+		},
+		{
+			name:    "go",
+			message: goPanic,
+			res:     "panic: runtime error: invalid memory address or nil pointer dereference\n[signal SIGSEGV: segmentation violation code=0x1 addr=0x0 pc=0x4871d1]",
+			trace:   "goroutine 1 [running]:\nmain.handle(0x0)\n\t/go/src/app/main.go:14 +0x21\nmain.main()\n\t/go/src/app/main.go:9 +0x2a",
+		},
+		{
+			name:    "python",
+			message: pythonTrace,
+			res:     "ValueError: bad payload",
+			trace:   pythonTrace,
+		},
+	}
+
+	for _, test := range tests {
+		msg := makeMessage(test.message)
+		res := p.Process(msg, time.Now())[0]
+
+		if res.Event.Message != test.res {
+			t.Errorf("%s: invalid message:\n- expected: %q\n- found:    %q", test.name, test.res, res.Event.Message)
+		}
+
+		if trace := res.Event.Data["stack_trace"]; trace != test.trace {
+			t.Errorf("%s: invalid stack trace:\n- expected: %q\n- found:    %q", test.name, test.trace, trace)
+		}
+
+		if res.Event.Data["user"] != "luke" {
+			t.Errorf("%s: the other fields should be kept: %#v", test.name, res.Event.Data)
+		}
+
+		if _, ok := msg.Event.Data["stack_trace"]; ok {
+			t.Errorf("%s: the data of the original message should not be modified", test.name)
+		}
+	}
+}
+
+func TestProcessorUntouched(t *testing.T) {
+	p := newTestProcessor(t, nil)
+
+	for _, s := range []string{
+		"GET /health 200",
+		"retrying in 5s\n  at most 3 attempts left",
+		"\tat com.example.Main.main(Main.java:12)",
+	} {
+		msg := makeMessage(s)
+
+		if res := p.Process(msg, time.Now())[0]; res.Event.Message != s || len(res.Event.Data) != 1 {
+			t.Errorf("%q: the message should be left unchanged: %+v", s, res.Event)
+		}
+	}
+
+	// The trace was already extracted by the application.
+	msg := makeMessage(goPanic)
+	msg.Event.Data["stack_trace"] = "..."
+
+	if res := p.Process(msg, time.Now())[0]; res.Event.Message != goPanic {
+		t.Errorf("an existing stack trace should not be replaced: %+v", res.Event)
+	}
+}
+
+func TestProcessorLanguages(t *testing.T) {
+	p := newTestProcessor(t, map[string]string{
+		"STACKTRACE_LANGUAGES":  "go",
+		"STACKTRACE_GO_PATTERN": `^goroutine \d+ \[running\]:$`,
+		"STACKTRACE_FIELD":      "trace",
+	})
+
+	if res := p.Process(makeMessage(javaTrace), time.Now())[0]; res.Event.Message != javaTrace {
+		t.Errorf("the detectors of the languages that aren't enabled should not run: %+v", res.Event)
+	}
+
+	if res := p.Process(makeMessage(goPanic), time.Now())[0]; res.Event.Data["trace"] == nil {
+		t.Errorf("the trace should be extracted to the configured field: %+v", res.Event)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	for _, env := range []map[string]string{
+		{"STACKTRACE_LANGUAGES": "java,ruby"},
+		{"STACKTRACE_PYTHON_PATTERN": "^Traceback ("},
+	} {
+		lib.SetConfigEnv(env)
+
+		if err := checkConfig(); err == nil {
+			t.Errorf("%v: the configuration should be rejected", env)
+		}
+	}
+}
+
+func makeMessage(s string) lib.Message {
+	return lib.Message{
+		Group:  "A",
+		Stream: "B",
+		Event: ecslogs.Event{
+			Level:   ecslogs.ERROR,
+			Time:    time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC),
+			Message: s,
+			Data:    ecslogs.EventData{"user": "luke"},
+		},
+	}
+}
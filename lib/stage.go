@@ -0,0 +1,130 @@
+package lib
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Stage sits between the sources and the destinations, ecs-logs opens a
+// processor for each stage enabled on the command line and passes every message
+// read from the sources through them in order.
+type Stage interface {
+	Open() (Processor, error)
+}
+
+type StageFunc func() (Processor, error)
+
+func (f StageFunc) Open() (Processor, error) {
+	return f()
+}
+
+// Processor is the interface implemented by the values returned by stages.
+//
+// Process is called with each message and returns the messages that continue
+// down the pipeline, which may be none if the message was dropped or held by
+// the processor. Flush is called periodically to collect messages generated
+// by the processor itself. The processors that hold messages call Hold on
+// them, so their sources wait for them to come back out before committing.
+type Processor interface {
+	Process(msg Message, now time.Time) []Message
+
+	Flush(now time.Time) []Message
+}
+
+// ProcessorFunc makes processors out of functions for stages that never hold
+// messages.
+type ProcessorFunc func(msg Message, now time.Time) []Message
+
+func (f ProcessorFunc) Process(msg Message, now time.Time) []Message {
+	return f(msg, now)
+}
+
+func (f ProcessorFunc) Flush(now time.Time) []Message {
+	return nil
+}
+
+// Pipeline chains processors, the messages returned by each processor are
+// passed to the next one.
+type Pipeline []Processor
+
+func (p Pipeline) Process(msg Message, now time.Time) []Message {
+	msgs := []Message{msg}
+
+	for _, proc := range p {
+		msgs = process(proc, msgs, now)
+	}
+
+	return msgs
+}
+
+func (p Pipeline) Flush(now time.Time) (msgs []Message) {
+	// Messages flushed by a processor still have to go through the ones that
+	// come after it.
+	for _, proc := range p {
+		msgs = append(process(proc, msgs, now), released(proc.Flush(now))...)
+	}
+	return
+}
+
+// process passes msgs through proc, the hold of each message on its source
+// moves to the messages that were made of it.
+func process(proc Processor, msgs []Message, now time.Time) (next []Message) {
+	for _, msg := range msgs {
+		out := proc.Process(msg, now)
+		HandOff(msg, out)
+		next = append(next, out...)
+	}
+	return
+}
+
+func RegisterStage(name string, stage Stage) {
+	stgmtx.Lock()
+	stgmap[name] = stage
+	stgmtx.Unlock()
+}
+
+func DeregisterStage(name string) {
+	stgmtx.Lock()
+	delete(stgmap, name)
+	delete(stgord, name)
+	stgmtx.Unlock()
+}
+
+func GetStage(name string) (stage Stage) {
+	stgmtx.RLock()
+	stage = stgmap[name]
+	stgmtx.RUnlock()
+	return
+}
+
+func GetStages(names ...string) (stages []Stage) {
+	stages = make([]Stage, 0, len(names))
+
+	for _, name := range names {
+		if stage := GetStage(name); stage != nil {
+			stages = append(stages, stage)
+		}
+	}
+
+	return
+}
+
+func StagesAvailable() (stages []string) {
+	stgmtx.RLock()
+	stages = make([]string, 0, len(stgmap))
+
+	for name := range stgmap {
+		stages = append(stages, name)
+	}
+
+	stgmtx.RUnlock()
+	sort.Strings(stages)
+	return
+}
+
+var (
+	stgmtx sync.RWMutex
+	stgmap = map[string]Stage{}
+	stgord = map[string]StageOrder{}
+)
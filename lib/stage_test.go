@@ -0,0 +1,60 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+type testProcessor struct {
+	tag     string
+	pending []Message
+}
+
+func (p *testProcessor) Process(msg Message, now time.Time) []Message {
+	msg.Event.Message += p.tag
+	return []Message{msg}
+}
+
+func (p *testProcessor) Flush(now time.Time) (msgs []Message) {
+	msgs, p.pending = p.pending, nil
+	return
+}
+
+func TestPipeline(t *testing.T) {
+	a := &testProcessor{tag: "a"}
+	b := &testProcessor{tag: "b"}
+	drop := ProcessorFunc(func(msg Message, now time.Time) []Message {
+		if msg.Event.Message == "drop" {
+			return nil
+		}
+		return []Message{msg}
+	})
+
+	p := Pipeline{drop, a, b}
+	now := time.Now()
+
+	if msgs := p.Process(Message{Event: ecslogs.Event{Message: "drop"}}, now); len(msgs) != 0 {
+		t.Errorf("dropped messages should not go through the next stages: %v", msgs)
+	}
+
+	if msgs := p.Process(Message{Event: ecslogs.Event{Message: "-"}}, now); len(msgs) != 1 || msgs[0].Event.Message != "-ab" {
+		t.Errorf("invalid messages returned by the pipeline: %v", msgs)
+	}
+
+	// Messages flushed by a stage only go through the stages after it.
+	a.pending = []Message{{Event: ecslogs.Event{Message: "A"}}}
+	b.pending = []Message{{Event: ecslogs.Event{Message: "B"}}}
+
+	var found []string
+
+	for _, msg := range p.Flush(now) {
+		found = append(found, msg.Event.Message)
+	}
+
+	if ref := []string{"Ab", "B"}; !reflect.DeepEqual(found, ref) {
+		t.Errorf("invalid messages flushed by the pipeline:\n- expected: %v\n- found:    %v", ref, found)
+	}
+}
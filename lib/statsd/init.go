@@ -3,5 +3,5 @@ package statsd
 import "github.com/segmentio/ecs-logs/lib"
 
 func init() {
-	lib.RegisterDestination("statsd", lib.DestinationFunc(NewWriter))
+	lib.RegisterDestination("statsd", lib.NewCheckedDestination(lib.DestinationFunc(NewWriter), checkConfig))
 }
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"io"
 	"net/url"
-	"os"
 	"strings"
 
 	"github.com/segmentio/ecs-logs-go"
@@ -29,10 +28,24 @@ type WriterConfig struct {
 
 func NewWriter(group string, stream string) (w lib.Writer, err error) {
 	var c WriterConfig
+
+	if c.Address, err = getAddress(); err != nil {
+		return
+	}
+
+	c.Group = group
+	c.Stream = stream
+
+	return DialWriter(c)
+}
+
+// getAddress returns the address of the statsd server set by STATSD_URL, empty
+// when DialWriter should use localhost:8125.
+func getAddress() (address string, err error) {
 	var s string
 	var u *url.URL
 
-	if s = os.Getenv("STATSD_URL"); len(s) != 0 {
+	if s = lib.Getenv("STATSD_URL"); len(s) != 0 {
 		if u, err = url.Parse(s); err != nil {
 			err = fmt.Errorf("invalid statsd URL: %s", err)
 			return
@@ -43,13 +56,15 @@ func NewWriter(group string, stream string) (w lib.Writer, err error) {
 			return
 		}
 
-		c.Address = u.Host
+		address = u.Host
 	}
 
-	c.Group = group
-	c.Stream = stream
+	return
+}
 
-	return DialWriter(c)
+func checkConfig() (err error) {
+	_, err = getAddress()
+	return
 }
 
 func DialWriter(config WriterConfig) (w lib.Writer, err error) {
@@ -33,6 +33,14 @@ func (store *Store) RemoveExpired(timeout time.Duration, now time.Time) (streams
 	return
 }
 
+// Len returns the number of messages buffered in all the streams of the store.
+func (store *Store) Len() (n int) {
+	for _, group := range store.groups {
+		group.ForEach(func(stream *Stream) { n += stream.Len() })
+	}
+	return
+}
+
 func (store *Store) ForEach(f func(*Group)) {
 	for _, group := range store.groups {
 		f(group)
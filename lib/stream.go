@@ -13,6 +13,9 @@ type Stream struct {
 	createdOn time.Time
 	updatedOn time.Time
 	flushedOn time.Time
+
+	// When the oldest message still buffered in the stream was added.
+	addedOn time.Time
 }
 
 type StreamLimits struct {
@@ -20,8 +23,23 @@ type StreamLimits struct {
 	MaxBytes int
 	MaxTime  time.Duration
 	Force    bool
+
+	// When non-zero, the messages of the stream are flushed once the oldest
+	// one was buffered for this long even if the other limits weren't met.
+	MaxLatency time.Duration
+
+	// When non-zero, the streams of a group are flushed together once per
+	// window by Group.Flush, instead of each one on its own time limit, so
+	// every stream is written with as many messages as it could gather. The
+	// streams still flush on their own when they reach MaxCount or MaxBytes.
+	GroupWindow time.Duration
 }
 
+// MaxLatencyExceeded is the reason returned by Flush when the oldest message of
+// a stream reached the maximum latency, writers should deliver those batches
+// ahead of the others.
+const MaxLatencyExceeded = "max latency exceeded"
+
 func NewStream(group string, name string, now time.Time) *Stream {
 	return &Stream{
 		group:     group,
@@ -45,7 +63,15 @@ func (stream *Stream) Name() string {
 	return stream.name
 }
 
+// Len returns the number of messages buffered in the stream.
+func (stream *Stream) Len() int {
+	return len(stream.messages)
+}
+
 func (stream *Stream) Add(msg Message, now time.Time) {
+	if len(stream.messages) == 0 {
+		stream.addedOn = now
+	}
 	stream.bytes += msg.ContentLength()
 	stream.messages = append(stream.messages, msg)
 	stream.updatedOn = now
@@ -64,6 +90,15 @@ func (stream *Stream) Flush(limits StreamLimits, now time.Time) (list MessageBat
 		return stream.flushDueToCountLimit(limits.MaxCount, now), "max message count exceeded"
 	}
 
+	// The group decides when its streams are flushed on time, see Group.Flush.
+	if limits.GroupWindow > 0 && !limits.Force {
+		return
+	}
+
+	if limits.MaxLatency > 0 && len(stream.messages) != 0 && now.Sub(stream.addedOn) >= limits.MaxLatency {
+		return stream.flush(len(stream.messages), now), MaxLatencyExceeded
+	}
+
 	if now.Sub(stream.flushedOn) >= limits.MaxTime {
 		return stream.flushDueToTimeLimit(now), "time limit exceeded"
 	}
@@ -113,6 +148,12 @@ func (stream *Stream) flush(count int, now time.Time) (msglist MessageBatch) {
 	msglist, stream.messages = splitMessageListHead(stream.messages, count)
 	stream.bytes -= messageListBytes(msglist)
 	stream.flushedOn = now
+
+	// The time when the remaining messages were added isn't tracked, keeping
+	// the one of the oldest message that was flushed is conservative.
+	if len(stream.messages) == 0 {
+		stream.addedOn = time.Time{}
+	}
 	return
 }
 
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib/clock"
 )
 
 func TestSplitMessageListHead(t *testing.T) {
@@ -182,3 +183,62 @@ func TestStreamBytes(t *testing.T) {
 		t.Error("invalid stream bytes count left in stream:", st.bytes)
 	}
 }
+
+func TestStreamMaxLatency(t *testing.T) {
+	const maxLatency = 2 * time.Second
+	const interval = maxLatency / 4
+
+	f := clock.NewFake(time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC))
+	st := NewStream("A", "0123456789", f.Now())
+	msg := Message{Group: "A", Stream: "0123456789", Event: ecslogs.Event{Message: "Hello World!"}}
+
+	// The stream would only be flushed by the time limit after a minute, the
+	// latency limit is expected to flush the quiet stream way before.
+	limits := StreamLimits{
+		MaxCount:   1000,
+		MaxBytes:   1000000,
+		MaxTime:    time.Minute,
+		MaxLatency: maxLatency - interval,
+	}
+
+	// The message arrives right after a tick, which is the worst case since
+	// it only gets checked on the following ones.
+	ticker := f.NewTimer(interval)
+	f.Advance(interval / 3)
+	addedOn := f.Now()
+	st.Add(msg, addedOn)
+
+	for {
+		f.Advance(interval)
+		<-ticker.C()
+		ticker.Reset(interval)
+		now := f.Now()
+
+		if list, reason := st.Flush(limits, now); len(list) != 0 {
+			if reason != MaxLatencyExceeded {
+				t.Errorf("invalid flush reason: %s", reason)
+			}
+
+			if !reflect.DeepEqual(list, MessageBatch{msg}) {
+				t.Error("invalid list of messages flushed from stream:", list)
+			}
+
+			if latency := now.Sub(addedOn); latency > maxLatency {
+				t.Errorf("the message was delivered after %s, which exceeds the %s latency bound", latency, maxLatency)
+			}
+			break
+		}
+
+		if now.Sub(addedOn) > maxLatency {
+			t.Fatalf("the message wasn't flushed within %s", maxLatency)
+		}
+	}
+
+	// The age of the stream must start over with the next message.
+	f.Advance(time.Second)
+	st.Add(msg, f.Now())
+
+	if list, _ := st.Flush(limits, f.Now()); len(list) != 0 {
+		t.Error("a message that was just added should not be flushed:", list)
+	}
+}
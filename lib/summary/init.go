@@ -0,0 +1,7 @@
+package summary
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterStage("summary", lib.NewCheckedStage(lib.StageFunc(NewProcessor), checkConfig))
+}
@@ -0,0 +1,215 @@
+package summary
+
+import (
+	"container/list"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/fingerprint"
+)
+
+type config struct {
+	// The patterns used to turn messages into fingerprints, the default ones
+	// replace UUIDs, hexadecimal strings and numbers.
+	patterns []fingerprint.Pattern
+
+	// The length of the window over which occurrences of a fingerprint are
+	// counted.
+	interval time.Duration
+
+	// How many messages with the same fingerprint are forwarded in each
+	// interval before they get rolled up into a summary.
+	rate int
+
+	// The maximum number of fingerprints tracked, the least recently seen
+	// ones are evicted first.
+	maxFingerprints int
+
+	// Only messages at this level or more severe are summarized.
+	level ecslogs.Level
+}
+
+func getConfig() (c config, err error) {
+	c = config{
+		patterns:        fingerprint.DefaultPatterns,
+		interval:        1 * time.Minute,
+		rate:            10,
+		maxFingerprints: 1000,
+		level:           ecslogs.ERROR,
+	}
+	var s string
+
+	if s = lib.Getenv("SUMMARY_PATTERNS"); len(strings.TrimSpace(s)) != 0 {
+		if c.patterns, err = fingerprint.ParsePatterns(s); err != nil {
+			err = fmt.Errorf("invalid SUMMARY_PATTERNS: %s", err)
+			return
+		}
+	}
+
+	if s = lib.Getenv("SUMMARY_INTERVAL"); len(s) != 0 {
+		if c.interval, err = time.ParseDuration(s); err != nil || c.interval <= 0 {
+			err = fmt.Errorf("invalid SUMMARY_INTERVAL, must be a positive duration: %s", s)
+			return
+		}
+	}
+
+	if s = lib.Getenv("SUMMARY_RATE"); len(s) != 0 {
+		if c.rate, err = strconv.Atoi(s); err != nil || c.rate < 0 {
+			err = fmt.Errorf("invalid SUMMARY_RATE, must be a positive integer: %s", s)
+			return
+		}
+	}
+
+	if s = lib.Getenv("SUMMARY_MAX_FINGERPRINTS"); len(s) != 0 {
+		if c.maxFingerprints, err = strconv.Atoi(s); err != nil || c.maxFingerprints <= 0 {
+			err = fmt.Errorf("invalid SUMMARY_MAX_FINGERPRINTS, must be a positive integer: %s", s)
+			return
+		}
+	}
+
+	if s = lib.Getenv("SUMMARY_LEVEL"); len(s) != 0 {
+		if c.level, err = ecslogs.ParseLevel(strings.ToUpper(strings.TrimSpace(s))); err != nil {
+			err = fmt.Errorf("invalid SUMMARY_LEVEL: %s", err)
+			return
+		}
+	}
+
+	return
+}
+
+func NewProcessor() (p lib.Processor, err error) {
+	var c config
+
+	if c, err = getConfig(); err == nil {
+		p = newSummarizer(c)
+	}
+
+	return
+}
+
+func checkConfig() (err error) {
+	_, err = getConfig()
+	return
+}
+
+// summarizer is a processor that rolls up messages sharing the same
+// fingerprint. In each interval the first messages (up to the rate) of a fingerprint are
+// forwarded, the following ones are counted and a single summary message is
+// emitted for them when the interval ends.
+type summarizer struct {
+	config  config
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type entry struct {
+	key      string
+	template string
+	start    time.Time
+	count    int
+	sample   lib.Message
+}
+
+func newSummarizer(c config) *summarizer {
+	if c.maxFingerprints <= 0 {
+		c.maxFingerprints = 1
+	}
+	return &summarizer{
+		config:  c,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (s *summarizer) Process(msg lib.Message, now time.Time) (msgs []lib.Message) {
+	if lvl := msg.Event.Level; lvl == ecslogs.NONE || lvl > s.config.level {
+		return []lib.Message{msg}
+	}
+
+	template := fingerprint.Apply(s.config.patterns, msg.Event.Message)
+	key := msg.Group + "\x00" + msg.Stream + "\x00" + template
+	elem := s.entries[key]
+
+	if elem != nil {
+		s.lru.MoveToFront(elem)
+	} else {
+		for s.lru.Len() >= s.config.maxFingerprints {
+			msgs = s.remove(s.lru.Back(), msgs, now)
+		}
+		elem = s.lru.PushFront(&entry{
+			key:      key,
+			template: template,
+			start:    now,
+		})
+		s.entries[key] = elem
+	}
+
+	e := elem.Value.(*entry)
+
+	if now.Sub(e.start) >= s.config.interval {
+		msgs = s.summarize(e, msgs, now)
+		e.start, e.count = now, 0
+	}
+
+	if e.count++; e.count <= s.config.rate {
+		msgs = append(msgs, msg)
+	} else if e.count == (s.config.rate + 1) {
+		lib.Hold(&msg)
+		e.sample = msg
+	}
+
+	return
+}
+
+func (s *summarizer) Flush(now time.Time) (msgs []lib.Message) {
+	for elem := s.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+
+		if now.Sub(elem.Value.(*entry).start) >= s.config.interval {
+			msgs = s.remove(elem, msgs, now)
+		}
+
+		elem = prev
+	}
+	return
+}
+
+func (s *summarizer) remove(elem *list.Element, msgs []lib.Message, now time.Time) []lib.Message {
+	e := s.lru.Remove(elem).(*entry)
+	delete(s.entries, e.key)
+	return s.summarize(e, msgs, now)
+}
+
+// summarize appends the summary of the messages of e that were suppressed to
+// msgs. The summary is made of the sample so it carries its hold, which keeps
+// the source of the suppressed messages from committing past them until the
+// summary is delivered.
+func (s *summarizer) summarize(e *entry, msgs []lib.Message, now time.Time) []lib.Message {
+	if e.count <= s.config.rate {
+		return msgs
+	}
+
+	msg := e.sample
+	msg.Received = time.Time{}
+	msg.Event = ecslogs.Event{
+		Level: e.sample.Event.Level,
+		Time:  now,
+		Info: ecslogs.EventInfo{
+			Host:   e.sample.Event.Info.Host,
+			Source: e.sample.Event.Info.Source,
+		},
+		Data: ecslogs.EventData{
+			"fingerprint": e.template,
+			"count":       e.count,
+			"suppressed":  e.count - s.config.rate,
+			"since":       e.start,
+		},
+		Message: fmt.Sprintf("%q occurred %d times, e.g. %s", e.template, e.count, e.sample.Event.Message),
+	}
+
+	return append(msgs, msg)
+}
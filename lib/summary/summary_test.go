@@ -0,0 +1,163 @@
+package summary
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/fingerprint"
+)
+
+func TestSummarizerRollup(t *testing.T) {
+	now := time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC)
+	s := newSummarizer(config{
+		patterns:        fingerprint.DefaultPatterns,
+		interval:        1 * time.Minute,
+		rate:            2,
+		maxFingerprints: 10,
+		level:           ecslogs.ERROR,
+	})
+
+	var forwarded []lib.Message
+
+	for i := 0; i != 5; i++ {
+		forwarded = append(forwarded, s.Process(makeMessage(ecslogs.ERROR, "request %d failed", i), now)...)
+	}
+
+	// Messages below the configured level are never summarized.
+	for i := 0; i != 5; i++ {
+		forwarded = append(forwarded, s.Process(makeMessage(ecslogs.INFO, "request %d done", i), now)...)
+	}
+
+	if len(forwarded) != 7 {
+		t.Errorf("invalid number of messages forwarded: %d", len(forwarded))
+	}
+
+	if msgs := s.Flush(now.Add(30 * time.Second)); len(msgs) != 0 {
+		t.Errorf("no summaries should be emitted before the end of the interval: %v", msgs)
+	}
+
+	msgs := s.Flush(now.Add(1 * time.Minute))
+
+	if len(msgs) != 1 {
+		t.Fatalf("invalid number of summaries: %d", len(msgs))
+	}
+
+	msg := msgs[0]
+
+	if ref := `"request <num> failed" occurred 5 times, e.g. request 2 failed`; msg.Event.Message != ref {
+		t.Errorf("invalid summary message:\n- expected: %#v\n- found:    %#v", ref, msg.Event.Message)
+	}
+
+	if msg.Group != "A" || msg.Stream != "B" {
+		t.Errorf("invalid summary group and stream: %s/%s", msg.Group, msg.Stream)
+	}
+
+	if msg.Event.Level != ecslogs.ERROR {
+		t.Errorf("invalid summary level: %s", msg.Event.Level)
+	}
+
+	if n := msg.Event.Data["suppressed"]; n != 3 {
+		t.Errorf("invalid number of suppressed messages: %v", n)
+	}
+
+	if n := s.lru.Len(); n != 0 {
+		t.Errorf("fingerprints should be removed at the end of the interval: %d", n)
+	}
+}
+
+func TestSummarizerNextInterval(t *testing.T) {
+	now := time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC)
+	s := newSummarizer(config{
+		patterns:        fingerprint.DefaultPatterns,
+		interval:        1 * time.Minute,
+		rate:            1,
+		maxFingerprints: 10,
+		level:           ecslogs.ERROR,
+	})
+
+	s.Process(makeMessage(ecslogs.ERROR, "request %d failed", 1), now)
+	s.Process(makeMessage(ecslogs.ERROR, "request %d failed", 2), now)
+
+	// A message arriving after the interval ended rolls up the previous one
+	// and starts a new interval.
+	msgs := s.Process(makeMessage(ecslogs.ERROR, "request %d failed", 3), now.Add(2*time.Minute))
+
+	if len(msgs) != 2 {
+		t.Fatalf("invalid number of messages: %d", len(msgs))
+	}
+
+	if n := msgs[0].Event.Data["count"]; n != 2 {
+		t.Errorf("invalid summary count: %v", n)
+	}
+
+	if s := msgs[1].Event.Message; s != "request 3 failed" {
+		t.Errorf("the first message of the new interval should be forwarded: %s", s)
+	}
+}
+
+func TestSummarizerEviction(t *testing.T) {
+	now := time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC)
+	s := newSummarizer(config{
+		patterns:        fingerprint.DefaultPatterns,
+		interval:        1 * time.Minute,
+		rate:            0,
+		maxFingerprints: 2,
+		level:           ecslogs.ERROR,
+	})
+
+	s.Process(makeMessage(ecslogs.ERROR, "A %d", 1), now)
+	s.Process(makeMessage(ecslogs.ERROR, "B %d", 1), now)
+	s.Process(makeMessage(ecslogs.ERROR, "A %d", 2), now)
+
+	// B is the least recently seen fingerprint, it gets evicted and its
+	// summary is emitted right away so no occurrences are lost.
+	msgs := s.Process(makeMessage(ecslogs.ERROR, "C %d", 1), now)
+
+	if len(msgs) != 1 {
+		t.Fatalf("invalid number of messages after eviction: %d", len(msgs))
+	}
+
+	if ref := `"B <num>" occurred 1 times, e.g. B 1`; msgs[0].Event.Message != ref {
+		t.Errorf("invalid summary of the evicted fingerprint:\n- expected: %#v\n- found:    %#v", ref, msgs[0].Event.Message)
+	}
+
+	if n := s.lru.Len(); n != 2 {
+		t.Errorf("invalid number of fingerprints: %d", n)
+	}
+
+	for _, key := range []string{"A <num>", "C <num>"} {
+		if s.entries["A\x00B\x00"+key] == nil {
+			t.Errorf("missing fingerprint: %s", key)
+		}
+	}
+}
+
+func makeMessage(level ecslogs.Level, format string, args ...interface{}) lib.Message {
+	return lib.Message{
+		Group:  "A",
+		Stream: "B",
+		Event: ecslogs.Event{
+			Level:   level,
+			Message: fmt.Sprintf(format, args...),
+		},
+	}
+}
+
+func TestGetConfigLevel(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(map[string]string{"SUMMARY_LEVEL": " warn "})
+
+	if c, err := getConfig(); err != nil || c.level != ecslogs.WARN {
+		t.Errorf("the level should be case insensitive: %s (%v)", c.level, err)
+	}
+
+	lib.SetConfigEnv(map[string]string{"SUMMARY_LEVEL": "loud"})
+
+	if _, err := getConfig(); err == nil {
+		t.Error("an unknown level should be reported")
+	}
+}
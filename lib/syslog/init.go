@@ -3,5 +3,6 @@ package syslog
 import "github.com/segmentio/ecs-logs/lib"
 
 func init() {
-	lib.RegisterDestination("syslog", lib.DestinationFunc(NewWriter))
+	lib.RegisterDestination("syslog", lib.NewCheckedDestination(lib.DestinationFunc(NewWriter), checkConfig))
+	lib.RegisterSource("syslog", lib.SourceFunc(NewReader))
 }
@@ -0,0 +1,288 @@
+package syslog
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// record is a syslog message parsed from the RFC5424 or RFC3164 format, the
+// fields that a message doesn't have are left empty.
+type record struct {
+	facility int
+	severity int
+	time     time.Time
+	hostname string
+	appName  string
+	procID   string
+	msgID    string
+	data     map[string]map[string]string
+	message  string
+}
+
+// The priority of the messages that don't have one, user.notice like the
+// RFC3164 says.
+const defaultPriority = 13
+
+var facilityNames = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+func facilityName(facility int) string {
+	if facility >= 0 && facility < len(facilityNames) {
+		return facilityNames[facility]
+	}
+	return strconv.Itoa(facility)
+}
+
+// parse decodes a syslog message, now is used to complete the timestamps of
+// RFC3164 which don't have a year or a time zone.
+func parse(b []byte, now time.Time) (rec record, err error) {
+	b = bytes.TrimRight(b, "\r\n\x00")
+
+	pri := defaultPriority
+
+	if len(b) != 0 && b[0] == '<' {
+		if pri, b, err = parsePriority(b); err != nil {
+			return
+		}
+	}
+
+	rec.facility, rec.severity = pri/8, pri%8
+
+	if len(b) >= 2 && b[0] == '1' && b[1] == ' ' {
+		err = parse5424(&rec, b[2:])
+	} else {
+		parse3164(&rec, b, now)
+	}
+
+	return
+}
+
+func parsePriority(b []byte) (pri int, rest []byte, err error) {
+	end := bytes.IndexByte(b, '>')
+
+	// The PRI is 1 to 3 digits, up to 191.
+	if end < 2 || end > 4 {
+		err = fmt.Errorf("invalid syslog priority, must be 1 to 3 digits between '<' and '>'")
+		return
+	}
+
+	if pri, err = strconv.Atoi(string(b[1:end])); err != nil || pri < 0 || pri > 191 {
+		err = fmt.Errorf("invalid syslog priority, must be a number between 0 and 191: %s", b[1:end])
+		return
+	}
+
+	rest = b[end+1:]
+	return
+}
+
+// parse5424 decodes the part of an RFC5424 message following the version:
+// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func parse5424(rec *record, b []byte) (err error) {
+	var fields [5]string
+
+	for i := range fields {
+		if fields[i], b = token(b); len(fields[i]) == 0 {
+			return fmt.Errorf("invalid RFC5424 syslog message, the header is truncated")
+		}
+
+		if fields[i] == "-" {
+			fields[i] = ""
+		}
+	}
+
+	if len(fields[0]) != 0 {
+		if rec.time, err = time.Parse(time.RFC3339Nano, fields[0]); err != nil {
+			return fmt.Errorf("invalid RFC5424 syslog timestamp: %s", fields[0])
+		}
+	}
+
+	rec.hostname, rec.appName, rec.procID, rec.msgID = fields[1], fields[2], fields[3], fields[4]
+
+	if len(b) == 0 {
+		return
+	}
+
+	if b[0] == '-' {
+		b = b[1:]
+	} else if rec.data, b, err = parseStructuredData(b); err != nil {
+		return
+	}
+
+	// The message is separated from the structured data by a space, and
+	// starts with a BOM when it's UTF-8.
+	if len(b) != 0 && b[0] == ' ' {
+		b = b[1:]
+	}
+
+	rec.message = string(bytes.TrimPrefix(b, []byte("\xef\xbb\xbf")))
+	return
+}
+
+// parseStructuredData decodes the [ID NAME="VALUE" ...] elements at the start
+// of b, the values are unescaped.
+func parseStructuredData(b []byte) (data map[string]map[string]string, rest []byte, err error) {
+	data = make(map[string]map[string]string)
+	truncated := fmt.Errorf("invalid RFC5424 syslog structured data, an element is truncated")
+
+	for len(b) != 0 && b[0] == '[' {
+		b = b[1:]
+
+		i := bytes.IndexAny(b, " ]")
+		if i <= 0 {
+			return nil, nil, truncated
+		}
+
+		params := data[string(b[:i])]
+		if params == nil {
+			params = make(map[string]string)
+			data[string(b[:i])] = params
+		}
+
+		for b = b[i:]; ; {
+			if len(b) == 0 {
+				return nil, nil, truncated
+			}
+
+			if b[0] == ']' {
+				b = b[1:]
+				break
+			}
+
+			b = bytes.TrimLeft(b, " ")
+
+			if i = bytes.Index(b, []byte(`="`)); i <= 0 {
+				return nil, nil, truncated
+			}
+
+			name := string(b[:i])
+			value, n := unescape(b[i+2:])
+
+			if n < 0 {
+				return nil, nil, truncated
+			}
+
+			params[name] = value
+			b = b[i+2+n:]
+		}
+	}
+
+	rest = b
+	return
+}
+
+// unescape reads a parameter value up to its closing quote, it returns the
+// value and the number of bytes consumed, or -1 if the quote is missing.
+func unescape(b []byte) (string, int) {
+	var s []byte
+
+	for i := 0; i < len(b); i++ {
+		switch c := b[i]; c {
+		case '"':
+			return string(s), i + 1
+		case '\\':
+			// Only ", \ and ] are escaped, the backslashes before other
+			// characters are kept.
+			if i+1 < len(b) && (b[i+1] == '"' || b[i+1] == '\\' || b[i+1] == ']') {
+				i++
+				c = b[i]
+			}
+			s = append(s, c)
+		default:
+			s = append(s, c)
+		}
+	}
+
+	return "", -1
+}
+
+// parse3164 decodes the BSD syslog format, which is more a convention than a
+// format: TIMESTAMP HOSTNAME TAG[PID]: MSG where any part may be missing. The
+// parts that can't be recognized are left in the message.
+func parse3164(rec *record, b []byte, now time.Time) {
+	if t, n := parse3164Time(b, now); n != 0 {
+		rec.time, b = t, bytes.TrimLeft(b[n:], " ")
+
+		// The messages sent to a local socket don't have a hostname, they
+		// start with the tag right after the timestamp.
+		if host, rest := token(b); len(host) != 0 && !isTag(host) && len(rest) != 0 {
+			rec.hostname, b = host, rest
+		}
+	}
+
+	if tag, rest := token(b); isTag(tag) {
+		tag = strings.TrimSuffix(tag, ":")
+
+		if i := strings.IndexByte(tag, '['); i >= 0 {
+			rec.procID = strings.TrimSuffix(tag[i+1:], "]")
+			tag = tag[:i]
+		}
+
+		rec.appName, b = tag, rest
+	}
+
+	rec.message = string(b)
+}
+
+// parse3164Time parses the timestamp at the start of b, either Mmm dd
+// hh:mm:ss in the local time of now or the RFC3339 timestamps that some
+// daemons use. The number of bytes of the timestamp is zero if b doesn't
+// start with one.
+func parse3164Time(b []byte, now time.Time) (t time.Time, n int) {
+	const layout = time.Stamp
+
+	if len(b) >= len(layout) {
+		if s := string(b[:len(layout)]); s[3] == ' ' {
+			var err error
+
+			if t, err = time.ParseInLocation(layout, s, now.Location()); err == nil {
+				t = time.Date(now.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, now.Location())
+
+				// The messages of December received in January are from the
+				// previous year.
+				if t.Sub(now) > 24*time.Hour {
+					t = t.AddDate(-1, 0, 0)
+				}
+
+				return t, len(layout)
+			}
+		}
+	}
+
+	if s, _ := token(b); len(s) != 0 {
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return t, len(s)
+		}
+	}
+
+	return time.Time{}, 0
+}
+
+// isTag returns true if s looks like the TAG of an RFC3164 message, a program
+// name followed by a colon or a PID in brackets.
+func isTag(s string) bool {
+	colon := strings.HasSuffix(s, ":")
+	s = strings.TrimSuffix(s, ":")
+
+	if i := strings.IndexByte(s, '['); i >= 0 && strings.HasSuffix(s, "]") {
+		s = s[:i]
+	} else if !colon || i >= 0 {
+		return false
+	}
+
+	return len(s) != 0 && len(s) <= 48 && utf8.ValidString(s)
+}
+
+// token returns the bytes of b up to the next space, and what follows it.
+func token(b []byte) (string, []byte) {
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		return string(b[:i]), b[i+1:]
+	}
+	return string(b), nil
+}
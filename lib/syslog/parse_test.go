@@ -0,0 +1,108 @@
+package syslog
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, test := range []struct {
+		in  string
+		out record
+	}{
+		{
+			in: `<165>1 2024-01-02T03:04:05.123Z web-1.local nginx 1234 ACCESS [exampleSDID@32473 iut="3" path="/a\"b\]"][meta seq="1"] ` + "\xef\xbb\xbf" + `GET / 200`,
+			out: record{
+				facility: 20,
+				severity: 5,
+				time:     time.Date(2024, 1, 2, 3, 4, 5, 123000000, time.UTC),
+				hostname: "web-1.local",
+				appName:  "nginx",
+				procID:   "1234",
+				msgID:    "ACCESS",
+				data: map[string]map[string]string{
+					"exampleSDID@32473": {"iut": "3", "path": `/a"b]`},
+					"meta":              {"seq": "1"},
+				},
+				message: "GET / 200",
+			},
+		},
+		{
+			in:  "<14>1 - - - - - -\n",
+			out: record{facility: 1, severity: 6},
+		},
+		{
+			in: `<34>Oct 11 22:14:15 mymachine su[42]: 'su root' failed for lonvick`,
+			out: record{
+				facility: 4,
+				severity: 2,
+				time:     time.Date(2023, 10, 11, 22, 14, 15, 0, time.UTC),
+				hostname: "mymachine",
+				appName:  "su",
+				procID:   "42",
+				message:  "'su root' failed for lonvick",
+			},
+		},
+		{
+			// Sent to a local socket, without a hostname.
+			in: `<30>Jan  2 03:00:00 systemd: Started Session 1.`,
+			out: record{
+				facility: 3,
+				severity: 6,
+				time:     time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC),
+				appName:  "systemd",
+				message:  "Started Session 1.",
+			},
+		},
+		{
+			in: `<190>2024-01-02T03:04:05+01:00 lb haproxy[7]: 10.0.0.1 GET /`,
+			out: record{
+				facility: 23,
+				severity: 6,
+				time:     time.Date(2024, 1, 2, 2, 4, 5, 0, time.UTC),
+				hostname: "lb",
+				appName:  "haproxy",
+				procID:   "7",
+				message:  "10.0.0.1 GET /",
+			},
+		},
+		{
+			in:  `just a line`,
+			out: record{facility: 1, severity: 5, message: "just a line"},
+		},
+	} {
+		rec, err := parse([]byte(test.in), now)
+
+		if err != nil {
+			t.Errorf("%q: %s", test.in, err)
+			continue
+		}
+
+		if !rec.time.Equal(test.out.time) {
+			t.Errorf("%q: invalid time: %s != %s", test.in, rec.time, test.out.time)
+		}
+
+		rec.time, test.out.time = time.Time{}, time.Time{}
+
+		if !reflect.DeepEqual(rec, test.out) {
+			t.Errorf("%q:\n%+v\n%+v", test.in, rec, test.out)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, in := range []string{
+		`<200>1 - - - - - -`,
+		`<x>hello`,
+		`<13>1 2024-01-02`,
+		`<13>1 yesterday host app - - - hello`,
+		`<13>1 - host app - - [id a="b`,
+	} {
+		if _, err := parse([]byte(in), time.Now()); err == nil {
+			t.Errorf("%q: the message should be invalid", in)
+		}
+	}
+}
@@ -17,6 +17,12 @@ type LimitedConnPool struct {
 	live   chan struct{} // Keep a count of living connections (in our hands, or the client)
 	signal chan struct{} // Used to wake up the connection producer
 	err    chan error    // Send dial errors back to the client
+	done   chan struct{} // Closed to interrupt the connection producer
+	exited chan struct{} // Closed when the connection producer returns
+
+	// Connections that stayed in the pool for longer than this are closed
+	// instead of being handed out, zero keeps them forever.
+	idleTimeout time.Duration
 }
 
 // conn wraps an io.WriteCloser, marking the connection as dead
@@ -27,6 +33,7 @@ type conn struct {
 	conn io.WriteCloser
 	pool *LimitedConnPool
 	dead bool
+	idle time.Time // when the connection was returned to the pool
 }
 
 func (w *conn) Write(p []byte) (int, error) {
@@ -45,15 +52,24 @@ type bufferedWriter interface {
 	Flush() error
 }
 
-func (w *conn) Flush() error {
+func (w *conn) Flush() (err error) {
 	if t, ok := w.conn.(bufferedWriter); ok {
-		return t.Flush()
+		if err = t.Flush(); err != nil {
+			w.dead = true
+		}
 	}
-	return nil
+	return
 }
 
 // NewLimited returns a new LimitedConnPool with the given size limit and dial function.
 func NewLimited(size int, dial func() (io.WriteCloser, error)) (*LimitedConnPool, error) {
+	return NewLimitedIdle(size, 0, dial)
+}
+
+// NewLimitedIdle is like NewLimited but connections that stayed unused in the
+// pool for longer than idleTimeout are closed and dialed again, which avoids
+// writing to connections that the other end already dropped.
+func NewLimitedIdle(size int, idleTimeout time.Duration, dial func() (io.WriteCloser, error)) (*LimitedConnPool, error) {
 	// Tentative first try - if this doesn't work, we assume it never will
 	// and fail to initialize. This is admittedly not great, but we rely on
 	// unreachable addresses failing immediately in our syslog package, which,
@@ -72,16 +88,23 @@ func NewLimited(size int, dial func() (io.WriteCloser, error)) (*LimitedConnPool
 		// try to make this large enough to avoid dropping
 		// errors if clients only check errors occasionally
 		err: make(chan error, size),
+
+		done:        make(chan struct{}),
+		exited:      make(chan struct{}),
+		idleTimeout: idleTimeout,
 	}
 
 	p.conns <- &conn{
 		conn: w,
 		pool: &p,
+		idle: time.Now(),
 	}
 	p.live <- struct{}{}
 
 	// keep p.conns populated
 	go func() {
+		defer close(p.exited)
+
 		// TODO: it would be nice if the client could control
 		// backoff, but doing it here seems sufficient for now.
 		backoff := &backoff.Backoff{
@@ -98,13 +121,18 @@ func NewLimited(size int, dial func() (io.WriteCloser, error)) (*LimitedConnPool
 					default:
 						// error channel is full, drop this error.
 					}
-					time.Sleep(backoff.Duration())
+					select {
+					case <-time.After(backoff.Duration()):
+					case <-p.done:
+						return
+					}
 					continue
 				}
 				backoff.Reset()
 				p.conns <- &conn{
 					conn: w,
 					pool: &p,
+					idle: time.Now(),
 				}
 				p.live <- struct{}{}
 			}
@@ -118,8 +146,12 @@ func NewLimited(size int, dial func() (io.WriteCloser, error)) (*LimitedConnPool
 }
 
 func (p *LimitedConnPool) Close() {
-	// Important to close this first, so the dialer doesn't loop again.
+	// Important to close this first, so the dialer doesn't loop again,
+	// then wait for it to return since it may be retrying to dial and
+	// would send to the channels closed below.
+	close(p.done)
 	close(p.signal)
+	<-p.exited
 
 	// Close all the underlying connections
 	close(p.conns)
@@ -147,6 +179,7 @@ func (p *LimitedConnPool) put(w *conn) error {
 
 		return w.conn.Close()
 	}
+	w.idle = time.Now()
 	p.conns <- w
 	return nil
 }
@@ -157,7 +190,35 @@ func (p *LimitedConnPool) put(w *conn) error {
 // Closing the returned io.WriteCloser automatically returns
 // the connection to the pool.
 func (p *LimitedConnPool) Get() io.WriteCloser {
-	return <-p.conns
+	w, _ := p.get(nil)
+	return w
+}
+
+// GetTimeout is like Get but gives up after waiting for timeout, which may
+// happen when the pool fails to dial new connections.
+func (p *LimitedConnPool) GetTimeout(timeout time.Duration) (io.WriteCloser, bool) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	return p.get(t.C)
+}
+
+func (p *LimitedConnPool) get(timeout <-chan time.Time) (io.WriteCloser, bool) {
+	for {
+		select {
+		case w, ok := <-p.conns:
+			if !ok {
+				return nil, false
+			}
+			if p.idleTimeout > 0 && time.Since(w.idle) > p.idleTimeout {
+				w.dead = true
+				w.Close()
+				continue
+			}
+			return w, true
+		case <-timeout:
+			return nil, false
+		}
+	}
 }
 
 // Errors returns a channel of errors encountered when dialing new
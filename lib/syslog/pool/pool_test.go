@@ -42,11 +42,20 @@ func TestPool(t *testing.T) {
 		}
 	}()
 
-	// report pool stats once per second
+	// report pool stats once per second, until the test completes
+	done := make(chan struct{})
+	defer close(done)
 	go func() {
 		start := time.Now()
-		for range time.Tick(1 * time.Second) {
-			t.Logf("T+%02.2vs: live=%d pool=%d failures=%d\n", time.Since(start).Seconds(), len(p.live), len(p.conns), atomic.LoadUint64(&failures))
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.Logf("T+%02.2vs: live=%d pool=%d failures=%d\n", time.Since(start).Seconds(), len(p.live), len(p.conns), atomic.LoadUint64(&failures))
+			case <-done:
+				return
+			}
 		}
 	}()
 
@@ -89,3 +98,47 @@ func TestPool(t *testing.T) {
 		t.Errorf("dialed %d connections, want %d", newConnections, poolSize)
 	}
 }
+
+type closeCounter struct {
+	closed *int32
+}
+
+func (c closeCounter) Write(b []byte) (int, error) { return len(b), nil }
+func (c closeCounter) Close() error                { atomic.AddInt32(c.closed, 1); return nil }
+
+func TestPoolIdleTimeout(t *testing.T) {
+	var dials int32
+	var closed int32
+
+	p, err := NewLimitedIdle(1, 50*time.Millisecond, func() (io.WriteCloser, error) {
+		atomic.AddInt32(&dials, 1)
+		return closeCounter{closed: &closed}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	p.Get().Close()
+	p.Get().Close()
+
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("connections used recently should be reused, %d were dialed", n)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	w, ok := p.GetTimeout(time.Second)
+	if !ok {
+		t.Fatal("no connection was available")
+	}
+	w.Close()
+
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Errorf("idle connections should be dialed again, %d were dialed", n)
+	}
+
+	if n := atomic.LoadInt32(&closed); n != 1 {
+		t.Errorf("idle connections should be closed, %d were closed", n)
+	}
+}
@@ -0,0 +1,528 @@
+package syslog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// ReaderConfig carries the settings of the syslog source, they're loaded from
+// the SYSLOG_LISTEN_* environment variables so they don't collide with the
+// ones of the syslog destination.
+type ReaderConfig struct {
+	// The addresses the source listens on, an empty address disables the
+	// listener.
+	UDPAddr string
+	TCPAddr string
+	TLSAddr string
+
+	// The configuration of the TLS listener.
+	TLS *tls.Config
+
+	// The templates of the group and stream of the messages, they can
+	// reference the {app}, {hostname} and {facility} of the messages.
+	Group  string
+	Stream string
+
+	// The maximum size in bytes of a message, the longer ones are truncated.
+	MaxMessageSize int
+
+	// The parser of the messages, when nil they're decoded as JSON when
+	// possible.
+	Parser lib.Parser
+}
+
+var readerVariables = regexp.MustCompile(`\{[^{}]*\}`)
+
+func getReaderConfig() (c ReaderConfig, err error) {
+	var s string
+	var t lib.TLSServerConfig
+
+	c = ReaderConfig{
+		UDPAddr:        strings.TrimSpace(lib.Getenv("SYSLOG_LISTEN_UDP")),
+		TCPAddr:        strings.TrimSpace(lib.Getenv("SYSLOG_LISTEN_TCP")),
+		TLSAddr:        strings.TrimSpace(lib.Getenv("SYSLOG_LISTEN_TLS")),
+		Group:          strings.TrimSpace(lib.Getenv("SYSLOG_LISTEN_GROUP")),
+		Stream:         strings.TrimSpace(lib.Getenv("SYSLOG_LISTEN_STREAM")),
+		MaxMessageSize: 64 * 1024,
+	}
+
+	if t, err = lib.ServerTLS("syslog_listen"); err != nil {
+		return
+	}
+
+	if t.Enabled() {
+		if c.TLS, err = t.Load(); err != nil {
+			return
+		}
+
+		if len(c.TLSAddr) == 0 {
+			c.TLSAddr = ":6514"
+		}
+	} else if len(c.TLSAddr) != 0 {
+		err = fmt.Errorf("invalid SYSLOG_LISTEN_TLS, the server certificate must be set with SYSLOG_LISTEN_TLS_CERT and SYSLOG_LISTEN_TLS_KEY")
+		return
+	}
+
+	if len(c.UDPAddr) == 0 && len(c.TCPAddr) == 0 && len(c.TLSAddr) == 0 {
+		c.UDPAddr, c.TCPAddr = ":514", ":514"
+	}
+
+	if len(c.Group) == 0 {
+		c.Group = "{app}"
+	}
+
+	if len(c.Stream) == 0 {
+		c.Stream = "{hostname}"
+	}
+
+	for _, v := range []struct {
+		name     string
+		template string
+	}{
+		{"SYSLOG_LISTEN_GROUP", c.Group},
+		{"SYSLOG_LISTEN_STREAM", c.Stream},
+	} {
+		for _, x := range readerVariables.FindAllString(v.template, -1) {
+			if x != "{app}" && x != "{hostname}" && x != "{facility}" {
+				err = fmt.Errorf("invalid %s, must only reference {app}, {hostname} and {facility}: %s", v.name, v.template)
+				return
+			}
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("SYSLOG_LISTEN_MAX_MESSAGE_SIZE")); len(s) != 0 {
+		if c.MaxMessageSize, err = strconv.Atoi(s); err != nil || c.MaxMessageSize <= 0 {
+			err = fmt.Errorf("invalid SYSLOG_LISTEN_MAX_MESSAGE_SIZE, must be a positive number of bytes: %s", s)
+			return
+		}
+	}
+
+	c.Parser, err = lib.SourceParser("syslog")
+	return
+}
+
+func NewReader() (r lib.Reader, err error) {
+	var c ReaderConfig
+	var f lib.NameFilter
+
+	if c, err = getReaderConfig(); err != nil {
+		return
+	}
+
+	if f, err = lib.SourceFilter("syslog"); err != nil {
+		return
+	}
+
+	rd := newReader(c)
+
+	if err = rd.listen(); err != nil {
+		rd.Close()
+		return
+	}
+
+	r = lib.NewFilteredReader("syslog", rd, f, metrics.Default)
+	return
+}
+
+// reader receives the messages of the UDP, TCP and TLS listeners and hands
+// them to ReadMessage.
+type reader struct {
+	config ReaderConfig
+	msgs   chan lib.Message
+	done   chan struct{}
+	once   sync.Once
+
+	mutex   sync.Mutex
+	closers []io.Closer
+	conns   map[net.Conn]struct{}
+}
+
+func newReader(c ReaderConfig) *reader {
+	return &reader{
+		config: c,
+		msgs:   make(chan lib.Message),
+		done:   make(chan struct{}),
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+// listen binds the listeners of the addresses in the configuration.
+func (r *reader) listen() (err error) {
+	if len(r.config.UDPAddr) != 0 {
+		var pc net.PacketConn
+
+		if pc, err = net.ListenPacket("udp", r.config.UDPAddr); err != nil {
+			return
+		}
+
+		r.closers = append(r.closers, pc)
+		go r.receive(pc)
+	}
+
+	for _, l := range []struct {
+		addr string
+		tls  *tls.Config
+	}{
+		{r.config.TCPAddr, nil},
+		{r.config.TLSAddr, r.config.TLS},
+	} {
+		if len(l.addr) != 0 {
+			var nl net.Listener
+
+			if nl, err = net.Listen("tcp", l.addr); err != nil {
+				return
+			}
+
+			if l.tls != nil {
+				nl = tls.NewListener(nl, l.tls)
+			}
+
+			r.closers = append(r.closers, nl)
+			go r.serve(nl)
+		}
+	}
+
+	return
+}
+
+func (r *reader) Close() (err error) {
+	r.once.Do(func() {
+		close(r.done)
+
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+
+		for _, c := range r.closers {
+			if x := c.Close(); x != nil && err == nil {
+				err = x
+			}
+		}
+
+		for conn := range r.conns {
+			conn.Close()
+		}
+	})
+	return
+}
+
+func (r *reader) ReadMessage() (msg lib.Message, err error) {
+	select {
+	case msg = <-r.msgs:
+	case <-r.done:
+		err = io.EOF
+	}
+	return
+}
+
+func (r *reader) closed() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// receive reads the datagrams of the UDP listener, each carries one message.
+func (r *reader) receive(pc net.PacketConn) {
+	b := make([]byte, r.config.MaxMessageSize)
+
+	for {
+		n, addr, err := pc.ReadFrom(b)
+
+		if err != nil {
+			if !r.closed() {
+				log.WithError(err).Error("the syslog source stopped reading UDP messages")
+			}
+			return
+		}
+
+		if !r.send(b[:n], addr) {
+			return
+		}
+	}
+}
+
+func (r *reader) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+
+		if err != nil {
+			if !r.closed() {
+				log.WithError(err).Error("the syslog source stopped accepting connections")
+			}
+			return
+		}
+
+		if !r.track(conn) {
+			conn.Close()
+			return
+		}
+
+		go r.handle(conn)
+	}
+}
+
+// track registers conn so it's closed with the reader, it returns false if
+// the reader is already closed.
+func (r *reader) track(conn net.Conn) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed() {
+		return false
+	}
+
+	r.conns[conn] = struct{}{}
+	return true
+}
+
+func (r *reader) untrack(conn net.Conn) {
+	r.mutex.Lock()
+	delete(r.conns, conn)
+	r.mutex.Unlock()
+}
+
+// handle reads the frames sent on conn until the client disconnects.
+func (r *reader) handle(conn net.Conn) {
+	defer r.untrack(conn)
+	defer conn.Close()
+
+	f := newFramer(conn, r.config.MaxMessageSize)
+
+	for {
+		b, err := f.next()
+
+		if err != nil {
+			if err != io.EOF && !r.closed() {
+				log.WithFields(log.Fields{"client": conn.RemoteAddr().String(), "error": err}).Warn("closing the syslog connection")
+			}
+			return
+		}
+
+		if !r.send(b, conn.RemoteAddr()) {
+			return
+		}
+	}
+}
+
+// send parses the message in b and hands it to ReadMessage, it returns false
+// if the reader was closed. The messages that fail to parse are logged and
+// dropped.
+func (r *reader) send(b []byte, addr net.Addr) bool {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return true
+	}
+
+	rec, err := parse(b, time.Now())
+
+	if err != nil {
+		log.WithFields(log.Fields{"client": addr.String(), "error": err}).Warn("dropping an invalid syslog message")
+		return true
+	}
+
+	if len(rec.hostname) == 0 {
+		rec.hostname = addr.String()
+
+		if host, _, err := net.SplitHostPort(rec.hostname); err == nil {
+			rec.hostname = host
+		}
+	}
+
+	select {
+	case r.msgs <- r.message(rec):
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+// message converts a syslog record to a message, the syslog fields are kept
+// in the syslog field of the data.
+func (r *reader) message(rec record) (msg lib.Message) {
+	app := rec.appName
+
+	// The messages without a tag are grouped by their facility, like the
+	// files that syslog daemons write them to.
+	if len(app) == 0 {
+		app = facilityName(rec.facility)
+	}
+
+	names := strings.NewReplacer(
+		"{app}", app,
+		"{hostname}", rec.hostname,
+		"{facility}", facilityName(rec.facility),
+	)
+
+	msg.Group = names.Replace(r.config.Group)
+	msg.Stream = names.Replace(r.config.Stream)
+
+	if line := strings.TrimRight(rec.message, "\r\n"); len(line) != 0 {
+		if r.config.Parser != nil {
+			msg.Event = lib.ParseMessage(r.config.Parser, []byte(line)).Event
+		} else {
+			d := json.NewDecoder(strings.NewReader(line))
+			d.UseNumber()
+
+			if d.Decode(&msg.Event) != nil {
+				msg.Event = ecslogs.Event{Message: line}
+			}
+		}
+	}
+
+	if msg.Event.Level == ecslogs.NONE {
+		msg.Event.Level = ecslogs.MakeLevel(rec.severity)
+	}
+
+	if msg.Event.Time.IsZero() {
+		msg.Event.Time = rec.time
+	}
+
+	if len(msg.Event.Info.Host) == 0 {
+		msg.Event.Info.Host = rec.hostname
+	}
+
+	if msg.Event.Info.PID == 0 {
+		msg.Event.Info.PID, _ = strconv.Atoi(rec.procID)
+	}
+
+	if len(msg.Event.Info.ID) == 0 {
+		msg.Event.Info.ID = rec.msgID
+	}
+
+	if msg.Event.Data == nil {
+		msg.Event.Data = ecslogs.EventData{}
+	}
+
+	info := map[string]interface{}{
+		"facility": facilityName(rec.facility),
+		"severity": rec.severity,
+	}
+
+	for k, v := range map[string]string{"app_name": rec.appName, "procid": rec.procID, "msgid": rec.msgID} {
+		if len(v) != 0 {
+			info[k] = v
+		}
+	}
+
+	if len(rec.data) != 0 {
+		info["structured_data"] = rec.data
+	}
+
+	msg.Event.Data["syslog"] = info
+	return
+}
+
+// framer splits the stream of a TCP connection into messages, framed either
+// with octet counting (a length, a space and the message) or with a newline
+// after each message, as RFC6587 describes.
+type framer struct {
+	r   *bufio.Reader
+	max int
+}
+
+func newFramer(r io.Reader, max int) *framer {
+	return &framer{r: bufio.NewReader(r), max: max}
+}
+
+func (f *framer) next() (b []byte, err error) {
+	var c byte
+
+	// The clients may mix both framings on the same connection, the frames
+	// with octet counting start with a digit and the others with '<'.
+	for {
+		if c, err = f.r.ReadByte(); err != nil {
+			return
+		}
+
+		if c != '\n' && c != '\r' {
+			break
+		}
+	}
+
+	if c < '0' || c > '9' {
+		f.r.UnreadByte()
+		return f.line()
+	}
+
+	n := int(c - '0')
+
+	for {
+		if c, err = f.r.ReadByte(); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		if c == ' ' {
+			break
+		}
+
+		if c < '0' || c > '9' {
+			return nil, fmt.Errorf("invalid syslog frame, the octet count must be a number followed by a space")
+		}
+
+		if n = 10*n + int(c-'0'); n > f.max {
+			return nil, fmt.Errorf("syslog frame of more than %d bytes, the maximum is %d", n-1, f.max)
+		}
+	}
+
+	b = make([]byte, n)
+
+	if _, err = io.ReadFull(f.r, b); err != nil {
+		err = unexpectedEOF(err)
+	}
+
+	return
+}
+
+// line reads a message up to the next newline, the part of the messages that
+// exceed the maximum size is discarded.
+func (f *framer) line() (b []byte, err error) {
+	for {
+		var chunk []byte
+
+		chunk, err = f.r.ReadSlice('\n')
+
+		if room := f.max - len(b); room > 0 {
+			if len(chunk) > room {
+				b = append(b, chunk[:room]...)
+			} else {
+				b = append(b, chunk...)
+			}
+		}
+
+		switch err {
+		case bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			// The last message of a connection may not be followed by a
+			// newline.
+			if len(b) != 0 {
+				err = nil
+			}
+		}
+
+		return
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
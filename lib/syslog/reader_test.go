@@ -0,0 +1,210 @@
+package syslog
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+func newTestReader(t *testing.T, c ReaderConfig) *reader {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	if c.MaxMessageSize == 0 {
+		c.MaxMessageSize = 1024
+	}
+
+	if len(c.Group) == 0 {
+		c.Group = "{app}"
+	}
+
+	if len(c.Stream) == 0 {
+		c.Stream = "{hostname}"
+	}
+
+	r := newReader(c)
+
+	if err := r.listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+// addr returns the address of the i-th listener of r.
+func (r *reader) addr(i int) string {
+	switch l := r.closers[i].(type) {
+	case net.PacketConn:
+		return l.LocalAddr().String()
+	case net.Listener:
+		return l.Addr().String()
+	}
+	return ""
+}
+
+func read(t *testing.T, r *reader, n int) (msgs []lib.Message) {
+	for i := 0; i != n; i++ {
+		select {
+		case msg := <-r.msgs:
+			msgs = append(msgs, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for message %d", i)
+		}
+	}
+	return
+}
+
+func TestReaderUDP(t *testing.T) {
+	r := newTestReader(t, ReaderConfig{UDPAddr: "127.0.0.1:0", Group: "syslog-{facility}"})
+	defer r.Close()
+
+	conn, err := net.Dial("udp", r.addr(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte(`<165>1 2024-01-02T03:04:05Z web-1 nginx 1234 ACCESS [req id="42"] {"level":"WARN","message":"slow","data":{"ms":1200}}` + "\n"))
+	conn.Write([]byte(`<11>Jan  2 03:04:05 web-2 cron[7]: job failed`))
+
+	msgs := read(t, r, 2)
+
+	m := msgs[0]
+
+	if m.Group != "syslog-local4" || m.Stream != "web-1" || m.Event.Message != "slow" || m.Event.Level != ecslogs.WARN || m.Event.Info.PID != 1234 || m.Event.Info.Host != "web-1" || m.Event.Data["ms"] == nil {
+		t.Errorf("invalid RFC5424 message: %+v", m)
+	}
+
+	info := m.Event.Data["syslog"].(map[string]interface{})
+
+	if info["facility"] != "local4" || info["severity"] != 5 || info["app_name"] != "nginx" || info["msgid"] != "ACCESS" || info["structured_data"].(map[string]map[string]string)["req"]["id"] != "42" {
+		t.Errorf("invalid syslog data: %+v", info)
+	}
+
+	if m = msgs[1]; m.Stream != "web-2" || m.Event.Message != "job failed" || m.Event.Level != ecslogs.ERROR || m.Event.Info.PID != 7 {
+		t.Errorf("invalid RFC3164 message: %+v", m)
+	}
+}
+
+func TestReaderTCP(t *testing.T) {
+	r := newTestReader(t, ReaderConfig{TCPAddr: "127.0.0.1:0", MaxMessageSize: 64})
+	defer r.Close()
+
+	conn, err := net.Dial("tcp", r.addr(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Octet counted frames can contain newlines, the other ones end with
+	// them and are truncated to the maximum size.
+	frame := "<14>1 - host app - - - multi\nline"
+	conn.Write([]byte(strconv.Itoa(len(frame)) + " " + frame + "<14>app: newline framed\n<14>app: " + strings.Repeat("x", 100) + "\n"))
+
+	msgs := read(t, r, 3)
+
+	if m := msgs[0]; m.Event.Message != "multi\nline" || m.Group != "app" || m.Stream != "host" {
+		t.Errorf("invalid octet counted message: %+v", m)
+	}
+
+	if m := msgs[1]; m.Event.Message != "newline framed" || m.Stream != "127.0.0.1" {
+		t.Errorf("the messages without a hostname should be streamed by client: %+v", m)
+	}
+
+	if m := msgs[2]; len(m.Event.Message) != 64-len("<14>app: ") {
+		t.Errorf("the long message should be truncated: %q", m.Event.Message)
+	}
+
+	// An octet count over the maximum size closes the connection.
+	conn.Write([]byte("1000 <14>app: too big"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("the connection should have been closed")
+	}
+
+	r.Close()
+
+	if _, err := r.ReadMessage(); err == nil {
+		t.Error("the reader should be closed")
+	}
+}
+
+func TestReaderTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "logs.local"},
+		DNSNames:     []string{"logs.local"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestReader(t, ReaderConfig{
+		TLSAddr: "127.0.0.1:0",
+		TLS:     &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}},
+	})
+	defer r.Close()
+
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	conn, err := tls.Dial("tcp", r.addr(0), &tls.Config{RootCAs: pool, ServerName: "logs.local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("<13>1 - host app - - - encrypted\n"))
+
+	if msgs := read(t, r, 1); msgs[0].Event.Message != "encrypted" {
+		t.Errorf("invalid message: %+v", msgs[0])
+	}
+}
+
+func TestReaderConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(nil)
+
+	if c, err := getReaderConfig(); err != nil || c.UDPAddr != ":514" || c.TCPAddr != ":514" || len(c.TLSAddr) != 0 {
+		t.Errorf("invalid default config: %+v (%v)", c, err)
+	}
+
+	for _, test := range []struct {
+		env map[string]string
+		err string
+	}{
+		{map[string]string{"SYSLOG_LISTEN_TLS": ":6514"}, "SYSLOG_LISTEN_TLS_CERT"},
+		{map[string]string{"SYSLOG_LISTEN_GROUP": "{app}-{level}"}, "SYSLOG_LISTEN_GROUP"},
+		{map[string]string{"SYSLOG_LISTEN_MAX_MESSAGE_SIZE": "0"}, "SYSLOG_LISTEN_MAX_MESSAGE_SIZE"},
+	} {
+		lib.SetConfigEnv(test.env)
+
+		if _, err := getReaderConfig(); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: the error should mention %s: %v", test.env, test.err, err)
+		}
+	}
+}
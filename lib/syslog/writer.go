@@ -8,13 +8,13 @@ import (
 	"io"
 	"net"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"text/template"
 	"time"
 
+	"github.com/jpillora/backoff"
 	"github.com/segmentio/ecs-logs/lib"
 	"github.com/segmentio/ecs-logs/lib/syslog/pool"
 
@@ -26,6 +26,9 @@ const DefaultTemplate = "<{{.PRIVAL}}>{{.TIMESTAMP}} {{.GROUP}}[{{.STREAM}}]: {{
 const (
 	poolSize    = 20
 	dialTimeout = 10 * time.Second
+
+	defaultKeepAlive = 30 * time.Second
+	defaultRetries   = 3
 )
 
 var (
@@ -41,22 +44,43 @@ type WriterConfig struct {
 	Tag        string
 	TLS        *tls.Config
 	SocksProxy string
+
+	// The interval of TCP keepalive probes, zero uses the default interval
+	// and a negative value disables them.
+	KeepAlive time.Duration
+
+	// How long connections can stay unused before being closed, zero keeps
+	// them open.
+	IdleTimeout time.Duration
+
+	// How many times a batch is resent on a new connection after a write
+	// failed, zero uses the default and a negative value disables retries.
+	Retries int
+
+	// The envelope that the events are wrapped in before being rendered by
+	// the template, the zero value sends them unwrapped.
+	Envelope lib.Envelope
+
+	// When set the lines that messages were parsed from are sent as is, if
+	// they weren't modified, instead of the JSON representation of the events.
+	RawPassthrough bool
 }
 
 // dialOpts is used to determine whether writers can share
 // the same connection pool.
 type dialOpts struct {
-	network    string
-	address    string
-	tls        *tls.Config
-	socksProxy string
+	network     string
+	address     string
+	tls         *tls.Config
+	socksProxy  string
+	keepAlive   time.Duration
+	idleTimeout time.Duration
 }
 
-// BUG: the generated key does not capture the TLS config,
-// so we are assuming that all otherwise identical dialOpts
-// have the same TLS config.
+// The TLS configs are compared by pointer, destinations must reuse the same
+// value for their connections to be pooled, like lib.TLSClientConfig.Load does.
 func (o *dialOpts) key() string {
-	return fmt.Sprintf("%s:%s:%s", o.network, o.address, o.socksProxy)
+	return fmt.Sprintf("%s:%s:%s:%s:%s:%p", o.network, o.address, o.socksProxy, o.keepAlive, o.idleTimeout, o.tls)
 }
 
 func init() {
@@ -64,22 +88,94 @@ func init() {
 }
 
 func NewWriter(group, stream string) (lib.Writer, error) {
-	var c WriterConfig
+	c, err := getWriterConfig()
+	if err != nil {
+		return nil, err
+	}
+	return DialWriter(c)
+}
 
-	if s := os.Getenv("SYSLOG_URL"); len(s) != 0 {
+// getWriterConfig loads the settings of the syslog destination from the
+// SYSLOG_* environment variables.
+func getWriterConfig() (c WriterConfig, err error) {
+	if s := lib.Getenv("SYSLOG_URL"); len(s) != 0 {
 		u, err := url.Parse(s)
 		if err != nil {
-			return nil, fmt.Errorf("invalid syslog URL: %s", err)
+			return c, fmt.Errorf("invalid syslog URL: %s", err)
+		}
+
+		switch u.Scheme {
+		case "", "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6", "tls", "unix", "unixgram":
+		default:
+			return c, fmt.Errorf("invalid syslog URL, the protocol must be one of udp, tcp, tls, unix or unixgram: %s", s)
 		}
 
 		c.Network = u.Scheme
 		c.Address = u.Host
 	}
 
-	c.Template = os.Getenv("SYSLOG_TEMPLATE")
-	c.TimeFormat = os.Getenv("SYSLOG_TIME_FORMAT")
+	c.Template = lib.Getenv("SYSLOG_TEMPLATE")
+	c.TimeFormat = lib.Getenv("SYSLOG_TIME_FORMAT")
 
-	return DialWriter(c)
+	if len(c.Template) != 0 {
+		if _, err := template.New("syslog").Parse(c.Template); err != nil {
+			return c, fmt.Errorf("invalid SYSLOG_TEMPLATE: %s", err)
+		}
+	}
+
+	if s := strings.TrimSpace(lib.Getenv("SYSLOG_KEEPALIVE")); len(s) != 0 {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return c, fmt.Errorf("invalid SYSLOG_KEEPALIVE, must be a positive duration: %s", s)
+		}
+		if c.KeepAlive = d; d == 0 {
+			c.KeepAlive = -1
+		}
+	}
+
+	if s := strings.TrimSpace(lib.Getenv("SYSLOG_IDLE_TIMEOUT")); len(s) != 0 {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return c, fmt.Errorf("invalid SYSLOG_IDLE_TIMEOUT, must be a positive duration: %s", s)
+		}
+		c.IdleTimeout = d
+	}
+
+	if s := strings.TrimSpace(lib.Getenv("SYSLOG_RETRIES")); len(s) != 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return c, fmt.Errorf("invalid SYSLOG_RETRIES, must be a positive integer: %s", s)
+		}
+		if c.Retries = n; n == 0 {
+			c.Retries = -1
+		}
+	}
+
+	if c.RawPassthrough, err = lib.DestinationRawPassthrough("syslog"); err != nil {
+		return c, err
+	}
+
+	if c.Envelope, err = lib.DestinationEnvelope("syslog"); err != nil {
+		return c, err
+	}
+
+	tlsConfig, err := lib.DestinationTLS("syslog")
+	if err != nil {
+		return c, err
+	}
+
+	if tlsConfig.Enabled() {
+		if c.TLS, err = tlsConfig.Load(); err != nil {
+			return c, err
+		}
+	}
+
+	return
+}
+
+func checkConfig() (err error) {
+	_, err = getWriterConfig()
+	return
 }
 
 func DialWriter(config WriterConfig) (lib.Writer, error) {
@@ -115,10 +211,12 @@ func DialWriter(config WriterConfig) (lib.Writer, error) {
 	for _, n := range netopts {
 		for _, a := range addropts {
 			opts := dialOpts{
-				network:    n,
-				address:    a,
-				tls:        config.TLS,
-				socksProxy: config.SocksProxy,
+				network:     n,
+				address:     a,
+				tls:         config.TLS,
+				socksProxy:  config.SocksProxy,
+				keepAlive:   config.KeepAlive,
+				idleTimeout: config.IdleTimeout,
 			}
 			if w, err = newWriter(opts, config); err == nil {
 				return w, nil
@@ -141,24 +239,33 @@ func (m multiError) Error() string {
 
 type writer struct {
 	// configuration
-	timefmt string
-	tpl     *template.Template
-	tag     string
+	timefmt  string
+	tpl      *template.Template
+	tag      string
+	envelope lib.Envelope
+	raw      bool
 
 	// connection state
 	pool    *pool.LimitedConnPool
 	backend io.WriteCloser
+	retries int
+	backoff backoff.Backoff
 
 	// buffered i/o
 	buf   bytes.Buffer
-	out   func(*writer, message) error
+	out   func(*writer, message) (int, error)
 	flush func() error
 }
 
 func newWriter(opts dialOpts, cfg WriterConfig) (*writer, error) {
-	var out func(*writer, message) error
-	var flush func() error
+	p, err := getPool(opts)
+	if err != nil {
+		return nil, err
+	}
+	return newPoolWriter(p, cfg)
+}
 
+func newPoolWriter(p *pool.LimitedConnPool, cfg WriterConfig) (*writer, error) {
 	if cfg.TimeFormat == "" {
 		cfg.TimeFormat = time.Stamp
 	}
@@ -167,17 +274,8 @@ func newWriter(opts dialOpts, cfg WriterConfig) (*writer, error) {
 		cfg.Template = DefaultTemplate
 	}
 
-	p, err := getPool(opts)
-	if err != nil {
-		return nil, err
-	}
-
-	backend := p.Get()
-	switch b := backend.(type) {
-	case bufferedWriter:
-		out, flush = (*writer).directWrite, b.Flush
-	default:
-		out, flush = (*writer).bufferedWrite, func() error { return nil }
+	if cfg.Retries == 0 {
+		cfg.Retries = defaultRetries
 	}
 
 	// Check for errors reported by the pool when dialing
@@ -196,17 +294,53 @@ loop:
 		return nil, errs
 	}
 
-	return &writer{
-		timefmt: cfg.TimeFormat,
-		tpl:     newWriterTemplate(cfg.Template),
-		tag:     cfg.Tag,
+	w := &writer{
+		timefmt:  cfg.TimeFormat,
+		tpl:      newWriterTemplate(cfg.Template),
+		tag:      cfg.Tag,
+		envelope: cfg.Envelope,
+		raw:      cfg.RawPassthrough,
 
-		backend: backend,
 		pool:    p,
+		retries: cfg.Retries,
+		backoff: backoff.Backoff{
+			Min:    100 * time.Millisecond,
+			Max:    5 * time.Second,
+			Factor: 2,
+			Jitter: true,
+		},
+	}
+
+	w.setBackend(p.Get())
+	return w, nil
+}
+
+func (w *writer) setBackend(backend io.WriteCloser) {
+	w.backend = backend
+
+	switch b := backend.(type) {
+	case bufferedWriter:
+		w.out, w.flush = (*writer).directWrite, b.Flush
+	default:
+		w.out, w.flush = (*writer).bufferedWrite, func() error { return nil }
+	}
+}
 
-		flush: flush,
-		out:   out,
-	}, nil
+// reconnect replaces the connection of the writer after a write failed on it,
+// the failed connection is discarded by the pool which dials a new one.
+func (w *writer) reconnect() error {
+	w.backend.Close()
+	w.backend = nil
+
+	time.Sleep(w.backoff.Duration())
+
+	backend, ok := w.pool.GetTimeout(dialTimeout)
+	if !ok {
+		return fmt.Errorf("no syslog connection could be established after %s", dialTimeout)
+	}
+
+	w.setBackend(backend)
+	return nil
 }
 
 // getPool returns a connection pool for the given configuration.
@@ -219,10 +353,10 @@ func getPool(opts dialOpts) (*pool.LimitedConnPool, error) {
 	if !ok {
 		// dial closes over opts
 		dial := func() (io.WriteCloser, error) {
-			return dialWriter(opts.network, opts.address, opts.tls, opts.socksProxy)
+			return dialWriter(opts.network, opts.address, opts.tls, opts.socksProxy, opts.keepAlive)
 		}
 		var err error
-		p, err = pool.NewLimited(poolSize, dial)
+		p, err = pool.NewLimitedIdle(poolSize, opts.idleTimeout, dial)
 		if err != nil {
 			return nil, err
 		}
@@ -242,23 +376,50 @@ func newWriterTemplate(format string) *template.Template {
 }
 
 func (w *writer) Close() (err error) {
-	return w.backend.Close()
+	if w.backend != nil {
+		err = w.backend.Close()
+	}
+	return
 }
 
 func (w *writer) WriteMessageBatch(batch lib.MessageBatch) error {
-	for _, msg := range batch {
-		if err := w.write(msg); err != nil {
-			return err
+	_, err := w.WriteMessageBatchSize(batch)
+	return err
+}
+
+// WriteMessageBatchSize writes the batch to the connection of the writer, when
+// it fails the whole batch is sent again on a new connection since there's no
+// way to know which messages made it to the other end.
+func (w *writer) WriteMessageBatchSize(batch lib.MessageBatch) (size int, err error) {
+	for attempt := 0; true; attempt++ {
+		if size, err = w.writeBatch(batch); err == nil || attempt >= w.retries {
+			break
+		}
+
+		if e := w.reconnect(); e != nil {
+			err = lib.AppendError(err, e)
+			break
 		}
 	}
-	if err := w.flush(); err != nil {
-		return err
+	return
+}
+
+func (w *writer) writeBatch(batch lib.MessageBatch) (size int, err error) {
+	for _, msg := range batch {
+		var n int
+		n, err = w.write(msg)
+		size += n
+
+		if err != nil {
+			return
+		}
 	}
-	return nil
+	err = w.flush()
+	return
 }
 
 func (w *writer) WriteMessage(msg lib.Message) error {
-	if err := w.write(msg); err != nil {
+	if _, err := w.write(msg); err != nil {
 		return err
 	}
 	if err := w.flush(); err != nil {
@@ -268,7 +429,7 @@ func (w *writer) WriteMessage(msg lib.Message) error {
 	return nil
 }
 
-func (w *writer) write(msg lib.Message) (err error) {
+func (w *writer) write(msg lib.Message) (n int, err error) {
 	m := message{
 		PRIVAL:    int(msg.Event.Level-1) + 8, // +8 is for user-level messages facility
 		HOSTNAME:  msg.Event.Info.Host,
@@ -293,18 +454,43 @@ func (w *writer) write(msg lib.Message) (err error) {
 		m.PROCID = strconv.Itoa(msg.Event.Info.PID)
 	}
 
-	m.MSG = msg.Event.String()
+	m.MSG = w.envelope.Wrap(w.payload(msg))
 	return w.out(w, m)
 }
 
-func (w *writer) directWrite(m message) (err error) {
-	return w.tpl.Execute(w.backend, m)
+// payload returns the content of the syslog message, the raw line of msg when
+// it's passed through or the JSON representation of its event.
+func (w *writer) payload(msg lib.Message) string {
+	if w.raw {
+		if line, ok := msg.RawLine(); ok {
+			return line
+		}
+	}
+	return msg.Event.String()
 }
 
-func (w *writer) bufferedWrite(m message) (err error) {
+func (w *writer) directWrite(m message) (n int, err error) {
+	c := &countWriter{w: w.backend}
+	err = w.tpl.Execute(c, m)
+	n = c.n
+	return
+}
+
+func (w *writer) bufferedWrite(m message) (n int, err error) {
 	w.buf.Reset()
 	w.tpl.Execute(&w.buf, m)
-	_, err = w.backend.Write(w.buf.Bytes())
+	n, err = w.backend.Write(w.buf.Bytes())
+	return
+}
+
+type countWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countWriter) Write(b []byte) (n int, err error) {
+	n, err = c.w.Write(b)
+	c.n += n
 	return
 }
 
@@ -333,13 +519,18 @@ func (c bufferedConn) Close() error                { return c.conn.Close() }
 func (c bufferedConn) Flush() error                { return c.buf.Flush() }
 func (c bufferedConn) Write(b []byte) (int, error) { return c.buf.Write(b) }
 
-func dialWriter(network, address string, config *tls.Config, socksProxy string) (w io.WriteCloser, err error) {
+func dialWriter(network, address string, config *tls.Config, socksProxy string, keepAlive time.Duration) (w io.WriteCloser, err error) {
 	var conn, rawConn net.Conn
 	var dial func(string, string) (net.Conn, error)
 	var socksDialer proxy.Dialer
 
+	if keepAlive == 0 {
+		keepAlive = defaultKeepAlive
+	}
+
 	dialer := net.Dialer{
-		Timeout: dialTimeout,
+		Timeout:   dialTimeout,
+		KeepAlive: keepAlive,
 	}
 	if network == "tls" {
 		network = "tcp"
@@ -1,16 +1,22 @@
 package syslog
 
 import (
+	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	ecslogs "github.com/segmentio/ecs-logs-go"
 	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/syslog/pool"
 )
 
 const testGoroutines = 50
@@ -109,6 +115,135 @@ func TestGetPool(t *testing.T) {
 	}
 }
 
+// fakeConn is a connection which drops after accepting limit bytes, a negative
+// limit never drops.
+type fakeConn struct {
+	mutex  sync.Mutex
+	buf    bytes.Buffer
+	limit  int
+	closed bool
+}
+
+func (c *fakeConn) Write(b []byte) (n int, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.limit >= 0 && (c.buf.Len()+len(b)) > c.limit {
+		n, _ = c.buf.Write(b[:c.limit-c.buf.Len()])
+		return n, errors.New("connection reset by peer")
+	}
+
+	return c.buf.Write(b)
+}
+
+func (c *fakeConn) Close() error {
+	c.mutex.Lock()
+	c.closed = true
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *fakeConn) String() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.buf.String()
+}
+
+// newFakePool returns a pool of a single connection dialing the given
+// connections in order.
+func newFakePool(t *testing.T, conns ...*fakeConn) *pool.LimitedConnPool {
+	var mutex sync.Mutex
+
+	p, err := pool.NewLimited(1, func() (io.WriteCloser, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if len(conns) == 0 {
+			return nil, errors.New("connection refused")
+		}
+
+		c := conns[0]
+		conns = conns[1:]
+		return c, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func makeTestBatch(n int) (batch lib.MessageBatch) {
+	for i := 0; i != n; i++ {
+		batch = append(batch, lib.Message{
+			Group:  "foo",
+			Stream: "bar",
+			Event:  ecslogs.Event{Level: ecslogs.INFO, Message: fmt.Sprintf("message %d", i)},
+		})
+	}
+	return
+}
+
+func TestWriterResendAfterDroppedConnection(t *testing.T) {
+	dropped := &fakeConn{limit: 100}
+	healthy := &fakeConn{limit: -1}
+	p := newFakePool(t, dropped, healthy)
+	defer p.Close()
+
+	w, err := newPoolWriter(p, WriterConfig{Template: "{{.MSG}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	batch := makeTestBatch(10)
+	size, err := w.WriteMessageBatchSize(batch)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []string
+	for _, msg := range batch {
+		expected = append(expected, msg.Event.String())
+	}
+
+	if s := healthy.String(); s != strings.Join(expected, "\n")+"\n" {
+		t.Errorf("the whole batch should be sent once on the new connection:\n%s", s)
+	}
+
+	if size != len(healthy.String()) {
+		t.Errorf("invalid batch size: %d", size)
+	}
+
+	if !dropped.closed {
+		t.Error("the dropped connection should be closed")
+	}
+
+	// The new connection is kept for the next batches.
+	if _, err := w.WriteMessageBatchSize(batch[:1]); err != nil {
+		t.Error(err)
+	}
+
+	if s := healthy.String(); s != strings.Join(append(expected, expected[0]), "\n")+"\n" {
+		t.Errorf("the next batch should be written to the same connection:\n%s", s)
+	}
+}
+
+func TestWriterRetriesExhausted(t *testing.T) {
+	p := newFakePool(t, &fakeConn{limit: 10}, &fakeConn{limit: 10})
+	defer p.Close()
+
+	w, err := newPoolWriter(p, WriterConfig{Retries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if _, err := w.WriteMessageBatchSize(makeTestBatch(3)); err == nil {
+		t.Error("the batch should fail once the retries are exhausted")
+	}
+}
+
 func BenchmarkNewWriter(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		w, err := NewWriter("foo", "bar")
@@ -150,3 +285,49 @@ func BenchmarkWrite(b *testing.B) {
 		b.Fatal(err)
 	}
 }
+
+func TestCheckConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	for env, s := range map[string]string{
+		"SYSLOG_URL":          "http://localhost:514",
+		"SYSLOG_TEMPLATE":     "{{.Message",
+		"SYSLOG_RETRIES":      "-1",
+		"SYSLOG_TLS_INSECURE": "maybe",
+	} {
+		lib.SetConfigEnv(map[string]string{env: s})
+
+		if err := checkConfig(); err == nil || !strings.Contains(err.Error(), env[len("SYSLOG_"):]) {
+			t.Errorf("%s=%s: the error should report the invalid setting: %v", env, s, err)
+		}
+	}
+
+	lib.SetConfigEnv(map[string]string{"SYSLOG_URL": "tcp://localhost:514"})
+
+	if err := checkConfig(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriterRawPassthrough(t *testing.T) {
+	lib.EnableRawLines()
+
+	const line = `{"level":"INFO",  "message":"Hello World!"}`
+	msg := lib.ParseMessage(lib.GetParser("json"), []byte(line))
+
+	w := &writer{raw: true}
+
+	if s := w.payload(msg); s != line {
+		t.Errorf("the raw line should be sent unchanged: %s", s)
+	}
+
+	msg.Event.Message = "Hello ecs-logs!"
+
+	if s := w.payload(msg); s != msg.Event.String() {
+		t.Errorf("the modified message should be serialized: %s", s)
+	}
+
+	if w.raw = false; w.payload(lib.ParseMessage(lib.GetParser("json"), []byte(line))) == line {
+		t.Error("the raw line should only be sent when the passthrough is enabled")
+	}
+}
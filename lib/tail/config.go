@@ -0,0 +1,229 @@
+package tail
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+// config carries the settings of the file source, they are loaded from FILE_*
+// environment variables.
+type config struct {
+	// The glob patterns of the files to tail, like /var/log/containers/*.log.
+	patterns []string
+
+	// Extracts variables for the templates of the names from the paths of the
+	// files, with its named groups.
+	pathPattern *regexp.Regexp
+
+	// The templates of the group and stream of the messages of a file.
+	group  string
+	stream string
+
+	// The file where the offsets of the files are saved, and how often.
+	checkpoint         string
+	checkpointInterval time.Duration
+
+	// With a checkpoint, how long a line may wait for its acknowledgement
+	// before it's read again and how many times, like the settings of
+	// lib.SourceAckTracker.
+	ackTimeout      time.Duration
+	maxRedeliveries int
+
+	// Whether the files found when the source starts without a checkpoint
+	// are read from their end, the files created later are always read from
+	// their beginning.
+	startAtEnd bool
+
+	// How often the patterns are matched again and the files read when they
+	// had nothing new.
+	pollInterval time.Duration
+
+	// The maximum size in bytes of a line, the longer ones are truncated.
+	maxLineSize int
+
+	// The parser of the lines, when nil they're decoded as JSON when
+	// possible.
+	parser lib.Parser
+}
+
+// The variables that the templates of the names can reference, in addition
+// to the named groups of the path pattern.
+var pathVariables = []string{"path", "dir", "base", "name"}
+
+var templateVariable = regexp.MustCompile(`\{([^{}]*)\}`)
+
+func getConfig() (c config, err error) {
+	var s string
+
+	c = config{
+		group:              strings.TrimSpace(lib.Getenv("FILE_GROUP")),
+		stream:             strings.TrimSpace(lib.Getenv("FILE_STREAM")),
+		checkpoint:         strings.TrimSpace(lib.Getenv("FILE_CHECKPOINT")),
+		checkpointInterval: 5 * time.Second,
+		startAtEnd:         true,
+		pollInterval:       time.Second,
+		maxLineSize:        256 * 1024,
+	}
+
+	for _, p := range strings.Split(lib.Getenv("FILE_PATHS"), ",") {
+		if p = strings.TrimSpace(p); len(p) == 0 {
+			continue
+		}
+
+		if _, err = filepath.Match(p, ""); err != nil {
+			err = fmt.Errorf("invalid FILE_PATHS, must be a list of glob patterns: %s", p)
+			return
+		}
+
+		c.patterns = append(c.patterns, p)
+	}
+
+	if len(c.patterns) == 0 {
+		err = fmt.Errorf("missing FILE_PATHS environment variable")
+		return
+	}
+
+	if s = lib.Getenv("FILE_PATH_PATTERN"); len(s) != 0 {
+		if c.pathPattern, err = regexp.Compile(s); err != nil {
+			err = fmt.Errorf("invalid FILE_PATH_PATTERN, must be a regular expression: %s", s)
+			return
+		}
+	}
+
+	if len(c.group) == 0 {
+		c.group = "{dir}"
+	}
+
+	if len(c.stream) == 0 {
+		c.stream = "{name}"
+	}
+
+	variables := pathVariables
+
+	if c.pathPattern != nil {
+		variables = append(variables, c.pathPattern.SubexpNames()...)
+	}
+
+	for _, t := range []struct {
+		name     string
+		template string
+	}{
+		{"FILE_GROUP", c.group},
+		{"FILE_STREAM", c.stream},
+	} {
+		if v := unknownVariable(t.template, variables); len(v) != 0 {
+			err = fmt.Errorf("invalid %s, {%s} isn't a variable of the paths or a group of FILE_PATH_PATTERN: %s", t.name, v, t.template)
+			return
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("FILE_START_AT")); len(s) != 0 {
+		switch strings.ToLower(s) {
+		case "end":
+			c.startAtEnd = true
+		case "beginning":
+			c.startAtEnd = false
+		default:
+			err = fmt.Errorf("invalid FILE_START_AT, must be beginning or end: %s", s)
+			return
+		}
+	}
+
+	for _, d := range []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"FILE_POLL_INTERVAL", &c.pollInterval},
+		{"FILE_CHECKPOINT_INTERVAL", &c.checkpointInterval},
+	} {
+		if s = strings.TrimSpace(lib.Getenv(d.name)); len(s) != 0 {
+			if *d.value, err = time.ParseDuration(s); err != nil || *d.value <= 0 {
+				err = fmt.Errorf("invalid %s, must be a positive duration: %s", d.name, s)
+				return
+			}
+		}
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("FILE_MAX_LINE_SIZE")); len(s) != 0 {
+		if c.maxLineSize, err = strconv.Atoi(s); err != nil || c.maxLineSize <= 0 {
+			err = fmt.Errorf("invalid FILE_MAX_LINE_SIZE, must be a positive number of bytes: %s", s)
+			return
+		}
+	}
+
+	if len(c.checkpoint) != 0 {
+		var acks *lib.AckTracker
+
+		if acks, err = lib.SourceAckTracker("file"); err != nil {
+			return
+		}
+
+		c.ackTimeout, c.maxRedeliveries = acks.Timeout, acks.MaxRedeliveries
+	}
+
+	c.parser, err = lib.SourceParser("file")
+	return
+}
+
+// unknownVariable returns the first variable referenced by template which
+// isn't one of variables, or an empty string.
+func unknownVariable(template string, variables []string) string {
+	for _, m := range templateVariable.FindAllStringSubmatch(template, -1) {
+		known := false
+
+		for _, v := range variables {
+			if len(v) != 0 && v == m[1] {
+				known = true
+				break
+			}
+		}
+
+		if !known {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// names renders the group and stream of the messages of the file at path.
+func (c config) names(path string) (group string, stream string) {
+	base := filepath.Base(path)
+	name := base
+
+	// The extensions are removed so the rotated files, like app.log.1, have
+	// the names of the file they were rotated from.
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		name = name[:i]
+	}
+
+	values := []string{
+		"{path}", path,
+		"{dir}", filepath.Dir(path),
+		"{base}", base,
+		"{name}", name,
+	}
+
+	// The groups of the pattern are empty when the path doesn't match it.
+	if c.pathPattern != nil {
+		m := c.pathPattern.FindStringSubmatch(path)
+
+		for i, n := range c.pathPattern.SubexpNames() {
+			if len(n) != 0 {
+				v := ""
+				if m != nil {
+					v = m[i]
+				}
+				values = append(values, "{"+n+"}", v)
+			}
+		}
+	}
+
+	r := strings.NewReplacer(values...)
+	return r.Replace(c.group), r.Replace(c.stream)
+}
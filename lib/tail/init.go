@@ -0,0 +1,7 @@
+package tail
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterSource("file", lib.SourceFunc(NewReader))
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package tail
+
+import (
+	"os"
+	"syscall"
+)
+
+// identify returns the device and inode of the file described by fi, which
+// follow the file when it's renamed by a rotation.
+func identify(fi os.FileInfo) (id fileID, ok bool) {
+	var st *syscall.Stat_t
+
+	if st, ok = fi.Sys().(*syscall.Stat_t); ok {
+		id = fileID{dev: uint64(st.Dev), inode: uint64(st.Ino)}
+	}
+
+	return
+}
@@ -0,0 +1,781 @@
+// Package tail implements the file source, which follows the log files
+// matching glob patterns like tail -F does and records how far their lines
+// were delivered in a checkpoint.
+package tail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/codec"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// The maximum number of bytes read from a file before moving to the next one,
+// so a busy file doesn't hold back the others.
+const readChunk = 1024 * 1024
+
+func NewReader() (r lib.Reader, err error) {
+	var c config
+	var f lib.NameFilter
+	var rd *reader
+
+	if c, err = getConfig(); err != nil {
+		return
+	}
+
+	if f, err = lib.SourceFilter("file"); err != nil {
+		return
+	}
+
+	if rd, err = newReader(c); err != nil {
+		return
+	}
+
+	go rd.run()
+
+	r = lib.NewFilteredReader("file", rd, f, metrics.Default)
+	return
+}
+
+// fileID identifies a file independently of its path.
+type fileID struct {
+	dev   uint64
+	inode uint64
+}
+
+// checkpoint is the content of the checkpoint file, the offsets of the files
+// that were being read.
+type checkpoint struct {
+	Files []fileState `json:"files"`
+}
+
+type fileState struct {
+	Path   string `json:"path"`
+	Dev    uint64 `json:"dev"`
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+
+	// Set when a compressed file was entirely read, they're not read again.
+	Complete bool `json:"complete,omitempty"`
+}
+
+// reader reads the files matching the patterns of its config from a single
+// goroutine, which hands their lines to ReadMessage. The patterns are matched
+// again at each poll to find the new files, and the rotations: a file that
+// stops being at its path is read to its end and closed.
+type reader struct {
+	config  config
+	msgs    chan lib.Message
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+
+	// The files are read from the goroutine of run, the mutex protects their
+	// list, their paths and the offsets their lines are tracked from, and the
+	// writes of the checkpoint, which Commit does from the main goroutine.
+	mutex sync.Mutex
+	files []*file
+
+	// Increments for each line handed to ReadMessage, it orders the lines
+	// waiting for their acknowledgement.
+	seq int64
+
+	// The offsets loaded from the checkpoint until the first scan matched
+	// them to the files.
+	saved   map[fileID]fileState
+	resumed bool
+
+	// The paths that failed to open, so the error is only logged once.
+	failed map[string]bool
+
+	scanned bool
+	last    []byte
+	savedAt time.Time
+}
+
+// file is a file being tailed, its offset is the position of the first line
+// that wasn't handed to ReadMessage.
+type file struct {
+	reader *reader
+	path   string
+	group  string
+	stream string
+
+	id         fileID
+	identified bool
+
+	// Compressed files are the rotated archives, they're read once from the
+	// beginning since their offsets are positions in the decompressed data.
+	compressed bool
+	complete   bool
+
+	// Set once the file isn't at the path it was found at anymore, its end
+	// is the end of the last line then.
+	rotated bool
+
+	rd      io.ReadCloser
+	buf     *bufio.Reader
+	offset  int64
+	read    int64
+	pending []byte
+	discard bool
+
+	// Set with a checkpoint, the lines handed to ReadMessage wait there for
+	// their acknowledgement. base is the offset they were read from, where
+	// the file is read again when none of them was committed yet, and since
+	// is the sequence number of the first of them.
+	acks  *lib.AckTracker
+	base  int64
+	since int64
+}
+
+func newReader(c config) (r *reader, err error) {
+	r = &reader{
+		config:  c,
+		msgs:    make(chan lib.Message),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		failed:  make(map[string]bool),
+	}
+
+	if len(c.checkpoint) != 0 {
+		err = r.load()
+	}
+
+	return
+}
+
+func (r *reader) load() (err error) {
+	var b []byte
+	var saved checkpoint
+
+	if b, err = ioutil.ReadFile(r.config.checkpoint); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	if err = json.Unmarshal(b, &saved); err != nil {
+		return fmt.Errorf("invalid checkpoint %s: %s", r.config.checkpoint, err)
+	}
+
+	r.resumed = true
+	r.saved = make(map[fileID]fileState, len(saved.Files))
+
+	for _, s := range saved.Files {
+		r.saved[fileID{dev: s.Dev, inode: s.Inode}] = s
+	}
+
+	return
+}
+
+func (r *reader) Close() (err error) {
+	r.once.Do(func() { close(r.done) })
+	<-r.stopped
+	return
+}
+
+func (r *reader) ReadMessage() (msg lib.Message, err error) {
+	select {
+	case msg = <-r.msgs:
+	case <-r.done:
+		err = io.EOF
+	}
+	return
+}
+
+func (r *reader) run() {
+	defer close(r.stopped)
+
+	defer func() {
+		r.mutex.Lock()
+		for _, f := range r.files {
+			f.close()
+		}
+		r.mutex.Unlock()
+	}()
+
+	defer r.checkpoint()
+
+	for {
+		r.scan()
+		progress := false
+
+		r.mutex.Lock()
+		files := append([]*file{}, r.files...)
+		r.mutex.Unlock()
+
+		for _, f := range files {
+			n, ok := r.tail(f)
+
+			if !ok {
+				return
+			}
+
+			progress = progress || n != 0
+		}
+
+		r.prune()
+
+		r.mutex.Lock()
+		due := time.Since(r.savedAt) >= r.config.checkpointInterval
+		r.mutex.Unlock()
+
+		if due {
+			r.checkpoint()
+		}
+
+		if progress {
+			select {
+			case <-r.done:
+				return
+			default:
+			}
+			continue
+		}
+
+		select {
+		case <-r.done:
+			return
+		case <-time.After(r.config.pollInterval):
+		}
+	}
+}
+
+// scan matches the patterns to find the files that were created, rotated or
+// truncated since the previous scan.
+func (r *reader) scan() {
+	var paths []string
+
+	for _, p := range r.config.patterns {
+		matches, _ := filepath.Glob(p)
+		paths = append(paths, matches...)
+	}
+
+	sort.Strings(paths)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	found := make(map[*file]bool, len(r.files))
+	failed := make(map[string]bool)
+
+	for i, path := range paths {
+		if i != 0 && paths[i-1] == path {
+			continue
+		}
+
+		fi, err := os.Stat(path)
+
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+
+		id, identified := identify(fi)
+
+		if f := r.lookupPath(path); f != nil {
+			if !identified || f.id == id {
+				if !f.compressed && fi.Size() < f.read {
+					f.truncated()
+				}
+				found[f] = true
+				continue
+			}
+
+			// Another file took the path, the file that was there was moved
+			// or removed by a rotation.
+			f.path, f.rotated = "", true
+		}
+
+		if f := r.lookupID(id, identified); f != nil {
+			// The file was renamed by a rotation to a path that the patterns
+			// match as well, like app.log to app.log.1.
+			f.path, f.rotated = path, true
+			found[f] = true
+			continue
+		}
+
+		if f, err := r.open(path, fi, id, identified); err == nil {
+			r.files = append(r.files, f)
+			found[f] = true
+		} else {
+			if !r.failed[path] {
+				log.WithFields(log.Fields{"path": path, "error": err}).Warn("failed to open a file of the file source")
+			}
+			failed[path] = true
+		}
+	}
+
+	for _, f := range r.files {
+		if !found[f] {
+			f.path, f.rotated = "", true
+		}
+	}
+
+	r.scanned, r.saved, r.failed = true, nil, failed
+}
+
+func (r *reader) lookupPath(path string) *file {
+	for _, f := range r.files {
+		if f.path == path {
+			return f
+		}
+	}
+	return nil
+}
+
+func (r *reader) lookupID(id fileID, identified bool) *file {
+	if identified {
+		for _, f := range r.files {
+			if f.identified && f.id == id {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+// open starts tailing the file at path, from the offset saved in the
+// checkpoint when there's one.
+func (r *reader) open(path string, fi os.FileInfo, id fileID, identified bool) (f *file, err error) {
+	f = &file{
+		reader:     r,
+		path:       path,
+		id:         id,
+		identified: identified,
+		compressed: isCompressed(path),
+	}
+
+	f.group, f.stream = r.config.names(path)
+
+	if len(r.config.checkpoint) != 0 {
+		f.acks = lib.NewAckTracker("file", r.config.ackTimeout, r.config.maxRedeliveries, metrics.Default)
+		f.since = r.seq + 1
+	}
+
+	if s, ok := r.saved[id]; ok && identified {
+		f.offset, f.complete = s.Offset, s.Complete && f.compressed
+	} else if !r.scanned && !r.resumed && r.config.startAtEnd {
+		// The files that were already there the first time ecs-logs ran
+		// were probably read by something else before.
+		f.offset, f.complete = fi.Size(), f.compressed
+	}
+
+	if f.complete {
+		return
+	}
+
+	if !f.compressed && f.offset > fi.Size() {
+		f.offset = 0
+	}
+
+	if err = f.seek(f.offset); err != nil {
+		return nil, err
+	}
+
+	f.base = f.offset
+	return
+}
+
+// seek moves f to offset, the next line is read from there. The files which
+// can't seek, like the compressed ones, are opened again and read up to it.
+func (f *file) seek(offset int64) (err error) {
+	rd := f.rd
+
+	if _, ok := rd.(io.Seeker); !ok {
+		if rd, _, err = codec.Open(f.path, !f.compressed); err != nil {
+			return
+		}
+	}
+
+	if s, ok := rd.(io.Seeker); ok {
+		_, err = s.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, rd, offset)
+	}
+
+	if err != nil {
+		if rd != f.rd {
+			rd.Close()
+		}
+		return
+	}
+
+	if rd != f.rd {
+		f.close()
+		f.rd = rd
+	}
+
+	if f.buf == nil {
+		f.buf = bufio.NewReader(rd)
+	} else {
+		f.buf.Reset(rd)
+	}
+
+	atomic.StoreInt64(&f.offset, offset)
+	f.read, f.pending, f.discard = offset, nil, false
+	return
+}
+
+// truncated starts reading f over, after it was truncated in place by a
+// rotation like the copytruncate of logrotate. The lines still waiting for
+// their acknowledgement don't hold its checkpoint back anymore.
+func (f *file) truncated() {
+	if _, ok := f.rd.(io.Seeker); ok && f.seek(0) == nil {
+		f.base, f.since = 0, f.reader.seq+1
+	}
+}
+
+func (f *file) close() {
+	if f.rd != nil {
+		f.rd.Close()
+		f.rd = nil
+	}
+}
+
+// prune stops tracking the files which were entirely read and aren't matched
+// by the patterns anymore, once their lines were all acknowledged.
+func (r *reader) prune() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	files := r.files[:0]
+
+	for _, f := range r.files {
+		if len(f.path) == 0 && (f.rd == nil || f.atEOF()) && (f.acks == nil || f.acks.Pending() == 0) {
+			f.close()
+			continue
+		}
+		files = append(files, f)
+	}
+
+	for i := len(files); i < len(r.files); i++ {
+		r.files[i] = nil
+	}
+
+	r.files = files
+}
+
+func (f *file) atEOF() bool {
+	if f.buf.Buffered() != 0 {
+		return false
+	}
+
+	if fi, err := os.Stat(f.path); err == nil && fi.Size() > f.read {
+		return false
+	}
+
+	// The path is gone, what's left to read is only known by reading.
+	if file, ok := f.rd.(*os.File); ok {
+		if fi, err := file.Stat(); err == nil {
+			return fi.Size() <= f.read
+		}
+	}
+
+	return true
+}
+
+// tail hands the new lines of f to ReadMessage, it returns the number of bytes
+// that were read and false if the reader was closed.
+func (r *reader) tail(f *file) (n int, ok bool) {
+	r.redeliver(f)
+
+	if f.rd == nil {
+		return 0, true
+	}
+
+	for n < readChunk {
+		var chunk []byte
+		var err error
+
+		chunk, err = f.buf.ReadSlice('\n')
+		n += len(chunk)
+		f.read += int64(len(chunk))
+
+		eol := len(chunk) != 0 && chunk[len(chunk)-1] == '\n'
+
+		if !f.discard {
+			if room := r.config.maxLineSize - len(f.pending); room < len(chunk) {
+				f.pending = append(f.pending, chunk[:room]...)
+			} else {
+				f.pending = append(f.pending, chunk...)
+			}
+
+			// The start of a line that is too long is sent right away, the
+			// rest is discarded up to the end of the line.
+			if !eol && len(f.pending) >= r.config.maxLineSize {
+				// The offset stays at the start of the line, which is read
+				// again if the checkpoint is saved before its end.
+				offset := atomic.LoadInt64(&f.offset)
+
+				if !r.send(f, offset, offset) {
+					return n, false
+				}
+				f.discard = true
+			}
+		}
+
+		switch {
+		case eol && f.discard:
+			f.discard = false
+			atomic.StoreInt64(&f.offset, f.read)
+
+		case eol:
+			if !r.send(f, atomic.LoadInt64(&f.offset), f.read) {
+				return n, false
+			}
+			atomic.StoreInt64(&f.offset, f.read)
+		}
+
+		switch err {
+		case nil, bufio.ErrBufferFull:
+			continue
+
+		case io.EOF:
+			// An active file may be in the middle of writing a line, the
+			// last line of the other ones doesn't have to end with a
+			// newline.
+			if f.rotated || f.compressed {
+				if len(f.pending) != 0 && !f.discard && !r.send(f, atomic.LoadInt64(&f.offset), f.read) {
+					return n, false
+				}
+				f.pending, f.discard = nil, false
+				atomic.StoreInt64(&f.offset, f.read)
+			}
+
+			if f.compressed {
+				r.mutex.Lock()
+				f.complete = true
+				f.close()
+				r.mutex.Unlock()
+			}
+
+		default:
+			log.WithFields(log.Fields{"path": f.path, "error": err}).Error("failed to read a file of the file source")
+			r.mutex.Lock()
+			f.close()
+			r.mutex.Unlock()
+		}
+
+		return n, true
+	}
+
+	return n, true
+}
+
+// send hands the pending line of f, which starts at offset, to ReadMessage.
+// The file is read from end once the line was acknowledged.
+func (r *reader) send(f *file, offset int64, end int64) bool {
+	line := strings.TrimRight(string(f.pending), "\r\n")
+	f.pending = f.pending[:0]
+
+	if len(strings.TrimSpace(line)) == 0 {
+		return true
+	}
+
+	msg := lib.Message{Group: f.group, Stream: f.stream}
+
+	if r.config.parser != nil {
+		msg.Event = lib.ParseMessage(r.config.parser, []byte(line)).Event
+	} else {
+		d := json.NewDecoder(strings.NewReader(line))
+		d.UseNumber()
+
+		if d.Decode(&msg.Event) != nil {
+			msg.Event = ecslogs.Event{Message: line}
+		}
+	}
+
+	if f.acks != nil {
+		r.seq++
+		pos := lib.Position{Seq: r.seq, Checkpoint: strconv.FormatInt(end, 10)}
+		f.acks.Read(pos, time.Now())
+		lib.SetOrigin(&msg, f, pos)
+	}
+
+	select {
+	case r.msgs <- msg:
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+// redeliver moves f back to the end of its latest committed line when the
+// line after it wasn't acknowledged in time, so it's read again with the ones
+// that followed it.
+func (r *reader) redeliver(f *file) {
+	if f.acks == nil {
+		return
+	}
+
+	// The lines are forgotten by the tracker and read again under the lock,
+	// the checkpoint isn't saved in between.
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := f.acks.Expire(time.Now()); !ok {
+		return
+	}
+
+	offset := f.resume()
+
+	log.WithFields(log.Fields{
+		"path":    f.path,
+		"offset":  offset,
+		"timeout": f.acks.Timeout,
+	}).Warn("redelivering the lines that were not acknowledged in time")
+
+	if err := f.seek(offset); err != nil {
+		log.WithFields(log.Fields{"path": f.path, "error": err}).Error("failed to read a file of the file source")
+		f.close()
+		return
+	}
+
+	f.base, f.since, f.complete = offset, r.seq+1, false
+}
+
+// resume returns the offset that f is read again from after its pending lines
+// were forgotten, the end of the latest line that was committed since base.
+func (f *file) resume() int64 {
+	if pos, ok := f.acks.Committed(); ok && pos.Seq >= f.since {
+		if offset, err := strconv.ParseInt(pos.Checkpoint, 10, 64); err == nil {
+			return offset
+		}
+	}
+	return f.base
+}
+
+// checkpoint returns the offset saved in the checkpoint for f, the lines
+// before it were all acknowledged.
+func (f *file) checkpoint() int64 {
+	// Loaded first, the lines before it were tracked already and were all
+	// acknowledged if none is pending. The offset is only stored once the
+	// line was received, which may be after it was acknowledged.
+	offset := atomic.LoadInt64(&f.offset)
+
+	if f.acks != nil {
+		if resume := f.resume(); f.acks.Pending() != 0 || resume > offset {
+			offset = resume
+		}
+	}
+
+	return offset
+}
+
+// Rewind is called when a line failed to be delivered, it stays
+// unacknowledged so the checkpoint doesn't move past it and it's read again
+// after the ack timeout.
+func (f *file) Rewind(pos lib.Position) {}
+
+func (f *file) Retain(pos lib.Position) {
+	f.acks.Retain(pos)
+}
+
+func (f *file) Acknowledge(pos lib.Position) {
+	f.acks.Acknowledge(pos)
+}
+
+// Commit saves the checkpoint right away if the offsets changed since it was
+// last saved.
+func (r *reader) Commit() error {
+	return r.save()
+}
+
+// checkpoint saves the offsets of the files, unless they didn't change since
+// the last time.
+func (r *reader) checkpoint() {
+	if err := r.save(); err != nil {
+		log.WithError(err).Error("failed to save the checkpoint of the file source")
+	}
+}
+
+func (r *reader) save() (err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.config.checkpoint) == 0 {
+		return
+	}
+
+	state := checkpoint{Files: []fileState{}}
+
+	for _, f := range r.files {
+		if !f.identified {
+			continue
+		}
+
+		s := fileState{
+			Path:     f.path,
+			Dev:      f.id.dev,
+			Inode:    f.id.inode,
+			Offset:   f.checkpoint(),
+			Complete: f.complete,
+		}
+
+		if s.Offset < atomic.LoadInt64(&f.offset) {
+			s.Complete = false
+		}
+
+		state.Files = append(state.Files, s)
+	}
+
+	b, _ := json.MarshalIndent(state, "", "  ")
+	b = append(b, '\n')
+
+	if bytes.Equal(b, r.last) {
+		r.savedAt = time.Now()
+		return
+	}
+
+	tmp := r.config.checkpoint + ".tmp"
+
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return
+	}
+
+	if err = os.Rename(tmp, r.config.checkpoint); err == nil {
+		syncDir(filepath.Dir(r.config.checkpoint))
+		r.last, r.savedAt = b, time.Now()
+	}
+
+	return
+}
+
+// isCompressed returns true if path has the extension of a compression
+// format, which is how the rotated archives are told from the active files.
+func isCompressed(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+
+	for _, name := range codec.Names() {
+		if c, err := codec.Get(name, 0); err == nil && len(c.Extension()) != 0 && c.Extension() == ext {
+			return true
+		}
+	}
+
+	return false
+}
+
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,436 @@
+package tail
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/multiline"
+)
+
+func newTestReader(t *testing.T, c config) *reader {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	if len(c.group) == 0 {
+		c.group, c.stream = "{dir}", "{name}"
+	}
+
+	if c.maxLineSize == 0 {
+		c.maxLineSize = 1024
+	}
+
+	c.pollInterval = 10 * time.Millisecond
+	c.checkpointInterval = 10 * time.Millisecond
+
+	r, err := newReader(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go r.run()
+
+	// The files found by the first scan are read from their end, the tests
+	// write the lines they expect after it.
+	for scanned := false; !scanned; time.Sleep(time.Millisecond) {
+		r.mutex.Lock()
+		scanned = r.scanned
+		r.mutex.Unlock()
+	}
+
+	return r
+}
+
+func readMessages(t *testing.T, r *reader, n int) (msgs []lib.Message) {
+	for i := 0; i != n; i++ {
+		select {
+		case msg := <-r.msgs:
+			msgs = append(msgs, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for line %d after %+v", i, msgs)
+		}
+	}
+	return
+}
+
+func read(t *testing.T, r *reader, n int) (lines []string) {
+	for _, msg := range readMessages(t, r, n) {
+		lines = append(lines, msg.Event.Message)
+	}
+	return
+}
+
+func readNothing(t *testing.T, r *reader) {
+	select {
+	case msg := <-r.msgs:
+		t.Errorf("unexpected message: %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func appendFile(t *testing.T, path string, content string) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tail_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestReaderRotation(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, "before\n")
+
+	r := newTestReader(t, config{patterns: []string{filepath.Join(dir, "*.log*")}, startAtEnd: true})
+	defer r.Close()
+
+	// The lines that were there before the source started are skipped, the
+	// partial lines wait for their end.
+	appendFile(t, path, "A\n{\"level\":\"WARN\",\"message\":\"B\"}\npartial")
+
+	msg := readMessages(t, r, 1)[0]
+	if msg.Event.Message != "A" || msg.Group != dir || msg.Stream != "app" {
+		t.Errorf("invalid message: %+v", msg)
+	}
+
+	if lines := read(t, r, 1); lines[0] != "B" {
+		t.Errorf("the JSON lines should be decoded: %q", lines)
+	}
+
+	readNothing(t, r)
+
+	// Rotated by renaming, the end of the old file is still read.
+	appendFile(t, path, " line\nC")
+
+	if lines := read(t, r, 1); lines[0] != "partial line" {
+		t.Errorf("invalid line: %q", lines)
+	}
+
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+
+	appendFile(t, path, "D\n")
+
+	if lines := read(t, r, 2); strings.Join(lines, ",") != "C,D" {
+		t.Errorf("the rotated file should be read to its end: %q", lines)
+	}
+
+	// Truncated in place like copytruncate.
+	os.Truncate(path, 0)
+	time.Sleep(50 * time.Millisecond)
+	appendFile(t, path, "E\n")
+
+	if lines := read(t, r, 1); lines[0] != "E" {
+		t.Errorf("the truncated file should be read from its beginning: %q", lines)
+	}
+
+	readNothing(t, r)
+}
+
+func readCheckpoint(t *testing.T, path string) (offset int64) {
+	var c checkpoint
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := json.Unmarshal(b, &c); err != nil || len(c.Files) != 1 {
+		t.Fatalf("invalid checkpoint: %s (%v)", b, err)
+	}
+
+	return c.Files[0].Offset
+}
+
+func TestReaderCheckpoint(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	c := config{
+		patterns:   []string{path},
+		checkpoint: filepath.Join(dir, "checkpoint.json"),
+		startAtEnd: true,
+	}
+
+	appendFile(t, path, "old\n")
+
+	r := newTestReader(t, c)
+	appendFile(t, path, "A\nB\n")
+	lib.AcknowledgeBatch(readMessages(t, r, 2))
+	r.Close()
+
+	// Lines written while ecs-logs was stopped are read after a restart,
+	// the checkpoint tells where the previous run stopped.
+	appendFile(t, path, "C\nD\n")
+	r = newTestReader(t, c)
+
+	msgs := readMessages(t, r, 2)
+
+	if msgs[0].Event.Message != "C" || msgs[1].Event.Message != "D" {
+		t.Errorf("the source should resume from the checkpoint: %+v", msgs)
+	}
+
+	// C and D failed to be delivered, they're read again after a restart.
+	lib.RewindBatch(lib.MessageBatch{msgs[1], msgs[0]})
+	r.Close()
+
+	if offset := readCheckpoint(t, c.checkpoint); offset != 8 {
+		t.Errorf("the checkpoint should have stayed at C: %d", offset)
+	}
+
+	r = newTestReader(t, c)
+	defer r.Close()
+
+	if lines := read(t, r, 2); strings.Join(lines, ",") != "C,D" {
+		t.Errorf("the source should resume from the line that failed: %q", lines)
+	}
+}
+
+func TestReaderAcknowledged(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	c := config{
+		patterns:   []string{path},
+		checkpoint: filepath.Join(dir, "checkpoint.json"),
+	}
+
+	appendFile(t, path, "A\n\nB\nC\n")
+
+	r := newTestReader(t, c)
+	defer r.Close()
+
+	msgs := readMessages(t, r, 3)
+
+	// The lines that were read aren't in the checkpoint until they're
+	// acknowledged, B was delivered before A.
+	lib.AcknowledgeBatch(lib.MessageBatch{msgs[1]})
+	r.Commit()
+
+	if offset := readCheckpoint(t, c.checkpoint); offset != 0 {
+		t.Errorf("the checkpoint shouldn't move past A: %d", offset)
+	}
+
+	lib.AcknowledgeBatch(lib.MessageBatch{msgs[0]})
+	r.Commit()
+
+	if offset := readCheckpoint(t, c.checkpoint); offset != 5 {
+		t.Errorf("the checkpoint should be at C once A and B were acknowledged: %d", offset)
+	}
+
+	lib.AcknowledgeBatch(lib.MessageBatch{msgs[2]})
+	r.Commit()
+
+	if offset := readCheckpoint(t, c.checkpoint); offset != 7 {
+		t.Errorf("the checkpoint should be at the end of the file: %d", offset)
+	}
+}
+
+func TestReaderMultiline(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	c := config{
+		patterns:   []string{path},
+		checkpoint: filepath.Join(dir, "checkpoint.json"),
+	}
+
+	appendFile(t, path, "A\n\tat A\nB\n")
+
+	proc, err := multiline.NewProcessor()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestReader(t, c)
+	defer r.Close()
+
+	pipeline := lib.Pipeline{proc}
+	msgs := readMessages(t, r, 3)
+	now := time.Now()
+
+	// The stage holds A while it waits for the lines that continue it, the
+	// checkpoint doesn't move past it until the joined message is delivered.
+	if out := append(pipeline.Process(msgs[0], now), pipeline.Process(msgs[1], now)...); len(out) != 0 {
+		t.Fatalf("A should be pending: %+v", out)
+	}
+	r.Commit()
+
+	if offset := readCheckpoint(t, c.checkpoint); offset != 0 {
+		t.Errorf("the checkpoint shouldn't move past the pending lines: %d", offset)
+	}
+
+	joined := pipeline.Process(msgs[2], now)
+	r.Commit()
+
+	if offset := readCheckpoint(t, c.checkpoint); offset != 0 {
+		t.Errorf("the checkpoint shouldn't move past the released message before it's delivered: %d", offset)
+	}
+
+	lib.AcknowledgeBatch(joined)
+	r.Commit()
+
+	if offset := readCheckpoint(t, c.checkpoint); offset != 8 {
+		t.Errorf("the checkpoint should be at B once the joined message was delivered: %d", offset)
+	}
+
+	flushed := pipeline.Flush(now.Add(time.Second))
+	r.Commit()
+
+	if offset := readCheckpoint(t, c.checkpoint); offset != 8 {
+		t.Errorf("the checkpoint shouldn't move past B before it's delivered: %d", offset)
+	}
+
+	lib.AcknowledgeBatch(flushed)
+	r.Commit()
+
+	if offset := readCheckpoint(t, c.checkpoint); offset != 10 {
+		t.Errorf("the checkpoint should be at the end of the file: %d", offset)
+	}
+}
+
+func TestReaderRedeliver(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	c := config{
+		patterns:        []string{path},
+		checkpoint:      filepath.Join(dir, "checkpoint.json"),
+		ackTimeout:      50 * time.Millisecond,
+		maxRedeliveries: 1,
+	}
+
+	appendFile(t, path, "A\nB\nC\n")
+
+	r := newTestReader(t, c)
+	defer r.Close()
+
+	msgs := readMessages(t, r, 3)
+	lib.AcknowledgeBatch(msgs[:1])
+
+	// B was never acknowledged, it's read again with C.
+	if lines := read(t, r, 2); strings.Join(lines, ",") != "B,C" {
+		t.Errorf("the lines after A should be redelivered: %q", lines)
+	}
+
+	// The acknowledgements of the first delivery are ignored, and B is given
+	// up after its second one.
+	lib.AcknowledgeBatch(msgs[1:])
+
+	if lines := read(t, r, 1); lines[0] != "C" {
+		t.Errorf("only C should be redelivered after B was given up: %q", lines)
+	}
+
+	readNothing(t, r)
+}
+
+func TestReaderCompressed(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	f, _ := os.Create(filepath.Join(dir, "app.log.2.gz"))
+	z := gzip.NewWriter(f)
+	z.Write([]byte("archived 1\narchived 2"))
+	z.Close()
+	f.Close()
+
+	r := newTestReader(t, config{patterns: []string{filepath.Join(dir, "app.log*")}})
+	defer r.Close()
+
+	if lines := read(t, r, 2); strings.Join(lines, ",") != "archived 1,archived 2" {
+		t.Errorf("the compressed file should be decompressed: %q", lines)
+	}
+
+	readNothing(t, r)
+}
+
+func TestReaderLongLines(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, strings.Repeat("x", 10000)+"\nshort\n")
+
+	r := newTestReader(t, config{patterns: []string{path}, maxLineSize: 100})
+	defer r.Close()
+
+	if lines := read(t, r, 2); len(lines[0]) != 100 || lines[1] != "short" {
+		t.Errorf("the long line should be truncated: %q", lines)
+	}
+}
+
+func TestConfigNames(t *testing.T) {
+	c := config{
+		group:       "{namespace}",
+		stream:      "{pod}/{name}",
+		pathPattern: regexp.MustCompile(`/(?P<pod>[^_/]+)_(?P<namespace>[^_]+)_`),
+	}
+
+	if group, stream := c.names("/var/log/containers/web-1_prod_nginx-0123.log"); group != "prod" || stream != "web-1/web-1_prod_nginx-0123" {
+		t.Errorf("invalid names: %s %s", group, stream)
+	}
+
+	if group, _ := c.names("/var/log/other.log"); group != "" {
+		t.Errorf("the groups of the pattern should be empty when the path doesn't match: %q", group)
+	}
+}
+
+func TestGetConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(map[string]string{"FILE_PATHS": "/var/log/*.log, /var/log/nginx/*.log"})
+
+	if c, err := getConfig(); err != nil || len(c.patterns) != 2 || c.group != "{dir}" || !c.startAtEnd {
+		t.Errorf("invalid config: %+v (%v)", c, err)
+	}
+
+	for _, test := range []struct {
+		env map[string]string
+		err string
+	}{
+		{map[string]string{}, "missing FILE_PATHS"},
+		{map[string]string{"FILE_PATHS": "/var/log/[a.log"}, "invalid FILE_PATHS"},
+		{map[string]string{"FILE_PATHS": "*.log", "FILE_GROUP": "{pod}"}, "{pod}"},
+		{map[string]string{"FILE_PATHS": "*.log", "FILE_START_AT": "middle"}, "FILE_START_AT"},
+		{map[string]string{"FILE_PATHS": "*.log", "FILE_POLL_INTERVAL": "0s"}, "FILE_POLL_INTERVAL"},
+		{map[string]string{"FILE_PATHS": "*.log", "FILE_CHECKPOINT": "checkpoint.json", "FILE_ACK_TIMEOUT": "soon"}, "FILE_ACK_TIMEOUT"},
+	} {
+		lib.SetConfigEnv(test.env)
+
+		if _, err := getConfig(); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: the error should mention %s: %v", test.env, test.err, err)
+		}
+	}
+
+	lib.SetConfigEnv(map[string]string{"FILE_PATHS": "*.log", "FILE_PATH_PATTERN": `(?P<pod>\w+)`, "FILE_GROUP": "{pod}"})
+
+	if _, err := getConfig(); err != nil {
+		t.Errorf("the groups of the pattern should be variables: %v", err)
+	}
+}
@@ -0,0 +1,11 @@
+package tenant
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterStage("tenant", lib.NewCheckedStage(lib.StageFunc(NewProcessor), checkConfig))
+
+	// The tenant is often a label added by the metadata stage, and the
+	// namespace stage prefixes the groups that the tenants are routed to.
+	lib.RegisterStageOrder("tenant", lib.StageOrder{After: []string{"metadata"}, Before: []string{"namespace"}})
+}
@@ -0,0 +1,336 @@
+// Package tenant implements the tenant stage, which routes the messages of each
+// tenant of a shared ecs-logs to the log group of the tenant, looked up by the
+// value of a field of the messages in a routing table.
+package tenant
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// Policy is what happens to the messages of the tenants that aren't in the
+// routing table, or that have no tenant.
+type Policy int
+
+const (
+	// DefaultPolicy sends the messages to the default route, they keep their
+	// group when there is none.
+	DefaultPolicy Policy = iota
+
+	// DeadLetterPolicy sends the messages to the dead-letter group, so the
+	// logs of a tenant that wasn't onboarded don't end up with the ones of
+	// another one.
+	DeadLetterPolicy
+
+	// DropPolicy drops the messages, with a warning.
+	DropPolicy
+)
+
+func ParsePolicy(s string) (p Policy, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "default":
+		p = DefaultPolicy
+	case "dead-letter":
+		p = DeadLetterPolicy
+	case "drop":
+		p = DropPolicy
+	default:
+		err = fmt.Errorf("invalid TENANT_UNKNOWN, must be one of default, dead-letter or drop: %s", s)
+	}
+	return
+}
+
+type config struct {
+	// The dotted path of the data field holding the tenant of the messages.
+	field string
+
+	// The group templates of the tenants, and the one of the tenants which
+	// aren't in the table when the policy is the default one.
+	routes       map[string]string
+	defaultRoute string
+	policy       Policy
+
+	// The group that the messages of unknown tenants are sent to with the
+	// dead-letter policy.
+	deadLetterGroup string
+}
+
+func getConfig() (c config, err error) {
+	var s string
+
+	c.field = "tenant"
+	c.routes = make(map[string]string)
+	c.deadLetterGroup = "ecs-logs-dead-letter"
+
+	if s = strings.TrimSpace(lib.Getenv("TENANT_FIELD")); len(s) != 0 {
+		c.field = s
+	}
+
+	// Large tables are easier to maintain in a file, the routes of the
+	// environment take precedence over the ones of the file.
+	if s = strings.TrimSpace(lib.Getenv("TENANT_ROUTES_FILE")); len(s) != 0 {
+		if err = loadRoutes(s, c.routes); err != nil {
+			return
+		}
+	}
+
+	if err = parseRoutes(lib.Getenv("TENANT_ROUTES"), c.routes); err != nil {
+		return
+	}
+
+	if len(c.routes) == 0 {
+		err = fmt.Errorf("missing TENANT_ROUTES or TENANT_ROUTES_FILE environment variable")
+		return
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("TENANT_DEFAULT_ROUTE")); len(s) != 0 {
+		if err = checkTemplate(s); err != nil {
+			err = fmt.Errorf("invalid TENANT_DEFAULT_ROUTE, %s", err)
+			return
+		}
+		c.defaultRoute = s
+	}
+
+	if c.policy, err = ParsePolicy(lib.Getenv("TENANT_UNKNOWN")); err != nil {
+		return
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("TENANT_DEAD_LETTER_GROUP")); len(s) != 0 {
+		c.deadLetterGroup = s
+	}
+
+	return
+}
+
+// parseRoutes adds the routes of s, a comma separated list of tenant=group
+// pairs, to routes.
+func parseRoutes(s string, routes map[string]string) error {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+
+		kv := strings.SplitN(item, "=", 2)
+
+		if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 || len(strings.TrimSpace(kv[1])) == 0 {
+			return fmt.Errorf("invalid TENANT_ROUTES, expected tenant=group: %s", item)
+		}
+
+		tenant, group := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+
+		if err := checkTemplate(group); err != nil {
+			return fmt.Errorf("invalid TENANT_ROUTES, %s: %s", err, item)
+		}
+
+		routes[tenant] = group
+	}
+
+	return nil
+}
+
+// loadRoutes adds the routes of the JSON object in the file at path, which maps
+// the tenants to their groups, to routes.
+func loadRoutes(path string, routes map[string]string) error {
+	var table map[string]string
+
+	b, err := ioutil.ReadFile(path)
+
+	if err == nil {
+		err = json.Unmarshal(b, &table)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid TENANT_ROUTES_FILE: %s", err)
+	}
+
+	for tenant, group := range table {
+		if len(tenant) == 0 || len(group) == 0 {
+			return fmt.Errorf("invalid TENANT_ROUTES_FILE, the tenants and their groups can't be empty: %q=%q", tenant, group)
+		}
+
+		if err := checkTemplate(group); err != nil {
+			return fmt.Errorf("invalid TENANT_ROUTES_FILE, %s: %s", err, tenant)
+		}
+
+		routes[tenant] = group
+	}
+
+	return nil
+}
+
+// checkTemplate reports the variables of the group template s that aren't one
+// of {group}, {stream} or {tenant}.
+func checkTemplate(s string) error {
+	for rest := s; ; {
+		i := strings.IndexByte(rest, '{')
+
+		if i < 0 {
+			return nil
+		}
+
+		j := strings.IndexByte(rest[i:], '}')
+
+		if j < 0 {
+			return fmt.Errorf("unclosed variable in %s", s)
+		}
+
+		switch name := rest[i+1 : i+j]; name {
+		case "group", "stream", "tenant":
+		default:
+			return fmt.Errorf("unknown variable {%s} in %s, must be one of {group}, {stream} or {tenant}", name, s)
+		}
+
+		rest = rest[i+j+1:]
+	}
+}
+
+func NewProcessor() (p lib.Processor, err error) {
+	var c config
+
+	if c, err = getConfig(); err == nil {
+		p = newProcessor(c, metrics.Default)
+	}
+
+	return
+}
+
+func checkConfig() (err error) {
+	_, err = getConfig()
+	return
+}
+
+type processor struct {
+	config
+	unknown *metrics.Counter
+}
+
+func newProcessor(c config, registry *metrics.Registry) *processor {
+	return &processor{
+		config:  c,
+		unknown: registry.Counter("unknown_tenant_messages", "stage", "tenant"),
+	}
+}
+
+func (p *processor) Process(msg lib.Message, now time.Time) []lib.Message {
+	tenant := p.tenant(msg)
+
+	if route, ok := p.routes[tenant]; ok {
+		msg.Group = p.render(route, msg, tenant)
+		return []lib.Message{msg}
+	}
+
+	p.unknown.Add(1)
+
+	switch p.policy {
+	case DropPolicy:
+		log.WithFields(log.Fields{
+			"group":  msg.Group,
+			"stream": msg.Stream,
+			"tenant": tenant,
+		}).Warn("dropping a message of an unknown tenant")
+		return nil
+
+	case DeadLetterPolicy:
+		res := msg
+		res.Group = strings.NewReplacer("{group}", msg.Group, "{stream}", msg.Stream).Replace(p.deadLetterGroup)
+		res.Event.Data = copyData(msg.Event.Data)
+
+		reason := "the message has no tenant"
+		if len(tenant) != 0 {
+			reason = fmt.Sprintf("the tenant %q has no route", tenant)
+		}
+
+		info := lib.DeadLetterInfo(msg, reason, nil)
+		info["tenant"] = tenant
+		res.Event.Data[lib.DeadLetterField] = info
+		return []lib.Message{res}
+	}
+
+	if len(p.defaultRoute) != 0 {
+		msg.Group = p.render(p.defaultRoute, msg, tenant)
+	}
+
+	return []lib.Message{msg}
+}
+
+func (p *processor) Flush(now time.Time) []lib.Message {
+	return nil
+}
+
+// tenant returns the tenant of msg, or an empty string if it has none. Numbers
+// and booleans are accepted since labels are often decoded as such.
+func (p *processor) tenant(msg lib.Message) string {
+	switch v := lookup(msg.Event.Data, p.field).(type) {
+	case nil:
+		return ""
+	case string:
+		return strings.TrimSpace(v)
+	case map[string]interface{}, ecslogs.EventData, []interface{}:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// render returns the group of the template s for msg. The tenant may come from
+// a message that isn't in the table, it's sanitized so it can't add levels to
+// the group or characters that CloudWatch Logs rejects.
+func (p *processor) render(s string, msg lib.Message, tenant string) string {
+	if len(tenant) == 0 {
+		tenant = "unknown"
+	}
+
+	return strings.NewReplacer(
+		"{group}", msg.Group,
+		"{stream}", msg.Stream,
+		"{tenant}", sanitize(tenant),
+	).Replace(s)
+}
+
+func sanitize(s string) string {
+	return strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			return c
+		case c == '.', c == '-', c == '_', c == '#':
+			return c
+		default:
+			return '_'
+		}
+	}, s)
+}
+
+func lookup(data ecslogs.EventData, path string) interface{} {
+	var value interface{} = map[string]interface{}(data)
+
+	for _, key := range strings.Split(path, ".") {
+		switch m := value.(type) {
+		case ecslogs.EventData:
+			value = m[key]
+		case map[string]interface{}:
+			value = m[key]
+		default:
+			return nil
+		}
+	}
+
+	return value
+}
+
+func copyData(data ecslogs.EventData) ecslogs.EventData {
+	c := make(ecslogs.EventData, len(data)+1)
+
+	for k, v := range data {
+		c[k] = v
+	}
+
+	return c
+}
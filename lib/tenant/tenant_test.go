@@ -0,0 +1,189 @@
+package tenant
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+func newTestProcessor(t *testing.T, env map[string]string) (*processor, *metrics.Registry) {
+	lib.SetConfigEnv(env)
+	defer lib.SetConfigEnv(nil)
+
+	c, err := getConfig()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry := metrics.NewRegistry()
+	return newProcessor(c, registry), registry
+}
+
+func TestProcessorRoutes(t *testing.T) {
+	p, _ := newTestProcessor(t, map[string]string{
+		"TENANT_FIELD":  "labels.tenant",
+		"TENANT_ROUTES": "acme=/tenants/acme/{group}, globex=/tenants/{tenant}/{stream}, 42=/tenants/answer",
+	})
+
+	tests := []struct {
+		data  ecslogs.EventData
+		group string
+	}{
+		{ecslogs.EventData{"labels": map[string]interface{}{"tenant": "acme"}}, "/tenants/acme/api"},
+		{ecslogs.EventData{"labels": ecslogs.EventData{"tenant": " globex "}}, "/tenants/globex/B"},
+		{ecslogs.EventData{"labels": map[string]interface{}{"tenant": 42}}, "/tenants/answer"},
+	}
+
+	for _, test := range tests {
+		res := p.Process(makeMessage("api", test.data), time.Now())
+
+		if len(res) != 1 {
+			t.Fatalf("%v: a single message should be returned, got %d", test.data, len(res))
+		}
+
+		if res[0].Group != test.group {
+			t.Errorf("%v: invalid group: %s != %s", test.data, res[0].Group, test.group)
+		}
+	}
+}
+
+func TestProcessorDefaultRoute(t *testing.T) {
+	p, registry := newTestProcessor(t, map[string]string{
+		"TENANT_ROUTES":        "acme=/tenants/acme/{group}",
+		"TENANT_DEFAULT_ROUTE": "/tenants/shared/{tenant}/{group}",
+	})
+
+	tests := []struct {
+		data  ecslogs.EventData
+		group string
+	}{
+		{ecslogs.EventData{"tenant": "initech"}, "/tenants/shared/initech/api"},
+		// The tenant can't add levels to the group.
+		{ecslogs.EventData{"tenant": "../acme"}, "/tenants/shared/.._acme/api"},
+		{ecslogs.EventData{}, "/tenants/shared/unknown/api"},
+	}
+
+	for _, test := range tests {
+		if res := p.Process(makeMessage("api", test.data), time.Now())[0]; res.Group != test.group {
+			t.Errorf("%v: invalid group: %s != %s", test.data, res.Group, test.group)
+		}
+	}
+
+	if n := registry.Counter("unknown_tenant_messages", "stage", "tenant").Value(); n != 3 {
+		t.Error("invalid number of messages of unknown tenants:", n)
+	}
+
+	// Without a default route the messages keep their group.
+	p, _ = newTestProcessor(t, map[string]string{"TENANT_ROUTES": "acme=/tenants/acme/{group}"})
+
+	if res := p.Process(makeMessage("api", ecslogs.EventData{"tenant": "initech"}), time.Now())[0]; res.Group != "api" {
+		t.Error("invalid group:", res.Group)
+	}
+}
+
+func TestProcessorUnknownTenant(t *testing.T) {
+	p, _ := newTestProcessor(t, map[string]string{
+		"TENANT_ROUTES":            "acme=/tenants/acme/{group}",
+		"TENANT_DEFAULT_ROUTE":     "/tenants/shared/{group}",
+		"TENANT_UNKNOWN":           "dead-letter",
+		"TENANT_DEAD_LETTER_GROUP": "dead-letters/{group}",
+	})
+
+	msg := makeMessage("api", ecslogs.EventData{"tenant": "initech", "user": "bob"})
+	res := p.Process(msg, time.Now())
+
+	if len(res) != 1 || res[0].Group != "dead-letters/api" {
+		t.Fatalf("the message should be dead-lettered: %+v", res)
+	}
+
+	info, _ := res[0].Event.Data[lib.DeadLetterField].(ecslogs.EventData)
+
+	if info["tenant"] != "initech" || info["group"] != "api" || !strings.Contains(info["reason"].(string), "initech") {
+		t.Error("invalid dead-letter info:", info)
+	}
+
+	if res[0].Event.Data["user"] != "bob" {
+		t.Error("the data of the message should be kept")
+	}
+
+	if _, ok := msg.Event.Data[lib.DeadLetterField]; ok {
+		t.Error("the data of the original message should not be modified")
+	}
+
+	// The known tenants are still routed.
+	if res := p.Process(makeMessage("api", ecslogs.EventData{"tenant": "acme"}), time.Now()); res[0].Group != "/tenants/acme/api" {
+		t.Error("invalid group:", res[0].Group)
+	}
+
+	p, _ = newTestProcessor(t, map[string]string{
+		"TENANT_ROUTES":  "acme=/tenants/acme/{group}",
+		"TENANT_UNKNOWN": "drop",
+	})
+
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	if res := p.Process(makeMessage("api", nil), time.Now()); len(res) != 0 {
+		t.Error("the message without a tenant should be dropped")
+	}
+}
+
+func TestRoutesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tenant")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "routes.json")
+	ioutil.WriteFile(path, []byte(`{"acme": "/tenants/acme/{group}", "globex": "/tenants/globex"}`), 0644)
+
+	p, _ := newTestProcessor(t, map[string]string{
+		"TENANT_ROUTES_FILE": path,
+		"TENANT_ROUTES":      "globex=/tenants/globex/{group}",
+	})
+
+	if p.routes["acme"] != "/tenants/acme/{group}" {
+		t.Error("the routes of the file should be loaded:", p.routes)
+	}
+
+	if p.routes["globex"] != "/tenants/globex/{group}" {
+		t.Error("the routes of the environment should take precedence:", p.routes)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	for _, env := range []map[string]string{
+		{},
+		{"TENANT_ROUTES": "acme"},
+		{"TENANT_ROUTES": "acme=/tenants/{team}"},
+		{"TENANT_ROUTES": "acme=/tenants/acme", "TENANT_DEFAULT_ROUTE": "/tenants/{tenant"},
+		{"TENANT_ROUTES": "acme=/tenants/acme", "TENANT_UNKNOWN": "reject"},
+		{"TENANT_ROUTES_FILE": "/nonexistent/routes.json"},
+	} {
+		lib.SetConfigEnv(env)
+
+		if _, err := getConfig(); err == nil {
+			t.Errorf("%v: the configuration should be rejected", env)
+		}
+	}
+}
+
+func makeMessage(group string, data ecslogs.EventData) lib.Message {
+	return lib.Message{
+		Group:  group,
+		Stream: "B",
+		Event:  ecslogs.Event{Message: "hello", Data: data},
+	}
+}
@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimestampPolicy controls which time is used as the timestamp of the events,
+// either the time ecs-logs read them or the time carried by the messages,
+// which sources and parsers extract from the log lines.
+type TimestampPolicy int
+
+const (
+	// PreferParsedTimestamp keeps the time of the message and falls back to
+	// the receive time for messages that don't carry one.
+	PreferParsedTimestamp TimestampPolicy = iota
+
+	// ReceiveTimestamp always uses the time the message was read, even when
+	// the message carries a time.
+	ReceiveTimestamp
+
+	// ParsedTimestamp only forwards messages that carry a time, the others
+	// are dropped.
+	ParsedTimestamp
+)
+
+func ParseTimestampPolicy(s string) (p TimestampPolicy, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "prefer-parsed-fallback-receive":
+		p = PreferParsedTimestamp
+	case "receive":
+		p = ReceiveTimestamp
+	case "parsed":
+		p = ParsedTimestamp
+	default:
+		err = fmt.Errorf("invalid timestamp policy, must be one of receive, parsed or prefer-parsed-fallback-receive: %s", s)
+	}
+	return
+}
+
+func (p TimestampPolicy) String() string {
+	switch p {
+	case ReceiveTimestamp:
+		return "receive"
+	case ParsedTimestamp:
+		return "parsed"
+	default:
+		return "prefer-parsed-fallback-receive"
+	}
+}
+
+// Apply sets the timestamp of msg, which was read at now, and returns false if
+// the message has no timestamp and should be dropped.
+func (p TimestampPolicy) Apply(msg *Message, now time.Time) bool {
+	switch p {
+	case ReceiveTimestamp:
+		msg.Event.Time = now
+	case ParsedTimestamp:
+		return !msg.Event.Time.IsZero()
+	default:
+		if msg.Event.Time.IsZero() {
+			msg.Event.Time = now
+		}
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+)
+
+func TestTimestampPolicy(t *testing.T) {
+	now := time.Date(2016, 10, 12, 12, 0, 0, 0, time.UTC)
+	parsed := now.Add(-time.Minute)
+
+	tests := []struct {
+		policy string
+		time   time.Time
+		out    time.Time
+		ok     bool
+	}{
+		{policy: "", time: parsed, out: parsed, ok: true},
+		{policy: "", out: now, ok: true},
+		{policy: "prefer-parsed-fallback-receive", time: parsed, out: parsed, ok: true},
+		{policy: "prefer-parsed-fallback-receive", out: now, ok: true},
+		{policy: "receive", time: parsed, out: now, ok: true},
+		{policy: "receive", out: now, ok: true},
+		{policy: "parsed", time: parsed, out: parsed, ok: true},
+		{policy: "parsed", ok: false},
+	}
+
+	for _, test := range tests {
+		p, err := ParseTimestampPolicy(test.policy)
+		if err != nil {
+			t.Errorf("%q: %s", test.policy, err)
+			continue
+		}
+
+		msg := Message{Event: ecslogs.Event{Time: test.time, Message: "Hello World!"}}
+
+		if ok := p.Apply(&msg, now); ok != test.ok {
+			t.Errorf("%s, %s: the message should be forwarded: %t", p, test.time, test.ok)
+		} else if ok && !msg.Event.Time.Equal(test.out) {
+			t.Errorf("%s, %s: invalid timestamp: %s", p, test.time, msg.Event.Time)
+		}
+	}
+
+	if _, err := ParseTimestampPolicy("sent"); err == nil {
+		t.Error("parsing an unknown timestamp policy should fail")
+	}
+}
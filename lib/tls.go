@@ -0,0 +1,267 @@
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// TLSClientConfig carries the TLS settings of the connections that a
+// destination opens, including the client certificate sent to servers that
+// require mutual TLS.
+type TLSClientConfig struct {
+	// The PEM files of the client certificate and its private key, both or
+	// neither must be set.
+	CertFile string
+	KeyFile  string
+
+	// The PEM bundle of the certificate authorities trusted to sign server
+	// certificates, the system roots are used when it's empty.
+	CAFile string
+
+	// The name checked against the server certificate, it defaults to the
+	// host that the destination connects to.
+	ServerName string
+
+	// Insecure disables the verification of server certificates, it's only
+	// meant for testing.
+	Insecure bool
+
+	// The prefix of the environment variables the settings were read from,
+	// used to report errors.
+	prefix string
+}
+
+// DestinationTLS returns the TLS settings configured for destination by the
+// <DESTINATION>_TLS_CERT, <DESTINATION>_TLS_KEY, <DESTINATION>_TLS_CA,
+// <DESTINATION>_TLS_SERVER_NAME and <DESTINATION>_TLS_INSECURE environment
+// variables.
+func DestinationTLS(destination string) (c TLSClientConfig, err error) {
+	c.prefix = strings.ToUpper(destination) + "_TLS_"
+	c.CertFile = strings.TrimSpace(Getenv(c.prefix + "CERT"))
+	c.KeyFile = strings.TrimSpace(Getenv(c.prefix + "KEY"))
+	c.CAFile = strings.TrimSpace(Getenv(c.prefix + "CA"))
+	c.ServerName = strings.TrimSpace(Getenv(c.prefix + "SERVER_NAME"))
+
+	if s := strings.TrimSpace(Getenv(c.prefix + "INSECURE")); len(s) != 0 {
+		if c.Insecure, err = strconv.ParseBool(s); err != nil {
+			err = fmt.Errorf("invalid %sINSECURE, must be a boolean: %s", c.prefix, s)
+			return
+		}
+	}
+
+	if (len(c.CertFile) == 0) != (len(c.KeyFile) == 0) {
+		err = fmt.Errorf("invalid %sCERT and %sKEY, the client certificate and its key must be set together", c.prefix, c.prefix)
+	}
+
+	return
+}
+
+// Enabled returns true if any of the settings is set, destinations keep their
+// default TLS configuration otherwise.
+func (c TLSClientConfig) Enabled() bool {
+	return len(c.CertFile) != 0 || len(c.CAFile) != 0 || len(c.ServerName) != 0 || c.Insecure
+}
+
+// Load returns the tls.Config described by c, after loading and validating the
+// certificates. The configurations are cached so loading the same settings
+// twice returns the same value, which lets connections be pooled by config.
+//
+// The client certificate is reloaded when its files change, so it can be
+// rotated without restarting ecs-logs.
+func (c TLSClientConfig) Load() (config *tls.Config, err error) {
+	tlsmtx.Lock()
+	defer tlsmtx.Unlock()
+
+	if config = tlsmap[c]; config != nil {
+		return
+	}
+
+	config = &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.Insecure,
+	}
+
+	if len(c.CAFile) != 0 {
+		var pem []byte
+
+		if pem, err = ioutil.ReadFile(c.CAFile); err != nil {
+			err = fmt.Errorf("invalid %sCA: %s", c.prefix, err)
+			return
+		}
+
+		config.RootCAs = x509.NewCertPool()
+
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			err = fmt.Errorf("invalid %sCA, no PEM certificates found in %s", c.prefix, c.CAFile)
+			return
+		}
+	}
+
+	if len(c.CertFile) != 0 {
+		r := &certReloader{certFile: c.CertFile, keyFile: c.KeyFile}
+
+		if err = r.load(); err != nil {
+			err = fmt.Errorf("invalid %sCERT or %sKEY: %s", c.prefix, c.prefix, err)
+			return
+		}
+
+		config.GetClientCertificate = r.getClientCertificate
+	}
+
+	tlsmap[c] = config
+	return
+}
+
+var (
+	tlsmtx sync.Mutex
+	tlsmap = map[TLSClientConfig]*tls.Config{}
+)
+
+// certReloader serves a client certificate, loaded again from its files when
+// their modification time changes.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex    sync.Mutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+func (r *certReloader) load() (err error) {
+	var cert tls.Certificate
+	var certTime, keyTime time.Time
+
+	if certTime, keyTime, err = r.modTimes(); err != nil {
+		return
+	}
+
+	if cert, err = tls.LoadX509KeyPair(r.certFile, r.keyFile); err != nil {
+		return
+	}
+
+	r.cert, r.certTime, r.keyTime = &cert, certTime, keyTime
+	return
+}
+
+func (r *certReloader) modTimes() (certTime time.Time, keyTime time.Time, err error) {
+	var info os.FileInfo
+
+	if info, err = os.Stat(r.certFile); err != nil {
+		return
+	}
+	certTime = info.ModTime()
+
+	if info, err = os.Stat(r.keyFile); err != nil {
+		return
+	}
+	keyTime = info.ModTime()
+	return
+}
+
+func (r *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// The certificate that was last loaded successfully keeps being used when
+	// the new files are invalid, they may be in the middle of being replaced.
+	if certTime, keyTime, err := r.modTimes(); err != nil || !certTime.Equal(r.certTime) || !keyTime.Equal(r.keyTime) {
+		if err == nil {
+			err = r.load()
+		}
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"cert":  r.certFile,
+				"key":   r.keyFile,
+				"error": err,
+			}).Warn("failed to reload the TLS client certificate")
+		}
+	}
+
+	return r.cert, nil
+}
+
+// getCertificate serves the certificate like getClientCertificate, for the
+// servers of the sources.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.getClientCertificate(nil)
+}
+
+// TLSServerConfig carries the TLS settings of the listeners of a source.
+type TLSServerConfig struct {
+	// The PEM files of the server certificate and its private key.
+	CertFile string
+	KeyFile  string
+
+	// The PEM bundle of the certificate authorities trusted to sign client
+	// certificates, when it's set the clients must present one.
+	ClientCAFile string
+
+	prefix string
+}
+
+// ServerTLS returns the TLS settings of the listeners configured by the
+// <NAME>_TLS_CERT, <NAME>_TLS_KEY and <NAME>_TLS_CLIENT_CA environment
+// variables.
+func ServerTLS(name string) (c TLSServerConfig, err error) {
+	c.prefix = strings.ToUpper(name) + "_TLS_"
+	c.CertFile = strings.TrimSpace(Getenv(c.prefix + "CERT"))
+	c.KeyFile = strings.TrimSpace(Getenv(c.prefix + "KEY"))
+	c.ClientCAFile = strings.TrimSpace(Getenv(c.prefix + "CLIENT_CA"))
+
+	if (len(c.CertFile) == 0) != (len(c.KeyFile) == 0) {
+		err = fmt.Errorf("invalid %sCERT and %sKEY, the server certificate and its key must be set together", c.prefix, c.prefix)
+	} else if len(c.ClientCAFile) != 0 && len(c.CertFile) == 0 {
+		err = fmt.Errorf("invalid %sCLIENT_CA, the server certificate must be set with %sCERT and %sKEY", c.prefix, c.prefix, c.prefix)
+	}
+
+	return
+}
+
+// Enabled returns true if the server certificate is set.
+func (c TLSServerConfig) Enabled() bool {
+	return len(c.CertFile) != 0
+}
+
+// Load returns the tls.Config described by c, the server certificate is
+// reloaded when its files change like the client certificates.
+func (c TLSServerConfig) Load() (config *tls.Config, err error) {
+	r := &certReloader{certFile: c.CertFile, keyFile: c.KeyFile}
+
+	if err = r.load(); err != nil {
+		err = fmt.Errorf("invalid %sCERT or %sKEY: %s", c.prefix, c.prefix, err)
+		return
+	}
+
+	config = &tls.Config{GetCertificate: r.getCertificate}
+
+	if len(c.ClientCAFile) != 0 {
+		var pem []byte
+
+		if pem, err = ioutil.ReadFile(c.ClientCAFile); err != nil {
+			err = fmt.Errorf("invalid %sCLIENT_CA: %s", c.prefix, err)
+			return
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			err = fmt.Errorf("invalid %sCLIENT_CA, no PEM certificates found in %s", c.prefix, c.ClientCAFile)
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,341 @@
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate is a certificate and its key, signed by the parent passed to
+// makeTestCertificate.
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func makeTestCertificate(t *testing.T, name string, serial int64, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, key
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	return &testCertificate{cert: cert, key: key, der: der}
+}
+
+func (c *testCertificate) write(t *testing.T, certFile string, keyFile string) {
+	b, _ := x509.MarshalECPrivateKey(c.key)
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keyFile) != 0 {
+		if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// startTLSServer starts a listener requiring client certificates signed by ca,
+// the serial number of the client certificate of each connection, or the
+// handshake error, is sent on the returned channel.
+func startTLSServer(t *testing.T, ca *testCertificate, server *testCertificate) (net.Listener, <-chan interface{}) {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.der}, PrivateKey: server.key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan interface{}, 10)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			c := conn.(*tls.Conn)
+
+			if err := c.Handshake(); err != nil {
+				results <- err
+			} else {
+				results <- c.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+			}
+
+			c.Close()
+		}
+	}()
+
+	return l, results
+}
+
+func dialTLS(addr string, config *tls.Config) error {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// With TLS 1.3 the server verifies the client certificate after the
+	// client completed its side of the handshake, the error only shows up
+	// when reading. The server closes connections it accepted.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	if _, err = conn.Read(make([]byte, 1)); err == io.EOF {
+		err = nil
+	}
+
+	return err
+}
+
+func TestTLSClientConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := makeTestCertificate(t, "ca", 1, nil)
+	server := makeTestCertificate(t, "logs.local", 2, ca)
+	client := makeTestCertificate(t, "client", 3, ca)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ca.write(t, caFile, "")
+	client.write(t, certFile, keyFile)
+
+	l, results := startTLSServer(t, ca, server)
+	defer l.Close()
+
+	SetConfigEnv(map[string]string{
+		"TESTDEST_TLS_CERT":        certFile,
+		"TESTDEST_TLS_KEY":         keyFile,
+		"TESTDEST_TLS_CA":          caFile,
+		"TESTDEST_TLS_SERVER_NAME": "logs.local",
+	})
+	defer SetConfigEnv(nil)
+
+	c, err := DestinationTLS("testdest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := c.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again, _ := c.Load(); again != config {
+		t.Error("loading the same settings twice should return the same config")
+	}
+
+	if err := dialTLS(l.Addr().String(), config); err != nil {
+		t.Fatal(err)
+	}
+
+	if serial := <-results; serial != int64(3) {
+		t.Fatalf("the server should have seen the client certificate: %v", serial)
+	}
+
+	// The rotated certificate is picked up by the next connection.
+	rotated := makeTestCertificate(t, "client", 4, ca)
+	rotated.write(t, certFile, keyFile)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+
+	dialTLS(l.Addr().String(), config)
+
+	if serial := <-results; serial != int64(4) {
+		t.Errorf("the rotated client certificate should have been used: %v", serial)
+	}
+
+	// Without a client certificate the server rejects the connection.
+	c.CertFile, c.KeyFile = "", ""
+
+	if config, err = c.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dialTLS(l.Addr().String(), config); err == nil {
+		t.Errorf("the handshake should have failed without a client certificate: %v", err)
+	}
+
+	if _, ok := (<-results).(error); !ok {
+		t.Error("the server should have rejected the connection")
+	}
+}
+
+func TestTLSClientConfigInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	garbage := filepath.Join(dir, "garbage.pem")
+	ioutil.WriteFile(garbage, []byte("not a certificate"), 0600)
+	defer SetConfigEnv(nil)
+
+	for _, test := range []struct {
+		env map[string]string
+		err string
+	}{
+		{map[string]string{"TESTDEST_TLS_CERT": garbage}, "TESTDEST_TLS_CERT and TESTDEST_TLS_KEY"},
+		{map[string]string{"TESTDEST_TLS_INSECURE": "maybe"}, "TESTDEST_TLS_INSECURE"},
+		{map[string]string{"TESTDEST_TLS_CERT": filepath.Join(dir, "missing.pem"), "TESTDEST_TLS_KEY": garbage}, "invalid TESTDEST_TLS_CERT or TESTDEST_TLS_KEY"},
+		{map[string]string{"TESTDEST_TLS_CERT": garbage, "TESTDEST_TLS_KEY": garbage}, "invalid TESTDEST_TLS_CERT or TESTDEST_TLS_KEY"},
+		{map[string]string{"TESTDEST_TLS_CA": garbage}, "invalid TESTDEST_TLS_CA, no PEM certificates"},
+	} {
+		SetConfigEnv(test.env)
+
+		c, err := DestinationTLS("testdest")
+		if err == nil {
+			_, err = c.Load()
+		}
+
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: the error should mention %q: %v", test.env, test.err, err)
+		}
+	}
+
+	SetConfigEnv(nil)
+
+	if c, err := DestinationTLS("testdest"); err != nil || c.Enabled() {
+		t.Errorf("the TLS settings should be disabled when none is set: %+v (%v)", c, err)
+	}
+}
+
+func TestTLSServerConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := makeTestCertificate(t, "ca", 1, nil)
+	server := makeTestCertificate(t, "logs.local", 2, ca)
+	client := makeTestCertificate(t, "client", 3, ca)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ca.write(t, caFile, "")
+	server.write(t, certFile, keyFile)
+
+	SetConfigEnv(map[string]string{
+		"TESTSRC_TLS_CERT":      certFile,
+		"TESTSRC_TLS_KEY":       keyFile,
+		"TESTSRC_TLS_CLIENT_CA": caFile,
+	})
+	defer SetConfigEnv(nil)
+
+	c, err := ServerTLS("testsrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := c.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	if err := dialTLS(l.Addr().String(), &tls.Config{
+		RootCAs:      pool,
+		ServerName:   "logs.local",
+		Certificates: []tls.Certificate{{Certificate: [][]byte{client.der}, PrivateKey: client.key}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dialTLS(l.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "logs.local"}); err == nil {
+		t.Error("the server should require a client certificate")
+	}
+
+	for _, test := range []struct {
+		env map[string]string
+		err string
+	}{
+		{map[string]string{"TESTSRC_TLS_CERT": certFile}, "TESTSRC_TLS_CERT and TESTSRC_TLS_KEY"},
+		{map[string]string{"TESTSRC_TLS_CLIENT_CA": caFile}, "invalid TESTSRC_TLS_CLIENT_CA"},
+		{map[string]string{"TESTSRC_TLS_CERT": certFile, "TESTSRC_TLS_KEY": keyFile, "TESTSRC_TLS_CLIENT_CA": keyFile}, "no PEM certificates"},
+	} {
+		SetConfigEnv(test.env)
+
+		c, err := ServerTLS("testsrc")
+		if err == nil {
+			_, err = c.Load()
+		}
+
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: the error should mention %q: %v", test.env, test.err, err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package unixsocket
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+// Framing is how the messages are delimited on the socket.
+type Framing int
+
+const (
+	// NewlineFraming terminates each message with a line feed, the messages
+	// are serialized on a single line.
+	NewlineFraming Framing = iota
+
+	// LengthPrefixFraming precedes each message with its length as a 32 bits
+	// big endian integer, like the length_delimited codec of vector.
+	LengthPrefixFraming
+)
+
+func ParseFraming(s string) (f Framing, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "newline":
+		f = NewlineFraming
+	case "length-prefix":
+		f = LengthPrefixFraming
+	default:
+		err = fmt.Errorf("invalid UNIXSOCKET_FRAMING, must be one of newline or length-prefix: %s", s)
+	}
+	return
+}
+
+func (f Framing) String() string {
+	if f == LengthPrefixFraming {
+		return "length-prefix"
+	}
+	return "newline"
+}
+
+// config carries the settings of the unixsocket destination, they are loaded
+// from UNIXSOCKET_* environment variables.
+type config struct {
+	// The path of the socket that messages are written to.
+	path string
+
+	framing Framing
+
+	// How long a batch is held while the socket can't be reached, for example
+	// while the agent listening on it restarts, before it's dropped.
+	reconnectTimeout time.Duration
+
+	// Whether the lines that messages were parsed from are sent instead of
+	// the JSON representation of their event.
+	raw bool
+
+	err error
+}
+
+func getConfig() (c config) {
+	var err error
+	var s string
+
+	c.path = strings.TrimSpace(lib.Getenv("UNIXSOCKET_PATH"))
+	c.reconnectTimeout = 30 * time.Second
+
+	if len(c.path) == 0 {
+		c.err = lib.AppendError(c.err, fmt.Errorf("missing UNIXSOCKET_PATH environment variable"))
+	}
+
+	if c.framing, err = ParseFraming(lib.Getenv("UNIXSOCKET_FRAMING")); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("UNIXSOCKET_RECONNECT_TIMEOUT")); len(s) != 0 {
+		if c.reconnectTimeout, err = time.ParseDuration(s); err != nil || c.reconnectTimeout < 0 {
+			c.err = lib.AppendError(c.err, fmt.Errorf("invalid UNIXSOCKET_RECONNECT_TIMEOUT, must be a positive duration or zero: %s", s))
+		}
+	}
+
+	if c.raw, err = lib.DestinationRawPassthrough("unixsocket"); err != nil {
+		c.err = lib.AppendError(c.err, err)
+	}
+
+	return
+}
+
+func (c config) check() error {
+	return c.err
+}
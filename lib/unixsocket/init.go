@@ -0,0 +1,7 @@
+package unixsocket
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterDestination("unixsocket", newDestination(getConfig))
+}
@@ -0,0 +1,174 @@
+// Package unixsocket implements the unixsocket destination, which writes the
+// messages to a Unix domain socket, where a co-located agent like vector or
+// fluent-bit picks them up.
+package unixsocket
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/clock"
+)
+
+// How long a write may block on the socket, an agent that stopped reading
+// from it is treated like one that went away.
+const writeTimeout = 10 * time.Second
+
+// destination writes to a single connection shared by the writers of all the
+// streams, the batches are written one at a time so their messages aren't
+// interleaved.
+type destination struct {
+	lazy   lib.LazyConfig
+	load   func() config
+	config config
+
+	mutex   sync.Mutex
+	conn    net.Conn
+	backoff backoff.Backoff
+	clock   clock.Clock
+}
+
+func newDestination(load func() config) *destination {
+	return &destination{
+		load:  load,
+		clock: clock.System,
+		backoff: backoff.Backoff{
+			Min:    100 * time.Millisecond,
+			Max:    5 * time.Second,
+			Factor: 2,
+			Jitter: true,
+		},
+	}
+}
+
+func (d *destination) Open(group string, stream string) (w lib.Writer, err error) {
+	if err = d.lazy.Init(d.init); err != nil {
+		return
+	}
+
+	w = writer{dest: d}
+	return
+}
+
+// CheckConfig reports the problems with the UNIXSOCKET_* settings when
+// ecs-logs starts.
+func (d *destination) CheckConfig() error {
+	return d.load().check()
+}
+
+func (d *destination) Close(group string, stream string) {}
+
+func (d *destination) init() error {
+	d.config = d.load()
+	return d.config.check()
+}
+
+// write sends b on the connection, dialing the socket again if the connection
+// was lost. While the socket can't be reached the write is retried with an
+// exponential backoff for up to the reconnect timeout.
+//
+// A write that failed is sent again whole on the new connection, the messages
+// that made it to the agent before the connection broke are duplicated.
+func (d *destination) write(b []byte) (err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	bo := d.backoff
+	bo.Reset()
+	deadline := d.clock.Now().Add(d.config.reconnectTimeout)
+
+	for {
+		if d.conn == nil {
+			d.conn, err = net.DialTimeout("unix", d.config.path, writeTimeout)
+		}
+
+		if err == nil {
+			d.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+
+			if _, err = d.conn.Write(b); err == nil {
+				return
+			}
+
+			d.conn.Close()
+			d.conn = nil
+		}
+
+		if !d.clock.Now().Before(deadline) {
+			err = fmt.Errorf("writing to the unix socket %s: %s", d.config.path, err)
+			return
+		}
+
+		d.clock.Sleep(context.Background(), bo.Duration())
+	}
+}
+
+// encode appends msg to buf, framed as configured.
+func (d *destination) encode(buf *bytes.Buffer, msg lib.Message) (size int) {
+	var b []byte
+
+	if line, ok := msg.RawLine(); d.config.raw && ok {
+		b = []byte(line)
+	} else {
+		b = msg.Bytes()
+	}
+
+	switch d.config.framing {
+	case LengthPrefixFraming:
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(b)))
+		buf.Write(n[:])
+		buf.Write(b)
+		size = len(n) + len(b)
+
+	default:
+		buf.Write(b)
+		buf.WriteByte('\n')
+		size = len(b) + 1
+	}
+
+	return
+}
+
+type writer struct {
+	dest *destination
+}
+
+func (w writer) Close() error {
+	return nil
+}
+
+func (w writer) WriteMessage(msg lib.Message) error {
+	return w.WriteMessageBatch(lib.MessageBatch{msg})
+}
+
+func (w writer) WriteMessageBatch(batch lib.MessageBatch) (err error) {
+	_, err = w.WriteMessageBatchSize(batch)
+	return
+}
+
+// WriteMessageBatchSize writes the framed messages of batch to the socket with
+// a single write, and returns the number of bytes written.
+func (w writer) WriteMessageBatchSize(batch lib.MessageBatch) (size int, err error) {
+	var buf bytes.Buffer
+
+	for _, msg := range batch {
+		size += w.dest.encode(&buf, msg)
+	}
+
+	if size == 0 {
+		return
+	}
+
+	if err = w.dest.write(buf.Bytes()); err != nil {
+		size = 0
+	}
+
+	return
+}
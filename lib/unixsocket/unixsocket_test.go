@@ -0,0 +1,247 @@
+package unixsocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+// server accepts connections on a unix socket and accumulates what they
+// received.
+type server struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	conns    []net.Conn
+	data     bytes.Buffer
+}
+
+func listen(t *testing.T, path string) *server {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &server{listener: l}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			s.mutex.Lock()
+			s.conns = append(s.conns, conn)
+			s.mutex.Unlock()
+
+			go func() {
+				b := make([]byte, 4096)
+				for {
+					n, err := conn.Read(b)
+					s.mutex.Lock()
+					s.data.Write(b[:n])
+					s.mutex.Unlock()
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return s
+}
+
+// close stops the server like an agent going away, the socket file is removed
+// with the listener.
+func (s *server) close() {
+	s.listener.Close()
+	s.mutex.Lock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+}
+
+// wait returns the first n bytes received by the server.
+func (s *server) wait(t *testing.T, n int) []byte {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		s.mutex.Lock()
+		b := append([]byte(nil), s.data.Bytes()...)
+		s.mutex.Unlock()
+
+		if len(b) >= n {
+			return b[:n]
+		}
+	}
+	t.Fatalf("the server didn't receive %d bytes", n)
+	return nil
+}
+
+func testPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "unixsocket_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "agent.sock"), func() { os.RemoveAll(dir) }
+}
+
+func newTestDestination(c config) *destination {
+	if c.reconnectTimeout == 0 {
+		c.reconnectTimeout = 5 * time.Second
+	}
+
+	d := newDestination(func() config { return c })
+	d.backoff.Min, d.backoff.Max = time.Millisecond, 10*time.Millisecond
+	return d
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	path, cleanup := testPath(t)
+	defer cleanup()
+
+	s := listen(t, path)
+	defer s.close()
+
+	batch := lib.MessageBatch{makeMessage("hello"), makeMessage("world")}
+
+	for _, framing := range []Framing{NewlineFraming, LengthPrefixFraming} {
+		s.mutex.Lock()
+		s.data.Reset()
+		s.mutex.Unlock()
+
+		d := newTestDestination(config{path: path, framing: framing})
+		w, err := d.Open("A", "B")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		size, err := w.(lib.SizedWriter).WriteMessageBatchSize(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ref bytes.Buffer
+
+		for _, msg := range batch {
+			b := msg.Bytes()
+
+			if framing == LengthPrefixFraming {
+				binary.Write(&ref, binary.BigEndian, uint32(len(b)))
+				ref.Write(b)
+			} else {
+				ref.Write(b)
+				ref.WriteByte('\n')
+			}
+		}
+
+		if size != ref.Len() {
+			t.Errorf("%s: invalid size: %d != %d", framing, size, ref.Len())
+		}
+
+		if b := s.wait(t, ref.Len()); !bytes.Equal(b, ref.Bytes()) {
+			t.Errorf("%s: invalid content received:\n- expected: %q\n- found:    %q", framing, ref.Bytes(), b)
+		}
+
+		d.conn.Close()
+	}
+}
+
+func TestWriterReconnect(t *testing.T) {
+	path, cleanup := testPath(t)
+	defer cleanup()
+
+	s1 := listen(t, path)
+	d := newTestDestination(config{path: path})
+
+	w, err := d.Open("A", "B")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteMessage(makeMessage("before")); err != nil {
+		t.Fatal(err)
+	}
+
+	first := append(makeMessage("before").Bytes(), '\n')
+	s1.wait(t, len(first))
+
+	// The agent restarts, the batch written meanwhile is held until the
+	// socket is back.
+	s1.close()
+	done := make(chan error, 1)
+
+	go func() { done <- w.WriteMessage(makeMessage("after")) }()
+
+	time.Sleep(50 * time.Millisecond)
+
+	select {
+	case err := <-done:
+		t.Fatalf("the write should wait for the socket to come back: %v", err)
+	default:
+	}
+
+	s2 := listen(t, path)
+	defer s2.close()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	second := append(makeMessage("after").Bytes(), '\n')
+
+	if b := s2.wait(t, len(second)); !bytes.Equal(b, second) {
+		t.Errorf("invalid content received after reconnecting: %q", b)
+	}
+}
+
+func TestWriterReconnectTimeout(t *testing.T) {
+	path, cleanup := testPath(t)
+	defer cleanup()
+
+	d := newTestDestination(config{path: path, reconnectTimeout: 20 * time.Millisecond})
+	w, _ := d.Open("A", "B")
+
+	if err := w.WriteMessage(makeMessage("lost")); err == nil {
+		t.Error("the write should fail once the reconnect timeout expired")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	lib.SetConfigEnv(map[string]string{
+		"UNIXSOCKET_PATH":              "/var/run/vector.sock",
+		"UNIXSOCKET_FRAMING":           "length-prefix",
+		"UNIXSOCKET_RECONNECT_TIMEOUT": "1m",
+	})
+
+	if c := getConfig(); c.check() != nil || c.path != "/var/run/vector.sock" || c.framing != LengthPrefixFraming || c.reconnectTimeout != time.Minute {
+		t.Errorf("invalid config: %+v", c)
+	}
+
+	lib.SetConfigEnv(map[string]string{"UNIXSOCKET_FRAMING": "netstring"})
+
+	if err := getConfig().check(); err == nil {
+		t.Error("a missing path and an invalid framing should be rejected")
+	} else if list, ok := err.(lib.ErrorList); !ok || len(list) != 2 {
+		t.Errorf("both problems should be reported: %v", err)
+	}
+}
+
+func makeMessage(message string) lib.Message {
+	return lib.Message{
+		Group:  "A",
+		Stream: "B",
+		Event:  ecslogs.Event{Message: message, Time: time.Date(2016, 10, 12, 0, 0, 0, 0, time.UTC)},
+	}
+}
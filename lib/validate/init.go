@@ -0,0 +1,11 @@
+package validate
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterStage("validate", lib.NewCheckedStage(lib.StageFunc(NewProcessor), checkConfig))
+
+	// The messages are validated the way they're sent, after the stages that
+	// add or reshape fields.
+	lib.RegisterStageOrder("validate", lib.StageOrder{After: []string{"correlation", "merge", "metadata", "schema", "xray"}})
+}
@@ -0,0 +1,609 @@
+package validate
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a compiled JSON Schema. The validation keywords of draft 7 are
+// supported, except the ones that reference other schemas ($ref and
+// dependencies) which are rejected when compiling. Annotations like title
+// or format are ignored.
+type Schema struct {
+	// Set for the true and false schemas, which accept and reject anything.
+	always *bool
+
+	types    []string
+	enum     []interface{}
+	constant []interface{} // holds the const value, if any
+
+	// Objects.
+	properties    map[string]*Schema
+	patternProps  []patternSchema
+	additional    *Schema
+	required      []string
+	minProperties int
+	maxProperties int
+
+	// Arrays.
+	items    *Schema
+	tuple    []*Schema
+	minItems int
+	maxItems int
+	unique   bool
+
+	// Strings.
+	minLength int
+	maxLength int
+	pattern   *regexp.Regexp
+
+	// Numbers.
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+
+	allOf []*Schema
+	anyOf []*Schema
+	oneOf []*Schema
+	not   *Schema
+}
+
+type patternSchema struct {
+	pattern *regexp.Regexp
+	schema  *Schema
+}
+
+// The keywords that ecs-logs doesn't implement, ignoring them would let
+// messages through that the destination rejects.
+var unsupportedKeywords = []string{"$ref", "dependencies", "if", "then", "else", "contains", "propertyNames"}
+
+// CompileSchema parses the JSON Schema document in b.
+func CompileSchema(b []byte) (s *Schema, err error) {
+	var v interface{}
+	d := json.NewDecoder(strings.NewReader(string(b)))
+	d.UseNumber()
+
+	if err = d.Decode(&v); err != nil {
+		err = fmt.Errorf("invalid JSON schema: %s", err)
+		return
+	}
+
+	return compile(v, "#")
+}
+
+func compile(v interface{}, path string) (s *Schema, err error) {
+	s = &Schema{minProperties: -1, maxProperties: -1, minItems: -1, maxItems: -1, minLength: -1, maxLength: -1}
+
+	switch x := v.(type) {
+	case bool:
+		s.always = &x
+		return
+	case map[string]interface{}:
+		err = s.compileObject(x, path)
+	default:
+		err = fmt.Errorf("%s: a schema must be an object or a boolean", path)
+	}
+
+	return
+}
+
+func (s *Schema) compileObject(m map[string]interface{}, path string) (err error) {
+	for _, k := range unsupportedKeywords {
+		if _, ok := m[k]; ok {
+			return fmt.Errorf("%s: the %s keyword isn't supported", path, k)
+		}
+	}
+
+	if v, ok := m["type"]; ok {
+		switch t := v.(type) {
+		case string:
+			s.types = []string{t}
+		case []interface{}:
+			for _, x := range t {
+				if name, ok := x.(string); ok {
+					s.types = append(s.types, name)
+				} else {
+					return fmt.Errorf("%s/type: must be a string or a list of strings", path)
+				}
+			}
+		default:
+			return fmt.Errorf("%s/type: must be a string or a list of strings", path)
+		}
+
+		for _, t := range s.types {
+			switch t {
+			case "null", "boolean", "object", "array", "number", "integer", "string":
+			default:
+				return fmt.Errorf("%s/type: unknown type %q", path, t)
+			}
+		}
+	}
+
+	if v, ok := m["enum"]; ok {
+		if s.enum, ok = v.([]interface{}); !ok {
+			return fmt.Errorf("%s/enum: must be a list", path)
+		}
+	}
+
+	if v, ok := m["const"]; ok {
+		s.constant = []interface{}{v}
+	}
+
+	if v, ok := m["properties"]; ok {
+		props, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s/properties: must be an object", path)
+		}
+
+		s.properties = make(map[string]*Schema, len(props))
+
+		for name, p := range props {
+			if s.properties[name], err = compile(p, path+"/properties/"+name); err != nil {
+				return
+			}
+		}
+	}
+
+	if v, ok := m["patternProperties"]; ok {
+		props, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s/patternProperties: must be an object", path)
+		}
+
+		for _, expr := range sortedKeys(props) {
+			var p patternSchema
+
+			if p.pattern, err = regexp.Compile(expr); err != nil {
+				return fmt.Errorf("%s/patternProperties: %s", path, err)
+			}
+
+			if p.schema, err = compile(props[expr], path+"/patternProperties/"+expr); err != nil {
+				return
+			}
+
+			s.patternProps = append(s.patternProps, p)
+		}
+	}
+
+	if v, ok := m["additionalProperties"]; ok {
+		if s.additional, err = compile(v, path+"/additionalProperties"); err != nil {
+			return
+		}
+	}
+
+	if v, ok := m["required"]; ok {
+		list, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s/required: must be a list of strings", path)
+		}
+
+		for _, x := range list {
+			name, ok := x.(string)
+			if !ok {
+				return fmt.Errorf("%s/required: must be a list of strings", path)
+			}
+			s.required = append(s.required, name)
+		}
+	}
+
+	if v, ok := m["items"]; ok {
+		if list, ok := v.([]interface{}); ok {
+			for i, x := range list {
+				var item *Schema
+
+				if item, err = compile(x, path+"/items/"+strconv.Itoa(i)); err != nil {
+					return
+				}
+
+				s.tuple = append(s.tuple, item)
+			}
+		} else if s.items, err = compile(v, path+"/items"); err != nil {
+			return
+		}
+	}
+
+	if v, ok := m["additionalItems"]; ok && s.tuple != nil {
+		if s.items, err = compile(v, path+"/additionalItems"); err != nil {
+			return
+		}
+	}
+
+	if v, ok := m["uniqueItems"]; ok {
+		if s.unique, ok = v.(bool); !ok {
+			return fmt.Errorf("%s/uniqueItems: must be a boolean", path)
+		}
+	}
+
+	for k, p := range map[string]*int{
+		"minProperties": &s.minProperties,
+		"maxProperties": &s.maxProperties,
+		"minItems":      &s.minItems,
+		"maxItems":      &s.maxItems,
+		"minLength":     &s.minLength,
+		"maxLength":     &s.maxLength,
+	} {
+		if v, ok := m[k]; ok {
+			n, e := number(v)
+			if e != nil || n < 0 || n != math.Trunc(n) {
+				return fmt.Errorf("%s/%s: must be a positive integer", path, k)
+			}
+			*p = int(n)
+		}
+	}
+
+	for k, p := range map[string]**float64{
+		"minimum":          &s.minimum,
+		"maximum":          &s.maximum,
+		"exclusiveMinimum": &s.exclusiveMinimum,
+		"exclusiveMaximum": &s.exclusiveMaximum,
+		"multipleOf":       &s.multipleOf,
+	} {
+		if v, ok := m[k]; ok {
+			n, e := number(v)
+			if e != nil {
+				return fmt.Errorf("%s/%s: must be a number", path, k)
+			}
+			*p = &n
+		}
+	}
+
+	if s.multipleOf != nil && *s.multipleOf <= 0 {
+		return fmt.Errorf("%s/multipleOf: must be greater than zero", path)
+	}
+
+	if v, ok := m["pattern"]; ok {
+		expr, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s/pattern: must be a string", path)
+		}
+
+		if s.pattern, err = regexp.Compile(expr); err != nil {
+			return fmt.Errorf("%s/pattern: %s", path, err)
+		}
+	}
+
+	for k, p := range map[string]*[]*Schema{
+		"allOf": &s.allOf,
+		"anyOf": &s.anyOf,
+		"oneOf": &s.oneOf,
+	} {
+		if v, ok := m[k]; ok {
+			list, ok := v.([]interface{})
+			if !ok || len(list) == 0 {
+				return fmt.Errorf("%s/%s: must be a non-empty list of schemas", path, k)
+			}
+
+			for i, x := range list {
+				var sub *Schema
+
+				if sub, err = compile(x, path+"/"+k+"/"+strconv.Itoa(i)); err != nil {
+					return
+				}
+
+				*p = append(*p, sub)
+			}
+		}
+	}
+
+	if v, ok := m["not"]; ok {
+		if s.not, err = compile(v, path+"/not"); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Validate returns the list of problems found with v, which must be a value
+// decoded from JSON with numbers decoded as json.Number. Each problem is
+// prefixed with the dotted path of the value it was found at.
+func (s *Schema) Validate(v interface{}) (problems []string) {
+	s.validate(v, "", &problems)
+	return
+}
+
+func (s *Schema) validate(v interface{}, path string, problems *[]string) {
+	report := func(format string, args ...interface{}) {
+		p := path
+
+		if len(p) == 0 {
+			p = "(root)"
+		}
+
+		*problems = append(*problems, p+": "+fmt.Sprintf(format, args...))
+	}
+
+	if s.always != nil {
+		if !*s.always {
+			report("no value is allowed")
+		}
+		return
+	}
+
+	if len(s.types) != 0 && !hasType(v, s.types) {
+		report("must be of type %s but is %s", strings.Join(s.types, " or "), typeOf(v))
+		return
+	}
+
+	if s.enum != nil && !contains(s.enum, v) {
+		report("must be one of %s", marshal(s.enum))
+	}
+
+	if len(s.constant) != 0 && !equal(s.constant[0], v) {
+		report("must be %s", marshal(s.constant[0]))
+	}
+
+	switch x := v.(type) {
+	case map[string]interface{}:
+		s.validateObject(x, path, problems, report)
+	case []interface{}:
+		s.validateArray(x, path, problems, report)
+	case string:
+		if n := utf8.RuneCountInString(x); s.minLength >= 0 && n < s.minLength {
+			report("must be at least %d characters long", s.minLength)
+		} else if s.maxLength >= 0 && n > s.maxLength {
+			report("must be at most %d characters long", s.maxLength)
+		}
+
+		if s.pattern != nil && !s.pattern.MatchString(x) {
+			report("must match %s", s.pattern)
+		}
+	case json.Number:
+		n, _ := x.Float64()
+
+		if s.minimum != nil && n < *s.minimum {
+			report("must be at least %v", *s.minimum)
+		}
+
+		if s.maximum != nil && n > *s.maximum {
+			report("must be at most %v", *s.maximum)
+		}
+
+		if s.exclusiveMinimum != nil && n <= *s.exclusiveMinimum {
+			report("must be greater than %v", *s.exclusiveMinimum)
+		}
+
+		if s.exclusiveMaximum != nil && n >= *s.exclusiveMaximum {
+			report("must be less than %v", *s.exclusiveMaximum)
+		}
+
+		if s.multipleOf != nil {
+			if q := n / *s.multipleOf; math.Abs(q-math.Round(q)) > 1e-9 {
+				report("must be a multiple of %v", *s.multipleOf)
+			}
+		}
+	}
+
+	for _, sub := range s.allOf {
+		sub.validate(v, path, problems)
+	}
+
+	if s.anyOf != nil {
+		matched := false
+
+		for _, sub := range s.anyOf {
+			if len(sub.Validate(v)) == 0 {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			report("must match at least one of the anyOf schemas")
+		}
+	}
+
+	if s.oneOf != nil {
+		matched := 0
+
+		for _, sub := range s.oneOf {
+			if len(sub.Validate(v)) == 0 {
+				matched++
+			}
+		}
+
+		if matched != 1 {
+			report("must match exactly one of the oneOf schemas but matched %d", matched)
+		}
+	}
+
+	if s.not != nil && len(s.not.Validate(v)) == 0 {
+		report("must not match the not schema")
+	}
+}
+
+func (s *Schema) validateObject(m map[string]interface{}, path string, problems *[]string, report func(string, ...interface{})) {
+	if s.minProperties >= 0 && len(m) < s.minProperties {
+		report("must have at least %d properties", s.minProperties)
+	}
+
+	if s.maxProperties >= 0 && len(m) > s.maxProperties {
+		report("must have at most %d properties", s.maxProperties)
+	}
+
+	for _, name := range s.required {
+		if _, ok := m[name]; !ok {
+			report("missing required property %s", name)
+		}
+	}
+
+	for _, name := range sortedKeys(m) {
+		matched := false
+		sub := join(path, name)
+
+		if p := s.properties[name]; p != nil {
+			p.validate(m[name], sub, problems)
+			matched = true
+		}
+
+		for _, p := range s.patternProps {
+			if p.pattern.MatchString(name) {
+				p.schema.validate(m[name], sub, problems)
+				matched = true
+			}
+		}
+
+		if !matched && s.additional != nil {
+			if s.additional.always != nil && !*s.additional.always {
+				report("property %s is not allowed", name)
+			} else {
+				s.additional.validate(m[name], sub, problems)
+			}
+		}
+	}
+}
+
+func (s *Schema) validateArray(list []interface{}, path string, problems *[]string, report func(string, ...interface{})) {
+	if s.minItems >= 0 && len(list) < s.minItems {
+		report("must have at least %d items", s.minItems)
+	}
+
+	if s.maxItems >= 0 && len(list) > s.maxItems {
+		report("must have at most %d items", s.maxItems)
+	}
+
+	for i, x := range list {
+		sub := join(path, strconv.Itoa(i))
+
+		switch {
+		case i < len(s.tuple):
+			s.tuple[i].validate(x, sub, problems)
+		case s.items != nil:
+			s.items.validate(x, sub, problems)
+		}
+	}
+
+	if s.unique {
+		for i := range list {
+			for j := i + 1; j < len(list); j++ {
+				if equal(list[i], list[j]) {
+					report("items %d and %d must be unique", i, j)
+					return
+				}
+			}
+		}
+	}
+}
+
+func hasType(v interface{}, types []string) bool {
+	t := typeOf(v)
+
+	for _, name := range types {
+		if name == t || (name == "number" && t == "integer") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func typeOf(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		if n, err := x.Float64(); err == nil && n == math.Trunc(n) {
+			return "integer"
+		}
+		return "number"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// equal compares JSON values, numbers are equal when their values are so 1
+// and 1.0 are the same.
+func equal(a interface{}, b interface{}) bool {
+	switch x := a.(type) {
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		n, _ := x.Float64()
+		m, _ := y.Float64()
+		return n == m
+
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			if w, ok := y[k]; !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equal(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+
+	default:
+		return a == b
+	}
+}
+
+func contains(list []interface{}, v interface{}) bool {
+	for _, x := range list {
+		if equal(x, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func number(v interface{}) (float64, error) {
+	if n, ok := v.(json.Number); ok {
+		return n.Float64()
+	}
+	return 0, fmt.Errorf("not a number: %v", v)
+}
+
+func marshal(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func join(path string, name string) string {
+	if len(path) == 0 {
+		return name
+	}
+	return path + "." + name
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,75 @@
+package validate
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSchemaValidate(t *testing.T) {
+	tests := []struct {
+		schema   string
+		value    string
+		problems []string
+	}{
+		{`true`, `{"a":1}`, nil},
+		{`false`, `1`, []string{"(root): no value is allowed"}},
+		{`{"type":["string","null"]}`, `null`, nil},
+		{`{"type":"number"}`, `1`, nil},
+		{`{"type":"integer"}`, `1.5`, []string{"(root): must be of type integer but is number"}},
+		{`{"const":1}`, `1.0`, nil},
+		{`{"enum":["a","b"]}`, `"c"`, []string{`(root): must be one of ["a","b"]`}},
+		{`{"minLength":2,"maxLength":3,"pattern":"^a"}`, `"bcde"`, []string{
+			"(root): must be at most 3 characters long",
+			"(root): must match ^a",
+		}},
+		{`{"maxLength":2}`, `"éé"`, nil},
+		{`{"exclusiveMinimum":0,"multipleOf":0.5}`, `0.75`, []string{"(root): must be a multiple of 0.5"}},
+		{`{"properties":{"a":{"type":"string"}},"additionalProperties":false}`, `{"a":"x","b":1}`, []string{"(root): property b is not allowed"}},
+		{`{"patternProperties":{"^x-":{"type":"string"}},"additionalProperties":{"type":"integer"}}`, `{"x-id":1,"n":2}`, []string{"x-id: must be of type string but is integer"}},
+		{`{"items":{"type":"integer"},"maxItems":2,"uniqueItems":true}`, `[1,1,"a"]`, []string{
+			"(root): must have at most 2 items",
+			"2: must be of type integer but is string",
+			"(root): items 0 and 1 must be unique",
+		}},
+		{`{"items":[{"type":"string"}],"additionalItems":false}`, `["a",1]`, []string{"1: no value is allowed"}},
+		{`{"anyOf":[{"type":"string"},{"type":"integer"}]}`, `true`, []string{"(root): must match at least one of the anyOf schemas"}},
+		{`{"oneOf":[{"type":"number"},{"type":"integer"}]}`, `1`, []string{"(root): must match exactly one of the oneOf schemas but matched 2"}},
+		{`{"allOf":[{"required":["a"]},{"required":["b"]}]}`, `{"a":1}`, []string{"(root): missing required property b"}},
+		{`{"not":{"type":"null"}}`, `null`, []string{"(root): must not match the not schema"}},
+	}
+
+	for _, test := range tests {
+		s, err := CompileSchema([]byte(test.schema))
+		if err != nil {
+			t.Errorf("%s: %s", test.schema, err)
+			continue
+		}
+
+		var v interface{}
+		d := json.NewDecoder(strings.NewReader(test.value))
+		d.UseNumber()
+		d.Decode(&v)
+
+		if problems := s.Validate(v); !reflect.DeepEqual(problems, test.problems) {
+			t.Errorf("%s with %s:\n- expected: %#v\n- found:    %#v", test.schema, test.value, test.problems, problems)
+		}
+	}
+}
+
+func TestCompileSchemaErrors(t *testing.T) {
+	for _, schema := range []string{
+		`[]`,
+		`{"type":"float"}`,
+		`{"minLength":-1}`,
+		`{"pattern":"("}`,
+		`{"anyOf":[]}`,
+		`{"properties":{"a":{"$ref":"#"}}}`,
+		`{"multipleOf":0}`,
+	} {
+		if _, err := CompileSchema([]byte(schema)); err == nil {
+			t.Errorf("%s: the schema should be rejected", schema)
+		}
+	}
+}
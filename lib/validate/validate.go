@@ -0,0 +1,184 @@
+// Package validate implements the validate stage, which checks the messages
+// against a JSON Schema before they're sent so a message breaking the ingest
+// contract of a destination doesn't get a whole batch rejected.
+package validate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+// Policy is what happens to the messages that don't conform to the schema.
+type Policy int
+
+const (
+	// DeadLetterPolicy sends the messages to the dead-letter group, with the
+	// validation errors recorded in their dead-letter data field.
+	DeadLetterPolicy Policy = iota
+
+	// DropPolicy drops the messages, a warning is logged with the validation
+	// errors.
+	DropPolicy
+)
+
+func ParsePolicy(s string) (p Policy, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "dead-letter":
+		p = DeadLetterPolicy
+	case "drop":
+		p = DropPolicy
+	default:
+		err = fmt.Errorf("invalid VALIDATE_POLICY, must be one of dead-letter or drop: %s", s)
+	}
+	return
+}
+
+// The maximum number of validation errors recorded for a message, a message
+// that is way off would otherwise carry one error per field.
+const maxProblems = 10
+
+type config struct {
+	schema *Schema
+	policy Policy
+
+	// The group that the non-conforming messages are sent to with the
+	// dead-letter policy, {group} and {stream} are replaced by the names of
+	// the message.
+	deadLetterGroup string
+}
+
+func getConfig() (c config, err error) {
+	var s string
+	var b []byte
+
+	c.deadLetterGroup = "ecs-logs-dead-letter"
+
+	// The schema is either inline or the path of a file.
+	if s = strings.TrimSpace(lib.Getenv("VALIDATE_SCHEMA")); len(s) == 0 {
+		err = fmt.Errorf("missing VALIDATE_SCHEMA environment variable")
+		return
+	}
+
+	if strings.HasPrefix(s, "{") {
+		b = []byte(s)
+	} else if b, err = ioutil.ReadFile(s); err != nil {
+		err = fmt.Errorf("invalid VALIDATE_SCHEMA: %s", err)
+		return
+	}
+
+	if c.schema, err = CompileSchema(b); err != nil {
+		err = fmt.Errorf("invalid VALIDATE_SCHEMA: %s", err)
+		return
+	}
+
+	if c.policy, err = ParsePolicy(lib.Getenv("VALIDATE_POLICY")); err != nil {
+		return
+	}
+
+	if s = strings.TrimSpace(lib.Getenv("VALIDATE_DEAD_LETTER_GROUP")); len(s) != 0 {
+		c.deadLetterGroup = s
+	}
+
+	return
+}
+
+func NewProcessor() (p lib.Processor, err error) {
+	var c config
+
+	if c, err = getConfig(); err == nil {
+		p = newProcessor(c, metrics.Default)
+	}
+
+	return
+}
+
+func checkConfig() (err error) {
+	_, err = getConfig()
+	return
+}
+
+type processor struct {
+	config
+	invalid *metrics.Counter
+}
+
+func newProcessor(c config, registry *metrics.Registry) *processor {
+	return &processor{
+		config:  c,
+		invalid: registry.Counter("invalid_messages", "stage", "validate"),
+	}
+}
+
+func (p *processor) Process(msg lib.Message, now time.Time) []lib.Message {
+	problems := p.validate(msg)
+
+	if len(problems) == 0 {
+		return []lib.Message{msg}
+	}
+
+	p.invalid.Add(1)
+
+	if len(problems) > maxProblems {
+		problems = append(problems[:maxProblems], fmt.Sprintf("and %d more problems", len(problems)-maxProblems))
+	}
+
+	if p.policy == DropPolicy {
+		log.WithFields(log.Fields{
+			"group":    msg.Group,
+			"stream":   msg.Stream,
+			"problems": strings.Join(problems, "; "),
+		}).Warn("dropping a message that doesn't conform to the schema")
+		return nil
+	}
+
+	res := msg
+	res.Group = strings.NewReplacer("{group}", msg.Group, "{stream}", msg.Stream).Replace(p.deadLetterGroup)
+	res.Event.Data = copyData(msg.Event.Data)
+
+	info := lib.DeadLetterInfo(msg, "the message doesn't conform to the schema", nil)
+	info["problems"] = problems
+	res.Event.Data[lib.DeadLetterField] = info
+	return []lib.Message{res}
+}
+
+func (p *processor) Flush(now time.Time) []lib.Message {
+	return nil
+}
+
+// validate checks the event of msg as it's serialized by the destinations,
+// it's decoded back from JSON so the schema sees the same types.
+func (p *processor) validate(msg lib.Message) []string {
+	var v interface{}
+
+	b, err := json.Marshal(msg.Event)
+
+	if err == nil {
+		d := json.NewDecoder(strings.NewReader(string(b)))
+		d.UseNumber()
+		err = d.Decode(&v)
+	}
+
+	if err != nil {
+		return []string{fmt.Sprintf("the message couldn't be serialized: %s", err)}
+	}
+
+	return p.schema.Validate(v)
+}
+
+func copyData(data ecslogs.EventData) ecslogs.EventData {
+	c := make(ecslogs.EventData, len(data)+1)
+
+	for k, v := range data {
+		c[k] = v
+	}
+
+	return c
+}
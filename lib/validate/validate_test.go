@@ -0,0 +1,138 @@
+package validate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+)
+
+const testSchema = `{
+	"type": "object",
+	"required": ["level", "message", "data"],
+	"properties": {
+		"level": {"enum": ["INFO", "WARN", "ERROR"]},
+		"message": {"type": "string", "minLength": 1},
+		"data": {
+			"type": "object",
+			"required": ["status"],
+			"properties": {
+				"status": {"type": "integer", "minimum": 100, "maximum": 599},
+				"user": {"type": "string"}
+			}
+		}
+	}
+}`
+
+func newTestProcessor(t *testing.T, policy Policy) (*processor, *metrics.Registry) {
+	schema, err := CompileSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := metrics.NewRegistry()
+	return newProcessor(config{schema: schema, policy: policy, deadLetterGroup: "dead-letter-{group}"}, r), r
+}
+
+func TestProcessorConforming(t *testing.T) {
+	p, _ := newTestProcessor(t, DeadLetterPolicy)
+	msg := makeMessage(ecslogs.EventData{"status": 200, "user": "luke"})
+
+	if msgs := p.Process(msg, time.Now()); len(msgs) != 1 || !reflect.DeepEqual(msgs[0], msg) {
+		t.Errorf("a conforming message should pass through unchanged: %+v", msgs)
+	}
+}
+
+func TestProcessorDeadLetter(t *testing.T) {
+	p, r := newTestProcessor(t, DeadLetterPolicy)
+	msg := makeMessage(ecslogs.EventData{"status": "OK", "user": 42})
+
+	msgs := p.Process(msg, time.Now())
+
+	if len(msgs) != 1 || msgs[0].Group != "dead-letter-A" || msgs[0].Stream != "B" {
+		t.Fatalf("the message should be sent to the dead-letter group: %+v", msgs)
+	}
+
+	info, _ := msgs[0].Event.Data[lib.DeadLetterField].(ecslogs.EventData)
+	problems := []string{
+		"data.status: must be of type integer but is string",
+		"data.user: must be of type string but is integer",
+	}
+
+	if info["group"] != "A" || info["stream"] != "B" || !reflect.DeepEqual(info["problems"], problems) {
+		t.Errorf("the validation errors should be attached to the dead-lettered message: %#v", info)
+	}
+
+	if _, ok := msg.Event.Data[lib.DeadLetterField]; ok {
+		t.Error("the original message should not be modified")
+	}
+
+	if n := r.Counter("invalid_messages", "stage", "validate").Value(); n != 1 {
+		t.Errorf("the invalid message should be counted: %d", n)
+	}
+}
+
+func TestProcessorDrop(t *testing.T) {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	p, _ := newTestProcessor(t, DropPolicy)
+
+	if msgs := p.Process(makeMessage(ecslogs.EventData{}), time.Now()); len(msgs) != 0 {
+		t.Errorf("the invalid message should be dropped: %+v", msgs)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	defer lib.SetConfigEnv(nil)
+
+	dir, err := ioutil.TempDir("", "validate_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "schema.json")
+	ioutil.WriteFile(path, []byte(testSchema), 0644)
+
+	lib.SetConfigEnv(map[string]string{
+		"VALIDATE_SCHEMA": path,
+		"VALIDATE_POLICY": "drop",
+	})
+
+	if c, err := getConfig(); err != nil || c.schema == nil || c.policy != DropPolicy {
+		t.Errorf("invalid config: %+v (%v)", c, err)
+	}
+
+	for _, env := range []map[string]string{
+		{},
+		{"VALIDATE_SCHEMA": filepath.Join(dir, "missing.json")},
+		{"VALIDATE_SCHEMA": `{"$ref": "#/definitions/event"}`},
+		{"VALIDATE_SCHEMA": `{"type": "object"}`, "VALIDATE_POLICY": "quarantine"},
+	} {
+		lib.SetConfigEnv(env)
+
+		if err := checkConfig(); err == nil {
+			t.Errorf("%v: the configuration should be rejected", env)
+		}
+	}
+}
+
+func makeMessage(data ecslogs.EventData) lib.Message {
+	return lib.Message{
+		Group:  "A",
+		Stream: "B",
+		Event: ecslogs.Event{
+			Level:   ecslogs.INFO,
+			Time:    time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC),
+			Message: "GET /",
+			Data:    data,
+		},
+	}
+}
@@ -0,0 +1,26 @@
+package lib
+
+import "fmt"
+
+// Warmer is implemented by destinations that prepare their writers when
+// ecs-logs starts, like creating the log streams that will be written to, so
+// the first batches aren't delayed by it.
+type Warmer interface {
+	WarmUp() error
+}
+
+// WarmUp warms up the destination called name if it implements Warmer, the
+// error is prefixed with its name.
+func WarmUp(name string, dest Destination) error {
+	w, ok := dest.(Warmer)
+
+	if !ok {
+		return nil
+	}
+
+	if err := w.WarmUp(); err != nil {
+		return fmt.Errorf("destination %s: %s", name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,35 @@
+package lib
+
+import (
+	"errors"
+	"testing"
+)
+
+type warmTestDestination struct {
+	Destination
+	err   error
+	warms int
+}
+
+func (d *warmTestDestination) WarmUp() error {
+	d.warms++
+	return d.err
+}
+
+func TestWarmUp(t *testing.T) {
+	d := &warmTestDestination{}
+
+	if err := WarmUp("logs", d); err != nil || d.warms != 1 {
+		t.Errorf("the destination should be warmed up: %v, %d call(s)", err, d.warms)
+	}
+
+	d.err = errors.New("AccessDeniedException")
+
+	if err := WarmUp("logs", d); err == nil || err.Error() != "destination logs: AccessDeniedException" {
+		t.Error("the error should be prefixed with the name of the destination:", err)
+	}
+
+	if err := WarmUp("stdout", GetDestination("stdout")); err != nil {
+		t.Error("the destinations that don't warm up should be skipped:", err)
+	}
+}
@@ -13,6 +13,46 @@ type Writer interface {
 	WriteMessageBatch(MessageBatch) error
 }
 
+// SizedWriter is implemented by writers that can report how many bytes they
+// sent to write a batch, measured after serialization (and compression when
+// the destination compresses its payloads).
+type SizedWriter interface {
+	WriteMessageBatchSize(MessageBatch) (int, error)
+}
+
+// WriteMessageBatchSize writes batch to w and returns the size of the payload
+// that was sent, writers that don't implement SizedWriter are assumed to send
+// the JSON representation of the events.
+func WriteMessageBatchSize(w Writer, batch MessageBatch) (size int, err error) {
+	if sw, ok := w.(SizedWriter); ok {
+		return sw.WriteMessageBatchSize(batch)
+	}
+
+	if err = w.WriteMessageBatch(batch); err == nil {
+		for _, msg := range batch {
+			size += msg.ContentLength()
+		}
+	}
+
+	return
+}
+
+// UrgentWriter is implemented by writers that can deliver some batches ahead
+// of the others, like the ones flushed because they reached the maximum latency
+// of their stream, when they're held back by a rate limit.
+type UrgentWriter interface {
+	WriteUrgentMessageBatch(MessageBatch) (int, error)
+}
+
+// WriteUrgentMessageBatch writes batch to w ahead of the other batches if w
+// supports it, it returns the size of the payload like WriteMessageBatchSize.
+func WriteUrgentMessageBatch(w Writer, batch MessageBatch) (size int, err error) {
+	if uw, ok := w.(UrgentWriter); ok {
+		return uw.WriteUrgentMessageBatch(batch)
+	}
+	return WriteMessageBatchSize(w, batch)
+}
+
 func NewMessageEncoder(w io.Writer) Writer {
 	return encoder{
 		j: json.NewEncoder(w),
@@ -35,10 +75,27 @@ func (e encoder) WriteMessage(msg Message) (err error) {
 }
 
 func (e encoder) WriteMessageBatch(batch MessageBatch) (err error) {
+	_, err = e.WriteMessageBatchSize(batch)
+	return
+}
+
+// WriteMessageBatchSize encodes the whole batch in a pooled buffer and writes
+// it with a single call, instead of one write and one encoder per message.
+func (e encoder) WriteMessageBatchSize(batch MessageBatch) (size int, err error) {
+	j := getJSONBuffer()
+	defer putJSONBuffer(j)
+
 	for _, msg := range batch {
-		if err = e.WriteMessage(msg); err != nil {
-			return
+		if err = j.enc.Encode(msg); err != nil {
+			break
 		}
 	}
+
+	n, werr := e.w.Write(j.buf.Bytes())
+	if err == nil {
+		err = werr
+	}
+
+	size = n
 	return
 }
@@ -0,0 +1,7 @@
+package xray
+
+import "github.com/segmentio/ecs-logs/lib"
+
+func init() {
+	lib.RegisterStage("xray", lib.NewCheckedStage(lib.StageFunc(NewProcessor), checkConfig))
+}
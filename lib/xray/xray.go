@@ -0,0 +1,178 @@
+// Package xray implements the xray stage, which attaches the AWS X-Ray trace
+// ID of the requests that messages were logged for, so logs and traces can be
+// correlated.
+package xray
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+// Field is the data field that trace IDs are set in.
+const Field = "xray_trace_id"
+
+type config struct {
+	// The dotted path of the data field that trace IDs are read from.
+	field string
+
+	// The trace ID from the environment of ecs-logs, attached to messages that
+	// don't carry one when it's set.
+	process string
+}
+
+func getConfig() (c config, err error) {
+	c.field = "trace_id"
+
+	if s := strings.TrimSpace(lib.Getenv("XRAY_FIELD")); len(s) != 0 {
+		c.field = s
+	}
+
+	if s := strings.TrimSpace(lib.Getenv("XRAY_PROCESS_TRACE")); len(s) != 0 {
+		var enabled bool
+
+		if enabled, err = strconv.ParseBool(s); err != nil {
+			err = fmt.Errorf("invalid XRAY_PROCESS_TRACE, must be a boolean: %s", s)
+			return
+		}
+
+		// The variable isn't a setting of ecs-logs, it's set by the X-Ray
+		// SDKs and Lambda so it's never read from the configuration file.
+		if enabled {
+			c.process, _ = Normalize(os.Getenv("_X_AMZN_TRACE_ID"))
+		}
+	}
+
+	return
+}
+
+func NewProcessor() (p lib.Processor, err error) {
+	var c config
+
+	if c, err = getConfig(); err != nil {
+		return
+	}
+
+	p = newProcessor(c)
+	return
+}
+
+func checkConfig() (err error) {
+	_, err = getConfig()
+	return
+}
+
+type processor struct {
+	config
+}
+
+func newProcessor(c config) *processor {
+	return &processor{config: c}
+}
+
+func (p *processor) Process(msg lib.Message, now time.Time) []lib.Message {
+	traceID, ok := "", false
+
+	if s, isString := lookup(msg.Event.Data, p.field).(string); isString {
+		traceID, ok = Normalize(s)
+	}
+
+	if !ok && len(p.process) != 0 {
+		traceID, ok = p.process, true
+	}
+
+	if ok {
+		data := make(ecslogs.EventData, len(msg.Event.Data)+1)
+
+		for k, v := range msg.Event.Data {
+			data[k] = v
+		}
+
+		data[Field] = traceID
+		msg.Event.Data = data
+	}
+
+	return []lib.Message{msg}
+}
+
+func (p *processor) Flush(now time.Time) []lib.Message {
+	return nil
+}
+
+func lookup(data ecslogs.EventData, path string) interface{} {
+	var value interface{} = map[string]interface{}(data)
+
+	for _, key := range strings.Split(path, ".") {
+		switch m := value.(type) {
+		case ecslogs.EventData:
+			value = m[key]
+		case map[string]interface{}:
+			value = m[key]
+		default:
+			return nil
+		}
+	}
+
+	return value
+}
+
+// Normalize returns the trace ID carried by s in the 1-<time>-<id> format of
+// X-Ray. s may be an X-Amzn-Trace-Id header (Root=1-...;Parent=...), an X-Ray
+// trace ID with or without its version, or a W3C trace ID or traceparent
+// header, which X-Ray trace IDs convert to. It returns false if s doesn't carry
+// a trace ID.
+func Normalize(s string) (traceID string, ok bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	// X-Amzn-Trace-Id: Root=1-5759e988-bd862e3fe1be46a994272793;Parent=...
+	if strings.Contains(s, "=") {
+		root := ""
+
+		for _, part := range strings.Split(s, ";") {
+			if kv := strings.SplitN(strings.TrimSpace(part), "=", 2); len(kv) == 2 && kv[0] == "root" {
+				root = kv[1]
+			}
+		}
+
+		s = root
+	}
+
+	// traceparent: 00-5759e988bd862e3fe1be46a994272793-53995c3f42cd8ad8-01
+	if parts := strings.Split(s, "-"); len(parts) == 4 && parts[0] == "00" {
+		s = parts[1]
+	}
+
+	switch parts := strings.Split(s, "-"); {
+	case len(parts) == 3 && parts[0] == "1":
+		parts = parts[1:]
+		fallthrough
+
+	case len(parts) == 2:
+		s = parts[0] + parts[1]
+
+	case len(parts) != 1:
+		return
+	}
+
+	// The first 8 digits of X-Ray trace IDs are the time the trace started,
+	// all zeros is an invalid W3C trace ID.
+	if len(s) != 32 || !isHex(s) || strings.Trim(s, "0") == "" {
+		return
+	}
+
+	return "1-" + s[:8] + "-" + s[8:], true
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package xray
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+func makeProcessor(t *testing.T, env map[string]string) *processor {
+	lib.SetConfigEnv(env)
+	defer lib.SetConfigEnv(nil)
+
+	c, err := getConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newProcessor(c)
+}
+
+func TestNormalize(t *testing.T) {
+	const traceID = "1-5759e988-bd862e3fe1be46a994272793"
+
+	tests := []struct {
+		in string
+		ok bool
+	}{
+		{in: traceID, ok: true},
+		{in: "1-5759E988-BD862E3FE1BE46A994272793", ok: true},
+		{in: "5759e988-bd862e3fe1be46a994272793", ok: true},
+		{in: "5759e988bd862e3fe1be46a994272793", ok: true},
+		{in: "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1", ok: true},
+		{in: "Self=1-67891234-12456789abcdef012345678;Root=1-5759e988-bd862e3fe1be46a994272793", ok: true},
+		{in: "00-5759e988bd862e3fe1be46a994272793-53995c3f42cd8ad8-01", ok: true},
+		{in: ""},
+		{in: "Parent=53995c3f42cd8ad8;Sampled=1"},
+		{in: "2-5759e988-bd862e3fe1be46a994272793"},
+		{in: "1-5759e988-bd862e3fe1be46a99427279"},
+		{in: "1-5759e988-bd862e3fe1be46a99427279z"},
+		{in: "00000000000000000000000000000000"},
+		{in: "request 1234"},
+	}
+
+	for _, test := range tests {
+		s, ok := Normalize(test.in)
+
+		if ok != test.ok {
+			t.Errorf("%q: the trace ID should be recognized: %t", test.in, test.ok)
+		} else if ok && s != traceID {
+			t.Errorf("%q: invalid trace ID: %q", test.in, s)
+		}
+	}
+}
+
+func TestProcessorField(t *testing.T) {
+	p := makeProcessor(t, map[string]string{"XRAY_FIELD": "request.trace"})
+
+	data := ecslogs.EventData{
+		"request": map[string]interface{}{
+			"trace": "Root=1-5759e988-bd862e3fe1be46a994272793;Sampled=1",
+		},
+	}
+
+	msgs := p.Process(lib.Message{Event: ecslogs.Event{Data: data}}, time.Now())
+
+	if len(msgs) != 1 {
+		t.Fatalf("invalid number of messages: %d", len(msgs))
+	}
+
+	if id := msgs[0].Event.Data[Field]; id != "1-5759e988-bd862e3fe1be46a994272793" {
+		t.Errorf("the normalized trace ID should have been attached: %#v", id)
+	}
+
+	if _, ok := data[Field]; ok {
+		t.Error("the data of the original message should not be modified")
+	}
+}
+
+func TestProcessorPassthrough(t *testing.T) {
+	p := makeProcessor(t, nil)
+
+	for _, data := range []ecslogs.EventData{
+		nil,
+		{"user": "bob"},
+		{"trace_id": "not a trace"},
+		{"trace_id": 42},
+	} {
+		msg := lib.Message{Event: ecslogs.Event{Message: "Hello World!", Data: data}}
+
+		if msgs := p.Process(msg, time.Now()); len(msgs) != 1 || !reflect.DeepEqual(msgs[0], msg) {
+			t.Errorf("messages without a trace ID should be left unchanged: %+v", msgs)
+		}
+	}
+}
+
+func TestProcessorProcessTrace(t *testing.T) {
+	os.Setenv("_X_AMZN_TRACE_ID", "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1")
+	defer os.Unsetenv("_X_AMZN_TRACE_ID")
+
+	p := makeProcessor(t, map[string]string{"XRAY_PROCESS_TRACE": "true"})
+
+	msgs := p.Process(lib.Message{}, time.Now())
+
+	if id := msgs[0].Event.Data[Field]; id != "1-5759e988-bd862e3fe1be46a994272793" {
+		t.Errorf("the trace ID of the process should have been attached: %#v", id)
+	}
+
+	msgs = p.Process(lib.Message{Event: ecslogs.Event{Data: ecslogs.EventData{"trace_id": "1-67891234-0123456789abcdef01234567"}}}, time.Now())
+
+	if id := msgs[0].Event.Data[Field]; id != "1-67891234-0123456789abcdef01234567" {
+		t.Errorf("the trace ID of the message should win over the one of the process: %#v", id)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	lib.SetConfigEnv(map[string]string{"XRAY_PROCESS_TRACE": "maybe"})
+	defer lib.SetConfigEnv(nil)
+
+	if err := checkConfig(); err == nil {
+		t.Error("an invalid XRAY_PROCESS_TRACE should be reported")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -21,13 +22,10 @@ import (
 	"github.com/apex/log/handlers/multi"
 	"github.com/segmentio/ecs-logs-go"
 	"github.com/segmentio/ecs-logs/lib"
-
-	_ "github.com/segmentio/ecs-logs/lib/cloudwatchlogs"
-	_ "github.com/segmentio/ecs-logs/lib/datadog"
-	_ "github.com/segmentio/ecs-logs/lib/logdna"
-	_ "github.com/segmentio/ecs-logs/lib/loggly"
-	_ "github.com/segmentio/ecs-logs/lib/statsd"
-	_ "github.com/segmentio/ecs-logs/lib/syslog"
+	"github.com/segmentio/ecs-logs/lib/clock"
+	"github.com/segmentio/ecs-logs/lib/metrics"
+	"github.com/segmentio/ecs-logs/lib/recent"
+	"github.com/segmentio/ecs-logs/lib/spool"
 )
 
 type source struct {
@@ -38,6 +36,49 @@ type source struct {
 type destination struct {
 	lib.Destination
 	name string
+
+	// How the batches of each stream are dispatched to the destination, the
+	// dispatcher queues the writes of a stream unless ordering is none.
+	ordering   lib.OrderingMode
+	dispatcher *lib.Dispatcher
+
+	// Buffers the batches of the destination while it's paused for
+	// maintenance, it's the outermost wrapper of the destination.
+	pausable *lib.PausableDestination
+
+	// The group whose batches aren't written to the destination, it's the
+	// heartbeat group when the destination isn't one of the
+	// -heartbeat-destinations.
+	skipGroup string
+
+	// The set of -atomic-destinations that the destination belongs to, nil
+	// if it's written to on its own.
+	atomic *atomicSet
+
+	// Writes the messages of the -fast-path right away when the destination
+	// is the -fast-destination, nil otherwise.
+	fast *lib.FastLane
+
+	// Picks the messages written to the destination with the -routes, nil
+	// when all of them are.
+	router *lib.Router
+
+	// Where the batches that expired in the queues of the destination are
+	// dead-lettered, nil when they're dropped.
+	deadLetters lib.DeadLetterSink
+}
+
+// atomicSet is the set of the -atomic-destinations, their batches are written
+// together by the dispatcher of the first one.
+type atomicSet struct {
+	*lib.AtomicDelivery
+	leader  string
+	targets []lib.AtomicTarget
+}
+
+type stage struct {
+	lib.Stage
+	name string
 }
 
 type reader struct {
@@ -49,27 +90,107 @@ func main() {
 	var err error
 	var src string
 	var dst string
+	var stg string
 	var hostname string
 	var level = lib.LogLevel(log.InfoLevel)
 	var maxBytes int
 	var maxCount int
 	var flushTimeout time.Duration
+	var maxLatency time.Duration
+	var groupWindow time.Duration
 	var cacheTimeout time.Duration
 	var profileAddr string
+	var configPath string
+	var emptyNames string
+	var names lib.EmptyNames
+	var timestamp string
+	var timestamps lib.TimestampPolicy
+	var messageIDs string
+	var ids lib.MessageIDScheme
+	var recentSize int
+	var recentBytes int
+	var heartbeatInterval time.Duration
+	var heartbeatGroup string
+	var heartbeatDests string
+	var memoryBudget int
+	var sourceField string
+	var auditFile string
+	var auditChain string
+	var audit *lib.AuditLog
+	var deadLetterSink string
+	var deadLetters lib.DeadLetterSink
+	var skewThreshold time.Duration
+	var skewInterval time.Duration
+	var atomicDests string
+	var atomicAttempts int
+	var atomicBackoff time.Duration
+	var fastPath string
+	var fastDest string
+	var routes string
+	var filter string
+	var dryRun bool
+	var output string
+	var metricsAddr string
+	var healthAddr string
+	var healthWindow time.Duration
+	var metricsStatsd string
+	var metricsInterval time.Duration
+	var shutdownTimeout time.Duration
 
 	hostname, _ = os.Hostname()
 
 	flag.StringVar(&src, "src", "stdin", "A comma separated list of log sources from which messages will be read ["+strings.Join(lib.SourcesAvailable(), ", ")+"]")
 	flag.StringVar(&dst, "dst", "stdout", "A comma separated list of log destinations to which messages will be written ["+strings.Join(lib.DestinationsAvailable(), ", ")+"]")
+	flag.StringVar(&stg, "stages", "", "A comma separated list of processing stages that messages go through, in order, before being written ["+strings.Join(lib.StagesAvailable(), ", ")+"]")
 	flag.StringVar(&hostname, "hostname", hostname, "The hostname advertised by ecs-logs")
 	flag.Var(&level, "log-level", "The minimum level of log messages shown by ecs-logs")
 	flag.IntVar(&maxBytes, "max-batch-bytes", 1000000, "The maximum size in bytes of a message batch")
 	flag.IntVar(&maxCount, "max-batch-size", 10000, "The maximum number of messages in a batch")
 	flag.DurationVar(&flushTimeout, "flush-timeout", 5*time.Second, "How often messages will be flushed")
+	flag.DurationVar(&maxLatency, "max-latency", 0, "The maximum time a message stays buffered before its stream is flushed, zero disables it")
+	flag.DurationVar(&groupWindow, "group-window", 0, "When non-zero, the streams of each group are flushed together once per window, with all the messages they buffered, instead of each one on its own schedule")
 	flag.DurationVar(&cacheTimeout, "cache-timeout", 5*time.Minute, "How to wait before clearing unused internal cache")
-	flag.StringVar(&profileAddr, "pprof-addr", "", "Address to serve profile information")
+	flag.StringVar(&profileAddr, "pprof-addr", "", "Address to serve profile information and the /destinations/ control interface")
+	flag.IntVar(&recentSize, "recent-size", 0, "The number of recent messages kept in memory and served on /debug/recent by the -pprof-addr server, zero disables it")
+	flag.IntVar(&recentBytes, "recent-bytes", 8*1024*1024, "The maximum size in bytes of the recent messages kept in memory")
+	flag.StringVar(&configPath, "config", "", "Path to a YAML or JSON configuration file, changes to the file are applied without restarting when possible")
+	flag.StringVar(&emptyNames, "empty-names", "drop", "What to do with messages read without a group or a stream [drop, default, dead-letter]")
+	flag.StringVar(&names.DefaultGroup, "default-group", "{source}", "The group of messages read without one when -empty-names=default")
+	flag.StringVar(&names.DefaultStream, "default-stream", "{hostname}", "The stream of messages read without one when -empty-names=default")
+	flag.StringVar(&names.DeadLetterGroup, "dead-letter-group", "ecs-logs-dead-letter", "The group that messages read without a group or a stream are sent to when -empty-names=dead-letter, and the oversized messages of destinations with the dead-letter oversize policy")
+	flag.StringVar(&timestamp, "timestamp", "prefer-parsed-fallback-receive", "Which time is used as the timestamp of messages, the time they carry or the time they were read [receive, parsed, prefer-parsed-fallback-receive]")
+	flag.StringVar(&messageIDs, "message-ids", "none", "How the IDs assigned to messages when they're read are generated, they're carried in the "+lib.MessageIDField+" data field [none, uuidv7, uuidv4]")
+	flag.DurationVar(&heartbeatInterval, "heartbeat-interval", 0, "How often ecs-logs emits a heartbeat message reporting its uptime, the messages it processed, its backlog and the error rates of the destinations, zero disables it")
+	flag.StringVar(&heartbeatGroup, "heartbeat-group", "ecs-logs-heartbeat", "The group of the heartbeat messages, their stream is the hostname")
+	flag.StringVar(&heartbeatDests, "heartbeat-destinations", "", "A comma separated list of the destinations that heartbeat messages are written to, all of them when empty")
+	flag.IntVar(&memoryBudget, "memory-budget", 0, "The maximum size in bytes of the messages held by ecs-logs, buffered or being written, past which the buffered messages are flushed early and then the sources stop being read, zero disables it")
+	flag.StringVar(&sourceField, "source-field", lib.SourceField, "The data field that messages are tagged with the name of the source they were read from in, empty disables it")
+	flag.StringVar(&auditFile, "audit-file", "", "Path to a file that an entry is appended to for each batch delivered to the destinations, with its ID, message IDs and the receipt of the destination, empty disables it")
+	flag.StringVar(&deadLetterSink, "dead-letter-sink", "", "Where the messages that the destinations permanently reject are written to with the reason of the rejection, either file:<path> or the name of a destination writing to the -dead-letter-group group, empty only logs them")
+	flag.StringVar(&auditChain, "audit-chain", "sha256", "How the entries of the -audit-file are linked to make the trail tamper-evident [sha256, none]")
+	flag.DurationVar(&skewThreshold, "clock-skew-threshold", 0, "How far the timestamps of messages may be from the time they were read before the skew of their source is reported, zero disables it")
+	flag.DurationVar(&skewInterval, "clock-skew-interval", time.Minute, "How often the sources with skewed timestamps are reported")
+	flag.StringVar(&atomicDests, "atomic-destinations", "", "A comma separated list of destinations that each batch is written to as a unit, it's written again to all of them until they all accept it, empty disables it")
+	flag.IntVar(&atomicAttempts, "atomic-attempts", 3, "The number of times a batch is written to all the -atomic-destinations before being dropped")
+	flag.DurationVar(&atomicBackoff, "atomic-backoff", time.Second, "How long to wait before writing a batch to the -atomic-destinations again, the delay doubles with each attempt")
+	flag.StringVar(&fastPath, "fast-path", "", "A comma separated list of predicates selecting the messages written right away to the -fast-destination instead of being batched for it [level=LEVEL, data.field, data.field=value]")
+	flag.StringVar(&fastDest, "fast-destination", "", "The destination that the messages of the -fast-path are written to as soon as they're read, empty disables it")
+	flag.StringVar(&routes, "routes", "", "A semicolon separated list of rules routing the messages to the destinations, the first rule matching a message picks its destinations and the others are written to all of them [predicates -> destinations]")
+	flag.StringVar(&filter, "filter", "", "A list of predicates separated by commas or spaces, only the messages matching all of them are written to the destinations [group=glob, stream=glob, level>=LEVEL, data.field, data.field=value]")
+	flag.BoolVar(&dryRun, "dry-run", false, "Run the whole pipeline but print the batches to the -output, with the destination they were routed to, instead of writing them to the destinations")
+	flag.StringVar(&output, "output", "stdout", "Where -dry-run prints the batches [stdout, stderr, or the path of a file]")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Address to serve the metrics of ecs-logs on in the Prometheus format at /metrics, they're also served by the -pprof-addr server")
+	flag.StringVar(&metricsStatsd, "metrics-statsd", "", "The host:port UDP address of a statsd server that the metrics of ecs-logs are mirrored to, empty disables it")
+	flag.DurationVar(&metricsInterval, "metrics-statsd-interval", 10*time.Second, "How often the metrics are sent to the -metrics-statsd server")
+	flag.StringVar(&healthAddr, "health-addr", "", "Address to serve the /healthz and /readyz endpoints on, they're also served by the -pprof-addr server")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 25*time.Second, "How long ecs-logs drains the messages it holds to the destinations and commits the checkpoints of the sources when it's stopped before exiting anyway, zero waits indefinitely")
+	flag.DurationVar(&healthWindow, "health-window", 5*time.Minute, "How long a source may be reconnecting, a destination may fail all its writes, or the sources may be held before ecs-logs is reported unhealthy")
 	flag.Parse()
 
+	// The values of the configuration file never override the flags passed
+	// on the command line, they're recorded before it sets the others.
+	explicit := commandLineFlags()
+
 	logger := &lib.LogHandler{
 		Group:    "ecs-logs",
 		Stream:   hostname,
@@ -79,6 +200,92 @@ func main() {
 	log.SetLevel(log.Level(level))
 	log.SetHandler(multi.New(cli.New(os.Stderr), logger))
 
+	var config lib.Config
+	var configC <-chan lib.Config
+	var configErrC <-chan error
+	var watcher *lib.ConfigWatcher
+
+	if len(configPath) != 0 {
+		if config, err = lib.LoadConfig(configPath); err != nil {
+			log.WithError(err).Fatal("failed to load the configuration file")
+		}
+
+		lib.SetConfigEnv(config.Environment())
+		setFlagsFromConfig(config, explicit)
+		log.SetLevel(log.Level(level))
+
+		watcher = lib.WatchConfig(configPath, 1*time.Second)
+		defer watcher.Close()
+		configC, configErrC = watcher.C, watcher.Errors()
+	}
+
+	var history *recent.Buffer
+
+	if recentSize > 0 {
+		if recentBytes <= 0 {
+			log.Fatal("-recent-bytes must be positive when -recent-size is set")
+		}
+		history = recent.NewBuffer(recentSize, recentBytes)
+		http.Handle("/debug/recent", history)
+	}
+
+	http.Handle("/metrics", metrics.Handler(metrics.Default))
+	http.Handle("/healthz", health.Handler(false))
+	http.Handle("/readyz", health.Handler(true))
+
+	if healthWindow <= 0 {
+		log.Fatal("-health-window must be positive")
+	}
+
+	health.Window = healthWindow
+
+	if shutdownTimeout < 0 {
+		log.Fatal("-shutdown-timeout must not be negative")
+	}
+
+	if healthAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", health.Handler(false))
+		mux.Handle("/readyz", health.Handler(true))
+
+		go func() {
+			if err := http.ListenAndServe(healthAddr, mux); err != nil {
+				log.Errorf("health: %v", err)
+			}
+		}()
+	}
+
+	if metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler(metrics.Default))
+
+		go func() {
+			if err := http.ListenAndServe(metricsAddr, mux); err != nil {
+				log.Errorf("metrics: %v", err)
+			}
+		}()
+	}
+
+	if metricsStatsd != "" {
+		if metricsInterval <= 0 {
+			log.Fatal("-metrics-statsd-interval must be positive when -metrics-statsd is set")
+		}
+
+		mirror, err := metrics.NewMirror(metrics.Default, metricsStatsd)
+
+		if err != nil {
+			log.WithError(err).Fatal("failed to connect to the -metrics-statsd server")
+		}
+
+		go func() {
+			for range time.Tick(metricsInterval) {
+				if err := mirror.Flush(); err != nil {
+					log.WithError(err).Warn("failed to send the metrics to statsd")
+				}
+			}
+		}()
+	}
+
 	// serve profiles if address is configured
 	if profileAddr != "" {
 		go func() {
@@ -92,11 +299,61 @@ func main() {
 	var sources []source
 	var readers []reader
 	var dests []destination
+	var stages []stage
+	var pipeline lib.Pipeline
 
 	if len(hostname) == 0 {
 		log.Fatal("no hostname configured")
 	}
 
+	if names.Policy, err = lib.ParseEmptyNamePolicy(emptyNames); err != nil {
+		log.WithError(err).Fatal("invalid -empty-names")
+	}
+
+	if err = names.Check(); err != nil {
+		log.WithError(err).Fatal("invalid name templates")
+	}
+
+	if timestamps, err = lib.ParseTimestampPolicy(timestamp); err != nil {
+		log.WithError(err).Fatal("invalid -timestamp")
+	}
+
+	if ids, err = lib.ParseMessageIDScheme(messageIDs); err != nil {
+		log.WithError(err).Fatal("invalid -message-ids")
+	}
+
+	if memoryBudget < 0 {
+		log.Fatal("-memory-budget must not be negative")
+	}
+
+	if len(auditFile) != 0 {
+		var chain lib.AuditChain
+
+		if chain, err = lib.ParseAuditChain(auditChain); err != nil {
+			log.WithError(err).Fatal("invalid -audit-chain")
+		}
+
+		if audit, err = lib.OpenAuditLog(auditFile, chain); err != nil {
+			log.WithError(err).Fatal("failed to open the audit log")
+		}
+	}
+
+	var dryRunOutput *lib.DryRunOutput
+
+	if dryRun {
+		var w io.Writer
+
+		if w, err = openOutput(output); err != nil {
+			log.WithError(err).Fatal("invalid -output")
+		}
+
+		dryRunOutput = lib.NewDryRunOutput(w)
+	}
+
+	if deadLetters, err = openDeadLetterSink(deadLetterSink, names.DeadLetterGroup, dryRunOutput); err != nil {
+		log.WithError(err).Fatal("invalid -dead-letter-sink")
+	}
+
 	if sources = getSources(strings.Split(src, ",")); len(sources) == 0 {
 		log.Fatal("no or invalid log sources")
 	}
@@ -105,7 +362,62 @@ func main() {
 		log.Fatal("no or invalid log destinations")
 	}
 
-	if readers, err = openSources(sources); err != nil {
+	if dryRun {
+		for i := range dests {
+			dests[i].Destination = lib.NewDryRunDestination(dests[i].name, dryRunOutput)
+		}
+	}
+
+	if err = wrapDestinations(dests, names.DeadLetterGroup, deadLetters, audit, maxCount, maxBytes); err != nil {
+		log.WithError(err).Fatal("invalid log destinations configuration")
+	}
+
+	if err = routeHeartbeats(dests, heartbeatGroup, heartbeatDests); err != nil {
+		log.WithError(err).Fatal("invalid -heartbeat-destinations")
+	}
+
+	if err = groupAtomic(dests, atomicDests, lib.NewAtomicDelivery(atomicAttempts, atomicBackoff, metrics.Default, clock.System)); err != nil {
+		log.WithError(err).Fatal("invalid -atomic-destinations")
+	}
+
+	if err = routeFastPath(dests, fastDest, fastPath); err != nil {
+		log.WithError(err).Fatal("invalid -fast-path or -fast-destination")
+	}
+
+	if err = routeMessages(dests, routes, filter); err != nil {
+		log.WithError(err).Fatal("invalid -routes or -filter")
+	}
+
+	pauses := lib.PauseHandler{}
+
+	for _, d := range dests {
+		pauses[d.name] = d.pausable
+	}
+
+	http.Handle("/destinations/", pauses)
+
+	if len(stg) != 0 {
+		if stages = getStages(strings.Split(stg, ",")); len(stages) == 0 {
+			log.Fatal("no or invalid processing stages")
+		}
+	}
+
+	if err = checkConfig(stages, dests); err != nil {
+		for _, e := range err.(lib.ErrorList) {
+			log.Error(e.Error())
+		}
+		log.Fatalf("invalid configuration, %d problems found", len(err.(lib.ErrorList)))
+	}
+
+	if err = warmUpDestinations(dests, dryRun); err != nil {
+		log.WithError(err).Fatal("failed to warm up the destinations")
+	}
+
+	if pipeline, err = openStages(stages); err != nil {
+		log.WithError(err).Fatal("failed to open processing stages")
+	}
+
+	if readers, err = openSources(sources, sourceField); err != nil {
 		log.WithError(err).Fatal("failed to open log sources readers")
 	}
 
@@ -115,54 +427,374 @@ func main() {
 		MaxCount: maxCount,
 		MaxBytes: maxBytes,
 		MaxTime:  flushTimeout,
+
+		GroupWindow: groupWindow,
 	}
 
-	expchan := time.Tick(flushTimeout / 2)
+	interval := setLatencyLimit(&limits, flushTimeout, maxLatency)
+	ticker := time.NewTicker(interval)
 	msgchan := make(chan lib.Message, len(readers))
 	sigchan := make(chan os.Signal, 1)
 	counter := int32(len(readers))
-	startReaders(readers, msgchan, &counter, hostname)
+	budget := lib.NewMemoryBudget(int64(memoryBudget), metrics.Default)
+	heartbeat := lib.NewHeartbeat(heartbeatInterval, heartbeatGroup, hostname, hostname, metrics.Default, clock.System)
+	skew := lib.NewSkewMonitor(skewThreshold, skewInterval, metrics.Default, clock.System)
+	released := make(chan struct{}, 1)
+
+	for _, d := range dests {
+		d.dispatcher.Released = released
+	}
+
+	startReaders(readers, msgchan, &counter, hostname, names, timestamps, lib.NewMessageIDGenerator(ids), skew)
 	setupSignals(sigchan)
+	health.SetReady()
 
 	for _, s := range sources {
 		log.WithField("source", s.name).Info("source enabled")
 	}
 
+	for _, s := range stages {
+		log.WithField("stage", s.name).Info("stage enabled")
+	}
+
 	for _, d := range dests {
 		log.WithField("destination", d.name).Info("destination enabled")
 	}
 
+	held := false
+	queued := ""
+
+	// Set when ecs-logs is stopped, it expires once the drain took longer
+	// than the -shutdown-timeout.
+	var deadline <-chan time.Time
+
 	for {
+		// The sources are held when the memory budget is almost exhausted,
+		// everything buffered is flushed so the memory is released as soon
+		// as the destinations catch up.
+		input := msgchan
+
+		if budget.Pressure() == lib.Backpressure {
+			if input = nil; !held {
+				log.WithField("used", budget.Used()).Warn("the memory budget is almost exhausted, holding the sources")
+				health.Saturated("the memory budget is almost exhausted")
+				held = true
+			}
+			flushAll(dests, store, budget, forced(limits), time.Now(), join)
+		} else if held {
+			log.WithField("used", budget.Used()).Info("resuming the sources")
+			health.Saturated("")
+			held = false
+		}
+
+		// The sources are also held while the queue of a stream is full, the
+		// streams that are written fine keep draining theirs meanwhile.
+		if name := saturated(dests); len(name) != 0 {
+			if input = nil; len(queued) == 0 {
+				log.WithField("destination", name).Warn("the queue of a stream is full, holding the sources")
+				health.Saturated("the queue of a stream of the " + name + " destination is full")
+				queued = name
+			}
+		} else if len(queued) != 0 {
+			log.WithField("destination", queued).Info("the stream queues have room again, resuming the sources")
+			if !held {
+				health.Saturated("")
+			}
+			queued = ""
+		}
+
 		select {
-		case msg, ok := <-msgchan:
+		case msg, ok := <-input:
 			now := time.Now()
 
 			if !ok {
 				log.Info("waiting for all write operations to complete")
 				limits.Force = true
-				flushAll(dests, store, limits, now, join)
-				flushQueue(dests, store, logger.Queue, limits, now, join)
-				join.Wait()
+				addMessages(dests, store, history, budget, pipeline.Flush(now), now, join)
+				flushAll(dests, store, budget, limits, now, join)
+				flushQueue(dests, store, logger.Queue, budget, limits, now, join)
+
+				if !drain(dests, store, readers, deadLetters, join, deadline) {
+					log.WithField("timeout", shutdownTimeout).Warn("exiting before all the messages were delivered, the shutdown timeout expired")
+				}
 				return
 			}
 
-			_, stream := store.Add(msg, now)
-			flush(dests, stream, limits, now, join)
+			// The messages made of msg hold its source until they're
+			// delivered, the stages hand the hold off from one to the next.
+			msgs := pipeline.Process(msg, now)
+
+			for _, msg := range msgs {
+				history.Add(msg)
+				writeFast(dests, msg, join)
+				budget.Acquire(msg.ContentLength())
+				_, stream := store.Add(msg, now)
+				flush(dests, stream, budget, limits, now, join)
+			}
 
 		case <-logger.Queue.C:
 			now := time.Now()
-			flushQueue(dests, store, logger.Queue, limits, now, join)
+			flushQueue(dests, store, logger.Queue, budget, limits, now, join)
 
-		case <-expchan:
+		case <-ticker.C:
 			now := time.Now()
-			flushAll(dests, store, limits, now, join)
+			addMessages(dests, store, history, budget, pipeline.Flush(now), now, join)
+
+			if msg, ok := heartbeat.Beat(backlog(dests, store)); ok {
+				addMessages(dests, store, history, budget, pipeline.Process(msg, now), now, join)
+			}
+
+			// Batches are sent without waiting for them to fill up when the
+			// memory budget is running out.
+			if budget.Pressure() != lib.NoPressure {
+				flushAll(dests, store, budget, forced(limits), now, join)
+			} else {
+				flushAll(dests, store, budget, limits, now, join)
+			}
+
 			removeExpired(dests, store, cacheTimeout, now)
+			skew.Report()
+
+		case <-budget.C():
+			// Memory was released, the pressure is checked again at the top
+			// of the loop.
+
+		case <-released:
+			// A full stream queue has room again, checked at the top of the
+			// loop as well.
+
+		case newConfig := <-configC:
+			config = reloadConfig(config, newConfig, explicit)
+
+			log.SetLevel(log.Level(level))
+			limits.MaxCount = maxCount
+			limits.MaxBytes = maxBytes
+			limits.MaxTime = flushTimeout
+			limits.GroupWindow = groupWindow
+			heartbeat.Interval = heartbeatInterval
+			skew.Configure(skewThreshold, skewInterval)
+
+			if newInterval := setLatencyLimit(&limits, flushTimeout, maxLatency); newInterval != interval {
+				interval = newInterval
+				ticker.Stop()
+				ticker = time.NewTicker(interval)
+			}
+
+		case err := <-configErrC:
+			log.WithError(err).Error("the configuration file was not reloaded")
 
 		case sig := <-sigchan:
+			// SIGHUP reloads the configuration file right away instead of
+			// waiting for the watcher to notice the change.
+			if sig == syscall.SIGHUP {
+				if watcher == nil {
+					log.Warn("received SIGHUP but ecs-logs has no configuration file to reload")
+				} else {
+					log.Info("reloading the configuration file")
+					watcher.Reload()
+				}
+				continue
+			}
+
+			// A second signal gives up on draining, for when the
+			// destinations are stuck and waiting for the deadline is
+			// pointless.
+			if deadline != nil {
+				log.WithFields(log.Fields{"signal": sig.String()}).Warn("exiting without draining the messages")
+				return
+			}
+
 			log.WithFields(log.Fields{"signal": sig.String()}).Info("closing message readers")
+			deadline = make(chan time.Time)
+
+			if shutdownTimeout > 0 {
+				deadline = time.After(shutdownTimeout)
+			}
+
 			stopReaders(readers)
+
+			// Everything buffered is flushed now instead of waiting for
+			// the readers to be done, so the drain isn't delayed by a
+			// slow source.
+			flushAll(dests, store, budget, forced(limits), time.Now(), join)
+
+		case <-deadline:
+			log.WithField("timeout", shutdownTimeout).Warn("exiting before the message readers were closed, the shutdown timeout expired")
+			return
+		}
+	}
+}
+
+// setLatencyLimit sets the maximum latency of streams in limits and returns how
+// often they must be checked. Quiet streams are only flushed by the ticker, a
+// batch may wait up to one interval after reaching the limit so it's taken out
+// of the latency to deliver messages within maxLatency.
+func setLatencyLimit(limits *lib.StreamLimits, flushTimeout time.Duration, maxLatency time.Duration) (interval time.Duration) {
+	interval = flushTimeout / 2
+	limits.MaxLatency = 0
+
+	if maxLatency > 0 {
+		if interval > (maxLatency / 4) {
+			interval = maxLatency / 4
+		}
+		limits.MaxLatency = maxLatency - interval
+	}
+
+	return
+}
+
+// commandLineFlags returns the names of the flags that were passed on the
+// command line. It must be called before any flag is set from the
+// configuration, flag.Visit reports those as well.
+func commandLineFlags() map[string]bool {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	return explicit
+}
+
+// setFlagsFromConfig sets the command line flags that weren't explicitly passed
+// to the program, the ones missing from explicit, from the values found in the
+// configuration.
+func setFlagsFromConfig(config lib.Config, explicit map[string]bool) {
+	values := map[string]string{
+		"src":               strings.Join(config.Sources, ","),
+		"dst":               strings.Join(config.Destinations, ","),
+		"stages":            strings.Join(config.Stages, ","),
+		"log-level":         config.LogLevel,
+		"empty-names":       config.EmptyNames,
+		"default-group":     config.DefaultGroup,
+		"default-stream":    config.DefaultStream,
+		"dead-letter-group": config.DeadLetterGroup,
+		"timestamp":         config.Timestamp,
+		"message-ids":       config.MessageIDs,
+
+		"heartbeat-group":        config.HeartbeatGroup,
+		"heartbeat-destinations": strings.Join(config.HeartbeatDests, ","),
+		"source-field":           config.SourceField,
+		"audit-file":             config.AuditFile,
+		"audit-chain":            config.AuditChain,
+		"dead-letter-sink":       config.DeadLetterSink,
+		"atomic-destinations":    strings.Join(config.AtomicDests, ","),
+		"fast-path":              config.FastPath,
+		"fast-destination":       config.FastDest,
+		"routes":                 strings.Join(config.Routes, ";"),
+	}
+
+	if config.MaxBatchBytes != 0 {
+		values["max-batch-bytes"] = strconv.Itoa(config.MaxBatchBytes)
+	}
+
+	if config.MaxBatchSize != 0 {
+		values["max-batch-size"] = strconv.Itoa(config.MaxBatchSize)
+	}
+
+	if config.FlushTimeout != 0 {
+		values["flush-timeout"] = config.FlushTimeout.String()
+	}
+
+	if config.MaxLatency != 0 {
+		values["max-latency"] = config.MaxLatency.String()
+	}
+
+	if config.GroupWindow != 0 {
+		values["group-window"] = config.GroupWindow.String()
+	}
+
+	if config.CacheTimeout != 0 {
+		values["cache-timeout"] = config.CacheTimeout.String()
+	}
+
+	if config.MemoryBudget != 0 {
+		values["memory-budget"] = strconv.Itoa(config.MemoryBudget)
+	}
+
+	if config.Heartbeat != 0 {
+		values["heartbeat-interval"] = config.Heartbeat.String()
+	}
+
+	if config.SkewThreshold != 0 {
+		values["clock-skew-threshold"] = config.SkewThreshold.String()
+	}
+
+	if config.SkewInterval != 0 {
+		values["clock-skew-interval"] = config.SkewInterval.String()
+	}
+
+	if config.AtomicAttempts != 0 {
+		values["atomic-attempts"] = strconv.Itoa(config.AtomicAttempts)
+	}
+
+	if config.AtomicBackoff != 0 {
+		values["atomic-backoff"] = config.AtomicBackoff.String()
+	}
+
+	if config.ShutdownTimeout != 0 {
+		values["shutdown-timeout"] = config.ShutdownTimeout.String()
+	}
+
+	for name, value := range values {
+		if !explicit[name] && len(value) != 0 {
+			flag.Set(name, value)
+		}
+	}
+}
+
+// reloadConfig applies the changes from oldConfig to newConfig that can be made
+// at runtime and returns the configuration now in effect. Changes that require
+// a restart are logged and left out, as well as the flags in explicit that
+// were passed on the command line.
+func reloadConfig(oldConfig lib.Config, newConfig lib.Config, explicit map[string]bool) lib.Config {
+	var applied []string
+	var ignored []string
+
+	for _, change := range oldConfig.Changes(newConfig) {
+		if change.Restart {
+			ignored = append(ignored, change.Field)
+		} else {
+			applied = append(applied, change.Field)
 		}
 	}
+
+	if len(ignored) != 0 {
+		log.WithField("fields", strings.Join(ignored, ", ")).Warn("some configuration changes require a restart of ecs-logs to take effect")
+	}
+
+	// The sources, destinations, stages, the handling of empty names, the
+	// timestamp policy, the message IDs, the routing of heartbeats, the
+	// memory budget, the source tags, the audit log, the dead-letter sink, the
+	// atomic delivery, the fast path and the routes are only set when the
+	// program starts.
+	newConfig.Sources = oldConfig.Sources
+	newConfig.Destinations = oldConfig.Destinations
+	newConfig.Stages = oldConfig.Stages
+	newConfig.EmptyNames = oldConfig.EmptyNames
+	newConfig.DefaultGroup = oldConfig.DefaultGroup
+	newConfig.DefaultStream = oldConfig.DefaultStream
+	newConfig.DeadLetterGroup = oldConfig.DeadLetterGroup
+	newConfig.Timestamp = oldConfig.Timestamp
+	newConfig.MessageIDs = oldConfig.MessageIDs
+	newConfig.HeartbeatGroup = oldConfig.HeartbeatGroup
+	newConfig.HeartbeatDests = oldConfig.HeartbeatDests
+	newConfig.MemoryBudget = oldConfig.MemoryBudget
+	newConfig.SourceField = oldConfig.SourceField
+	newConfig.AuditFile = oldConfig.AuditFile
+	newConfig.AuditChain = oldConfig.AuditChain
+	newConfig.DeadLetterSink = oldConfig.DeadLetterSink
+	newConfig.AtomicDests = oldConfig.AtomicDests
+	newConfig.AtomicAttempts = oldConfig.AtomicAttempts
+	newConfig.AtomicBackoff = oldConfig.AtomicBackoff
+	newConfig.FastPath = oldConfig.FastPath
+	newConfig.FastDest = oldConfig.FastDest
+	newConfig.Routes = oldConfig.Routes
+
+	lib.SetConfigEnv(newConfig.Environment())
+	setFlagsFromConfig(newConfig, explicit)
+
+	if len(applied) != 0 {
+		log.WithField("fields", strings.Join(applied, ", ")).Info("configuration reloaded")
+	}
+
+	return newConfig
 }
 
 func getSources(names []string) (sources []source) {
@@ -211,123 +843,525 @@ func getDestinations(names []string) (destinations []destination) {
 	return
 }
 
-func openSources(sources []source) (readers []reader, err error) {
-	readers = make([]reader, 0, len(sources))
-
-	for _, source := range sources {
-		if r, e := source.Open(); e != nil {
-			log.WithFields(log.Fields{
-				"source": source.name,
-				"error":  e,
-			}).Error("failed to open log source")
-		} else {
-			readers = append(readers, reader{
-				Reader: r,
-				name:   source.name,
-			})
-		}
-	}
-
-	if len(readers) == 0 {
-		err = fmt.Errorf("no sources to read from")
+// openDeadLetterSink opens the -dead-letter-sink s. In dry-run mode, when
+// dryRun isn't nil, the dead letters bound to a destination are printed to the
+// dry-run output like the batches instead.
+func openDeadLetterSink(s string, group string, dryRun *lib.DryRunOutput) (lib.DeadLetterSink, error) {
+	if name := strings.TrimSpace(s); dryRun != nil && lib.GetDestination(name) != nil {
+		return lib.NewDestinationDeadLetterSink(lib.NewDryRunDestination(name, dryRun), group), nil
 	}
-
-	return
-}
-
-func setupSignals(sigchan chan<- os.Signal) {
-	signal.Notify(sigchan, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	return lib.OpenDeadLetterSink(s, group)
 }
 
-func startReaders(readers []reader, msgchan chan<- lib.Message, counter *int32, hostname string) {
-	for _, reader := range readers {
-		go read(reader, msgchan, counter, hostname)
+// warmUpDestinations warms up the destinations which know how to, unless
+// ecs-logs runs in dry-run mode and doesn't write to them.
+func warmUpDestinations(dests []destination, dryRun bool) error {
+	if dryRun {
+		return nil
 	}
-}
 
-func stopReaders(readers []reader) {
-	for _, reader := range readers {
-		reader.Close()
+	// The destinations were wrapped with the per-destination options, the
+	// registered ones are the ones that know how to warm up.
+	for _, d := range dests {
+		if err := lib.WarmUp(d.name, lib.GetDestination(d.name)); err != nil {
+			return err
+		}
 	}
-}
 
-func term(c chan<- lib.Message, counter *int32) {
-	if atomic.AddInt32(counter, -1) == 0 {
-		close(c)
-	}
+	return nil
 }
 
-func read(r reader, c chan<- lib.Message, counter *int32, hostname string) {
-	defer term(c, counter)
-	for {
-		var msg lib.Message
-		var err error
-
-		if msg, err = r.ReadMessage(); err != nil {
-			if err == io.EOF {
-				log.WithFields(log.Fields{
-					"reader": r.name,
-				}).Info("the message reader was closed")
-			} else {
-				log.WithFields(log.Fields{
-					"reader": r.name,
-					"error":  err,
-				}).Error("the message reader failed")
-			}
+// wrapDestinations applies the per-destination options, which are read from
+// environment variables prefixed with the uppercased destination name. The
+// batches delivered are recorded in audit when it isn't nil, and the messages
+// rejected by the destinations are written to deadLetters.
+func wrapDestinations(dests []destination, deadLetterGroup string, deadLetters lib.DeadLetterSink, audit *lib.AuditLog, maxCount int, maxBytes int) (err error) {
+	for i, dest := range dests {
+		prefix := strings.ToUpper(dest.name) + "_"
+		var newlines lib.NewlinePolicy
+
+		if newlines, err = lib.ParseNewlinePolicy(lib.Getenv(prefix + "NEWLINES")); err != nil {
+			err = fmt.Errorf("%sNEWLINES: %s", prefix, err)
 			return
 		}
 
-		if len(msg.Group) == 0 {
-			log.WithFields(log.Fields{
-				"reader":  r.name,
-				"missing": "group",
-			}).Warn("dropping message because the a required field wasn't set")
-			continue
-		}
+		var fieldNewlines lib.FieldNewlines
 
-		if len(msg.Stream) == 0 {
-			log.WithFields(log.Fields{
-				"reader":  r.name,
-				"missing": "stream",
-			}).Warn("dropping message because the a required field wasn't set")
-			continue
+		if fieldNewlines, err = lib.DestinationFieldNewlines(dest.name); err != nil {
+			return
 		}
 
-		if len(msg.Event.Info.Host) == 0 {
-			msg.Event.Info.Host = hostname
+		if dests[i].ordering, err = lib.DestinationOrdering(dest.name); err != nil {
+			return
 		}
 
-		if msg.Event.Time == (time.Time{}) {
-			msg.Event.Time = time.Now()
+		dests[i].dispatcher = &lib.Dispatcher{}
+
+		if s := strings.TrimSpace(lib.Getenv(prefix + "MAX_QUEUE_AGE")); len(s) != 0 {
+			if dests[i].dispatcher.MaxQueueAge, err = time.ParseDuration(s); err != nil || dests[i].dispatcher.MaxQueueAge < 0 {
+				err = fmt.Errorf("invalid %sMAX_QUEUE_AGE, must be a positive duration: %s", prefix, s)
+				return
+			}
+		}
+
+		if s := strings.TrimSpace(lib.Getenv(prefix + "QUEUE_DEPTH")); len(s) != 0 {
+			if dests[i].dispatcher.QueueDepth, err = strconv.Atoi(s); err != nil || dests[i].dispatcher.QueueDepth < 0 {
+				err = fmt.Errorf("invalid %sQUEUE_DEPTH, must be a positive integer or zero: %s", prefix, s)
+				return
+			}
+		}
+
+		if s := strings.TrimSpace(lib.Getenv(prefix + "WORKERS")); len(s) != 0 {
+			if dests[i].dispatcher.Workers, err = strconv.Atoi(s); err != nil || dests[i].dispatcher.Workers < 0 {
+				err = fmt.Errorf("invalid %sWORKERS, must be a positive integer or zero: %s", prefix, s)
+				return
+			}
+		}
+
+		var oversize lib.Oversize
+
+		if oversize, err = lib.DestinationOversize(dest.name, deadLetterGroup); err != nil {
+			return
+		}
+
+		var quarantine lib.Quarantine
+
+		if quarantine, err = lib.DestinationQuarantine(dest.name, deadLetterGroup); err != nil {
+			return
+		}
+
+		var pause lib.Pause
+
+		if pause, err = lib.DestinationPause(dest.name); err != nil {
+			return
+		}
+
+		var raw bool
+
+		if raw, err = lib.DestinationRawPassthrough(dest.name); err != nil {
+			return
+		} else if raw {
+			lib.EnableRawLines()
+		}
+
+		var latency bool
+
+		if latency, err = lib.DestinationPipelineLatency(dest.name); err != nil {
+			return
+		}
+
+		var shadow lib.Shadow
+
+		if shadow, err = lib.DestinationShadow(dest.name); err != nil {
+			return
+		}
+
+		var redaction lib.RedactionAudit
+
+		if redaction, err = lib.DestinationRedactionAudit(dest.name, deadLetterGroup); err != nil {
+			return
+		}
+
+		var spill spool.Spill
+
+		if spill, err = spool.DestinationSpill(dest.name); err != nil {
+			return
+		}
+
+		spill.MaxBatchCount, spill.MaxBatchBytes = maxCount, maxBytes
+
+		// The wrappers are applied from the innermost to the outermost.
+		wrapped := dest.Destination
+
+		// The messages rejected by the destination go to the dead-letter sink.
+		wrapped = lib.NewDeadLetterDestination(dest.name, wrapped, deadLetters, metrics.Default)
+
+		// The batches are recorded in the audit log once they're accepted.
+		wrapped = lib.NewAuditDestination(dest.name, wrapped, audit)
+
+		// A sample of the messages is scanned for unredacted values.
+		wrapped = lib.NewRedactionAuditDestination(dest.name, wrapped, redaction, metrics.Default)
+
+		// The messages get their pipeline latency right before being written.
+		wrapped = lib.NewLatencyDestination(wrapped, latency)
+
+		// The newlines of the data fields and of the messages are handled.
+		wrapped = lib.NewFieldNewlineDestination(wrapped, fieldNewlines)
+		wrapped = lib.NewNewlineDestination(wrapped, newlines)
+
+		// The oversized messages are truncated, split or dead-lettered.
+		wrapped = lib.NewOversizeDestination(wrapped, oversize)
+
+		// The batches that keep failing are dead-lettered as poison batches.
+		wrapped = lib.NewQuarantineDestination(dest.name, wrapped, quarantine, metrics.Default, clock.System)
+
+		// The messages are counted as delivered once they reached the
+		// destination.
+		wrapped = lib.NewMeteredDestination(dest.name, wrapped, metrics.Default)
+
+		// The failed batches are spilled to disk, the replayed ones go through
+		// the metered wrapper.
+		if wrapped, err = spool.NewSpillDestination(dest.name, wrapped, spill, metrics.Default, clock.System); err != nil {
+			return
+		}
+
+		// The shadow wrapper sits outside of the metered one so only the
+		// mirrored messages are counted as delivered.
+		wrapped = lib.NewShadowDestination(dest.name, wrapped, shadow, metrics.Default)
+
+		// The batches are buffered while the destination is paused.
+		dests[i].pausable = lib.NewPausableDestination(dest.name, wrapped, pause, metrics.Default)
+		dests[i].Destination = dests[i].pausable
+		dests[i].deadLetters = deadLetters
+	}
+	return
+}
+
+func getStages(names []string) (stages []stage) {
+	for _, name := range names {
+		if stg := lib.GetStage(name); stg != nil {
+			stages = append(stages, stage{
+				Stage: stg,
+				name:  name,
+			})
+		} else {
+			log.WithFields(log.Fields{"stage": name}).Warn("stage disabled")
+		}
+	}
+	return
+}
+
+// checkConfig validates the configuration and the order of the stages and the
+// configuration of the destinations, the errors are returned as a single
+// lib.ErrorList so all the problems can be reported at once.
+func checkConfig(stages []stage, dests []destination) error {
+	var errs lib.ErrorList
+
+	names := make([]string, 0, len(stages))
+
+	for _, s := range stages {
+		names = append(names, s.name)
+
+		if err := lib.CheckConfig("stage", s.name, s.Stage); err != nil {
+			errs = append(errs, err.(lib.ErrorList)...)
+		}
+	}
+
+	if err := lib.CheckStageOrder(names); err != nil {
+		errs = append(errs, err.(lib.ErrorList)...)
+	}
+
+	// The destinations were wrapped with the per-destination options, the
+	// registered ones are the ones implementing lib.ConfigChecker.
+	for _, d := range dests {
+		if err := lib.CheckConfig("destination", d.name, lib.GetDestination(d.name)); err != nil {
+			errs = append(errs, err.(lib.ErrorList)...)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return errs
+}
+
+func openStages(stages []stage) (pipeline lib.Pipeline, err error) {
+	pipeline = make(lib.Pipeline, 0, len(stages))
+
+	for _, stage := range stages {
+		var proc lib.Processor
+
+		if proc, err = stage.Open(); err != nil {
+			err = fmt.Errorf("%s: %s", stage.name, err)
+			return
+		}
+
+		pipeline = append(pipeline, proc)
+	}
+
+	return
+}
+
+// openSources opens the readers of the sources, their messages are tagged with
+// the name of the source in the field data field.
+func openSources(sources []source, field string) (readers []reader, err error) {
+	readers = make([]reader, 0, len(sources))
+
+	for _, source := range sources {
+		var policy lib.Reconnect
+
+		if policy, err = lib.SourceReconnect(source.name); err != nil {
+			return
+		}
+
+		if r, e := lib.NewReconnectingReader(source.name, source.Source, policy, metrics.Default, health, clock.System); e != nil {
+			log.WithFields(log.Fields{
+				"source": source.name,
+				"error":  e,
+			}).Error("failed to open log source")
+		} else {
+			readers = append(readers, reader{
+				Reader: lib.NewTaggedReader(source.name, field, r, metrics.Default),
+				name:   source.name,
+			})
+		}
+	}
+
+	if len(readers) == 0 {
+		err = fmt.Errorf("no sources to read from")
+	}
+
+	return
+}
+
+func setupSignals(sigchan chan<- os.Signal) {
+	signal.Notify(sigchan, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+}
+
+// drain waits for the batches being written and for the paused destinations,
+// then closes the streams of the destinations so the ones buffering messages
+// write them, closes the dead-letter sink, and commits the checkpoints of the
+// sources once the destinations acknowledged the messages. It gives up and
+// returns false when deadline expires first, a nil deadline never does.
+func drain(dests []destination, store *lib.Store, readers []reader, deadLetters lib.DeadLetterSink, join *sync.WaitGroup, deadline <-chan time.Time) bool {
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		join.Wait()
+
+		for _, d := range dests {
+			d.pausable.Wait()
+
+			if n := d.pausable.Buffered(); n != 0 {
+				log.WithFields(log.Fields{
+					"destination": d.name,
+					"count":       n,
+				}).Warn("exiting with messages buffered by a paused destination")
+			}
+		}
+
+		store.ForEach(func(group *lib.Group) {
+			group.ForEach(func(stream *lib.Stream) {
+				for _, d := range dests {
+					d.Close(stream.Group(), stream.Name())
+				}
+			})
+		})
+
+		// Closed once the streams were, their last writes may have rejected
+		// messages.
+		if deadLetters != nil {
+			if err := deadLetters.Close(); err != nil {
+				log.WithError(err).Error("failed to close the dead-letter sink")
+			}
+		}
+
+		for _, r := range readers {
+			if err := lib.Commit(r.name, r.Reader); err != nil {
+				log.WithError(err).Error("failed to commit the checkpoint of the source")
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-deadline:
+		return false
+	}
+}
+
+func startReaders(readers []reader, msgchan chan<- lib.Message, counter *int32, hostname string, names lib.EmptyNames, timestamps lib.TimestampPolicy, ids *lib.MessageIDGenerator, skew *lib.SkewMonitor) {
+	for _, reader := range readers {
+		go read(reader, msgchan, counter, hostname, names, timestamps, ids, skew)
+	}
+}
+
+func stopReaders(readers []reader) {
+	for _, reader := range readers {
+		reader.Close()
+	}
+}
+
+func term(c chan<- lib.Message, counter *int32) {
+	if atomic.AddInt32(counter, -1) == 0 {
+		close(c)
+	}
+}
+
+func read(r reader, c chan<- lib.Message, counter *int32, hostname string, names lib.EmptyNames, timestamps lib.TimestampPolicy, ids *lib.MessageIDGenerator, skew *lib.SkewMonitor) {
+	defer term(c, counter)
+	for {
+		var msg lib.Message
+		var err error
+
+		if msg, err = r.ReadMessage(); err != nil {
+			if err == io.EOF {
+				log.WithFields(log.Fields{
+					"reader": r.name,
+				}).Info("the message reader was closed")
+			} else if _, ok := err.(*lib.ReconnectError); ok {
+				log.WithFields(log.Fields{
+					"reader": r.name,
+					"error":  err,
+				}).Fatal("the message reader gave up reconnecting")
+			} else {
+				log.WithFields(log.Fields{
+					"reader": r.name,
+					"error":  err,
+				}).Error("the message reader failed")
+			}
+			return
+		}
+
+		res, missing, ok := names.Resolve(msg, r.name, hostname)
+
+		if !ok {
+			log.WithFields(log.Fields{
+				"reader":  r.name,
+				"missing": missing,
+			}).Warn("dropping message because a required field wasn't set")
+			lib.AcknowledgeBatch(lib.MessageBatch{msg})
+			continue
+		}
+
+		msg = res
+
+		if len(msg.Event.Info.Host) == 0 {
+			msg.Event.Info.Host = hostname
+		}
+
+		msg.Received = time.Now()
+
+		// The skew is measured on the time the message carries, before the
+		// timestamp policy possibly replaces it.
+		skew.Observe(r.name, msg)
+
+		if !timestamps.Apply(&msg, time.Now()) {
+			log.WithFields(log.Fields{
+				"reader": r.name,
+				"group":  msg.Group,
+				"stream": msg.Stream,
+			}).Warn("dropping message because it has no timestamp and -timestamp=parsed")
+			lib.AcknowledgeBatch(lib.MessageBatch{msg})
+			continue
 		}
 
 		if msg.Event.Data == nil {
 			msg.Event.Data = ecslogs.EventData{}
 		}
 
+		ids.Assign(&msg)
 		c <- msg
 	}
 }
 
-func write(dest destination, group, stream string, batch lib.MessageBatch, join *sync.WaitGroup) {
+func write(dest destination, group, stream string, batch lib.MessageBatch, urgent bool, join *sync.WaitGroup) {
 	defer join.Done()
 
 	var writer lib.Writer
 	var err error
 
 	if writer, err = dest.Open(group, stream); err != nil {
+		reportWrite(dest.name, err)
 		logDropBatch(dest.name, group, stream, err, batch)
 		return
 	}
 	defer writer.Close()
 
-	if err = writer.WriteMessageBatch(batch); err != nil {
+	metrics.Default.Histogram("batch_messages", batchBuckets, "destination", dest.name).Observe(float64(len(batch)))
+
+	if urgent {
+		_, err = lib.WriteUrgentMessageBatch(writer, batch)
+	} else {
+		err = writer.WriteMessageBatch(batch)
+	}
+
+	if reportWrite(dest.name, err); err != nil {
+		logDropBatch(dest.name, group, stream, err, batch)
+	} else {
+		lib.AcknowledgeBatch(batch)
+	}
+}
+
+// reportWrite records the result of writing a batch to the destination name,
+// the failures are counted by its write_errors metric.
+func reportWrite(name string, err error) {
+	if err != nil {
+		metrics.Default.Counter("write_errors", "destination", name).Add(1)
+		health.Failed(name, err)
+	} else {
+		health.Delivered(name)
+	}
+}
+
+// health is the state of the sources and destinations served on /healthz and
+// /readyz, its window is set by -health-window.
+var health = lib.NewHealth(5*time.Minute, clock.System)
+
+// The upper bounds of the buckets of the batch_messages histograms, up to the
+// default -max-batch-size.
+var batchBuckets = []float64{1, 10, 50, 100, 500, 1000, 5000, 10000}
+
+// writeAtomic writes batch to all the destinations of set, the batch is
+// dropped by the ones that failed it if they didn't all accept it in the same
+// attempt. The others have it already, the source is rewound so it's read
+// again after a restart.
+func writeAtomic(set *atomicSet, group, stream string, batch lib.MessageBatch, urgent bool, join *sync.WaitGroup) {
+	defer join.Done()
+
+	err := set.Write(set.targets, group, stream, batch, urgent)
+	e, _ := err.(*lib.AtomicError)
+
+	// The batch is only acknowledged once all the destinations have it.
+	if err == nil {
+		defer lib.AcknowledgeBatch(batch)
+	}
+
+	for _, target := range set.targets {
+		if e != nil && e.Errors[target.Name] != nil {
+			reportWrite(target.Name, e.Errors[target.Name])
+			logDropBatch(target.Name, group, stream, e.Errors[target.Name], batch)
+		} else {
+			reportWrite(target.Name, nil)
+		}
+	}
+}
+
+// expire dead-letters a batch that waited in the queue of its stream for
+// longer than the maximum queue age of the destination, with its age as the
+// reason. The batch is dropped when there's no dead-letter sink or the sink
+// failed to write it.
+func expire(dest destination, group, stream string, batch lib.MessageBatch, age time.Duration, join *sync.WaitGroup) {
+	defer join.Done()
+
+	metrics.Default.Counter("expired_messages", "group", group, "stream", stream, "destination", dest.name).Add(int64(len(batch)))
+	err := fmt.Errorf("the batch waited %s in the queue of the stream, more than the maximum of %s", age, dest.dispatcher.MaxQueueAge)
+
+	if dest.deadLetters == nil {
 		logDropBatch(dest.name, group, stream, err, batch)
 		return
 	}
+
+	deadLetters := make(lib.MessageBatch, len(batch))
+
+	for i, msg := range batch {
+		deadLetters[i] = lib.DeadLetterMessage(msg, dest.name, err.Error(), nil)
+	}
+
+	if e := dest.deadLetters.WriteDeadLetters(deadLetters); e != nil {
+		logDropBatch(dest.name, group, stream, lib.AppendError(err, e), batch)
+		return
+	}
+
+	metrics.Default.Counter("dead_lettered_messages", "destination", dest.name).Add(int64(len(batch)))
+	lib.LogMessages(deadLetters, "dead-lettered", log.Fields{"destination": dest.name})
+	lib.AcknowledgeBatch(batch)
 }
 
-func flush(dests []destination, stream *lib.Stream, limits lib.StreamLimits, now time.Time, join *sync.WaitGroup) {
+func flush(dests []destination, stream *lib.Stream, budget *lib.MemoryBudget, limits lib.StreamLimits, now time.Time, join *sync.WaitGroup) {
 	for {
 		batch, reason := stream.Flush(limits, now)
 
@@ -335,42 +1369,113 @@ func flush(dests []destination, stream *lib.Stream, limits lib.StreamLimits, now
 			break
 		}
 
-		// Ensure all messages in the batch are sorted. Checking if the batch is
-		// sorted is an optimization since in most cases the batch will be sorted
-		// because we're reading events that are generated live (checking for a
-		// sorted list is O(N) vs O(N*log(N)) for sorting it).
-		// There are cases where some log entries do appear unordered and this is
-		// causing issues with CloudWatchLogs.
-		if !sort.IsSorted(batch) {
-			sort.Stable(batch)
+		dispatch(dests, stream, batch, reason, budget, join)
+	}
+}
+
+func dispatch(dests []destination, stream *lib.Stream, batch lib.MessageBatch, reason string, budget *lib.MemoryBudget, join *sync.WaitGroup) {
+	// Ensure all messages in the batch are sorted. Checking if the batch is
+	// sorted is an optimization since in most cases the batch will be sorted
+	// because we're reading events that are generated live (checking for a
+	// sorted list is O(N) vs O(N*log(N)) for sorting it).
+	// There are cases where some log entries do appear unordered and this is
+	// causing issues with CloudWatchLogs.
+	if !sort.IsSorted(batch) {
+		sort.Stable(batch)
+	}
+
+	log.WithFields(log.Fields{
+		"group":  stream.Group(),
+		"stream": stream.Name(),
+		"count":  len(batch),
+		"reason": reason,
+	}).Info("flushing message batch")
+
+	// Batches that reached the maximum latency are delivered ahead of the
+	// others when destinations are being rate limited.
+	urgent := reason == lib.MaxLatencyExceeded
+
+	group, name := stream.Group(), stream.Name()
+	count := 0
+
+	// The -atomic-destinations are written to by a single job, queued to the
+	// dispatcher of the first one.
+	skip := func(dest destination) bool {
+		return group == dest.skipGroup || (dest.atomic != nil && dest.atomic.leader != dest.name)
+	}
+
+	// The -fast-destination already received the messages of the fast path,
+	// its batch has the other ones, and the -routes leave out the messages
+	// that aren't written to each destination.
+	batches := make([]lib.MessageBatch, len(dests))
+
+	for i, dest := range dests {
+		if batches[i] = dest.router.Batch(dest.name, batch); dest.fast != nil {
+			batches[i] = dest.fast.Batch(batches[i])
+		}
+
+		if !skip(dest) && len(batches[i]) != 0 {
+			count++
 		}
+	}
 
-		log.WithFields(log.Fields{
-			"group":  stream.Group(),
-			"stream": stream.Name(),
-			"count":  len(batch),
-			"reason": reason,
-		}).Info("flushing message batch")
+	// The memory of the batch is released once it was written to, or
+	// dropped by, all the destinations.
+	release := budget.Hold(batchBytes(batch), count)
 
-		for _, dest := range dests {
-			join.Add(1)
-			go write(dest, stream.Group(), stream.Name(), batch, join)
+	for i, dest := range dests {
+		if skip(dest) || len(batches[i]) == 0 {
+			continue
+		}
+
+		dest, batch := dest, batches[i]
+		lib.RetainBatch(batch)
+		join.Add(1)
+		dest.dispatcher.Dispatch(dest.ordering, group+":"+name, func() {
+			defer release()
+
+			if dest.atomic != nil {
+				writeAtomic(dest.atomic, group, name, batch, urgent, join)
+			} else {
+				write(dest, group, name, batch, urgent, join)
+			}
+		}, func(age time.Duration) {
+			defer release()
+			expire(dest, group, name, batch, age, join)
+		})
+	}
+
+	// Each destination holds the messages it was routed to now, the hold of
+	// the stream is released.
+	lib.AcknowledgeBatch(batch)
+}
+
+// saturated returns the name of the first destination whose dispatcher has a
+// full stream queue, or an empty string.
+func saturated(dests []destination) string {
+	for _, d := range dests {
+		if d.dispatcher.Saturated() {
+			return d.name
 		}
 	}
+	return ""
 }
 
-func flushAll(dests []destination, store *lib.Store, limits lib.StreamLimits, now time.Time, join *sync.WaitGroup) {
+// flushAll flushes the streams of each group in the order picked by the group,
+// which also decides when they're flushed together with -group-window.
+func flushAll(dests []destination, store *lib.Store, budget *lib.MemoryBudget, limits lib.StreamLimits, now time.Time, join *sync.WaitGroup) {
 	store.ForEach(func(group *lib.Group) {
-		group.ForEach(func(stream *lib.Stream) {
-			flush(dests, stream, limits, now, join)
-		})
+		for _, b := range group.Flush(limits, now) {
+			dispatch(dests, b.Stream, b.Batch, b.Reason, budget, join)
+		}
 	})
 }
 
-func flushQueue(dests []destination, store *lib.Store, queue *lib.MessageQueue, limits lib.StreamLimits, now time.Time, join *sync.WaitGroup) {
+func flushQueue(dests []destination, store *lib.Store, queue *lib.MessageQueue, budget *lib.MemoryBudget, limits lib.StreamLimits, now time.Time, join *sync.WaitGroup) {
 	streams := make(map[string]*lib.Stream)
 
 	for _, msg := range queue.Flush() {
+		budget.Acquire(msg.ContentLength())
 		_, stream := store.Add(msg, now)
 		key := stream.Group() + ":" + stream.Name()
 
@@ -380,8 +1485,255 @@ func flushQueue(dests []destination, store *lib.Store, queue *lib.MessageQueue,
 	}
 
 	for _, stream := range streams {
-		flush(dests, stream, limits, now, join)
+		flush(dests, stream, budget, limits, now, join)
+	}
+}
+
+func addMessages(dests []destination, store *lib.Store, history *recent.Buffer, budget *lib.MemoryBudget, msgs []lib.Message, now time.Time, join *sync.WaitGroup) {
+	for _, msg := range msgs {
+		history.Add(msg)
+		writeFast(dests, msg, join)
+		budget.Acquire(msg.ContentLength())
+		store.Add(msg, now)
+	}
+}
+
+// forced returns a copy of limits which flushes all the buffered messages.
+func forced(limits lib.StreamLimits) lib.StreamLimits {
+	limits.Force = true
+	return limits
+}
+
+func batchBytes(batch lib.MessageBatch) (n int) {
+	for _, msg := range batch {
+		n += msg.ContentLength()
 	}
+	return
+}
+
+// writeFast writes msg right away to the -fast-destination if it takes the fast
+// path, the write doesn't wait for the batch of its stream.
+func writeFast(dests []destination, msg lib.Message, join *sync.WaitGroup) {
+	for _, dest := range dests {
+		if dest.fast == nil || msg.Group == dest.skipGroup || !dest.router.Routes(dest.name, msg) {
+			continue
+		}
+
+		dest := dest
+		join.Add(1)
+		lib.RetainBatch(lib.MessageBatch{msg})
+
+		if !dest.fast.Write(msg, func(err error) {
+			defer join.Done()
+
+			if reportWrite(dest.name, err); err != nil {
+				logDropBatch(dest.name, msg.Group, msg.Stream, err, lib.MessageBatch{msg})
+			} else {
+				lib.AcknowledgeBatch(lib.MessageBatch{msg})
+			}
+		}) {
+			lib.AcknowledgeBatch(lib.MessageBatch{msg})
+			join.Done()
+		}
+	}
+}
+
+// routeHeartbeats keeps the heartbeat messages out of the destinations that
+// aren't listed in names, a comma separated list of destinations which sends
+// them to all of them when it's empty.
+func routeHeartbeats(dests []destination, group string, names string) error {
+	if len(strings.TrimSpace(names)) == 0 {
+		return nil
+	}
+
+	routed := make(map[string]bool)
+
+	for _, name := range strings.Split(names, ",") {
+		routed[strings.TrimSpace(name)] = true
+	}
+
+	for i := range dests {
+		if routed[dests[i].name] {
+			delete(routed, dests[i].name)
+		} else {
+			dests[i].skipGroup = group
+		}
+	}
+
+	for name := range routed {
+		return fmt.Errorf("%s is not one of the destinations", name)
+	}
+
+	return nil
+}
+
+// groupAtomic makes the destinations listed in names, a comma separated list,
+// receive their batches through delivery. It does nothing when names is empty.
+func groupAtomic(dests []destination, names string, delivery *lib.AtomicDelivery) error {
+	if len(strings.TrimSpace(names)) == 0 {
+		return nil
+	}
+
+	listed := make(map[string]bool)
+
+	for _, name := range strings.Split(names, ",") {
+		listed[strings.TrimSpace(name)] = true
+	}
+
+	set := &atomicSet{AtomicDelivery: delivery}
+	var members []int
+
+	for i := range dests {
+		if listed[dests[i].name] {
+			delete(listed, dests[i].name)
+			members = append(members, i)
+			set.targets = append(set.targets, lib.AtomicTarget{Name: dests[i].name, Destination: dests[i].Destination})
+		}
+	}
+
+	for name := range listed {
+		return fmt.Errorf("%s is not one of the destinations", name)
+	}
+
+	if len(members) < 2 {
+		return fmt.Errorf("at least two destinations must be listed")
+	}
+
+	for _, i := range members {
+		// A batch is written to all the destinations of the set or none, so
+		// they must agree on the heartbeats.
+		if dests[i].skipGroup != dests[members[0]].skipGroup {
+			return fmt.Errorf("the heartbeats must be written to all of them or none")
+		}
+
+		dests[i].atomic = set
+	}
+
+	set.leader = dests[members[0]].name
+	return nil
+}
+
+// routeFastPath makes the destination called name receive the messages matching
+// the predicates of path as soon as they're read, it does nothing when both are
+// empty.
+func routeFastPath(dests []destination, name string, path string) error {
+	var p lib.FastPath
+	var err error
+
+	if name = strings.TrimSpace(name); len(name) == 0 && len(strings.TrimSpace(path)) == 0 {
+		return nil
+	}
+
+	if p, err = lib.ParseFastPath(path); err != nil {
+		return err
+	}
+
+	if !p.Enabled() || len(name) == 0 {
+		return fmt.Errorf("both the fast path and its destination must be set")
+	}
+
+	for i := range dests {
+		if dests[i].name != name {
+			continue
+		}
+
+		// The atomic destinations receive the same batches, they can't be
+		// written to on their own.
+		if dests[i].atomic != nil {
+			return fmt.Errorf("%s is one of the -atomic-destinations", name)
+		}
+
+		dests[i].fast = lib.NewFastLane(name, dests[i].Destination, p, metrics.Default)
+		return nil
+	}
+
+	return fmt.Errorf("%s is not one of the destinations", name)
+}
+
+// routeMessages makes the destinations receive the messages picked for them by
+// the rules of routes, all the messages are written to all the destinations
+// when it's empty. Only the messages matching filter are written when it's
+// not empty.
+func routeMessages(dests []destination, routes string, filter string) error {
+	r, err := lib.ParseRoutes(routes)
+
+	if err != nil {
+		return err
+	}
+
+	var f []lib.RoutePredicate
+
+	if f, err = lib.ParseFilter(filter); err != nil {
+		return err
+	}
+
+	if len(f) != 0 {
+		if r == nil {
+			r = &lib.Router{}
+		}
+		r.Filter = f
+	}
+
+	if r == nil {
+		return nil
+	}
+
+	names := make([]string, len(dests))
+
+	for i := range dests {
+		names[i] = dests[i].name
+	}
+
+	if err = r.Check(names); err != nil {
+		return err
+	}
+
+	for _, rule := range r.Rules {
+		listed := make(map[string]bool)
+
+		for _, name := range rule.Destinations {
+			listed[name] = true
+		}
+
+		// The atomic destinations are written to with the batches of the
+		// first one, each rule must route to all of them or none.
+		for i := range dests {
+			if set := dests[i].atomic; set != nil && listed[dests[i].name] != listed[set.leader] {
+				return fmt.Errorf("the routes must write to all the -atomic-destinations or none")
+			}
+		}
+	}
+
+	for i := range dests {
+		dests[i].router = r
+	}
+
+	return nil
+}
+
+// openOutput returns the writer of the -dry-run output called name, stdout,
+// stderr or the path of a file which is created or truncated.
+func openOutput(name string) (io.Writer, error) {
+	switch name {
+	case "", "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	default:
+		return os.Create(name)
+	}
+}
+
+// backlog returns the number of messages held by ecs-logs, buffered in the
+// streams or by paused destinations.
+func backlog(dests []destination, store *lib.Store) (n int) {
+	n = store.Len()
+
+	for _, d := range dests {
+		n += d.pausable.Buffered()
+	}
+
+	return
 }
 
 func removeExpired(dests []destination, store *lib.Store, cacheTimeout time.Duration, now time.Time) {
@@ -397,19 +1749,27 @@ func removeExpired(dests []destination, store *lib.Store, cacheTimeout time.Dura
 }
 
 func logDropBatch(dest string, group string, stream string, err error, batch lib.MessageBatch) {
-	log.WithFields(log.Fields{
+	fields := log.Fields{
 		"group":       group,
 		"stream":      stream,
 		"destination": dest,
 		"error":       err,
 		"count":       len(batch),
-	}).Error("dropping message batch")
+	}
 
-	for _, msg := range batch {
-		log.WithFields(log.Fields{
-			"group":  msg.Group,
-			"stream": msg.Stream,
-			"event":  msg.Event,
-		}).Debug("dropped")
+	// The ID of a request that the destination rejected is what its support
+	// needs to look into the rejection.
+	if id := lib.RequestID(err); len(id) != 0 {
+		fields["request_id"] = id
 	}
+
+	log.WithFields(fields).Error("dropping message batch")
+
+	metrics.Default.Counter("dropped_messages", "destination", dest).Add(int64(len(batch)))
+
+	lib.LogMessages(batch, "dropped", log.Fields{"destination": dest})
+
+	// The sources that checkpoint their progress read the batch again after
+	// a restart.
+	lib.RewindBatch(batch)
 }
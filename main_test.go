@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/segmentio/ecs-logs-go"
+	"github.com/segmentio/ecs-logs/lib"
+)
+
+func TestReloadConfigFlags(t *testing.T) {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+	defer lib.SetConfigEnv(nil)
+
+	var flushTimeout time.Duration
+	var maxLatency time.Duration
+
+	flag.DurationVar(&flushTimeout, "flush-timeout", 2*time.Second, "")
+	flag.DurationVar(&maxLatency, "max-latency", 0, "")
+
+	// -max-latency was passed on the command line, -flush-timeout comes from
+	// the configuration file.
+	flag.Set("max-latency", "1m")
+	explicit := commandLineFlags()
+
+	config := lib.Config{
+		FlushTimeout: lib.Duration(time.Second),
+		MaxLatency:   lib.Duration(time.Hour),
+	}
+	setFlagsFromConfig(config, explicit)
+
+	if flushTimeout != time.Second || maxLatency != time.Minute {
+		t.Fatalf("invalid flags after loading the configuration: flush-timeout=%s max-latency=%s", flushTimeout, maxLatency)
+	}
+
+	// Each reload applies its value, the flags set by the previous ones
+	// aren't mistaken for explicit ones.
+	for _, timeout := range []time.Duration{3 * time.Second, 4 * time.Second} {
+		newConfig := config
+		newConfig.FlushTimeout = lib.Duration(timeout)
+		newConfig.MaxLatency = lib.Duration(2 * time.Hour)
+		config = reloadConfig(config, newConfig, explicit)
+
+		if flushTimeout != timeout {
+			t.Errorf("the reload should set -flush-timeout to %s: %s", timeout, flushTimeout)
+		}
+
+		if maxLatency != time.Minute {
+			t.Errorf("the reload should not override -max-latency passed on the command line: %s", maxLatency)
+		}
+	}
+}
+
+// warmDestination records whether it was written to or warmed up.
+type warmDestination struct {
+	opened   bool
+	warmedUp bool
+}
+
+func (d *warmDestination) Open(group string, stream string) (lib.Writer, error) {
+	d.opened = true
+	return nil, errors.New("the destination should not be written to")
+}
+
+func (d *warmDestination) Close(group string, stream string) {}
+
+func (d *warmDestination) WarmUp() error {
+	d.warmedUp = true
+	return nil
+}
+
+func TestDryRunDestinations(t *testing.T) {
+	dest := &warmDestination{}
+	lib.RegisterDestination("dryrun", dest)
+	defer lib.DeregisterDestination("dryrun")
+
+	var out bytes.Buffer
+
+	sink, err := openDeadLetterSink("dryrun", "dead-letters", lib.NewDryRunOutput(&out))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := lib.MessageBatch{{Group: "A", Stream: "B", Event: ecslogs.Event{Message: "rejected"}}}
+
+	if err := sink.WriteDeadLetters(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	if dest.opened || !strings.Contains(out.String(), `"rejected"`) {
+		t.Errorf("the dead letters should be printed instead of written to the destination: %q", out.String())
+	}
+
+	if err := warmUpDestinations([]destination{{name: "dryrun"}}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if dest.warmedUp {
+		t.Error("the destinations should not be warmed up in dry-run mode")
+	}
+
+	if err := warmUpDestinations([]destination{{name: "dryrun"}}, false); err != nil || !dest.warmedUp {
+		t.Errorf("the destinations should be warmed up: %v", err)
+	}
+}
+
+// testDeadLetterSink records the messages dead-lettered to it.
+type testDeadLetterSink struct {
+	messages lib.MessageBatch
+}
+
+func (s *testDeadLetterSink) WriteDeadLetters(batch lib.MessageBatch) error {
+	s.messages = append(s.messages, batch...)
+	return nil
+}
+
+func (s *testDeadLetterSink) Close() error { return nil }
+
+func TestExpireDeadLetters(t *testing.T) {
+	log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
+
+	sink := &testDeadLetterSink{}
+	dest := destination{
+		name:        "test",
+		dispatcher:  &lib.Dispatcher{MaxQueueAge: time.Minute},
+		deadLetters: sink,
+	}
+
+	batch := lib.MessageBatch{
+		{Group: "A", Stream: "B", Event: ecslogs.Event{Message: "1"}},
+		{Group: "A", Stream: "B", Event: ecslogs.Event{Message: "2"}},
+	}
+
+	join := &sync.WaitGroup{}
+	join.Add(1)
+	expire(dest, "A", "B", batch, 2*time.Minute, join)
+	join.Wait()
+
+	if len(sink.messages) != len(batch) {
+		t.Fatalf("the expired batch should be dead-lettered: %d messages", len(sink.messages))
+	}
+
+	for _, msg := range sink.messages {
+		info, _ := msg.Event.Data[lib.DeadLetterField].(ecslogs.EventData)
+
+		if reason, _ := info["reason"].(string); !strings.Contains(reason, "waited 2m0s") || info["destination"] != "test" {
+			t.Errorf("the age of the batch should be the reason it was dead-lettered: %v", info)
+		}
+	}
+}
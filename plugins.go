@@ -0,0 +1,48 @@
+package main
+
+// The sources, destinations and stages compiled into ecs-logs, they register
+// themselves when their package is initialized. Custom builds add their own
+// plugins by importing them the same way from another file of this package.
+import (
+	_ "github.com/segmentio/ecs-logs/lib/blank"
+	_ "github.com/segmentio/ecs-logs/lib/cloudwatchlogs"
+	_ "github.com/segmentio/ecs-logs/lib/coerce"
+	_ "github.com/segmentio/ecs-logs/lib/correlation"
+	_ "github.com/segmentio/ecs-logs/lib/datadog"
+	_ "github.com/segmentio/ecs-logs/lib/elasticsearch"
+	_ "github.com/segmentio/ecs-logs/lib/firehose"
+	_ "github.com/segmentio/ecs-logs/lib/fluentd"
+	_ "github.com/segmentio/ecs-logs/lib/gelf"
+	_ "github.com/segmentio/ecs-logs/lib/ingest"
+	_ "github.com/segmentio/ecs-logs/lib/kafka"
+	_ "github.com/segmentio/ecs-logs/lib/logdna"
+	_ "github.com/segmentio/ecs-logs/lib/loggly"
+	_ "github.com/segmentio/ecs-logs/lib/loki"
+	_ "github.com/segmentio/ecs-logs/lib/merge"
+	_ "github.com/segmentio/ecs-logs/lib/metadata"
+	_ "github.com/segmentio/ecs-logs/lib/mongodb"
+	_ "github.com/segmentio/ecs-logs/lib/multiline"
+	_ "github.com/segmentio/ecs-logs/lib/namespace"
+	_ "github.com/segmentio/ecs-logs/lib/otlp"
+	_ "github.com/segmentio/ecs-logs/lib/pagerduty"
+	_ "github.com/segmentio/ecs-logs/lib/parse"
+	_ "github.com/segmentio/ecs-logs/lib/pulsar"
+	_ "github.com/segmentio/ecs-logs/lib/redact"
+	_ "github.com/segmentio/ecs-logs/lib/repeat"
+	_ "github.com/segmentio/ecs-logs/lib/reserved"
+	_ "github.com/segmentio/ecs-logs/lib/s3"
+	_ "github.com/segmentio/ecs-logs/lib/sample"
+	_ "github.com/segmentio/ecs-logs/lib/schema"
+	_ "github.com/segmentio/ecs-logs/lib/split"
+	_ "github.com/segmentio/ecs-logs/lib/splunk"
+	_ "github.com/segmentio/ecs-logs/lib/sqs"
+	_ "github.com/segmentio/ecs-logs/lib/stacktrace"
+	_ "github.com/segmentio/ecs-logs/lib/statsd"
+	_ "github.com/segmentio/ecs-logs/lib/summary"
+	_ "github.com/segmentio/ecs-logs/lib/syslog"
+	_ "github.com/segmentio/ecs-logs/lib/tail"
+	_ "github.com/segmentio/ecs-logs/lib/tenant"
+	_ "github.com/segmentio/ecs-logs/lib/unixsocket"
+	_ "github.com/segmentio/ecs-logs/lib/validate"
+	_ "github.com/segmentio/ecs-logs/lib/xray"
+)